@@ -0,0 +1,243 @@
+// Package abr holds the pieces of the adaptive bitrate ladder that do not
+// depend on GStreamer: the rungs to transcode, per-rendition health tracking
+// and master playlist generation.
+package abr
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// State is the health of one rendition
+type State int
+
+const (
+	// Healthy renditions are listed in the master playlist
+	Healthy State = iota
+	// Unhealthy renditions stalled or fell behind and are being restarted
+	Unhealthy
+	// Recovering renditions were restarted and must prove themselves again
+	Recovering
+	// Failed renditions ran out of restart attempts and stay disabled
+	Failed
+)
+
+var stateNames = [...]string{"healthy", "unhealthy", "recovering", "failed"}
+
+func (s State) String() string {
+	if s < 0 || int(s) >= len(stateNames) {
+		return fmt.Sprintf("state(%d)", int(s))
+	}
+	return stateNames[s]
+}
+
+// HealthConfig bounds what counts as a healthy rendition
+type HealthConfig struct {
+	// StallTimeout is how long a rendition may go without producing a segment
+	StallTimeout time.Duration
+	// MaxQueueDepth is the encoder queue depth above which a rendition is behind
+	MaxQueueDepth int
+	// MaxRestarts bounds the restarts of a rendition before it is given up
+	MaxRestarts int
+	// RecoverySegments is the number of consecutive good segments a restarted
+	// rendition has to produce before it is listed again
+	RecoverySegments int
+}
+
+// DefaultHealthConfig suits segment durations of a few seconds
+func DefaultHealthConfig(segmentDuration time.Duration) HealthConfig {
+	return HealthConfig{
+		StallTimeout:     3 * segmentDuration,
+		MaxQueueDepth:    30,
+		MaxRestarts:      3,
+		RecoverySegments: 2,
+	}
+}
+
+// Transition is a change of health of one rendition
+type Transition struct {
+	Rendition string
+	From      State
+	To        State
+	Reason    string
+}
+
+type rendition struct {
+	state       State
+	lastSegment time.Time
+	queueDepth  int
+	good        int
+	restarts    int
+}
+
+// Health tracks the renditions of one ladder. Segment and queue reports come
+// from the branches, Check is called periodically and restarts wedged ones.
+type Health struct {
+	config  HealthConfig
+	restart func(name string) error
+	notify  func(Transition)
+
+	lock        sync.Mutex
+	renditions  map[string]*rendition
+	transitions map[State]int
+}
+
+// NewHealth returns a tracker calling restart to restart a single branch and
+// notify, if not nil, on every transition
+func NewHealth(config HealthConfig, restart func(name string) error, notify func(Transition)) *Health {
+	return &Health{
+		config:      config,
+		restart:     restart,
+		notify:      notify,
+		renditions:  map[string]*rendition{},
+		transitions: map[State]int{},
+	}
+}
+
+// Add starts tracking name as healthy
+func (h *Health) Add(name string, now time.Time) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.renditions[name] = &rendition{lastSegment: now}
+}
+
+// Segment records a segment produced by name
+func (h *Health) Segment(name string, now time.Time) {
+	h.lock.Lock()
+	r := h.renditions[name]
+	if r == nil {
+		h.lock.Unlock()
+		return
+	}
+	r.lastSegment = now
+	var transition *Transition
+	if r.state == Recovering {
+		if r.queueDepth > h.config.MaxQueueDepth {
+			r.good = 0
+		} else {
+			r.good++
+		}
+		if r.good >= h.config.RecoverySegments {
+			transition = h.setState(name, r, Healthy, fmt.Sprintf("%d good segments", r.good))
+			r.restarts = 0
+		}
+	}
+	h.lock.Unlock()
+	h.emit(transition)
+}
+
+// QueueDepth records the current encoder queue depth of name
+func (h *Health) QueueDepth(name string, depth int) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if r := h.renditions[name]; r != nil {
+		r.queueDepth = depth
+	}
+}
+
+// Check marks stalled or lagging renditions unhealthy and restarts them
+func (h *Health) Check(now time.Time) {
+	var transitions []*Transition
+	var restarts []string
+
+	h.lock.Lock()
+	for name, r := range h.renditions {
+		switch r.state {
+		case Failed:
+			continue
+		case Unhealthy:
+			// the last restart failed, try again
+			restarts = append(restarts, name)
+			continue
+		}
+		reason := ""
+		switch {
+		case now.Sub(r.lastSegment) > h.config.StallTimeout:
+			reason = fmt.Sprintf("no segment for %v", now.Sub(r.lastSegment).Round(time.Second))
+		case r.queueDepth > h.config.MaxQueueDepth:
+			reason = fmt.Sprintf("encoder queue depth %d", r.queueDepth)
+		default:
+			continue
+		}
+		if r.restarts >= h.config.MaxRestarts {
+			transitions = append(transitions, h.setState(name, r, Failed, reason+", out of restarts"))
+			continue
+		}
+		transitions = append(transitions, h.setState(name, r, Unhealthy, reason))
+		restarts = append(restarts, name)
+	}
+	h.lock.Unlock()
+
+	for _, t := range transitions {
+		h.emit(t)
+	}
+	for _, name := range restarts {
+		h.restartBranch(name, now)
+	}
+}
+
+func (h *Health) restartBranch(name string, now time.Time) {
+	err := h.restart(name)
+
+	h.lock.Lock()
+	r := h.renditions[name]
+	if r == nil || r.state != Unhealthy {
+		h.lock.Unlock()
+		return
+	}
+	r.restarts++
+	var transition *Transition
+	if err != nil {
+		// retried on the next check while restarts are left
+		if r.restarts >= h.config.MaxRestarts {
+			transition = h.setState(name, r, Failed, "restart failed: "+err.Error())
+		}
+	} else {
+		r.lastSegment = now
+		r.queueDepth = 0
+		r.good = 0
+		transition = h.setState(name, r, Recovering, "restarted")
+	}
+	h.lock.Unlock()
+	h.emit(transition)
+}
+
+func (h *Health) setState(name string, r *rendition, to State, reason string) *Transition {
+	t := &Transition{Rendition: name, From: r.state, To: to, Reason: reason}
+	r.state = to
+	h.transitions[to]++
+	return t
+}
+
+func (h *Health) emit(t *Transition) {
+	if t != nil && h.notify != nil {
+		h.notify(*t)
+	}
+}
+
+// State returns the health of name
+func (h *Health) State(name string) State {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if r := h.renditions[name]; r != nil {
+		return r.state
+	}
+	return Failed
+}
+
+// Listed reports whether name belongs in the master playlist
+func (h *Health) Listed(name string) bool {
+	return h.State(name) == Healthy
+}
+
+// Transitions counts the transitions into each state so far
+func (h *Health) Transitions() map[State]int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	counts := make(map[State]int, len(h.transitions))
+	for state, n := range h.transitions {
+		counts[state] = n
+	}
+	return counts
+}
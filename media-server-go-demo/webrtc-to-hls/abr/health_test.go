@@ -0,0 +1,112 @@
+package abr
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func testConfig() HealthConfig {
+	return HealthConfig{
+		StallTimeout:     6 * time.Second,
+		MaxQueueDepth:    10,
+		MaxRestarts:      2,
+		RecoverySegments: 2,
+	}
+}
+
+func TestHealthRestartsStalledRendition(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	var restarted []string
+	var transitions []Transition
+	h := NewHealth(testConfig(), func(name string) error {
+		restarted = append(restarted, name)
+		return nil
+	}, func(tr Transition) {
+		transitions = append(transitions, tr)
+	})
+	h.Add("720p", start)
+	h.Add("360p", start)
+
+	now := start.Add(8 * time.Second)
+	h.Segment("360p", now)
+	h.Check(now)
+
+	if len(restarted) != 1 || restarted[0] != "720p" {
+		t.Fatalf("restarted %v", restarted)
+	}
+	if h.Listed("720p") || !h.Listed("360p") {
+		t.Fatal("stalled rendition still listed")
+	}
+
+	h.Segment("720p", now.Add(2*time.Second))
+	if h.Listed("720p") {
+		t.Fatal("listed after a single good segment")
+	}
+	h.Segment("720p", now.Add(4*time.Second))
+	if !h.Listed("720p") {
+		t.Fatal("not listed after two good segments")
+	}
+
+	want := []State{Unhealthy, Recovering, Healthy}
+	if len(transitions) != len(want) {
+		t.Fatalf("transitions %+v", transitions)
+	}
+	for i, state := range want {
+		if transitions[i].To != state || transitions[i].Rendition != "720p" {
+			t.Errorf("transition %d = %+v, want %v", i, transitions[i], state)
+		}
+	}
+	if h.Transitions()[Healthy] != 1 {
+		t.Fatalf("counts %v", h.Transitions())
+	}
+}
+
+func TestHealthQueueDepth(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	h := NewHealth(testConfig(), func(string) error { return nil }, nil)
+	h.Add("720p", start)
+	h.QueueDepth("720p", 50)
+	h.Check(start.Add(time.Second))
+	if h.State("720p") != Recovering {
+		t.Fatalf("state = %v", h.State("720p"))
+	}
+}
+
+func TestHealthGivesUp(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	attempts := 0
+	h := NewHealth(testConfig(), func(string) error {
+		attempts++
+		return errors.New("encoder wedged")
+	}, nil)
+	h.Add("720p", start)
+
+	for i := 1; i <= 5; i++ {
+		h.Check(start.Add(time.Duration(i) * 10 * time.Second))
+	}
+	if attempts != 2 {
+		t.Fatalf("attempts = %d, want bounded to 2", attempts)
+	}
+	if h.State("720p") != Failed {
+		t.Fatalf("state = %v", h.State("720p"))
+	}
+}
+
+func TestWriteMaster(t *testing.T) {
+	variants := []Variant{
+		{Name: "720p", Bandwidth: 2500000, Width: 1280, Height: 720, Codecs: "avc1.64001f", URI: "720p/playlist.m3u8"},
+		{Name: "360p", Bandwidth: 800000, Width: 640, Height: 360, Codecs: "avc1.42e01e", URI: "360p/playlist.m3u8"},
+	}
+	var buf bytes.Buffer
+	err := WriteMaster(&buf, variants, func(name string) bool { return name != "720p" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "#EXTM3U\n#EXT-X-VERSION:3\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360,CODECS=\"avc1.42e01e\"\n360p/playlist.m3u8\n"
+	if buf.String() != want {
+		t.Fatalf("master =\n%s", buf.String())
+	}
+}
@@ -0,0 +1,69 @@
+package abr
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Rung is a rendition transcoded from the published video
+type Rung struct {
+	// Name names the rendition's directory, e.g. 720p
+	Name          string
+	Width, Height int
+	// Bitrate is the video bitrate in kbit/s
+	Bitrate int
+}
+
+// DefaultLadder is what a ladder set to on transcodes
+var DefaultLadder = []Rung{
+	{Name: "1080p", Width: 1920, Height: 1080, Bitrate: 4500},
+	{Name: "720p", Width: 1280, Height: 720, Bitrate: 2500},
+	{Name: "480p", Width: 854, Height: 480, Bitrate: 1000},
+}
+
+var (
+	rungName = regexp.MustCompile(`^[a-z0-9]{1,16}$`)
+	rungSpec = regexp.MustCompile(`^([^:]+):(\d+)x(\d+)@(\d+)$`)
+)
+
+// ParseLadder parses a ladder: off or empty for none, on for DefaultLadder,
+// else comma separated name:WIDTHxHEIGHT@KBPS rungs, such as
+// "720p:1280x720@2500,360p:640x360@800". Rungs are returned highest first.
+func ParseLadder(spec string) ([]Rung, error) {
+	switch spec = strings.TrimSpace(spec); spec {
+	case "", "off":
+		return nil, nil
+	case "on":
+		return append([]Rung(nil), DefaultLadder...), nil
+	}
+	var rungs []Rung
+	seen := map[string]bool{}
+	for _, item := range strings.Split(spec, ",") {
+		m := rungSpec.FindStringSubmatch(strings.TrimSpace(item))
+		if m == nil {
+			return nil, fmt.Errorf("abr: bad rung %q, want name:WIDTHxHEIGHT@KBPS", item)
+		}
+		r := Rung{Name: m[1]}
+		r.Width, _ = strconv.Atoi(m[2])
+		r.Height, _ = strconv.Atoi(m[3])
+		r.Bitrate, _ = strconv.Atoi(m[4])
+		switch {
+		case !rungName.MatchString(r.Name):
+			return nil, fmt.Errorf("abr: rung name %q must be up to 16 lowercase letters and digits", r.Name)
+		case seen[r.Name]:
+			return nil, fmt.Errorf("abr: duplicate rung %s", r.Name)
+		case r.Width < 16 || r.Height < 16 || r.Width%2 != 0 || r.Height%2 != 0:
+			// 4:2:0 video needs even dimensions
+			return nil, fmt.Errorf("abr: rung %s: bad size %dx%d", r.Name, r.Width, r.Height)
+		case r.Bitrate <= 0:
+			return nil, fmt.Errorf("abr: rung %s: bitrate must be positive", r.Name)
+		}
+		seen[r.Name] = true
+		rungs = append(rungs, r)
+	}
+	sort.SliceStable(rungs, func(i, j int) bool { return rungs[i].Height > rungs[j].Height })
+	return rungs, nil
+}
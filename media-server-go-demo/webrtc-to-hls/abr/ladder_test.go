@@ -0,0 +1,35 @@
+package abr
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLadder(t *testing.T) {
+	for _, spec := range []string{"", "off"} {
+		if rungs, err := ParseLadder(spec); err != nil || rungs != nil {
+			t.Fatalf("%q = %v, %v", spec, rungs, err)
+		}
+	}
+	if rungs, err := ParseLadder("on"); err != nil || !reflect.DeepEqual(rungs, DefaultLadder) {
+		t.Fatalf("on = %v, %v", rungs, err)
+	}
+	rungs, err := ParseLadder("360p:640x360@800, 720p:1280x720@2500")
+	want := []Rung{{"720p", 1280, 720, 2500}, {"360p", 640, 360, 800}}
+	if err != nil || !reflect.DeepEqual(rungs, want) {
+		t.Fatalf("ladder = %v, %v", rungs, err)
+	}
+
+	for _, bad := range []string{
+		"720p",
+		"720p:1280x720",
+		"../x:1280x720@2500",
+		"720p:1280x720@2500,720p:1280x720@2000",
+		"odd:641x360@800",
+		"none:640x360@0",
+	} {
+		if _, err := ParseLadder(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package abr
+
+import (
+	"io"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/playlist"
+)
+
+// Variant is one rendition as listed in the master playlist
+type Variant struct {
+	Name      string
+	Bandwidth int
+	Width     int
+	Height    int
+	// Codecs is the RFC 6381 codecs string, e.g. avc1.42e01f
+	Codecs string
+	// URI is the media playlist, relative to the master playlist
+	URI string
+	// Audio and Subtitles are the GROUP-IDs of the alternate audio and the
+	// subtitles of the rendition, if any
+	Audio     string
+	Subtitles string
+}
+
+// WriteMaster writes a master playlist listing the variants for which
+// listed returns true, so unhealthy renditions are not offered to players,
+// and the alternate renditions they refer to
+func WriteMaster(w io.Writer, variants []Variant, listed func(name string) bool, renditions ...playlist.Rendition) error {
+	entries := make([]playlist.Variant, 0, len(variants))
+	for _, v := range variants {
+		if listed != nil && !listed(v.Name) {
+			continue
+		}
+		entries = append(entries, playlist.Variant{
+			Bandwidth: v.Bandwidth,
+			Width:     v.Width,
+			Height:    v.Height,
+			Codecs:    v.Codecs,
+			URI:       v.URI,
+			Audio:     v.Audio,
+			Subtitles: v.Subtitles,
+		})
+	}
+	return playlist.WriteMaster(w, entries, renditions...)
+}
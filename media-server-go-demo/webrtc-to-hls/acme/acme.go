@@ -0,0 +1,430 @@
+// Package acme obtains TLS certificates from an ACME certificate
+// authority such as Let's Encrypt, as RFC 8555 describes, proving control
+// of the domains with http-01 challenges. Requests are signed with an ES256
+// account key.
+package acme
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LetsEncrypt is the directory of the production Let's Encrypt CA
+const LetsEncrypt = "https://acme-v02.api.letsencrypt.org/directory"
+
+// ChallengePath is where the CA fetches the key authorizations of http-01
+// challenges, followed by their token, on port 80 of each domain
+const ChallengePath = "/.well-known/acme-challenge/"
+
+// the statuses of orders, authorizations and challenges
+const (
+	statusPending    = "pending"
+	statusProcessing = "processing"
+	statusValid      = "valid"
+	statusInvalid    = "invalid"
+)
+
+// badNonce is the problem a request with a stale nonce is answered with,
+// retried once with a fresh one
+const badNonce = "urn:ietf:params:acme:error:badNonce"
+
+// Problem is an error answered by the CA
+type Problem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+func (p *Problem) Error() string {
+	return fmt.Sprintf("acme: %s (%s)", p.Detail, p.Type)
+}
+
+// Challenges holds the key authorizations of the pending http-01
+// challenges, served at ChallengePath while the CA validates them
+type Challenges struct {
+	lock   sync.Mutex
+	tokens map[string]string
+}
+
+func (c *Challenges) set(token, keyAuthorization string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.tokens == nil {
+		c.tokens = map[string]string{}
+	}
+	c.tokens[token] = keyAuthorization
+}
+
+func (c *Challenges) remove(token string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.tokens, token)
+}
+
+// ServeHTTP answers the key authorization of the token of the path, 404
+// for other tokens and paths
+func (c *Challenges) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, ChallengePath)
+	c.lock.Lock()
+	keyAuthorization, ok := c.tokens[token]
+	c.lock.Unlock()
+	if !ok || !strings.HasPrefix(r.URL.Path, ChallengePath) {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(keyAuthorization))
+}
+
+// Client orders certificates from the CA at Directory for the account of
+// Key, registered on first use with the contact Email
+type Client struct {
+	Directory string
+	Email     string
+	// Key is the account key, on the P-256 curve
+	Key *ecdsa.PrivateKey
+	// Challenges serves the http-01 challenges of the orders
+	Challenges *Challenges
+	// Client sends the requests, http.DefaultClient when nil
+	Client *http.Client
+	// Poll is how often pending authorizations and orders are checked, a
+	// second when 0
+	Poll time.Duration
+
+	lock  sync.Mutex
+	dir   *directory
+	kid   string
+	nonce string
+}
+
+type directory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+type identifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type order struct {
+	Status         string   `json:"status"`
+	Authorizations []string `json:"authorizations"`
+	Finalize       string   `json:"finalize"`
+	Certificate    string   `json:"certificate"`
+	Error          *Problem `json:"error"`
+}
+
+type challenge struct {
+	Type   string   `json:"type"`
+	URL    string   `json:"url"`
+	Token  string   `json:"token"`
+	Status string   `json:"status"`
+	Error  *Problem `json:"error"`
+}
+
+type authorization struct {
+	Status     string      `json:"status"`
+	Identifier identifier  `json:"identifier"`
+	Challenges []challenge `json:"challenges"`
+}
+
+// Obtain orders a certificate of key for domains and returns its PEM chain
+func (c *Client) Obtain(ctx context.Context, domains []string, key crypto.Signer) ([]byte, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(domains) == 0 {
+		return nil, errors.New("acme: no domains")
+	}
+	if err := c.register(ctx); err != nil {
+		return nil, err
+	}
+	var ids []identifier
+	for _, domain := range domains {
+		ids = append(ids, identifier{Type: "dns", Value: domain})
+	}
+	var o order
+	resp, err := c.post(ctx, c.dir.NewOrder, map[string]interface{}{"identifiers": ids}, &o)
+	if err != nil {
+		return nil, err
+	}
+	orderURL := resp.Header.Get("Location")
+	for _, authz := range o.Authorizations {
+		if err := c.authorize(ctx, authz); err != nil {
+			return nil, err
+		}
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domains[0]},
+		DNSNames: domains,
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.post(ctx, o.Finalize, map[string]string{"csr": encode(csr)}, &o); err != nil {
+		return nil, err
+	}
+	for o.Status == statusPending || o.Status == statusProcessing {
+		if err := c.wait(ctx); err != nil {
+			return nil, err
+		}
+		if _, err := c.post(ctx, orderURL, nil, &o); err != nil {
+			return nil, err
+		}
+	}
+	if o.Status != statusValid || o.Certificate == "" {
+		if o.Error != nil {
+			return nil, o.Error
+		}
+		return nil, fmt.Errorf("acme: order %s", o.Status)
+	}
+	resp, err = c.post(ctx, o.Certificate, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// register discovers the directory and registers the account, once
+func (c *Client) register(ctx context.Context) error {
+	if c.dir == nil {
+		req, err := http.NewRequest(http.MethodGet, c.Directory, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := c.client().Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		var dir directory
+		if err := json.NewDecoder(resp.Body).Decode(&dir); err != nil {
+			return fmt.Errorf("acme: directory: %v", err)
+		}
+		c.dir = &dir
+	}
+	if c.kid != "" {
+		return nil
+	}
+	account := map[string]interface{}{"termsOfServiceAgreed": true}
+	if c.Email != "" {
+		account["contact"] = []string{"mailto:" + c.Email}
+	}
+	resp, err := c.post(ctx, c.dir.NewAccount, account, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if c.kid = resp.Header.Get("Location"); c.kid == "" {
+		return errors.New("acme: account without a location")
+	}
+	return nil
+}
+
+// authorize answers the http-01 challenge of the authorization at url and
+// waits for the CA to validate it
+func (c *Client) authorize(ctx context.Context, url string) error {
+	var authz authorization
+	if _, err := c.post(ctx, url, nil, &authz); err != nil {
+		return err
+	}
+	if authz.Status == statusValid {
+		return nil
+	}
+	var ch *challenge
+	for i := range authz.Challenges {
+		if authz.Challenges[i].Type == "http-01" {
+			ch = &authz.Challenges[i]
+		}
+	}
+	if ch == nil {
+		return fmt.Errorf("acme: no http-01 challenge for %s", authz.Identifier.Value)
+	}
+	c.Challenges.set(ch.Token, ch.Token+"."+Thumbprint(&c.Key.PublicKey))
+	defer c.Challenges.remove(ch.Token)
+	if _, err := c.post(ctx, ch.URL, struct{}{}, nil); err != nil {
+		return err
+	}
+	for authz.Status == statusPending {
+		if err := c.wait(ctx); err != nil {
+			return err
+		}
+		if _, err := c.post(ctx, url, nil, &authz); err != nil {
+			return err
+		}
+	}
+	if authz.Status != statusValid {
+		for _, ch := range authz.Challenges {
+			if ch.Error != nil {
+				return ch.Error
+			}
+		}
+		return fmt.Errorf("acme: authorization of %s %s", authz.Identifier.Value, authz.Status)
+	}
+	return nil
+}
+
+func (c *Client) wait(ctx context.Context) error {
+	poll := c.Poll
+	if poll == 0 {
+		poll = time.Second
+	}
+	select {
+	case <-time.After(poll):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *Client) client() *http.Client {
+	if c.Client != nil {
+		return c.Client
+	}
+	return http.DefaultClient
+}
+
+// post sends payload to url signed, nil for a POST-as-GET, decoding the
+// answer into out if not nil. A stale nonce is retried once.
+func (c *Client) post(ctx context.Context, url string, payload, out interface{}) (*http.Response, error) {
+	resp, err := c.postOnce(ctx, url, payload)
+	if p, ok := err.(*Problem); ok && p.Type == badNonce {
+		resp, err = c.postOnce(ctx, url, payload)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if out != nil {
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return nil, fmt.Errorf("acme: %s: %v", url, err)
+		}
+	}
+	return resp, nil
+}
+
+func (c *Client) postOnce(ctx context.Context, url string, payload interface{}) (*http.Response, error) {
+	nonce, err := c.takeNonce(ctx)
+	if err != nil {
+		return nil, err
+	}
+	body, err := c.sign(url, nonce, payload)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/jose+json")
+	resp, err := c.client().Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	c.nonce = resp.Header.Get("Replay-Nonce")
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		p := &Problem{Status: resp.StatusCode}
+		if err := json.NewDecoder(resp.Body).Decode(p); err != nil || p.Type == "" {
+			return nil, fmt.Errorf("acme: %s: %s", url, resp.Status)
+		}
+		return nil, p
+	}
+	return resp, nil
+}
+
+// takeNonce returns the nonce of the last answer, or a new one
+func (c *Client) takeNonce(ctx context.Context) (string, error) {
+	if nonce := c.nonce; nonce != "" {
+		c.nonce = ""
+		return nonce, nil
+	}
+	req, err := http.NewRequest(http.MethodHead, c.dir.NewNonce, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.client().Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	nonce := resp.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", errors.New("acme: no nonce")
+	}
+	return nonce, nil
+}
+
+// sign wraps payload in a JWS of the account key, identified by its JWK
+// until registered and by its account url after
+func (c *Client) sign(url, nonce string, payload interface{}) ([]byte, error) {
+	protected := map[string]interface{}{"alg": "ES256", "nonce": nonce, "url": url}
+	if c.kid != "" {
+		protected["kid"] = c.kid
+	} else {
+		protected["jwk"] = jwk(&c.Key.PublicKey)
+	}
+	header, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+	var body []byte
+	if payload != nil {
+		if body, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+	}
+	signed := encode(header) + "." + encode(body)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, c.Key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	signature := append(pad(r), pad(s)...)
+	return json.Marshal(map[string]string{
+		"protected": encode(header),
+		"payload":   encode(body),
+		"signature": encode(signature),
+	})
+}
+
+// jwk is the JSON Web Key of key, its members in the lexical order its
+// thumbprint hashes them in
+func jwk(key *ecdsa.PublicKey) map[string]string {
+	return map[string]string{"crv": "P-256", "kty": "EC", "x": encode(pad(key.X)), "y": encode(pad(key.Y))}
+}
+
+// Thumbprint is the RFC 7638 thumbprint of key, which key authorizations
+// end with
+func Thumbprint(key *ecdsa.PublicKey) string {
+	k := jwk(key)
+	digest := sha256.Sum256([]byte(fmt.Sprintf(`{"crv":"%s","kty":"%s","x":"%s","y":"%s"}`, k["crv"], k["kty"], k["x"], k["y"])))
+	return encode(digest[:])
+}
+
+// pad is n on the 32 bytes of a P-256 coordinate
+func pad(n *big.Int) []byte {
+	b := make([]byte, 32)
+	return append(b[:32-len(n.Bytes())], n.Bytes()...)
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
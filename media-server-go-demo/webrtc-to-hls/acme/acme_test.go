@@ -0,0 +1,131 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeCA issues certificates for the http-01 challenges it finds served by
+// challenges, checking every request is signed by the account key
+type fakeCA struct {
+	t          *testing.T
+	url        string
+	key        *ecdsa.PublicKey
+	challenges *Challenges
+	nonces     int
+	validated  bool
+	csr        *x509.CertificateRequest
+}
+
+func (ca *fakeCA) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ca.nonces++
+	w.Header().Set("Replay-Nonce", fmt.Sprint("nonce-", ca.nonces))
+	if r.URL.Path == "/directory" {
+		json.NewEncoder(w).Encode(directory{NewNonce: ca.url + "/nonce", NewAccount: ca.url + "/account", NewOrder: ca.url + "/order"})
+		return
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+	var jws struct{ Protected, Payload, Signature string }
+	json.NewDecoder(r.Body).Decode(&jws)
+	header, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+	signature, _ := base64.RawURLEncoding.DecodeString(jws.Signature)
+	var protected struct {
+		URL string `json:"url"`
+		Kid string `json:"kid"`
+	}
+	json.Unmarshal(header, &protected)
+	digest := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	if len(signature) != 64 || !ecdsa.Verify(ca.key, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+		ca.t.Errorf("%s: bad signature", r.URL.Path)
+	}
+	if protected.URL != ca.url+r.URL.Path {
+		ca.t.Errorf("url = %s", protected.URL)
+	}
+	if r.URL.Path != "/account" && protected.Kid != ca.url+"/accounts/1" {
+		ca.t.Errorf("%s: kid = %q", r.URL.Path, protected.Kid)
+	}
+	switch r.URL.Path {
+	case "/account":
+		w.Header().Set("Location", ca.url+"/accounts/1")
+		w.WriteHeader(http.StatusCreated)
+	case "/order":
+		w.Header().Set("Location", ca.url+"/orders/1")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(order{Status: statusPending, Authorizations: []string{ca.url + "/authz/1"}, Finalize: ca.url + "/finalize"})
+	case "/authz/1":
+		status := statusPending
+		if ca.validated {
+			status = statusValid
+		}
+		json.NewEncoder(w).Encode(authorization{Status: status, Identifier: identifier{"dns", "example.com"},
+			Challenges: []challenge{{Type: "http-01", URL: ca.url + "/challenge/1", Token: "tok"}}})
+	case "/challenge/1":
+		rec := httptest.NewRecorder()
+		ca.challenges.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, ChallengePath+"tok", nil))
+		if want := "tok." + Thumbprint(ca.key); rec.Body.String() != want {
+			ca.t.Errorf("key authorization = %q, want %q", rec.Body.String(), want)
+		}
+		ca.validated = true
+		json.NewEncoder(w).Encode(challenge{Type: "http-01", Status: statusProcessing})
+	case "/finalize":
+		var finalize struct{ CSR string }
+		json.Unmarshal(payload, &finalize)
+		der, _ := base64.RawURLEncoding.DecodeString(finalize.CSR)
+		ca.csr, _ = x509.ParseCertificateRequest(der)
+		json.NewEncoder(w).Encode(order{Status: statusProcessing})
+	case "/orders/1":
+		json.NewEncoder(w).Encode(order{Status: statusValid, Certificate: ca.url + "/cert/1"})
+	case "/cert/1":
+		if len(payload) != 0 {
+			ca.t.Errorf("POST-as-GET with a payload: %s", payload)
+		}
+		w.Write([]byte("-----BEGIN CERTIFICATE-----\n"))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(Problem{Type: "urn:ietf:params:acme:error:malformed", Detail: "no " + r.URL.Path})
+	}
+}
+
+func TestObtain(t *testing.T) {
+	accountKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	certKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	challenges := &Challenges{}
+	ca := &fakeCA{t: t, key: &accountKey.PublicKey, challenges: challenges}
+	server := httptest.NewServer(ca)
+	defer server.Close()
+	ca.url = server.URL
+
+	client := &Client{Directory: server.URL + "/directory", Email: "ops@example.com", Key: accountKey, Challenges: challenges, Poll: time.Millisecond}
+	chain, err := client.Obtain(context.Background(), []string{"example.com", "www.example.com"}, certKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block, _ := pem.Decode(append(chain, "-----END CERTIFICATE-----\n"...)); block == nil {
+		t.Fatalf("chain = %q", chain)
+	}
+	if ca.csr == nil || strings.Join(ca.csr.DNSNames, ",") != "example.com,www.example.com" || ca.csr.Subject.CommonName != "example.com" {
+		t.Fatalf("csr = %+v", ca.csr)
+	}
+	rec := httptest.NewRecorder()
+	challenges.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, ChallengePath+"tok", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("challenge still served after the order: %d", rec.Code)
+	}
+}
@@ -0,0 +1,228 @@
+// Package analytics follows the viewers of live streams as sessions: a
+// viewer joins, watches and leaves, and each join and leave is an event for
+// a sink, a log, a webhook or Kafka. HLS players only poll, so their
+// sessions are made out of requests and end once they stop; WebRTC viewers
+// join and leave explicitly. Like audience, viewer addresses are only used
+// to resolve a location and derive a salted id, never kept.
+package analytics
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/audience"
+)
+
+// event types
+const (
+	Join  = "join"
+	Leave = "leave"
+)
+
+// Event is a viewer joining or leaving a stream
+type Event struct {
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	Stream   string    `json:"stream"`
+	Viewer   string    `json:"viewer"`
+	Protocol string    `json:"protocol"`
+	// WatchSeconds is how long the viewer watched, in leave events
+	WatchSeconds float64 `json:"watchSeconds,omitempty"`
+	Country      string  `json:"country,omitempty"`
+	ASN          string  `json:"asn,omitempty"`
+}
+
+type viewer struct {
+	stream, protocol string
+	country, asn     string
+	joined, last     time.Time
+	// polled viewers leave once idle, the others on Leave
+	polled bool
+}
+
+// Tracker holds the viewers watching and the events not taken yet
+type Tracker struct {
+	resolver audience.Resolver
+	idle     time.Duration
+	pending  int
+	dropped  uint64
+
+	lock    sync.Mutex
+	salt    []byte
+	viewers map[string]*viewer
+	events  []Event
+}
+
+// NewTracker returns a tracker locating viewers with resolver. Polled
+// viewers leave after idle without a request; at most pending events wait
+// to be taken, newer ones are dropped and counted.
+func NewTracker(resolver audience.Resolver, idle time.Duration, pending int) *Tracker {
+	salt := make([]byte, 32)
+	rand.Read(salt)
+	return &Tracker{
+		resolver: resolver,
+		idle:     idle,
+		pending:  pending,
+		salt:     salt,
+		viewers:  map[string]*viewer{},
+	}
+}
+
+// viewerID derives the id of a polling viewer of stream from its address
+// and user agent
+func (t *Tracker) viewerID(stream string, ip net.IP, agent string) string {
+	mac := hmac.New(sha256.New, t.salt)
+	mac.Write([]byte(stream))
+	mac.Write([]byte{0})
+	mac.Write(ip)
+	mac.Write([]byte{0})
+	mac.Write([]byte(agent))
+	return hex.EncodeToString(mac.Sum(nil)[:12])
+}
+
+// locate resolves ip to the country and ASN of events
+func (t *Tracker) locate(ip net.IP) (string, string) {
+	if ip == nil || t.resolver == nil {
+		return "", ""
+	}
+	// a failed lookup leaves the location unknown
+	location, _ := t.resolver.Resolve(ip)
+	asn := ""
+	if location.ASN != 0 {
+		asn = fmt.Sprintf("AS%d", location.ASN)
+	}
+	return location.Country, asn
+}
+
+// Seen records a request of a polling viewer of stream, joining it on its
+// first one
+func (t *Tracker) Seen(stream, protocol string, ip net.IP, agent string, now time.Time) {
+	if ip == nil {
+		return
+	}
+	id := t.viewerID(stream, ip, agent)
+	t.lock.Lock()
+	if v := t.viewers[id]; v != nil {
+		v.last = now
+		t.lock.Unlock()
+		return
+	}
+	t.lock.Unlock()
+	// resolved without the lock, requests of other viewers never wait on it
+	country, asn := t.locate(ip)
+	t.join(id, &viewer{stream: stream, protocol: protocol, country: country, asn: asn, joined: now, last: now, polled: true})
+}
+
+// Watching reports whether the polling viewer of stream at ip with agent
+// is watching it, seen and not idle since
+func (t *Tracker) Watching(stream string, ip net.IP, agent string) bool {
+	if ip == nil {
+		return false
+	}
+	id := t.viewerID(stream, ip, agent)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.viewers[id] != nil
+}
+
+// Join records a viewer of stream with id, until Leave
+func (t *Tracker) Join(stream, id, protocol string, ip net.IP, now time.Time) {
+	country, asn := t.locate(ip)
+	t.join(id, &viewer{stream: stream, protocol: protocol, country: country, asn: asn, joined: now, last: now})
+}
+
+func (t *Tracker) join(id string, v *viewer) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if existing := t.viewers[id]; existing != nil {
+		// a concurrent request joined it first
+		if v.last.After(existing.last) {
+			existing.last = v.last
+		}
+		return
+	}
+	t.viewers[id] = v
+	t.emit(v.event(Join, id, v.joined))
+}
+
+// Leave records the end of the viewer with id, at now
+func (t *Tracker) Leave(id string, now time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if v := t.viewers[id]; v != nil {
+		delete(t.viewers, id)
+		t.emit(v.event(Leave, id, now))
+	}
+}
+
+// Expire ends the polling viewers idle at now, as of their last request
+func (t *Tracker) Expire(now time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for id, v := range t.viewers {
+		if v.polled && now.Sub(v.last) >= t.idle {
+			delete(t.viewers, id)
+			t.emit(v.event(Leave, id, v.last))
+		}
+	}
+}
+
+func (v *viewer) event(kind, id string, at time.Time) Event {
+	e := Event{
+		Type:     kind,
+		Time:     at,
+		Stream:   v.stream,
+		Viewer:   id,
+		Protocol: v.protocol,
+		Country:  v.country,
+		ASN:      v.asn,
+	}
+	if kind == Leave {
+		e.WatchSeconds = at.Sub(v.joined).Seconds()
+	}
+	return e
+}
+
+// emit queues e; called with the lock held
+func (t *Tracker) emit(e Event) {
+	if len(t.events) >= t.pending {
+		atomic.AddUint64(&t.dropped, 1)
+		return
+	}
+	t.events = append(t.events, e)
+}
+
+// Events takes the events queued since the previous call, oldest first
+func (t *Tracker) Events() []Event {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	events := t.events
+	t.events = nil
+	return events
+}
+
+// Dropped returns the number of events dropped on a full queue
+func (t *Tracker) Dropped() uint64 {
+	return atomic.LoadUint64(&t.dropped)
+}
+
+// Concurrent counts the viewers watching, per stream and protocol
+func (t *Tracker) Concurrent() map[string]map[string]int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	counts := map[string]map[string]int{}
+	for _, v := range t.viewers {
+		if counts[v.stream] == nil {
+			counts[v.stream] = map[string]int{}
+		}
+		counts[v.stream][v.protocol]++
+	}
+	return counts
+}
@@ -0,0 +1,126 @@
+package analytics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/audience"
+)
+
+type fakeResolver struct{}
+
+func (fakeResolver) Resolve(ip net.IP) (audience.Location, error) {
+	if ip.String() == "192.0.2.10" {
+		return audience.Location{Country: "NL", ASN: 64500}, nil
+	}
+	return audience.Location{}, errors.New("not found")
+}
+
+func TestTrackerSessions(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tracker := NewTracker(fakeResolver{}, 30*time.Second, 16)
+	player := net.ParseIP("192.0.2.10")
+	tracker.Seen("live", "hls", player, "player", now)
+	tracker.Seen("live", "hls", player, "player", now.Add(10*time.Second))
+	tracker.Seen("live", "hls", net.ParseIP("198.51.100.1"), "player", now)
+	tracker.Join("live", "v1", "webrtc", player, now)
+	if c := tracker.Concurrent()["live"]; c["hls"] != 2 || c["webrtc"] != 1 {
+		t.Fatalf("concurrent = %v", c)
+	}
+	if !tracker.Watching("live", player, "player") || tracker.Watching("live", player, "other") || tracker.Watching("other", player, "player") {
+		t.Fatal("watching of the wrong viewer")
+	}
+
+	tracker.Expire(now.Add(35 * time.Second))
+	tracker.Leave("v1", now.Add(60*time.Second))
+	tracker.Leave("v1", now.Add(61*time.Second))
+	if c := tracker.Concurrent()["live"]; c["hls"] != 1 || c["webrtc"] != 0 {
+		t.Fatalf("concurrent after leaving = %v", c)
+	}
+	if tracker.Watching("live", net.ParseIP("198.51.100.1"), "player") || !tracker.Watching("live", player, "player") {
+		t.Fatal("idle viewer watching")
+	}
+	events := tracker.Events()
+	if len(events) != 5 {
+		t.Fatalf("events = %+v", events)
+	}
+	if e := events[0]; e.Type != Join || e.Country != "NL" || e.ASN != "AS64500" || e.Viewer == "" || strings.Contains(e.Viewer, "192.0.2.10") {
+		t.Fatalf("join = %+v", e)
+	}
+	leaves := map[string]Event{}
+	for _, e := range events[3:] {
+		leaves[e.Protocol] = e
+	}
+	if e := leaves["hls"]; e.Type != Leave || e.WatchSeconds != 0 || e.Country != "" {
+		t.Fatalf("hls leave = %+v", e)
+	}
+	if e := leaves["webrtc"]; e.Type != Leave || e.WatchSeconds != 60 {
+		t.Fatalf("webrtc leave = %+v", e)
+	}
+	if len(tracker.Events()) != 0 {
+		t.Fatal("events taken twice")
+	}
+}
+
+func TestTrackerDrops(t *testing.T) {
+	tracker := NewTracker(nil, time.Second, 2)
+	for _, id := range []string{"a", "b", "c"} {
+		tracker.Join("live", id, "webrtc", nil, time.Unix(1000, 0))
+	}
+	if len(tracker.Events()) != 2 || tracker.Dropped() != 1 {
+		t.Fatalf("dropped = %d", tracker.Dropped())
+	}
+}
+
+func TestSinks(t *testing.T) {
+	var out bytes.Buffer
+	events := []Event{{Type: Join, Stream: "live", Viewer: "v1", Protocol: "hls"}}
+	if err := (&Log{W: &out}).Send(context.Background(), events); err != nil || !strings.HasPrefix(out.String(), `{"type":"join"`) {
+		t.Fatalf("log = %q, %v", out.String(), err)
+	}
+
+	var path, contentType string
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, contentType = r.URL.Path, r.Header.Get("Content-Type")
+		body, _ = ioutil.ReadAll(r.Body)
+		if r.URL.Path == "/fail" {
+			http.Error(w, "nope", http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	if err := (&Webhook{URL: server.URL + "/events"}).Send(context.Background(), events); err != nil {
+		t.Fatal(err)
+	}
+	var hook struct{ Events []Event }
+	if json.Unmarshal(body, &hook); len(hook.Events) != 1 || contentType != "application/json" {
+		t.Fatalf("webhook body %s", body)
+	}
+
+	if err := (&Kafka{URL: server.URL + "/", Topic: "viewers"}).Send(context.Background(), events); err != nil {
+		t.Fatal(err)
+	}
+	var kafka struct {
+		Records []struct {
+			Key   string
+			Value Event
+		}
+	}
+	if json.Unmarshal(body, &kafka); path != "/topics/viewers" || len(kafka.Records) != 1 || kafka.Records[0].Key != "live" || kafka.Records[0].Value.Viewer != "v1" {
+		t.Fatalf("kafka %s %s", path, body)
+	}
+
+	if err := (&Webhook{URL: server.URL + "/fail"}).Send(context.Background(), events); err == nil || !strings.Contains(err.Error(), "502") {
+		t.Fatalf("failure = %v", err)
+	}
+}
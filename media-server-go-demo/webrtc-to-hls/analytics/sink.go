@@ -0,0 +1,120 @@
+package analytics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Sink delivers events somewhere. Sinks only send; batching and retrying
+// failures is left to the caller.
+type Sink interface {
+	// Name describes the sink in logs
+	Name() string
+	Send(ctx context.Context, events []Event) error
+}
+
+// Log writes events as JSON lines, e.g. to a file shipped elsewhere
+type Log struct {
+	W io.Writer
+
+	lock sync.Mutex
+}
+
+func (l *Log) Name() string {
+	return "log"
+}
+
+func (l *Log) Send(ctx context.Context, events []Event) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	encoder := json.NewEncoder(l.W)
+	for _, e := range events {
+		if err := encoder.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Webhook posts events to URL as {"events": [...]}
+type Webhook struct {
+	URL string
+	// Client sends the requests, http.DefaultClient when nil
+	Client *http.Client
+}
+
+func (w *Webhook) Name() string {
+	return w.URL
+}
+
+func (w *Webhook) Send(ctx context.Context, events []Event) error {
+	body, err := json.Marshal(struct {
+		Events []Event `json:"events"`
+	}{events})
+	if err != nil {
+		return err
+	}
+	return post(ctx, w.Client, w.URL, "application/json", body)
+}
+
+// Kafka produces events to Topic through a Kafka REST proxy at URL, e.g.
+// http://kafka-rest:8082, keyed by stream so the events of a stream stay in
+// order on one partition
+type Kafka struct {
+	URL   string
+	Topic string
+	// Client sends the requests, http.DefaultClient when nil
+	Client *http.Client
+}
+
+func (k *Kafka) Name() string {
+	return "kafka://" + k.Topic
+}
+
+type kafkaRecord struct {
+	Key   string `json:"key"`
+	Value Event  `json:"value"`
+}
+
+func (k *Kafka) Send(ctx context.Context, events []Event) error {
+	records := make([]kafkaRecord, len(events))
+	for i, e := range events {
+		records[i] = kafkaRecord{Key: e.Stream, Value: e}
+	}
+	body, err := json.Marshal(struct {
+		Records []kafkaRecord `json:"records"`
+	}{records})
+	if err != nil {
+		return err
+	}
+	return post(ctx, k.Client, strings.TrimRight(k.URL, "/")+"/topics/"+k.Topic, "application/vnd.kafka.json.v2+json", body)
+}
+
+func post(ctx context.Context, client *http.Client, url, contentType string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", contentType)
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		detail, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("analytics: post %s: %s %s", url, resp.Status, strings.TrimSpace(string(detail)))
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+// Package audience rolls viewers up per stream by country and ASN. Viewer
+// addresses are only held while they wait to be resolved: lookups are
+// cached per network prefix and viewers are deduplicated by a salted hash
+// that is rotated on every flush.
+package audience
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// Location is what a viewer address resolves to; empty fields are unknown
+type Location struct {
+	Country string
+	ASN     uint
+}
+
+// Resolver maps addresses to locations, e.g. MaxMind
+type Resolver interface {
+	Resolve(ip net.IP) (Location, error)
+}
+
+// Unknown is the rollup key of viewers whose country or ASN did not resolve
+const Unknown = "unknown"
+
+// Rollup counts the distinct viewers of a stream
+type Rollup struct {
+	Viewers   int            `json:"viewers"`
+	Countries map[string]int `json:"countries"`
+	ASNs      map[string]int `json:"asns"`
+}
+
+func newRollup() *Rollup {
+	return &Rollup{Countries: map[string]int{}, ASNs: map[string]int{}}
+}
+
+func (r *Rollup) add(location Location, n int) {
+	country, asn := location.Country, Unknown
+	if country == "" {
+		country = Unknown
+	}
+	if location.ASN != 0 {
+		asn = fmt.Sprintf("AS%d", location.ASN)
+	}
+	r.Viewers += n
+	r.Countries[country] += n
+	r.ASNs[asn] += n
+}
+
+// Merge adds the counts of other to r
+func (r *Rollup) Merge(other *Rollup) {
+	r.Viewers += other.Viewers
+	for k, v := range other.Countries {
+		r.Countries[k] += v
+	}
+	for k, v := range other.ASNs {
+		r.ASNs[k] += v
+	}
+}
+
+// Clone returns a copy of r safe to hand out
+func (r *Rollup) Clone() *Rollup {
+	c := newRollup()
+	c.Merge(r)
+	return c
+}
+
+type sighting struct {
+	streams []string
+	ip      net.IP
+	agent   string
+}
+
+// Tracker aggregates viewer sightings in the background so recording one
+// never waits on a lookup
+type Tracker struct {
+	resolver Resolver
+	queue    chan sighting
+	dropped  uint64
+
+	// OnViewer, if set, is called with each new distinct viewer, e.g. to
+	// count countries in metrics. It must be set before Run.
+	OnViewer func(Location)
+
+	lock     sync.Mutex
+	salt     []byte
+	seen     map[[sha256.Size]byte]bool
+	interval map[string]*Rollup
+}
+
+// NewTracker returns a tracker resolving through resolver with room for
+// queue pending sightings
+func NewTracker(resolver Resolver, queue int) *Tracker {
+	t := &Tracker{
+		resolver: resolver,
+		queue:    make(chan sighting, queue),
+	}
+	t.reset()
+	return t
+}
+
+// reset starts a new interval; called with the lock held or before Run
+func (t *Tracker) reset() {
+	t.salt = make([]byte, 32)
+	rand.Read(t.salt)
+	t.seen = map[[sha256.Size]byte]bool{}
+	t.interval = map[string]*Rollup{}
+}
+
+// Observe records a viewer of streams. It never blocks: when the queue is
+// full the sighting is dropped and counted.
+func (t *Tracker) Observe(streams []string, ip net.IP, agent string) {
+	if len(streams) == 0 || ip == nil {
+		return
+	}
+	select {
+	case t.queue <- sighting{streams: streams, ip: ip, agent: agent}:
+	default:
+		atomic.AddUint64(&t.dropped, 1)
+	}
+}
+
+// Dropped returns the number of sightings dropped on a full queue
+func (t *Tracker) Dropped() uint64 {
+	return atomic.LoadUint64(&t.dropped)
+}
+
+// Run processes sightings until stop is closed
+func (t *Tracker) Run(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case s := <-t.queue:
+			t.process(s)
+		}
+	}
+}
+
+func (t *Tracker) process(s sighting) {
+	var location Location
+	resolved := false
+	for _, stream := range s.streams {
+		t.lock.Lock()
+		mac := hmac.New(sha256.New, t.salt)
+		mac.Write([]byte(stream))
+		mac.Write([]byte{0})
+		mac.Write(s.ip)
+		mac.Write([]byte{0})
+		mac.Write([]byte(s.agent))
+		var id [sha256.Size]byte
+		copy(id[:], mac.Sum(nil))
+		seen := t.seen[id]
+		t.seen[id] = true
+		t.lock.Unlock()
+		if seen {
+			continue
+		}
+		if !resolved {
+			// a failed lookup counts as unknown
+			location, _ = t.resolver.Resolve(s.ip)
+			resolved = true
+			if t.OnViewer != nil {
+				t.OnViewer(location)
+			}
+		}
+		t.lock.Lock()
+		rollup := t.interval[stream]
+		if rollup == nil {
+			rollup = newRollup()
+			t.interval[stream] = rollup
+		}
+		rollup.add(location, 1)
+		t.lock.Unlock()
+	}
+}
+
+// Flush returns the rollups of the interval since the previous flush and
+// starts a new one with a new salt, so a viewer seen in both is counted in
+// both
+func (t *Tracker) Flush() map[string]*Rollup {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	interval := t.interval
+	t.reset()
+	return interval
+}
@@ -0,0 +1,100 @@
+package audience
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+type fakeResolver struct {
+	calls int
+}
+
+func (f *fakeResolver) Resolve(ip net.IP) (Location, error) {
+	f.calls++
+	switch ip.String() {
+	case "192.0.2.10", "192.0.2.20":
+		return Location{Country: "NL", ASN: 64500}, nil
+	case "2001:db8::1":
+		return Location{Country: "BR"}, nil
+	}
+	return Location{}, errors.New("not found")
+}
+
+func TestTracker(t *testing.T) {
+	resolver := &fakeResolver{}
+	cached := NewCached(resolver, 16)
+	tracker := NewTracker(cached, 16)
+	var viewers []Location
+	tracker.OnViewer = func(l Location) { viewers = append(viewers, l) }
+
+	for _, s := range []sighting{
+		{[]string{"live"}, net.ParseIP("192.0.2.10"), "player"},
+		{[]string{"live"}, net.ParseIP("192.0.2.10"), "player"},
+		{[]string{"live"}, net.ParseIP("192.0.2.20"), "player"},
+		{[]string{"live", "other"}, net.ParseIP("2001:db8::1"), "player"},
+		{[]string{"live"}, net.ParseIP("198.51.100.1"), "player"},
+	} {
+		tracker.process(s)
+	}
+	if resolver.calls != 3 {
+		t.Fatalf("resolver calls = %d, the /24 should be cached", resolver.calls)
+	}
+	if len(viewers) != 4 {
+		t.Fatalf("viewers = %v", viewers)
+	}
+
+	rollups := tracker.Flush()
+	live := rollups["live"]
+	if live.Viewers != 4 || live.Countries["NL"] != 2 || live.Countries["BR"] != 1 || live.Countries[Unknown] != 1 {
+		t.Fatalf("live = %+v", live)
+	}
+	if live.ASNs["AS64500"] != 2 || live.ASNs[Unknown] != 2 {
+		t.Fatalf("live asns = %+v", live.ASNs)
+	}
+	if rollups["other"].Viewers != 1 {
+		t.Fatalf("other = %+v", rollups["other"])
+	}
+
+	// a new interval counts returning viewers again
+	tracker.process(sighting{[]string{"live"}, net.ParseIP("192.0.2.10"), "player"})
+	if got := tracker.Flush()["live"]; got == nil || got.Viewers != 1 {
+		t.Fatalf("next interval = %+v", got)
+	}
+}
+
+func TestObserveNeverBlocks(t *testing.T) {
+	tracker := NewTracker(&fakeResolver{}, 1)
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			tracker.Observe([]string{"live"}, net.ParseIP("192.0.2.10"), "player")
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Observe blocked")
+	}
+	if tracker.Dropped() != 9 {
+		t.Fatalf("dropped = %d", tracker.Dropped())
+	}
+}
+
+func TestCacheEvicts(t *testing.T) {
+	resolver := &fakeResolver{}
+	cached := NewCached(resolver, 1)
+	cached.Resolve(net.ParseIP("192.0.2.10"))
+	cached.Resolve(net.ParseIP("2001:db8::1"))
+	cached.Resolve(net.ParseIP("192.0.2.10"))
+	if resolver.calls != 3 || len(cached.entries) != 1 {
+		t.Fatalf("calls = %d entries = %v", resolver.calls, cached.entries)
+	}
+	for key := range cached.entries {
+		if key == "192.0.2.10" {
+			t.Fatal("full address cached")
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package audience
+
+import (
+	"net"
+	"sync"
+)
+
+// Cached resolves through a resolver, caching results per network (/24 for
+// IPv4, /48 for IPv6) so full addresses are never kept as keys. Entries are
+// evicted oldest first once size is reached.
+type Cached struct {
+	resolver Resolver
+	size     int
+
+	lock    sync.Mutex
+	entries map[string]Location
+	order   []string
+}
+
+func NewCached(resolver Resolver, size int) *Cached {
+	return &Cached{resolver: resolver, size: size, entries: map[string]Location{}}
+}
+
+// network returns the cache key of ip
+func network(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+func (c *Cached) Resolve(ip net.IP) (Location, error) {
+	key := network(ip)
+	c.lock.Lock()
+	location, ok := c.entries[key]
+	c.lock.Unlock()
+	if ok {
+		return location, nil
+	}
+	location, err := c.resolver.Resolve(ip)
+	if err != nil {
+		return location, err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.entries[key]; !ok {
+		if len(c.order) >= c.size && c.size > 0 {
+			delete(c.entries, c.order[0])
+			c.order = c.order[1:]
+		}
+		c.order = append(c.order, key)
+	}
+	c.entries[key] = location
+	return location, nil
+}
@@ -0,0 +1,67 @@
+package audience
+
+import (
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// MaxMind resolves from GeoIP2 / GeoLite2 Country and ASN databases
+type MaxMind struct {
+	country *maxminddb.Reader
+	asn     *maxminddb.Reader
+}
+
+// OpenMaxMind opens the databases at the given paths; either may be empty
+// to leave that field unknown
+func OpenMaxMind(countryPath, asnPath string) (*MaxMind, error) {
+	m := &MaxMind{}
+	var err error
+	if countryPath != "" {
+		if m.country, err = maxminddb.Open(countryPath); err != nil {
+			return nil, err
+		}
+	}
+	if asnPath != "" {
+		if m.asn, err = maxminddb.Open(asnPath); err != nil {
+			m.Close()
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *MaxMind) Resolve(ip net.IP) (Location, error) {
+	var location Location
+	if m.country != nil {
+		var record struct {
+			Country struct {
+				ISOCode string `maxminddb:"iso_code"`
+			} `maxminddb:"country"`
+		}
+		if err := m.country.Lookup(ip, &record); err != nil {
+			return location, err
+		}
+		location.Country = record.Country.ISOCode
+	}
+	if m.asn != nil {
+		var record struct {
+			ASN uint `maxminddb:"autonomous_system_number"`
+		}
+		if err := m.asn.Lookup(ip, &record); err != nil {
+			return location, err
+		}
+		location.ASN = record.ASN
+	}
+	return location, nil
+}
+
+func (m *MaxMind) Close() error {
+	if m.country != nil {
+		m.country.Close()
+	}
+	if m.asn != nil {
+		m.asn.Close()
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+// Package budget enforces memory budgets per session and for the whole
+// process. Buffers are reserved before they are allocated; a reservation
+// that does not fit walks the account's degradation ladder, e.g. drop ABR
+// renditions, shrink the DVR window, and finally terminate the session,
+// instead of letting the process grow until it is OOM-killed.
+package budget
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrOverBudget is returned by Reserve when the ladder could not free enough
+var ErrOverBudget = errors.New("budget: memory budget exceeded")
+
+// Step is one rung of a degradation ladder; Degrade frees memory, releasing
+// it from the account, and returns once it did
+type Step struct {
+	Name    string
+	Degrade func()
+}
+
+// Budget is the global memory budget shared by the accounts
+type Budget struct {
+	limit int64
+
+	lock     sync.Mutex
+	used     int64
+	accounts map[*Account]struct{}
+}
+
+// New returns a budget of limit bytes, unlimited when limit is not positive
+func New(limit int64) *Budget {
+	return &Budget{
+		limit:    limit,
+		accounts: map[*Account]struct{}{},
+	}
+}
+
+// Account is the budget of one session
+type Account struct {
+	Name   string
+	budget *Budget
+	limit  int64
+	ladder []Step
+
+	// guarded by budget.lock
+	used   int64
+	rung   int
+	closed bool
+}
+
+// Account opens an account of limit bytes, unlimited when not positive,
+// degrading along ladder when a reservation does not fit
+func (b *Budget) Account(name string, limit int64, ladder ...Step) *Account {
+	a := &Account{
+		Name:   name,
+		budget: b,
+		limit:  limit,
+		ladder: ladder,
+	}
+	b.lock.Lock()
+	b.accounts[a] = struct{}{}
+	b.lock.Unlock()
+	return a
+}
+
+// fits must be called with the budget lock held
+func (a *Account) fits(n int64) bool {
+	b := a.budget
+	return (a.limit <= 0 || a.used+n <= a.limit) && (b.limit <= 0 || b.used+n <= b.limit)
+}
+
+// Reserve accounts for n more bytes. When they do not fit, the next rungs
+// of the ladder run one by one until they do; degradation is permanent for
+// the account. ErrOverBudget is returned once the ladder is exhausted.
+func (a *Account) Reserve(n int64) error {
+	b := a.budget
+	for {
+		b.lock.Lock()
+		if a.closed {
+			b.lock.Unlock()
+			return ErrOverBudget
+		}
+		if a.fits(n) {
+			a.used += n
+			b.used += n
+			b.lock.Unlock()
+			return nil
+		}
+		if a.rung >= len(a.ladder) {
+			b.lock.Unlock()
+			return ErrOverBudget
+		}
+		step := a.ladder[a.rung]
+		a.rung++
+		b.lock.Unlock()
+
+		// outside the lock, the step releases what it frees
+		step.Degrade()
+	}
+}
+
+// Release returns n bytes to the account
+func (a *Account) Release(n int64) {
+	b := a.budget
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if n > a.used {
+		n = a.used
+	}
+	a.used -= n
+	b.used -= n
+}
+
+// Close returns everything the account holds; later reservations fail
+func (a *Account) Close() {
+	b := a.budget
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.used -= a.used
+	a.used = 0
+	a.closed = true
+	delete(b.accounts, a)
+}
+
+// Usage is the memory accounted for against a limit, in bytes
+type Usage struct {
+	Used  int64 `json:"used"`
+	Limit int64 `json:"limit"`
+	// Degraded lists the ladder steps taken so far
+	Degraded []string `json:"degraded,omitempty"`
+}
+
+// Usage reports the account usage
+func (a *Account) Usage() Usage {
+	b := a.budget
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	usage := Usage{Used: a.used, Limit: a.limit}
+	for _, step := range a.ladder[:a.rung] {
+		usage.Degraded = append(usage.Degraded, step.Name)
+	}
+	return usage
+}
+
+// Usage reports the global usage
+func (b *Budget) Usage() Usage {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return Usage{Used: b.used, Limit: b.limit}
+}
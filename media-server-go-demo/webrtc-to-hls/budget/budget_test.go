@@ -0,0 +1,94 @@
+package budget
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func TestLadder(t *testing.T) {
+	b := New(0)
+	var taken []string
+	var a *Account
+	a = b.Account("live", 100,
+		Step{Name: "drop-renditions", Degrade: func() {
+			taken = append(taken, "drop-renditions")
+			a.Release(30)
+		}},
+		Step{Name: "terminate", Degrade: func() {
+			taken = append(taken, "terminate")
+		}},
+	)
+	if err := a.Reserve(80); err != nil {
+		t.Fatal(err)
+	}
+	// 80+40 does not fit, dropping renditions frees 30: 50+40 fits
+	if err := a.Reserve(40); err != nil {
+		t.Fatal(err)
+	}
+	if len(taken) != 1 {
+		t.Fatalf("steps taken %v", taken)
+	}
+	if err := a.Reserve(20); err != ErrOverBudget {
+		t.Fatalf("err = %v", err)
+	}
+	if len(taken) != 2 || taken[1] != "terminate" {
+		t.Fatalf("steps taken %v", taken)
+	}
+	if u := a.Usage(); u.Used != 90 || len(u.Degraded) != 2 {
+		t.Fatalf("usage %+v", u)
+	}
+	a.Close()
+	if u := b.Usage(); u.Used != 0 {
+		t.Fatalf("global usage after close %+v", u)
+	}
+}
+
+// TestSoak runs many sessions churning buffers under a small global budget;
+// the accounted total must never exceed it
+func TestSoak(t *testing.T) {
+	const limit = 1 << 20
+	b := New(limit)
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	peak := int64(0)
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var held []int64
+			var a *Account
+			a = b.Account(fmt.Sprintf("s%d", i), 64<<10, Step{Name: "shrink", Degrade: func() {
+				for _, n := range held {
+					a.Release(n)
+				}
+				held = held[:0]
+			}})
+			defer a.Close()
+			r := rand.New(rand.NewSource(int64(i)))
+			for j := 0; j < 2000; j++ {
+				n := int64(r.Intn(8 << 10))
+				if a.Reserve(n) == nil {
+					held = append(held, n)
+				}
+				if len(held) > 4 {
+					a.Release(held[0])
+					held = held[1:]
+				}
+				lock.Lock()
+				if u := b.Usage().Used; u > peak {
+					peak = u
+				}
+				lock.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if peak > limit {
+		t.Fatalf("peak usage %d over budget %d", peak, limit)
+	}
+	if u := b.Usage(); u.Used != 0 {
+		t.Fatalf("usage after all sessions closed %+v", u)
+	}
+}
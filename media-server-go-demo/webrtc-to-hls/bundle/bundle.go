@@ -0,0 +1,101 @@
+// Package bundle assembles support bundles: zip archives of diagnostics
+// bounded by a size cap. Files that do not fit are left out and listed in
+// the archive's MANIFEST, so a bundle is always complete about what it
+// does not contain.
+package bundle
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// ManifestName is the archive entry listing the bundle's files
+const ManifestName = "MANIFEST"
+
+// Writer builds one bundle in memory
+type Writer struct {
+	limit   int64
+	created time.Time
+
+	buf     bytes.Buffer
+	zip     *zip.Writer
+	size    int64
+	added   []string
+	skipped []string
+	err     error
+}
+
+// New returns a writer for a bundle of at most limit bytes of file
+// content, unlimited when limit is not positive
+func New(limit int64, created time.Time) *Writer {
+	w := &Writer{limit: limit, created: created}
+	w.zip = zip.NewWriter(&w.buf)
+	return w
+}
+
+// Add adds a file, reporting false when it was left out over the cap
+func (w *Writer) Add(name string, data []byte) bool {
+	if w.err != nil {
+		return false
+	}
+	if w.limit > 0 && w.size+int64(len(data)) > w.limit {
+		w.skipped = append(w.skipped, fmt.Sprintf("%s: %d bytes, over the %d byte cap", name, len(data), w.limit))
+		return false
+	}
+	f, err := w.zip.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: w.created})
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if err != nil {
+		w.err = err
+		return false
+	}
+	w.size += int64(len(data))
+	w.added = append(w.added, name)
+	return true
+}
+
+// AddJSON adds v as an indented JSON file
+func (w *Writer) AddJSON(name string, v interface{}) bool {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		w.skipped = append(w.skipped, fmt.Sprintf("%s: %v", name, err))
+		return false
+	}
+	return w.Add(name, append(data, '\n'))
+}
+
+// Skipped lists the files left out so far, with the reason
+func (w *Writer) Skipped() []string {
+	return w.skipped
+}
+
+// Close writes the manifest, which is never subject to the cap, and
+// returns the archive
+func (w *Writer) Close() ([]byte, error) {
+	if w.err != nil {
+		return nil, w.err
+	}
+	var manifest bytes.Buffer
+	fmt.Fprintf(&manifest, "created %s\n", w.created.UTC().Format(time.RFC3339))
+	for _, name := range w.added {
+		fmt.Fprintf(&manifest, "file %s\n", name)
+	}
+	for _, skipped := range w.skipped {
+		fmt.Fprintf(&manifest, "skipped %s\n", skipped)
+	}
+	f, err := w.zip.CreateHeader(&zip.FileHeader{Name: ManifestName, Method: zip.Deflate, Modified: w.created})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(manifest.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := w.zip.Close(); err != nil {
+		return nil, err
+	}
+	return w.buf.Bytes(), nil
+}
@@ -0,0 +1,54 @@
+package bundle
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBundleCap(t *testing.T) {
+	w := New(10, time.Unix(1000, 0))
+	if !w.Add("small.txt", []byte("12345")) {
+		t.Fatal("small file left out")
+	}
+	if w.Add("large.txt", []byte("1234567890")) {
+		t.Fatal("file over the cap added")
+	}
+	if !w.AddJSON("stats.json", 1) {
+		t.Fatal("json left out")
+	}
+	data, err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(content)
+	}
+	if files["small.txt"] != "12345" || files["stats.json"] != "1\n" {
+		t.Fatalf("files = %v", files)
+	}
+	if _, ok := files["large.txt"]; ok {
+		t.Fatal("large file in the archive")
+	}
+	manifest := files[ManifestName]
+	for _, want := range []string{"file small.txt\n", "file stats.json\n", "skipped large.txt: 10 bytes, over the 10 byte cap\n"} {
+		if !strings.Contains(manifest, want) {
+			t.Fatalf("manifest missing %q:\n%s", want, manifest)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package captions
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWAV(t *testing.T) {
+	wav := WAV([]byte{1, 2, 3, 4})
+	if len(wav) != 48 || string(wav[:4]) != "RIFF" || string(wav[8:16]) != "WAVEfmt " || wav[40] != 4 || !bytes.Equal(wav[44:], []byte{1, 2, 3, 4}) {
+		t.Fatalf("wav %x", wav)
+	}
+}
+
+func TestWhisper(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, _, err := r.FormFile("file")
+		if err != nil || r.FormValue("model") != "whisper-1" || r.FormValue("language") != "fr" || r.Header.Get("Authorization") != "Bearer k" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		wav, _ := ioutil.ReadAll(file)
+		if !bytes.Equal(wav[44:], []byte{0, 1}) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"text":" bonjour "}`))
+	}))
+	defer server.Close()
+	provider := &Whisper{URL: server.URL, APIKey: "k"}
+	if text, err := provider.Transcribe(context.Background(), []byte{0, 1}, "fr-FR"); err != nil || text != "bonjour" {
+		t.Fatalf("text %q, %v", text, err)
+	}
+	provider.APIKey = "other"
+	if _, err := provider.Transcribe(context.Background(), []byte{0, 1}, "fr"); err == nil {
+		t.Fatal("refusal not reported")
+	}
+}
+
+func TestGoogle(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Config struct {
+				LanguageCode    string
+				SampleRateHertz int
+			}
+			Audio struct{ Content string }
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if r.Header.Get("X-Goog-Api-Key") != "k" || req.Config.LanguageCode != "en-US" || req.Config.SampleRateHertz != SampleRate ||
+			req.Audio.Content != base64.StdEncoding.EncodeToString([]byte{0, 1}) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"results":[{"alternatives":[{"transcript":"hello"}]},{"alternatives":[{"transcript":" world"}]}]}`))
+	}))
+	defer server.Close()
+	provider := &Google{URL: server.URL, APIKey: "k"}
+	if text, err := provider.Transcribe(context.Background(), []byte{0, 1}, ""); err != nil || text != "hello world" {
+		t.Fatalf("text %q, %v", text, err)
+	}
+}
+
+func TestSegment(t *testing.T) {
+	cues := []Cue{
+		{Start: 0, End: 3 * time.Second, Text: "before"},
+		{Start: 3 * time.Second, End: 6 * time.Second, Text: "a <b> & c"},
+		{Start: time.Hour + 5*time.Second + 250*time.Millisecond, End: time.Hour + 8*time.Second, Text: "late"},
+	}
+	vtt := string(Segment(cues, 4*time.Second, 6*time.Second, 900000))
+	want := "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:00.000\n\n00:00:03.000 --> 00:00:06.000\na &lt;b&gt; &amp; c\n"
+	if vtt != want {
+		t.Fatalf("segment\n%s\nwant\n%s", vtt, want)
+	}
+	if vtt := string(Segment(cues, time.Hour, time.Hour+6*time.Second, 0)); !bytes.Contains([]byte(vtt), []byte("01:00:05.250 --> 01:00:08.000\nlate")) {
+		t.Fatalf("segment\n%s", vtt)
+	}
+}
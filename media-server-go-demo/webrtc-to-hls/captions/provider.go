@@ -0,0 +1,164 @@
+// Package captions turns the speech of a live stream into captions: a
+// Provider transcribes chunks of its audio, the cues it returns are written
+// as WebVTT segments for HLS players.
+package captions
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"strings"
+)
+
+// SampleRate is the rate of the audio providers transcribe: 16-bit little
+// endian mono PCM, what speech models are trained on
+const SampleRate = 16000
+
+// Provider transcribes speech
+type Provider interface {
+	// Transcribe returns the text spoken in pcm, empty for silence;
+	// language is a BCP 47 tag, e.g. en-US
+	Transcribe(ctx context.Context, pcm []byte, language string) (string, error)
+}
+
+// WAV wraps pcm in a WAV file
+func WAV(pcm []byte) []byte {
+	header := []byte("RIFF")
+	header = binary.LittleEndian.AppendUint32(header, uint32(36+len(pcm)))
+	header = append(header, "WAVEfmt "...)
+	header = binary.LittleEndian.AppendUint32(header, 16)
+	// PCM, one channel
+	header = binary.LittleEndian.AppendUint16(header, 1)
+	header = binary.LittleEndian.AppendUint16(header, 1)
+	header = binary.LittleEndian.AppendUint32(header, SampleRate)
+	header = binary.LittleEndian.AppendUint32(header, SampleRate*2)
+	header = binary.LittleEndian.AppendUint16(header, 2)
+	header = binary.LittleEndian.AppendUint16(header, 16)
+	header = append(header, "data"...)
+	header = binary.LittleEndian.AppendUint32(header, uint32(len(pcm)))
+	return append(header, pcm...)
+}
+
+// Whisper transcribes with the audio transcriptions API of OpenAI, which
+// self-hosted Whisper servers such as faster-whisper-server implement too
+type Whisper struct {
+	// URL defaults to https://api.openai.com/v1/audio/transcriptions
+	URL    string
+	APIKey string
+	// Model defaults to whisper-1
+	Model  string
+	Client *http.Client
+}
+
+func (w *Whisper) Transcribe(ctx context.Context, pcm []byte, language string) (string, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	model := w.Model
+	if model == "" {
+		model = "whisper-1"
+	}
+	form.WriteField("model", model)
+	// Whisper takes ISO 639-1 languages
+	if lang := strings.SplitN(language, "-", 2)[0]; lang != "" {
+		form.WriteField("language", lang)
+	}
+	form.WriteField("response_format", "json")
+	file, _ := form.CreateFormFile("file", "speech.wav")
+	file.Write(WAV(pcm))
+	form.Close()
+
+	url := w.URL
+	if url == "" {
+		url = "https://api.openai.com/v1/audio/transcriptions"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	if w.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+w.APIKey)
+	}
+	var answer struct {
+		Text string `json:"text"`
+	}
+	if err := do(w.Client, req, &answer); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(answer.Text), nil
+}
+
+// Google transcribes with the recognize method of the Google Cloud
+// Speech-to-Text REST API
+type Google struct {
+	// URL defaults to https://speech.googleapis.com/v1/speech:recognize
+	URL    string
+	APIKey string
+	Client *http.Client
+}
+
+func (g *Google) Transcribe(ctx context.Context, pcm []byte, language string) (string, error) {
+	url := g.URL
+	if url == "" {
+		url = "https://speech.googleapis.com/v1/speech:recognize"
+	}
+	if language == "" {
+		language = "en-US"
+	}
+	request, _ := json.Marshal(map[string]interface{}{
+		"config": map[string]interface{}{
+			"encoding":                   "LINEAR16",
+			"sampleRateHertz":            SampleRate,
+			"languageCode":               language,
+			"enableAutomaticPunctuation": true,
+		},
+		"audio": map[string]string{"content": base64.StdEncoding.EncodeToString(pcm)},
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(request))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Goog-Api-Key", g.APIKey)
+	var answer struct {
+		Results []struct {
+			Alternatives []struct {
+				Transcript string `json:"transcript"`
+			} `json:"alternatives"`
+		} `json:"results"`
+	}
+	if err := do(g.Client, req, &answer); err != nil {
+		return "", err
+	}
+	var text []string
+	for _, r := range answer.Results {
+		if len(r.Alternatives) > 0 {
+			text = append(text, strings.TrimSpace(r.Alternatives[0].Transcript))
+		}
+	}
+	return strings.Join(text, " "), nil
+}
+
+// do sends req and decodes its JSON answer into v
+func do(client *http.Client, req *http.Request, v interface{}) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("captions: %s answered %d: %s", req.URL.Host, resp.StatusCode, bytes.TrimSpace(message))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
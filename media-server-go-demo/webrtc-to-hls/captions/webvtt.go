@@ -0,0 +1,37 @@
+package captions
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Cue is a caption, timed on the output from its start
+type Cue struct {
+	Start, End time.Duration
+	Text       string
+}
+
+// Segment writes the WebVTT segment of the cues overlapping from until to.
+// Its X-TIMESTAMP-MAP maps the start of the output to base, the PTS of its
+// media segments there in 90kHz units, for players to sync the cues with.
+func Segment(cues []Cue, from, to time.Duration, base int64) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:%d,LOCAL:00:00:00.000\n", base)
+	for _, c := range cues {
+		if c.End <= from || c.Start >= to || c.Text == "" {
+			continue
+		}
+		fmt.Fprintf(&b, "\n%s --> %s\n%s\n", timestamp(c.Start), timestamp(c.End), escape(c.Text))
+	}
+	return []byte(b.String())
+}
+
+// timestamp formats d as a WebVTT timestamp, hh:mm:ss.ttt
+func timestamp(d time.Duration) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// escape makes text cue text: no markup, no blank line ending the cue
+var escape = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\n\n", "\n", "-->", "->").Replace
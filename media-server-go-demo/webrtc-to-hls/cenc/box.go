@@ -0,0 +1,129 @@
+package cenc
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// box is an ISOBMFF box. The boxes encryption rewrites are parsed down to
+// their children, every other box is kept as its payload.
+type box struct {
+	typ string
+	// offset is where the box started in the file it was parsed from
+	offset int
+	// head is what a container has ahead of its children, e.g. the entry
+	// count of stsd or the fields of a sample entry
+	head     []byte
+	children []*box
+	// payload is the content of a box that was not parsed
+	payload []byte
+}
+
+// heads are the sizes of what containers have ahead of their children
+var heads = map[string]int{
+	"moov": 0, "trak": 0, "mdia": 0, "minf": 0, "stbl": 0,
+	"moof": 0, "traf": 0, "sinf": 0, "schi": 0,
+	// a full box and its entry count
+	"stsd": 8,
+	// SampleEntry and VisualSampleEntry, ISO/IEC 14496-12 12.1.3
+	"avc1": 78, "avc3": 78, "encv": 78,
+}
+
+// parseBoxes parses the boxes of data, which start at offset in their file
+func parseBoxes(data []byte, offset int) ([]*box, error) {
+	var boxes []*box
+	for pos := 0; pos < len(data); {
+		if len(data)-pos < 8 {
+			return nil, fmt.Errorf("cenc: truncated box header at %d", offset+pos)
+		}
+		size := int(binary.BigEndian.Uint32(data[pos:]))
+		typ := string(data[pos+4 : pos+8])
+		header := 8
+		switch size {
+		case 0:
+			size = len(data) - pos
+		case 1:
+			if len(data)-pos < 16 {
+				return nil, fmt.Errorf("cenc: truncated %s at %d", typ, offset+pos)
+			}
+			large := binary.BigEndian.Uint64(data[pos+8:])
+			if large > uint64(len(data)-pos) {
+				return nil, fmt.Errorf("cenc: %s at %d overruns its parent", typ, offset+pos)
+			}
+			size, header = int(large), 16
+		}
+		if size < header || size > len(data)-pos {
+			return nil, fmt.Errorf("cenc: %s at %d has size %d", typ, offset+pos, size)
+		}
+		b := &box{typ: typ, offset: offset + pos}
+		content := data[pos+header : pos+size]
+		if head, ok := heads[typ]; ok {
+			if len(content) < head {
+				return nil, fmt.Errorf("cenc: truncated %s at %d", typ, offset+pos)
+			}
+			b.head = content[:head]
+			children, err := parseBoxes(content[head:], offset+pos+header+head)
+			if err != nil {
+				return nil, err
+			}
+			b.children = children
+		} else {
+			b.payload = content
+		}
+		boxes = append(boxes, b)
+		pos += size
+	}
+	return boxes, nil
+}
+
+// container reports whether b was parsed down to its children
+func (b *box) container() bool {
+	_, ok := heads[b.typ]
+	return ok
+}
+
+// child returns the first child of b of type typ
+func (b *box) child(typ string) *box {
+	for _, c := range b.children {
+		if c.typ == typ {
+			return c
+		}
+	}
+	return nil
+}
+
+// size is the size b is written with
+func (b *box) size() int {
+	size := 8 + len(b.head) + len(b.payload)
+	for _, c := range b.children {
+		size += c.size()
+	}
+	return size
+}
+
+// appendTo writes b to out
+func (b *box) appendTo(out []byte) []byte {
+	out = binary.BigEndian.AppendUint32(out, uint32(b.size()))
+	out = append(out, b.typ...)
+	out = append(out, b.head...)
+	out = append(out, b.payload...)
+	for _, c := range b.children {
+		out = c.appendTo(out)
+	}
+	return out
+}
+
+// fullBox returns a box of typ with the version and flags of a full box
+// ahead of payload
+func fullBox(typ string, version byte, flags uint32, payload []byte) *box {
+	head := binary.BigEndian.AppendUint32(nil, uint32(version)<<24|flags&0xffffff)
+	return &box{typ: typ, payload: append(head, payload...)}
+}
+
+func writeBoxes(boxes []*box) []byte {
+	var out []byte
+	for _, b := range boxes {
+		out = b.appendTo(out)
+	}
+	return out
+}
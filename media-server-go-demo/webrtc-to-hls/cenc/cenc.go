@@ -0,0 +1,109 @@
+// Package cenc protects fMP4 segments with Common Encryption (ISO/IEC
+// 23001-7), so they can be played through DRM systems such as Widevine and
+// FairPlay, or with a clear key. It rewrites segments as they are: the
+// initialization section gets the protection scheme and the systems' pssh
+// boxes, media segments get their samples encrypted and described by senc,
+// saiz and saio.
+//
+// Keys come from a KeyProvider, the hook a deployment plugs its key
+// server into, much like SPEKE: given a stream and an output generation it
+// returns the key, its id and the data each DRM system needs to acquire it.
+package cenc
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Scheme is a protection scheme of Common Encryption
+type Scheme string
+
+const (
+	// CENC encrypts with AES-CTR: Widevine, PlayReady and clear key
+	CENC Scheme = "cenc"
+	// CBCS encrypts one block in ten with AES-CBC: FairPlay, and Widevine
+	// on recent players
+	CBCS Scheme = "cbcs"
+)
+
+// SystemID identifies a DRM system
+type SystemID [16]byte
+
+// the DRM systems of the DASH-IF registry keys are commonly issued for
+var (
+	Widevine  = mustSystem("edef8ba9-79d6-4ace-a3c8-27dcd51d21ed")
+	PlayReady = mustSystem("9a04f079-9840-4286-ab92-e65be0885f95")
+	FairPlay  = mustSystem("94ce86fb-07ff-4f43-adb8-93d2fa968ca2")
+	// ClearKey is the W3C common system, whose pssh lists key ids
+	ClearKey = mustSystem("1077efec-c0b2-4d02-ace3-3c1e52e2fb4b")
+)
+
+// ParseSystemID parses a system id written as a UUID
+func ParseSystemID(s string) (SystemID, error) {
+	var id SystemID
+	b, err := hex.DecodeString(strings.Replace(s, "-", "", -1))
+	if err != nil || len(b) != len(id) {
+		return id, fmt.Errorf("cenc: system id %q is not a uuid", s)
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
+func mustSystem(s string) SystemID {
+	id, err := ParseSystemID(s)
+	if err != nil {
+		panic(err)
+	}
+	return id
+}
+
+// String writes id as a UUID
+func (id SystemID) String() string {
+	return uuid(id[:])
+}
+
+func uuid(b []byte) string {
+	h := hex.EncodeToString(b)
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// KeyID identifies a content key
+type KeyID [16]byte
+
+func (id KeyID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// UUID writes id as a UUID, the default_KID of DASH manifests
+func (id KeyID) UUID() string {
+	return uuid(id[:])
+}
+
+// System is what a DRM system needs to acquire a key
+type System struct {
+	ID SystemID
+	// Data is the system specific data of its pssh box, if any
+	Data []byte
+	// KeyIDs are listed by a version 1 pssh box, e.g. by ClearKey
+	KeyIDs []KeyID
+	// URI is where HLS players acquire the key, e.g. the skd:// URI of
+	// FairPlay. Empty, players are given the pssh box as a data URI.
+	URI string
+}
+
+// Key is the content key of a stream
+type Key struct {
+	ID  KeyID
+	Key [16]byte
+	// IV is the constant IV of CBCS, CENC IVs are per sample
+	IV      [16]byte
+	Systems []System
+}
+
+// KeyProvider returns the key of the output generation of a stream. A key
+// is asked for over and over, once per segment served; see Cached.
+type KeyProvider interface {
+	Key(ctx context.Context, stream string, generation int64) (*Key, error)
+}
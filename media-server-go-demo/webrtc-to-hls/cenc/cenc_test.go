@@ -0,0 +1,255 @@
+package cenc
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func raw(typ string, payload []byte) *box {
+	return &box{typ: typ, payload: payload}
+}
+
+func nest(typ string, head []byte, children ...*box) *box {
+	return &box{typ: typ, head: head, children: children}
+}
+
+// testInit is an initialization section of one H.264 track
+func testInit() []byte {
+	avc1 := nest("avc1", make([]byte, 78), raw("avcC", []byte{1, 0x42, 0xe0, 0x1f, 0xff}))
+	stsd := nest("stsd", []byte{0, 0, 0, 0, 0, 0, 0, 1}, avc1)
+	trak := nest("trak", nil, raw("tkhd", make([]byte, 84)),
+		nest("mdia", nil, raw("mdhd", make([]byte, 24)),
+			nest("minf", nil, nest("stbl", nil, stsd, raw("stts", make([]byte, 8))))))
+	moov := nest("moov", nil, raw("mvhd", make([]byte, 100)), trak, raw("mvex", make([]byte, 32)))
+	return writeBoxes([]*box{raw("ftyp", []byte("iso6\x00\x00\x00\x00iso6cmfc")), moov})
+}
+
+// nal returns a length prefixed NAL unit of type typ and size bytes
+func nal(typ byte, size int) []byte {
+	unit := binary.BigEndian.AppendUint32(nil, uint32(size))
+	unit = append(unit, typ)
+	for i := 1; i < size; i++ {
+		unit = append(unit, byte(i))
+	}
+	return unit
+}
+
+// testSegment is a fragment of samples, whose trun lists sample sizes and
+// points at the mdat
+func testSegment(samples ...[]byte) []byte {
+	tfhd := fullBox("tfhd", 0, 0x20000, []byte{0, 0, 0, 1})
+	// the sample count, then the data offset, set once the moof is laid out
+	trun := binary.BigEndian.AppendUint32(nil, uint32(len(samples)))
+	trun = append(trun, 0, 0, 0, 0)
+	var mdat []byte
+	for _, s := range samples {
+		trun = binary.BigEndian.AppendUint32(trun, uint32(len(s)))
+		mdat = append(mdat, s...)
+	}
+	trunBox := fullBox("trun", 0, 0x201, trun)
+	moof := nest("moof", nil, fullBox("mfhd", 0, 0, []byte{0, 0, 0, 1}),
+		nest("traf", nil, tfhd, fullBox("tfdt", 1, 0, make([]byte, 8)), trunBox))
+	binary.BigEndian.PutUint32(trunBox.payload[8:], uint32(moof.size()+8))
+	return writeBoxes([]*box{raw("styp", []byte("msdh\x00\x00\x00\x00msdh")), moof, raw("mdat", mdat)})
+}
+
+// decrypt undoes EncryptSegment from what it describes in senc and saio
+func decrypt(t *testing.T, segment []byte, scheme Scheme, key *Key) [][]byte {
+	t.Helper()
+	boxes, err := parseBoxes(segment, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := aes.NewCipher(key.Key[:])
+	var samples [][]byte
+	for _, moof := range boxes {
+		if moof.typ != "moof" {
+			continue
+		}
+		traf := moof.child("traf")
+		located, err := samplesOf(traf, moof.offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		senc, saio := traf.child("senc"), traf.child("saio")
+		info := moof.offset + int(binary.BigEndian.Uint32(saio.payload[8:]))
+		if !bytes.Equal(segment[info:info+8], senc.payload[8:16]) && scheme == CENC {
+			t.Fatalf("saio points at %d, not at the first sample's information", info)
+		}
+		p := senc.payload[8:]
+		for i, at := range located.positions {
+			sample := append([]byte(nil), segment[at:at+located.sizes[i]]...)
+			var ctr cipher.Stream
+			if scheme == CENC {
+				counter := make([]byte, 16)
+				copy(counter, p[:8])
+				p = p[8:]
+				ctr = cipher.NewCTR(block, counter)
+			}
+			count := int(binary.BigEndian.Uint16(p))
+			p = p[2:]
+			pos := 0
+			for j := 0; j < count; j++ {
+				clear, protected := int(binary.BigEndian.Uint16(p)), int(binary.BigEndian.Uint32(p[2:]))
+				p = p[6:]
+				pos += clear
+				run := sample[pos : pos+protected]
+				pos += protected
+				if scheme == CENC {
+					ctr.XORKeyStream(run, run)
+					continue
+				}
+				cbc := cipher.NewCBCDecrypter(block, key.IV[:])
+				for off := 0; off+16 <= len(run); off += 160 {
+					cbc.CryptBlocks(run[off:off+16], run[off:off+16])
+				}
+			}
+			if pos != len(sample) {
+				t.Fatalf("subsamples cover %d of %d bytes", pos, len(sample))
+			}
+			samples = append(samples, sample)
+		}
+	}
+	return samples
+}
+
+func TestEncryptInit(t *testing.T) {
+	key, _ := (&ClearKeys{Secret: []byte("s")}).Key(context.Background(), "show", 7)
+	for _, scheme := range []Scheme{CENC, CBCS} {
+		init, err := EncryptInit(testInit(), scheme, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		boxes, err := parseBoxes(init, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		moov := boxes[1]
+		encv := descend(moov, "trak", "mdia", "minf", "stbl", "stsd", "encv")
+		if encv == nil || encv.child("avcC") == nil {
+			t.Fatalf("%s: no encv entry", scheme)
+		}
+		sinf := encv.child("sinf")
+		if string(sinf.child("frma").payload) != "avc1" || string(sinf.child("schm").payload[4:8]) != string(scheme) {
+			t.Fatalf("%s: sinf %+v", scheme, sinf)
+		}
+		tenc := descend(sinf, "schi", "tenc").payload
+		if !bytes.Equal(tenc[8:24], key.ID[:]) || tenc[6] != 1 {
+			t.Fatalf("%s: tenc %x", scheme, tenc)
+		}
+		if scheme == CBCS && (tenc[5] != 0x19 || tenc[7] != 0 || !bytes.Equal(tenc[25:41], key.IV[:])) {
+			t.Fatalf("cbcs tenc %x", tenc)
+		}
+		pssh := moov.child("pssh")
+		if pssh == nil || !bytes.Equal(pssh.payload[4:20], ClearKey[:]) || !bytes.Equal(pssh.payload[24:40], key.ID[:]) {
+			t.Fatalf("%s: pssh %+v", scheme, pssh)
+		}
+	}
+	if _, err := EncryptInit(writeBoxes([]*box{nest("moov", nil)}), CENC, key); err != ErrNoVideo {
+		t.Fatalf("init without video: %v", err)
+	}
+}
+
+func TestEncryptSegment(t *testing.T) {
+	key, _ := (&ClearKeys{Secret: []byte("s")}).Key(context.Background(), "show", 7)
+	// SPS, PPS and an IDR slice, then a slice with a partial block
+	samples := [][]byte{
+		append(append(nal(7, 20), nal(8, 6)...), nal(5, 1000)...),
+		nal(1, 333),
+		nal(1, 12),
+	}
+	plain := testSegment(samples...)
+	for _, scheme := range []Scheme{CENC, CBCS} {
+		sealed, err := EncryptSegment(plain, scheme, key, 42)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(sealed, samples[0][40:200]) {
+			t.Fatalf("%s: slice left in the clear", scheme)
+		}
+		opened := decrypt(t, sealed, scheme, key)
+		if len(opened) != len(samples) {
+			t.Fatalf("%s: %d samples", scheme, len(opened))
+		}
+		for i := range samples {
+			if !bytes.Equal(opened[i], samples[i]) {
+				t.Fatalf("%s: sample %d does not decrypt", scheme, i)
+			}
+		}
+	}
+	subs, _ := subsamples(samples[0])
+	if len(subs) != 1 || subs[0].clear != 24+10+4+32+8 || subs[0].protected != 960 {
+		t.Fatalf("subsamples %+v", subs)
+	}
+	if _, err := subsamples([]byte{0, 0, 1, 0, 5}); err != ErrNALOverruns {
+		t.Fatalf("overrun: %v", err)
+	}
+}
+
+func TestClearKeyLicense(t *testing.T) {
+	keys := &ClearKeys{Secret: []byte("s")}
+	key, _ := keys.Key(context.Background(), "show", 7)
+	kid := base64.RawURLEncoding.EncodeToString(key.ID[:])
+	license, err := keys.License("show", 7, []byte(`{"kids":["`+kid+`","other"],"type":"temporary"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var answer struct {
+		Keys []struct{ Kty, KID, K string }
+	}
+	json.Unmarshal(license, &answer)
+	if len(answer.Keys) != 1 || answer.Keys[0].KID != kid || answer.Keys[0].K != base64.RawURLEncoding.EncodeToString(key.Key[:]) {
+		t.Fatalf("license %s", license)
+	}
+	if other, _ := keys.License("show", 8, []byte(`{"kids":["`+kid+`"]}`)); !bytes.Contains(other, []byte(`"keys":[]`)) {
+		t.Fatalf("key of another generation licensed: %s", other)
+	}
+}
+
+func TestHTTPProvider(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		var req struct {
+			Stream     string
+			Generation int64
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Stream != "show" || req.Generation != 7 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"keyId":"00112233445566778899aabbccddeeff","key":"0f0e0d0c0b0a09080706050403020100",
+			"systems":[{"systemId":"edef8ba9-79d6-4ace-a3c8-27dcd51d21ed","pssh":"CAESEA=="},
+			{"systemId":"94ce86fb-07ff-4f43-adb8-93d2fa968ca2","uri":"skd://show-7"}]}`))
+	}))
+	defer server.Close()
+	provider := Cached(&HTTPProvider{URL: server.URL, Client: server.Client()})
+	for i := 0; i < 2; i++ {
+		key, err := provider.Key(context.Background(), "show", 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key.ID.String() != "00112233445566778899aabbccddeeff" || key.Key[0] != 0x0f || len(key.Systems) != 2 ||
+			key.Systems[0].ID != Widevine || !bytes.Equal(key.Systems[0].Data, []byte{8, 1, 18, 16}) || key.Systems[1].URI != "skd://show-7" {
+			t.Fatalf("key %+v", key)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("%d calls to the key server", calls)
+	}
+	if _, err := provider.Key(context.Background(), "other", 7); err == nil {
+		t.Fatal("refused key accepted")
+	}
+	if Widevine.String() != "edef8ba9-79d6-4ace-a3c8-27dcd51d21ed" {
+		t.Fatalf("system id %s", Widevine)
+	}
+}
@@ -0,0 +1,363 @@
+package cenc
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrNoVideo     = errors.New("cenc: no H.264 sample entry to protect")
+	ErrBaseOffset  = errors.New("cenc: explicit base data offsets are not supported")
+	ErrNALOverruns = errors.New("cenc: NAL unit overruns its sample")
+)
+
+// clearLead is how much of a slice NAL unit is left clear, its header and
+// the slice header in all but odd cases, which decoders parse ahead of
+// decryption
+const clearLead = 32
+
+// pattern of CBCS: one block encrypted, nine skipped (ISO/IEC 23001-7 10.4)
+const (
+	cryptBlocks = 1
+	skipBlocks  = 9
+)
+
+// nalLength is the size of the length prefixes of NAL units in samples,
+// what muxers write
+const nalLength = 4
+
+// PSSH returns the pssh box of system, version 1 when it lists key ids
+func PSSH(system System) []byte {
+	payload := append([]byte(nil), system.ID[:]...)
+	version := byte(0)
+	if len(system.KeyIDs) > 0 {
+		version = 1
+		payload = binary.BigEndian.AppendUint32(payload, uint32(len(system.KeyIDs)))
+		for _, kid := range system.KeyIDs {
+			payload = append(payload, kid[:]...)
+		}
+	}
+	payload = binary.BigEndian.AppendUint32(payload, uint32(len(system.Data)))
+	payload = append(payload, system.Data...)
+	return fullBox("pssh", version, 0, payload).appendTo(nil)
+}
+
+// EncryptInit protects the initialization section init: its H.264 sample
+// entries become encv entries naming the scheme and the key id, and the
+// pssh boxes of the systems of key follow the tracks
+func EncryptInit(init []byte, scheme Scheme, key *Key) ([]byte, error) {
+	boxes, err := parseBoxes(init, 0)
+	if err != nil {
+		return nil, err
+	}
+	var moov *box
+	for _, b := range boxes {
+		if b.typ == "moov" {
+			moov = b
+		}
+	}
+	if moov == nil {
+		return nil, errors.New("cenc: no moov box")
+	}
+	protected := 0
+	for _, trak := range moov.children {
+		if trak.typ != "trak" {
+			continue
+		}
+		stsd := descend(trak, "mdia", "minf", "stbl", "stsd")
+		if stsd == nil {
+			continue
+		}
+		for _, entry := range stsd.children {
+			if entry.typ != "avc1" && entry.typ != "avc3" {
+				continue
+			}
+			entry.children = append(entry.children, sinf(entry.typ, scheme, key))
+			entry.typ = "encv"
+			protected++
+		}
+	}
+	if protected == 0 {
+		return nil, ErrNoVideo
+	}
+	for _, system := range key.Systems {
+		pssh, _ := parseBoxes(PSSH(system), 0)
+		moov.children = append(moov.children, pssh...)
+	}
+	return writeBoxes(boxes), nil
+}
+
+// descend returns the box at the path of types below b
+func descend(b *box, path ...string) *box {
+	for _, typ := range path {
+		if b = b.child(typ); b == nil {
+			return nil
+		}
+	}
+	return b
+}
+
+// sinf describes the protection of a sample entry of format
+func sinf(format string, scheme Scheme, key *Key) *box {
+	schm := fullBox("schm", 0, 0, binary.BigEndian.AppendUint32([]byte(scheme), 0x00010000))
+	var tenc *box
+	if scheme == CBCS {
+		// pattern encryption with a constant IV, none per sample
+		payload := []byte{0, cryptBlocks<<4 | skipBlocks, 1, 0}
+		payload = append(payload, key.ID[:]...)
+		payload = append(payload, byte(len(key.IV)))
+		tenc = fullBox("tenc", 1, 0, append(payload, key.IV[:]...))
+	} else {
+		tenc = fullBox("tenc", 0, 0, append([]byte{0, 0, 1, 8}, key.ID[:]...))
+	}
+	return &box{typ: "sinf", children: []*box{
+		{typ: "frma", payload: []byte(format)},
+		schm,
+		{typ: "schi", children: []*box{tenc}},
+	}}
+}
+
+// subsample is a run of clear bytes followed by a run of protected ones
+type subsample struct {
+	clear     int
+	protected int
+}
+
+// subsamples splits an H.264 sample into the runs left clear and those
+// encrypted: the protected part of a slice is what follows its clear lead,
+// in whole blocks; other NAL units stay clear
+func subsamples(sample []byte) ([]subsample, error) {
+	var subs []subsample
+	clear := 0
+	for pos := 0; pos < len(sample); {
+		if len(sample)-pos < nalLength {
+			return nil, ErrNALOverruns
+		}
+		n := int(binary.BigEndian.Uint32(sample[pos:]))
+		if n > len(sample)-pos-nalLength {
+			return nil, ErrNALOverruns
+		}
+		protected := 0
+		if nalType := sample[pos+nalLength] & 0x1f; n > clearLead && nalType >= 1 && nalType <= 5 {
+			protected = (n - clearLead) &^ (aes.BlockSize - 1)
+		}
+		clear += nalLength + n - protected
+		if protected > 0 {
+			for ; clear > 0xffff; clear -= 0xffff {
+				subs = append(subs, subsample{clear: 0xffff})
+			}
+			subs = append(subs, subsample{clear: clear, protected: protected})
+			clear = 0
+		}
+		pos += nalLength + n
+	}
+	for ; clear > 0xffff; clear -= 0xffff {
+		subs = append(subs, subsample{clear: 0xffff})
+	}
+	if clear > 0 || len(subs) == 0 {
+		subs = append(subs, subsample{clear: clear})
+	}
+	return subs, nil
+}
+
+// encryptSample encrypts the protected runs of sample in place. CENC runs
+// one AES-CTR keystream from iv over all of them, CBCS restarts the chain
+// at each run with the constant IV of the key and encrypts its pattern.
+func encryptSample(block cipher.Block, scheme Scheme, key *Key, iv uint64, sample []byte, subs []subsample) {
+	var ctr cipher.Stream
+	if scheme == CENC {
+		counter := make([]byte, aes.BlockSize)
+		binary.BigEndian.PutUint64(counter, iv)
+		ctr = cipher.NewCTR(block, counter)
+	}
+	pos := 0
+	for _, s := range subs {
+		pos += s.clear
+		run := sample[pos : pos+s.protected]
+		pos += s.protected
+		if scheme == CENC {
+			ctr.XORKeyStream(run, run)
+			continue
+		}
+		cbc := cipher.NewCBCEncrypter(block, key.IV[:])
+		for off := 0; off+aes.BlockSize <= len(run); off += (cryptBlocks + skipBlocks) * aes.BlockSize {
+			crypt := run[off : off+cryptBlocks*aes.BlockSize]
+			cbc.CryptBlocks(crypt, crypt)
+		}
+	}
+}
+
+// trafSamples are the samples a traf describes
+type trafSamples struct {
+	// truns are the trun boxes whose data offset is patched
+	truns []*box
+	// positions and sizes of the samples in the segment
+	positions []int
+	sizes     []int
+}
+
+// samplesOf locates the samples of traf, whose moof starts at moofStart
+func samplesOf(traf *box, moofStart int) (*trafSamples, error) {
+	tfhd := traf.child("tfhd")
+	if tfhd == nil || len(tfhd.payload) < 8 {
+		return nil, errors.New("cenc: traf without tfhd")
+	}
+	flags := binary.BigEndian.Uint32(tfhd.payload) & 0xffffff
+	if flags&0x1 != 0 {
+		return nil, ErrBaseOffset
+	}
+	defaultSize := 0
+	if flags&0x10 != 0 {
+		at := 8
+		for _, field := range []uint32{0x2, 0x8} {
+			if flags&field != 0 {
+				at += 4
+			}
+		}
+		if len(tfhd.payload) < at+4 {
+			return nil, errors.New("cenc: truncated tfhd")
+		}
+		defaultSize = int(binary.BigEndian.Uint32(tfhd.payload[at:]))
+	}
+	samples := &trafSamples{}
+	pos := moofStart
+	for _, trun := range traf.children {
+		if trun.typ != "trun" {
+			continue
+		}
+		p := trun.payload
+		if len(p) < 8 {
+			return nil, errors.New("cenc: truncated trun")
+		}
+		flags := binary.BigEndian.Uint32(p) & 0xffffff
+		count := int(binary.BigEndian.Uint32(p[4:]))
+		at := 8
+		if flags&0x1 != 0 {
+			pos = moofStart + int(int32(binary.BigEndian.Uint32(p[at:])))
+			samples.truns = append(samples.truns, trun)
+			at += 4
+		}
+		if flags&0x4 != 0 {
+			at += 4
+		}
+		for i := 0; i < count; i++ {
+			size := defaultSize
+			for _, field := range []uint32{0x100, 0x200, 0x400, 0x800} {
+				if flags&field == 0 {
+					continue
+				}
+				if len(p) < at+4 {
+					return nil, errors.New("cenc: truncated trun")
+				}
+				if field == 0x200 {
+					size = int(binary.BigEndian.Uint32(p[at:]))
+				}
+				at += 4
+			}
+			samples.positions = append(samples.positions, pos)
+			samples.sizes = append(samples.sizes, size)
+			pos += size
+		}
+	}
+	return samples, nil
+}
+
+// EncryptSegment protects the media segment segment: the samples of each
+// fragment are encrypted with key and described in the senc, saiz and saio
+// boxes added to their traf. CENC samples are given consecutive IVs from
+// iv, which must not repeat under the key; CBCS uses the constant IV.
+func EncryptSegment(segment []byte, scheme Scheme, key *Key, iv uint64) ([]byte, error) {
+	data := append([]byte(nil), segment...)
+	boxes, err := parseBoxes(data, 0)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key.Key[:])
+	if err != nil {
+		return nil, err
+	}
+	ivSize := 8
+	if scheme == CBCS {
+		ivSize = 0
+	}
+	for _, moof := range boxes {
+		if moof.typ != "moof" {
+			continue
+		}
+		size := moof.size()
+		var located []*trafSamples
+		for _, traf := range moof.children {
+			if traf.typ != "traf" {
+				continue
+			}
+			samples, err := samplesOf(traf, moof.offset)
+			if err != nil {
+				return nil, err
+			}
+			var senc, saiz []byte
+			senc = binary.BigEndian.AppendUint32(senc, uint32(len(samples.sizes)))
+			saiz = append(saiz, 0)
+			saiz = binary.BigEndian.AppendUint32(saiz, uint32(len(samples.sizes)))
+			for i, at := range samples.positions {
+				if at < 0 || at+samples.sizes[i] > len(data) {
+					return nil, fmt.Errorf("cenc: sample %d overruns the segment", i)
+				}
+				sample := data[at : at+samples.sizes[i]]
+				subs, err := subsamples(sample)
+				if err != nil {
+					return nil, err
+				}
+				info := 2 + 6*len(subs) + ivSize
+				if info > 0xff {
+					return nil, fmt.Errorf("cenc: sample %d has %d subsamples", i, len(subs))
+				}
+				saiz = append(saiz, byte(info))
+				if ivSize > 0 {
+					senc = binary.BigEndian.AppendUint64(senc, iv)
+				}
+				senc = binary.BigEndian.AppendUint16(senc, uint16(len(subs)))
+				for _, s := range subs {
+					senc = binary.BigEndian.AppendUint16(senc, uint16(s.clear))
+					senc = binary.BigEndian.AppendUint32(senc, uint32(s.protected))
+				}
+				encryptSample(block, scheme, key, iv, sample, subs)
+				iv++
+			}
+			// saio is filled in once the moof is laid out
+			traf.children = append(traf.children,
+				fullBox("senc", 0, 0x2, senc),
+				fullBox("saiz", 0, 0, saiz),
+				fullBox("saio", 0, 0, make([]byte, 8)))
+			located = append(located, samples)
+		}
+		growth := moof.size() - size
+		pos := 8
+		for _, traf := range moof.children {
+			if traf.typ != "traf" {
+				pos += traf.size()
+				continue
+			}
+			at := pos + 8
+			for _, c := range traf.children {
+				if c.typ == "senc" {
+					// the first sample's information, past the header, the
+					// version and flags and the sample count
+					binary.BigEndian.PutUint32(traf.child("saio").payload[4:], 1)
+					binary.BigEndian.PutUint32(traf.child("saio").payload[8:], uint32(at+16))
+				}
+				at += c.size()
+			}
+			pos += traf.size()
+		}
+		for _, samples := range located {
+			for _, trun := range samples.truns {
+				offset := int32(binary.BigEndian.Uint32(trun.payload[8:]))
+				binary.BigEndian.PutUint32(trun.payload[8:], uint32(offset+int32(growth)))
+			}
+		}
+	}
+	return writeBoxes(boxes), nil
+}
@@ -0,0 +1,204 @@
+package cenc
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// ClearKeys derives the keys of streams from Secret, for playback with a
+// clear key: players get the keys from a license endpoint of the server
+// instead of a DRM system. Every instance holding the secret derives the
+// same keys, nothing is stored.
+type ClearKeys struct {
+	Secret []byte
+}
+
+func (k *ClearKeys) derive(label, stream string, generation int64) []byte {
+	mac := hmac.New(sha256.New, k.Secret)
+	fmt.Fprintf(mac, "%s/%s/%d", label, stream, generation)
+	return mac.Sum(nil)
+}
+
+// Key derives the key of generation of stream, listed by a ClearKey pssh
+func (k *ClearKeys) Key(ctx context.Context, stream string, generation int64) (*Key, error) {
+	key := &Key{}
+	copy(key.ID[:], k.derive("kid", stream, generation))
+	copy(key.Key[:], k.derive("key", stream, generation))
+	copy(key.IV[:], k.derive("iv", stream, generation))
+	key.Systems = []System{{ID: ClearKey, KeyIDs: []KeyID{key.ID}}}
+	return key, nil
+}
+
+// License answers a W3C Clear Key license request (EME 9.1.3) for the keys
+// of generation of stream: the keys it asks for that are the key of the
+// generation. Requests for other keys get none.
+func (k *ClearKeys) License(stream string, generation int64, request []byte) ([]byte, error) {
+	var req struct {
+		KIDs []string `json:"kids"`
+		Type string   `json:"type"`
+	}
+	if err := json.Unmarshal(request, &req); err != nil {
+		return nil, fmt.Errorf("cenc: license request: %v", err)
+	}
+	key, _ := k.Key(context.Background(), stream, generation)
+	kid := base64.RawURLEncoding.EncodeToString(key.ID[:])
+	type jwk struct {
+		Kty string `json:"kty"`
+		KID string `json:"kid"`
+		K   string `json:"k"`
+	}
+	license := struct {
+		Keys []jwk  `json:"keys"`
+		Type string `json:"type,omitempty"`
+	}{Keys: []jwk{}, Type: req.Type}
+	for _, requested := range req.KIDs {
+		if requested == kid {
+			license.Keys = append(license.Keys, jwk{Kty: "oct", KID: kid, K: base64.RawURLEncoding.EncodeToString(key.Key[:])})
+		}
+	}
+	return json.Marshal(license)
+}
+
+// HTTPProvider asks a key server for keys, posting the stream and the
+// generation as JSON: {"stream": "studio-a", "generation": 1700000000}.
+// The server answers with the key, its id and the IV in hex, and what each
+// system needs:
+//
+//	{"keyId": "...", "key": "...", "iv": "...", "systems": [
+//	  {"systemId": "edef8ba9-79d6-4ace-a3c8-27dcd51d21ed", "pssh": "<base64>"},
+//	  {"systemId": "94ce86fb-07ff-4f43-adb8-93d2fa968ca2", "uri": "skd://..."}]}
+type HTTPProvider struct {
+	URL    string
+	Client *http.Client
+}
+
+type httpKey struct {
+	KeyID   string `json:"keyId"`
+	Key     string `json:"key"`
+	IV      string `json:"iv"`
+	Systems []struct {
+		SystemID string   `json:"systemId"`
+		PSSH     []byte   `json:"pssh"`
+		KeyIDs   []string `json:"keyIds"`
+		URI      string   `json:"uri"`
+	} `json:"systems"`
+}
+
+// Key posts the request of a key to the key server
+func (p *HTTPProvider) Key(ctx context.Context, stream string, generation int64) (*Key, error) {
+	body, _ := json.Marshal(map[string]interface{}{"stream": stream, "generation": generation})
+	req, err := http.NewRequest(http.MethodPost, p.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, fmt.Errorf("cenc: key server answered %s", resp.Status)
+	}
+	var answer httpKey
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return nil, fmt.Errorf("cenc: key server answer: %v", err)
+	}
+	key := &Key{}
+	if err := decodeHex(answer.KeyID, key.ID[:]); err != nil {
+		return nil, fmt.Errorf("cenc: keyId: %v", err)
+	}
+	if err := decodeHex(answer.Key, key.Key[:]); err != nil {
+		return nil, fmt.Errorf("cenc: key: %v", err)
+	}
+	if answer.IV != "" {
+		if err := decodeHex(answer.IV, key.IV[:]); err != nil {
+			return nil, fmt.Errorf("cenc: iv: %v", err)
+		}
+	}
+	for _, s := range answer.Systems {
+		id, err := ParseSystemID(s.SystemID)
+		if err != nil {
+			return nil, err
+		}
+		system := System{ID: id, Data: s.PSSH, URI: s.URI}
+		for _, kid := range s.KeyIDs {
+			var k KeyID
+			if err := decodeHex(kid, k[:]); err != nil {
+				return nil, fmt.Errorf("cenc: keyIds: %v", err)
+			}
+			system.KeyIDs = append(system.KeyIDs, k)
+		}
+		key.Systems = append(key.Systems, system)
+	}
+	return key, nil
+}
+
+func decodeHex(s string, into []byte) error {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	if len(b) != len(into) {
+		return fmt.Errorf("%d bytes, want %d", len(b), len(into))
+	}
+	copy(into, b)
+	return nil
+}
+
+// cachedKeys bounds the keys Cached keeps
+const cachedKeys = 256
+
+// Cached returns a provider asking p once for each key. The keys of the
+// generations asked for longest ago are forgotten past cachedKeys.
+func Cached(p KeyProvider) KeyProvider {
+	return &cache{provider: p, keys: make(map[cacheKey]*Key)}
+}
+
+type cacheKey struct {
+	stream     string
+	generation int64
+}
+
+type cache struct {
+	provider KeyProvider
+	lock     sync.Mutex
+	keys     map[cacheKey]*Key
+	order    []cacheKey
+}
+
+func (c *cache) Key(ctx context.Context, stream string, generation int64) (*Key, error) {
+	id := cacheKey{stream, generation}
+	c.lock.Lock()
+	key := c.keys[id]
+	c.lock.Unlock()
+	if key != nil {
+		return key, nil
+	}
+	key, err := c.provider.Key(ctx, stream, generation)
+	if err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.keys[id]; !ok {
+		c.order = append(c.order, id)
+		if len(c.order) > cachedKeys {
+			delete(c.keys, c.order[0])
+			c.order = c.order[1:]
+		}
+	}
+	c.keys[id] = key
+	return key, nil
+}
@@ -0,0 +1,375 @@
+// Package client implements the publisher side of the webrtc-to-hls
+// signaling protocol, so Go publishers don't have to re-implement it.
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// DefaultTimeout bounds writes and the close handshake
+const DefaultTimeout = 5 * time.Second
+
+// ServerError is an error message returned by the server
+type ServerError struct {
+	Reason string
+	// Code is the error code, if the server gave one
+	Code string
+}
+
+func (e *ServerError) Error() string {
+	return "client: server error: " + e.Reason
+}
+
+var (
+	ErrClosed         = errors.New("client: connection closed")
+	ErrOfferInFlight  = errors.New("client: offer already in flight")
+	ErrAlreadyStarted = errors.New("client: stream already published on this connection")
+	ErrNotPublished   = errors.New("client: no stream published on this connection")
+)
+
+type state int
+
+const (
+	stateConnected state = iota
+	stateOffering
+	statePublished
+	stateClosed
+)
+
+// Client is a signaling connection to the server; one stream is published per Client
+type Client struct {
+	conn   *websocket.Conn
+	events chan Message
+	// version is the protocol version spoken, Version2 when the url asks
+	// for it
+	version int
+
+	writeLock sync.Mutex
+
+	sync.Mutex
+	state state
+	// reply receives the answer or error for the offer in flight, the
+	// request of id in Version2
+	reply   chan Message
+	replyID string
+	// requests numbers the requests of Version2, for their ids
+	requests int
+	err      error
+	done     chan struct{}
+}
+
+// Dial opens the signaling websocket, e.g. ws://localhost:8000/channel. The
+// client speaks Version2 when the v query parameter of rawurl is 2, e.g.
+// ws://localhost:8000/channel?v=2, the server reading it too, and Version1
+// otherwise.
+func Dial(ctx context.Context, rawurl string, header http.Header) (*Client, error) {
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, rawurl, header)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{
+		conn:    conn,
+		events:  make(chan Message, 16),
+		version: urlVersion(rawurl),
+		done:    make(chan struct{}),
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+// urlVersion is the protocol version the v query parameter of rawurl asks
+// for, Version1 when none
+func urlVersion(rawurl string) int {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return Version1
+	}
+	if v, err := strconv.Atoi(u.Query().Get("v")); err == nil && v >= Version2 {
+		return Version2
+	}
+	return Version1
+}
+
+// expect has reply receive the reply to msg, given a request id in
+// Version2, with the client locked
+func (c *Client) expect(msg *Message, reply chan Message) {
+	c.reply = reply
+	c.replyID = ""
+	if c.version >= Version2 {
+		c.requests++
+		msg.ID = strconv.Itoa(c.requests)
+		c.replyID = msg.ID
+	}
+}
+
+// Offer is what Publish sends to the server
+type Offer struct {
+	StreamID string
+	Sdp      string
+	// ExternalID is the caller's own id of the content, unique among live
+	// streams
+	ExternalID string
+	// Latency is one of the Latency* presets, empty for the server default
+	Latency string
+	// ResumeToken is the token of a CmdMigrate event, when republishing a
+	// migrated stream on the target instance
+	ResumeToken string
+	// ReconnectToken is the SessionInfo.ReconnectToken of the latest
+	// answer, when publishing again after the connection dropped
+	ReconnectToken string
+	// Credential authenticates the publish, when the server requires it
+	Credential string
+}
+
+// Answer is the server's reply to an Offer
+type Answer struct {
+	Sdp     string
+	Preset  *Preset
+	Session *SessionInfo
+}
+
+// Publish sends the offer and waits for the answer; a rejected offer
+// returns a *ServerError
+func (c *Client) Publish(ctx context.Context, offer Offer) (*Answer, error) {
+	c.Lock()
+	switch c.state {
+	case stateOffering:
+		c.Unlock()
+		return nil, ErrOfferInFlight
+	case statePublished:
+		c.Unlock()
+		return nil, ErrAlreadyStarted
+	case stateClosed:
+		c.Unlock()
+		return nil, c.Err()
+	}
+	c.state = stateOffering
+	reply := make(chan Message, 1)
+	msg := Message{
+		Cmd:            CmdOffer,
+		Sdp:            offer.Sdp,
+		StreamID:       offer.StreamID,
+		ExternalID:     offer.ExternalID,
+		Latency:        offer.Latency,
+		Token:          offer.ResumeToken,
+		Credential:     offer.Credential,
+		ReconnectToken: offer.ReconnectToken,
+	}
+	c.expect(&msg, reply)
+	c.Unlock()
+
+	if err := c.send(msg); err != nil {
+		c.setState(stateConnected)
+		return nil, err
+	}
+
+	select {
+	case msg := <-reply:
+		if msg.Cmd == CmdError {
+			c.setState(stateConnected)
+			return nil, &ServerError{Reason: msg.Reason, Code: msg.Code}
+		}
+		c.setState(statePublished)
+		return &Answer{Sdp: msg.Sdp, Preset: msg.Preset, Session: msg.Session}, nil
+	case <-c.done:
+		return nil, c.Err()
+	case <-ctx.Done():
+		c.setState(stateConnected)
+		return nil, ctx.Err()
+	}
+}
+
+// Renegotiate offers the streams of the published stream anew, e.g. with a
+// screen share added, and returns the answer; the output goes on
+func (c *Client) Renegotiate(ctx context.Context, sdp string) (string, error) {
+	msg, err := c.request(ctx, Message{Cmd: CmdRenegotiate, Sdp: sdp})
+	if err != nil {
+		return "", err
+	}
+	return msg.Sdp, nil
+}
+
+// Update switches the output to the video of the published stream track,
+// its msid
+func (c *Client) Update(ctx context.Context, track string) error {
+	_, err := c.request(ctx, Message{Cmd: CmdUpdate, Track: track})
+	return err
+}
+
+// Candidate trickles an ICE candidate of the publisher, the SDP candidate
+// attribute; an empty one ends them. The server does not answer.
+func (c *Client) Candidate(candidate string) error {
+	return c.send(Message{Cmd: CmdCandidate, Candidate: candidate})
+}
+
+// request sends msg about the published stream and waits for its reply; a
+// refused request returns a *ServerError
+func (c *Client) request(ctx context.Context, msg Message) (Message, error) {
+	c.Lock()
+	switch {
+	case c.state == stateClosed:
+		c.Unlock()
+		return Message{}, c.Err()
+	case c.state != statePublished:
+		c.Unlock()
+		return Message{}, ErrNotPublished
+	case c.reply != nil:
+		c.Unlock()
+		return Message{}, ErrOfferInFlight
+	}
+	reply := make(chan Message, 1)
+	c.expect(&msg, reply)
+	c.Unlock()
+
+	if err := c.send(msg); err != nil {
+		c.dropReply(reply)
+		return Message{}, err
+	}
+	select {
+	case msg := <-reply:
+		if msg.Cmd == CmdError {
+			return Message{}, &ServerError{Reason: msg.Reason, Code: msg.Code}
+		}
+		return msg, nil
+	case <-c.done:
+		return Message{}, c.Err()
+	case <-ctx.Done():
+		c.dropReply(reply)
+		return Message{}, ctx.Err()
+	}
+}
+
+// dropReply stops waiting on reply
+func (c *Client) dropReply(reply chan Message) {
+	c.Lock()
+	if c.reply == reply {
+		c.reply = nil
+	}
+	c.Unlock()
+}
+
+// Events delivers server messages other than the answer; it is closed when
+// the connection ends. Events are dropped if the channel is not drained.
+func (c *Client) Events() <-chan Message {
+	return c.events
+}
+
+// Done is closed when the connection ends
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the connection ended, a *websocket.CloseError when the
+// server closed it (see CloseStreamBusy and CloseReplaced)
+func (c *Client) Err() error {
+	c.Lock()
+	defer c.Unlock()
+	if c.err == nil && c.state == stateClosed {
+		return ErrClosed
+	}
+	return c.err
+}
+
+// Close performs the websocket close handshake, waiting up to DefaultTimeout
+// or until ctx is done for the server to acknowledge
+func (c *Client) Close(ctx context.Context) error {
+	c.writeLock.Lock()
+	err := c.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(DefaultTimeout))
+	c.writeLock.Unlock()
+
+	select {
+	case <-c.done:
+		// the server already ended the connection
+		err = nil
+	default:
+	}
+
+	if err == nil {
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+		case <-time.After(DefaultTimeout):
+		}
+	}
+	c.conn.Close()
+	<-c.done
+	return err
+}
+
+// IsCloseCode reports whether err is a server close with one of codes
+func IsCloseCode(err error, codes ...int) bool {
+	return websocket.IsCloseError(err, codes...)
+}
+
+func (c *Client) send(msg Message) error {
+	data, err := EncodeMessage(msg, c.version)
+	if err != nil {
+		return err
+	}
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(DefaultTimeout))
+	return c.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+func (c *Client) setState(s state) {
+	c.Lock()
+	if c.state != stateClosed {
+		c.state = s
+	}
+	c.Unlock()
+}
+
+func (c *Client) readLoop() {
+	for {
+		_, data, err := c.conn.ReadMessage()
+		var msg Message
+		if err == nil {
+			msg, err = DecodeMessage(data)
+		}
+		if err != nil {
+			c.Lock()
+			c.state = stateClosed
+			if c.err == nil {
+				c.err = err
+			}
+			c.Unlock()
+			close(c.events)
+			close(c.done)
+			return
+		}
+
+		if msg.Cmd == CmdAnswer || msg.Cmd == CmdError || msg.Cmd == CmdUpdate {
+			c.Lock()
+			// in Version2, only the reply of the request in flight, not an
+			// error the server sends on its own
+			reply := c.reply
+			if c.version >= Version2 && msg.ID != c.replyID {
+				reply = nil
+			}
+			if reply != nil {
+				c.reply = nil
+			}
+			c.Unlock()
+			if reply != nil {
+				reply <- msg
+				continue
+			}
+		}
+
+		select {
+		case c.events <- msg:
+		default:
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func fakeServer(t *testing.T, handle func(ws *websocket.Conn)) string {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer ws.Close()
+		handle(ws)
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func TestPublish(t *testing.T) {
+	url := fakeServer(t, func(ws *websocket.Conn) {
+		var msg Message
+		if err := ws.ReadJSON(&msg); err != nil {
+			return
+		}
+		if msg.Cmd != CmdOffer || msg.StreamID != "live" {
+			t.Errorf("unexpected offer %+v", msg)
+		}
+		ws.WriteJSON(Message{Cmd: "event"})
+		ws.WriteJSON(Message{
+			Cmd:     CmdAnswer,
+			Sdp:     "answer-" + msg.Sdp,
+			Session: &SessionInfo{Stream: msg.StreamID, Mode: ModePassthrough},
+		})
+		ws.ReadMessage()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c, err := Dial(ctx, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer, err := c.Publish(ctx, Offer{StreamID: "live", Sdp: "offer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer.Sdp != "answer-offer" {
+		t.Fatalf("answer = %q", answer.Sdp)
+	}
+	if answer.Session == nil || answer.Session.Mode != ModePassthrough {
+		t.Fatalf("session = %+v", answer.Session)
+	}
+	if _, err := c.Publish(ctx, Offer{StreamID: "live", Sdp: "offer"}); err != ErrAlreadyStarted {
+		t.Fatalf("second publish err = %v", err)
+	}
+	if msg := <-c.Events(); msg.Cmd != "event" {
+		t.Fatalf("event = %+v", msg)
+	}
+	if err := c.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPublishRejected(t *testing.T) {
+	url := fakeServer(t, func(ws *websocket.Conn) {
+		ws.ReadMessage()
+		ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(CloseStreamBusy, "stream already publishing"),
+			time.Now().Add(time.Second))
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c, err := Dial(ctx, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Publish(ctx, Offer{StreamID: "live", Sdp: "offer"})
+	if !IsCloseCode(err, CloseStreamBusy) {
+		t.Fatalf("err = %v", err)
+	}
+	c.Close(ctx)
+}
+
+func TestPublishServerError(t *testing.T) {
+	url := fakeServer(t, func(ws *websocket.Conn) {
+		var msg Message
+		ws.ReadJSON(&msg)
+		if msg.Latency != LatencyLow {
+			t.Errorf("latency = %q", msg.Latency)
+		}
+		ws.WriteJSON(Message{Cmd: CmdError, Reason: "nope"})
+		ws.ReadMessage()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c, err := Dial(ctx, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Publish(ctx, Offer{StreamID: "live", Sdp: "offer", Latency: LatencyLow})
+	if serr, ok := err.(*ServerError); !ok || serr.Reason != "nope" {
+		t.Fatalf("err = %v", err)
+	}
+	c.Close(ctx)
+}
+
+func TestRenegotiate(t *testing.T) {
+	url := fakeServer(t, func(ws *websocket.Conn) {
+		var msg Message
+		for ws.ReadJSON(&msg) == nil {
+			switch msg.Cmd {
+			case CmdOffer:
+				ws.WriteJSON(Message{Cmd: CmdAnswer, Sdp: "answer"})
+			case CmdCandidate:
+				if msg.Candidate != "candidate:1 1 udp 2122260223 192.0.2.1 54321 typ host" {
+					t.Errorf("candidate = %q", msg.Candidate)
+				}
+			case CmdRenegotiate:
+				ws.WriteJSON(Message{Cmd: CmdAnswer, Sdp: "answer-" + msg.Sdp})
+			case CmdUpdate:
+				if msg.Track != "screen" {
+					ws.WriteJSON(Message{Cmd: CmdError, Reason: "no published stream with video"})
+					continue
+				}
+				ws.WriteJSON(Message{Cmd: CmdUpdate, Track: msg.Track})
+			}
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c, err := Dial(ctx, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Renegotiate(ctx, "offer"); err != ErrNotPublished {
+		t.Fatalf("renegotiate before publishing err = %v", err)
+	}
+	if _, err := c.Publish(ctx, Offer{StreamID: "live", Sdp: "offer"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Candidate("candidate:1 1 udp 2122260223 192.0.2.1 54321 typ host"); err != nil {
+		t.Fatal(err)
+	}
+	if answer, err := c.Renegotiate(ctx, "screen"); err != nil || answer != "answer-screen" {
+		t.Fatalf("renegotiate = %q, %v", answer, err)
+	}
+	if err := c.Update(ctx, "screen"); err != nil {
+		t.Fatal(err)
+	}
+	if err, ok := c.Update(ctx, "gone").(*ServerError); !ok || err.Reason != "no published stream with video" {
+		t.Fatalf("update of a missing stream err = %v", err)
+	}
+	if err := c.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
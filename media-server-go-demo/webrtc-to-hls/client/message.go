@@ -0,0 +1,404 @@
+package client
+
+// Message is the JSON envelope exchanged over the /channel websocket, as
+// is in Version1, or as the payload of an Envelope in Version2, see
+// DecodeMessage and EncodeMessage
+type Message struct {
+	// Version is the protocol version the message came in, or goes out in
+	// when set; ID is the request id of Version2. Neither is a field of
+	// the Version1 message.
+	Version  int    `json:"-"`
+	ID       string `json:"-"`
+	Cmd      string `json:"cmd,omitempty"`
+	Sdp      string `json:"sdp,omitempty"`
+	StreamID string `json:"stream,omitempty"`
+	// ExternalID is the publisher's own id of the content, in an offer
+	ExternalID string `json:"externalId,omitempty"`
+	// AudioLanguages are the BCP 47 languages of the published audio
+	// tracks, by track id, in an offer: the tracks besides the one muxed
+	// with the video are packaged as alternate audio renditions
+	AudioLanguages map[string]string `json:"audioLanguages,omitempty"`
+	// Screen is the id (msid) of the published stream sharing a screen, in
+	// an offer, composited with the camera when the stream key has a
+	// composite layout
+	Screen string `json:"screen,omitempty"`
+	// Latency selects the latency preset in an offer
+	Latency string `json:"latency,omitempty"`
+	// Preset echoes the resolved latency preset in an answer
+	Preset *Preset `json:"preset,omitempty"`
+	// Session describes what the server decided for a publish, in an answer
+	Session *SessionInfo `json:"session,omitempty"`
+	// Reason explains an error or warning
+	Reason string `json:"reason,omitempty"`
+	// Code is the stable, machine readable code of an error or warning, one
+	// of the Error* or Warning* codes
+	Code string `json:"code,omitempty"`
+	// Details are the structured facts of a warning, per code, e.g.
+	// gopMs and suggestedKeyframeIntervalMs for WarningGOPTooLong
+	Details map[string]interface{} `json:"details,omitempty"`
+	// Target is the instance to reconnect to, in a migrate event
+	Target string `json:"target,omitempty"`
+	// Token is the one-time resume token of a migrate event, sent back in
+	// the offer made to the target
+	Token string `json:"token,omitempty"`
+	// ReconnectToken is the reconnect token of a session, sent in an offer
+	// on a new connection to resume it, see SessionInfo.ReconnectToken
+	ReconnectToken string `json:"reconnectToken,omitempty"`
+	// Credential is the publish credential of an offer, a stream secret or
+	// a JWT, when the server authenticates publishers
+	Credential string `json:"credential,omitempty"`
+	// ICEServers are the STUN and TURN servers to create the peer
+	// connection with, in an ice-servers message
+	ICEServers []ICEServer `json:"iceServers,omitempty"`
+	// Candidate is a trickled ICE candidate, the candidate attribute of the
+	// SDP with or without its a= prefix; empty ends the candidates
+	Candidate string `json:"candidate,omitempty"`
+	// Track is the id (msid) of the published stream whose video the
+	// output packages, in an update
+	Track string `json:"track,omitempty"`
+	// Event is what an event reports, one of the Event* names
+	Event string `json:"event,omitempty"`
+	// State is the new state of an ice-state or dtls-state event
+	State string `json:"state,omitempty"`
+	// URL is where players load the stream, in a playlist-ready event
+	URL string `json:"url,omitempty"`
+	// Cue is the cue of a cue message, answered with its placement
+	Cue *Cue `json:"cue,omitempty"`
+	// Stats is the transport feedback of a stats message
+	Stats *Stats `json:"stats,omitempty"`
+	// Data is the UTF-8 payload of a data message, e.g. a live caption, up
+	// to 16KB, and Label what it is, "data" when empty
+	Data  string `json:"data,omitempty"`
+	Label string `json:"label,omitempty"`
+}
+
+// Stats is what the server measures of the transport of a publish, sent
+// periodically so the publisher can adapt its encoder bitrate
+type Stats struct {
+	// EstimatedBitrate is the bandwidth the server estimates the publisher
+	// can send, in bits per second, the REMB it feeds back; 0 before any
+	// estimate
+	EstimatedBitrate int `json:"estimatedBitrate"`
+	// ReceivedBitrate is the video bitrate received, retransmissions and
+	// FEC included, in bits per second
+	ReceivedBitrate int `json:"receivedBitrate"`
+	// PacketLoss is the fraction of video packets lost since the last stats
+	// message, 0 to 1
+	PacketLoss float64 `json:"packetLoss"`
+	// RttMs is the round trip time to the publisher
+	RttMs int `json:"rttMs"`
+}
+
+// Cue marks a moment of a publish, e.g. an ad break, listed by the LL-HLS
+// playlist as a date range
+type Cue struct {
+	// ID names the cue, 1-64 letters, digits, '.', '_' or '-'
+	ID string `json:"id"`
+	// Time is when the cue starts on the publisher's clock, in unix
+	// milliseconds; the server corrects it by the clock skew it measured
+	Time int64 `json:"time"`
+	// DurationMs is how long the cue lasts, zero when unknown
+	DurationMs float64 `json:"durationMs,omitempty"`
+	// PtsMs is where the cue starts in the presentation time of the output,
+	// and Date its PROGRAM-DATE-TIME, in the answer
+	PtsMs float64 `json:"ptsMs,omitempty"`
+	Date  string  `json:"date,omitempty"`
+}
+
+// ICEServer is a STUN or TURN server, as in an RTCConfiguration
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// commands understood by the server
+const (
+	CmdOffer  = "offer"
+	CmdAnswer = "answer"
+	CmdError  = "error"
+	// CmdWarning reports a problem with a publish that does not end it, e.g. clock skew
+	CmdWarning = "warning"
+	// CmdMigrate asks the publisher to republish on another instance
+	CmdMigrate = "migrate"
+	// CmdICEServers hands the client its ICE servers once connected, when
+	// the server has any; TURN credentials may expire
+	CmdICEServers = "ice-servers"
+	// CmdCandidate trickles an ICE candidate of the publisher; it is not
+	// answered
+	CmdCandidate = "candidate"
+	// CmdRenegotiate offers the streams of a live publish anew, e.g. with a
+	// screen share added, on the same transport; it is answered like an
+	// offer, the output going on
+	CmdRenegotiate = "renegotiate"
+	// CmdUpdate switches the output to the video of another published
+	// stream, Track; the server echoes it once switched
+	CmdUpdate = "update"
+	// CmdEvent tells the publisher how its publish is doing after the
+	// answer, see the Event* names
+	CmdEvent = "event"
+	// CmdCue places a cue on the output timeline, answered with the cue as
+	// placed or an error
+	CmdCue = "cue"
+	// CmdStats reports the transport feedback of a publish, Stats, every
+	// publisher_stats_interval seconds
+	CmdStats = "stats"
+	// CmdData carries a data message of the publisher, relayed to the
+	// websocket viewers and into MPEG-TS output as ID3 timed metadata when
+	// the stream relays data; it is answered only with an error. Viewers
+	// of a captioned stream get its captions as data messages labeled
+	// captions.
+	CmdData = "data"
+)
+
+// events, sent with CmdEvent
+const (
+	// EventICEState: the ICE state of the transport changed to State:
+	// checking, connected or disconnected
+	EventICEState = "ice-state"
+	// EventDTLSState: the DTLS state of the transport changed to State:
+	// new, connecting, connected, closed or failed
+	EventDTLSState = "dtls-state"
+	// EventFirstFrame: the server received the first frame of a track;
+	// details track, video or audio
+	EventFirstFrame = "first-frame"
+	// EventPlaylistReady: the HLS playlist lists the first segment of the
+	// output, players can load URL
+	EventPlaylistReady = "playlist-ready"
+)
+
+// error codes
+const (
+	// ErrorVideoRequired rejects an offer without a video track
+	ErrorVideoRequired = "video-required"
+	// ErrorProfileConflict rejects a latency preset the stream's HLS
+	// compatibility profile does not allow
+	ErrorProfileConflict = "profile-conflict"
+	// ErrorBadIdentifier rejects a stream key or external id that is not
+	// 1-64 letters, digits, '.', '_' or '-', or is reserved
+	ErrorBadIdentifier = "bad-identifier"
+	// ErrorUnauthorized rejects a publish that failed ingest
+	// authentication; the server closes with CloseUnauthorized after it
+	ErrorUnauthorized = "unauthorized"
+	// ErrorBadOffer rejects an offer that is not valid SDP, or lacks media,
+	// ICE credentials or a DTLS fingerprint
+	ErrorBadOffer = "bad-offer"
+	// ErrorRejected refuses a request the stream is not configured for,
+	// e.g. an unknown latency preset or a renegotiation changing codecs
+	ErrorRejected = "rejected"
+	// ErrorNotLive answers a request for a stream that is not published,
+	// on the connection or at all
+	ErrorNotLive = "not-live"
+	// ErrorPipelineFailed ends a publish whose output could not start
+	ErrorPipelineFailed = "pipeline-failed"
+	// ErrorQuarantined refuses a viewer of a stream moderation hid
+	ErrorQuarantined = "quarantined"
+	// ErrorInternal reports a server bug handling the connection; the
+	// server closes it after
+	ErrorInternal = "internal"
+	// ErrorLimitExceeded refuses a publish the instance has no room for,
+	// or ends one over its bitrate limit; details limit (publishers,
+	// pipelines or bitrate), max and current
+	ErrorLimitExceeded = "limit-exceeded"
+	// ErrorPolicyViolation ends a publish over the resolution or bitrate of
+	// the publish policy of its stream key, when the policy ends violators;
+	// details as WarningPolicyResolution or WarningPolicyBitrate
+	ErrorPolicyViolation = "policy-violation"
+	// ErrorBadMessage rejects a message that is not valid JSON, or a
+	// Version2 payload not of its command
+	ErrorBadMessage = "bad-message"
+	// ErrorUnsupportedVersion rejects a message of a protocol version the
+	// server does not speak; details version and supported, the latest it
+	// does
+	ErrorUnsupportedVersion = "unsupported-version"
+)
+
+// warning codes, sent with CmdWarning
+const (
+	// WarningClockSkew: the publisher clock is off; details skewMs and
+	// thresholdMs
+	WarningClockSkew = "clock-skew"
+	// WarningGOPTooLong: keyframes come less often than segments are cut;
+	// details gopMs, segmentDurationMs and suggestedKeyframeIntervalMs
+	WarningGOPTooLong = "gop-too-long"
+	// WarningKeyframeTooLarge: a keyframe is over the size alert; details
+	// bytes and limitBytes
+	WarningKeyframeTooLarge = "keyframe-too-large"
+	// WarningBitrateUnstable: the bitrate varies over the alert; details
+	// variation and windowSeconds
+	WarningBitrateUnstable = "bitrate-unstable"
+	// WarningBitrateLow: the bitrate is under the alert; details bitrate
+	// and minBitrate, in bits per second
+	WarningBitrateLow = "bitrate-low"
+	// WarningKeyframeStorm: keyframe requests hit their ceiling; details
+	// dropped, source and requests
+	WarningKeyframeStorm = "keyframe-storm"
+	// WarningPlaylistHeld: a playlist revision failed validation and is
+	// held back; details error
+	WarningPlaylistHeld = "playlist-held"
+	// WarningQuarantined: the stream is quarantined by moderation
+	WarningQuarantined = "quarantined"
+	// WarningPipelineRestarting: the output pipeline failed and is
+	// restarted; details reason, failures and delayMs
+	WarningPipelineRestarting = "pipeline-restarting"
+	// WarningPipelineFailed: the output pipeline failed too often in a
+	// row, the server closes with ClosePipelineFailed after it; details
+	// reason and failures
+	WarningPipelineFailed = "pipeline-failed"
+	// WarningPolicyResolution: the video is over the resolution of the
+	// publish policy; details width, height, maxWidth and maxHeight
+	WarningPolicyResolution = "policy-resolution"
+	// WarningPolicyBitrate: the video is over the bitrate of the publish
+	// policy; details bitrate and maxBitrate, in bits per second
+	WarningPolicyBitrate = "policy-bitrate"
+	// WarningPolicyProfile: the H.264 profile of the video is not one the
+	// publish policy allows; details profile and allowed
+	WarningPolicyProfile = "policy-profile"
+	// WarningOrientationChanged: the video turned between landscape and
+	// portrait mid-stream, which players show letterboxed; details width,
+	// height, previousWidth and previousHeight
+	WarningOrientationChanged = "orientation-changed"
+)
+
+// latency presets
+const (
+	LatencyQuality  = "quality"
+	LatencyBalanced = "balanced"
+	LatencyLow      = "low-latency"
+)
+
+// HLS compatibility profiles, configured per stream key on the server
+const (
+	// ProfileTVLegacy is for smart TVs and set-top boxes: TS, AAC-LC, 6s
+	// segments, no LL-HLS
+	ProfileTVLegacy = "tv-legacy"
+	// ProfileWebDefault leaves packaging to the latency preset
+	ProfileWebDefault = "web-default"
+	// ProfileLLWeb is for low-latency web players: segments of 2s at most
+	ProfileLLWeb = "ll-web"
+)
+
+// Preset is the bundle of packaging settings a latency preset resolved to
+type Preset struct {
+	Name string `json:"name"`
+	// SegmentDuration is the HLS target duration in seconds
+	SegmentDuration int `json:"segmentDuration"`
+	// PlaylistLength is the number of segments listed in the live playlist,
+	// 0 when it lists them all (a DVR EVENT playlist)
+	PlaylistLength int `json:"playlistLength"`
+	// MaxFiles is the number of segments kept on disk, 0 when the server
+	// keeps them all
+	MaxFiles int `json:"maxFiles"`
+	// KeyframeInterval is the period of keyframe requests in milliseconds
+	KeyframeInterval int `json:"keyframeInterval"`
+	// Ladder is the ABR ladder of the output, as abr_ladder takes it, when
+	// abr_ladder does not set one for the stream
+	Ladder string `json:"ladder,omitempty"`
+	// HLSMode is ll when the output is packaged as LL-HLS too, when
+	// hls_mode does not set the mode of the stream
+	HLSMode string `json:"hlsMode,omitempty"`
+	// Passthrough packages the video as published: what would transcode it,
+	// a ladder, a composite, a watermark or a codec other than H.264, is
+	// refused
+	Passthrough bool `json:"passthrough,omitempty"`
+}
+
+// output modes of a session
+const (
+	// ModePassthrough packages the published video as is
+	ModePassthrough = "passthrough"
+	// ModeTranscode re-encodes the published video
+	ModeTranscode = "transcode"
+	// ModeMixed mixes the published video and audio into the broadcast of
+	// a room with the other participants
+	ModeMixed = "mixed"
+)
+
+// session kinds
+const (
+	// KindVideo sessions package the published video
+	KindVideo = "video"
+	// KindAudioOnly sessions were accepted without a video track
+	KindAudioOnly = "audio-only"
+)
+
+// SessionInfo is what the server negotiated and set up for a publish
+type SessionInfo struct {
+	// ID is the server's id of the session, unique per publish
+	ID     string `json:"id"`
+	Stream string `json:"stream"`
+	// ExternalID echoes the external id of the offer
+	ExternalID string `json:"externalId,omitempty"`
+	// Codecs lists the answered codecs as media/codec, e.g. video/h264
+	Codecs []string `json:"codecs"`
+	// Mode is ModePassthrough, ModeTranscode or ModeMixed
+	Mode string `json:"mode"`
+	// Preset is the name of the latency preset in effect
+	Preset string `json:"preset"`
+	// Profile is the name of the HLS compatibility profile in effect
+	Profile string `json:"profile"`
+	// Kind is KindVideo or KindAudioOnly
+	Kind string `json:"kind"`
+	// Audio is set when the HLS output carries the published audio
+	Audio bool `json:"audio,omitempty"`
+	// Resumed is set when the publish resumed a migrated session
+	Resumed bool `json:"resumed,omitempty"`
+	// Reconnected is set when the offer resumed the session on a new
+	// connection, with its output going on
+	Reconnected bool `json:"reconnected,omitempty"`
+	// ReconnectToken resumes the session when its connection drops: sent
+	// in an offer on a new connection within the reconnect grace period of
+	// the server, with the same stream key, its transport and output go
+	// on, the offer restarting ICE or not. A new token comes with each
+	// answer.
+	ReconnectToken string `json:"reconnectToken,omitempty"`
+	// Answer is the SDP answer mode, full or minimal
+	Answer string `json:"answer"`
+	// Playlist is the path of the HLS playlist on the server, empty when
+	// the session has no output
+	Playlist string `json:"playlist"`
+	// Streams are the paths of the playlists of the published streams
+	// other than the one of Playlist, by stream id: each stream with video
+	// of an offer, a camera and a shared screen say, is packaged on its own
+	Streams map[string]string `json:"streams,omitempty"`
+	Timings Timings           `json:"timings"`
+}
+
+// Timings are the durations of the setup steps of a publish, in milliseconds
+type Timings struct {
+	ParseSdp    float64 `json:"parseSdp"`
+	Negotiation float64 `json:"negotiation"`
+	Pipeline    float64 `json:"pipeline"`
+}
+
+// websocket close codes sent by the server
+const (
+	// CloseUnauthorized rejects a publish that failed ingest authentication
+	CloseUnauthorized = 4003
+	// CloseStreamBusy rejects a publish because the stream key, or the
+	// external id under another key, is already live
+	CloseStreamBusy = 4009
+	// CloseReplaced ends a session taken over by a newer publish of the same key
+	CloseReplaced = 4010
+	// CloseOverBudget ends a session that exceeded its memory budget
+	CloseOverBudget = 4011
+	// CloseDraining ends or refuses a publish on an instance being drained
+	CloseDraining = 4012
+	// CloseStreamEnded ends a /watch viewer whose publish ended
+	CloseStreamEnded = 4013
+	// CloseKicked ends a publish an operator stopped through the API
+	CloseKicked = 4014
+	// ClosePipelineFailed ends a publish whose output kept failing
+	ClosePipelineFailed = 4015
+	// CloseQuarantined ends a /watch viewer of a stream moderation hid
+	CloseQuarantined = 4016
+	// CloseLimitExceeded ends a publish whose video stayed over the
+	// bitrate limit
+	CloseLimitExceeded = 4017
+	// CloseIdle ends a publish whose publisher sent no media for its idle
+	// timeout
+	CloseIdle = 4018
+	// ClosePolicyViolation ends a publish over the limits of the publish
+	// policy of its stream key
+	ClosePolicyViolation = 4019
+)
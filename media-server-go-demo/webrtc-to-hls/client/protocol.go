@@ -0,0 +1,218 @@
+package client
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+)
+
+// versions of the signaling protocol
+const (
+	// Version1 is the flat Message of every field, without request ids
+	Version1 = 1
+	// Version2 wraps the fields of each command in a typed payload of an
+	// Envelope, with request ids
+	Version2 = 2
+	// ProtocolVersion is the latest version, the one the JSON schema of
+	// Schema describes
+	ProtocolVersion = Version2
+)
+
+// Schema is the JSON schema of the Envelope of each command of
+// ProtocolVersion, e.g. for clients in other languages to validate what
+// they send and generate their types from
+//
+//go:embed schema.json
+var Schema []byte
+
+// Envelope is a message of Version2 on the wire. A client opts in by
+// sending the v query parameter of the websocket url at 2, or its first
+// message as an Envelope: the server then sends it Envelopes only. Messages
+// without v are Version1, the flat Message, which the server keeps
+// speaking to the clients that sent none.
+type Envelope struct {
+	V int `json:"v"`
+	// ID correlates a request with its reply: the client picks it, unique
+	// among its requests in flight, and the answer, error, update or cue
+	// replying echoes it. Messages the server sends on its own have none.
+	ID      string          `json:"id,omitempty"`
+	Cmd     string          `json:"cmd"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// the payloads of the commands of Version2, their fields named as in
+// Message
+
+// OfferPayload publishes a stream, CmdOffer
+type OfferPayload struct {
+	Sdp            string            `json:"sdp"`
+	StreamID       string            `json:"stream,omitempty"`
+	ExternalID     string            `json:"externalId,omitempty"`
+	AudioLanguages map[string]string `json:"audioLanguages,omitempty"`
+	Screen         string            `json:"screen,omitempty"`
+	Latency        string            `json:"latency,omitempty"`
+	Token          string            `json:"token,omitempty"`
+	ReconnectToken string            `json:"reconnectToken,omitempty"`
+	Credential     string            `json:"credential,omitempty"`
+}
+
+// AnswerPayload answers a CmdOffer or CmdRenegotiate, CmdAnswer
+type AnswerPayload struct {
+	Sdp      string       `json:"sdp"`
+	StreamID string       `json:"stream,omitempty"`
+	Preset   *Preset      `json:"preset,omitempty"`
+	Session  *SessionInfo `json:"session,omitempty"`
+}
+
+// ErrorPayload is a CmdError, or a CmdWarning
+type ErrorPayload struct {
+	Code    string                 `json:"code,omitempty"`
+	Reason  string                 `json:"reason,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// MigratePayload is a CmdMigrate
+type MigratePayload struct {
+	Target string `json:"target"`
+	Token  string `json:"token"`
+}
+
+// ICEServersPayload is a CmdICEServers
+type ICEServersPayload struct {
+	ICEServers []ICEServer `json:"iceServers"`
+}
+
+// CandidatePayload is a CmdCandidate
+type CandidatePayload struct {
+	Candidate string `json:"candidate,omitempty"`
+}
+
+// RenegotiatePayload is a CmdRenegotiate
+type RenegotiatePayload struct {
+	Sdp string `json:"sdp"`
+}
+
+// UpdatePayload is a CmdUpdate, and its echo
+type UpdatePayload struct {
+	Track string `json:"track"`
+}
+
+// EventPayload is a CmdEvent
+type EventPayload struct {
+	Event   string                 `json:"event"`
+	State   string                 `json:"state,omitempty"`
+	URL     string                 `json:"url,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// CuePayload is a CmdCue, and its reply
+type CuePayload struct {
+	Cue *Cue `json:"cue"`
+}
+
+// StatsPayload is a CmdStats
+type StatsPayload struct {
+	Stats *Stats `json:"stats"`
+}
+
+// DataPayload is a CmdData
+type DataPayload struct {
+	Data  string `json:"data"`
+	Label string `json:"label,omitempty"`
+}
+
+// Payloads are the payload types of the commands of Version2
+var Payloads = map[string]func() interface{}{
+	CmdOffer:       func() interface{} { return &OfferPayload{} },
+	CmdAnswer:      func() interface{} { return &AnswerPayload{} },
+	CmdError:       func() interface{} { return &ErrorPayload{} },
+	CmdWarning:     func() interface{} { return &ErrorPayload{} },
+	CmdMigrate:     func() interface{} { return &MigratePayload{} },
+	CmdICEServers:  func() interface{} { return &ICEServersPayload{} },
+	CmdCandidate:   func() interface{} { return &CandidatePayload{} },
+	CmdRenegotiate: func() interface{} { return &RenegotiatePayload{} },
+	CmdUpdate:      func() interface{} { return &UpdatePayload{} },
+	CmdEvent:       func() interface{} { return &EventPayload{} },
+	CmdCue:         func() interface{} { return &CuePayload{} },
+	CmdStats:       func() interface{} { return &StatsPayload{} },
+	CmdData:        func() interface{} { return &DataPayload{} },
+}
+
+// replies are the commands a reply to a request is sent with
+var replies = map[string]bool{CmdAnswer: true, CmdError: true, CmdUpdate: true, CmdCue: true}
+
+// IsReply reports whether a message of cmd may reply to a request, and so
+// carry its id
+func IsReply(cmd string) bool {
+	return replies[cmd]
+}
+
+// UnsupportedVersion is the error of DecodeMessage for a message of a
+// version after ProtocolVersion
+type UnsupportedVersion struct {
+	Version int
+}
+
+func (e *UnsupportedVersion) Error() string {
+	return fmt.Sprintf("client: unsupported protocol version %d, at most %d", e.Version, ProtocolVersion)
+}
+
+// DecodeMessage reads a message of either version into a Message, its
+// Version and ID set. The payload of a Version2 message must be that of
+// its command, without unknown fields; unknown commands are left to the
+// receiver, as they are in Version1.
+func DecodeMessage(data []byte) (Message, error) {
+	var envelope Envelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return Message{}, err
+	}
+	if envelope.V < Version2 {
+		var msg Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return Message{}, err
+		}
+		msg.Version = Version1
+		return msg, nil
+	}
+	if envelope.V > ProtocolVersion {
+		return Message{Cmd: envelope.Cmd, ID: envelope.ID, Version: envelope.V}, &UnsupportedVersion{Version: envelope.V}
+	}
+	msg := Message{Cmd: envelope.Cmd, ID: envelope.ID, Version: Version2}
+	payload := bytes.TrimSpace(envelope.Payload)
+	if len(payload) == 0 || bytes.Equal(payload, []byte("null")) {
+		return msg, nil
+	}
+	if typed, ok := Payloads[envelope.Cmd]; ok {
+		decoder := json.NewDecoder(bytes.NewReader(payload))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(typed()); err != nil {
+			return msg, fmt.Errorf("client: %s payload: %v", envelope.Cmd, err)
+		}
+	}
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return msg, err
+	}
+	// the envelope wins over what the payload may repeat
+	msg.Cmd, msg.ID, msg.Version = envelope.Cmd, envelope.ID, Version2
+	return msg, nil
+}
+
+// EncodeMessage writes msg in version: as is in Version1, its ID dropped,
+// or as an Envelope whose payload holds the fields of msg but Cmd
+func EncodeMessage(msg Message, version int) ([]byte, error) {
+	if version < Version2 {
+		return json.Marshal(msg)
+	}
+	cmd, id := msg.Cmd, msg.ID
+	msg.Cmd = ""
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	envelope := Envelope{V: Version2, ID: id, Cmd: cmd}
+	if !bytes.Equal(payload, []byte("{}")) {
+		envelope.Payload = payload
+	}
+	return json.Marshal(envelope)
+}
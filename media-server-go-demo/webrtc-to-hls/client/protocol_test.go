@@ -0,0 +1,162 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// jsonFields are the JSON names of the fields of the struct type t
+func jsonFields(t reflect.Type) map[string]bool {
+	fields := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			fields[name] = true
+		}
+	}
+	return fields
+}
+
+func TestPayloadsMatchMessage(t *testing.T) {
+	var schema struct {
+		Properties struct {
+			Cmd struct {
+				Enum []string `json:"enum"`
+			} `json:"cmd"`
+		} `json:"properties"`
+		Defs map[string]struct {
+			Properties map[string]json.RawMessage `json:"properties"`
+		} `json:"$defs"`
+	}
+	if err := json.Unmarshal(Schema, &schema); err != nil {
+		t.Fatalf("schema: %v", err)
+	}
+	if len(schema.Properties.Cmd.Enum) != len(Payloads) {
+		t.Fatalf("schema lists %d commands, %d payloads", len(schema.Properties.Cmd.Enum), len(Payloads))
+	}
+	message := jsonFields(reflect.TypeOf(Message{}))
+	for cmd, payload := range Payloads {
+		fields := jsonFields(reflect.TypeOf(payload()).Elem())
+		for name := range fields {
+			// the compatibility layer moves the payload into the Message
+			if !message[name] {
+				t.Errorf("%s payload field %s is not a Message field", cmd, name)
+			}
+		}
+		def := cmd
+		if cmd == CmdWarning {
+			def = CmdError
+		}
+		described, ok := schema.Defs[def]
+		if !ok {
+			t.Errorf("schema has no payload of %s", cmd)
+			continue
+		}
+		if len(described.Properties) != len(fields) {
+			t.Errorf("schema payload of %s has %d properties, the type %d", cmd, len(described.Properties), len(fields))
+		}
+		for name := range fields {
+			if _, ok := described.Properties[name]; !ok {
+				t.Errorf("schema payload of %s lacks %s", cmd, name)
+			}
+		}
+	}
+}
+
+func TestDecodeMessage(t *testing.T) {
+	v1, err := DecodeMessage([]byte(`{"cmd":"offer","sdp":"v=0","stream":"live","latency":"low-latency"}`))
+	if err != nil || v1.Version != Version1 || v1.ID != "" || v1.Sdp != "v=0" || v1.StreamID != "live" || v1.Latency != LatencyLow {
+		t.Fatalf("v1 = %+v, %v", v1, err)
+	}
+	v2, err := DecodeMessage([]byte(`{"v":2,"id":"7","cmd":"offer","payload":{"sdp":"v=0","stream":"live","audioLanguages":{"a":"en"}}}`))
+	if err != nil || v2.Version != Version2 || v2.ID != "7" || v2.Cmd != CmdOffer || v2.StreamID != "live" || v2.AudioLanguages["a"] != "en" {
+		t.Fatalf("v2 = %+v, %v", v2, err)
+	}
+	// a field of another command is refused
+	if _, err := DecodeMessage([]byte(`{"v":2,"cmd":"update","payload":{"track":"screen","sdp":"v=0"}}`)); err == nil {
+		t.Fatal("foreign payload field accepted")
+	}
+	if msg, err := DecodeMessage([]byte(`{"v":3,"id":"1","cmd":"offer"}`)); err == nil || msg.ID != "1" {
+		t.Fatalf("v3 = %+v, %v", msg, err)
+	} else if unsupported, ok := err.(*UnsupportedVersion); !ok || unsupported.Version != 3 {
+		t.Fatalf("v3 err = %v", err)
+	}
+	if msg, err := DecodeMessage([]byte(`{"v":2,"cmd":"future","payload":{"anything":1}}`)); err != nil || msg.Cmd != "future" {
+		t.Fatalf("unknown command = %+v, %v", msg, err)
+	}
+}
+
+func TestEncodeMessage(t *testing.T) {
+	msg := Message{Cmd: CmdError, ID: "3", Code: ErrorBadOffer, Reason: "no media"}
+	v1, err := EncodeMessage(msg, Version1)
+	if err != nil || string(v1) != `{"cmd":"error","reason":"no media","code":"bad-offer"}` {
+		t.Fatalf("v1 = %s, %v", v1, err)
+	}
+	v2, err := EncodeMessage(msg, Version2)
+	if err != nil || string(v2) != `{"v":2,"id":"3","cmd":"error","payload":{"reason":"no media","code":"bad-offer"}}` {
+		t.Fatalf("v2 = %s, %v", v2, err)
+	}
+	back, err := DecodeMessage(v2)
+	if err != nil || back.Code != msg.Code || back.Reason != msg.Reason || back.ID != "3" {
+		t.Fatalf("decoded = %+v, %v", back, err)
+	}
+	if empty, _ := EncodeMessage(Message{Cmd: CmdCandidate}, Version2); string(empty) != `{"v":2,"cmd":"candidate"}` {
+		t.Fatalf("end of candidates = %s", empty)
+	}
+}
+
+func TestVersion2Requests(t *testing.T) {
+	url := fakeServer(t, func(ws *websocket.Conn) {
+		for {
+			_, data, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			msg, err := DecodeMessage(data)
+			if err != nil || msg.Version != Version2 || msg.ID == "" {
+				t.Errorf("request %s: %v", data, err)
+				return
+			}
+			var replies []Message
+			switch msg.Cmd {
+			case CmdOffer:
+				replies = []Message{{Cmd: CmdAnswer, ID: msg.ID, Sdp: "answer"}}
+			case CmdUpdate:
+				// an error of the server's own comes first, not a reply
+				replies = []Message{
+					{Cmd: CmdError, Code: ErrorPolicyViolation, Reason: "over the bitrate"},
+					{Cmd: CmdUpdate, ID: msg.ID, Track: msg.Track},
+				}
+			}
+			for _, reply := range replies {
+				data, _ := EncodeMessage(reply, Version2)
+				ws.WriteMessage(websocket.TextMessage, data)
+			}
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := Dial(ctx, url+"?v=2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer, err := c.Publish(ctx, Offer{StreamID: "live", Sdp: "offer"}); err != nil || answer.Sdp != "answer" {
+		t.Fatalf("publish = %+v, %v", answer, err)
+	}
+	if err := c.Update(ctx, "screen"); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if msg := <-c.Events(); msg.Cmd != CmdError || msg.Code != ErrorPolicyViolation {
+		t.Fatalf("event = %+v", msg)
+	}
+	if err := c.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,78 @@
+// Package cluster shares which instance hosts the publisher of each stream
+// key, so instances behind one name can route players to the owner. A
+// claim expires unless its node renews it, so the keys of an instance that
+// died free up on their own.
+package cluster
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Directory maps stream keys to the node publishing them. Nodes are named
+// by the url they are reached at, e.g. http://10.0.0.5:9000.
+type Directory interface {
+	// Claim makes node the owner of key for ttl unless another node owns
+	// it, and returns the owner. Claiming a key node owns renews it.
+	Claim(ctx context.Context, key, node string, ttl time.Duration) (string, error)
+	// Release drops the claim of node on key, if it still owns it
+	Release(ctx context.Context, key, node string) error
+	// Owner returns the node owning key, empty when none does
+	Owner(ctx context.Context, key string) (string, error)
+}
+
+// Memory is a Directory in the memory of one instance, for a single
+// instance or tests
+type Memory struct {
+	now func() time.Time
+
+	lock   sync.Mutex
+	claims map[string]claim
+}
+
+type claim struct {
+	node    string
+	expires time.Time
+}
+
+// NewMemory returns an empty directory; now is the clock, time.Now when nil
+func NewMemory(now func() time.Time) *Memory {
+	if now == nil {
+		now = time.Now
+	}
+	return &Memory{now: now, claims: map[string]claim{}}
+}
+
+func (m *Memory) owner(key string) string {
+	c, ok := m.claims[key]
+	if !ok || !m.now().Before(c.expires) {
+		return ""
+	}
+	return c.node
+}
+
+func (m *Memory) Claim(ctx context.Context, key, node string, ttl time.Duration) (string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if owner := m.owner(key); owner != "" && owner != node {
+		return owner, nil
+	}
+	m.claims[key] = claim{node: node, expires: m.now().Add(ttl)}
+	return node, nil
+}
+
+func (m *Memory) Release(ctx context.Context, key, node string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.owner(key) == node {
+		delete(m.claims, key)
+	}
+	return nil
+}
+
+func (m *Memory) Owner(ctx context.Context, key string) (string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.owner(key), nil
+}
@@ -0,0 +1,164 @@
+package cluster
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testDirectory(t *testing.T, d Directory, expire func()) {
+	ctx := context.Background()
+	if owner, err := d.Claim(ctx, "live", "http://a", time.Minute); err != nil || owner != "http://a" {
+		t.Fatalf("claim = %q, %v", owner, err)
+	}
+	if owner, err := d.Claim(ctx, "live", "http://b", time.Minute); err != nil || owner != "http://a" {
+		t.Fatalf("claim of an owned key = %q, %v", owner, err)
+	}
+	if owner, err := d.Claim(ctx, "live", "http://a", time.Minute); err != nil || owner != "http://a" {
+		t.Fatalf("renewal = %q, %v", owner, err)
+	}
+	if err := d.Release(ctx, "live", "http://b"); err != nil {
+		t.Fatal(err)
+	}
+	if owner, _ := d.Owner(ctx, "live"); owner != "http://a" {
+		t.Fatalf("released by another node, owner = %q", owner)
+	}
+	if err := d.Release(ctx, "live", "http://a"); err != nil {
+		t.Fatal(err)
+	}
+	if owner, err := d.Owner(ctx, "live"); err != nil || owner != "" {
+		t.Fatalf("released, owner = %q, %v", owner, err)
+	}
+	d.Claim(ctx, "live", "http://a", time.Second)
+	expire()
+	if owner, _ := d.Claim(ctx, "live", "http://b", time.Minute); owner != "http://b" {
+		t.Fatalf("expired claim kept, owner = %q", owner)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	now := time.Unix(1000, 0)
+	testDirectory(t, NewMemory(func() time.Time { return now }), func() { now = now.Add(2 * time.Second) })
+}
+
+// fakeRedis answers the commands of Redis with the semantics of its scripts
+type fakeRedis struct {
+	lock    sync.Mutex
+	values  map[string]string
+	expired bool
+	authed  bool
+}
+
+func (f *fakeRedis) serve(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		reply, err := readReply(reader)
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, arg := range reply.([]interface{}) {
+			args = append(args, arg.(string))
+		}
+		conn.Write([]byte(f.command(args)))
+	}
+}
+
+func bulk(s string) string {
+	return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+}
+
+func (f *fakeRedis) command(args []string) string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.expired {
+		f.values, f.expired = map[string]string{}, false
+	}
+	switch {
+	case args[0] == "AUTH":
+		if args[1] != "secret" {
+			return "-WRONGPASS invalid password\r\n"
+		}
+		f.authed = true
+		return "+OK\r\n"
+	case !f.authed:
+		return "-NOAUTH Authentication required.\r\n"
+	case args[0] == "SELECT":
+		return "+OK\r\n"
+	case args[0] == "PING":
+		return "+PONG\r\n"
+	case args[0] == "GET":
+		if v, ok := f.values[args[1]]; ok {
+			return bulk(v)
+		}
+		return "$-1\r\n"
+	case args[0] == "EVAL" && args[1] == claimScript:
+		if owner, ok := f.values[args[3]]; ok && owner != args[4] {
+			return bulk(owner)
+		}
+		f.values[args[3]] = args[4]
+		return bulk(args[4])
+	case args[0] == "EVAL" && args[1] == releaseScript:
+		if f.values[args[3]] == args[4] {
+			delete(f.values, args[3])
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func TestRedis(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	fake := &fakeRedis{values: map[string]string{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go fake.serve(t, conn)
+		}
+	}()
+
+	wrong := &Redis{Addr: listener.Addr().String(), Password: "wrong"}
+	if _, err := wrong.Owner(context.Background(), "live"); err == nil {
+		t.Fatal("wrong password accepted")
+	}
+	r := &Redis{Addr: listener.Addr().String(), Password: "secret", DB: 2, Prefix: "streams:"}
+	defer r.Close()
+	if err := r.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	testDirectory(t, r, func() {
+		fake.lock.Lock()
+		fake.expired = true
+		fake.lock.Unlock()
+	})
+	fake.lock.Lock()
+	_, prefixed := fake.values["streams:live"]
+	fake.lock.Unlock()
+	if !prefixed {
+		t.Fatal("claims not stored under the prefix")
+	}
+
+	// a connection dropped by the server is opened again
+	r.lock.Lock()
+	r.conn.Close()
+	r.lock.Unlock()
+	if _, err := r.Owner(context.Background(), "live"); err == nil {
+		t.Fatal("no error on a closed connection")
+	}
+	if owner, err := r.Owner(context.Background(), "live"); err != nil || owner != "http://b" {
+		t.Fatalf("after reconnecting, owner = %q, %v", owner, err)
+	}
+}
@@ -0,0 +1,226 @@
+package cluster
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNil is the reply of Redis for a missing key
+var ErrNil = errors.New("cluster: redis nil reply")
+
+// the claims are compared and set atomically by scripts, so a node never
+// overwrites or deletes the claim of another one
+const (
+	claimScript = `local owner = redis.call('GET', KEYS[1])
+if owner and owner ~= ARGV[1] then return owner end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+return ARGV[1]`
+	releaseScript = `if redis.call('GET', KEYS[1]) == ARGV[1] then return redis.call('DEL', KEYS[1]) end
+return 0`
+)
+
+// Redis is a Directory in a Redis server shared by the instances, each
+// claim a key of Prefix followed by the stream key holding the node. It
+// speaks RESP over one connection, opened on first use and again after an
+// error.
+type Redis struct {
+	Addr     string
+	Password string
+	DB       int
+	Prefix   string
+	// Timeout bounds a command when its context has no deadline, 5s when 0
+	Timeout time.Duration
+
+	lock   sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (r *Redis) Claim(ctx context.Context, key, node string, ttl time.Duration) (string, error) {
+	reply, err := r.do(ctx, "EVAL", claimScript, "1", r.Prefix+key, node, strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	if err != nil {
+		return "", err
+	}
+	owner, ok := reply.(string)
+	if !ok {
+		return "", fmt.Errorf("cluster: claim of %s answered %v", key, reply)
+	}
+	return owner, nil
+}
+
+func (r *Redis) Release(ctx context.Context, key, node string) error {
+	_, err := r.do(ctx, "EVAL", releaseScript, "1", r.Prefix+key, node)
+	return err
+}
+
+func (r *Redis) Owner(ctx context.Context, key string) (string, error) {
+	reply, err := r.do(ctx, "GET", r.Prefix+key)
+	if err == ErrNil {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	owner, _ := reply.(string)
+	return owner, nil
+}
+
+// Ping checks the server answers, for health checks
+func (r *Redis) Ping(ctx context.Context) error {
+	reply, err := r.do(ctx, "PING")
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("cluster: ping answered %v", reply)
+	}
+	return nil
+}
+
+// Close closes the connection, if open
+func (r *Redis) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.reset()
+}
+
+func (r *Redis) reset() error {
+	if r.conn == nil {
+		return nil
+	}
+	err := r.conn.Close()
+	r.conn, r.reader = nil, nil
+	return err
+}
+
+// do sends a command and reads its reply. A connection failing mid command
+// is closed, the next command opening a new one.
+func (r *Redis) do(ctx context.Context, args ...string) (interface{}, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		timeout := r.Timeout
+		if timeout == 0 {
+			timeout = 5 * time.Second
+		}
+		deadline = time.Now().Add(timeout)
+	}
+	if r.conn == nil {
+		if err := r.dial(ctx, deadline); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := r.roundTrip(deadline, args...)
+	if _, replied := err.(redisError); err != nil && err != ErrNil && !replied {
+		r.reset()
+	}
+	return reply, err
+}
+
+func (r *Redis) dial(ctx context.Context, deadline time.Time) error {
+	dialer := net.Dialer{Deadline: deadline}
+	conn, err := dialer.DialContext(ctx, "tcp", r.Addr)
+	if err != nil {
+		return err
+	}
+	r.conn, r.reader = conn, bufio.NewReader(conn)
+	if r.Password != "" {
+		if _, err := r.roundTrip(deadline, "AUTH", r.Password); err != nil {
+			r.reset()
+			return err
+		}
+	}
+	if r.DB != 0 {
+		if _, err := r.roundTrip(deadline, "SELECT", strconv.Itoa(r.DB)); err != nil {
+			r.reset()
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Redis) roundTrip(deadline time.Time, args ...string) (interface{}, error) {
+	r.conn.SetDeadline(deadline)
+	if _, err := r.conn.Write(encodeCommand(args)); err != nil {
+		return nil, err
+	}
+	return readReply(r.reader)
+}
+
+// encodeCommand encodes args as a RESP array of bulk strings
+func encodeCommand(args []string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return []byte(b.String())
+}
+
+// redisError is an error reply: the command failed, the connection is fine
+type redisError string
+
+func (e redisError) Error() string {
+	return "cluster: redis: " + string(e)
+}
+
+// readReply reads one RESP reply: strings, integers, arrays of them, or
+// ErrNil or a redisError
+func readReply(reader *bufio.Reader) (interface{}, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("cluster: bad redis reply %q", line)
+	}
+	line = line[:len(line)-2]
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, ErrNil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, ErrNil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			item, err := readReply(reader)
+			if err != nil && err != ErrNil {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("cluster: bad redis reply %q", line)
+}
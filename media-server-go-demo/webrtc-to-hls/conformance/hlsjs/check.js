@@ -0,0 +1,56 @@
+// check.js plays an HLS stream with hls.js in headless Chromium for a few
+// seconds and prints every error hls.js reports, one JSON object a line.
+// It exits 1 when there was any, and reports a stream that never started
+// playing as a playbackStalled error.
+//
+//   node check.js <playlist url> [seconds]
+const puppeteer = require('puppeteer');
+const hlsPath = require.resolve('hls.js/dist/hls.min.js');
+
+const url = process.argv[2];
+const seconds = Number(process.argv[3] || 10);
+
+function report(errors, e) {
+  errors.push(e);
+  console.log(JSON.stringify(e));
+}
+
+async function main() {
+  const browser = await puppeteer.launch({
+    headless: true,
+    args: ['--no-sandbox', '--autoplay-policy=no-user-gesture-required'],
+  });
+  const errors = [];
+  try {
+    const page = await browser.newPage();
+    await page.exposeFunction('reportError', (e) => report(errors, e));
+    await page.setContent('<video muted playsinline></video>');
+    await page.addScriptTag({ path: hlsPath });
+    await page.evaluate((url) => {
+      const video = document.querySelector('video');
+      const hls = new Hls({ lowLatencyMode: true });
+      hls.on(Hls.Events.ERROR, (_, data) => window.reportError({
+        type: data.type,
+        details: data.details,
+        fatal: data.fatal,
+        url: (data.frag && data.frag.url) || data.url || '',
+      }));
+      hls.on(Hls.Events.MANIFEST_PARSED, () => video.play().catch(() => {}));
+      hls.loadSource(url);
+      hls.attachMedia(video);
+    }, url);
+    await new Promise((resolve) => setTimeout(resolve, seconds * 1000));
+    const played = await page.evaluate(() => document.querySelector('video').currentTime);
+    if (played === 0) {
+      report(errors, { type: 'mediaError', details: 'playbackStalled', fatal: true, url: url });
+    }
+  } finally {
+    await browser.close();
+  }
+  process.exit(errors.length > 0 ? 1 : 0);
+}
+
+main().catch((err) => {
+  console.error(err && err.stack ? err.stack : String(err));
+  process.exit(2);
+});
@@ -0,0 +1,79 @@
+// Package conformance checks HLS output with the tools players are judged
+// by: Apple's mediastreamvalidator, ffprobe and hls.js. Each tool is
+// optional; one that is not installed is reported as skipped instead of
+// failing the run, so the suite is useful on any machine that has some of
+// them.
+//
+// The suite itself only builds with the conformance tag, as it runs
+// GStreamer and the tools for minutes:
+//
+//	go test -tags conformance ./conformance/
+//
+// It writes a report of every configuration and tool to the path in
+// conformance_report, conformance-report.json by default.
+package conformance
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"time"
+)
+
+// Status is the outcome of running one tool on one configuration
+type Status string
+
+const (
+	Pass Status = "pass"
+	Fail Status = "fail"
+	Skip Status = "skip"
+)
+
+// Finding is one problem a tool reported
+type Finding struct {
+	// Tag is the playlist tag or the check the problem is about, e.g.
+	// EXT-X-TARGETDURATION or keyframe, so a regression names what broke
+	Tag     string `json:"tag"`
+	URI     string `json:"uri,omitempty"`
+	Message string `json:"message"`
+}
+
+// Result is what one tool said about one configuration
+type Result struct {
+	Config   string    `json:"config"`
+	Tool     string    `json:"tool"`
+	Status   Status    `json:"status"`
+	Reason   string    `json:"reason,omitempty"`
+	Findings []Finding `json:"findings,omitempty"`
+	Seconds  float64   `json:"seconds"`
+}
+
+// Report is the machine-readable outcome of a run
+type Report struct {
+	Started time.Time `json:"started"`
+	Results []Result  `json:"results"`
+}
+
+// Add records a result
+func (r *Report) Add(result Result) {
+	r.Results = append(r.Results, result)
+}
+
+// Failures returns the results that failed
+func (r *Report) Failures() []Result {
+	var failed []Result
+	for _, result := range r.Results {
+		if result.Status == Fail {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+// WriteFile writes the report as indented JSON
+func (r *Report) WriteFile(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
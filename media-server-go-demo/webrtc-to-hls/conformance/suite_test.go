@@ -0,0 +1,251 @@
+//go:build conformance
+// +build conformance
+
+package conformance
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/abr"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/hlscheck"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/playlist"
+)
+
+// the synthetic publisher: a test pattern encoded the way browsers publish
+// it, packaged by the elements and settings of the server's pipeline
+// (pipeline.HLS, the sink of the outputs in pipeline/pipeline.go)
+const (
+	publisherSource = "videotestsrc num-buffers=%d pattern=smpte ! video/x-raw,width=%d,height=%d,framerate=25/1 ! timeoverlay ! x264enc tune=zerolatency bitrate=%d key-int-max=%d ! h264parse ! "
+	tsSink          = "mpegtsmux ! hlssink location=%s playlist-location=%s target-duration=%d max-files=0 playlist-length=0"
+	cmafSink        = "hlscmafsink init-location=%s location=%s playlist-location=%s target-duration=%d playlist-length=0"
+)
+
+const (
+	publishSeconds = 12
+	toolTimeout    = 2 * time.Minute
+	playSeconds    = 10
+)
+
+// publish writes publishSeconds of the synthetic publisher to dir as TS
+// segments of targetDuration seconds listed by dir/playlist.m3u8
+func publish(t *testing.T, dir string, width, height, kbps, targetDuration int) {
+	t.Helper()
+	sink := fmt.Sprintf(tsSink, filepath.Join(dir, "segment%05d.ts"), filepath.Join(dir, "playlist.m3u8"), targetDuration)
+	launch(t, dir, width, height, kbps, targetDuration, sink)
+}
+
+func launch(t *testing.T, dir string, width, height, kbps, targetDuration int, sink string) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	pipeline := fmt.Sprintf(publisherSource, publishSeconds*25, width, height, kbps, targetDuration*25) + sink
+	if out, err := exec.Command("gst-launch-1.0", append([]string{"-e"}, strings.Fields(pipeline)...)...).CombinedOutput(); err != nil {
+		t.Fatalf("publisher: %v\n%s", err, out)
+	}
+}
+
+func readMedia(t *testing.T, path string) *hlscheck.Media {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	media, err := hlscheck.ParseMedia(data)
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	return media
+}
+
+func standard(t *testing.T, dir string) string {
+	publish(t, dir, 1280, 720, 2500, 2)
+	return "playlist.m3u8"
+}
+
+// fmp4 publishes CMAF segments sharing one initialization section
+func fmp4(t *testing.T, dir string) string {
+	sink := fmt.Sprintf(cmafSink, filepath.Join(dir, "init%05d.mp4"), filepath.Join(dir, "segment%05d.m4s"), filepath.Join(dir, "playlist.m3u8"), 2)
+	launch(t, dir, 1280, 720, 2500, 2, sink)
+	return "playlist.m3u8"
+}
+
+// lowLatency publishes one second parts and joins every four into a
+// segment, MPEG-TS segments being concatenable
+func lowLatency(t *testing.T, dir string) string {
+	const partsPerSegment = 4
+	publish(t, filepath.Join(dir, "parts"), 1280, 720, 2500, 1)
+	parts := readMedia(t, filepath.Join(dir, "parts", "playlist.m3u8")).Segments
+	stream := playlist.Stream{TargetDuration: partsPerSegment, PartTarget: 1}
+	var data []byte
+	duration := 0.0
+	for i, part := range parts {
+		chunk, err := ioutil.ReadFile(filepath.Join(dir, "parts", part.URI))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, chunk...)
+		duration += part.Duration
+		next := ""
+		if i+1 < len(parts) {
+			next = "parts/" + parts[i+1].URI
+		}
+		stream.AppendPart(playlist.Part{URI: "parts/" + part.URI, Duration: part.Duration, Independent: true}, next)
+		if (i+1)%partsPerSegment != 0 && i+1 < len(parts) {
+			continue
+		}
+		name := fmt.Sprintf("segment%05d.ts", i/partsPerSegment)
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		stream.Append(playlist.Segment{URI: name, Duration: duration})
+		data, duration = nil, 0
+	}
+	stream.End()
+	writePlaylist(t, filepath.Join(dir, "ll.m3u8"), stream.Media().Write)
+	return "ll.m3u8"
+}
+
+// adaptive publishes two renditions and lists them in a master playlist,
+// with the codecs of their SPS and their measured peak bitrate
+func adaptive(t *testing.T, dir string) string {
+	renditions := []struct {
+		name          string
+		width, height int
+		kbps          int
+	}{
+		{"720p", 1280, 720, 2500},
+		{"360p", 640, 360, 800},
+	}
+	var variants []abr.Variant
+	for _, r := range renditions {
+		rdir := filepath.Join(dir, r.name)
+		publish(t, rdir, r.width, r.height, r.kbps, 2)
+		media := readMedia(t, filepath.Join(rdir, "playlist.m3u8"))
+		v := abr.Variant{Name: r.name, URI: r.name + "/playlist.m3u8"}
+		for i, segment := range media.Segments {
+			data, err := ioutil.ReadFile(filepath.Join(rdir, segment.URI))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bandwidth := int(math.Ceil(float64(len(data)*8) / segment.Duration)); bandwidth > v.Bandwidth {
+				v.Bandwidth = bandwidth
+			}
+			if i > 0 {
+				continue
+			}
+			nal, err := hlscheck.FindSPS(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sps, err := hlscheck.ParseSPS(nal)
+			if err != nil {
+				t.Fatal(err)
+			}
+			v.Codecs, v.Width, v.Height = sps.CodecString(), sps.Width, sps.Height
+		}
+		variants = append(variants, v)
+	}
+	writePlaylist(t, filepath.Join(dir, "master.m3u8"), func(w io.Writer) error {
+		return abr.WriteMaster(w, variants, nil)
+	})
+	return "master.m3u8"
+}
+
+func writePlaylist(t *testing.T, path string, write func(io.Writer) error) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := write(f); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// configurations are what the suite validates. A configuration without
+// build is one the server cannot produce yet; its results are skipped so
+// the report still lists it.
+var configurations = []struct {
+	name      string
+	container string
+	build     func(t *testing.T, dir string) string
+	reason    string
+}{
+	{name: "standard", container: "ts", build: standard},
+	{name: "ll-hls", container: "ts", build: lowLatency},
+	{name: "abr", container: "ts", build: adaptive},
+	{name: "fmp4", container: "fmp4", build: fmp4},
+}
+
+// corsFiles serves dir to hls.js, whose page has no origin
+func corsFiles(dir string) http.Handler {
+	files := http.FileServer(http.Dir(dir))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		files.ServeHTTP(w, r)
+	})
+}
+
+func TestConformance(t *testing.T) {
+	if _, err := exec.LookPath("gst-launch-1.0"); err != nil {
+		t.Skip("gst-launch-1.0 is not installed")
+	}
+	root, err := ioutil.TempDir("", "conformance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	server := httptest.NewServer(corsFiles(root))
+	defer server.Close()
+
+	tools := []Tool{MediaStreamValidator(), FFProbe(), HLSJS(filepath.Join("hlsjs", "check.js"), playSeconds)}
+	report := &Report{Started: time.Now()}
+	for _, config := range configurations {
+		if config.build == nil {
+			for _, tool := range tools {
+				report.Add(Result{Config: config.name, Tool: tool.Name, Status: Skip, Reason: config.reason})
+			}
+			continue
+		}
+		dir := filepath.Join(root, config.name)
+		target := Target{
+			Config:    config.name,
+			Dir:       dir,
+			BaseURL:   server.URL + "/" + config.name,
+			Playlist:  config.build(t, dir),
+			Container: config.container,
+		}
+		for _, tool := range tools {
+			ctx, cancel := context.WithTimeout(context.Background(), toolTimeout)
+			report.Add(tool.Check(ctx, target))
+			cancel()
+		}
+	}
+
+	path := os.Getenv("conformance_report")
+	if path == "" {
+		path = "conformance-report.json"
+	}
+	if err := report.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	for _, result := range report.Failures() {
+		for _, f := range result.Findings {
+			t.Errorf("%s/%s: %s %s: %s", result.Config, result.Tool, f.Tag, f.URI, f.Message)
+		}
+	}
+}
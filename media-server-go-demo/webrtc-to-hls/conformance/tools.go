@@ -0,0 +1,361 @@
+package conformance
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/hlscheck"
+)
+
+// Target is an output to validate
+type Target struct {
+	Config string
+	// Dir is where the output was written and BaseURL where it is served
+	Dir     string
+	BaseURL string
+	// Playlist is the media or master playlist, relative to Dir and BaseURL
+	Playlist string
+	// Container is "ts" or "fmp4"
+	Container string
+}
+
+// URL is the URL of the playlist
+func (t Target) URL() string {
+	return strings.TrimSuffix(t.BaseURL, "/") + "/" + t.Playlist
+}
+
+// Tool is an external validator
+type Tool struct {
+	Name string
+	// Command is the executable, looked up in PATH
+	Command string
+	// missing returns why the tool cannot run besides Command not being
+	// installed, empty when it can
+	missing func() string
+	check   func(ctx context.Context, command string, target Target) ([]Finding, error)
+}
+
+// Check runs the tool on target. A tool that is not installed is skipped;
+// one that could not run at all fails with a finding tagged "run".
+func (t Tool) Check(ctx context.Context, target Target) Result {
+	result := Result{Config: target.Config, Tool: t.Name}
+	command, err := exec.LookPath(t.Command)
+	if err != nil {
+		result.Status, result.Reason = Skip, t.Command+" is not installed"
+		return result
+	}
+	if t.missing != nil {
+		if reason := t.missing(); reason != "" {
+			result.Status, result.Reason = Skip, reason
+			return result
+		}
+	}
+	start := time.Now()
+	findings, err := t.check(ctx, command, target)
+	result.Seconds = time.Since(start).Seconds()
+	if err != nil {
+		findings = append(findings, Finding{Tag: "run", Message: err.Error()})
+	}
+	result.Findings = findings
+	result.Status = Pass
+	if len(findings) > 0 {
+		result.Status = Fail
+	}
+	return result
+}
+
+// run runs a command, returning its output. A non zero exit status is
+// not an error: validators exit with one when they found problems.
+func run(ctx context.Context, command string, args ...string) (stdout, stderr []byte, err error) {
+	var out, errOut bytes.Buffer
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.Stdout, cmd.Stderr = &out, &errOut
+	if err := cmd.Run(); err != nil {
+		if _, exited := err.(*exec.ExitError); !exited || ctx.Err() != nil {
+			return out.Bytes(), errOut.Bytes(), fmt.Errorf("%s: %v", filepath.Base(command), err)
+		}
+	}
+	return out.Bytes(), errOut.Bytes(), nil
+}
+
+// MediaStreamValidator is Apple's validator, installed with the HTTP Live
+// Streaming tools on macOS
+func MediaStreamValidator() Tool {
+	return Tool{
+		Name:    "mediastreamvalidator",
+		Command: "mediastreamvalidator",
+		check: func(ctx context.Context, command string, target Target) ([]Finding, error) {
+			stdout, _, err := run(ctx, command, target.URL())
+			if err != nil {
+				return nil, err
+			}
+			return parseValidator(stdout), nil
+		},
+	}
+}
+
+var (
+	numberedIssue = regexp.MustCompile(`^\d+\.\s+(.*)$`)
+	issueURI      = regexp.MustCompile(`^(?:Stream|URL|Playlist):\s*(\S+)`)
+	playlistTag   = regexp.MustCompile(`EXT-X-[A-Z0-9-]+`)
+)
+
+// parseValidator returns the MUST FIX issues of a mediastreamvalidator
+// report. SHOULD FIX issues are recommendations and are not findings.
+func parseValidator(output []byte) []Finding {
+	var findings []Finding
+	mustFix := false
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasSuffix(line, "issues found"):
+			mustFix = strings.HasPrefix(line, "MUST FIX")
+		case !mustFix:
+		case numberedIssue.MatchString(line):
+			message := numberedIssue.FindStringSubmatch(line)[1]
+			tag := playlistTag.FindString(message)
+			if tag == "" {
+				tag = "must-fix"
+			}
+			findings = append(findings, Finding{Tag: tag, Message: message})
+		case issueURI.MatchString(line) && len(findings) > 0 && findings[len(findings)-1].URI == "":
+			findings[len(findings)-1].URI = issueURI.FindStringSubmatch(line)[1]
+		}
+	}
+	return findings
+}
+
+// FFProbe checks every segment of the output: that it decodes cleanly, is
+// in the expected container, holds H264 starting with a keyframe, lasts what
+// its EXTINF says and continues the timestamps of the segment before it
+func FFProbe() Tool {
+	return Tool{
+		Name:    "ffprobe",
+		Command: "ffprobe",
+		check: func(ctx context.Context, command string, target Target) ([]Finding, error) {
+			playlists, err := mediaPlaylists(target.Dir, target.Playlist)
+			if err != nil {
+				return nil, err
+			}
+			var findings []Finding
+			for _, name := range playlists {
+				data, err := ioutil.ReadFile(filepath.Join(target.Dir, filepath.FromSlash(name)))
+				if err != nil {
+					return findings, err
+				}
+				media, err := hlscheck.ParseMedia(data)
+				if err != nil {
+					findings = append(findings, Finding{Tag: "playlist", URI: name, Message: err.Error()})
+					continue
+				}
+				end := math.NaN()
+				for _, segment := range media.Segments {
+					uri := path.Join(path.Dir(name), segment.URI)
+					file := filepath.Join(target.Dir, filepath.FromSlash(uri))
+					if media.Map != "" {
+						if file, err = withInit(filepath.Join(target.Dir, filepath.FromSlash(path.Join(path.Dir(name), media.Map))), file); err != nil {
+							return findings, err
+						}
+					}
+					stdout, stderr, err := run(ctx, command, "-v", "error", "-of", "json",
+						"-show_format", "-show_streams", "-select_streams", "v:0",
+						"-show_frames", "-read_intervals", "%+#1", file)
+					if media.Map != "" {
+						os.Remove(file)
+					}
+					if err != nil {
+						return findings, err
+					}
+					var found []Finding
+					found, end = checkProbe(uri, segment.Duration, target.Container, stdout, stderr, end)
+					findings = append(findings, found...)
+				}
+			}
+			return findings, nil
+		},
+	}
+}
+
+// withInit copies the fMP4 segment at file behind its initialization
+// section init to a temporary file, as a media segment alone does not probe
+func withInit(init, file string) (string, error) {
+	header, err := ioutil.ReadFile(init)
+	if err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile("", "segment*.mp4")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(header, data...)); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+type probe struct {
+	Format struct {
+		FormatName string `json:"format_name"`
+		StartTime  string `json:"start_time"`
+		Duration   string `json:"duration"`
+	} `json:"format"`
+	Streams []struct {
+		CodecName string `json:"codec_name"`
+	} `json:"streams"`
+	Frames []struct {
+		KeyFrame int `json:"key_frame"`
+	} `json:"frames"`
+}
+
+// tolerances for a segment against its EXTINF and the previous segment, in
+// seconds: one frame at 25fps on top of rounding
+const (
+	durationTolerance   = 0.1
+	continuityTolerance = 0.05
+)
+
+var containerFormats = map[string]string{"ts": "mpegts", "fmp4": "mov"}
+
+// checkProbe checks the ffprobe output of a segment listed with duration
+// extinf, prevEnd being where the previous segment ended (NaN for the first
+// one). It returns the findings and where this segment ends.
+func checkProbe(uri string, extinf float64, container string, stdout, stderr []byte, prevEnd float64) ([]Finding, float64) {
+	var findings []Finding
+	add := func(tag, format string, args ...interface{}) {
+		findings = append(findings, Finding{Tag: tag, URI: uri, Message: fmt.Sprintf(format, args...)})
+	}
+	if line := firstLine(stderr); line != "" {
+		add("decode", "%s", line)
+	}
+	var p probe
+	if err := json.Unmarshal(stdout, &p); err != nil {
+		add("decode", "unreadable ffprobe output: %v", err)
+		return findings, math.NaN()
+	}
+	if want := containerFormats[container]; !strings.Contains(p.Format.FormatName, want) {
+		add("container", "segment is %q, want %s", p.Format.FormatName, want)
+	}
+	if len(p.Streams) == 0 {
+		add("codec", "segment has no video stream")
+	} else if p.Streams[0].CodecName != "h264" {
+		add("codec", "video is %s, want h264", p.Streams[0].CodecName)
+	}
+	if len(p.Frames) == 0 || p.Frames[0].KeyFrame != 1 {
+		add("keyframe", "segment does not start with a keyframe")
+	}
+	start, errStart := strconv.ParseFloat(p.Format.StartTime, 64)
+	duration, errDuration := strconv.ParseFloat(p.Format.Duration, 64)
+	if errStart != nil || errDuration != nil {
+		add("timestamps", "segment has no start time or duration")
+		return findings, math.NaN()
+	}
+	if math.Abs(duration-extinf) > durationTolerance {
+		add("EXTINF", "segment lasts %.3fs, EXTINF says %.3fs", duration, extinf)
+	}
+	if !math.IsNaN(prevEnd) && math.Abs(start-prevEnd) > continuityTolerance {
+		add("timestamps", "segment starts at %.3f, the previous one ended at %.3f", start, prevEnd)
+	}
+	return findings, start + duration
+}
+
+// HLSJS plays the output with hls.js in headless Chromium, through the node
+// script at script. The script's dependencies are installed with npm install
+// next to it.
+func HLSJS(script string, seconds int) Tool {
+	return Tool{
+		Name:    "hls.js",
+		Command: "node",
+		missing: func() string {
+			if _, err := os.Stat(filepath.Join(filepath.Dir(script), "node_modules")); err != nil {
+				return "run npm install in " + filepath.Dir(script)
+			}
+			return ""
+		},
+		check: func(ctx context.Context, command string, target Target) ([]Finding, error) {
+			stdout, stderr, err := run(ctx, command, script, target.URL(), strconv.Itoa(seconds))
+			if err != nil {
+				return nil, err
+			}
+			findings, err := parseHLSJS(stdout)
+			if err == nil && len(findings) == 0 && len(stderr) > 0 {
+				err = fmt.Errorf("hls.js: %s", firstLine(stderr))
+			}
+			return findings, err
+		},
+	}
+}
+
+// parseHLSJS reads the errors the script printed, one JSON object a line
+func parseHLSJS(output []byte) ([]Finding, error) {
+	var findings []Finding
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var e struct {
+			Type    string `json:"type"`
+			Details string `json:"details"`
+			Fatal   bool   `json:"fatal"`
+			URL     string `json:"url"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return findings, fmt.Errorf("hls.js: unreadable line %q", scanner.Text())
+		}
+		message := e.Type
+		if e.Fatal {
+			message += " (fatal)"
+		}
+		findings = append(findings, Finding{Tag: e.Details, URI: e.URL, Message: message})
+	}
+	return findings, nil
+}
+
+// mediaPlaylists returns the media playlists of the output, relative to
+// dir: the variants of a master playlist, or the playlist itself
+func mediaPlaylists(dir, playlist string) ([]string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(playlist)))
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Contains(data, []byte("#EXT-X-STREAM-INF")) {
+		return []string{playlist}, nil
+	}
+	variants, err := hlscheck.ParseMaster(data)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(variants))
+	for _, v := range variants {
+		names = append(names, path.Join(path.Dir(playlist), v.URI))
+	}
+	return names, nil
+}
+
+func firstLine(data []byte) string {
+	line := strings.TrimSpace(string(data))
+	if i := strings.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	return line
+}
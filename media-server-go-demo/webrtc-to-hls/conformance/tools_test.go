@@ -0,0 +1,108 @@
+package conformance
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseValidator(t *testing.T) {
+	output := []byte(`Processing http://127.0.0.1/abr/master.m3u8
+--------------------------------------------------------------------------------
+MUST FIX issues found
+--------------------------------------------------------------------------------
+1. Measured peak bitrate compared to master playlist declared value exceeds error tolerance
+	Stream: http://127.0.0.1/abr/720p/playlist.m3u8
+2. EXT-X-TARGETDURATION is less than the duration of a segment
+--------------------------------------------------------------------------------
+SHOULD FIX issues found
+--------------------------------------------------------------------------------
+1. Playlist vendor tags found
+`)
+	want := []Finding{
+		{Tag: "must-fix", URI: "http://127.0.0.1/abr/720p/playlist.m3u8", Message: "Measured peak bitrate compared to master playlist declared value exceeds error tolerance"},
+		{Tag: "EXT-X-TARGETDURATION", Message: "EXT-X-TARGETDURATION is less than the duration of a segment"},
+	}
+	if got := parseValidator(output); !reflect.DeepEqual(got, want) {
+		t.Fatalf("findings = %+v", got)
+	}
+	if got := parseValidator([]byte("No problems found\n")); got != nil {
+		t.Fatalf("clean run has findings: %+v", got)
+	}
+}
+
+func TestCheckProbe(t *testing.T) {
+	good := []byte(`{"frames":[{"key_frame":1}],"streams":[{"codec_name":"h264"}],"format":{"format_name":"mpegts","start_time":"3.400000","duration":"2.000000"}}`)
+	findings, end := checkProbe("segment00001.ts", 2, "ts", good, nil, 3.4)
+	if len(findings) != 0 || math.Abs(end-5.4) > 1e-9 {
+		t.Fatalf("findings = %+v, end = %v", findings, end)
+	}
+
+	bad := []byte(`{"frames":[{"key_frame":0}],"streams":[{"codec_name":"hevc"}],"format":{"format_name":"mov,mp4","start_time":"6.000000","duration":"3.000000"}}`)
+	findings, _ = checkProbe("segment00002.ts", 2, "ts", bad, []byte("non-existing PPS 0 referenced\n"), 5.4)
+	var tags []string
+	for _, f := range findings {
+		if f.URI != "segment00002.ts" {
+			t.Errorf("finding without its segment: %+v", f)
+		}
+		tags = append(tags, f.Tag)
+	}
+	if want := []string{"decode", "container", "codec", "keyframe", "EXTINF", "timestamps"}; !reflect.DeepEqual(tags, want) {
+		t.Fatalf("tags = %v", tags)
+	}
+}
+
+func TestParseHLSJS(t *testing.T) {
+	output := []byte(`{"type":"networkError","details":"fragLoadError","fatal":true,"url":"http://127.0.0.1/ll-hls/parts/segment00003.ts"}
+
+{"type":"mediaError","details":"bufferStalledError","fatal":false,"url":""}
+`)
+	findings, err := parseHLSJS(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Finding{
+		{Tag: "fragLoadError", URI: "http://127.0.0.1/ll-hls/parts/segment00003.ts", Message: "networkError (fatal)"},
+		{Tag: "bufferStalledError", Message: "mediaError"},
+	}
+	if !reflect.DeepEqual(findings, want) {
+		t.Fatalf("findings = %+v", findings)
+	}
+	if _, err := parseHLSJS([]byte("TypeError: Hls is not defined\n")); err == nil {
+		t.Fatal("script crash read as no errors")
+	}
+}
+
+func TestMissingToolSkips(t *testing.T) {
+	tool := Tool{Name: "validator", Command: "no-such-validator-installed"}
+	result := tool.Check(context.Background(), Target{Config: "standard"})
+	if result.Status != Skip || result.Config != "standard" || result.Tool != "validator" {
+		t.Fatalf("result = %+v", result)
+	}
+
+	dir, err := ioutil.TempDir("", "hlsjs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hlsjs := HLSJS(filepath.Join(dir, "check.js"), 1)
+	hlsjs.Command = "go"
+	if result := hlsjs.Check(context.Background(), Target{Config: "abr"}); result.Status != Skip || result.Reason != "run npm install in "+dir {
+		t.Fatalf("result = %+v", result)
+	}
+}
+
+func TestReportFailures(t *testing.T) {
+	report := &Report{}
+	report.Add(Result{Config: "standard", Tool: "ffprobe", Status: Pass})
+	report.Add(Result{Config: "ll-hls", Tool: "hls.js", Status: Fail, Findings: []Finding{{Tag: "levelParsingError"}}})
+	report.Add(Result{Config: "fmp4", Tool: "ffprobe", Status: Skip})
+	failed := report.Failures()
+	if len(failed) != 1 || failed[0].Config != "ll-hls" || failed[0].Findings[0].Tag != "levelParsingError" {
+		t.Fatalf("failures = %+v", failed)
+	}
+}
@@ -0,0 +1,23 @@
+// Package control is the Control service of control.proto, served over
+// gRPC for orchestration services managing the server without polling it:
+// its messages and service stubs, generated from control.proto, and the
+// Hub fanning lifecycle events out to WatchEvents calls.
+package control
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative control.proto
+
+import (
+	"context"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// Metadata returns the metadata name of the incoming call of ctx, e.g.
+// x-admin-identity, empty when not sent
+func Metadata(ctx context.Context, name string) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get(name); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
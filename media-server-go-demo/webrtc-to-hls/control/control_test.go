@@ -0,0 +1,144 @@
+package control
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+type fakeService struct {
+	UnimplementedControlServer
+	events []*Event
+}
+
+func (f *fakeService) GetStream(ctx context.Context, req *StreamRequest) (*Stream, error) {
+	if req.Id != "live" {
+		return nil, status.Errorf(codes.NotFound, "stream %s is not live", req.Id)
+	}
+	return &Stream{Key: "live", SessionId: "s1", Viewers: 3, Publisher: Metadata(ctx, "x-admin-identity")}, nil
+}
+
+func (f *fakeService) WatchStats(req *WatchStatsRequest, stream Control_WatchStatsServer) error {
+	<-stream.Context().Done()
+	return stream.Context().Err()
+}
+
+func (f *fakeService) WatchEvents(req *WatchEventsRequest, stream Control_WatchEventsServer) error {
+	for _, event := range f.events {
+		if len(req.Types) > 0 && req.Types[0] != event.Type {
+			continue
+		}
+		if err := stream.Send(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dial serves service in memory and returns a client of it
+func dial(t *testing.T, service ControlServer) ControlClient {
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	RegisterControlServer(server, service)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	conn, err := grpc.NewClient("passthrough:///control",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return NewControlClient(conn)
+}
+
+func TestUnary(t *testing.T) {
+	client := dial(t, &fakeService{})
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-admin-identity", "ops")
+
+	stream, err := client.GetStream(ctx, &StreamRequest{Id: "live"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stream.Key != "live" || stream.SessionId != "s1" || stream.Viewers != 3 || stream.Publisher != "ops" {
+		t.Fatalf("stream %v", stream)
+	}
+
+	_, err = client.GetStream(context.Background(), &StreamRequest{Id: "gone"})
+	if s := status.Convert(err); s.Code() != codes.NotFound || s.Message() != "stream gone is not live" {
+		t.Fatalf("not found = %v", err)
+	}
+	if _, err := client.KickStream(ctx, &KickStreamRequest{Id: "live"}); status.Code(err) != codes.Unimplemented {
+		t.Fatalf("unimplemented = %v", err)
+	}
+	deadline, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	stats, err := client.WatchStats(deadline, &WatchStatsRequest{Id: "live"})
+	if err == nil {
+		_, err = stats.Recv()
+	}
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("deadline = %v", err)
+	}
+}
+
+func TestServerStream(t *testing.T) {
+	client := dial(t, &fakeService{events: []*Event{
+		{Id: "e1", Type: "stream.started", Stream: "live", Data: map[string]string{"ingest": "whip"}},
+		{Id: "e2", Type: "stream.ended", Stream: "live"},
+		{Id: "e3", Type: "stream.started", Stream: "other"},
+	}})
+
+	events, err := client.WatchEvents(context.Background(), &WatchEventsRequest{Types: []string{"stream.started"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for {
+		event, err := events.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, event.Id)
+		if event.Id == "e1" && event.Data["ingest"] != "whip" {
+			t.Fatalf("event %v", event)
+		}
+	}
+	if strings.Join(ids, ",") != "e1,e3" {
+		t.Fatalf("events %v", ids)
+	}
+}
+
+func TestHub(t *testing.T) {
+	var hub Hub
+	events, cancel := hub.Subscribe(1)
+	hub.Publish(&Event{Id: "e1"})
+	hub.Publish(&Event{Id: "e2"})
+	if e := <-events; e.Id != "e1" || hub.Dropped() != 1 {
+		t.Fatalf("got %s, dropped %d", e.Id, hub.Dropped())
+	}
+	cancel()
+	cancel()
+	hub.Publish(&Event{Id: "e3"})
+	select {
+	case e := <-events:
+		t.Fatalf("got %s after cancel", e.Id)
+	case <-time.After(10 * time.Millisecond):
+	}
+	if hub.Subscribers() != 0 {
+		t.Fatal("subscription kept")
+	}
+}
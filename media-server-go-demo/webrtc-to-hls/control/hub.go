@@ -0,0 +1,59 @@
+package control
+
+import "sync"
+
+// Hub fans events out to the WatchEvents calls subscribed. A subscriber
+// whose buffer is full misses the event rather than holding up the server.
+// The zero Hub is ready to use.
+type Hub struct {
+	lock        sync.Mutex
+	subscribers map[chan *Event]struct{}
+	dropped     uint64
+}
+
+// Subscribe returns the events published from now on, buffering up to
+// buffer of them, and the func ending the subscription
+func (h *Hub) Subscribe(buffer int) (<-chan *Event, func()) {
+	events := make(chan *Event, buffer)
+	h.lock.Lock()
+	if h.subscribers == nil {
+		h.subscribers = map[chan *Event]struct{}{}
+	}
+	h.subscribers[events] = struct{}{}
+	h.lock.Unlock()
+	var once sync.Once
+	return events, func() {
+		once.Do(func() {
+			h.lock.Lock()
+			delete(h.subscribers, events)
+			h.lock.Unlock()
+		})
+	}
+}
+
+// Publish sends event to every subscriber with room for it
+func (h *Hub) Publish(event *Event) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for events := range h.subscribers {
+		select {
+		case events <- event:
+		default:
+			h.dropped++
+		}
+	}
+}
+
+// Subscribers counts the subscriptions
+func (h *Hub) Subscribers() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return len(h.subscribers)
+}
+
+// Dropped counts the events subscribers missed
+func (h *Hub) Dropped() uint64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.dropped
+}
@@ -0,0 +1,178 @@
+// Package egress limits the bandwidth HLS playback may use, per stream and
+// for the whole instance. Limits are enforced when a request is admitted,
+// never while it is being answered: a response that started is written at
+// full speed and its bytes are taken from the buckets as they go out, which
+// may leave a bucket in debt. New requests are refused until the debt is
+// paid back, so one popular stream is turned away instead of slowing every
+// viewer of every stream down.
+package egress
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// rateWindow is how long egress is averaged over to report its rate
+const rateWindow = 5 * time.Second
+
+// Bucket is a token bucket of bytes
+type Bucket struct {
+	// Rate is the refill rate in bytes per second, unlimited when zero
+	Rate  float64
+	Burst float64
+
+	lock   sync.Mutex
+	now    func() time.Time
+	tokens float64
+	last   time.Time
+
+	windowStart time.Time
+	windowBytes float64
+	rate        float64
+}
+
+// NewBucket returns a full bucket refilling at rate bytes per second and
+// holding up to burst bytes
+func NewBucket(rate, burst float64) *Bucket {
+	return newBucket(rate, burst, time.Now)
+}
+
+func newBucket(rate, burst float64, now func() time.Time) *Bucket {
+	if burst < rate {
+		burst = rate
+	}
+	start := now()
+	return &Bucket{
+		Rate:        rate,
+		Burst:       burst,
+		now:         now,
+		tokens:      burst,
+		last:        start,
+		windowStart: start,
+	}
+}
+
+// refill adds the tokens earned since the last call; called with the lock held
+func (b *Bucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.Burst, b.tokens+elapsed*b.Rate)
+	}
+	b.last = now
+	if elapsed := now.Sub(b.windowStart); elapsed >= rateWindow {
+		b.rate = b.windowBytes / elapsed.Seconds()
+		b.windowStart = now
+		b.windowBytes = 0
+	}
+}
+
+// wait reports how long until the bucket is out of debt, zero when a
+// request may start now
+func (b *Bucket) wait() time.Duration {
+	if b == nil || b.Rate <= 0 {
+		return 0
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill(b.now())
+	if b.tokens > 0 {
+		return 0
+	}
+	return time.Duration((-b.tokens/b.Rate)*float64(time.Second)) + time.Millisecond
+}
+
+// take removes n bytes from the bucket, going into debt if need be
+func (b *Bucket) take(n int) {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill(b.now())
+	b.windowBytes += float64(n)
+	if b.Rate > 0 {
+		b.tokens -= float64(n)
+	}
+}
+
+// Usage is the egress of a bucket against its limit, in bytes per second
+type Usage struct {
+	Rate float64 `json:"rateBps"`
+	// Limit is zero when unlimited
+	Limit float64 `json:"limitBps"`
+}
+
+// Usage returns the egress rate averaged over the last complete window
+func (b *Bucket) Usage() Usage {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill(b.now())
+	return Usage{Rate: b.rate, Limit: b.Rate}
+}
+
+// Shaper holds the global bucket and one bucket per stream
+type Shaper struct {
+	// Global bounds the egress of all streams, nil for no global bucket
+	Global *Bucket
+	// Limit returns the rate and burst of a stream, in bytes, or a zero rate
+	// for no stream limit
+	Limit func(stream string) (float64, float64)
+
+	lock    sync.Mutex
+	now     func() time.Time
+	streams map[string]*Bucket
+}
+
+// NewShaper returns a shaper with the given global bucket
+func NewShaper(global *Bucket, limit func(stream string) (float64, float64)) *Shaper {
+	return &Shaper{Global: global, Limit: limit, now: time.Now, streams: map[string]*Bucket{}}
+}
+
+// Stream returns the bucket of stream, created on first use
+func (s *Shaper) Stream(stream string) *Bucket {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	b := s.streams[stream]
+	if b == nil {
+		var rate, burst float64
+		if s.Limit != nil {
+			rate, burst = s.Limit(stream)
+		}
+		b = newBucket(rate, burst, s.now)
+		s.streams[stream] = b
+	}
+	return b
+}
+
+// Forget drops the bucket of a stream that ended
+func (s *Shaper) Forget(stream string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.streams, stream)
+}
+
+// Admit decides whether a new request for streams may start. When it may
+// not, it returns how long until it would.
+func (s *Shaper) Admit(streams []string) (time.Duration, bool) {
+	retry := s.Global.wait()
+	for _, stream := range streams {
+		if wait := s.Stream(stream).wait(); wait > retry {
+			retry = wait
+		}
+	}
+	return retry, retry == 0
+}
+
+// Meter returns the function taking the bytes of a response for streams
+// from the global bucket and the stream buckets
+func (s *Shaper) Meter(streams []string) func(n int) {
+	buckets := []*Bucket{s.Global}
+	for _, stream := range streams {
+		buckets = append(buckets, s.Stream(stream))
+	}
+	return func(n int) {
+		for _, b := range buckets {
+			b.take(n)
+		}
+	}
+}
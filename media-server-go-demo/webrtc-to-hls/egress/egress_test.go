@@ -0,0 +1,100 @@
+package egress
+
+import (
+	"testing"
+	"time"
+)
+
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time { return c.t }
+
+func (c *clock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func TestBucketDebt(t *testing.T) {
+	c := &clock{t: time.Unix(1000, 0)}
+	b := newBucket(1000, 2000, c.now)
+	if wait := b.wait(); wait != 0 {
+		t.Fatalf("full bucket wait = %v", wait)
+	}
+	// a response that started is never cut short, the bucket goes into debt
+	b.take(3000)
+	wait := b.wait()
+	if wait < time.Second || wait > time.Second+10*time.Millisecond {
+		t.Fatalf("wait = %v, want about 1s", wait)
+	}
+	c.advance(500 * time.Millisecond)
+	if b.wait() == 0 {
+		t.Fatal("admitted while in debt")
+	}
+	c.advance(600 * time.Millisecond)
+	if wait := b.wait(); wait != 0 {
+		t.Fatalf("wait = %v once paid back", wait)
+	}
+	// tokens never pile up over the burst
+	c.advance(time.Hour)
+	b.take(2001)
+	if b.wait() == 0 {
+		t.Fatal("burst exceeded")
+	}
+}
+
+func TestUnlimitedBucket(t *testing.T) {
+	c := &clock{t: time.Unix(1000, 0)}
+	b := newBucket(0, 0, c.now)
+	b.take(1 << 30)
+	if wait := b.wait(); wait != 0 {
+		t.Fatalf("unlimited wait = %v", wait)
+	}
+	if usage := b.Usage(); usage.Limit != 0 {
+		t.Fatalf("usage = %+v", usage)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	c := &clock{t: time.Unix(1000, 0)}
+	b := newBucket(1000, 1000, c.now)
+	for i := 0; i < 5; i++ {
+		b.take(400)
+		c.advance(time.Second)
+	}
+	usage := b.Usage()
+	if usage.Rate != 400 || usage.Limit != 1000 {
+		t.Fatalf("usage = %+v", usage)
+	}
+}
+
+func TestShaper(t *testing.T) {
+	c := &clock{t: time.Unix(1000, 0)}
+	s := NewShaper(newBucket(10000, 10000, c.now), func(stream string) (float64, float64) {
+		if stream == "viral" {
+			return 1000, 1000
+		}
+		return 0, 0
+	})
+	s.now = c.now
+
+	s.Meter([]string{"viral"})(1500)
+	if _, ok := s.Admit([]string{"viral"}); ok {
+		t.Fatal("viral stream admitted over its budget")
+	}
+	if _, ok := s.Admit([]string{"quiet"}); !ok {
+		t.Fatal("other stream refused")
+	}
+
+	// the global budget applies to every stream
+	s.Meter([]string{"quiet"})(9000)
+	retry, ok := s.Admit([]string{"quiet"})
+	if ok || retry <= 0 {
+		t.Fatalf("admit = %v %v over the global budget", retry, ok)
+	}
+	c.advance(retry)
+	if _, ok := s.Admit([]string{"quiet"}); !ok {
+		t.Fatal("still refused after retry")
+	}
+
+	s.Forget("viral")
+	if _, ok := s.Admit([]string{"viral"}); !ok {
+		t.Fatal("forgotten stream kept its debt")
+	}
+}
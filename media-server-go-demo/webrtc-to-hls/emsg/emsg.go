@@ -0,0 +1,76 @@
+// Package emsg writes the DASH event message boxes CMAF segments carry
+// their timed metadata in (ISO/IEC 23009-1 5.10.3.3), and places them in
+// segments ahead of the movie fragments they annotate.
+package emsg
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// SchemeID3 is the scheme of events whose message is an ID3 tag, which
+// hls.js and AVPlayer surface like the ID3 of MPEG-TS (AOM ID3 in CMAF)
+const SchemeID3 = "https://aomedia.org/emsg/ID3"
+
+// UnknownDuration is the duration of an event whose end is not known
+const UnknownDuration = 0xffffffff
+
+var ErrNoFragment = errors.New("emsg: no moof box in the segment")
+
+// Event is an event message
+type Event struct {
+	SchemeIDURI string
+	Value       string
+	// Timescale is the units per second of the times of the event
+	Timescale uint32
+	// PresentationTimeDelta is when the event starts past the earliest
+	// presentation time of the segment
+	PresentationTimeDelta uint32
+	Duration              uint32
+	// ID tells repeated announcements of an event apart from new events
+	ID   uint32
+	Data []byte
+}
+
+// Box writes the event as a version 0 emsg box
+func (e Event) Box() []byte {
+	payload := []byte{0, 0, 0, 0}
+	payload = append(payload, e.SchemeIDURI...)
+	payload = append(payload, 0)
+	payload = append(payload, e.Value...)
+	payload = append(payload, 0)
+	for _, field := range []uint32{e.Timescale, e.PresentationTimeDelta, e.Duration, e.ID} {
+		payload = binary.BigEndian.AppendUint32(payload, field)
+	}
+	payload = append(payload, e.Data...)
+	box := binary.BigEndian.AppendUint32(nil, uint32(8+len(payload)))
+	return append(append(box, "emsg"...), payload...)
+}
+
+// Insert returns segment with the emsg boxes of events before its first
+// moof. Offsets in a moof are relative to its own start, so moving it
+// leaves its samples where it says they are.
+func Insert(segment []byte, events ...Event) ([]byte, error) {
+	for pos := 0; pos+8 <= len(segment); {
+		size := int(binary.BigEndian.Uint32(segment[pos:]))
+		switch {
+		case size == 1 && pos+16 <= len(segment):
+			size = int(binary.BigEndian.Uint64(segment[pos+8:]))
+		case size == 0:
+			size = len(segment) - pos
+		}
+		if size < 8 || pos+size > len(segment) {
+			return nil, errors.New("emsg: malformed box")
+		}
+		if string(segment[pos+4:pos+8]) == "moof" {
+			out := make([]byte, 0, len(segment)+len(events)*64)
+			out = append(out, segment[:pos]...)
+			for _, e := range events {
+				out = append(out, e.Box()...)
+			}
+			return append(out, segment[pos:]...), nil
+		}
+		pos += size
+	}
+	return nil, ErrNoFragment
+}
@@ -0,0 +1,34 @@
+package emsg
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestInsert(t *testing.T) {
+	styp := []byte("\x00\x00\x00\x10stypmsdh\x00\x00\x00\x00")
+	moof := []byte("\x00\x00\x00\x08moof")
+	mdat := []byte("\x00\x00\x00\x0amdat\x01\x02")
+	event := Event{SchemeIDURI: SchemeID3, Timescale: 1000, PresentationTimeDelta: 1500,
+		Duration: UnknownDuration, ID: 7, Data: []byte("ID3")}
+	box := event.Box()
+	want := append([]byte("\x00\x00\x00\x3demsg\x00\x00\x00\x00"+SchemeID3+"\x00\x00"),
+		"\x00\x00\x03\xe8\x00\x00\x05\xdc\xff\xff\xff\xff\x00\x00\x00\x07ID3"...)
+	if !bytes.Equal(box, want) {
+		t.Fatalf("box\n%q\nwant\n%q", box, want)
+	}
+	segment := append(append(append([]byte(nil), styp...), moof...), mdat...)
+	out, err := Insert(segment, event, event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, bytes.Join([][]byte{styp, box, box, moof, mdat}, nil)) {
+		t.Fatalf("segment %q", out)
+	}
+	if _, err := Insert(styp, event); err != ErrNoFragment {
+		t.Fatalf("segment without moof: %v", err)
+	}
+	if _, err := Insert([]byte("\x00\x00\x00\x40moof"), event); err == nil {
+		t.Fatal("overrunning box accepted")
+	}
+}
@@ -0,0 +1,163 @@
+package eventbus
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var messages = []Message{
+	{Subject: "stream-events", Key: "main", Value: []byte(`{"type":"stream.started"}`)},
+	{Subject: "viewer-events", Key: "main", Value: []byte(`{"type":"join"}`)},
+	{Subject: "stream-events", Key: "main", Value: []byte(`{"type":"stream.ended"}`)},
+}
+
+func TestKafka(t *testing.T) {
+	produced := map[string][]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/vnd.kafka.json.v2+json" {
+			t.Errorf("content type = %s", r.Header.Get("Content-Type"))
+		}
+		var body struct {
+			Records []struct {
+				Key   string
+				Value struct{ Type string }
+			}
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		topic := strings.TrimPrefix(r.URL.Path, "/topics/")
+		for _, record := range body.Records {
+			produced[topic] = append(produced[topic], record.Key+" "+record.Value.Type)
+		}
+		if topic == "refused" {
+			http.Error(w, "unknown topic", http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	bus, err := Open("kafka", srv.URL+"/", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bus.Publish(context.Background(), messages); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(produced["stream-events"], ","); got != "main stream.started,main stream.ended" {
+		t.Fatalf("stream events = %s", got)
+	}
+	if got := strings.Join(produced["viewer-events"], ","); got != "main join" {
+		t.Fatalf("viewer events = %s", got)
+	}
+	if err := bus.Publish(context.Background(), []Message{{Subject: "refused", Value: []byte("{}")}}); err == nil || !strings.Contains(err.Error(), "unknown topic") {
+		t.Fatalf("refused produce = %v", err)
+	}
+}
+
+// natsServer accepts clients taking token, and hands the messages
+// published to it on got; a PUB to "refused" is answered -ERR
+func natsServer(t *testing.T, token string, got chan<- string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveNATS(conn, token, got)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return ln.Addr().String()
+}
+
+func serveNATS(conn net.Conn, token string, got chan<- string) {
+	defer conn.Close()
+	conn.Write([]byte(`INFO {"server_id":"test","max_payload":1048576}` + "\r\n"))
+	r := bufio.NewReader(conn)
+	ponged := false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "CONNECT":
+			var connect natsConnect
+			json.Unmarshal([]byte(strings.TrimPrefix(strings.TrimSpace(line), "CONNECT ")), &connect)
+			if connect.Token != token {
+				conn.Write([]byte("-ERR 'Authorization Violation'\r\n"))
+				return
+			}
+			// a server PING the client must answer
+			conn.Write([]byte("PING\r\n"))
+		case "PONG":
+			ponged = true
+		case "PUB":
+			size, _ := strconv.Atoi(fields[2])
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(r, payload); err != nil || !ponged {
+				return
+			}
+			if fields[1] == "refused" {
+				conn.Write([]byte("-ERR 'Permissions Violation for Publish to refused'\r\n"))
+				return
+			}
+			got <- fields[1] + " " + string(payload[:size])
+		case "PING":
+			conn.Write([]byte("PONG\r\n"))
+		}
+	}
+}
+
+func TestNATS(t *testing.T) {
+	got := make(chan string, 10)
+	addr := natsServer(t, "secret", got)
+	bus, err := Open("nats", "nats://secret@"+addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bus.Close()
+	for i := 0; i < 2; i++ {
+		if err := bus.Publish(context.Background(), messages); err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range messages {
+			if m := <-got; m != want.Subject+" "+string(want.Value) {
+				t.Fatalf("published %s, want %s %s", m, want.Subject, want.Value)
+			}
+		}
+	}
+	// the server closes the connection after an error, the next publish
+	// connects again
+	if err := bus.Publish(context.Background(), []Message{{Subject: "refused", Value: []byte("{}")}}); err == nil || !strings.Contains(err.Error(), "Permissions Violation") {
+		t.Fatalf("refused publish = %v", err)
+	}
+	if err := bus.Publish(context.Background(), messages[:1]); err != nil {
+		t.Fatal(err)
+	}
+	<-got
+
+	wrong, _ := Open("nats", "nats://other@"+addr, time.Second)
+	if err := wrong.Publish(context.Background(), messages); err == nil || !strings.Contains(err.Error(), "Authorization Violation") {
+		t.Fatalf("publish with a wrong token = %v", err)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	for _, c := range [][2]string{{"kafka", "nats://nats:4222"}, {"nats", "http://nats:4222"}, {"rabbitmq", "amqp://rabbit"}} {
+		if _, err := Open(c[0], c[1], time.Second); err == nil {
+			t.Fatalf("%s at %s opened", c[0], c[1])
+		}
+	}
+}
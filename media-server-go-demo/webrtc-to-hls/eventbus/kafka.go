@@ -0,0 +1,81 @@
+package eventbus
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Kafka produces messages to their topic through a Kafka REST proxy at
+// URL, e.g. http://kafka-rest:8082, one request per topic
+type Kafka struct {
+	URL string
+	// Client sends the requests, http.DefaultClient when nil
+	Client *http.Client
+}
+
+func (k *Kafka) Name() string {
+	return "kafka " + k.URL
+}
+
+type kafkaRecord struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+func (k *Kafka) Publish(ctx context.Context, messages []Message) error {
+	var topics []string
+	records := map[string][]kafkaRecord{}
+	for _, m := range messages {
+		if _, ok := records[m.Subject]; !ok {
+			topics = append(topics, m.Subject)
+		}
+		records[m.Subject] = append(records[m.Subject], kafkaRecord{Key: m.Key, Value: m.Value})
+	}
+	for _, topic := range topics {
+		body, err := json.Marshal(struct {
+			Records []kafkaRecord `json:"records"`
+		}{records[topic]})
+		if err != nil {
+			return err
+		}
+		if err := k.produce(ctx, topic, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (k *Kafka) produce(ctx context.Context, topic string, body []byte) error {
+	endpoint := strings.TrimRight(k.URL, "/") + "/topics/" + url.PathEscape(topic)
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	client := k.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		detail, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("eventbus: produce to %s: %s %s", topic, resp.Status, strings.TrimSpace(string(detail)))
+	}
+	return nil
+}
+
+func (k *Kafka) Close() error {
+	return nil
+}
@@ -0,0 +1,174 @@
+package eventbus
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NATS publishes messages to their subject on the NATS server at URL,
+// speaking the client protocol of NATS core: a message is published once
+// the server answered the PING following it. The connection is opened on
+// the first publish, and again after a failure.
+type NATS struct {
+	// URL is the server: nats://host:4222, or tls://host:4222 for TLS, with
+	// a token or a user and password as user info
+	URL *url.URL
+	// Timeout bounds a publish, 5s when 0
+	Timeout time.Duration
+
+	lock   sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (n *NATS) Name() string {
+	return "nats " + n.URL.Host
+}
+
+// natsConnect is the CONNECT of the client
+type natsConnect struct {
+	Verbose  bool   `json:"verbose"`
+	Pedantic bool   `json:"pedantic"`
+	Name     string `json:"name"`
+	Lang     string `json:"lang"`
+	Version  string `json:"version"`
+	Token    string `json:"auth_token,omitempty"`
+	User     string `json:"user,omitempty"`
+	Password string `json:"pass,omitempty"`
+}
+
+func (n *NATS) timeout() time.Duration {
+	if n.Timeout > 0 {
+		return n.Timeout
+	}
+	return 5 * time.Second
+}
+
+func (n *NATS) Publish(ctx context.Context, messages []Message) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	deadline := time.Now().Add(n.timeout())
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	err := n.publish(deadline, messages)
+	if err != nil && n.conn != nil {
+		// the connection is in an unknown state
+		n.conn.Close()
+		n.conn, n.reader = nil, nil
+	}
+	return err
+}
+
+func (n *NATS) publish(deadline time.Time, messages []Message) error {
+	if n.conn == nil {
+		if err := n.connect(deadline); err != nil {
+			return err
+		}
+	}
+	n.conn.SetDeadline(deadline)
+	w := bufio.NewWriter(n.conn)
+	for _, m := range messages {
+		if m.Subject == "" || strings.ContainsAny(m.Subject, " \t\r\n") {
+			return fmt.Errorf("eventbus: %q is not a nats subject", m.Subject)
+		}
+		fmt.Fprintf(w, "PUB %s %d\r\n", m.Subject, len(m.Value))
+		w.Write(m.Value)
+		w.WriteString("\r\n")
+	}
+	w.WriteString("PING\r\n")
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return n.awaitPong()
+}
+
+// connect opens the connection: the server greets with INFO, upgraded to
+// TLS for tls URLs, then the client sends CONNECT and a PING it waits the
+// PONG of, the server answering -ERR when it refuses the client
+func (n *NATS) connect(deadline time.Time) error {
+	conn, err := net.DialTimeout("tcp", n.URL.Host, time.Until(deadline))
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(deadline)
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return fmt.Errorf("eventbus: not a nats server, it greeted with %q", strings.TrimSpace(line))
+	}
+	if n.URL.Scheme == "tls" {
+		secure := tls.Client(conn, &tls.Config{ServerName: n.URL.Hostname()})
+		if err := secure.Handshake(); err != nil {
+			conn.Close()
+			return err
+		}
+		conn, reader = secure, bufio.NewReader(secure)
+	}
+	connect := natsConnect{Name: "stream-server", Lang: "go", Version: "1"}
+	if user := n.URL.User; user != nil {
+		if password, ok := user.Password(); ok {
+			connect.User, connect.Password = user.Username(), password
+		} else {
+			connect.Token = user.Username()
+		}
+	}
+	body, err := json.Marshal(connect)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	n.conn, n.reader = conn, reader
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", body); err != nil {
+		return err
+	}
+	return n.awaitPong()
+}
+
+// awaitPong reads what the server sends until the PONG of the last PING,
+// answering its own PINGs; -ERR is an error
+func (n *NATS) awaitPong() error {
+	for {
+		line, err := n.reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := n.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return errors.New("eventbus: nats: " + strings.Trim(strings.TrimSpace(strings.TrimPrefix(line, "-ERR")), "'"))
+		}
+		// +OK and INFO updates need no answer
+	}
+}
+
+func (n *NATS) Close() error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.conn == nil {
+		return nil
+	}
+	err := n.conn.Close()
+	n.conn, n.reader = nil, nil
+	return err
+}
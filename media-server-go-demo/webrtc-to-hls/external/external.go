@@ -0,0 +1,448 @@
+// Package external fronts HLS packaged elsewhere, a remote playlist URL or a
+// local directory, so it can be served next to the streams produced here.
+//
+// The upstream media playlist is polled; segment URIs are rewritten to
+// names served by this package, so players never talk to the upstream
+// directly. When upstream fetches fail the last good playlist keeps being
+// served until it is older than the staleness window, then the stream is
+// reported offline. What is fetched upstream, redirects included, can be
+// held to an allow-list and to public addresses, see Allow and PublicOnly.
+package external
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/ident"
+)
+
+var (
+	ErrBadID          = errors.New("external: stream id must be 1-64 letters, digits, '.', '-' or '_', starting with a letter or digit")
+	ErrBadSource      = errors.New("external: exactly one of url and dir is required")
+	ErrMasterPlaylist = errors.New("external: master playlists are not supported, register a media playlist")
+	ErrUnknownSegment = errors.New("external: segment not in playlist")
+	ErrOffline        = errors.New("external: stream offline")
+	ErrPrivateAddress = errors.New("external: upstream address is not public")
+)
+
+// maxRedirects is how many redirects a fetch of the upstream follows
+const maxRedirects = 10
+
+// ValidID reports whether id can be used as a stream id
+func ValidID(id string) bool {
+	return ident.Check(ident.PlaybackID, id) == nil
+}
+
+// Source is where a stream is packaged
+type Source struct {
+	// URL of a remote media playlist
+	URL string `json:"url,omitempty"`
+	// Dir is a local directory holding Playlist and its segments
+	Dir      string `json:"dir,omitempty"`
+	Playlist string `json:"playlist,omitempty"`
+}
+
+// State of an external stream
+type State string
+
+const (
+	StateWaiting State = "waiting"
+	StateLive    State = "live"
+	StateEnded   State = "ended"
+	StateOffline State = "offline"
+)
+
+// Event is a lifecycle change of a stream
+type Event struct {
+	ID     string
+	State  State
+	Reason string
+}
+
+// Stream is one registered external stream
+type Stream struct {
+	ID     string
+	Source Source
+
+	base       *url.URL
+	client     *http.Client
+	allow      func(*url.URL) error
+	staleAfter time.Duration
+	notify     func(Event)
+
+	lock     sync.Mutex
+	state    State
+	playlist []byte
+	// segments maps the served names to the upstream URL or file
+	segments map[string]string
+	lastGood time.Time
+}
+
+// NewStream validates source and returns a stream that has not been fetched yet
+func NewStream(id string, source Source, staleAfter time.Duration, notify func(Event)) (*Stream, error) {
+	if !ValidID(id) {
+		return nil, ErrBadID
+	}
+	if (source.URL == "") == (source.Dir == "") {
+		return nil, ErrBadSource
+	}
+	s := &Stream{
+		ID:         id,
+		Source:     source,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		staleAfter: staleAfter,
+		notify:     notify,
+		state:      StateWaiting,
+		segments:   map[string]string{},
+	}
+	s.client.CheckRedirect = s.checkRedirect
+	if source.URL != "" {
+		base, err := url.Parse(source.URL)
+		if err != nil || (base.Scheme != "http" && base.Scheme != "https") {
+			return nil, fmt.Errorf("external: bad playlist url %q", source.URL)
+		}
+		s.base = base
+	} else {
+		if s.Source.Playlist == "" {
+			s.Source.Playlist = "playlist.m3u8"
+		}
+		if path.Base(s.Source.Playlist) != s.Source.Playlist {
+			return nil, fmt.Errorf("external: bad playlist name %q", s.Source.Playlist)
+		}
+		if err := checkDir(s.Source.Dir); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Allow makes s fetch only the upstream URLs allow accepts: the playlist,
+// the segments it lists and every redirect on the way to them. Call it
+// before the stream is registered.
+func (s *Stream) Allow(allow func(*url.URL) error) {
+	s.allow = allow
+}
+
+// PublicOnly makes s fetch from public addresses alone, not loopback,
+// private, link-local or shared ones, whatever the upstream host resolves
+// to when it is dialed. Call it before the stream is registered.
+func (s *Stream) PublicOnly() {
+	dialer := &net.Dialer{Timeout: 5 * time.Second, Control: func(network, address string, _ syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if !publicIP(net.ParseIP(host)) {
+			return fmt.Errorf("%w: %s", ErrPrivateAddress, host)
+		}
+		return nil
+	}}
+	s.client.Transport = &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+	}
+}
+
+// sharedAddresses are the carrier-grade NAT range, RFC 6598, not public
+// although neither private nor link-local
+var sharedAddresses = &net.IPNet{IP: net.IPv4(100, 64, 0, 0).To4(), Mask: net.CIDRMask(10, 32)}
+
+func publicIP(ip net.IP) bool {
+	return ip != nil && ip.IsGlobalUnicast() && !ip.IsPrivate() && !sharedAddresses.Contains(ip)
+}
+
+// check refuses an upstream URL not allowed, see Allow
+func (s *Stream) check(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("external: bad upstream url %q", u)
+	}
+	if s.allow == nil {
+		return nil
+	}
+	if err := s.allow(u); err != nil {
+		return fmt.Errorf("external: upstream url %q: %v", u, err)
+	}
+	return nil
+}
+
+func (s *Stream) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("external: %d redirects", len(via))
+	}
+	return s.check(req.URL)
+}
+
+// State returns the current lifecycle state
+func (s *Stream) State() State {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.state
+}
+
+func (s *Stream) fetch(ctx context.Context) ([]byte, error) {
+	if s.base == nil {
+		return ioutil.ReadFile(filepath.Join(s.Source.Dir, s.Source.Playlist))
+	}
+	if err := s.check(s.base); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, s.base.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("external: upstream playlist: %s", resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, 4<<20))
+}
+
+// Refresh fetches the upstream playlist once
+func (s *Stream) Refresh(ctx context.Context, now time.Time) error {
+	body, err := s.fetch(ctx)
+	var playlist []byte
+	var segments map[string]string
+	var ended bool
+	if err == nil {
+		playlist, segments, ended, err = s.rewrite(body)
+	}
+
+	s.lock.Lock()
+	var event *Event
+	switch {
+	case err != nil:
+		if s.state != StateOffline && s.state != StateEnded && !s.lastGood.IsZero() && now.Sub(s.lastGood) > s.staleAfter {
+			event = s.setState(StateOffline, err.Error())
+		}
+	case ended:
+		s.playlist, s.segments, s.lastGood = playlist, segments, now
+		if s.state != StateEnded {
+			event = s.setState(StateEnded, "upstream playlist ended")
+		}
+	default:
+		s.playlist, s.segments, s.lastGood = playlist, segments, now
+		if s.state != StateLive {
+			event = s.setState(StateLive, "upstream playlist updated")
+		}
+	}
+	s.lock.Unlock()
+
+	if event != nil && s.notify != nil {
+		s.notify(*event)
+	}
+	return err
+}
+
+func (s *Stream) setState(state State, reason string) *Event {
+	s.state = state
+	return &Event{ID: s.ID, State: state, Reason: reason}
+}
+
+// rewrite replaces the segment URIs of a media playlist with served names
+func (s *Stream) rewrite(body []byte) ([]byte, map[string]string, bool, error) {
+	var out bytes.Buffer
+	segments := map[string]string{}
+	ended := false
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF"):
+			return nil, nil, false, ErrMasterPlaylist
+		case line == "#EXT-X-ENDLIST":
+			ended = true
+		case line != "" && !strings.HasPrefix(line, "#"):
+			name, target, err := s.resolve(line)
+			if err != nil {
+				return nil, nil, false, err
+			}
+			if other, ok := segments[name]; ok && other != target {
+				name = fmt.Sprintf("%d-%s", len(segments), name)
+			}
+			segments[name] = target
+			line = name
+		}
+		out.WriteString(line)
+		out.WriteByte('\n')
+	}
+	return out.Bytes(), segments, ended, scanner.Err()
+}
+
+// resolve maps a playlist URI to the name it is served under and its upstream
+func (s *Stream) resolve(uri string) (string, string, error) {
+	ref, err := url.Parse(uri)
+	if err != nil {
+		return "", "", err
+	}
+	if s.base != nil {
+		target := s.base.ResolveReference(ref)
+		if err := s.check(target); err != nil {
+			return "", "", err
+		}
+		// names only need to be unique within the playlist; keep the
+		// extension so players and caches recognize the type
+		name := path.Base(target.Path)
+		if !validSegmentName(name) {
+			return "", "", fmt.Errorf("external: bad segment uri %q", uri)
+		}
+		return name, target.String(), nil
+	}
+	// local playlists may only reference files in their directory
+	if ref.IsAbs() || ref.Path != path.Base(ref.Path) || !validSegmentName(ref.Path) {
+		return "", "", fmt.Errorf("external: bad segment uri %q", uri)
+	}
+	return ref.Path, filepath.Join(s.Source.Dir, ref.Path), nil
+}
+
+func validSegmentName(name string) bool {
+	return name != "" && name != "." && name != ".." && name != "/" && !strings.ContainsAny(name, "/\\")
+}
+
+// Run polls the upstream playlist every interval until ctx is done
+func (s *Stream) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.Refresh(ctx, time.Now())
+		if s.State() == StateEnded {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Playlist returns the rewritten playlist, unless the stream is offline or
+// was never fetched
+func (s *Stream) Playlist() ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.playlist == nil || s.state == StateOffline {
+		return nil, ErrOffline
+	}
+	return s.playlist, nil
+}
+
+// ServeSegment serves a segment listed in the current playlist
+func (s *Stream) ServeSegment(w http.ResponseWriter, r *http.Request, name string) {
+	s.lock.Lock()
+	target, ok := s.segments[name]
+	s.lock.Unlock()
+	if !ok {
+		http.Error(w, ErrUnknownSegment.Error(), http.StatusNotFound)
+		return
+	}
+	if s.base == nil {
+		http.ServeFile(w, r, target)
+		return
+	}
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err == nil {
+		err = s.check(req.URL)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	resp, err := s.client.Do(req.WithContext(r.Context()))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		http.Error(w, "upstream segment: "+resp.Status, http.StatusBadGateway)
+		return
+	}
+	for _, header := range []string{"Content-Type", "Content-Length", "Cache-Control"} {
+		if value := resp.Header.Get(header); value != "" {
+			w.Header().Set(header, value)
+		}
+	}
+	io.Copy(w, resp.Body)
+}
+
+// Registry holds the registered external streams
+type Registry struct {
+	lock    sync.Mutex
+	streams map[string]*registered
+}
+
+type registered struct {
+	stream *Stream
+	cancel context.CancelFunc
+}
+
+func NewRegistry() *Registry {
+	return &Registry{streams: map[string]*registered{}}
+}
+
+// Add registers s and starts polling it every interval
+func (r *Registry) Add(s *Stream, interval time.Duration) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.streams[s.ID]; ok {
+		return fmt.Errorf("external: stream %s already registered", s.ID)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r.streams[s.ID] = &registered{stream: s, cancel: cancel}
+	go s.Run(ctx, interval)
+	return nil
+}
+
+// Get returns the stream registered as id, or nil
+func (r *Registry) Get(id string) *Stream {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if reg, ok := r.streams[id]; ok {
+		return reg.stream
+	}
+	return nil
+}
+
+// Remove stops polling id and forgets it
+func (r *Registry) Remove(id string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	reg, ok := r.streams[id]
+	if ok {
+		reg.cancel()
+		delete(r.streams, id)
+	}
+	return ok
+}
+
+func checkDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("external: %s is not a directory", dir)
+	}
+	return nil
+}
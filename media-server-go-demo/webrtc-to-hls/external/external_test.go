@@ -0,0 +1,198 @@
+package external
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type upstream struct {
+	sync.Mutex
+	playlist string
+	fail     bool
+}
+
+func (u *upstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.Lock()
+	defer u.Unlock()
+	switch {
+	case u.fail:
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	case r.URL.Path == "/live/index.m3u8":
+		fmt.Fprint(w, u.playlist)
+	default:
+		fmt.Fprint(w, "segment "+r.URL.Path)
+	}
+}
+
+func TestRemoteStream(t *testing.T) {
+	up := &upstream{playlist: "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXTINF:2,\nseg1.ts\n#EXTINF:2,\nhttp://cdn.invalid/a/seg2.ts\n"}
+	server := httptest.NewServer(up)
+	defer server.Close()
+
+	var events []Event
+	s, err := NewStream("ext", Source{URL: server.URL + "/live/index.m3u8"}, 10*time.Second, func(e Event) {
+		events = append(events, e)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Playlist(); err != ErrOffline {
+		t.Fatalf("playlist before first fetch: %v", err)
+	}
+
+	start := time.Now()
+	if err := s.Refresh(context.Background(), start); err != nil {
+		t.Fatal(err)
+	}
+	playlist, _ := s.Playlist()
+	if !strings.Contains(string(playlist), "\nseg1.ts\n") || !strings.Contains(string(playlist), "\nseg2.ts\n") {
+		t.Fatalf("playlist =\n%s", playlist)
+	}
+
+	rec := httptest.NewRecorder()
+	s.ServeSegment(rec, httptest.NewRequest("GET", "/hls/ext/seg1.ts", nil), "seg1.ts")
+	if body, _ := ioutil.ReadAll(rec.Body); string(body) != "segment /live/seg1.ts" {
+		t.Fatalf("segment = %q", body)
+	}
+	rec = httptest.NewRecorder()
+	s.ServeSegment(rec, httptest.NewRequest("GET", "/hls/ext/other.ts", nil), "other.ts")
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("unlisted segment status %d", rec.Code)
+	}
+
+	// the last good playlist is served through short outages
+	up.Lock()
+	up.fail = true
+	up.Unlock()
+	s.Refresh(context.Background(), start.Add(5*time.Second))
+	if _, err := s.Playlist(); err != nil {
+		t.Fatalf("playlist within staleness window: %v", err)
+	}
+	s.Refresh(context.Background(), start.Add(11*time.Second))
+	if _, err := s.Playlist(); err != ErrOffline {
+		t.Fatalf("playlist after staleness window: %v", err)
+	}
+
+	up.Lock()
+	up.fail = false
+	up.playlist += "#EXT-X-ENDLIST\n"
+	up.Unlock()
+	s.Refresh(context.Background(), start.Add(12*time.Second))
+
+	want := []State{StateLive, StateOffline, StateEnded}
+	if len(events) != len(want) {
+		t.Fatalf("events %+v", events)
+	}
+	for i, state := range want {
+		if events[i].State != state {
+			t.Errorf("event %d = %+v, want %s", i, events[i], state)
+		}
+	}
+}
+
+func TestRemoteStreamAllowList(t *testing.T) {
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "internal "+r.URL.Path)
+	}))
+	defer internal.Close()
+	up := &upstream{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/moved.ts") {
+			http.Redirect(w, r, internal.URL+"/secret.ts", http.StatusFound)
+			return
+		}
+		up.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	allowed, _ := url.Parse(server.URL)
+	allow := func(u *url.URL) error {
+		if u.Host != allowed.Host {
+			return fmt.Errorf("host %s not allowed", u.Host)
+		}
+		return nil
+	}
+
+	// a segment off the list fails the playlist
+	up.playlist = "#EXTM3U\n#EXTINF:2,\nseg1.ts\n#EXTINF:2,\n" + internal.URL + "/secret.ts\n"
+	s, err := NewStream("ext", Source{URL: server.URL + "/live/index.m3u8"}, time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Allow(allow)
+	if err := s.Refresh(context.Background(), time.Now()); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Fatalf("off-list segment = %v", err)
+	}
+
+	// a segment redirected off the list is not followed
+	up.playlist = "#EXTM3U\n#EXTINF:2,\nmoved.ts\n"
+	if err := s.Refresh(context.Background(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	s.ServeSegment(rec, httptest.NewRequest("GET", "/hls/ext/moved.ts", nil), "moved.ts")
+	if rec.Code != http.StatusBadGateway || strings.Contains(rec.Body.String(), "internal") {
+		t.Fatalf("off-list redirect = %d %q", rec.Code, rec.Body)
+	}
+
+	// nor is a playlist redirected off the list
+	redirected, err := NewStream("moved", Source{URL: server.URL + "/moved.ts"}, time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	redirected.Allow(allow)
+	if err := redirected.Refresh(context.Background(), time.Now()); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Fatalf("off-list playlist redirect = %v", err)
+	}
+}
+
+func TestRemoteStreamPublicOnly(t *testing.T) {
+	server := httptest.NewServer(&upstream{playlist: "#EXTM3U\n#EXTINF:2,\nseg1.ts\n"})
+	defer server.Close()
+	s, err := NewStream("ext", Source{URL: server.URL + "/live/index.m3u8"}, time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.PublicOnly()
+	if err := s.Refresh(context.Background(), time.Now()); !errors.Is(err, ErrPrivateAddress) {
+		t.Fatalf("loopback upstream = %v", err)
+	}
+	for addr, public := range map[string]bool{
+		"203.0.113.7": true, "2001:db8::1": true, "127.0.0.1": false, "10.1.2.3": false, "172.20.0.1": false,
+		"192.168.1.1": false, "169.254.169.254": false, "100.64.0.1": false, "0.0.0.0": false, "::1": false, "fd00::1": false, "fe80::1": false,
+	} {
+		if publicIP(net.ParseIP(addr)) != public {
+			t.Errorf("public %s = %v", addr, !public)
+		}
+	}
+}
+
+func TestLocalStreamRejectsEscapes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "external")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(dir+"/playlist.m3u8", []byte("#EXTM3U\n#EXTINF:2,\n../../etc/passwd\n"), 0644)
+
+	s, err := NewStream("local", Source{Dir: dir}, time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Refresh(context.Background(), time.Now()); err == nil {
+		t.Fatal("playlist escaping its directory accepted")
+	}
+	if _, err := NewStream("../x", Source{Dir: dir}, time.Minute, nil); err != ErrBadID {
+		t.Fatalf("bad id err = %v", err)
+	}
+}
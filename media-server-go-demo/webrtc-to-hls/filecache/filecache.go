@@ -0,0 +1,109 @@
+// Package filecache keeps the files most recently read in memory, the
+// segments of live outputs that every viewer asks for within seconds of
+// each other. A cached file is served only as long as its size and
+// modification time are those it was read with, so a file rewritten in
+// place is read again.
+package filecache
+
+import (
+	"container/list"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// Cache holds files up to a total size, evicting the least recently used
+type Cache struct {
+	max int64
+
+	lock    sync.Mutex
+	size    int64
+	recent  *list.List
+	entries map[string]*list.Element
+}
+
+type entry struct {
+	path    string
+	size    int64
+	modTime time.Time
+	data    []byte
+}
+
+// New returns a cache of max bytes. Files over an eighth of it are never
+// cached, so a few large ones do not flush every segment.
+func New(max int64) *Cache {
+	return &Cache{max: max, recent: list.New(), entries: map[string]*list.Element{}}
+}
+
+// Read returns the content of the file at path and its info, from memory
+// when cached and unchanged since, hit reporting whether it was
+func (c *Cache) Read(path string) (data []byte, info os.FileInfo, hit bool, err error) {
+	if info, err = os.Stat(path); err != nil {
+		return nil, nil, false, err
+	}
+	if data, ok := c.get(path, info); ok {
+		return data, info, true, nil
+	}
+	if data, err = ioutil.ReadFile(path); err != nil {
+		return nil, nil, false, err
+	}
+	// changed while read, it is not cached
+	if int64(len(data)) == info.Size() {
+		c.put(path, info, data)
+	}
+	return data, info, false, nil
+}
+
+// Prefetch reads the file at path into the cache ahead of its first
+// request
+func (c *Cache) Prefetch(path string) error {
+	_, _, _, err := c.Read(path)
+	return err
+}
+
+// Size is the total size of the files cached
+func (c *Cache) Size() int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.size
+}
+
+func (c *Cache) get(path string, info os.FileInfo) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	element, ok := c.entries[path]
+	if !ok {
+		return nil, false
+	}
+	e := element.Value.(*entry)
+	if e.size != info.Size() || !e.modTime.Equal(info.ModTime()) {
+		c.remove(element)
+		return nil, false
+	}
+	c.recent.MoveToFront(element)
+	return e.data, true
+}
+
+func (c *Cache) put(path string, info os.FileInfo, data []byte) {
+	size := int64(len(data))
+	if size > c.max/8 {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if element, ok := c.entries[path]; ok {
+		c.remove(element)
+	}
+	c.entries[path] = c.recent.PushFront(&entry{path: path, size: size, modTime: info.ModTime(), data: data})
+	c.size += size
+	for c.size > c.max {
+		c.remove(c.recent.Back())
+	}
+}
+
+func (c *Cache) remove(element *list.Element) {
+	e := c.recent.Remove(element).(*entry)
+	delete(c.entries, e.path)
+	c.size -= e.size
+}
@@ -0,0 +1,61 @@
+package filecache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name string, size int) string {
+		path := filepath.Join(dir, name)
+		ioutil.WriteFile(path, []byte(strings.Repeat(name[:1], size)), 0644)
+		return path
+	}
+	c := New(800)
+	a, b := write("a.ts", 100), write("b.ts", 100)
+	if err := c.Prefetch(a); err != nil || c.Size() != 100 {
+		t.Fatalf("prefetch = %v, size %d", err, c.Size())
+	}
+	// a rewritten file is read again
+	ioutil.WriteFile(a, []byte(strings.Repeat("A", 50)), 0644)
+	later := time.Now().Add(time.Second)
+	os.Chtimes(a, later, later)
+	if data, info, hit, err := c.Read(a); err != nil || hit || string(data) != strings.Repeat("A", 50) || info.Size() != 50 {
+		t.Fatalf("read = %q, %v, %v", data, hit, err)
+	}
+	if _, _, hit, err := c.Read(a); err != nil || !hit {
+		t.Fatalf("second read = %v, %v", hit, err)
+	}
+	if _, _, _, err := c.Read(b); err != nil || c.Size() != 150 {
+		t.Fatalf("size = %d, %v", c.Size(), err)
+	}
+	// over the limit, the least recently used go first
+	for _, name := range []string{"c.ts", "d.ts", "e.ts", "f.ts", "g.ts", "h.ts", "i.ts"} {
+		c.Read(write(name, 100))
+	}
+	if c.Size() > 800 {
+		t.Fatalf("size = %d", c.Size())
+	}
+	if _, ok := c.entries[a]; ok {
+		t.Fatal("least recently used file kept")
+	}
+	// too large to cache
+	if _, _, _, err := c.Read(write("large.ts", 101)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.entries[filepath.Join(dir, "large.ts")]; ok {
+		t.Fatal("large file cached")
+	}
+	if _, _, _, err := c.Read(filepath.Join(dir, "missing.ts")); !os.IsNotExist(err) {
+		t.Fatalf("missing file = %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+package hlscheck
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// AudioConfig is what CODECS is derived from for AAC, as the
+// AudioSpecificConfig carries it or an ADTS header repeats it
+type AudioConfig struct {
+	ObjectType int
+	SampleRate int
+	Channels   int
+}
+
+// CodecString is the RFC 6381 codecs value, e.g. mp4a.40.2 for AAC-LC
+func (a AudioConfig) CodecString() string {
+	return fmt.Sprintf("mp4a.40.%d", a.ObjectType)
+}
+
+// Matches is whether codec describes the AAC of a. An ADTS header cannot
+// signal HE-AAC but implicitly, as AAC-LC, so AAC-LC matches HE-AAC too.
+func (a AudioConfig) Matches(codec string) bool {
+	if strings.EqualFold(codec, a.CodecString()) {
+		return true
+	}
+	return a.ObjectType == 2 && (strings.EqualFold(codec, "mp4a.40.5") || strings.EqualFold(codec, "mp4a.40.29"))
+}
+
+var errNoADTS = errors.New("hlscheck: no ADTS AAC found in segment")
+
+// sampleRates are the rates of the sampling frequency indexes of
+// ISO/IEC 14496-3 1.6.3.4
+var sampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// ParseASC parses an AudioSpecificConfig (ISO/IEC 14496-3 1.6.2.1), such
+// as the codec_data of AAC caps
+func ParseASC(asc []byte) (AudioConfig, error) {
+	if len(asc) < 2 {
+		return AudioConfig{}, fmt.Errorf("hlscheck: AudioSpecificConfig of %d bytes", len(asc))
+	}
+	r := &bitReader{data: asc}
+	var a AudioConfig
+	if a.ObjectType = r.bits(5); a.ObjectType == 31 {
+		a.ObjectType = 32 + r.bits(6)
+	}
+	if index := r.bits(4); index == 15 {
+		a.SampleRate = r.bits(24)
+	} else if index < len(sampleRates) {
+		a.SampleRate = sampleRates[index]
+	}
+	a.Channels = r.bits(4)
+	if r.err != nil || a.ObjectType == 0 || a.SampleRate == 0 {
+		return AudioConfig{}, fmt.Errorf("hlscheck: bad AudioSpecificConfig %x", asc)
+	}
+	return a, nil
+}
+
+// FindADTS returns the configuration of the first ADTS frame of an MPEG-TS
+// segment or an ADTS stream. A frame counts when another frame or PES
+// header follows it, or it ends the data, so the sync word is not taken
+// from other payloads.
+func FindADTS(data []byte) (AudioConfig, error) {
+	if len(data) >= tsPacketSize && data[0] == 0x47 {
+		for _, payload := range tsPayloads(data) {
+			if a, ok := findADTS(payload); ok {
+				return a, nil
+			}
+		}
+		return AudioConfig{}, errNoADTS
+	}
+	if a, ok := findADTS(data); ok {
+		return a, nil
+	}
+	return AudioConfig{}, errNoADTS
+}
+
+func findADTS(data []byte) (AudioConfig, bool) {
+	for i := 0; i+7 <= len(data); i++ {
+		length, ok := adtsFrame(data[i:])
+		if !ok {
+			continue
+		}
+		next := data[i+length:]
+		if len(next) != 0 && !pesStart(next) {
+			if _, ok := adtsFrame(next); !ok {
+				continue
+			}
+		}
+		h := data[i:]
+		index := int(h[2]>>2) & 0xf
+		return AudioConfig{
+			ObjectType: int(h[2]>>6) + 1,
+			SampleRate: sampleRates[index],
+			Channels:   int(h[2]&1)<<2 | int(h[3]>>6),
+		}, true
+	}
+	return AudioConfig{}, false
+}
+
+// adtsFrame returns the length of the ADTS frame data starts with, false
+// when it does not start with one
+func adtsFrame(data []byte) (int, bool) {
+	if len(data) < 7 || data[0] != 0xff || data[1]&0xf6 != 0xf0 {
+		return 0, false
+	}
+	if index := int(data[2]>>2) & 0xf; index >= len(sampleRates) {
+		return 0, false
+	}
+	length := int(data[3]&3)<<11 | int(data[4])<<3 | int(data[5]>>5)
+	if length < 7 || length > len(data) {
+		return 0, false
+	}
+	return length, true
+}
+
+// pesStart is whether data starts with the start code of a PES header
+func pesStart(data []byte) bool {
+	return len(data) >= 3 && data[0] == 0 && data[1] == 0 && data[2] == 1
+}
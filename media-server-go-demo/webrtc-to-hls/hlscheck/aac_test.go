@@ -0,0 +1,91 @@
+package hlscheck
+
+import "testing"
+
+// testADTS encodes an ADTS frame of objectType at the sampling frequency
+// index rate, with channels channels and a payload of n bytes
+func testADTS(objectType, rate, channels, n int) []byte {
+	w := &bitWriter{}
+	w.bits(0xfff, 12)
+	w.bits(0, 1) // MPEG-4
+	w.bits(0, 2) // layer
+	w.bits(1, 1) // protection_absent
+	w.bits(objectType-1, 2)
+	w.bits(rate, 4)
+	w.bits(0, 1) // private_bit
+	w.bits(channels, 3)
+	w.bits(0, 4) // originality, home, copyright id bit and start
+	w.bits(7+n, 13)
+	w.bits(0x7ff, 11) // buffer fullness, VBR
+	w.bits(0, 2)      // one raw data block
+	return append(w.data, make([]byte, n)...)
+}
+
+// testTS packs payload into the MPEG-TS packets of pid, 184 bytes each,
+// the last one stuffed with an adaptation field
+func testTS(pid int, payload []byte) []byte {
+	var ts []byte
+	for len(payload) > 0 {
+		n := len(payload)
+		if n > tsPacketSize-4 {
+			n = tsPacketSize - 4
+		}
+		packet := []byte{0x47, byte(pid >> 8), byte(pid), 0x10}
+		if stuffing := tsPacketSize - 4 - n; stuffing > 0 {
+			packet[3] = 0x30
+			packet = append(packet, byte(stuffing-1))
+			for i := 1; i < stuffing; i++ {
+				packet = append(packet, 0xff)
+			}
+		}
+		ts = append(ts, append(packet, payload[:n]...)...)
+		payload = payload[n:]
+	}
+	return ts
+}
+
+func TestFindADTS(t *testing.T) {
+	frame := testADTS(2, 3, 2, 100)
+	a, err := FindADTS(append(append([]byte{0x12, 0x34}, frame...), frame...))
+	if err != nil || a != (AudioConfig{ObjectType: 2, SampleRate: 48000, Channels: 2}) || a.CodecString() != "mp4a.40.2" {
+		t.Fatalf("ADTS stream = %+v, %v", a, err)
+	}
+
+	// one frame per PES, the way mpegtsmux writes AAC
+	pes := []byte{0, 0, 1, 0xc0, 0, 0, 0x80, 0x80, 5, 0x21, 0, 1, 0, 1}
+	var audio []byte
+	for i := 0; i < 2; i++ {
+		audio = append(append(audio, pes...), testADTS(1, 6, 1, 300)...)
+	}
+	segment := append(testTS(0x100, append([]byte{0, 0, 1, 0xe0}, make([]byte, 400)...)), testTS(0x101, audio)...)
+	if a, err := FindADTS(segment); err != nil || a.CodecString() != "mp4a.40.1" || a.SampleRate != 24000 || a.Channels != 1 {
+		t.Fatalf("AAC Main in MPEG-TS = %+v, %v", a, err)
+	}
+	// HE-AAC is signalled implicitly in ADTS, as AAC-LC
+	if !a.Matches("mp4a.40.5") || !a.Matches("MP4A.40.2") || a.Matches("mp4a.40.1") {
+		t.Fatal("AAC-LC matches")
+	}
+
+	// a sync word followed by neither a frame nor a PES header
+	if _, err := FindADTS(append(frame[:len(frame):len(frame)], 0x12, 0x34, 0x56)); err == nil {
+		t.Fatal("stray sync word taken for ADTS")
+	}
+	if _, err := FindADTS(testTS(0x100, make([]byte, 400))); err == nil {
+		t.Fatal("ADTS found in a segment without audio")
+	}
+}
+
+func TestParseASC(t *testing.T) {
+	// AAC-LC, 44.1kHz, stereo
+	a, err := ParseASC([]byte{0x12, 0x10})
+	if err != nil || a != (AudioConfig{ObjectType: 2, SampleRate: 44100, Channels: 2}) {
+		t.Fatalf("AAC-LC = %+v, %v", a, err)
+	}
+	// escaped object type, 32 + 10
+	if a, err := ParseASC([]byte{0xf9, 0x46, 0x40}); err != nil || a.ObjectType != 42 || a.SampleRate != 48000 {
+		t.Fatalf("escaped object type = %+v, %v", a, err)
+	}
+	if _, err := ParseASC([]byte{0x12}); err == nil {
+		t.Fatal("truncated AudioSpecificConfig accepted")
+	}
+}
@@ -0,0 +1,211 @@
+package hlscheck
+
+import (
+	"errors"
+	"fmt"
+)
+
+// the OBU types of the AV1 bitstream specification 6.2.2 read here
+const (
+	OBUSequenceHeader = 1
+	OBUFrameHeader    = 3
+	OBUFrame          = 6
+)
+
+// OBU is an open bitstream unit of an AV1 temporal unit
+type OBU struct {
+	Type    int
+	Payload []byte
+}
+
+var errShortOBU = errors.New("hlscheck: truncated AV1 OBU")
+
+// ParseOBUs splits a low overhead bitstream, such as a temporal unit of
+// WebRTC, into its OBUs. Only the last OBU may lack a size field.
+func ParseOBUs(data []byte) ([]OBU, error) {
+	var obus []OBU
+	for len(data) > 0 {
+		header := data[0]
+		if header&0x80 != 0 {
+			return nil, errors.New("hlscheck: forbidden bit set in AV1 OBU header")
+		}
+		obu := OBU{Type: int(header >> 3 & 0x0f)}
+		data = data[1:]
+		if header&0x04 != 0 {
+			// obu_extension_header
+			if len(data) == 0 {
+				return nil, errShortOBU
+			}
+			data = data[1:]
+		}
+		size := len(data)
+		if header&0x02 != 0 {
+			var n int
+			size, n = leb128(data)
+			if n == 0 {
+				return nil, errShortOBU
+			}
+			data = data[n:]
+		}
+		if size > len(data) {
+			return nil, errShortOBU
+		}
+		obu.Payload = data[:size]
+		obus = append(obus, obu)
+		data = data[size:]
+	}
+	return obus, nil
+}
+
+// leb128 decodes the size field of an OBU, returning the bytes read, zero
+// if truncated
+func leb128(data []byte) (int, int) {
+	value := 0
+	for i := 0; i < 8 && i < len(data); i++ {
+		value |= int(data[i]&0x7f) << (7 * uint(i))
+		if data[i]&0x80 == 0 {
+			return value, i + 1
+		}
+	}
+	return 0, 0
+}
+
+// SequenceHeader is what CODECS and RESOLUTION are derived from for AV1
+type SequenceHeader struct {
+	Profile  int
+	Level    int
+	Tier     int
+	BitDepth int
+	// ReducedStillPicture headers are followed by key frames only
+	ReducedStillPicture bool
+	Width               int
+	Height              int
+}
+
+// CodecString is the codecs value of the AV1 ISOBMFF binding, e.g.
+// av01.0.08M.08
+func (s SequenceHeader) CodecString() string {
+	tier := "M"
+	if s.Tier == 1 {
+		tier = "H"
+	}
+	return fmt.Sprintf("av01.%d.%02d%s.%02d", s.Profile, s.Level, tier, s.BitDepth)
+}
+
+// FindSequenceHeader returns the payload of the first sequence header OBU
+// of a temporal unit
+func FindSequenceHeader(data []byte) ([]byte, error) {
+	obus, err := ParseOBUs(data)
+	if err != nil {
+		return nil, err
+	}
+	for _, obu := range obus {
+		if obu.Type == OBUSequenceHeader {
+			return obu.Payload, nil
+		}
+	}
+	return nil, errors.New("hlscheck: no AV1 sequence header found")
+}
+
+// ParseSequenceHeader parses the payload of a sequence header OBU (AV1
+// bitstream specification 5.5) up to the bit depth of its color config
+func ParseSequenceHeader(payload []byte) (SequenceHeader, error) {
+	r := &bitReader{data: payload}
+	s := SequenceHeader{}
+	s.Profile = r.bits(3)
+	r.bit() // still_picture
+	s.ReducedStillPicture = r.bit() == 1
+	if s.ReducedStillPicture {
+		s.Level = r.bits(5)
+	} else {
+		decoderModel, bufferDelayLength := false, 0
+		if r.bit() == 1 {
+			// timing_info
+			r.bits(32) // num_units_in_display_tick
+			r.bits(32) // time_scale
+			if r.bit() == 1 {
+				// num_ticks_per_picture_minus_1, uvlc
+				zeros := 0
+				for r.bit() == 0 && r.err == nil && zeros < 32 {
+					zeros++
+				}
+				r.bits(zeros)
+			}
+			if r.bit() == 1 {
+				// decoder_model_info
+				decoderModel = true
+				bufferDelayLength = r.bits(5) + 1
+				r.bits(32) // num_units_in_decoding_tick
+				r.bits(5)  // buffer_removal_time_length_minus_1
+				r.bits(5)  // frame_presentation_time_length_minus_1
+			}
+		}
+		initialDisplayDelay := r.bit() == 1
+		points := r.bits(5) + 1
+		for i := 0; i < points && r.err == nil; i++ {
+			r.bits(12) // operating_point_idc
+			level, tier := r.bits(5), 0
+			if level > 7 {
+				tier = r.bit()
+			}
+			if i == 0 {
+				s.Level, s.Tier = level, tier
+			}
+			if decoderModel && r.bit() == 1 {
+				r.bits(bufferDelayLength) // decoder_buffer_delay
+				r.bits(bufferDelayLength) // encoder_buffer_delay
+				r.bit()                   // low_delay_mode_flag
+			}
+			if initialDisplayDelay && r.bit() == 1 {
+				r.bits(4) // initial_display_delay_minus_1
+			}
+		}
+	}
+	widthBits, heightBits := r.bits(4)+1, r.bits(4)+1
+	s.Width = r.bits(widthBits) + 1
+	s.Height = r.bits(heightBits) + 1
+	if !s.ReducedStillPicture && r.bit() == 1 {
+		// frame_id_numbers_present_flag
+		r.bits(4) // delta_frame_id_length_minus_2
+		r.bits(3) // additional_frame_id_length_minus_1
+	}
+	r.bit() // use_128x128_superblock
+	r.bit() // enable_filter_intra
+	r.bit() // enable_intra_edge_filter
+	if !s.ReducedStillPicture {
+		r.bit() // enable_interintra_compound
+		r.bit() // enable_masked_compound
+		r.bit() // enable_warped_motion
+		r.bit() // enable_dual_filter
+		orderHint := r.bit() == 1
+		if orderHint {
+			r.bit() // enable_jnt_comp
+			r.bit() // enable_ref_frame_mvs
+		}
+		screenContent := 2
+		if r.bit() == 0 {
+			// seq_choose_screen_content_tools off
+			screenContent = r.bit()
+		}
+		if screenContent > 0 && r.bit() == 0 {
+			r.bit() // seq_force_integer_mv
+		}
+		if orderHint {
+			r.bits(3) // order_hint_bits_minus_1
+		}
+	}
+	r.bit() // enable_superres
+	r.bit() // enable_cdef
+	r.bit() // enable_restoration
+	s.BitDepth = 8
+	if r.bit() == 1 {
+		s.BitDepth = 10
+		if s.Profile == 2 && r.bit() == 1 {
+			s.BitDepth = 12
+		}
+	}
+	if r.err != nil {
+		return SequenceHeader{}, errShortOBU
+	}
+	return s, nil
+}
@@ -0,0 +1,64 @@
+package hlscheck
+
+import "testing"
+
+// testSequenceHeader encodes the sequence header OBU, size field included,
+// of a profile 0 8 bit stream of width x height at level 4.0
+func testSequenceHeader(width, height int) []byte {
+	w := &bitWriter{}
+	w.bits(0, 3)  // seq_profile
+	w.bits(0, 1)  // still_picture
+	w.bits(0, 1)  // reduced_still_picture_header
+	w.bits(0, 1)  // timing_info_present_flag
+	w.bits(0, 1)  // initial_display_delay_present_flag
+	w.bits(0, 5)  // operating_points_cnt_minus_1
+	w.bits(0, 12) // operating_point_idc
+	w.bits(8, 5)  // seq_level_idx
+	w.bits(0, 1)  // seq_tier
+	w.bits(15, 4) // frame_width_bits_minus_1
+	w.bits(15, 4) // frame_height_bits_minus_1
+	w.bits(width-1, 16)
+	w.bits(height-1, 16)
+	w.bits(0, 1)    // frame_id_numbers_present_flag
+	w.bits(0x1f, 5) // superblock, filter intra, intra edge, interintra, masked
+	w.bits(0x3, 2)  // warped motion, dual filter
+	w.bits(0x7, 3)  // order hint, jnt comp, ref frame mvs
+	w.bits(1, 1)    // seq_choose_screen_content_tools
+	w.bits(1, 1)    // seq_choose_integer_mv
+	w.bits(6, 3)    // order_hint_bits_minus_1
+	w.bits(0x3, 3)  // superres, cdef, restoration
+	w.bits(0, 1)    // high_bitdepth
+	w.bits(0x1a, 8) // rest of color_config, film grain, trailing bits
+	return append([]byte{0x0a, byte(len(w.data))}, w.data...)
+}
+
+func TestParseSequenceHeader(t *testing.T) {
+	// temporal delimiter, sequence header, then a frame without size field
+	tu := append([]byte{0x12, 0x00}, testSequenceHeader(1280, 720)...)
+	tu = append(tu, 0x30, 0x10, 0x00)
+	obus, err := ParseOBUs(tu)
+	if err != nil || len(obus) != 3 || obus[2].Type != OBUFrame || len(obus[2].Payload) != 2 {
+		t.Fatalf("obus = %v, %v", obus, err)
+	}
+	payload, err := FindSequenceHeader(tu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := ParseSequenceHeader(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.CodecString() != "av01.0.08M.08" || s.Width != 1280 || s.Height != 720 {
+		t.Fatalf("sequence header = %+v, %s", s, s.CodecString())
+	}
+
+	if _, err := ParseOBUs([]byte{0x0a, 0x20, 0x00}); err == nil {
+		t.Fatal("truncated obu parsed")
+	}
+	if _, err := FindSequenceHeader([]byte{0x12, 0x00}); err == nil {
+		t.Fatal("sequence header found in a temporal delimiter")
+	}
+	if _, err := ParseSequenceHeader(payload[:4]); err == nil {
+		t.Fatal("truncated sequence header parsed")
+	}
+}
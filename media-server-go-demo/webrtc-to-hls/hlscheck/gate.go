@@ -0,0 +1,101 @@
+package hlscheck
+
+import "sync"
+
+// Gate holds back the revisions of a playlist that fail validation, media
+// revisions being checked against the last good one too. The last good
+// revision keeps being served in their place; in strict mode a failing
+// revision is an error with nothing served, for CI and integration tests.
+type Gate struct {
+	Strict bool
+
+	lock sync.Mutex
+	last *Media
+	good []byte
+	// the revision last rejected, so repeated reads report it once
+	rejected    []byte
+	rejectedErr error
+	// rules are checked on every revision, see SetRules
+	rules Rules
+}
+
+// Revision validates data and returns the playlist to serve. changed is
+// set the first time a given bad revision is seen.
+func (g *Gate) Revision(data []byte) (serve []byte, changed bool, err error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.good != nil && string(data) == string(g.good) {
+		return g.good, false, nil
+	}
+	m, err := ParseMedia(data)
+	if err == nil {
+		err = m.Check(g.last)
+	}
+	if err == nil {
+		err = g.rules.CheckMedia(m)
+	}
+	if err != nil {
+		return g.reject(data, err)
+	}
+	g.last = m
+	g.good = append([]byte(nil), data...)
+	return g.good, false, nil
+}
+
+// Master validates a master playlist revision against the rules and the
+// renditions it lists, returning the playlist to serve as Revision does.
+// segment returns the first segment of the rendition of a variant URI,
+// false when there is none to check the variant against.
+func (g *Gate) Master(data []byte, segment func(uri string) ([]byte, bool)) (serve []byte, changed bool, err error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.good != nil && string(data) == string(g.good) {
+		return g.good, false, nil
+	}
+	if g.rejected != nil && string(data) == string(g.rejected) {
+		// no need to read the segments again
+		return g.reject(data, g.rejectedErr)
+	}
+	variants, err := ParseMaster(data)
+	if err == nil {
+		err = g.rules.CheckMaster(variants)
+	}
+	for i := 0; err == nil && i < len(variants); i++ {
+		if first, ok := segment(variants[i].URI); ok {
+			err = CheckVariant(variants[i], first)
+		}
+	}
+	if err != nil {
+		return g.reject(data, err)
+	}
+	g.good = append([]byte(nil), data...)
+	return g.good, false, nil
+}
+
+// reject records data as the revision last rejected for err, with the gate
+// locked
+func (g *Gate) reject(data []byte, err error) (serve []byte, changed bool, _ error) {
+	changed = string(data) != string(g.rejected)
+	g.rejected = append(g.rejected[:0], data...)
+	g.rejectedErr = err
+	if g.Strict {
+		return nil, changed, err
+	}
+	return g.good, changed, err
+}
+
+// Reset forgets the revision history, e.g. when a new session starts
+// writing the playlist
+func (g *Gate) Reset() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.last, g.good, g.rejected, g.rejectedErr = nil, nil, nil, nil
+}
+
+// SetRules sets the device constraints revisions are checked against, e.g.
+// those of the compatibility profile of a new session
+func (g *Gate) SetRules(r Rules) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.rules = r
+}
@@ -0,0 +1,143 @@
+package hlscheck
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+// HEVCSPS is what CODECS and RESOLUTION are derived from for H.265
+type HEVCSPS struct {
+	// ProfileSpace, Tier, Profile, Compatibility, Constraints and Level
+	// are those of the general profile_tier_level (H.265 7.3.3)
+	ProfileSpace  int
+	Tier          int
+	Profile       int
+	Compatibility uint32
+	Constraints   [6]byte
+	Level         int
+	Width         int
+	Height        int
+}
+
+// CodecString is the RFC 6381 codecs value (ISO/IEC 14496-15 E.3), e.g.
+// hvc1.1.6.L93.B0
+func (s HEVCSPS) CodecString() string {
+	var b strings.Builder
+	b.WriteString("hvc1.")
+	if s.ProfileSpace > 0 {
+		b.WriteByte(byte('A' + s.ProfileSpace - 1))
+	}
+	fmt.Fprintf(&b, "%d.%x.", s.Profile, bits.Reverse32(s.Compatibility))
+	if s.Tier == 1 {
+		b.WriteByte('H')
+	} else {
+		b.WriteByte('L')
+	}
+	fmt.Fprintf(&b, "%d", s.Level)
+	constraints := s.Constraints[:]
+	for len(constraints) > 0 && constraints[len(constraints)-1] == 0 {
+		constraints = constraints[:len(constraints)-1]
+	}
+	for _, c := range constraints {
+		fmt.Fprintf(&b, ".%X", c)
+	}
+	return b.String()
+}
+
+// hevcSPSType is the NAL unit type of an H.265 SPS
+const hevcSPSType = 33
+
+var errNoHEVCSPS = errors.New("hlscheck: no H265 SPS found")
+
+// FindHEVCSPS returns the first SPS NAL unit of an Annex B H.265 stream
+func FindHEVCSPS(data []byte) ([]byte, error) {
+	for i := 0; i+4 < len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		start := i + 3
+		if data[start]>>1&0x3f != hevcSPSType {
+			continue
+		}
+		end := len(data)
+		for j := start; j+2 < len(data); j++ {
+			if data[j] == 0 && data[j+1] == 0 && (data[j+2] == 1 || data[j+2] == 0) {
+				end = j
+				break
+			}
+		}
+		return data[start:end], nil
+	}
+	return nil, errNoHEVCSPS
+}
+
+// ParseHEVCSPS parses an H.265 SPS NAL unit, its two header bytes included
+// (H.265 7.3.2.2), up to the conformance window
+func ParseHEVCSPS(nal []byte) (HEVCSPS, error) {
+	if len(nal) < 15 || nal[0]>>1&0x3f != hevcSPSType {
+		return HEVCSPS{}, errors.New("hlscheck: not an H265 SPS NAL unit")
+	}
+	r := &bitReader{data: unescape(nal[2:])}
+	s := HEVCSPS{}
+	r.bits(4) // sps_video_parameter_set_id
+	subLayers := r.bits(3)
+	r.bit() // sps_temporal_id_nesting_flag
+
+	s.ProfileSpace = r.bits(2)
+	s.Tier = r.bit()
+	s.Profile = r.bits(5)
+	s.Compatibility = uint32(r.bits(32))
+	for i := range s.Constraints {
+		s.Constraints[i] = byte(r.bits(8))
+	}
+	s.Level = r.bits(8)
+	profilePresent := make([]bool, subLayers)
+	levelPresent := make([]bool, subLayers)
+	for i := 0; i < subLayers; i++ {
+		profilePresent[i] = r.bit() == 1
+		levelPresent[i] = r.bit() == 1
+	}
+	if subLayers > 0 {
+		for i := subLayers; i < 8; i++ {
+			r.bits(2) // reserved_zero_2bits
+		}
+	}
+	for i := 0; i < subLayers; i++ {
+		if profilePresent[i] {
+			// profile space to the constraint flags of the sub-layer
+			r.bits(32)
+			r.bits(32)
+			r.bits(24)
+		}
+		if levelPresent[i] {
+			r.bits(8)
+		}
+	}
+
+	r.ue() // sps_seq_parameter_set_id
+	chroma := r.ue()
+	if chroma == 3 && r.bit() == 1 {
+		// separate_colour_plane_flag: each plane is coded as monochrome
+		chroma = 0
+	}
+	s.Width = r.ue()
+	s.Height = r.ue()
+	if r.bit() == 1 {
+		left, right, top, bottom := r.ue(), r.ue(), r.ue(), r.ue()
+		cropX, cropY := 1, 1
+		switch chroma {
+		case 1:
+			cropX, cropY = 2, 2
+		case 2:
+			cropX = 2
+		}
+		s.Width -= cropX * (left + right)
+		s.Height -= cropY * (top + bottom)
+	}
+	if r.err != nil {
+		return HEVCSPS{}, r.err
+	}
+	return s, nil
+}
@@ -0,0 +1,112 @@
+package hlscheck
+
+import "testing"
+
+// testHEVCSPS encodes an SPS NAL unit of a Main profile 4:2:0 stream of
+// width x height, cropping cropBottom luma rows, with one sub-layer more
+// than the highest when subLayer
+func testHEVCSPS(level, width, height, cropBottom int, subLayer bool) []byte {
+	w := &bitWriter{}
+	w.bits(0, 4) // sps_video_parameter_set_id
+	if subLayer {
+		w.bits(1, 3) // sps_max_sub_layers_minus1
+	} else {
+		w.bits(0, 3)
+	}
+	w.bits(1, 1)       // sps_temporal_id_nesting_flag
+	w.bits(0, 2)       // general_profile_space
+	w.bits(0, 1)       // general_tier_flag
+	w.bits(1, 5)       // general_profile_idc
+	w.bits(0x6000, 16) // general_profile_compatibility_flag 1 and 2
+	w.bits(0, 16)      // the other compatibility flags
+	w.bits(0xb0, 8)    // progressive, non packed, frame only
+	w.bits(0, 32)      // the other constraint flags
+	w.bits(0, 8)       // reserved
+	w.bits(level, 8)   // general_level_idc
+	if subLayer {
+		w.bits(0, 1)  // sub_layer_profile_present_flag
+		w.bits(1, 1)  // sub_layer_level_present_flag
+		w.bits(0, 14) // reserved_zero_2bits
+		w.bits(level, 8)
+	}
+	w.ue(0) // sps_seq_parameter_set_id
+	w.ue(1) // chroma_format_idc
+	w.ue(width)
+	w.ue(height)
+	if cropBottom > 0 {
+		w.bits(1, 1)
+		w.ue(0)
+		w.ue(0)
+		w.ue(0)
+		w.ue(cropBottom / 2)
+	} else {
+		w.bits(0, 1)
+	}
+	w.ue(0) // bit_depth_luma_minus8
+	w.ue(0) // bit_depth_chroma_minus8
+	w.bits(1, 1)
+	return append([]byte{hevcSPSType << 1, 0x01}, escape(w.data)...)
+}
+
+// escape inserts the emulation prevention bytes of an RBSP
+func escape(rbsp []byte) []byte {
+	var out []byte
+	zeros := 0
+	for _, b := range rbsp {
+		if zeros >= 2 && b <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+func TestParseHEVCSPS(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		sps    []byte
+		width  int
+		height int
+		codec  string
+	}{
+		{"1080p", testHEVCSPS(120, 1920, 1088, 8, false), 1920, 1080, "hvc1.1.6.L120.B0"},
+		{"720p", testHEVCSPS(93, 1280, 720, 0, false), 1280, 720, "hvc1.1.6.L93.B0"},
+		{"sub-layer", testHEVCSPS(93, 1280, 720, 0, true), 1280, 720, "hvc1.1.6.L93.B0"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// a VPS, then the SPS, then a PPS
+			stream := append([]byte{0, 0, 0, 1, 32 << 1, 1, 0x0c, 0x01}, 0, 0, 0, 1)
+			stream = append(stream, tc.sps...)
+			stream = append(stream, 0, 0, 0, 1, 34<<1, 1, 0xc1)
+			nal, err := FindHEVCSPS(stream)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s, err := ParseHEVCSPS(nal)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.Width != tc.width || s.Height != tc.height {
+				t.Fatalf("size = %dx%d, want %dx%d", s.Width, s.Height, tc.width, tc.height)
+			}
+			if got := s.CodecString(); got != tc.codec {
+				t.Fatalf("codec = %s, want %s", got, tc.codec)
+			}
+		})
+	}
+}
+
+func TestFindHEVCSPSMissing(t *testing.T) {
+	if _, err := FindHEVCSPS([]byte{0, 0, 0, 1, 32 << 1, 1, 0x0c}); err == nil {
+		t.Fatal("found an SPS in a VPS")
+	}
+	if _, err := ParseHEVCSPS(testSPS(66, 0, 30, 640, 360, 0)); err == nil {
+		t.Fatal("parsed an H264 SPS")
+	}
+}
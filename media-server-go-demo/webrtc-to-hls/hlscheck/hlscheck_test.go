@@ -0,0 +1,220 @@
+package hlscheck
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const media = `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:5
+#EXT-X-MEDIA-SEQUENCE:%d
+#EXTINF:5.000,
+segment%d.ts
+#EXTINF:4.8,
+segment%d.ts
+`
+
+func mediaRevision(seq int) []byte {
+	return []byte(fmt.Sprintf(media, seq, seq, seq+1))
+}
+
+func TestParseMedia(t *testing.T) {
+	m, err := ParseMedia(mediaRevision(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.TargetDuration != 5 || m.MediaSequence != 3 || len(m.Segments) != 2 || m.Segments[1].URI != "segment4.ts" {
+		t.Fatalf("parsed %+v", m)
+	}
+	if err := m.Check(nil); err != nil {
+		t.Fatal(err)
+	}
+	m, err = ParseMedia([]byte("#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MAP:URI=\"init00000.mp4\"\n#EXTINF:2,\na00000.m4s\n"))
+	if err != nil || m.Map != "init00000.mp4" {
+		t.Fatalf("fmp4 playlist: %+v, %v", m, err)
+	}
+
+	bad := map[string]string{
+		"no header":         "#EXT-X-TARGETDURATION:5\n",
+		"no target":         "#EXTM3U\n#EXTINF:5,\na.ts\n",
+		"late header tag":   "#EXTM3U\n#EXT-X-TARGETDURATION:5\n#EXTINF:5,\na.ts\n#EXT-X-MEDIA-SEQUENCE:1\n",
+		"uri without inf":   "#EXTM3U\n#EXT-X-TARGETDURATION:5\na.ts\n",
+		"dangling inf":      "#EXTM3U\n#EXT-X-TARGETDURATION:5\n#EXTINF:5,\n",
+		"after endlist":     "#EXTM3U\n#EXT-X-TARGETDURATION:5\n#EXT-X-ENDLIST\n#EXTINF:5,\na.ts\n",
+		"master in media":   "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1\na.m3u8\n",
+		"map without uri":   "#EXTM3U\n#EXT-X-TARGETDURATION:5\n#EXT-X-MAP:BYTERANGE=\"1@0\"\n",
+		"duplicate version": "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:5\n",
+	}
+	for name, playlist := range bad {
+		if _, err := ParseMedia([]byte(playlist)); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	long, _ := ParseMedia([]byte("#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXTINF:2.6,\na.ts\n"))
+	if err := long.Check(nil); err == nil {
+		t.Fatal("segment over target duration accepted")
+	}
+
+	prev, _ := ParseMedia(mediaRevision(3))
+	next, _ := ParseMedia(mediaRevision(4))
+	if err := next.Check(prev); err != nil {
+		t.Fatal(err)
+	}
+	if err := prev.Check(next); err == nil {
+		t.Fatal("media sequence going back accepted")
+	}
+	renamed, _ := ParseMedia([]byte(strings.Replace(string(mediaRevision(4)), "segment4.ts", "other.ts", 1)))
+	if err := renamed.Check(prev); err == nil {
+		t.Fatal("changed segment accepted")
+	}
+}
+
+func TestGate(t *testing.T) {
+	g := &Gate{}
+	good := mediaRevision(3)
+	if serve, _, err := g.Revision(good); err != nil || string(serve) != string(good) {
+		t.Fatalf("good revision: %v", err)
+	}
+	serve, changed, err := g.Revision(mediaRevision(2))
+	if err == nil || !changed || string(serve) != string(good) {
+		t.Fatalf("bad revision served %q, changed %v, err %v", serve, changed, err)
+	}
+	if _, changed, _ := g.Revision(mediaRevision(2)); changed {
+		t.Fatal("same bad revision reported twice")
+	}
+
+	strict := &Gate{Strict: true}
+	strict.Revision(good)
+	if serve, _, err := strict.Revision(mediaRevision(2)); err == nil || serve != nil {
+		t.Fatal("strict gate served a bad revision")
+	}
+}
+
+func TestMaster(t *testing.T) {
+	master := "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=2500000,RESOLUTION=1280x720,CODECS=\"avc1.42c01f,mp4a.40.2\"\n720p/playlist.m3u8\n"
+	variants, err := ParseMaster([]byte(master))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := variants[0]
+	if v.Bandwidth != 2500000 || v.Width != 1280 || v.Codecs != "avc1.42c01f,mp4a.40.2" || v.URI != "720p/playlist.m3u8" {
+		t.Fatalf("variant %+v", v)
+	}
+	if _, err := ParseMaster([]byte("#EXTM3U\n#EXT-X-STREAM-INF:RESOLUTION=1x1\na.m3u8\n")); err == nil {
+		t.Fatal("variant without bandwidth accepted")
+	}
+
+	frame := testADTS(2, 3, 2, 50)
+	segment := append(append(frame, frame...), 0, 0, 1)
+	segment = append(segment, testSPS(0x42, 0xc0, 0x1f, 1280, 720, 0)...)
+	if err := CheckVariant(v, segment); err != nil {
+		t.Fatal(err)
+	}
+	he := v
+	he.Codecs = "avc1.42c01f,mp4a.40.5"
+	if err := CheckVariant(he, segment); err != nil {
+		t.Fatalf("HE-AAC signalled implicitly: %v", err)
+	}
+	aacMain := v
+	aacMain.Codecs = "avc1.42c01f,mp4a.40.1"
+	if err := CheckVariant(aacMain, segment); err == nil || !strings.Contains(err.Error(), "ADTS says mp4a.40.2") {
+		t.Fatalf("wrong audio CODECS = %v", err)
+	}
+	audioOnly := Variant{URI: "audio/playlist.m3u8", Codecs: "mp4a.40.2"}
+	if err := CheckVariant(audioOnly, append(frame, frame...)); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckVariant(v, segment[2*len(frame):]); err == nil {
+		t.Fatal("audio CODECS of a segment without audio accepted")
+	}
+	v.Codecs = "avc1.640028"
+	if err := CheckVariant(v, segment); err == nil {
+		t.Fatal("wrong CODECS accepted")
+	}
+}
+
+func TestGateMaster(t *testing.T) {
+	const master = "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=2500000,RESOLUTION=1280x720,CODECS=\"avc1.42c01f,%s\"\n720p/playlist.m3u8\n"
+	frame := testADTS(2, 3, 2, 50)
+	segment := append(append(frame, frame...), 0, 0, 1)
+	segment = append(segment, testSPS(0x42, 0xc0, 0x1f, 1280, 720, 0)...)
+	reads := 0
+	first := func(uri string) ([]byte, bool) {
+		reads++
+		return segment, uri == "720p/playlist.m3u8"
+	}
+
+	g := &Gate{}
+	good := []byte(fmt.Sprintf(master, "mp4a.40.2"))
+	if serve, _, err := g.Master(good, first); err != nil || string(serve) != string(good) {
+		t.Fatalf("good master: %v", err)
+	}
+	bad := []byte(fmt.Sprintf(master, "mp4a.40.1"))
+	serve, changed, err := g.Master(bad, first)
+	if err == nil || !changed || string(serve) != string(good) {
+		t.Fatalf("bad master served %q, changed %v, err %v", serve, changed, err)
+	}
+	reads = 0
+	if _, changed, err := g.Master(bad, first); changed || err == nil || reads != 0 {
+		t.Fatalf("same bad master: changed %v, err %v, %d segments read", changed, err, reads)
+	}
+
+	g.Reset()
+	g.SetRules(Rules{AudioCodecs: []string{"mp4a.40.5"}})
+	if serve, _, err := g.Master(good, first); err == nil || serve != nil {
+		t.Fatal("gate ignored its master rules")
+	}
+
+	strict := &Gate{Strict: true}
+	strict.Master(good, first)
+	if serve, _, err := strict.Master(bad, first); err == nil || serve != nil {
+		t.Fatal("strict gate served a bad master")
+	}
+}
+
+func TestRules(t *testing.T) {
+	ll, err := ParseMedia([]byte("#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-PART-INF:PART-TARGET=0.5\n#EXT-X-PART:DURATION=0.5,URI=\"a.0.ts\"\n#EXTINF:2,\na.ts\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ll.LowLatency != "#EXT-X-PART-INF" {
+		t.Fatalf("low-latency tag = %q", ll.LowLatency)
+	}
+	if err := (Rules{}).CheckMedia(ll); err != nil {
+		t.Fatal(err)
+	}
+	if err := (Rules{NoLowLatency: true}).CheckMedia(ll); err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Fatalf("low-latency tags = %v", err)
+	}
+	if err := (Rules{TargetDuration: 6}).CheckMedia(ll); err == nil {
+		t.Fatal("target duration other than the fixed one accepted")
+	}
+	if err := (Rules{MaxTargetDuration: 1}).CheckMedia(ll); err == nil {
+		t.Fatal("target duration over the maximum accepted")
+	}
+
+	g := &Gate{}
+	g.SetRules(Rules{TargetDuration: 6})
+	if _, _, err := g.Revision(mediaRevision(3)); err == nil {
+		t.Fatal("gate ignored its rules")
+	}
+
+	variants := []Variant{
+		{URI: "a.m3u8", Codecs: "avc1.42c01f,mp4a.40.2"},
+		{URI: "b.m3u8", Codecs: "avc1.42c01f,mp4a.40.5"},
+	}
+	if err := (Rules{MaxVariants: 1}).CheckMaster(variants); err == nil {
+		t.Fatal("too many variants accepted")
+	}
+	if err := (Rules{AudioCodecs: []string{"mp4a.40.2"}}).CheckMaster(variants); err == nil || !strings.Contains(err.Error(), "b.m3u8") {
+		t.Fatalf("HE-AAC variant = %v", err)
+	}
+	if err := (Rules{AudioCodecs: []string{"mp4a.40.2"}, MaxVariants: 3}).CheckMaster(variants[:1]); err != nil {
+		t.Fatal(err)
+	}
+}
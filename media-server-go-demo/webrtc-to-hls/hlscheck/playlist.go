@@ -0,0 +1,378 @@
+// Package hlscheck validates HLS playlists before they are made visible:
+// syntax and tag order, segment durations against EXT-X-TARGETDURATION,
+// MEDIA-SEQUENCE progression between revisions, and master playlist
+// CODECS/RESOLUTION against the SPS of each rendition's first segment.
+// Rules add device constraints on top, such as a fixed target duration.
+package hlscheck
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Error is a validation failure at a playlist line
+type Error struct {
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	if e.Line == 0 {
+		return "hlscheck: " + e.Msg
+	}
+	return fmt.Sprintf("hlscheck: line %d: %s", e.Line, e.Msg)
+}
+
+func errorf(line int, format string, args ...interface{}) error {
+	return &Error{Line: line, Msg: fmt.Sprintf(format, args...)}
+}
+
+// Segment is one media segment of a media playlist
+type Segment struct {
+	Duration float64
+	URI      string
+}
+
+// Media is a parsed media playlist
+type Media struct {
+	TargetDuration int
+	MediaSequence  int
+	Segments       []Segment
+	Ended          bool
+	// Map is the URI of the initialization section of fMP4 segments, from
+	// the first EXT-X-MAP
+	Map string
+	// LowLatency is the first LL-HLS tag of the playlist, if any
+	LowLatency     string
+	lowLatencyLine int
+}
+
+// tags that may only appear once, before the first segment
+var headerTags = map[string]bool{
+	"#EXT-X-VERSION":                true,
+	"#EXT-X-TARGETDURATION":         true,
+	"#EXT-X-MEDIA-SEQUENCE":         true,
+	"#EXT-X-PLAYLIST-TYPE":          true,
+	"#EXT-X-DISCONTINUITY-SEQUENCE": true,
+	"#EXT-X-ALLOW-CACHE":            true,
+	"#EXT-X-INDEPENDENT-SEGMENTS":   true,
+}
+
+func splitTag(line string) (string, string) {
+	if i := strings.IndexByte(line, ':'); i >= 0 {
+		return line[:i], line[i+1:]
+	}
+	return line, ""
+}
+
+// ParseMedia parses a media playlist, checking its syntax and tag order
+func ParseMedia(data []byte) (*Media, error) {
+	m := &Media{TargetDuration: -1}
+	seen := map[string]bool{}
+	var pending *Segment
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if n == 1 {
+			if line != "#EXTM3U" {
+				return nil, errorf(n, "playlist must start with #EXTM3U")
+			}
+			continue
+		}
+		if line == "" {
+			continue
+		}
+		if m.Ended {
+			return nil, errorf(n, "content after #EXT-X-ENDLIST")
+		}
+		if !strings.HasPrefix(line, "#") {
+			if pending == nil {
+				return nil, errorf(n, "segment %q without #EXTINF", line)
+			}
+			pending.URI = line
+			m.Segments = append(m.Segments, *pending)
+			pending = nil
+			continue
+		}
+		if !strings.HasPrefix(line, "#EXT") {
+			// comment
+			continue
+		}
+		tag, value := splitTag(line)
+		if lowLatencyTags[tag] && m.LowLatency == "" {
+			m.LowLatency, m.lowLatencyLine = tag, n
+		}
+		if headerTags[tag] {
+			if seen[tag] {
+				return nil, errorf(n, "duplicate %s", tag)
+			}
+			if len(m.Segments) > 0 || pending != nil {
+				return nil, errorf(n, "%s after the first segment", tag)
+			}
+			seen[tag] = true
+		}
+		if pending != nil && tag != "#EXT-X-PROGRAM-DATE-TIME" && tag != "#EXT-X-DISCONTINUITY" && tag != "#EXT-X-BYTERANGE" {
+			return nil, errorf(n, "%s between #EXTINF and its URI", tag)
+		}
+		switch tag {
+		case "#EXT-X-STREAM-INF":
+			return nil, errorf(n, "master playlist tag in media playlist")
+		case "#EXT-X-TARGETDURATION":
+			target, err := strconv.Atoi(value)
+			if err != nil || target <= 0 {
+				return nil, errorf(n, "bad target duration %q", value)
+			}
+			m.TargetDuration = target
+		case "#EXT-X-MEDIA-SEQUENCE":
+			seq, err := strconv.Atoi(value)
+			if err != nil || seq < 0 {
+				return nil, errorf(n, "bad media sequence %q", value)
+			}
+			m.MediaSequence = seq
+		case "#EXTINF":
+			if m.TargetDuration < 0 {
+				return nil, errorf(n, "#EXTINF before #EXT-X-TARGETDURATION")
+			}
+			durationStr := value
+			if i := strings.IndexByte(value, ','); i >= 0 {
+				durationStr = value[:i]
+			}
+			duration, err := strconv.ParseFloat(durationStr, 64)
+			if err != nil || duration < 0 {
+				return nil, errorf(n, "bad segment duration %q", value)
+			}
+			pending = &Segment{Duration: duration}
+		case "#EXT-X-MAP":
+			attrs, err := parseAttributes(value)
+			if err != nil || attrs["URI"] == "" {
+				return nil, errorf(n, "bad map %q", value)
+			}
+			if m.Map == "" {
+				m.Map = attrs["URI"]
+			}
+		case "#EXT-X-ENDLIST":
+			m.Ended = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, errorf(0, "empty playlist")
+	}
+	if pending != nil {
+		return nil, errorf(n, "#EXTINF without URI")
+	}
+	if m.TargetDuration < 0 {
+		return nil, errorf(0, "missing #EXT-X-TARGETDURATION")
+	}
+	return m, nil
+}
+
+// Check validates m as the revision following prev, which may be nil
+func (m *Media) Check(prev *Media) error {
+	for i, s := range m.Segments {
+		// RFC 8216 4.3.3.1: durations rounded to the nearest integer
+		if int(math.Floor(s.Duration+0.5)) > m.TargetDuration {
+			return errorf(0, "segment %d (%s) lasts %.3fs, over the %ds target duration", m.MediaSequence+i, s.URI, s.Duration, m.TargetDuration)
+		}
+	}
+	if prev == nil {
+		return nil
+	}
+	if m.MediaSequence < prev.MediaSequence {
+		return errorf(0, "media sequence went back from %d to %d", prev.MediaSequence, m.MediaSequence)
+	}
+	if prev.Ended && !m.Ended {
+		return errorf(0, "#EXT-X-ENDLIST removed")
+	}
+	// segments still listed by both revisions must not change
+	shift := m.MediaSequence - prev.MediaSequence
+	for i := shift; i < len(prev.Segments) && i-shift < len(m.Segments); i++ {
+		if prev.Segments[i].URI != m.Segments[i-shift].URI {
+			return errorf(0, "segment %d changed from %s to %s", prev.MediaSequence+i, prev.Segments[i].URI, m.Segments[i-shift].URI)
+		}
+	}
+	if m.MediaSequence+len(m.Segments) < prev.MediaSequence+len(prev.Segments) {
+		return errorf(0, "segments disappeared from the end of the playlist")
+	}
+	return nil
+}
+
+// Variant is one EXT-X-STREAM-INF entry of a master playlist
+type Variant struct {
+	Bandwidth int
+	Codecs    string
+	Width     int
+	Height    int
+	URI       string
+}
+
+// ParseMaster parses a master playlist
+func ParseMaster(data []byte) ([]Variant, error) {
+	var variants []Variant
+	var pending *Variant
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if n == 1 {
+			if line != "#EXTM3U" {
+				return nil, errorf(n, "playlist must start with #EXTM3U")
+			}
+			continue
+		}
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "#") {
+			if pending == nil {
+				return nil, errorf(n, "URI %q without #EXT-X-STREAM-INF", line)
+			}
+			pending.URI = line
+			variants = append(variants, *pending)
+			pending = nil
+			continue
+		}
+		tag, value := splitTag(line)
+		switch tag {
+		case "#EXTINF", "#EXT-X-TARGETDURATION":
+			return nil, errorf(n, "media playlist tag in master playlist")
+		case "#EXT-X-STREAM-INF":
+			if pending != nil {
+				return nil, errorf(n, "#EXT-X-STREAM-INF without URI")
+			}
+			v, err := parseStreamInf(value)
+			if err != nil {
+				return nil, errorf(n, "%v", err)
+			}
+			pending = v
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if pending != nil {
+		return nil, errorf(n, "#EXT-X-STREAM-INF without URI")
+	}
+	if len(variants) == 0 {
+		return nil, errorf(0, "no variants")
+	}
+	return variants, nil
+}
+
+// parseAttributes splits an attribute list, honoring quoted strings
+func parseAttributes(list string) (map[string]string, error) {
+	attrs := map[string]string{}
+	for len(list) > 0 {
+		eq := strings.IndexByte(list, '=')
+		if eq <= 0 {
+			return nil, fmt.Errorf("bad attribute list %q", list)
+		}
+		name := list[:eq]
+		list = list[eq+1:]
+		var value string
+		if strings.HasPrefix(list, "\"") {
+			end := strings.IndexByte(list[1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quoted string in %s", name)
+			}
+			value = list[1 : end+1]
+			list = list[end+2:]
+		} else if comma := strings.IndexByte(list, ','); comma >= 0 {
+			value = list[:comma]
+			list = list[comma:]
+		} else {
+			value = list
+			list = ""
+		}
+		if _, ok := attrs[name]; ok {
+			return nil, fmt.Errorf("duplicate attribute %s", name)
+		}
+		attrs[name] = value
+		if strings.HasPrefix(list, ",") {
+			list = list[1:]
+		} else if list != "" {
+			return nil, fmt.Errorf("bad attribute list after %s", name)
+		}
+	}
+	return attrs, nil
+}
+
+func parseStreamInf(value string) (*Variant, error) {
+	attrs, err := parseAttributes(value)
+	if err != nil {
+		return nil, err
+	}
+	v := &Variant{Codecs: attrs["CODECS"]}
+	if v.Bandwidth, err = strconv.Atoi(attrs["BANDWIDTH"]); err != nil || v.Bandwidth <= 0 {
+		return nil, fmt.Errorf("missing or bad BANDWIDTH")
+	}
+	if resolution, ok := attrs["RESOLUTION"]; ok {
+		if _, err := fmt.Sscanf(resolution, "%dx%d", &v.Width, &v.Height); err != nil {
+			return nil, fmt.Errorf("bad RESOLUTION %q", resolution)
+		}
+	}
+	return v, nil
+}
+
+// CheckVariant cross-checks the CODECS and RESOLUTION of v against the
+// first segment of the rendition, MPEG-TS or Annex B: the SPS of its
+// H.264, and the ADTS header of its AAC. A variant listing audio codecs
+// alone is not checked for video.
+func CheckVariant(v Variant, firstSegment []byte) error {
+	video := v.Codecs == "" || v.Width > 0
+	for _, codec := range strings.Split(v.Codecs, ",") {
+		codec = strings.TrimSpace(codec)
+		if isVideoCodec(codec) {
+			video = true
+		}
+		if !strings.HasPrefix(codec, "mp4a.") {
+			continue
+		}
+		aac, err := FindADTS(firstSegment)
+		if err != nil {
+			return errorf(0, "%s: CODECS says %s: %v", v.URI, codec, err)
+		}
+		if !aac.Matches(codec) {
+			return errorf(0, "%s: CODECS says %s, ADTS says %s", v.URI, codec, aac.CodecString())
+		}
+	}
+	if !video {
+		return nil
+	}
+	sps, err := FindSPS(firstSegment)
+	if err != nil {
+		return err
+	}
+	info, err := ParseSPS(sps)
+	if err != nil {
+		return err
+	}
+	if v.Codecs != "" {
+		found := false
+		for _, codec := range strings.Split(v.Codecs, ",") {
+			codec = strings.TrimSpace(codec)
+			if strings.HasPrefix(codec, "avc1.") {
+				found = true
+				if !strings.EqualFold(codec, info.CodecString()) {
+					return errorf(0, "%s: CODECS says %s, SPS says %s", v.URI, codec, info.CodecString())
+				}
+			}
+		}
+		if !found {
+			return errorf(0, "%s: CODECS %q lists no avc1 codec for an H264 rendition", v.URI, v.Codecs)
+		}
+	}
+	if v.Width > 0 && (v.Width != info.Width || v.Height != info.Height) {
+		return errorf(0, "%s: RESOLUTION says %dx%d, SPS says %dx%d", v.URI, v.Width, v.Height, info.Width, info.Height)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package hlscheck
+
+import "strings"
+
+// lowLatencyTags are the tags of Low-Latency HLS, which older players
+// reject rather than ignore
+var lowLatencyTags = map[string]bool{
+	"#EXT-X-SERVER-CONTROL":   true,
+	"#EXT-X-PART-INF":         true,
+	"#EXT-X-PART":             true,
+	"#EXT-X-PRELOAD-HINT":     true,
+	"#EXT-X-RENDITION-REPORT": true,
+	"#EXT-X-SKIP":             true,
+}
+
+// videoCodecs are the CODECS prefixes of video formats; anything else is
+// taken for audio
+var videoCodecs = []string{"avc1.", "avc3.", "hvc1.", "hev1.", "av01.", "vp09."}
+
+// Rules are device constraints checked on top of the spec, e.g. from a
+// compatibility profile. The zero value checks nothing.
+type Rules struct {
+	// TargetDuration is the only target duration allowed, any when 0
+	TargetDuration int
+	// MaxTargetDuration bounds the target duration, unbounded when 0
+	MaxTargetDuration int
+	// NoLowLatency rejects LL-HLS tags
+	NoLowLatency bool
+	// MaxVariants bounds the variants of a master playlist, unbounded when 0
+	MaxVariants int
+	// AudioCodecs are the only audio codecs a variant may list, any when
+	// empty
+	AudioCodecs []string
+}
+
+// CheckMedia validates a media playlist against the rules
+func (r Rules) CheckMedia(m *Media) error {
+	if r.NoLowLatency && m.LowLatency != "" {
+		return errorf(m.lowLatencyLine, "%s not allowed: low-latency tags are disabled", m.LowLatency)
+	}
+	if r.TargetDuration > 0 && m.TargetDuration != r.TargetDuration {
+		return errorf(0, "target duration %ds, must be %ds", m.TargetDuration, r.TargetDuration)
+	}
+	if r.MaxTargetDuration > 0 && m.TargetDuration > r.MaxTargetDuration {
+		return errorf(0, "target duration %ds over the %ds maximum", m.TargetDuration, r.MaxTargetDuration)
+	}
+	return nil
+}
+
+// CheckMaster validates the variants of a master playlist against the rules
+func (r Rules) CheckMaster(variants []Variant) error {
+	if r.MaxVariants > 0 && len(variants) > r.MaxVariants {
+		return errorf(0, "%d variants, at most %d allowed", len(variants), r.MaxVariants)
+	}
+	if len(r.AudioCodecs) == 0 {
+		return nil
+	}
+	for _, v := range variants {
+		for _, codec := range strings.Split(v.Codecs, ",") {
+			codec = strings.TrimSpace(codec)
+			if codec == "" || isVideoCodec(codec) || r.allowsAudio(codec) {
+				continue
+			}
+			return errorf(0, "%s: audio codec %s not allowed, only %s", v.URI, codec, strings.Join(r.AudioCodecs, ", "))
+		}
+	}
+	return nil
+}
+
+func (r Rules) allowsAudio(codec string) bool {
+	for _, allowed := range r.AudioCodecs {
+		if strings.EqualFold(codec, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+func isVideoCodec(codec string) bool {
+	for _, prefix := range videoCodecs {
+		if strings.HasPrefix(codec, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,256 @@
+package hlscheck
+
+import (
+	"errors"
+	"fmt"
+)
+
+// SPS is what CODECS and RESOLUTION are derived from
+type SPS struct {
+	Profile     int
+	Constraints int
+	Level       int
+	Width       int
+	Height      int
+}
+
+// CodecString is the RFC 6381 codecs value, e.g. avc1.42c01f
+func (s SPS) CodecString() string {
+	return fmt.Sprintf("avc1.%02x%02x%02x", s.Profile, s.Constraints, s.Level)
+}
+
+var errNoSPS = errors.New("hlscheck: no H264 SPS found in segment")
+
+const tsPacketSize = 188
+
+// FindSPS returns the first SPS NAL unit of an MPEG-TS segment or an
+// Annex B stream
+func FindSPS(data []byte) ([]byte, error) {
+	if len(data) >= tsPacketSize && data[0] == 0x47 {
+		for _, payload := range tsPayloads(data) {
+			if sps := findNAL(payload, 7); sps != nil {
+				return sps, nil
+			}
+		}
+		return nil, errNoSPS
+	}
+	if sps := findNAL(data, 7); sps != nil {
+		return sps, nil
+	}
+	return nil, errNoSPS
+}
+
+// tsPayloads concatenates the payloads of each PID, in PID order of appearance
+func tsPayloads(data []byte) [][]byte {
+	var order []int
+	payloads := map[int][]byte{}
+	for off := 0; off+tsPacketSize <= len(data); off += tsPacketSize {
+		packet := data[off : off+tsPacketSize]
+		if packet[0] != 0x47 {
+			break
+		}
+		pid := int(packet[1]&0x1f)<<8 | int(packet[2])
+		start := 4
+		switch packet[3] >> 4 & 0x3 {
+		case 1:
+		case 3:
+			start += 1 + int(packet[4])
+		default:
+			continue
+		}
+		if pid == 0 || start >= tsPacketSize {
+			continue
+		}
+		if _, ok := payloads[pid]; !ok {
+			order = append(order, pid)
+		}
+		payloads[pid] = append(payloads[pid], packet[start:]...)
+	}
+	result := make([][]byte, 0, len(order))
+	for _, pid := range order {
+		result = append(result, payloads[pid])
+	}
+	return result
+}
+
+// findNAL returns the first NAL unit of type nalType in an Annex B stream
+func findNAL(data []byte, nalType byte) []byte {
+	for i := 0; i+3 < len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		start := i + 3
+		if data[start]&0x1f != nalType {
+			continue
+		}
+		end := len(data)
+		for j := start; j+2 < len(data); j++ {
+			if data[j] == 0 && data[j+1] == 0 && (data[j+2] == 1 || data[j+2] == 0) {
+				end = j
+				break
+			}
+		}
+		return data[start:end]
+	}
+	return nil
+}
+
+type bitReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+var errShortSPS = errors.New("hlscheck: truncated SPS")
+
+func (r *bitReader) bit() int {
+	if r.pos >= len(r.data)*8 {
+		r.err = errShortSPS
+		return 0
+	}
+	b := int(r.data[r.pos/8]>>(7-uint(r.pos%8))) & 1
+	r.pos++
+	return b
+}
+
+func (r *bitReader) bits(n int) int {
+	v := 0
+	for i := 0; i < n; i++ {
+		v = v<<1 | r.bit()
+	}
+	return v
+}
+
+// ue reads an unsigned exp-Golomb value
+func (r *bitReader) ue() int {
+	zeros := 0
+	for r.bit() == 0 && r.err == nil {
+		zeros++
+		if zeros > 31 {
+			r.err = errShortSPS
+			return 0
+		}
+	}
+	return 1<<uint(zeros) - 1 + r.bits(zeros)
+}
+
+// se reads a signed exp-Golomb value
+func (r *bitReader) se() int {
+	v := r.ue()
+	if v%2 == 0 {
+		return -v / 2
+	}
+	return (v + 1) / 2
+}
+
+// unescape removes emulation prevention bytes
+func unescape(nal []byte) []byte {
+	out := make([]byte, 0, len(nal))
+	zeros := 0
+	for _, b := range nal {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+func skipScalingList(r *bitReader, size int) {
+	last, next := 8, 8
+	for j := 0; j < size; j++ {
+		if next != 0 {
+			next = (last + r.se() + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+}
+
+// ParseSPS parses an SPS NAL unit, header byte included
+func ParseSPS(nal []byte) (SPS, error) {
+	if len(nal) < 4 || nal[0]&0x1f != 7 {
+		return SPS{}, errors.New("hlscheck: not an SPS NAL unit")
+	}
+	r := &bitReader{data: unescape(nal[1:])}
+	s := SPS{}
+	s.Profile = r.bits(8)
+	s.Constraints = r.bits(8)
+	s.Level = r.bits(8)
+	r.ue() // seq_parameter_set_id
+
+	chroma := 1
+	switch s.Profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chroma = r.ue()
+		if chroma == 3 {
+			r.bit() // separate_colour_plane_flag
+		}
+		r.ue()  // bit_depth_luma_minus8
+		r.ue()  // bit_depth_chroma_minus8
+		r.bit() // qpprime_y_zero_transform_bypass_flag
+		if r.bit() == 1 {
+			lists := 8
+			if chroma == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if r.bit() == 1 {
+					if i < 6 {
+						skipScalingList(r, 16)
+					} else {
+						skipScalingList(r, 64)
+					}
+				}
+			}
+		}
+	}
+
+	r.ue() // log2_max_frame_num_minus4
+	switch r.ue() {
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.bit() // delta_pic_order_always_zero_flag
+		r.se()  // offset_for_non_ref_pic
+		r.se()  // offset_for_top_to_bottom_field
+		for i, n := 0, r.ue(); i < n && r.err == nil; i++ {
+			r.se()
+		}
+	}
+	r.ue()  // max_num_ref_frames
+	r.bit() // gaps_in_frame_num_value_allowed_flag
+	widthMbs := r.ue() + 1
+	heightMapUnits := r.ue() + 1
+	frameMbsOnly := r.bit()
+	if frameMbsOnly == 0 {
+		r.bit() // mb_adaptive_frame_field_flag
+	}
+	r.bit() // direct_8x8_inference_flag
+
+	s.Width = widthMbs * 16
+	s.Height = (2 - frameMbsOnly) * heightMapUnits * 16
+	if r.bit() == 1 {
+		left, right, top, bottom := r.ue(), r.ue(), r.ue(), r.ue()
+		cropX, cropY := 1, 2-frameMbsOnly
+		switch chroma {
+		case 1:
+			cropX, cropY = 2, 2*(2-frameMbsOnly)
+		case 2:
+			cropX = 2
+		}
+		s.Width -= cropX * (left + right)
+		s.Height -= cropY * (top + bottom)
+	}
+	if r.err != nil {
+		return SPS{}, r.err
+	}
+	return s, nil
+}
@@ -0,0 +1,85 @@
+package hlscheck
+
+import "testing"
+
+type bitWriter struct {
+	data []byte
+	n    int
+}
+
+func (w *bitWriter) bits(v, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.n%8 == 0 {
+			w.data = append(w.data, 0)
+		}
+		w.data[len(w.data)-1] |= byte((v>>uint(i))&1) << (7 - uint(w.n%8))
+		w.n++
+	}
+}
+
+func (w *bitWriter) ue(v int) {
+	v++
+	n := 0
+	for x := v; x > 1; x >>= 1 {
+		n++
+	}
+	w.bits(0, n)
+	w.bits(v, n+1)
+}
+
+// testSPS encodes a baseline style SPS of width x height, cropping
+// cropBottom luma rows
+func testSPS(profile, constraints, level, width, height, cropBottom int) []byte {
+	w := &bitWriter{}
+	w.bits(0x67, 8)
+	w.bits(profile, 8)
+	w.bits(constraints, 8)
+	w.bits(level, 8)
+	w.ue(0) // sps id
+	w.ue(0) // log2_max_frame_num_minus4
+	w.ue(2) // pic_order_cnt_type
+	w.ue(1) // max_num_ref_frames
+	w.bits(0, 1)
+	w.ue((width+15)/16 - 1)
+	w.ue((height+cropBottom+15)/16 - 1)
+	w.bits(1, 1) // frame_mbs_only
+	w.bits(1, 1) // direct_8x8
+	if cropBottom > 0 {
+		w.bits(1, 1)
+		w.ue(0)
+		w.ue(0)
+		w.ue(0)
+		w.ue(cropBottom / 2)
+	} else {
+		w.bits(0, 1)
+	}
+	w.bits(0, 1) // vui
+	w.bits(1, 1) // rbsp stop bit
+	return w.data
+}
+
+func TestParseSPS(t *testing.T) {
+	sps, err := ParseSPS(testSPS(0x42, 0xc0, 0x1f, 1920, 1080, 8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sps.Width != 1920 || sps.Height != 1080 || sps.CodecString() != "avc1.42c01f" {
+		t.Fatalf("sps %+v %s", sps, sps.CodecString())
+	}
+}
+
+func TestFindSPSInTS(t *testing.T) {
+	nal := testSPS(0x42, 0xc0, 0x1f, 640, 360, 8)
+	payload := append([]byte{0, 0, 0, 1}, nal...)
+	payload = append(payload, 0, 0, 0, 1, 0x68)
+	packet := make([]byte, tsPacketSize)
+	packet[0], packet[1], packet[2], packet[3] = 0x47, 0x41, 0x00, 0x10
+	copy(packet[4:], payload)
+	found, err := FindSPS(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(found) != string(nal) {
+		t.Fatalf("found %x, want %x", found, nal)
+	}
+}
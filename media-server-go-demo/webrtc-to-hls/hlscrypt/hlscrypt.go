@@ -0,0 +1,114 @@
+// Package hlscrypt encrypts HLS segments with AES-128 (RFC 8216 5.2): each
+// segment is encrypted whole with AES-128-CBC and PKCS7 padding, under a key
+// players fetch from the URI of the EXT-X-KEY tag listed ahead of it. Keys
+// are derived from a secret, never stored: every instance holding the secret
+// gives the same key for the same segments, so segments can be encrypted as
+// they are served and keys handed out by whichever instance a player asks.
+package hlscrypt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// KeySize is the size of AES-128 keys and of their IVs
+const KeySize = 16
+
+// Keys derives the rotating keys of streams from Secret. A key encrypts
+// Rotation consecutive segments of an output generation, so a leaked key
+// only opens that many.
+type Keys struct {
+	Secret []byte
+	// Rotation is the number of segments a key encrypts, one when below
+	Rotation int
+}
+
+// Period returns the rotation period of the segment numbered index, which
+// its key is derived for
+func (k *Keys) Period(index int) int {
+	if k.Rotation <= 1 {
+		return index
+	}
+	return index / k.Rotation
+}
+
+// Key returns the key of period of the output generation of stream
+func (k *Keys) Key(stream string, generation int64, period int) []byte {
+	mac := hmac.New(sha256.New, k.Secret)
+	fmt.Fprintf(mac, "%s/%d/%d", stream, generation, period)
+	return mac.Sum(nil)[:KeySize]
+}
+
+// IV returns the initialization vector of the segment at name, its path
+// below the output. Keys encrypt several segments, the IV keeps them apart.
+func IV(name string) []byte {
+	sum := sha256.Sum256([]byte(name))
+	return sum[:KeySize]
+}
+
+// Encrypt returns data encrypted with key and iv, padded as PKCS7
+func Encrypt(key, iv, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() {
+		return nil, fmt.Errorf("hlscrypt: iv of %d bytes", len(iv))
+	}
+	pad := block.BlockSize() - len(data)%block.BlockSize()
+	out := make([]byte, len(data)+pad)
+	copy(out, data)
+	for i := len(data); i < len(out); i++ {
+		out[i] = byte(pad)
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, out)
+	return out, nil
+}
+
+// Tag is the EXT-X-KEY of the segments encrypted with the key at URI
+func Tag(uri string, iv []byte) string {
+	return "#EXT-X-KEY:METHOD=AES-128,URI=\"" + uri + "\",IV=0x" + hex.EncodeToString(iv)
+}
+
+// Decorate lists the EXT-X-KEY line tag returns for the URI of each segment
+// of the media playlist data ahead of its EXTINF. A segment tag returns ""
+// for keeps the key of the segment before it.
+func Decorate(data []byte, tag func(uri string) string) []byte {
+	var out bytes.Buffer
+	var pending [][]byte
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		switch {
+		case bytes.HasPrefix(line, []byte("#EXTINF:")) || len(pending) > 0:
+			// the tags of a segment, up to its URI
+			pending = append(pending, append([]byte(nil), line...))
+			if len(line) == 0 || line[0] == '#' {
+				continue
+			}
+			if t := tag(string(line)); t != "" {
+				out.WriteString(t)
+				out.WriteByte('\n')
+			}
+			for _, l := range pending {
+				out.Write(l)
+				out.WriteByte('\n')
+			}
+			pending = nil
+		default:
+			out.Write(line)
+			out.WriteByte('\n')
+		}
+	}
+	for _, l := range pending {
+		out.Write(l)
+		out.WriteByte('\n')
+	}
+	return out.Bytes()
+}
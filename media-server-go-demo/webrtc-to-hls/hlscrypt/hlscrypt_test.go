@@ -0,0 +1,84 @@
+package hlscrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"strings"
+	"testing"
+)
+
+func TestKeysRotate(t *testing.T) {
+	k := &Keys{Secret: []byte("secret"), Rotation: 3}
+	if k.Period(2) != 0 || k.Period(3) != 1 {
+		t.Fatalf("periods %d %d", k.Period(2), k.Period(3))
+	}
+	a := k.Key("show", 1700000000, 0)
+	if len(a) != KeySize || !bytes.Equal(a, k.Key("show", 1700000000, 0)) {
+		t.Fatal("key not stable")
+	}
+	for _, other := range [][]byte{
+		k.Key("show", 1700000000, 1),
+		k.Key("show", 1700000001, 0),
+		k.Key("other", 1700000000, 0),
+		(&Keys{Secret: []byte("other")}).Key("show", 1700000000, 0),
+	} {
+		if bytes.Equal(a, other) {
+			t.Fatal("keys shared")
+		}
+	}
+	if (&Keys{}).Period(7) != 7 {
+		t.Fatal("no rotation set")
+	}
+}
+
+func TestEncrypt(t *testing.T) {
+	key, iv := bytes.Repeat([]byte{1}, KeySize), IV("segment-1-00001.ts")
+	for _, size := range []int{0, 15, 16, 188 * 7} {
+		data := bytes.Repeat([]byte{0x47}, size)
+		sealed, err := Encrypt(key, iv, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sealed)%aes.BlockSize != 0 || len(sealed) <= size {
+			t.Fatalf("%d bytes sealed to %d", size, len(sealed))
+		}
+		block, _ := aes.NewCipher(key)
+		opened := make([]byte, len(sealed))
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(opened, sealed)
+		pad := int(opened[len(opened)-1])
+		if !bytes.Equal(opened[:len(opened)-pad], data) {
+			t.Fatalf("%d bytes did not round trip", size)
+		}
+	}
+	if _, err := Encrypt(key, iv[:8], nil); err == nil {
+		t.Fatal("short iv accepted")
+	}
+}
+
+func TestDecorate(t *testing.T) {
+	playlist := "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:4\n" +
+		"#EXTINF:2.000,\nsegment-1-00004.ts\n" +
+		"#EXT-X-DISCONTINUITY\n#EXTINF:2.000,\nsegment-2-00000.ts\n" +
+		"#EXTINF:2.000,\nunkeyed.ts\n#EXT-X-ENDLIST\n"
+	got := string(Decorate([]byte(playlist), func(uri string) string {
+		if uri == "unkeyed.ts" {
+			return ""
+		}
+		return Tag("key-"+uri[8:9]+".key", IV(uri))
+	}))
+	lines := strings.Split(got, "\n")
+	want := []string{
+		"#EXTM3U", "#EXT-X-VERSION:3", "#EXT-X-TARGETDURATION:2", "#EXT-X-MEDIA-SEQUENCE:4",
+		Tag("key-1.key", IV("segment-1-00004.ts")), "#EXTINF:2.000,", "segment-1-00004.ts",
+		"#EXT-X-DISCONTINUITY",
+		Tag("key-2.key", IV("segment-2-00000.ts")), "#EXTINF:2.000,", "segment-2-00000.ts",
+		"#EXTINF:2.000,", "unkeyed.ts", "#EXT-X-ENDLIST", "",
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("decorated:\n%s", got)
+	}
+	if !strings.HasPrefix(want[4], `#EXT-X-KEY:METHOD=AES-128,URI="key-1.key",IV=0x`) || len(want[4]) != len(`#EXT-X-KEY:METHOD=AES-128,URI="key-1.key",IV=0x`)+32 {
+		t.Fatalf("tag %s", want[4])
+	}
+}
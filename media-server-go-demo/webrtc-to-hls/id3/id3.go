@@ -0,0 +1,65 @@
+// Package id3 writes the ID3v2.4 tags HLS carries as timed metadata in
+// MPEG-TS segments: players such as hls.js and AVPlayer surface their
+// frames to the page at the presentation time of the tag.
+package id3
+
+import "errors"
+
+// ErrTooLarge is returned for a tag over the 256MB syncsafe sizes allow
+var ErrTooLarge = errors.New("id3: tag too large")
+
+// maxSize is the largest size a syncsafe integer holds
+const maxSize = 1<<28 - 1
+
+// encodingUTF8 marks the text of a frame as UTF-8
+const encodingUTF8 = 3
+
+// Frame is a frame of a tag
+type Frame struct {
+	// ID is the four character frame id, e.g. TXXX
+	ID   string
+	Body []byte
+}
+
+// TXXX is a user defined text frame, value described by description
+func TXXX(description, value string) Frame {
+	body := append([]byte{encodingUTF8}, description...)
+	body = append(body, 0)
+	return Frame{ID: "TXXX", Body: append(body, value...)}
+}
+
+// PRIV is a private frame of owner, usually a reverse DNS name or URL
+func PRIV(owner string, data []byte) Frame {
+	body := append([]byte(owner), 0)
+	return Frame{ID: "PRIV", Body: append(body, data...)}
+}
+
+// Tag writes an ID3v2.4 tag of frames
+func Tag(frames ...Frame) ([]byte, error) {
+	size := 0
+	for _, f := range frames {
+		if len(f.ID) != 4 {
+			return nil, errors.New("id3: frame id must be 4 characters")
+		}
+		if len(f.Body) > maxSize {
+			return nil, ErrTooLarge
+		}
+		size += 10 + len(f.Body)
+	}
+	if size > maxSize {
+		return nil, ErrTooLarge
+	}
+	tag := append([]byte("ID3\x04\x00\x00"), syncsafe(size)...)
+	for _, f := range frames {
+		tag = append(tag, f.ID...)
+		tag = append(tag, syncsafe(len(f.Body))...)
+		tag = append(tag, 0, 0)
+		tag = append(tag, f.Body...)
+	}
+	return tag, nil
+}
+
+// syncsafe writes n in 4 bytes of 7 bits, so no size reads as a sync word
+func syncsafe(n int) []byte {
+	return []byte{byte(n >> 21 & 0x7f), byte(n >> 14 & 0x7f), byte(n >> 7 & 0x7f), byte(n & 0x7f)}
+}
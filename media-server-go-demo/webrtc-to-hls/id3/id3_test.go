@@ -0,0 +1,28 @@
+package id3
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestTag(t *testing.T) {
+	tag, err := Tag(TXXX("caption", "héllo"), PRIV("com.example", []byte{1, 2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte("ID3\x04\x00\x00\x00\x00\x00\x31" +
+		"TXXX\x00\x00\x00\x0f\x00\x00\x03caption\x00h\xc3\xa9llo" +
+		"PRIV\x00\x00\x00\x0e\x00\x00com.example\x00\x01\x02")
+	if !bytes.Equal(tag, want) {
+		t.Fatalf("tag\n%q\nwant\n%q", tag, want)
+	}
+	// sizes are written 7 bits a byte
+	big, _ := Tag(TXXX("", strings.Repeat("x", 200)))
+	if !bytes.Equal(big[6:10], []byte{0, 0, 1, 0x54}) || !bytes.Equal(big[14:18], []byte{0, 0, 1, 0x4a}) {
+		t.Fatalf("sizes %x %x", big[6:10], big[14:18])
+	}
+	if _, err := Tag(Frame{ID: "TX", Body: nil}); err == nil {
+		t.Fatal("short frame id accepted")
+	}
+}
@@ -0,0 +1,114 @@
+// Package ident validates the identifiers that end up in filesystem paths
+// and URLs: stream keys, external and playback ids, and the file names
+// requested under a stream. Every entry point runs what it is given through
+// here first, so nothing downstream has to wonder whether an id could be
+// "../../etc".
+//
+// An identifier is 1 to MaxLength letters, digits, '.', '_' or '-',
+// starting with a letter or digit, so it is never a relative path element,
+// a hidden file or an option. Names starting with '_' are reserved for the
+// server (e.g. "_mosaic"), as are the names of fixed routes.
+package ident
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// MaxLength bounds every identifier
+const MaxLength = 64
+
+// Kind names what an identifier is for, in errors
+type Kind string
+
+const (
+	StreamKey  Kind = "stream key"
+	ExternalID Kind = "external id"
+	PlaybackID Kind = "playback id"
+	FileName   Kind = "file name"
+)
+
+// reserved are names the server uses itself in URLs, on top of every name
+// starting with '_': the first elements of the paths of its routes, and
+// by-external next to the stream keys of /api/streams
+var reserved = map[string]bool{
+	"by-external": true,
+	"api":         true,
+	"hls":         true,
+	"metrics":     true,
+	"healthz":     true,
+	"readyz":      true,
+	"channel":     true,
+	"vod":         true,
+	"whip":        true,
+	"whep":        true,
+	"watch":       true,
+	"admin":       true,
+}
+
+// Error is an identifier that was refused
+type Error struct {
+	Kind   Kind
+	ID     string
+	Reason string
+}
+
+func (e *Error) Error() string {
+	id := e.ID
+	if len(id) > MaxLength {
+		id = id[:MaxLength] + "..."
+	}
+	return fmt.Sprintf("%s %q %s", e.Kind, id, e.Reason)
+}
+
+// Check validates id as a kind of identifier. File names are not subject
+// to the reserved names: they live below a stream, not next to it.
+func Check(kind Kind, id string) error {
+	fail := func(reason string) error {
+		return &Error{Kind: kind, ID: id, Reason: reason}
+	}
+	switch {
+	case id == "":
+		return fail("must not be empty")
+	case len(id) > MaxLength:
+		return fail(fmt.Sprintf("is longer than %d characters", MaxLength))
+	case id[0] == '_':
+		return fail("is reserved for the server")
+	case !alphanumeric(id[0]):
+		return fail("must start with a letter or digit")
+	}
+	for i := 0; i < len(id); i++ {
+		if c := id[i]; !alphanumeric(c) && c != '.' && c != '_' && c != '-' {
+			return fail("may only hold letters, digits, '.', '_' or '-'")
+		}
+	}
+	if kind != FileName && reserved[strings.ToLower(id)] {
+		return fail("is reserved")
+	}
+	return nil
+}
+
+// Normalize trims the blanks around id, which clients add by accident, and
+// checks what is left
+func Normalize(kind Kind, id string) (string, error) {
+	id = strings.TrimSpace(id)
+	return id, Check(kind, id)
+}
+
+// Join returns the path of name below root, refusing a name that is not a
+// valid file name or would leave root
+func Join(root, name string) (string, error) {
+	if err := Check(FileName, name); err != nil {
+		return "", err
+	}
+	path := filepath.Join(root, name)
+	if filepath.Dir(path) != filepath.Clean(root) {
+		return "", &Error{Kind: FileName, ID: name, Reason: "leaves its directory"}
+	}
+	return path, nil
+}
+
+func alphanumeric(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
@@ -0,0 +1,69 @@
+package ident
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	for id, valid := range map[string]bool{
+		"cms-42":                 true,
+		"Show_2.part-1":          true,
+		"1f9a3b2c-8a13-4b7c":     true,
+		strings.Repeat("a", 64):  true,
+		strings.Repeat("a", 65):  false,
+		"":                       false,
+		"../etc":                 false,
+		"..":                     false,
+		".hidden":                false,
+		"-rf":                    false,
+		"_mosaic":                false,
+		"by-external":            false,
+		"API":                    false,
+		"a/b":                    false,
+		`a\b`:                    false,
+		"with space":             false,
+		"nul\x00byte":            false,
+		"café":                   false,
+		"%2e%2e":                 false,
+		"{5e14e5a4-4a5d-4d9b}":   false,
+		"segment00001.ts":        true,
+		"stream.with.many.dots.": true,
+	} {
+		if err := Check(StreamKey, id); (err == nil) != valid {
+			t.Errorf("Check(%q) = %v", id, err)
+		}
+	}
+	if err := Check(FileName, "hls"); err != nil {
+		t.Errorf("reserved name refused as a file name: %v", err)
+	}
+	err := Check(ExternalID, "../etc")
+	if e, ok := err.(*Error); !ok || e.Kind != ExternalID || !strings.Contains(err.Error(), `external id "../etc"`) {
+		t.Fatalf("error = %v", err)
+	}
+	if err := Check(StreamKey, strings.Repeat("x", 1000)); len(err.Error()) > 200 {
+		t.Fatalf("error quotes the whole id: %v", err)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	if id, err := Normalize(StreamKey, " key-1\n"); err != nil || id != "key-1" {
+		t.Fatalf("Normalize = %q, %v", id, err)
+	}
+	if _, err := Normalize(StreamKey, "  "); err == nil {
+		t.Fatal("blank key accepted")
+	}
+}
+
+func TestJoin(t *testing.T) {
+	root := filepath.Join("out", "root")
+	if path, err := Join(root, "segment00001.ts"); err != nil || path != filepath.Join(root, "segment00001.ts") {
+		t.Fatalf("Join = %q, %v", path, err)
+	}
+	for _, name := range []string{"..", "../x", "a/../../x", "/etc/passwd", ""} {
+		if path, err := Join(root, name); err == nil {
+			t.Errorf("Join(%q) = %q", name, path)
+		}
+	}
+}
@@ -0,0 +1,6 @@
+// Package integration runs the server in process and publishes to it with
+// the pion client of package publisher, checking the HLS output it writes
+// and how publishes end. It needs GStreamer with the plugins of the
+// pipelines, and runs with go test -tags integration ./integration/;
+// ffprobe, when installed, checks the segments too.
+package integration
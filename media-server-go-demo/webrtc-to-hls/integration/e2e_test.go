@@ -0,0 +1,302 @@
+//go:build integration
+// +build integration
+
+package integration
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/conformance"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/hlscheck"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/publisher"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/streamserver"
+)
+
+const (
+	// liveTimeout bounds the wait for the output to have liveSegments
+	liveTimeout  = time.Minute
+	liveSegments = 3
+	// endTimeout bounds the wait for a publish to end
+	endTimeout = 15 * time.Second
+	admin      = "integration"
+)
+
+// base is the url of the server, and hlsDir where it writes its output
+var base, hlsDir string
+
+func TestMain(m *testing.M) {
+	os.Exit(run(m))
+}
+
+// run starts the server in a temporary directory, with the output of
+// ended generations kept for ffprobe, and runs the tests against it
+func run(m *testing.M) int {
+	index, err := filepath.Abs(filepath.Join("..", "index.html"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	dir, err := ioutil.TempDir("", "integration")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+	hlsDir = filepath.Join(dir, "hls")
+	address, err := freeAddress()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	server, err := streamserver.New(
+		streamserver.WithAddress(address),
+		streamserver.WithIndexPage(index),
+		streamserver.WithSetting("hls_output_dir", hlsDir),
+		streamserver.WithSetting("hls_delete_old_segments", "false"),
+		streamserver.WithSetting("audit_log", filepath.Join(dir, "audit.log")),
+	)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "server:", err)
+		return 1
+	}
+	go func() {
+		if err := server.Run(); err != nil {
+			fmt.Fprintln(os.Stderr, "server:", err)
+			os.Exit(1)
+		}
+	}()
+	base = "http://" + address
+	if err := waitFor(10*time.Second, func() bool { return status(http.MethodGet, "/healthz") == http.StatusOK }); err != nil {
+		fmt.Fprintln(os.Stderr, "server not healthy:", err)
+		return 1
+	}
+	code := m.Run()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
+	return code
+}
+
+func freeAddress() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
+
+// waitFor polls done until it holds or timeout passes
+func waitFor(timeout time.Duration, done func() bool) error {
+	deadline := time.Now().Add(timeout)
+	for !done() {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("not done after %s", timeout)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return nil
+}
+
+// request sends a request of the admin to the server
+func request(method, path string) (*http.Response, error) {
+	req, err := http.NewRequest(method, base+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Admin-Identity", admin)
+	return http.DefaultClient.Do(req)
+}
+
+// status is the status of a request, 0 when it failed
+func status(method, path string) int {
+	resp, err := request(method, path)
+	if err != nil {
+		return 0
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// get reads path, failing on any status but 200
+func get(path string) ([]byte, error) {
+	resp, err := request(http.MethodGet, path)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// publish publishes a test pattern of key, closed when the test ends
+func publish(t *testing.T, key string) *publisher.Publication {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	p, err := publisher.Publish(ctx, publisher.Options{
+		URL:    strings.Replace(base, "http", "ws", 1) + "/channel",
+		Offer:  client.Offer{StreamID: key},
+		Source: publisher.Source{Width: 640, Height: 360, Framerate: 25, Bitrate: 800},
+	})
+	if err != nil {
+		t.Fatalf("publish %s: %v", key, err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), client.DefaultTimeout)
+		defer cancel()
+		p.Close(ctx)
+	})
+	return p
+}
+
+// waitLive polls the playlist of the publication until it lists
+// liveSegments, each revision checked against the one before, e.g. for
+// its media sequence to only move forward
+func waitLive(t *testing.T, p *publisher.Publication) *hlscheck.Media {
+	t.Helper()
+	gate := &hlscheck.Gate{Strict: true}
+	var media *hlscheck.Media
+	err := waitFor(liveTimeout, func() bool {
+		data, err := get(p.Answer.Session.Playlist)
+		if err != nil {
+			return false
+		}
+		if _, _, err := gate.Revision(data); err != nil {
+			t.Fatalf("playlist revision: %v\n%s", err, data)
+		}
+		media, _ = hlscheck.ParseMedia(data)
+		return len(media.Segments) >= liveSegments
+	})
+	if err != nil {
+		t.Fatalf("playlist %s: %v", p.Answer.Session.Playlist, err)
+	}
+	return media
+}
+
+// segmentPath is the path on the server of a segment of the playlist
+func segmentPath(playlist, uri string) string {
+	return playlist[:strings.LastIndex(playlist, "/")+1] + uri
+}
+
+func TestPublishToHLS(t *testing.T) {
+	const key = "e2e"
+	p := publish(t, key)
+	session := p.Answer.Session
+	if session == nil || session.Stream != key || session.Playlist == "" {
+		t.Fatalf("answered session %+v", session)
+	}
+	if !strings.Contains(strings.Join(session.Codecs, " "), "video/h264") {
+		t.Fatalf("answered codecs %v", session.Codecs)
+	}
+
+	media := waitLive(t, p)
+	if media.Ended {
+		t.Fatal("live playlist ended")
+	}
+	for i, segment := range media.Segments {
+		if segment.Duration <= 0 || segment.Duration > float64(media.TargetDuration)+0.5 {
+			t.Fatalf("segment %s lasts %.3fs, target %ds", segment.URI, segment.Duration, media.TargetDuration)
+		}
+		data, err := get(segmentPath(session.Playlist, segment.URI))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 {
+			continue
+		}
+		nal, err := hlscheck.FindSPS(data)
+		if err != nil {
+			t.Fatalf("first segment: %v", err)
+		}
+		sps, err := hlscheck.ParseSPS(nal)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sps.Width != 640 || sps.Height != 360 || !strings.HasPrefix(sps.CodecString(), "avc1.") {
+			t.Fatalf("first segment is %s %dx%d", sps.CodecString(), sps.Width, sps.Height)
+		}
+	}
+
+	// a second publisher of the key is refused, the first one going on
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if second, err := publisher.Publish(ctx, publisher.Options{
+		URL:    strings.Replace(base, "http", "ws", 1) + "/channel",
+		Offer:  client.Offer{StreamID: key},
+		Source: publisher.Source{Width: 640, Height: 360},
+	}); err == nil {
+		second.Close(ctx)
+		t.Fatal("second publisher of the key accepted")
+	}
+	select {
+	case <-p.Done():
+		t.Fatalf("publish ended by a second publisher: %v", p.Err())
+	default:
+	}
+
+	// closing the publisher ends the playlist and the session
+	if err := p.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	err := waitFor(endTimeout, func() bool {
+		data, err := get(session.Playlist)
+		if err != nil {
+			return false
+		}
+		media, err := hlscheck.ParseMedia(data)
+		return err == nil && media.Ended
+	})
+	if err != nil {
+		t.Fatalf("playlist not ended: %v", err)
+	}
+	if code := status(http.MethodGet, "/api/v1/streams/"+key); code != http.StatusNotFound {
+		t.Fatalf("ended stream is %d", code)
+	}
+
+	// every segment decodes, in sequence, as ffprobe sees it
+	result := conformance.FFProbe().Check(ctx, conformance.Target{
+		Config:    "e2e",
+		Dir:       filepath.Join(hlsDir, key),
+		Playlist:  filepath.Base(session.Playlist),
+		Container: "ts",
+	})
+	if result.Status == conformance.Skip {
+		t.Log("segments not probed:", result.Reason)
+	}
+	for _, f := range result.Findings {
+		t.Errorf("ffprobe %s %s: %s", f.Tag, f.URI, f.Message)
+	}
+}
+
+func TestKickedPublisher(t *testing.T) {
+	const key = "e2e-kicked"
+	p := publish(t, key)
+	waitLive(t, p)
+	if code := status(http.MethodDelete, "/api/v1/streams/"+key); code != http.StatusNoContent {
+		t.Fatalf("kick: %d", code)
+	}
+	select {
+	case <-p.Done():
+	case <-time.After(endTimeout):
+		t.Fatal("kicked publisher still connected")
+	}
+	if !client.IsCloseCode(p.Err(), client.CloseKicked) {
+		t.Fatalf("kicked publisher ended with %v", p.Err())
+	}
+	if err := waitFor(endTimeout, func() bool { return status(http.MethodGet, "/api/v1/streams/"+key) == http.StatusNotFound }); err != nil {
+		t.Fatalf("kicked stream still live: %v", err)
+	}
+}
@@ -0,0 +1,382 @@
+// Package jobs runs background work on one bounded queue shared by every
+// kind of job. Each class of job has its own concurrency limit and retry
+// policy: a failed attempt is retried after an exponential backoff with
+// jitter, and a job out of attempts is kept as a dead letter until it is
+// requeued or pushed out by newer ones. The queue never holds more than its
+// depth, so an outage of whatever the jobs talk to costs rejected submits,
+// not memory.
+package jobs
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrFull is returned when the queue, or the class, is at its depth
+	ErrFull = errors.New("jobs: queue full")
+	// ErrUnknownClass is returned for a class that was never registered
+	ErrUnknownClass = errors.New("jobs: unknown class")
+	// ErrNotFound is returned when requeueing an unknown dead letter
+	ErrNotFound = errors.New("jobs: no such dead letter")
+	// ErrClosed is returned once the queue is closed
+	ErrClosed = errors.New("jobs: queue closed")
+)
+
+// Outcomes reported to Queue.Observe
+const (
+	Succeeded = "succeeded"
+	Failed    = "failed"
+	Dead      = "dead"
+	Rejected  = "rejected"
+)
+
+// Class is the policy of one kind of job
+type Class struct {
+	Name string
+	// Concurrency is how many jobs of the class run at once, at least 1
+	Concurrency int
+	// Depth bounds the queued and running jobs of the class, so one class
+	// cannot fill the whole queue; 0 leaves only the queue's bound
+	Depth int
+	// MaxAttempts is how often a job runs before it is dead, at least 1
+	MaxAttempts int
+	// Backoff is the delay before the first retry, doubled for every
+	// further one up to MaxBackoff; defaults to 1s and 1m
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Timeout bounds one attempt, unbounded when 0
+	Timeout time.Duration
+}
+
+// delay is the wait before attempt (2 or more): half the backoff plus a
+// random part of the other half, so retries of jobs that failed together
+// spread out
+func (c Class) delay(attempt int) time.Duration {
+	d := c.Backoff
+	for i := 2; i < attempt && d < c.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > c.MaxBackoff {
+		d = c.MaxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Func is the work of a job. Its context is cancelled when the attempt
+// times out or the queue is closed.
+type Func func(ctx context.Context) error
+
+// Info describes a queued, running or dead job
+type Info struct {
+	ID       string    `json:"id"`
+	Class    string    `json:"class"`
+	Name     string    `json:"name"`
+	Attempts int       `json:"attempts"`
+	Enqueued time.Time `json:"enqueued"`
+	Next     time.Time `json:"next,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type job struct {
+	Info
+	run Func
+}
+
+// Stats is the state of one class
+type Stats struct {
+	// Depth counts the queued and running jobs
+	Depth   int `json:"depth"`
+	Running int `json:"running"`
+	// Oldest is how long the longest waiting job has been queued
+	Oldest time.Duration `json:"oldest"`
+	// Dead counts the dead letters currently kept
+	Dead int `json:"dead"`
+}
+
+type class struct {
+	Class
+	running int
+	depth   int
+}
+
+// Queue is a bounded job queue
+type Queue struct {
+	// Observe, when set before the first Submit, is called with the
+	// outcome of every attempt and rejected submit
+	Observe func(job Info, outcome string)
+
+	depth       int
+	deadLetters int
+
+	mu      sync.Mutex
+	classes map[string]*class
+	pending []*job
+	dead    []*job
+	total   int
+	seq     uint64
+	closed  bool
+
+	wake   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// New starts a queue holding at most depth jobs, queued and running, and
+// keeping the latest deadLetters dead jobs
+func New(depth, deadLetters int) *Queue {
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &Queue{
+		depth:       depth,
+		deadLetters: deadLetters,
+		classes:     map[string]*class{},
+		wake:        make(chan struct{}, 1),
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+	go q.loop()
+	return q
+}
+
+// Register adds or replaces the policy of a class
+func (q *Queue) Register(c Class) {
+	if c.Concurrency < 1 {
+		c.Concurrency = 1
+	}
+	if c.MaxAttempts < 1 {
+		c.MaxAttempts = 1
+	}
+	if c.Backoff <= 0 {
+		c.Backoff = time.Second
+	}
+	if c.MaxBackoff < c.Backoff {
+		c.MaxBackoff = time.Minute
+		if c.MaxBackoff < c.Backoff {
+			c.MaxBackoff = c.Backoff
+		}
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if existing, ok := q.classes[c.Name]; ok {
+		existing.Class = c
+		return
+	}
+	q.classes[c.Name] = &class{Class: c}
+}
+
+// Submit queues a job of class, returning its id. name describes the job in
+// listings.
+func (q *Queue) Submit(className, name string, run Func) (string, error) {
+	q.mu.Lock()
+	c, ok := q.classes[className]
+	if !ok {
+		q.mu.Unlock()
+		return "", ErrUnknownClass
+	}
+	q.seq++
+	j := &job{Info: Info{ID: strconv.FormatUint(q.seq, 10), Class: className, Name: name, Enqueued: time.Now()}, run: run}
+	if err := q.admit(c); err != nil {
+		q.mu.Unlock()
+		if err == ErrFull {
+			q.observe(j.Info, Rejected)
+		}
+		return "", err
+	}
+	q.pending = append(q.pending, j)
+	q.mu.Unlock()
+	q.poke()
+	return j.ID, nil
+}
+
+// admit takes room for a job of c; called with the lock held
+func (q *Queue) admit(c *class) error {
+	if q.closed {
+		return ErrClosed
+	}
+	if (q.depth > 0 && q.total >= q.depth) || (c.Depth > 0 && c.depth >= c.Depth) {
+		return ErrFull
+	}
+	q.total++
+	c.depth++
+	return nil
+}
+
+// Requeue moves a dead letter back to the queue with a fresh set of attempts
+func (q *Queue) Requeue(id string) (Info, error) {
+	q.mu.Lock()
+	for i, j := range q.dead {
+		if j.ID != id {
+			continue
+		}
+		c, ok := q.classes[j.Class]
+		if !ok {
+			q.mu.Unlock()
+			return Info{}, ErrUnknownClass
+		}
+		if err := q.admit(c); err != nil {
+			q.mu.Unlock()
+			return Info{}, err
+		}
+		q.dead = append(q.dead[:i], q.dead[i+1:]...)
+		j.Attempts, j.Next, j.Error, j.Enqueued = 0, time.Time{}, "", time.Now()
+		q.pending = append(q.pending, j)
+		info := j.Info
+		q.mu.Unlock()
+		q.poke()
+		return info, nil
+	}
+	q.mu.Unlock()
+	return Info{}, ErrNotFound
+}
+
+// Dead lists the dead letters, oldest first
+func (q *Queue) Dead() []Info {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	dead := make([]Info, 0, len(q.dead))
+	for _, j := range q.dead {
+		dead = append(dead, j.Info)
+	}
+	return dead
+}
+
+// Stats returns the state of every registered class
+func (q *Queue) Stats() map[string]Stats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	stats := map[string]Stats{}
+	for name, c := range q.classes {
+		stats[name] = Stats{Depth: c.depth, Running: c.running}
+	}
+	for _, j := range q.pending {
+		s := stats[j.Class]
+		if age := now.Sub(j.Enqueued); age > s.Oldest {
+			s.Oldest = age
+		}
+		stats[j.Class] = s
+	}
+	for _, j := range q.dead {
+		s := stats[j.Class]
+		s.Dead++
+		stats[j.Class] = s
+	}
+	return stats
+}
+
+// Close stops starting jobs and cancels the running ones, which become dead
+// letters if they fail. Queued jobs are dropped.
+func (q *Queue) Close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.cancel()
+}
+
+func (q *Queue) observe(info Info, outcome string) {
+	if q.Observe != nil {
+		q.Observe(info, outcome)
+	}
+}
+
+func (q *Queue) poke() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *Queue) loop() {
+	for {
+		timer := time.NewTimer(q.dispatch())
+		select {
+		case <-q.wake:
+		case <-timer.C:
+		case <-q.ctx.Done():
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+// dispatch starts every due job whose class has a free slot, in submit
+// order, and returns how long until the next retry is due
+func (q *Queue) dispatch() time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	next := time.Hour
+	if q.closed {
+		return next
+	}
+	now := time.Now()
+	waiting := q.pending[:0]
+	for _, j := range q.pending {
+		c := q.classes[j.Class]
+		if wait := j.Next.Sub(now); wait > 0 {
+			if wait < next {
+				next = wait
+			}
+			waiting = append(waiting, j)
+			continue
+		}
+		if c.running >= c.Concurrency {
+			waiting = append(waiting, j)
+			continue
+		}
+		c.running++
+		j.Attempts++
+		go q.run(j, c.Class)
+	}
+	for i := len(waiting); i < len(q.pending); i++ {
+		q.pending[i] = nil
+	}
+	q.pending = waiting
+	return next
+}
+
+// run makes one attempt at j and settles its outcome
+func (q *Queue) run(j *job, policy Class) {
+	ctx, cancel := q.ctx, context.CancelFunc(func() {})
+	if policy.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, policy.Timeout)
+	}
+	err := j.run(ctx)
+	cancel()
+
+	q.mu.Lock()
+	c := q.classes[j.Class]
+	c.running--
+	outcome := Succeeded
+	switch {
+	case err == nil:
+		q.release(c)
+	case j.Attempts >= policy.MaxAttempts || q.closed:
+		outcome = Dead
+		q.release(c)
+		j.Error, j.Next = err.Error(), time.Time{}
+		q.dead = append(q.dead, j)
+		if over := len(q.dead) - q.deadLetters; q.deadLetters >= 0 && over > 0 {
+			q.dead = append(q.dead[:0:0], q.dead[over:]...)
+		}
+	default:
+		outcome = Failed
+		j.Error = err.Error()
+		j.Next = time.Now().Add(policy.delay(j.Attempts + 1))
+		q.pending = append(q.pending, j)
+	}
+	info := j.Info
+	q.mu.Unlock()
+	q.observe(info, outcome)
+	q.poke()
+}
+
+// release gives back the room of a finished job; called with the lock held
+func (q *Queue) release(c *class) {
+	q.total--
+	c.depth--
+}
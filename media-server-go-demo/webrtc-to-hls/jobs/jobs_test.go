@@ -0,0 +1,167 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDelay(t *testing.T) {
+	c := Class{Backoff: 100 * time.Millisecond, MaxBackoff: 300 * time.Millisecond}
+	for attempt, max := range map[int]time.Duration{2: 100, 3: 200, 4: 300, 9: 300} {
+		max *= time.Millisecond
+		for i := 0; i < 50; i++ {
+			if d := c.delay(attempt); d < max/2 || d > max {
+				t.Fatalf("delay(%d) = %v, want within [%v, %v]", attempt, d, max/2, max)
+			}
+		}
+	}
+}
+
+// waitFor polls cond for up to a few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// TestOutage simulates the remote end being down: the queue saturates at its
+// depth instead of growing, every accepted job is delivered once the outage
+// ends, and jobs that ran out of attempts are delivered when requeued
+func TestOutage(t *testing.T) {
+	q := New(10, 4)
+	defer q.Close()
+	var mu sync.Mutex
+	outcomes := map[string]int{}
+	q.Observe = func(job Info, outcome string) {
+		mu.Lock()
+		outcomes[outcome]++
+		mu.Unlock()
+	}
+	q.Register(Class{Name: "hook", Concurrency: 2, MaxAttempts: 1000, Backoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond})
+	q.Register(Class{Name: "upload", MaxAttempts: 2, Backoff: time.Millisecond})
+
+	var down int32 = 1
+	var delivered int32
+	var running, maxRunning int32
+	deliver := func(ctx context.Context) error {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		if atomic.LoadInt32(&down) == 1 {
+			return errors.New("connection refused")
+		}
+		atomic.AddInt32(&delivered, 1)
+		return nil
+	}
+
+	if _, err := q.Submit("upload", "segment", deliver); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "dead letter", func() bool { return len(q.Dead()) == 1 })
+	dead := q.Dead()[0]
+	if dead.Attempts != 2 || dead.Error != "connection refused" {
+		t.Fatalf("dead letter = %+v", dead)
+	}
+
+	accepted, rejected := 0, 0
+	for i := 0; i < 100; i++ {
+		if _, err := q.Submit("hook", "event", deliver); err == ErrFull {
+			rejected++
+		} else if err != nil {
+			t.Fatal(err)
+		} else {
+			accepted++
+		}
+		if depth := q.Stats()["hook"].Depth; depth > 10 {
+			t.Fatalf("depth %d over the bound", depth)
+		}
+	}
+	if accepted != 10 || rejected != 90 {
+		t.Fatalf("accepted %d, rejected %d", accepted, rejected)
+	}
+	if _, err := q.Requeue(dead.ID); err != ErrFull {
+		t.Fatalf("requeue into a full queue = %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if s := q.Stats()["hook"]; s.Depth != 10 || s.Oldest <= 0 {
+		t.Fatalf("during the outage: %+v", s)
+	}
+
+	atomic.StoreInt32(&down, 0)
+	waitFor(t, "delivery", func() bool { return atomic.LoadInt32(&delivered) == 10 })
+	waitFor(t, "an empty queue", func() bool { return q.Stats()["hook"].Depth == 0 })
+	if _, err := q.Requeue(dead.ID); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "requeued delivery", func() bool { return atomic.LoadInt32(&delivered) == 11 })
+	if len(q.Dead()) != 0 {
+		t.Fatalf("dead letters = %+v", q.Dead())
+	}
+	if _, err := q.Requeue(dead.ID); err != ErrNotFound {
+		t.Fatalf("second requeue = %v", err)
+	}
+	if max := atomic.LoadInt32(&maxRunning); max > 2 {
+		t.Fatalf("%d jobs ran at once", max)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if outcomes[Succeeded] != 11 || outcomes[Rejected] != 90 || outcomes[Dead] != 1 || outcomes[Failed] < 10 {
+		t.Fatalf("outcomes = %v", outcomes)
+	}
+}
+
+func TestBounds(t *testing.T) {
+	q := New(0, 2)
+	defer q.Close()
+	if _, err := q.Submit("nope", "", nil); err != ErrUnknownClass {
+		t.Fatalf("unknown class = %v", err)
+	}
+
+	block := make(chan struct{})
+	q.Register(Class{Name: "slow", Depth: 1})
+	if _, err := q.Submit("slow", "", func(ctx context.Context) error { <-block; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Submit("slow", "", nil); err != ErrFull {
+		t.Fatalf("over the class depth = %v", err)
+	}
+	close(block)
+
+	// only the latest dead letters are kept
+	q.Register(Class{Name: "broken"})
+	for i := 0; i < 3; i++ {
+		q.Submit("broken", "", func(ctx context.Context) error { return errors.New("broken") })
+	}
+	waitFor(t, "dead letters", func() bool { return q.Stats()["broken"].Depth == 0 })
+	if dead := q.Dead(); len(dead) != 2 || dead[0].ID == "3" {
+		t.Fatalf("dead letters = %+v", dead)
+	}
+
+	// attempts past their timeout are cancelled
+	q.Register(Class{Name: "timed", Timeout: 10 * time.Millisecond})
+	q.Submit("timed", "", func(ctx context.Context) error { <-ctx.Done(); return ctx.Err() })
+	waitFor(t, "timeout", func() bool {
+		dead := q.Dead()
+		return dead[len(dead)-1].Class == "timed"
+	})
+
+	q.Close()
+	if _, err := q.Submit("slow", "", nil); err != ErrClosed {
+		t.Fatalf("after close = %v", err)
+	}
+}
@@ -0,0 +1,338 @@
+// Package llhls packages an H.264 stream as Low-Latency HLS: segments are
+// published part by part as they are produced, and playlist requests can
+// block until the part they ask for exists (RFC 8216bis 6.2.5.2), so players
+// run a few parts behind the publisher instead of a few segments.
+package llhls
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/playlist"
+)
+
+// ErrNoDateTime refuses a cue on a stream without PROGRAM-DATE-TIME, which
+// date ranges are placed on
+var ErrNoDateTime = errors.New("stream has no program date time")
+
+// ErrTooFar refuses a blocking request for a segment further ahead than the
+// next two, which a client in sync with the stream never asks for
+var ErrTooFar = errors.New("requested segment is too far ahead of the live edge")
+
+// Config is the packaging of a stream
+type Config struct {
+	// Dir is where the segment and part files are written
+	Dir string
+	// Prefix starts the file names: segments are <prefix><msn>.ts, their
+	// parts <prefix><msn>.<part>.ts
+	Prefix string
+	// SegmentTarget is the target duration of segments, which are cut on
+	// the first keyframe past it
+	SegmentTarget time.Duration
+	// PartTarget is the duration parts do not exceed
+	PartTarget time.Duration
+	// Window is the number of segments the playlist lists
+	Window int
+	// DeleteOld removes the files of segments that left the window
+	DeleteOld bool
+	// ProgramDateTime maps a presentation time to the wall clock, stamped
+	// as PROGRAM-DATE-TIME on each segment; none are without it
+	ProgramDateTime func(pts time.Duration) time.Time
+}
+
+// Packager cuts the frames of a stream into parts and segments and keeps
+// the playlist revision that lists them
+type Packager struct {
+	config Config
+
+	sync.Mutex
+	mux    *muxer
+	stream *playlist.Stream
+	// msn and part number the part being produced
+	msn, part int
+	started   bool
+	ended     bool
+	partBuf   bytes.Buffer
+	segBuf    bytes.Buffer
+	// presentation times of the part and segment being produced, and of
+	// the last frame
+	partStart, segStart, last time.Duration
+	// interval is the time between the last two frames
+	interval    time.Duration
+	independent bool
+	// written are the media sequence numbers of the segments on disk
+	written  []int
+	revision []byte
+	// changed is closed, and replaced, on every revision
+	changed chan struct{}
+}
+
+// New returns the packager of a stream starting with media sequence 0
+func New(config Config) *Packager {
+	p := &Packager{
+		config: config,
+		mux:    newMuxer(),
+		stream: &playlist.Stream{
+			Window:         config.Window,
+			TargetDuration: int((config.SegmentTarget + time.Second/2) / time.Second),
+			PartTarget:     config.PartTarget.Seconds(),
+		},
+		changed: make(chan struct{}),
+	}
+	p.publish()
+	return p
+}
+
+// SegmentURI is the file name of segment msn
+func (p *Packager) SegmentURI(msn int) string {
+	return fmt.Sprintf("%s%d.ts", p.config.Prefix, msn)
+}
+
+// PartURI is the file name of part n of segment msn
+func (p *Packager) PartURI(msn, n int) string {
+	return fmt.Sprintf("%s%d.%d.ts", p.config.Prefix, msn, n)
+}
+
+// WriteFrame packages an Annex B access unit presented at pts. Frames
+// before the first keyframe are dropped, a stream has to start decodable.
+func (p *Packager) WriteFrame(frame []byte, pts time.Duration, keyframe bool) error {
+	p.Lock()
+	defer p.Unlock()
+	if p.ended {
+		return nil
+	}
+	if !p.started {
+		if !keyframe {
+			return nil
+		}
+		p.started = true
+		p.segStart, p.partStart, p.last = pts, pts, pts
+	}
+	p.interval, p.last = pts-p.last, pts
+	switch {
+	case keyframe && pts-p.segStart >= p.config.SegmentTarget:
+		if err := p.finishPart(pts); err != nil {
+			return err
+		}
+		if err := p.finishSegment(pts); err != nil {
+			return err
+		}
+		p.stream.Hint(p.PartURI(p.msn, 0))
+		p.publish()
+	case p.partBuf.Len() > 0 && pts+p.interval-p.partStart > p.config.PartTarget:
+		// cut before the frame that would take the part past its target
+		if err := p.finishPart(pts); err != nil {
+			return err
+		}
+		p.publish()
+	}
+	if p.partBuf.Len() == 0 {
+		p.partStart = pts
+		p.independent = keyframe
+	}
+	return p.mux.writeFrame(&p.partBuf, frame, pts, keyframe)
+}
+
+// End finishes the segment being produced and gives the playlist its
+// ENDLIST
+func (p *Packager) End() error {
+	p.Lock()
+	defer p.Unlock()
+	if p.ended {
+		return nil
+	}
+	var err error
+	if p.started {
+		// the last frame lasts as long as the one before it did
+		end := p.last + p.interval
+		if p.interval <= 0 {
+			end += time.Second / 30
+		}
+		if err = p.finishPart(end); err == nil {
+			err = p.finishSegment(end)
+		}
+	}
+	p.ended = true
+	p.stream.End()
+	p.publish()
+	return err
+}
+
+// finishPart writes the part being produced, which ends at end, and lists
+// it with the next part as preload hint. The caller publishes the revision.
+func (p *Packager) finishPart(end time.Duration) error {
+	if p.partBuf.Len() == 0 {
+		return nil
+	}
+	uri := p.PartURI(p.msn, p.part)
+	if err := writeFile(filepath.Join(p.config.Dir, uri), p.partBuf.Bytes()); err != nil {
+		return err
+	}
+	p.segBuf.Write(p.partBuf.Bytes())
+	p.partBuf.Reset()
+	p.stream.AppendPart(playlist.Part{
+		URI:         uri,
+		Duration:    (end - p.partStart).Seconds(),
+		Independent: p.independent,
+	}, p.PartURI(p.msn, p.part+1))
+	p.part++
+	return nil
+}
+
+// finishSegment writes the segment made of the parts written since the
+// previous one; the next segment starts at end
+func (p *Packager) finishSegment(end time.Duration) error {
+	uri := p.SegmentURI(p.msn)
+	if err := writeFile(filepath.Join(p.config.Dir, uri), p.segBuf.Bytes()); err != nil {
+		return err
+	}
+	p.segBuf.Reset()
+	segment := playlist.Segment{URI: uri, Duration: (end - p.segStart).Seconds()}
+	if p.config.ProgramDateTime != nil {
+		segment.ProgramDateTime = p.config.ProgramDateTime(p.segStart)
+	}
+	p.stream.Append(segment)
+	p.written = append(p.written, p.msn)
+	p.removeOld()
+	p.msn++
+	p.part = 0
+	p.segStart = end
+	return nil
+}
+
+// removeOld deletes the segments that left the window, and their parts,
+// keeping one more for players still downloading it
+func (p *Packager) removeOld() {
+	if !p.config.DeleteOld || p.config.Window <= 0 {
+		return
+	}
+	for len(p.written) > p.config.Window+1 {
+		msn := p.written[0]
+		p.written = p.written[1:]
+		os.Remove(filepath.Join(p.config.Dir, p.SegmentURI(msn)))
+		parts, _ := filepath.Glob(filepath.Join(p.config.Dir, fmt.Sprintf("%s%d.*.ts", p.config.Prefix, msn)))
+		for _, part := range parts {
+			os.Remove(part)
+		}
+	}
+}
+
+// Cue lists a date range id starting at the presentation time pts and
+// lasting duration, zero when unknown, and returns its start date
+func (p *Packager) Cue(id string, pts, duration time.Duration) (time.Time, error) {
+	if p.config.ProgramDateTime == nil {
+		return time.Time{}, ErrNoDateTime
+	}
+	start := p.config.ProgramDateTime(pts)
+	p.Lock()
+	defer p.Unlock()
+	p.stream.AddDateRange(playlist.DateRange{ID: id, Start: start, Duration: duration.Seconds()})
+	p.publish()
+	return start, nil
+}
+
+// Buffered is the memory the packager holds: the part and segment being
+// produced and the playlist revision
+func (p *Packager) Buffered() int {
+	p.Lock()
+	defer p.Unlock()
+	return p.partBuf.Cap() + p.segBuf.Cap() + len(p.revision)
+}
+
+// SetWindow narrows the playlist to window segments, deleting those that
+// left it when DeleteOld is set; a wider window than the current one is
+// ignored
+func (p *Packager) SetWindow(window int) {
+	p.Lock()
+	defer p.Unlock()
+	if window <= 0 || (p.config.Window > 0 && window >= p.config.Window) {
+		return
+	}
+	p.config.Window = window
+	p.stream.Slide(window)
+	p.removeOld()
+	p.publish()
+}
+
+// publish renders the current revision and wakes the blocked requests
+func (p *Packager) publish() {
+	var buf bytes.Buffer
+	p.stream.Media().Write(&buf)
+	p.revision = buf.Bytes()
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// has reports whether the playlist lists part of segment msn, or the whole
+// segment when part is negative
+func (p *Packager) has(msn, part int) bool {
+	switch {
+	case p.ended || msn < p.msn:
+		return true
+	case msn > p.msn || part < 0:
+		return false
+	}
+	return part < p.part
+}
+
+// Playlist returns the first revision listing part of segment msn, waiting
+// for it until ctx is done. A negative msn asks for the current revision;
+// a negative part for the revision completing segment msn.
+func (p *Packager) Playlist(ctx context.Context, msn, part int) ([]byte, error) {
+	p.Lock()
+	defer p.Unlock()
+	if msn < 0 {
+		return p.revision, nil
+	}
+	if msn > p.msn+2 && !p.ended {
+		return nil, ErrTooFar
+	}
+	for !p.has(msn, part) {
+		changed := p.changed
+		p.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			p.Lock()
+			return nil, ctx.Err()
+		}
+		p.Lock()
+	}
+	return p.revision, nil
+}
+
+// WaitPart blocks until part n of segment msn is written, so a player
+// following the preload hint gets the part as soon as it exists
+func (p *Packager) WaitPart(ctx context.Context, msn, n int) error {
+	_, err := p.Playlist(ctx, msn, n)
+	return err
+}
+
+// ParsePart returns the segment and part number of a part file name
+func (p *Packager) ParsePart(name string) (msn, n int, ok bool) {
+	if !strings.HasPrefix(name, p.config.Prefix) {
+		return 0, 0, false
+	}
+	if count, _ := fmt.Sscanf(strings.TrimPrefix(name, p.config.Prefix), "%d.%d.ts", &msn, &n); count != 2 || name != p.PartURI(msn, n) {
+		return 0, 0, false
+	}
+	return msn, n, true
+}
+
+// writeFile writes data through a temporary file, so a part is never
+// served half written
+func writeFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
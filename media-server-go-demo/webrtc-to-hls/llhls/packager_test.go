@@ -0,0 +1,239 @@
+package llhls
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/hlscheck"
+)
+
+var (
+	idr   = []byte{0, 0, 0, 1, 0x65, 0x88, 0x84, 0x00}
+	slice = []byte{0, 0, 0, 1, 0x41, 0x9a, 0x20}
+)
+
+// feed writes frames at 30fps from frame from to frame to, a keyframe every
+// second
+func feed(t *testing.T, p *Packager, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		frame := slice
+		if i%30 == 0 {
+			frame = idr
+		}
+		if err := p.WriteFrame(frame, time.Duration(i)*time.Second/30, i%30 == 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func newTestPackager(t *testing.T) (*Packager, string) {
+	dir, err := ioutil.TempDir("", "llhls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(Config{
+		Dir:           dir,
+		Prefix:        "ll-",
+		SegmentTarget: time.Second,
+		PartTarget:    250 * time.Millisecond,
+		Window:        3,
+		DeleteOld:     true,
+	}), dir
+}
+
+func TestPackager(t *testing.T) {
+	p, dir := newTestPackager(t)
+	defer os.RemoveAll(dir)
+	var prev *hlscheck.Media
+	for second := 0; second < 5; second++ {
+		feed(t, p, second*30, (second+1)*30)
+		revision, _ := p.Playlist(context.Background(), -1, 0)
+		m, err := hlscheck.ParseMedia(revision)
+		if err == nil {
+			err = m.Check(prev)
+		}
+		if err != nil {
+			t.Fatalf("%v:\n%s", err, revision)
+		}
+		prev = m
+	}
+
+	revision, _ := p.Playlist(context.Background(), -1, 0)
+	text := string(revision)
+	for _, want := range []string{
+		"#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=0.750\n",
+		"#EXT-X-PART-INF:PART-TARGET=0.250\n",
+		"#EXT-X-MEDIA-SEQUENCE:1\n",
+		"#EXT-X-PART:DURATION=0.233,URI=\"ll-4.0.ts\",INDEPENDENT=YES\n",
+		"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"ll-4.4.ts\"\n",
+	} {
+		if !strings.Contains(text, want) {
+			t.Fatalf("no %q in\n%s", want, text)
+		}
+	}
+	if strings.Contains(text, "DURATION=0.26") {
+		t.Fatalf("part over the part target:\n%s", text)
+	}
+
+	// a segment is its parts back to back, each part whole TS packets
+	var parts []byte
+	for n := 0; n < 5; n++ {
+		part, err := ioutil.ReadFile(filepath.Join(dir, p.PartURI(3, n)))
+		if err != nil {
+			break
+		}
+		if len(part)%packetSize != 0 || part[0] != 0x47 {
+			t.Fatalf("part %d is not MPEG-TS", n)
+		}
+		parts = append(parts, part...)
+	}
+	segment, err := ioutil.ReadFile(filepath.Join(dir, p.SegmentURI(3)))
+	if err != nil || !bytes.Equal(segment, parts) {
+		t.Fatalf("segment 3 is not its parts: %v", err)
+	}
+
+	if err := p.End(); err != nil {
+		t.Fatal(err)
+	}
+	// one segment past the window is kept for players still downloading it
+	if _, err := os.Stat(filepath.Join(dir, p.SegmentURI(0))); !os.IsNotExist(err) {
+		t.Fatal("segment out of the window kept")
+	}
+	if _, err := os.Stat(filepath.Join(dir, p.SegmentURI(1))); err != nil {
+		t.Fatal(err)
+	}
+	revision, _ = p.Playlist(context.Background(), 9, 0)
+	if !bytes.HasSuffix(revision, []byte("ll-4.ts\n#EXT-X-ENDLIST\n")) || bytes.Contains(revision, []byte("PRELOAD-HINT")) {
+		t.Fatalf("final revision:\n%s", revision)
+	}
+}
+
+func TestBlockingReload(t *testing.T) {
+	p, dir := newTestPackager(t)
+	defer os.RemoveAll(dir)
+	feed(t, p, 0, 10)
+
+	if _, err := p.Playlist(context.Background(), 3, 0); err != ErrTooFar {
+		t.Fatalf("request three segments ahead = %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := p.Playlist(ctx, 0, 2); err != context.DeadlineExceeded {
+		t.Fatalf("unproduced part answered: %v", err)
+	}
+
+	got := make(chan []byte)
+	go func() {
+		revision, _ := p.Playlist(context.Background(), 1, -1)
+		got <- revision
+	}()
+	feed(t, p, 10, 30)
+	select {
+	case revision := <-got:
+		t.Fatalf("segment 1 answered before it was complete:\n%s", revision)
+	case <-time.After(20 * time.Millisecond):
+	}
+	feed(t, p, 30, 61)
+	if revision := <-got; !bytes.Contains(revision, []byte("ll-1.ts\n")) {
+		t.Fatalf("revision without segment 1:\n%s", revision)
+	}
+	feed(t, p, 61, 70)
+	if err := p.WaitPart(context.Background(), 2, 0); err != nil {
+		t.Fatal(err)
+	}
+	if msn, n, ok := p.ParsePart("ll-2.0.ts"); !ok || msn != 2 || n != 0 {
+		t.Fatalf("parsed part %d.%d, %v", msn, n, ok)
+	}
+	if _, _, ok := p.ParsePart("ll-2.ts"); ok {
+		t.Fatal("segment parsed as a part")
+	}
+}
+
+func TestSetWindow(t *testing.T) {
+	p, dir := newTestPackager(t)
+	defer os.RemoveAll(dir)
+	feed(t, p, 0, 151)
+	before := p.Buffered()
+	if before < len(idr) {
+		t.Fatalf("buffered %d", before)
+	}
+	p.SetWindow(5)
+	p.SetWindow(1)
+	revision, _ := p.Playlist(context.Background(), -1, 0)
+	m, err := hlscheck.ParseMedia(revision)
+	if err != nil || len(m.Segments) != 1 || m.MediaSequence != 4 {
+		t.Fatalf("narrowed playlist %v:\n%s", err, revision)
+	}
+	if p.Buffered() >= before {
+		t.Fatalf("buffered %d, %d before narrowing", p.Buffered(), before)
+	}
+	if _, err := os.Stat(filepath.Join(dir, p.SegmentURI(2))); !os.IsNotExist(err) {
+		t.Fatal("segment out of the narrowed window kept")
+	}
+}
+
+func TestPSI(t *testing.T) {
+	// as written by ffmpeg for the same program
+	want := []byte{0x00, 0xb0, 0x0d, 0x00, 0x01, 0xc1, 0x00, 0x00, 0x00, 0x01, 0xf0, 0x00, 0x2a, 0xb1, 0x04, 0xb2}
+	if pat := patSection(); !bytes.Equal(pat, want) {
+		t.Fatalf("PAT = % x", pat)
+	}
+	var buf bytes.Buffer
+	m := newMuxer()
+	big := append(append([]byte{}, idr...), make([]byte, 1000)...)
+	if err := m.writeFrame(&buf, big, time.Second, true); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if len(data)%packetSize != 0 {
+		t.Fatalf("%d bytes, not whole packets", len(data))
+	}
+	for i := 0; i < len(data); i += packetSize {
+		if data[i] != 0x47 {
+			t.Fatalf("packet %d has no sync byte", i/packetSize)
+		}
+	}
+	// PAT, PMT, then the PES starting with the random access flag and PCR
+	video := data[2*packetSize:]
+	if video[1]&0x40 == 0 || video[3]&0x30 != 0x30 || video[5] != 0x50 {
+		t.Fatalf("first video packet % x", video[:12])
+	}
+}
+
+func TestProgramDateTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "llhls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	p := New(Config{Dir: dir, Prefix: "ll-", SegmentTarget: time.Second, PartTarget: 250 * time.Millisecond, Window: 3})
+	if _, err := p.Cue("break", time.Second, 0); err != ErrNoDateTime {
+		t.Fatalf("cue without program date time: %v", err)
+	}
+	p = New(Config{Dir: dir, Prefix: "ll-", SegmentTarget: time.Second, PartTarget: 250 * time.Millisecond, Window: 3, ProgramDateTime: start.Add})
+	feed(t, p, 0, 61)
+	date, err := p.Cue("break", 1500*time.Millisecond, 2*time.Second)
+	if err != nil || !date.Equal(start.Add(1500*time.Millisecond)) {
+		t.Fatalf("cue at %v, %v", date, err)
+	}
+	revision, _ := p.Playlist(context.Background(), -1, 0)
+	if _, err := hlscheck.ParseMedia(revision); err != nil {
+		t.Fatalf("%v:\n%s", err, revision)
+	}
+	for _, want := range []string{
+		"#EXT-X-PROGRAM-DATE-TIME:2026-03-01T12:00:01.000Z\n",
+		`#EXT-X-DATERANGE:ID="break",START-DATE="2026-03-01T12:00:01.500Z",DURATION=2.000` + "\n",
+	} {
+		if !strings.Contains(string(revision), want) {
+			t.Fatalf("no %q in:\n%s", want, revision)
+		}
+	}
+}
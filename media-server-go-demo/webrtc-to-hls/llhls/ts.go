@@ -0,0 +1,210 @@
+package llhls
+
+import (
+	"io"
+	"time"
+)
+
+// MPEG-TS layout of the output: one program with one H.264 stream
+const (
+	packetSize = 188
+	patPID     = 0x0000
+	pmtPID     = 0x1000
+	videoPID   = 0x0100
+
+	streamTypeH264 = 0x1b
+	// ptsOffset is how far PTS runs ahead of the PCR, the decoder buffer
+	// players expect to be able to fill
+	ptsOffset = 700 * time.Millisecond
+)
+
+// accessUnitDelimiter starts every access unit, as Apple's HLS
+// authoring specification asks of H.264 in TS
+var accessUnitDelimiter = []byte{0, 0, 0, 1, 0x09, 0xf0}
+
+// muxer writes H.264 access units as an MPEG-TS byte stream. PAT and PMT are
+// repeated before every keyframe, so each part starting with one can be
+// decoded on its own.
+type muxer struct {
+	continuity map[uint16]byte
+}
+
+func newMuxer() *muxer {
+	return &muxer{continuity: make(map[uint16]byte)}
+}
+
+// writeFrame writes an Annex B access unit presented at pts
+func (m *muxer) writeFrame(w io.Writer, frame []byte, pts time.Duration, keyframe bool) error {
+	if keyframe {
+		if err := m.writeSection(w, patPID, patSection()); err != nil {
+			return err
+		}
+		if err := m.writeSection(w, pmtPID, pmtSection()); err != nil {
+			return err
+		}
+	}
+	clock := ticks(pts)
+	pes := pesHeader(clock + ticks(ptsOffset))
+	pes = append(pes, accessUnitDelimiter...)
+	pes = append(pes, frame...)
+	return m.writePES(w, pes, clock, keyframe)
+}
+
+func (m *muxer) next(pid uint16) byte {
+	cc := m.continuity[pid]
+	m.continuity[pid] = (cc + 1) & 0x0f
+	return cc
+}
+
+// writeSection writes a PSI section in a packet of its own
+func (m *muxer) writeSection(w io.Writer, pid uint16, section []byte) error {
+	packet := make([]byte, packetSize)
+	packet[0] = 0x47
+	packet[1] = 0x40 | byte(pid>>8) // payload unit start
+	packet[2] = byte(pid)
+	packet[3] = 0x10 | m.next(pid)
+	packet[4] = 0 // pointer field
+	n := 5 + copy(packet[5:], section)
+	for i := n; i < packetSize; i++ {
+		packet[i] = 0xff
+	}
+	_, err := w.Write(packet)
+	return err
+}
+
+// writePES splits a PES packet into TS packets. The first one carries the
+// PCR, and the random access flag on keyframes; the last one is padded by
+// adaptation field stuffing.
+func (m *muxer) writePES(w io.Writer, pes []byte, pcr uint64, keyframe bool) error {
+	for first := true; len(pes) > 0; first = false {
+		var adaptation []byte
+		if first {
+			flags := byte(0x10) // PCR
+			if keyframe {
+				flags |= 0x40
+			}
+			adaptation = append([]byte{flags}, pcrField(pcr)...)
+		}
+		space := packetSize - 4
+		if adaptation != nil {
+			space -= 1 + len(adaptation)
+		}
+		if stuffing := space - len(pes); stuffing > 0 {
+			switch {
+			case adaptation != nil:
+				adaptation = append(adaptation, padding(stuffing)...)
+			case stuffing == 1:
+				// an adaptation field of length zero
+				adaptation = []byte{}
+			default:
+				adaptation = append([]byte{0x00}, padding(stuffing-2)...)
+			}
+			space -= stuffing
+		}
+
+		packet := make([]byte, 0, packetSize)
+		start := byte(0)
+		if first {
+			start = 0x40
+		}
+		control := byte(0x10)
+		if adaptation != nil {
+			control = 0x30
+		}
+		packet = append(packet, 0x47, start|byte(videoPID>>8), byte(videoPID&0xff), control|m.next(videoPID))
+		if adaptation != nil {
+			packet = append(packet, byte(len(adaptation)))
+			packet = append(packet, adaptation...)
+		}
+		packet = append(packet, pes[:space]...)
+		pes = pes[space:]
+		if _, err := w.Write(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func padding(n int) []byte {
+	p := make([]byte, n)
+	for i := range p {
+		p[i] = 0xff
+	}
+	return p
+}
+
+// ticks converts d to the 90kHz clock of PTS and PCR
+func ticks(d time.Duration) uint64 {
+	return uint64(d * 90000 / time.Second)
+}
+
+// pesHeader starts a video PES packet of unbounded length with a PTS
+func pesHeader(pts uint64) []byte {
+	return []byte{
+		0, 0, 1, 0xe0, 0, 0,
+		0x84, // data aligned
+		0x80, // PTS only
+		5,
+		0x21 | byte(pts>>29)&0x0e,
+		byte(pts >> 22),
+		byte(pts>>14) | 1,
+		byte(pts >> 7),
+		byte(pts<<1) | 1,
+	}
+}
+
+// pcrField encodes a PCR base, with a zero extension
+func pcrField(base uint64) []byte {
+	return []byte{
+		byte(base >> 25),
+		byte(base >> 17),
+		byte(base >> 9),
+		byte(base >> 1),
+		byte(base<<7) | 0x7e,
+		0,
+	}
+}
+
+// patSection maps program 1 to the PMT
+func patSection() []byte {
+	return withCRC([]byte{
+		0x00, 0xb0, 0x0d, // table id, section length 13
+		0x00, 0x01, // transport stream id
+		0xc1, 0x00, 0x00, // version 0, current, section 0 of 0
+		0x00, 0x01, 0xe0 | byte(pmtPID>>8), byte(pmtPID & 0xff),
+	})
+}
+
+// pmtSection lists the video stream, which carries the PCR
+func pmtSection() []byte {
+	return withCRC([]byte{
+		0x02, 0xb0, 0x12, // table id, section length 18
+		0x00, 0x01, // program number
+		0xc1, 0x00, 0x00,
+		0xe0 | byte(videoPID>>8), byte(videoPID & 0xff), // PCR PID
+		0xf0, 0x00, // no program info
+		streamTypeH264, 0xe0 | byte(videoPID>>8), byte(videoPID & 0xff), 0xf0, 0x00,
+	})
+}
+
+func withCRC(section []byte) []byte {
+	crc := crc32MPEG(section)
+	return append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+}
+
+// crc32MPEG is the CRC of PSI sections: polynomial 0x04c11db7, not
+// reflected, unlike hash/crc32
+func crc32MPEG(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,239 @@
+// Package loudness measures the loudness of audio as EBU R 128 does, after
+// ITU-R BS.1770: the samples are K-weighted, their mean square taken over
+// blocks of 400 ms every 100 ms, and the loudness of the blocks given in
+// LUFS. Momentary loudness is that of the last block, short-term that of the
+// last 3 s, and integrated that of the whole audio measured, gated: blocks
+// under -70 LUFS, then those 10 LU under the loudness of the others, do
+// not count.
+package loudness
+
+import (
+	"encoding/binary"
+	"math"
+	"sync"
+)
+
+// Silence is the loudness of audio without any block over the absolute
+// gate, or of too little audio to tell
+var Silence = math.Inf(-1)
+
+const (
+	// absoluteGate is where blocks stop counting towards the integrated
+	// loudness, in LUFS
+	absoluteGate = -70
+	// relativeGate is how far under the loudness of the blocks over the
+	// absolute gate the others stop counting, in LU
+	relativeGate = -10
+	// momentaryBlocks and shortTermBlocks are the windows of the momentary
+	// and the short-term loudness, in 100 ms steps
+	momentaryBlocks = 4
+	shortTermBlocks = 30
+	// histogram bins span absoluteGate to histogramTop, binsPerLU to a LU,
+	// to keep the gated blocks of hours of audio in bounded memory
+	histogramTop = 10
+	binsPerLU    = 10
+)
+
+// biquad is a second-order filter, in direct form I
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+	x1, x2, y1, y2     float64
+}
+
+func (f *biquad) filter(x float64) float64 {
+	y := f.b0*x + f.b1*f.x1 + f.b2*f.x2 - f.a1*f.y1 - f.a2*f.y2
+	f.x2, f.x1 = f.x1, x
+	f.y2, f.y1 = f.y1, y
+	return y
+}
+
+// kWeighting is the K-weighting of BS.1770 at rate: a high shelf modelling
+// the head, then a high-pass filter, their coefficients derived for rate
+// as libebur128 does
+func kWeighting(rate int) [2]biquad {
+	fs := float64(rate)
+
+	f0, gain, q := 1681.974450955533, 3.999843853973347, 0.7071752369554196
+	k := math.Tan(math.Pi * f0 / fs)
+	vh := math.Pow(10, gain/20)
+	vb := math.Pow(vh, 0.4996667741545416)
+	a0 := 1 + k/q + k*k
+	shelf := biquad{
+		b0: (vh + vb*k/q + k*k) / a0,
+		b1: 2 * (k*k - vh) / a0,
+		b2: (vh - vb*k/q + k*k) / a0,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+
+	f0, q = 38.13547087602444, 0.5003270373238773
+	k = math.Tan(math.Pi * f0 / fs)
+	a0 = 1 + k/q + k*k
+	highPass := biquad{
+		b0: 1,
+		b1: -2,
+		b2: 1,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+	return [2]biquad{shelf, highPass}
+}
+
+// Meter measures the loudness of interleaved audio. It is safe for
+// concurrent use: audio written by one goroutine, loudness read by others.
+type Meter struct {
+	lock     sync.Mutex
+	channels int
+	// step is the samples of a channel in 100 ms
+	step    int
+	filters [][2]biquad
+	// sum is the energy of the step being measured, of n samples
+	sum float64
+	n   int
+	// steps are the mean energies of the last shortTermBlocks steps, a
+	// ring written at next, full once filled
+	steps  [shortTermBlocks]float64
+	next   int
+	filled int
+	// the gated blocks, by loudness: their count and their summed energy
+	counts   []int
+	energies []float64
+}
+
+// NewMeter measures audio of channels channels at rate samples per second
+func NewMeter(rate, channels int) *Meter {
+	m := &Meter{
+		channels: channels,
+		step:     rate / 10,
+		filters:  make([][2]biquad, channels),
+		counts:   make([]int, (histogramTop-absoluteGate)*binsPerLU),
+		energies: make([]float64, (histogramTop-absoluteGate)*binsPerLU),
+	}
+	for c := range m.filters {
+		m.filters[c] = kWeighting(rate)
+	}
+	return m
+}
+
+// Write measures interleaved samples, at full scale at ±1; the samples of
+// the last frame may be partial
+func (m *Meter) Write(samples []float64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for i := 0; i+m.channels <= len(samples); i += m.channels {
+		for c := 0; c < m.channels; c++ {
+			filters := &m.filters[c]
+			y := filters[1].filter(filters[0].filter(samples[i+c]))
+			// the front channels all weigh 1
+			m.sum += y * y
+		}
+		m.n++
+		if m.n == m.step {
+			m.endStep()
+		}
+	}
+}
+
+// WriteS16LE measures interleaved signed 16-bit little-endian samples
+func (m *Meter) WriteS16LE(pcm []byte) {
+	samples := make([]float64, len(pcm)/2)
+	for i := range samples {
+		samples[i] = float64(int16(binary.LittleEndian.Uint16(pcm[2*i:]))) / 32768
+	}
+	m.Write(samples)
+}
+
+// endStep closes a step of 100 ms, and the block of 400 ms it ends
+func (m *Meter) endStep() {
+	m.steps[m.next] = m.sum / float64(m.n)
+	m.next = (m.next + 1) % shortTermBlocks
+	if m.filled < shortTermBlocks {
+		m.filled++
+	}
+	m.sum, m.n = 0, 0
+	if m.filled < momentaryBlocks {
+		return
+	}
+	energy := m.mean(momentaryBlocks)
+	if bin, ok := histogramBin(energyLoudness(energy)); ok {
+		m.counts[bin]++
+		m.energies[bin] += energy
+	}
+}
+
+// mean is the mean energy of the last steps, with the meter locked
+func (m *Meter) mean(steps int) float64 {
+	sum := 0.0
+	for i := 1; i <= steps; i++ {
+		sum += m.steps[(m.next-i+shortTermBlocks)%shortTermBlocks]
+	}
+	return sum / float64(steps)
+}
+
+// histogramBin is the bin of a block of loudness, false under the
+// absolute gate
+func histogramBin(loudness float64) (int, bool) {
+	if loudness < absoluteGate {
+		return 0, false
+	}
+	bin := int((loudness - absoluteGate) * binsPerLU)
+	if top := (histogramTop-absoluteGate)*binsPerLU - 1; bin > top {
+		bin = top
+	}
+	return bin, true
+}
+
+// energyLoudness is the loudness of a mean energy, in LUFS
+func energyLoudness(energy float64) float64 {
+	if energy <= 0 {
+		return Silence
+	}
+	return -0.691 + 10*math.Log10(energy)
+}
+
+// Momentary is the loudness of the last 400 ms, Silence before them
+func (m *Meter) Momentary() float64 {
+	return m.window(momentaryBlocks)
+}
+
+// ShortTerm is the loudness of the last 3 s, Silence before them
+func (m *Meter) ShortTerm() float64 {
+	return m.window(shortTermBlocks)
+}
+
+func (m *Meter) window(steps int) float64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.filled < steps {
+		return Silence
+	}
+	return energyLoudness(m.mean(steps))
+}
+
+// Integrated is the gated loudness of all the audio written
+func (m *Meter) Integrated() float64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	count, energy := 0, 0.0
+	for bin := range m.counts {
+		count += m.counts[bin]
+		energy += m.energies[bin]
+	}
+	if count == 0 {
+		return Silence
+	}
+	gate := energyLoudness(energy/float64(count)) + relativeGate
+	count, energy = 0, 0
+	for bin := range m.counts {
+		// a bin counts when its blocks are over the gate, its lower edge
+		if float64(bin)/binsPerLU+absoluteGate < gate {
+			continue
+		}
+		count += m.counts[bin]
+		energy += m.energies[bin]
+	}
+	if count == 0 {
+		return Silence
+	}
+	return energyLoudness(energy / float64(count))
+}
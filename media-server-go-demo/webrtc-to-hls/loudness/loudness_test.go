@@ -0,0 +1,67 @@
+package loudness
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// sine is seconds of a stereo sine of freq at amplitude, at rate
+func sine(rate int, freq, amplitude, seconds float64) []float64 {
+	n := int(float64(rate) * seconds)
+	samples := make([]float64, 2*n)
+	for i := 0; i < n; i++ {
+		v := amplitude * math.Sin(2*math.Pi*freq*float64(i)/float64(rate))
+		samples[2*i], samples[2*i+1] = v, v
+	}
+	return samples
+}
+
+func near(t *testing.T, what string, got, want, tolerance float64) {
+	t.Helper()
+	if math.Abs(got-want) > tolerance {
+		t.Errorf("%s = %.2f LUFS, want %.2f", what, got, want)
+	}
+}
+
+func TestSine(t *testing.T) {
+	// a stereo 1 kHz sine at full scale measures 0 LUFS, at -20 dBFS -20
+	for _, rate := range []int{48000, 44100} {
+		m := NewMeter(rate, 2)
+		m.Write(sine(rate, 1000, 0.1, 5))
+		near(t, "momentary", m.Momentary(), -20, 0.1)
+		near(t, "short-term", m.ShortTerm(), -20, 0.1)
+		near(t, "integrated", m.Integrated(), -20, 0.1)
+	}
+}
+
+func TestGates(t *testing.T) {
+	m := NewMeter(48000, 2)
+	if m.Integrated() != Silence || m.Momentary() != Silence {
+		t.Fatal("loudness of nothing")
+	}
+	// under the absolute gate
+	m.Write(sine(48000, 1000, 0.0001, 2))
+	if m.Integrated() != Silence {
+		t.Fatalf("integrated under the absolute gate = %.2f", m.Integrated())
+	}
+	near(t, "momentary", m.Momentary(), -80, 0.1)
+	// the quiet part is under the relative gate, the pauses of speech say;
+	// the blocks straddling the change of level count, a little under -20
+	m.Write(sine(48000, 1000, 0.1, 5))
+	m.Write(sine(48000, 1000, 0.001, 5))
+	near(t, "integrated", m.Integrated(), -20, 0.5)
+	near(t, "momentary", m.Momentary(), -60, 0.1)
+}
+
+func TestWriteS16LE(t *testing.T) {
+	samples := sine(48000, 1000, 0.1, 1)
+	pcm := make([]byte, 2*len(samples))
+	for i, v := range samples {
+		binary.LittleEndian.PutUint16(pcm[2*i:], uint16(int16(v*32767)))
+	}
+	m := NewMeter(48000, 2)
+	m.WriteS16LE(pcm)
+	near(t, "short-term of a second", m.ShortTerm(), math.Inf(-1), 0)
+	near(t, "momentary", m.Momentary(), -20, 0.1)
+}
@@ -0,0 +1,13 @@
+// Command webrtc-to-hls runs the server of package streamserver, see
+// streamserver.Main for its subcommands
+package main
+
+import (
+	"os"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/streamserver"
+)
+
+func main() {
+	streamserver.Main(os.Args[1:])
+}
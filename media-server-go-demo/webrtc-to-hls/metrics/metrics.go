@@ -0,0 +1,194 @@
+// Package metrics keeps process wide counters, gauges and histograms and
+// renders them in the Prometheus text exposition format
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var (
+	registryLock sync.Mutex
+	registered   []metric
+)
+
+func register(m metric) {
+	registryLock.Lock()
+	registered = append(registered, m)
+	registryLock.Unlock()
+}
+
+// Counter is a monotonically increasing count, optionally split by the
+// values of a single label
+type Counter struct {
+	name  string
+	help  string
+	label string
+
+	sync.Mutex
+	values map[string]uint64
+}
+
+// NewCounter registers a counter. label is the name of the label its values
+// are split by, or "" for a plain counter.
+func NewCounter(name, help, label string) *Counter {
+	c := &Counter{name: name, help: help, label: label, values: map[string]uint64{}}
+	register(c)
+	return c
+}
+
+// Add adds n to the count for the label value, which is ignored by plain
+// counters
+func (c *Counter) Add(value string, n uint64) {
+	if c.label == "" {
+		value = ""
+	}
+	c.Lock()
+	c.values[value] += n
+	c.Unlock()
+}
+
+func (c *Counter) Inc(value string) {
+	c.Add(value, 1)
+}
+
+// Value returns the count for the label value
+func (c *Counter) Value(value string) uint64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.values[value]
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	if c.label == "" {
+		fmt.Fprintf(w, "%s %d\n", c.name, c.values[""])
+		return
+	}
+	values := make([]string, 0, len(c.values))
+	for value := range c.values {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	for _, value := range values {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", c.name, c.label, escape(value), c.values[value])
+	}
+}
+
+// Histogram counts observations in cumulative buckets
+type Histogram struct {
+	name    string
+	help    string
+	buckets []float64
+
+	sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram registers a histogram with the given upper bounds, in
+// increasing order
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := &Histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+	register(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.Lock()
+	defer h.Unlock()
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// Count returns the number of observations
+func (h *Histogram) Count() uint64 {
+	h.Lock()
+	defer h.Unlock()
+	return h.count
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for i, bound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n", h.name, strconv.FormatFloat(h.sum, 'g', -1, 64), h.name, h.count)
+}
+
+// GaugeFunc is a value read when the metrics are written, optionally split
+// by the values of a single label
+type GaugeFunc struct {
+	name  string
+	help  string
+	label string
+	read  func() map[string]float64
+}
+
+// NewGaugeFunc registers a gauge whose values read returns, keyed by label
+// value; a plain gauge (label "") reports the value for "".
+func NewGaugeFunc(name, help, label string, read func() map[string]float64) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, label: label, read: read}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	values := g.read()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	if g.label == "" {
+		fmt.Fprintf(w, "%s %s\n", g.name, strconv.FormatFloat(values[""], 'g', -1, 64))
+		return
+	}
+	keys := make([]string, 0, len(values))
+	for value := range values {
+		keys = append(keys, value)
+	}
+	sort.Strings(keys)
+	for _, value := range keys {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %s\n", g.name, g.label, escape(value), strconv.FormatFloat(values[value], 'g', -1, 64))
+	}
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escape(value string) string {
+	return escaper.Replace(value)
+}
+
+// WriteText writes every registered metric
+func WriteText(w io.Writer) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	for _, m := range registered {
+		m.write(w)
+	}
+}
+
+// Handler serves WriteText
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteText(w)
+	})
+}
@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	plain := NewCounter("test_plain_total", "A plain counter", "")
+	plain.Add("ignored", 2)
+	plain.Inc("")
+	split := NewCounter("test_split_total", "A split counter", "uri")
+	split.Inc("urn:b")
+	split.Add("urn:a", 3)
+	split.Inc(`a"b`)
+
+	var buf bytes.Buffer
+	WriteText(&buf)
+	want := `# HELP test_plain_total A plain counter
+# TYPE test_plain_total counter
+test_plain_total 3
+# HELP test_split_total A split counter
+# TYPE test_split_total counter
+test_split_total{uri="a\"b"} 1
+test_split_total{uri="urn:a"} 3
+test_split_total{uri="urn:b"} 1
+`
+	if !strings.Contains(buf.String(), want) {
+		t.Fatalf("got\n%s", buf.String())
+	}
+	if split.Value("urn:a") != 3 {
+		t.Fatalf("value = %d", split.Value("urn:a"))
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram("test_seconds", "A histogram", []float64{0.5, 1, 5})
+	h.Observe(0.2)
+	h.Observe(1)
+	h.Observe(7.5)
+
+	var buf bytes.Buffer
+	WriteText(&buf)
+	want := `# HELP test_seconds A histogram
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.5"} 1
+test_seconds_bucket{le="1"} 2
+test_seconds_bucket{le="5"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 8.7
+test_seconds_count 3
+`
+	if !strings.Contains(buf.String(), want) {
+		t.Fatalf("got\n%s", buf.String())
+	}
+}
+
+func TestGaugeFunc(t *testing.T) {
+	NewGaugeFunc("test_depth", "A gauge", "class", func() map[string]float64 {
+		return map[string]float64{"b": 2, "a": 0.5}
+	})
+	NewGaugeFunc("test_plain", "A plain gauge", "", func() map[string]float64 {
+		return map[string]float64{"": 7}
+	})
+
+	var buf bytes.Buffer
+	WriteText(&buf)
+	want := `# HELP test_depth A gauge
+# TYPE test_depth gauge
+test_depth{class="a"} 0.5
+test_depth{class="b"} 2
+# HELP test_plain A plain gauge
+# TYPE test_plain gauge
+test_plain 7
+`
+	if !strings.Contains(buf.String(), want) {
+		t.Fatalf("got\n%s", buf.String())
+	}
+}
@@ -0,0 +1,151 @@
+// Package mpd renders the DASH manifest of a CMAF output, listing the same
+// fMP4 segments its HLS playlist does, so one set of media files serves
+// both dash.js and HLS players. Like package playlist, rendering is pure.
+package mpd
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"time"
+)
+
+// Segment is a media segment, timed from the availability start
+type Segment struct {
+	URI string
+	// Start and Duration are in seconds
+	Start    float64
+	Duration float64
+}
+
+// ContentProtection is a ContentProtection descriptor of the
+// representation: the Common Encryption scheme and default key id, or what
+// a DRM system needs to acquire the key
+type ContentProtection struct {
+	// SchemeIDURI is urn:mpeg:dash:mp4protection:2011 for the scheme, the
+	// urn:uuid: of its system id for a DRM system
+	SchemeIDURI string
+	// Value and DefaultKID describe the scheme, cenc or cbcs
+	Value      string
+	DefaultKID string
+	// PSSH is the base64 pssh box of a system
+	PSSH string
+	// LicenseURL is where dash.js posts the license requests of clear keys
+	LicenseURL string
+}
+
+// Manifest is a single period, single representation video MPD
+type Manifest struct {
+	// Dynamic is set while the stream is live
+	Dynamic bool
+	// AvailabilityStart is when media time zero was produced
+	AvailabilityStart time.Time
+	PublishTime       time.Time
+	// TargetDuration is the segment target in seconds, which drives the
+	// manifest update period and buffer times
+	TargetDuration int
+	Codecs         string
+	Width, Height  int
+	// Bandwidth is the peak bitrate in bits per second
+	Bandwidth int
+	// Init is the URI of the initialization segment
+	Init        string
+	StartNumber int
+	Segments    []Segment
+	// ContentProtection describes the encryption of protected segments
+	ContentProtection []ContentProtection
+	// InbandEvents are the schemes of the emsg boxes segments carry
+	InbandEvents []string
+}
+
+const dateTimeFormat = "2006-01-02T15:04:05.000Z"
+
+// Write renders the manifest to w
+func (m *Manifest) Write(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	target := float64(m.TargetDuration)
+	if target <= 0 {
+		target = 1
+	}
+	listed := 0.0
+	for _, s := range m.Segments {
+		listed += s.Duration
+	}
+	fmt.Fprint(b, `<?xml version="1.0" encoding="UTF-8"?>`+"\n")
+	fmt.Fprint(b, `<MPD xmlns="urn:mpeg:dash:schema:mpd:2011"`)
+	if len(m.ContentProtection) > 0 {
+		fmt.Fprint(b, ` xmlns:cenc="urn:mpeg:cenc:2013" xmlns:dashif="https://dashif.org/CPS"`)
+	}
+	fmt.Fprint(b, ` profiles="urn:mpeg:dash:profile:isoff-live:2011,urn:mpeg:dash:profile:cmaf:2019"`)
+	if m.Dynamic {
+		fmt.Fprintf(b, ` type="dynamic" availabilityStartTime="%s" publishTime="%s" minimumUpdatePeriod="%s" timeShiftBufferDepth="%s" suggestedPresentationDelay="%s"`,
+			m.AvailabilityStart.UTC().Format(dateTimeFormat), m.PublishTime.UTC().Format(dateTimeFormat),
+			duration(target), duration(listed), duration(3*target))
+	} else {
+		fmt.Fprintf(b, ` type="static" mediaPresentationDuration="%s"`, duration(m.end()))
+	}
+	fmt.Fprintf(b, ` minBufferTime="%s">`+"\n", duration(2*target))
+	fmt.Fprint(b, `  <Period id="0" start="PT0S">`+"\n")
+	fmt.Fprint(b, `    <AdaptationSet contentType="video" mimeType="video/mp4" segmentAlignment="true" startWithSAP="1">`+"\n")
+	for _, p := range m.ContentProtection {
+		fmt.Fprintf(b, `      <ContentProtection schemeIdUri="%s"`, p.SchemeIDURI)
+		if p.Value != "" {
+			fmt.Fprintf(b, ` value="%s"`, p.Value)
+		}
+		if p.DefaultKID != "" {
+			fmt.Fprintf(b, ` cenc:default_KID="%s"`, p.DefaultKID)
+		}
+		if p.PSSH == "" && p.LicenseURL == "" {
+			fmt.Fprint(b, "/>\n")
+			continue
+		}
+		fmt.Fprint(b, ">\n")
+		if p.PSSH != "" {
+			fmt.Fprintf(b, "        <cenc:pssh>%s</cenc:pssh>\n", p.PSSH)
+		}
+		if p.LicenseURL != "" {
+			fmt.Fprintf(b, "        <dashif:Laurl>%s</dashif:Laurl>\n", html.EscapeString(p.LicenseURL))
+		}
+		fmt.Fprint(b, "      </ContentProtection>\n")
+	}
+	for _, scheme := range m.InbandEvents {
+		fmt.Fprintf(b, `      <InbandEventStream schemeIdUri="%s"/>`+"\n", html.EscapeString(scheme))
+	}
+	fmt.Fprintf(b, `      <Representation id="video" codecs="%s" bandwidth="%d"`, m.Codecs, m.Bandwidth)
+	if m.Width > 0 && m.Height > 0 {
+		fmt.Fprintf(b, ` width="%d" height="%d"`, m.Width, m.Height)
+	}
+	fmt.Fprint(b, ">\n")
+	fmt.Fprintf(b, `        <SegmentList timescale="1000" startNumber="%d">`+"\n", m.StartNumber)
+	fmt.Fprintf(b, `          <Initialization sourceURL="%s"/>`+"\n", m.Init)
+	fmt.Fprint(b, "          <SegmentTimeline>\n")
+	for _, s := range m.Segments {
+		fmt.Fprintf(b, `            <S t="%d" d="%d"/>`+"\n", millis(s.Start), millis(s.Duration))
+	}
+	fmt.Fprint(b, "          </SegmentTimeline>\n")
+	for _, s := range m.Segments {
+		fmt.Fprintf(b, `          <SegmentURL media="%s"/>`+"\n", s.URI)
+	}
+	fmt.Fprint(b, "        </SegmentList>\n      </Representation>\n    </AdaptationSet>\n  </Period>\n</MPD>\n")
+	return b.Flush()
+}
+
+// end is when the last listed segment ends
+func (m *Manifest) end() float64 {
+	if len(m.Segments) == 0 {
+		return 0
+	}
+	last := m.Segments[len(m.Segments)-1]
+	return last.Start + last.Duration
+}
+
+func millis(seconds float64) int64 {
+	return int64(math.Floor(seconds*1000 + 0.5))
+}
+
+// duration formats seconds as an xs:duration
+func duration(seconds float64) string {
+	return fmt.Sprintf("PT%.3fS", seconds)
+}
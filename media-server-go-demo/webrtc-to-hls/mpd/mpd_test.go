@@ -0,0 +1,78 @@
+package mpd
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files")
+
+func golden(t *testing.T, name string, m *Manifest) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := m.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("%s:\n%s\nwant:\n%s", name, buf.String(), want)
+	}
+}
+
+func manifest() *Manifest {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	return &Manifest{
+		Dynamic:           true,
+		AvailabilityStart: start,
+		PublishTime:       start.Add(10 * time.Second),
+		TargetDuration:    2,
+		Codecs:            "avc1.42e01f",
+		Width:             1280,
+		Height:            720,
+		Bandwidth:         2500000,
+		Init:              "segment-7-init00000.mp4",
+		StartNumber:       3,
+		Segments: []Segment{
+			{URI: "segment-7-00003.m4s", Start: 6, Duration: 2},
+			{URI: "segment-7-00004.m4s", Start: 8, Duration: 2.002},
+		},
+	}
+}
+
+func TestDynamic(t *testing.T) {
+	golden(t, "dynamic.mpd", manifest())
+}
+
+func TestStatic(t *testing.T) {
+	m := manifest()
+	m.Dynamic = false
+	golden(t, "static.mpd", m)
+}
+
+func TestProtected(t *testing.T) {
+	m := manifest()
+	m.ContentProtection = []ContentProtection{
+		{SchemeIDURI: "urn:mpeg:dash:mp4protection:2011", Value: "cenc", DefaultKID: "00112233-4455-6677-8899-aabbccddeeff"},
+		{SchemeIDURI: "urn:uuid:1077efec-c0b2-4d02-ace3-3c1e52e2fb4b", PSSH: "AAAANHBzc2g=", LicenseURL: "/hls/show/license-7?token=a&b"},
+	}
+	golden(t, "protected.mpd", m)
+}
+
+func TestInbandEvents(t *testing.T) {
+	m := manifest()
+	m.InbandEvents = []string{"https://aomedia.org/emsg/ID3"}
+	golden(t, "events.mpd", m)
+}
@@ -0,0 +1,86 @@
+package pipeline
+
+import (
+	"fmt"
+	"strings"
+)
+
+// the H.264 encoders video can be transcoded with
+const (
+	// X264 encodes in software, available everywhere
+	X264 = "x264"
+	// VAAPI encodes on Intel and AMD GPUs
+	VAAPI = "vaapi"
+	// NVENC encodes on NVIDIA GPUs
+	NVENC = "nvenc"
+	// V4L2 encodes on the memory-to-memory encoder of a SoC, e.g. a
+	// Raspberry Pi
+	V4L2 = "v4l2"
+)
+
+// Encoders are the encoders in the order Detect prefers them, hardware
+// first
+var Encoders = []string{NVENC, VAAPI, V4L2, X264}
+
+// EncoderElements are the GStreamer elements of the encoders. The plugins
+// of the hardware ones only register them when they find a device to
+// encode on.
+var EncoderElements = map[string]string{
+	X264:  "x264enc",
+	VAAPI: "vaapih264enc",
+	NVENC: "nvh264enc",
+	V4L2:  "v4l2h264enc",
+}
+
+// ParseEncoder reads an encoder, empty for none
+func ParseEncoder(value string) (string, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if _, ok := EncoderElements[value]; !ok && value != "" {
+		return "", fmt.Errorf("unknown encoder %q, only %s", value, strings.Join(Encoders, ", "))
+	}
+	return value, nil
+}
+
+// Detect is the first of Encoders whose element is available, X264 when
+// none is
+func Detect(available func(element string) bool) string {
+	for _, encoder := range Encoders {
+		if available(EncoderElements[encoder]) {
+			return encoder
+		}
+	}
+	return X264
+}
+
+// H264 encodes raw video to H.264, at a constant rate so the segments of a
+// rendition stay near its advertised bandwidth
+type H264 struct {
+	// Encoder is one of Encoders, X264 when empty
+	Encoder string
+	// Bitrate is in kbps
+	Bitrate int
+	// KeyframeInterval is in frames
+	KeyframeInterval int
+	// Profile, when set, constrains the profile of the H.264, e.g.
+	// constrained-baseline
+	Profile string
+}
+
+func (h H264) String() string {
+	var enc string
+	switch h.Encoder {
+	case VAAPI:
+		enc = fmt.Sprintf("vaapih264enc rate-control=cbr bitrate=%d keyframe-period=%d", h.Bitrate, h.KeyframeInterval)
+	case NVENC:
+		enc = fmt.Sprintf("nvh264enc preset=low-latency-hq rc-mode=cbr zerolatency=true bitrate=%d gop-size=%d", h.Bitrate, h.KeyframeInterval)
+	case V4L2:
+		// in bits per second
+		enc = fmt.Sprintf("v4l2h264enc extra-controls=\"controls,video_bitrate=%d,h264_i_frame_period=%d\"", h.Bitrate*1000, h.KeyframeInterval)
+	default:
+		enc = fmt.Sprintf("x264enc tune=zerolatency speed-preset=veryfast bitrate=%d key-int-max=%d", h.Bitrate, h.KeyframeInterval)
+	}
+	if h.Profile != "" {
+		enc += " ! video/x-h264,profile=" + h.Profile
+	}
+	return enc
+}
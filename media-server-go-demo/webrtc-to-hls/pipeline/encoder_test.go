@@ -0,0 +1,35 @@
+package pipeline
+
+import "testing"
+
+func TestH264(t *testing.T) {
+	for _, c := range []struct {
+		enc  H264
+		want string
+	}{
+		{H264{Bitrate: 800, KeyframeInterval: 60}, "x264enc tune=zerolatency speed-preset=veryfast bitrate=800 key-int-max=60"},
+		{H264{Encoder: VAAPI, Bitrate: 800, KeyframeInterval: 60, Profile: "constrained-baseline"}, "vaapih264enc rate-control=cbr bitrate=800 keyframe-period=60 ! video/x-h264,profile=constrained-baseline"},
+		{H264{Encoder: NVENC, Bitrate: 2500, KeyframeInterval: 30}, "nvh264enc preset=low-latency-hq rc-mode=cbr zerolatency=true bitrate=2500 gop-size=30"},
+		{H264{Encoder: V4L2, Bitrate: 2500, KeyframeInterval: 30}, "v4l2h264enc extra-controls=\"controls,video_bitrate=2500000,h264_i_frame_period=30\""},
+	} {
+		if got := c.enc.String(); got != c.want {
+			t.Errorf("%s encoder = %s", c.enc.Encoder, got)
+		}
+	}
+}
+
+func TestDetect(t *testing.T) {
+	registered := map[string]bool{"x264enc": true, "v4l2h264enc": true, "vaapih264enc": true}
+	if got := Detect(func(element string) bool { return registered[element] }); got != VAAPI {
+		t.Fatalf("detected %s", got)
+	}
+	if got := Detect(func(string) bool { return false }); got != X264 {
+		t.Fatalf("detected %s without encoders", got)
+	}
+	if _, err := ParseEncoder("qsv"); err == nil {
+		t.Fatal("unknown encoder parsed")
+	}
+	if got, err := ParseEncoder(" NVENC"); err != nil || got != NVENC {
+		t.Fatalf("parsed %s, %v", got, err)
+	}
+}
@@ -0,0 +1,253 @@
+// Package pipeline builds the launch descriptions of output pipelines from
+// their parts instead of formatted strings: the video and the audio pushed
+// into appsrcs, in the codec they are published in, and the sinks they are
+// packaged to, HLS in TS or fMP4 segments, DASH, a file, RTMP or SRT.
+//
+// The video, and the audio when there is some, are teed, so that the sinks
+// added next to the first one are branches of the same graph:
+//
+//	b := pipeline.New(video, pipeline.HLS{Container: pipeline.TS, ...})
+//	b.Audio(audio)
+//	b.Branch("dash", pipeline.DASH{...})
+//	launch := b.String()
+package pipeline
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// the containers HLS segments are packaged in
+const (
+	TS   = "ts"
+	FMP4 = "fmp4"
+)
+
+// the elements of a pipeline fragments given to Raw can link to
+const (
+	// VideoTee is the tee of the video, linked as video.
+	VideoTee = "video"
+	// AudioTee is the tee of the AAC audio, linked as aac.
+	AudioTee = "aac"
+	// Muxer is the muxer of the sink given to New, linked as muxer.
+	Muxer = "muxer"
+)
+
+// Track is the frames of a track pushed into an appsrc
+type Track struct {
+	// Name names the appsrc, found by it once the pipeline is built
+	Name string
+	// Input follows the name of the appsrc: its caps, if any, then the
+	// elements turning the frames into what the sinks take, e.g.
+	// "! h264parse" or "caps=video/x-vp8 ! vp8dec ! ..."
+	Input string
+	// Timed has appsrc take buffers in time format, as audio does
+	Timed bool
+	// Timestamped has the buffers pushed with their PTS, in time format,
+	// rather than appsrc timestamping them as they are pushed
+	Timestamped bool
+	// MaxBytes bounds the bytes appsrc holds, pushes blocking beyond;
+	// unbounded at 0
+	MaxBytes int
+}
+
+func (t Track) String() string {
+	src := "appsrc do-timestamp=true is-live=true"
+	switch {
+	case t.Timestamped:
+		src = "appsrc is-live=true format=time"
+	case t.Timed:
+		src += " format=time"
+	}
+	if t.MaxBytes > 0 {
+		src += fmt.Sprintf(" block=true max-bytes=%d", t.MaxBytes)
+	}
+	return src + " name=" + t.Name + " " + t.Input
+}
+
+// Sink is where a pipeline writes a stream: a muxer and what it writes to
+type Sink interface {
+	// describe is the sink, its muxer named name
+	describe(name string) string
+	// muxesAudio reports whether the sink takes the audio next to the video
+	muxesAudio() bool
+}
+
+// HLS writes segments listed by a playlist
+type HLS struct {
+	// Container is TS or FMP4. hlscmafsink muxes a single track: an fMP4
+	// sink takes the video, or the audio as an audio-only rendition.
+	Container string
+	// Prefix is the path of the segments before their number, e.g.
+	// hls/main/segment-4-
+	Prefix         string
+	Playlist       string
+	MaxFiles       int
+	TargetDuration int
+	PlaylistLength int
+	// Splitmux has splitmuxsink cut TS segments, on the first keyframe
+	// past TargetDuration, instead of hlssink: the caller writes their
+	// playlist, Playlist and PlaylistLength being unused
+	Splitmux bool
+}
+
+func (h HLS) describe(name string) string {
+	if h.Splitmux && h.Container != FMP4 {
+		return fmt.Sprintf("splitmuxsink name=%s muxer-factory=mpegtsmux location=%s%%05d.ts max-size-time=%d max-files=%d", name, h.Prefix, uint64(h.TargetDuration)*uint64(time.Second), h.MaxFiles)
+	}
+	playlist := fmt.Sprintf("playlist-location=%s max-files=%d target-duration=%d playlist-length=%d", h.Playlist, h.MaxFiles, h.TargetDuration, h.PlaylistLength)
+	if h.Container == FMP4 {
+		return fmt.Sprintf("hlscmafsink init-location=%sinit%%05d.mp4 location=%s%%05d.m4s %s", h.Prefix, h.Prefix, playlist)
+	}
+	return fmt.Sprintf("mpegtsmux name=%s ! hlssink location=%s%%05d.ts %s", name, h.Prefix, playlist)
+}
+
+func (h HLS) muxesAudio() bool {
+	return h.Container != FMP4
+}
+
+// DASH writes fMP4 segments listed by a dynamic MPD, Manifest in Root
+type DASH struct {
+	Root           string
+	Manifest       string
+	TargetDuration int
+}
+
+func (d DASH) describe(name string) string {
+	return fmt.Sprintf("dashsink name=%s mpd-root-path=%s mpd-filename=%s target-duration=%d dynamic=true muxer=mp4", name, d.Root, d.Manifest, d.TargetDuration)
+}
+
+func (d DASH) muxesAudio() bool {
+	return true
+}
+
+// File writes the stream to Location with Muxer, e.g. mp4mux
+type File struct {
+	Muxer    string
+	Location string
+}
+
+func (f File) describe(name string) string {
+	return fmt.Sprintf("%s name=%s ! filesink location=\"%s\"", f.Muxer, name, f.Location)
+}
+
+func (f File) muxesAudio() bool {
+	return true
+}
+
+// RTMP pushes the stream to an RTMP or RTMPS url as FLV
+type RTMP struct {
+	Location string
+}
+
+func (r RTMP) describe(name string) string {
+	return fmt.Sprintf("flvmux name=%s streamable=true ! rtmpsink location=\"%s live=1\"", name, r.Location)
+}
+
+func (r RTMP) muxesAudio() bool {
+	return true
+}
+
+// SRT sends the stream to an srt:// uri as MPEG-TS
+type SRT struct {
+	URI string
+}
+
+func (s SRT) describe(name string) string {
+	return fmt.Sprintf("mpegtsmux name=%s ! srtsink uri=%s wait-for-connection=false", name, s.URI)
+}
+
+func (s SRT) muxesAudio() bool {
+	return true
+}
+
+// branch is a sink added next to the one of New
+type branch struct {
+	name string
+	sink Sink
+	// track feeds the sink when set, instead of a tee
+	track *Track
+	// audio has the sink fed the audio alone
+	audio bool
+}
+
+// Builder builds the launch description of a pipeline
+type Builder struct {
+	video    Track
+	sink     Sink
+	audio    *Track
+	branches []branch
+	raw      []string
+}
+
+// New is the pipeline writing video, pushed into the appsrc of the track,
+// to sink, its muxer named Muxer
+func New(video Track, sink Sink) *Builder {
+	return &Builder{video: video, sink: sink}
+}
+
+// Audio adds the audio, given to the sinks muxing it and to the branches of
+// AudioBranch, teed as AudioTee: its track must end with the AAC, and a
+// sink must take it
+func (b *Builder) Audio(audio Track) *Builder {
+	b.audio = &audio
+	return b
+}
+
+// Branch adds a sink fed the video too, and the audio when it muxes it,
+// its muxer named name
+func (b *Builder) Branch(name string, sink Sink) *Builder {
+	b.branches = append(b.branches, branch{name: name, sink: sink})
+	return b
+}
+
+// AudioBranch adds a sink fed the audio alone, e.g. an audio-only
+// rendition, its muxer named name
+func (b *Builder) AudioBranch(name string, sink Sink) *Builder {
+	b.branches = append(b.branches, branch{name: name, sink: sink, audio: true})
+	return b
+}
+
+// Track adds a track of its own written to sink, e.g. an alternate audio
+// rendition, its muxer named name
+func (b *Builder) Track(track Track, name string, sink Sink) *Builder {
+	b.branches = append(b.branches, branch{name: name, sink: sink, track: &track})
+	return b
+}
+
+// Raw adds a fragment of launch description as is, for what the builder
+// does not model, e.g. an appsink; it may link to VideoTee, AudioTee and
+// Muxer
+func (b *Builder) Raw(fragment string) *Builder {
+	b.raw = append(b.raw, strings.TrimSpace(fragment))
+	return b
+}
+
+// String is the launch description of the pipeline, for gstreamer.New
+func (b *Builder) String() string {
+	parts := []string{b.video.String() + " ! tee name=" + VideoTee + " ! queue ! " + b.sink.describe(Muxer)}
+	if b.audio != nil {
+		audio := b.audio.String() + " ! tee name=" + AudioTee
+		if b.sink.muxesAudio() {
+			audio += " ! queue ! " + Muxer + "."
+		}
+		parts = append(parts, audio)
+	}
+	for _, br := range b.branches {
+		switch {
+		case br.track != nil:
+			parts = append(parts, br.track.String()+" ! queue ! "+br.sink.describe(br.name))
+		case br.audio:
+			if b.audio != nil {
+				parts = append(parts, AudioTee+". ! queue ! "+br.sink.describe(br.name))
+			}
+		default:
+			parts = append(parts, VideoTee+". ! queue ! "+br.sink.describe(br.name))
+			if b.audio != nil && br.sink.muxesAudio() {
+				parts = append(parts, AudioTee+". ! queue ! "+br.name+".")
+			}
+		}
+	}
+	return strings.Join(append(parts, b.raw...), " ")
+}
@@ -0,0 +1,96 @@
+package pipeline
+
+import (
+	"strings"
+	"testing"
+)
+
+var (
+	video = Track{Name: "appsrc", Input: "! h264parse", MaxBytes: 4 << 20}
+	audio = Track{Name: "audiosrc", Input: "caps=audio/mpeg,mpegversion=4,stream-format=adts ! aacparse", Timed: true}
+	ts    = HLS{Container: TS, Prefix: "hls/main/segment-4-", Playlist: "hls/main/playlist.m3u8", MaxFiles: 10, TargetDuration: 2, PlaylistLength: 6}
+)
+
+func TestHLS(t *testing.T) {
+	b := New(video, ts)
+	want := "appsrc do-timestamp=true is-live=true block=true max-bytes=4194304 name=appsrc ! h264parse ! tee name=video ! queue ! mpegtsmux name=muxer ! hlssink location=hls/main/segment-4-%05d.ts playlist-location=hls/main/playlist.m3u8 max-files=10 target-duration=2 playlist-length=6"
+	if got := b.String(); got != want {
+		t.Fatalf("pipeline = %s", got)
+	}
+	b.Audio(audio)
+	if got := b.String(); !strings.HasPrefix(got, want+" appsrc do-timestamp=true is-live=true format=time name=audiosrc caps=") || !strings.HasSuffix(got, " ! aacparse ! tee name=aac ! queue ! muxer.") {
+		t.Fatalf("pipeline with audio = %s", got)
+	}
+
+	// frames pushed with their PTS are not timestamped by appsrc
+	timestamped := video
+	timestamped.Timestamped = true
+	if got := New(timestamped, ts).String(); !strings.HasPrefix(got, "appsrc is-live=true format=time block=true max-bytes=4194304 name=appsrc ") {
+		t.Fatalf("timestamped pipeline = %s", got)
+	}
+
+	cmaf := ts
+	cmaf.Container = FMP4
+	b = New(video, cmaf).Audio(audio)
+	if got := b.String(); strings.Contains(got, "muxer") || !strings.HasSuffix(got, "tee name=aac") {
+		t.Fatalf("fmp4 muxes audio: %s", got)
+	}
+	cmaf.Prefix, cmaf.Playlist = "hls/main/audio/segment-4-", "hls/main/audio/playlist.m3u8"
+	b.AudioBranch("audiomuxer", cmaf)
+	if got := b.String(); !strings.HasSuffix(got, " ! tee name=aac aac. ! queue ! hlscmafsink init-location=hls/main/audio/segment-4-init%05d.mp4 location=hls/main/audio/segment-4-%05d.m4s playlist-location=hls/main/audio/playlist.m3u8 max-files=10 target-duration=2 playlist-length=6") {
+		t.Fatalf("fmp4 audio rendition = %s", got)
+	}
+}
+
+func TestSplitmux(t *testing.T) {
+	split := ts
+	split.Splitmux = true
+	got := New(video, split).Audio(audio).String()
+	if !strings.Contains(got, " ! queue ! splitmuxsink name=muxer muxer-factory=mpegtsmux location=hls/main/segment-4-%05d.ts max-size-time=2000000000 max-files=10 ") || !strings.HasSuffix(got, " ! queue ! muxer.") {
+		t.Fatalf("pipeline = %s", got)
+	}
+	// hlscmafsink cuts fMP4 segments either way
+	split.Container = FMP4
+	if got := New(video, split).String(); !strings.Contains(got, "hlscmafsink") {
+		t.Fatalf("fmp4 pipeline = %s", got)
+	}
+}
+
+func TestBranches(t *testing.T) {
+	b := New(video, ts).
+		Branch("dash", DASH{Root: "hls/main/dash-4", Manifest: "manifest.mpd", TargetDuration: 2}).
+		Branch("srtmux", SRT{URI: "srt://contribution.example:9000"}).
+		AudioBranch("audiomuxer", ts).
+		Track(Track{Name: "altaudiosrc0", Input: "! aacparse", Timed: true}, "altaudiomuxer0", ts).
+		Raw(" appsrc name=metasrc caps=meta/x-id3 ! queue ! muxer.")
+	got := b.String()
+	for _, want := range []string{
+		" video. ! queue ! dashsink name=dash mpd-root-path=hls/main/dash-4 mpd-filename=manifest.mpd target-duration=2 dynamic=true muxer=mp4 ",
+		" video. ! queue ! mpegtsmux name=srtmux ! srtsink uri=srt://contribution.example:9000 wait-for-connection=false ",
+		" appsrc do-timestamp=true is-live=true format=time name=altaudiosrc0 ! aacparse ! queue ! mpegtsmux name=altaudiomuxer0 ! hlssink ",
+	} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("no %q in %s", want, got)
+		}
+	}
+	if strings.Contains(got, "aac.") || !strings.HasSuffix(got, "playlist-length=6 appsrc name=metasrc caps=meta/x-id3 ! queue ! muxer.") {
+		t.Fatalf("audio linked without audio: %s", got)
+	}
+	got = b.Audio(audio).String()
+	for _, want := range []string{" aac. ! queue ! dash.", " aac. ! queue ! srtmux.", " aac. ! queue ! mpegtsmux name=audiomuxer ! hlssink "} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("no %q in %s", want, got)
+		}
+	}
+}
+
+func TestOutputs(t *testing.T) {
+	record := New(Track{Name: "appsrc", Input: "! h264parse"}, File{Muxer: "mp4mux", Location: "recordings/a.mp4"})
+	if got := record.String(); got != `appsrc do-timestamp=true is-live=true name=appsrc ! h264parse ! tee name=video ! queue ! mp4mux name=muxer ! filesink location="recordings/a.mp4"` {
+		t.Fatalf("file = %s", got)
+	}
+	restream := New(Track{Name: "appsrc", Input: "! h264parse"}, RTMP{Location: "rtmp://a.rtmp.youtube.com/live2/abcd"}).Audio(audio)
+	if got := restream.String(); !strings.Contains(got, `flvmux name=muxer streamable=true ! rtmpsink location="rtmp://a.rtmp.youtube.com/live2/abcd live=1" appsrc `) || !strings.HasSuffix(got, "tee name=aac ! queue ! muxer.") {
+		t.Fatalf("rtmp = %s", got)
+	}
+}
@@ -0,0 +1,285 @@
+// Package playlist renders HLS playlists from an ordered description of
+// segments and parts. Rendering is pure: the same description always gives
+// the same text, so what players are served is pinned by the golden files of
+// the tests rather than found out by players.
+package playlist
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Type is the EXT-X-PLAYLIST-TYPE of a media playlist
+type Type string
+
+const (
+	// Sliding is a live playlist whose oldest segments are removed
+	Sliding Type = ""
+	// Event is a live playlist that only grows
+	Event Type = "EVENT"
+	// VOD is a playlist that no longer changes
+	VOD Type = "VOD"
+)
+
+// ByteRange is a sub-range of a resource, as in EXT-X-BYTERANGE
+type ByteRange struct {
+	Length int64
+	Offset int64
+}
+
+func (r ByteRange) String() string {
+	return fmt.Sprintf("%d@%d", r.Length, r.Offset)
+}
+
+// Part is an LL-HLS partial segment
+type Part struct {
+	URI      string
+	Duration float64
+	// Independent is set when the part starts with a keyframe
+	Independent bool
+}
+
+// Segment is one media segment
+type Segment struct {
+	URI      string
+	Duration float64
+	Title    string
+	// Discontinuity marks a segment that does not continue the previous one,
+	// e.g. the first one after a publisher reconnected
+	Discontinuity bool
+	// ProgramDateTime is the wall clock time of the first sample, if known
+	ProgramDateTime time.Time
+	// Parts are the partial segments the segment was published as, if any
+	Parts []Part
+	// Keyframe locates the keyframe within the segment, listed by I-frame
+	// playlists only
+	Keyframe *ByteRange
+	// ByteRange is the range of URI the segment is, for segments sharing a
+	// file; the whole file when nil
+	ByteRange *ByteRange
+}
+
+// DateRange is a span of the wall clock timeline of a playlist, e.g. a cue
+// placed by the publisher; playlists listing one stamp PROGRAM-DATE-TIME
+type DateRange struct {
+	ID    string
+	Start time.Time
+	// Duration is in seconds, zero when unknown
+	Duration float64
+}
+
+// end is when the range ends, its start when its duration is unknown
+func (d DateRange) end() time.Time {
+	return d.Start.Add(time.Duration(d.Duration * float64(time.Second)))
+}
+
+// Media is a media playlist
+type Media struct {
+	Type Type
+	// TargetDuration is derived from the segments when zero
+	TargetDuration        int
+	MediaSequence         int
+	DiscontinuitySequence int
+	Segments              []Segment
+	// Partial are the parts of the segment being produced, listed after
+	// the last complete segment
+	Partial []Part
+	// PartTarget is the LL-HLS part target duration, zero without parts
+	PartTarget float64
+	// PreloadHint is the URI of the next part, announced ahead of time
+	PreloadHint string
+	// Map is the URI of the initialization section of fMP4 segments
+	Map string
+	// DateRanges are listed ahead of the segments
+	DateRanges  []DateRange
+	Ended       bool
+	IFramesOnly bool
+}
+
+// Version is the lowest EXT-X-VERSION the playlist is compatible with
+func (m *Media) Version() int {
+	switch {
+	case m.PartTarget > 0, m.Map != "" && !m.IFramesOnly:
+		return 6
+	case m.Map != "":
+		return 5
+	case m.IFramesOnly:
+		// EXT-X-BYTERANGE
+		return 4
+	}
+	for _, s := range m.Segments {
+		if s.ByteRange != nil {
+			return 4
+		}
+	}
+	return 3
+}
+
+// targetDuration is the configured target, or the longest segment rounded
+// to the nearest second as players check it (RFC 8216 4.3.3.1)
+func (m *Media) targetDuration() int {
+	target := m.TargetDuration
+	for _, s := range m.Segments {
+		if d := int(math.Floor(s.Duration + 0.5)); d > target {
+			target = d
+		}
+	}
+	if target == 0 {
+		target = 1
+	}
+	return target
+}
+
+// Write renders the playlist to w
+func (m *Media) Write(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, "#EXTM3U\n#EXT-X-VERSION:%d\n", m.Version())
+	fmt.Fprintf(b, "#EXT-X-TARGETDURATION:%d\n", m.targetDuration())
+	if m.PartTarget > 0 {
+		fmt.Fprintf(b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%s\n", duration(3*m.PartTarget))
+		fmt.Fprintf(b, "#EXT-X-PART-INF:PART-TARGET=%s\n", duration(m.PartTarget))
+	}
+	fmt.Fprintf(b, "#EXT-X-MEDIA-SEQUENCE:%d\n", m.MediaSequence)
+	if m.DiscontinuitySequence > 0 {
+		fmt.Fprintf(b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", m.DiscontinuitySequence)
+	}
+	if m.Type != Sliding {
+		fmt.Fprintf(b, "#EXT-X-PLAYLIST-TYPE:%s\n", m.Type)
+	}
+	if m.IFramesOnly {
+		fmt.Fprint(b, "#EXT-X-I-FRAMES-ONLY\n")
+	}
+	if m.Map != "" {
+		fmt.Fprintf(b, "#EXT-X-MAP:URI=\"%s\"\n", m.Map)
+	}
+	for _, d := range m.DateRanges {
+		fmt.Fprintf(b, "#EXT-X-DATERANGE:ID=\"%s\",START-DATE=\"%s\"", d.ID, d.Start.UTC().Format(dateTimeFormat))
+		if d.Duration > 0 {
+			fmt.Fprintf(b, ",DURATION=%s", duration(d.Duration))
+		}
+		b.WriteByte('\n')
+	}
+	for _, s := range m.Segments {
+		if s.Discontinuity {
+			fmt.Fprint(b, "#EXT-X-DISCONTINUITY\n")
+		}
+		if !s.ProgramDateTime.IsZero() {
+			fmt.Fprintf(b, "#EXT-X-PROGRAM-DATE-TIME:%s\n", s.ProgramDateTime.UTC().Format(dateTimeFormat))
+		}
+		writeParts(b, s.Parts)
+		fmt.Fprintf(b, "#EXTINF:%s,%s\n", duration(s.Duration), s.Title)
+		switch {
+		case m.IFramesOnly && s.Keyframe != nil:
+			fmt.Fprintf(b, "#EXT-X-BYTERANGE:%s\n", s.Keyframe)
+		case !m.IFramesOnly && s.ByteRange != nil:
+			fmt.Fprintf(b, "#EXT-X-BYTERANGE:%s\n", s.ByteRange)
+		}
+		fmt.Fprintf(b, "%s\n", s.URI)
+	}
+	if !m.Ended {
+		writeParts(b, m.Partial)
+		if m.PreloadHint != "" {
+			fmt.Fprintf(b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%s\"\n", m.PreloadHint)
+		}
+	} else {
+		fmt.Fprint(b, "#EXT-X-ENDLIST\n")
+	}
+	return b.Flush()
+}
+
+func writeParts(b *bufio.Writer, parts []Part) {
+	for _, p := range parts {
+		fmt.Fprintf(b, "#EXT-X-PART:DURATION=%s,URI=\"%s\"", duration(p.Duration), p.URI)
+		if p.Independent {
+			fmt.Fprint(b, ",INDEPENDENT=YES")
+		}
+		b.WriteByte('\n')
+	}
+}
+
+const dateTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// duration formats seconds with millisecond precision
+func duration(seconds float64) string {
+	return strconv.FormatFloat(seconds, 'f', 3, 64)
+}
+
+// Variant is one rendition as listed in a master playlist
+type Variant struct {
+	Bandwidth int
+	Width     int
+	Height    int
+	// Codecs is the RFC 6381 codecs string, e.g. avc1.42e01f
+	Codecs string
+	// URI is the media playlist, relative to the master playlist
+	URI string
+	// Audio and Subtitles are the GROUP-IDs of the alternate audio and the
+	// subtitles renditions of the variant, if any
+	Audio     string
+	Subtitles string
+}
+
+// MediaType is the TYPE of a rendition
+type MediaType string
+
+const (
+	AudioMedia     MediaType = "AUDIO"
+	SubtitlesMedia MediaType = "SUBTITLES"
+)
+
+// Rendition is an alternate rendition of a master playlist, an EXT-X-MEDIA
+type Rendition struct {
+	Type    MediaType
+	GroupID string
+	Name    string
+	// Language is a BCP 47 tag, e.g. en-US, empty when unknown
+	Language string
+	// Default is set for the rendition players pick without a preference
+	Default bool
+	// URI is the media playlist, relative to the master playlist; empty
+	// for audio muxed into the variants
+	URI string
+}
+
+// WriteMaster renders a master playlist listing variants in order, after
+// the renditions they refer to
+func WriteMaster(w io.Writer, variants []Variant, renditions ...Rendition) error {
+	b := bufio.NewWriter(w)
+	fmt.Fprint(b, "#EXTM3U\n#EXT-X-VERSION:3\n")
+	for _, r := range renditions {
+		fmt.Fprintf(b, "#EXT-X-MEDIA:TYPE=%s,GROUP-ID=\"%s\",NAME=\"%s\"", r.Type, r.GroupID, r.Name)
+		if r.Language != "" {
+			fmt.Fprintf(b, ",LANGUAGE=\"%s\"", r.Language)
+		}
+		def := "NO"
+		if r.Default {
+			def = "YES"
+		}
+		fmt.Fprintf(b, ",DEFAULT=%s,AUTOSELECT=YES", def)
+		if r.URI != "" {
+			fmt.Fprintf(b, ",URI=\"%s\"", r.URI)
+		}
+		b.WriteByte('\n')
+	}
+	for _, v := range variants {
+		fmt.Fprintf(b, "#EXT-X-STREAM-INF:BANDWIDTH=%d", v.Bandwidth)
+		if v.Width > 0 && v.Height > 0 {
+			fmt.Fprintf(b, ",RESOLUTION=%dx%d", v.Width, v.Height)
+		}
+		if v.Codecs != "" {
+			fmt.Fprintf(b, ",CODECS=\"%s\"", v.Codecs)
+		}
+		if v.Audio != "" {
+			fmt.Fprintf(b, ",AUDIO=\"%s\"", v.Audio)
+		}
+		if v.Subtitles != "" {
+			fmt.Fprintf(b, ",SUBTITLES=\"%s\"", v.Subtitles)
+		}
+		fmt.Fprintf(b, "\n%s\n", v.URI)
+	}
+	return b.Flush()
+}
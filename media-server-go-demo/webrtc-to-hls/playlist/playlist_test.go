@@ -0,0 +1,265 @@
+package playlist
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/hlscheck"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files")
+
+// golden compares m against testdata/name and checks it is a playlist
+// hlscheck accepts as the revision following prev
+func golden(t *testing.T, name string, m *Media, prev *hlscheck.Media) *hlscheck.Media {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := m.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("%s:\n%s\nwant:\n%s", name, buf.String(), want)
+	}
+	parsed, err := hlscheck.ParseMedia(buf.Bytes())
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	if err := parsed.Check(prev); err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return parsed
+}
+
+func segment(n int, duration float64) Segment {
+	return Segment{URI: fmt.Sprintf("segment-%05d.ts", n), Duration: duration}
+}
+
+func TestLiveWindow(t *testing.T) {
+	s := &Stream{Window: 3, TargetDuration: 2}
+	var prev *hlscheck.Media
+	for i := 0; i < 2; i++ {
+		s.Append(segment(i, 2))
+	}
+	prev = golden(t, "live_start.m3u8", s.Media(), prev)
+	for i := 2; i < 5; i++ {
+		s.Append(segment(i, 2.002))
+	}
+	golden(t, "live_window.m3u8", s.Media(), prev)
+}
+
+func TestDiscontinuitySequence(t *testing.T) {
+	s := &Stream{Window: 3, TargetDuration: 2}
+	var prev *hlscheck.Media
+	for i := 0; i < 7; i++ {
+		seg := segment(i, 2)
+		// publisher reconnects before segments 2 and 4
+		seg.Discontinuity = i == 2 || i == 4
+		s.Append(seg)
+		if i == 4 {
+			prev = golden(t, "discontinuity_listed.m3u8", s.Media(), prev)
+		}
+	}
+	golden(t, "discontinuity_sequence.m3u8", s.Media(), prev)
+}
+
+func TestResume(t *testing.T) {
+	first := &Stream{Window: 3, TargetDuration: 2}
+	for i := 0; i < 5; i++ {
+		first.Append(segment(i, 2))
+	}
+	s := Resume(first.Media(), 3)
+	var prev *hlscheck.Media
+	for i := 0; i < 4; i++ {
+		s.Append(Segment{URI: fmt.Sprintf("next-%05d.ts", i), Duration: 2})
+		if i == 0 {
+			prev = golden(t, "resume.m3u8", s.Media(), prev)
+		}
+	}
+	golden(t, "resume_slid.m3u8", s.Media(), prev)
+}
+
+func TestDateRanges(t *testing.T) {
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	s := &Stream{Window: 3, TargetDuration: 2}
+	var prev *hlscheck.Media
+	for i := 0; i < 6; i++ {
+		seg := segment(i, 2)
+		seg.ProgramDateTime = start.Add(time.Duration(2*i) * time.Second)
+		s.Append(seg)
+		if i == 1 {
+			s.AddDateRange(DateRange{ID: "break", Start: start.Add(3 * time.Second), Duration: 2})
+			s.AddDateRange(DateRange{ID: "marker", Start: start.Add(7 * time.Second)})
+			prev = golden(t, "dateranges.m3u8", s.Media(), prev)
+		}
+	}
+	// the break ended before the first segment listed
+	golden(t, "dateranges_slid.m3u8", s.Media(), prev)
+}
+
+func TestEventToSliding(t *testing.T) {
+	s := &Stream{TargetDuration: 2}
+	for i := 0; i < 4; i++ {
+		s.Append(segment(i, 2))
+	}
+	prev := golden(t, "event.m3u8", s.Media(), nil)
+	s.Slide(2)
+	s.Append(segment(4, 2))
+	golden(t, "event_sliding.m3u8", s.Media(), prev)
+}
+
+func TestEndList(t *testing.T) {
+	s := &Stream{TargetDuration: 2, PartTarget: 0.5}
+	for i := 0; i < 2; i++ {
+		s.Append(segment(i, 2))
+	}
+	s.AppendPart(Part{URI: "part-2.0.ts", Duration: 0.5, Independent: true}, "part-2.1.ts")
+	prev := golden(t, "event_parts.m3u8", s.Media(), nil)
+	s.End()
+	// nothing is added after the end
+	s.Append(segment(2, 2))
+	prev = golden(t, "endlist.m3u8", s.Media(), prev)
+
+	sliding := &Stream{Window: 2, TargetDuration: 2}
+	for i := 0; i < 3; i++ {
+		sliding.Append(segment(i, 2))
+	}
+	sliding.End()
+	golden(t, "endlist_sliding.m3u8", sliding.Media(), nil)
+}
+
+func TestIFrames(t *testing.T) {
+	start := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	s := &Stream{Window: 4, TargetDuration: 2}
+	for i := 0; i < 4; i++ {
+		seg := segment(i, 2)
+		seg.ProgramDateTime = start.Add(time.Duration(i) * 2 * time.Second)
+		seg.Discontinuity = i == 1
+		if i != 1 {
+			// the keyframe of segment 1 was not located
+			seg.Keyframe = &ByteRange{Length: int64(9000 + i), Offset: 376}
+		}
+		s.Append(seg)
+	}
+	golden(t, "media_pdt.m3u8", s.Media(), nil)
+	golden(t, "iframes.m3u8", s.IFrames(), nil)
+}
+
+func TestByteRanges(t *testing.T) {
+	m := &Media{TargetDuration: 2, Segments: []Segment{
+		{URI: "stream.ts", Duration: 2, ByteRange: &ByteRange{Length: 75200, Offset: 0}},
+		{URI: "stream.ts", Duration: 2, ByteRange: &ByteRange{Length: 82344, Offset: 75200}},
+		{URI: "segment-00002.ts", Duration: 1.5},
+	}}
+	if m.Version() != 4 {
+		t.Fatalf("version %d", m.Version())
+	}
+	golden(t, "byteranges.m3u8", m, nil)
+}
+
+func TestInitializationSection(t *testing.T) {
+	m := &Media{TargetDuration: 2, Map: "init.mp4", Segments: []Segment{
+		{URI: "segment-00000.m4s", Duration: 2},
+		{URI: "segment-00001.m4s", Duration: 2, Discontinuity: true},
+	}}
+	parsed := golden(t, "fmp4_map.m3u8", m, nil)
+	if parsed.Map != "init.mp4" {
+		t.Fatalf("map %q", parsed.Map)
+	}
+}
+
+func TestLowLatencyParts(t *testing.T) {
+	s := &Stream{Window: 6, TargetDuration: 2, PartTarget: 0.5}
+	var prev *hlscheck.Media
+	for i := 0; i < 5; i++ {
+		for p := 0; p < 4; p++ {
+			s.AppendPart(Part{
+				URI:         fmt.Sprintf("part-%d.%d.ts", i, p),
+				Duration:    0.5,
+				Independent: p == 0,
+			}, fmt.Sprintf("part-%d.%d.ts", i, p+1))
+		}
+		s.Append(segment(i, 2))
+	}
+	s.AppendPart(Part{URI: "part-5.0.ts", Duration: 0.5, Independent: true}, "part-5.1.ts")
+	prev = golden(t, "ll_parts.m3u8", s.Media(), prev)
+	s.AppendPart(Part{URI: "part-5.1.ts", Duration: 0.5}, "part-5.2.ts")
+	golden(t, "ll_parts_next.m3u8", s.Media(), prev)
+}
+
+func TestRenderingIsDeterministic(t *testing.T) {
+	s := &Stream{Window: 3, TargetDuration: 2, PartTarget: 0.5}
+	for i := 0; i < 4; i++ {
+		s.AppendPart(Part{URI: fmt.Sprintf("part-%d.0.ts", i), Duration: 0.5, Independent: true}, "")
+		s.Append(segment(i, 2))
+	}
+	var first, second bytes.Buffer
+	s.Media().Write(&first)
+	s.Media().Write(&second)
+	if first.String() != second.String() {
+		t.Fatalf("renders differ:\n%s\n%s", first.String(), second.String())
+	}
+}
+
+func TestWriteMaster(t *testing.T) {
+	var buf bytes.Buffer
+	err := WriteMaster(&buf, []Variant{
+		{Bandwidth: 2500000, Width: 1280, Height: 720, Codecs: "avc1.64001f", URI: "720p/playlist.m3u8"},
+		{Bandwidth: 800000, URI: "360p/playlist.m3u8"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join("testdata", "master.m3u8")
+	if *update {
+		ioutil.WriteFile(path, buf.Bytes(), 0644)
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("master:\n%s\nwant:\n%s", buf.String(), want)
+	}
+	if _, err := hlscheck.ParseMaster(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteMasterRenditions(t *testing.T) {
+	var buf bytes.Buffer
+	err := WriteMaster(&buf, []Variant{
+		{Bandwidth: 2500000, Codecs: "avc1.64001f,mp4a.40.2", URI: "playlist.m3u8", Audio: "audio", Subtitles: "captions"},
+	},
+		Rendition{Type: AudioMedia, GroupID: "audio", Name: "en", Language: "en", Default: true},
+		Rendition{Type: AudioMedia, GroupID: "audio", Name: "es", Language: "es", URI: "audio-es/playlist.m3u8"},
+		Rendition{Type: SubtitlesMedia, GroupID: "captions", Name: "Captions", Language: "en-US", URI: "captions.m3u8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "#EXTM3U\n#EXT-X-VERSION:3\n" +
+		"#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"audio\",NAME=\"en\",LANGUAGE=\"en\",DEFAULT=YES,AUTOSELECT=YES\n" +
+		"#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"audio\",NAME=\"es\",LANGUAGE=\"es\",DEFAULT=NO,AUTOSELECT=YES,URI=\"audio-es/playlist.m3u8\"\n" +
+		"#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"captions\",NAME=\"Captions\",LANGUAGE=\"en-US\",DEFAULT=NO,AUTOSELECT=YES,URI=\"captions.m3u8\"\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=2500000,CODECS=\"avc1.64001f,mp4a.40.2\",AUDIO=\"audio\",SUBTITLES=\"captions\"\nplaylist.m3u8\n"
+	if buf.String() != want {
+		t.Fatalf("master:\n%s\nwant:\n%s", buf.String(), want)
+	}
+	if _, err := hlscheck.ParseMaster(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,197 @@
+package playlist
+
+// Stream is the playlist of an output as it is produced: segments and parts
+// are appended in order and each revision is taken with Media. A stream
+// starts as an EVENT playlist when Window is zero and slides once a window
+// is set.
+type Stream struct {
+	// Window is the number of segments a sliding playlist lists, zero to
+	// keep them all
+	Window         int
+	TargetDuration int
+	// PartTarget enables LL-HLS parts
+	PartTarget float64
+
+	segments        []Segment
+	sequence        int
+	discontinuities int
+	partial         []Part
+	hint            string
+	ended           bool
+	// discontinue marks the next segment appended as a discontinuity
+	discontinue bool
+	dateRanges  []DateRange
+}
+
+// Resume returns a stream continuing m, the last revision of the playlist
+// of another output, e.g. the one a takeover replaced: the segments of m
+// slide out as new ones are appended, the first of which starts with a
+// discontinuity.
+func Resume(m *Media, window int) *Stream {
+	s := &Stream{
+		Window:          window,
+		TargetDuration:  m.TargetDuration,
+		PartTarget:      m.PartTarget,
+		segments:        append([]Segment(nil), m.Segments...),
+		sequence:        m.MediaSequence,
+		discontinuities: m.DiscontinuitySequence,
+		discontinue:     true,
+	}
+	for i := range s.segments {
+		s.segments[i].Parts = nil
+	}
+	s.trim()
+	return s
+}
+
+// AppendPart adds a part of the segment being produced and the URI of the
+// part expected next, announced as preload hint
+func (s *Stream) AppendPart(part Part, next string) {
+	if s.ended {
+		return
+	}
+	s.partial = append(s.partial, part)
+	s.hint = next
+}
+
+// Hint replaces the preload hint, e.g. with the first part of the next
+// segment once a segment completed
+func (s *Stream) Hint(next string) {
+	if !s.ended {
+		s.hint = next
+	}
+}
+
+// Append completes a segment. A segment without parts takes the ones
+// appended since the previous segment.
+func (s *Stream) Append(segment Segment) {
+	if s.ended {
+		return
+	}
+	if segment.Parts == nil && len(s.partial) > 0 {
+		segment.Parts = s.partial
+	}
+	if s.discontinue {
+		segment.Discontinuity = true
+		s.discontinue = false
+	}
+	s.partial = nil
+	s.segments = append(s.segments, segment)
+	s.trim()
+}
+
+// AddDateRange lists d until it ended before the first segment listed
+func (s *Stream) AddDateRange(d DateRange) {
+	s.dateRanges = append(s.dateRanges, d)
+}
+
+// Slide turns the stream into a sliding playlist of window segments, e.g. an
+// EVENT playlist that went on longer than the DVR window
+func (s *Stream) Slide(window int) {
+	s.Window = window
+	s.trim()
+}
+
+// End finalizes the stream: the parts of an unfinished segment are dropped
+// and the playlist gets its ENDLIST
+func (s *Stream) End() {
+	s.ended = true
+	s.partial = nil
+	s.hint = ""
+}
+
+// trim removes segments that slid out of the window, counting the
+// discontinuities they took with them
+func (s *Stream) trim() {
+	if s.Window <= 0 || len(s.segments) <= s.Window {
+		return
+	}
+	drop := len(s.segments) - s.Window
+	for _, segment := range s.segments[:drop] {
+		if segment.Discontinuity {
+			s.discontinuities++
+		}
+	}
+	s.sequence += drop
+	s.segments = append([]Segment(nil), s.segments[drop:]...)
+	if first := s.segments[0].ProgramDateTime; !first.IsZero() {
+		ranges := s.dateRanges[:0]
+		for _, d := range s.dateRanges {
+			if !d.end().Before(first) {
+				ranges = append(ranges, d)
+			}
+		}
+		s.dateRanges = ranges
+	}
+}
+
+// Media returns the current revision of the playlist. Parts are only listed
+// for the segments of the last three target durations, players have no use
+// for older ones.
+func (s *Stream) Media() *Media {
+	m := &Media{
+		TargetDuration:        s.TargetDuration,
+		MediaSequence:         s.sequence,
+		DiscontinuitySequence: s.discontinuities,
+		Segments:              make([]Segment, len(s.segments)),
+		DateRanges:            append([]DateRange(nil), s.dateRanges...),
+		Ended:                 s.ended,
+	}
+	copy(m.Segments, s.segments)
+	switch {
+	case s.Window > 0:
+		m.Type = Sliding
+	case s.ended:
+		m.Type = VOD
+	default:
+		m.Type = Event
+	}
+	if s.PartTarget <= 0 {
+		for i := range m.Segments {
+			m.Segments[i].Parts = nil
+		}
+		return m
+	}
+	m.PartTarget = s.PartTarget
+	m.Partial = s.partial
+	m.PreloadHint = s.hint
+	// RFC 8216bis 6.2.2: parts older than three target durations from the
+	// end of the playlist should be removed
+	keep := 3 * float64(m.targetDuration())
+	listed := 0.0
+	for _, p := range s.partial {
+		listed += p.Duration
+	}
+	for i := len(m.Segments) - 1; i >= 0; i-- {
+		if listed >= keep {
+			m.Segments[i].Parts = nil
+		}
+		listed += m.Segments[i].Duration
+	}
+	return m
+}
+
+// IFrames returns the I-frame playlist of the current revision, listing the
+// keyframe of every segment that has one located
+func (s *Stream) IFrames() *Media {
+	m := s.Media()
+	m.IFramesOnly = true
+	m.PartTarget = 0
+	m.Partial = nil
+	m.PreloadHint = ""
+	segments := m.Segments[:0]
+	discontinuity := false
+	for _, segment := range m.Segments {
+		if segment.Keyframe == nil {
+			// the next listed keyframe is still past the discontinuity
+			discontinuity = discontinuity || segment.Discontinuity
+			continue
+		}
+		segment.Discontinuity = segment.Discontinuity || discontinuity
+		discontinuity = false
+		segment.Parts = nil
+		segments = append(segments, segment)
+	}
+	m.Segments = segments
+	return m
+}
@@ -0,0 +1,177 @@
+// Package pubauth authenticates publishers before their offer is accepted.
+// It has two backends: pre-shared secrets per stream key, and JWTs signed
+// with a shared secret. A deployment with its own backend, e.g. a call to
+// its user service, implements Authenticator.
+package pubauth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNoCredential refuses a publish that presented no credential
+	ErrNoCredential = errors.New("publish credential required")
+	// ErrDenied refuses a credential that does not allow the publish
+	ErrDenied = errors.New("publish credential refused")
+)
+
+// Request is a publish to authenticate
+type Request struct {
+	// Key is the stream key the publisher asked for
+	Key string
+	// Credential is the secret or token the publisher presented, empty
+	// when it presented none
+	Credential string
+	// TLS is the state of the publisher's connection, nil without TLS
+	TLS *tls.ConnectionState
+}
+
+// Authenticator decides whether a request may publish. It returns the
+// identity of the publisher, which is recorded on the session and in the
+// logs, or why it may not.
+type Authenticator interface {
+	Authenticate(r Request) (identity string, err error)
+}
+
+// Keys are pre-shared secrets by stream key. The secret is not the key:
+// the key names the stream in playback URLs, the secret only travels with
+// the publish.
+type Keys map[string]string
+
+// Authenticate allows a publish whose credential is the secret of its key.
+// The identity is the key.
+func (k Keys) Authenticate(r Request) (string, error) {
+	if r.Credential == "" {
+		return "", ErrNoCredential
+	}
+	secret, ok := k[r.Key]
+	// compared even for unknown keys, so the timing tells nothing
+	equal := subtle.ConstantTimeCompare([]byte(secret), []byte(r.Credential)) == 1
+	if !ok || !equal {
+		return "", ErrDenied
+	}
+	return r.Key, nil
+}
+
+// JWT allows publishes presenting a JWT signed with HS256. The token must
+// carry the stream key it is for in its stream claim; expiry (exp) and
+// not-before (nbf) are checked when present. The identity is the subject
+// (sub), else the stream key.
+type JWT struct {
+	Secret []byte
+	// Leeway is the clock difference tolerated on exp and nbf
+	Leeway time.Duration
+	// Now is the clock, time.Now when nil
+	Now func() time.Time
+}
+
+// Claims are the JWT claims the server reads
+type Claims struct {
+	Subject   string   `json:"sub,omitempty"`
+	Stream    string   `json:"stream,omitempty"`
+	ExpiresAt *float64 `json:"exp,omitempty"`
+	NotBefore *float64 `json:"nbf,omitempty"`
+}
+
+func (j *JWT) now() time.Time {
+	if j.Now != nil {
+		return j.Now()
+	}
+	return time.Now()
+}
+
+// Authenticate verifies the token of r
+func (j *JWT) Authenticate(r Request) (string, error) {
+	if r.Credential == "" {
+		return "", ErrNoCredential
+	}
+	claims, err := j.Verify(r.Credential)
+	if err != nil {
+		return "", err
+	}
+	if claims.Stream != r.Key {
+		return claims.Subject, fmt.Errorf("%w: token is for stream %q", ErrDenied, claims.Stream)
+	}
+	if claims.Subject == "" {
+		return r.Key, nil
+	}
+	return claims.Subject, nil
+}
+
+// Verify checks the signature and validity period of token and returns its
+// claims
+func (j *JWT) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: not a JWT", ErrDenied)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	// the algorithm is fixed by the server, never chosen by the token
+	if header.Alg != "HS256" {
+		return nil, fmt.Errorf("%w: algorithm %q, want HS256", ErrDenied, header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad signature encoding", ErrDenied)
+	}
+	mac := hmac.New(sha256.New, j.Secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, fmt.Errorf("%w: bad signature", ErrDenied)
+	}
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	now := j.now()
+	if claims.ExpiresAt != nil && now.After(unixTime(*claims.ExpiresAt).Add(j.Leeway)) {
+		return nil, fmt.Errorf("%w: token expired", ErrDenied)
+	}
+	if claims.NotBefore != nil && now.Add(j.Leeway).Before(unixTime(*claims.NotBefore)) {
+		return nil, fmt.Errorf("%w: token not valid yet", ErrDenied)
+	}
+	return &claims, nil
+}
+
+// Sign returns an HS256 JWT of claims, for tools and tests that issue
+// publish tokens
+func (j *JWT) Sign(claims Claims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) +
+		"." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, j.Secret)
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err == nil {
+		err = json.Unmarshal(data, v)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: malformed token", ErrDenied)
+	}
+	return nil
+}
+
+func unixTime(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
@@ -0,0 +1,78 @@
+package pubauth
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeys(t *testing.T) {
+	keys := Keys{"live-a": "s3cret"}
+	if identity, err := keys.Authenticate(Request{Key: "live-a", Credential: "s3cret"}); err != nil || identity != "live-a" {
+		t.Fatalf("authenticate = %q, %v", identity, err)
+	}
+	for _, r := range []Request{
+		{Key: "live-a", Credential: "wrong"},
+		{Key: "live-b", Credential: "s3cret"},
+		// the secret of an unknown key is empty, never a match
+		{Key: "live-b", Credential: " "},
+	} {
+		if _, err := keys.Authenticate(r); err != ErrDenied {
+			t.Errorf("%+v: err = %v", r, err)
+		}
+	}
+	if _, err := keys.Authenticate(Request{Key: "live-a"}); err != ErrNoCredential {
+		t.Fatalf("no credential err = %v", err)
+	}
+}
+
+func TestJWT(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	j := &JWT{Secret: []byte("shared"), Leeway: 30 * time.Second, Now: func() time.Time { return now }}
+	seconds := func(d time.Duration) *float64 {
+		v := float64(now.Add(d).Unix())
+		return &v
+	}
+	sign := func(c Claims) string {
+		token, err := j.Sign(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	valid := sign(Claims{Subject: "encoder-1", Stream: "live-a", ExpiresAt: seconds(time.Minute)})
+	if identity, err := j.Authenticate(Request{Key: "live-a", Credential: valid}); err != nil || identity != "encoder-1" {
+		t.Fatalf("authenticate = %q, %v", identity, err)
+	}
+	if identity, err := j.Authenticate(Request{Key: "live-a", Credential: sign(Claims{Stream: "live-a"})}); err != nil || identity != "live-a" {
+		t.Fatalf("without subject = %q, %v", identity, err)
+	}
+
+	parts := strings.Split(valid, ".")
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + parts[1] + "."
+	other := (&JWT{Secret: []byte("other")})
+	forged, _ := other.Sign(Claims{Stream: "live-a"})
+	for name, token := range map[string]string{
+		"wrong stream": sign(Claims{Stream: "live-b"}),
+		"no stream":    sign(Claims{Subject: "encoder-1"}),
+		"expired":      sign(Claims{Stream: "live-a", ExpiresAt: seconds(-time.Minute)}),
+		"not yet":      sign(Claims{Stream: "live-a", NotBefore: seconds(time.Minute)}),
+		"alg none":     none,
+		"forged":       forged,
+		"tampered":     parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"stream":"live-a","sub":"admin"}`)) + "." + parts[2],
+		"garbage":      "not-a-token",
+	} {
+		if _, err := j.Authenticate(Request{Key: "live-a", Credential: token}); !errors.Is(err, ErrDenied) {
+			t.Errorf("%s: err = %v", name, err)
+		}
+	}
+
+	// within the leeway
+	skewed := sign(Claims{Stream: "live-a", ExpiresAt: seconds(-10 * time.Second), NotBefore: seconds(10 * time.Second)})
+	if _, err := j.Authenticate(Request{Key: "live-a", Credential: skewed}); err != nil {
+		t.Fatalf("within leeway: %v", err)
+	}
+}
@@ -0,0 +1,321 @@
+// Package publisher publishes a local media file or a test pattern to the
+// server with a pion/webrtc peer connection, over the signaling of package
+// client, for integration tests and headless ingest. The media is encoded
+// by a GStreamer pipeline to H.264 and Opus, the codecs the server takes.
+package publisher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	gstreamer "github.com/notedit/gstreamer-go"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// ErrSourceEnded ends a publication whose file was published to its end
+var ErrSourceEnded = errors.New("publisher: source ended")
+
+// the launch descriptions of the sources, their video completed with its
+// size, framerate, bitrate in kbps and keyframe interval in frames
+const (
+	patternVideo = "videotestsrc is-live=true pattern=ball ! video/x-raw,width=%d,height=%d,framerate=%d/1 ! timeoverlay ! videoconvert ! "
+	patternAudio = "audiotestsrc is-live=true wave=sine freq=440 ! "
+	fileVideo    = "filesrc location=%q ! decodebin name=dec dec. ! queue ! videoconvert ! videoscale ! videorate ! video/x-raw,width=%d,height=%d,framerate=%d/1 ! "
+	fileAudio    = "dec. ! queue ! "
+	videoEncoder = "x264enc tune=zerolatency speed-preset=veryfast bitrate=%d key-int-max=%d ! video/x-h264,profile=constrained-baseline ! h264parse config-interval=-1 ! video/x-h264,stream-format=byte-stream,alignment=au ! appsink name=videosink "
+	audioEncoder = "audioconvert ! audioresample ! audio/x-raw,rate=48000,channels=2 ! opusenc frame-size=20 ! appsink name=audiosink"
+)
+
+// opusFrame is the duration of the Opus frames of audioEncoder
+const opusFrame = 20 * time.Millisecond
+
+// Source is the media published
+type Source struct {
+	// File is the path of the media file published, decoded whatever its
+	// format; a moving test pattern with a tone when empty
+	File string
+	// Width and Height are the size of the video, 1280x720 by default
+	Width, Height int
+	// Framerate is the frames per second of the video, 30 by default
+	Framerate int
+	// Bitrate is the bitrate of the video in kbps, 2000 by default
+	Bitrate int
+	// NoAudio publishes the video alone, e.g. of a file without audio
+	NoAudio bool
+}
+
+// withDefaults is s with the defaults of the fields left zero
+func (s Source) withDefaults() Source {
+	if s.Width == 0 && s.Height == 0 {
+		s.Width, s.Height = 1280, 720
+	}
+	if s.Framerate == 0 {
+		s.Framerate = 30
+	}
+	if s.Bitrate == 0 {
+		s.Bitrate = 2000
+	}
+	return s
+}
+
+// launch is the launch description of the pipeline encoding s, a keyframe
+// every two seconds
+func (s Source) launch() (string, error) {
+	s = s.withDefaults()
+	if s.Width <= 0 || s.Height <= 0 || s.Width%2 != 0 || s.Height%2 != 0 {
+		return "", fmt.Errorf("publisher: %dx%d is not an even size", s.Width, s.Height)
+	}
+	if s.Framerate <= 0 || s.Bitrate <= 0 {
+		return "", fmt.Errorf("publisher: the framerate and the bitrate must be positive")
+	}
+	if strings.ContainsAny(s.File, "\"\\") {
+		return "", fmt.Errorf("publisher: %q does not fit in a pipeline", s.File)
+	}
+	var launch string
+	if s.File == "" {
+		launch = fmt.Sprintf(patternVideo, s.Width, s.Height, s.Framerate)
+	} else {
+		launch = fmt.Sprintf(fileVideo, s.File, s.Width, s.Height, s.Framerate)
+	}
+	launch += fmt.Sprintf(videoEncoder, s.Bitrate, 2*s.Framerate)
+	if s.NoAudio {
+		return strings.TrimSpace(launch), nil
+	}
+	if s.File == "" {
+		return launch + patternAudio + audioEncoder, nil
+	}
+	return launch + fileAudio + audioEncoder, nil
+}
+
+// Options configures a publication, see Publish
+type Options struct {
+	// URL is the signaling endpoint of the server, e.g.
+	// ws://localhost:9000/channel
+	URL string
+	// Header is sent with the websocket handshake, e.g. its Authorization
+	Header http.Header
+	// Offer carries the stream key and the other fields of the offer; its
+	// Sdp is the one of the peer connection
+	Offer client.Offer
+	// ICEServers are those of the peer connection, none by default as the
+	// server answers with its own candidates
+	ICEServers []webrtc.ICEServer
+	Source     Source
+}
+
+// Publication is a stream published, until Close or the end of its source
+// or connection
+type Publication struct {
+	// Answer is the answer of the server, with its session
+	Answer *client.Answer
+
+	signaling *client.Client
+	pc        *webrtc.PeerConnection
+	pipeline  *gstreamer.Pipeline
+	videosink *gstreamer.Element
+	audiosink *gstreamer.Element
+
+	once sync.Once
+	done chan struct{}
+	err  error
+}
+
+// Publish connects to the server, negotiates the publish of opts.Offer's
+// stream key and starts sending the media of opts.Source
+func Publish(ctx context.Context, opts Options) (*Publication, error) {
+	launch, err := opts.Source.launch()
+	if err != nil {
+		return nil, err
+	}
+	pc, video, audio, err := newPeerConnection(opts.ICEServers, opts.Offer.StreamID, !opts.Source.NoAudio)
+	if err != nil {
+		return nil, err
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err == nil {
+		err = pc.SetLocalDescription(offer)
+	}
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	// the offer carries every candidate, the server taking no trickle
+	select {
+	case <-webrtc.GatheringCompletePromise(pc):
+	case <-ctx.Done():
+		pc.Close()
+		return nil, ctx.Err()
+	}
+
+	signaling, err := client.Dial(ctx, opts.URL, opts.Header)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	o := opts.Offer
+	o.Sdp = pc.LocalDescription().SDP
+	answer, err := signaling.Publish(ctx, o)
+	if err == nil {
+		err = pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer.Sdp})
+	}
+	if err != nil {
+		signaling.Close(ctx)
+		pc.Close()
+		return nil, err
+	}
+
+	pipeline, err := gstreamer.New(launch)
+	if err != nil {
+		signaling.Close(ctx)
+		pc.Close()
+		return nil, err
+	}
+	p := &Publication{
+		Answer:    answer,
+		signaling: signaling,
+		pc:        pc,
+		pipeline:  pipeline,
+		videosink: pipeline.FindElement("videosink"),
+		audiosink: pipeline.FindElement("audiosink"),
+		done:      make(chan struct{}),
+	}
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			p.end(fmt.Errorf("publisher: peer connection %s", state))
+		}
+	})
+	go p.send(video, p.videosink.Poll(), time.Second/time.Duration(opts.Source.withDefaults().Framerate))
+	if audio != nil {
+		go p.send(audio, p.audiosink.Poll(), opusFrame)
+	}
+	go func() {
+		<-signaling.Done()
+		p.end(signaling.Err())
+	}()
+	pipeline.Start()
+	return p, nil
+}
+
+// newPeerConnection is a peer connection sending the tracks of streamID,
+// H.264 and, with audio, Opus, offering no other codec
+func newPeerConnection(servers []webrtc.ICEServer, streamID string, audio bool) (*webrtc.PeerConnection, *webrtc.TrackLocalStaticSample, *webrtc.TrackLocalStaticSample, error) {
+	h264 := webrtc.RTPCodecCapability{
+		MimeType:     webrtc.MimeTypeH264,
+		ClockRate:    90000,
+		SDPFmtpLine:  "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+		RTCPFeedback: []webrtc.RTCPFeedback{{Type: "nack"}, {Type: "nack", Parameter: "pli"}, {Type: "ccm", Parameter: "fir"}, {Type: "goog-remb"}},
+	}
+	opus := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: "minptime=10;useinbandfec=1"}
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterCodec(webrtc.RTPCodecParameters{RTPCodecCapability: h264, PayloadType: 102}, webrtc.RTPCodecTypeVideo); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := m.RegisterCodec(webrtc.RTPCodecParameters{RTPCodecCapability: opus, PayloadType: 111}, webrtc.RTPCodecTypeAudio); err != nil {
+		return nil, nil, nil, err
+	}
+	pc, err := webrtc.NewAPI(webrtc.WithMediaEngine(m)).NewPeerConnection(webrtc.Configuration{ICEServers: servers})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	video, err := addTrack(pc, h264, "video", streamID)
+	if err != nil {
+		pc.Close()
+		return nil, nil, nil, err
+	}
+	if !audio {
+		return pc, video, nil, nil
+	}
+	sound, err := addTrack(pc, opus, "audio", streamID)
+	if err != nil {
+		pc.Close()
+		return nil, nil, nil, err
+	}
+	return pc, video, sound, nil
+}
+
+// addTrack adds a track of codec sent only, reading its RTCP for the
+// interceptors of pc
+func addTrack(pc *webrtc.PeerConnection, codec webrtc.RTPCodecCapability, id, streamID string) (*webrtc.TrackLocalStaticSample, error) {
+	track, err := webrtc.NewTrackLocalStaticSample(codec, id, streamID)
+	if err != nil {
+		return nil, err
+	}
+	sender, err := pc.AddTransceiverFromTrack(track, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			if _, _, err := sender.Sender().Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	return track, nil
+}
+
+// send writes the frames of an appsink to track, each lasting duration,
+// ending the publication with ErrSourceEnded when they end
+func (p *Publication) send(track *webrtc.TrackLocalStaticSample, frames <-chan []byte, duration time.Duration) {
+	for frame := range frames {
+		if err := track.WriteSample(media.Sample{Data: frame, Duration: duration}); err != nil {
+			p.end(err)
+			return
+		}
+	}
+	p.end(ErrSourceEnded)
+}
+
+// end ends the publication for err, the first reason kept
+func (p *Publication) end(err error) {
+	p.once.Do(func() {
+		p.err = err
+		close(p.done)
+	})
+}
+
+// Events delivers the messages of the server other than the answer, e.g.
+// CmdMigrate, see client.Client.Events
+func (p *Publication) Events() <-chan client.Message {
+	return p.signaling.Events()
+}
+
+// Done is closed when the publication ends, see Err
+func (p *Publication) Done() <-chan struct{} {
+	return p.done
+}
+
+// Err is why the publication ended: ErrSourceEnded, the error of the
+// connection to the server, e.g. a close of the server, or nil after Close
+func (p *Publication) Err() error {
+	select {
+	case <-p.done:
+		return p.err
+	default:
+		return nil
+	}
+}
+
+// Close stops the media and closes the connection to the server, which
+// then ends the output of the stream
+func (p *Publication) Close(ctx context.Context) error {
+	p.end(nil)
+	p.videosink.Stop()
+	if p.audiosink != nil {
+		p.audiosink.Stop()
+	}
+	p.pipeline.Stop()
+	err := p.signaling.Close(ctx)
+	if pcErr := p.pc.Close(); err == nil {
+		err = pcErr
+	}
+	return err
+}
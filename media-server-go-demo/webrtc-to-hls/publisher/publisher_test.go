@@ -0,0 +1,30 @@
+package publisher
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSourceLaunch(t *testing.T) {
+	launch, err := Source{}.launch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, part := range []string{"videotestsrc", "width=1280,height=720,framerate=30/1", "bitrate=2000 key-int-max=60", "audiotestsrc", "opusenc"} {
+		if !strings.Contains(launch, part) {
+			t.Fatalf("%q not in %s", part, launch)
+		}
+	}
+	launch, err = Source{File: "clips/foo bar.mp4", Width: 640, Height: 360, Framerate: 25, NoAudio: true}.launch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(launch, `filesrc location="clips/foo bar.mp4" ! decodebin`) || strings.Contains(launch, "opusenc") || !strings.HasSuffix(launch, "appsink name=videosink") {
+		t.Fatalf("file launch %s", launch)
+	}
+	for _, s := range []Source{{Width: 641, Height: 360}, {Framerate: -1}, {File: `a"b.mp4`}} {
+		if _, err := s.launch(); err == nil {
+			t.Fatalf("source %+v accepted", s)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+// Package restream keeps the third-party RTMP destinations, e.g. YouTube,
+// Twitch or Facebook ingest points, live streams are pushed to, and the
+// status of each push.
+//
+// Destinations are configured per stream key and outlive sessions: a push
+// starts whenever the key goes live. A push that fails is retried with a
+// backoff that grows with the failures in a row; a push that held for
+// StableAfter starts over from the shortest delay.
+package restream
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrBadURL  = errors.New("restream: url must be an rtmp:// or rtmps:// url")
+	ErrBadKey  = errors.New("restream: key must be non empty, without spaces or quotes")
+	ErrUnknown = errors.New("restream: no such destination")
+	ErrTooMany = errors.New("restream: too many destinations for the stream")
+)
+
+var (
+	// MaxPerStream bounds the destinations of a stream key
+	MaxPerStream = 8
+	// StableAfter is how long a push must hold to reset the backoff
+	StableAfter = 30 * time.Second
+	// MinBackoff and MaxBackoff bound the delay before a retry
+	MinBackoff = time.Second
+	MaxBackoff = time.Minute
+)
+
+// unsafeChars may not appear in urls and keys, which end up quoted in a
+// launch description
+const unsafeChars = " \t\r\n\"'!"
+
+// State of a push to a destination
+type State string
+
+const (
+	// StateIdle: the stream is not live
+	StateIdle State = "idle"
+	// StateConnecting: a push is starting
+	StateConnecting State = "connecting"
+	// StateStreaming: the push runs without error so far
+	StateStreaming State = "streaming"
+	// StateReconnecting: the push failed and waits to be retried
+	StateReconnecting State = "reconnecting"
+)
+
+// Status is the status of the push to a destination
+type Status struct {
+	State State     `json:"state"`
+	Since time.Time `json:"since"`
+	// Reconnects counts the retries since the stream went live
+	Reconnects int    `json:"reconnects"`
+	LastError  string `json:"lastError,omitempty"`
+	// failures are the failures in a row, for the backoff
+	failures int
+}
+
+// Destination is an RTMP ingest point a stream key is pushed to
+type Destination struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	// URL is the ingest url without the stream key of the platform, e.g.
+	// rtmp://a.rtmp.youtube.com/live2
+	URL string `json:"url"`
+	key string
+
+	mu      sync.Mutex
+	status  Status
+	removed chan struct{}
+}
+
+// New validates a destination pushing to url with the stream key of the
+// platform, key
+func New(name, rawURL, key string) (*Destination, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "rtmp" && u.Scheme != "rtmps") || u.Host == "" || strings.ContainsAny(rawURL, unsafeChars) {
+		return nil, ErrBadURL
+	}
+	if key == "" || strings.ContainsAny(key, unsafeChars) {
+		return nil, ErrBadKey
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	return &Destination{
+		ID:      hex.EncodeToString(id),
+		Name:    name,
+		URL:     strings.TrimRight(rawURL, "/"),
+		key:     key,
+		status:  Status{State: StateIdle, Since: time.Now()},
+		removed: make(chan struct{}),
+	}, nil
+}
+
+// Target is the url pushed to, the key of the platform included
+func (d *Destination) Target() string {
+	return d.URL + "/" + d.key
+}
+
+// KeyHint is the key of the platform as listed: its last four characters
+func (d *Destination) KeyHint() string {
+	if len(d.key) <= 4 {
+		return "****"
+	}
+	return "****" + d.key[len(d.key)-4:]
+}
+
+// Removed is closed once the destination is removed
+func (d *Destination) Removed() <-chan struct{} {
+	return d.removed
+}
+
+// Status returns the status of the push
+func (d *Destination) Status() Status {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.status
+}
+
+func (d *Destination) set(state State, now time.Time) {
+	if d.status.State != state {
+		d.status.State, d.status.Since = state, now
+	}
+}
+
+// Connecting records that a push starts
+func (d *Destination) Connecting(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.set(StateConnecting, now)
+}
+
+// Streaming records that the push started
+func (d *Destination) Streaming(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.set(StateStreaming, now)
+}
+
+// Failed records that the push failed with err and returns how long to
+// wait before retrying it
+func (d *Destination) Failed(err error, now time.Time) time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.status.State == StateStreaming && now.Sub(d.status.Since) >= StableAfter {
+		d.status.failures = 0
+	}
+	d.status.failures++
+	d.status.Reconnects++
+	if err != nil {
+		d.status.LastError = err.Error()
+	}
+	d.set(StateReconnecting, now)
+	return Backoff(d.status.failures)
+}
+
+// Idle records that the stream is no longer live; the next push starts
+// its reconnect count over
+func (d *Destination) Idle(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.set(StateIdle, now)
+	d.status.failures, d.status.Reconnects = 0, 0
+}
+
+// Backoff is the delay before the retry after failures in a row, doubling
+// from MinBackoff up to MaxBackoff
+func Backoff(failures int) time.Duration {
+	delay := MinBackoff
+	for i := 1; i < failures && delay < MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > MaxBackoff {
+		delay = MaxBackoff
+	}
+	return delay
+}
+
+// Registry holds the destinations of every stream key
+type Registry struct {
+	mu           sync.Mutex
+	destinations map[string][]*Destination
+}
+
+func NewRegistry() *Registry {
+	return &Registry{destinations: map[string][]*Destination{}}
+}
+
+// Add adds d to the destinations of key
+func (r *Registry) Add(key string, d *Destination) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.destinations[key]) >= MaxPerStream {
+		return ErrTooMany
+	}
+	r.destinations[key] = append(r.destinations[key], d)
+	return nil
+}
+
+// Remove removes the destination id of key, closing its Removed
+func (r *Registry) Remove(key, id string) (*Destination, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := r.destinations[key]
+	for i, d := range list {
+		if d.ID == id {
+			r.destinations[key] = append(list[:i:i], list[i+1:]...)
+			if len(r.destinations[key]) == 0 {
+				delete(r.destinations, key)
+			}
+			close(d.removed)
+			return d, nil
+		}
+	}
+	return nil, ErrUnknown
+}
+
+// List returns the destinations of key, by name then id
+func (r *Registry) List(key string) []*Destination {
+	r.mu.Lock()
+	list := append([]*Destination(nil), r.destinations[key]...)
+	r.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
@@ -0,0 +1,100 @@
+package restream
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	d, err := New("youtube", "rtmp://a.rtmp.youtube.com/live2/", "abcd-efgh-1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Target() != "rtmp://a.rtmp.youtube.com/live2/abcd-efgh-1234" || d.KeyHint() != "****1234" || len(d.ID) != 16 {
+		t.Fatalf("destination = %s %s %s", d.ID, d.Target(), d.KeyHint())
+	}
+	if _, err := New("", "rtmps://live-api-s.facebook.com:443/rtmp", "FB-1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct{ url, key string }{
+		{"http://example.com/live", "k"},
+		{"rtmp:///live", "k"},
+		{"rtmp://example.com/live location=x", "k"},
+		{"rtmp://example.com/live", ""},
+		{"rtmp://example.com/live", "k\" ! fakesink"},
+	} {
+		if _, err := New("", c.url, c.key); err == nil {
+			t.Errorf("%q %q accepted", c.url, c.key)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for failures, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 4: 8 * time.Second, 7: time.Minute, 40: time.Minute} {
+		if got := Backoff(failures); got != want {
+			t.Errorf("backoff after %d = %s", failures, got)
+		}
+	}
+}
+
+func TestStatus(t *testing.T) {
+	d, _ := New("twitch", "rtmp://live.twitch.tv/app", "live_123")
+	now := time.Now()
+	d.Connecting(now)
+	if delay := d.Failed(errors.New("refused"), now); delay != time.Second {
+		t.Fatalf("first delay = %s", delay)
+	}
+	d.Connecting(now)
+	d.Streaming(now)
+	if delay := d.Failed(nil, now.Add(time.Second)); delay != 2*time.Second {
+		t.Fatalf("second delay = %s", delay)
+	}
+	// a push that held resets the backoff
+	d.Streaming(now)
+	if delay := d.Failed(nil, now.Add(StableAfter)); delay != time.Second {
+		t.Fatalf("delay after a stable push = %s", delay)
+	}
+	if s := d.Status(); s.State != StateReconnecting || s.Reconnects != 3 || s.LastError != "refused" {
+		t.Fatalf("status = %+v", s)
+	}
+	d.Idle(now)
+	if s := d.Status(); s.State != StateIdle || s.Reconnects != 0 {
+		t.Fatalf("idle status = %+v", s)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	b, _ := New("b", "rtmp://b.example/live", "kb")
+	a, _ := New("a", "rtmp://a.example/live", "ka")
+	r.Add("main", b)
+	r.Add("main", a)
+	if list := r.List("main"); len(list) != 2 || list[0] != a {
+		t.Fatalf("list = %v", list)
+	}
+	if _, err := r.Remove("main", "nope"); err != ErrUnknown {
+		t.Fatalf("unknown removed: %v", err)
+	}
+	if d, err := r.Remove("main", a.ID); err != nil || d != a {
+		t.Fatalf("remove = %v, %v", d, err)
+	}
+	select {
+	case <-a.Removed():
+	default:
+		t.Fatal("removed not closed")
+	}
+	if list := r.List("main"); len(list) != 1 || list[0] != b {
+		t.Fatalf("list after remove = %v", list)
+	}
+	for i := 1; i < MaxPerStream; i++ {
+		d, _ := New("", "rtmp://example/live", "k")
+		if err := r.Add("main", d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d, _ := New("", "rtmp://example/live", "k")
+	if err := r.Add("main", d); err != ErrTooMany {
+		t.Fatalf("add over the limit = %v", err)
+	}
+}
@@ -0,0 +1,199 @@
+// Package scratch hands sessions private temporary directories under a
+// common root. A directory is created on first use, capped in size, and
+// removed with its session; directories left behind by a crash are swept
+// when the process starts.
+package scratch
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ErrQuotaExceeded is wrapped by the QuotaError of an allocation that does
+// not fit the directory cap
+var ErrQuotaExceeded = errors.New("scratch: session quota exceeded")
+
+// ErrRemoved is returned when using a directory after its session ended
+var ErrRemoved = errors.New("scratch: directory removed")
+
+// QuotaError is returned when a write or reservation would take a directory
+// over its cap
+type QuotaError struct {
+	Dir       string
+	Limit     int64
+	Used      int64
+	Requested int64
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("scratch: %s: %d bytes requested with %d of %d used", e.Dir, e.Requested, e.Used, e.Limit)
+}
+
+func (e *QuotaError) Unwrap() error {
+	return ErrQuotaExceeded
+}
+
+// Root is the directory session scratch directories are created under
+type Root struct {
+	path  string
+	limit int64
+}
+
+// NewRoot returns the root at path, capping each directory at limit bytes or
+// leaving them uncapped when limit is not positive
+func NewRoot(path string, limit int64) *Root {
+	return &Root{path: path, limit: limit}
+}
+
+// Sweep removes the directories of the root whose name live does not
+// report as a running session
+func (r *Root) Sweep(live func(name string) bool) error {
+	entries, err := ioutil.ReadDir(r.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || live(entry.Name()) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(r.path, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Dir returns the scratch directory of a session; nothing is created on disk
+// until it is first written to
+func (r *Root) Dir(name string) *Dir {
+	return &Dir{path: filepath.Join(r.path, name), limit: r.limit}
+}
+
+// Dir is the scratch directory of one session
+type Dir struct {
+	path  string
+	limit int64
+
+	lock    sync.Mutex
+	created bool
+	removed bool
+	used    int64
+}
+
+// ensure creates the directory on first use; called with the lock held
+func (d *Dir) ensure() error {
+	if d.removed {
+		return ErrRemoved
+	}
+	if d.created {
+		return nil
+	}
+	if err := os.MkdirAll(d.path, 0700); err != nil {
+		return err
+	}
+	d.created = true
+	return nil
+}
+
+// Reserve accounts n bytes written by something other than Create, e.g. a
+// pipeline given a Path
+func (d *Dir) Reserve(n int64) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.removed {
+		return ErrRemoved
+	}
+	if d.limit > 0 && d.used+n > d.limit {
+		return &QuotaError{Dir: d.path, Limit: d.limit, Used: d.used, Requested: n}
+	}
+	d.used += n
+	return nil
+}
+
+// Release gives back n bytes, e.g. after deleting a file
+func (d *Dir) Release(n int64) {
+	d.lock.Lock()
+	d.used -= n
+	if d.used < 0 {
+		d.used = 0
+	}
+	d.lock.Unlock()
+}
+
+// Used returns the bytes accounted to the directory
+func (d *Dir) Used() int64 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.used
+}
+
+// Path returns the path of name inside the directory, creating the
+// directory. name must be a plain relative path that stays inside it.
+func (d *Dir) Path(name string) (string, error) {
+	clean := filepath.Clean(name)
+	if filepath.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("scratch: invalid name %q", name)
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err := d.ensure(); err != nil {
+		return "", err
+	}
+	path := filepath.Join(d.path, clean)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// Create creates name in the directory; its writes count against the cap
+func (d *Dir) Create(name string) (*File, error) {
+	path, err := d.Path(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &File{File: f, dir: d}, nil
+}
+
+// Remove deletes the directory and everything in it. The directory cannot
+// be used afterwards.
+func (d *Dir) Remove() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.removed = true
+	d.used = 0
+	if !d.created {
+		return nil
+	}
+	return os.RemoveAll(d.path)
+}
+
+// File is a file created in a scratch directory
+type File struct {
+	*os.File
+	dir *Dir
+}
+
+// Write fails with a QuotaError, writing nothing, when p does not fit the cap
+func (f *File) Write(p []byte) (int, error) {
+	if err := f.dir.Reserve(int64(len(p))); err != nil {
+		return 0, err
+	}
+	n, err := f.File.Write(p)
+	if n < len(p) {
+		f.dir.Release(int64(len(p) - n))
+	}
+	return n, err
+}
@@ -0,0 +1,73 @@
+package scratch
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDir(t *testing.T) {
+	base, err := ioutil.TempDir("", "scratch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+	root := NewRoot(filepath.Join(base, "root"), 10)
+
+	d := root.Dir("session-1")
+	if _, err := os.Stat(filepath.Join(base, "root", "session-1")); !os.IsNotExist(err) {
+		t.Fatal("created before first use")
+	}
+	f, err := d.Create("capture/part.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("12345678")); err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write([]byte("abc"))
+	var quota *QuotaError
+	if !errors.As(err, &quota) || !errors.Is(err, ErrQuotaExceeded) || quota.Used != 8 || quota.Requested != 3 {
+		t.Fatalf("err = %v", err)
+	}
+	f.Close()
+	if _, err := d.Path("../escape"); err == nil {
+		t.Fatal("path outside the directory")
+	}
+
+	if err := d.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(base, "root", "session-1")); !os.IsNotExist(err) {
+		t.Fatal("directory left after Remove")
+	}
+	if _, err := d.Create("again"); err != ErrRemoved {
+		t.Fatalf("create after remove err = %v", err)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	base, err := ioutil.TempDir("", "scratch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+	root := NewRoot(base, 0)
+	for _, name := range []string{"stale", "live"} {
+		if _, err := root.Dir(name).Path("file"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := root.Sweep(func(name string) bool { return name == "live" }); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := ioutil.ReadDir(base)
+	if len(entries) != 1 || entries[0].Name() != "live" {
+		t.Fatalf("entries = %v", entries)
+	}
+	if err := NewRoot(filepath.Join(base, "missing"), 0).Sweep(func(string) bool { return false }); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,83 @@
+// Package scte35 writes the SCTE-35 splice_info_section of the splice
+// points of ad breaks, as HLS playlists carry them in the SCTE35-OUT and
+// SCTE35-IN attributes of date ranges for ad insertion services.
+package scte35
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// ticks is the 90kHz clock of splice times and durations
+const ticks = 90000
+
+// spliceInsert is the splice_command_type of splice_insert()
+const spliceInsert = 0x05
+
+// Insert is a splice_insert() of the immediate kind: the splice happens at
+// the segment the section is listed with
+type Insert struct {
+	EventID uint32
+	// Out leaves the network for a break, else it returns to it
+	Out bool
+	// Duration is the planned length of the break, zero when unknown;
+	// breaks with a duration return automatically
+	Duration time.Duration
+}
+
+// Section writes the splice_info_section of the insert, unencrypted and
+// without descriptors
+func (i Insert) Section() []byte {
+	command := binary.BigEndian.AppendUint32(nil, i.EventID)
+	// not cancelled
+	command = append(command, 0x7f)
+	// program splice, immediate
+	flags := byte(0x40 | 0x10 | 0x0f)
+	if i.Out {
+		flags |= 0x80
+	}
+	if i.Duration > 0 {
+		flags |= 0x20
+	}
+	command = append(command, flags)
+	if i.Duration > 0 {
+		// auto return, six reserved bits, then 33 bits of duration
+		d := uint64(i.Duration) * ticks / uint64(time.Second)
+		command = append(command, 0x80|0x7e|byte(d>>32&1))
+		command = binary.BigEndian.AppendUint32(command, uint32(d))
+	}
+	// unique_program_id, avail_num and avails_expected
+	command = append(command, 0, 0, 0, 0)
+
+	section := []byte{0xfc, 0, 0}
+	// protocol_version, then unencrypted with no pts_adjustment
+	section = append(section, 0, 0, 0, 0, 0, 0)
+	// cw_index, tier 0xfff and the 12 bits of the command length
+	section = append(section, 0, 0xff, 0xf0|byte(len(command)>>8&0xf), byte(len(command)))
+	section = append(section, spliceInsert)
+	section = append(section, command...)
+	// descriptor_loop_length
+	section = append(section, 0, 0)
+	// section_length counts from after itself to the end of the CRC;
+	// sap_type is 3, not specified
+	length := len(section) - 3 + 4
+	section[1] = 0x30 | byte(length>>8&0xf)
+	section[2] = byte(length)
+	return binary.BigEndian.AppendUint32(section, CRC(section))
+}
+
+// CRC is the MPEG-2 CRC-32 sections end with
+func CRC(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,30 @@
+package scte35
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+func TestCRC(t *testing.T) {
+	if crc := CRC([]byte("123456789")); crc != 0x0376e6e7 {
+		t.Fatalf("crc %08x", crc)
+	}
+}
+
+func TestSection(t *testing.T) {
+	out := Insert{EventID: 7, Out: true, Duration: 30 * time.Second}.Section()
+	want, _ := hex.DecodeString("fc302000000000000000fff00f05" + "00000007" + "7f" + "ff" + "fe002932e0" + "00000000" + "0000")
+	if !bytes.Equal(out[:len(out)-4], want) {
+		t.Fatalf("section\n%x\nwant\n%x", out[:len(out)-4], want)
+	}
+	if CRC(out) != 0 {
+		t.Fatal("crc does not check")
+	}
+	in := Insert{EventID: 7}.Section()
+	want, _ = hex.DecodeString("fc301b00000000000000fff00a05" + "00000007" + "7f" + "5f" + "00000000" + "0000")
+	if !bytes.Equal(in[:len(in)-4], want) || CRC(in) != 0 {
+		t.Fatalf("return %x", in)
+	}
+}
@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// HTTP stores objects on an origin taking HTTP PUT ingest, such as Akamai
+// MSL or AWS Elemental MediaStore, as <Endpoint>/<name>. Header is sent with
+// every request, e.g. the credentials of the origin.
+type HTTP struct {
+	// Endpoint is the url objects are put below, e.g.
+	// https://ingest.example/live
+	Endpoint string
+	Header   http.Header
+	// Client sends the requests, http.DefaultClient when nil
+	Client *http.Client
+}
+
+func (h *HTTP) Name() string {
+	return h.Endpoint
+}
+
+// Put uploads body as name
+func (h *HTTP) Put(ctx context.Context, name string, body io.Reader, size int64, contentType string) error {
+	req, err := h.request(ctx, http.MethodPut, name, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType)
+	resp, err := h.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		detail, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("storage: put %s: %s %s", name, resp.Status, strings.TrimSpace(string(detail)))
+	}
+	return nil
+}
+
+// Get downloads name
+func (h *HTTP) Get(ctx context.Context, name string) ([]byte, error) {
+	req, err := h.request(ctx, http.MethodGet, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := h.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, ErrNotFound
+	case resp.StatusCode/100 != 2:
+		detail, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("storage: get %s: %s %s", name, resp.Status, strings.TrimSpace(string(detail)))
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, maxGet))
+}
+
+func (h *HTTP) request(ctx context.Context, method, name string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, strings.TrimRight(h.Endpoint, "/")+"/"+escapePath(strings.TrimLeft(name, "/")), body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range h.Header {
+		req.Header[name] = values
+	}
+	return req.WithContext(ctx), nil
+}
+
+func (h *HTTP) client() *http.Client {
+	if h.Client == nil {
+		return http.DefaultClient
+	}
+	return h.Client
+}
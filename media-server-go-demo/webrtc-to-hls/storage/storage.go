@@ -0,0 +1,145 @@
+// Package storage writes the files of an output, HLS segments, playlists and
+// recordings, to where they are served from: a directory, an S3-compatible
+// bucket, or an origin taking HTTP PUT. Backends only store objects; uploading them in the
+// background and retrying failures is left to the caller.
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Backend stores objects by name, a slash separated path
+type Backend interface {
+	// Name describes the backend in logs, e.g. s3://bucket
+	Name() string
+	// Put stores the size bytes of body as name, replacing any object of
+	// that name. Readers of name see the old object or the new one, never
+	// a part of it.
+	Put(ctx context.Context, name string, body io.Reader, size int64, contentType string) error
+	// Get returns the object name, ErrNotFound when there is none
+	Get(ctx context.Context, name string) ([]byte, error)
+}
+
+// ErrNotFound is returned by Get for a name nothing was stored as
+var ErrNotFound = errors.New("storage: object not found")
+
+// maxGet bounds the objects Get reads, playlists and segments
+const maxGet = 64 << 20
+
+// Disk stores objects below a directory, e.g. a mounted volume
+type Disk struct {
+	Root string
+}
+
+func (d *Disk) Name() string {
+	return d.Root
+}
+
+// Put writes body to a temporary file renamed to name once complete
+func (d *Disk) Put(ctx context.Context, name string, body io.Reader, size int64, contentType string) error {
+	target := filepath.Join(d.Root, filepath.FromSlash(path.Clean("/"+name)))
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(target), ".put-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), target)
+}
+
+func (d *Disk) Get(ctx context.Context, name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filepath.Join(d.Root, filepath.FromSlash(path.Clean("/"+name))))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+// ContentType is the content type of the object name by its extension
+func ContentType(name string) string {
+	switch path.Ext(name) {
+	case ".m3u8":
+		return "application/vnd.apple.mpegurl"
+	case ".ts":
+		return "video/mp2t"
+	case ".m4s", ".mp4":
+		return "video/mp4"
+	case ".mkv":
+		return "video/x-matroska"
+	case ".mpd":
+		return "application/dash+xml"
+	case ".vtt":
+		return "text/vtt"
+	case ".aac":
+		return "audio/aac"
+	}
+	return "application/octet-stream"
+}
+
+var uriAttribute = regexp.MustCompile(`URI="([^"]*)"`)
+
+// relative reports whether uri is relative to the playlist
+func relative(uri string) bool {
+	return !strings.Contains(uri, "://") && !strings.HasPrefix(uri, "/")
+}
+
+// RewritePlaylist returns the relative uris a playlist refers to, segments
+// and the URI attributes of tags such as EXT-X-MAP, in order, and the
+// playlist with those uris prefixed by base, e.g. the url of a CDN. The
+// playlist is returned as is when base is empty.
+func RewritePlaylist(playlist []byte, base string) ([]byte, []string) {
+	base = strings.TrimRight(base, "/")
+	var uris []string
+	prefix := func(uri string) string {
+		if !relative(uri) {
+			return uri
+		}
+		uris = append(uris, uri)
+		if base == "" {
+			return uri
+		}
+		return base + "/" + uri
+	}
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(playlist))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch trimmed := strings.TrimSpace(line); {
+		case trimmed == "":
+		case !strings.HasPrefix(trimmed, "#"):
+			line = prefix(trimmed)
+		case strings.HasPrefix(trimmed, "#EXT"):
+			line = uriAttribute.ReplaceAllStringFunc(line, func(attr string) string {
+				return `URI="` + prefix(uriAttribute.FindStringSubmatch(attr)[1]) + `"`
+			})
+		}
+		out.WriteString(line)
+		out.WriteByte('\n')
+	}
+	if base == "" {
+		return playlist, uris
+	}
+	return out.Bytes(), uris
+}
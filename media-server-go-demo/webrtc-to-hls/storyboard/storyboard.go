@@ -0,0 +1,228 @@
+// Package storyboard builds seek-preview sprite sheets from HLS segments:
+// JPEG strips of small frames plus a WebVTT file mapping time ranges to
+// sprite coordinates.
+package storyboard
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Segment is one media segment of a playlist
+type Segment struct {
+	URI      string
+	Duration float64
+}
+
+// ParsePlaylist reads the segments of an HLS media playlist
+func ParsePlaylist(r io.Reader) ([]Segment, error) {
+	var segments []Segment
+	var duration float64
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "#EXTINF:"):
+			value := strings.TrimPrefix(line, "#EXTINF:")
+			if i := strings.Index(value, ","); i >= 0 {
+				value = value[:i]
+			}
+			d, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("storyboard: bad EXTINF %q", line)
+			}
+			duration = d
+		case line == "" || strings.HasPrefix(line, "#"):
+		default:
+			segments = append(segments, Segment{URI: line, Duration: duration})
+			duration = 0
+		}
+	}
+	return segments, scanner.Err()
+}
+
+// Options controls the storyboard layout
+type Options struct {
+	// Interval is the number of seconds between thumbnails
+	Interval   float64
+	TileWidth  int
+	TileHeight int
+	Columns    int
+	Rows       int
+	// Name prefixes the artifacts: <Name>-000.jpg ... and <Name>.vtt
+	Name string
+}
+
+// DefaultOptions is one 160x90 frame every 10 seconds in 10x10 strips
+var DefaultOptions = Options{
+	Interval:   10,
+	TileWidth:  160,
+	TileHeight: 90,
+	Columns:    10,
+	Rows:       10,
+	Name:       "storyboard",
+}
+
+// Thumbnail is one tile: the frame taken from Segment shown for [Start, End)
+type Thumbnail struct {
+	Segment int
+	Start   float64
+	End     float64
+}
+
+// Plan picks a thumbnail every interval seconds, each taken from the start
+// (a keyframe) of the segment containing that time
+func Plan(segments []Segment, interval float64) []Thumbnail {
+	var total float64
+	for _, s := range segments {
+		total += s.Duration
+	}
+	if interval <= 0 || total <= 0 {
+		return nil
+	}
+
+	var thumbs []Thumbnail
+	var offset float64
+	segment := 0
+	for t := 0.0; t < total; t += interval {
+		for segment < len(segments)-1 && offset+segments[segment].Duration <= t {
+			offset += segments[segment].Duration
+			segment++
+		}
+		end := t + interval
+		if end > total {
+			end = total
+		}
+		thumbs = append(thumbs, Thumbnail{Segment: segment, Start: t, End: end})
+	}
+	return thumbs
+}
+
+// Extractor decodes one frame from the start of a segment file
+type Extractor interface {
+	Extract(path string, width, height int) (image.Image, error)
+}
+
+// StripName is the file name of strip n
+func (o Options) StripName(n int) string {
+	return fmt.Sprintf("%s-%03d.jpg", o.Name, n)
+}
+
+// VTTName is the file name of the WebVTT index
+func (o Options) VTTName() string {
+	return o.Name + ".vtt"
+}
+
+func (o Options) perStrip() int {
+	return o.Columns * o.Rows
+}
+
+// Generate writes the strips and the WebVTT index for the segments found
+// in dir. Strips already on disk are kept, so a failed run can be retried
+// without re-extracting them; the WebVTT file is written last and marks a
+// complete storyboard.
+func Generate(dir string, segments []Segment, opts Options, extractor Extractor) error {
+	thumbs := Plan(segments, opts.Interval)
+	if len(thumbs) == 0 {
+		return fmt.Errorf("storyboard: no media in %s", dir)
+	}
+
+	strips := (len(thumbs) + opts.perStrip() - 1) / opts.perStrip()
+	for n := 0; n < strips; n++ {
+		path := filepath.Join(dir, opts.StripName(n))
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+		first := n * opts.perStrip()
+		last := first + opts.perStrip()
+		if last > len(thumbs) {
+			last = len(thumbs)
+		}
+		if err := writeStrip(path, dir, segments, thumbs[first:last], opts, extractor); err != nil {
+			return err
+		}
+	}
+
+	return writeFile(filepath.Join(dir, opts.VTTName()), func(w io.Writer) error {
+		return WriteVTT(w, thumbs, opts)
+	})
+}
+
+func writeStrip(path string, dir string, segments []Segment, thumbs []Thumbnail, opts Options, extractor Extractor) error {
+	rows := (len(thumbs) + opts.Columns - 1) / opts.Columns
+	columns := opts.Columns
+	if len(thumbs) < columns {
+		columns = len(thumbs)
+	}
+	sprite := image.NewRGBA(image.Rect(0, 0, columns*opts.TileWidth, rows*opts.TileHeight))
+
+	frames := map[int]image.Image{}
+	for i, thumb := range thumbs {
+		frame, ok := frames[thumb.Segment]
+		if !ok {
+			var err error
+			frame, err = extractor.Extract(filepath.Join(dir, segments[thumb.Segment].URI), opts.TileWidth, opts.TileHeight)
+			if err != nil {
+				return fmt.Errorf("storyboard: %s: %v", segments[thumb.Segment].URI, err)
+			}
+			frames[thumb.Segment] = frame
+		}
+		x := (i % opts.Columns) * opts.TileWidth
+		y := (i / opts.Columns) * opts.TileHeight
+		draw.Draw(sprite, image.Rect(x, y, x+opts.TileWidth, y+opts.TileHeight), frame, frame.Bounds().Min, draw.Src)
+	}
+
+	return writeFile(path, func(w io.Writer) error {
+		return jpeg.Encode(w, sprite, &jpeg.Options{Quality: 75})
+	})
+}
+
+// WriteVTT writes the WebVTT index mapping each thumbnail time range to its
+// strip and tile coordinates
+func WriteVTT(w io.Writer, thumbs []Thumbnail, opts Options) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprint(bw, "WEBVTT\n")
+	for i, thumb := range thumbs {
+		strip := i / opts.perStrip()
+		tile := i % opts.perStrip()
+		x := (tile % opts.Columns) * opts.TileWidth
+		y := (tile / opts.Columns) * opts.TileHeight
+		fmt.Fprintf(bw, "\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n",
+			vttTime(thumb.Start), vttTime(thumb.End), opts.StripName(strip),
+			x, y, opts.TileWidth, opts.TileHeight)
+	}
+	return bw.Flush()
+}
+
+func vttTime(seconds float64) string {
+	ms := int64(seconds*1000 + 0.5)
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// writeFile writes through a temporary file so partial artifacts are never
+// mistaken for finished ones
+func writeFile(path string, write func(io.Writer) error) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
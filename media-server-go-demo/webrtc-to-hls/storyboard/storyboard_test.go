@@ -0,0 +1,120 @@
+package storyboard
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const playlist = `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:5
+#EXTINF:5.000,
+segment00000.ts
+#EXTINF:5.000,
+segment00001.ts
+#EXTINF:4.5,
+segment00002.ts
+`
+
+type fakeExtractor struct {
+	calls []string
+	fail  string
+}
+
+func (f *fakeExtractor) Extract(path string, width, height int) (image.Image, error) {
+	f.calls = append(f.calls, filepath.Base(path))
+	if filepath.Base(path) == f.fail {
+		return nil, errors.New("decode failed")
+	}
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	img.Set(0, 0, color.White)
+	return img, nil
+}
+
+func TestParsePlaylist(t *testing.T) {
+	segments, err := ParsePlaylist(strings.NewReader(playlist))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 3 || segments[2].URI != "segment00002.ts" || segments[2].Duration != 4.5 {
+		t.Fatalf("segments = %+v", segments)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	segments, _ := ParsePlaylist(strings.NewReader(playlist))
+	thumbs := Plan(segments, 4)
+	want := []Thumbnail{
+		{Segment: 0, Start: 0, End: 4},
+		{Segment: 0, Start: 4, End: 8},
+		{Segment: 1, Start: 8, End: 12},
+		{Segment: 2, Start: 12, End: 14.5},
+	}
+	if len(thumbs) != len(want) {
+		t.Fatalf("thumbs = %+v", thumbs)
+	}
+	for i := range want {
+		if thumbs[i] != want[i] {
+			t.Errorf("thumb %d = %+v, want %+v", i, thumbs[i], want[i])
+		}
+	}
+}
+
+func TestWriteVTT(t *testing.T) {
+	opts := Options{Interval: 10, TileWidth: 100, TileHeight: 50, Columns: 2, Rows: 1, Name: "sb"}
+	thumbs := []Thumbnail{{0, 0, 10}, {1, 10, 20}, {2, 20, 25}}
+	var buf bytes.Buffer
+	if err := WriteVTT(&buf, thumbs, opts); err != nil {
+		t.Fatal(err)
+	}
+	want := "WEBVTT\n" +
+		"\n00:00:00.000 --> 00:00:10.000\nsb-000.jpg#xywh=0,0,100,50\n" +
+		"\n00:00:10.000 --> 00:00:20.000\nsb-000.jpg#xywh=100,0,100,50\n" +
+		"\n00:00:20.000 --> 00:00:25.000\nsb-001.jpg#xywh=0,0,100,50\n"
+	if buf.String() != want {
+		t.Fatalf("vtt =\n%s", buf.String())
+	}
+}
+
+func TestGenerateResumes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storyboard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	segments, _ := ParsePlaylist(strings.NewReader(playlist))
+	opts := Options{Interval: 5, TileWidth: 16, TileHeight: 9, Columns: 2, Rows: 1, Name: "sb"}
+
+	// the second strip fails, the first one must survive
+	extractor := &fakeExtractor{fail: "segment00002.ts"}
+	if err := Generate(dir, segments, opts, extractor); err == nil {
+		t.Fatal("expected failure")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "sb-000.jpg")); err != nil {
+		t.Fatal("first strip missing after failure")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "sb.vtt")); err == nil {
+		t.Fatal("vtt written for incomplete storyboard")
+	}
+
+	extractor = &fakeExtractor{}
+	if err := Generate(dir, segments, opts, extractor); err != nil {
+		t.Fatal(err)
+	}
+	if len(extractor.calls) != 1 || extractor.calls[0] != "segment00002.ts" {
+		t.Fatalf("retry extracted %v, want only the missing strip", extractor.calls)
+	}
+	for _, name := range []string{"sb-001.jpg", "sb.vtt"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Fatalf("%s missing", name)
+		}
+	}
+}
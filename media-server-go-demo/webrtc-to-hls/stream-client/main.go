@@ -0,0 +1,108 @@
+// Command stream-client publishes a media file or a test pattern to a
+// webrtc-to-hls server, headless, with package publisher:
+//
+//	stream-client publish --stream main --file foo.mp4
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/publisher"
+)
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] != "publish" {
+		fmt.Fprintln(os.Stderr, "usage: stream-client publish [flags]")
+		os.Exit(2)
+	}
+	if err := publish(os.Args[2:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// publish publishes until the source ends, the server ends the stream,
+// -duration passes or the process gets SIGINT or SIGTERM
+func publish(args []string) error {
+	fs := flag.NewFlagSet("publish", flag.ExitOnError)
+	server := fs.String("server", "ws://localhost:9000/channel", "signaling url of the server")
+	stream := fs.String("stream", "", "stream key published")
+	file := fs.String("file", "", "media file published (default a test pattern)")
+	size := fs.String("size", "1280x720", "size of the video, WxH")
+	framerate := fs.Int("framerate", 30, "frames per second of the video")
+	bitrate := fs.Int("bitrate", 2000, "bitrate of the video in kbps")
+	noAudio := fs.Bool("no-audio", false, "publish the video alone")
+	latency := fs.String("latency", "", "latency preset: low, balanced or quality (default the server's)")
+	externalID := fs.String("external-id", "", "own id of the content")
+	credential := fs.String("credential", "", "credential of the publish, when the server requires one")
+	duration := fs.Duration("duration", 0, "how long to publish (default until the source ends)")
+	fs.Parse(args)
+	if *stream == "" || fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	wh := strings.SplitN(*size, "x", 2)
+	if len(wh) != 2 {
+		return fmt.Errorf("size %q is not WxH", *size)
+	}
+	width, werr := strconv.Atoi(wh[0])
+	height, herr := strconv.Atoi(wh[1])
+	if werr != nil || herr != nil {
+		return fmt.Errorf("size %q is not WxH", *size)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	p, err := publisher.Publish(ctx, publisher.Options{
+		URL: *server,
+		Offer: client.Offer{
+			StreamID:   *stream,
+			ExternalID: *externalID,
+			Latency:    *latency,
+			Credential: *credential,
+		},
+		Source: publisher.Source{
+			File:      *file,
+			Width:     width,
+			Height:    height,
+			Framerate: *framerate,
+			Bitrate:   *bitrate,
+			NoAudio:   *noAudio,
+		},
+	})
+	cancel()
+	if err != nil {
+		return err
+	}
+	if s := p.Answer.Session; s != nil {
+		fmt.Printf("publishing %s, session %s, playlist %s\n", s.Stream, s.ID, s.Playlist)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	var timeout <-chan time.Time
+	if *duration > 0 {
+		timeout = time.After(*duration)
+	}
+	select {
+	case <-p.Done():
+	case <-signals:
+	case <-timeout:
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), client.DefaultTimeout)
+	defer cancel()
+	closeErr := p.Close(ctx)
+	if err := p.Err(); err != nil && !errors.Is(err, publisher.ErrSourceEnded) {
+		return err
+	}
+	return closeErr
+}
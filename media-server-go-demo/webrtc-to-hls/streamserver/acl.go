@@ -0,0 +1,199 @@
+package streamserver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/metrics"
+)
+
+var playbackRestrictions = metrics.NewCounter("playback_restricted_total",
+	"HLS and WHEP playback requests refused by the access rules of their stream, by reason: ip, country or viewers", "reason")
+
+// reasons playback is restricted for
+const (
+	// restrictIP: the address of the viewer is denied, or not allowed
+	restrictIP = "ip"
+	// restrictCountry: the country of the viewer is denied, or not allowed
+	restrictCountry = "country"
+	// restrictViewers: the stream has as many viewers as it may
+	restrictViewers = "viewers"
+)
+
+var errNoGeoIP = errors.New("playback country restrictions need geoip_country_db")
+
+// aclSettings are the settings of the playback access rules, each with its
+// _overrides
+var aclSettings = []string{"playback_allow", "playback_deny", "playback_countries_allow", "playback_countries_deny", "playback_max_viewers"}
+
+// playbackACL are the access rules of the playback of a stream key
+type playbackACL struct {
+	// allow, when set, are the only networks served; deny are refused
+	allow, deny []*net.IPNet
+	// countriesAllow, when set, are the only countries served, viewers
+	// whose country does not resolve refused; countriesDeny are refused
+	countriesAllow, countriesDeny map[string]bool
+	// maxViewers caps the concurrent viewers, HLS and WebRTC, 0 for none
+	maxViewers int
+}
+
+// aclList splits a setting listing addresses or countries, by commas or,
+// in _overrides whose entries commas separate, by spaces
+func aclList(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool { return r == ',' || unicode.IsSpace(r) })
+}
+
+// countrySet parses the ISO 3166 country codes of setting
+func countrySet(setting, value string) (map[string]bool, error) {
+	codes := aclList(value)
+	if len(codes) == 0 {
+		return nil, nil
+	}
+	set := map[string]bool{}
+	for _, code := range codes {
+		if len(code) != 2 {
+			return nil, fmt.Errorf("%s: %q is not a country code", setting, code)
+		}
+		set[strings.ToUpper(code)] = true
+	}
+	return set, nil
+}
+
+// resolvePlaybackACL reads the access rules of the playback of key:
+// playback_allow and playback_deny list the addresses and CIDR ranges of
+// viewers served and refused, playback_countries_allow and
+// playback_countries_deny their ISO 3166 countries, located with the GeoIP
+// databases, and playback_max_viewers caps their number. In the
+// _overrides, the entries of lists are separated by spaces, e.g.
+// playback_deny_overrides=main=192.0.2.0/24 198.51.100.7.
+func resolvePlaybackACL(key string) (playbackACL, error) {
+	var acl playbackACL
+	var err error
+	if acl.allow, err = parseNetworks("playback_allow", aclList(envForKey("playback_allow", key))); err != nil {
+		return acl, err
+	}
+	if acl.deny, err = parseNetworks("playback_deny", aclList(envForKey("playback_deny", key))); err != nil {
+		return acl, err
+	}
+	if acl.countriesAllow, err = countrySet("playback_countries_allow", envForKey("playback_countries_allow", key)); err != nil {
+		return acl, err
+	}
+	if acl.countriesDeny, err = countrySet("playback_countries_deny", envForKey("playback_countries_deny", key)); err != nil {
+		return acl, err
+	}
+	if value := strings.TrimSpace(envForKey("playback_max_viewers", key)); value != "" {
+		if _, err := fmt.Sscanf(value, "%d", &acl.maxViewers); err != nil || acl.maxViewers < 0 {
+			return acl, fmt.Errorf("playback_max_viewers: %q is not a number of viewers", value)
+		}
+	}
+	return acl, nil
+}
+
+// restrictsCountries reports whether acl locates viewers
+func (acl playbackACL) restrictsCountries() bool {
+	return len(acl.countriesAllow) > 0 || len(acl.countriesDeny) > 0
+}
+
+// setupPlaybackACL checks the playback access rules of every stream key
+// set, and that viewers can be located when countries are restricted
+func setupPlaybackACL() error {
+	keys := map[string]bool{"": true}
+	for _, name := range aclSettings {
+		for key := range envOverrides(name) {
+			keys[key] = true
+		}
+	}
+	for key := range keys {
+		acl, err := resolvePlaybackACL(key)
+		if err != nil {
+			return err
+		}
+		if acl.restrictsCountries() && os.Getenv("geoip_country_db") == "" {
+			return errNoGeoIP
+		}
+	}
+	return nil
+}
+
+// check is why acl refuses the viewer at ip, empty when it does not:
+// country locates it, watching reports whether it is watching already and
+// viewers counts those watching
+func (acl playbackACL) check(ip net.IP, country func(net.IP) string, watching func() bool, viewers func() int) string {
+	if ip == nil && (len(acl.allow) > 0 || acl.restrictsCountries()) {
+		return restrictIP
+	}
+	if containsIP(acl.deny, ip) || len(acl.allow) > 0 && !containsIP(acl.allow, ip) {
+		return restrictIP
+	}
+	if acl.restrictsCountries() {
+		code := country(ip)
+		if acl.countriesDeny[code] || len(acl.countriesAllow) > 0 && !acl.countriesAllow[code] {
+			return restrictCountry
+		}
+	}
+	// the viewers watching already keep watching, their segments served
+	if acl.maxViewers > 0 && !watching() && viewers() >= acl.maxViewers {
+		return restrictViewers
+	}
+	return ""
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// viewerCountry is the country of the viewer at ip, empty when it does not
+// resolve
+func viewerCountry(ip net.IP) string {
+	resolver, err := geoResolver()
+	if err != nil {
+		return ""
+	}
+	location, _ := resolver.Resolve(ip)
+	return strings.ToUpper(location.Country)
+}
+
+// restrictPlayback refuses the playlists and segments of HLS viewers, and
+// the WHEP offers of WebRTC ones, the access rules of their stream do not
+// let through, with a 403 saying why, see resolvePlaybackACL
+func restrictPlayback(c *gin.Context) {
+	keys := playbackKeys(c.Request.URL.Path)
+	if strings.HasPrefix(c.Request.URL.Path, "/whep/") && c.Request.Method != http.MethodPost {
+		keys = nil
+	}
+	ip, agent := net.ParseIP(c.ClientIP()), c.GetHeader("User-Agent")
+	for _, key := range keys {
+		acl, err := resolvePlaybackACL(key)
+		if err != nil {
+			logger.Warn("playback access rules", "stream", key, "error", err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		seen := func() bool {
+			// a WHEP offer is a new viewer
+			return strings.HasPrefix(c.Request.URL.Path, "/hls/") && watching.Watching(key, ip, agent)
+		}
+		count := func() int {
+			protocols := watching.Concurrent()[key]
+			return protocols[protocolHLS] + protocols[protocolWebRTC]
+		}
+		if reason := acl.check(ip, viewerCountry, seen, count); reason != "" {
+			playbackRestrictions.Inc(reason)
+			c.Header("Cache-Control", "no-store")
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "playback restricted", "reason": reason, "stream": key})
+			return
+		}
+	}
+	c.Next()
+}
@@ -0,0 +1,89 @@
+package streamserver
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/analytics"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/audience"
+)
+
+type countries map[string]string
+
+func (c countries) Resolve(ip net.IP) (audience.Location, error) {
+	return audience.Location{Country: c[ip.String()]}, nil
+}
+
+func TestResolvePlaybackACL(t *testing.T) {
+	t.Setenv("playback_deny_overrides", "main=192.0.2.0/24 198.51.100.7,bad=300.1.1.1")
+	t.Setenv("playback_countries_allow", "nl,BE")
+	acl, err := resolvePlaybackACL("main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(acl.deny) != 2 || !acl.countriesAllow["NL"] || !acl.countriesAllow["BE"] || acl.maxViewers != 0 {
+		t.Fatalf("acl = %+v", acl)
+	}
+	if _, err := resolvePlaybackACL("bad"); err == nil {
+		t.Fatal("bad address accepted")
+	}
+	if err := setupPlaybackACL(); err == nil {
+		t.Fatal("bad address set up")
+	}
+	// country rules need the GeoIP databases
+	unsetenv(t, "playback_deny_overrides")
+	if err := setupPlaybackACL(); err != errNoGeoIP {
+		t.Fatalf("setup without geoip = %v", err)
+	}
+}
+
+func TestRestrictPlayback(t *testing.T) {
+	defer func(r audience.Resolver, w *analytics.Tracker) { geo, watching = r, w }(geo, watching)
+	geo = countries{"203.0.113.1": "NL", "203.0.113.2": "US"}
+	watching = analytics.NewTracker(nil, time.Minute, 16)
+	t.Setenv("playback_deny_overrides", "main=192.0.2.0/24")
+	t.Setenv("playback_countries_deny_overrides", "main=us")
+	t.Setenv("playback_max_viewers_overrides", "capped=1")
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(restrictPlayback)
+	r.GET("/hls/:id/:file", func(c *gin.Context) { c.Status(http.StatusOK) })
+	get := func(peer, path string) (int, string) {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = peer + ":40000"
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		var body struct{ Reason string }
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		return rec.Code, body.Reason
+	}
+	for _, c := range []struct {
+		peer, path string
+		status     int
+		reason     string
+	}{
+		{"203.0.113.1", "/hls/main/playlist.m3u8", http.StatusOK, ""},
+		{"192.0.2.9", "/hls/main/playlist.m3u8", http.StatusForbidden, restrictIP},
+		{"203.0.113.2", "/hls/main/segment-1-00001.ts", http.StatusForbidden, restrictCountry},
+		{"192.0.2.9", "/hls/other/playlist.m3u8", http.StatusOK, ""},
+	} {
+		if status, reason := get(c.peer, c.path); status != c.status || reason != c.reason {
+			t.Fatalf("%s %s = %d %q, want %d %q", c.peer, c.path, status, reason, c.status, c.reason)
+		}
+	}
+
+	// the viewer watching keeps watching, the next one is refused
+	watching.Seen("capped", protocolHLS, net.ParseIP("203.0.113.1"), "", time.Now())
+	if status, _ := get("203.0.113.1", "/hls/capped/segment-1-00002.ts"); status != http.StatusOK {
+		t.Fatalf("viewer watching refused: %d", status)
+	}
+	if status, reason := get("203.0.113.2", "/hls/capped/playlist.m3u8"); status != http.StatusForbidden || reason != restrictViewers {
+		t.Fatalf("viewer over the cap = %d %q", status, reason)
+	}
+}
@@ -0,0 +1,27 @@
+package streamserver
+
+import (
+	"embed"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// adminUI is the admin page, built into the binary so that it needs no
+// file next to it, unlike the demo page of index
+//
+//go:embed admin/index.html
+var adminUI embed.FS
+
+// adminPage handles GET /admin, the page listing the live streams with
+// their thumbnails and viewers, and buttons to kick, record and restream
+// them. It calls the management API as the admin the operator types in.
+func adminPage(c *gin.Context) {
+	page, err := adminUI.ReadFile("admin/index.html")
+	if err != nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	c.Header("Cache-Control", "no-cache")
+	c.Data(http.StatusOK, "text/html; charset=utf-8", page)
+}
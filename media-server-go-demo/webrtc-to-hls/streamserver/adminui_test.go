@@ -0,0 +1,27 @@
+package streamserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAdminPage(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/admin", adminPage)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin", nil))
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("GET /admin = %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	// the page is backed by the management API
+	for _, call := range []string{"/api/v1/streams", "/record/start", "/restreams", "X-Admin-Identity", "Authorization"} {
+		if !strings.Contains(w.Body.String(), call) {
+			t.Errorf("admin page does not use %s", call)
+		}
+	}
+}
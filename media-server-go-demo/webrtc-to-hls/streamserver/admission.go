@@ -0,0 +1,144 @@
+package streamserver
+
+import (
+	"fmt"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/abr"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/metrics"
+	"github.com/notedit/sdp"
+)
+
+var limitRefusals = metrics.NewCounter("admission_refusals_total",
+	"Publishes refused or ended for a resource limit, by limit", "limit")
+
+// the resource limits of the instance, see resourceLimits
+const (
+	limitPublishers = "publishers"
+	limitPipelines  = "pipelines"
+	limitBitrate    = "bitrate"
+)
+
+// limitExceeded refuses a publish over a resource limit rather than have
+// every stream of the instance degrade; sent as client.ErrorLimitExceeded
+// with its details
+type limitExceeded struct {
+	limit   string
+	max     int
+	current int
+}
+
+func (e *limitExceeded) Error() string {
+	if e.limit == limitBitrate {
+		return fmt.Sprintf("bitrate limit exceeded: %d kbps over the %d kbps allowed", e.current/1000, e.max/1000)
+	}
+	return fmt.Sprintf("%s limit reached: %d of %d in use", e.limit, e.current, e.max)
+}
+
+func (e *limitExceeded) details() map[string]interface{} {
+	return map[string]interface{}{"limit": e.limit, "max": e.max, "current": e.current}
+}
+
+// resourceLimits bound what the publishes of the instance use, each
+// unlimited at 0: max_publishers live publishes, max_pipelines GStreamer
+// pipelines, the HLS output of a publish, each rung of its ABR ladder and
+// the output of each of its other streams, and max_publisher_bitrate_kbps the video bitrate of a publisher
+type resourceLimits struct {
+	publishers int
+	pipelines  int
+	// bitrate is in bits per second
+	bitrate int
+}
+
+func limitsFromEnv() resourceLimits {
+	return resourceLimits{
+		publishers: envInt("max_publishers", 0),
+		pipelines:  envInt("max_pipelines", 0),
+		bitrate:    envInt("max_publisher_bitrate_kbps", 0) * 1000,
+	}
+}
+
+// runningPipelines counts the HLS pipelines of the live sessions, the
+// rungs of their ladders and the outputs of their other streams
+func runningPipelines() int {
+	running := 0
+	for _, key := range registry.keys() {
+		if sess := registry.get(key); sess != nil {
+			sess.Lock()
+			if sess.hls != nil {
+				running++
+				if sess.hls.ladder != nil {
+					running += len(sess.hls.ladder.current())
+				}
+			}
+			running += len(sess.streams)
+			sess.Unlock()
+		}
+	}
+	return running
+}
+
+// admitResources refuses a publish of key the limits of the instance have
+// no room for. A publish taking over a live key replaces what it uses. The
+// pipelines it needs are its HLS output and the rungs of its ladder under
+// its default preset, at most, see ladderSpec. Publishes admitted side by side may overshoot a limit by the
+// others being set up.
+func admitResources(key string) error {
+	limits := limitsFromEnv()
+	if registry.get(key) != nil {
+		return nil
+	}
+	if limits.publishers > 0 {
+		if live := len(registry.keys()); live >= limits.publishers {
+			limitRefusals.Inc(limitPublishers)
+			return &limitExceeded{limit: limitPublishers, max: limits.publishers, current: live}
+		}
+	}
+	if limits.pipelines > 0 {
+		needed := 1
+		preset, _ := resolvePreset("", key)
+		spec, _ := ladderSpec(preset, key)
+		if rungs, err := abr.ParseLadder(spec); err == nil {
+			needed += len(rungs)
+		}
+		if running := runningPipelines(); running+needed > limits.pipelines {
+			limitRefusals.Inc(limitPipelines)
+			return &limitExceeded{limit: limitPipelines, max: limits.pipelines, current: running}
+		}
+	}
+	return nil
+}
+
+// capBitrate asks the publisher of answer to keep its video under
+// max_publisher_bitrate_kbps, with the b=AS line browsers hold their
+// encoder to
+func capBitrate(answer *sdp.SDPInfo) {
+	max := limitsFromEnv().bitrate
+	if video := answer.GetMedia("video"); video != nil && max > 0 {
+		video.SetBitrate(max / 1000)
+	}
+}
+
+// overBitrate reports the video bitrate of a publisher over
+// max_publisher_bitrate_kbps, averaged over the frame alert window once it
+// is full, nil otherwise; publishers that ignore b=AS, e.g. over RTMP or
+// SRT, are ended on it
+func (s *session) overBitrate() *limitExceeded {
+	max := limitsFromEnv().bitrate
+	if max <= 0 {
+		return nil
+	}
+	if bitrate, full := s.frames.meanBitrate(); full && bitrate > max {
+		return &limitExceeded{limit: limitBitrate, max: max, current: bitrate}
+	}
+	return nil
+}
+
+// endOverBitrate ends the publish of s, over its bitrate limit
+func (s *session) endOverBitrate(err *limitExceeded) {
+	limitRefusals.Inc(limitBitrate)
+	s.logf("%v, ending the publish", err)
+	s.timeline.add(eventSession, err.Error())
+	s.send(client.Message{Cmd: client.CmdError, Code: client.ErrorLimitExceeded, Reason: err.Error(), Details: err.details()})
+	s.endWith(client.CloseLimitExceeded, err.Error())
+}
@@ -0,0 +1,89 @@
+package streamserver
+
+import (
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+)
+
+func TestAdmitResources(t *testing.T) {
+	t.Setenv("max_publishers", "1")
+	sess := newSession("admitted", nil, presets[client.LatencyBalanced])
+	if err := admitResources("admitted"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := registry.claim(sess, conflictReject); err != nil {
+		t.Fatal(err)
+	}
+	defer registry.release(sess)
+
+	err := admitResources("refused")
+	limit, ok := err.(*limitExceeded)
+	if !ok || limit.limit != limitPublishers || limit.details()["current"] != 1 {
+		t.Fatalf("over the publishers limit: %v", err)
+	}
+	// a takeover replaces the live publish
+	if err := admitResources("admitted"); err != nil {
+		t.Fatalf("takeover: %v", err)
+	}
+
+	unsetenv(t, "max_publishers")
+	t.Setenv("max_pipelines", "2")
+	sess.Lock()
+	sess.hls = &hlsOutput{}
+	sess.Unlock()
+	defer func() { sess.hls = nil }()
+	// the ladder of the quality preset would take two more
+	t.Setenv("latency_overrides", "single=balanced")
+	if err := admitResources("single"); err != nil {
+		t.Fatalf("one pipeline left: %v", err)
+	}
+	t.Setenv("abr_ladder_overrides", "laddered=on")
+	if err, ok := admitResources("laddered").(*limitExceeded); !ok || err.limit != limitPipelines {
+		t.Fatalf("a ladder over the pipelines limit: %v", err)
+	}
+}
+
+func TestOverBitrate(t *testing.T) {
+	t.Setenv("max_publisher_bitrate_kbps", "1000")
+	sess := newSession("bitrate", nil, presets[client.LatencyBalanced])
+	frame := make([]byte, 150000)
+	for i := 0; i < len(sess.frames.window)-1; i++ {
+		if sess.overBitrate() != nil {
+			t.Fatal("judged before the window is full")
+		}
+		sess.frames.record(frame, false)
+		sess.frames.tick()
+	}
+	if err := sess.overBitrate(); err == nil || err.current != 1200000 {
+		t.Fatalf("1200 kbps: %v", err)
+	}
+}
+
+func TestOutputBackpressure(t *testing.T) {
+	o := &hlsOutput{queue: newFrameQueue(2)}
+	frame := []byte{0, 0, 0, 1, 0x65}
+	o.push(frame, frameTime{}, true)
+	frame[4] = 0x41
+	o.push(frame, frameTime{}, false)
+	// full: the oldest frame is dropped, and the video up to a keyframe
+	o.push(frame, frameTime{}, false)
+	if o.queue.len() != 2 || o.droppedVideo != 1 {
+		t.Fatalf("queued %d, dropped %d", o.queue.len(), o.droppedVideo)
+	}
+	o.pushAudio(frame, frameTime{})
+	if o.queue.len() != 2 || o.droppedVideo != 1 {
+		t.Fatal("queued audio without an audio branch")
+	}
+	if f := o.queue.pop(); f.keyframe || f.seq != 2 {
+		t.Fatal("dropped the newest frame")
+	}
+	frame[4] = 0
+	if f := o.queue.pop(); f.data[4] != 0x41 {
+		t.Fatal("queued the caller's buffer, not a copy")
+	}
+	if stats := o.queueStats(); stats["queued"] != 0 || stats["dropped"].(gin.H)["video"] != int64(1) {
+		t.Fatalf("stats = %v", stats)
+	}
+}
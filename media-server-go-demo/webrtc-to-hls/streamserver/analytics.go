@@ -0,0 +1,160 @@
+package streamserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/analytics"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/metrics"
+)
+
+// analyticsJobs is the job class delivering viewer events to the sink
+const analyticsJobs = "analytics"
+
+// protocols of viewers in analytics events
+const (
+	protocolHLS    = "hls"
+	protocolWebRTC = "webrtc"
+)
+
+// watching follows the viewers of every stream, for the concurrent counts
+// and the analytics events; setupAnalytics replaces it once configured
+var watching = analytics.NewTracker(nil, 30*time.Second, 4096)
+
+// analyticsSink receives the viewer events, nil to only count viewers
+var analyticsSink analytics.Sink
+
+var (
+	analyticsEvents = metrics.NewCounter("analytics_events_total",
+		"Viewer events handed to the analytics sink, by type", "type")
+	_ = metrics.NewGaugeFunc("viewers_concurrent",
+		"Viewers watching, HLS and WebRTC, by stream key", "stream", func() map[string]float64 {
+			counts := map[string]float64{}
+			for key, protocols := range watching.Concurrent() {
+				for _, n := range protocols {
+					counts[key] += float64(n)
+				}
+			}
+			return counts
+		})
+	_ = metrics.NewGaugeFunc("analytics_events_dropped",
+		"Viewer events dropped before reaching the sink", "", func() map[string]float64 {
+			return map[string]float64{"": float64(watching.Dropped())}
+		})
+)
+
+// setupAnalytics reads where viewer events go from analytics_sink: empty
+// for nowhere, log to append them to analytics_log (stdout when empty),
+// webhook to post them to analytics_webhook_url, kafka to produce them to
+// analytics_kafka_topic through the REST proxy at analytics_kafka_url. HLS
+// viewers leave after analytics_idle_timeout (30) seconds without a
+// request, and events are sent every analytics_flush_interval (5) seconds.
+// Viewers are located with the audience GeoIP databases.
+func setupAnalytics() error {
+	resolver, err := geoResolver()
+	if err != nil {
+		return err
+	}
+	watching = analytics.NewTracker(resolver, time.Duration(envInt("analytics_idle_timeout", 30))*time.Second, 4096)
+	client := &http.Client{Timeout: 10 * time.Second}
+	switch kind := os.Getenv("analytics_sink"); kind {
+	case "":
+	case "log":
+		out := os.Stdout
+		if name := os.Getenv("analytics_log"); name != "" {
+			if out, err = os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600); err != nil {
+				return err
+			}
+		}
+		analyticsSink = &analytics.Log{W: out}
+	case "webhook":
+		url := os.Getenv("analytics_webhook_url")
+		if url == "" {
+			return errors.New("analytics: analytics_webhook_url required")
+		}
+		analyticsSink = &analytics.Webhook{URL: url, Client: client}
+	case "kafka":
+		url, topic := os.Getenv("analytics_kafka_url"), os.Getenv("analytics_kafka_topic")
+		if url == "" || topic == "" {
+			return errors.New("analytics: analytics_kafka_url and analytics_kafka_topic required")
+		}
+		analyticsSink = &analytics.Kafka{URL: url, Topic: topic, Client: client}
+	default:
+		return fmt.Errorf("analytics_sink must be log, webhook or kafka, not %q", kind)
+	}
+	if analyticsSink != nil {
+		logger.Info("sending viewer events", "sink", analyticsSink.Name())
+	}
+	go flushAnalytics(time.Duration(envInt("analytics_flush_interval", 5)) * time.Second)
+	return nil
+}
+
+// flushAnalytics ends the idle HLS viewers and queues the events since the
+// previous flush for the sink, every interval
+func flushAnalytics(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		watching.Expire(now)
+		sendAnalytics(watching.Events())
+	}
+}
+
+// sendAnalytics queues the delivery of events to the sink, and to the
+// event bus
+func sendAnalytics(events []analytics.Event) {
+	publishViewerEvents(events)
+	if analyticsSink == nil || len(events) == 0 {
+		return
+	}
+	for _, e := range events {
+		analyticsEvents.Inc(e.Type)
+	}
+	sink := analyticsSink
+	background.Submit(analyticsJobs, fmt.Sprintf("%d viewer events", len(events)), func(ctx context.Context) error {
+		return sink.Send(ctx, events)
+	})
+}
+
+// trackViewers records the HLS viewer of each playlist and segment answered
+func trackViewers(c *gin.Context) {
+	c.Next()
+	keys := playbackKeys(c.Request.URL.Path)
+	if len(keys) == 0 || c.Writer.Status() >= http.StatusBadRequest {
+		return
+	}
+	if name := path.Base(c.Request.URL.Path); path.Ext(name) != ".m3u8" && !segmentFile(name) {
+		return
+	}
+	ip, agent, now := net.ParseIP(c.ClientIP()), c.GetHeader("User-Agent"), time.Now()
+	for _, key := range keys {
+		watching.Seen(key, protocolHLS, ip, agent, now)
+	}
+}
+
+// concurrentViewers counts the viewers of key, per protocol and in total
+func concurrentViewers(key string) gin.H {
+	protocols := watching.Concurrent()[key]
+	return gin.H{
+		protocolHLS:    protocols[protocolHLS],
+		protocolWebRTC: protocols[protocolWebRTC],
+		"total":        protocols[protocolHLS] + protocols[protocolWebRTC],
+	}
+}
+
+// listViewers handles GET /api/v1/viewers, the concurrent viewers of every
+// stream watched
+func listViewers(c *gin.Context) {
+	streams := gin.H{}
+	for key := range watching.Concurrent() {
+		streams[key] = concurrentViewers(key)
+	}
+	c.JSON(http.StatusOK, gin.H{"streams": streams})
+}
@@ -0,0 +1,80 @@
+package streamserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/analytics"
+)
+
+type sinkFunc func([]analytics.Event)
+
+func (f sinkFunc) Name() string { return "test" }
+
+func (f sinkFunc) Send(ctx context.Context, events []analytics.Event) error {
+	f(events)
+	return nil
+}
+
+func TestTrackViewers(t *testing.T) {
+	defer func(tracker *analytics.Tracker, sink analytics.Sink) { watching, analyticsSink = tracker, sink }(watching, analyticsSink)
+	watching = analytics.NewTracker(nil, time.Minute, 16)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(trackViewers)
+	r.GET("/hls/:key/:file", func(c *gin.Context) {
+		if c.Param("key") == "missing" {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		c.String(http.StatusOK, "#EXTM3U\n")
+	})
+	r.GET("/api/v1/viewers", listViewers)
+	for _, request := range []struct{ path, addr string }{
+		{"/hls/viewed/playlist.m3u8", "192.0.2.1:1000"},
+		{"/hls/viewed/playlist.m3u8", "192.0.2.1:1001"},
+		{"/hls/viewed/segment-1-0.ts", "192.0.2.1:1002"},
+		{"/hls/viewed/segment-1-0.ts", "192.0.2.2:1000"},
+		{"/hls/viewed/thumbnail.jpg", "192.0.2.3:1000"},
+		{"/hls/missing/playlist.m3u8", "192.0.2.4:1000"},
+	} {
+		req := httptest.NewRequest("GET", request.path, nil)
+		req.RemoteAddr = request.addr
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/viewers", nil))
+	var body struct {
+		Streams map[string]map[string]int
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Streams) != 1 || body.Streams["viewed"]["hls"] != 2 || body.Streams["viewed"]["total"] != 2 {
+		t.Fatalf("viewers = %s", w.Body)
+	}
+
+	background = newJobQueue()
+	defer background.Close()
+	sent := make(chan []analytics.Event, 1)
+	analyticsSink = sinkFunc(func(events []analytics.Event) { sent <- events })
+	sendAnalytics(watching.Events())
+	select {
+	case events := <-sent:
+		if len(events) != 2 || events[0].Type != analytics.Join || events[0].Stream != "viewed" || events[0].Protocol != protocolHLS {
+			t.Fatalf("events = %+v", events)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no events sent")
+	}
+	if analyticsEvents.Value(analytics.Join) < 2 {
+		t.Fatal("events not counted")
+	}
+}
@@ -0,0 +1,81 @@
+package streamserver
+
+import (
+	"github.com/notedit/sdp"
+)
+
+// answer modes
+const (
+	answerFull    = "full"
+	answerMinimal = "minimal"
+)
+
+// answerModeFor reads answer_mode / answer_mode_overrides; some embedded
+// publishers choke on the full answer
+func answerModeFor(key string) string {
+	if envForKey("answer_mode", key) == answerMinimal {
+		return answerMinimal
+	}
+	return answerFull
+}
+
+// usedExtensions are the header extensions the server acts on
+var usedExtensions = map[string]bool{
+	"http://www.ietf.org/id/draft-holmer-rmcat-transport-wide-cc-extensions-01": true,
+	"http://www.webrtc.org/experiments/rtp-hdrext/abs-send-time":                true,
+	"urn:ietf:params:rtp-hdrext:sdes:mid":                                       true,
+	"urn:ietf:params:rtp-hdrext:sdes:rtp-stream-id":                             true,
+	"urn:ietf:params:rtp-hdrext:sdes:repaired-rtp-stream-id":                    true,
+}
+
+// minimizeAnswer strips answer down to one codec per m-line, the header
+// extensions the server uses and the rtcp-fb entries backed by them. ICE,
+// DTLS and candidates are left alone.
+func minimizeAnswer(answer *sdp.SDPInfo) {
+	for _, media := range answer.GetMedias() {
+		extensions := media.GetExtensions()
+		for id, uri := range extensions {
+			if !usedExtensions[uri] {
+				delete(extensions, id)
+			}
+		}
+		transportCC := media.HasExtension("http://www.ietf.org/id/draft-holmer-rmcat-transport-wide-cc-extensions-01")
+		absSendTime := media.HasExtension("http://www.webrtc.org/experiments/rtp-hdrext/abs-send-time")
+
+		chosen := preferredCodec(media)
+		if chosen == nil {
+			continue
+		}
+		codec := sdp.NewCodecInfo(chosen.GetCodec(), chosen.GetType())
+		codec.SetRTX(chosen.GetRTX())
+		codec.AddParams(chosen.GetParams())
+		for _, fb := range chosen.GetRTCPFeedbacks() {
+			switch fb.GetID() {
+			case "transport-cc":
+				if !transportCC {
+					continue
+				}
+			case "goog-remb":
+				if !absSendTime {
+					continue
+				}
+			case "nack", "ccm":
+			default:
+				continue
+			}
+			codec.AddRTCPFeedback(fb)
+		}
+		media.SetCodecs(map[int]*sdp.CodecInfo{codec.GetType(): codec})
+	}
+}
+
+// preferredCodec picks the codec kept by a minimal answer: the first by
+// codec_preference, then the lowest payload type, which is stable for a
+// given offer
+func preferredCodec(media *sdp.MediaInfo) *sdp.CodecInfo {
+	ranked := rankedCodecs(media, preferredCodecs())
+	if len(ranked) == 0 {
+		return nil
+	}
+	return ranked[0]
+}
@@ -0,0 +1,71 @@
+package streamserver
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/notedit/sdp"
+)
+
+func answerFixture(t *testing.T, name string) (*sdp.SDPInfo, *sdp.SDPInfo) {
+	data, err := ioutil.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer, err := sdp.Parse(string(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ice := sdp.GenerateICEInfo(true)
+	dtls := sdp.NewDTLSInfo(sdp.SETUPPASSIVE, "sha-256", "AA:BB")
+	candidates := []*sdp.CandidateInfo{sdp.NewCandidateInfo("1", 1, "UDP", 33554431, "127.0.0.1", 5000, "host", "", 0)}
+	return offer, offer.Answer(ice, dtls, candidates, Capabilities)
+}
+
+func TestMinimizeAnswer(t *testing.T) {
+	for _, fixture := range []string{"chrome_offer.sdp", "embedded_offer.sdp"} {
+		_, answer := answerFixture(t, fixture)
+		full := answer.String()
+		minimizeAnswer(answer)
+		minimal := answer.String()
+
+		// what the publisher will parse
+		parsed, err := sdp.Parse(minimal)
+		if err != nil {
+			t.Fatalf("%s: minimal answer does not parse: %v\n%s", fixture, err, minimal)
+		}
+		if len(minimal) > len(full) {
+			t.Errorf("%s: minimal answer larger than full", fixture)
+		}
+		video := parsed.GetMedia("video")
+		if video == nil || len(video.GetCodecs()) != 1 {
+			t.Fatalf("%s: video codecs %v", fixture, video)
+		}
+		for _, codec := range video.GetCodecs() {
+			if !strings.EqualFold(codec.GetCodec(), "h264") {
+				t.Errorf("%s: answered %s", fixture, codec.GetCodec())
+			}
+		}
+		for _, uri := range video.GetExtensions() {
+			if !usedExtensions[uri] {
+				t.Errorf("%s: unused extension %s kept", fixture, uri)
+			}
+		}
+		for _, line := range []string{"a=ice-ufrag:", "a=ice-pwd:", "a=fingerprint:", "a=candidate:"} {
+			if !strings.Contains(minimal, line) {
+				t.Errorf("%s: minimal answer lost %s", fixture, line)
+			}
+		}
+	}
+}
+
+func TestMinimizeAnswerKeepsRTX(t *testing.T) {
+	_, answer := answerFixture(t, "chrome_offer.sdp")
+	minimizeAnswer(answer)
+	for _, codec := range answer.GetMedia("video").GetCodecs() {
+		if codec.GetType() != 102 || codec.GetRTX() != 121 {
+			t.Fatalf("kept pt %d rtx %d, want 102/121", codec.GetType(), codec.GetRTX())
+		}
+	}
+}
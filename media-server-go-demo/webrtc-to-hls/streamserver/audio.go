@@ -0,0 +1,120 @@
+package streamserver
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/pipeline"
+)
+
+// opusToAAC transcodes the Opus of WebRTC publishers, see aacTrack
+const opusToAAC = opusDecode + " ! audioconvert ! audioresample ! avenc_aac"
+
+// opusDecode decodes the Opus frames of WebRTC publishers given to an appsrc
+const opusDecode = opusCaps + " ! opusdec"
+
+// opusCaps are the caps of the Opus frames of WebRTC publishers
+const opusCaps = "caps=audio/x-opus,channel-mapping-family=0,channels=2,rate=48000"
+
+// aacCodec is the CODECS value of the audio aacTrack produces, AAC-LC
+const aacCodec = "mp4a.40.2"
+
+// opusCodec is the CODECS value of Opus in fMP4 segments
+const opusCodec = "Opus"
+
+// muxAudio decides whether the output of key carries the publisher's audio:
+// when the published stream has an audio track and hls_audio /
+// hls_audio_overrides is not "off"
+func muxAudio(audioTracks int, key string) bool {
+	return audioTracks > 0 && strings.TrimSpace(envForKey("hls_audio", key)) != "off"
+}
+
+// audioRenditionName is the directory of the audio-only rendition of an
+// output, listed in its master playlist for players to fall back to on a
+// poor connection, and for listeners who do not want the video
+const audioRenditionName = "audio"
+
+// audioRendition decides whether the output of key has an audio-only
+// rendition, when hls_audio_rendition / hls_audio_rendition_overrides is
+// "on"
+func audioRendition(key string) bool {
+	return strings.TrimSpace(envForKey("hls_audio_rendition", key)) == "on"
+}
+
+// takesAudio decides whether the output of the session takes the audio of
+// a publish with audioTracks: fMP4 outputs only do for their audio-only
+// rendition
+func (s *session) takesAudio(audioTracks int) bool {
+	return muxAudio(audioTracks, s.key) && (s.container != containerFMP4 || audioRendition(s.key))
+}
+
+// audioRenditionDir is where the audio-only rendition of the output written
+// to dir goes
+func audioRenditionDir(dir string) string {
+	return filepath.Join(dir, audioRenditionName)
+}
+
+// aacTrack is the audio of an output, pushed into audiosrc: the AAC of
+// caps parsed as is, for RTMP and SRT publishers, or else the Opus of
+// WebRTC publishers transcoded
+func aacTrack(caps string) pipeline.Track {
+	input := opusToAAC
+	if caps != "" {
+		input = caps
+	}
+	return pipeline.Track{Name: "audiosrc", Input: input + " ! aacparse", Timed: true}
+}
+
+// opusTrack is the audio of an output passing the Opus of WebRTC publishers
+// through, see resolveOpusPassthrough
+func opusTrack() pipeline.Track {
+	return pipeline.Track{Name: "audiosrc", Input: opusCaps + " ! opusparse", Timed: true}
+}
+
+// resolveOpusPassthrough reads whether the Opus of a WebRTC publisher of
+// key is packaged as published instead of transcoded to AAC, from
+// opus_passthrough / opus_passthrough_overrides (on or off, the default),
+// saving the CPU and the latency of the transcoding. Only fMP4 segments
+// carry Opus, and only players of profiles allowing it decode it.
+func resolveOpusPassthrough(profile hlsProfile, container string, key string) (bool, error) {
+	on, err := resolvePassthrough("opus", key)
+	switch {
+	case err != nil || !on:
+		return false, err
+	case container != containerFMP4:
+		return false, fmt.Errorf("opus passthrough: %s outputs cannot carry opus, only %s", container, containerFMP4)
+	case len(profile.AudioCodecs) > 0 && !containsFold(profile.AudioCodecs, opusCodec):
+		return false, fmt.Errorf("opus passthrough: hls profile %s does not allow opus", profile.Name)
+	}
+	return true, nil
+}
+
+// passesOpus reports whether the output of the session packages the audio
+// as Opus, with the session locked: when passing it through, and the
+// publisher sends Opus, not the AAC of aacCaps
+func (s *session) passesOpus() bool {
+	return s.opusPassthrough && s.aacCaps == ""
+}
+
+// audioCodec is the CODECS value of the audio of the output, with the
+// session locked
+func (s *session) audioCodec() string {
+	if s.passesOpus() {
+		return opusCodec
+	}
+	return aacCodec
+}
+
+// outputAudio is what the output of the session packages of its audio next
+// to muxing it, when it takes the audio: an audio-only rendition, and the
+// alternate audio tracks, packaged as TS renditions
+func (s *session) outputAudio(audio bool) (rendition bool, packaged []audioTrack) {
+	if !audio {
+		return false, nil
+	}
+	if s.container != containerFMP4 {
+		packaged = s.alternateAudio
+	}
+	return audioRendition(s.key), packaged
+}
@@ -0,0 +1,121 @@
+package streamserver
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	mediaserver "github.com/notedit/media-server-go"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/pipeline"
+	"github.com/notedit/sdp"
+)
+
+var errBadAudioLanguage = errors.New("audio languages must be BCP 47 tags of offered audio tracks, one track per language")
+
+// maxAlternateAudio bounds the alternate audio renditions of an output,
+// each transcoded on its own
+const maxAlternateAudio = 4
+
+// audioGroup is the GROUP-ID of the audio renditions in the master playlist
+const audioGroup = "audio"
+
+// languageTag matches BCP 47 language tags, e.g. en or pt-BR
+var languageTag = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{1,8})*$`)
+
+// audioTrack is a published audio track and the language spoken in it
+type audioTrack struct {
+	id       string
+	language string
+}
+
+// firstAudioTrack is the audio track of stream muxed with its video, the
+// first by id
+func firstAudioTrack(stream *mediaserver.IncomingStream) *mediaserver.IncomingStreamTrack {
+	tracks := stream.GetAudioTracks()
+	sort.Slice(tracks, func(i, j int) bool { return tracks[i].GetID() < tracks[j].GetID() })
+	return tracks[0]
+}
+
+// resolveAudioTracks reads the audio tracks of offer given languages, the
+// audioLanguages of the offer by track id. The main track is the first
+// audio track, by id, of the stream with video, muxed with it; the other
+// tracks given a language are the alternates, by track id.
+func resolveAudioTracks(offer *sdp.SDPInfo, languages map[string]string) (main audioTrack, alternates []audioTrack, err error) {
+	var ids []string
+	if video := offer.GetStream(firstStreamWith(offer, "video")); video != nil {
+		for id, track := range video.GetTracks() {
+			if track.GetMedia() == "audio" {
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Strings(ids)
+	if len(ids) > 0 {
+		main = audioTrack{id: ids[0], language: languages[ids[0]]}
+	}
+	offered := map[string]bool{}
+	for _, stream := range offer.GetStreams() {
+		for id, track := range stream.GetTracks() {
+			offered[id] = track.GetMedia() == "audio"
+		}
+	}
+	seen := map[string]bool{main.language: main.language != ""}
+	for id, language := range languages {
+		if !offered[id] || !languageTag.MatchString(language) {
+			return main, nil, errBadAudioLanguage
+		}
+		if id == main.id {
+			continue
+		}
+		if seen[language] {
+			return main, nil, errBadAudioLanguage
+		}
+		seen[language] = true
+		alternates = append(alternates, audioTrack{id: id, language: language})
+	}
+	if len(alternates) > maxAlternateAudio {
+		return main, nil, fmt.Errorf("at most %d alternate audio tracks are packaged", maxAlternateAudio)
+	}
+	sort.Slice(alternates, func(i, j int) bool { return alternates[i].id < alternates[j].id })
+	return main, alternates, nil
+}
+
+// alternateAudioDir is where the rendition of an alternate audio track in
+// language goes, for the output written to dir
+func alternateAudioDir(dir, language string) string {
+	return filepath.Join(dir, audioRenditionName+"-"+language)
+}
+
+// alternateAudioTrack is the alternate audio track i of the publish, Opus
+// transcoded to AAC for the TS segments of its own rendition
+func alternateAudioTrack(i int) pipeline.Track {
+	return pipeline.Track{Name: fmt.Sprintf("altaudiosrc%d", i), Input: opusToAAC + " ! aacparse", Timed: true}
+}
+
+// feedAlternateAudio attaches the published audio tracks of stream that are
+// alternates to their renditions
+func (s *session) feedAlternateAudio(stream *mediaserver.IncomingStream) {
+	s.Lock()
+	alternates := s.alternateAudio
+	s.Unlock()
+	for i, alternate := range alternates {
+		track := stream.GetTrack(alternate.id)
+		if track == nil || track.GetMedia() != "audio" {
+			continue
+		}
+		i := i
+		track.OnMediaFrame(func(frame []byte, timestamp uint) {
+			if len(frame) == 0 {
+				return
+			}
+			ingestBytes.Add("audio", uint64(len(frame)))
+			s.Lock()
+			defer s.Unlock()
+			if s.hls != nil {
+				s.hls.pushAlternateAudio(i, frame)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package streamserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/sdp"
+)
+
+func TestResolveAudioTracks(t *testing.T) {
+	offer, err := sdp.Parse(string(mustRead(t, "testdata/multi_audio_offer.sdp")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const (
+		muxed       = "0d6b1c2e-1111-4c3b-8e4f-5a6b7c8d9e02"
+		second      = "1f9a3b2c-8a13-4b7c-9a55-2f2f1d9aa001"
+		translation = "7e2c9a41-2222-4d5e-9f60-1b2c3d4e5f03"
+		video       = "6c1e287b-7a5e-4c0f-8d2a-7d3c9c1f2b02"
+	)
+	main, alternates, err := resolveAudioTracks(offer, nil)
+	if err != nil || main != (audioTrack{id: muxed}) || alternates != nil {
+		t.Fatalf("without languages = %v %v %v", main, alternates, err)
+	}
+	main, alternates, err = resolveAudioTracks(offer, map[string]string{muxed: "en", translation: "es", second: "pt-BR"})
+	want := []audioTrack{{id: second, language: "pt-BR"}, {id: translation, language: "es"}}
+	if err != nil || main != (audioTrack{id: muxed, language: "en"}) || !reflect.DeepEqual(alternates, want) {
+		t.Fatalf("with languages = %v %v %v", main, alternates, err)
+	}
+	for _, languages := range []map[string]string{
+		{translation: "spanish language"},
+		{video: "es"},
+		{"missing": "es"},
+		{muxed: "es", translation: "es"},
+	} {
+		if _, _, err := resolveAudioTracks(offer, languages); err != errBadAudioLanguage {
+			t.Fatalf("%v = %v", languages, err)
+		}
+	}
+}
+
+func TestServeMasterAlternateAudio(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(serveMaster)
+
+	dir := outputDir("dubbed-live")
+	defer os.RemoveAll(dir)
+	sess := newSession("dubbed-live", nil, presets[client.LatencyBalanced])
+	if _, err := registry.claim(sess, conflictReject); err != nil {
+		t.Fatal(err)
+	}
+	defer registry.release(sess)
+	sess.Lock()
+	sess.started, sess.audio = true, true
+	sess.mainAudio = audioTrack{id: "a", language: "en"}
+	sess.packagedAudio = []audioTrack{{id: "b", language: "es"}, {id: "c", language: "fr"}}
+	sess.Unlock()
+
+	// the French rendition has no segment yet
+	for rdir, segment := range map[string][]byte{dir: testSegment(250000), alternateAudioDir(dir, "es"): append(testADTS, make([]byte, 16000-len(testADTS))...)} {
+		if err := os.MkdirAll(rdir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(rdir, "segment-4-00000.ts"), segment, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(rdir, playlistName), []byte("#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXTINF:2.000,\nsegment-4-00000.ts\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", masterPath("dubbed-live"), nil))
+	want := "#EXTM3U\n#EXT-X-VERSION:3\n" +
+		"#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"audio\",NAME=\"en\",LANGUAGE=\"en\",DEFAULT=YES,AUTOSELECT=YES\n" +
+		"#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"audio\",NAME=\"es\",LANGUAGE=\"es\",DEFAULT=NO,AUTOSELECT=YES,URI=\"audio-es/playlist.m3u8\"\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=1000000,RESOLUTION=1280x720,CODECS=\"avc1.42c01f,mp4a.40.2\",AUDIO=\"audio\"\nplaylist.m3u8\n"
+	if w.Code != http.StatusOK || w.Body.String() != want {
+		t.Fatalf("master = %d\n%s", w.Code, w.Body.String())
+	}
+	if streamIDs(sess)["master"] != masterPath("dubbed-live") {
+		t.Fatalf("ids = %v", streamIDs(sess))
+	}
+}
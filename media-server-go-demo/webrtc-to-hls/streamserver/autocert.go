@@ -0,0 +1,251 @@
+package streamserver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/acme"
+)
+
+var (
+	errNoCertificate = errors.New("no certificate obtained yet")
+	errCertExclusive = errors.New("tls_domains and tls_cert are exclusive")
+)
+
+const (
+	// certRenewal is how long before it expires a certificate is renewed
+	certRenewal = 30 * 24 * time.Hour
+	// certCheck is how often the certificate is checked for renewal, and
+	// a failed renewal retried
+	certCheck = time.Hour
+	// certTimeout bounds an order, its challenges validated included
+	certTimeout = 5 * time.Minute
+)
+
+// certManager keeps the certificate of the domains served over TLS
+// obtained from an ACME CA, Let's Encrypt by default, and renewed before
+// it expires. The certificate and the keys are cached in its directory so
+// a restart does not order a new one.
+type certManager struct {
+	client  *acme.Client
+	domains []string
+	dir     string
+	now     func() time.Time
+
+	sync.Mutex
+	cert *tls.Certificate
+}
+
+// setupAutocert obtains the certificate of tls_domains, e.g.
+// live.example.com, for the server listening on address, from the CA of
+// tls_acme_directory with the contact tls_acme_email. It is cached in
+// tls_cert_dir (certs). The CA validates the domains on tls_http_addr
+// (:80), which redirects everything else to HTTPS.
+func setupAutocert(address string) (*certManager, error) {
+	domains := envList("tls_domains")
+	if len(domains) == 0 {
+		return nil, nil
+	}
+	if os.Getenv("tls_cert") != "" {
+		return nil, errCertExclusive
+	}
+	dir := os.Getenv("tls_cert_dir")
+	if dir == "" {
+		dir = "certs"
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	accountKey, err := loadKey(filepath.Join(dir, "account.pem"))
+	if err != nil {
+		return nil, err
+	}
+	directoryURL := os.Getenv("tls_acme_directory")
+	if directoryURL == "" {
+		directoryURL = acme.LetsEncrypt
+	}
+	m := &certManager{
+		client: &acme.Client{
+			Directory:  directoryURL,
+			Email:      os.Getenv("tls_acme_email"),
+			Key:        accountKey,
+			Challenges: &acme.Challenges{},
+		},
+		domains: domains,
+		dir:     dir,
+		now:     time.Now,
+	}
+	if err := m.load(); err != nil && !os.IsNotExist(err) {
+		logger.Warn("cached certificate unusable", "dir", dir, "error", err)
+	}
+
+	httpAddr := os.Getenv("tls_http_addr")
+	if httpAddr == "" {
+		httpAddr = ":80"
+	}
+	listener, err := net.Listen("tcp", httpAddr)
+	if err != nil {
+		return nil, err
+	}
+	_, port, _ := net.SplitHostPort(address)
+	go func() {
+		fatal("acme listener failed", http.Serve(listener, m.handler(port)))
+	}()
+	go m.run()
+	logger.Info("serving certificates from acme", "domains", domains, "directory", directoryURL, "http", listener.Addr().String())
+	return m, nil
+}
+
+// loadKey reads the P-256 key at path, generated on first use
+func loadKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		data, err := encodeKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return key, ioutil.WriteFile(path, data, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New(path + ": no PEM key")
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+func encodeKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+// load reads the cached certificate
+func (m *certManager) load() error {
+	cert, err := tls.LoadX509KeyPair(filepath.Join(m.dir, "cert.pem"), filepath.Join(m.dir, "key.pem"))
+	if err != nil {
+		return err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return err
+	}
+	m.Lock()
+	m.cert = &cert
+	m.Unlock()
+	return nil
+}
+
+// due reports whether the certificate is to be renewed: missing, expiring
+// within certRenewal or not covering every domain
+func (m *certManager) due() bool {
+	m.Lock()
+	defer m.Unlock()
+	if m.cert == nil || m.now().Add(certRenewal).After(m.cert.Leaf.NotAfter) {
+		return true
+	}
+	for _, domain := range m.domains {
+		if m.cert.Leaf.VerifyHostname(domain) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// renew orders a certificate of a new key and caches it
+func (m *certManager) renew(ctx context.Context) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := m.client.Obtain(ctx, m.domains, key)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(chain, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(m.dir, "key.pem"), keyPEM, 0600); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(m.dir, "cert.pem"), chain, 0600); err != nil {
+		return nil, err
+	}
+	m.Lock()
+	m.cert = &cert
+	m.Unlock()
+	return &cert, nil
+}
+
+// run renews the certificate once due, checking every certCheck
+func (m *certManager) run() {
+	for {
+		if m.due() {
+			ctx, cancel := context.WithTimeout(context.Background(), certTimeout)
+			cert, err := m.renew(ctx)
+			cancel()
+			if err != nil {
+				logger.Error("certificate renewal failed", "domains", m.domains, "error", err)
+			} else {
+				logger.Info("certificate renewed", "domains", m.domains, "expires", cert.Leaf.NotAfter)
+			}
+		}
+		time.Sleep(certCheck)
+	}
+}
+
+// getCertificate is the tls.Config GetCertificate of the server
+func (m *certManager) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.Lock()
+	defer m.Unlock()
+	if m.cert == nil {
+		return nil, errNoCertificate
+	}
+	return m.cert, nil
+}
+
+// handler answers the http-01 challenges, redirecting other requests to
+// the same URL over HTTPS on port
+func (m *certManager) handler(port string) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(acme.ChallengePath, m.client.Challenges)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+	return mux
+}
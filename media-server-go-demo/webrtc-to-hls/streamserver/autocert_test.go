@@ -0,0 +1,77 @@
+package streamserver
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/acme"
+)
+
+func TestCertManager(t *testing.T) {
+	dir := t.TempDir()
+	key, err := loadKey(filepath.Join(dir, "key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := loadKey(filepath.Join(dir, "key.pem")); err != nil || !again.Equal(key) {
+		t.Fatalf("key not cached: %v", err)
+	}
+	notAfter := time.Date(2026, 12, 31, 0, 0, 0, 0, time.UTC)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "live.example.com"},
+		DNSNames:     []string{"live.example.com"},
+		NotBefore:    notAfter.Add(-90 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "cert.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+
+	now := notAfter.Add(-60 * 24 * time.Hour)
+	m := &certManager{client: &acme.Client{Challenges: &acme.Challenges{}}, domains: []string{"live.example.com"}, dir: dir, now: func() time.Time { return now }}
+	if _, err := m.getCertificate(nil); err != errNoCertificate {
+		t.Fatalf("err = %v", err)
+	}
+	if !m.due() {
+		t.Fatal("not due without a certificate")
+	}
+	if err := m.load(); err != nil {
+		t.Fatal(err)
+	}
+	if cert, err := m.getCertificate(nil); err != nil || cert.Leaf.NotAfter != notAfter {
+		t.Fatalf("certificate = %v, %v", cert, err)
+	}
+	if m.due() {
+		t.Fatal("due 60 days before expiring")
+	}
+	if now = notAfter.Add(-20 * 24 * time.Hour); !m.due() {
+		t.Fatal("not due 20 days before expiring")
+	}
+	now = notAfter.Add(-60 * 24 * time.Hour)
+	if m.domains = append(m.domains, "www.example.com"); !m.due() {
+		t.Fatal("not due for a new domain")
+	}
+
+	rec := httptest.NewRecorder()
+	m.handler("9000").ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://live.example.com/watch?stream=main", nil))
+	if location := rec.Header().Get("Location"); rec.Code != http.StatusMovedPermanently || location != "https://live.example.com:9000/watch?stream=main" {
+		t.Fatalf("redirect %d to %s", rec.Code, location)
+	}
+	rec = httptest.NewRecorder()
+	m.handler("443").ServeHTTP(rec, httptest.NewRequest(http.MethodGet, acme.ChallengePath+"unknown", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("unknown challenge answered %d", rec.Code)
+	}
+}
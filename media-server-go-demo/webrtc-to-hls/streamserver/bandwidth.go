@@ -0,0 +1,72 @@
+package streamserver
+
+import (
+	"time"
+
+	mediaserver "github.com/notedit/media-server-go"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+)
+
+// transportFeedback turns the cumulative packet counters of a track into
+// the loss of each interval between stats messages
+type transportFeedback struct {
+	lost, received uint
+}
+
+// next returns the stats of an interval from the track's stats per
+// encoding: the bitrates and the packets of all simulcast encodings add up,
+// the estimate is the transport's
+func (f *transportFeedback) next(stats map[string]*mediaserver.IncomingAllStats) client.Stats {
+	var out client.Stats
+	var lost, received uint
+	for _, s := range stats {
+		if s == nil || s.Media == nil {
+			continue
+		}
+		out.ReceivedBitrate += int(s.Total)
+		if int(s.Remb) > out.EstimatedBitrate {
+			out.EstimatedBitrate = int(s.Remb)
+		}
+		if int(s.Rtt) > out.RttMs {
+			out.RttMs = int(s.Rtt)
+		}
+		lost += s.Media.LostPackets
+		received += s.Media.NumPackets
+	}
+	if lost >= f.lost && received >= f.received {
+		if expected := lost - f.lost + received - f.received; expected > 0 {
+			out.PacketLoss = float64(lost-f.lost) / float64(expected)
+		}
+	}
+	// counters start over when the encodings change
+	f.lost, f.received = lost, received
+	return out
+}
+
+// sendTransportStats sends the transport feedback of track to the
+// publisher every publisher_stats_interval seconds (2, 0 to disable) until
+// the session closes, and logs the REMB estimates at debug level. Stats
+// messages are not recorded on the timeline, they would crowd it out.
+func (s *session) sendTransportStats(track *mediaserver.IncomingStreamTrack) {
+	interval := time.Duration(envInt("publisher_stats_interval", 2)) * time.Second
+	if interval <= 0 || s.conn == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var feedback transportFeedback
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		stats := feedback.next(track.GetStats())
+		s.log.get().Debug("transport feedback", "remb", stats.EstimatedBitrate, "received", stats.ReceivedBitrate,
+			"loss", stats.PacketLoss, "rttMs", stats.RttMs)
+		if err := s.conn.send(client.Message{Cmd: client.CmdStats, Stats: &stats}); err != nil {
+			return
+		}
+	}
+}
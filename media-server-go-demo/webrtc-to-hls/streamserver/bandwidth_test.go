@@ -0,0 +1,39 @@
+package streamserver
+
+import (
+	"testing"
+
+	mediaserver "github.com/notedit/media-server-go"
+)
+
+func TestTransportFeedback(t *testing.T) {
+	encoding := func(lost, received, total, remb uint) *mediaserver.IncomingAllStats {
+		return &mediaserver.IncomingAllStats{
+			Rtt:   40,
+			Total: total,
+			Remb:  remb,
+			Media: &mediaserver.IncomingStats{LostPackets: lost, NumPackets: received},
+		}
+	}
+	var f transportFeedback
+	stats := f.next(map[string]*mediaserver.IncomingAllStats{"": encoding(10, 990, 1500000, 2000000)})
+	if stats.EstimatedBitrate != 2000000 || stats.ReceivedBitrate != 1500000 || stats.PacketLoss != 0.01 || stats.RttMs != 40 {
+		t.Fatalf("first interval %+v", stats)
+	}
+	// simulcast encodings add up, the loss is of the interval only
+	stats = f.next(map[string]*mediaserver.IncomingAllStats{
+		"h": encoding(20, 1480, 1500000, 2500000),
+		"l": encoding(0, 500, 300000, 2500000),
+	})
+	if stats.EstimatedBitrate != 2500000 || stats.ReceivedBitrate != 1800000 || stats.PacketLoss != 0.01 {
+		t.Fatalf("second interval %+v", stats)
+	}
+	// counters starting over are not counted as a negative loss
+	stats = f.next(map[string]*mediaserver.IncomingAllStats{"": encoding(1, 99, 100000, 0)})
+	if stats.PacketLoss != 0 || stats.EstimatedBitrate != 0 {
+		t.Fatalf("after a reset %+v", stats)
+	}
+	if stats := f.next(map[string]*mediaserver.IncomingAllStats{"": encoding(2, 198, 100000, 0)}); stats.PacketLoss != 0.01 {
+		t.Fatalf("after a reset %+v", stats)
+	}
+}
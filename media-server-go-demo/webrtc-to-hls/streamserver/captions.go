@@ -0,0 +1,282 @@
+package streamserver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/captions"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/hlscheck"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/ident"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/metrics"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/playlist"
+)
+
+var captionChunks = metrics.NewCounter("caption_chunks_total",
+	"Audio chunks of captioned outputs, by result: cue, silence, error, or dropped while the provider was busy", "result")
+
+// the speech-to-text providers of captions
+const (
+	captionsWhisper = "whisper"
+	captionsGoogle  = "google"
+)
+
+// captionsName is the WebVTT playlist of a captioned output, its segments
+// served below captionsDir, and captionsGroup the GROUP-ID of its
+// rendition in the master playlist
+const (
+	captionsName  = "captions.m3u8"
+	captionsDir   = "captions"
+	captionsGroup = "captions"
+)
+
+// captionLabel is the label of the data messages carrying captions to the
+// websocket viewers
+const captionLabel = "captions"
+
+// maxCues bounds the cues an output keeps, well past its playlist window
+const maxCues = 512
+
+// captionTimeout bounds the transcription of a chunk
+const captionTimeout = 20 * time.Second
+
+// tsClockBase is the PTS mpegtsmux stamps the start of its output with,
+// TS_MUX_CLOCK_BASE, an hour in 90kHz units
+const tsClockBase = 3600 * 90000
+
+// captionBranch decodes the AAC the TS segments mux into the PCM providers
+// transcribe, for the output to caption; it drops audio rather than
+// holding the pipeline back when the transcriber falls behind
+var captionBranch = fmt.Sprintf("aac. ! queue leaky=downstream ! avdec_aac ! audioconvert ! audioresample ! audio/x-raw,format=S16LE,channels=1,rate=%d ! appsink name=captionsink sync=false", captions.SampleRate)
+
+// captionProvider returns the provider captioning the output of key, from
+// captions / captions_overrides: whisper or google, nil when unset.
+// captions_url, captions_api_key and captions_model configure it.
+func captionProvider(key string) captions.Provider {
+	switch strings.TrimSpace(envForKey("captions", key)) {
+	case captionsWhisper:
+		return &captions.Whisper{URL: os.Getenv("captions_url"), APIKey: os.Getenv("captions_api_key"), Model: os.Getenv("captions_model")}
+	case captionsGoogle:
+		return &captions.Google{URL: os.Getenv("captions_url"), APIKey: os.Getenv("captions_api_key")}
+	}
+	return nil
+}
+
+// captionLanguage is the language spoken in the stream of key, from
+// captions_language / captions_language_overrides, en-US by default
+func captionLanguage(key string) string {
+	if language := strings.TrimSpace(envForKey("captions_language", key)); language != "" {
+		return language
+	}
+	return "en-US"
+}
+
+// captionChunk is how much audio is transcribed at once, from
+// captions_chunk_seconds: longer chunks transcribe better but show later
+func captionChunk() time.Duration {
+	seconds := envInt("captions_chunk_seconds", 3)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// outputCaptions are the cues of the captioned output of a stream key,
+// timed from the start of its generation
+type outputCaptions struct {
+	sync.Mutex
+	// generation is the captioned generation, zero without captions
+	generation int64
+	start      time.Time
+	cues       []captions.Cue
+	// through is the end of the latest chunk transcribed: the WebVTT
+	// segments of the media segments written before it are complete
+	through time.Time
+}
+
+// begin captions generation, its output started at start
+func (c *outputCaptions) begin(generation int64, start time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	c.generation, c.start, c.cues, c.through = generation, start, nil, time.Time{}
+}
+
+// end stops captioning the output
+func (c *outputCaptions) end() {
+	c.begin(0, time.Time{})
+}
+
+// active reports whether the output is captioned
+func (c *outputCaptions) active() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.generation != 0
+}
+
+// add records the transcript of the audio of generation from from until to,
+// empty for silence, the oldest cue dropped past maxCues
+func (c *outputCaptions) add(generation int64, from, to time.Time, text string) {
+	c.Lock()
+	defer c.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if to.After(c.through) {
+		c.through = to
+	}
+	if text == "" {
+		return
+	}
+	c.cues = append(c.cues, captions.Cue{Start: from.Sub(c.start), End: to.Sub(c.start), Text: text})
+	if len(c.cues) > maxCues {
+		c.cues = append([]captions.Cue(nil), c.cues[len(c.cues)-maxCues:]...)
+	}
+}
+
+// transcribed is the end of the latest chunk transcribed
+func (c *outputCaptions) transcribed() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.through
+}
+
+// segment writes the WebVTT segment of the media segment of generation
+// written from from until to, see segmentWindow
+func (c *outputCaptions) segment(generation int64, from, to time.Time) []byte {
+	c.Lock()
+	defer c.Unlock()
+	if generation != c.generation {
+		return captions.Segment(nil, 0, 0, tsClockBase)
+	}
+	return captions.Segment(c.cues, from.Sub(c.start), to.Sub(c.start), tsClockBase)
+}
+
+// speech is a chunk of the audio of an output, heard from from until to
+type speech struct {
+	pcm      []byte
+	from, to time.Time
+}
+
+// transcribe captions generation of the output from the PCM of its
+// caption branch until the pipeline stops. Chunks are transcribed one at a
+// time, those arriving while the provider is busy dropped; each transcript
+// becomes a cue of the WebVTT segments and a data message to the websocket
+// viewers.
+func (s *session) transcribe(pcm <-chan []byte, provider captions.Provider, language string, generation int64) {
+	chunk := captionChunk()
+	size := int(chunk/time.Second) * captions.SampleRate * 2
+	chunks := make(chan speech, 1)
+	defer close(chunks)
+	go func() {
+		for sp := range chunks {
+			s.caption(provider, language, generation, sp)
+		}
+	}()
+	var buffered []byte
+	for frame := range pcm {
+		if buffered = append(buffered, frame...); len(buffered) < size {
+			continue
+		}
+		now := time.Now()
+		select {
+		case chunks <- speech{pcm: buffered, from: now.Add(-chunk), to: now}:
+		default:
+			captionChunks.Inc("dropped")
+		}
+		buffered = nil
+	}
+}
+
+// caption transcribes a chunk of the audio of generation
+func (s *session) caption(provider captions.Provider, language string, generation int64, sp speech) {
+	ctx, cancel := context.WithTimeout(context.Background(), captionTimeout)
+	defer cancel()
+	text, err := provider.Transcribe(ctx, sp.pcm, language)
+	// a chunk that failed is left uncaptioned rather than holding the
+	// playlist back
+	outputs.get(s.key).captions.add(generation, sp.from, sp.to, text)
+	if err != nil {
+		captionChunks.Inc("error")
+		s.log.get().Warn("transcription failed", "error", err)
+		return
+	}
+	if text == "" {
+		captionChunks.Inc("silence")
+		return
+	}
+	captionChunks.Inc("cue")
+	s.sendViewers(client.Message{Cmd: client.CmdData, Label: captionLabel, Data: text})
+}
+
+// captionsPath is where players fetch the WebVTT playlist of key
+func captionsPath(key string) string {
+	return "/hls/" + key + "/" + captionsName
+}
+
+// captionsPlaylist renders the WebVTT playlist of out: a segment per media
+// segment of the live playlist, up to the last one fully transcribed
+func captionsPlaylist(out *streamOutput) ([]byte, error) {
+	data, err := ioutil.ReadFile(out.playlist())
+	if err != nil {
+		return nil, err
+	}
+	live, err := hlscheck.ParseMedia(data)
+	if err != nil {
+		return nil, err
+	}
+	through := out.captions.transcribed()
+	m := playlist.Media{TargetDuration: live.TargetDuration, MediaSequence: live.MediaSequence, Ended: live.Ended}
+	for _, s := range live.Segments {
+		name := path.Base(s.URI)
+		if _, _, to, ok := segmentWindow(out.dir, name); ok && to.After(through) {
+			break
+		}
+		m.Segments = append(m.Segments, playlist.Segment{
+			URI:      captionsDir + "/" + strings.TrimSuffix(name, path.Ext(name)) + ".vtt",
+			Duration: s.Duration,
+		})
+	}
+	var b strings.Builder
+	m.Write(&b)
+	return []byte(b.String()), nil
+}
+
+// serveCaptions serves the captions of a captioned output: its WebVTT
+// playlist, and the WebVTT segment of each media segment holding the cues
+// spoken while it was written
+func serveCaptions(c *gin.Context) {
+	parts := strings.Split(strings.TrimPrefix(c.Request.URL.Path, "/hls/"), "/")
+	if !strings.HasPrefix(c.Request.URL.Path, "/hls/") || ident.Check(ident.StreamKey, parts[0]) != nil {
+		c.Next()
+		return
+	}
+	list := len(parts) == 2 && parts[1] == captionsName
+	segment := len(parts) == 3 && parts[1] == captionsDir && path.Ext(parts[2]) == ".vtt"
+	out := outputs.lookup(parts[0])
+	if (!list && !segment) || out == nil || !out.captions.active() {
+		c.Next()
+		return
+	}
+	c.Abort()
+	if list {
+		data, err := captionsPlaylist(out)
+		if err != nil {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		c.Header("Cache-Control", "no-cache")
+		c.Data(http.StatusOK, "application/vnd.apple.mpegurl", data)
+		return
+	}
+	// a segment out of the window has no cues
+	generation, from, to, _ := segmentWindow(out.dir, strings.TrimSuffix(parts[2], ".vtt")+".ts")
+	c.Data(http.StatusOK, "text/vtt", out.captions.segment(generation, from, to))
+}
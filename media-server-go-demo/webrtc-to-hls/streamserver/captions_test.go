@@ -0,0 +1,75 @@
+package streamserver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestServeCaptions(t *testing.T) {
+	savedDir, savedOutputs := hlsDir, outputs
+	defer func() { hlsDir, outputs = savedDir, savedOutputs }()
+	hlsDir, outputs = t.TempDir(), newStreamOutputs(time.Now)
+
+	out := outputs.get("captioned")
+	os.MkdirAll(out.dir, 0755)
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	live := "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:0\n"
+	for i := 0; i < 3; i++ {
+		name := fmt.Sprintf("segment-3-%05d.ts", i)
+		at := start.Add(time.Duration(2*i+2) * time.Second)
+		ioutil.WriteFile(filepath.Join(out.dir, name), []byte{0x47}, 0644)
+		os.Chtimes(filepath.Join(out.dir, name), at, at)
+		live += "#EXTINF:2.000,\n" + name + "\n"
+	}
+	ioutil.WriteFile(out.playlist(), []byte(live), 0644)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(serveCaptions)
+	r.Use(func(c *gin.Context) { c.Status(http.StatusTeapot) })
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+	if w := get(captionsPath("captioned")); w.Code != http.StatusTeapot {
+		t.Fatalf("captions of an output without = %d", w.Code)
+	}
+
+	out.captions.begin(3, start)
+	out.captions.add(3, start.Add(time.Second), start.Add(3*time.Second), "hello")
+	out.captions.add(3, start.Add(3*time.Second), start.Add(4500*time.Millisecond), "")
+	out.captions.add(2, start.Add(3*time.Second), start.Add(9*time.Second), "previous output")
+
+	// the last segment is written after the audio transcribed so far
+	want := "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:0\n" +
+		"#EXTINF:2.000,\ncaptions/segment-3-00000.vtt\n#EXTINF:2.000,\ncaptions/segment-3-00001.vtt\n"
+	if w := get(captionsPath("captioned")); w.Code != http.StatusOK || w.Body.String() != want {
+		t.Fatalf("captions playlist %d:\n%s\nwant:\n%s", w.Code, w.Body, want)
+	}
+	for name, cue := range map[string]string{
+		"segment-3-00000.vtt": "00:00:01.000 --> 00:00:03.000\nhello\n",
+		"segment-3-00001.vtt": "00:00:01.000 --> 00:00:03.000\nhello\n",
+		"segment-3-00002.vtt": "",
+	} {
+		w := get("/hls/captioned/captions/" + name)
+		body := w.Body.String()
+		if w.Code != http.StatusOK || !strings.HasPrefix(body, "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:324000000,") || !strings.HasSuffix(body, cue) || strings.Contains(body, "-->") != (cue != "") {
+			t.Fatalf("%s %d:\n%s", name, w.Code, body)
+		}
+	}
+
+	out.captions.end()
+	if w := get(captionsPath("captioned")); w.Code != http.StatusTeapot {
+		t.Fatalf("captions after the end = %d", w.Code)
+	}
+}
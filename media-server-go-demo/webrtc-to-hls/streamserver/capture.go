@@ -0,0 +1,302 @@
+package streamserver
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	mediaserver "github.com/notedit/media-server-go"
+)
+
+var (
+	errCapturing    = errors.New("already capturing")
+	errNotCapturing = errors.New("not capturing")
+	errNoTransport  = errors.New("the stream is not published over WebRTC")
+	errCaptureFile  = errors.New("cannot open the capture file")
+)
+
+// captureCheck is how often a capture checks whether its file is due to
+// rotate
+const captureCheck = time.Second
+
+// captureDir is where packet captures are written, capture_dir (captures),
+// one directory per stream key
+func captureDir() string {
+	if dir := os.Getenv("capture_dir"); dir != "" {
+		return dir
+	}
+	return "captures"
+}
+
+// captureRotation is when a capture moves on to a new file: every
+// capture_rotate_seconds (300), or once its file reaches capture_rotate_mb
+// megabytes (100). capture_max_files (10) bounds the files a capture keeps,
+// the oldest removed first.
+type captureRotation struct {
+	every    time.Duration
+	size     int64
+	maxFiles int
+}
+
+func captureRotationFromEnv() captureRotation {
+	r := captureRotation{
+		every:    time.Duration(envInt("capture_rotate_seconds", 300)) * time.Second,
+		size:     int64(envInt("capture_rotate_mb", 100)) << 20,
+		maxFiles: envInt("capture_max_files", 10),
+	}
+	if r.maxFiles < 1 {
+		r.maxFiles = 1
+	}
+	return r
+}
+
+// due reports whether a file opened at opened, size bytes long by now, is
+// to be rotated
+func (r captureRotation) due(now, opened time.Time, size int64) bool {
+	return (r.every > 0 && now.Sub(opened) >= r.every) || (r.size > 0 && size >= r.size)
+}
+
+// capturePath names the capture file of key opened at start, e.g.
+// captures/main/main-20261014T101500.250Z.pcap
+func capturePath(dir, key string, start time.Time) string {
+	return filepath.Join(dir, key, fmt.Sprintf("%s-%s.pcap", key, start.UTC().Format("20060102T150405.000Z")))
+}
+
+// pcapWriter switches the pcap file the packets of a transport are dumped
+// into, see mediaserver.PCAPDumper
+type pcapWriter interface {
+	Rotate(filename string) bool
+	Stop()
+}
+
+// packetCapture dumps the RTP and RTCP a publisher sends into pcap files,
+// rotated as they grow old or large, for codec and packetization issues to
+// be looked into offline
+type packetCapture struct {
+	writer   pcapWriter
+	dir      string
+	key      string
+	rotation captureRotation
+	now      func() time.Time
+	started  time.Time
+
+	sync.Mutex
+	file   string
+	opened time.Time
+	// files are the files written, oldest first
+	files []string
+
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+func newPacketCapture(writer pcapWriter, dir, key string, rotation captureRotation, now func() time.Time) (*packetCapture, error) {
+	c := &packetCapture{writer: writer, dir: dir, key: key, rotation: rotation, now: now, done: make(chan struct{})}
+	if err := c.rotate(); err != nil {
+		return nil, err
+	}
+	c.started = c.opened
+	return c, nil
+}
+
+// rotate dumps into a new file, removing the oldest past maxFiles
+func (c *packetCapture) rotate() error {
+	now := c.now()
+	path := capturePath(c.dir, c.key, now)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if !c.writer.Rotate(path) {
+		return errCaptureFile
+	}
+	c.Lock()
+	c.file, c.opened = path, now
+	c.files = append(c.files, path)
+	var removed []string
+	if len(c.files) > c.rotation.maxFiles {
+		removed = c.files[:len(c.files)-c.rotation.maxFiles]
+		c.files = append([]string(nil), c.files[len(removed):]...)
+	}
+	c.Unlock()
+	for _, file := range removed {
+		os.Remove(file)
+	}
+	return nil
+}
+
+// check rotates the file once due
+func (c *packetCapture) check() error {
+	c.Lock()
+	file, opened := c.file, c.opened
+	c.Unlock()
+	var size int64
+	if info, err := os.Stat(file); err == nil {
+		size = info.Size()
+	}
+	if !c.rotation.due(c.now(), opened, size) {
+		return nil
+	}
+	return c.rotate()
+}
+
+// run rotates the files until stop; a file that fails to open stops the
+// capture
+func (c *packetCapture) run(failed func(error)) {
+	ticker := time.NewTicker(captureCheck)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.check(); err != nil {
+				failed(err)
+				return
+			}
+		}
+	}
+}
+
+// stop closes the current file
+func (c *packetCapture) stop() {
+	c.stopOnce.Do(func() {
+		close(c.done)
+		c.writer.Stop()
+	})
+}
+
+// current is the file dumped into and those kept before it
+func (c *packetCapture) current() (string, []string) {
+	c.Lock()
+	defer c.Unlock()
+	return c.file, append([]string(nil), c.files...)
+}
+
+// startCapture starts dumping the packets of the publisher. A transport
+// hands its packets to a single dumper for its life, attached on the first
+// capture and stopped in between.
+func (s *session) startCapture() (*packetCapture, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return nil, errNotLive
+	}
+	if s.transport == nil {
+		return nil, errNoTransport
+	}
+	if s.capture != nil {
+		return nil, errCapturing
+	}
+	if s.dumper == nil {
+		dumper := mediaserver.NewPCAPDumper()
+		if !s.transport.DumpTo(dumper, true, false, true) {
+			dumper.Delete()
+			return nil, errCaptureFile
+		}
+		s.dumper = dumper
+	}
+	c, err := newPacketCapture(s.dumper, captureDir(), s.key, captureRotationFromEnv(), time.Now)
+	if err != nil {
+		s.dumper.Stop()
+		return nil, err
+	}
+	s.capture = c
+	s.timeline.add(eventPipeline, "capturing packets to "+c.file)
+	go c.run(func(err error) {
+		if s.endCapture(c) {
+			s.logf("packet capture stopped: %v", err)
+		}
+	})
+	return c, nil
+}
+
+// endCapture stops c if it is the capture of the session
+func (s *session) endCapture(c *packetCapture) bool {
+	s.Lock()
+	owned := s.capture == c
+	if owned {
+		s.capture = nil
+	}
+	s.Unlock()
+	if owned {
+		c.stop()
+	}
+	return owned
+}
+
+// stopCapture stops dumping the packets of the publisher
+func (s *session) stopCapture() (*packetCapture, error) {
+	s.Lock()
+	c := s.capture
+	s.Unlock()
+	if c == nil || !s.endCapture(c) {
+		return nil, errNotCapturing
+	}
+	file, _ := c.current()
+	s.timeline.add(eventPipeline, "captured packets to "+file)
+	return c, nil
+}
+
+// startStreamCapture handles POST /api/v1/streams/:id/capture
+func startStreamCapture(c *gin.Context) {
+	admin, ok := adminIdentity(c)
+	if !ok {
+		return
+	}
+	sess := liveSession(c)
+	if sess == nil {
+		return
+	}
+	capture, err := sess.startCapture()
+	switch err {
+	case nil:
+	case errCapturing, errNotLive, errNoTransport:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	file, _ := capture.current()
+	logger.Info("packet capture started", "stream", sess.key, "file", file, "admin", admin)
+	c.JSON(http.StatusOK, gin.H{"stream": sess.key, "file": file})
+}
+
+// stopStreamCapture handles DELETE /api/v1/streams/:id/capture, answering
+// the files kept
+func stopStreamCapture(c *gin.Context) {
+	admin, ok := adminIdentity(c)
+	if !ok {
+		return
+	}
+	sess := liveSession(c)
+	if sess == nil {
+		return
+	}
+	capture, err := sess.stopCapture()
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	_, files := capture.current()
+	logger.Info("packet capture stopped", "stream", sess.key, "files", len(files), "admin", admin)
+	c.JSON(http.StatusOK, gin.H{"stream": sess.key, "files": files, "durationMs": milliseconds(time.Since(capture.started))})
+}
+
+// captureFile is the file the packets of the publisher are dumped into,
+// empty when not capturing
+func (s *session) captureFile() string {
+	s.Lock()
+	c := s.capture
+	s.Unlock()
+	if c == nil {
+		return ""
+	}
+	file, _ := c.current()
+	return file
+}
@@ -0,0 +1,68 @@
+package streamserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeDumper writes the files a PCAPDumper would
+type fakeDumper struct {
+	opened  []string
+	stopped bool
+}
+
+func (d *fakeDumper) Rotate(filename string) bool {
+	d.opened = append(d.opened, filename)
+	d.stopped = false
+	return ioutil.WriteFile(filename, nil, 0644) == nil
+}
+
+func (d *fakeDumper) Stop() {
+	d.stopped = true
+}
+
+func TestPacketCaptureRotation(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2026, 10, 14, 10, 15, 0, 250e6, time.UTC)
+	clock := func() time.Time { return now }
+	dumper := &fakeDumper{}
+	c, err := newPacketCapture(dumper, dir, "main", captureRotation{every: time.Minute, size: 1000, maxFiles: 2}, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := filepath.Join(dir, "main", "main-20261014T101500.250Z.pcap")
+	if file, _ := c.current(); file != first {
+		t.Fatalf("file = %s", file)
+	}
+
+	// neither old nor large enough
+	now = now.Add(30 * time.Second)
+	if c.check(); len(dumper.opened) != 1 {
+		t.Fatalf("rotated early: %v", dumper.opened)
+	}
+	// large enough
+	ioutil.WriteFile(first, make([]byte, 1000), 0644)
+	c.check()
+	// old enough
+	now = now.Add(time.Minute)
+	c.check()
+	if len(dumper.opened) != 3 {
+		t.Fatalf("opened = %v", dumper.opened)
+	}
+	file, files := c.current()
+	if file != dumper.opened[2] || len(files) != 2 || files[0] != dumper.opened[1] {
+		t.Fatalf("file %s of %v", file, files)
+	}
+	if _, err := os.Stat(first); !os.IsNotExist(err) {
+		t.Fatalf("the oldest file was kept: %v", err)
+	}
+
+	c.stop()
+	c.stop()
+	if !dumper.stopped {
+		t.Fatal("dumper not stopped")
+	}
+}
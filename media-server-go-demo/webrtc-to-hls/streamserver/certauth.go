@@ -0,0 +1,259 @@
+package streamserver
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/pubauth"
+)
+
+var (
+	errNoClientCert  = errors.New("client certificate required")
+	errCertNotMapped = errors.New("client certificate is not allowed to publish")
+	errCertRevoked   = errors.New("client certificate revoked")
+	errCertWrongKey  = errors.New("client certificate is not allowed to publish this stream")
+)
+
+// certIdentity names the publisher a certificate belongs to: its first URI,
+// DNS or email SAN, else the subject common name
+func certIdentity(cert *x509.Certificate) string {
+	switch {
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	}
+	return cert.Subject.CommonName
+}
+
+// reloadingFile re-reads a file whenever its modification time changes, so
+// edits take effect for the next session without a restart
+type reloadingFile struct {
+	path  string
+	parse func(data []byte) (interface{}, error)
+
+	lock    sync.Mutex
+	modTime time.Time
+	value   interface{}
+}
+
+func (f *reloadingFile) get() (interface{}, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return nil, err
+	}
+	if f.value != nil && info.ModTime().Equal(f.modTime) {
+		return f.value, nil
+	}
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+	value, err := f.parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", f.path, err)
+	}
+	f.value, f.modTime = value, info.ModTime()
+	return value, nil
+}
+
+// parseCertMap reads "identity stream-key" lines; # starts a comment
+func parseCertMap(data []byte) (interface{}, error) {
+	mapping := map[string]string{}
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: want \"identity stream-key\"", n)
+		}
+		mapping[fields[0]] = fields[1]
+	}
+	return mapping, scanner.Err()
+}
+
+// parseDenylist reads one identity or hex serial number per line
+func parseDenylist(data []byte) (interface{}, error) {
+	denied := map[string]bool{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			denied[strings.ToLower(line)] = true
+		}
+	}
+	return denied, nil
+}
+
+// revocationList is a CRL whose signature checked out
+type revocationList struct {
+	revoked    map[string]bool
+	nextUpdate time.Time
+}
+
+// crlParser reads the revoked serial numbers of a PEM or DER CRL, which must
+// be signed by one of cas
+func crlParser(cas []*x509.Certificate) func(data []byte) (interface{}, error) {
+	return func(data []byte) (interface{}, error) {
+		if block, _ := pem.Decode(data); block != nil {
+			data = block.Bytes
+		}
+		crl, err := x509.ParseRevocationList(data)
+		if err != nil {
+			return nil, err
+		}
+		var issuer *x509.Certificate
+		for _, ca := range cas {
+			if bytes.Equal(ca.RawSubject, crl.RawIssuer) {
+				issuer = ca
+				break
+			}
+		}
+		if issuer == nil {
+			return nil, errors.New("CRL not issued by a client_ca certificate")
+		}
+		if err := crl.CheckSignatureFrom(issuer); err != nil {
+			return nil, err
+		}
+		revoked := map[string]bool{}
+		for _, entry := range crl.RevokedCertificateEntries {
+			revoked[strings.ToLower(entry.SerialNumber.Text(16))] = true
+		}
+		return &revocationList{revoked: revoked, nextUpdate: crl.NextUpdate}, nil
+	}
+}
+
+// readCertificates reads the PEM certificates of the file at path
+func readCertificates(path string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%s: no certificates", path)
+	}
+	return certs, nil
+}
+
+// denied returns the serial numbers and identities list revokes. A CRL
+// past its next update fails, as a broken one does.
+func denied(list *reloadingFile, now time.Time) (map[string]bool, error) {
+	value, err := list.get()
+	if err != nil {
+		return nil, err
+	}
+	crl, ok := value.(*revocationList)
+	if !ok {
+		return value.(map[string]bool), nil
+	}
+	if !crl.nextUpdate.IsZero() && now.After(crl.nextUpdate) {
+		return nil, fmt.Errorf("%s: CRL stale since %s", list.path, crl.nextUpdate.Format(time.RFC3339))
+	}
+	return crl.revoked, nil
+}
+
+// certAuth maps verified client certificates to the stream keys they may publish
+type certAuth struct {
+	mapping  *reloadingFile
+	denylist *reloadingFile
+	crl      *reloadingFile
+}
+
+// newCertAuth reads client_cert_map, and the optional client_denylist and
+// client_crl, all reloaded when they change. The CRL must be signed by a
+// client_ca certificate.
+func newCertAuth() (*certAuth, error) {
+	path := os.Getenv("client_cert_map")
+	if path == "" {
+		return nil, errors.New("ingest_auth=cert needs client_cert_map")
+	}
+	auth := &certAuth{mapping: &reloadingFile{path: path, parse: parseCertMap}}
+	if _, err := auth.mapping.get(); err != nil {
+		return nil, err
+	}
+	if path := os.Getenv("client_denylist"); path != "" {
+		auth.denylist = &reloadingFile{path: path, parse: parseDenylist}
+	}
+	if path := os.Getenv("client_crl"); path != "" {
+		if os.Getenv("client_ca") == "" {
+			return nil, errors.New("client_crl needs client_ca to check its signature")
+		}
+		cas, err := readCertificates(os.Getenv("client_ca"))
+		if err != nil {
+			return nil, err
+		}
+		auth.crl = &reloadingFile{path: path, parse: crlParser(cas)}
+	}
+	return auth, nil
+}
+
+// authorize returns the identity of the verified client certificate of
+// state if it may publish key
+func (a *certAuth) authorize(state *tls.ConnectionState, key string) (string, error) {
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return "", errNoClientCert
+	}
+	cert := state.VerifiedChains[0][0]
+	identity := certIdentity(cert)
+	serial := strings.ToLower(cert.SerialNumber.Text(16))
+
+	for _, list := range []*reloadingFile{a.denylist, a.crl} {
+		if list == nil {
+			continue
+		}
+		revoked, err := denied(list, time.Now())
+		if err != nil {
+			// fail closed, a broken or stale revocation list must not let
+			// revoked certificates in
+			return identity, err
+		}
+		if revoked[serial] || revoked[strings.ToLower(identity)] {
+			return identity, errCertRevoked
+		}
+	}
+
+	value, err := a.mapping.get()
+	if err != nil {
+		return identity, err
+	}
+	mapped, ok := value.(map[string]string)[identity]
+	switch {
+	case !ok:
+		return identity, errCertNotMapped
+	case key != "" && mapped != key:
+		return identity, errCertWrongKey
+	}
+	return identity, nil
+}
+
+// Authenticate authorizes the client certificate of r for its key
+func (a *certAuth) Authenticate(r pubauth.Request) (string, error) {
+	return a.authorize(r.TLS, r.Key)
+}
@@ -0,0 +1,176 @@
+package streamserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/pubauth"
+)
+
+func testCert(t *testing.T, serial int64, name string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestCertAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mapPath := filepath.Join(dir, "map")
+	denyPath := filepath.Join(dir, "deny")
+	ioutil.WriteFile(mapPath, []byte("# venue encoders\nstage-a live-a\nstage-b live-b\n"), 0644)
+	ioutil.WriteFile(denyPath, nil, 0644)
+
+	auth := &certAuth{
+		mapping:  &reloadingFile{path: mapPath, parse: parseCertMap},
+		denylist: &reloadingFile{path: denyPath, parse: parseDenylist},
+	}
+	state := func(cert *x509.Certificate) *tls.ConnectionState {
+		return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	}
+	stageA := testCert(t, 0x1a, "stage-a")
+
+	if _, err := auth.authorize(nil, "live-a"); err != errNoClientCert {
+		t.Fatalf("no cert err = %v", err)
+	}
+	if identity, err := auth.authorize(state(stageA), "live-a"); err != nil || identity != "stage-a" {
+		t.Fatalf("authorize = %q, %v", identity, err)
+	}
+	if _, err := auth.authorize(state(stageA), "live-b"); err != errCertWrongKey {
+		t.Fatalf("wrong key err = %v", err)
+	}
+	if _, err := auth.authorize(state(testCert(t, 2, "unknown")), "live-a"); err != errCertNotMapped {
+		t.Fatalf("unmapped err = %v", err)
+	}
+
+	// revocation applies to the next publish, without a restart
+	ioutil.WriteFile(denyPath, []byte("1A\n"), 0644)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(denyPath, later, later)
+	if _, err := auth.authorize(state(stageA), "live-a"); err != errCertRevoked {
+		t.Fatalf("revoked err = %v", err)
+	}
+}
+
+// testCA returns a CA certificate allowed to sign CRLs, and its key
+func testCA(t *testing.T, name string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca, key
+}
+
+func TestCertAuthCRL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mapPath := filepath.Join(dir, "map")
+	crlPath := filepath.Join(dir, "crl")
+	ioutil.WriteFile(mapPath, []byte("stage-a live-a\n"), 0644)
+
+	ca, key := testCA(t, "venue CA")
+	forger, forgerKey := testCA(t, "venue CA")
+	modified := time.Now()
+	writeCRL := func(issuer *x509.Certificate, signer *ecdsa.PrivateKey, nextUpdate time.Time) {
+		der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+			Number:                    big.NewInt(1),
+			ThisUpdate:                time.Now().Add(-time.Hour),
+			NextUpdate:                nextUpdate,
+			RevokedCertificateEntries: []x509.RevocationListEntry{{SerialNumber: big.NewInt(0x1a), RevocationTime: time.Now()}},
+		}, issuer, signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.WriteFile(crlPath, der, 0644)
+		modified = modified.Add(time.Minute)
+		os.Chtimes(crlPath, modified, modified)
+	}
+	auth := &certAuth{
+		mapping: &reloadingFile{path: mapPath, parse: parseCertMap},
+		crl:     &reloadingFile{path: crlPath, parse: crlParser([]*x509.Certificate{ca})},
+	}
+	state := func(cert *x509.Certificate) *tls.ConnectionState {
+		return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	}
+	revoked, valid := testCert(t, 0x1a, "stage-a"), testCert(t, 0x1b, "stage-a")
+
+	writeCRL(ca, key, time.Now().Add(time.Hour))
+	if _, err := auth.authorize(state(revoked), "live-a"); err != errCertRevoked {
+		t.Fatalf("revoked err = %v", err)
+	}
+	if _, err := auth.authorize(state(valid), "live-a"); err != nil {
+		t.Fatal(err)
+	}
+	// a CRL signed by another key under the same name fails closed
+	writeCRL(forger, forgerKey, time.Now().Add(time.Hour))
+	if _, err := auth.authorize(state(valid), "live-a"); err == nil {
+		t.Fatal("forged CRL accepted")
+	}
+	writeCRL(ca, key, time.Now().Add(-time.Minute))
+	if _, err := auth.authorize(state(valid), "live-a"); err == nil || !strings.Contains(err.Error(), "stale") {
+		t.Fatalf("stale CRL err = %v", err)
+	}
+}
+
+func TestParseStreamKeys(t *testing.T) {
+	value, err := parseStreamKeys([]byte("# studio\nlive-a s3cret\n\nlive-b other\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := value.(pubauth.Keys); len(keys) != 2 || keys["live-a"] != "s3cret" {
+		t.Fatalf("keys = %v", keys)
+	}
+	if _, err := parseStreamKeys([]byte("live-a\n")); err == nil {
+		t.Fatal("line without a secret accepted")
+	}
+}
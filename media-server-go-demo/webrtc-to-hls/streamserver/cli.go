@@ -0,0 +1,496 @@
+package streamserver
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/ident"
+)
+
+// command is a subcommand of the server binary
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+var commands = []command{
+	{"serve", "run the server, the default", serveCommand},
+	{"validate-config", "check the settings and exit", validateConfigCommand},
+	{"list-pipelines", "list the publishes of a running server and their pipelines", listPipelinesCommand},
+	{"record", "start or stop recording a stream of a running server", recordCommand},
+	{"bench", "load a running server with synthetic publishers and report the streams per core", benchCommand},
+}
+
+// errUsage fails a command run with wrong arguments, its usage printed
+var errUsage = errors.New("usage")
+
+// Main runs the subcommand of args, the arguments of the server binary,
+// exiting with status 1 when it fails
+func Main(args []string) {
+	if err := runCommand(args); err != nil {
+		if err != errUsage {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(1)
+	}
+}
+
+// runCommand runs the subcommand args name, serve when args start with a
+// flag or are empty, so the server still starts without one
+func runCommand(args []string) error {
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	for _, c := range commands {
+		if c.name == name {
+			return c.run(args)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\ncommands:\n", name)
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", c.name, c.summary)
+	}
+	return errUsage
+}
+
+// newFlags returns the flag set of a command taking settings, see
+// parseSettings, with -env-file
+func newFlags(name, usage string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	envFile := fs.String("env-file", "", "settings file read after the flags and the environment (default .env when it exists)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s %s\n\n", os.Args[0], usage)
+		fs.PrintDefaults()
+		fmt.Fprintln(fs.Output(), "\nAny setting may be given as a flag, its underscores as dashes: --max-publishers=10 sets max_publishers.")
+	}
+	return fs, envFile
+}
+
+// parseSettings parses args with fs, the flags fs does not define taking
+// settings: --max-publishers=10 or --max-publishers 10 sets max_publishers,
+// over the environment and the env file, which is then loaded. It returns
+// the arguments left.
+func parseSettings(fs *flag.FlagSet, envFile *string, args []string) ([]string, error) {
+	var own []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || !strings.HasPrefix(arg, "-") || arg == "-" {
+			own = append(own, args[i:]...)
+			break
+		}
+		name := strings.TrimLeft(arg, "-")
+		value, hasValue := "", false
+		if eq := strings.Index(name, "="); eq >= 0 {
+			name, value, hasValue = name[:eq], name[eq+1:], true
+		}
+		if name == "h" || name == "help" {
+			own = append(own, arg)
+			continue
+		}
+		if f := fs.Lookup(name); f != nil {
+			own = append(own, arg)
+			b, isBool := f.Value.(interface{ IsBoolFlag() bool })
+			if !hasValue && !(isBool && b.IsBoolFlag()) && i+1 < len(args) {
+				i++
+				own = append(own, args[i])
+			}
+			continue
+		}
+		if !hasValue {
+			if i+1 == len(args) {
+				fs.Usage()
+				return nil, fmt.Errorf("setting %s needs a value", name)
+			}
+			i++
+			value = args[i]
+		}
+		os.Setenv(strings.Replace(name, "-", "_", -1), value)
+	}
+	if err := fs.Parse(own); err != nil {
+		if err == flag.ErrHelp {
+			return nil, errUsage
+		}
+		return nil, err
+	}
+	path := *envFile
+	if path == "" {
+		path = ".env"
+	}
+	if err := loadSettingsFile(path, *envFile != ""); err != nil {
+		return nil, err
+	}
+	return fs.Args(), nil
+}
+
+// serveCommand runs the server
+func serveCommand(args []string) error {
+	fs, envFile := newFlags("serve", "[serve] [flags]")
+	rest, err := parseSettings(fs, envFile, args)
+	if err != nil {
+		return err
+	}
+	if len(rest) > 0 {
+		fs.Usage()
+		return errUsage
+	}
+	runServer()
+	return nil
+}
+
+// validateConfigCommand checks the settings as the server would at
+// startup, without listening or pulling anything: those of the instance,
+// and those of each stream key named in an override
+func validateConfigCommand(args []string) error {
+	fs, envFile := newFlags("validate-config", "validate-config [flags]")
+	rest, err := parseSettings(fs, envFile, args)
+	if err != nil {
+		return err
+	}
+	if len(rest) > 0 {
+		fs.Usage()
+		return errUsage
+	}
+	errs := validateConfig()
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d invalid settings", len(errs))
+	}
+	fmt.Println("config ok")
+	return nil
+}
+
+// validateConfig runs the checks of the startup of the server that have no
+// effect outside the process, then resolves the output of every stream key
+// with overrides as a publish of it would
+func validateConfig() []error {
+	var errs []error
+	for _, setup := range []func() error{
+		setupLogging,
+		setupTracing,
+		validateHLS,
+		setupCodecPreference,
+		setupTranscode,
+		setupEncoder,
+		setupWebhooks,
+		setupKeyframes,
+		setupPlayback,
+		setupEncryption,
+		setupDRM,
+		setupStorage,
+		setupEndpoints,
+		setupProxies,
+	} {
+		if err := setup(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, key := range overriddenKeys() {
+		if err := validateKey(key); err != nil {
+			errs = append(errs, fmt.Errorf("stream %s: %v", key, err))
+		}
+	}
+	return errs
+}
+
+// validateHLS is setupHLS without creating hlsDir
+func validateHLS() error {
+	config, err := loadHLSConfig(os.Getenv("hls_config"))
+	if err != nil {
+		return err
+	}
+	return config.apply()
+}
+
+// overriddenKeys returns the stream keys of all <name>_overrides settings
+func overriddenKeys() []string {
+	seen := map[string]bool{}
+	for _, variable := range os.Environ() {
+		name := strings.SplitN(variable, "=", 2)[0]
+		if !strings.HasSuffix(name, "_overrides") {
+			continue
+		}
+		for key := range envOverrides(strings.TrimSuffix(name, "_overrides")) {
+			seen[key] = true
+		}
+	}
+	keys := make([]string, 0, len(seen))
+	for key := range seen {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// validateKey resolves the settings of a publish of key, as the publish
+// handlers do
+func validateKey(key string) error {
+	if err := ident.Check(ident.StreamKey, key); err != nil {
+		return err
+	}
+	preset, err := resolvePreset("", key)
+	profile, profileErr := resolveProfile(key)
+	if err == nil {
+		err = profileErr
+	}
+	if err == nil {
+		preset, err = profile.fit(preset, false)
+	}
+	if err == nil {
+		_, err = resolveDVR(preset, key)
+	}
+	var dash bool
+	if err == nil {
+		dash, err = resolveDASH("", key)
+	}
+	var container string
+	if err == nil {
+		container, err = resolveContainer(profile, key)
+	}
+	if err == nil {
+		_, err = resolveLadder(preset, profile, container, key)
+	}
+	var passthrough bool
+	if err == nil {
+		passthrough, err = resolveAV1Passthrough(container, key)
+	}
+	var hevc bool
+	if err == nil {
+		hevc, err = resolveH265Passthrough(container, key)
+	}
+	if err == nil {
+		_, err = resolveOpusPassthrough(profile, container, key)
+	}
+	if err == nil {
+		_, err = resolveLayer(key)
+	}
+	if err == nil {
+		_, err = resolveSRTEgress(key)
+	}
+	if err == nil {
+		_, err = resolvePublishPolicy(key)
+	}
+	if err == nil {
+		err = checkPassthrough(preset, "", key)
+	}
+	if err == nil {
+		err = checkEncryption(container, dash, preset, key)
+	}
+	if err == nil {
+		err = checkDRM(container, passthrough || hevc, preset, key)
+	}
+	return err
+}
+
+// apiFlags adds to fs the flags of the commands calling the API of a
+// running server: -server, by default the server of the port setting on
+// this host, and -admin, sent as X-Admin-Identity
+func apiFlags(fs *flag.FlagSet) (server, admin *string) {
+	server = fs.String("server", "", "url of the server (default http://localhost:<port>)")
+	admin = fs.String("admin", os.Getenv("USER"), "admin identity the request is made as")
+	return server, admin
+}
+
+// serverURL is the url of the API of the server, or the local one
+func serverURL(server string) string {
+	if server != "" {
+		return strings.TrimRight(server, "/")
+	}
+	port := os.Getenv("port")
+	if port == "" {
+		port = "9000"
+	}
+	return "http://localhost:" + port
+}
+
+// callAPI sends a request to the API of a running server, with the
+// admin_token setting as its bearer token, and decodes its JSON answer into
+// out, failing on the error an answer other than 200 carries
+func callAPI(method, url, admin string, out interface{}) error {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return err
+	}
+	if admin != "" {
+		req.Header.Set("X-Admin-Identity", admin)
+	}
+	if token := os.Getenv("admin_token"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(body, &failure) == nil && failure.Error != "" {
+			return fmt.Errorf("%s %s: %s", method, url, failure.Error)
+		}
+		return fmt.Errorf("%s %s: %s", method, url, resp.Status)
+	}
+	return json.Unmarshal(body, out)
+}
+
+// pipelineListing is a publish as GET /api/v1/streams lists it
+type pipelineListing struct {
+	Stream    string `json:"stream"`
+	Preset    string `json:"preset"`
+	Ingest    string `json:"ingest"`
+	WHIP      bool   `json:"whip"`
+	Pipeline  string `json:"pipeline"`
+	Viewers   int    `json:"viewers"`
+	Recording string `json:"recording"`
+}
+
+// listPipelinesCommand prints the publishes of a running server, one per
+// line
+func listPipelinesCommand(args []string) error {
+	fs, envFile := newFlags("list-pipelines", "list-pipelines [flags]")
+	server, admin := apiFlags(fs)
+	rest, err := parseSettings(fs, envFile, args)
+	if err != nil {
+		return err
+	}
+	if len(rest) > 0 {
+		fs.Usage()
+		return errUsage
+	}
+	var list struct {
+		Streams []pipelineListing `json:"streams"`
+	}
+	if err := callAPI(http.MethodGet, serverURL(*server)+"/api/v1/streams", *admin, &list); err != nil {
+		return err
+	}
+	return printPipelines(os.Stdout, list.Streams)
+}
+
+// printPipelines writes streams as a table
+func printPipelines(w io.Writer, streams []pipelineListing) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "STREAM\tINGEST\tPRESET\tPIPELINE\tVIEWERS\tRECORDING")
+	for _, s := range streams {
+		ingest := s.Ingest
+		switch {
+		case ingest != "":
+		case s.WHIP:
+			ingest = "whip"
+		default:
+			ingest = "webrtc"
+		}
+		pipeline, recording := s.Pipeline, s.Recording
+		if pipeline == "" {
+			pipeline = "-"
+		}
+		if recording == "" {
+			recording = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\n", s.Stream, ingest, s.Preset, pipeline, s.Viewers, recording)
+	}
+	return tw.Flush()
+}
+
+// recordCommand starts or stops the recording of a stream of a running
+// server, printing the file
+func recordCommand(args []string) error {
+	fs, envFile := newFlags("record", "record [flags] start|stop <stream key>")
+	server, admin := apiFlags(fs)
+	rest, err := parseSettings(fs, envFile, args)
+	if err != nil {
+		return err
+	}
+	if len(rest) != 2 || (rest[0] != "start" && rest[0] != "stop") {
+		fs.Usage()
+		return errUsage
+	}
+	if err := ident.Check(ident.StreamKey, rest[1]); err != nil {
+		return err
+	}
+	var recording struct {
+		File string `json:"file"`
+	}
+	url := fmt.Sprintf("%s/api/v1/streams/%s/record/%s", serverURL(*server), rest[1], rest[0])
+	if err := callAPI(http.MethodPost, url, *admin, &recording); err != nil {
+		return err
+	}
+	fmt.Println(recording.File)
+	return nil
+}
+
+// benchCommand starts the load generator of a running server, measures
+// the CPU of the process once the publishers had warmup to go live, then
+// stops them and prints the report
+func benchCommand(args []string) error {
+	fs, envFile := newFlags("bench", "bench [flags]")
+	server, admin := apiFlags(fs)
+	publishers := fs.Int("publishers", 10, "synthetic publishers to start")
+	warmup := fs.Duration("warmup", 15*time.Second, "time the publishers get to go live before measuring")
+	duration := fs.Duration("duration", time.Minute, "time the CPU is measured over")
+	rest, err := parseSettings(fs, envFile, args)
+	if err != nil {
+		return err
+	}
+	if len(rest) > 0 || *publishers <= 0 || *duration <= 0 {
+		fs.Usage()
+		return errUsage
+	}
+	url := serverURL(*server) + "/api/v1/loadtest"
+	var first, last loadReport
+	if err := callAPI(http.MethodPost, fmt.Sprintf("%s?publishers=%d", url, *publishers), *admin, &first); err != nil {
+		return err
+	}
+	defer func() {
+		if err := callAPI(http.MethodDelete, url, *admin, &loadReport{}); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}()
+	time.Sleep(*warmup)
+	if err := callAPI(http.MethodGet, url, *admin, &first); err != nil {
+		return err
+	}
+	time.Sleep(*duration)
+	if err := callAPI(http.MethodGet, url, *admin, &last); err != nil {
+		return err
+	}
+	return printBench(os.Stdout, first, last)
+}
+
+// printBench writes the load between the reports first and last: the
+// cores the process used, and the live publishers per core used
+func printBench(w io.Writer, first, last loadReport) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "publishers\t%d\n", last.Publishers)
+	fmt.Fprintf(tw, "live\t%d\n", last.Live)
+	fmt.Fprintf(tw, "pipeline restarts\t%d\n", last.Restarts-first.Restarts)
+	fmt.Fprintf(tw, "cores\t%d\n", last.Cores)
+	used := 0.0
+	if elapsed := last.At.Sub(first.At).Seconds(); elapsed > 0 {
+		used = (last.CPUSeconds - first.CPUSeconds) / elapsed
+	}
+	fmt.Fprintf(tw, "cores used\t%.2f\n", used)
+	if used > 0 {
+		fmt.Fprintf(tw, "streams per core\t%.2f\n", float64(last.Live)/used)
+	} else {
+		fmt.Fprintln(tw, "streams per core\t-")
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,97 @@
+package streamserver
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSettings(t *testing.T) {
+	unsetenv(t, "max_publishers")
+	unsetenv(t, "hls_mode")
+	t.Setenv("port", "9000")
+	fs, envFile := newFlags("record", "record")
+	server, _ := apiFlags(fs)
+	rest, err := parseSettings(fs, envFile, []string{
+		"--max-publishers=10", "-server", "http://origin:9000", "--hls-mode", "ll", "--port=8080", "start", "main",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *server != "http://origin:9000" || strings.Join(rest, " ") != "start main" {
+		t.Fatalf("server %q, arguments %q", *server, rest)
+	}
+	for name, value := range map[string]string{"max_publishers": "10", "hls_mode": "ll", "port": "8080"} {
+		if got := os.Getenv(name); got != value {
+			t.Fatalf("%s = %q", name, got)
+		}
+	}
+
+	fs, envFile = newFlags("serve", "serve")
+	fs.SetOutput(&bytes.Buffer{})
+	if _, err := parseSettings(fs, envFile, []string{"--max-publishers"}); err == nil {
+		t.Fatal("setting without a value accepted")
+	}
+	fs, envFile = newFlags("serve", "serve")
+	fs.SetOutput(&bytes.Buffer{})
+	if _, err := parseSettings(fs, envFile, []string{"-h"}); err != errUsage {
+		t.Fatalf("help: %v", err)
+	}
+	if _, err := parseSettings(fs, envFile, []string{"-env-file", "testdata/missing.env"}); err == nil {
+		t.Fatal("missing env file accepted")
+	}
+}
+
+func TestPrintPipelines(t *testing.T) {
+	var out bytes.Buffer
+	printPipelines(&out, []pipelineListing{
+		{Stream: "main", Preset: "balanced", WHIP: true, Pipeline: "running", Viewers: 3, Recording: "recordings/main/main.mp4"},
+		{Stream: "lobby", Preset: "quality", Ingest: protocolRTSP},
+	})
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("%d lines:\n%s", len(lines), out.String())
+	}
+	if fields := strings.Fields(lines[1]); strings.Join(fields, " ") != "main whip balanced running 3 recordings/main/main.mp4" {
+		t.Fatalf("row %q", lines[1])
+	}
+	if fields := strings.Fields(lines[2]); strings.Join(fields, " ") != "lobby rtsp quality - 0 -" {
+		t.Fatalf("row %q", lines[2])
+	}
+}
+
+func TestServerURL(t *testing.T) {
+	unsetenv(t, "port")
+	if url := serverURL(""); url != "http://localhost:9000" {
+		t.Fatal(url)
+	}
+	t.Setenv("port", "8080")
+	if url := serverURL("https://live.example/"); url != "https://live.example" {
+		t.Fatal(url)
+	}
+	if url := serverURL(""); url != "http://localhost:8080" {
+		t.Fatal(url)
+	}
+}
+
+func TestPrintBench(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	first := loadReport{Publishers: 8, Live: 8, Restarts: 1, Cores: 4, CPUSeconds: 100, At: at}
+	last := loadReport{Publishers: 8, Live: 8, Restarts: 2, Cores: 4, CPUSeconds: 220, At: at.Add(time.Minute)}
+	var out bytes.Buffer
+	if err := printBench(&out, first, last); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"pipeline restarts  1", "cores used         2.00", "streams per core   4.00"} {
+		if !strings.Contains(out.String(), line) {
+			t.Fatalf("%q not in\n%s", line, out.String())
+		}
+	}
+	out.Reset()
+	printBench(&out, last, last)
+	if !strings.Contains(out.String(), "streams per core   -") {
+		t.Fatalf("no measure in\n%s", out.String())
+	}
+}
@@ -0,0 +1,289 @@
+package streamserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/cluster"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/ident"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/metrics"
+)
+
+var clusterErrors = metrics.NewCounter("cluster_errors_total",
+	"Failed calls to the cluster directory, by operation", "op")
+
+var clusterRouted = metrics.NewCounter("cluster_routed_total",
+	"Requests sent to the instance owning their stream, by routing", "routing")
+
+// ways of routing a request to the owner of its stream
+const (
+	routeRedirect = "redirect"
+	routeProxy    = "proxy"
+)
+
+// directory shares the owners of stream keys between instances, nil for a
+// single instance
+var directory cluster.Directory
+
+var (
+	// nodeURL is where other instances and players reach this one
+	nodeURL string
+	// clusterTTL is how long a claim lasts unless renewed
+	clusterTTL = 15 * time.Second
+	// clusterRouting is routeRedirect or routeProxy
+	clusterRouting = routeRedirect
+)
+
+// ownedElsewhere refuses the claim of a stream key published on another
+// instance
+type ownedElsewhere struct {
+	key, owner string
+}
+
+func (e *ownedElsewhere) Error() string {
+	return fmt.Sprintf("stream %s is published on %s", e.key, e.owner)
+}
+
+// setupCluster shares the stream keys with other instances when
+// cluster_redis, the address of a Redis server, is set, authenticated with
+// cluster_redis_password and in database cluster_redis_db. cluster_node_url
+// is where this instance is reached, e.g. http://10.0.0.5:9000. Claims
+// last cluster_ttl (15) seconds and are renewed while live; cluster_routing
+// is redirect (307 to the owner) or proxy for requests landing on another
+// instance.
+func setupCluster() error {
+	addr := os.Getenv("cluster_redis")
+	if addr == "" {
+		return nil
+	}
+	nodeURL = strings.TrimRight(os.Getenv("cluster_node_url"), "/")
+	if u, err := url.Parse(nodeURL); err != nil || u.Host == "" {
+		return errors.New("cluster: cluster_node_url required, e.g. http://10.0.0.5:9000")
+	}
+	switch routing := os.Getenv("cluster_routing"); routing {
+	case "", routeRedirect:
+	case routeProxy:
+		clusterRouting = routeProxy
+	default:
+		return fmt.Errorf("cluster_routing must be redirect or proxy, not %q", routing)
+	}
+	clusterTTL = time.Duration(envInt("cluster_ttl", 15)) * time.Second
+	directory = &cluster.Redis{
+		Addr:     addr,
+		Password: os.Getenv("cluster_redis_password"),
+		DB:       envInt("cluster_redis_db", 0),
+		Prefix:   "streams:",
+	}
+	logger.Info("sharing streams with the cluster", "node", nodeURL, "redis", addr)
+	go renewClaims()
+	return nil
+}
+
+// clusterContext bounds a call to the directory
+func clusterContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), 2*time.Second)
+}
+
+// claimCluster claims key for this instance. A directory that cannot be
+// reached is logged and does not stop the publish: one instance going on
+// alone beats every instance refusing publishers.
+func claimCluster(key string) error {
+	if directory == nil {
+		return nil
+	}
+	ctx, cancel := clusterContext()
+	defer cancel()
+	owner, err := directory.Claim(ctx, key, nodeURL, clusterTTL)
+	if err != nil {
+		clusterErrors.Inc("claim")
+		logger.Warn("cluster claim failed, publishing anyway", "stream", key, "error", err)
+		return nil
+	}
+	if owner != nodeURL {
+		return &ownedElsewhere{key: key, owner: owner}
+	}
+	return nil
+}
+
+// releaseCluster hands key back once no session of this instance owns it
+func releaseCluster(key string) {
+	if directory == nil {
+		return
+	}
+	ctx, cancel := clusterContext()
+	defer cancel()
+	if err := directory.Release(ctx, key, nodeURL); err != nil {
+		clusterErrors.Inc("release")
+		logger.Warn("cluster release failed, the claim expires instead", "stream", key, "error", err)
+	}
+}
+
+// renewClaims renews the claims of the live keys three times per ttl
+func renewClaims() {
+	ticker := time.NewTicker(clusterTTL / 3)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, key := range registry.keys() {
+			renewClaim(key)
+		}
+	}
+}
+
+// renewClaim renews the claim of the live key. A claim another instance
+// took meanwhile ends the session here: two instances publishing one key
+// would each write an output players are routed away from.
+func renewClaim(key string) {
+	ctx, cancel := clusterContext()
+	owner, err := directory.Claim(ctx, key, nodeURL, clusterTTL)
+	cancel()
+	switch {
+	case err != nil:
+		clusterErrors.Inc("renew")
+		logger.Warn("cluster renewal failed", "stream", key, "error", err)
+	case owner != nodeURL:
+		// the claim expired meanwhile and another instance took it
+		clusterErrors.Inc("lost")
+		logger.Error("stream claimed by another instance while live here, ending it", "stream", key, "owner", owner)
+		if sess := registry.get(key); sess != nil {
+			sess.endWith(client.CloseReplaced, (&ownedElsewhere{key: key, owner: owner}).Error())
+		}
+	}
+}
+
+// maxCachedOwners bounds the owners cached, requests for made up keys
+// included
+const maxCachedOwners = 4096
+
+// owners caches the owners of keys not live here for a second, so
+// players polling them do not each ask the directory. Keys nobody owns and
+// failed lookups are cached like owners.
+var owners = struct {
+	sync.Mutex
+	entries map[string]cachedOwner
+	proxies map[string]*httputil.ReverseProxy
+}{entries: map[string]cachedOwner{}, proxies: map[string]*httputil.ReverseProxy{}}
+
+type cachedOwner struct {
+	owner   string
+	expires time.Time
+}
+
+// clusterOwner returns the instance owning key, empty when none or unknown
+func clusterOwner(key string, now time.Time) string {
+	owners.Lock()
+	cached, ok := owners.entries[key]
+	owners.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.owner
+	}
+	ctx, cancel := clusterContext()
+	defer cancel()
+	owner, err := directory.Owner(ctx, key)
+	if err != nil {
+		// served here until the directory answers again
+		clusterErrors.Inc("owner")
+		owner = ""
+	}
+	owners.Lock()
+	if len(owners.entries) >= maxCachedOwners {
+		pruneOwners(now)
+	}
+	owners.entries[key] = cachedOwner{owner: owner, expires: now.Add(time.Second)}
+	owners.Unlock()
+	return owner
+}
+
+// pruneOwners drops the expired entries, and every entry when none
+// expired; called with owners locked
+func pruneOwners(now time.Time) {
+	for key, cached := range owners.entries {
+		if !now.Before(cached.expires) {
+			delete(owners.entries, key)
+		}
+	}
+	if len(owners.entries) >= maxCachedOwners {
+		owners.entries = map[string]cachedOwner{}
+	}
+}
+
+// proxyTo returns the reverse proxy to the instance at owner
+func proxyTo(owner string) (*httputil.ReverseProxy, error) {
+	owners.Lock()
+	defer owners.Unlock()
+	if proxy := owners.proxies[owner]; proxy != nil {
+		return proxy, nil
+	}
+	target, err := url.Parse(owner)
+	if err != nil {
+		return nil, err
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	// the CORS headers are those allowCORS answered here
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		for name := range resp.Header {
+			if strings.HasPrefix(name, "Access-Control-") {
+				resp.Header.Del(name)
+			}
+		}
+		return nil
+	}
+	owners.proxies[owner] = proxy
+	return proxy, nil
+}
+
+// routedKey is the stream key a request for another instance is routed
+// by: the key of HLS playback and of WHEP viewers, empty when it is not a
+// valid one
+func routedKey(urlPath string) string {
+	for _, prefix := range []string{"/hls/", "/whep/"} {
+		if strings.HasPrefix(urlPath, prefix) {
+			key := strings.SplitN(strings.TrimPrefix(urlPath, prefix), "/", 2)[0]
+			if ident.Check(ident.StreamKey, key) != nil {
+				return ""
+			}
+			return key
+		}
+	}
+	return ""
+}
+
+// routeToOwner sends HLS and WHEP requests for a stream live on another
+// instance there, redirected or proxied; streams live here, or nowhere,
+// are served here
+func routeToOwner(c *gin.Context) {
+	key := routedKey(c.Request.URL.Path)
+	if directory == nil || key == "" || registry.find(key) != nil {
+		c.Next()
+		return
+	}
+	owner := clusterOwner(key, time.Now())
+	if owner == "" || owner == nodeURL {
+		c.Next()
+		return
+	}
+	clusterRouted.Inc(clusterRouting)
+	if clusterRouting == routeProxy {
+		proxy, err := proxyTo(owner)
+		if err != nil {
+			c.String(http.StatusBadGateway, err.Error())
+			c.Abort()
+			return
+		}
+		proxy.ServeHTTP(c.Writer, c.Request)
+		c.Abort()
+		return
+	}
+	// 307 keeps the method and body of WHEP offers
+	c.Redirect(http.StatusTemporaryRedirect, owner+c.Request.URL.RequestURI())
+	c.Abort()
+}
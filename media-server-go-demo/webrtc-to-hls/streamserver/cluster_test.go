@@ -0,0 +1,166 @@
+package streamserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/cluster"
+)
+
+func TestClusterClaims(t *testing.T) {
+	defer func(d cluster.Directory, node string) { directory, nodeURL = d, node }(directory, nodeURL)
+	shared := cluster.NewMemory(nil)
+	directory, nodeURL = shared, "http://here:9000"
+	ctx := context.Background()
+	shared.Claim(ctx, "elsewhere", "http://there:9000", time.Minute)
+
+	if _, err := registry.claim(newSession("elsewhere", nil, presets[client.LatencyBalanced]), conflictReject); err == nil {
+		t.Fatal("claimed a key live on another instance")
+	} else if e, ok := err.(*ownedElsewhere); !ok || e.owner != "http://there:9000" {
+		t.Fatalf("claim = %v", err)
+	}
+
+	sess := newSession("clustered", nil, presets[client.LatencyBalanced])
+	if _, err := registry.claim(sess, conflictReject); err != nil {
+		t.Fatal(err)
+	}
+	if owner, _ := shared.Owner(ctx, "clustered"); owner != nodeURL {
+		t.Fatalf("owner = %q", owner)
+	}
+	registry.release(sess)
+	if owner, _ := shared.Owner(ctx, "clustered"); owner != "" {
+		t.Fatalf("owner after the release = %q", owner)
+	}
+}
+
+func TestRouteToOwner(t *testing.T) {
+	defer func(d cluster.Directory, node, routing string) { directory, nodeURL, clusterRouting = d, node, routing }(directory, nodeURL, clusterRouting)
+	owner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("from the owner " + r.URL.Path))
+	}))
+	defer owner.Close()
+	shared := cluster.NewMemory(nil)
+	directory, nodeURL = shared, "http://here:9000"
+	shared.Claim(context.Background(), "remote", owner.URL, time.Minute)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(routeToOwner)
+	r.NoRoute(func(c *gin.Context) { c.String(http.StatusOK, "local") })
+	// a served router, gin's writer over a recorder cannot be proxied
+	here := httptest.NewServer(r)
+	defer here.Close()
+	noRedirects := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	do := func(method, path string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, here.URL+path, nil)
+		resp, err := noRedirects.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	clusterRouting = routeRedirect
+	if resp, _ := do("POST", "/whep/remote"); resp.StatusCode != http.StatusTemporaryRedirect || resp.Header.Get("Location") != owner.URL+"/whep/remote" {
+		t.Fatalf("redirect %d %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if _, body := do("GET", "/hls/unclaimed/playlist.m3u8"); body != "local" {
+		t.Fatalf("unclaimed stream: %s", body)
+	}
+	if _, body := do("GET", "/api/v1/streams"); body != "local" {
+		t.Fatal("routed an api request")
+	}
+	clusterRouting = routeProxy
+	if _, body := do("GET", "/hls/remote/playlist.m3u8"); body != "from the owner /hls/remote/playlist.m3u8" {
+		t.Fatalf("proxied: %s", body)
+	}
+}
+
+// countingDirectory counts the lookups of a directory, failing them when
+// broken
+type countingDirectory struct {
+	*cluster.Memory
+	lookups int
+	broken  bool
+}
+
+func (d *countingDirectory) Owner(ctx context.Context, key string) (string, error) {
+	d.lookups++
+	if d.broken {
+		return "", errors.New("directory down")
+	}
+	return d.Memory.Owner(ctx, key)
+}
+
+func TestClusterOwnerCache(t *testing.T) {
+	defer func(d cluster.Directory) { directory = d }(directory)
+	shared := &countingDirectory{Memory: cluster.NewMemory(nil), broken: true}
+	directory = shared
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if owner := clusterOwner("cache-failed", now); owner != "" {
+			t.Fatalf("owner %q", owner)
+		}
+	}
+	if shared.lookups != 1 {
+		t.Fatalf("failed lookup repeated %d times", shared.lookups)
+	}
+	shared.broken = false
+	clusterOwner("cache-failed", now.Add(2*time.Second))
+	if shared.lookups != 2 {
+		t.Fatal("failure cached past its second")
+	}
+
+	for i := 0; i < 2*maxCachedOwners; i++ {
+		clusterOwner(fmt.Sprintf("made-up-%d", i), now)
+	}
+	owners.Lock()
+	cached := len(owners.entries)
+	owners.Unlock()
+	if cached > maxCachedOwners {
+		t.Fatalf("%d owners cached", cached)
+	}
+	if routedKey("/hls/../playlist.m3u8") != "" || routedKey("/whep/_mosaic") != "" || routedKey("/hls/main/playlist.m3u8") != "main" {
+		t.Fatal("routed an invalid key")
+	}
+}
+
+func TestLostClaimEndsSession(t *testing.T) {
+	defer func(d cluster.Directory, node string) { directory, nodeURL = d, node }(directory, nodeURL)
+	shared := cluster.NewMemory(nil)
+	directory, nodeURL = shared, "http://here:9000"
+	sess := newSession("contested", nil, presets[client.LatencyBalanced])
+	if _, err := registry.claim(sess, conflictReject); err != nil {
+		t.Fatal(err)
+	}
+	defer registry.release(sess)
+
+	renewClaim("contested")
+	select {
+	case <-sess.done:
+		t.Fatal("renewal ended the session")
+	default:
+	}
+	// the claim expired and another instance took it
+	shared.Release(context.Background(), "contested", nodeURL)
+	shared.Claim(context.Background(), "contested", "http://there:9000", time.Minute)
+	renewClaim("contested")
+	select {
+	case <-sess.done:
+	default:
+		t.Fatal("session kept publishing a key owned elsewhere")
+	}
+	if owner, _ := shared.Owner(context.Background(), "contested"); owner != "http://there:9000" {
+		t.Fatalf("owner after the end = %q", owner)
+	}
+}
@@ -0,0 +1,234 @@
+package streamserver
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/notedit/sdp"
+)
+
+// codecRule is one entry of codec_preference: a codec name and the fmtp
+// parameters it must carry, e.g. h264;packetization-mode=1;profile-level-id=42e01f
+type codecRule struct {
+	codec  string
+	params map[string]string
+}
+
+// parseCodecPreference parses a comma separated list of codec rules, most
+// preferred first
+func parseCodecPreference(value string) ([]codecRule, error) {
+	var rules []codecRule
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ";")
+		rule := codecRule{codec: strings.ToLower(strings.TrimSpace(parts[0])), params: map[string]string{}}
+		for _, param := range parts[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return nil, fmt.Errorf("codec preference %q: bad parameter %q", entry, param)
+			}
+			rule.params[kv[0]] = kv[1]
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (r codecRule) matches(codec *sdp.CodecInfo) bool {
+	if strings.ToLower(codec.GetCodec()) != r.codec {
+		return false
+	}
+	for k, v := range r.params {
+		if !strings.EqualFold(codec.GetParam(k), v) {
+			return false
+		}
+	}
+	return true
+}
+
+// codecPreference is read from codec_preference at startup and on reload,
+// guarded by configLock, see preferredCodecs; codecs no rule matches rank
+// after those that do, by payload type
+var codecPreference []codecRule
+
+// preferredCodecs returns the rules of codec_preference
+func preferredCodecs() []codecRule {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return codecPreference
+}
+
+func setupCodecPreference() error {
+	rules, err := parseCodecPreference(os.Getenv("codec_preference"))
+	if err != nil {
+		return err
+	}
+	configLock.Lock()
+	codecPreference = rules
+	configLock.Unlock()
+	return nil
+}
+
+// rankedCodecs returns the codecs of media, most preferred first
+func rankedCodecs(media *sdp.MediaInfo, rules []codecRule) []*sdp.CodecInfo {
+	rank := func(codec *sdp.CodecInfo) int {
+		for i, rule := range rules {
+			if rule.matches(codec) {
+				return i
+			}
+		}
+		return len(rules)
+	}
+	var codecs []*sdp.CodecInfo
+	for _, codec := range media.GetCodecs() {
+		codecs = append(codecs, codec)
+	}
+	sort.Slice(codecs, func(i, j int) bool {
+		ri, rj := rank(codecs[i]), rank(codecs[j])
+		if ri != rj {
+			return ri < rj
+		}
+		return codecs[i].GetType() < codecs[j].GetType()
+	})
+	return codecs
+}
+
+// orderAnswer rewrites the payload lists of the m-lines of the serialized
+// answer in preference order, each rtx right after its codec. The SDP
+// library keeps codecs in a map and writes them in random order.
+func orderAnswer(text string, answer *sdp.SDPInfo, rules []codecRule) string {
+	lines := strings.Split(text, "\r\n")
+	for i, line := range lines {
+		if !strings.HasPrefix(line, "m=") {
+			continue
+		}
+		fields := strings.Fields(line)
+		media := answer.GetMedia(strings.TrimPrefix(fields[0], "m="))
+		if media == nil || len(fields) < 4 {
+			continue
+		}
+		var ordered []string
+		seen := map[string]bool{}
+		add := func(pt int) {
+			s := strconv.Itoa(pt)
+			if !seen[s] {
+				seen[s] = true
+				ordered = append(ordered, s)
+			}
+		}
+		for _, codec := range rankedCodecs(media, rules) {
+			add(codec.GetType())
+			if codec.HasRTX() {
+				add(codec.GetRTX())
+			}
+		}
+		for _, pt := range fields[3:] {
+			if !seen[pt] {
+				seen[pt] = true
+				ordered = append(ordered, pt)
+			}
+		}
+		lines[i] = strings.Join(append(fields[:3:3], ordered...), " ")
+	}
+	return strings.Join(lines, "\r\n")
+}
+
+// codecSignature identifies a codec across offers with possibly different
+// payload types
+func codecSignature(media string, codec *sdp.CodecInfo) string {
+	signature := media + "/" + strings.ToLower(codec.GetCodec())
+	if strings.EqualFold(codec.GetCodec(), "h264") {
+		signature += fmt.Sprintf(";packetization-mode=%s;profile-level-id=%s",
+			codec.GetParam("packetization-mode"), strings.ToLower(codec.GetParam("profile-level-id")))
+	}
+	return signature
+}
+
+// payloadPins keeps the payload types answered on a connection so a
+// renegotiation answers unchanged codecs with the same numbers, which is
+// what the publisher then sends and the depacketizer keeps expecting
+type payloadPins struct {
+	codecs map[string]int
+	rtx    map[string]int
+}
+
+func newPayloadPins() *payloadPins {
+	return &payloadPins{codecs: map[string]int{}, rtx: map[string]int{}}
+}
+
+// apply renumbers the codecs of offer to their pinned payload types before
+// it is answered, then pins the codecs seen for the first time. Codecs
+// without a usable pin keep their offered number if it is free, or get the
+// first free dynamic one.
+func (p *payloadPins) apply(offer *sdp.SDPInfo) {
+	for _, media := range offer.GetMedias() {
+		codecs := media.GetCodecs()
+		pts := make([]int, 0, len(codecs))
+		for pt := range codecs {
+			pts = append(pts, pt)
+		}
+		sort.Ints(pts)
+
+		used := map[int]bool{}
+		claim := func(pt int) bool {
+			if used[pt] {
+				return false
+			}
+			used[pt] = true
+			return true
+		}
+		assigned := map[int]int{}
+		assignedRTX := map[int]int{}
+		assign := func(pick func(pt int, codec *sdp.CodecInfo, pins map[string]int, offered int) (int, bool)) {
+			for _, pt := range pts {
+				codec := codecs[pt]
+				if _, ok := assigned[pt]; !ok {
+					if n, ok := pick(pt, codec, p.codecs, pt); ok {
+						assigned[pt] = n
+					}
+				}
+				if _, ok := assignedRTX[pt]; !ok && codec.HasRTX() {
+					if n, ok := pick(pt, codec, p.rtx, codec.GetRTX()); ok {
+						assignedRTX[pt] = n
+					}
+				}
+			}
+		}
+		// pinned numbers first, then offered ones, then free ones
+		assign(func(pt int, codec *sdp.CodecInfo, pins map[string]int, offered int) (int, bool) {
+			pin, ok := pins[codecSignature(media.GetType(), codec)]
+			return pin, ok && claim(pin)
+		})
+		assign(func(pt int, codec *sdp.CodecInfo, pins map[string]int, offered int) (int, bool) {
+			return offered, claim(offered)
+		})
+		assign(func(pt int, codec *sdp.CodecInfo, pins map[string]int, offered int) (int, bool) {
+			for n := 96; n <= 127; n++ {
+				if claim(n) {
+					return n, true
+				}
+			}
+			return offered, true
+		})
+
+		renumbered := map[int]*sdp.CodecInfo{}
+		for _, pt := range pts {
+			codec := codecs[pt]
+			signature := codecSignature(media.GetType(), codec)
+			codec.SetType(assigned[pt])
+			p.codecs[signature] = assigned[pt]
+			if codec.HasRTX() {
+				codec.SetRTX(assignedRTX[pt])
+				p.rtx[signature] = assignedRTX[pt]
+			}
+			renumbered[assigned[pt]] = codec
+		}
+		media.SetCodecs(renumbered)
+	}
+}
@@ -0,0 +1,81 @@
+package streamserver
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/notedit/sdp"
+)
+
+// videoPayloads returns the payload list of the video m-line
+func videoPayloads(text string) string {
+	for _, line := range strings.Split(text, "\r\n") {
+		if strings.HasPrefix(line, "m=video") {
+			return strings.Join(strings.Fields(line)[3:], " ")
+		}
+	}
+	return ""
+}
+
+func TestOrderAnswer(t *testing.T) {
+	rules, err := parseCodecPreference("h264;packetization-mode=1;profile-level-id=42e01f, h264;packetization-mode=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, answer := answerFixture(t, "chrome_offer.sdp")
+	ordered := orderAnswer(answer.String(), answer, rules)
+	if payloads := videoPayloads(ordered); payloads != "125 107 102 121 127 108" {
+		t.Fatalf("payloads = %q", payloads)
+	}
+	if _, err := sdp.Parse(ordered); err != nil {
+		t.Fatal(err)
+	}
+	// without rules the order is by payload type instead of map order
+	if payloads := videoPayloads(orderAnswer(answer.String(), answer, nil)); payloads != "102 121 125 107 127 108" {
+		t.Fatalf("default payloads = %q", payloads)
+	}
+	if _, err := parseCodecPreference("h264;packetization-mode"); err == nil {
+		t.Fatal("accepted a parameter without value")
+	}
+}
+
+func TestRenegotiationKeepsPayloadTypes(t *testing.T) {
+	pins := newPayloadPins()
+	first, _ := answerFixture(t, "chrome_offer.sdp")
+	pins.apply(first)
+
+	// a mid-stream offer numbering the same codecs differently: the two
+	// packetization-mode=1 H264 codecs swap numbers, VP8 moves
+	data := string(mustRead(t, "testdata/chrome_offer.sdp"))
+	swapped := strings.NewReplacer(
+		" 96 97 102 121 125 107 127 108", " 98 99 125 107 102 121 127 108",
+		":96 ", ":98 ", ":97 ", ":99 ", "apt=96", "apt=98",
+		":102 ", ":125 ", ":125 ", ":102 ", "apt=102", "apt=125", "apt=125", "apt=102",
+		":121 ", ":107 ", ":107 ", ":121 ",
+	).Replace(data)
+	second, err := sdp.Parse(swapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := second.GetMedia("video").GetCodecForType(125); c == nil || c.GetParam("profile-level-id") != "42001f" {
+		t.Fatal("fixture did not swap the H264 payload types")
+	}
+	pins.apply(second)
+
+	video := second.GetMedia("video")
+	for pt, want := range map[int]string{102: "42001f", 125: "42e01f", 127: "42001f"} {
+		codec := video.GetCodecForType(pt)
+		if codec == nil || !strings.EqualFold(codec.GetCodec(), "h264") || codec.GetParam("profile-level-id") != want {
+			t.Fatalf("pt %d = %v", pt, codec)
+		}
+	}
+	if video.GetCodecForType(102).GetRTX() != 121 || video.GetCodecForType(125).GetRTX() != 107 {
+		t.Fatal("rtx payload types moved")
+	}
+	if vp8 := video.GetCodec("vp8"); vp8 == nil || vp8.GetType() != 96 || vp8.GetRTX() != 97 {
+		t.Fatalf("vp8 = %v", vp8)
+	}
+	if opus := second.GetMedia("audio").GetCodec("opus"); opus == nil || opus.GetType() != 111 {
+		t.Fatal("audio payload types moved")
+	}
+}
@@ -0,0 +1,317 @@
+package streamserver
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	gstreamer "github.com/notedit/gstreamer-go"
+	mediaserver "github.com/notedit/media-server-go"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/sdp"
+)
+
+var (
+	errNoScreen    = errors.New("the screen must be a published stream with video, besides the camera")
+	errNotComposed = errors.New("the output is not a composite")
+)
+
+// the layouts of a composite: the camera inset in a corner of the screen,
+// or both side by side
+const (
+	layoutPIP        = "pip"
+	layoutSideBySide = "side-by-side"
+)
+
+// the size of composites
+const (
+	compositeWidth  = 1280
+	compositeHeight = 720
+)
+
+// placement is where a composited video goes in the frame
+type placement struct {
+	x, y, width, height int
+}
+
+// compositeLayouts place the screen and the camera, in that order
+var compositeLayouts = map[string][2]placement{
+	layoutPIP:        {{0, 0, 1280, 720}, {936, 516, 320, 180}},
+	layoutSideBySide: {{640, 180, 640, 360}, {0, 180, 640, 360}},
+}
+
+// compositeDecoders decode the published video for the compositor, next
+// to transcodeFormats
+var compositeDecoders = map[string]string{
+	codecH264: "! h264parse ! avdec_h264",
+}
+
+// decoderFor decodes the video of codec given to an appsrc
+func decoderFor(codec string) string {
+	if decode, ok := compositeDecoders[codec]; ok {
+		return decode
+	}
+	return transcodeFormats[codec]
+}
+
+// compositeSource scales one of the composited videos to its placement,
+// sink_0 being the screen and sink_1 the camera
+const compositeSource = "appsrc do-timestamp=true is-live=true name=%s %s ! videoconvert ! videoscale ! video/x-raw,width=%d,height=%d ! comp.sink_%d "
+
+// compositeMixer lays the screen and the camera out, the camera on top,
+// and encodes the composite as the H.264 the output is fed
+const compositeMixer = "compositor name=comp background=black sink_0::xpos=%d sink_0::ypos=%d sink_0::zorder=0 sink_1::xpos=%d sink_1::ypos=%d sink_1::zorder=1 ! video/x-raw,width=%d,height=%d%s ! video/x-h264,stream-format=byte-stream,alignment=au ! appsink name=compositesink sync=false"
+
+// resolveComposite decides whether the output of key composites the camera
+// of offer with a screen share, from composite_layout /
+// composite_layout_overrides: pip, side-by-side, or off (the default).
+// screen is the stream the publisher shares its screen in; without, an
+// offer of two video streams shares it in the one without audio. The
+// layout is empty when the output is not composited.
+func resolveComposite(offer *sdp.SDPInfo, screen, key string) (layout, stream string, err error) {
+	switch layout = envForKey("composite_layout", key); layout {
+	case "", "off":
+		return "", "", nil
+	case layoutPIP, layoutSideBySide:
+	default:
+		return "", "", fmt.Errorf("composite_layout must be %s, %s or off, not %q", layoutPIP, layoutSideBySide, layout)
+	}
+	var videos, silent []string
+	for id, info := range offer.GetStreams() {
+		if info.GetFirstTrack("video") == nil {
+			continue
+		}
+		videos = append(videos, id)
+		if info.GetFirstTrack("audio") == nil {
+			silent = append(silent, id)
+		}
+	}
+	if screen != "" {
+		if offer.GetStream(screen) == nil || offer.GetStream(screen).GetFirstTrack("video") == nil || len(videos) < 2 {
+			return "", "", errNoScreen
+		}
+		return layout, screen, nil
+	}
+	if len(videos) != 2 || len(silent) != 1 {
+		// no screen share, or no telling it from the camera
+		return "", "", nil
+	}
+	return layout, silent[0], nil
+}
+
+// compositePipelineFor composites the screen and the camera, both in codec,
+// in layout for key
+func compositePipelineFor(layout, codec string, p client.Preset, key string) string {
+	decode := decoderFor(codec)
+	screen, camera := compositeLayouts[layout][0], compositeLayouts[layout][1]
+	return fmt.Sprintf(compositeSource, "screensrc", decode, screen.width, screen.height, 0) +
+		fmt.Sprintf(compositeSource, "camerasrc", decode, camera.width, camera.height, 1) +
+		fmt.Sprintf(compositeMixer, screen.x, screen.y, camera.x, camera.y, compositeWidth, compositeHeight, transcodeEncoding(p, key))
+}
+
+// compositor runs the pipeline compositing the camera and the screen of a
+// publish, its H.264 fed to the output. A new layout replaces the
+// pipeline, the output going on from its first keyframe.
+type compositor struct {
+	sync.Mutex
+	codec  string
+	preset client.Preset
+	key    string
+	// out takes the composited frames
+	out func([]byte)
+
+	layout   string
+	pipeline *gstreamer.Pipeline
+	camera   *gstreamer.Element
+	screen   *gstreamer.Element
+	stopped  bool
+}
+
+func newCompositor(layout, codec string, p client.Preset, key string, out func([]byte)) (*compositor, error) {
+	c := &compositor{codec: codec, preset: p, key: key, out: out}
+	if err := c.setLayout(layout); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// setLayout composites in layout from now on
+func (c *compositor) setLayout(layout string) error {
+	if _, ok := compositeLayouts[layout]; !ok {
+		return fmt.Errorf("layout must be %s or %s, not %q", layoutPIP, layoutSideBySide, layout)
+	}
+	pipeline, err := gstreamer.New(compositePipelineFor(layout, c.codec, c.preset, c.key))
+	if err != nil {
+		return err
+	}
+	frames := pumpFrames(pipeline.FindElement("compositesink").Poll())
+	go func() {
+		// drained until Stop closes it
+		for range pipeline.PullMessage() {
+		}
+	}()
+	c.Lock()
+	if c.stopped {
+		c.Unlock()
+		pipeline.Stop()
+		return errNotComposed
+	}
+	previous := c.pipeline
+	replaced := []*gstreamer.Element{c.camera, c.screen}
+	c.layout, c.pipeline = layout, pipeline
+	c.camera, c.screen = pipeline.FindElement("camerasrc"), pipeline.FindElement("screensrc")
+	c.Unlock()
+	pipeline.Start()
+	go c.pump(pipeline, frames)
+	if previous != nil {
+		for _, src := range replaced {
+			src.Stop()
+		}
+		previous.Stop()
+	}
+	return nil
+}
+
+// pump feeds the composited frames of pipeline to the output while it is
+// the current one
+func (c *compositor) pump(pipeline *gstreamer.Pipeline, frames <-chan []byte) {
+	for frame := range frames {
+		c.Lock()
+		current := c.pipeline == pipeline
+		c.Unlock()
+		if current {
+			c.out(frame)
+		}
+	}
+}
+
+func (c *compositor) pushCamera(frame []byte) {
+	c.Lock()
+	defer c.Unlock()
+	if !c.stopped {
+		c.camera.Push(frame)
+	}
+}
+
+func (c *compositor) pushScreen(frame []byte) {
+	c.Lock()
+	defer c.Unlock()
+	if !c.stopped {
+		c.screen.Push(frame)
+	}
+}
+
+// current is the layout composited
+func (c *compositor) current() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.layout
+}
+
+func (c *compositor) stop() {
+	c.Lock()
+	defer c.Unlock()
+	if c.stopped {
+		return
+	}
+	c.stopped = true
+	c.camera.Stop()
+	c.screen.Stop()
+	c.pipeline.Stop()
+}
+
+// startComposite starts compositing the camera with the screen share,
+// before the output starts
+func (s *session) startComposite() error {
+	s.Lock()
+	layout, codec := s.compositeLayout, s.videoCodec
+	s.Unlock()
+	if layout == "" {
+		return nil
+	}
+	c, err := newCompositor(layout, codec, s.preset, s.key, func(frame []byte) { s.push(frame, frameTime{}) })
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	s.composite = c
+	s.Unlock()
+	s.logf("compositing %s with the screen in %s", codec, layout)
+	return nil
+}
+
+// compositor is the compositor of the output, nil unless composited
+func (s *session) compositor() *compositor {
+	s.Lock()
+	defer s.Unlock()
+	return s.composite
+}
+
+// feedScreen attaches the video of the screen share to the compositor
+func (s *session) feedScreen(stream *mediaserver.IncomingStream) {
+	c := s.compositor()
+	tracks := stream.GetVideoTracks()
+	if c == nil || len(tracks) == 0 {
+		return
+	}
+	onFrame := tracks[0].OnMediaFrame
+	if c.codec != codecH264 {
+		// only H.264 is converted to Annex B
+		onFrame = tracks[0].OnRawMediaFrame
+	}
+	onFrame(func(frame []byte, timestamp uint) {
+		if len(frame) <= 4 {
+			return
+		}
+		ingestBytes.Add("video", uint64(len(frame)))
+		c.pushScreen(frame)
+	})
+}
+
+// setStreamLayout handles PUT /api/v1/streams/:id/layout, switching the
+// layout of a composite
+func setStreamLayout(c *gin.Context) {
+	admin, ok := adminIdentity(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Layout string `json:"layout"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		return
+	}
+	sess := liveSession(c)
+	if sess == nil {
+		return
+	}
+	composite := sess.compositor()
+	if composite == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": errNotComposed.Error()})
+		return
+	}
+	layout := strings.TrimSpace(req.Layout)
+	if _, ok := compositeLayouts[layout]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("layout must be %s or %s", layoutPIP, layoutSideBySide)})
+		return
+	}
+	if layout != composite.current() {
+		if err := composite.setLayout(layout); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		// the decoders of the new pipeline start from keyframes
+		sess.Lock()
+		refresher := sess.refresher
+		sess.Unlock()
+		if refresher != nil {
+			refresher.request(keyframeSwitch)
+		}
+		sess.timeline.add(eventSignaling, "composite layout "+layout)
+		sess.logf("composite layout %s set by %s", layout, admin)
+	}
+	c.JSON(http.StatusOK, gin.H{"layout": layout})
+}
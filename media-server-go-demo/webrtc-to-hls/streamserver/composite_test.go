@@ -0,0 +1,65 @@
+package streamserver
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/sdp"
+)
+
+func TestResolveComposite(t *testing.T) {
+	offer, err := sdp.Parse(string(mustRead(t, "testdata/screen_share_offer.sdp")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const camera = "5Bq1nTqHKk1Yq7dFQZPmWLhWDkjvkxhzmTe7"
+	if layout, screen, err := resolveComposite(offer, "", "talk"); layout != "" || screen != "" || err != nil {
+		t.Fatalf("off = %q %q %v", layout, screen, err)
+	}
+
+	t.Setenv("composite_layout", layoutPIP)
+	t.Setenv("composite_layout_overrides", "talk="+layoutSideBySide+",broken=grid")
+	// the screen is the video stream without audio
+	if layout, screen, err := resolveComposite(offer, "", "talk"); layout != layoutSideBySide || screen != "screen" || err != nil {
+		t.Fatalf("talk = %q %q %v", layout, screen, err)
+	}
+	if layout, screen, err := resolveComposite(offer, camera, "lecture"); layout != layoutPIP || screen != camera || err != nil {
+		t.Fatalf("named screen = %q %q %v", layout, screen, err)
+	}
+	if _, _, err := resolveComposite(offer, "", "broken"); err == nil {
+		t.Fatal("unknown layout accepted")
+	}
+	if _, _, err := resolveComposite(offer, "missing", "lecture"); err != errNoScreen {
+		t.Fatalf("missing screen = %v", err)
+	}
+
+	single, err := sdp.Parse(string(mustRead(t, "testdata/chrome_offer.sdp")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layout, _, err := resolveComposite(single, "", "lecture"); layout != "" || err != nil {
+		t.Fatalf("single video = %q %v", layout, err)
+	}
+}
+
+func TestCompositePipeline(t *testing.T) {
+	p := presets[client.LatencyBalanced]
+	pip := compositePipelineFor(layoutPIP, codecH264, p, "talk")
+	for _, part := range []string{
+		"name=screensrc ! h264parse ! avdec_h264 ! videoconvert ! videoscale ! video/x-raw,width=1280,height=720 ! comp.sink_0 ",
+		"name=camerasrc ! h264parse ! avdec_h264 ! videoconvert ! videoscale ! video/x-raw,width=320,height=180 ! comp.sink_1 ",
+		"sink_1::xpos=936 sink_1::ypos=516 sink_1::zorder=1",
+		"x264enc",
+		"appsink name=compositesink",
+	} {
+		if !strings.Contains(pip, part) {
+			t.Fatalf("pip pipeline lacks %q:\n%s", part, pip)
+		}
+	}
+	sideBySide := compositePipelineFor(layoutSideBySide, codecVP8, p, "talk")
+	if !strings.Contains(sideBySide, "name=camerasrc caps=video/x-vp8 ! vp8dec ! videoconvert ! videoscale ! video/x-raw,width=640,height=360") ||
+		!strings.Contains(sideBySide, "sink_0::xpos=640 sink_0::ypos=180") {
+		t.Fatalf("side-by-side pipeline:\n%s", sideBySide)
+	}
+}
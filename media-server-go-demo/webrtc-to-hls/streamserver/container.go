@@ -0,0 +1,205 @@
+package streamserver
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/hlscheck"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/mpd"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/pipeline"
+)
+
+// the segment containers an output can be packaged in
+const (
+	containerTS   = pipeline.TS
+	containerFMP4 = pipeline.FMP4
+)
+
+// defaultContainer is the container of outputs without hls_container, the
+// container setting of the HLS config
+var defaultContainer = containerTS
+
+func validContainer(name string) bool {
+	return name == containerTS || name == containerFMP4
+}
+
+// resolveContainer picks the container of the output of key from
+// hls_container / hls_container_overrides, falling back to the HLS config.
+// A profile needing another container wins over the config default but
+// not over a container set for the key, which is an error.
+func resolveContainer(profile hlsProfile, key string) (string, error) {
+	container := envForKey("hls_container", key)
+	if container == "" {
+		configLock.RLock()
+		container = defaultContainer
+		configLock.RUnlock()
+		if profile.Container != "" {
+			container = profile.Container
+		}
+	}
+	if !validContainer(container) {
+		return "", fmt.Errorf("hls container must be %s or %s, not %q", containerTS, containerFMP4, container)
+	}
+	if profile.Container != "" && profile.Container != container {
+		return "", fmt.Errorf("hls profile %s: needs %s segments, the output is %s", profile.Name, profile.Container, container)
+	}
+	return container, nil
+}
+
+// segmentFile reports whether name is a media file of an output: a TS or
+// fMP4 segment, or an fMP4 initialization section
+func segmentFile(name string) bool {
+	switch filepath.Ext(name) {
+	case ".ts", ".m4s", ".mp4":
+		return true
+	}
+	return false
+}
+
+// cmafTimeline places the fMP4 segments of an output generation on the
+// media timeline of its MPD. The HLS playlist only has durations, and a
+// segment must keep its start across manifest revisions once listed: starts
+// are remembered by media sequence number while the segment is listed.
+type cmafTimeline struct {
+	sync.Mutex
+	// start is when the pipeline started, the availability start
+	start time.Time
+	// the parameters of the published video, once seen
+	codecs        string
+	width, height int
+
+	starts map[int]float64
+	next   int
+	end    float64
+}
+
+func newCMAFTimeline(start time.Time) *cmafTimeline {
+	return &cmafTimeline{start: start, starts: make(map[int]float64)}
+}
+
+// parameters records the stream parameters of the first keyframe of the
+// output's codec carrying them: an SPS, or an AV1 sequence header or H.265
+// SPS when AV1 or H.265 is passed through
+func (t *cmafTimeline) parameters(codec string, frame []byte) {
+	t.Lock()
+	defer t.Unlock()
+	if t.codecs != "" {
+		return
+	}
+	if codec == codecAV1 {
+		payload, err := hlscheck.FindSequenceHeader(frame)
+		if err != nil {
+			return
+		}
+		seq, err := hlscheck.ParseSequenceHeader(payload)
+		if err != nil {
+			return
+		}
+		t.codecs, t.width, t.height = seq.CodecString(), seq.Width, seq.Height
+		return
+	}
+	if codec == codecH265 {
+		nal, err := hlscheck.FindHEVCSPS(frame)
+		if err != nil {
+			return
+		}
+		sps, err := hlscheck.ParseHEVCSPS(nal)
+		if err != nil {
+			return
+		}
+		t.codecs, t.width, t.height = sps.CodecString(), sps.Width, sps.Height
+		return
+	}
+	nal, err := hlscheck.FindSPS(frame)
+	if err != nil {
+		return
+	}
+	sps, err := hlscheck.ParseSPS(nal)
+	if err != nil {
+		return
+	}
+	t.codecs, t.width, t.height = sps.CodecString(), sps.Width, sps.Height
+}
+
+// video returns the codecs and size of the video, as seen by parameters
+func (t *cmafTimeline) video() (codecs string, width, height int) {
+	t.Lock()
+	defer t.Unlock()
+	codecs = t.codecs
+	if codecs == "" {
+		// constrained baseline 3.1, what browsers publish by default
+		codecs = "avc1.42e01f"
+	}
+	return codecs, t.width, t.height
+}
+
+// place returns the segments of the playlist revision m with their starts.
+// Segments first seen after some went unlisted, e.g. before the first
+// manifest request, are assumed to last the target duration.
+func (t *cmafTimeline) place(m *hlscheck.Media) []mpd.Segment {
+	t.Lock()
+	defer t.Unlock()
+	segments := make([]mpd.Segment, 0, len(m.Segments))
+	for i, s := range m.Segments {
+		msn := m.MediaSequence + i
+		start, ok := t.starts[msn]
+		if !ok {
+			start = t.end
+			if msn > t.next {
+				start += float64((msn - t.next) * m.TargetDuration)
+			}
+			t.starts[msn] = start
+		}
+		if msn >= t.next {
+			t.next, t.end = msn+1, start+s.Duration
+		}
+		segments = append(segments, mpd.Segment{URI: s.URI, Start: start, Duration: s.Duration})
+	}
+	for msn := range t.starts {
+		if msn < m.MediaSequence {
+			delete(t.starts, msn)
+		}
+	}
+	return segments
+}
+
+// manifest is the MPD of the fMP4 output listed by the playlist revision
+// data, written to dir
+func (t *cmafTimeline) manifest(dir string, data []byte) (*mpd.Manifest, error) {
+	m, err := hlscheck.ParseMedia(data)
+	if err != nil {
+		return nil, err
+	}
+	if m.Map == "" || len(m.Segments) == 0 {
+		return nil, fmt.Errorf("no fmp4 segment listed yet")
+	}
+	segments := t.place(m)
+	bandwidth := 0
+	for _, s := range segments {
+		info, err := os.Stat(filepath.Join(dir, s.URI))
+		if err != nil || s.Duration <= 0 {
+			continue
+		}
+		if peak := int(math.Ceil(float64(info.Size()*8) / s.Duration)); peak > bandwidth {
+			bandwidth = peak
+		}
+	}
+	codecs, width, height := t.video()
+	return &mpd.Manifest{
+		Dynamic:           !m.Ended,
+		AvailabilityStart: t.start,
+		PublishTime:       time.Now(),
+		TargetDuration:    m.TargetDuration,
+		Codecs:            codecs,
+		Width:             width,
+		Height:            height,
+		Bandwidth:         bandwidth,
+		Init:              m.Map,
+		StartNumber:       m.MediaSequence,
+		Segments:          segments,
+	}, nil
+}
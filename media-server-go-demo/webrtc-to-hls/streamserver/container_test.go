@@ -0,0 +1,159 @@
+package streamserver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/hlscheck"
+)
+
+func TestResolveContainer(t *testing.T) {
+	t.Setenv("hls_container_overrides", "cmaf=fmp4,bad=mkv")
+	web, tv := hlsProfiles[client.ProfileWebDefault], hlsProfiles[client.ProfileTVLegacy]
+	if container, err := resolveContainer(web, "main"); err != nil || container != containerTS {
+		t.Fatalf("default container = %q, %v", container, err)
+	}
+	if container, err := resolveContainer(web, "cmaf"); err != nil || container != containerFMP4 {
+		t.Fatalf("overridden container = %q, %v", container, err)
+	}
+	if _, err := resolveContainer(web, "bad"); err == nil {
+		t.Fatal("unknown container accepted")
+	}
+	if _, err := resolveContainer(tv, "cmaf"); err == nil {
+		t.Fatal("fmp4 accepted for a ts only profile")
+	}
+
+	defer saveHLS()()
+	defaultContainer = containerFMP4
+	if container, err := resolveContainer(tv, "main"); err != nil || container != containerTS {
+		t.Fatalf("ts only profile under an fmp4 default = %q, %v", container, err)
+	}
+}
+
+func TestCMAFPipeline(t *testing.T) {
+	sess := newSession("cmaf-pipeline", nil, presets[client.LatencyBalanced])
+	sess.container = containerFMP4
+	pipeline := sess.outputPipeline("hls/main", 4, false, false).String()
+	want := "hlscmafsink init-location=hls/main/segment-4-init%05d.mp4 location=hls/main/segment-4-%05d.m4s playlist-location=hls/main/playlist.m3u8 max-files=10 target-duration=2 playlist-length=6"
+	if !strings.HasSuffix(pipeline, want) || strings.Contains(pipeline, "mpegtsmux") {
+		t.Fatalf("fmp4 pipeline = %s", pipeline)
+	}
+}
+
+func cmafRevision(seq int, durations ...float64) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:%d\n#EXT-X-MAP:URI=\"segment-4-init00000.mp4\"\n", seq)
+	for i, d := range durations {
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\nsegment-4-%05d.m4s\n", d, seq+i)
+	}
+	return []byte(b.String())
+}
+
+func TestCMAFTimeline(t *testing.T) {
+	timeline := newCMAFTimeline(time.Now())
+	// starts in milliseconds
+	place := func(data []byte) map[string]int {
+		m, err := hlscheck.ParseMedia(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		starts := map[string]int{}
+		for _, s := range timeline.place(m) {
+			starts[s.URI] = int(s.Start*1000 + 0.5)
+		}
+		return starts
+	}
+	// the first request comes after segment 0 rolled out
+	first := place(cmafRevision(1, 2, 1.8))
+	if first["segment-4-00001.m4s"] != 2000 || first["segment-4-00002.m4s"] != 4000 {
+		t.Fatalf("first revision = %v", first)
+	}
+	next := place(cmafRevision(2, 1.8, 2.1, 2))
+	if next["segment-4-00002.m4s"] != 4000 || next["segment-4-00003.m4s"] != 5800 || next["segment-4-00004.m4s"] != 7900 {
+		t.Fatalf("next revision = %v", next)
+	}
+	if _, ok := timeline.starts[1]; ok {
+		t.Fatal("start of an unlisted segment kept")
+	}
+
+	frame := append([]byte{0, 0, 0, 1}, 0x67, 0x42, 0xc0, 0x1f, 0xda, 0x01, 0x40, 0x16, 0xe8)
+	timeline.parameters(codecH264, append(frame, 0, 0, 0, 1, 0x65, 0x88))
+	if timeline.codecs != "avc1.42c01f" || timeline.width == 0 {
+		t.Fatalf("codecs = %q, %dx%d", timeline.codecs, timeline.width, timeline.height)
+	}
+}
+
+func TestServeCMAFManifest(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(serveDASH)
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", dashPath("cmaf-live"), nil))
+		return w
+	}
+
+	out := outputs.get("cmaf-live")
+	if err := os.MkdirAll(out.dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(out.dir)
+	sess := newSession("cmaf-live", nil, presets[client.LatencyBalanced])
+	sess.container = containerFMP4
+	if _, err := registry.claim(sess, conflictReject); err != nil {
+		t.Fatal(err)
+	}
+	defer registry.release(sess)
+	sess.Lock()
+	sess.started, sess.generation, sess.cmaf = true, 4, newCMAFTimeline(time.Now())
+	sess.Unlock()
+	if w := get(); w.Code != http.StatusNotFound {
+		t.Fatalf("no playlist yet = %d", w.Code)
+	}
+
+	if err := ioutil.WriteFile(out.playlist(), cmafRevision(0, 2, 2), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(out.dir, "segment-4-00000.m4s"), make([]byte, 500000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w := get()
+	body := w.Body.String()
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/dash+xml" ||
+		!strings.Contains(body, `type="dynamic"`) || !strings.Contains(body, `<Initialization sourceURL="segment-4-init00000.mp4"/>`) ||
+		!strings.Contains(body, `<S t="2000" d="2000"/>`) || !strings.Contains(body, `bandwidth="2000000"`) {
+		t.Fatalf("manifest = %d %s", w.Code, body)
+	}
+	if streamIDs(sess)["dash"] != dashPath("cmaf-live") {
+		t.Fatalf("ids = %v", streamIDs(sess))
+	}
+}
+
+func TestNewestFMP4Segment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fmp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"segment-4-init00000.mp4", "segment-4-00000.m4s", "segment-4-00001.m4s", "segment-3-00007.m4s"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if newest := newestSegment(dir, 4); newest != 1 {
+		t.Fatalf("newest segment = %d", newest)
+	}
+	removeGeneration(dir, 4)
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 || files[0].Name() != "segment-3-00007.m4s" {
+		t.Fatalf("left after removal: %v", files)
+	}
+}
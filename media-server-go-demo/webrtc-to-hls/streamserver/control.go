@@ -0,0 +1,301 @@
+package streamserver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/control"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/ident"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/metrics"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/webhook"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// controlEvents fans the lifecycle events out to the WatchEvents calls
+var controlEvents control.Hub
+
+var (
+	_ = metrics.NewGaugeFunc("control_event_watchers",
+		"gRPC calls watching lifecycle events", "", func() map[string]float64 {
+			return map[string]float64{"": float64(controlEvents.Subscribers())}
+		})
+	_ = metrics.NewGaugeFunc("control_events_dropped",
+		"Lifecycle events gRPC watchers too slow to read them missed", "", func() map[string]float64 {
+			return map[string]float64{"": float64(controlEvents.Dropped())}
+		})
+)
+
+// controlBuffer bounds the events a WatchEvents call has not sent yet
+const controlBuffer = 64
+
+// setupControl serves the gRPC control plane of control/control.proto on
+// grpc_port, e.g. 9090: over TLS with tls_cert and tls_key when set, else
+// in the clear, for a private network only.
+func setupControl() error {
+	port := os.Getenv("grpc_port")
+	if port == "" {
+		return nil
+	}
+	var options []grpc.ServerOption
+	certFile, keyFile := os.Getenv("tls_cert"), os.Getenv("tls_key")
+	if certFile != "" {
+		creds, err := credentials.NewServerTLSFromFile(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("grpc: %v", err)
+		}
+		options = append(options, grpc.Creds(creds))
+	}
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return fmt.Errorf("grpc: %v", err)
+	}
+	server := grpc.NewServer(options...)
+	control.RegisterControlServer(server, controlService{})
+	go func() {
+		fatal("grpc listener failed", server.Serve(listener))
+	}()
+	logger.Info("serving the grpc control plane", "address", listener.Addr().String(), "tls", certFile != "")
+	return nil
+}
+
+// publishControlEvent sends event, posted to webhooks, to the WatchEvents
+// calls too
+func publishControlEvent(event webhook.Event) {
+	data := make(map[string]string, len(event.Data))
+	for name, value := range event.Data {
+		data[name] = fmt.Sprint(value)
+	}
+	controlEvents.Publish(&control.Event{
+		Id:         event.ID,
+		Type:       event.Type,
+		TimeUnixMs: unixMilli(event.Time),
+		Stream:     event.Stream,
+		Data:       data,
+	})
+}
+
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// controlService implements the calls of the control plane like their REST
+// counterparts in streamsapi.go and record.go
+type controlService struct {
+	control.UnimplementedControlServer
+}
+
+// controlSession returns the live session of id, a stream key, external id
+// or session id
+func controlSession(id string) (*session, error) {
+	if err := ident.Check(ident.PlaybackID, id); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	sess := registry.find(id)
+	if sess == nil {
+		return nil, status.Errorf(codes.NotFound, "%v", errNotLive)
+	}
+	return sess, nil
+}
+
+// controlAdmin is the acting admin of a call changing a stream, as the
+// authenticating proxy in front of the control plane sets it or as sent
+// with admin_token, see adminTrusted
+func controlAdmin(ctx context.Context) (string, error) {
+	admin := strings.TrimSpace(control.Metadata(ctx, "x-admin-identity"))
+	if admin == "" {
+		return "", status.Errorf(codes.Unauthenticated, "x-admin-identity required")
+	}
+	var host string
+	if p, ok := peer.FromContext(ctx); ok {
+		host, _, _ = net.SplitHostPort(p.Addr.String())
+	}
+	if !adminTrusted(host, control.Metadata(ctx, "authorization")) {
+		return "", status.Errorf(codes.PermissionDenied, "x-admin-identity is only taken from a trusted proxy or with admin_token")
+	}
+	return admin, nil
+}
+
+// streamMessage describes a live session, as streamSummary does
+func streamMessage(s *session) *control.Stream {
+	viewers, _ := concurrentViewers(s.key)["total"].(int)
+	return &control.Stream{
+		Key:           s.key,
+		SessionId:     s.id,
+		ExternalId:    s.externalID,
+		Preset:        s.preset.Name,
+		Ingest:        ingestProtocol(s),
+		Publisher:     s.identity,
+		CreatedUnixMs: unixMilli(s.created),
+		WebrtcViewers: int32(s.viewerCount()),
+		Viewers:       int32(viewers),
+		Recording:     s.recordingFile(),
+		Pipeline:      s.pipelineState().State,
+		Upstream:      s.upstream,
+	}
+}
+
+// statsMessage samples the stats of a live session at now
+func statsMessage(s *session, now time.Time) *control.StreamStats {
+	frames := s.frames.stats()
+	viewers, _ := concurrentViewers(s.key)["total"].(int)
+	return &control.StreamStats{
+		Stream:             s.key,
+		TimeUnixMs:         unixMilli(now),
+		Fps:                frames.FPS,
+		Bitrate:            int64(frames.Bitrate),
+		BitrateVariation:   frames.BitrateVariation,
+		KeyframeIntervalMs: frames.KeyframeIntervalMs,
+		Frames:             frames.Frames.Count,
+		Keyframes:          frames.Keyframes.Count,
+		Viewers:            int32(viewers),
+		Pipeline:           s.pipelineState().State,
+	}
+}
+
+func (controlService) ListStreams(ctx context.Context, req *control.ListStreamsRequest) (*control.ListStreamsResponse, error) {
+	keys := registry.keys()
+	sort.Strings(keys)
+	resp := &control.ListStreamsResponse{}
+	for _, key := range keys {
+		if sess := registry.get(key); sess != nil {
+			resp.Streams = append(resp.Streams, streamMessage(sess))
+		}
+	}
+	return resp, nil
+}
+
+func (controlService) GetStream(ctx context.Context, req *control.StreamRequest) (*control.Stream, error) {
+	sess, err := controlSession(req.Id)
+	if err != nil {
+		return nil, err
+	}
+	return streamMessage(sess), nil
+}
+
+func (controlService) KickStream(ctx context.Context, req *control.KickStreamRequest) (*control.KickStreamResponse, error) {
+	admin, err := controlAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sess, err := controlSession(req.Id)
+	if err != nil {
+		return nil, err
+	}
+	if err := kickSession(sess, admin, req.Reason); err != nil {
+		return nil, status.Errorf(codes.Internal, "%v", err)
+	}
+	return &control.KickStreamResponse{}, nil
+}
+
+func (controlService) StartRecording(ctx context.Context, req *control.StreamRequest) (*control.Recording, error) {
+	admin, err := controlAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sess, err := controlSession(req.Id)
+	if err != nil {
+		return nil, err
+	}
+	sess.Lock()
+	path, err := sess.startRecording()
+	sess.Unlock()
+	switch err {
+	case nil:
+	case errRecording, errNotLive:
+		return nil, status.Errorf(codes.FailedPrecondition, "%v", err)
+	default:
+		return nil, status.Errorf(codes.Internal, "%v", err)
+	}
+	logger.Info("recording started", "stream", sess.key, "file", path, "admin", admin)
+	return &control.Recording{Stream: sess.key, File: path}, nil
+}
+
+func (controlService) StopRecording(ctx context.Context, req *control.StreamRequest) (*control.Recording, error) {
+	admin, err := controlAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sess, err := controlSession(req.Id)
+	if err != nil {
+		return nil, err
+	}
+	rec, err := sess.stopRecording()
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "%v", err)
+	}
+	logger.Info("recording stopped", "stream", sess.key, "file", rec.path, "admin", admin)
+	return &control.Recording{Stream: sess.key, File: rec.path, DurationMs: milliseconds(time.Since(rec.started))}, nil
+}
+
+// WatchStats sends the stats of the session live at the call until it
+// ends, each interval_ms, 100 at least
+func (controlService) WatchStats(req *control.WatchStatsRequest, stream control.Control_WatchStatsServer) error {
+	ctx := stream.Context()
+	sess, err := controlSession(req.Id)
+	if err != nil {
+		return err
+	}
+	interval := time.Duration(req.IntervalMs) * time.Millisecond
+	switch {
+	case interval == 0:
+		interval = time.Second
+	case interval < 100*time.Millisecond:
+		interval = 100 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := stream.Send(statsMessage(sess, time.Now())); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-sess.done:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// WatchEvents sends the lifecycle events wanted until the caller leaves.
+// A caller too slow to read them misses events, see Hub.
+func (controlService) WatchEvents(req *control.WatchEventsRequest, stream control.Control_WatchEventsServer) error {
+	events, cancel := controlEvents.Subscribe(controlBuffer)
+	defer cancel()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case event := <-events:
+			if !listed(req.Types, event.Type) || !listed(req.Streams, event.Stream) {
+				continue
+			}
+			if err := stream.Send(event); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// listed reports whether value is in list, every value being in an empty one
+func listed(list []string, value string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
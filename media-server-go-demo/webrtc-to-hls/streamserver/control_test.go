@@ -0,0 +1,114 @@
+package streamserver
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/control"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// dialControl serves the control plane in memory and returns a client of it
+func dialControl(t *testing.T) control.ControlClient {
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	control.RegisterControlServer(server, controlService{})
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	conn, err := grpc.NewClient("passthrough:///control",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return control.NewControlClient(conn)
+}
+
+func TestControlPlane(t *testing.T) {
+	dir, err := ioutil.TempDir("", "control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	saved := audit
+	audit = &auditLog{path: filepath.Join(dir, "audit.log")}
+	defer func() { audit = saved }()
+
+	grpcClient := dialControl(t)
+	ctx := context.Background()
+	admin := metadata.AppendToOutgoingContext(ctx, "x-admin-identity", "ops", "authorization", "Bearer "+testAdminToken)
+
+	sess := newSession("controlled", nil, presets[client.LatencyBalanced])
+	if _, err := registry.claim(sess, conflictReject); err != nil {
+		t.Fatal(err)
+	}
+	defer registry.release(sess)
+
+	list, err := grpcClient.ListStreams(ctx, &control.ListStreamsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, stream := range list.Streams {
+		found = found || (stream.Key == "controlled" && stream.SessionId == sess.id && stream.Ingest == "whip")
+	}
+	if !found {
+		t.Fatalf("streams %v", list)
+	}
+	if _, err := grpcClient.GetStream(ctx, &control.StreamRequest{Id: "missing"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("missing stream = %v", err)
+	}
+	if _, err := grpcClient.GetStream(ctx, &control.StreamRequest{Id: "../x"}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("bad id = %v", err)
+	}
+	if _, err := grpcClient.StartRecording(admin, &control.StreamRequest{Id: "controlled"}); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("recording without output = %v", err)
+	}
+
+	// watch the events of the stream, then kick it
+	events, err := grpcClient.WatchEvents(ctx, &control.WatchEventsRequest{Streams: []string{"controlled"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(time.Second); controlEvents.Subscribers() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("WatchEvents did not subscribe")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	notifyHooks(hookStreamStarted, "other", nil)
+
+	if _, err := grpcClient.KickStream(ctx, &control.KickStreamRequest{Id: "controlled"}); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("kick without admin = %v", err)
+	}
+	spoofed := metadata.AppendToOutgoingContext(ctx, "x-admin-identity", "ops")
+	if _, err := grpcClient.KickStream(spoofed, &control.KickStreamRequest{Id: "controlled"}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("kick without admin_token = %v", err)
+	}
+	if _, err := grpcClient.KickStream(admin, &control.KickStreamRequest{Id: "controlled", Reason: "test"}); err != nil {
+		t.Fatalf("kick = %v", err)
+	}
+	event, err := events.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != hookStreamEnded || event.Stream != "controlled" || event.Data["session"] != sess.id || !strings.Contains(event.Data["reason"], "test") {
+		t.Fatalf("event %v", event)
+	}
+	if log, _ := ioutil.ReadFile(audit.path); !strings.Contains(string(log), `"kick"`) {
+		t.Fatalf("kick not audited: %s", log)
+	}
+}
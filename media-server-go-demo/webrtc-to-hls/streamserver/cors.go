@@ -0,0 +1,101 @@
+package streamserver
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// corsPrefixes are the paths pages of other origins may call: playlists and
+// segments, the API and WHIP and WHEP
+var corsPrefixes = []string{"/hls/", "/vod/", "/api/", "/whip", "/whep/"}
+
+const (
+	corsMethods = "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS"
+	corsHeaders = "Authorization, Content-Type, If-Match, Range"
+	// corsExposed are the headers WHIP and WHEP clients and players read
+	corsExposed = "Location, Link, ETag, Content-Length, Content-Range"
+	// corsMaxAge is how long, in seconds, browsers keep a preflight answer
+	corsMaxAge = 600
+)
+
+// corsOrigin is the Access-Control-Allow-Origin answered to origin, from
+// cors_origins, comma separated, e.g. https://player.example: the origin
+// itself when listed, * when * is, empty when not allowed
+func corsOrigin(origin string) string {
+	for _, allowed := range envList("cors_origins") {
+		switch {
+		case allowed == "*":
+			return "*"
+		case strings.EqualFold(allowed, origin):
+			return origin
+		}
+	}
+	return ""
+}
+
+// allowOrigin is the CheckOrigin of the signaling WebSocket: the origins
+// of signaling_origins, comma separated, * for any, or else those allowed
+// by cors_origins, and the page of the server itself. Clients other than
+// browsers send no origin and are let through, to the checks of
+// guardSignaling.
+func allowOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || strings.EqualFold(origin, requestBaseURL(r)) {
+		return true
+	}
+	allowed := envList("signaling_origins")
+	if len(allowed) == 0 {
+		return corsOrigin(origin) != ""
+	}
+	for _, o := range allowed {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowCORS answers the CORS headers of the origins of cors_origins on
+// corsPrefixes, and their preflight requests. The OPTIONS a WHIP or WHEP
+// client sends for its ICE servers is preflighted itself, then reaches
+// iceOptions.
+func allowCORS(c *gin.Context) {
+	origin := c.GetHeader("Origin")
+	if origin == "" || !corsPath(c.Request.URL.Path) {
+		c.Next()
+		return
+	}
+	allowed := corsOrigin(origin)
+	if allowed == "" {
+		c.Next()
+		return
+	}
+	header := c.Writer.Header()
+	header.Set("Access-Control-Allow-Origin", allowed)
+	header.Add("Vary", "Origin")
+	if allowed != "*" {
+		// the playback token cookie of private streams
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	header.Set("Access-Control-Expose-Headers", corsExposed)
+	if c.Request.Method != http.MethodOptions || c.GetHeader("Access-Control-Request-Method") == "" {
+		c.Next()
+		return
+	}
+	header.Set("Access-Control-Allow-Methods", corsMethods)
+	header.Set("Access-Control-Allow-Headers", corsHeaders)
+	header.Set("Access-Control-Max-Age", strconv.Itoa(corsMaxAge))
+	c.AbortWithStatus(http.StatusNoContent)
+}
+
+func corsPath(path string) bool {
+	for _, prefix := range corsPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package streamserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAllowCORS(t *testing.T) {
+	t.Setenv("cors_origins", "https://player.example")
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(allowCORS)
+	r.GET("/hls/main/playlist.m3u8", func(c *gin.Context) { c.String(http.StatusOK, "#EXTM3U") })
+	r.OPTIONS("/whip", iceOptions)
+	r.GET("/metrics", func(c *gin.Context) { c.String(http.StatusOK, "") })
+	do := func(method, path, origin string, headers ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Origin", origin)
+		for i := 0; i < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do("GET", "/hls/main/playlist.m3u8", "https://player.example")
+	if rec.Header().Get("Access-Control-Allow-Origin") != "https://player.example" || rec.Header().Get("Access-Control-Allow-Credentials") != "true" || rec.Body.String() != "#EXTM3U" {
+		t.Fatalf("allowed origin: %v", rec.Header())
+	}
+	if rec := do("GET", "/hls/main/playlist.m3u8", "https://other.example"); rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("other origin: %v", rec.Header())
+	}
+	if rec := do("GET", "/metrics", "https://player.example"); rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("outside the CORS paths: %v", rec.Header())
+	}
+	rec = do("OPTIONS", "/api/v1/streams", "https://player.example", "Access-Control-Request-Method", "DELETE")
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Access-Control-Allow-Methods") != corsMethods {
+		t.Fatalf("preflight %d: %v", rec.Code, rec.Header())
+	}
+	// a WHIP client asking for its ICE servers, after its preflight
+	if rec := do("OPTIONS", "/whip", "https://player.example"); rec.Code != http.StatusNoContent || rec.Header().Get("Access-Control-Expose-Headers") != corsExposed {
+		t.Fatalf("whip options %d: %v", rec.Code, rec.Header())
+	}
+
+	req := httptest.NewRequest("GET", "http://live.example/channel", nil)
+	for origin, want := range map[string]bool{"https://player.example": true, "http://live.example": true, "https://evil.example": false, "": true} {
+		req.Header.Set("Origin", origin)
+		if allowOrigin(req) != want {
+			t.Errorf("websocket from %q allowed = %v", origin, !want)
+		}
+	}
+	t.Setenv("cors_origins", "*")
+	if rec := do("GET", "/hls/main/playlist.m3u8", "https://other.example"); rec.Header().Get("Access-Control-Allow-Origin") != "*" || rec.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Fatalf("any origin: %v", rec.Header())
+	}
+}
+
+func TestAllowOriginSignaling(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://live.example/channel", nil)
+	allowed := func(origin string) bool {
+		req.Header.Set("Origin", origin)
+		return allowOrigin(req)
+	}
+	// nothing set: the page of the server, and clients without origin
+	if !allowed("http://live.example") || !allowed("") || allowed("https://player.example") {
+		t.Fatal("default origins")
+	}
+	t.Setenv("cors_origins", "https://player.example")
+	t.Setenv("signaling_origins", "https://studio.example")
+	if !allowed("https://studio.example") || allowed("https://player.example") || !allowed("http://live.example") {
+		t.Fatal("signaling_origins not replacing cors_origins")
+	}
+	t.Setenv("signaling_origins", "*")
+	if !allowed("https://evil.example") {
+		t.Fatal("signaling_origins=* refused an origin")
+	}
+}
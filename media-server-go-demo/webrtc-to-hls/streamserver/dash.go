@@ -0,0 +1,125 @@
+package streamserver
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/emsg"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/ident"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/mpd"
+)
+
+// dashName is the MPD dashsink writes for an output generation
+const dashName = "manifest.mpd"
+
+// dashDefault is whether outputs write DASH by default, the dash setting of
+// the HLS config
+var dashDefault = false
+
+// dashDir is where the DASH output of a generation is written, the branch
+// of its pipeline packaging the video and audio of the output as fMP4
+// segments listed by a dynamic MPD. dashsink keeps every segment of a
+// generation, they are removed with it.
+func dashDir(dir string, generation int64) string {
+	return filepath.Join(dir, fmt.Sprintf("dash-%d", generation))
+}
+
+// dashPath is where players fetch the MPD of key, redirected to the
+// generation being written
+func dashPath(key string) string {
+	return "/hls/" + key + "/" + dashName
+}
+
+// resolveDASH decides whether a publish writes DASH next to HLS: requested
+// is the dash query parameter of the publish, on or off, else dash /
+// dash_overrides, else the HLS config
+func resolveDASH(requested string, key string) (bool, error) {
+	value := requested
+	if value == "" {
+		value = envForKey("dash", key)
+	}
+	switch value {
+	case "":
+		configLock.RLock()
+		defer configLock.RUnlock()
+		return dashDefault, nil
+	case "on", "true", "1":
+		return true, nil
+	case "off", "false", "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("dash must be on or off, not %q", value)
+}
+
+// dashManifest returns the MPD of the live session of key, if it writes
+// DASH, and the timeline of its fMP4 output when the MPD is to be rendered
+// from the HLS playlist instead
+func dashManifest(key string) (string, *cmafTimeline, bool) {
+	sess := registry.get(key)
+	if sess == nil {
+		return "", nil, false
+	}
+	sess.Lock()
+	defer sess.Unlock()
+	if !sess.started {
+		return "", nil, false
+	}
+	if sess.cmaf != nil {
+		return "", sess.cmaf, true
+	}
+	if !sess.dash {
+		return "", nil, false
+	}
+	return fmt.Sprintf("/hls/%s/dash-%d/%s", key, sess.generation, dashName), nil, true
+}
+
+// serveDASH redirects requests for dashPath to the MPD of the generation
+// being written. The MPD of an fMP4 output lists the segments of its HLS
+// playlist, and is served right away. Segments are static files.
+func serveDASH(c *gin.Context) {
+	parts := strings.Split(strings.TrimPrefix(c.Request.URL.Path, "/hls/"), "/")
+	if !strings.HasPrefix(c.Request.URL.Path, "/hls/") || len(parts) != 2 || parts[1] != dashName || ident.Check(ident.StreamKey, parts[0]) != nil {
+		c.Next()
+		return
+	}
+	c.Abort()
+	manifest, cmaf, ok := dashManifest(parts[0])
+	if !ok {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	c.Header("Cache-Control", "no-cache")
+	if cmaf == nil {
+		c.Redirect(http.StatusFound, manifest)
+		return
+	}
+	out := outputs.get(parts[0])
+	data, err := ioutil.ReadFile(out.playlist())
+	var m *mpd.Manifest
+	if err == nil {
+		m, err = cmaf.manifest(out.dir, data)
+	}
+	if err != nil {
+		// not playable yet
+		c.String(http.StatusNotFound, err.Error())
+		return
+	}
+	if drmScheme(parts[0]) != "" {
+		if m.ContentProtection, err = contentProtection(c, parts[0], m.Init); err != nil {
+			logger.Warn("drm key unavailable", "stream", parts[0], "error", err)
+			c.String(http.StatusServiceUnavailable, "key unavailable")
+			return
+		}
+	}
+	if timedMetadata(parts[0]) {
+		m.InbandEvents = []string{emsg.SchemeID3}
+	}
+	var buf bytes.Buffer
+	m.Write(&buf)
+	c.Data(http.StatusOK, "application/dash+xml", buf.Bytes())
+}
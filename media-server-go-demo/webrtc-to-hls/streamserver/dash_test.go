@@ -0,0 +1,81 @@
+package streamserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+)
+
+func TestResolveDASH(t *testing.T) {
+	t.Setenv("dash_overrides", "players=on")
+	for _, c := range []struct {
+		requested, key string
+		want           bool
+	}{
+		{"", "main", false},
+		{"", "players", true},
+		{"off", "players", false},
+		{"on", "main", true},
+	} {
+		if dash, err := resolveDASH(c.requested, c.key); err != nil || dash != c.want {
+			t.Errorf("resolveDASH(%q, %q) = %v, %v", c.requested, c.key, dash, err)
+		}
+	}
+	if _, err := resolveDASH("maybe", "main"); err == nil {
+		t.Fatal("bad dash value accepted")
+	}
+}
+
+func TestPipelineDASH(t *testing.T) {
+	sess := newSession("dash-pipeline", nil, presets[client.LatencyBalanced])
+	hls := sess.outputPipeline("hls/main", 4, true, false).String()
+	sess.dash = true
+	dash := sess.outputPipeline("hls/main", 4, true, false).String()
+	if strings.Contains(hls, "dashsink") || !strings.HasPrefix(dash, hls) {
+		t.Fatalf("DASH branch is not an addition: %s", dash)
+	}
+	if !strings.Contains(dash, " video. ! queue ! dashsink name=dash mpd-root-path=hls/main/dash-4 mpd-filename=manifest.mpd target-duration=2 ") ||
+		!strings.HasSuffix(dash, "aac. ! queue ! dash.") {
+		t.Fatalf("DASH pipeline = %s", dash)
+	}
+	if video := sess.outputPipeline("hls/main", 4, false, false).String(); strings.Contains(video, "aac.") {
+		t.Fatalf("DASH audio without audio: %s", video)
+	}
+}
+
+func TestServeDASH(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(serveDASH)
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", dashPath("dash-live"), nil))
+		return w
+	}
+	if w := get(); w.Code != http.StatusNotFound {
+		t.Fatalf("no session = %d", w.Code)
+	}
+
+	sess := newSession("dash-live", nil, presets[client.LatencyBalanced])
+	sess.dash = true
+	if _, err := registry.claim(sess, conflictReject); err != nil {
+		t.Fatal(err)
+	}
+	defer registry.release(sess)
+	if w := get(); w.Code != http.StatusNotFound {
+		t.Fatalf("not started = %d", w.Code)
+	}
+	sess.Lock()
+	sess.started, sess.generation = true, 12
+	sess.Unlock()
+	if w := get(); w.Code != http.StatusFound || w.Header().Get("Location") != "/hls/dash-live/dash-12/manifest.mpd" {
+		t.Fatalf("manifest = %d %q", w.Code, w.Header().Get("Location"))
+	}
+	if streamIDs(sess)["dash"] != dashPath("dash-live") {
+		t.Fatalf("ids = %v", streamIDs(sess))
+	}
+}
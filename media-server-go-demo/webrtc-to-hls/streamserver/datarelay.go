@@ -0,0 +1,81 @@
+package streamserver
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/id3"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/metrics"
+)
+
+var dataRelayed = metrics.NewCounter("data_messages_relayed_total",
+	"Data messages of publishers relayed, by destination: hls or viewer", "to")
+
+var (
+	errDataRelayOff = errors.New("data: the stream does not relay data messages")
+	errBadData      = errors.New("data: 1 to 16384 bytes of data and a label of up to 64 letters, digits, '.', '_' or '-' are required")
+)
+
+// maxDataBytes bounds a data message, an ID3 frame of a TS packet run
+const maxDataBytes = 16 << 10
+
+// dataLabel is the label of data messages sent without one, the description
+// of their TXXX frames
+const dataLabel = "data"
+
+// metadataBranch muxes ID3 tags into the TS segments as timed metadata,
+// timed on arrival like the media
+const metadataBranch = "appsrc do-timestamp=true is-live=true format=time name=metasrc caps=meta/x-id3 ! queue ! muxer."
+
+// dataRelay decides whether the publish of key relays data messages, when
+// data_relay / data_relay_overrides is "on"
+func dataRelay(key string) bool {
+	return strings.TrimSpace(envForKey("data_relay", key)) == "on"
+}
+
+// relayData relays a data message of the publisher, e.g. a live caption, to
+// the websocket viewers of the session and into the output as timed
+// metadata, an ID3 TXXX frame of its label. WHEP viewers have no channel to
+// send it on.
+func (s *session) relayData(msg client.Message) error {
+	if !dataRelay(s.key) {
+		return errDataRelayOff
+	}
+	label := msg.Label
+	if label == "" {
+		label = dataLabel
+	}
+	if msg.Data == "" || len(msg.Data) > maxDataBytes || !cueID.MatchString(label) {
+		return errBadData
+	}
+	tag, err := id3.Tag(id3.TXXX(label, msg.Data))
+	if err != nil {
+		return err
+	}
+	if s.injectMetadata(tag) == nil {
+		dataRelayed.Inc("hls")
+	}
+	sent := s.sendViewers(client.Message{Cmd: client.CmdData, Label: label, Data: msg.Data})
+	dataRelayed.Add("viewer", uint64(sent))
+	s.log.get().Debug("data relayed", "label", label, "bytes", len(msg.Data), "viewers", sent)
+	return nil
+}
+
+// sendViewers sends msg to the websocket viewers of the session, returning
+// how many it reached
+func (s *session) sendViewers(msg client.Message) int {
+	s.Lock()
+	viewers := make([]*webrtcViewer, 0, len(s.viewers))
+	for _, v := range s.viewers {
+		viewers = append(viewers, v)
+	}
+	s.Unlock()
+	sent := 0
+	for _, v := range viewers {
+		if v.conn != nil && v.conn.send(msg) == nil {
+			sent++
+		}
+	}
+	return sent
+}
@@ -0,0 +1,65 @@
+package streamserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+)
+
+func TestRelayData(t *testing.T) {
+	conns := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conns <- ws
+	}))
+	defer server.Close()
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	sess := newSession("captioned", nil, presets[client.LatencyBalanced])
+	sess.viewers = map[string]*webrtcViewer{
+		"1-1": {id: "1-1", conn: newSignaling(<-conns), done: make(chan struct{})},
+		"1-2": {id: "1-2", done: make(chan struct{})},
+	}
+	caption := client.Message{Cmd: client.CmdData, Label: "caption", Data: "hello"}
+	if err := sess.relayData(caption); err != errDataRelayOff {
+		t.Fatalf("relayed without data_relay: %v", err)
+	}
+	t.Setenv("data_relay_overrides", "captioned=on")
+	for _, bad := range []client.Message{
+		{Cmd: client.CmdData},
+		{Cmd: client.CmdData, Data: strings.Repeat("x", maxDataBytes+1)},
+		{Cmd: client.CmdData, Label: "no spaces", Data: "x"},
+	} {
+		if err := sess.relayData(bad); err != errBadData {
+			t.Fatalf("%+v relayed: %v", bad, err)
+		}
+	}
+	if err := sess.relayData(caption); err != nil {
+		t.Fatal(err)
+	}
+	var msg client.Message
+	if err := ws.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Cmd != client.CmdData || msg.Label != "caption" || msg.Data != "hello" {
+		t.Fatalf("viewer got %+v", msg)
+	}
+	if err := sess.relayData(client.Message{Cmd: client.CmdData, Data: "cue"}); err != nil {
+		t.Fatal(err)
+	}
+	if ws.ReadJSON(&msg); msg.Label != dataLabel {
+		t.Fatalf("unlabelled data relayed as %q", msg.Label)
+	}
+}
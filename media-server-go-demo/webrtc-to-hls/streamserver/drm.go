@@ -0,0 +1,347 @@
+package streamserver
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/cenc"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/hlscrypt"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/ident"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/metrics"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/mpd"
+)
+
+var drmLicensesServed = metrics.NewCounter("drm_licenses_served_total",
+	"clear key licenses delivered to players", "")
+
+// drmClearKey is the drm_key_provider deriving keys from drm_key_secret,
+// delivered by the license endpoint of the server
+const drmClearKey = "clearkey"
+
+// licensePrefix starts the name of the clear key license endpoint of a
+// generation, /hls/<id>/license-<generation>
+const licensePrefix = "license-"
+
+// drmKeys provides the keys of protected outputs, nil when no stream is
+// protected. clearKeys is set when they are derived by the server.
+var (
+	drmKeys   cenc.KeyProvider
+	clearKeys *cenc.ClearKeys
+)
+
+// setupDRM reads drm / drm_overrides, the Common Encryption scheme of the
+// fMP4 output of a stream key, cenc, cbcs or none, and drm_key_provider:
+// clearkey derives the keys from drm_key_secret and licenses them to
+// viewers with a playback token, an http(s) URL names the key server of a
+// DRM deployment (see cenc.HTTPProvider).
+func setupDRM() error {
+	schemes := envOverrides("drm")
+	schemes[""] = os.Getenv("drm")
+	protected := false
+	for key, scheme := range schemes {
+		switch cenc.Scheme(scheme) {
+		case "", encryptionNone:
+		case cenc.CENC, cenc.CBCS:
+			protected = true
+		default:
+			return fmt.Errorf("drm of %q: must be %s, %s or %s, not %q", key, cenc.CENC, cenc.CBCS, encryptionNone, scheme)
+		}
+	}
+	if !protected {
+		return nil
+	}
+	provider := os.Getenv("drm_key_provider")
+	switch u, err := url.Parse(provider); {
+	case provider == drmClearKey:
+		secret := os.Getenv("drm_key_secret")
+		if secret == "" {
+			return errors.New("drm_key_provider clearkey needs drm_key_secret")
+		}
+		if playbackTokens == nil {
+			return errors.New("clear key licenses are delivered to token holders, drm needs playback_secret")
+		}
+		clearKeys = &cenc.ClearKeys{Secret: []byte(secret)}
+		drmKeys = cenc.Cached(clearKeys)
+	case err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "":
+		drmKeys = cenc.Cached(&cenc.HTTPProvider{URL: provider, Client: &http.Client{Timeout: 10 * time.Second}})
+	default:
+		return fmt.Errorf("drm_key_provider must be %s or the http(s) URL of a key server, not %q", drmClearKey, provider)
+	}
+	return nil
+}
+
+// drmScheme is the scheme the output of key is protected with, empty when
+// it is served in the clear
+func drmScheme(key string) cenc.Scheme {
+	if drmKeys == nil {
+		return ""
+	}
+	switch scheme := cenc.Scheme(envForKey("drm", key)); scheme {
+	case cenc.CENC, cenc.CBCS:
+		return scheme
+	}
+	return ""
+}
+
+// checkDRM refuses a publish of key whose output could not be protected:
+// only the H.264 samples of the fMP4 output are, not MPEG-TS segments,
+// AV1 or H.265 passed through or LL-HLS parts
+func checkDRM(container string, passthrough bool, p client.Preset, key string) error {
+	switch {
+	case drmScheme(key) == "":
+		return nil
+	case container != containerFMP4:
+		return fmt.Errorf("protected output of %s needs the %s container", key, containerFMP4)
+	case passthrough:
+		return fmt.Errorf("protected output of %s cannot pass av1 or h265 through", key)
+	case lowLatency(p, key):
+		return fmt.Errorf("protected output of %s cannot be packaged as LL-HLS", key)
+	}
+	return nil
+}
+
+// cmafGeneration returns the generation of an fMP4 initialization section
+// or media segment name, <name>-<generation>-init<n>.mp4 or
+// <name>-<generation>-<n>.m4s
+func cmafGeneration(name string) (int64, bool) {
+	rest := strings.TrimPrefix(name, segmentName+"-")
+	dash := strings.IndexByte(rest, '-')
+	if rest == name || dash < 0 {
+		return 0, false
+	}
+	generation, err := strconv.ParseInt(rest[:dash], 10, 64)
+	return generation, err == nil
+}
+
+// licenseRequest reports whether urlPath asks for a clear key license of
+// the protected output of key, which only viewers with a token get
+func licenseRequest(urlPath, key string) bool {
+	return clearKeys != nil && strings.HasPrefix(path.Base(urlPath), licensePrefix) && drmScheme(key) != ""
+}
+
+// protectCMAF serves the fMP4 output of protected stream keys: the
+// initialization sections and media segments are encrypted as they are
+// served, the playlist lists the EXT-X-KEY of each DRM system of a
+// generation. With clear keys, players post their license requests to
+// /hls/<id>/license-<generation>, past authorizePlayback.
+func protectCMAF(c *gin.Context) {
+	keys := playbackKeys(c.Request.URL.Path)
+	if !strings.HasPrefix(c.Request.URL.Path, "/hls/") || len(keys) == 0 || drmScheme(keys[0]) == "" {
+		c.Next()
+		return
+	}
+	key := keys[0]
+	out := outputs.lookup(key)
+	parts := strings.SplitN(strings.TrimPrefix(c.Request.URL.Path, "/hls/"), "/", 2)
+	// the fMP4 output is a single rendition, its files all sit in out.dir
+	if out == nil || len(parts) != 2 || ident.Check(ident.FileName, parts[1]) != nil {
+		c.Next()
+		return
+	}
+	switch name := parts[1]; {
+	case licenseRequest(name, key):
+		c.Abort()
+		serveLicense(c, key, name)
+	case filepath.Ext(name) == ".mp4" || filepath.Ext(name) == ".m4s":
+		c.Abort()
+		serveProtected(c, key, out, name)
+	case name == playlistName:
+		protectPlaylist(c, key)
+	default:
+		c.Next()
+	}
+}
+
+// serveLicense answers the clear key license request of a generation of
+// the output of key
+func serveLicense(c *gin.Context, key, name string) {
+	generation, err := strconv.ParseInt(strings.TrimPrefix(name, licensePrefix), 10, 64)
+	if err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	if c.Request.Method != http.MethodPost {
+		c.Status(http.StatusMethodNotAllowed)
+		return
+	}
+	request, err := ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, 64<<10))
+	var license []byte
+	if err == nil {
+		license, err = clearKeys.License(key, generation, request)
+	}
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	drmLicensesServed.Inc("")
+	c.Header("Cache-Control", "private, no-store")
+	c.Data(http.StatusOK, "application/json", license)
+}
+
+// drmKey asks for the key of the generation of the output of key, failing
+// the request when the key server does not answer
+func drmKey(c *gin.Context, key string, generation int64) (*cenc.Key, bool) {
+	k, err := drmKeys.Key(c.Request.Context(), key, generation)
+	if err != nil {
+		logger.Warn("drm key unavailable", "stream", key, "generation", generation, "error", err)
+		c.String(http.StatusServiceUnavailable, "key unavailable")
+		return nil, false
+	}
+	return k, true
+}
+
+// serveProtected serves the initialization section or media segment name
+// in dir, the output of key, encrypted with the key of its generation.
+// CENC IVs of a segment start from the hash of its name, so no two
+// segments of a generation share them.
+func serveProtected(c *gin.Context, key string, out *streamOutput, name string) {
+	generation, ok := cmafGeneration(name)
+	if !ok {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	data, err := readSegment(out, name)
+	if err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	k, ok := drmKey(c, key, generation)
+	if !ok {
+		return
+	}
+	scheme := drmScheme(key)
+	var sealed []byte
+	if filepath.Ext(name) == ".mp4" {
+		sealed, err = cenc.EncryptInit(data, scheme, k)
+	} else {
+		sum := sha256.Sum256([]byte(name))
+		sealed, err = cenc.EncryptSegment(data, scheme, k, binary.BigEndian.Uint64(sum[:]))
+	}
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.Data(http.StatusOK, "video/mp4", sealed)
+}
+
+// keyFormats are the KEYFORMAT players know DRM systems by in HLS, other
+// systems go by their UUID
+var keyFormats = map[cenc.SystemID]string{
+	cenc.FairPlay:  "com.apple.streamingkeydelivery",
+	cenc.PlayReady: "com.microsoft.playready",
+	cenc.ClearKey:  "org.w3.clearkey",
+}
+
+// drmTags are the EXT-X-KEY of the systems of k: the URI a system acquires
+// the key from, else its pssh box as a data URI
+func drmTags(scheme cenc.Scheme, k *cenc.Key) string {
+	method := "SAMPLE-AES-CTR"
+	if scheme == cenc.CBCS {
+		method = "SAMPLE-AES"
+	}
+	var tags []string
+	for _, system := range k.Systems {
+		uri := system.URI
+		if uri == "" {
+			uri = "data:text/plain;base64," + base64.StdEncoding.EncodeToString(cenc.PSSH(system))
+		}
+		format, ok := keyFormats[system.ID]
+		if !ok {
+			format = "urn:uuid:" + system.ID.String()
+		}
+		tag := fmt.Sprintf(`#EXT-X-KEY:METHOD=%s,URI="%s",KEYFORMAT="%s",KEYFORMATVERSIONS="1"`, method, uri, format)
+		if system.ID != cenc.FairPlay {
+			tag += ",KEYID=0x" + k.ID.String()
+		}
+		tags = append(tags, tag)
+	}
+	return strings.Join(tags, "\n")
+}
+
+// protectPlaylist lists the EXT-X-KEY of the systems of each generation in
+// the playlist of key, whichever handler serves it, ahead of the first
+// segment of the generation
+func protectPlaylist(c *gin.Context, key string) {
+	captured := &capturedResponse{ResponseWriter: c.Writer}
+	c.Writer = captured
+	c.Next()
+	c.Writer = captured.ResponseWriter
+
+	body := captured.body.Bytes()
+	if c.Writer.Status() == http.StatusOK {
+		scheme := drmScheme(key)
+		var tagged int64
+		var failed error
+		body = hlscrypt.Decorate(body, func(uri string) string {
+			generation, ok := cmafGeneration(path.Base(uri))
+			if !ok || generation == tagged || failed != nil {
+				return ""
+			}
+			k, err := drmKeys.Key(c.Request.Context(), key, generation)
+			if err != nil {
+				failed = err
+				return ""
+			}
+			tagged = generation
+			return drmTags(scheme, k)
+		})
+		if failed != nil {
+			logger.Warn("drm key unavailable", "stream", key, "error", failed)
+			c.String(http.StatusServiceUnavailable, "key unavailable")
+			return
+		}
+		c.Writer.Header().Del("Content-Length")
+	}
+	if len(body) == 0 {
+		c.Writer.WriteHeaderNow()
+		return
+	}
+	c.Writer.Write(body)
+}
+
+// contentProtection describes the protection of the fMP4 output of key to
+// DASH players, from the key of the generation of its initialization
+// section. The license URL of clear keys carries the token of the request.
+func contentProtection(c *gin.Context, key, init string) ([]mpd.ContentProtection, error) {
+	generation, ok := cmafGeneration(init)
+	if !ok {
+		return nil, fmt.Errorf("no generation in %s", init)
+	}
+	k, err := drmKeys.Key(c.Request.Context(), key, generation)
+	if err != nil {
+		return nil, err
+	}
+	protection := []mpd.ContentProtection{{
+		SchemeIDURI: "urn:mpeg:dash:mp4protection:2011",
+		Value:       string(drmScheme(key)),
+		DefaultKID:  k.ID.UUID(),
+	}}
+	for _, system := range k.Systems {
+		p := mpd.ContentProtection{
+			SchemeIDURI: "urn:uuid:" + system.ID.String(),
+			PSSH:        base64.StdEncoding.EncodeToString(cenc.PSSH(system)),
+		}
+		if system.ID == cenc.ClearKey && clearKeys != nil {
+			p.LicenseURL = "/hls/" + key + "/" + licensePrefix + strconv.FormatInt(generation, 10)
+			if token := c.Query("token"); token != "" {
+				p.LicenseURL += "?token=" + url.QueryEscape(token)
+			}
+		}
+		protection = append(protection, p)
+	}
+	return protection, nil
+}
@@ -0,0 +1,118 @@
+package streamserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/pubauth"
+)
+
+// mp4Box writes an ISOBMFF box of typ holding content
+func mp4Box(typ string, content ...[]byte) []byte {
+	body := bytes.Join(content, nil)
+	return append(append(binary.BigEndian.AppendUint32(nil, uint32(8+len(body))), typ...), body...)
+}
+
+func TestProtectedOutput(t *testing.T) {
+	savedDir, savedOutputs, savedKeys, savedClear, savedTokens := hlsDir, outputs, drmKeys, clearKeys, playbackTokens
+	defer func() {
+		hlsDir, outputs, drmKeys, clearKeys, playbackTokens = savedDir, savedOutputs, savedKeys, savedClear, savedTokens
+	}()
+	t.Setenv("drm_overrides", "premium=cenc")
+	t.Setenv("drm_key_secret", "keys")
+	for _, provider := range []string{"", "ftp://keys.example", "widevine"} {
+		t.Setenv("drm_key_provider", provider)
+		if err := setupDRM(); err == nil {
+			t.Fatalf("drm_key_provider %q accepted", provider)
+		}
+	}
+	t.Setenv("drm_key_provider", drmClearKey)
+	playbackTokens = nil
+	if err := setupDRM(); err == nil {
+		t.Fatal("clear keys without playback_secret")
+	}
+	playbackTokens = &pubauth.JWT{Secret: []byte("playback")}
+	if err := setupDRM(); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkDRM(containerTS, false, presets[client.LatencyBalanced], "premium"); err == nil {
+		t.Fatal("MPEG-TS output protected")
+	}
+	if err := checkDRM(containerFMP4, true, presets[client.LatencyBalanced], "premium"); err == nil {
+		t.Fatal("av1 output protected")
+	}
+	if err := checkDRM(containerTS, false, presets[client.LatencyBalanced], "free"); err != nil {
+		t.Fatal(err)
+	}
+
+	hlsDir, outputs = t.TempDir(), newStreamOutputs(time.Now)
+	out := outputs.get("premium")
+	os.MkdirAll(out.dir, 0755)
+	avc1 := mp4Box("avc1", make([]byte, 78), mp4Box("avcC", []byte{1, 0x42, 0xe0, 0x1f, 0xff}))
+	stsd := mp4Box("stsd", make([]byte, 4), []byte{0, 0, 0, 1}, avc1)
+	init := append(mp4Box("ftyp", []byte("iso6\x00\x00\x00\x00")),
+		mp4Box("moov", mp4Box("trak", mp4Box("mdia", mp4Box("minf", mp4Box("stbl", stsd)))))...)
+	ioutil.WriteFile(filepath.Join(out.dir, "segment-7-init00000.mp4"), init, 0644)
+	ioutil.WriteFile(out.playlist(), []byte("#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MAP:URI=\"segment-7-init00000.mp4\"\n"+
+		"#EXTINF:2.000,\nsegment-7-00002.m4s\n#EXTINF:2.000,\nsegment-7-00003.m4s\n"+
+		"#EXT-X-DISCONTINUITY\n#EXT-X-MAP:URI=\"segment-8-init00000.mp4\"\n#EXTINF:2.000,\nsegment-8-00000.m4s\n"), 0644)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(authorizePlayback)
+	r.Use(protectCMAF)
+	r.Use(serveMedia)
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	key7, _ := drmKeys.Key(context.Background(), "premium", 7)
+	key8, _ := drmKeys.Key(context.Background(), "premium", 8)
+	w := do("GET", "/hls/premium/playlist.m3u8", "")
+	playlist := w.Body.String()
+	if w.Code != http.StatusOK || strings.Count(playlist, "#EXT-X-KEY:METHOD=SAMPLE-AES-CTR,") != 2 ||
+		!strings.Contains(playlist, `KEYFORMAT="org.w3.clearkey",KEYFORMATVERSIONS="1",KEYID=0x`+key7.ID.String()+"\n#EXTINF:2.000,\nsegment-7-00002.m4s") ||
+		!strings.Contains(playlist, "KEYID=0x"+key8.ID.String()+"\n#EXTINF:2.000,\nsegment-8-00000.m4s") {
+		t.Fatalf("playlist %d:\n%s", w.Code, playlist)
+	}
+
+	w = do("GET", "/hls/premium/segment-7-init00000.mp4", "")
+	if w.Code != http.StatusOK || !bytes.Contains(w.Body.Bytes(), []byte("encv")) || !bytes.Contains(w.Body.Bytes(), key7.ID[:]) {
+		t.Fatalf("init = %d %x", w.Code, w.Body.Bytes())
+	}
+
+	// licenses are for token holders only, even of a public stream
+	kid := base64.RawURLEncoding.EncodeToString(key7.ID[:])
+	request := `{"kids":["` + kid + `"],"type":"temporary"}`
+	if w := do("POST", "/hls/premium/license-7", request); w.Code != http.StatusUnauthorized {
+		t.Fatalf("license without a token = %d", w.Code)
+	}
+	exp := float64(time.Now().Add(time.Hour).Unix())
+	token, _ := playbackTokens.Sign(pubauth.Claims{Stream: "premium", ExpiresAt: &exp})
+	w = do("POST", "/hls/premium/license-7?token="+token, request)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"k":"`+base64.RawURLEncoding.EncodeToString(key7.Key[:])+`"`) {
+		t.Fatalf("license = %d %s", w.Code, w.Body)
+	}
+
+	// other streams are served as written
+	free := outputs.get("free")
+	os.MkdirAll(free.dir, 0755)
+	ioutil.WriteFile(filepath.Join(free.dir, "segment-7-init00000.mp4"), init, 0644)
+	if w := do("GET", "/hls/free/segment-7-init00000.mp4", ""); !bytes.Equal(w.Body.Bytes(), init) {
+		t.Fatalf("plain init altered")
+	}
+}
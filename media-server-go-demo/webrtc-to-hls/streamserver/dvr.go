@@ -0,0 +1,145 @@
+package streamserver
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/ident"
+)
+
+// dvrEvent is the DVR window of EVENT playlists, listing the whole stream
+const dvrEvent = "event"
+
+// maxDVRWindow bounds a DVR window, in seconds
+const maxDVRWindow = 24 * 60 * 60
+
+// dvrWindows are the DVR windows the management API set, by stream key;
+// they take precedence over dvr_window
+var dvrWindows = struct {
+	sync.Mutex
+	byKey map[string]string
+}{byKey: map[string]string{}}
+
+// dvrWindowFor is the DVR window of key: set through the API, or read from
+// dvr_window / dvr_window_overrides. A number of seconds keeps that much of
+// the stream in the playlist, e.g. 7200 for two hours players can seek
+// back in; event lists it all; empty keeps the playlist of the preset.
+func dvrWindowFor(key string) string {
+	dvrWindows.Lock()
+	window, ok := dvrWindows.byKey[key]
+	dvrWindows.Unlock()
+	if ok {
+		return window
+	}
+	return envForKey("dvr_window", key)
+}
+
+// validDVRWindow checks window is empty, event or a number of seconds
+func validDVRWindow(window string) error {
+	if window == "" || window == dvrEvent {
+		return nil
+	}
+	seconds, err := strconv.Atoi(window)
+	if err != nil || seconds <= 0 || seconds > maxDVRWindow {
+		return fmt.Errorf("dvr window must be event or up to %d seconds, not %q", maxDVRWindow, window)
+	}
+	return nil
+}
+
+// resolveDVR returns p with the DVR window of key: the playlist lists the
+// segments of the window, and as many more as p had are kept on disk for
+// players still loading them. An EVENT playlist lists and keeps every
+// segment.
+func resolveDVR(p client.Preset, key string) (client.Preset, error) {
+	window := dvrWindowFor(key)
+	if err := validDVRWindow(window); err != nil {
+		return p, err
+	}
+	switch window {
+	case "":
+		return p, nil
+	case dvrEvent:
+		// hlssink lists every segment with playlist-length=0
+		p.PlaylistLength, p.MaxFiles = 0, 0
+		return p, nil
+	}
+	seconds, _ := strconv.Atoi(window)
+	length := (seconds + p.SegmentDuration - 1) / p.SegmentDuration
+	if length < p.PlaylistLength {
+		length = p.PlaylistLength
+	}
+	if p.MaxFiles != 0 {
+		p.MaxFiles += length - p.PlaylistLength
+	}
+	p.PlaylistLength = length
+	return p, validatePreset(p)
+}
+
+// withPlaylistType marks a playlist hlssink writes as an EVENT or a VOD
+// playlist
+func withPlaylistType(playlist []byte, kind string) []byte {
+	if bytes.Contains(playlist, []byte("#EXT-X-PLAYLIST-TYPE")) {
+		return playlist
+	}
+	return bytes.Replace(playlist, []byte("#EXTM3U\n"), []byte("#EXTM3U\n#EXT-X-PLAYLIST-TYPE:"+kind+"\n"), 1)
+}
+
+// dvrJSON describes the DVR window of key, and that of its live session
+func dvrJSON(key string) gin.H {
+	dvr := gin.H{"stream": key, "window": dvrWindowFor(key)}
+	if sess := registry.get(key); sess != nil {
+		dvr["live"] = gin.H{
+			"event":     sess.preset.PlaylistLength == 0,
+			"windowSec": sess.preset.PlaylistLength * sess.preset.SegmentDuration,
+		}
+	}
+	return dvr
+}
+
+// getDVR handles GET /api/v1/streams/:id/dvr
+func getDVR(c *gin.Context) {
+	key, ok := identParam(c, "id", ident.StreamKey)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, dvrJSON(key))
+}
+
+// setDVR handles PUT /api/v1/streams/:id/dvr, setting the DVR window of a
+// stream key: {"window": "7200"}, "event", or "" for the playlist of the
+// preset. The window of a live stream is that of its publish; the new one
+// applies from the next.
+func setDVR(c *gin.Context) {
+	admin, ok := adminIdentity(c)
+	if !ok {
+		return
+	}
+	key, ok := identParam(c, "id", ident.StreamKey)
+	if !ok {
+		return
+	}
+	var req struct {
+		Window *string `json:"window"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		return
+	}
+	if req.Window == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "window required"})
+		return
+	}
+	if err := validDVRWindow(*req.Window); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	dvrWindows.Lock()
+	dvrWindows.byKey[key] = *req.Window
+	dvrWindows.Unlock()
+	logger.Info("dvr window set", "stream", key, "window", *req.Window, "admin", admin)
+	c.JSON(http.StatusOK, dvrJSON(key))
+}
@@ -0,0 +1,68 @@
+package streamserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+)
+
+func TestResolveDVR(t *testing.T) {
+	t.Setenv("dvr_window_overrides", "twohours=7200,short=4,event=event,bad=2h")
+	balanced := presets[client.LatencyBalanced]
+	for key, want := range map[string][2]int{
+		"twohours": {3600, 3604},
+		// never shorter than the preset
+		"short": {6, 10},
+		"event": {0, 0},
+		"other": {6, 10},
+	} {
+		p, err := resolveDVR(balanced, key)
+		if err != nil || p.PlaylistLength != want[0] || p.MaxFiles != want[1] {
+			t.Errorf("%s = %d listed, %d kept, %v", key, p.PlaylistLength, p.MaxFiles, err)
+		}
+	}
+	if _, err := resolveDVR(balanced, "bad"); err == nil {
+		t.Error("2h accepted")
+	}
+	// segments kept forever stay so
+	kept := balanced
+	kept.MaxFiles = 0
+	if p, _ := resolveDVR(kept, "twohours"); p.MaxFiles != 0 {
+		t.Errorf("max files = %d", p.MaxFiles)
+	}
+
+	if got := string(withPlaylistType([]byte("#EXTM3U\n#EXT-X-VERSION:3\n"), "EVENT")); got != "#EXTM3U\n#EXT-X-PLAYLIST-TYPE:EVENT\n#EXT-X-VERSION:3\n" {
+		t.Fatalf("event playlist = %q", got)
+	}
+}
+
+func TestDVRAPI(t *testing.T) {
+	defer func() { delete(dvrWindows.byKey, "dvr-api") }()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/api/v1/streams/:id/dvr", getDVR)
+	r.PUT("/api/v1/streams/:id/dvr", setDVR)
+	do := func(method, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, "/api/v1/streams/dvr-api/dvr", strings.NewReader(body))
+		asAdmin(req, "ops")
+		r.ServeHTTP(w, req)
+		return w
+	}
+	for body, status := range map[string]int{`{"window":"forever"}`: http.StatusBadRequest, `{}`: http.StatusBadRequest, `{"window":"3600"}`: http.StatusOK} {
+		if w := do("PUT", body); w.Code != status {
+			t.Errorf("PUT %s = %d", body, w.Code)
+		}
+	}
+	if w := do("GET", ""); !strings.Contains(w.Body.String(), `"window":"3600"`) {
+		t.Fatalf("dvr = %s", w.Body)
+	}
+	t.Setenv("dvr_window", "event")
+	if p, _ := resolveDVR(presets[client.LatencyBalanced], "dvr-api"); p.PlaylistLength != 1800 {
+		t.Fatalf("the window set through the api does not win: %d", p.PlaylistLength)
+	}
+}
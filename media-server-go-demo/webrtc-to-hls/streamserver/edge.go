@@ -0,0 +1,388 @@
+package streamserver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	mediaserver "github.com/notedit/media-server-go"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/ident"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/metrics"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/tracing"
+	"github.com/notedit/sdp"
+)
+
+var edgePulls = metrics.NewCounter("edge_pulls_total",
+	"Streams pulled from an origin on demand, by result", "result")
+
+// protocolWHEP is the ingest of a stream an edge pulls from the WHEP
+// endpoint of its origin
+const protocolWHEP = "whep"
+
+var (
+	// edgeEnabled is set when streams are pulled from origins, see setupEdge
+	edgeEnabled bool
+	// edgeStreams are the keys replicated on demand, every key when empty
+	edgeStreams []string
+	// edgeIdle is how long a pulled stream goes unwatched before it ends
+	edgeIdle = 30 * time.Second
+	// edgeWait is how long a request waits for the pull it started
+	edgeWait = 5 * time.Second
+)
+
+// pullStream replicates key from origin, replaced in tests
+var pullStream = pullFromOrigin
+
+// pulls are the keys being pulled, so concurrent viewers start one pull
+var pulls = struct {
+	sync.Mutex
+	active map[string]bool
+}{active: map[string]bool{}}
+
+// setupEdge makes this instance an edge when edge_origin, the base url of
+// the origin instance, e.g. http://origin.example:9000, is set for some key
+// through edge_origin or edge_origin_overrides. The keys of edge_streams,
+// every key when empty, are pulled on demand, the first HLS or WHEP
+// request waiting up to edge_wait_timeout (5) seconds for it, and end
+// after edge_idle_timeout (30) seconds without viewers. A key with an
+// edge_srt uri, e.g. srt://origin.example:9800, is pulled from the SRT
+// egress of the origin, the others from its WHEP endpoint.
+func setupEdge() error {
+	origins := envOverrides("edge_origin")
+	if origin := os.Getenv("edge_origin"); origin != "" {
+		origins[""] = origin
+	}
+	if len(origins) == 0 {
+		return nil
+	}
+	for key, origin := range origins {
+		if u, err := url.Parse(origin); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("edge: origin of %q is not an http url: %q", key, origin)
+		}
+	}
+	for key, uri := range envOverrides("edge_srt") {
+		if err := validSRT(uri); err != nil {
+			return fmt.Errorf("edge: srt of %s: %v", key, err)
+		}
+	}
+	if uri := os.Getenv("edge_srt"); uri != "" {
+		if err := validSRT(uri); err != nil {
+			return fmt.Errorf("edge: srt: %v", err)
+		}
+	}
+	edgeEnabled = true
+	edgeStreams = envList("edge_streams")
+	edgeIdle = time.Duration(envInt("edge_idle_timeout", 30)) * time.Second
+	edgeWait = time.Duration(envInt("edge_wait_timeout", 5)) * time.Second
+	logger.Info("pulling streams from origins on demand", "origins", len(origins), "streams", edgeStreams)
+	return nil
+}
+
+// edgeOrigin returns the base url key is pulled from, empty when key is not
+// replicated
+func edgeOrigin(key string) string {
+	if !edgeEnabled || ident.Check(ident.StreamKey, key) != nil || !listed(edgeStreams, key) {
+		return ""
+	}
+	return strings.TrimRight(envForKey("edge_origin", key), "/")
+}
+
+// startPull pulls key from origin unless a pull of key is running, and
+// reports whether it started one
+func startPull(key, origin string) bool {
+	pulls.Lock()
+	if pulls.active[key] {
+		pulls.Unlock()
+		return false
+	}
+	pulls.active[key] = true
+	pulls.Unlock()
+	edgePulls.Inc("started")
+	go func() {
+		if err := pullStream(key, origin); err != nil {
+			edgePulls.Inc("failed")
+			logger.Warn("edge pull failed", "stream", key, "origin", origin, "error", err)
+		}
+		pulls.Lock()
+		delete(pulls.active, key)
+		pulls.Unlock()
+	}()
+	return true
+}
+
+// edgeReady reports whether a request for key can be served: HLS once the
+// pulled session is registered, the warm-up playlist covering its first
+// segments, and WHEP once its video is live
+func edgeReady(key string, whep bool) bool {
+	sess := registry.find(key)
+	if sess == nil || !whep {
+		return sess != nil
+	}
+	video, _ := sess.liveTracks()
+	return video != nil
+}
+
+// pullOnDemand starts pulling a replicated stream that is not live here
+// when a player asks for it, and holds the request until the stream can
+// serve it or edgeWait passes
+func pullOnDemand(c *gin.Context) {
+	key := routedKey(c.Request.URL.Path)
+	if !edgeEnabled || key == "" || registry.find(key) != nil {
+		c.Next()
+		return
+	}
+	origin := edgeOrigin(key)
+	if origin == "" {
+		c.Next()
+		return
+	}
+	startPull(key, origin)
+	whep := strings.HasPrefix(c.Request.URL.Path, "/whep/")
+	deadline := time.NewTimer(edgeWait)
+	defer deadline.Stop()
+	poll := time.NewTicker(100 * time.Millisecond)
+	defer poll.Stop()
+	for !edgeReady(key, whep) {
+		select {
+		case <-c.Request.Context().Done():
+			c.Abort()
+			return
+		case <-deadline.C:
+			c.Next()
+			return
+		case <-poll.C:
+		}
+	}
+	c.Next()
+}
+
+// pullFromOrigin replicates key from origin over SRT when key has an edge_srt
+// uri, else over WebRTC from its WHEP endpoint
+func pullFromOrigin(key, origin string) error {
+	if uri := envForKey("edge_srt", key); uri != "" {
+		return ingestSRT(key, uri, origin)
+	}
+	return pullWHEP(key, origin)
+}
+
+// edgeClient is the client of the WHEP requests to origins
+var edgeClient = &http.Client{Timeout: 10 * time.Second}
+
+// originIP is the address of origin, a url, for the endpoint of its
+// network; nil when it does not resolve
+func originIP(origin string) net.IP {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return nil
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil {
+		return ip
+	}
+	ips, err := net.LookupIP(u.Hostname())
+	if err != nil || len(ips) == 0 {
+		return nil
+	}
+	return ips[0]
+}
+
+// requestWHEP posts offer to the WHEP endpoint at endpoint and returns the
+// answer and the url of the viewer it made, which DELETE ends
+func requestWHEP(ctx context.Context, endpoint, offer string) (string, string, error) {
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(offer))
+	if err != nil {
+		return "", "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/sdp")
+	tracing.Inject(ctx, req.Header)
+	resp, err := edgeClient.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxWHIPOffer))
+	if err != nil {
+		return "", "", err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return "", "", fmt.Errorf("edge: whep %s: %s %s", endpoint, resp.Status, strings.TrimSpace(string(body)))
+	}
+	location, err := resp.Location()
+	if err != nil {
+		return "", "", fmt.Errorf("edge: whep %s: %v", endpoint, err)
+	}
+	return string(body), location.String(), nil
+}
+
+// stopWHEP ends the viewer an edge is at its origin
+func stopWHEP(location string) {
+	req, err := http.NewRequest(http.MethodDelete, location, nil)
+	if err != nil {
+		return
+	}
+	resp, err := edgeClient.Do(req)
+	if err != nil {
+		logger.Warn("edge viewer not ended at the origin", "viewer", location, "error", err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// pullWHEP publishes key here as a viewer of origin: the offer is receive
+// only, and the tracks of the origin's answer feed the output and the
+// viewers of the session like those of a publisher.
+func pullWHEP(key, origin string) error {
+	if _, err := admitPublish(client.Message{}, key); err != nil {
+		return err
+	}
+	sess, err := newIngestSession(key)
+	if err != nil {
+		return err
+	}
+	sess.ingest = protocolWHEP
+	sess.upstream = origin
+	sess.timeline.add(eventSignaling, "out whep offer to "+origin)
+	sess.startTrace(nil, time.Now(), 0)
+	if _, err := registry.claim(sess, conflictReject); err != nil {
+		sess.close(0, "")
+		return err
+	}
+
+	endpoint := newEndpoint(originIP(origin))
+	offer := endpoint.CreateOffer(Capabilities["video"], Capabilities["audio"])
+	for _, media := range offer.GetMedias() {
+		media.SetDirection(sdp.RECVONLY)
+	}
+	// the origin sets its publish up in the trace of this one
+	ctx, cancel := context.WithTimeout(sess.traceContext(), edgeClient.Timeout)
+	raw, location, err := requestWHEP(ctx, origin+"/whep/"+key, offer.String())
+	cancel()
+	if err != nil {
+		sess.end()
+		releaseEndpoint(endpoint)
+		return err
+	}
+	go func() {
+		<-sess.done
+		stopWHEP(location)
+	}()
+	// answers carry what parseOffer checks of offers
+	answer, err := parseOffer(raw)
+	if err != nil {
+		sess.end()
+		releaseEndpoint(endpoint)
+		return err
+	}
+	sess.sdps.add(client.CmdAnswer, redactSDP(raw))
+
+	transport := endpoint.CreateTransport(answer, offer)
+	transport.OnDTLSICEState(func(state string) {
+		if state == "failed" || state == "closed" {
+			go sess.end()
+		}
+	})
+	transport.SetRemoteProperties(answer.GetMedia("audio"), answer.GetMedia("video"))
+	transport.SetLocalProperties(offer.GetMedia("audio"), offer.GetMedia("video"))
+	sess.Lock()
+	sess.videoCodec = pickVideoCodec(answer)
+	sess.Unlock()
+	refresher := newKeyframeRequester(sess, refreshPeriod(sess.preset, sess.key))
+	if !sess.setTransport(transport, refresher) {
+		refresher.Stop()
+		transport.Stop()
+		return errStreamReplaced
+	}
+	go sess.endWhenUnwatched(edgeIdle)
+
+	for _, stream := range answer.GetStreams() {
+		incoming := transport.CreateIncomingStream(stream)
+		refresher.AddStream(incoming)
+		if len(incoming.GetVideoTracks()) == 0 {
+			continue
+		}
+		if err := sess.feedPulled(incoming); err != nil {
+			sess.end()
+			return err
+		}
+		sess.logf("pulling from %s over whep", origin)
+		return nil
+	}
+	sess.end()
+	return fmt.Errorf("edge: %s answered no video for %s", origin, key)
+}
+
+// feedPulled starts the output of a pulled stream and feeds it the video,
+// and the audio unless left out
+func (s *session) feedPulled(incoming *mediaserver.IncomingStream) error {
+	s.setIncoming(incoming)
+	if err := s.waitPrevious(); err != nil {
+		return err
+	}
+	audio := s.takesAudio(len(incoming.GetAudioTracks()))
+	if err := s.startPipeline(audio); err != nil {
+		return err
+	}
+	s.feedVideo(incoming)
+	go s.watchFrames()
+	go s.watchSegments()
+	go s.runHeartbeat()
+	go s.runFallback()
+	if audio {
+		s.feedAudio(incoming)
+	}
+	return nil
+}
+
+// demandWatch tells when a pulled stream has gone unwatched for idle
+type demandWatch struct {
+	idle    time.Duration
+	watched time.Time
+}
+
+// next reports whether the stream, with viewers at now, is to end
+func (w *demandWatch) next(viewers int, now time.Time) bool {
+	if w.watched.IsZero() || viewers > 0 {
+		w.watched = now
+		return false
+	}
+	return now.Sub(w.watched) >= w.idle
+}
+
+// edgeViewers counts the HLS and WebRTC viewers of key
+func edgeViewers(key string) int {
+	total := 0
+	for _, count := range watching.Concurrent()[key] {
+		total += count
+	}
+	return total
+}
+
+// endWhenUnwatched ends a pulled session once nobody watched it for idle,
+// handing the origin its viewer back
+func (s *session) endWhenUnwatched(idle time.Duration) {
+	w := &demandWatch{idle: idle}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			if w.next(edgeViewers(s.key), now) {
+				s.logf("no viewers for %s, ending the pull", idle)
+				s.end()
+				return
+			}
+		}
+	}
+}
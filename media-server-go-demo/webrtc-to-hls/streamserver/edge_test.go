@@ -0,0 +1,178 @@
+package streamserver
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+)
+
+func TestEdgeOrigin(t *testing.T) {
+	defer func(enabled bool, streams []string) { edgeEnabled, edgeStreams = enabled, streams }(edgeEnabled, edgeStreams)
+	for _, name := range []string{"edge_origin", "edge_origin_overrides", "edge_streams", "edge_srt"} {
+		unsetenv(t, name)
+	}
+
+	if err := setupEdge(); err != nil || edgeEnabled {
+		t.Fatalf("no origin: %v %v", err, edgeEnabled)
+	}
+	t.Setenv("edge_origin", "origin.example")
+	if err := setupEdge(); err == nil {
+		t.Fatal("accepted an origin without scheme")
+	}
+	t.Setenv("edge_origin", "http://origin.example:9000/")
+	t.Setenv("edge_srt", "udp://origin.example")
+	if err := setupEdge(); err == nil {
+		t.Fatal("accepted a bad srt uri")
+	}
+	unsetenv(t, "edge_srt")
+	t.Setenv("edge_origin_overrides", "sports=https://origin-b.example")
+	t.Setenv("edge_streams", "main, sports")
+	if err := setupEdge(); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{
+		"main":   "http://origin.example:9000",
+		"sports": "https://origin-b.example",
+		"other":  "",
+		"../x":   "",
+	} {
+		if got := edgeOrigin(key); got != want {
+			t.Errorf("edgeOrigin(%s) = %q, want %q", key, got, want)
+		}
+	}
+	unsetenv(t, "edge_streams")
+	if err := setupEdge(); err != nil || edgeOrigin("other") != "http://origin.example:9000" {
+		t.Fatalf("every key replicated: %v %q", err, edgeOrigin("other"))
+	}
+}
+
+func TestPullOnDemand(t *testing.T) {
+	defer func(enabled bool, streams []string, wait time.Duration) {
+		edgeEnabled, edgeStreams, edgeWait = enabled, streams, wait
+	}(edgeEnabled, edgeStreams, edgeWait)
+	defer func(pull func(string, string) error) { pullStream = pull }(pullStream)
+	t.Setenv("edge_origin", "http://origin.example")
+	edgeEnabled, edgeStreams, edgeWait = true, []string{"pulled", "failing"}, 2*time.Second
+
+	var lock sync.Mutex
+	started := map[string]int{}
+	release := make(chan struct{})
+	pullStream = func(key, origin string) error {
+		lock.Lock()
+		started[key]++
+		lock.Unlock()
+		if key == "failing" {
+			return nil
+		}
+		// like an SRT pull, running as long as the session
+		sess := newSession(key, nil, presets[client.LatencyBalanced])
+		sess.upstream = origin
+		if _, err := registry.claim(sess, conflictReject); err != nil {
+			return err
+		}
+		defer registry.release(sess)
+		<-release
+		return nil
+	}
+	defer close(release)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(pullOnDemand)
+	r.GET("/hls/:id/*file", func(c *gin.Context) {
+		if sess := registry.find(c.Param("id")); sess != nil {
+			c.String(http.StatusOK, "from "+sess.upstream)
+			return
+		}
+		c.Status(http.StatusNotFound)
+	})
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if w := get("/hls/pulled/playlist.m3u8"); w.Code != http.StatusOK || w.Body.String() != "from http://origin.example" {
+				t.Errorf("pulled stream = %d %s", w.Code, w.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+	if w := get("/hls/unlisted/playlist.m3u8"); w.Code != http.StatusNotFound {
+		t.Fatalf("unlisted stream = %d", w.Code)
+	}
+	edgeWait = 200 * time.Millisecond
+	if w := get("/hls/failing/playlist.m3u8"); w.Code != http.StatusNotFound {
+		t.Fatalf("failed pull = %d", w.Code)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if started["pulled"] != 1 || started["failing"] != 1 || started["unlisted"] != 0 {
+		t.Fatalf("pulls %v", started)
+	}
+}
+
+func TestDemandWatch(t *testing.T) {
+	start := time.Unix(1000, 0)
+	w := &demandWatch{idle: 30 * time.Second}
+	if w.next(0, start) {
+		t.Fatal("ended before its first viewer could arrive")
+	}
+	if w.next(0, start.Add(20*time.Second)) || w.next(2, start.Add(25*time.Second)) {
+		t.Fatal("ended while watched")
+	}
+	if w.next(0, start.Add(50*time.Second)) {
+		t.Fatal("ended before idle since the last viewer")
+	}
+	if !w.next(0, start.Add(55*time.Second)) {
+		t.Fatal("kept an unwatched pull")
+	}
+}
+
+func TestRequestWHEP(t *testing.T) {
+	var deleted string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "DELETE":
+			deleted = r.URL.Path
+		case r.Header.Get("Content-Type") != "application/sdp":
+			http.Error(w, "offer must be application/sdp", http.StatusUnsupportedMediaType)
+		case r.URL.Path == "/whep/offline":
+			http.Error(w, errNotLive.Error(), http.StatusNotFound)
+		default:
+			body, _ := ioutil.ReadAll(r.Body)
+			w.Header().Set("Location", r.URL.Path+"/viewer1")
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("answer to " + string(body)))
+		}
+	}))
+	defer origin.Close()
+
+	answer, location, err := requestWHEP(context.Background(), origin.URL+"/whep/live", "offer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer != "answer to offer" || location != origin.URL+"/whep/live/viewer1" {
+		t.Fatalf("answer %q at %q", answer, location)
+	}
+	stopWHEP(location)
+	if deleted != "/whep/live/viewer1" {
+		t.Fatalf("deleted %q", deleted)
+	}
+	if _, _, err := requestWHEP(context.Background(), origin.URL+"/whep/offline", "offer"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("offline stream = %v", err)
+	}
+}
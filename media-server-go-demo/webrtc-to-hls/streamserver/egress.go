@@ -0,0 +1,87 @@
+package streamserver
+
+import (
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/egress"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/metrics"
+)
+
+var egressThrottled = metrics.NewCounter("egress_throttled_total",
+	"Playback requests refused over an egress limit", "")
+
+// shaper limits playback egress; without egress_global_kbps or
+// egress_stream_kbps its buckets only measure it
+var shaper = egress.NewShaper(egress.NewBucket(0, 0), nil)
+
+// egressRate returns a limit in kbps as bytes per second, with
+// egress_burst_seconds (2) of it as burst
+func egressRate(value string) (float64, float64) {
+	kbps, err := strconv.Atoi(value)
+	if err != nil || kbps <= 0 {
+		return 0, 0
+	}
+	rate := float64(kbps) * 1000 / 8
+	return rate, rate * float64(envInt("egress_burst_seconds", 2))
+}
+
+// setupEgress reads the global limit, egress_global_kbps, and the
+// per stream key limit, egress_stream_kbps and its overrides
+func setupEgress() {
+	rate, burst := egressRate(os.Getenv("egress_global_kbps"))
+	shaper = egress.NewShaper(egress.NewBucket(rate, burst), func(key string) (float64, float64) {
+		return egressRate(envForKey("egress_stream_kbps", key))
+	})
+}
+
+// shapedWriter takes the bytes of a playback response from the buckets
+type shapedWriter struct {
+	gin.ResponseWriter
+	meter func(n int)
+}
+
+func (w *shapedWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.meter(n)
+	return n, err
+}
+
+func (w *shapedWriter) WriteString(s string) (int, error) {
+	n, err := w.ResponseWriter.WriteString(s)
+	w.meter(n)
+	return n, err
+}
+
+// shapeEgress refuses new playback requests with 503 while the stream or
+// the instance is over its egress limit, telling players when to retry.
+// Responses that were admitted are written in full.
+func shapeEgress(c *gin.Context) {
+	// playbackKeys is nil for anything but playback
+	keys := playbackKeys(c.Request.URL.Path)
+	if keys == nil {
+		c.Next()
+		return
+	}
+	if retry, ok := shaper.Admit(keys); !ok {
+		egressThrottled.Inc("")
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+		c.Header("Cache-Control", "no-store")
+		c.String(http.StatusServiceUnavailable, "stream egress limit reached\n")
+		c.Abort()
+		return
+	}
+	c.Writer = &shapedWriter{ResponseWriter: c.Writer, meter: shaper.Meter(keys)}
+	c.Next()
+}
+
+// egressUsage is the egress of a stream and of the instance, for stats
+func egressUsage(key string) gin.H {
+	return gin.H{
+		"stream": shaper.Stream(key).Usage(),
+		"global": shaper.Global.Usage(),
+	}
+}
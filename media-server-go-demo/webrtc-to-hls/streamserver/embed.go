@@ -0,0 +1,175 @@
+// Package streamserver is the WebRTC-to-HLS server, for the webrtc-to-hls
+// binary and Go programs embedding it: New sets a Server up with its
+// options, e.g. routes of the program, and Run serves it.
+package streamserver
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+)
+
+// Server is the WebRTC-to-HLS server of a Go program embedding it, see New.
+// The publishes, the settings and the metrics are those of the package, so
+// a process runs one Server.
+type Server struct {
+	address   string
+	settings  map[string]string
+	routes    []func(r *gin.Engine)
+	indexPage string
+
+	engine            *gin.Engine
+	http              *http.Server
+	certFile, keyFile string
+}
+
+// Option configures a Server, see New
+type Option func(s *Server)
+
+// WithAddress has the server listen on address, e.g. ":8080", rather than
+// on the port setting
+func WithAddress(address string) Option {
+	return func(s *Server) {
+		s.address = address
+	}
+}
+
+// WithSetting sets the setting name, e.g. max_publishers, over the
+// environment and the env file
+func WithSetting(name, value string) Option {
+	return func(s *Server) {
+		if s.settings == nil {
+			s.settings = map[string]string{}
+		}
+		s.settings[name] = value
+	}
+}
+
+// WithRoutes has register add routes of the program to the router, after
+// those of the server. The first element of the paths of the server is
+// reserved, see ident; those of register are not, so a stream key may
+// shadow them in the HLS paths.
+func WithRoutes(register func(r *gin.Engine)) Option {
+	return func(s *Server) {
+		s.routes = append(s.routes, register)
+	}
+}
+
+// WithIndexPage serves the page at path on /, ./index.html by default
+func WithIndexPage(path string) Option {
+	return func(s *Server) {
+		s.indexPage = path
+	}
+}
+
+// Router is the router of the server, with its routes and those of
+// WithRoutes, for a program serving it itself
+func (s *Server) Router() *gin.Engine {
+	return s.engine
+}
+
+// Run serves until the listener fails, Shutdown is called, or the process
+// gets SIGINT or SIGTERM, which shut the server down gracefully
+func (s *Server) Run() error {
+	return serve(s.http, s.certFile, s.keyFile)
+}
+
+// Shutdown ends every publish, letting its output finish, then stops the
+// listener; publishes still finishing when ctx is done are abandoned
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := shutdown(ctx, s.http)
+	if err := tracer.Flush(ctx); err != nil {
+		logger.Warn("spans not exported", "error", err)
+	}
+	return err
+}
+
+// Sessions are the live publishes, ordered by stream key
+func (s *Server) Sessions() []*Session {
+	keys := registry.keys()
+	sort.Strings(keys)
+	var sessions []*Session
+	for _, key := range keys {
+		if sess := registry.get(key); sess != nil {
+			sessions = append(sessions, &Session{sess})
+		}
+	}
+	return sessions
+}
+
+// Session is the live publish of key, nil when there is none
+func (s *Server) Session(key string) *Session {
+	sess := registry.get(key)
+	if sess == nil {
+		return nil
+	}
+	return &Session{sess}
+}
+
+// Session is a publish, from a WebRTC publisher or another ingest
+type Session struct {
+	s *session
+}
+
+// ID is unique per publish, unlike the stream key
+func (s *Session) ID() string { return s.s.id }
+
+// Key is the stream key published
+func (s *Session) Key() string { return s.s.key }
+
+// Preset is the name of the latency preset of the output
+func (s *Session) Preset() string { return s.s.preset.Name }
+
+// Ingest is the protocol of a publisher that is not WebRTC, e.g. rtmp,
+// empty for WebRTC publishers
+func (s *Session) Ingest() string { return s.s.ingest }
+
+// Created is when the publish started
+func (s *Session) Created() time.Time { return s.s.created }
+
+// Playlist is the path of the HLS playlist of the output, empty for audio
+// only publishes
+func (s *Session) Playlist() string { return playlistPath(s.s) }
+
+// Viewers counts the viewers of the stream, those of HLS and WebRTC
+func (s *Session) Viewers() int {
+	protocols := watching.Concurrent()[s.s.key]
+	return protocols[protocolHLS] + protocols[protocolWebRTC]
+}
+
+// Pipeline is the state of the output pipeline of the publish
+func (s *Session) Pipeline() Pipeline {
+	status := s.s.pipelineState()
+	s.s.Lock()
+	launch := s.s.pipeline
+	s.s.Unlock()
+	return Pipeline{
+		State:     status.State,
+		Since:     status.Since,
+		Restarts:  status.Restarts,
+		LastError: status.LastError,
+		Launch:    launch,
+	}
+}
+
+// Close disconnects the publisher, telling it reason, and ends the output
+func (s *Session) Close(reason string) {
+	s.s.endWith(client.CloseKicked, reason)
+}
+
+// Pipeline is the state of the output pipeline of a publish
+type Pipeline struct {
+	// State is running, restarting, failed or stopped, empty before the
+	// output started
+	State string
+	Since time.Time
+	// Restarts counts the restarts of the pipeline after failures
+	Restarts  int
+	LastError string
+	// Launch is the launch description of the pipeline, once started
+	Launch string
+}
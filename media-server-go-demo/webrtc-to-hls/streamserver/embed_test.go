@@ -0,0 +1,41 @@
+package streamserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestOptions(t *testing.T) {
+	s := &Server{indexPage: "./index.html"}
+	registered := false
+	for _, option := range []Option{
+		WithAddress(":8080"),
+		WithSetting("max_publishers", "10"),
+		WithRoutes(func(r *gin.Engine) { registered = true }),
+		WithIndexPage("web/index.html"),
+	} {
+		option(s)
+	}
+	if s.address != ":8080" || s.settings["max_publishers"] != "10" || s.indexPage != "web/index.html" || len(s.routes) != 1 {
+		t.Fatalf("server %+v", s)
+	}
+	s.routes[0](nil)
+	if !registered {
+		t.Fatal("routes not registered")
+	}
+}
+
+func TestSessionPipeline(t *testing.T) {
+	since := time.Now()
+	sess := &Session{&session{id: "s1", key: "main", pipeline: "appsrc ! hlssink"}}
+	sess.s.supervisor = pipelineStatus{State: pipelineRestarting, Since: since, Restarts: 2, LastError: "eos"}
+	want := Pipeline{State: pipelineRestarting, Since: since, Restarts: 2, LastError: "eos", Launch: "appsrc ! hlssink"}
+	if p := sess.Pipeline(); p != want {
+		t.Fatalf("pipeline %+v", p)
+	}
+	if sess.ID() != "s1" || sess.Key() != "main" {
+		t.Fatalf("session %s %s", sess.ID(), sess.Key())
+	}
+}
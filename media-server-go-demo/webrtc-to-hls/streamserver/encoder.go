@@ -0,0 +1,50 @@
+package streamserver
+
+import (
+	"fmt"
+	"os"
+
+	gstreamer "github.com/notedit/gstreamer-go"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/pipeline"
+)
+
+// videoEncoder is the encoder transcodes and ABR rungs encode H.264 with,
+// see setupEncoder
+var videoEncoder = pipeline.X264
+
+// encoderProbe is a pipeline feeding an encoder element raw video, which
+// only parses when the element is registered
+const encoderProbe = "appsrc name=encoderprobe ! videoconvert ! %s ! fakesink"
+
+// encoderAvailable reports whether the encoder element is registered
+var encoderAvailable = func(element string) bool {
+	probe, err := gstreamer.New(fmt.Sprintf(encoderProbe, element))
+	if err != nil {
+		return false
+	}
+	probe.Stop()
+	return true
+}
+
+// setupEncoder picks the encoder of video_encoder: x264, vaapi, nvenc or
+// v4l2, or auto (the default) for the first hardware encoder GStreamer
+// finds, else x264. A forced encoder must be available.
+func setupEncoder() error {
+	value := os.Getenv("video_encoder")
+	if value == "auto" {
+		value = ""
+	}
+	encoder, err := pipeline.ParseEncoder(value)
+	if err != nil {
+		return fmt.Errorf("video_encoder: %v", err)
+	}
+	switch {
+	case encoder == "":
+		encoder = pipeline.Detect(encoderAvailable)
+	case !encoderAvailable(pipeline.EncoderElements[encoder]):
+		return fmt.Errorf("video_encoder: %s is not available, %s is not registered", encoder, pipeline.EncoderElements[encoder])
+	}
+	videoEncoder = encoder
+	logger.Info("encoding video", "encoder", encoder, "forced", value != "")
+	return nil
+}
@@ -0,0 +1,31 @@
+package streamserver
+
+import "testing"
+
+func TestSetupEncoder(t *testing.T) {
+	savedEncoder, savedAvailable := videoEncoder, encoderAvailable
+	defer func() { videoEncoder, encoderAvailable = savedEncoder, savedAvailable }()
+	registered := map[string]bool{"x264enc": true, "vaapih264enc": true}
+	encoderAvailable = func(element string) bool { return registered[element] }
+
+	if err := setupEncoder(); err != nil || videoEncoder != "vaapi" {
+		t.Fatalf("detected %s, %v", videoEncoder, err)
+	}
+	t.Setenv("video_encoder", "x264")
+	if err := setupEncoder(); err != nil || videoEncoder != "x264" {
+		t.Fatalf("forced %s, %v", videoEncoder, err)
+	}
+	t.Setenv("video_encoder", "nvenc")
+	if err := setupEncoder(); err == nil {
+		t.Fatal("nvenc forced without nvh264enc")
+	}
+	t.Setenv("video_encoder", "qsv")
+	if err := setupEncoder(); err == nil {
+		t.Fatal("unknown encoder accepted")
+	}
+	delete(registered, "vaapih264enc")
+	t.Setenv("video_encoder", "auto")
+	if err := setupEncoder(); err != nil || videoEncoder != "x264" {
+		t.Fatalf("fallback %s, %v", videoEncoder, err)
+	}
+}
@@ -0,0 +1,258 @@
+package streamserver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/hlscrypt"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/ident"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/metrics"
+)
+
+var hlsKeysServed = metrics.NewCounter("hls_keys_served_total",
+	"AES-128 keys delivered to players", "")
+
+// encryption methods of hls_encryption
+const (
+	encryptionNone   = "none"
+	encryptionAES128 = "aes-128"
+	// encryptionSampleAES encrypts the samples inside the segments, which
+	// would take a packager of its own: hlssink writes plain MPEG-TS
+	encryptionSampleAES = "sample-aes"
+)
+
+// keySuffix ends the names keys are delivered under, key-<generation>-<period>.key
+const keySuffix = ".key"
+
+// hlsKeys derives the keys of encrypted outputs, nil when no stream is
+// encrypted
+var hlsKeys *hlscrypt.Keys
+
+// setupEncryption reads hls_encryption / hls_encryption_overrides, aes-128
+// or none, the keys derived from hls_key_secret rotating every
+// hls_key_rotation_segments (10) segments. Keys are delivered to viewers
+// with a playback token, so encryption needs playback_secret too.
+func setupEncryption() error {
+	methods := envOverrides("hls_encryption")
+	methods[""] = os.Getenv("hls_encryption")
+	encrypted := false
+	for key, method := range methods {
+		switch method {
+		case "", encryptionNone:
+		case encryptionAES128:
+			encrypted = true
+		case encryptionSampleAES:
+			return fmt.Errorf("hls_encryption of %q: %s is not supported by the MPEG-TS output, use %s", key, method, encryptionAES128)
+		default:
+			return fmt.Errorf("hls_encryption of %q: must be %s or %s, not %q", key, encryptionAES128, encryptionNone, method)
+		}
+	}
+	if !encrypted {
+		return nil
+	}
+	secret := os.Getenv("hls_key_secret")
+	if secret == "" {
+		return errors.New("hls_encryption needs hls_key_secret")
+	}
+	if playbackTokens == nil {
+		return errors.New("hls_encryption delivers keys to token holders, it needs playback_secret")
+	}
+	hlsKeys = &hlscrypt.Keys{Secret: []byte(secret), Rotation: envInt("hls_key_rotation_segments", 10)}
+	return nil
+}
+
+// encrypted reports whether the HLS output of key is served encrypted
+func encrypted(key string) bool {
+	return hlsKeys != nil && envForKey("hls_encryption", key) == encryptionAES128
+}
+
+// checkEncryption refuses a publish of key whose output could not be
+// served encrypted: only the segments hlssink writes as MPEG-TS are, not
+// fMP4, DASH or LL-HLS parts
+func checkEncryption(container string, dash bool, p client.Preset, key string) error {
+	switch {
+	case !encrypted(key):
+		return nil
+	case container == containerFMP4:
+		return fmt.Errorf("encrypted output of %s needs the %s container", key, containerTS)
+	case dash:
+		return fmt.Errorf("encrypted output of %s cannot be written as DASH", key)
+	case lowLatency(p, key):
+		return fmt.Errorf("encrypted output of %s cannot be packaged as LL-HLS", key)
+	}
+	return nil
+}
+
+// keyName is the name the key of period of generation is delivered under
+func keyName(generation int64, period int) string {
+	return fmt.Sprintf("key-%d-%d%s", generation, period, keySuffix)
+}
+
+// parseKeyName returns the generation and period of a key name
+func parseKeyName(name string) (int64, int, bool) {
+	fields := strings.Split(strings.TrimSuffix(strings.TrimPrefix(name, "key-"), keySuffix), "-")
+	if !strings.HasPrefix(name, "key-") || !strings.HasSuffix(name, keySuffix) || len(fields) != 2 {
+		return 0, 0, false
+	}
+	generation, err := strconv.ParseInt(fields[0], 10, 64)
+	period, perr := strconv.Atoi(fields[1])
+	if err != nil || perr != nil || period < 0 {
+		return 0, 0, false
+	}
+	return generation, period, true
+}
+
+// encryptedSegment returns the generation and index of an MPEG-TS segment
+// name, those of the restarted rungs of the ladder included:
+// <name>-<generation>-[<attempt>-]<index>.ts
+func encryptedSegment(name string) (int64, int, bool) {
+	if !strings.HasPrefix(name, segmentName+"-") || filepath.Ext(name) != ".ts" {
+		return 0, 0, false
+	}
+	fields := strings.Split(strings.TrimSuffix(strings.TrimPrefix(name, segmentName+"-"), ".ts"), "-")
+	if len(fields) < 2 {
+		return 0, 0, false
+	}
+	generation, err := strconv.ParseInt(fields[0], 10, 64)
+	index, ierr := strconv.Atoi(fields[len(fields)-1])
+	if err != nil || ierr != nil || index < 0 {
+		return 0, 0, false
+	}
+	return generation, index, true
+}
+
+// keyRequest reports whether urlPath asks for a key of the encrypted output
+// of key, which only viewers with a token get
+func keyRequest(urlPath, key string) bool {
+	return strings.HasSuffix(urlPath, keySuffix) && encrypted(key)
+}
+
+// encryptHLS serves the output of encrypted stream keys: segments are
+// encrypted as they are served, media playlists list the EXT-X-KEY of each
+// segment, and keys are delivered at /hls/<id>/key-<generation>-<period>.key
+// to the viewers authorizePlayback let through. The token of a playlist
+// request is carried over to the key URIs it lists.
+func encryptHLS(c *gin.Context) {
+	keys := playbackKeys(c.Request.URL.Path)
+	if !strings.HasPrefix(c.Request.URL.Path, "/hls/") || len(keys) == 0 || !encrypted(keys[0]) {
+		c.Next()
+		return
+	}
+	key := keys[0]
+	out := outputs.lookup(key)
+	parts := strings.SplitN(strings.TrimPrefix(c.Request.URL.Path, "/hls/"), "/", 2)
+	if out == nil || len(parts) != 2 {
+		c.Next()
+		return
+	}
+	rel := parts[1]
+	for _, element := range strings.Split(rel, "/") {
+		if ident.Check(ident.FileName, element) != nil {
+			c.Next()
+			return
+		}
+	}
+	switch name := path.Base(rel); {
+	case strings.HasSuffix(name, keySuffix) && rel == name:
+		c.Abort()
+		serveKey(c, key, name)
+	case filepath.Ext(name) == ".ts":
+		c.Abort()
+		serveEncrypted(c, key, out.dir, rel)
+	case filepath.Ext(name) == ".m3u8" && rel != masterName:
+		decoratePlaylist(c, key, rel)
+	default:
+		c.Next()
+	}
+}
+
+// serveKey delivers the key named name of the output of key
+func serveKey(c *gin.Context, key, name string) {
+	generation, period, ok := parseKeyName(name)
+	if !ok {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	hlsKeysServed.Inc("")
+	c.Header("Cache-Control", "private, no-store")
+	c.Data(http.StatusOK, "application/octet-stream", hlsKeys.Key(key, generation, period))
+}
+
+// serveEncrypted serves the segment at rel below dir, the output of key,
+// encrypted with the key of its period
+func serveEncrypted(c *gin.Context, key, dir, rel string) {
+	generation, index, ok := encryptedSegment(path.Base(rel))
+	if !ok {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(rel)))
+	if err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	sealed, err := hlscrypt.Encrypt(hlsKeys.Key(key, generation, hlsKeys.Period(index)), hlscrypt.IV(rel), data)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.Data(http.StatusOK, "video/mp2t", sealed)
+}
+
+// capturedResponse holds back the body of a response to rewrite it
+type capturedResponse struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *capturedResponse) Write(p []byte) (int, error) {
+	return w.body.Write(p)
+}
+
+func (w *capturedResponse) WriteString(s string) (int, error) {
+	return w.body.WriteString(s)
+}
+
+// decoratePlaylist lists the EXT-X-KEY of each segment in the playlist at
+// rel, whichever handler serves it. Key URIs are relative to the playlist,
+// which is the playlist of a rung one directory down.
+func decoratePlaylist(c *gin.Context, key, rel string) {
+	captured := &capturedResponse{ResponseWriter: c.Writer}
+	c.Writer = captured
+	c.Next()
+	c.Writer = captured.ResponseWriter
+
+	body := captured.body.Bytes()
+	if c.Writer.Status() == http.StatusOK {
+		up := strings.Repeat("../", strings.Count(rel, "/"))
+		query := ""
+		if token := c.Query("token"); token != "" {
+			query = "?token=" + url.QueryEscape(token)
+		}
+		body = hlscrypt.Decorate(body, func(uri string) string {
+			segment := path.Clean(path.Join(path.Dir(rel), uri))
+			generation, index, ok := encryptedSegment(path.Base(segment))
+			if !ok {
+				return ""
+			}
+			return hlscrypt.Tag(up+keyName(generation, hlsKeys.Period(index))+query, hlscrypt.IV(segment))
+		})
+		c.Writer.Header().Del("Content-Length")
+	}
+	if len(body) == 0 {
+		c.Writer.WriteHeaderNow()
+		return
+	}
+	c.Writer.Write(body)
+}
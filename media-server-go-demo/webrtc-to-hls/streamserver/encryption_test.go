@@ -0,0 +1,109 @@
+package streamserver
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/hlscrypt"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/pubauth"
+)
+
+func TestEncryptedOutput(t *testing.T) {
+	savedDir, savedOutputs, savedKeys, savedTokens := hlsDir, outputs, hlsKeys, playbackTokens
+	defer func() { hlsDir, outputs, hlsKeys, playbackTokens = savedDir, savedOutputs, savedKeys, savedTokens }()
+	t.Setenv("hls_encryption_overrides", "premium=aes-128")
+	t.Setenv("hls_key_secret", "keys")
+	t.Setenv("hls_key_rotation_segments", "2")
+
+	playbackTokens = nil
+	if err := setupEncryption(); err == nil {
+		t.Fatal("encryption without playback_secret")
+	}
+	playbackTokens = &pubauth.JWT{Secret: []byte("playback")}
+	if err := setupEncryption(); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEncryption(containerFMP4, false, presets[client.LatencyBalanced], "premium"); err == nil {
+		t.Fatal("fMP4 output encrypted")
+	}
+	if err := checkEncryption(containerFMP4, true, presets[client.LatencyBalanced], "free"); err != nil {
+		t.Fatal(err)
+	}
+
+	hlsDir, outputs = t.TempDir(), newStreamOutputs(time.Now)
+	out := outputs.get("premium")
+	os.MkdirAll(filepath.Join(out.dir, "360p"), 0755)
+	segment := bytes.Repeat([]byte{0x47}, 188*3)
+	names := []string{"segment-7-00002.ts", "segment-7-00003.ts", "360p/segment-7-1-00004.ts"}
+	for _, name := range names {
+		ioutil.WriteFile(filepath.Join(out.dir, filepath.FromSlash(name)), segment, 0644)
+	}
+	ioutil.WriteFile(out.playlist(), []byte("#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:2\n"+
+		"#EXTINF:2.000,\nsegment-7-00002.ts\n#EXTINF:2.000,\nsegment-7-00003.ts\n"), 0644)
+	ioutil.WriteFile(filepath.Join(out.dir, "360p", playlistName), []byte("#EXTM3U\n#EXT-X-TARGETDURATION:2\n"+
+		"#EXTINF:2.000,\nsegment-7-1-00004.ts\n"), 0644)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(authorizePlayback)
+	r.Use(encryptHLS)
+	r.Use(serveMedia)
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+	exp := float64(time.Now().Add(time.Hour).Unix())
+	token, _ := playbackTokens.Sign(pubauth.Claims{Stream: "premium", ExpiresAt: &exp})
+
+	w := get("/hls/premium/playlist.m3u8?token=" + token)
+	playlist := w.Body.String()
+	if w.Code != http.StatusOK || strings.Count(playlist, "#EXT-X-KEY:") != 2 ||
+		!strings.Contains(playlist, hlscrypt.Tag("key-7-1.key?token="+token, hlscrypt.IV("segment-7-00002.ts"))) ||
+		!strings.Contains(playlist, hlscrypt.Tag("key-7-1.key?token="+token, hlscrypt.IV("segment-7-00003.ts"))) {
+		t.Fatalf("playlist %d:\n%s", w.Code, playlist)
+	}
+	if w := get("/hls/premium/360p/playlist.m3u8"); !strings.Contains(w.Body.String(), `URI="../key-7-2.key"`) {
+		t.Fatalf("rung playlist:\n%s", w.Body)
+	}
+
+	// keys are for token holders only, even of a public stream
+	if w := get("/hls/premium/key-7-1.key"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("key without a token = %d", w.Code)
+	}
+	w = get("/hls/premium/key-7-1.key?token=" + token)
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), hlsKeys.Key("premium", 7, 1)) {
+		t.Fatalf("key = %d %x", w.Code, w.Body.Bytes())
+	}
+	for _, name := range names {
+		w := get("/hls/premium/" + name)
+		block, _ := aes.NewCipher(hlsKeys.Key("premium", 7, hlsKeys.Period(map[string]int{names[0]: 2, names[1]: 3, names[2]: 4}[name])))
+		opened := make([]byte, len(w.Body.Bytes()))
+		if w.Code != http.StatusOK || len(opened)%aes.BlockSize != 0 || len(opened) <= len(segment) {
+			t.Fatalf("segment %s = %d, %d bytes", name, w.Code, len(opened))
+		}
+		cipher.NewCBCDecrypter(block, hlscrypt.IV(name)).CryptBlocks(opened, w.Body.Bytes())
+		if !bytes.Equal(opened[:len(segment)], segment) {
+			t.Fatalf("segment %s does not decrypt", name)
+		}
+	}
+
+	// other streams are served as written
+	free := outputs.get("free")
+	os.MkdirAll(free.dir, 0755)
+	ioutil.WriteFile(filepath.Join(free.dir, "segment-7-00002.ts"), segment, 0644)
+	if w := get("/hls/free/segment-7-00002.ts"); !bytes.Equal(w.Body.Bytes(), segment) {
+		t.Fatalf("plain segment altered")
+	}
+}
@@ -0,0 +1,53 @@
+package streamserver
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+func envInt(name string, def int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return value
+}
+
+// envList splits the comma separated setting name, dropping empty items
+func envList(name string) []string {
+	var items []string
+	for _, item := range strings.Split(os.Getenv(name), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// envOverrides returns the per stream key overrides of name, read from
+// <name>_overrides as envForKey does
+func envOverrides(name string) map[string]string {
+	overrides := map[string]string{}
+	for _, override := range strings.Split(os.Getenv(name+"_overrides"), ",") {
+		kv := strings.SplitN(strings.TrimSpace(override), "=", 2)
+		if len(kv) == 2 {
+			if _, ok := overrides[kv[0]]; !ok {
+				overrides[kv[0]] = strings.TrimSpace(kv[1])
+			}
+		}
+	}
+	return overrides
+}
+
+// envForKey returns the per stream key override of name, read from
+// <name>_overrides ("key1=value1,key2=value2"), falling back to name itself
+func envForKey(name string, key string) string {
+	for _, override := range strings.Split(os.Getenv(name+"_overrides"), ",") {
+		kv := strings.SplitN(strings.TrimSpace(override), "=", 2)
+		if len(kv) == 2 && kv[0] == key {
+			return strings.TrimSpace(kv[1])
+		}
+	}
+	return os.Getenv(name)
+}
@@ -0,0 +1,14 @@
+package streamserver
+
+import (
+	"os"
+	"testing"
+)
+
+// unsetenv unsets name for the rest of the test, restoring it after as
+// t.Setenv does; for the settings a test leaves unset, or that the code
+// under test sets
+func unsetenv(t testing.TB, name string) {
+	t.Setenv(name, "")
+	os.Unsetenv(name)
+}
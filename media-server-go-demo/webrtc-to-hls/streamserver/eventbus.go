@@ -0,0 +1,118 @@
+package streamserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/analytics"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/eventbus"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/metrics"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/webhook"
+)
+
+// eventBusJobs is the job class publishing events to the event bus
+const eventBusJobs = "eventbus"
+
+var eventBusMessages = metrics.NewCounter("eventbus_messages_total",
+	"Events handed to the event bus, by topic", "topic")
+
+// eventBus publishes the lifecycle and the viewer events, nil without
+// event_bus
+var eventBus eventbus.Bus
+
+// eventBusKind is the kind of eventBus, kafka or nats
+var eventBusKind string
+
+// lifecycleTopic and viewerTopic are where the lifecycle and the viewer
+// events go, see setupEventBus
+var lifecycleTopic, viewerTopic string
+
+// setupEventBus reads the bus the lifecycle events posted to webhooks and
+// the viewer events of analytics are also published to, from event_bus:
+// empty for none, kafka for the Kafka REST proxy at event_bus_url, nats for
+// the NATS server at event_bus_url. Lifecycle events go to the topic
+// event_bus_topic (stream-events), viewer events to
+// event_bus_viewer_topic (viewer-events); NATS subjects end with the type
+// of the event, e.g. stream-events.stream.started. event_bus_timeout (10)
+// seconds bound a publish.
+func setupEventBus() error {
+	kind := os.Getenv("event_bus")
+	if kind == "" {
+		return nil
+	}
+	url := os.Getenv("event_bus_url")
+	if url == "" {
+		return fmt.Errorf("event bus: event_bus_url required")
+	}
+	bus, err := eventbus.Open(kind, url, time.Duration(envInt("event_bus_timeout", 10))*time.Second)
+	if err != nil {
+		return err
+	}
+	lifecycleTopic, viewerTopic = "stream-events", "viewer-events"
+	if topic := os.Getenv("event_bus_topic"); topic != "" {
+		lifecycleTopic = topic
+	}
+	if topic := os.Getenv("event_bus_viewer_topic"); topic != "" {
+		viewerTopic = topic
+	}
+	eventBus, eventBusKind = bus, kind
+	logger.Info("publishing events", "bus", bus.Name(), "topic", lifecycleTopic, "viewerTopic", viewerTopic)
+	return nil
+}
+
+// busSubject is the subject of an event of kind in topic: the topic on
+// Kafka, the topic and the kind on NATS
+func busSubject(topic, kind string) string {
+	if eventBusKind == "nats" {
+		return topic + "." + kind
+	}
+	return topic
+}
+
+// publishLifecycle queues the publishing of a lifecycle event to the event
+// bus, if any. Like deliveries, publishes are retried, the event keeping
+// its id.
+func publishLifecycle(event webhook.Event) {
+	if eventBus == nil {
+		return
+	}
+	value, err := json.Marshal(event)
+	if err != nil {
+		logger.Warn("event bus: encoding event", "type", event.Type, "error", err)
+		return
+	}
+	publishMessages(event.Type, []eventbus.Message{{Subject: busSubject(lifecycleTopic, event.Type), Key: event.Stream, Value: value}})
+}
+
+// publishViewerEvents queues the publishing of viewer events to the event
+// bus, if any
+func publishViewerEvents(events []analytics.Event) {
+	if eventBus == nil || len(events) == 0 {
+		return
+	}
+	messages := make([]eventbus.Message, 0, len(events))
+	for _, e := range events {
+		value, err := json.Marshal(e)
+		if err != nil {
+			continue
+		}
+		messages = append(messages, eventbus.Message{Subject: busSubject(viewerTopic, e.Type), Key: e.Stream, Value: value})
+	}
+	publishMessages(fmt.Sprintf("%d viewer events", len(messages)), messages)
+}
+
+func publishMessages(what string, messages []eventbus.Message) {
+	bus := eventBus
+	background.Submit(eventBusJobs, what, func(ctx context.Context) error {
+		if err := bus.Publish(ctx, messages); err != nil {
+			return err
+		}
+		for _, m := range messages {
+			eventBusMessages.Inc(m.Subject)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,65 @@
+package streamserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/analytics"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/eventbus"
+)
+
+func TestEventBus(t *testing.T) {
+	defer func(bus eventbus.Bus, kind string) { eventBus, eventBusKind = bus, kind }(eventBus, eventBusKind)
+	produced := make(chan string, 8)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Records []struct {
+				Key   string
+				Value struct{ Type string }
+			}
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		for _, record := range body.Records {
+			produced <- strings.TrimPrefix(r.URL.Path, "/topics/") + " " + record.Key + " " + record.Value.Type
+		}
+	}))
+	defer server.Close()
+	t.Setenv("event_bus", "kafka")
+	if setupEventBus() == nil {
+		t.Fatal("event bus without a url")
+	}
+	t.Setenv("event_bus_url", server.URL)
+	t.Setenv("event_bus_viewer_topic", "viewers")
+	if err := setupEventBus(); err != nil {
+		t.Fatal(err)
+	}
+	background = newJobQueue()
+	defer background.Close()
+
+	next := func() string {
+		select {
+		case record := <-produced:
+			return record
+		case <-time.After(5 * time.Second):
+			t.Fatal("nothing produced")
+		}
+		return ""
+	}
+	notifyHooks(hookRetentionPruned, "main", map[string]interface{}{"files": 2})
+	if record := next(); record != "stream-events main retention.pruned" {
+		t.Fatalf("lifecycle record = %s", record)
+	}
+	sendAnalytics([]analytics.Event{{Type: analytics.Join, Stream: "main", Protocol: protocolHLS}})
+	if record := next(); record != "viewers main join" {
+		t.Fatalf("viewer record = %s", record)
+	}
+
+	eventBusKind = "nats"
+	if subject := busSubject(lifecycleTopic, hookStreamStarted); subject != "stream-events.stream.started" {
+		t.Fatalf("nats subject = %s", subject)
+	}
+}
@@ -0,0 +1,93 @@
+package streamserver
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	mediaserver "github.com/notedit/media-server-go"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+)
+
+// pushEvent tells the publisher how its publish is doing, see the
+// client.Event* names; publishers without signaling connection get none
+func (s *session) pushEvent(msg client.Message) {
+	msg.Cmd = client.CmdEvent
+	s.send(msg)
+}
+
+// playbackURL is where players load the output of s: playback_base_url,
+// e.g. https://live.example, or else the address its publish came in on,
+// followed by its playlist path
+func playbackURL(s *session) string {
+	base := os.Getenv("playback_base_url")
+	if base == "" {
+		base = s.baseURL
+	}
+	return strings.TrimRight(base, "/") + playlistPath(s)
+}
+
+// states of the ICE connection of a publisher, see iceWatch
+const (
+	iceChecking     = "checking"
+	iceConnected    = "connected"
+	iceDisconnected = "disconnected"
+)
+
+// iceWatch follows the ICE state of a transport from its connectivity
+// checks: connected once the publisher's checks are answered, disconnected
+// when they stop for timeout; the publisher keeps checking while connected
+type iceWatch struct {
+	timeout  time.Duration
+	state    string
+	requests int64
+	lastSeen time.Time
+}
+
+// next returns the state for stats polled at now, and whether it changed
+func (w *iceWatch) next(stats mediaserver.ICEStats, now time.Time) (string, bool) {
+	if w.state == "" {
+		w.state, w.lastSeen = iceChecking, now
+		return w.state, true
+	}
+	state := w.state
+	if stats.RequestsReceived > w.requests {
+		w.requests, w.lastSeen = stats.RequestsReceived, now
+		if stats.ResponsesSent > 0 {
+			state = iceConnected
+		}
+	} else if w.state == iceConnected && now.Sub(w.lastSeen) >= w.timeout {
+		state = iceDisconnected
+	}
+	if state == w.state {
+		return state, false
+	}
+	w.state = state
+	return state, true
+}
+
+// watchICE pushes the ICE state of transport to the publisher until the
+// session closes or replaces it. ice_disconnect_timeout (10) is how many
+// seconds without checks make the connection disconnected.
+func (s *session) watchICE(transport *mediaserver.Transport) {
+	w := &iceWatch{timeout: time.Duration(envInt("ice_disconnect_timeout", 10)) * time.Second}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		if state, changed := w.next(transport.GetICEStats(), time.Now()); changed {
+			s.pushEvent(client.Message{Event: client.EventICEState, State: state})
+		}
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		s.Lock()
+		replaced := s.transport != transport
+		s.Unlock()
+		if replaced {
+			// by an ICE restart, see restartICE
+			return
+		}
+	}
+}
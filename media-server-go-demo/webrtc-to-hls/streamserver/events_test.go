@@ -0,0 +1,96 @@
+package streamserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	mediaserver "github.com/notedit/media-server-go"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+)
+
+func TestICEWatch(t *testing.T) {
+	now := time.Unix(1000, 0)
+	w := &iceWatch{timeout: 10 * time.Second}
+	for i, step := range []struct {
+		stats   mediaserver.ICEStats
+		after   time.Duration
+		state   string
+		changed bool
+	}{
+		{mediaserver.ICEStats{}, 0, iceChecking, true},
+		{mediaserver.ICEStats{RequestsReceived: 1}, time.Second, iceChecking, false},
+		{mediaserver.ICEStats{RequestsReceived: 2, ResponsesSent: 2}, time.Second, iceConnected, true},
+		{mediaserver.ICEStats{RequestsReceived: 2, ResponsesSent: 2}, 9 * time.Second, iceConnected, false},
+		{mediaserver.ICEStats{RequestsReceived: 2, ResponsesSent: 2}, time.Second, iceDisconnected, true},
+		{mediaserver.ICEStats{RequestsReceived: 3, ResponsesSent: 3}, time.Second, iceConnected, true},
+	} {
+		now = now.Add(step.after)
+		if state, changed := w.next(step.stats, now); state != step.state || changed != step.changed {
+			t.Fatalf("step %d: %s %v", i, state, changed)
+		}
+	}
+}
+
+func TestPlaylistReadyEvent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	saved := hlsDir
+	defer func() { hlsDir = saved }()
+	hlsDir = dir
+	t.Setenv("playback_base_url", "https://live.example/")
+
+	events := make(chan client.Message, 1)
+	// the handler ends the session, which reads hlsDir, after done
+	finished := make(chan struct{})
+	defer func() {
+		select {
+		case <-finished:
+		case <-time.After(5 * time.Second):
+			t.Error("handler still running")
+		}
+	}()
+	ws, done := dialSignaling(t, func(c *gin.Context) {
+		defer close(finished)
+		ws, err := upGrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		sess := newSession("ready", newSignaling(ws), presets[client.LatencyBalanced])
+		sess.Lock()
+		sess.generation = 7
+		sess.Unlock()
+		go sess.watchSegments()
+		defer sess.end()
+		var msg client.Message
+		ws.ReadJSON(&msg)
+	})
+	defer done()
+	go func() {
+		var msg client.Message
+		if err := ws.ReadJSON(&msg); err == nil {
+			events <- msg
+		}
+	}()
+	if err := os.MkdirAll(outputDir("ready"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(outputDir("ready"), segmentPrefix(7)+"0.ts"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-events:
+		if msg.Cmd != client.CmdEvent || msg.Event != client.EventPlaylistReady || msg.URL != "https://live.example/hls/ready/"+playlistName {
+			t.Fatalf("event = %+v", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no playlist-ready event")
+	}
+}
@@ -0,0 +1,198 @@
+package streamserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/external"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/ident"
+)
+
+var externalStreams = external.NewRegistry()
+
+// externalHooks are the lifecycle events posted as an external stream
+// enters a state
+var externalHooks = map[external.State]string{
+	external.StateLive:    hookExternalLive,
+	external.StateOffline: hookExternalOffline,
+	external.StateEnded:   hookExternalEnded,
+}
+
+type externalStreamRequest struct {
+	ID string `json:"id"`
+	external.Source
+}
+
+func randomID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// externalDir resolves a registered directory below external_root; local
+// sources are refused when it is not set
+func externalDir(dir string) (string, error) {
+	root := os.Getenv("external_root")
+	if root == "" {
+		return "", fmt.Errorf("local external streams need external_root")
+	}
+	full := filepath.Join(root, filepath.Clean("/"+dir))
+	if full != filepath.Clean(root) && !strings.HasPrefix(full, filepath.Clean(root)+string(filepath.Separator)) {
+		return "", fmt.Errorf("dir %q outside external_root", dir)
+	}
+	return full, nil
+}
+
+// externalURL checks the playlist url of a remote source, which the server
+// fetches, see externalAllowed
+func externalURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("playlist url %q is not http or https", raw)
+	}
+	return externalAllowed(u)
+}
+
+// externalAllowed checks a url a remote source is fetched from, its
+// playlist, its segments or a redirect: http or https, on a host of
+// external_hosts, comma separated, e.g. cdn.example.com, a leading dot
+// allowing the subdomains of a domain, .example.com. Remote sources are
+// refused when it is not set.
+func externalAllowed(u *url.URL) error {
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return fmt.Errorf("url %q is not http or https", u)
+	}
+	hosts := envList("external_hosts")
+	if len(hosts) == 0 {
+		return fmt.Errorf("remote external streams need external_hosts")
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range hosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || (strings.HasPrefix(allowed, ".") && strings.HasSuffix(host, allowed)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("host %q not in external_hosts", host)
+}
+
+// notifyExternal posts the lifecycle event of the state an external
+// stream entered
+func notifyExternal(e external.Event) {
+	logger.Info("external stream "+string(e.State), "external", e.ID, "reason", e.Reason)
+	if kind, ok := externalHooks[e.State]; ok {
+		notifyHooks(kind, e.ID, map[string]interface{}{
+			"external": e.ID, "reason": e.Reason, "playlist": "/hls/" + e.ID + "/playlist.m3u8",
+		})
+	}
+}
+
+// createExternalStream handles POST /api/external-streams
+func createExternalStream(c *gin.Context) {
+	admin, ok := adminIdentity(c)
+	if !ok {
+		return
+	}
+	var req externalStreamRequest
+	if err := c.BindJSON(&req); err != nil {
+		return
+	}
+	if req.ID == "" {
+		req.ID = randomID()
+	}
+	if req.URL != "" {
+		if err := externalURL(req.URL); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if req.Dir != "" {
+		dir, err := externalDir(req.Dir)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		req.Dir = dir
+	}
+	staleAfter := time.Duration(envInt("external_stale_after", 30)) * time.Second
+	stream, err := external.NewStream(req.ID, req.Source, staleAfter, notifyExternal)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.URL != "" {
+		// the playlist may send the server anywhere, its segments and
+		// their redirects are held to external_hosts too
+		stream.Allow(externalAllowed)
+		stream.PublicOnly()
+	}
+	interval := time.Duration(envInt("external_poll_interval", 2)) * time.Second
+	if err := externalStreams.Add(stream, interval); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Info("external stream created", "external", stream.ID, "admin", admin)
+	c.JSON(http.StatusCreated, gin.H{
+		"id":       stream.ID,
+		"playlist": "/hls/" + stream.ID + "/playlist.m3u8",
+	})
+}
+
+// deleteExternalStream handles DELETE /api/external-streams/:id
+func deleteExternalStream(c *gin.Context) {
+	admin, ok := adminIdentity(c)
+	if !ok {
+		return
+	}
+	id, ok := identParam(c, "id", ident.PlaybackID)
+	if !ok {
+		return
+	}
+	if !externalStreams.Remove(id) {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	logger.Info("external stream deleted", "external", id, "admin", admin)
+	c.Status(http.StatusNoContent)
+}
+
+// serveExternalStream handles GET /hls/:id/*file, for external, live and
+// scheduled streams
+func serveExternalStream(c *gin.Context) {
+	id, ok := identParam(c, "id", ident.PlaybackID)
+	if !ok {
+		return
+	}
+	// one file below the stream, nothing deeper
+	name := strings.TrimPrefix(c.Param("file"), "/")
+	if err := ident.Check(ident.FileName, name); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	stream := externalStreams.Get(id)
+	if stream == nil {
+		if !serveLiveStream(c, id, name) && !serveScheduledStream(c, id, name) {
+			c.Status(http.StatusNotFound)
+		}
+		return
+	}
+	if name == "playlist.m3u8" {
+		playlist, err := stream.Playlist()
+		if err != nil {
+			c.String(http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		c.Header("Cache-Control", "no-cache")
+		c.Data(http.StatusOK, "application/vnd.apple.mpegurl", playlist)
+		return
+	}
+	stream.ServeSegment(c.Writer, c.Request, name)
+}
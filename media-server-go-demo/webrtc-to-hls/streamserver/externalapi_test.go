@@ -0,0 +1,121 @@
+package streamserver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/external"
+)
+
+func TestExternalURL(t *testing.T) {
+	if err := externalURL("https://cdn.example.com/live/index.m3u8"); err == nil {
+		t.Fatal("remote source accepted without external_hosts")
+	}
+	t.Setenv("external_hosts", "cdn.example.com, .example.net")
+	for _, good := range []string{
+		"https://cdn.example.com/live/index.m3u8",
+		"http://CDN.example.com:8080/live/index.m3u8",
+		"https://edge.eu.example.net/index.m3u8",
+	} {
+		if err := externalURL(good); err != nil {
+			t.Errorf("%s: %v", good, err)
+		}
+	}
+	for _, bad := range []string{
+		"file:///etc/passwd",
+		"gopher://cdn.example.com/index.m3u8",
+		"http://169.254.169.254/latest/meta-data",
+		"https://cdn.example.com.evil.test/index.m3u8",
+		"https://example.net/index.m3u8",
+		"/live/index.m3u8",
+	} {
+		if err := externalURL(bad); err == nil {
+			t.Errorf("%s accepted", bad)
+		}
+	}
+}
+
+func TestExternalAllowed(t *testing.T) {
+	t.Setenv("external_hosts", "cdn.example.com")
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("#EXTM3U\n#EXTINF:2,\nhttp://169.254.169.254/latest/meta-data\n"))
+	}))
+	defer up.Close()
+	stream, err := external.NewStream("ext", external.Source{URL: up.URL + "/index.m3u8"}, time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Allow(externalAllowed)
+	if err := stream.Refresh(context.Background(), time.Now()); err == nil || !strings.Contains(err.Error(), "not in external_hosts") {
+		t.Fatalf("playlist off external_hosts = %v", err)
+	}
+	stream.Allow(func(u *url.URL) error {
+		if u.Host == strings.TrimPrefix(up.URL, "http://") {
+			return nil
+		}
+		return externalAllowed(u)
+	})
+	if err := stream.Refresh(context.Background(), time.Now()); err == nil || !strings.Contains(err.Error(), "169.254.169.254") {
+		t.Fatalf("segment off external_hosts = %v", err)
+	}
+}
+
+func TestExternalStreamAPI(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/api/external-streams", createExternalStream)
+	r.DELETE("/api/external-streams/:id", deleteExternalStream)
+	do := func(method, path, body, admin string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if admin != "" {
+			asAdmin(req, admin)
+		}
+		r.ServeHTTP(w, req)
+		return w
+	}
+	create := `{"id":"ext","url":"http://127.0.0.1:8080/index.m3u8"}`
+	if w := do("POST", "/api/external-streams", create, ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("create without an admin = %d", w.Code)
+	}
+	if w := do("DELETE", "/api/external-streams/ext", "", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("delete without an admin = %d", w.Code)
+	}
+	if w := do("POST", "/api/external-streams", create, "ops@example.com"); w.Code != http.StatusBadRequest {
+		t.Fatalf("create of a host not allowed = %d", w.Code)
+	}
+	if w := do("DELETE", "/api/external-streams/ext", "", "ops@example.com"); w.Code != http.StatusNotFound {
+		t.Fatalf("delete of an unknown stream = %d", w.Code)
+	}
+}
+
+func TestExternalLifecycleEvents(t *testing.T) {
+	events, cancel := controlEvents.Subscribe(8)
+	defer cancel()
+	notifyExternal(external.Event{ID: "ext", State: external.StateLive, Reason: "upstream playlist updated"})
+	notifyExternal(external.Event{ID: "ext", State: external.StateEnded, Reason: "upstream playlist ended"})
+	var types []string
+	for len(types) < 2 {
+		select {
+		case event := <-events:
+			if event.Data["external"] != "ext" {
+				continue
+			}
+			if event.Stream != "ext" || event.Data["playlist"] != "/hls/ext/playlist.m3u8" {
+				t.Fatalf("event = %+v", event)
+			}
+			types = append(types, event.Type)
+		case <-time.After(time.Second):
+			t.Fatalf("lifecycle events = %v", types)
+		}
+	}
+	if strings.Join(types, " ") != hookExternalLive+" "+hookExternalEnded {
+		t.Fatalf("lifecycle events = %v", types)
+	}
+}
@@ -0,0 +1,112 @@
+package streamserver
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/ident"
+)
+
+// externalIDConflict rejects a publish whose external id is live under
+// another stream key
+type externalIDConflict struct {
+	externalID string
+	session    string
+}
+
+func (e *externalIDConflict) Error() string {
+	return fmt.Sprintf("external id %s is live as session %s", e.externalID, e.session)
+}
+
+// outputPath is where the playlist of the output of key is served
+func outputPath(key string) string {
+	return "/hls/" + key + "/" + playlistName
+}
+
+// playlistPath is where players find the playlist of s: under the stream
+// key, or the external id with playlist_id set to "external", falling back
+// to the key. Audio-only sessions have none.
+func playlistPath(s *session) string {
+	if s.kind == client.KindAudioOnly {
+		return ""
+	}
+	if os.Getenv("playlist_id") == "external" && s.externalID != "" {
+		return "/hls/" + s.externalID + "/" + playlistName
+	}
+	return outputPath(s.key)
+}
+
+// serveLiveStream answers the playlist of a live session under /hls/<id>/,
+// id being its external or session id, with the output of its stream key
+func serveLiveStream(c *gin.Context, id, name string) bool {
+	sess := registry.find(id)
+	if name != playlistName || sess == nil || sess.key == id {
+		return false
+	}
+	c.Header("Cache-Control", "no-cache")
+	c.Redirect(http.StatusFound, outputPath(sess.key))
+	return true
+}
+
+// streamIDs describes the ids of a live session, with the LL-HLS playlist,
+// the DASH manifest and the master playlist when it has them
+func streamIDs(s *session) gin.H {
+	ids := gin.H{
+		"id":         s.id,
+		"externalId": s.externalID,
+		"stream":     s.key,
+		"kind":       s.kind,
+		"playlist":   playlistPath(s),
+	}
+	if lowLatency(s.preset, s.key) {
+		ids["lowLatencyPlaylist"] = "/hls/" + s.key + "/" + lowLatencyName
+	}
+	if s.dash || s.container == containerFMP4 {
+		ids["dash"] = dashPath(s.key)
+	}
+	if len(s.ladder) > 0 || s.captionLanguage != "" || s.audioRendition || len(s.packagedAudio) > 0 {
+		ids["master"] = masterPath(s.key)
+	}
+	if s.captionLanguage != "" {
+		ids["captions"] = captionsPath(s.key)
+	}
+	return ids
+}
+
+// streamByExternal handles GET /api/streams/by-external/:id
+func streamByExternal(c *gin.Context, id string) {
+	sess := registry.byExternal(id)
+	if sess == nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	c.JSON(http.StatusOK, streamIDs(sess))
+}
+
+// streamDetail routes GET /api/streams/:id/:detail. The router cannot have
+// the static /api/streams/by-external/ next to the :id wildcard, so the
+// lookup by external id is dispatched from here too.
+func streamDetail(c *gin.Context) {
+	if c.Param("id") == "by-external" {
+		if id, ok := identParam(c, "detail", ident.ExternalID); ok {
+			streamByExternal(c, id)
+		}
+		return
+	}
+	if _, ok := identParam(c, "id", ident.StreamKey); !ok {
+		return
+	}
+	switch c.Param("detail") {
+	case "stats":
+		streamStats(c)
+	case "timeline":
+		streamTimeline(c)
+	case "support-bundle":
+		requestSupportBundle(c)
+	default:
+		c.Status(http.StatusNotFound)
+	}
+}
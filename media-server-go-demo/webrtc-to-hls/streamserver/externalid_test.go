@@ -0,0 +1,85 @@
+package streamserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+)
+
+func TestExternalIDConflict(t *testing.T) {
+	r := newSessionRegistry()
+	first := newSession("main", nil, client.Preset{})
+	first.externalID = "cms-42"
+	if _, err := r.claim(first, conflictReject); err != nil {
+		t.Fatal(err)
+	}
+
+	other := newSession("backup", nil, client.Preset{})
+	other.externalID = "cms-42"
+	_, err := r.claim(other, conflictTakeover)
+	conflict, ok := err.(*externalIDConflict)
+	if !ok || conflict.session != first.id {
+		t.Fatalf("claim err = %v, want conflict with %s", err, first.id)
+	}
+	if r.get("backup") != nil {
+		t.Fatal("conflicting session registered")
+	}
+
+	for _, id := range []string{"main", "cms-42", first.id} {
+		if r.find(id) != first {
+			t.Fatalf("find(%q) did not return the session", id)
+		}
+	}
+
+	// the external id is free again once its session ended
+	r.release(first)
+	if r.byExternal("cms-42") != nil {
+		t.Fatal("external id kept after release")
+	}
+	if _, err := r.claim(other, conflictReject); err != nil {
+		t.Fatal(err)
+	}
+	if r.byExternal("cms-42") != other {
+		t.Fatal("external id not reassigned")
+	}
+}
+
+func TestStreamByExternal(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	sess := newSession("by-external-test", nil, client.Preset{})
+	sess.externalID = "cms-7"
+	if _, err := registry.claim(sess, conflictReject); err != nil {
+		t.Fatal(err)
+	}
+	defer registry.release(sess)
+
+	r := gin.New()
+	r.GET("/api/streams/:id/:detail", streamDetail)
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	w := get("/api/streams/by-external/cms-7")
+	if w.Code != http.StatusOK {
+		t.Fatalf("lookup = %d", w.Code)
+	}
+	var ids map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &ids); err != nil {
+		t.Fatal(err)
+	}
+	if ids["id"] != sess.id || ids["stream"] != "by-external-test" || ids["externalId"] != "cms-7" {
+		t.Fatalf("ids = %v", ids)
+	}
+	if w := get("/api/streams/by-external/unknown"); w.Code != http.StatusNotFound {
+		t.Fatalf("unknown = %d", w.Code)
+	}
+	if w := get("/api/streams/" + sess.id + "/timeline"); w.Code != http.StatusOK {
+		t.Fatalf("timeline by session id = %d", w.Code)
+	}
+}
@@ -0,0 +1,111 @@
+package streamserver
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	mediaserver "github.com/notedit/media-server-go"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/metrics"
+	"github.com/notedit/sdp"
+)
+
+var (
+	extensionNegotiated = metrics.NewCounter("extension_negotiated_sessions_total",
+		"Sessions that negotiated a video header extension", "uri")
+	extensionUsed = metrics.NewCounter("extension_used_sessions_total",
+		"Sessions whose sampled video packets carried a negotiated header extension", "uri")
+)
+
+// ExtensionUsage is which of the negotiated video header extensions a
+// publisher actually sends, judged on the first packets of the session
+type ExtensionUsage struct {
+	Packets uint `json:"packets"`
+	// Used counts the sampled packets carrying each extension
+	Used map[string]uint `json:"used"`
+	// Unused lists negotiated extensions no sampled packet carried
+	Unused []string `json:"unused"`
+	// Unparsed lists negotiated extensions the receiver does not parse, so
+	// their usage is unknown
+	Unparsed []string `json:"unparsed"`
+}
+
+func newExtensionUsage(negotiated []string, packets uint, counts map[string]uint) *ExtensionUsage {
+	usage := &ExtensionUsage{Packets: packets, Used: map[string]uint{}}
+	for _, uri := range negotiated {
+		count, parsed := counts[uri]
+		switch {
+		case !parsed:
+			usage.Unparsed = append(usage.Unparsed, uri)
+		case count == 0:
+			usage.Unused = append(usage.Unused, uri)
+		default:
+			usage.Used[uri] = count
+		}
+	}
+	return usage
+}
+
+// negotiatedExtensions returns the uris of the extensions answered for media
+func negotiatedExtensions(media *sdp.MediaInfo) []string {
+	if media == nil {
+		return nil
+	}
+	var uris []string
+	for _, uri := range media.GetExtensions() {
+		uris = append(uris, uri)
+	}
+	sort.Strings(uris)
+	return uris
+}
+
+// watchExtensions samples which negotiated extensions the publisher sends
+// in its first extension_usage_packets packets (0 disables it), records them
+// on the session and the counters, and logs which ones could be pruned from
+// Capabilities
+func (s *session) watchExtensions(track *mediaserver.IncomingStreamTrack, negotiated []string) {
+	threshold := uint(envInt("extension_usage_packets", 300))
+	if threshold == 0 || len(negotiated) == 0 {
+		return
+	}
+	// the receiver counts the extensions of the sampled packets only
+	track.SampleExtensions(threshold)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		packets, counts := track.GetExtensionUsage(negotiated)
+		if packets < threshold {
+			continue
+		}
+		usage := newExtensionUsage(negotiated, packets, counts)
+		s.Lock()
+		s.extensions = usage
+		s.Unlock()
+
+		for _, uri := range negotiated {
+			extensionNegotiated.Inc(uri)
+		}
+		for uri := range usage.Used {
+			extensionUsed.Inc(uri)
+		}
+		if len(usage.Unused) > 0 {
+			s.logf("header extensions negotiated but not sent, consider pruning: %s", strings.Join(usage.Unused, ", "))
+		}
+		if len(usage.Unparsed) > 0 {
+			s.logf("header extensions negotiated but not parsed: %s", strings.Join(usage.Unparsed, ", "))
+		}
+		return
+	}
+}
+
+// extensionUsage returns the sampled usage, once watchExtensions took it
+func (s *session) extensionUsage() *ExtensionUsage {
+	s.Lock()
+	defer s.Unlock()
+	return s.extensions
+}
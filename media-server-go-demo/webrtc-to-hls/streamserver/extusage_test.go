@@ -0,0 +1,30 @@
+package streamserver
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExtensionUsage(t *testing.T) {
+	negotiated := []string{
+		"http://www.webrtc.org/experiments/rtp-hdrext/abs-send-time",
+		"urn:3gpp:video-orientation",
+		"urn:ietf:params:rtp-hdrext:sdes:mid",
+		"urn:ietf:params:rtp-hdrext:toffse",
+	}
+	counts := map[string]uint{
+		"http://www.webrtc.org/experiments/rtp-hdrext/abs-send-time": 300,
+		"urn:3gpp:video-orientation":                                 0,
+		"urn:ietf:params:rtp-hdrext:sdes:mid":                        12,
+	}
+	usage := newExtensionUsage(negotiated, 300, counts)
+	if want := []string{"urn:3gpp:video-orientation"}; !reflect.DeepEqual(usage.Unused, want) {
+		t.Fatalf("unused = %v", usage.Unused)
+	}
+	if want := []string{"urn:ietf:params:rtp-hdrext:toffse"}; !reflect.DeepEqual(usage.Unparsed, want) {
+		t.Fatalf("unparsed = %v", usage.Unparsed)
+	}
+	if len(usage.Used) != 2 || usage.Used["urn:ietf:params:rtp-hdrext:sdes:mid"] != 12 {
+		t.Fatalf("used = %v", usage.Used)
+	}
+}
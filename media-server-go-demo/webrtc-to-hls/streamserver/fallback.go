@@ -0,0 +1,291 @@
+package streamserver
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	gstreamer "github.com/notedit/gstreamer-go"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/metrics"
+)
+
+var fallbacksShown = metrics.NewCounter("fallback_slates_shown_total",
+	"Times outputs switched to their fallback slate, their publisher gone, by stream", "stream")
+
+// fallbackImage shows a still image: decoded once, then repeated as a live
+// source
+const fallbackImage = "filesrc location=%s ! decodebin ! imagefreeze is-live=true"
+
+// fallbackClip plays the video of an MP4, looped by starting it over
+const fallbackClip = "filesrc location=%s ! qtdemux ! queue ! decodebin"
+
+// fallbackVideo scales the slate to the size of the output and encodes it
+// as the H.264 the output is fed, at the pace it is played
+const fallbackVideo = " ! videoconvert ! videoscale ! video/x-raw,width=%d,height=%d%s ! video/x-h264,stream-format=byte-stream,alignment=au ! appsink name=fallbackvideo sync=true"
+
+// fallbackAudio is silence, encoded as the audio the output is fed
+const fallbackAudio = " audiotestsrc wave=silence is-live=true ! audio/x-raw,rate=48000,channels=2 ! audioconvert ! %s ! appsink name=fallbackaudio sync=false"
+
+// fallback stands in for the publisher of a session while it is gone,
+// mid-broadcast, feeding the output a slate so the playlist goes on. Its
+// methods are called with the session lock held.
+type fallback struct {
+	// source is the image or MP4 shown
+	source string
+	clip   bool
+	width  int
+	height int
+	// after is how long the publisher may send nothing before the slate
+	// shows
+	after time.Duration
+
+	lastReal time.Time
+	showing  bool
+	// player plays the slate while it shows, nil while it starts or
+	// starts over
+	player *fallbackPlayer
+}
+
+// fallbackFor returns the fallback of key, from fallback_slate /
+// fallback_slate_overrides, the path of a PNG or JPEG image or of an MP4
+// shown fallback_slate_after (2) seconds after the publisher went silent,
+// scaled to fallback_slate_size (1280x720); nil without, or when the path
+// is not one
+func fallbackFor(key string) *fallback {
+	source := strings.TrimSpace(envForKey("fallback_slate", key))
+	if source == "" || source == "off" {
+		return nil
+	}
+	f, err := parseFallback(source, envForKey("fallback_slate_size", key), envInt("fallback_slate_after", 2))
+	if err != nil {
+		logger.Warn("no fallback slate", "stream", key, "error", err)
+		return nil
+	}
+	return f
+}
+
+func parseFallback(source, size string, after int) (*fallback, error) {
+	if strings.ContainsAny(source, " !\"'") {
+		return nil, fmt.Errorf("fallback_slate: %q does not fit in a pipeline", source)
+	}
+	f := &fallback{source: source, width: 1280, height: 720, after: time.Duration(after) * time.Second}
+	switch strings.ToLower(filepath.Ext(source)) {
+	case ".png", ".jpg", ".jpeg":
+	case ".mp4":
+		f.clip = true
+	default:
+		return nil, fmt.Errorf("fallback_slate: %q is not a png, jpeg or mp4", source)
+	}
+	if size = strings.TrimSpace(size); size != "" {
+		wh := strings.SplitN(size, "x", 2)
+		if len(wh) != 2 {
+			return nil, fmt.Errorf("fallback_slate_size: %q is not WxH", size)
+		}
+		width, werr := strconv.Atoi(wh[0])
+		height, herr := strconv.Atoi(wh[1])
+		if werr != nil || herr != nil || width <= 0 || height <= 0 || width%2 != 0 || height%2 != 0 {
+			return nil, fmt.Errorf("fallback_slate_size: %q is not an even WxH", size)
+		}
+		f.width, f.height = width, height
+	}
+	if f.after <= 0 {
+		return nil, fmt.Errorf("fallback_slate_after: must be positive")
+	}
+	return f, nil
+}
+
+// real records a published frame and reports whether it may be pushed:
+// while the slate shows, the publisher is back on its next keyframe, the
+// player of the slate returned to be stopped
+func (f *fallback) real(keyframe bool, now time.Time) (bool, *fallbackPlayer) {
+	f.lastReal = now
+	if !f.showing {
+		return true, nil
+	}
+	if !keyframe {
+		return false, nil
+	}
+	player := f.player
+	f.showing, f.player = false, nil
+	return true, player
+}
+
+// due reports whether a player of the slate is to start now: the publisher
+// silent for longer than after, or the slate ended, an MP4 to loop
+func (f *fallback) due(now time.Time) bool {
+	if f.showing {
+		return f.player == nil
+	}
+	return !f.lastReal.IsZero() && now.Sub(f.lastReal) >= f.after
+}
+
+// pipelineFor is the launch description of the slate, its silence encoded
+// as Opus, or AAC as caps, the caps of the audio of the output, for an
+// output with audio
+func (f *fallback) pipelineFor(audio bool, caps string, s *session) string {
+	decode := fallbackImage
+	if f.clip {
+		decode = fallbackClip
+	}
+	description := fmt.Sprintf(decode, f.source) + fmt.Sprintf(fallbackVideo, f.width, f.height, transcodeEncoding(s.preset, s.key))
+	if !audio {
+		return description
+	}
+	switch {
+	case caps == "":
+		return description + fmt.Sprintf(fallbackAudio, "opusenc")
+	case strings.Contains(caps, "stream-format=adts"):
+		return description + fmt.Sprintf(fallbackAudio, "avenc_aac ! aacparse ! audio/mpeg,stream-format=adts")
+	default:
+		// the AAC of RTMP publishers, at 48kHz stereo as most send it
+		return description + fmt.Sprintf(fallbackAudio, "avenc_aac ! aacparse ! audio/mpeg,stream-format=raw")
+	}
+}
+
+// runFallback shows the slate of the session whenever its publisher goes
+// silent mid-broadcast, for as long as the session stays open: the drop
+// of its connection is bounded by reconnect_grace, and silence by
+// publish_idle_timeout. Only H.264 outputs fed the publisher's H.264 show
+// one.
+func (s *session) runFallback() {
+	s.Lock()
+	f := s.fallback
+	eligible := s.inputCodec() == codecH264 && s.composite == nil
+	s.Unlock()
+	if f == nil || !eligible {
+		return
+	}
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		s.Lock()
+		due := s.hls != nil && s.fallback == f && f.due(time.Now())
+		shown := due && !f.showing
+		if due {
+			f.showing = true
+		}
+		audio, caps := s.audio, s.aacCaps
+		s.Unlock()
+		if !due {
+			continue
+		}
+		if shown {
+			fallbacksShown.Inc(s.key)
+			s.timeline.add(eventMedia, "publisher gone, showing the fallback slate")
+			s.logf("no media for %s, showing the fallback slate %s", f.after, f.source)
+		}
+		if err := s.startFallback(f, audio, caps); err != nil {
+			s.logf("fallback slate: %v, not showing it", err)
+			s.Lock()
+			s.fallback = nil
+			s.Unlock()
+			return
+		}
+	}
+}
+
+// fallbackPlayer is a pipeline playing a slate, and its sinks
+type fallbackPlayer struct {
+	pipeline *gstreamer.Pipeline
+	video    *gstreamer.Element
+	// audio is nil for outputs without audio
+	audio *gstreamer.Element
+}
+
+// stop stops the pipeline, and its sinks for their frames to end
+func (p *fallbackPlayer) stop() {
+	if p == nil {
+		return
+	}
+	p.pipeline.Stop()
+	p.video.Stop()
+	if p.audio != nil {
+		p.audio.Stop()
+	}
+}
+
+// startFallback starts a player of the slate of f, fed to the output
+// while it shows
+func (s *session) startFallback(f *fallback, audio bool, caps string) error {
+	pipeline, err := gstreamer.New(f.pipelineFor(audio, caps, s))
+	if err != nil {
+		return err
+	}
+	p := &fallbackPlayer{pipeline: pipeline, video: pipeline.FindElement("fallbackvideo")}
+	video := pumpFrames(p.video.Poll())
+	var sound <-chan []byte
+	if audio {
+		p.audio = pipeline.FindElement("fallbackaudio")
+		sound = pumpFrames(p.audio.Poll())
+	}
+	go func() {
+		// drained until Stop closes it
+		for range pipeline.PullMessage() {
+		}
+	}()
+	s.Lock()
+	if !f.showing || s.hls == nil || s.closed {
+		s.Unlock()
+		p.stop()
+		return nil
+	}
+	f.player = p
+	s.Unlock()
+	pipeline.Start()
+	if sound != nil {
+		go s.pumpFallbackAudio(f, p, sound)
+	}
+	go s.pumpFallbackVideo(f, p, video)
+	return nil
+}
+
+// pumpFallbackVideo feeds the frames of p to the output while it plays
+// the slate of f; once it ends, a clip at its end, the next tick of
+// runFallback starts it over
+func (s *session) pumpFallbackVideo(f *fallback, p *fallbackPlayer, frames <-chan []byte) {
+	for frame := range frames {
+		s.Lock()
+		if f.player == p {
+			s.output(frame, frameTime{}, videoKeyframe(codecH264, frame))
+		}
+		s.Unlock()
+	}
+	s.Lock()
+	ended := f.player == p
+	if ended {
+		f.player = nil
+	}
+	s.Unlock()
+	if ended {
+		p.stop()
+	}
+}
+
+func (s *session) pumpFallbackAudio(f *fallback, p *fallbackPlayer, frames <-chan []byte) {
+	for frame := range frames {
+		s.Lock()
+		if f.player == p {
+			s.writeAudio(frame, frameTime{})
+		}
+		s.Unlock()
+	}
+}
+
+// stopFallback stops the slate of the session, closing
+func (s *session) stopFallback() {
+	s.Lock()
+	var p *fallbackPlayer
+	if f := s.fallback; f != nil {
+		p = f.player
+		f.showing, f.player = false, nil
+	}
+	s.Unlock()
+	p.stop()
+}
@@ -0,0 +1,80 @@
+package streamserver
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+)
+
+func TestParseFallback(t *testing.T) {
+	f, err := parseFallback("/slates/brb.PNG", "", 2)
+	if err != nil || f.clip || f.width != 1280 || f.height != 720 || f.after != 2*time.Second {
+		t.Fatalf("parseFallback = %+v, %v", f, err)
+	}
+	f, err = parseFallback("/slates/loop.mp4", "640x360", 5)
+	if err != nil || !f.clip || f.width != 640 || f.height != 360 {
+		t.Fatalf("parseFallback = %+v, %v", f, err)
+	}
+	for _, bad := range [][2]string{
+		{"/slates/brb.gif", ""},
+		{"/slates/be right back.png", ""},
+		{"/slates/brb.png", "1280"},
+		{"/slates/brb.png", "641x360"},
+		{"/slates/brb.png", "0x0"},
+	} {
+		if _, err := parseFallback(bad[0], bad[1], 2); err == nil {
+			t.Errorf("parseFallback(%q, %q) accepted", bad[0], bad[1])
+		}
+	}
+	if _, err := parseFallback("/slates/brb.png", "", 0); err == nil {
+		t.Error("fallback_slate_after 0 accepted")
+	}
+
+	s := &session{key: "live", preset: client.Preset{KeyframeInterval: 2000}}
+	if p := f.pipelineFor(true, "", s); !strings.Contains(p, "qtdemux") || !strings.Contains(p, "opusenc") {
+		t.Fatalf("pipeline = %s", p)
+	}
+	if p := f.pipelineFor(true, adtsCaps, s); !strings.Contains(p, "stream-format=adts ! appsink name=fallbackaudio") {
+		t.Fatalf("pipeline = %s", p)
+	}
+	if p := f.pipelineFor(false, "", s); strings.Contains(p, "fallbackaudio") {
+		t.Fatalf("pipeline = %s", p)
+	}
+}
+
+func TestFallbackSwitch(t *testing.T) {
+	f := &fallback{after: 2 * time.Second}
+	now := time.Unix(1700000000, 0)
+	if f.due(now.Add(time.Hour)) {
+		t.Fatal("slate due before the publisher sent anything")
+	}
+	f.real(true, now)
+	if f.due(now.Add(time.Second)) {
+		t.Fatal("slate due within the gap")
+	}
+	if !f.due(now.Add(3 * time.Second)) {
+		t.Fatal("slate not due past the gap")
+	}
+	f.showing = true
+	if !f.due(now.Add(4 * time.Second)) {
+		t.Fatal("slate not started over without a player")
+	}
+	player := &fallbackPlayer{}
+	f.player = player
+	if f.due(now.Add(4 * time.Second)) {
+		t.Fatal("slate started twice")
+	}
+
+	// the publisher is back on its next keyframe
+	if ok, _ := f.real(false, now.Add(5*time.Second)); ok || !f.showing {
+		t.Fatal("non keyframe pushed over the slate")
+	}
+	if ok, stopped := f.real(true, now.Add(5500*time.Millisecond)); !ok || stopped != player || f.showing || f.player != nil {
+		t.Fatal("keyframe did not end the slate")
+	}
+	if ok, stopped := f.real(false, now.Add(5600*time.Millisecond)); !ok || stopped != nil {
+		t.Fatal("frame dropped after the publisher came back")
+	}
+}
@@ -0,0 +1,273 @@
+package streamserver
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	mediaserver "github.com/notedit/media-server-go"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/metrics"
+	"github.com/notedit/sdp"
+)
+
+var (
+	errNotLive       = errors.New("stream is not live")
+	errNoVideoWanted = errors.New("offer does not receive video")
+)
+
+var _ = metrics.NewGaugeFunc("webrtc_viewers",
+	"WebRTC viewers attached to live streams, by stream key", "stream", func() map[string]float64 {
+		counts := map[string]float64{}
+		for _, key := range registry.keys() {
+			if sess := registry.get(key); sess != nil {
+				if n := sess.viewerCount(); n > 0 {
+					counts[key] = float64(n)
+				}
+			}
+		}
+		return counts
+	})
+
+// webrtcViewer is a WebRTC viewer of a live session: a transport of its
+// own with an outgoing stream attached to the publisher's incoming one, so
+// any number of viewers share one publish
+type webrtcViewer struct {
+	id        string
+	transport *mediaserver.Transport
+	// endpoint is that of newEndpoint the transport is on, released with it
+	endpoint *mediaserver.Endpoint
+	// conn is the signaling connection of a websocket viewer, nil for WHEP
+	conn   *signaling
+	joined time.Time
+
+	once sync.Once
+	done chan struct{}
+}
+
+// releaseViewerEndpoint releases the endpoint of a viewer, replaced in
+// tests
+var releaseViewerEndpoint = releaseEndpoint
+
+// stop releases the viewer's transport, the outgoing stream on it and its
+// endpoint. A websocket viewer is told why with code, when non zero.
+func (v *webrtcViewer) stop(code int, reason string) {
+	v.once.Do(func() {
+		if v.transport != nil {
+			v.transport.Stop()
+		}
+		if v.endpoint != nil {
+			releaseViewerEndpoint(v.endpoint)
+		}
+		if v.conn != nil && code != 0 {
+			v.conn.close(code, reason)
+		}
+		watching.Leave(v.id, time.Now())
+		close(v.done)
+	})
+}
+
+// setIncoming records the published stream viewers attach to
+func (s *session) setIncoming(stream *mediaserver.IncomingStream) {
+	s.Lock()
+	s.incoming = stream
+	s.Unlock()
+}
+
+// liveStream returns the published stream, nil until negotiated
+func (s *session) liveStream() *mediaserver.IncomingStream {
+	s.Lock()
+	defer s.Unlock()
+	return s.incoming
+}
+
+// liveTracks returns the published video track and the audio track, nil
+// without audio, viewers attach to: those of a WebRTC publisher, or of the
+// relay of an RTMP one. The video track is nil until negotiated.
+func (s *session) liveTracks() (video, audio *mediaserver.IncomingStreamTrack) {
+	s.Lock()
+	defer s.Unlock()
+	switch {
+	case s.incoming != nil:
+		video = s.incoming.GetVideoTracks()[0]
+		if tracks := s.incoming.GetAudioTracks(); len(tracks) > 0 {
+			audio = tracks[0]
+		}
+	case s.relay != nil:
+		video, audio = s.relay.tracks()
+	}
+	return video, audio
+}
+
+// attachViewer answers a viewer's offer with the session's media,
+// registering the viewer until detachViewer or the end of the session. ip
+// locates the viewer for analytics and picks the endpoint of its network.
+func (s *session) attachViewer(offer *sdp.SDPInfo, conn *signaling, ip net.IP) (*webrtcViewer, string, error) {
+	videoTrack, audioTrack := s.liveTracks()
+	if videoTrack == nil {
+		return nil, "", errNotLive
+	}
+	if quarantined.has(s.key) {
+		return nil, "", errQuarantined
+	}
+	if offer.GetMedia("video") == nil {
+		return nil, "", errNoVideoWanted
+	}
+	endpoint := newEndpoint(ip)
+	transport := endpoint.CreateTransport(offer, nil)
+	transport.SetRemoteProperties(offer.GetMedia("audio"), offer.GetMedia("video"))
+	answer := offer.Answer(transport.GetLocalICEInfo(),
+		transport.GetLocalDTLSInfo(),
+		localCandidates(endpoint.GetLocalCandidates()),
+		Capabilities)
+	transport.SetLocalProperties(answer.GetMedia("audio"), answer.GetMedia("video"))
+
+	v := &webrtcViewer{id: newSessionID(), transport: transport, endpoint: endpoint, conn: conn, joined: time.Now(), done: make(chan struct{})}
+	audio := offer.GetMedia("audio") != nil && audioTrack != nil
+	outgoing := transport.CreateOutgoingStreamWithID(v.id, audio, true)
+	outgoing.GetVideoTracks()[0].AttachTo(videoTrack)
+	if audio {
+		outgoing.GetAudioTracks()[0].AttachTo(audioTrack)
+	}
+	answer.AddStream(outgoing.GetStreamInfo())
+
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		v.stop(0, "")
+		return nil, "", errNotLive
+	}
+	if s.viewers == nil {
+		s.viewers = map[string]*webrtcViewer{}
+	}
+	s.viewers[v.id] = v
+	keyframes := s.refresher
+	s.Unlock()
+	watching.Join(s.key, v.id, protocolWebRTC, ip, v.joined)
+	s.timeline.add(eventSession, "viewer "+v.id+" joined")
+	// the viewer's decoder starts on a keyframe rather than the next refresh
+	if keyframes != nil {
+		keyframes.request(keyframeViewer)
+	}
+	return v, answer.String(), nil
+}
+
+// detachViewers stops every viewer, telling websocket viewers why with
+// code
+func (s *session) detachViewers(code int, reason string) {
+	s.Lock()
+	viewers := s.viewers
+	s.viewers = nil
+	s.Unlock()
+	for _, v := range viewers {
+		v.stop(code, reason)
+		s.timeline.add(eventSession, "viewer "+v.id+" left")
+	}
+}
+
+// detachViewer stops the viewer with id and returns it, nil if unknown
+func (s *session) detachViewer(id string) *webrtcViewer {
+	s.Lock()
+	v := s.viewers[id]
+	delete(s.viewers, id)
+	s.Unlock()
+	if v != nil {
+		v.stop(0, "")
+		s.timeline.add(eventSession, "viewer "+v.id+" left")
+	}
+	return v
+}
+
+func (s *session) viewerCount() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.viewers)
+}
+
+// webrtcViewers returns the attached viewers, oldest first
+func (s *session) webrtcViewers() []*webrtcViewer {
+	s.Lock()
+	list := make([]*webrtcViewer, 0, len(s.viewers))
+	for _, v := range s.viewers {
+		list = append(list, v)
+	}
+	s.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].joined.Before(list[j].joined) })
+	return list
+}
+
+// watchChannel handles the /watch websocket, the signaling of WebRTC
+// viewers: the viewer sends an offer for a stream and gets the answer. The
+// viewer is detached when the websocket closes, and the websocket is
+// closed with client.CloseStreamEnded when the publish ends.
+func watchChannel(c *gin.Context) {
+	ws, err := upGrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		websocketErrors.Inc("upgrade")
+		return
+	}
+	defer ws.Close()
+	conn := newSignaling(ws)
+	conn.speak(c)
+	defer conn.recoverPanic()
+	stopPings := make(chan struct{})
+	defer close(stopPings)
+	conn.keepAlive(stopPings)
+	sendICEServers(conn, "")
+
+	msg, err := conn.read()
+	if err != nil || msg.Cmd != client.CmdOffer {
+		return
+	}
+	conn.received()
+	sess := registry.find(msg.StreamID)
+	if sess == nil {
+		conn.sendError(client.ErrorNotLive, errNotLive)
+		return
+	}
+	if quarantined.has(sess.key) {
+		conn.sendError(client.ErrorQuarantined, errQuarantined)
+		return
+	}
+	offer, err := parseOffer(msg.Sdp)
+	if err != nil {
+		conn.sendError(client.ErrorBadOffer, err)
+		return
+	}
+	viewer, answer, err := sess.attachViewer(offer, conn, net.ParseIP(c.ClientIP()))
+	switch err {
+	case nil:
+	case errNotLive:
+		conn.sendError(client.ErrorNotLive, err)
+		return
+	case errQuarantined:
+		conn.sendError(client.ErrorQuarantined, err)
+		return
+	default:
+		conn.sendError(client.ErrorRejected, err)
+		return
+	}
+	defer sess.detachViewer(viewer.id)
+	if err := conn.send(client.Message{Cmd: client.CmdAnswer, Sdp: answer, StreamID: sess.key}); err != nil {
+		return
+	}
+
+	// viewers send nothing more; a read error is the websocket closing
+	closed := make(chan struct{})
+	go func() {
+		for {
+			if _, _, err := ws.NextReader(); err != nil {
+				close(closed)
+				return
+			}
+			conn.received()
+		}
+	}()
+	select {
+	case <-closed:
+	case <-viewer.done:
+	}
+}
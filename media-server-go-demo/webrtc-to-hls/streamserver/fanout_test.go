@@ -0,0 +1,75 @@
+package streamserver
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	mediaserver "github.com/notedit/media-server-go"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+)
+
+func TestViewersEndWithSession(t *testing.T) {
+	sess := newSession("fanout-closed", nil, presets[client.LatencyBalanced])
+	viewers := []*webrtcViewer{
+		{id: "1-1", done: make(chan struct{})},
+		{id: "1-2", done: make(chan struct{})},
+	}
+	sess.viewers = map[string]*webrtcViewer{}
+	for _, v := range viewers {
+		sess.viewers[v.id] = v
+	}
+	if sess.detachViewer("1-2") == nil || sess.viewerCount() != 1 {
+		t.Fatal("viewer not detached")
+	}
+	sess.close(0, "")
+	for _, v := range viewers {
+		select {
+		case <-v.done:
+		default:
+			t.Fatalf("viewer %s not stopped", v.id)
+		}
+	}
+	if sess.viewerCount() != 0 || sess.detachViewer("1-1") != nil {
+		t.Fatal("viewers left on a closed session")
+	}
+}
+
+func TestViewerReleasesEndpoint(t *testing.T) {
+	defer func(release func(*mediaserver.Endpoint)) { releaseViewerEndpoint = release }(releaseViewerEndpoint)
+	var released []*mediaserver.Endpoint
+	releaseViewerEndpoint = func(endpoint *mediaserver.Endpoint) { released = append(released, endpoint) }
+	endpoint := &mediaserver.Endpoint{}
+	v := &webrtcViewer{id: "1-1", endpoint: endpoint, done: make(chan struct{})}
+	v.stop(0, "")
+	v.stop(0, "")
+	if len(released) != 1 || released[0] != endpoint {
+		t.Fatalf("released %d endpoints", len(released))
+	}
+}
+
+func TestWatchNeedsLiveStream(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/watch", watchChannel)
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/watch", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if err := ws.WriteJSON(client.Message{Cmd: client.CmdOffer, StreamID: "nobody-live", Sdp: "v=0\r\n"}); err != nil {
+		t.Fatal(err)
+	}
+	var msg client.Message
+	if err := ws.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Cmd != client.CmdError || msg.Reason != errNotLive.Error() {
+		t.Fatalf("reply = %+v", msg)
+	}
+}
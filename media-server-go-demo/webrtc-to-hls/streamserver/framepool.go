@@ -0,0 +1,28 @@
+package streamserver
+
+import "sync"
+
+// maxPooledFrame bounds the buffers kept in frameBuffers, so that a burst
+// of large keyframes does not stay pinned in memory
+const maxPooledFrame = 1 << 20
+
+// frameBuffers pools the copies the output queues keep of frames. A copy
+// is given back once appsrc has pushed it, GStreamer copying it into a
+// buffer of its own, so a warm pool queues frames without allocating.
+var frameBuffers = sync.Pool{New: func() interface{} { return new([]byte) }}
+
+// copyFrame copies frame into a buffer of frameBuffers, to be given back
+// with releaseFrame once nothing reads it
+func copyFrame(frame []byte) *[]byte {
+	buf := frameBuffers.Get().(*[]byte)
+	*buf = append((*buf)[:0], frame...)
+	return buf
+}
+
+// releaseFrame gives buf back to frameBuffers; nil is ignored
+func releaseFrame(buf *[]byte) {
+	if buf == nil || cap(*buf) > maxPooledFrame {
+		return
+	}
+	frameBuffers.Put(buf)
+}
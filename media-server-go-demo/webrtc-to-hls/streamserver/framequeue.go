@@ -0,0 +1,109 @@
+package streamserver
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// outputFrame is a frame queued for the HLS pipeline, of its video or its
+// audio
+type outputFrame struct {
+	data []byte
+	// buf holds data, from frameBuffers
+	buf      *[]byte
+	audio    bool
+	keyframe bool
+	// seq numbers the video frames, see hlsOutput.videoSeq
+	seq uint64
+	// pts is the PTS of the frame, see hlsOutput.timing
+	pts time.Duration
+}
+
+// outputFrames pools the frames of the queues, as frameBuffers their data
+var outputFrames = sync.Pool{New: func() interface{} { return new(outputFrame) }}
+
+// newOutputFrame is a frame of outputFrames holding a copy of data, to be
+// given back with releaseOutputFrame once pushed or dropped
+func newOutputFrame(data []byte) *outputFrame {
+	f := outputFrames.Get().(*outputFrame)
+	f.buf = copyFrame(data)
+	f.data = *f.buf
+	return f
+}
+
+func releaseOutputFrame(f *outputFrame) {
+	releaseFrame(f.buf)
+	*f = outputFrame{}
+	outputFrames.Put(f)
+}
+
+// frameQueue is the bounded queue between the media thread pushing the
+// frames of a stream and the goroutine feeding them to its pipeline. It is
+// lock-free for one producer and one consumer, the producer never waiting:
+// when full, the oldest frame is dropped to make room. The consumer waits
+// on ready.
+type frameQueue struct {
+	slots []atomic.Pointer[outputFrame]
+	// head is the next frame to pop and tail the next slot to push to,
+	// both counting up; head is advanced by pop and by push dropping
+	head uint64
+	tail uint64
+	// ready is signaled after a push
+	ready chan struct{}
+}
+
+func newFrameQueue(size int) *frameQueue {
+	return &frameQueue{
+		slots: make([]atomic.Pointer[outputFrame], size),
+		ready: make(chan struct{}, 1),
+	}
+}
+
+// push queues f and returns the frame dropped for it, nil unless the queue
+// was full
+func (q *frameQueue) push(f *outputFrame) (dropped *outputFrame) {
+	size := uint64(len(q.slots))
+	tail := atomic.LoadUint64(&q.tail)
+	for {
+		head := atomic.LoadUint64(&q.head)
+		if tail-head < size {
+			break
+		}
+		oldest := q.slots[head%size].Load()
+		// lost to pop when it fails, which made room
+		if atomic.CompareAndSwapUint64(&q.head, head, head+1) {
+			dropped = oldest
+			break
+		}
+	}
+	q.slots[tail%size].Store(f)
+	atomic.StoreUint64(&q.tail, tail+1)
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return dropped
+}
+
+// pop takes the oldest frame, nil when the queue is empty
+func (q *frameQueue) pop() *outputFrame {
+	size := uint64(len(q.slots))
+	for {
+		head := atomic.LoadUint64(&q.head)
+		if head == atomic.LoadUint64(&q.tail) {
+			return nil
+		}
+		f := q.slots[head%size].Load()
+		// lost to push dropping it when it fails
+		if atomic.CompareAndSwapUint64(&q.head, head, head+1) {
+			return f
+		}
+	}
+}
+
+// len is the number of queued frames
+func (q *frameQueue) len() int {
+	head := atomic.LoadUint64(&q.head)
+	return int(atomic.LoadUint64(&q.tail) - head)
+}
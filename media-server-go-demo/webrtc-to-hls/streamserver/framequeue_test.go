@@ -0,0 +1,41 @@
+package streamserver
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestFrameQueue(t *testing.T) {
+	const frames = 100000
+	q := newFrameQueue(8)
+	done := make(chan struct{})
+	var popped []uint64
+	go func() {
+		defer close(done)
+		for len(popped) == 0 || popped[len(popped)-1] < frames-1 {
+			<-q.ready
+			for f := q.pop(); f != nil; f = q.pop() {
+				popped = append(popped, binary.BigEndian.Uint64(f.data))
+				releaseOutputFrame(f)
+			}
+		}
+	}()
+	dropped := 0
+	frame := make([]byte, 8)
+	for i := uint64(0); i < frames; i++ {
+		binary.BigEndian.PutUint64(frame, i)
+		if f := q.push(newOutputFrame(frame)); f != nil {
+			releaseOutputFrame(f)
+			dropped++
+		}
+	}
+	<-done
+	for i := 1; i < len(popped); i++ {
+		if popped[i] <= popped[i-1] {
+			t.Fatalf("frame %d popped after %d", popped[i], popped[i-1])
+		}
+	}
+	if len(popped)+dropped != frames {
+		t.Fatalf("%d popped and %d dropped of %d", len(popped), dropped, frames)
+	}
+}
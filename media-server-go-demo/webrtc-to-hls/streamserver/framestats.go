@@ -0,0 +1,428 @@
+package streamserver
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"sync"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/metrics"
+)
+
+// sizes are bucketed by power of two, each octave split in subBuckets
+// linear buckets, which keeps percentiles within 25% of the true value
+const (
+	subBucketBits = 2
+	subBuckets    = 1 << subBucketBits
+	numBuckets    = 32 * subBuckets
+)
+
+// sizeHistogram counts frame sizes in fixed buckets
+type sizeHistogram struct {
+	buckets [numBuckets]uint64
+	count   uint64
+	max     int
+}
+
+func sizeBucket(size int) int {
+	if size < subBuckets {
+		return size
+	}
+	octave := bits.Len(uint(size)) - 1
+	sub := (size >> uint(octave-subBucketBits)) & (subBuckets - 1)
+	return (octave-subBucketBits+1)*subBuckets + sub
+}
+
+// bucketUpper is the largest size falling in bucket
+func bucketUpper(bucket int) int {
+	if bucket < subBuckets {
+		return bucket
+	}
+	octave := bucket/subBuckets + subBucketBits - 1
+	sub := bucket % subBuckets
+	return (subBuckets+sub+1)<<uint(octave-subBucketBits) - 1
+}
+
+func (h *sizeHistogram) record(size int) {
+	bucket := sizeBucket(size)
+	if bucket >= numBuckets {
+		bucket = numBuckets - 1
+	}
+	h.buckets[bucket]++
+	h.count++
+	if size > h.max {
+		h.max = size
+	}
+}
+
+// percentile returns the bucket bound below which p percent of the sizes fall
+func (h *sizeHistogram) percentile(p float64) int {
+	if h.count == 0 {
+		return 0
+	}
+	target := uint64(math.Ceil(float64(h.count) * p / 100))
+	var seen uint64
+	for bucket, n := range h.buckets {
+		seen += n
+		if seen >= target {
+			if upper := bucketUpper(bucket); upper < h.max {
+				return upper
+			}
+			return h.max
+		}
+	}
+	return h.max
+}
+
+// SizeSummary is the distribution of frame sizes in bytes
+type SizeSummary struct {
+	Count uint64 `json:"count"`
+	P50   int    `json:"p50"`
+	P95   int    `json:"p95"`
+	Max   int    `json:"max"`
+}
+
+func (h *sizeHistogram) summary() SizeSummary {
+	return SizeSummary{
+		Count: h.count,
+		P50:   h.percentile(50),
+		P95:   h.percentile(95),
+		Max:   h.max,
+	}
+}
+
+// FrameStats summarizes the frames of one track
+type FrameStats struct {
+	Frames    SizeSummary `json:"frames"`
+	Keyframes SizeSummary `json:"keyframes"`
+	// FPS is the mean frame rate over the alert window
+	FPS float64 `json:"fps"`
+	// Bitrate is the mean over the alert window, in bits per second
+	Bitrate int `json:"bitrate"`
+	// BitrateVariation is the coefficient of variation of the per second
+	// bitrate over the alert window
+	BitrateVariation float64 `json:"bitrateVariation"`
+	// KeyframeIntervalMs is the time between the last two keyframes
+	KeyframeIntervalMs float64 `json:"keyframeIntervalMs"`
+	// LastFrame is when the latest frame was received, nil before the first
+	LastFrame *time.Time `json:"lastFrame,omitempty"`
+}
+
+// frameAlerts are the thresholds of the frame size alerts; zero disables one
+type frameAlerts struct {
+	keyframeBytes int
+	// bitrateVariation is the coefficient of variation above which the
+	// bitrate is considered erratic
+	bitrateVariation float64
+	// minBitrate is the bitrate below which the publisher is warned, in
+	// bits per second
+	minBitrate int
+	window     int
+	// segment is the segment duration of the output, which keyframes must
+	// come at least as often as; segments can only be cut on them
+	segment time.Duration
+}
+
+// frameAlertsFromEnv reads frame_alert_keyframe_bytes,
+// frame_alert_bitrate_variation (percent), frame_alert_min_bitrate_kbps and
+// frame_alert_window (seconds)
+func frameAlertsFromEnv() frameAlerts {
+	window := envInt("frame_alert_window", 10)
+	if window < 2 {
+		window = 2
+	}
+	return frameAlerts{
+		keyframeBytes:    envInt("frame_alert_keyframe_bytes", 300000),
+		bitrateVariation: float64(envInt("frame_alert_bitrate_variation", 50)) / 100,
+		minBitrate:       envInt("frame_alert_min_bitrate_kbps", 100) * 1000,
+		window:           window,
+	}
+}
+
+// frameAlertsFor returns the alert thresholds of a session with preset
+func frameAlertsFor(preset client.Preset) frameAlerts {
+	alerts := frameAlertsFromEnv()
+	alerts.segment = time.Duration(preset.SegmentDuration) * time.Second
+	return alerts
+}
+
+// frameStats tracks the frame size distribution of a video track. record is
+// on the frame path: it only bumps counters and does not allocate.
+type frameStats struct {
+	alerts frameAlerts
+
+	sync.Mutex
+	frames    sizeHistogram
+	keyframes sizeHistogram
+	// bytes and frames per second over the alert window, current second
+	// at head
+	window []uint64
+	counts []uint64
+	head   int
+	filled int
+	// largest keyframe since the last check
+	largestKeyframe int
+	// longest keyframe interval since the last check
+	lastKeyframe time.Time
+	longestGOP   time.Duration
+	// gop is the latest keyframe interval
+	gop       time.Duration
+	lastFrame time.Time
+	now       func() time.Time
+}
+
+func newFrameStats(alerts frameAlerts) *frameStats {
+	return &frameStats{
+		alerts: alerts,
+		window: make([]uint64, alerts.window),
+		counts: make([]uint64, alerts.window),
+		now:    time.Now,
+	}
+}
+
+func (f *frameStats) record(frame []byte, keyframe bool) {
+	now := f.now()
+	f.Lock()
+	f.frames.record(len(frame))
+	if keyframe {
+		f.keyframes.record(len(frame))
+		if len(frame) > f.largestKeyframe {
+			f.largestKeyframe = len(frame)
+		}
+		if !f.lastKeyframe.IsZero() {
+			f.gop = now.Sub(f.lastKeyframe)
+			if f.gop > f.longestGOP {
+				f.longestGOP = f.gop
+			}
+		}
+		f.lastKeyframe = now
+	}
+	f.window[f.head] += uint64(len(frame))
+	f.counts[f.head]++
+	f.lastFrame = now
+	f.Unlock()
+}
+
+// tick closes the current second of the bitrate window
+func (f *frameStats) tick() {
+	f.Lock()
+	defer f.Unlock()
+	f.head = (f.head + 1) % len(f.window)
+	f.window[f.head] = 0
+	f.counts[f.head] = 0
+	if f.filled < len(f.window)-1 {
+		f.filled++
+	}
+}
+
+// bitrate returns mean and coefficient of variation of the completed seconds
+func (f *frameStats) bitrate() (float64, float64) {
+	if f.filled == 0 {
+		return 0, 0
+	}
+	var sum float64
+	for i := 1; i <= f.filled; i++ {
+		sum += float64(f.window[(f.head-i+len(f.window))%len(f.window)])
+	}
+	mean := sum / float64(f.filled)
+	if mean == 0 {
+		return 0, 0
+	}
+	var variance float64
+	for i := 1; i <= f.filled; i++ {
+		d := float64(f.window[(f.head-i+len(f.window))%len(f.window)]) - mean
+		variance += d * d
+	}
+	variance /= float64(f.filled)
+	return mean * 8, math.Sqrt(variance) / mean
+}
+
+// meanBitrate returns the mean bitrate of the completed seconds, in bits
+// per second, and whether they fill the window
+func (f *frameStats) meanBitrate() (int, bool) {
+	f.Lock()
+	defer f.Unlock()
+	bitrate, _ := f.bitrate()
+	return int(bitrate), f.filled == len(f.window)-1
+}
+
+// fps returns the mean frame rate of the completed seconds
+func (f *frameStats) fps() float64 {
+	if f.filled == 0 {
+		return 0
+	}
+	var sum uint64
+	for i := 1; i <= f.filled; i++ {
+		sum += f.counts[(f.head-i+len(f.counts))%len(f.counts)]
+	}
+	return float64(sum) / float64(f.filled)
+}
+
+func (f *frameStats) stats() FrameStats {
+	f.Lock()
+	defer f.Unlock()
+	bitrate, variation := f.bitrate()
+	stats := FrameStats{
+		Frames:             f.frames.summary(),
+		Keyframes:          f.keyframes.summary(),
+		FPS:                f.fps(),
+		Bitrate:            int(bitrate),
+		BitrateVariation:   variation,
+		KeyframeIntervalMs: milliseconds(f.gop),
+	}
+	if !f.lastFrame.IsZero() {
+		last := f.lastFrame
+		stats.LastFrame = &last
+	}
+	return stats
+}
+
+// check returns the alerts raised since the previous check. The bitrate is
+// only judged once the window is full.
+func (f *frameStats) check() []warning {
+	f.Lock()
+	defer f.Unlock()
+	var alerts []warning
+	if f.alerts.keyframeBytes > 0 && f.largestKeyframe > f.alerts.keyframeBytes {
+		alerts = append(alerts, warning{
+			code:    client.WarningKeyframeTooLarge,
+			text:    fmt.Sprintf("encoder: keyframe of %d bytes exceeds %d", f.largestKeyframe, f.alerts.keyframeBytes),
+			details: map[string]interface{}{"bytes": f.largestKeyframe, "limitBytes": f.alerts.keyframeBytes},
+		})
+	}
+	f.largestKeyframe = 0
+	if segment := f.alerts.segment; segment > 0 && f.longestGOP > segment {
+		alerts = append(alerts, warning{
+			code: client.WarningGOPTooLong,
+			text: fmt.Sprintf("encoder: keyframes every %.1fs, longer than the %v segments; set the keyframe interval to %v",
+				f.longestGOP.Seconds(), segment, segment),
+			details: map[string]interface{}{
+				"gopMs":                       milliseconds(f.longestGOP),
+				"segmentDurationMs":           milliseconds(segment),
+				"suggestedKeyframeIntervalMs": milliseconds(segment),
+			},
+		})
+	}
+	f.longestGOP = 0
+	full := f.filled == len(f.window)-1
+	if f.alerts.minBitrate > 0 && full {
+		if bitrate, _ := f.bitrate(); bitrate < float64(f.alerts.minBitrate) {
+			alerts = append(alerts, warning{
+				code:    client.WarningBitrateLow,
+				text:    fmt.Sprintf("encoder: bitrate of %.0f kbps over %ds, under %d kbps", bitrate/1000, f.filled, f.alerts.minBitrate/1000),
+				details: map[string]interface{}{"bitrate": int(bitrate), "minBitrate": f.alerts.minBitrate},
+			})
+		}
+	}
+	if f.alerts.bitrateVariation > 0 && full {
+		if _, variation := f.bitrate(); variation > f.alerts.bitrateVariation {
+			alerts = append(alerts, warning{
+				code:    client.WarningBitrateUnstable,
+				text:    fmt.Sprintf("encoder: bitrate varies by %.0f%% over %ds", variation*100, f.filled),
+				details: map[string]interface{}{"variation": variation, "windowSeconds": f.filled},
+			})
+		}
+	}
+	return alerts
+}
+
+// ingestGauge registers a gauge of the video each live stream receives, by
+// stream key; value skips the streams it has nothing for
+func ingestGauge(name, help string, value func(stats FrameStats, now time.Time) (float64, bool)) *metrics.GaugeFunc {
+	return metrics.NewGaugeFunc(name, help, "stream", func() map[string]float64 {
+		values := map[string]float64{}
+		now := time.Now()
+		for _, key := range registry.keys() {
+			if sess := registry.get(key); sess != nil {
+				if v, ok := value(sess.frames.stats(), now); ok {
+					values[key] = v
+				}
+			}
+		}
+		return values
+	})
+}
+
+var (
+	_ = ingestGauge("ingest_video_fps", "Frames per second of the published video, by stream key",
+		func(stats FrameStats, now time.Time) (float64, bool) { return stats.FPS, true })
+	_ = ingestGauge("ingest_video_bitrate_bps", "Bitrate of the published video in bits per second, by stream key",
+		func(stats FrameStats, now time.Time) (float64, bool) { return float64(stats.Bitrate), true })
+	_ = ingestGauge("ingest_keyframe_interval_seconds", "Seconds between the latest two keyframes of the published video, by stream key",
+		func(stats FrameStats, now time.Time) (float64, bool) {
+			return stats.KeyframeIntervalMs / 1000, stats.KeyframeIntervalMs > 0
+		})
+	_ = ingestGauge("ingest_last_frame_age_seconds", "Seconds since the published video last delivered a frame, by stream key",
+		func(stats FrameStats, now time.Time) (float64, bool) {
+			if stats.LastFrame == nil {
+				return 0, false
+			}
+			return now.Sub(*stats.LastFrame).Seconds(), true
+		})
+)
+
+// isH264Keyframe reports whether an Annex B access unit holds an IDR slice
+func isH264Keyframe(frame []byte) bool {
+	for i := 0; i+3 < len(frame); i++ {
+		if frame[i] == 0 && frame[i+1] == 0 && frame[i+2] == 1 {
+			if frame[i+3]&0x1f == 5 {
+				return true
+			}
+			i += 2
+		}
+	}
+	return false
+}
+
+// watchFrames closes a second of the bitrate window every second and warns
+// the publisher about misbehaving encoders, at most once per alert window,
+// and about the video turning, each time it does. A publisher over its
+// bitrate limit is ended, see overBitrate.
+func (s *session) watchFrames() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var quiet int
+	warned := map[string]bool{}
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		s.frames.tick()
+		if err := s.overBitrate(); err != nil {
+			s.endOverBitrate(err)
+			return
+		}
+		if s.enforcePolicy(warned) {
+			return
+		}
+		if turn, ok := s.size.takeTurn(); ok {
+			s.frameAlert(turn)
+		}
+		alerts := s.frames.check()
+		if quiet > 0 {
+			quiet--
+			continue
+		}
+		for _, alert := range alerts {
+			s.frameAlert(alert)
+		}
+		if len(alerts) > 0 {
+			quiet = s.frames.alerts.window
+		}
+	}
+}
+
+// frameAlert warns the publisher about its encoder, and posts the alert as
+// an encoder.alert event for the operators
+func (s *session) frameAlert(alert warning) {
+	s.warn(alert)
+	data := map[string]interface{}{"session": s.id, "code": alert.code, "reason": alert.text}
+	for k, v := range alert.details {
+		data[k] = v
+	}
+	s.notify(hookEncoderAlert, data)
+}
@@ -0,0 +1,172 @@
+package streamserver
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+)
+
+func TestSizeBuckets(t *testing.T) {
+	for _, size := range []int{0, 3, 4, 7, 8, 9, 100, 1000, 600000} {
+		bucket := sizeBucket(size)
+		if upper := bucketUpper(bucket); size > upper || (bucket > 0 && size <= bucketUpper(bucket-1)) {
+			t.Errorf("size %d in bucket %d with upper bound %d", size, bucket, upper)
+		}
+	}
+}
+
+func TestSizeHistogram(t *testing.T) {
+	var h sizeHistogram
+	for i := 0; i < 95; i++ {
+		h.record(1000)
+	}
+	for i := 0; i < 5; i++ {
+		h.record(100000)
+	}
+	s := h.summary()
+	if s.Count != 100 || s.Max != 100000 {
+		t.Fatalf("summary %+v", s)
+	}
+	if s.P50 < 1000 || s.P50 > 1250 || s.P95 < 1000 || s.P95 > 1250 {
+		t.Fatalf("percentiles %+v", s)
+	}
+	h.record(100000)
+	if p := h.percentile(95); p < 100000 {
+		t.Fatalf("p95 = %d", p)
+	}
+}
+
+func TestFrameAlerts(t *testing.T) {
+	f := newFrameStats(frameAlerts{keyframeBytes: 5000, bitrateVariation: 0.5, window: 4})
+	idr := make([]byte, 6000)
+	copy(idr, []byte{0, 0, 0, 1, 0x65})
+	slice := make([]byte, 6000)
+	copy(slice, []byte{0, 0, 0, 1, 0x41})
+
+	f.record(slice, false)
+	if alerts := f.check(); len(alerts) != 0 {
+		t.Fatalf("alerts for a large non-IDR frame: %v", alerts)
+	}
+	f.record(idr, true)
+	alerts := f.check()
+	if len(alerts) != 1 {
+		t.Fatalf("alerts = %v", alerts)
+	}
+	// the operators get the alert too
+	events, cancel := controlEvents.Subscribe(4)
+	defer cancel()
+	sess := newSession("misbehaving", nil, presets[client.LatencyBalanced])
+	sess.frameAlert(alerts[0])
+	select {
+	case event := <-events:
+		if event.Type != hookEncoderAlert || event.Stream != "misbehaving" || event.Data["code"] != client.WarningKeyframeTooLarge ||
+			event.Data["session"] != sess.id || event.Data["bytes"] != "6000" {
+			t.Fatalf("alert event = %v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no encoder.alert event")
+	}
+	if stats := f.stats(); stats.Keyframes.Count != 1 || stats.Frames.Count != 2 {
+		t.Fatalf("stats %+v", stats)
+	}
+
+	// steady, then a burst
+	for _, frames := range []int{1, 1, 10} {
+		f.tick()
+		for i := 0; i < frames; i++ {
+			f.record(slice, false)
+		}
+	}
+	f.tick()
+	if alerts := f.check(); len(alerts) != 1 {
+		t.Fatalf("bitrate alerts = %v", alerts)
+	}
+}
+
+func TestLowBitrateAlert(t *testing.T) {
+	f := newFrameStats(frameAlerts{minBitrate: 100000, window: 4})
+	slice := make([]byte, 1000)
+	copy(slice, []byte{0, 0, 0, 1, 0x41})
+	for second := 0; second < 2; second++ {
+		f.record(slice, false)
+		f.tick()
+		if alerts := f.check(); len(alerts) != 0 {
+			t.Fatalf("alerts before the window is full: %v", alerts)
+		}
+	}
+	f.record(slice, false)
+	f.tick()
+	alerts := f.check()
+	if len(alerts) != 1 || alerts[0].code != client.WarningBitrateLow || alerts[0].details["bitrate"] != 8000 {
+		t.Fatalf("alerts = %v", alerts)
+	}
+	for second := 0; second < 3; second++ {
+		for i := 0; i < 20; i++ {
+			f.record(slice, false)
+		}
+		f.tick()
+	}
+	if alerts := f.check(); len(alerts) != 0 {
+		t.Fatalf("alerts at 160 kbps: %v", alerts)
+	}
+}
+
+func TestGOPAlert(t *testing.T) {
+	now := time.Unix(1000, 0)
+	f := newFrameStats(frameAlerts{window: 4, segment: 2 * time.Second})
+	f.now = func() time.Time { return now }
+	idr := []byte{0, 0, 0, 1, 0x65, 0}
+
+	for i := 0; i < 3; i++ {
+		f.record(idr, true)
+		now = now.Add(2 * time.Second)
+	}
+	if alerts := f.check(); len(alerts) != 0 {
+		t.Fatalf("alerts for keyframes every segment: %+v", alerts)
+	}
+	now = now.Add(2 * time.Second)
+	f.record(idr, true)
+	alerts := f.check()
+	if len(alerts) != 1 || alerts[0].code != client.WarningGOPTooLong || alerts[0].details["gopMs"] != float64(4000) {
+		t.Fatalf("alerts = %+v", alerts)
+	}
+	if !strings.Contains(alerts[0].text, "set the keyframe interval to 2s") {
+		t.Fatalf("text = %q", alerts[0].text)
+	}
+	if alerts := f.check(); len(alerts) != 0 {
+		t.Fatalf("alert repeated without a new long GOP: %+v", alerts)
+	}
+}
+
+func TestIngestStats(t *testing.T) {
+	now := time.Unix(1000, 0)
+	f := newFrameStats(frameAlerts{window: 4})
+	f.now = func() time.Time { return now }
+	idr := []byte{0, 0, 0, 1, 0x65, 0}
+	slice := []byte{0, 0, 0, 1, 0x41, 0, 0, 0, 0, 0}
+
+	if stats := f.stats(); stats.LastFrame != nil || stats.FPS != 0 {
+		t.Fatalf("stats before any frame %+v", stats)
+	}
+	for second := 0; second < 2; second++ {
+		f.record(idr, true)
+		for i := 0; i < 29; i++ {
+			now = now.Add(time.Second / 30)
+			f.record(slice, false)
+		}
+		now = now.Add(time.Second / 30)
+		f.tick()
+	}
+	stats := f.stats()
+	if stats.FPS != 30 || stats.Bitrate != (6+29*10)*8 {
+		t.Fatalf("fps %v, bitrate %d", stats.FPS, stats.Bitrate)
+	}
+	if stats.KeyframeIntervalMs < 999 || stats.KeyframeIntervalMs > 1001 {
+		t.Fatalf("keyframe interval %vms", stats.KeyframeIntervalMs)
+	}
+	if stats.LastFrame == nil || !stats.LastFrame.Equal(now.Add(-time.Second/30)) {
+		t.Fatalf("last frame %v", stats.LastFrame)
+	}
+}
@@ -0,0 +1,379 @@
+package streamserver
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/hlscheck"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/llhls"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/metrics"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/playlist"
+)
+
+// streamOutput is where the sessions of a stream key write: a directory of
+// its own below hlsDir, served at /hls/<key>/. It outlives the sessions, so
+// a publisher reconnecting with the same key continues the output players
+// follow.
+type streamOutput struct {
+	dir         string
+	generations *outputGenerations
+	// gates validate each revision of its playlists before it is served;
+	// playlist_validation=strict fails requests instead of serving the last
+	// good revision, playlist_validation=off serves the files as is
+	gates *outputGates
+	// uploads copy the output to the storage backend, if any
+	uploads outputUploads
+
+	llLock sync.Mutex
+	// ll is the LL-HLS packaging of the latest generation, if any
+	ll *llhls.Packager
+	// llGate orders the LL-HLS revisions through their gate
+	llGate sync.Mutex
+
+	restoreLock sync.Mutex
+	// restored is where playback resumed after a quarantine, if it did
+	restored *restoreMark
+
+	// events are the timed metadata of an fMP4 output
+	events outputEvents
+	// splices are the ad breaks listed in the playlist
+	splices outputSplices
+	// captions are the cues of a captioned output
+	captions outputCaptions
+	// dates are the keyframes its segments are dated by
+	dates outputDates
+}
+
+// playlist is the path of the live playlist
+func (o *streamOutput) playlist() string {
+	return filepath.Join(o.dir, playlistName)
+}
+
+// streamOutputs are the outputs by stream key
+type streamOutputs struct {
+	sync.Mutex
+	now   func() time.Time
+	byKey map[string]*streamOutput
+}
+
+var outputs = newStreamOutputs(time.Now)
+
+var pipelineRestarts = metrics.NewCounter("hls_pipeline_restarts_total",
+	"Pipelines started for a stream key that had an output before: reconnects, renegotiations, takeovers and restarts after failures", "")
+
+func newStreamOutputs(now func() time.Time) *streamOutputs {
+	return &streamOutputs{now: now, byKey: make(map[string]*streamOutput)}
+}
+
+// outputDir is the directory the output of key is written to
+func outputDir(key string) string {
+	return filepath.Join(hlsDir, key)
+}
+
+// get returns the output of key, creating it
+func (o *streamOutputs) get(key string) *streamOutput {
+	o.Lock()
+	defer o.Unlock()
+	out := o.byKey[key]
+	if out == nil {
+		dir := outputDir(key)
+		out = &streamOutput{
+			dir:         dir,
+			generations: &outputGenerations{now: o.now, dir: dir},
+			gates:       newOutputGates(os.Getenv("playlist_validation") == "strict"),
+		}
+		o.byKey[key] = out
+	}
+	return out
+}
+
+// lookup returns the output of key, or nil when nothing was published
+// under it
+func (o *streamOutputs) lookup(key string) *streamOutput {
+	o.Lock()
+	defer o.Unlock()
+	return o.byKey[key]
+}
+
+// outputGenerations versions the output of a stream key per session. Back
+// to back sessions of the key write the same served directory, so each one names its segments
+// after its own generation: a player still following an ended session gets
+// the segments it asks for or a 404, never the next session's content. The
+// ended session's final playlist keeps being served until players caught up
+// with its ENDLIST, and only then does the playlist switch to the new session.
+type outputGenerations struct {
+	sync.Mutex
+	now  func() time.Time
+	dir  string
+	last int64
+
+	// final is the ENDLIST revision of the last ended generation, while held
+	final []byte
+	// continued stitches the playlist of a takeover to the one it replaced
+	continued   *continuation
+	endedAt     time.Time
+	firstServed time.Time
+	target      time.Duration
+	window      time.Duration
+}
+
+// segmentPrefix is what hlssink names the segments of a generation with
+func segmentPrefix(generation int64) string {
+	return fmt.Sprintf("%s-%d-", segmentName, generation)
+}
+
+// next returns the generation of a new output. Generations start from the
+// wall clock so they keep increasing across restarts. The segments of the
+// previous generation are removed once players had a playlist window to
+// finish them, unless old segments are kept.
+func (o *outputGenerations) next() int64 {
+	o.Lock()
+	defer o.Unlock()
+	previous := o.last
+	o.last = o.now().Unix()
+	if o.last <= previous {
+		o.last = previous + 1
+	}
+	if previous != 0 {
+		pipelineRestarts.Inc("")
+		if !deleteOldSegments {
+			return o.last
+		}
+		linger := o.window + o.target
+		if linger == 0 {
+			linger = time.Minute
+		}
+		time.AfterFunc(linger, func() { removeGeneration(o.dir, previous) })
+	}
+	return o.last
+}
+
+// ended holds final, the playlist hlssink left behind for generation, if it
+// is that generation's ENDLIST revision
+func (o *outputGenerations) ended(generation int64, final []byte, preset client.Preset) {
+	if !bytes.Contains(final, []byte("#EXT-X-ENDLIST")) || !bytes.Contains(final, []byte(segmentPrefix(generation))) {
+		return
+	}
+	o.Lock()
+	defer o.Unlock()
+	if c := o.continued; c != nil && c.generation == generation {
+		// the ENDLIST of the continued playlist players follow
+		if m, err := hlscheck.ParseMedia(final); err == nil && c.sync(m) {
+			final = c.render()
+		}
+	}
+	o.continued = nil
+	o.final = final
+	o.endedAt = o.now()
+	o.firstServed = time.Time{}
+	o.target = time.Duration(preset.SegmentDuration) * time.Second
+	o.window = time.Duration(preset.SegmentDuration*preset.PlaylistLength) * time.Second
+}
+
+// replaced continues the playlist of generation, which a takeover ended,
+// with the generation of the new publish: players keep reloading the same
+// playlist, and see a discontinuity instead of an ENDLIST. fMP4 and LL-HLS
+// playlists, whose tags the continuation does not carry over, end as
+// usual. It reports whether the playlist is continued.
+func (o *outputGenerations) replaced(generation int64, final []byte, preset client.Preset) bool {
+	m, err := hlscheck.ParseMedia(final)
+	if err != nil || m.Map != "" || m.LowLatency != "" || !bytes.Contains(final, []byte(segmentPrefix(generation))) {
+		return false
+	}
+	o.Lock()
+	defer o.Unlock()
+	previous := &playlist.Media{TargetDuration: m.TargetDuration, MediaSequence: m.MediaSequence}
+	if c := o.continued; c != nil && c.generation == generation && c.sync(m) {
+		// a takeover of a takeover goes on from the stitched playlist
+		previous = c.stream.Media()
+	} else {
+		for _, segment := range m.Segments {
+			previous.Segments = append(previous.Segments, playlist.Segment{URI: segment.URI, Duration: segment.Duration})
+		}
+	}
+	o.continueLocked(generation, previous, preset)
+	return true
+}
+
+// migrated continues m, the playlist the source instance of a migration
+// stored, with the generations of this instance, which follow those it
+// lists. It reports false for playlists replaced does not continue either.
+func (o *outputGenerations) migrated(m *hlscheck.Media, preset client.Preset) bool {
+	if m.Map != "" || m.LowLatency != "" || len(m.Segments) == 0 {
+		return false
+	}
+	previous := &playlist.Media{TargetDuration: m.TargetDuration, MediaSequence: m.MediaSequence}
+	last := int64(0)
+	for _, segment := range m.Segments {
+		generation, _, ok := segmentGeneration(path.Base(segment.URI))
+		if !ok {
+			return false
+		}
+		if generation > last {
+			last = generation
+		}
+		previous.Segments = append(previous.Segments, playlist.Segment{URI: segment.URI, Duration: segment.Duration})
+	}
+	o.Lock()
+	defer o.Unlock()
+	if o.last < last {
+		o.last = last
+	}
+	o.continueLocked(last, previous, preset)
+	return true
+}
+
+// continueLocked continues previous, the playlist generation left, with
+// the next generation, with the generations locked
+func (o *outputGenerations) continueLocked(generation int64, previous *playlist.Media, preset client.Preset) {
+	o.continued = &continuation{replaced: generation, stream: playlist.Resume(previous, preset.PlaylistLength)}
+	o.final = nil
+	o.target = time.Duration(preset.SegmentDuration) * time.Second
+	o.window = time.Duration(preset.SegmentDuration*preset.PlaylistLength) * time.Second
+}
+
+// continuedPlaylist returns data, a live revision of the playlist, as the
+// continuation of the generation a takeover replaced, false when the
+// playlist is not continued
+func (o *outputGenerations) continuedPlaylist(data []byte) ([]byte, bool) {
+	o.Lock()
+	defer o.Unlock()
+	c := o.continued
+	if c == nil {
+		return data, false
+	}
+	m, err := hlscheck.ParseMedia(data)
+	if err != nil {
+		return data, false
+	}
+	if !c.sync(m) {
+		// a later generation, not a takeover, is served
+		o.continued = nil
+		return data, false
+	}
+	return c.render(), true
+}
+
+// continuation is the playlist of the generation following a takeover
+type continuation struct {
+	// replaced is the generation taken over
+	replaced int64
+	stream   *playlist.Stream
+	// generation continues replaced, zero until its segments are listed
+	generation int64
+	// appended is the index of the next segment of generation to append
+	appended int
+}
+
+// sync appends the segments of m, a revision of the playlist hlssink
+// writes, not appended yet. It reports false when m is the playlist of a
+// generation other than the one continuing.
+func (c *continuation) sync(m *hlscheck.Media) bool {
+	for _, segment := range m.Segments {
+		generation, index, ok := segmentGeneration(path.Base(segment.URI))
+		switch {
+		case !ok:
+			return false
+		case generation <= c.replaced:
+			// the last revision of the taken over generation is still on disk
+			continue
+		case c.generation == 0:
+			c.generation = generation
+		case generation != c.generation:
+			return false
+		}
+		if index >= c.appended {
+			c.stream.Append(playlist.Segment{URI: segment.URI, Duration: segment.Duration})
+			c.appended = index + 1
+		}
+	}
+	if m.Ended && c.generation != 0 {
+		c.stream.End()
+	}
+	return true
+}
+
+func (c *continuation) render() []byte {
+	var buf bytes.Buffer
+	c.stream.Media().Write(&buf)
+	return buf.Bytes()
+}
+
+// segmentGeneration returns the generation and index of a segment file
+// name, false for other files
+func segmentGeneration(name string) (int64, int, bool) {
+	rest := strings.TrimPrefix(name, segmentName+"-")
+	dash := strings.IndexByte(rest, '-')
+	if rest == name || dash < 0 {
+		return 0, 0, false
+	}
+	generation, err := strconv.ParseInt(rest[:dash], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	index, ok := segmentIndex(name, segmentPrefix(generation))
+	return generation, index, ok
+}
+
+// finalPlaylist returns the ENDLIST revision of the last ended generation,
+// nil when none is held
+func (o *outputGenerations) finalPlaylist() []byte {
+	o.Lock()
+	defer o.Unlock()
+	return o.final
+}
+
+// held returns the final playlist to serve instead of the live one, or nil.
+// It is held until it was served and players had two target durations to
+// reload it, or for a playlist window when nobody asks for it.
+func (o *outputGenerations) held() []byte {
+	o.Lock()
+	defer o.Unlock()
+	if o.final == nil {
+		return nil
+	}
+	now := o.now()
+	switch {
+	case now.Sub(o.endedAt) >= o.window:
+	case !o.firstServed.IsZero() && now.Sub(o.firstServed) >= 2*o.target:
+	default:
+		if o.firstServed.IsZero() {
+			o.firstServed = now
+		}
+		return o.final
+	}
+	o.final = nil
+	return nil
+}
+
+// removeGeneration deletes the segments of generation from dir, LL-HLS
+// parts, fMP4 initialization sections, DASH output and ABR renditions
+// included
+func removeGeneration(dir string, generation int64) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	os.RemoveAll(dashDir(dir, generation))
+	prefix, ll := segmentPrefix(generation), llPrefix(generation)
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() {
+			// the directory of a rung
+			removeGeneration(filepath.Join(dir, name), generation)
+			continue
+		}
+		if (strings.HasPrefix(name, prefix) || strings.HasPrefix(name, ll)) && segmentFile(name) {
+			os.Remove(filepath.Join(dir, name))
+		}
+	}
+}
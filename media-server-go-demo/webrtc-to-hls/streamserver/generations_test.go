@@ -0,0 +1,264 @@
+package streamserver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/hlscheck"
+)
+
+func writeGeneration(t *testing.T, dir string, generation int64, first, last int, ended bool) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:%d\n", first)
+	for i := first; i <= last; i++ {
+		name := fmt.Sprintf("%s%05d.ts", segmentPrefix(generation), i)
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(fmt.Sprintf("%d/%d", generation, i)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(&b, "#EXTINF:2,\n%s\n", name)
+	}
+	if ended {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, playlistName), []byte(b.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestStreamIDReuse follows a player across two back to back sessions
+// writing the same served directory
+func TestStreamIDReuse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "generations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	t.Setenv("playlist_validation", "off")
+
+	now := time.Unix(1000, 0)
+	saved := outputs
+	outputs = newStreamOutputs(func() time.Time { return now })
+	defer func() { outputs = saved }()
+	out := outputs.get("reuse")
+	dir = out.dir
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(servePlaylist)
+	r.Use(serveMedia)
+	get := func(path string) (int, string) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code, w.Body.String()
+	}
+	preset := presets[client.LatencyBalanced]
+
+	first := out.generations.next()
+	writeGeneration(t, dir, first, 0, 4, false)
+	if _, body := get(outputPath("reuse")); !strings.Contains(body, segmentPrefix(first)) {
+		t.Fatalf("live playlist = %q", body)
+	}
+
+	// the publisher reconnects right away with the same key
+	writeGeneration(t, dir, first, 0, 5, true)
+	out.generations.ended(first, mustRead(t, out.playlist()), preset)
+	restarts := pipelineRestarts.Value("")
+	second := out.generations.next()
+	if pipelineRestarts.Value("") != restarts+1 {
+		t.Fatal("restart of the output not counted")
+	}
+	if second == first {
+		t.Fatal("generation reused")
+	}
+	os.Remove(filepath.Join(dir, fmt.Sprintf("%s%05d.ts", segmentPrefix(first), 0)))
+	writeGeneration(t, dir, second, 0, 1, false)
+	if newest := newestSegment(dir, second); newest != 1 {
+		t.Fatalf("newest segment of the new generation = %d", newest)
+	}
+	if newest := newestSegment(dir, second+1); newest != -1 {
+		t.Fatalf("newest segment of a generation without any = %d", newest)
+	}
+
+	// the overlapping player reloads and gets the ended session first
+	_, body := get(outputPath("reuse"))
+	if !strings.Contains(body, "#EXT-X-ENDLIST") || strings.Contains(body, segmentPrefix(second)) {
+		t.Fatalf("held playlist = %q", body)
+	}
+	if code, body := get(fmt.Sprintf("/hls/reuse/%s%05d.ts", segmentPrefix(first), 5)); code != http.StatusOK || body != fmt.Sprintf("%d/5", first) {
+		t.Fatalf("old segment = %d %q", code, body)
+	}
+	if code, _ := get(fmt.Sprintf("/hls/reuse/%s%05d.ts", segmentPrefix(first), 0)); code != http.StatusNotFound {
+		t.Fatalf("removed old segment = %d", code)
+	}
+
+	now = now.Add(3 * time.Second)
+	if _, body := get(outputPath("reuse")); !strings.Contains(body, "#EXT-X-ENDLIST") {
+		t.Fatal("switched before players had time to reload")
+	}
+	now = now.Add(2 * time.Second)
+	if _, body := get(outputPath("reuse")); !strings.Contains(body, segmentPrefix(second)) {
+		t.Fatalf("switched playlist = %q", body)
+	}
+
+	removeGeneration(dir, first)
+	if code, _ := get(fmt.Sprintf("/hls/reuse/%s%05d.ts", segmentPrefix(first), 5)); code != http.StatusNotFound {
+		t.Fatalf("old generation segment served after removal: %d", code)
+	}
+}
+
+// TestConcurrentStreams serves two stream keys publishing at once, each
+// from the directory of its own output
+func TestConcurrentStreams(t *testing.T) {
+	dir, err := ioutil.TempDir("", "streams")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	now := time.Unix(1000, 0)
+	saved := outputs
+	outputs = newStreamOutputs(func() time.Time { return now })
+	defer func() { outputs = saved }()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(servePlaylist)
+	r.Use(serveMedia)
+	get := func(path string) (int, string) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code, w.Body.String()
+	}
+
+	generations := map[string]int64{}
+	for _, key := range []string{"studio-a", "studio-b"} {
+		out := outputs.get(key)
+		if out.dir != filepath.Join(hlsDir, key) {
+			t.Fatalf("output of %s in %s", key, out.dir)
+		}
+		os.MkdirAll(out.dir, 0755)
+		generations[key] = out.generations.next()
+		writeGeneration(t, out.dir, generations[key], 0, 2, false)
+	}
+	if generations["studio-a"] != generations["studio-b"] {
+		t.Fatal("streams share a generation sequence")
+	}
+	a := outputs.get("studio-a")
+	a.generations.ended(generations["studio-a"], mustRead(t, a.playlist()), presets[client.LatencyBalanced])
+
+	if code, body := get(outputPath("studio-b")); code != http.StatusOK || strings.Contains(body, "#EXT-X-ENDLIST") {
+		t.Fatalf("studio-b = %d %q", code, body)
+	}
+	for _, key := range []string{"studio-a", "studio-b"} {
+		segment := fmt.Sprintf("/hls/%s/%s%05d.ts", key, segmentPrefix(generations[key]), 1)
+		if code, body := get(segment); code != http.StatusOK || body != fmt.Sprintf("%d/1", generations[key]) {
+			t.Fatalf("%s = %d %q", segment, code, body)
+		}
+	}
+	if code, _ := get(outputPath("nobody")); code != http.StatusNotFound {
+		t.Fatalf("unknown stream = %d", code)
+	}
+}
+
+func TestHeldPlaylistExpires(t *testing.T) {
+	now := time.Unix(1000, 0)
+	o := &outputGenerations{now: func() time.Time { return now }}
+	generation := o.next()
+	final := []byte("#EXTM3U\n#EXTINF:2,\n" + segmentPrefix(generation) + "00000.ts\n#EXT-X-ENDLIST\n")
+
+	o.ended(generation+1, final, presets[client.LatencyBalanced])
+	if o.held() != nil {
+		t.Fatal("held a playlist of another generation")
+	}
+	o.ended(generation, final, presets[client.LatencyBalanced])
+	now = now.Add(12 * time.Second)
+	if o.held() != nil {
+		t.Fatal("held past the playlist window")
+	}
+}
+
+// TestTakeoverContinuesPlaylist follows a player across a takeover: the
+// playlist goes on with a discontinuity, its sequence numbers continuing
+func TestTakeoverContinuesPlaylist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "takeover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	preset := presets[client.LatencyBalanced]
+	preset.SegmentDuration, preset.PlaylistLength = 2, 3
+	o := &outputGenerations{now: time.Now, dir: dir}
+	serve := func() *hlscheck.Media {
+		data, _ := o.continuedPlaylist(mustRead(t, filepath.Join(dir, playlistName)))
+		m, err := hlscheck.ParseMedia(data)
+		if err != nil {
+			t.Fatalf("%v\n%s", err, data)
+		}
+		return m
+	}
+
+	first := o.next()
+	writeGeneration(t, dir, first, 4, 6, true)
+	if !o.replaced(first, mustRead(t, filepath.Join(dir, playlistName)), preset) {
+		t.Fatal("takeover playlist not continued")
+	}
+	if o.held() != nil {
+		t.Fatal("ENDLIST held for a takeover")
+	}
+	// the replaced playlist is still on disk, without its ENDLIST
+	m := serve()
+	if m.Ended || m.MediaSequence != 4 || len(m.Segments) != 3 {
+		t.Fatalf("before the new output: %+v", m)
+	}
+
+	second := o.next()
+	writeGeneration(t, dir, second, 0, 1, false)
+	next := serve()
+	if err := next.Check(m); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := o.continuedPlaylist(mustRead(t, filepath.Join(dir, playlistName)))
+	if next.MediaSequence != 6 || len(next.Segments) != 3 || !strings.Contains(string(data), "#EXT-X-DISCONTINUITY\n#EXTINF:2.000,\n"+segmentPrefix(second)+"00000.ts") {
+		t.Fatalf("continued playlist:\n%s", data)
+	}
+
+	writeGeneration(t, dir, second, 0, 4, true)
+	o.ended(second, mustRead(t, filepath.Join(dir, playlistName)), preset)
+	final := o.held()
+	if m, err := hlscheck.ParseMedia(final); err != nil || !m.Ended || m.MediaSequence != 9 {
+		t.Fatalf("final playlist:\n%s", final)
+	}
+	if _, continued := o.continuedPlaylist(final); continued {
+		t.Fatal("continued past the end of the takeover")
+	}
+}
+
+func mustRead(t *testing.T, path string) []byte {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
@@ -0,0 +1,185 @@
+package streamserver
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"github.com/notedit/sdp"
+)
+
+// the H.264 NAL unit types the parameter sets are handled by
+const (
+	nalIDR = 5
+	nalSPS = 7
+	nalPPS = 8
+	nalAUD = 9
+)
+
+var annexBStart = []byte{0, 0, 0, 1}
+
+// h264Params keeps the parameter sets of an H.264 publish, SPS and PPS, to
+// precede every IDR of its output with them, so that each segment, which
+// starts with an IDR, decodes on its own. Publishers sending them in band
+// once, or only out of band in the sprop-parameter-sets of their offer,
+// otherwise get segments, the first one included, that players cannot
+// decode. The sets sent in band replace those known so far. Guarded by the
+// lock of the session.
+type h264Params struct {
+	sps, pps [][]byte
+	// idr is set once an IDR went out, the frames before it, which nothing
+	// decodes, being dropped
+	idr bool
+}
+
+// spropParameterSets parses the sprop-parameter-sets of the fmtp of an
+// H.264 codec (RFC 6184 8.1): NAL units in base64, separated by commas.
+// Their padding is optional, as the SDP library drops it.
+func spropParameterSets(value string) (h264Params, error) {
+	var p h264Params
+	for _, set := range strings.Split(value, ",") {
+		set = strings.TrimRight(strings.TrimSpace(set), "=")
+		if set == "" {
+			continue
+		}
+		nal, err := base64.RawStdEncoding.DecodeString(set)
+		if err != nil {
+			return h264Params{}, err
+		}
+		if len(nal) == 0 {
+			continue
+		}
+		switch nal[0] & 0x1f {
+		case nalSPS:
+			p.sps = append(p.sps, nal)
+		case nalPPS:
+			p.pps = append(p.pps, nal)
+		}
+	}
+	if p.sps == nil || p.pps == nil {
+		return h264Params{}, errors.New("sprop-parameter-sets without both an SPS and a PPS")
+	}
+	return p, nil
+}
+
+// offeredParameterSets are those of the sprop-parameter-sets of the H.264
+// codec answered, none when the offer has none for it
+func offeredParameterSets(offer, answer *sdp.SDPInfo) h264Params {
+	offered, answered := offer.GetMedia("video"), answer.GetMedia("video")
+	if offered == nil || answered == nil {
+		return h264Params{}
+	}
+	for pt, codec := range answered.GetCodecs() {
+		if !strings.EqualFold(codec.GetCodec(), codecH264) {
+			continue
+		}
+		source := offered.GetCodecs()[pt]
+		if source == nil {
+			continue
+		}
+		for name, value := range source.GetParams() {
+			if !strings.EqualFold(strings.TrimSpace(name), "sprop-parameter-sets") {
+				continue
+			}
+			if p, err := spropParameterSets(value); err == nil {
+				return p
+			}
+		}
+	}
+	return h264Params{}
+}
+
+// complete is frame, an Annex B access unit, with the parameter sets known
+// inserted before its IDR when it does not carry both; nil for the frames
+// before the first IDR. The sets frame carries are kept for the next IDRs.
+func (p *h264Params) complete(frame []byte) []byte {
+	var sps, pps [][]byte
+	var idr, aud bool
+	for i, nal := range splitAnnexB(frame) {
+		switch nal[0] & 0x1f {
+		case nalSPS:
+			sps = append(sps, append([]byte(nil), nal...))
+		case nalPPS:
+			pps = append(pps, append([]byte(nil), nal...))
+		case nalIDR:
+			idr = true
+		case nalAUD:
+			aud = aud || i == 0
+		}
+	}
+	if sps != nil {
+		p.sps = sps
+	}
+	if pps != nil {
+		p.pps = pps
+	}
+	if !idr {
+		if !p.idr {
+			return nil
+		}
+		return frame
+	}
+	p.idr = true
+	if (sps != nil && pps != nil) || p.sps == nil || p.pps == nil {
+		return frame
+	}
+	var out bytes.Buffer
+	rest := frame
+	if aud {
+		// the access unit delimiter stays first
+		end := nextStartCode(frame, 3)
+		out.Write(frame[:end])
+		rest = frame[end:]
+	}
+	for _, nal := range append(append([][]byte(nil), p.sps...), p.pps...) {
+		out.Write(annexBStart)
+		out.Write(nal)
+	}
+	out.Write(rest)
+	return out.Bytes()
+}
+
+// splitAnnexB are the NAL units of an Annex B access unit, without their
+// start codes
+func splitAnnexB(frame []byte) [][]byte {
+	var nals [][]byte
+	start := -1
+	for i := 0; i+2 < len(frame); i++ {
+		if frame[i] != 0 || frame[i+1] != 0 || frame[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			nals = appendNAL(nals, frame[start:i])
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 {
+		nals = appendNAL(nals, frame[start:])
+	}
+	return nals
+}
+
+// appendNAL appends nal less the zeros of the start code after it
+func appendNAL(nals [][]byte, nal []byte) [][]byte {
+	nal = bytes.TrimRight(nal, "\x00")
+	if len(nal) == 0 {
+		return nals
+	}
+	return append(nals, nal)
+}
+
+// nextStartCode is the offset of the first start code of frame at or past
+// from, counting the zero before a four byte one, len(frame) when none
+func nextStartCode(frame []byte, from int) int {
+	for i := from; i+2 < len(frame); i++ {
+		if frame[i] == 0 && frame[i+1] == 0 && frame[i+2] == 1 {
+			if i > from && frame[i-1] == 0 {
+				return i - 1
+			}
+			return i
+		}
+	}
+	return len(frame)
+}
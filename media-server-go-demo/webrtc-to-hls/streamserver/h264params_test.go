@@ -0,0 +1,57 @@
+package streamserver
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSpropParameterSets(t *testing.T) {
+	// the SDP library drops the padding of the last set
+	p, err := spropParameterSets("Z0LAH9oBQBbpUgAAAwACAAADAGQeMGVA,aM4yyA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.sps) != 1 || p.sps[0][0] != 0x67 || len(p.pps) != 1 || !bytes.Equal(p.pps[0], []byte{0x68, 0xce, 0x32, 0xc8}) {
+		t.Fatalf("sets %x %x", p.sps, p.pps)
+	}
+	if _, err := spropParameterSets("Z0LAH9oBQBbpUgAAAwACAAADAGQeMGVA"); err == nil {
+		t.Fatal("sets without a PPS")
+	}
+	if _, err := spropParameterSets("not base64!,aM4yyA=="); err == nil {
+		t.Fatal("sets not in base64")
+	}
+}
+
+func TestCompleteIDR(t *testing.T) {
+	sps, pps := []byte{0x67, 0x42, 0xc0, 0x1f}, []byte{0x68, 0xce, 0x32, 0xc8}
+	p := h264Params{sps: [][]byte{sps}, pps: [][]byte{pps}}
+	if p.complete([]byte{0, 0, 0, 1, 0x41, 1}) != nil {
+		t.Fatal("frame before the first IDR kept")
+	}
+	idr := []byte{0, 0, 0, 1, 0x65, 1, 2}
+	want := append(append(append([]byte{0, 0, 0, 1}, sps...), append([]byte{0, 0, 0, 1}, pps...)...), idr...)
+	if got := p.complete(idr); !bytes.Equal(got, want) {
+		t.Fatalf("IDR = %x", got)
+	}
+	if got := p.complete([]byte{0, 0, 1, 0x41, 3}); !bytes.Equal(got, []byte{0, 0, 1, 0x41, 3}) {
+		t.Fatalf("frame after the IDR = %x", got)
+	}
+
+	// the sets sent in band are left alone, and replace those of the offer
+	inband := []byte{0, 0, 0, 1, 0x67, 0x64, 0, 0x28, 0, 0, 0, 1, 0x68, 0xee, 0, 0, 1, 0x65, 9}
+	if got := p.complete(inband); !bytes.Equal(got, inband) {
+		t.Fatalf("IDR with its sets = %x", got)
+	}
+	// the access unit delimiter stays first
+	got := p.complete([]byte{0, 0, 0, 1, 0x09, 0xf0, 0, 0, 0, 1, 0x65, 4})
+	want = []byte{0, 0, 0, 1, 0x09, 0xf0, 0, 0, 0, 1, 0x67, 0x64, 0, 0x28, 0, 0, 0, 1, 0x68, 0xee, 0, 0, 0, 1, 0x65, 4}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("IDR after a delimiter = %x", got)
+	}
+
+	// without sets, the IDR goes out as it is
+	var none h264Params
+	if got := none.complete(idr); !bytes.Equal(got, idr) {
+		t.Fatalf("IDR without sets = %x", got)
+	}
+}
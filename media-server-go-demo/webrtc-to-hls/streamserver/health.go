@@ -0,0 +1,163 @@
+package streamserver
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	gstreamer "github.com/notedit/gstreamer-go"
+)
+
+var errNoUDPPort = errors.New("the media endpoint did not bind a UDP port")
+
+// healthTimeout bounds the checks of a probe
+const healthTimeout = 2 * time.Second
+
+// gstreamerProbe is a pipeline of the elements every output needs, which
+// only parses once GStreamer is initialized with its plugins installed
+const gstreamerProbe = "appsrc name=probesrc ! h264parse ! mpegtsmux ! hlssink"
+
+// healthCheck is a dependency a probe checks
+type healthCheck struct {
+	name  string
+	check func(context.Context) error
+}
+
+// gstreamerReady checks the GStreamer runtime once: the plugins installed
+// do not change while the process runs, and every pipeline parsed is kept
+// by gstreamer-go
+var gstreamerReady = func() func(context.Context) error {
+	var once sync.Once
+	var err error
+	return func(context.Context) error {
+		once.Do(func() {
+			var pipeline *gstreamer.Pipeline
+			if pipeline, err = gstreamer.New(gstreamerProbe); err == nil {
+				pipeline.Stop()
+			}
+		})
+		return err
+	}
+}()
+
+// endpointReady checks a media endpoint binds a UDP port for transports
+func endpointReady(context.Context) error {
+	endpoint := newEndpoint(nil)
+	defer releaseEndpoint(endpoint)
+	if candidates := endpoint.GetLocalCandidates(); len(candidates) == 0 || candidates[0].GetPort() == 0 {
+		return errNoUDPPort
+	}
+	return nil
+}
+
+// outputWritable checks outputs can be written to hlsDir
+func outputWritable(context.Context) error {
+	f, err := ioutil.TempFile(hlsDir, ".healthz-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// directoryReachable checks the Redis of the cluster answers
+func directoryReachable(ctx context.Context) error {
+	if pinger, ok := directory.(interface{ Ping(context.Context) error }); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+// notDraining fails while the instance drains, see startDrain
+func notDraining(context.Context) error {
+	if drain.active() {
+		return errDraining
+	}
+	return nil
+}
+
+// livenessChecks are what /healthz checks: the process can serve streams
+// at all
+func livenessChecks() []healthCheck {
+	return []healthCheck{
+		{"gstreamer", gstreamerReady},
+		{"endpoint", endpointReady},
+	}
+}
+
+// readinessChecks are what /readyz checks: the instance can take new
+// publishes now. Redis is only checked with cluster_redis set.
+func readinessChecks() []healthCheck {
+	checks := append(livenessChecks(), healthCheck{"storage", outputWritable})
+	if directory != nil {
+		checks = append(checks, healthCheck{"redis", directoryReachable})
+	}
+	return append(checks, healthCheck{"drain", notDraining})
+}
+
+// runChecks runs checks side by side, returning the result of each by name,
+// ok or the error, and whether all passed
+func runChecks(ctx context.Context, checks []healthCheck) (map[string]string, bool) {
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+	results := make([]error, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check healthCheck) {
+			defer wg.Done()
+			done := make(chan error, 1)
+			go func() { done <- check.check(ctx) }()
+			select {
+			case results[i] = <-done:
+			case <-ctx.Done():
+				results[i] = ctx.Err()
+			}
+		}(i, check)
+	}
+	wg.Wait()
+	report, healthy := map[string]string{}, true
+	for i, check := range checks {
+		if results[i] != nil {
+			report[check.name], healthy = results[i].Error(), false
+			continue
+		}
+		report[check.name] = "ok"
+	}
+	return report, healthy
+}
+
+// answerChecks answers 200 when checks pass, 503 naming the failing ones
+// otherwise
+func answerChecks(c *gin.Context, checks []healthCheck) {
+	report, healthy := runChecks(c.Request.Context(), checks)
+	if healthy {
+		c.JSON(http.StatusOK, gin.H{"status": "ok", "checks": report})
+		return
+	}
+	var failing []string
+	for name, result := range report {
+		if result != "ok" {
+			failing = append(failing, name)
+		}
+	}
+	sort.Strings(failing)
+	logger.Warn("health check failed", "path", c.Request.URL.Path, "failing", failing)
+	c.JSON(http.StatusServiceUnavailable, gin.H{"status": "failing", "failing": failing, "checks": report})
+}
+
+// healthz handles GET /healthz, the liveness probe
+func healthz(c *gin.Context) {
+	answerChecks(c, livenessChecks())
+}
+
+// readyz handles GET /readyz, the readiness probe
+func readyz(c *gin.Context) {
+	answerChecks(c, readinessChecks())
+}
@@ -0,0 +1,62 @@
+package streamserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/cluster"
+)
+
+func TestHealthChecks(t *testing.T) {
+	savedDir, savedDirectory := hlsDir, directory
+	defer func() { hlsDir, directory = savedDir, savedDirectory }()
+	hlsDir = t.TempDir()
+	ctx := context.Background()
+	if err := outputWritable(ctx); err != nil {
+		t.Fatal(err)
+	}
+	hlsDir = hlsDir + "/missing"
+	if err := outputWritable(ctx); err == nil {
+		t.Fatal("missing output directory writable")
+	}
+	directory = cluster.NewMemory(time.Now)
+	if err := directoryReachable(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	checks := []healthCheck{
+		{"fine", func(context.Context) error { return nil }},
+		{"broken", func(context.Context) error { return errors.New("broken") }},
+	}
+	r.GET("/healthz", func(c *gin.Context) { answerChecks(c, checks[:1]) })
+	r.GET("/readyz", func(c *gin.Context) { answerChecks(c, checks) })
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+	if w := get("/healthz"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"fine":"ok"`) {
+		t.Fatalf("healthz = %d %s", w.Code, w.Body)
+	}
+	if w := get("/readyz"); w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), `"failing":["broken"]`) {
+		t.Fatalf("readyz = %d %s", w.Code, w.Body)
+	}
+
+	// a check that hangs fails once the probe times out
+	release := make(chan struct{})
+	defer close(release)
+	hung := []healthCheck{{"hung", func(context.Context) error { <-release; return nil }}}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if report, healthy := runChecks(ctx, hung); healthy || report["hung"] != context.DeadlineExceeded.Error() {
+		t.Fatalf("hung check = %v", report)
+	}
+}
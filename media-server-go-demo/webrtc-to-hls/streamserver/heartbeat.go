@@ -0,0 +1,153 @@
+package streamserver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/budget"
+)
+
+// syntheticManifest lists when the output carried heartbeat frames instead
+// of published media, so analytics can exclude those segments
+var syntheticManifest = "synthetic.json"
+
+// syntheticRange is a span of wallclock time filled with heartbeat frames
+type syntheticRange struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end,omitempty"`
+}
+
+// heartbeat keeps the playlist advancing while the publisher sends nothing
+// (paused, held, or a sparse source) by repeating the last keyframe. All
+// methods are called with the session lock held.
+type heartbeat struct {
+	// gap is how long input may be missing before frames are synthesized
+	gap time.Duration
+
+	// memory holds the keyframe copy
+	memory charge
+
+	keyframe  []byte
+	lastReal  time.Time
+	synthetic bool
+	ranges    []syntheticRange
+}
+
+// heartbeatFor returns the heartbeat of key when heartbeat / heartbeat_overrides
+// enable it, nil otherwise
+func heartbeatFor(key string, segmentDuration int, account *budget.Account) *heartbeat {
+	if envForKey("heartbeat", key) != "on" {
+		return nil
+	}
+	return &heartbeat{
+		gap:    time.Duration(segmentDuration) * time.Second / 2,
+		memory: charge{account: account},
+	}
+}
+
+// real records a published frame and reports whether it may be pushed:
+// after a synthetic run, output resumes on the next keyframe so the
+// first real segment starts cleanly
+func (h *heartbeat) real(frame []byte, keyframe bool, now time.Time) bool {
+	h.lastReal = now
+	if keyframe {
+		h.cacheKeyframe(frame)
+	}
+	if !h.synthetic {
+		return true
+	}
+	if !keyframe {
+		return false
+	}
+	h.synthetic = false
+	h.ranges[len(h.ranges)-1].End = now
+	return true
+}
+
+// cacheKeyframe copies frame, into a buffer allocated to its exact size
+// when the cached one is too small, so the reservation is what it holds
+func (h *heartbeat) cacheKeyframe(frame []byte) {
+	if len(frame) > cap(h.keyframe) {
+		if !h.memory.sync(int64(len(frame))) {
+			// over budget: no heartbeat rather than unaccounted memory
+			h.memory.sync(0)
+			h.keyframe = nil
+			return
+		}
+		h.keyframe = make([]byte, len(frame))
+	}
+	h.keyframe = h.keyframe[:len(frame)]
+	copy(h.keyframe, frame)
+}
+
+// due returns the frame to push now, if input has been missing for longer
+// than the gap
+func (h *heartbeat) due(now time.Time) []byte {
+	if h.keyframe == nil || now.Sub(h.lastReal) < h.gap {
+		return nil
+	}
+	if !h.synthetic {
+		h.synthetic = true
+		h.ranges = append(h.ranges, syntheticRange{Start: now})
+	}
+	return h.keyframe
+}
+
+func (h *heartbeat) manifest() []syntheticRange {
+	return append([]syntheticRange(nil), h.ranges...)
+}
+
+func writeSyntheticManifest(dir string, ranges []syntheticRange) error {
+	data, err := json.Marshal(map[string]interface{}{"ranges": ranges})
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, syntheticManifest)
+	if err := ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// runHeartbeat pushes two heartbeat frames per second for as long as the
+// session is open and the publisher stays silent
+func (s *session) runHeartbeat() {
+	if s.heartbeat == nil {
+		return
+	}
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	written := 0
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		s.Lock()
+		// the fallback slate, showing, is the output
+		if s.hls != nil && (s.fallback == nil || !s.fallback.showing) {
+			if frame := s.heartbeat.due(time.Now()); frame != nil {
+				s.output(frame, frameTime{}, videoKeyframe(s.inputCodec(), frame))
+			}
+		}
+		ranges := s.heartbeat.manifest()
+		s.Unlock()
+
+		// rewritten when a range starts and when it ends
+		changed := len(ranges) * 2
+		if len(ranges) > 0 && ranges[len(ranges)-1].End.IsZero() {
+			changed--
+		}
+		if changed != written {
+			if err := writeSyntheticManifest(outputDir(s.key), ranges); err != nil {
+				s.logf("heartbeat manifest: %v", err)
+				continue
+			}
+			written = changed
+		}
+	}
+}
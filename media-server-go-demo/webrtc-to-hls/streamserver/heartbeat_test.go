@@ -0,0 +1,62 @@
+package streamserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/budget"
+)
+
+func TestHeartbeat(t *testing.T) {
+	h := &heartbeat{gap: time.Second, memory: charge{account: budget.New(0).Account("live", 0)}}
+	idr := []byte{0, 0, 0, 1, 0x65, 1}
+	slice := []byte{0, 0, 0, 1, 0x41, 2}
+	now := time.Unix(1700000000, 0)
+
+	if h.due(now.Add(time.Hour)) != nil {
+		t.Fatal("heartbeat before any keyframe")
+	}
+	h.real(idr, true, now)
+	h.real(slice, false, now.Add(100*time.Millisecond))
+	if h.due(now.Add(500*time.Millisecond)) != nil {
+		t.Fatal("heartbeat within the gap")
+	}
+	if frame := h.due(now.Add(2 * time.Second)); string(frame) != string(idr) {
+		t.Fatalf("heartbeat frame = %v", frame)
+	}
+
+	// real media resumes on a keyframe only
+	if h.real(slice, false, now.Add(3*time.Second)) {
+		t.Fatal("non keyframe pushed while resuming")
+	}
+	if !h.real(idr, true, now.Add(3500*time.Millisecond)) {
+		t.Fatal("keyframe dropped while resuming")
+	}
+	ranges := h.manifest()
+	if len(ranges) != 1 || !ranges[0].Start.Equal(now.Add(2*time.Second)) || !ranges[0].End.Equal(now.Add(3500*time.Millisecond)) {
+		t.Fatalf("ranges = %+v", ranges)
+	}
+	if !h.real(slice, false, now.Add(3600*time.Millisecond)) {
+		t.Fatal("frame dropped after resuming")
+	}
+}
+
+func TestHeartbeatMemory(t *testing.T) {
+	account := budget.New(0).Account("live", 100)
+	h := &heartbeat{gap: time.Second, memory: charge{account: account}}
+	h.real(make([]byte, 60), true, time.Now())
+	h.real(make([]byte, 40), true, time.Now())
+	// the smaller keyframe reuses the buffer reserved for the first
+	if used := account.Usage().Used; used != 60 || cap(h.keyframe) != 60 || len(h.keyframe) != 40 {
+		t.Fatalf("used %d for a keyframe of %d in %d", used, len(h.keyframe), cap(h.keyframe))
+	}
+	h.real(make([]byte, 90), true, time.Now())
+	if used := account.Usage().Used; used != 90 || cap(h.keyframe) != 90 {
+		t.Fatalf("used %d for a buffer of %d", used, cap(h.keyframe))
+	}
+	// over budget the cached keyframe is given up, and all it held
+	h.real(make([]byte, 120), true, time.Now())
+	if used := account.Usage().Used; used != 0 || h.keyframe != nil {
+		t.Fatalf("used %d over budget", used)
+	}
+}
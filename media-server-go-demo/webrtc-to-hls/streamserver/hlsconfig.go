@@ -0,0 +1,180 @@
+package streamserver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"gopkg.in/yaml.v2"
+)
+
+// where hlssink writes its output: a directory per stream key below
+// hlsDir, served at /hls/<key>/. setupHLS replaces the defaults.
+var (
+	hlsDir       = "hls"
+	playlistName = "playlist.m3u8"
+	// segmentName starts the segment names, <name>-<generation>-<n>.ts or
+	// .m4s
+	segmentName = "segment"
+	// deleteOldSegments removes the segments past max-files and those of
+	// ended generations; off keeps them all, e.g. to cut recordings from
+	deleteOldSegments = true
+)
+
+// hlsConfig is the HLS packaging, read from the YAML file hls_config names:
+//
+//	output_dir: /var/lib/webrtc-to-hls
+//	segment_name: seg
+//	delete_old_segments: false
+//	dash: true
+//	container: fmp4
+//	presets:
+//	  low-latency:
+//	    segment_duration: 1
+//	    playlist_length: 4
+//
+// Unset settings keep their default; dash is the default of resolveDASH and
+// container, ts or fmp4, that of resolveContainer.
+// Each one is overridden by an
+// environment variable: hls_output_dir, hls_segment_name,
+// hls_delete_old_segments, and hls_<preset>_segment_duration,
+// hls_<preset>_playlist_length, hls_<preset>_max_files and
+// hls_<preset>_keyframe_interval_ms, dashes in the preset name written as
+// underscores, e.g. hls_low_latency_playlist_length.
+type hlsConfig struct {
+	OutputDir         string                  `yaml:"output_dir"`
+	SegmentName       string                  `yaml:"segment_name"`
+	DeleteOldSegments *bool                   `yaml:"delete_old_segments"`
+	DASH              bool                    `yaml:"dash"`
+	Container         string                  `yaml:"container"`
+	Presets           map[string]presetConfig `yaml:"presets"`
+}
+
+// presetConfig overrides the packaging of a latency preset
+type presetConfig struct {
+	SegmentDuration  int `yaml:"segment_duration"`
+	PlaylistLength   int `yaml:"playlist_length"`
+	MaxFiles         int `yaml:"max_files"`
+	KeyframeInterval int `yaml:"keyframe_interval_ms"`
+}
+
+// loadHLSConfig reads the config file at path, none when path is empty, and
+// applies the environment overrides on top
+func loadHLSConfig(path string) (hlsConfig, error) {
+	var config hlsConfig
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return config, err
+		}
+		// strict, a misspelt setting must not be silently ignored
+		if err := yaml.UnmarshalStrict(data, &config); err != nil {
+			return config, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	if dir := os.Getenv("hls_output_dir"); dir != "" {
+		config.OutputDir = dir
+	}
+	if name := os.Getenv("hls_segment_name"); name != "" {
+		config.SegmentName = name
+	}
+	if value := os.Getenv("hls_delete_old_segments"); value != "" {
+		remove, err := strconv.ParseBool(value)
+		if err != nil {
+			return config, fmt.Errorf("hls_delete_old_segments: %v", err)
+		}
+		config.DeleteOldSegments = &remove
+	}
+	for name := range builtinPresets {
+		override := config.Presets[name]
+		prefix := "hls_" + strings.Replace(name, "-", "_", -1) + "_"
+		override.SegmentDuration = envInt(prefix+"segment_duration", override.SegmentDuration)
+		override.PlaylistLength = envInt(prefix+"playlist_length", override.PlaylistLength)
+		override.MaxFiles = envInt(prefix+"max_files", override.MaxFiles)
+		override.KeyframeInterval = envInt(prefix+"keyframe_interval_ms", override.KeyframeInterval)
+		if override != (presetConfig{}) {
+			if config.Presets == nil {
+				config.Presets = make(map[string]presetConfig)
+			}
+			config.Presets[name] = override
+		}
+	}
+	return config, nil
+}
+
+// apply makes config the packaging of new pipelines, failing without
+// changing anything when it leaves a preset inconsistent
+func (config hlsConfig) apply() error {
+	if strings.ContainsAny(config.SegmentName, `/\%`) {
+		return fmt.Errorf("segment_name %q: must be a plain file name", config.SegmentName)
+	}
+	if config.Container != "" && !validContainer(config.Container) {
+		return fmt.Errorf("container %q: must be %s or %s", config.Container, containerTS, containerFMP4)
+	}
+	remove := deleteOldSegments
+	if config.DeleteOldSegments != nil {
+		remove = *config.DeleteOldSegments
+	}
+	for name := range config.Presets {
+		if _, ok := builtinPresets[name]; !ok {
+			return fmt.Errorf("presets: unknown latency preset %q", name)
+		}
+	}
+
+	resolved := make(map[string]client.Preset, len(builtinPresets))
+	for name, preset := range builtinPresets {
+		override := config.Presets[name]
+		if override.SegmentDuration != 0 {
+			preset.SegmentDuration = override.SegmentDuration
+		}
+		if override.PlaylistLength != 0 {
+			preset.PlaylistLength = override.PlaylistLength
+		}
+		if override.MaxFiles != 0 {
+			preset.MaxFiles = override.MaxFiles
+		}
+		if override.KeyframeInterval != 0 {
+			preset.KeyframeInterval = override.KeyframeInterval
+		}
+		if !remove {
+			// hlssink keeps every segment with max-files=0
+			preset.MaxFiles = 0
+		}
+		if err := validatePreset(preset); err != nil {
+			return err
+		}
+		resolved[name] = preset
+	}
+
+	configLock.Lock()
+	defer configLock.Unlock()
+	presets = resolved
+	if config.OutputDir != "" {
+		hlsDir = config.OutputDir
+	}
+	if config.SegmentName != "" {
+		segmentName = config.SegmentName
+	}
+	deleteOldSegments = remove
+	dashDefault = config.DASH
+	defaultContainer = containerTS
+	if config.Container != "" {
+		defaultContainer = config.Container
+	}
+	return nil
+}
+
+// setupHLS applies the HLS config from hls_config and the environment
+func setupHLS() error {
+	config, err := loadHLSConfig(os.Getenv("hls_config"))
+	if err != nil {
+		return err
+	}
+	if err := config.apply(); err != nil {
+		return err
+	}
+	return os.MkdirAll(hlsDir, 0755)
+}
@@ -0,0 +1,107 @@
+package streamserver
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+)
+
+// saveHLS returns a func undoing what apply changed
+func saveHLS() func() {
+	saved, dir, name, remove, dash, container := presets, hlsDir, segmentName, deleteOldSegments, dashDefault, defaultContainer
+	return func() {
+		presets, hlsDir, segmentName, deleteOldSegments, dashDefault, defaultContainer = saved, dir, name, remove, dash, container
+	}
+}
+
+func writeHLSConfig(t *testing.T, config string) string {
+	f, err := ioutil.TempFile("", "hls-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(config); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestHLSConfig(t *testing.T) {
+	defer saveHLS()()
+	t.Setenv("hls_segment_name", "chunk")
+	t.Setenv("hls_low_latency_playlist_length", "4")
+	path := writeHLSConfig(t, `
+output_dir: /srv/hls
+segment_name: seg
+presets:
+  low-latency:
+    playlist_length: 5
+    max_files: 8
+`)
+	defer os.Remove(path)
+	config, err := loadHLSConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.apply(); err != nil {
+		t.Fatal(err)
+	}
+	if hlsDir != "/srv/hls" || segmentName != "chunk" || !deleteOldSegments {
+		t.Fatalf("output = %s %s %v", hlsDir, segmentName, deleteOldSegments)
+	}
+	low := presets[client.LatencyLow]
+	if low.PlaylistLength != 4 || low.MaxFiles != 8 || low.SegmentDuration != 1 {
+		t.Fatalf("low preset = %+v", low)
+	}
+	pipeline := newSession("main", nil, low).outputPipeline(outputDir("main"), 7, false, false).String()
+	if !strings.Contains(pipeline, "location=/srv/hls/main/chunk-7-%05d.ts ") || !strings.Contains(pipeline, "max-files=8 target-duration=1 playlist-length=4") {
+		t.Fatalf("pipeline = %s", pipeline)
+	}
+}
+
+func TestHLSConfigKeepSegments(t *testing.T) {
+	defer saveHLS()()
+	t.Setenv("hls_delete_old_segments", "false")
+	config, err := loadHLSConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.apply(); err != nil {
+		t.Fatal(err)
+	}
+	for name, preset := range presets {
+		if preset.MaxFiles != 0 {
+			t.Errorf("preset %s still removes segments past %d", name, preset.MaxFiles)
+		}
+	}
+	if pipeline := newSession("main", nil, presets[client.LatencyQuality]).outputPipeline("hls/main", 1, false, false).String(); !strings.Contains(pipeline, "max-files=0 ") {
+		t.Fatalf("pipeline = %s", pipeline)
+	}
+}
+
+func TestHLSConfigRejected(t *testing.T) {
+	defer saveHLS()()
+	for name, config := range map[string]string{
+		"unknown setting": "segment_lenght: 4\n",
+		"unknown preset":  "presets:\n  instant:\n    segment_duration: 1\n",
+		"inconsistent":    "presets:\n  low-latency:\n    max_files: 2\n",
+		"segment path":    "segment_name: ../seg\n",
+		"container":       "container: mkv\n",
+	} {
+		path := writeHLSConfig(t, config)
+		loaded, err := loadHLSConfig(path)
+		if err == nil {
+			err = loaded.apply()
+		}
+		os.Remove(path)
+		if err == nil {
+			t.Errorf("%s accepted", name)
+		}
+	}
+	if hlsDir != "hls" || presets[client.LatencyLow].MaxFiles != 6 {
+		t.Fatal("a rejected config was applied")
+	}
+}
@@ -0,0 +1,287 @@
+package streamserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	mediaserver "github.com/notedit/media-server-go"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/sdp"
+)
+
+// iceAddresses are the addresses transports advertise host candidates on,
+// ice_ips: comma separated, e.g. the public address of the host first and
+// its private one next. The endpoints listen on every interface.
+func iceAddresses() []string {
+	var addresses []string
+	for _, address := range strings.Split(os.Getenv("ice_ips"), ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	if len(addresses) == 0 {
+		return []string{"127.0.0.1"}
+	}
+	return addresses
+}
+
+// muxEndpoint is the UDP endpoint every transport shares in single-port
+// mode, nil otherwise, see setupPorts
+var muxEndpoint *mediaserver.Endpoint
+
+// setupPorts reads the UDP ports transports receive on: rtc_min_port and
+// rtc_max_port bound the port each endpoint binds, e.g. 40000 and 40999, so
+// a firewall or a container maps a known range. rtc_mux_port instead runs
+// every transport on that single port, the endpoint telling them apart by
+// their ICE username, for hosts where only one port can be opened.
+func setupPorts() error {
+	if mux := os.Getenv("rtc_mux_port"); mux != "" {
+		port, err := strconv.Atoi(mux)
+		if err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("rtc_mux_port must be a port, not %q", mux)
+		}
+		muxEndpoint = mediaserver.NewEndpointWithPort(iceAddresses()[0], port)
+		if candidates := muxEndpoint.GetLocalCandidates(); candidates[0].GetPort() != port {
+			return fmt.Errorf("cannot bind rtc_mux_port %d", port)
+		}
+		logger.Info("muxing transports on a single port", "port", port)
+		return nil
+	}
+	min, max := os.Getenv("rtc_min_port"), os.Getenv("rtc_max_port")
+	if min == "" && max == "" {
+		return nil
+	}
+	minPort, err := strconv.Atoi(min)
+	if err != nil {
+		return fmt.Errorf("rtc_min_port must be a port, not %q", min)
+	}
+	maxPort, err := strconv.Atoi(max)
+	if err != nil {
+		return fmt.Errorf("rtc_max_port must be a port, not %q", max)
+	}
+	if err := checkPortRange(minPort, maxPort); err != nil {
+		return err
+	}
+	if !mediaserver.SetPortRange(minPort, maxPort) {
+		return fmt.Errorf("cannot use the ports %d to %d", minPort, maxPort)
+	}
+	logger.Info("binding transports in a port range", "min", minPort, "max", maxPort)
+	return nil
+}
+
+// checkPortRange checks min to max, inclusive, is a range of ports
+func checkPortRange(min, max int) error {
+	if min < 1 || max > 65535 || min > max {
+		return fmt.Errorf("rtc_min_port %d and rtc_max_port %d are not a range of ports", min, max)
+	}
+	return nil
+}
+
+// mediaEndpoint is an address of a multi-homed host transports advertise
+// to the clients of its networks
+type mediaEndpoint struct {
+	name    string
+	address string
+	// networks are those of the clients the endpoint serves, none for the
+	// clients of no other endpoint
+	networks []*net.IPNet
+}
+
+// mediaEndpoints are the endpoints of rtc_endpoints, none to advertise the
+// addresses of iceAddresses to every client
+var mediaEndpoints []mediaEndpoint
+
+// setupEndpoints reads the endpoints of a host on several networks from
+// rtc_endpoints, comma separated name=address@networks, e.g.
+// internal=10.0.0.5@10.0.0.0/8 172.16.0.0/12,public=203.0.113.7: a client
+// in one of the networks, by CIDR, gets the endpoint of that address, and
+// any other client the endpoint without networks, or the first. The
+// endpoints listen on every interface, so it is the address they advertise
+// that routes the client. Single-port mode shares one endpoint, which
+// advertises one address only.
+func setupEndpoints() error {
+	endpoints, err := parseEndpoints(envList("rtc_endpoints"))
+	if err != nil {
+		return err
+	}
+	if len(endpoints) > 0 && muxEndpoint != nil {
+		return errors.New("rtc_endpoints cannot be used with rtc_mux_port")
+	}
+	mediaEndpoints = endpoints
+	for _, e := range endpoints {
+		logger.Info("media endpoint", "name", e.name, "address", e.address, "networks", len(e.networks))
+	}
+	return nil
+}
+
+func parseEndpoints(items []string) ([]mediaEndpoint, error) {
+	var endpoints []mediaEndpoint
+	for _, item := range items {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("rtc_endpoints: %q is not name=address@networks", item)
+		}
+		e := mediaEndpoint{name: strings.TrimSpace(kv[0])}
+		fields := strings.SplitN(kv[1], "@", 2)
+		e.address = strings.TrimSpace(fields[0])
+		if net.ParseIP(e.address) == nil {
+			return nil, fmt.Errorf("rtc_endpoints: %s: %q is not an ip address", e.name, e.address)
+		}
+		if len(fields) == 2 {
+			for _, cidr := range strings.Fields(fields[1]) {
+				_, network, err := net.ParseCIDR(cidr)
+				if err != nil {
+					return nil, fmt.Errorf("rtc_endpoints: %s: %v", e.name, err)
+				}
+				e.networks = append(e.networks, network)
+			}
+			if len(e.networks) == 0 {
+				return nil, fmt.Errorf("rtc_endpoints: %s lists no network after @", e.name)
+			}
+		}
+		endpoints = append(endpoints, e)
+	}
+	return endpoints, nil
+}
+
+// endpointFor returns the endpoint that serves a client at remote, nil
+// without rtc_endpoints. remote is nil when not known, e.g. for health
+// checks, which get the default endpoint.
+func endpointFor(remote net.IP) *mediaEndpoint {
+	if len(mediaEndpoints) == 0 {
+		return nil
+	}
+	var fallback *mediaEndpoint
+	for i := range mediaEndpoints {
+		e := &mediaEndpoints[i]
+		if len(e.networks) == 0 && fallback == nil {
+			fallback = e
+		}
+		for _, network := range e.networks {
+			if remote != nil && network.Contains(remote) {
+				return e
+			}
+		}
+	}
+	if fallback == nil {
+		fallback = &mediaEndpoints[0]
+	}
+	return fallback
+}
+
+// newEndpoint creates the UDP endpoint of a transport with a client at
+// remote, on a port of its own, or returns the shared one in single-port
+// mode
+func newEndpoint(remote net.IP) *mediaserver.Endpoint {
+	if muxEndpoint != nil {
+		return muxEndpoint
+	}
+	if e := endpointFor(remote); e != nil {
+		return mediaserver.NewEndpoint(e.address)
+	}
+	return mediaserver.NewEndpoint(iceAddresses()[0])
+}
+
+// releaseEndpoint stops an endpoint of newEndpoint, unless shared: the
+// transports on the shared endpoint are stopped one by one
+func releaseEndpoint(endpoint *mediaserver.Endpoint) {
+	if endpoint != muxEndpoint {
+		endpoint.Stop()
+	}
+}
+
+// localCandidates are the candidates an answer lists: own, those of its
+// endpoint, then one per other address of iceAddresses on the same port,
+// each preferred less than the one before. The endpoints of rtc_endpoints
+// advertise the address of their network only.
+func localCandidates(own []*sdp.CandidateInfo) []*sdp.CandidateInfo {
+	addresses := iceAddresses()
+	if len(own) == 0 || len(addresses) == 1 || len(mediaEndpoints) > 0 {
+		return own
+	}
+	first := own[0]
+	candidates := own
+	for i, address := range addresses[1:] {
+		foundation := strconv.Itoa(len(own) + i + 1)
+		candidates = append(candidates, sdp.NewCandidateInfo(foundation, first.GetComponentID(), first.GetTransport(),
+			first.GetPriority()-i-1, address, first.GetPort(), "host", "", 0))
+	}
+	return candidates
+}
+
+// iceServers are the STUN and TURN servers handed to the clients of key, from
+// ice_servers, comma separated urls, e.g.
+// stun:stun.example:3478,turn:turn.example:3478?transport=udp. TURN servers
+// get the turn_username and turn_credential, or with turn_secret ephemeral
+// credentials valid turn_ttl (86400) seconds, those of the TURN REST API
+// coturn checks with use-auth-secret.
+func iceServers(key string, now time.Time) []client.ICEServer {
+	var servers []client.ICEServer
+	for _, url := range strings.Split(os.Getenv("ice_servers"), ",") {
+		url = strings.TrimSpace(url)
+		if url == "" {
+			continue
+		}
+		server := client.ICEServer{URLs: []string{url}}
+		if strings.HasPrefix(url, "turn:") || strings.HasPrefix(url, "turns:") {
+			server.Username, server.Credential = turnCredentials(key, now)
+		}
+		servers = append(servers, server)
+	}
+	return servers
+}
+
+// turnCredentials are the TURN username and password of key
+func turnCredentials(key string, now time.Time) (string, string) {
+	secret := os.Getenv("turn_secret")
+	if secret == "" {
+		return os.Getenv("turn_username"), os.Getenv("turn_credential")
+	}
+	// the username is the expiry time, then the key for the TURN logs
+	username := strconv.FormatInt(now.Add(time.Duration(envInt("turn_ttl", 86400))*time.Second).Unix(), 10)
+	if key != "" {
+		username += ":" + key
+	}
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return username, base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// sendICEServers hands the signaling client of key its ICE servers, when
+// any are configured, before it makes its offer
+func sendICEServers(conn *signaling, key string) {
+	if servers := iceServers(key, time.Now()); len(servers) > 0 {
+		conn.send(client.Message{Cmd: client.CmdICEServers, ICEServers: servers})
+	}
+}
+
+// iceServerLinks adds the ICE servers of key to a WHIP or WHEP response, as
+// the Link headers of the WHIP specification
+func iceServerLinks(c *gin.Context, key string) {
+	for _, server := range iceServers(key, time.Now()) {
+		for _, url := range server.URLs {
+			link := fmt.Sprintf("<%s>; rel=\"ice-server\"", url)
+			if server.Username != "" {
+				link += fmt.Sprintf("; username=%q; credential=%q; credential-type=\"password\"", server.Username, server.Credential)
+			}
+			c.Writer.Header().Add("Link", link)
+		}
+	}
+}
+
+// iceOptions handles OPTIONS /whip and /whep/:id, through which WHIP and
+// WHEP clients learn the ICE servers before they make their offer
+func iceOptions(c *gin.Context) {
+	iceServerLinks(c, "")
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,123 @@
+package streamserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/sdp"
+)
+
+func TestICEAddresses(t *testing.T) {
+	if addresses := iceAddresses(); len(addresses) != 1 || addresses[0] != "127.0.0.1" {
+		t.Fatalf("default = %v", addresses)
+	}
+	t.Setenv("ice_ips", "203.0.113.7, 10.0.0.7,")
+	own := sdp.NewCandidateInfo("1", 1, "UDP", 33554431, "203.0.113.7", 40000, "host", "", 0)
+	candidates := localCandidates([]*sdp.CandidateInfo{own})
+	if len(candidates) != 2 || candidates[0].GetAddress() != "203.0.113.7" || candidates[1].GetAddress() != "10.0.0.7" {
+		t.Fatalf("candidates = %v", candidates)
+	}
+	if candidates[1].GetPort() != candidates[0].GetPort() || candidates[1].GetPriority() >= candidates[0].GetPriority() || candidates[1].GetFoundation() == candidates[0].GetFoundation() {
+		t.Fatalf("second candidate = %+v", candidates[1])
+	}
+}
+
+func TestPortSettings(t *testing.T) {
+	if err := checkPortRange(40000, 40999); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range [][2]int{{0, 100}, {40999, 40000}, {60000, 70000}} {
+		if err := checkPortRange(r[0], r[1]); err == nil {
+			t.Errorf("%d-%d accepted", r[0], r[1])
+		}
+	}
+	for _, env := range [][3]string{{"40000", "", ""}, {"", "40999", ""}, {"a", "40999", ""}, {"", "", "0"}, {"", "", "udp"}} {
+		t.Setenv("rtc_min_port", env[0])
+		t.Setenv("rtc_max_port", env[1])
+		t.Setenv("rtc_mux_port", env[2])
+		if err := setupPorts(); err == nil {
+			t.Errorf("%q accepted", env)
+		}
+	}
+	t.Setenv("rtc_min_port", "")
+	t.Setenv("rtc_max_port", "")
+	t.Setenv("rtc_mux_port", "")
+	if err := setupPorts(); err != nil || muxEndpoint != nil {
+		t.Fatalf("unset = %v", err)
+	}
+}
+
+func TestEndpoints(t *testing.T) {
+	defer func() { mediaEndpoints = nil }()
+	for _, bad := range []string{"10.0.0.5", "internal=eth0", "internal=10.0.0.5@10.0.0.0/33", "internal=10.0.0.5@"} {
+		if _, err := parseEndpoints([]string{bad}); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+	if endpointFor(net.ParseIP("10.1.2.3")) != nil {
+		t.Fatal("endpoint without rtc_endpoints")
+	}
+	endpoints, err := parseEndpoints([]string{"internal=10.0.0.5@10.0.0.0/8 fd00::/8", "public=203.0.113.7", "vpn=100.64.0.5@100.64.0.0/10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaEndpoints = endpoints
+	for remote, name := range map[string]string{"10.1.2.3": "internal", "fd00::1": "internal", "100.64.9.9": "vpn", "198.51.100.4": "public", "": "public"} {
+		if e := endpointFor(net.ParseIP(remote)); e.name != name {
+			t.Errorf("%q gets %s", remote, e.name)
+		}
+	}
+	mediaEndpoints = endpoints[2:]
+	if e := endpointFor(net.ParseIP("198.51.100.4")); e.name != "vpn" {
+		t.Fatalf("without a default, %s", e.name)
+	}
+
+	// each endpoint advertises its own address only
+	t.Setenv("ice_ips", "203.0.113.7,10.0.0.5")
+	own := sdp.NewCandidateInfo("1", 1, "UDP", 33554431, "100.64.0.5", 40000, "host", "", 0)
+	if candidates := localCandidates([]*sdp.CandidateInfo{own}); len(candidates) != 1 {
+		t.Fatalf("candidates = %v", candidates)
+	}
+}
+
+func TestICEServers(t *testing.T) {
+	for _, name := range []string{"ice_servers", "turn_secret", "turn_username", "turn_credential"} {
+		unsetenv(t, name)
+	}
+	if servers := iceServers("main", time.Now()); len(servers) != 0 {
+		t.Fatalf("servers = %v", servers)
+	}
+	t.Setenv("ice_servers", "stun:stun.example:3478, turn:turn.example:3478?transport=udp")
+	t.Setenv("turn_username", "user")
+	t.Setenv("turn_credential", "pass")
+	servers := iceServers("main", time.Now())
+	if len(servers) != 2 || servers[0].Username != "" || servers[1].Username != "user" || servers[1].Credential != "pass" {
+		t.Fatalf("static = %+v", servers)
+	}
+
+	t.Setenv("turn_secret", "north")
+	now := time.Unix(1760000000, 0)
+	servers = iceServers("main", now)
+	mac := hmac.New(sha1.New, []byte("north"))
+	mac.Write([]byte("1760086400:main"))
+	if servers[1].Username != "1760086400:main" || servers[1].Credential != base64.StdEncoding.EncodeToString(mac.Sum(nil)) {
+		t.Fatalf("ephemeral = %+v", servers[1])
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.OPTIONS("/whip", iceOptions)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("OPTIONS", "/whip", nil))
+	links := w.Header()["Link"]
+	if w.Code != http.StatusNoContent || len(links) != 2 || links[0] != `<stun:stun.example:3478>; rel="ice-server"` {
+		t.Fatalf("options = %d %v", w.Code, links)
+	}
+}
@@ -0,0 +1,41 @@
+package streamserver
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/ident"
+	"github.com/notedit/sdp"
+)
+
+// publishIDs returns the stream key and external id of an offer, the key
+// falling back to the id of the offer's first stream. Firefox wraps that id
+// in braces, which are dropped.
+func publishIDs(msg client.Message, offer *sdp.SDPInfo) (key, externalID string, err error) {
+	key = msg.StreamID
+	if key == "" && offer != nil && offer.GetFirstStream() != nil {
+		key = strings.Trim(offer.GetFirstStream().GetID(), "{}")
+	}
+	if key, err = ident.Normalize(ident.StreamKey, key); err != nil {
+		return "", "", err
+	}
+	if msg.ExternalID != "" {
+		if externalID, err = ident.Normalize(ident.ExternalID, msg.ExternalID); err != nil {
+			return "", "", err
+		}
+	}
+	return key, externalID, nil
+}
+
+// identParam reads a path parameter as a kind of identifier, answering 400
+// when it is not one
+func identParam(c *gin.Context, name string, kind ident.Kind) (string, bool) {
+	id := c.Param(name)
+	if err := ident.Check(kind, id); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return "", false
+	}
+	return id, true
+}
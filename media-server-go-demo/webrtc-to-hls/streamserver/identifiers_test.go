@@ -0,0 +1,189 @@
+package streamserver
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/ident"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/scratch"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/vod"
+)
+
+// hostileIDs are identifiers crafted to reach outside the output root
+var hostileIDs = []string{
+	"../../etc", "..", ".", "../", `..\..\etc`, "/etc/passwd", "~/secret.txt",
+	"secret.txt", "../secret.txt", "./../secret.txt", "....//secret.txt",
+	"a/../../secret.txt", "%2e%2e%2fsecret.txt", "..%2fsecret.txt",
+	"secret.txt\x00.ts", "\x00", " ../secret.txt ", "{../secret.txt}",
+	strings.Repeat("../", 40) + "secret.txt", "_mosaic", "by-external",
+}
+
+// fuzzIDs returns hostileIDs and n more assembled at random from path
+// fragments, the same ones on every run, to seed the fuzz tests
+func fuzzIDs(n int) []string {
+	fragments := []string{"..", ".", "/", `\`, "%2e", "%2f", "\x00", " ", "_", "-", "a", "secret.txt", "out", "{", "}", "\n"}
+	rnd := rand.New(rand.NewSource(235))
+	ids := append([]string{"fuzz-key"}, hostileIDs...)
+	for i := 0; i < n; i++ {
+		var id strings.Builder
+		for j := rnd.Intn(8); j >= 0; j-- {
+			id.WriteString(fragments[rnd.Intn(len(fragments))])
+		}
+		ids = append(ids, id.String())
+	}
+	return ids
+}
+
+// outputRoot lays out base/out, the served output root the test runs in,
+// base/scratch and the file base/secret.txt nothing may touch
+func outputRoot(t testing.TB) (base string, restore func()) {
+	base, err := ioutil.TempDir("", "identifiers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Mkdir(filepath.Join(base, "out"), 0755)
+	if err := ioutil.WriteFile(filepath.Join(base, "secret.txt"), []byte("SECRET"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wd, _ := os.Getwd()
+	if err := os.Chdir(filepath.Join(base, "out")); err != nil {
+		t.Fatal(err)
+	}
+	oldScratch := scratchRoot
+	scratchRoot = scratch.NewRoot(filepath.Join(base, "scratch"), 0)
+	return base, func() {
+		scratchRoot = oldScratch
+		os.Chdir(wd)
+		os.RemoveAll(base)
+	}
+}
+
+// checkContained fails the test when anything but out/ and scratch/ changed
+// below base
+func checkContained(t testing.TB, base string) {
+	t.Helper()
+	if data, err := ioutil.ReadFile(filepath.Join(base, "secret.txt")); err != nil || string(data) != "SECRET" {
+		t.Fatalf("secret.txt touched: %q, %v", data, err)
+	}
+	entries, _ := ioutil.ReadDir(base)
+	for _, entry := range entries {
+		switch entry.Name() {
+		case "out", "scratch", "secret.txt":
+		default:
+			t.Fatalf("%s created outside the output root", entry.Name())
+		}
+	}
+}
+
+// FuzzSessionIdentifiers creates sessions from the identifiers of offers:
+// a session of an accepted one keeps its files in the output root
+func FuzzSessionIdentifiers(f *testing.F) {
+	for _, id := range fuzzIDs(500) {
+		f.Add(id, id)
+	}
+	base, restore := outputRoot(f)
+	defer restore()
+
+	f.Fuzz(func(t *testing.T, streamID, externalID string) {
+		key, external, err := publishIDs(client.Message{StreamID: streamID, ExternalID: externalID}, nil)
+		if err != nil {
+			return
+		}
+		if strings.ContainsAny(key, `/\`) || strings.HasPrefix(key, ".") || strings.HasPrefix(key, "_") {
+			t.Fatalf("%q accepted as %q", streamID, key)
+		}
+		sess := newSession(key, nil, presets[client.LatencyBalanced])
+		sess.externalID = external
+		if _, err := registry.claim(sess, conflictReject); err != nil {
+			t.Fatal(err)
+		}
+		defer sess.close(0, "")
+		defer registry.release(sess)
+		file, err := sess.scratchDir().Create("capture.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Write([]byte("frame"))
+		file.Close()
+		sess.record(time.Time{})
+		checkContained(t, base)
+	})
+}
+
+// FuzzServingIdentifiers requests hostile paths of streams, segments and
+// details: none serves the secret outside the output root or writes there
+func FuzzServingIdentifiers(f *testing.F) {
+	for _, id := range fuzzIDs(500) {
+		f.Add(id)
+	}
+	base, restore := outputRoot(f)
+	defer restore()
+	f.Setenv("playlist_validation", "off")
+	os.MkdirAll(outputDir("fuzz-live"), 0755)
+	ioutil.WriteFile(filepath.Join(outputDir("fuzz-live"), playlistName), []byte("#EXTM3U\n#EXT-X-TARGETDURATION:2\n"), 0644)
+
+	sess := newSession("fuzz-live", nil, presets[client.LatencyBalanced])
+	if _, err := registry.claim(sess, conflictReject); err != nil {
+		f.Fatal(err)
+	}
+	defer registry.release(sess)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(servePlaylist)
+	r.Use(serveMedia)
+	r.GET("/hls/:id/*file", serveExternalStream)
+	r.GET("/vod/:id/*file", serveVOD)
+	r.GET("/api/streams/:id/:detail", streamDetail)
+
+	// without a catalog, then with one in the output root
+	for _, raw := range hostileIDs {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.URL.Path = "/vod/" + raw + "/" + playlistName
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	saved := catalog
+	defer func() { catalog = saved }()
+	var err error
+	if catalog, err = vod.Open("vod"); err != nil {
+		f.Fatal(err)
+	}
+
+	f.Fuzz(func(t *testing.T, raw string) {
+		for _, path := range []string{"/hls/" + raw + "/" + playlistName, "/hls/fuzz-live/" + raw, "/vod/" + raw + "/" + playlistName, "/" + raw, "/api/streams/" + raw + "/timeline"} {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.URL.Path = path
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if strings.Contains(w.Body.String(), "SECRET") {
+				t.Fatalf("%q served the secret", path)
+			}
+		}
+		checkContained(t, base)
+	})
+}
+
+// TestReservedRoutes keeps ident's reserved names in sync with the routes:
+// no stream key may be the first element of a path the server serves
+func TestReservedRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	routes(r)
+	for _, route := range r.Routes() {
+		first := strings.SplitN(strings.TrimPrefix(route.Path, "/"), "/", 2)[0]
+		if first == "" {
+			continue
+		}
+		if err := ident.Check(ident.StreamKey, first); err == nil {
+			t.Errorf("%s %s: %q is not a reserved name", route.Method, route.Path, first)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package streamserver
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/metrics"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/pubauth"
+)
+
+var errUnknownAuthMode = errors.New("unknown ingest_auth mode")
+
+// ingest authentication modes, one per listener
+const (
+	authNone = "none"
+	authCert = "cert"
+	authKey  = "key"
+	authJWT  = "jwt"
+)
+
+var authFailures = metrics.NewCounter("publish_auth_failures_total",
+	"Publishes refused by ingest authentication, by mode", "mode")
+
+// authenticators are the ingest_auth modes besides none. A deployment
+// wires in its own backend by adding a mode from an init function of its
+// own file.
+var authenticators = map[string]func() (pubauth.Authenticator, error){
+	authCert: func() (pubauth.Authenticator, error) {
+		cert, err := newCertAuth()
+		if err != nil {
+			return nil, err
+		}
+		return cert, nil
+	},
+	authKey: newKeyAuth,
+	authJWT: newJWTAuth,
+}
+
+// parseStreamKeys reads "stream-key secret" lines; # starts a comment
+func parseStreamKeys(data []byte) (interface{}, error) {
+	keys := pubauth.Keys{}
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: want \"stream-key secret\"", n)
+		}
+		keys[fields[0]] = fields[1]
+	}
+	return keys, scanner.Err()
+}
+
+// keyAuth checks pre-shared secrets from the stream_keys file, reloaded
+// when it changes
+type keyAuth struct {
+	keys *reloadingFile
+}
+
+func newKeyAuth() (pubauth.Authenticator, error) {
+	path := os.Getenv("stream_keys")
+	if path == "" {
+		return nil, errors.New("ingest_auth=key needs stream_keys")
+	}
+	auth := &keyAuth{keys: &reloadingFile{path: path, parse: parseStreamKeys}}
+	if _, err := auth.keys.get(); err != nil {
+		return nil, err
+	}
+	return auth, nil
+}
+
+func (a *keyAuth) Authenticate(r pubauth.Request) (string, error) {
+	value, err := a.keys.get()
+	if err != nil {
+		// fail closed, a broken key file must not let anyone in
+		return "", err
+	}
+	return value.(pubauth.Keys).Authenticate(r)
+}
+
+// newJWTAuth verifies tokens signed with jwt_secret, tolerating
+// jwt_leeway_seconds (30) of clock difference
+func newJWTAuth() (pubauth.Authenticator, error) {
+	secret := os.Getenv("jwt_secret")
+	if secret == "" {
+		return nil, errors.New("ingest_auth=jwt needs jwt_secret")
+	}
+	return &pubauth.JWT{
+		Secret: []byte(secret),
+		Leeway: time.Duration(envInt("jwt_leeway_seconds", 30)) * time.Second,
+	}, nil
+}
+
+// ingestAuth authenticates publishes on the listener
+type ingestAuth struct {
+	mode          string
+	authenticator pubauth.Authenticator
+}
+
+// newIngestAuth reads ingest_auth, none by default
+func newIngestAuth() (*ingestAuth, error) {
+	mode := os.Getenv("ingest_auth")
+	if mode == "" || mode == authNone {
+		return &ingestAuth{mode: authNone}, nil
+	}
+	newAuthenticator, ok := authenticators[mode]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", errUnknownAuthMode, mode)
+	}
+	authenticator, err := newAuthenticator()
+	if err != nil {
+		return nil, err
+	}
+	return &ingestAuth{mode: mode, authenticator: authenticator}, nil
+}
+
+// authorize returns the authenticated publisher identity for a publish
+func (a *ingestAuth) authorize(r pubauth.Request) (string, error) {
+	if a == nil || a.authenticator == nil {
+		return "", nil
+	}
+	identity, err := a.authenticator.Authenticate(r)
+	if err != nil {
+		authFailures.Inc(a.mode)
+	}
+	return identity, err
+}
+
+// takesCredential reports whether publishers present a secret or token,
+// which then must not double as their stream key. Certificates are
+// presented by the TLS handshake.
+func (a *ingestAuth) takesCredential() bool {
+	return a != nil && a.authenticator != nil && a.mode != authCert
+}
+
+// unauthenticated reports whether err is a publish without any credential,
+// rather than one whose credential was refused
+func unauthenticated(err error) bool {
+	return errors.Is(err, pubauth.ErrNoCredential) || err == errNoClientCert
+}
+
+// channelCredential returns the credential a publisher presented over the
+// channel: in its offer, as the token query parameter, browsers not being
+// able to set headers on a websocket, or as a bearer token of the upgrade
+func channelCredential(c *gin.Context, msg client.Message) string {
+	switch {
+	case msg.Credential != "":
+		return msg.Credential
+	case c.Query("token") != "":
+		return c.Query("token")
+	}
+	return bearerToken(c.Request)
+}
+
+// tlsConfig requests client certificates signed by client_ca when
+// certificate auth is on
+func (a *ingestAuth) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{}
+	if a.mode != authCert {
+		return config, nil
+	}
+	path := os.Getenv("client_ca")
+	if path == "" {
+		return nil, errors.New("ingest_auth=cert needs client_ca")
+	}
+	bundle, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("%s: no certificates", path)
+	}
+	config.ClientCAs = pool
+	// verified when presented; publishes without one are rejected by
+	// authorize, the player pages stay reachable
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	return config, nil
+}
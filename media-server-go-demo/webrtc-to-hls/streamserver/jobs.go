@@ -0,0 +1,145 @@
+package streamserver
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/jobs"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/metrics"
+)
+
+// background is the queue every kind of background work goes through,
+// created in main once the environment is loaded
+var background *jobs.Queue
+
+var (
+	jobsSucceeded = metrics.NewCounter("jobs_succeeded_total",
+		"Background jobs that succeeded, by class", "class")
+	jobsFailed = metrics.NewCounter("jobs_failed_attempts_total",
+		"Failed attempts of background jobs, by class", "class")
+	jobsDead = metrics.NewCounter("jobs_dead_total",
+		"Background jobs that ran out of attempts, by class", "class")
+	jobsRejected = metrics.NewCounter("jobs_rejected_total",
+		"Background jobs refused by a full queue, by class", "class")
+	_ = metrics.NewGaugeFunc("jobs_queue_depth",
+		"Queued and running background jobs, by class", "class", func() map[string]float64 {
+			return jobStat(func(s jobs.Stats) float64 { return float64(s.Depth) })
+		})
+	_ = metrics.NewGaugeFunc("jobs_oldest_age_seconds",
+		"Age of the longest waiting background job, by class", "class", func() map[string]float64 {
+			return jobStat(func(s jobs.Stats) float64 { return s.Oldest.Seconds() })
+		})
+)
+
+// newJobQueue creates the shared queue, job_queue_depth (256) jobs deep and
+// keeping job_dead_letters (100), and registers the job classes
+func newJobQueue() *jobs.Queue {
+	q := jobs.New(envInt("job_queue_depth", 256), envInt("job_dead_letters", 100))
+	q.Observe = observeJob
+	q.Register(jobs.Class{
+		Name:        storyboardJobs,
+		Concurrency: envInt("storyboard_workers", 2),
+		Depth:       16,
+		MaxAttempts: storyboardAttempts,
+		Backoff:     time.Second,
+	})
+	// a thumbnail is not retried, the next one being taken soon
+	q.Register(jobs.Class{
+		Name:        thumbnailJobs,
+		Concurrency: envInt("thumbnail_workers", 2),
+		Depth:       32,
+		MaxAttempts: 1,
+	})
+	q.Register(uploadClass())
+	q.Register(jobs.Class{
+		Name:        webhookJobs,
+		Concurrency: envInt("webhook_workers", 2),
+		Depth:       128,
+		MaxAttempts: envInt("webhook_attempts", 8),
+		Backoff:     time.Second,
+		MaxBackoff:  5 * time.Minute,
+		Timeout:     15 * time.Second,
+	})
+	q.Register(jobs.Class{
+		Name:        analyticsJobs,
+		Concurrency: 1,
+		Depth:       64,
+		MaxAttempts: envInt("analytics_attempts", 5),
+		Backoff:     time.Second,
+		MaxBackoff:  30 * time.Second,
+		Timeout:     15 * time.Second,
+	})
+	q.Register(jobs.Class{
+		Name:        eventBusJobs,
+		Concurrency: 1,
+		Depth:       256,
+		MaxAttempts: envInt("event_bus_attempts", 8),
+		Backoff:     time.Second,
+		MaxBackoff:  5 * time.Minute,
+		Timeout:     15 * time.Second,
+	})
+	return q
+}
+
+func observeJob(job jobs.Info, outcome string) {
+	switch outcome {
+	case jobs.Succeeded:
+		jobsSucceeded.Inc(job.Class)
+	case jobs.Failed:
+		jobsFailed.Inc(job.Class)
+		logger.Warn("job failed, retrying", "class", job.Class, "job", job.Name, "error", job.Error)
+	case jobs.Dead:
+		jobsFailed.Inc(job.Class)
+		jobsDead.Inc(job.Class)
+		logger.Error("job dead", "class", job.Class, "job", job.Name, "error", job.Error)
+	case jobs.Rejected:
+		jobsRejected.Inc(job.Class)
+		logger.Warn("job queue full, skipping", "class", job.Class, "job", job.Name)
+	}
+}
+
+// jobStat reads one number per class off the queue, for the gauges
+func jobStat(read func(jobs.Stats) float64) map[string]float64 {
+	values := map[string]float64{}
+	if background == nil {
+		return values
+	}
+	for class, s := range background.Stats() {
+		values[class] = read(s)
+	}
+	return values
+}
+
+// listDeadJobs handles GET /api/jobs/dead
+func listDeadJobs(c *gin.Context) {
+	if _, ok := adminIdentity(c); !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"jobs": background.Dead(), "classes": background.Stats()})
+}
+
+// requeueDeadJob handles POST /api/jobs/dead/:id/requeue
+func requeueDeadJob(c *gin.Context) {
+	admin, ok := adminIdentity(c)
+	if !ok {
+		return
+	}
+	id := c.Param("id")
+	if err := audit.record(auditEntry{Time: time.Now(), Admin: admin, Action: "requeue-job", Reason: id}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	job, err := background.Requeue(id)
+	switch err {
+	case nil:
+		c.JSON(http.StatusAccepted, job)
+	case jobs.ErrNotFound:
+		c.Status(http.StatusNotFound)
+	case jobs.ErrFull:
+		c.Header("Retry-After", "1")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
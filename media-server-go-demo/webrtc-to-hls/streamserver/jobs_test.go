@@ -0,0 +1,98 @@
+package streamserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/jobs"
+)
+
+func TestDeadJobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	audit = &auditLog{path: filepath.Join(dir, "audit.log")}
+	background = newJobQueue()
+	defer background.Close()
+	background.Register(jobs.Class{Name: "test", Backoff: time.Millisecond})
+
+	fail := true
+	done := make(chan struct{})
+	id, err := background.Submit("test", "flaky", func(ctx context.Context) error {
+		if fail {
+			return errors.New("remote down")
+		}
+		close(done)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(background.Dead()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("job never failed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if jobsDead.Value("test") != 1 {
+		t.Fatal("dead job not counted")
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/api/jobs/dead", listDeadJobs)
+	r.POST("/api/jobs/dead/:id/requeue", requeueDeadJob)
+	do := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, nil)
+		asAdmin(req, "oncall")
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/jobs/dead", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("without admin = %d", w.Code)
+	}
+	w = do("GET", "/api/jobs/dead")
+	var listing struct {
+		Jobs []jobs.Info `json:"jobs"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &listing); err != nil {
+		t.Fatal(err)
+	}
+	if len(listing.Jobs) != 1 || listing.Jobs[0].ID != id || listing.Jobs[0].Error != "remote down" {
+		t.Fatalf("listing = %s", w.Body)
+	}
+
+	fail = false
+	if w := do("POST", "/api/jobs/dead/"+id+"/requeue"); w.Code != http.StatusAccepted {
+		t.Fatalf("requeue = %d %s", w.Code, w.Body)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("requeued job never ran")
+	}
+	if w := do("POST", "/api/jobs/dead/"+id+"/requeue"); w.Code != http.StatusNotFound {
+		t.Fatalf("second requeue = %d", w.Code)
+	}
+	data, _ := ioutil.ReadFile(audit.path)
+	if !strings.Contains(string(data), `"action":"requeue-job"`) {
+		t.Fatalf("audit log = %s", data)
+	}
+}
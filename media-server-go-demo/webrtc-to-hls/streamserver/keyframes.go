@@ -0,0 +1,309 @@
+package streamserver
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	mediaserver "github.com/notedit/media-server-go"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/ident"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/metrics"
+)
+
+// sources of keyframe requests
+const (
+	keyframeRefresher = "refresher"
+	keyframeAPI       = "api"
+	keyframeLayer     = "simulcast-layer"
+	keyframeSwitch    = "stream-switch"
+	keyframeRestart   = "pipeline-restart"
+	keyframeViewer    = "viewer"
+)
+
+// keyframeRefreshOff turns the refresher off, keyframe_refresh=off: the
+// publisher's own GOP cuts the segments, keyframes are only requested on
+// demand
+const keyframeRefreshOff = "off"
+
+// setupKeyframes checks keyframe_refresh / keyframe_refresh_overrides, the
+// period of the refresher of a stream key in milliseconds or off. Unset,
+// the keyframe interval of the latency preset is used.
+func setupKeyframes() error {
+	values := envOverrides("keyframe_refresh")
+	values[""] = os.Getenv("keyframe_refresh")
+	for key, value := range values {
+		if value == "" || value == keyframeRefreshOff {
+			continue
+		}
+		if ms, err := strconv.Atoi(value); err != nil || ms <= 0 {
+			return fmt.Errorf("keyframe_refresh of %q: must be a period in milliseconds or %s, not %q", key, keyframeRefreshOff, value)
+		}
+	}
+	return nil
+}
+
+// refreshPeriod is the period of the refresher of a publish of key with
+// preset p, 0 when off. It is shortened to divide the segment duration so
+// that every segment starts on a requested keyframe: hlssink cuts at the
+// first keyframe past the target duration, and a 5s period against 6s
+// segments would cut them every 10s.
+func refreshPeriod(p client.Preset, key string) time.Duration {
+	interval := p.KeyframeInterval
+	switch value := envForKey("keyframe_refresh", key); value {
+	case "":
+	case keyframeRefreshOff:
+		return 0
+	default:
+		interval, _ = strconv.Atoi(value)
+	}
+	segment := p.SegmentDuration * 1000
+	if interval <= 0 || segment <= 0 {
+		return time.Duration(interval) * time.Millisecond
+	}
+	n := (segment + interval - 1) / interval
+	return time.Duration(segment/n) * time.Millisecond
+}
+
+var (
+	keyframeRequests = metrics.NewCounter("keyframe_requests_total",
+		"Keyframe requests (PLI) sent to publishers, by source", "source")
+	keyframeDrops = metrics.NewCounter("keyframe_requests_dropped_total",
+		"Keyframe requests dropped by the per track ceiling, by source", "source")
+)
+
+// KeyframeStats counts the keyframe requests of a session by source
+type KeyframeStats struct {
+	Requests map[string]uint64 `json:"requests"`
+	Dropped  map[string]uint64 `json:"dropped"`
+}
+
+// refreshable is the part of an incoming video track keyframes are requested from
+type refreshable interface {
+	GetID() string
+	Refresh()
+}
+
+// keyframeLimiter is a token bucket of keyframe requests for one track
+type keyframeLimiter struct {
+	tokens float64
+	last   time.Time
+}
+
+// keyframeRequester sends the keyframe requests of a session: periodically
+// for the refresher and on demand, all under a per track ceiling of
+// keyframe_requests_per_min (burst keyframe_request_burst). When the ceiling
+// drops keyframe_storm_drops requests within a minute, the publisher is warned
+// of the source that asked the most.
+type keyframeRequester struct {
+	sess   *session
+	period time.Duration
+	rate   float64 // tokens per second
+	burst  float64
+	storm  uint64
+	now    func() time.Time
+
+	sync.Mutex
+	tracks   map[string]refreshable
+	limiters map[string]*keyframeLimiter
+	stats    KeyframeStats
+	// windowed counts, for storm detection
+	window       time.Time
+	windowCounts map[string]uint64
+	windowDrops  uint64
+	warned       bool
+
+	stop chan struct{}
+	once sync.Once
+}
+
+func newKeyframeRequester(sess *session, period time.Duration) *keyframeRequester {
+	return &keyframeRequester{
+		sess:         sess,
+		period:       period,
+		rate:         float64(envInt("keyframe_requests_per_min", 120)) / 60,
+		burst:        float64(envInt("keyframe_request_burst", 5)),
+		storm:        uint64(envInt("keyframe_storm_drops", 10)),
+		now:          time.Now,
+		tracks:       map[string]refreshable{},
+		limiters:     map[string]*keyframeLimiter{},
+		stats:        KeyframeStats{Requests: map[string]uint64{}, Dropped: map[string]uint64{}},
+		windowCounts: map[string]uint64{},
+		stop:         make(chan struct{}),
+	}
+}
+
+// AddStream requests keyframes of the video tracks of incoming, starting the
+// refresher with the first one
+func (k *keyframeRequester) AddStream(incoming *mediaserver.IncomingStream) {
+	for _, track := range incoming.GetVideoTracks() {
+		k.add(track)
+	}
+}
+
+// RemoveStream stops requesting keyframes of the video tracks of incoming,
+// which a renegotiation dropped
+func (k *keyframeRequester) RemoveStream(incoming *mediaserver.IncomingStream) {
+	k.Lock()
+	defer k.Unlock()
+	for _, track := range incoming.GetVideoTracks() {
+		delete(k.tracks, track.GetID())
+		delete(k.limiters, track.GetID())
+	}
+}
+
+func (k *keyframeRequester) add(track refreshable) {
+	k.Lock()
+	first := len(k.tracks) == 0
+	k.tracks[track.GetID()] = track
+	k.Unlock()
+	if first && k.period > 0 {
+		go k.refresh()
+	}
+}
+
+func (k *keyframeRequester) refresh() {
+	ticker := time.NewTicker(k.period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-k.stop:
+			return
+		case <-ticker.C:
+		}
+		k.request(keyframeRefresher)
+	}
+}
+
+// request asks every track for a keyframe on behalf of source, reporting
+// whether any request went out
+func (k *keyframeRequester) request(source string) bool {
+	k.Lock()
+	k.rollWindow()
+	var send []refreshable
+	for id, track := range k.tracks {
+		if k.allow(id) {
+			send = append(send, track)
+			k.stats.Requests[source]++
+			keyframeRequests.Inc(source)
+		} else {
+			k.stats.Dropped[source]++
+			k.windowDrops++
+			keyframeDrops.Inc(source)
+		}
+		k.windowCounts[source]++
+	}
+	warning := k.checkStorm()
+	k.Unlock()
+
+	for _, track := range send {
+		track.Refresh()
+	}
+	if warning != nil && k.sess != nil {
+		k.sess.warn(*warning)
+	}
+	return len(send) > 0
+}
+
+// allow takes a token from the bucket of a track; called with the lock held
+func (k *keyframeRequester) allow(id string) bool {
+	now := k.now()
+	limiter := k.limiters[id]
+	if limiter == nil {
+		limiter = &keyframeLimiter{tokens: k.burst, last: now}
+		k.limiters[id] = limiter
+	}
+	limiter.tokens += now.Sub(limiter.last).Seconds() * k.rate
+	if limiter.tokens > k.burst {
+		limiter.tokens = k.burst
+	}
+	limiter.last = now
+	if limiter.tokens < 1 {
+		return false
+	}
+	limiter.tokens--
+	return true
+}
+
+// rollWindow starts a new storm detection minute once the current one is
+// over; called with the lock held
+func (k *keyframeRequester) rollWindow() {
+	now := k.now()
+	if now.Sub(k.window) >= time.Minute {
+		k.window = now
+		k.windowCounts = map[string]uint64{}
+		k.windowDrops = 0
+		k.warned = false
+	}
+}
+
+// checkStorm returns a warning the first time the drops of the current
+// minute reach the storm threshold; called with the lock held
+func (k *keyframeRequester) checkStorm() *warning {
+	k.rollWindow()
+	if k.warned || k.storm == 0 || k.windowDrops < k.storm {
+		return nil
+	}
+	k.warned = true
+	dominant, most := "", uint64(0)
+	for source, count := range k.windowCounts {
+		if count > most || (count == most && source < dominant) {
+			dominant, most = source, count
+		}
+	}
+	return &warning{
+		code: client.WarningKeyframeStorm,
+		text: fmt.Sprintf("keyframe request ceiling hit %d times in a minute, mostly requested by %s (%d)", k.windowDrops, dominant, most),
+		details: map[string]interface{}{
+			"dropped":  k.windowDrops,
+			"source":   dominant,
+			"requests": most,
+		},
+	}
+}
+
+func (k *keyframeRequester) keyframeStats() KeyframeStats {
+	k.Lock()
+	defer k.Unlock()
+	stats := KeyframeStats{Requests: map[string]uint64{}, Dropped: map[string]uint64{}}
+	for source, count := range k.stats.Requests {
+		stats.Requests[source] = count
+	}
+	for source, count := range k.stats.Dropped {
+		stats.Dropped[source] = count
+	}
+	return stats
+}
+
+func (k *keyframeRequester) Stop() {
+	k.once.Do(func() { close(k.stop) })
+}
+
+// requestKeyframe handles POST /api/streams/:id/keyframe
+func requestKeyframe(c *gin.Context) {
+	id, ok := identParam(c, "id", ident.StreamKey)
+	if !ok {
+		return
+	}
+	sess := registry.find(id)
+	if sess == nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	sess.Lock()
+	keyframes := sess.refresher
+	sess.Unlock()
+	if keyframes == nil {
+		c.Status(http.StatusConflict)
+		return
+	}
+	if !keyframes.request(keyframeAPI) {
+		c.Status(http.StatusTooManyRequests)
+		return
+	}
+	c.Status(http.StatusAccepted)
+}
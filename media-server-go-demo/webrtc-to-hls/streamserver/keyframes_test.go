@@ -0,0 +1,109 @@
+package streamserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+)
+
+type fakeTrack struct {
+	id        string
+	refreshes int
+}
+
+func (t *fakeTrack) GetID() string { return t.id }
+func (t *fakeTrack) Refresh()      { t.refreshes++ }
+
+func TestKeyframeCeiling(t *testing.T) {
+	now := time.Unix(1000, 0)
+	k := newKeyframeRequester(nil, 0)
+	k.now = func() time.Time { return now }
+	k.rate, k.burst, k.storm = 1, 3, 5
+	track := &fakeTrack{id: "video"}
+	k.add(track)
+
+	k.request(keyframeRefresher)
+	for i := 0; i < 9; i++ {
+		k.request(keyframeAPI)
+	}
+	if track.refreshes != 3 {
+		t.Fatalf("refreshes = %d", track.refreshes)
+	}
+	stats := k.keyframeStats()
+	if stats.Requests[keyframeRefresher] != 1 || stats.Requests[keyframeAPI] != 2 || stats.Dropped[keyframeAPI] != 7 {
+		t.Fatalf("stats = %+v", stats)
+	}
+	if !k.warned {
+		t.Fatal("storm not detected")
+	}
+	if warning := k.checkStorm(); warning != nil {
+		t.Fatalf("warned twice: %s", warning.text)
+	}
+
+	// the bucket refills at the configured rate
+	now = now.Add(2 * time.Second)
+	if !k.request(keyframeRefresher) || !k.request(keyframeRefresher) || k.request(keyframeRefresher) {
+		t.Fatal("refill did not allow exactly two requests")
+	}
+}
+
+func TestKeyframeStormNamesDominantSource(t *testing.T) {
+	now := time.Unix(1000, 0)
+	k := newKeyframeRequester(nil, 0)
+	k.now = func() time.Time { return now }
+	k.rate, k.burst, k.storm = 0, 0, 100
+	k.add(&fakeTrack{id: "video"})
+
+	for i := 0; i < 3; i++ {
+		k.request(keyframeRefresher)
+	}
+	k.request(keyframeAPI)
+
+	k.Lock()
+	k.storm = 4
+	warning := k.checkStorm()
+	k.Unlock()
+	if want := "keyframe request ceiling hit 4 times in a minute, mostly requested by refresher (3)"; warning == nil || warning.text != want {
+		t.Fatalf("warning = %+v", warning)
+	}
+	if warning.code != client.WarningKeyframeStorm || warning.details["source"] != keyframeRefresher {
+		t.Fatalf("warning = %+v", warning)
+	}
+
+	now = now.Add(time.Minute)
+	k.Lock()
+	warning = k.checkStorm()
+	k.Unlock()
+	if warning != nil {
+		t.Fatalf("new window warned right away: %q", warning.text)
+	}
+}
+
+func TestRefreshPeriod(t *testing.T) {
+	quality := client.Preset{SegmentDuration: 6, KeyframeInterval: 5000}
+	// 5s would cut 6s segments every 10s
+	if period := refreshPeriod(quality, "main"); period != 3*time.Second {
+		t.Fatalf("quality period %v", period)
+	}
+	if period := refreshPeriod(client.Preset{SegmentDuration: 2, KeyframeInterval: 1000}, "main"); period != time.Second {
+		t.Fatalf("low-latency period %v", period)
+	}
+	t.Setenv("keyframe_refresh_overrides", "main=off,studio=4000,bad=soon")
+	if err := setupKeyframes(); err == nil {
+		t.Fatal("keyframe_refresh soon accepted")
+	}
+	if period := refreshPeriod(quality, "main"); period != 0 {
+		t.Fatalf("refresher off: %v", period)
+	}
+	if period := refreshPeriod(quality, "studio"); period != 3*time.Second {
+		t.Fatalf("studio period %v", period)
+	}
+	t.Setenv("keyframe_refresh_overrides", "studio=6000")
+	if err := setupKeyframes(); err != nil {
+		t.Fatal(err)
+	}
+	if period := refreshPeriod(quality, "studio"); period != 6*time.Second {
+		t.Fatalf("studio period %v", period)
+	}
+}
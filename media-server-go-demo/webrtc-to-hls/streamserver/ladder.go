@@ -0,0 +1,358 @@
+package streamserver
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/abr"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/hlscheck"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/ident"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/pipeline"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/playlist"
+)
+
+// masterName is the master playlist of an output with an ABR ladder,
+// captions or an audio-only rendition, listing the published video first
+// and then each rung
+const masterName = "master.m3u8"
+
+// ladderRate is the frame rate rungs are encoded at, so their keyframe
+// interval can follow the preset
+const ladderRate = 30
+
+// rungQueueBytes bounds the bytes appsrc holds for a rung's decoder before
+// pushing blocks and frames queue up in the rung's own queue
+const rungQueueBytes = 4 << 20
+
+// rungDecoder and rungEncoder transcode the published H.264 to one rung
+// with videoEncoder, packaged in the rung's directory, the watermark of the
+// output overlaid between them. Each rung is a pipeline of its own,
+// decoding the published video itself, so one wedged encoder can be
+// restarted without the others; see rungOutput.
+const rungDecoder = " ! avdec_h264"
+
+const rungEncoder = " ! videoscale ! videorate ! video/x-raw,width=%d,height=%d,framerate=%d/1 ! videoconvert ! %s ! h264parse"
+
+// ladderSpec is the ABR ladder of key under p: abr_ladder /
+// abr_ladder_overrides, or else the ladder of the preset, which fromPreset
+// tells
+func ladderSpec(p client.Preset, key string) (spec string, fromPreset bool) {
+	if spec := envForKey("abr_ladder", key); spec != "" {
+		return spec, false
+	}
+	return p.Ladder, true
+}
+
+// resolveLadder reads the ABR ladder of key under p, see ladderSpec and
+// abr.ParseLadder. Only TS outputs are transcoded, the ladder of a preset
+// left out of others, and none under a preset passing the video through. A
+// ladder longer than the profile allows is cut to its highest rungs, the
+// published video being a rendition too.
+func resolveLadder(p client.Preset, profile hlsProfile, container string, key string) ([]abr.Rung, error) {
+	spec, fromPreset := ladderSpec(p, key)
+	rungs, err := abr.ParseLadder(spec)
+	if err != nil || len(rungs) == 0 {
+		return nil, err
+	}
+	if p.Passthrough {
+		return nil, fmt.Errorf("abr ladder: preset %s passes the video through", p.Name)
+	}
+	if container != containerTS {
+		if fromPreset {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("abr ladder: %s outputs are not transcoded", container)
+	}
+	if max := profile.MaxRenditions; max > 0 && len(rungs)+1 > max {
+		rungs = rungs[:max-1]
+	}
+	return rungs, nil
+}
+
+// rungDir is where the rendition of rung is written
+func rungDir(dir string, rung abr.Rung) string {
+	return filepath.Join(dir, rung.Name)
+}
+
+// rungPrefix is what the segments of attempt of a rung are named with: a
+// restarted rung numbers its segments from 0 again
+func rungPrefix(generation int64, attempt int) string {
+	if attempt == 0 {
+		return segmentPrefix(generation)
+	}
+	return fmt.Sprintf("%s%d-", segmentPrefix(generation), attempt)
+}
+
+// rungPlaylist is the media playlist of attempt of a rung, a new one per
+// restart so players never see its media sequence start over
+func rungPlaylist(attempt int) string {
+	if attempt == 0 {
+		return playlistName
+	}
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(playlistName, ".m3u8"), attempt, ".m3u8")
+}
+
+// rungPipeline is the pipeline of attempt of rung, for an output generation
+// written to dir, with the session locked
+func (s *session) rungPipeline(dir string, generation int64, rung abr.Rung, attempt int) *pipeline.Builder {
+	p := s.preset
+	keyframes := p.KeyframeInterval * ladderRate / 1000
+	if keyframes < 1 {
+		keyframes = 1
+	}
+	rdir := rungDir(dir, rung)
+	sink := pipeline.HLS{
+		Container:      containerTS,
+		Prefix:         filepath.Join(rdir, rungPrefix(generation, attempt)),
+		Playlist:       filepath.Join(rdir, rungPlaylist(attempt)),
+		MaxFiles:       p.MaxFiles,
+		TargetDuration: p.SegmentDuration,
+		PlaylistLength: p.PlaylistLength,
+	}
+	enc := pipeline.H264{Encoder: videoEncoder, Bitrate: rung.Bitrate, KeyframeInterval: keyframes}
+	return s.sidePipeline(rungQueueBytes, rungDecoder+s.overlay()+fmt.Sprintf(rungEncoder, rung.Width, rung.Height, ladderRate, enc), sink)
+}
+
+// masterPath is where players fetch the master playlist of key
+func masterPath(key string) string {
+	return "/hls/" + key + "/" + masterName
+}
+
+// measurePlaylist reads the media playlist at path, returning the peak
+// bitrate of its listed segments and the first of them still on disk. ok is
+// false until it lists a segment.
+func measurePlaylist(path string) (peak int, first []byte, ok bool) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, nil, false
+	}
+	m, err := hlscheck.ParseMedia(data)
+	if err != nil || len(m.Segments) == 0 {
+		return 0, nil, false
+	}
+	dir := filepath.Dir(path)
+	for _, s := range m.Segments {
+		segment, err := ioutil.ReadFile(filepath.Join(dir, s.URI))
+		if err != nil {
+			// removed meanwhile
+			continue
+		}
+		if first == nil {
+			first = segment
+		}
+		if s.Duration > 0 {
+			if bitrate := int(math.Ceil(float64(len(segment)*8) / s.Duration)); bitrate > peak {
+				peak = bitrate
+			}
+		}
+	}
+	return peak, first, peak > 0
+}
+
+// measureRendition describes the rendition listed by the media playlist at
+// path for the master playlist: CODECS and RESOLUTION from the SPS of its
+// first segment, and from its ADTS headers when it muxes audio, BANDWIDTH
+// as the peak bitrate of the listed segments. first is that segment. ok is
+// false until it lists a segment.
+func measureRendition(path string, audio bool) (v abr.Variant, first []byte, ok bool) {
+	peak, first, ok := measurePlaylist(path)
+	if !ok {
+		return v, nil, false
+	}
+	v.Bandwidth = peak
+	if nal, err := hlscheck.FindSPS(first); err == nil {
+		if sps, err := hlscheck.ParseSPS(nal); err == nil {
+			v.Codecs, v.Width, v.Height = sps.CodecString(), sps.Width, sps.Height
+		}
+	}
+	if v.Codecs == "" {
+		return v, nil, false
+	}
+	if audio {
+		aac, err := hlscheck.FindADTS(first)
+		if err != nil {
+			return v, nil, false
+		}
+		v.Codecs += "," + aac.CodecString()
+	}
+	return v, first, true
+}
+
+// masterListing is what the master playlist of a live session lists
+type masterListing struct {
+	// rungs are the healthy rungs of the ladder
+	rungs []listedRung
+	// audio is set when the renditions mux audio
+	audio bool
+	// captions is the language of the captions, empty without
+	captions string
+	// audioOnly is set when the output has an audio-only rendition, of
+	// audioCodec
+	audioOnly  bool
+	audioCodec string
+	// mainAudio is the audio muxed with the video, alternateAudio the
+	// alternate audio renditions
+	mainAudio      audioTrack
+	alternateAudio []audioTrack
+	// cmaf times the output when it is fMP4, whose video is described by
+	// the parameters it saw rather than by its segments
+	cmaf *cmafTimeline
+}
+
+// ladderOf describes the master playlist of the live session of key, false
+// when it has none: no ladder, captions, audio-only or alternate audio
+// rendition
+func ladderOf(key string) (masterListing, bool) {
+	sess := registry.get(key)
+	if sess == nil {
+		return masterListing{}, false
+	}
+	sess.Lock()
+	listing := masterListing{captions: sess.captionLanguage, audioOnly: sess.audioRendition, mainAudio: sess.mainAudio, alternateAudio: sess.packagedAudio, cmaf: sess.cmaf, audioCodec: sess.audioCodec()}
+	started := sess.started && (len(sess.ladder) > 0 || listing.captions != "" || listing.audioOnly || len(listing.alternateAudio) > 0)
+	// the video of fMP4 outputs is silent
+	listing.audio = sess.audio && sess.container != containerFMP4
+	var ladder *ladderOutput
+	if sess.hls != nil {
+		ladder = sess.hls.ladder
+	}
+	sess.Unlock()
+	if !started {
+		return masterListing{}, false
+	}
+	if ladder != nil {
+		// nil between two output generations, or without rungs
+		listing.rungs = ladder.listed()
+	}
+	return listing, true
+}
+
+// serveMaster serves the master playlist of a stream key with a ladder,
+// captions, an audio-only or alternate audio renditions, listing the
+// renditions that have segments and are healthy, the audio-only one last,
+// the alternate audio as their audio group and the captions as their
+// subtitles
+func serveMaster(c *gin.Context) {
+	parts := strings.Split(strings.TrimPrefix(c.Request.URL.Path, "/hls/"), "/")
+	if !strings.HasPrefix(c.Request.URL.Path, "/hls/") || len(parts) != 2 || parts[1] != masterName || ident.Check(ident.StreamKey, parts[0]) != nil {
+		c.Next()
+		return
+	}
+	c.Abort()
+	listing, ok := ladderOf(parts[0])
+	if !ok {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	dir := outputDir(parts[0])
+	var variants []abr.Variant
+	// the first segments of the TS renditions, by URI, for the gate
+	firsts := make(map[string][]byte)
+	if listing.cmaf != nil {
+		if peak, _, ok := measurePlaylist(filepath.Join(dir, playlistName)); ok {
+			v := abr.Variant{Name: "source", URI: playlistName, Bandwidth: peak}
+			v.Codecs, v.Width, v.Height = listing.cmaf.video()
+			variants = append(variants, v)
+		}
+	} else if v, first, ok := measureRendition(filepath.Join(dir, playlistName), listing.audio); ok {
+		v.Name, v.URI = "source", playlistName
+		variants = append(variants, v)
+		firsts[v.URI] = first
+	}
+	for _, rung := range listing.rungs {
+		if v, first, ok := measureRendition(filepath.Join(rungDir(dir, rung.Rung), rung.playlist), listing.audio); ok {
+			v.Name, v.URI = rung.Name, rung.Name+"/"+rung.playlist
+			variants = append(variants, v)
+			firsts[v.URI] = first
+		}
+	}
+	if listing.audioOnly {
+		if peak, first, ok := measurePlaylist(filepath.Join(audioRenditionDir(dir), playlistName)); ok {
+			v := abr.Variant{Name: audioRenditionName, Bandwidth: peak, Codecs: listing.audioCodec, URI: audioRenditionName + "/" + playlistName}
+			if v.Codecs == aacCodec {
+				// listed once a segment shows its AAC, as the renditions
+				// muxing audio are
+				aac, err := hlscheck.FindADTS(first)
+				v.Codecs, ok = aac.CodecString(), err == nil
+			}
+			if ok {
+				variants = append(variants, v)
+				firsts[v.URI] = first
+			}
+		}
+	}
+	var renditions []playlist.Rendition
+	if len(listing.alternateAudio) > 0 {
+		renditions = audioRenditions(dir, listing.mainAudio, listing.alternateAudio)
+		// alternates are only packaged next to TS variants muxing audio
+		for i := range variants {
+			variants[i].Audio = audioGroup
+		}
+	}
+	if listing.captions != "" {
+		renditions = append(renditions, playlist.Rendition{Type: playlist.SubtitlesMedia, GroupID: captionsGroup, Name: "Captions", Language: listing.captions, URI: captionsName})
+		for i := range variants {
+			variants[i].Subtitles = captionsGroup
+		}
+	}
+	if len(variants) == 0 {
+		c.String(http.StatusNotFound, "no rendition has segments yet")
+		return
+	}
+	var buf bytes.Buffer
+	abr.WriteMaster(&buf, variants, nil, renditions...)
+	serve := buf.Bytes()
+	if out := outputs.lookup(parts[0]); out != nil && os.Getenv("playlist_validation") != "off" {
+		gate := out.gates.gate(masterName)
+		gated, changed, err := gate.Master(serve, func(uri string) ([]byte, bool) {
+			first, ok := firsts[uri]
+			return first, ok
+		})
+		if err != nil && changed {
+			heldBack(parts[0], masterName, err)
+		}
+		if gated == nil {
+			if gate.Strict && err != nil {
+				c.String(http.StatusInternalServerError, err.Error())
+				return
+			}
+			c.String(http.StatusNotFound, "no master playlist passed validation yet")
+			return
+		}
+		serve = gated
+	}
+	c.Header("Cache-Control", "no-cache")
+	c.Data(http.StatusOK, "application/vnd.apple.mpegurl", serve)
+}
+
+// audioRenditions are the renditions of the audio group of the output
+// written to dir: main, muxed with the video, the default, and the
+// alternates that have segments
+func audioRenditions(dir string, main audioTrack, alternates []audioTrack) []playlist.Rendition {
+	name := main.language
+	if name == "" {
+		name = "main"
+	}
+	renditions := []playlist.Rendition{{Type: playlist.AudioMedia, GroupID: audioGroup, Name: name, Language: main.language, Default: true}}
+	for _, alternate := range alternates {
+		if _, _, ok := measurePlaylist(filepath.Join(alternateAudioDir(dir, alternate.language), playlistName)); !ok {
+			continue
+		}
+		renditions = append(renditions, playlist.Rendition{
+			Type:     playlist.AudioMedia,
+			GroupID:  audioGroup,
+			Name:     alternate.language,
+			Language: alternate.language,
+			URI:      audioRenditionName + "-" + alternate.language + "/" + playlistName,
+		})
+	}
+	return renditions
+}
@@ -0,0 +1,317 @@
+package streamserver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/abr"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+)
+
+func TestResolveLadder(t *testing.T) {
+	t.Setenv("abr_ladder_overrides", "mobile=on,bad=720p")
+	balanced := presets[client.LatencyBalanced]
+	web, tv := hlsProfiles[client.ProfileWebDefault], hlsProfiles[client.ProfileTVLegacy]
+	if rungs, err := resolveLadder(balanced, web, containerTS, "main"); err != nil || rungs != nil {
+		t.Fatalf("default ladder = %v, %v", rungs, err)
+	}
+	if rungs, err := resolveLadder(balanced, web, containerTS, "mobile"); err != nil || len(rungs) != 3 {
+		t.Fatalf("ladder = %v, %v", rungs, err)
+	}
+	// tv-legacy allows three renditions, the published video and two rungs
+	if rungs, err := resolveLadder(balanced, tv, containerTS, "mobile"); err != nil || len(rungs) != 2 || rungs[0].Name != "1080p" {
+		t.Fatalf("tv-legacy ladder = %v, %v", rungs, err)
+	}
+	if _, err := resolveLadder(balanced, web, containerFMP4, "mobile"); err == nil {
+		t.Fatal("fmp4 output transcoded")
+	}
+	if _, err := resolveLadder(balanced, web, containerTS, "bad"); err == nil {
+		t.Fatal("bad ladder accepted")
+	}
+}
+
+func TestLadderPipeline(t *testing.T) {
+	preset := presets[client.LatencyBalanced]
+	rung := abr.Rung{Name: "360p", Width: 640, Height: 360, Bitrate: 800}
+	sess := newSession("ladder", nil, preset)
+	pipeline := sess.rungPipeline("hls/main", 4, rung, 0).String()
+	for _, want := range []string{
+		"name=appsrc ! h264parse ! avdec_h264 ! ",
+		"video/x-raw,width=640,height=360,framerate=30/1 ! videoconvert ! x264enc tune=zerolatency speed-preset=veryfast bitrate=800 key-int-max=60 ",
+		"mpegtsmux name=muxer ! hlssink location=hls/main/360p/segment-4-%05d.ts playlist-location=hls/main/360p/playlist.m3u8 max-files=10 target-duration=2 playlist-length=6",
+	} {
+		if !strings.Contains(pipeline, want) {
+			t.Fatalf("no %q in %s", want, pipeline)
+		}
+	}
+	// a restarted rung numbers its segments and lists them anew
+	if restarted := sess.rungPipeline("hls/main", 4, rung, 2).String(); !strings.Contains(restarted, "location=hls/main/360p/segment-4-2-%05d.ts playlist-location=hls/main/360p/playlist-2.m3u8 ") {
+		t.Fatalf("restarted rung = %s", restarted)
+	}
+	if strings.Contains(pipeline, "audiosrc") {
+		t.Fatalf("rung audio without audio: %s", pipeline)
+	}
+	sess.audio = true
+	if muxed := sess.rungPipeline("hls/main", 4, rung, 0).String(); !strings.HasSuffix(muxed, "tee name=aac ! queue ! muxer.") {
+		t.Fatalf("rung audio not muxed: %s", muxed)
+	}
+	defer func(saved string) { videoEncoder = saved }(videoEncoder)
+	videoEncoder = "nvenc"
+	if nvenc := sess.rungPipeline("hls/main", 4, rung, 0).String(); !strings.Contains(nvenc, "videoconvert ! nvh264enc preset=low-latency-hq rc-mode=cbr zerolatency=true bitrate=800 gop-size=60 ! h264parse") {
+		t.Fatalf("nvenc rung = %s", nvenc)
+	}
+}
+
+func TestRenditionHealth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "renditions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sess := newSession("abr-health", nil, presets[client.LatencyBalanced])
+	sess.ladder = []abr.Rung{{Name: "720p", Width: 1280, Height: 720, Bitrate: 2500}, {Name: "360p", Width: 640, Height: 360, Bitrate: 800}}
+	sess.Lock()
+	ladder, err := sess.startLadder(dir, 4)
+	sess.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ladder.release()
+	events, cancel := controlEvents.Subscribe(16)
+	defer cancel()
+
+	segment := func(rung, name string) {
+		rdir := filepath.Join(dir, rung)
+		if err := os.MkdirAll(rdir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(rdir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	listed := func() string {
+		var rungs []string
+		for _, rung := range ladder.listed() {
+			rungs = append(rungs, rung.Name+"/"+rung.playlist)
+		}
+		return strings.Join(rungs, ",")
+	}
+
+	start := time.Now()
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+	segment("720p", "segment-4-00000.ts")
+	segment("360p", "segment-4-00000.ts")
+	ladder.check(at(0), at(0))
+	if got := listed(); got != "720p/playlist.m3u8,360p/playlist.m3u8" {
+		t.Fatalf("listed %s", got)
+	}
+	// 360p stalls past three segment durations and is restarted
+	segment("720p", "segment-4-00001.ts")
+	ladder.check(at(7), at(7))
+	if got := listed(); got != "720p/playlist.m3u8" {
+		t.Fatalf("listed %s with 360p stalled", got)
+	}
+	if states := sess.renditions(); states != nil || ladder.states()["360p"] != "recovering" {
+		t.Fatalf("states %v %v", states, ladder.states())
+	}
+	var transitions []string
+	for len(transitions) < 2 {
+		select {
+		case event := <-events:
+			if event.Type == hookRenditionHealth && event.Stream == "abr-health" && event.Data["rendition"] == "360p" {
+				transitions = append(transitions, event.Data["to"])
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("transitions %v", transitions)
+		}
+	}
+	if strings.Join(transitions, ",") != "unhealthy,recovering" {
+		t.Fatalf("transitions %v", transitions)
+	}
+
+	// the restarted attempt is listed again after two good segments
+	for i, name := range []string{"segment-4-1-00000.ts", "segment-4-1-00001.ts"} {
+		segment("720p", fmt.Sprintf("segment-4-%05d.ts", i+2))
+		segment("360p", name)
+		ladder.check(at(8+i), at(8+i))
+	}
+	if got := listed(); got != "720p/playlist.m3u8,360p/playlist-1.m3u8" {
+		t.Fatalf("listed %s after recovery", got)
+	}
+}
+
+// testSegment is a segment of size bytes starting with the SPS of a
+// 1280x720 baseline stream, then AAC-LC, 48kHz stereo
+func testSegment(size int) []byte {
+	sps := []byte{0, 0, 0, 1, 0x67, 0x42, 0xc0, 0x1f, 0xda, 0x01, 0x40, 0x16, 0xe8}
+	return append(append(sps, testADTS...), make([]byte, size-len(sps)-len(testADTS))...)
+}
+
+// testADTS are two ADTS frames of AAC-LC, 48kHz stereo, 16 bytes each
+var testADTS = []byte{
+	0xff, 0xf1, 0x4c, 0x80, 0x02, 0x1f, 0xfc, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0xff, 0xf1, 0x4c, 0x80, 0x02, 0x1f, 0xfc, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+}
+
+func TestServeMaster(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(serveMaster)
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", masterPath("abr-live"), nil))
+		return w
+	}
+
+	dir := outputDir("abr-live")
+	defer os.RemoveAll(dir)
+	sess := newSession("abr-live", nil, presets[client.LatencyBalanced])
+	sess.ladder = []abr.Rung{{Name: "720p", Width: 1280, Height: 720, Bitrate: 2500}, {Name: "360p", Width: 640, Height: 360, Bitrate: 800}}
+	if _, err := registry.claim(sess, conflictReject); err != nil {
+		t.Fatal(err)
+	}
+	defer registry.release(sess)
+	sess.Lock()
+	sess.started, sess.audio = true, true
+	sess.hls, _ = newHLSOutput("")
+	sess.hls.ladder, _ = sess.startLadder(dir, 4)
+	hls := sess.hls
+	sess.Unlock()
+	defer hls.Release()
+	if w := get(); w.Code != http.StatusNotFound {
+		t.Fatalf("no segment yet = %d", w.Code)
+	}
+
+	// the source and the 720p rung have a segment, 360p has not
+	for _, rdir := range []string{dir, filepath.Join(dir, "720p")} {
+		if err := os.MkdirAll(rdir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(rdir, "segment-4-00000.ts"), testSegment(250000), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(rdir, playlistName), []byte("#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXTINF:2.000,\nsegment-4-00000.ts\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := get()
+	want := "#EXTM3U\n#EXT-X-VERSION:3\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=1000000,RESOLUTION=1280x720,CODECS=\"avc1.42c01f,mp4a.40.2\"\nplaylist.m3u8\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=1000000,RESOLUTION=1280x720,CODECS=\"avc1.42c01f,mp4a.40.2\"\n720p/playlist.m3u8\n"
+	if w.Code != http.StatusOK || w.Body.String() != want {
+		t.Fatalf("master = %d\n%s", w.Code, w.Body.String())
+	}
+	if streamIDs(sess)["master"] != masterPath("abr-live") {
+		t.Fatalf("ids = %v", streamIDs(sess))
+	}
+}
+
+func TestServeMasterProfile(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(serveMaster)
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", masterPath("tv-live"), nil))
+		return w
+	}
+
+	dir := outputDir("tv-live")
+	defer os.RemoveAll(dir)
+	sess := newSession("tv-live", nil, presets[client.LatencyBalanced])
+	sess.ladder = []abr.Rung{{Name: "720p", Width: 1280, Height: 720, Bitrate: 2500}, {Name: "360p", Width: 640, Height: 360, Bitrate: 800}}
+	if _, err := registry.claim(sess, conflictReject); err != nil {
+		t.Fatal(err)
+	}
+	defer registry.release(sess)
+	outputs.get("tv-live").gates.reset(hlsProfiles[client.ProfileTVLegacy].rules())
+	sess.Lock()
+	sess.started, sess.audio = true, true
+	sess.hls, _ = newHLSOutput("")
+	sess.hls.ladder, _ = sess.startLadder(dir, 4)
+	hls := sess.hls
+	sess.Unlock()
+	defer hls.Release()
+
+	write := func(rdir string, segment []byte) {
+		if err := os.MkdirAll(rdir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(rdir, "segment-4-00000.ts"), segment, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(rdir, playlistName), []byte("#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXTINF:2.000,\nsegment-4-00000.ts\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, rdir := range []string{dir, filepath.Join(dir, "720p"), filepath.Join(dir, "360p")} {
+		write(rdir, testSegment(250000))
+	}
+	w := get()
+	if w.Code != http.StatusOK || strings.Count(w.Body.String(), "#EXT-X-STREAM-INF") != 3 {
+		t.Fatalf("master = %d\n%s", w.Code, w.Body.String())
+	}
+	good := w.Body.String()
+
+	// the audio-only rendition makes a fourth variant, one more than
+	// tv-legacy players take: the last good master is served instead
+	sess.Lock()
+	sess.audioRendition = true
+	sess.Unlock()
+	write(audioRenditionDir(dir), append(testADTS, make([]byte, 16000-len(testADTS))...))
+	if w := get(); w.Code != http.StatusOK || w.Body.String() != good {
+		t.Fatalf("non-conforming master = %d\n%s", w.Code, w.Body.String())
+	}
+	entries := sess.timeline.entries()
+	if last := entries[len(entries)-1]; last.Kind != eventWarning || !strings.Contains(last.Detail, client.WarningPlaylistHeld) || !strings.Contains(last.Detail, "4 variants") {
+		t.Fatalf("timeline entry = %+v", last)
+	}
+}
+
+func TestServeMasterAudioRendition(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(serveMaster)
+
+	dir := outputDir("podcast-live")
+	defer os.RemoveAll(dir)
+	sess := newSession("podcast-live", nil, presets[client.LatencyBalanced])
+	if _, err := registry.claim(sess, conflictReject); err != nil {
+		t.Fatal(err)
+	}
+	defer registry.release(sess)
+	sess.Lock()
+	sess.started, sess.audio, sess.audioRendition = true, true, true
+	sess.Unlock()
+
+	for rdir, segment := range map[string][]byte{dir: testSegment(250000), audioRenditionDir(dir): append(testADTS, make([]byte, 16000-len(testADTS))...)} {
+		if err := os.MkdirAll(rdir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(rdir, "segment-4-00000.ts"), segment, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(rdir, playlistName), []byte("#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXTINF:2.000,\nsegment-4-00000.ts\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", masterPath("podcast-live"), nil))
+	want := "#EXTM3U\n#EXT-X-VERSION:3\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=1000000,RESOLUTION=1280x720,CODECS=\"avc1.42c01f,mp4a.40.2\"\nplaylist.m3u8\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=64000,CODECS=\"mp4a.40.2\"\naudio/playlist.m3u8\n"
+	if w.Code != http.StatusOK || w.Body.String() != want {
+		t.Fatalf("master = %d\n%s", w.Code, w.Body.String())
+	}
+	if streamIDs(sess)["master"] != masterPath("podcast-live") {
+		t.Fatalf("ids = %v", streamIDs(sess))
+	}
+}
@@ -0,0 +1,236 @@
+package streamserver
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// protocolSynthetic is the ingest of the publishers of the load generator
+const protocolSynthetic = "synthetic"
+
+// syntheticFormat is a synthetic publisher, completed with its pattern,
+// size, framerate, bitrate in kbps and keyframe interval: a test pattern
+// encoded to H.264, with a tone encoded to AAC, received as the media of
+// an SRT publisher is
+const syntheticFormat = "videotestsrc is-live=true pattern=%s ! video/x-raw,width=%d,height=%d,framerate=%d/1 ! timeoverlay ! videoconvert ! x264enc tune=zerolatency speed-preset=ultrafast bitrate=%d key-int-max=%d ! h264parse ! video/x-h264,stream-format=byte-stream,alignment=au ! appsink name=videosink " +
+	"audiotestsrc is-live=true wave=ticks ! audio/x-raw,rate=48000,channels=2 ! audioconvert ! avenc_aac ! aacparse ! audio/mpeg,stream-format=adts ! appsink name=audiosink"
+
+// syntheticPatterns are the test patterns of the publishers, in turn; all
+// move so that no encoder idles on a still picture
+var syntheticPatterns = []string{"ball", "smpte", "snow", "pinwheel"}
+
+var errLoadRunning = errors.New("the load generator is running")
+
+// loadGenerator publishes synthetic streams loadtest-1 to loadtest-N, to
+// load the packaging, the storage and the API without real publishers
+type loadGenerator struct {
+	sync.Mutex
+	keys    []string
+	stop    chan struct{}
+	started time.Time
+}
+
+var load = &loadGenerator{}
+
+// syntheticLaunch is the launch description of the synthetic publisher n,
+// from loadtest_resolution (640x360), loadtest_framerate (30) and
+// loadtest_bitrate_kbps (1000)
+func syntheticLaunch(n int) (string, error) {
+	width, height := 640, 360
+	if size := strings.TrimSpace(os.Getenv("loadtest_resolution")); size != "" {
+		wh := strings.SplitN(strings.ToLower(size), "x", 2)
+		if len(wh) != 2 {
+			return "", fmt.Errorf("loadtest_resolution: %q is not WxH", size)
+		}
+		w, werr := strconv.Atoi(wh[0])
+		h, herr := strconv.Atoi(wh[1])
+		if werr != nil || herr != nil || w <= 0 || h <= 0 || w%2 != 0 || h%2 != 0 {
+			return "", fmt.Errorf("loadtest_resolution: %q is not an even WxH", size)
+		}
+		width, height = w, h
+	}
+	framerate, bitrate := envInt("loadtest_framerate", 30), envInt("loadtest_bitrate_kbps", 1000)
+	if framerate <= 0 || bitrate <= 0 {
+		return "", fmt.Errorf("loadtest_framerate and loadtest_bitrate_kbps must be positive")
+	}
+	pattern := syntheticPatterns[(n-1)%len(syntheticPatterns)]
+	return fmt.Sprintf(syntheticFormat, pattern, width, height, framerate, bitrate, 2*framerate), nil
+}
+
+// start publishes n synthetic streams, each started over after rtspRetry
+// when its publish fails, until stop
+func (g *loadGenerator) start(n int) error {
+	if n <= 0 {
+		return fmt.Errorf("the publishers must be positive")
+	}
+	var launches []string
+	for i := 1; i <= n; i++ {
+		launch, err := syntheticLaunch(i)
+		if err != nil {
+			return err
+		}
+		launches = append(launches, launch)
+	}
+	g.Lock()
+	defer g.Unlock()
+	if g.stop != nil {
+		return errLoadRunning
+	}
+	g.keys, g.stop, g.started = nil, make(chan struct{}), time.Now()
+	for i, launch := range launches {
+		key := fmt.Sprintf("loadtest-%d", i+1)
+		g.keys = append(g.keys, key)
+		go g.publish(key, ingestInput{protocol: protocolSynthetic, launch: launch, where: "the load generator", stop: g.stop})
+	}
+	logger.Info("load generator started", "publishers", n)
+	return nil
+}
+
+func (g *loadGenerator) publish(key string, in ingestInput) {
+	for {
+		if err := ingestFrom(key, in); err != nil {
+			logger.Warn("synthetic publish failed", "stream", key, "error", err)
+		}
+		select {
+		case <-in.stop:
+			return
+		case <-time.After(rtspRetry):
+		}
+	}
+}
+
+// end stops the publishers, reporting whether they ran
+func (g *loadGenerator) end() bool {
+	g.Lock()
+	defer g.Unlock()
+	if g.stop == nil {
+		return false
+	}
+	close(g.stop)
+	g.keys, g.stop = nil, nil
+	logger.Info("load generator stopped")
+	return true
+}
+
+// loadReport is the load of the publishers of the generator on the process.
+// The CPU is that of the whole process, the encoders of the publishers
+// included, so the streams a core packages are at least those reported.
+type loadReport struct {
+	Publishers int       `json:"publishers"`
+	Started    time.Time `json:"started,omitempty"`
+	// Live counts the publishers whose output pipeline runs
+	Live int `json:"live"`
+	// Restarts counts the restarts of their pipelines
+	Restarts int `json:"restarts"`
+	Cores    int `json:"cores"`
+	// CPUSeconds is the user and system time of the process since it
+	// started, so that two reports give the cores used between them
+	CPUSeconds float64   `json:"cpuSeconds"`
+	At         time.Time `json:"at"`
+}
+
+func (g *loadGenerator) report() loadReport {
+	g.Lock()
+	keys, started := g.keys, g.started
+	g.Unlock()
+	r := loadReport{Publishers: len(keys), Cores: runtime.NumCPU(), CPUSeconds: cpuSeconds(), At: time.Now()}
+	if len(keys) > 0 {
+		r.Started = started
+	}
+	for _, key := range keys {
+		sess := registry.get(key)
+		if sess == nil {
+			continue
+		}
+		status := sess.pipelineState()
+		if status.State == pipelineRunning {
+			r.Live++
+		}
+		r.Restarts += status.Restarts
+	}
+	return r
+}
+
+// cpuSeconds is the user and system time of the process
+func cpuSeconds() float64 {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano()).Seconds()
+}
+
+// setupLoadTest starts the publishers of loadtest_publishers, none by
+// default
+func setupLoadTest() error {
+	n := envInt("loadtest_publishers", 0)
+	if n == 0 {
+		return nil
+	}
+	return load.start(n)
+}
+
+// startLoadTest handles POST /api/v1/loadtest?publishers=N, 409 while the
+// generator runs
+func startLoadTest(c *gin.Context) {
+	admin, ok := adminIdentity(c)
+	if !ok {
+		return
+	}
+	n, err := strconv.Atoi(c.Query("publishers"))
+	if err != nil || n <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "publishers must be a positive number"})
+		return
+	}
+	if err := audit.record(auditEntry{Time: time.Now(), Admin: admin, Action: "loadtest-start", Reason: strconv.Itoa(n) + " publishers"}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	switch err := load.start(n); err {
+	case nil:
+	case errLoadRunning:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, load.report())
+}
+
+// getLoadTest handles GET /api/v1/loadtest, the report of the generator
+func getLoadTest(c *gin.Context) {
+	if _, ok := adminIdentity(c); !ok {
+		return
+	}
+	c.JSON(http.StatusOK, load.report())
+}
+
+// stopLoadTest handles DELETE /api/v1/loadtest, answering the report of
+// the publishers stopped, 404 when none ran
+func stopLoadTest(c *gin.Context) {
+	admin, ok := adminIdentity(c)
+	if !ok {
+		return
+	}
+	if err := audit.record(auditEntry{Time: time.Now(), Admin: admin, Action: "loadtest-stop"}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	report := load.report()
+	if !load.end() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "the load generator is not running"})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,42 @@
+package streamserver
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSyntheticLaunch(t *testing.T) {
+	t.Setenv("loadtest_resolution", "1280x720")
+	t.Setenv("loadtest_framerate", "25")
+	launch, err := syntheticLaunch(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, part := range []string{"pattern=smpte", "width=1280,height=720,framerate=25/1", "bitrate=1000 key-int-max=50", "appsink name=videosink", "appsink name=audiosink"} {
+		if !strings.Contains(launch, part) {
+			t.Fatalf("%q not in %s", part, launch)
+		}
+	}
+	if launch, _ := syntheticLaunch(5); !strings.Contains(launch, "pattern=ball") {
+		t.Fatalf("fifth publisher %s", launch)
+	}
+	for _, size := range []string{"720p", "641x360", "0x0"} {
+		t.Setenv("loadtest_resolution", size)
+		if _, err := syntheticLaunch(1); err == nil {
+			t.Fatalf("resolution %s accepted", size)
+		}
+	}
+}
+
+func TestLoadGenerator(t *testing.T) {
+	g := &loadGenerator{}
+	if err := g.start(0); err == nil {
+		t.Fatal("no publishers accepted")
+	}
+	if g.end() {
+		t.Fatal("idle generator stopped")
+	}
+	if r := g.report(); r.Publishers != 0 || !r.Started.IsZero() || r.Cores == 0 {
+		t.Fatalf("idle report %+v", r)
+	}
+}
@@ -0,0 +1,97 @@
+package streamserver
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+	mediaserver "github.com/notedit/media-server-go"
+)
+
+// logLevel is the level of the server logs, log_level (info) at start and
+// then PUT /api/v1/log-level
+var logLevel = new(slog.LevelVar)
+
+// logger writes the server logs to standard output as JSON lines: time,
+// level and msg, then the attributes of the line, e.g. stream
+var logger = slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel}))
+
+// setupLogging reads log_level: debug, info, warn or error
+func setupLogging() error {
+	if level := os.Getenv("log_level"); level != "" {
+		if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+			return err
+		}
+	}
+	applyLogLevel()
+	return nil
+}
+
+// applyLogLevel has the media server log as much as the server: its debug
+// logs at debug
+func applyLogLevel() {
+	mediaserver.EnableLog(logLevel.Level() <= slog.LevelInfo)
+	mediaserver.EnableDebug(logLevel.Level() <= slog.LevelDebug)
+}
+
+// fatal logs err and exits, for what the server cannot start without
+func fatal(msg string, err error) {
+	logger.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// sessionLog is the logger of a session, its lines carrying the stream
+// key and session id, the signaling connection and the transport once
+// known. It is swapped atomically as those become known so logging never
+// needs the session lock.
+type sessionLog struct {
+	v atomic.Value
+}
+
+func (l *sessionLog) get() *slog.Logger {
+	if logger, ok := l.v.Load().(*slog.Logger); ok {
+		return logger
+	}
+	return logger
+}
+
+func (l *sessionLog) with(args ...interface{}) {
+	l.v.Store(l.get().With(args...))
+}
+
+// logLevelJSON describes the log level
+func logLevelJSON() gin.H {
+	return gin.H{"level": strings.ToLower(logLevel.Level().String())}
+}
+
+// getLogLevel handles GET /api/v1/log-level
+func getLogLevel(c *gin.Context) {
+	c.JSON(http.StatusOK, logLevelJSON())
+}
+
+// setLogLevel handles PUT /api/v1/log-level, {"level": "debug"}, until the
+// next change or restart
+func setLogLevel(c *gin.Context) {
+	admin, ok := adminIdentity(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Level string `json:"level"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		return
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(req.Level)); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	logLevel.Set(level)
+	applyLogLevel()
+	logger.Warn("log level set", "level", level.String(), "admin", admin)
+	c.JSON(http.StatusOK, logLevelJSON())
+}
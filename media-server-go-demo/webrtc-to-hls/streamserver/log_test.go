@@ -0,0 +1,69 @@
+package streamserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+)
+
+func TestLogLevelAPI(t *testing.T) {
+	defer logLevel.Set(logLevel.Level())
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/api/v1/log-level", getLogLevel)
+	r.PUT("/api/v1/log-level", setLogLevel)
+	do := func(method, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, "/api/v1/log-level", strings.NewReader(body))
+		asAdmin(req, "ops")
+		r.ServeHTTP(w, req)
+		return w
+	}
+	for body, status := range map[string]int{`{"level":"loud"}`: http.StatusBadRequest, `{}`: http.StatusBadRequest, `{"level":"debug"}`: http.StatusOK} {
+		if w := do("PUT", body); w.Code != status {
+			t.Errorf("PUT %s = %d", body, w.Code)
+		}
+	}
+	if w := do("GET", ""); w.Body.String() != `{"level":"debug"}` {
+		t.Fatalf("level = %s", w.Body)
+	}
+	if !logger.Enabled(context.Background(), slog.LevelDebug) {
+		t.Fatal("debug lines are still dropped")
+	}
+}
+
+func TestSetupLogging(t *testing.T) {
+	defer logLevel.Set(logLevel.Level())
+	t.Setenv("log_level", "warn")
+	if err := setupLogging(); err != nil || logLevel.Level() != slog.LevelWarn {
+		t.Fatalf("level = %v, %v", logLevel.Level(), err)
+	}
+	t.Setenv("log_level", "chatty")
+	if setupLogging() == nil {
+		t.Fatal("unknown level accepted")
+	}
+}
+
+func TestSessionLog(t *testing.T) {
+	var out bytes.Buffer
+	defer func(l *slog.Logger) { logger = l }(logger)
+	logger = slog.New(slog.NewJSONHandler(&out, nil))
+	s := newSession("logged", &signaling{id: "conn"}, client.Preset{})
+	s.log.with("transport", "ufrag")
+	s.logf("publishing %d tracks", 2)
+	var line map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &line); err != nil {
+		t.Fatalf("%v: %s", err, out.String())
+	}
+	if line["msg"] != "publishing 2 tracks" || line["stream"] != "logged" || line["session"] != s.id || line["transport"] != "ufrag" || line["connection"] != "conn" {
+		t.Fatalf("line = %v", line)
+	}
+}
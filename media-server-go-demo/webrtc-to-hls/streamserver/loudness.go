@@ -0,0 +1,85 @@
+package streamserver
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/loudness"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/pipeline"
+)
+
+// loudnessTap is the tee of the decoded audio of an output normalized to a
+// loudness target, linked as loudnesstap.
+const loudnessTap = "loudnesstap"
+
+// loudnessRate is the rate the loudness of an output is measured at
+const loudnessRate = 48000
+
+// loudnessBranch measures the audio of the output as published, before it
+// is normalized: appsink loudnesssink gives its PCM, see hlsOutput.meter
+var loudnessBranch = fmt.Sprintf("%s. ! queue leaky=downstream ! audioconvert ! audioresample ! audio/x-raw,format=S16LE,channels=2,rate=%d ! appsink name=loudnesssink sync=false", loudnessTap, loudnessRate)
+
+// resolveLoudness reads the loudness the audio of the outputs of key is
+// normalized to before it is encoded, in LUFS, from loudness_target /
+// loudness_target_overrides: -23 for EBU R 128, -16 or -14 for streaming
+// platforms. 0, unset, leaves the audio as published.
+func resolveLoudness(key string) (float64, error) {
+	value := strings.TrimSpace(envForKey("loudness_target", key))
+	if value == "" {
+		return 0, nil
+	}
+	target, err := strconv.ParseFloat(value, 64)
+	if err != nil || target < -70 || target > -5 {
+		return 0, fmt.Errorf("loudness target must be between -70 and -5 LUFS, not %q", value)
+	}
+	return target, nil
+}
+
+// normalizedTrack is the audio of an output normalized to target LUFS by
+// audioloudnorm, which runs at 192 kHz, then encoded to AAC: the AAC of
+// caps, for RTMP and SRT publishers, or else the Opus of WebRTC publishers,
+// decoded first. The decoded audio is teed as loudnessTap for
+// loudnessBranch to measure.
+func normalizedTrack(caps string, target float64) pipeline.Track {
+	input := opusDecode
+	if caps != "" {
+		input = caps + " ! aacparse ! avdec_aac"
+	}
+	input += fmt.Sprintf(" ! audioconvert ! tee name=%s ! queue ! audioresample ! audio/x-raw,rate=192000 ! audioloudnorm loudness-target=%g ! audioresample ! audio/x-raw,rate=%d ! audioconvert ! avenc_aac ! aacparse", loudnessTap, target, loudnessRate)
+	return pipeline.Track{Name: "audiosrc", Input: input, Timed: true}
+}
+
+// outputAudioTrack is the audio of the outputs of the session, with the
+// session locked: passed through, normalized or transcoded as its settings
+// say
+func (s *session) outputAudioTrack() pipeline.Track {
+	switch {
+	case s.passesOpus():
+		return opusTrack()
+	case s.loudnessTarget != 0:
+		return normalizedTrack(s.aacCaps, s.loudnessTarget)
+	}
+	return aacTrack(s.aacCaps)
+}
+
+// lufs is loudness for stats, nil for loudness.Silence, which JSON cannot
+// carry
+func lufs(value float64) interface{} {
+	if math.IsInf(value, -1) {
+		return nil
+	}
+	return math.Round(value*10) / 10
+}
+
+// loudnessStats are the loudness target of the output and the loudness of
+// the audio published, as meter measured it
+func loudnessStats(target float64, meter *loudness.Meter) map[string]interface{} {
+	return map[string]interface{}{
+		"targetLufs":     target,
+		"momentaryLufs":  lufs(meter.Momentary()),
+		"shortTermLufs":  lufs(meter.ShortTerm()),
+		"integratedLufs": lufs(meter.Integrated()),
+	}
+}
@@ -0,0 +1,56 @@
+package streamserver
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/loudness"
+)
+
+func TestResolveLoudness(t *testing.T) {
+	t.Setenv("loudness_target_overrides", "show=-23,loud=0,bad=-100,text=quiet")
+	if target, err := resolveLoudness("other"); err != nil || target != 0 {
+		t.Fatalf("default target = %v, %v", target, err)
+	}
+	if target, err := resolveLoudness("show"); err != nil || target != -23 {
+		t.Fatalf("target = %v, %v", target, err)
+	}
+	for _, key := range []string{"loud", "bad", "text"} {
+		if _, err := resolveLoudness(key); err == nil {
+			t.Fatalf("%s accepted", key)
+		}
+	}
+}
+
+func TestNormalizedTrack(t *testing.T) {
+	sess := newSession("show", nil, presets[client.LatencyBalanced])
+	sess.loudnessTarget = -23
+	ts := sess.outputPipeline("hls/show", 2, true, false).String()
+	if !strings.Contains(ts, " ! opusdec ! audioconvert ! tee name=loudnesstap ! queue ! ") || !strings.Contains(ts, "audioloudnorm loudness-target=-23 ! ") || !strings.Contains(ts, " ! avenc_aac ! aacparse ! tee name=aac ") {
+		t.Fatalf("normalized pipeline = %s", ts)
+	}
+	if !strings.HasSuffix(ts, loudnessBranch) {
+		t.Fatalf("unmeasured pipeline = %s", ts)
+	}
+	sess.aacCaps = adtsCaps
+	if track := sess.outputAudioTrack(); !strings.HasPrefix(track.Input, adtsCaps+" ! aacparse ! avdec_aac ! ") {
+		t.Fatalf("normalized aac = %s", track.Input)
+	}
+	// the Opus passed through is not normalized
+	sess.aacCaps, sess.opusPassthrough = "", true
+	if track := sess.outputAudioTrack(); strings.Contains(track.Input, "audioloudnorm") {
+		t.Fatalf("opus passed through normalized: %s", track.Input)
+	}
+}
+
+func TestLoudnessStats(t *testing.T) {
+	stats := loudnessStats(-23, loudness.NewMeter(loudnessRate, 2))
+	if stats["targetLufs"] != -23.0 || stats["integratedLufs"] != nil {
+		t.Fatalf("stats = %v", stats)
+	}
+	if lufs(-23.04) != -23.0 || lufs(math.Inf(-1)) != nil {
+		t.Fatal("lufs rounding")
+	}
+}
@@ -0,0 +1,345 @@
+package streamserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/ident"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/llhls"
+)
+
+// lowLatencyName is the LL-HLS playlist of an output, served next to the
+// playlist hlssink writes for players without LL-HLS support
+const lowLatencyName = "ll.m3u8"
+
+// hlsModeLL packages an output as LL-HLS too
+const hlsModeLL = "ll"
+
+// lowLatency reports whether the output of key under p is packaged as
+// LL-HLS too: hls_mode / hls_mode_overrides set to ll, or unset under a
+// preset which is
+func lowLatency(p client.Preset, key string) bool {
+	mode := envForKey("hls_mode", key)
+	if mode == "" {
+		mode = p.HLSMode
+	}
+	return mode == hlsModeLL
+}
+
+// llPrefix starts the names of the LL-HLS segments and parts of a
+// generation
+func llPrefix(generation int64) string {
+	return fmt.Sprintf("%s-ll-%d-", segmentName, generation)
+}
+
+// newLowLatency packages a generation as LL-HLS with the segments of the
+// preset, cut in parts of ll_part_ms (333). Frames are timed on arrival
+// from the start of the output, date giving the PROGRAM-DATE-TIME of a
+// time since, see session.dateFrom.
+func newLowLatency(p client.Preset, dir string, generation int64, date func(time.Duration) time.Time) *llhls.Packager {
+	return llhls.New(llhls.Config{
+		Dir:             dir,
+		Prefix:          llPrefix(generation),
+		SegmentTarget:   time.Duration(p.SegmentDuration) * time.Second,
+		PartTarget:      time.Duration(envInt("ll_part_ms", 333)) * time.Millisecond,
+		Window:          p.PlaylistLength,
+		DeleteOld:       deleteOldSegments,
+		ProgramDateTime: date,
+	})
+}
+
+// llQueueFrames bounds the frames queued for the LL-HLS packaging. Falling
+// this far behind, it drops frames until the next keyframe.
+const llQueueFrames = 120
+
+// llFrame is a frame queued for the LL-HLS packaging, timed on arrival
+type llFrame struct {
+	data     []byte
+	pts      time.Duration
+	keyframe bool
+}
+
+// llWriter feeds the LL-HLS packaging of a generation from a goroutine of
+// its own: the parts, segments and playlists it writes, and the old
+// segments it deletes, are disk I/O kept off the frame path, which holds
+// the session lock.
+type llWriter struct {
+	sess *session
+	ll   *llhls.Packager
+	// queue is closed by close, with the session locked like push
+	queue chan llFrame
+	// dropping is set once the queue overflowed, until the next keyframe;
+	// guarded by the session lock
+	dropping bool
+	// queued holds the frames of queue, buffered what ll buffers
+	queued   *charge
+	buffered *charge
+	done     chan struct{}
+}
+
+// startLowLatency feeds ll from a writer, with the session locked
+func (s *session) startLowLatency(ll *llhls.Packager) *llWriter {
+	w := &llWriter{
+		sess:     s,
+		ll:       ll,
+		queue:    make(chan llFrame, llQueueFrames),
+		queued:   &charge{account: s.account},
+		buffered: &charge{account: s.account},
+		done:     make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// push queues a copy of a frame, reserved before it is made as the caller
+// reuses its buffers, with the session locked
+func (w *llWriter) push(frame []byte, pts time.Duration, keyframe bool) {
+	if keyframe {
+		w.dropping = false
+	}
+	if w.dropping {
+		return
+	}
+	size := int64(len(frame))
+	if len(w.queue) == cap(w.queue) || !w.queued.grow(size) {
+		w.dropping = true
+		return
+	}
+	f := llFrame{data: append(make([]byte, 0, len(frame)), frame...), pts: pts, keyframe: keyframe}
+	select {
+	case w.queue <- f:
+	default:
+		w.queued.shrink(size)
+		w.dropping = true
+	}
+}
+
+// close ends the packaging once the queued frames are written, its players
+// getting the ENDLIST then; with the session locked
+func (w *llWriter) close() {
+	close(w.queue)
+}
+
+// run writes the queued frames until close. LL-HLS stops at its first write
+// error, the pipeline carries on.
+func (w *llWriter) run() {
+	defer close(w.done)
+	failed := false
+	for f := range w.queue {
+		if !failed {
+			if err := w.ll.WriteFrame(f.data, f.pts, f.keyframe); err != nil {
+				failed = true
+				w.sess.logf("ll-hls stopped: %v", err)
+				w.stopped()
+			} else {
+				// over budget the degradation ladder runs, terminating last
+				w.buffered.sync(int64(w.ll.Buffered()))
+			}
+		}
+		w.queued.shrink(int64(len(f.data)))
+	}
+	if err := w.ll.End(); err != nil && !failed {
+		w.sess.logf("ll-hls end: %v", err)
+	}
+	w.buffered.sync(0)
+}
+
+// stopped drops the failed packaging from its session, unless the session
+// moved on to another
+func (w *llWriter) stopped() {
+	s := w.sess
+	s.Lock()
+	defer s.Unlock()
+	if s.llWriter != w {
+		return
+	}
+	s.ll, s.llWriter = nil, nil
+	s.shed.set(s.hls.ladder, nil)
+}
+
+var (
+	errBadCue      = errors.New("cue: an id of 1-64 letters, digits, '.', '_' or '-' and a time are required")
+	errCueTooEarly = errors.New("cue: before the start of the output")
+)
+
+// cueID is what the IDs of cues are made of, quoted in date ranges
+var cueID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// cue places c on the LL-HLS timeline of the output. Its time, on the
+// publisher's clock, is moved to the server clock by the skew measured from
+// sender reports, so cues land on the segments PROGRAM-DATE-TIME dates
+// however far off the publisher's clock is.
+func (s *session) cue(c client.Cue) (client.Cue, error) {
+	if !cueID.MatchString(c.ID) || c.Time <= 0 || c.DurationMs < 0 {
+		return c, errBadCue
+	}
+	s.Lock()
+	ll, start := s.ll, s.llStart
+	s.Unlock()
+	if ll == nil {
+		return c, llhls.ErrNoDateTime
+	}
+	at := time.Unix(0, c.Time*int64(time.Millisecond))
+	if skew, ok := s.clockSkew(); ok {
+		at = at.Add(-skew)
+	}
+	pts := at.Sub(start)
+	if pts < 0 {
+		return c, errCueTooEarly
+	}
+	date, err := ll.Cue(c.ID, pts, time.Duration(c.DurationMs*float64(time.Millisecond)))
+	if err != nil {
+		return c, err
+	}
+	c.PtsMs, c.Date = milliseconds(pts), date.UTC().Format(time.RFC3339Nano)
+	s.logf("cue %s at %v", c.ID, pts)
+	return c, nil
+}
+
+// setLowLatency makes ll the LL-HLS packaging served for the output, nil
+// when the latest generation has none
+func (o *streamOutput) setLowLatency(ll *llhls.Packager) {
+	o.llLock.Lock()
+	defer o.llLock.Unlock()
+	o.ll = ll
+}
+
+func (o *streamOutput) lowLatency() *llhls.Packager {
+	o.llLock.Lock()
+	defer o.llLock.Unlock()
+	return o.ll
+}
+
+// blockingRequest reads the _HLS_msn and _HLS_part directives of a
+// playlist request, -1 when absent
+func blockingRequest(c *gin.Context) (msn, part int, err error) {
+	msn, part = -1, -1
+	if value := c.Query("_HLS_msn"); value != "" {
+		if msn, err = strconv.Atoi(value); err != nil || msn < 0 {
+			return 0, 0, fmt.Errorf("bad _HLS_msn %q", value)
+		}
+	}
+	if value := c.Query("_HLS_part"); value != "" {
+		if msn < 0 {
+			return 0, 0, fmt.Errorf("_HLS_part without _HLS_msn")
+		}
+		if part, err = strconv.Atoi(value); err != nil || part < 0 {
+			return 0, 0, fmt.Errorf("bad _HLS_part %q", value)
+		}
+	}
+	return msn, part, nil
+}
+
+// serveLowLatency serves the LL-HLS playlist of a stream key, blocking
+// reloads until the segment or part asked for is listed, and holds requests
+// for the part announced as preload hint until it is written. Both are held
+// for at most three target durations, then answered 503 (RFC 8216bis
+// 6.2.5.2). Anything else is left to the static files.
+func serveLowLatency(c *gin.Context) {
+	parts := strings.Split(strings.TrimPrefix(c.Request.URL.Path, "/hls/"), "/")
+	if !strings.HasPrefix(c.Request.URL.Path, "/hls/") || len(parts) != 2 || ident.Check(ident.StreamKey, parts[0]) != nil {
+		c.Next()
+		return
+	}
+	var ll *llhls.Packager
+	out := outputs.lookup(parts[0])
+	if out != nil {
+		ll = out.lowLatency()
+	}
+	if ll == nil {
+		c.Next()
+		return
+	}
+	preset, _ := resolvePreset("", parts[0])
+	if sess := registry.get(parts[0]); sess != nil {
+		preset = sess.preset
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 3*time.Duration(preset.SegmentDuration)*time.Second)
+	defer cancel()
+
+	if parts[1] != lowLatencyName {
+		msn, n, ok := ll.ParsePart(parts[1])
+		if !ok {
+			c.Next()
+			return
+		}
+		if err := ll.WaitPart(ctx, msn, n); err != nil {
+			c.Abort()
+			blockingFailed(c, err)
+			return
+		}
+		c.Next()
+		return
+	}
+
+	c.Abort()
+	msn, part, err := blockingRequest(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	if msn < 0 {
+		// a player starting has to wait for the first part
+		msn, part = 0, 0
+	}
+	if _, err := ll.Playlist(ctx, msn, part); err != nil {
+		blockingFailed(c, err)
+		return
+	}
+	serve, err := out.gateLowLatency(parts[0], ll)
+	if serve == nil {
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		c.Status(http.StatusNotFound)
+		return
+	}
+	c.Header("Cache-Control", "no-cache")
+	c.Data(http.StatusOK, "application/vnd.apple.mpegurl", serve)
+}
+
+// gateLowLatency runs the current revision of ll, the LL-HLS packaging of
+// the output of key, through its gate, returning the revision to serve and
+// the error of a strict gate. Held requests end in any order, so the
+// revision is taken under llGate: the gate sees the revisions in the order
+// they were written, not a stale one after a newer one.
+func (o *streamOutput) gateLowLatency(key string, ll *llhls.Packager) ([]byte, error) {
+	o.llGate.Lock()
+	defer o.llGate.Unlock()
+	revision, _ := ll.Playlist(context.Background(), -1, 0)
+	if os.Getenv("playlist_validation") == "off" {
+		return revision, nil
+	}
+	gate := o.gates.gate(lowLatencyName)
+	serve, changed, err := gate.Revision(revision)
+	if err != nil && changed {
+		heldBack(key, lowLatencyName, err)
+	}
+	if !gate.Strict {
+		err = nil
+	}
+	return serve, err
+}
+
+// blockingFailed answers a held request that could not be fulfilled
+func blockingFailed(c *gin.Context, err error) {
+	switch err {
+	case llhls.ErrTooFar:
+		c.String(http.StatusBadRequest, err.Error())
+	case context.DeadlineExceeded:
+		c.String(http.StatusServiceUnavailable, "not produced in time")
+	default:
+		// the player went away
+		c.Status(http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,196 @@
+package streamserver
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/static"
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/budget"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/llhls"
+)
+
+func TestLowLatencyPlaylist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lowlatency")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	t.Setenv("ll_part_ms", "200")
+
+	out := outputs.get("ll-live")
+	ll := newLowLatency(presets[client.LatencyLow], dir, 3, time.Now().Add)
+	out.setLowLatency(ll)
+	defer out.setLowLatency(nil)
+	write := func(from, to int) {
+		for i := from; i < to; i++ {
+			frame := []byte{0, 0, 0, 1, 0x41, 0x9a}
+			if i%25 == 0 {
+				frame = []byte{0, 0, 0, 1, 0x65, 0x88}
+			}
+			if err := ll.WriteFrame(frame, time.Duration(i)*time.Second/25, i%25 == 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(serveLowLatency)
+	r.Use(static.Serve("/hls/ll-live", static.LocalFile(dir, false)))
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/hls/ll-live/"+path, nil))
+		return w
+	}
+
+	write(0, 31)
+	w := get(lowLatencyName)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "#EXT-X-PART-INF:PART-TARGET=0.200\n") || !strings.Contains(w.Body.String(), llPrefix(3)+"0.ts\n") {
+		t.Fatalf("playlist = %d %s", w.Code, w.Body.String())
+	}
+	for query, want := range map[string]int{
+		"?_HLS_part=1":            http.StatusBadRequest,
+		"?_HLS_msn=x":             http.StatusBadRequest,
+		"?_HLS_msn=9":             http.StatusBadRequest,
+		"?_HLS_msn=0":             http.StatusOK,
+		"?_HLS_msn=1&_HLS_part=0": http.StatusOK,
+	} {
+		if w := get(lowLatencyName + query); w.Code != want {
+			t.Errorf("%s = %d, want %d", query, w.Code, want)
+		}
+	}
+
+	// a blocking reload is answered once its part is listed
+	answered := make(chan *httptest.ResponseRecorder)
+	go func() { answered <- get(lowLatencyName + "?_HLS_msn=1&_HLS_part=3") }()
+	hint := ll.PartURI(1, 3)
+	select {
+	case w := <-answered:
+		t.Fatalf("answered before the part: %d", w.Code)
+	case <-time.After(20 * time.Millisecond):
+	}
+	// and so is the request for the preload hint
+	fetched := make(chan *httptest.ResponseRecorder)
+	go func() { fetched <- get(hint) }()
+	write(31, 50)
+	if w := <-answered; w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "URI=\""+hint+"\"") {
+		t.Fatalf("blocking reload = %d %s", w.Code, w.Body.String())
+	}
+	if w := <-fetched; w.Code != http.StatusOK || w.Body.Len() == 0 {
+		t.Fatalf("preload hint = %d", w.Code)
+	}
+
+	ll.End()
+	if w := get(lowLatencyName + "?_HLS_msn=5"); w.Code != http.StatusOK || !strings.HasSuffix(w.Body.String(), "#EXT-X-ENDLIST\n") {
+		t.Fatalf("ended playlist = %d %s", w.Code, w.Body.String())
+	}
+}
+
+// TestCueSkew places a cue stamped on a publisher clock 5s ahead
+func TestCueSkew(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sess := newSession("cued", nil, presets[client.LatencyLow])
+	if _, err := sess.cue(client.Cue{ID: "break", Time: 1}); err != llhls.ErrNoDateTime {
+		t.Fatalf("cue without ll-hls: %v", err)
+	}
+	start := time.Now().Add(-time.Minute)
+	sess.llStart = start
+	sess.ll = newLowLatency(sess.preset, dir, 1, start.Add)
+	now := time.Now()
+	sess.skew.sample(toNTP(now.Add(5*time.Second)), now, 0)
+
+	publisher := start.Add(5*time.Second + 2*time.Second)
+	cue, err := sess.cue(client.Cue{ID: "break", Time: publisher.UnixNano() / int64(time.Millisecond), DurationMs: 30000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cue.PtsMs < 1999 || cue.PtsMs > 2001 {
+		t.Fatalf("cue at %vms, want 2000", cue.PtsMs)
+	}
+	if _, err := sess.cue(client.Cue{ID: `"quoted"`, Time: cue.Time}); err != errBadCue {
+		t.Fatalf("bad id: %v", err)
+	}
+	if _, err := sess.cue(client.Cue{ID: "early", Time: start.Add(-time.Minute).UnixNano() / int64(time.Millisecond)}); err != errCueTooEarly {
+		t.Fatalf("cue before the output: %v", err)
+	}
+}
+
+// TestLowLatencyWriter feeds the LL-HLS packaging off the session lock
+func TestLowLatencyWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "llwriter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sess := newSession("ll-writer", nil, presets[client.LatencyLow])
+	sess.account = budget.New(0).Account(sess.key, 1<<20)
+	push := func(w *llWriter, frames int) {
+		sess.Lock()
+		defer sess.Unlock()
+		for i := 0; i < frames; i++ {
+			frame := []byte{0, 0, 0, 1, 0x41, 0x9a}
+			if i%25 == 0 {
+				frame = []byte{0, 0, 0, 1, 0x65, 0x88}
+			}
+			w.push(frame, time.Duration(i)*time.Second/25, i%25 == 0)
+		}
+	}
+
+	sess.Lock()
+	ll := newLowLatency(sess.preset, dir, 1, time.Now().Add)
+	w := sess.startLowLatency(ll)
+	sess.Unlock()
+	push(w, 60)
+	sess.Lock()
+	w.close()
+	sess.Unlock()
+	<-w.done
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if revision, err := ll.Playlist(ctx, 0, 0); err != nil || !strings.Contains(string(revision), "#EXT-X-ENDLIST") {
+		t.Fatalf("playlist %s: %v", revision, err)
+	}
+	if used := sess.account.Usage().Used; used != 0 {
+		t.Fatalf("%d bytes charged once ended", used)
+	}
+
+	// a failed write drops the packaging from the session
+	gone := dir + "/gone"
+	sess.Lock()
+	sess.hls = &hlsOutput{}
+	sess.ll = newLowLatency(sess.preset, gone, 2, time.Now().Add)
+	sess.llWriter = sess.startLowLatency(sess.ll)
+	w = sess.llWriter
+	sess.Unlock()
+	push(w, 60)
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(5 * time.Millisecond) {
+		sess.Lock()
+		stopped := sess.llWriter == nil && sess.ll == nil
+		sess.Unlock()
+		if stopped {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("failed ll-hls kept")
+		}
+	}
+	sess.Lock()
+	w.close()
+	sess.Unlock()
+	<-w.done
+	if used := sess.account.Usage().Used; used != 0 {
+		t.Fatalf("%d bytes charged once failed", used)
+	}
+}
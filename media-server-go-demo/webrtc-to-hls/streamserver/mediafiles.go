@@ -0,0 +1,140 @@
+package streamserver
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/filecache"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/ident"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/metrics"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/storage"
+)
+
+var mediaCacheReads = metrics.NewCounter("media_cache_reads_total",
+	"Segments served, by whether the memory cache had them", "result")
+
+// mediaCache keeps the latest segments in memory, nil when media_cache_mb
+// is 0, the default
+var mediaCache *filecache.Cache
+
+// setupMediaCache reads the size of the memory cache of segments,
+// media_cache_mb
+func setupMediaCache() {
+	if mb := envInt("media_cache_mb", 0); mb > 0 {
+		mediaCache = filecache.New(int64(mb) << 20)
+	}
+}
+
+// mediaFiles are the extensions of the files of an output served to
+// viewers; anything else below hlsDir, e.g. temporary files, is not
+var mediaFiles = map[string]bool{
+	".m3u8": true,
+	".ts":   true,
+	".m4s":  true,
+	".mp4":  true,
+	".mpd":  true,
+	".vtt":  true,
+	".aac":  true,
+}
+
+// mediaCacheControl is how long players and CDNs may keep a file: the
+// playlists change with every segment, the segments never do, their names
+// carrying the generation of their output
+func mediaCacheControl(name string) string {
+	switch path.Ext(name) {
+	case ".m3u8", ".mpd":
+		return "no-cache"
+	}
+	return fmt.Sprintf("max-age=%d", envInt("media_max_age", 86400))
+}
+
+// mediaFile returns the path of the file of an output a request for
+// /hls/<key>/<name> asks for, name possibly in a directory of the output,
+// false for any other request
+func mediaFile(urlPath string) (string, bool) {
+	if !strings.HasPrefix(urlPath, "/hls/") {
+		return "", false
+	}
+	elements := strings.Split(strings.TrimPrefix(urlPath, "/hls/"), "/")
+	if len(elements) < 2 || ident.Check(ident.StreamKey, elements[0]) != nil {
+		return "", false
+	}
+	for _, element := range elements[1:] {
+		if ident.Check(ident.FileName, element) != nil {
+			return "", false
+		}
+	}
+	if !mediaFiles[path.Ext(urlPath)] {
+		return "", false
+	}
+	return filepath.Join(append([]string{outputDir(elements[0])}, elements[1:]...)...), true
+}
+
+// serveMedia serves the files of the outputs below hlsDir, with their
+// content type and caching, and the byte ranges players ask for. Only
+// media files are served, nothing else of hlsDir or of the working
+// directory. Segments are read through mediaCache, when set. Files that do
+// not exist are left to serveExternalStream.
+func serveMedia(c *gin.Context) {
+	if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+		c.Next()
+		return
+	}
+	file, ok := mediaFile(c.Request.URL.Path)
+	if !ok {
+		c.Next()
+		return
+	}
+	var content io.ReadSeeker
+	var info os.FileInfo
+	var err error
+	if mediaCache != nil && segmentFile(file) {
+		var data []byte
+		var hit bool
+		data, info, hit, err = mediaCache.Read(file)
+		content = bytes.NewReader(data)
+		if err == nil {
+			result := "miss"
+			if hit {
+				result = "hit"
+			}
+			mediaCacheReads.Inc(result)
+		}
+	} else {
+		var f *os.File
+		if f, err = os.Open(file); err == nil {
+			defer f.Close()
+			info, err = f.Stat()
+			content = f
+		}
+	}
+	if err != nil || info.IsDir() {
+		c.Next()
+		return
+	}
+	c.Abort()
+	c.Header("Content-Type", storage.ContentType(file))
+	c.Header("Cache-Control", mediaCacheControl(file))
+	http.ServeContent(c.Writer, c.Request, filepath.Base(file), info.ModTime(), content)
+}
+
+// prefetchSegment reads segment index of generation, in dir, into the
+// memory cache, once written, for the viewers about to ask for it
+func prefetchSegment(dir string, generation int64, index int) {
+	if mediaCache == nil || index < 0 {
+		return
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, fmt.Sprintf("%s%05d.*", segmentPrefix(generation), index)))
+	for _, match := range matches {
+		if segmentFile(match) {
+			mediaCache.Prefetch(match)
+		}
+	}
+}
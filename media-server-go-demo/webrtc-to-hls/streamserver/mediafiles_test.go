@@ -0,0 +1,69 @@
+package streamserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/filecache"
+)
+
+func TestServeMedia(t *testing.T) {
+	dir, err := ioutil.TempDir("", "media")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	os.MkdirAll(filepath.Join(outputDir("main"), "360p"), 0755)
+	ioutil.WriteFile(filepath.Join(outputDir("main"), playlistName), []byte("#EXTM3U\n"), 0644)
+	ioutil.WriteFile(filepath.Join(outputDir("main"), "segment-7-00002.ts"), []byte("0123456789"), 0644)
+	ioutil.WriteFile(filepath.Join(outputDir("main"), "360p", "segment-7-1-00002.ts"), []byte("rendition"), 0644)
+	ioutil.WriteFile(filepath.Join(outputDir("main"), ".put-123"), []byte("partial"), 0644)
+	ioutil.WriteFile(".env", []byte("secret"), 0644)
+	ioutil.WriteFile("server.go", []byte("package main"), 0644)
+	defer func() { mediaCache = nil }()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(serveMedia)
+	get := func(path, rng string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", path, nil)
+		if rng != "" {
+			req.Header.Set("Range", rng)
+		}
+		r.ServeHTTP(w, req)
+		return w
+	}
+	for _, cache := range []*filecache.Cache{nil, filecache.New(1 << 20)} {
+		mediaCache = cache
+		w := get("/hls/main/"+playlistName, "")
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/vnd.apple.mpegurl" || w.Header().Get("Cache-Control") != "no-cache" {
+			t.Fatalf("playlist = %d %v", w.Code, w.Header())
+		}
+		w = get("/hls/main/segment-7-00002.ts", "bytes=2-5")
+		if w.Code != http.StatusPartialContent || w.Body.String() != "2345" || w.Header().Get("Content-Type") != "video/mp2t" || w.Header().Get("Cache-Control") != "max-age=86400" {
+			t.Fatalf("range = %d %q %v", w.Code, w.Body, w.Header())
+		}
+		if w = get("/hls/main/360p/segment-7-1-00002.ts", ""); w.Code != http.StatusOK || w.Body.String() != "rendition" {
+			t.Fatalf("rendition = %d %q", w.Code, w.Body)
+		}
+	}
+	if mediaCache.Size() != int64(len("0123456789")+len("rendition")) {
+		t.Fatalf("cached %d bytes", mediaCache.Size())
+	}
+	for _, path := range []string{"/.env", "/server.go", "/hls/main/.put-123", "/hls/main/../../server.go", "/hls/main/missing.ts", "/hls/main"} {
+		if w := get(path, ""); w.Code != http.StatusNotFound {
+			t.Errorf("%s = %d %q", path, w.Code, w.Body)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package streamserver
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/budget"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/metrics"
+)
+
+var (
+	memoryDegradations = metrics.NewCounter("memory_budget_degradations_total",
+		"Degradation ladder steps sessions over their memory budget took, by step", "step")
+	_ = metrics.NewGaugeFunc("memory_budget_used_bytes",
+		"Memory accounted for against the process wide budget", "", func() map[string]float64 {
+			return map[string]float64{"": float64(memory.Usage().Used)}
+		})
+	_ = metrics.NewGaugeFunc("session_memory_used_bytes",
+		"Memory accounted for against the budget of a live session, by stream key", "stream", func() map[string]float64 {
+			used := map[string]float64{}
+			for _, key := range registry.keys() {
+				if sess := registry.get(key); sess != nil {
+					used[key] = float64(sess.account.Usage().Used)
+				}
+			}
+			return used
+		})
+)
+
+// shrunkDVRSegments is the window of an LL-HLS playlist the shrink-dvr step
+// of the degradation ladder narrows it to
+const shrunkDVRSegments = 3
+
+// charge is the memory one buffer of a session holds against its account.
+// Growth is reserved before the buffer grows, so it can walk the ladder;
+// held only counts what was reserved and not released since.
+type charge struct {
+	account *budget.Account
+	held    int64
+}
+
+// grow reserves n more bytes, false when they do not fit the budget
+func (c *charge) grow(n int64) bool {
+	if n <= 0 {
+		return true
+	}
+	if c.account.Reserve(n) != nil {
+		return false
+	}
+	atomic.AddInt64(&c.held, n)
+	return true
+}
+
+// shrink releases n bytes
+func (c *charge) shrink(n int64) {
+	if n <= 0 {
+		return
+	}
+	atomic.AddInt64(&c.held, -n)
+	c.account.Release(n)
+}
+
+// sync accounts for the buffer holding n bytes now, false when the growth
+// does not fit the budget
+func (c *charge) sync(n int64) bool {
+	held := atomic.LoadInt64(&c.held)
+	if n < held {
+		c.shrink(held - n)
+		return true
+	}
+	return c.grow(n - held)
+}
+
+// shedding is what the degradation ladder of a session frees. It has a lock
+// of its own: reservations are made with the session locked.
+type shedding struct {
+	sync.Mutex
+	ladder *ladderOutput
+	ll     *llWriter
+}
+
+func (sh *shedding) set(ladder *ladderOutput, ll *llWriter) {
+	sh.Lock()
+	defer sh.Unlock()
+	sh.ladder, sh.ll = ladder, ll
+}
+
+func (sh *shedding) get() (*ladderOutput, *llWriter) {
+	sh.Lock()
+	defer sh.Unlock()
+	return sh.ladder, sh.ll
+}
+
+// degradations is the ladder a session over its memory budget walks: drop
+// the ABR renditions and their queues, narrow the LL-HLS playlist, and
+// finally terminate. Each step frees what it can synchronously.
+func (s *session) degradations() []budget.Step {
+	return []budget.Step{
+		{Name: "drop-abr", Degrade: func() {
+			memoryDegradations.Inc("drop-abr")
+			if ladder, _ := s.shed.get(); ladder != nil {
+				s.logf("memory budget exceeded, dropping the abr renditions")
+				s.timeline.add(eventPipeline, "abr renditions dropped over the memory budget")
+				ladder.release()
+			}
+		}},
+		{Name: "shrink-dvr", Degrade: func() {
+			memoryDegradations.Inc("shrink-dvr")
+			if _, ll := s.shed.get(); ll != nil {
+				s.logf("memory budget exceeded, narrowing the ll-hls playlist to %d segments", shrunkDVRSegments)
+				before := ll.ll.Buffered()
+				ll.ll.SetWindow(shrunkDVRSegments)
+				ll.buffered.shrink(int64(before - ll.ll.Buffered()))
+			}
+		}},
+		{Name: "terminate", Degrade: func() {
+			memoryDegradations.Inc("terminate")
+			s.logf("memory budget exceeded, terminating")
+			go s.endWith(client.CloseOverBudget, budget.ErrOverBudget.Error())
+		}},
+	}
+}
+
+// stageUpload charges the playlist revision an upload of key holds until
+// it is stored, to the live session of key. release is to be called once;
+// ok is false when the revision does not fit the budget.
+func stageUpload(key string, size int) (release func(), ok bool) {
+	sess := registry.get(key)
+	if sess == nil {
+		return func() {}, true
+	}
+	staged := &charge{account: sess.account}
+	if !staged.grow(int64(size)) {
+		return nil, false
+	}
+	var once sync.Once
+	return func() { once.Do(func() { staged.shrink(int64(size)) }) }, true
+}
@@ -0,0 +1,75 @@
+package streamserver
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/abr"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/budget"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+)
+
+func TestMemoryDegradation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sess := newSession("over-budget", nil, presets[client.LatencyBalanced])
+	sess.account = budget.New(0).Account(sess.key, 1000, sess.degradations()...)
+	sess.ladder = []abr.Rung{{Name: "360p", Width: 640, Height: 360, Bitrate: 800}}
+	sess.Lock()
+	ladder, err := sess.startLadder(dir, 1)
+	sess.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ladder.release()
+	sess.shed.set(ladder, nil)
+
+	// queued frames are charged until the rung pipeline takes them
+	ladder.push(make([]byte, 600), true)
+	for deadline := time.Now().Add(time.Second); sess.account.Usage().Used != 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("queued frame still charged: %+v", sess.account.Usage())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	// a frame over the budget walks the whole ladder
+	ladder.push(make([]byte, 2000), true)
+	select {
+	case <-sess.done:
+	case <-time.After(time.Second):
+		t.Fatal("session over budget not terminated")
+	}
+	if usage := sess.account.Usage(); strings.Join(usage.Degraded, ",") != "drop-abr,shrink-dvr,terminate" {
+		t.Fatalf("usage %+v", usage)
+	}
+	if rungs := ladder.listed(); len(rungs) != 0 {
+		t.Fatalf("renditions %v kept over budget", rungs)
+	}
+}
+
+func TestStageUpload(t *testing.T) {
+	sess := newSession("staged", nil, presets[client.LatencyBalanced])
+	sess.account = budget.New(0).Account(sess.key, 100)
+	if _, err := registry.claim(sess, conflictReject); err != nil {
+		t.Fatal(err)
+	}
+	defer registry.release(sess)
+	release, ok := stageUpload("staged", 80)
+	if !ok || sess.account.Usage().Used != 80 {
+		t.Fatalf("staged %v, %+v", ok, sess.account.Usage())
+	}
+	if _, ok := stageUpload("staged", 40); ok {
+		t.Fatal("revision over budget staged")
+	}
+	release()
+	release()
+	if used := sess.account.Usage().Used; used != 0 {
+		t.Fatalf("used %d once stored", used)
+	}
+}
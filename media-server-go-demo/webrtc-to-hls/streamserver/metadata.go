@@ -0,0 +1,225 @@
+package streamserver
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/emsg"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/id3"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/ident"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/metrics"
+)
+
+var metadataInjected = metrics.NewCounter("timed_metadata_injected_total",
+	"ID3 tags put on the timeline of live outputs, by container", "container")
+
+var (
+	errMetadataOff = errors.New("metadata: the stream does not carry timed metadata")
+	errBadMetadata = errors.New("metadata: text of up to 16384 bytes or a cue of out or in is required, and a label of up to 64 letters, digits, '.', '_' or '-'")
+)
+
+// the descriptions of the TXXX frames of cues
+const (
+	cueOutLabel = "CUE-OUT"
+	cueInLabel  = "CUE-IN"
+)
+
+// maxOutputEvents bounds the events an output keeps for its fMP4 segments
+const maxOutputEvents = 256
+
+// timedMetadata decides whether the output of key carries timed metadata,
+// when timed_metadata / timed_metadata_overrides is "on" or it relays data
+// messages
+func timedMetadata(key string) bool {
+	return strings.TrimSpace(envForKey("timed_metadata", key)) == "on" || dataRelay(key)
+}
+
+// outputEvent is an ID3 tag put on the timeline of an fMP4 output
+type outputEvent struct {
+	generation int64
+	at         time.Time
+	id         uint32
+	tag        []byte
+}
+
+// outputEvents are the timed metadata of the fMP4 output of a stream key,
+// put into its segments as emsg boxes when they are served: hlscmafsink
+// has no metadata input
+type outputEvents struct {
+	sync.Mutex
+	next   uint32
+	events []outputEvent
+}
+
+// add records tag at time at of generation, the oldest event dropped past
+// maxOutputEvents
+func (e *outputEvents) add(generation int64, at time.Time, tag []byte) {
+	e.Lock()
+	defer e.Unlock()
+	e.next++
+	e.events = append(e.events, outputEvent{generation: generation, at: at, id: e.next, tag: tag})
+	if len(e.events) > maxOutputEvents {
+		e.events = append([]outputEvent(nil), e.events[len(e.events)-maxOutputEvents:]...)
+	}
+}
+
+// between returns the events of generation after from, zero for any, until
+// to included
+func (e *outputEvents) between(generation int64, from, to time.Time) []outputEvent {
+	e.Lock()
+	defer e.Unlock()
+	var events []outputEvent
+	for _, ev := range e.events {
+		if ev.generation == generation && ev.at.After(from) && !ev.at.After(to) {
+			events = append(events, ev)
+		}
+	}
+	return events
+}
+
+// injectMetadata puts tag on the timeline of the output now: muxed into
+// MPEG-TS segments, or kept for the emsg boxes of fMP4 ones
+func (s *session) injectMetadata(tag []byte) error {
+	s.Lock()
+	hls, generation, container := s.hls, s.generation, s.container
+	s.Unlock()
+	if hls == nil {
+		return errNotLive
+	}
+	if container == containerFMP4 {
+		outputs.get(s.key).events.add(generation, time.Now(), tag)
+	} else if !hls.pushMetadata(tag) {
+		return errMetadataOff
+	}
+	metadataInjected.Inc(container)
+	return nil
+}
+
+// readSegment reads the file name of the output out, with the emsg boxes of
+// the events injected while it was written when it is an fMP4 segment, see
+// segmentWindow
+func readSegment(out *streamOutput, name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filepath.Join(out.dir, name))
+	if err != nil || filepath.Ext(name) != ".m4s" {
+		return data, err
+	}
+	generation, from, to, ok := segmentWindow(out.dir, name)
+	if !ok {
+		return data, nil
+	}
+	events := out.events.between(generation, from, to)
+	if len(events) == 0 {
+		return data, nil
+	}
+	boxes := make([]emsg.Event, len(events))
+	for i, ev := range events {
+		boxes[i] = emsg.Event{SchemeIDURI: emsg.SchemeID3, Timescale: 1000,
+			Duration: emsg.UnknownDuration, ID: ev.id, Data: ev.tag}
+		if !from.IsZero() {
+			boxes[i].PresentationTimeDelta = uint32(ev.at.Sub(from) / time.Millisecond)
+		}
+	}
+	return emsg.Insert(data, boxes...)
+}
+
+// serveEvents serves the fMP4 segments of stream keys carrying timed
+// metadata with their emsg boxes; protectCMAF serves protected ones
+func serveEvents(c *gin.Context) {
+	parts := strings.SplitN(strings.TrimPrefix(c.Request.URL.Path, "/hls/"), "/", 2)
+	if !strings.HasPrefix(c.Request.URL.Path, "/hls/") || len(parts) != 2 || filepath.Ext(parts[1]) != ".m4s" ||
+		ident.Check(ident.FileName, parts[1]) != nil || !timedMetadata(parts[0]) {
+		c.Next()
+		return
+	}
+	out := outputs.lookup(parts[0])
+	if out == nil {
+		c.Next()
+		return
+	}
+	c.Abort()
+	data, err := readSegment(out, parts[1])
+	switch {
+	case os.IsNotExist(err):
+		c.Status(http.StatusNotFound)
+	case err != nil:
+		c.String(http.StatusInternalServerError, err.Error())
+	default:
+		c.Data(http.StatusOK, "video/mp4", data)
+	}
+}
+
+// injectStreamMetadata handles POST /api/v1/streams/:id/metadata: it puts
+// an ID3 tag on the output timeline now, of a TXXX frame of text described
+// by label ("data" when empty), and of cue, out with its durationMs or in,
+// marking an ad break the way SCTE-35 splice points do
+func injectStreamMetadata(c *gin.Context) {
+	admin, ok := adminIdentity(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Label      string  `json:"label"`
+		Text       string  `json:"text"`
+		Cue        string  `json:"cue"`
+		DurationMs float64 `json:"durationMs"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		return
+	}
+	if req.Label == "" {
+		req.Label = dataLabel
+	}
+	var frames []id3.Frame
+	switch req.Cue {
+	case "":
+	case "out":
+		duration := ""
+		if req.DurationMs > 0 {
+			duration = fmt.Sprintf("DURATION=%.3f", req.DurationMs/1000)
+		}
+		frames = append(frames, id3.TXXX(cueOutLabel, duration))
+	case "in":
+		frames = append(frames, id3.TXXX(cueInLabel, ""))
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": errBadMetadata.Error()})
+		return
+	}
+	if req.Text != "" {
+		frames = append(frames, id3.TXXX(req.Label, req.Text))
+	}
+	if len(frames) == 0 || len(req.Text) > maxDataBytes || req.DurationMs < 0 || !cueID.MatchString(req.Label) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": errBadMetadata.Error()})
+		return
+	}
+	sess := liveSession(c)
+	if sess == nil {
+		return
+	}
+	if !timedMetadata(sess.key) {
+		c.JSON(http.StatusConflict, gin.H{"error": errMetadataOff.Error()})
+		return
+	}
+	tag, err := id3.Tag(frames...)
+	if err == nil {
+		err = sess.injectMetadata(tag)
+	}
+	switch err {
+	case nil:
+	case errNotLive, errMetadataOff:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	sess.logf("timed metadata injected by %s: cue %q, %d bytes of %s", admin, req.Cue, len(req.Text), req.Label)
+	c.JSON(http.StatusOK, gin.H{"stream": sess.key, "time": time.Now().UTC()})
+}
@@ -0,0 +1,100 @@
+package streamserver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/emsg"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/id3"
+)
+
+func TestSegmentEvents(t *testing.T) {
+	savedDir, savedOutputs := hlsDir, outputs
+	defer func() { hlsDir, outputs = savedDir, savedOutputs }()
+	hlsDir, outputs = t.TempDir(), newStreamOutputs(time.Now)
+	t.Setenv("timed_metadata_overrides", "tagged=on")
+
+	out := outputs.get("tagged")
+	os.MkdirAll(out.dir, 0755)
+	segment := append(mp4Box("styp", []byte("msdh")), append(mp4Box("moof"), mp4Box("mdat", []byte{1})...)...)
+	start := time.Now().Add(-time.Minute).Truncate(time.Second)
+	for i, name := range []string{"segment-7-00000.m4s", "segment-7-00001.m4s", "segment-7-00003.m4s"} {
+		path := filepath.Join(out.dir, name)
+		ioutil.WriteFile(path, segment, 0644)
+		at := start.Add(time.Duration(2*i) * time.Second)
+		os.Chtimes(path, at, at)
+	}
+	tag, _ := id3.Tag(id3.TXXX("caption", "hi"))
+	out.events.add(7, start.Add(-time.Second), tag)
+	out.events.add(7, start.Add(500*time.Millisecond), tag)
+	out.events.add(8, start.Add(time.Second), tag)
+	out.events.add(7, start.Add(3*time.Second), tag)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(serveEvents)
+	r.Use(func(c *gin.Context) { c.String(http.StatusTeapot, "static") })
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	first := emsg.Event{SchemeIDURI: emsg.SchemeID3, Timescale: 1000, Duration: emsg.UnknownDuration, ID: 1, Data: tag}
+	want, _ := emsg.Insert(segment, first)
+	if w := get("/hls/tagged/segment-7-00000.m4s"); w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), want) {
+		t.Fatalf("first segment = %d %q", w.Code, w.Body.Bytes())
+	}
+	second := emsg.Event{SchemeIDURI: emsg.SchemeID3, Timescale: 1000, PresentationTimeDelta: 500,
+		Duration: emsg.UnknownDuration, ID: 2, Data: tag}
+	want, _ = emsg.Insert(segment, second)
+	if w := get("/hls/tagged/segment-7-00001.m4s"); !bytes.Equal(w.Body.Bytes(), want) {
+		t.Fatalf("second segment %q", w.Body.Bytes())
+	}
+	// the segment before is gone, its window unknown
+	if w := get("/hls/tagged/segment-7-00003.m4s"); !bytes.Equal(w.Body.Bytes(), segment) {
+		t.Fatalf("segment after a gap %q", w.Body.Bytes())
+	}
+	if w := get("/hls/tagged/segment-7-00009.m4s"); w.Code != http.StatusNotFound {
+		t.Fatalf("missing segment = %d", w.Code)
+	}
+	if w := get("/hls/untagged/segment-7-00000.m4s"); w.Code != http.StatusTeapot {
+		t.Fatalf("stream without metadata = %d", w.Code)
+	}
+
+	for i := 0; i < maxOutputEvents; i++ {
+		out.events.add(9, start, tag)
+	}
+	if len(out.events.between(7, time.Time{}, time.Now())) != 0 || len(out.events.events) != maxOutputEvents {
+		t.Fatalf("%d events kept", len(out.events.events))
+	}
+}
+
+func TestInjectMetadataRequests(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/api/v1/streams/:id/metadata", injectStreamMetadata)
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/api/v1/streams/nobody-live/metadata", strings.NewReader(body))
+		asAdmin(req, "ops")
+		r.ServeHTTP(w, req)
+		return w
+	}
+	for _, body := range []string{`{}`, `{"cue":"pause"}`, `{"text":"x","label":"no spaces"}`, `{"cue":"out","durationMs":-1}`} {
+		if w := post(body); w.Code != http.StatusBadRequest {
+			t.Fatalf("%s = %d", body, w.Code)
+		}
+	}
+	if w := post(`{"cue":"out","durationMs":30000}`); w.Code != http.StatusNotFound {
+		t.Fatalf("stream not live = %d", w.Code)
+	}
+}
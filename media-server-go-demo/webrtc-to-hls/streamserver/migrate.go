@@ -0,0 +1,333 @@
+package streamserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/cluster"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/hlscheck"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/storage"
+)
+
+var (
+	errDraining     = errors.New("instance draining, publish elsewhere")
+	errBadResume    = errors.New("invalid or expired resume token")
+	errNoMigrateKey = errors.New("migration needs migration_secret")
+)
+
+// resumeTokens are one-time tokens handed to publishers of a draining
+// instance. They are signed with migration_secret, shared by the instances,
+// and registered in the cluster directory when there is one, so a token is
+// accepted once across the cluster; without one, once per instance.
+type resumeTokens struct {
+	secret []byte
+	// shared is the cluster directory tokens are registered in, and node
+	// this instance as named there; nil for a single instance
+	shared cluster.Directory
+	node   string
+
+	lock sync.Mutex
+	used map[string]time.Time
+}
+
+// directory entries of resume tokens: issued ones, and redeemed ones
+// claimed by the instance that redeemed them. Stream keys have no colon.
+const (
+	resumeIssued   = "resume:"
+	resumeRedeemed = "resumed:"
+)
+
+// migrationHandover bounds how long a resumed publish waits for the source
+// instance of the migration to hand its stream key over
+const migrationHandover = 5 * time.Second
+
+type resumeClaims struct {
+	Stream  string `json:"stream"`
+	Expires int64  `json:"exp"`
+	Nonce   string `json:"nonce"`
+}
+
+func newResumeTokens(secret string) *resumeTokens {
+	return &resumeTokens{secret: []byte(secret), used: map[string]time.Time{}}
+}
+
+func (t *resumeTokens) sign(payload string) string {
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// issue returns a token resuming key on another instance until ttl passed
+func (t *resumeTokens) issue(key string, ttl time.Duration) (string, error) {
+	if len(t.secret) == 0 {
+		return "", errNoMigrateKey
+	}
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(resumeClaims{Stream: key, Expires: time.Now().Add(ttl).Unix(), Nonce: hex.EncodeToString(nonce)})
+	if err != nil {
+		return "", err
+	}
+	if t.shared != nil {
+		ctx, cancel := clusterContext()
+		defer cancel()
+		if _, err := t.shared.Claim(ctx, resumeIssued+hex.EncodeToString(nonce), t.node, ttl); err != nil {
+			return "", err
+		}
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + t.sign(payload), nil
+}
+
+// redeem accepts token once for a publish of key
+func (t *resumeTokens) redeem(token, key string, now time.Time) error {
+	if len(t.secret) == 0 {
+		return errBadResume
+	}
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 || !hmac.Equal([]byte(t.sign(parts[0])), []byte(parts[1])) {
+		return errBadResume
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return errBadResume
+	}
+	var claims resumeClaims
+	if err := json.Unmarshal(data, &claims); err != nil || claims.Stream != key || now.Unix() > claims.Expires {
+		return errBadResume
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for nonce, expires := range t.used {
+		if now.After(expires) {
+			delete(t.used, nonce)
+		}
+	}
+	if _, ok := t.used[claims.Nonce]; ok {
+		return errBadResume
+	}
+	if t.shared != nil && !t.redeemShared(claims.Nonce, time.Unix(claims.Expires, 0).Sub(now)) {
+		return errBadResume
+	}
+	t.used[claims.Nonce] = time.Unix(claims.Expires, 0)
+	return nil
+}
+
+// redeemShared redeems the token of nonce in the cluster directory: it has
+// to be registered, and not redeemed by another instance, claiming it
+// being atomic
+func (t *resumeTokens) redeemShared(nonce string, ttl time.Duration) bool {
+	ctx, cancel := clusterContext()
+	defer cancel()
+	if issuer, err := t.shared.Owner(ctx, resumeIssued+nonce); err != nil || issuer == "" {
+		return false
+	}
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+	redeemer, err := t.shared.Claim(ctx, resumeRedeemed+nonce, t.node, ttl)
+	return err == nil && redeemer == t.node
+}
+
+var tokens = newResumeTokens("")
+
+// drainState is set when an admin asks the instance to hand its sessions over
+type drainState struct {
+	sync.Mutex
+	draining bool
+	target   string
+}
+
+var drain = &drainState{}
+
+func (d *drainState) active() bool {
+	d.Lock()
+	defer d.Unlock()
+	return d.draining
+}
+
+// startDrain handles POST /api/drain: new publishes are refused, live
+// publishers are told to migrate to target, and whatever has not left when
+// the window closes is finalized normally
+func startDrain(c *gin.Context) {
+	admin, ok := adminIdentity(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Target string `json:"target"`
+		Window int    `json:"window"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		return
+	}
+	if req.Window <= 0 {
+		req.Window = envInt("drain_window", 60)
+	}
+	window := time.Duration(req.Window) * time.Second
+	if req.Target != "" && len(tokens.secret) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": errNoMigrateKey.Error()})
+		return
+	}
+	if err := audit.record(auditEntry{Time: time.Now(), Admin: admin, Action: "drain", Reason: req.Target}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	drain.Lock()
+	already := drain.draining
+	drain.draining, drain.target = true, req.Target
+	drain.Unlock()
+
+	migrating := 0
+	for _, key := range registry.keys() {
+		sess := registry.get(key)
+		// WHIP publishers cannot be told to move, the drain window ends them
+		if sess == nil || sess.conn == nil || req.Target == "" {
+			continue
+		}
+		token, err := tokens.issue(key, window)
+		if err != nil {
+			sess.logf("no resume token: %v", err)
+			continue
+		}
+		sess.Lock()
+		sess.migrating = true
+		sess.Unlock()
+		sess.logf("migrating to %s", req.Target)
+		sess.send(client.Message{Cmd: client.CmdMigrate, Target: req.Target, Token: token})
+		migrating++
+	}
+	if !already {
+		time.AfterFunc(window, finishDrain)
+	}
+	c.JSON(http.StatusAccepted, gin.H{"migrating": migrating, "window": req.Window})
+}
+
+// finishDrain closes the sessions that did not migrate within the window
+func finishDrain() {
+	for _, key := range registry.keys() {
+		if sess := registry.get(key); sess != nil {
+			sess.logf("drain window over, finalizing")
+			sess.timeline.add(eventSession, "drain window over")
+			go sess.close(client.CloseDraining, errDraining.Error())
+		}
+	}
+}
+
+// admitPublish refuses new publishes on a draining instance or over its
+// resource limits, and redeems the resume token of a migrating one
+func admitPublish(msg client.Message, key string) (resumed bool, err error) {
+	if drain.active() {
+		return false, errDraining
+	}
+	if err := admitResources(key); err != nil {
+		return false, err
+	}
+	if msg.Token == "" {
+		return false, nil
+	}
+	if err := tokens.redeem(msg.Token, key, time.Now()); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// awaitHandover holds a resumed publish of key until the source instance
+// released the key in the cluster directory, the migrating publisher
+// having left it, or migrationHandover passed
+func awaitHandover(key string) {
+	if directory == nil {
+		return
+	}
+	for deadline := time.Now().Add(migrationHandover); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		ctx, cancel := clusterContext()
+		owner, err := directory.Owner(ctx, key)
+		cancel()
+		if err != nil || owner == "" || owner == nodeURL {
+			return
+		}
+	}
+}
+
+// resumeOutput continues, with a discontinuity, the playlist the source
+// instance of a migration stored: the segments it lists are fetched from
+// the storage backend into the output of key, and the generations of this
+// instance are appended to them. Without a backend the playlist starts
+// over.
+func resumeOutput(key string, preset client.Preset) error {
+	if store == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), uploadClass().Timeout)
+	defer cancel()
+	data, err := store.Get(ctx, objectName(key, playlistName))
+	if err == storage.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	m, err := hlscheck.ParseMedia(data)
+	if err != nil {
+		return err
+	}
+	out := outputs.get(key)
+	if err := os.MkdirAll(out.dir, 0755); err != nil {
+		return err
+	}
+	_, uris := storage.RewritePlaylist(data, "")
+	for _, uri := range uris {
+		segment, err := store.Get(ctx, objectName(key, uri))
+		if err != nil {
+			return fmt.Errorf("segment %s: %v", uri, err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(out.dir, filepath.FromSlash(path.Clean("/"+uri))), segment, 0644); err != nil {
+			return err
+		}
+	}
+	if !out.generations.migrated(m, preset) {
+		return fmt.Errorf("stored playlist of %s cannot be continued", key)
+	}
+	out.uploads.restored(uris)
+	return nil
+}
+
+// uploadHandover stores the last revision of the playlist of a migrating
+// session, as served, without its ENDLIST: the target of the migration
+// goes on with it
+func uploadHandover(key string) {
+	if store == nil {
+		return
+	}
+	out := outputs.get(key)
+	playlist := out.generations.finalPlaylist()
+	if playlist == nil {
+		var err error
+		if playlist, err = ioutil.ReadFile(out.playlist()); err != nil {
+			return
+		}
+	}
+	uploadPlaylist(key, bytes.Replace(playlist, []byte("#EXT-X-ENDLIST\n"), nil, 1))
+}
@@ -0,0 +1,136 @@
+package streamserver
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/cluster"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/hlscheck"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/storage"
+)
+
+func TestResumeTokens(t *testing.T) {
+	source := newResumeTokens("shared")
+	target := newResumeTokens("shared")
+	token, err := source.issue("live", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if err := target.redeem(token, "other", now); err != errBadResume {
+		t.Fatalf("token for another stream: %v", err)
+	}
+	if err := target.redeem(token, "live", now.Add(2*time.Minute)); err != errBadResume {
+		t.Fatalf("expired token: %v", err)
+	}
+	if err := target.redeem(token, "live", now); err != nil {
+		t.Fatal(err)
+	}
+	if err := target.redeem(token, "live", now); err != errBadResume {
+		t.Fatalf("token redeemed twice: %v", err)
+	}
+	if err := newResumeTokens("other").redeem(token, "live", now); err != errBadResume {
+		t.Fatalf("token signed with another secret: %v", err)
+	}
+	if _, err := newResumeTokens("").issue("live", time.Minute); err != errNoMigrateKey {
+		t.Fatalf("issue without secret: %v", err)
+	}
+}
+
+func TestSharedResumeTokens(t *testing.T) {
+	shared := cluster.NewMemory(nil)
+	a, b := newResumeTokens("shared"), newResumeTokens("shared")
+	a.shared, a.node = shared, "http://a:9000"
+	b.shared, b.node = shared, "http://b:9000"
+	token, err := a.issue("live", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if err := b.redeem(token, "live", now); err != nil {
+		t.Fatal(err)
+	}
+	// another instance sharing the directory refuses it too
+	if err := a.redeem(token, "live", now); err != errBadResume {
+		t.Fatalf("token redeemed on two instances: %v", err)
+	}
+	// a token signed right but never issued is refused
+	unregistered, _ := newResumeTokens("shared").issue("live", time.Minute)
+	if err := b.redeem(unregistered, "live", now); err != errBadResume {
+		t.Fatalf("unregistered token: %v", err)
+	}
+}
+
+// TestMigrationContinuesPlaylist migrates a stream between two instances
+// sharing a storage backend: players of the target get the segments of
+// the source, then a discontinuity and those of the target
+func TestMigrationContinuesPlaylist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	savedDir, savedOutputs, savedBackground := hlsDir, outputs, background
+	defer func() { hlsDir, outputs, background, store = savedDir, savedOutputs, savedBackground, nil }()
+	store = &storage.Disk{Root: filepath.Join(dir, "stored")}
+	background = newJobQueue()
+	defer background.Close()
+	preset := presets[client.LatencyBalanced]
+	preset.SegmentDuration, preset.PlaylistLength = 2, 3
+
+	// the source instance hands its playlist over
+	hlsDir, outputs = filepath.Join(dir, "a"), newStreamOutputs(time.Now)
+	source := outputs.get("live")
+	os.MkdirAll(source.dir, 0755)
+	writeGeneration(t, source.dir, 100, 4, 6, true)
+	uploadHandover("live")
+	stored := filepath.Join(dir, "stored", "live", playlistName)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(stored); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("handover playlist not stored")
+		}
+	}
+	if data := mustRead(t, stored); strings.Contains(string(data), "#EXT-X-ENDLIST") {
+		t.Fatalf("handover playlist ended:\n%s", data)
+	}
+
+	// the target instance goes on with it
+	hlsDir, outputs = filepath.Join(dir, "b"), newStreamOutputs(time.Now)
+	if err := resumeOutput("live", preset); err != nil {
+		t.Fatal(err)
+	}
+	target := outputs.get("live")
+	if data := mustRead(t, filepath.Join(target.dir, segmentPrefix(100)+"00006.ts")); string(data) != "100/6" {
+		t.Fatalf("stored segment = %q", data)
+	}
+	generation := target.generations.next()
+	if generation <= 100 {
+		t.Fatalf("generation %d does not follow the migrated one", generation)
+	}
+	writeGeneration(t, target.dir, generation, 0, 0, false)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(servePlaylist)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/hls/live/"+playlistName, nil))
+	m, err := hlscheck.ParseMedia(w.Body.Bytes())
+	if err != nil {
+		t.Fatalf("%v\n%s", err, w.Body.String())
+	}
+	if m.Ended || m.MediaSequence != 5 || len(m.Segments) != 3 ||
+		m.Segments[1].URI != segmentPrefix(100)+"00006.ts" ||
+		!strings.Contains(w.Body.String(), "#EXT-X-DISCONTINUITY\n#EXTINF:2.000,\n"+segmentPrefix(generation)+"00000.ts") {
+		t.Fatalf("migrated playlist:\n%s", w.Body.String())
+	}
+}
@@ -0,0 +1,44 @@
+package streamserver
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/sdp"
+)
+
+var errVideoRequired = errors.New("offer has no video track, video is required")
+
+// no_video_policy values, with per key overrides in no_video_policy_overrides
+const (
+	// noVideoReject refuses offers without video; the default
+	noVideoReject = "reject"
+	// noVideoAudioOnly accepts them as audio-only sessions, which have no
+	// output until the audio HLS path exists
+	noVideoAudioOnly = "audio-only"
+)
+
+// offerHasVideo reports whether the offer sends a video track
+func offerHasVideo(offer *sdp.SDPInfo) bool {
+	for _, stream := range offer.GetStreams() {
+		for _, track := range stream.GetTracks() {
+			if track.GetMedia() == "video" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sessionKind decides the kind of the session an offer for key starts, or
+// rejects the offer under the key's no_video_policy
+func sessionKind(offer *sdp.SDPInfo, key string) (string, error) {
+	if offerHasVideo(offer) {
+		return client.KindVideo, nil
+	}
+	if strings.TrimSpace(envForKey("no_video_policy", key)) == noVideoAudioOnly {
+		return client.KindAudioOnly, nil
+	}
+	return "", errVideoRequired
+}
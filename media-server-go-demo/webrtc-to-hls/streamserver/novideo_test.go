@@ -0,0 +1,69 @@
+package streamserver
+
+import (
+	"testing"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/sdp"
+)
+
+func parseFixture(t *testing.T, name string) *sdp.SDPInfo {
+	offer, err := sdp.Parse(string(mustRead(t, "testdata/"+name)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return offer
+}
+
+// TestAudioOnlyThenVideo follows a publisher that offers audio only and
+// renegotiates with video on the same connection
+func TestAudioOnlyThenVideo(t *testing.T) {
+	audioOnly := parseFixture(t, "audio_only_offer.sdp")
+	withVideo := parseFixture(t, "chrome_offer.sdp")
+	if offerHasVideo(audioOnly) || !offerHasVideo(withVideo) {
+		t.Fatal("video tracks misdetected")
+	}
+
+	// rejected by default, with a structured error
+	if _, err := sessionKind(audioOnly, "radio"); err != errVideoRequired {
+		t.Fatalf("default policy err = %v", err)
+	}
+	if kind, err := sessionKind(withVideo, "radio"); err != nil || kind != client.KindVideo {
+		t.Fatalf("renegotiated with video = %q %v", kind, err)
+	}
+
+	t.Setenv("no_video_policy_overrides", "radio=audio-only")
+	kind, err := sessionKind(audioOnly, "radio")
+	if err != nil || kind != client.KindAudioOnly {
+		t.Fatalf("audio-only policy = %q %v", kind, err)
+	}
+	if _, err := sessionKind(audioOnly, "other"); err != errVideoRequired {
+		t.Fatalf("override leaked to another key: %v", err)
+	}
+
+	sess := newSession("radio", nil, presets[client.LatencyBalanced])
+	sess.kind = kind
+	if playlistPath(sess) != "" {
+		t.Fatalf("audio-only playlist = %q", playlistPath(sess))
+	}
+	if _, err := registry.claim(sess, conflictReject); err != nil {
+		t.Fatal(err)
+	}
+	if warmingUp("radio") == sess {
+		t.Fatal("audio-only session warming up an output it does not have")
+	}
+	// the renegotiated offer replaces the session, as the channel does
+	registry.release(sess)
+	sess.close(0, "")
+
+	kind, _ = sessionKind(withVideo, "radio")
+	video := newSession("radio", nil, presets[client.LatencyBalanced])
+	video.kind = kind
+	if _, err := registry.claim(video, conflictReject); err != nil {
+		t.Fatal(err)
+	}
+	defer registry.release(video)
+	if registry.find("radio").kind != client.KindVideo || playlistPath(video) == "" {
+		t.Fatal("renegotiated session is not a video session")
+	}
+}
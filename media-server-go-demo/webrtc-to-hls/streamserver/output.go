@@ -0,0 +1,526 @@
+package streamserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+	gstreamer "github.com/notedit/gstreamer-go"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/loudness"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/metrics"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/pipeline"
+)
+
+var (
+	framesPushed = metrics.NewCounter("appsrc_frames_pushed_total",
+		"Frames pushed into HLS pipelines, by track", "track")
+	framesDropped = metrics.NewCounter("appsrc_frames_dropped_total",
+		"Frames dropped because the queue of an HLS pipeline was full, by track", "track")
+	sideFramesDropped = metrics.NewCounter("side_output_frames_dropped_total",
+		"Frames dropped because the queue of a side output was full, by kind", "kind")
+)
+
+// outputQueueBytes bounds the bytes appsrc holds for the HLS pipeline
+// before pushing blocks and frames queue up in the output's own queue
+const outputQueueBytes = 4 << 20
+
+// sideQueueBytes bounds the bytes appsrc holds for a side pipeline before
+// pushing blocks and frames queue up in its sideFeeder
+const sideQueueBytes = 4 << 20
+
+// outputQueueFrames bounds the frames queued for the HLS pipeline, a few
+// seconds of video and audio. A pipeline falling this far behind loses
+// its oldest frames rather than holding up the media thread.
+const outputQueueFrames = 300
+
+var errPipelineFailed = errors.New("hls pipeline failed")
+
+// reasons an HLS pipeline fails for, as given to fail
+const (
+	failureError = "error"
+	// failureEOS: the pipeline ended without being flushed
+	failureEOS = "eos"
+)
+
+// hlsOutput is the GStreamer pipeline packaging a session into HLS
+type hlsOutput struct {
+	pipeline *gstreamer.Pipeline
+	appsrc   *gstreamer.Element
+	// audiosrc is nil when the pipeline has no audio branch
+	audiosrc *gstreamer.Element
+	// metasrc takes ID3 tags, nil unless the session relays data
+	metasrc *gstreamer.Element
+	// captionsink gives the PCM of the caption branch on pcm, nil unless
+	// the output is captioned
+	captionsink *gstreamer.Element
+	pcm         <-chan []byte
+	// loudnesssink gives the PCM meter measures, nil unless the audio is
+	// normalized, see loudnessBranch
+	loudnesssink *gstreamer.Element
+	meter        *loudness.Meter
+	// altAudio take the alternate audio tracks, see alternateAudioTrack
+	altAudio []*gstreamer.Element
+	// ladder is nil without ABR rungs
+	ladder *ladderOutput
+	// playlist writes the playlist of the segments splitmuxsink cuts, nil
+	// when hlssink writes it
+	playlist *playlistWriter
+	// queue holds the frames for appsrc and audiosrc, fed by feed
+	queue *frameQueue
+	// timing gives the frames their PTS as they are queued, nil when
+	// appsrc and audiosrc timestamp them, see rtpTimestamps
+	timing *outputTiming
+	// videoSeq numbers the video frames queued, with the session locked.
+	// feed skips the video after a gap in them, until the next keyframe,
+	// so the pipeline resumes on a clean GOP; lastVideo and skipping are
+	// its own.
+	videoSeq  uint64
+	lastVideo uint64
+	skipping  bool
+	// flushes asks feed to push the queued frames, see Flush
+	flushes chan chan struct{}
+	// dropped counts the video and audio frames lost to overflows
+	droppedVideo int64
+	droppedAudio int64
+
+	eosOnce sync.Once
+	eos     chan struct{}
+	// flushing is set by Flush, an EOS before it failing the pipeline
+	flushing int32
+	failOnce sync.Once
+	failed   chan struct{}
+	// failure is why the pipeline failed, once failed is closed
+	failure string
+	// released is closed by Release
+	released chan struct{}
+}
+
+func newHLSOutput(pipelineStr string) (*hlsOutput, error) {
+	pipeline, err := gstreamer.New(pipelineStr)
+	if err != nil {
+		return nil, err
+	}
+	out := &hlsOutput{
+		pipeline:     pipeline,
+		appsrc:       pipeline.FindElement("appsrc"),
+		audiosrc:     pipeline.FindElement("audiosrc"),
+		metasrc:      pipeline.FindElement("metasrc"),
+		captionsink:  pipeline.FindElement("captionsink"),
+		loudnesssink: pipeline.FindElement("loudnesssink"),
+		queue:        newFrameQueue(outputQueueFrames),
+		flushes:      make(chan chan struct{}),
+		eos:          make(chan struct{}),
+		failed:       make(chan struct{}),
+		released:     make(chan struct{}),
+	}
+	for i := 0; ; i++ {
+		src := pipeline.FindElement(fmt.Sprintf("altaudiosrc%d", i))
+		if src == nil {
+			break
+		}
+		out.altAudio = append(out.altAudio, src)
+	}
+	if out.captionsink != nil {
+		// polled before the pipeline plays, not to miss its first buffers
+		out.pcm = pumpFrames(out.captionsink.Poll())
+	}
+	if out.loudnesssink != nil {
+		out.meter = loudness.NewMeter(loudnessRate, 2)
+		go func(pcm <-chan []byte) {
+			for buf := range pcm {
+				out.meter.WriteS16LE(buf)
+			}
+		}(pumpFrames(out.loudnesssink.Poll()))
+	}
+	go out.watchBus(pipeline.PullMessage())
+	pipeline.Start()
+	go out.feed()
+	return out, nil
+}
+
+// feed pushes the queued frames into the pipeline until Release. appsrc
+// blocks while full, so a stalled pipeline fills the queue instead.
+func (o *hlsOutput) feed() {
+	for {
+		select {
+		case <-o.released:
+			return
+		case flushed := <-o.flushes:
+			o.pushQueued()
+			close(flushed)
+		case <-o.queue.ready:
+			o.pushQueued()
+		}
+	}
+}
+
+// pushQueued pushes the frames in the queue, but the video of a gap up
+// to the next keyframe
+func (o *hlsOutput) pushQueued() {
+	for f := o.queue.pop(); f != nil; f = o.queue.pop() {
+		if f.audio {
+			o.pushFrame(o.audiosrc, f)
+			releaseOutputFrame(f)
+			continue
+		}
+		if f.keyframe {
+			o.skipping = false
+		} else if f.seq != o.lastVideo+1 {
+			o.skipping = true
+		}
+		o.lastVideo = f.seq
+		if o.skipping {
+			o.drop(f)
+			continue
+		}
+		o.pushFrame(o.appsrc, f)
+		releaseOutputFrame(f)
+	}
+}
+
+// pushFrame pushes f into src, with its PTS when the output times them
+func (o *hlsOutput) pushFrame(src *gstreamer.Element, f *outputFrame) {
+	if o.timing == nil {
+		src.Push(f.data)
+		return
+	}
+	src.Push2(f.data, uint64(f.pts))
+}
+
+// enqueue queues a copy of frame, as the caller reuses its buffers, the
+// oldest frame being dropped when the queue is full
+func (o *hlsOutput) enqueue(frame []byte, at frameTime, audio, keyframe bool) {
+	f := newOutputFrame(frame)
+	f.audio, f.keyframe = audio, keyframe
+	if o.timing != nil {
+		f.pts = o.timing.pts(at, audio)
+	}
+	if !audio {
+		o.videoSeq++
+		f.seq = o.videoSeq
+	}
+	if dropped := o.queue.push(f); dropped != nil {
+		o.drop(dropped)
+	}
+}
+
+// drop counts a frame lost to an overflow and releases it
+func (o *hlsOutput) drop(f *outputFrame) {
+	if f.audio {
+		atomic.AddInt64(&o.droppedAudio, 1)
+		framesDropped.Inc("audio")
+	} else {
+		atomic.AddInt64(&o.droppedVideo, 1)
+		framesDropped.Inc("video")
+	}
+	releaseOutputFrame(f)
+}
+
+// queueStats are the queued frames of the output, for the stats API, and
+// the frames it dropped
+func (o *hlsOutput) queueStats() gin.H {
+	return gin.H{
+		"queued":   o.queue.len(),
+		"capacity": outputQueueFrames,
+		"dropped": gin.H{
+			"video": atomic.LoadInt64(&o.droppedVideo),
+			"audio": atomic.LoadInt64(&o.droppedAudio),
+		},
+	}
+}
+
+// watchBus drains the pipeline bus until Stop closes it. An error, such as
+// a full disk or an element failing, fails the output, and so does an EOS
+// nobody asked for.
+func (o *hlsOutput) watchBus(messages <-chan *gstreamer.Message) {
+	for msg := range messages {
+		switch msg.GetType() {
+		case gstreamer.MESSAGE_EOS:
+			if atomic.LoadInt32(&o.flushing) == 0 {
+				o.fail(failureEOS)
+				continue
+			}
+			o.eosOnce.Do(func() { close(o.eos) })
+		case gstreamer.MESSAGE_ERROR:
+			o.fail(failureError)
+		}
+	}
+}
+
+// fail fails the output for reason, once; see superviseOutput
+func (o *hlsOutput) fail(reason string) {
+	o.failOnce.Do(func() {
+		o.failure = reason
+		close(o.failed)
+	})
+}
+
+// push queues a video frame captured at at; the caller holds the session
+// lock, serializing pushes as the queue needs
+func (o *hlsOutput) push(frame []byte, at frameTime, keyframe bool) {
+	o.enqueue(frame, at, false, keyframe)
+	framesPushed.Inc("video")
+}
+
+func (o *hlsOutput) pushAudio(frame []byte, at frameTime) {
+	if o.audiosrc == nil {
+		return
+	}
+	o.enqueue(frame, at, true, false)
+	framesPushed.Inc("audio")
+}
+
+// pushAlternateAudio gives a frame of the alternate audio track i to its
+// rendition
+func (o *hlsOutput) pushAlternateAudio(i int, frame []byte) {
+	if i < len(o.altAudio) {
+		framesPushed.Inc("audio")
+		o.altAudio[i].Push(frame)
+	}
+}
+
+// pushMetadata muxes an ID3 tag as timed metadata, false when the pipeline
+// has no metadata branch
+func (o *hlsOutput) pushMetadata(tag []byte) bool {
+	if o.metasrc == nil {
+		return false
+	}
+	o.metasrc.Push(tag)
+	return true
+}
+
+func (o *hlsOutput) Name() string {
+	return "hls"
+}
+
+// Flush pushes the queued frames and sends EOS so the muxer and the sink
+// close the last segment, and waits for it to reach the bus, then flushes
+// the rungs of the ladder
+func (o *hlsOutput) Flush(ctx context.Context) error {
+	flushed := make(chan struct{})
+	select {
+	case o.flushes <- flushed:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-flushed:
+	case <-o.failed:
+		return errPipelineFailed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	atomic.StoreInt32(&o.flushing, 1)
+	o.pipeline.SendEOS()
+	select {
+	case <-o.eos:
+	case <-o.failed:
+		return errPipelineFailed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if o.ladder != nil {
+		return o.ladder.flush(ctx)
+	}
+	return nil
+}
+
+// Finalize lists the last segment and ends the playlist, when written in
+// Go: hlssink rewrites its own on EOS
+func (o *hlsOutput) Finalize(ctx context.Context) error {
+	if o.playlist != nil {
+		return o.playlist.finish()
+	}
+	return nil
+}
+
+// Drain is a no-op: segments are written to local disk synchronously
+func (o *hlsOutput) Drain(ctx context.Context) error {
+	return nil
+}
+
+func (o *hlsOutput) Release() {
+	o.appsrc.Stop()
+	if o.audiosrc != nil {
+		o.audiosrc.Stop()
+	}
+	if o.metasrc != nil {
+		o.metasrc.Stop()
+	}
+	for _, src := range o.altAudio {
+		src.Stop()
+	}
+	if o.captionsink != nil {
+		o.captionsink.Stop()
+	}
+	if o.loudnesssink != nil {
+		o.loudnesssink.Stop()
+	}
+	o.pipeline.Stop()
+	if o.ladder != nil {
+		o.ladder.release()
+	}
+	close(o.released)
+}
+
+// sidePipeline is the pipeline of an output fed next to the HLS one,
+// writing to sink, with the session locked: the video is H.264, other
+// codecs being transcoded, then goes through chain, and the audio of the
+// output is muxed. maxBytes bounds what its appsrc holds, see
+// pipeline.Track.
+func (s *session) sidePipeline(maxBytes int, chain string, sink pipeline.Sink) *pipeline.Builder {
+	video := pipeline.Track{Name: "appsrc", Input: videoInput(codecH264, s.inputCodec(), s.preset, s.key) + chain, MaxBytes: maxBytes}
+	b := pipeline.New(video, sink)
+	if s.audio {
+		track := aacTrack(s.aacCaps)
+		if s.loudnessTarget != 0 {
+			track = normalizedTrack(s.aacCaps, s.loudnessTarget)
+		}
+		b.Audio(track)
+	}
+	return b
+}
+
+// sideFeeder feeds the frames of a side pipeline, see sidePipeline, to its
+// appsrc and audiosrc from a frameQueue on a goroutine of its own, so a
+// stalled sink, restream or recording drops its oldest frames rather than
+// holding up the session. The frames before the first keyframe are
+// dropped, and the video of a gap skipped up to the next keyframe, as
+// hlsOutput does.
+type sideFeeder struct {
+	// kind labels the frames dropped, e.g. rtmp
+	kind string
+	// video and audio push a frame into the pipeline; audio is nil when
+	// the pipeline has no audio branch
+	video, audio func(frame []byte)
+	queue        *frameQueue
+	// started and videoSeq are those of the writer, lastVideo and skipping
+	// of feed
+	started   bool
+	videoSeq  uint64
+	lastVideo uint64
+	skipping  bool
+	// flushes asks feed to push the queued frames, see flush
+	flushes chan chan struct{}
+	// released is closed by release
+	released    chan struct{}
+	releaseOnce sync.Once
+}
+
+// newSideFeeder feeds the appsrc and, if any, the audiosrc of pipe
+func newSideFeeder(kind string, pipe *gstreamer.Pipeline) *sideFeeder {
+	f := &sideFeeder{kind: kind, video: pipe.FindElement("appsrc").Push}
+	if audiosrc := pipe.FindElement("audiosrc"); audiosrc != nil {
+		f.audio = audiosrc.Push
+	}
+	f.start()
+	return f
+}
+
+func (f *sideFeeder) start() {
+	f.queue = newFrameQueue(outputQueueFrames)
+	f.flushes = make(chan chan struct{})
+	f.released = make(chan struct{})
+	go f.feed()
+}
+
+// feed pushes the queued frames into the pipeline until release, then
+// drops those left
+func (f *sideFeeder) feed() {
+	for {
+		select {
+		case <-f.released:
+			for frame := f.queue.pop(); frame != nil; frame = f.queue.pop() {
+				releaseOutputFrame(frame)
+			}
+			return
+		case flushed := <-f.flushes:
+			f.pushQueued()
+			close(flushed)
+		case <-f.queue.ready:
+			f.pushQueued()
+		}
+	}
+}
+
+func (f *sideFeeder) pushQueued() {
+	for frame := f.queue.pop(); frame != nil; frame = f.queue.pop() {
+		if !frame.audio {
+			if frame.keyframe {
+				f.skipping = false
+			} else if frame.seq != f.lastVideo+1 {
+				f.skipping = true
+			}
+			f.lastVideo = frame.seq
+			if f.skipping {
+				f.drop(frame)
+				continue
+			}
+			f.video(frame.data)
+		} else {
+			f.audio(frame.data)
+		}
+		releaseOutputFrame(frame)
+	}
+}
+
+// push queues a copy of a video frame; the caller serializes the writes,
+// as the queue needs
+func (f *sideFeeder) push(data []byte, keyframe bool) {
+	if !f.started && !keyframe {
+		return
+	}
+	f.started = true
+	frame := newOutputFrame(data)
+	frame.keyframe = keyframe
+	f.videoSeq++
+	frame.seq = f.videoSeq
+	f.enqueue(frame)
+}
+
+func (f *sideFeeder) pushAudio(data []byte) {
+	if f.audio == nil || !f.started {
+		return
+	}
+	frame := newOutputFrame(data)
+	frame.audio = true
+	f.enqueue(frame)
+}
+
+func (f *sideFeeder) enqueue(frame *outputFrame) {
+	if dropped := f.queue.push(frame); dropped != nil {
+		f.drop(dropped)
+	}
+}
+
+func (f *sideFeeder) drop(frame *outputFrame) {
+	sideFramesDropped.Inc(f.kind)
+	releaseOutputFrame(frame)
+}
+
+// flush pushes the frames queued, before the pipeline is sent EOS
+func (f *sideFeeder) flush(ctx context.Context) error {
+	flushed := make(chan struct{})
+	select {
+	case f.flushes <- flushed:
+	case <-f.released:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release stops feeding, once the sources of the pipeline are stopped so
+// a push blocked on them returns
+func (f *sideFeeder) release() {
+	f.releaseOnce.Do(func() { close(f.released) })
+}
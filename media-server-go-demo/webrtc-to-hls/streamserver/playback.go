@@ -0,0 +1,225 @@
+package streamserver
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/ident"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/metrics"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/pubauth"
+)
+
+var playbackRefusals = metrics.NewCounter("playback_auth_refusals_total",
+	"HLS requests of private streams refused, by reason", "reason")
+
+var errNoPlaybackSecret = errors.New("private playback needs playback_secret")
+
+// playbackCookie carries the token of a playlist request to the segment
+// requests of its player, which only know the URIs the playlist lists
+const playbackCookie = "playback_token"
+
+// maxPlaybackTTL bounds the playback tokens the API issues
+const maxPlaybackTTL = 24 * time.Hour
+
+// playbackTokens verifies playback tokens: HS256 JWTs of playback_secret
+// whose stream claim is the stream key and which expire (exp). Nil without
+// playback_secret.
+var playbackTokens *pubauth.JWT
+
+// playbackPrivacy is whether the management API made a stream key private,
+// by key; it takes precedence over playback_private
+var playbackPrivacy = struct {
+	sync.Mutex
+	byKey map[string]bool
+}{byKey: map[string]bool{}}
+
+// setupPlayback reads playback_secret, which signs the tokens of private
+// streams, and jwt_leeway_seconds (30). playback_private /
+// playback_private_overrides set to true make streams private.
+func setupPlayback() error {
+	secret := os.Getenv("playback_secret")
+	if secret == "" {
+		if os.Getenv("playback_private") != "" || os.Getenv("playback_private_overrides") != "" {
+			return errNoPlaybackSecret
+		}
+		return nil
+	}
+	playbackTokens = &pubauth.JWT{
+		Secret: []byte(secret),
+		Leeway: time.Duration(envInt("jwt_leeway_seconds", 30)) * time.Second,
+	}
+	return nil
+}
+
+// privatePlayback reports whether the HLS output of key is only served to
+// viewers with a token: as set through the API, else playback_private
+func privatePlayback(key string) bool {
+	playbackPrivacy.Lock()
+	private, ok := playbackPrivacy.byKey[key]
+	playbackPrivacy.Unlock()
+	if ok {
+		return private
+	}
+	return envForKey("playback_private", key) == "true"
+}
+
+// playbackToken returns the token of a request: the token query parameter,
+// else the cookie set by an earlier playlist request
+func playbackToken(c *gin.Context) (token string, fromQuery bool) {
+	if token := c.Query("token"); token != "" {
+		return token, true
+	}
+	token, _ = c.Cookie(playbackCookie)
+	return token, false
+}
+
+// verifyPlayback checks token allows playback of key until its expiry
+func verifyPlayback(key, token string) (time.Time, error) {
+	if playbackTokens == nil {
+		return time.Time{}, errNoPlaybackSecret
+	}
+	claims, err := playbackTokens.Verify(token)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if claims.Stream != key || claims.ExpiresAt == nil {
+		return time.Time{}, pubauth.ErrDenied
+	}
+	return time.Unix(int64(*claims.ExpiresAt), 0), nil
+}
+
+// authorizePlayback refuses the playlists and segments of private streams,
+// and the keys and clear key licenses of protected ones, to requests
+// without a valid token: 401 without one, 403 for a bad or expired one. A playlist request authorized by its query sets the cookie
+// its segment requests are authorized by.
+func authorizePlayback(c *gin.Context) {
+	if !strings.HasPrefix(c.Request.URL.Path, "/hls/") {
+		c.Next()
+		return
+	}
+	for _, key := range playbackKeys(c.Request.URL.Path) {
+		// the keys of encrypted outputs and the licenses of protected ones
+		// are private to token holders
+		if !privatePlayback(key) && !keyRequest(c.Request.URL.Path, key) && !licenseRequest(c.Request.URL.Path, key) {
+			continue
+		}
+		token, fromQuery := playbackToken(c)
+		if token == "" {
+			refusePlayback(c, http.StatusUnauthorized, "missing")
+			return
+		}
+		expires, err := verifyPlayback(key, token)
+		if err != nil {
+			refusePlayback(c, http.StatusForbidden, "denied")
+			return
+		}
+		if fromQuery {
+			id := strings.SplitN(strings.TrimPrefix(c.Request.URL.Path, "/hls/"), "/", 2)[0]
+			maxAge := int(time.Until(expires) / time.Second)
+			c.SetCookie(playbackCookie, token, maxAge, "/hls/"+id+"/", "", c.Request.TLS != nil, true)
+		}
+		c.Header("Cache-Control", "private, no-cache")
+	}
+	c.Next()
+}
+
+func refusePlayback(c *gin.Context, status int, reason string) {
+	playbackRefusals.Inc(reason)
+	c.Header("Cache-Control", "no-store")
+	c.String(status, "playback token %s\n", reason)
+	c.Abort()
+}
+
+// playbackJSON describes the playback access of key
+func playbackJSON(key string) gin.H {
+	return gin.H{"stream": key, "private": privatePlayback(key)}
+}
+
+// getPlayback handles GET /api/v1/streams/:id/playback
+func getPlayback(c *gin.Context) {
+	key, ok := identParam(c, "id", ident.StreamKey)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, playbackJSON(key))
+}
+
+// setPlayback handles PUT /api/v1/streams/:id/playback, making the HLS
+// output of a stream key private or public: {"private": true}. It applies
+// to the requests that follow, of a live stream too.
+func setPlayback(c *gin.Context) {
+	admin, ok := adminIdentity(c)
+	if !ok {
+		return
+	}
+	key, ok := identParam(c, "id", ident.StreamKey)
+	if !ok {
+		return
+	}
+	var req struct {
+		Private *bool `json:"private"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		return
+	}
+	if req.Private == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "private required"})
+		return
+	}
+	if *req.Private && playbackTokens == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": errNoPlaybackSecret.Error()})
+		return
+	}
+	playbackPrivacy.Lock()
+	playbackPrivacy.byKey[key] = *req.Private
+	playbackPrivacy.Unlock()
+	logger.Info("playback access set", "stream", key, "private", *req.Private, "admin", admin)
+	c.JSON(http.StatusOK, playbackJSON(key))
+}
+
+// issuePlaybackToken handles POST /api/v1/streams/:id/playback/tokens,
+// issuing a token for the stream key valid for ttlSec (3600) seconds, up
+// to a day: {"ttlSec": 600}. Backends with playback_secret sign their own.
+func issuePlaybackToken(c *gin.Context) {
+	admin, ok := adminIdentity(c)
+	if !ok {
+		return
+	}
+	key, ok := identParam(c, "id", ident.StreamKey)
+	if !ok {
+		return
+	}
+	var req struct {
+		TTLSec int `json:"ttlSec"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.BindJSON(&req); err != nil {
+			return
+		}
+	}
+	ttl := time.Duration(req.TTLSec) * time.Second
+	if req.TTLSec == 0 {
+		ttl = time.Hour
+	}
+	if ttl <= 0 || ttl > maxPlaybackTTL {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ttlSec must be 1 to 86400"})
+		return
+	}
+	if playbackTokens == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": errNoPlaybackSecret.Error()})
+		return
+	}
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	exp := float64(expires.Unix())
+	token, err := playbackTokens.Sign(pubauth.Claims{Subject: admin, Stream: key, ExpiresAt: &exp})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"stream": key, "token": token, "expires": expires.UTC()})
+}
@@ -0,0 +1,125 @@
+package streamserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/pubauth"
+)
+
+func TestPlaybackAuthorization(t *testing.T) {
+	saved := playbackTokens
+	playbackTokens = &pubauth.JWT{Secret: []byte("playback")}
+	defer func() { playbackTokens = saved }()
+	t.Setenv("playback_private_overrides", "private-show=true")
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(authorizePlayback)
+	r.GET("/hls/:id/*file", func(c *gin.Context) { c.String(http.StatusOK, "served") })
+	get := func(path string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	sign := func(stream string, expires time.Time) string {
+		exp := float64(expires.Unix())
+		token, err := playbackTokens.Sign(pubauth.Claims{Stream: stream, ExpiresAt: &exp})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	if w := get("/hls/public-show/playlist.m3u8", nil); w.Code != http.StatusOK {
+		t.Fatalf("public stream = %d", w.Code)
+	}
+	hour := time.Now().Add(time.Hour)
+	expired := sign("private-show", time.Now().Add(-time.Hour))
+	noExpiry, _ := playbackTokens.Sign(pubauth.Claims{Stream: "private-show"})
+	for token, status := range map[string]int{
+		"":                       http.StatusUnauthorized,
+		"garbage":                http.StatusForbidden,
+		sign("other-show", hour): http.StatusForbidden,
+		expired:                  http.StatusForbidden,
+		noExpiry:                 http.StatusForbidden,
+	} {
+		if w := get("/hls/private-show/playlist.m3u8?token="+token, nil); w.Code != status || w.Body.String() == "served" {
+			t.Errorf("token %q = %d, want %d", token, w.Code, status)
+		}
+	}
+
+	// the playlist sets the cookie its segments are authorized by
+	w := get("/hls/private-show/playlist.m3u8?token="+sign("private-show", hour), nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("valid token = %d", w.Code)
+	}
+	cookies := (&http.Response{Header: w.Header()}).Cookies()
+	if len(cookies) != 1 || cookies[0].Name != playbackCookie || cookies[0].Path != "/hls/private-show/" || !cookies[0].HttpOnly {
+		t.Fatalf("cookies %v", cookies)
+	}
+	if w := get("/hls/private-show/segment-1-00001.ts", cookies[0]); w.Code != http.StatusOK {
+		t.Fatalf("segment with the cookie = %d", w.Code)
+	}
+	if w := get("/hls/private-show/segment-1-00001.ts", nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("segment without a token = %d", w.Code)
+	}
+}
+
+func TestPlaybackAPI(t *testing.T) {
+	saved := playbackTokens
+	defer func() {
+		playbackTokens = saved
+		delete(playbackPrivacy.byKey, "playback-api")
+	}()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/api/v1/streams/:id/playback", getPlayback)
+	r.PUT("/api/v1/streams/:id/playback", setPlayback)
+	r.POST("/api/v1/streams/:id/playback/tokens", issuePlaybackToken)
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, "/api/v1/streams/playback-api/"+path, strings.NewReader(body))
+		asAdmin(req, "ops")
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	playbackTokens = nil
+	if w := do("PUT", "playback", `{"private":true}`); w.Code != http.StatusConflict {
+		t.Fatalf("private without a secret = %d", w.Code)
+	}
+	playbackTokens = &pubauth.JWT{Secret: []byte("playback")}
+	for body, status := range map[string]int{`{}`: http.StatusBadRequest, `{"private":true}`: http.StatusOK} {
+		if w := do("PUT", "playback", body); w.Code != status {
+			t.Errorf("PUT %s = %d", body, w.Code)
+		}
+	}
+	if w := do("GET", "playback", ""); !strings.Contains(w.Body.String(), `"private":true`) || !privatePlayback("playback-api") {
+		t.Fatalf("playback = %s", w.Body)
+	}
+
+	if w := do("POST", "playback/tokens", `{"ttlSec":100000}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("token past a day = %d", w.Code)
+	}
+	w := do("POST", "playback/tokens", `{"ttlSec":600}`)
+	var issued struct {
+		Token   string    `json:"token"`
+		Expires time.Time `json:"expires"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &issued); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("issued %d %s", w.Code, w.Body)
+	}
+	if expires, err := verifyPlayback("playback-api", issued.Token); err != nil || !expires.Equal(issued.Expires) || time.Until(expires) > 10*time.Minute {
+		t.Fatalf("issued token: %v, expires %v", err, expires)
+	}
+}
@@ -0,0 +1,189 @@
+package streamserver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/hlscheck"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/ident"
+)
+
+// outputKey returns the stream key of a request for the playlist of an
+// output, /hls/<key>/playlist.m3u8
+func outputKey(urlPath string) (string, bool) {
+	parts := strings.Split(strings.TrimPrefix(urlPath, "/hls/"), "/")
+	if !strings.HasPrefix(urlPath, "/hls/") || len(parts) != 2 || parts[1] != playlistName {
+		return "", false
+	}
+	if ident.Check(ident.StreamKey, parts[0]) != nil {
+		return "", false
+	}
+	return parts[0], true
+}
+
+// servePlaylist serves the live playlist of a stream key through the gate
+// of its output, the held final playlist of the previous output generation,
+// or the warm-up answer of a session that has no segment yet. Requests by
+// any other id are left to serveExternalStream.
+func servePlaylist(c *gin.Context) {
+	key, ok := outputKey(c.Request.URL.Path)
+	if !ok {
+		c.Next()
+		return
+	}
+	out := outputs.lookup(key)
+	if out == nil && registry.get(key) == nil {
+		c.Next()
+		return
+	}
+	if out != nil {
+		if final := out.generations.held(); final != nil {
+			// players of the ended session see its ENDLIST first
+			c.Abort()
+			c.Header("Cache-Control", "no-cache")
+			c.Data(http.StatusOK, "application/vnd.apple.mpegurl", final)
+			return
+		}
+	}
+	if sess := warmingUp(key); sess != nil && serveWarmup(c, sess) {
+		c.Abort()
+		return
+	}
+	mode := os.Getenv("playlist_validation")
+	if mode == "off" {
+		c.Next()
+		return
+	}
+	c.Abort()
+	if out == nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	data, err := ioutil.ReadFile(out.playlist())
+	if err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	gate := out.gates.gate(playlistName)
+	serve, changed, err := gate.Revision(data)
+	if err != nil && changed {
+		heldBack(key, playlistName, err)
+	}
+	if serve == nil {
+		if gate.Strict && err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		c.Status(http.StatusNotFound)
+		return
+	}
+	// an EVENT playlist restored after a quarantine no longer lists the
+	// start of the event, it goes on as a live playlist
+	serve, continued := out.generations.continuedPlaylist(serve)
+	serve, restored := out.restoredPlaylist(serve)
+	if sess := registry.get(key); sess != nil && sess.preset.PlaylistLength == 0 && !restored && !continued {
+		serve = withPlaylistType(serve, "EVENT")
+	}
+	c.Header("Cache-Control", "no-cache")
+	c.Data(http.StatusOK, "application/vnd.apple.mpegurl", serve)
+}
+
+// serveRenditionPlaylist serves the media playlists of the renditions of an
+// output, its rungs and audio renditions, through their gates like
+// servePlaylist does the live playlist. The other files are left to
+// serveMedia.
+func serveRenditionPlaylist(c *gin.Context) {
+	file, ok := mediaFile(c.Request.URL.Path)
+	if !ok || path.Ext(file) != ".m3u8" || os.Getenv("playlist_validation") == "off" {
+		c.Next()
+		return
+	}
+	elements := strings.Split(strings.TrimPrefix(c.Request.URL.Path, "/hls/"), "/")
+	out := outputs.lookup(elements[0])
+	if out == nil {
+		c.Next()
+		return
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		c.Next()
+		return
+	}
+	c.Abort()
+	name := strings.Join(elements[1:], "/")
+	gate := out.gates.gate(name)
+	serve, changed, err := gate.Revision(data)
+	if err != nil && changed {
+		heldBack(elements[0], name, err)
+	}
+	if serve == nil {
+		if gate.Strict && err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		c.Status(http.StatusNotFound)
+		return
+	}
+	c.Header("Cache-Control", "no-cache")
+	c.Data(http.StatusOK, "application/vnd.apple.mpegurl", serve)
+}
+
+// heldBack reports a revision of the playlist name of the output of key
+// failing validation, the first time it is seen
+func heldBack(key, name string, err error) {
+	reason := fmt.Sprintf("playlist revision of %s held back: %v", key+"/"+name, err)
+	logger.Warn("playlist revision held back", "stream", key, "playlist", name, "error", err)
+	if sess := registry.get(key); sess != nil {
+		sess.warn(warning{
+			code:    client.WarningPlaylistHeld,
+			text:    reason,
+			details: map[string]interface{}{"error": err.Error(), "playlist": name},
+		})
+	}
+}
+
+// outputGates are the gates of the playlists of an output, one per
+// playlist: the live playlist, those of its renditions, the LL-HLS one
+// and the master playlist
+type outputGates struct {
+	strict bool
+
+	lock   sync.Mutex
+	rules  hlscheck.Rules
+	byName map[string]*hlscheck.Gate
+}
+
+func newOutputGates(strict bool) *outputGates {
+	return &outputGates{strict: strict, byName: make(map[string]*hlscheck.Gate)}
+}
+
+// gate returns the gate of the playlist at name, relative to the output
+// directory
+func (g *outputGates) gate(name string) *hlscheck.Gate {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	gate := g.byName[name]
+	if gate == nil {
+		gate = &hlscheck.Gate{Strict: g.strict}
+		gate.SetRules(g.rules)
+		g.byName[name] = gate
+	}
+	return gate
+}
+
+// reset forgets the revisions of every playlist and checks the next ones
+// against rules, when a new session starts writing the output
+func (g *outputGates) reset(rules hlscheck.Rules) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.rules = rules
+	g.byName = make(map[string]*hlscheck.Gate)
+}
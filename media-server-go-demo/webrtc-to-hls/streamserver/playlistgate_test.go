@@ -0,0 +1,61 @@
+package streamserver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/hlscheck"
+)
+
+func TestServeRenditionPlaylist(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(serveRenditionPlaylist)
+	r.Use(serveMedia)
+
+	key := "gated-rungs"
+	out := outputs.get(key)
+	defer os.RemoveAll(out.dir)
+	out.gates.reset(hlscheck.Rules{})
+	rdir := filepath.Join(out.dir, "720p")
+	if err := os.MkdirAll(rdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	write := func(seq int) string {
+		revision := fmt.Sprintf("#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:%d\n#EXTINF:2.000,\nsegment-4-%05d.ts\n", seq, seq)
+		if err := ioutil.WriteFile(filepath.Join(rdir, playlistName), []byte(revision), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return revision
+	}
+	get := func(name string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/hls/"+key+"/"+name, nil))
+		return w
+	}
+
+	good := write(3)
+	if w := get("720p/playlist.m3u8"); w.Code != http.StatusOK || w.Body.String() != good {
+		t.Fatalf("good revision = %d %q", w.Code, w.Body.String())
+	}
+	// the media sequence going back is held back
+	write(2)
+	if w := get("720p/playlist.m3u8"); w.Code != http.StatusOK || w.Body.String() != good {
+		t.Fatalf("bad revision = %d %q", w.Code, w.Body.String())
+	}
+	// a new session starts over
+	out.gates.reset(hlscheck.Rules{})
+	restarted := write(0)
+	if w := get("720p/playlist.m3u8"); w.Code != http.StatusOK || w.Body.String() != restarted {
+		t.Fatalf("after a reset = %d %q", w.Code, w.Body.String())
+	}
+	if w := get("720p/missing.m3u8"); w.Code != http.StatusNotFound {
+		t.Fatalf("missing playlist = %d", w.Code)
+	}
+}
@@ -0,0 +1,162 @@
+package streamserver
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/pipeline"
+)
+
+// presets are the latency modes publishers can pick from instead of tuning
+// each packaging knob: quality adds the default ABR ladder, low-latency
+// packages LL-HLS parts of the video passed through
+var presets = map[string]client.Preset{
+	client.LatencyQuality: {
+		Name:             client.LatencyQuality,
+		SegmentDuration:  5,
+		PlaylistLength:   10,
+		MaxFiles:         15,
+		KeyframeInterval: 5000,
+		Ladder:           "on",
+	},
+	client.LatencyBalanced: {
+		Name:             client.LatencyBalanced,
+		SegmentDuration:  2,
+		PlaylistLength:   6,
+		MaxFiles:         10,
+		KeyframeInterval: 2000,
+	},
+	client.LatencyLow: {
+		Name:             client.LatencyLow,
+		SegmentDuration:  1,
+		PlaylistLength:   3,
+		MaxFiles:         6,
+		KeyframeInterval: 1000,
+		HLSMode:          hlsModeLL,
+		Passthrough:      true,
+	},
+}
+
+// builtinPresets are the presets before the HLS config, which a reload
+// applies to again
+var builtinPresets = presets
+
+var errPresetChange = errors.New("latency preset cannot change mid-stream")
+
+// resolvePreset picks the requested preset, or the stream key default from
+// latency / latency_overrides, falling back to quality
+func resolvePreset(requested string, key string) (client.Preset, error) {
+	name := requested
+	if name == "" {
+		name = envForKey("latency", key)
+	}
+	if name == "" {
+		name = client.LatencyQuality
+	}
+	configLock.RLock()
+	preset, ok := presets[name]
+	configLock.RUnlock()
+	if !ok {
+		return client.Preset{}, fmt.Errorf("unknown latency preset %q", name)
+	}
+	return preset, validatePreset(preset)
+}
+
+// validatePreset checks the settings of a preset are consistent with each other
+func validatePreset(p client.Preset) error {
+	switch {
+	case p.SegmentDuration < 1:
+		return fmt.Errorf("preset %s: segment duration must be at least 1s", p.Name)
+	case p.PlaylistLength < 3:
+		return fmt.Errorf("preset %s: playlist must list at least 3 segments", p.Name)
+	case p.MaxFiles != 0 && p.MaxFiles <= p.PlaylistLength:
+		return fmt.Errorf("preset %s: must keep more segments on disk than the playlist lists", p.Name)
+	case p.KeyframeInterval <= 0 || p.KeyframeInterval > p.SegmentDuration*1000:
+		// segments can only be cut on keyframes
+		return fmt.Errorf("preset %s: keyframe interval must not exceed the segment duration", p.Name)
+	}
+	return nil
+}
+
+// checkPassthrough refuses, under a preset passing the video through, what
+// would transcode it besides a ladder, see resolveLadder: a composite
+// layout or a watermark of key
+func checkPassthrough(p client.Preset, layout string, key string) error {
+	if !p.Passthrough {
+		return nil
+	}
+	if layout != "" {
+		return fmt.Errorf("preset %s passes the video through, it cannot be composited", p.Name)
+	}
+	mark, err := watermarkFor(key)
+	if err != nil {
+		return err
+	}
+	if mark != nil {
+		return fmt.Errorf("preset %s passes the video through, it cannot be watermarked", p.Name)
+	}
+	return nil
+}
+
+// hlsSink writes the segments of an output generation to dir, in
+// container, as p packages them
+func hlsSink(p client.Preset, dir string, generation int64, container string) pipeline.HLS {
+	return pipeline.HLS{
+		Container:      container,
+		Prefix:         filepath.Join(dir, segmentPrefix(generation)),
+		Playlist:       filepath.Join(dir, playlistName),
+		MaxFiles:       p.MaxFiles,
+		TargetDuration: p.SegmentDuration,
+		PlaylistLength: p.PlaylistLength,
+	}
+}
+
+// outputPipeline is the pipeline of an output generation written to dir,
+// with the session locked: the video, transcoded or passed through as
+// outputCodec says, packaged in the container of the session, its audio
+// when audio is set, and the renditions and branches of its settings.
+// captioned adds the branch transcribed for captions. The video and the
+// audio are pushed with their PTS unless rtp_timestamps is off.
+func (s *session) outputPipeline(dir string, generation int64, audio, captioned bool) *pipeline.Builder {
+	timestamped := rtpTimestamps(s.key)
+	input := videoInput(s.outputCodec(), s.inputCodec(), s.preset, s.key)
+	if s.watermark != nil {
+		input = s.watermarkedInput()
+	}
+	video := pipeline.Track{Name: "appsrc", Input: input, MaxBytes: outputQueueBytes, Timestamped: timestamped}
+	sink := hlsSink(s.preset, dir, generation, s.container)
+	sink.Splitmux = s.splitmux
+	b := pipeline.New(video, sink)
+	rendition, packaged := s.outputAudio(audio)
+	// fMP4 segments only take the audio as its audio-only rendition
+	if audio && (s.container != containerFMP4 || rendition) {
+		track := s.outputAudioTrack()
+		track.Timestamped = timestamped
+		b.Audio(track)
+		if s.loudnessTarget != 0 {
+			b.Raw(loudnessBranch)
+		}
+	}
+	if s.dash && s.container != containerFMP4 {
+		b.Branch("dash", pipeline.DASH{Root: dashDir(dir, generation), Manifest: dashName, TargetDuration: s.preset.SegmentDuration})
+	}
+	if rendition {
+		b.AudioBranch("audiomuxer", hlsSink(s.preset, audioRenditionDir(dir), generation, s.container))
+	}
+	for i, alternate := range packaged {
+		b.Track(alternateAudioTrack(i), fmt.Sprintf("altaudiomuxer%d", i), hlsSink(s.preset, alternateAudioDir(dir, alternate.language), generation, containerTS))
+	}
+	if s.srtEgress != "" && s.outputCodec() == codecH264 {
+		b.Branch("srtmux", pipeline.SRT{URI: s.srtEgress})
+	}
+	// fMP4 segments get their metadata as they are served, see readSegment
+	if s.container != containerFMP4 && timedMetadata(s.key) {
+		b.Raw(metadataBranch)
+	}
+	if captioned {
+		b.Raw(captionBranch)
+	}
+	return b
+}
@@ -0,0 +1,199 @@
+package streamserver
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+)
+
+func TestPresetsValidate(t *testing.T) {
+	for name, preset := range presets {
+		if preset.Name != name {
+			t.Errorf("preset %s is named %s", name, preset.Name)
+		}
+		if err := validatePreset(preset); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestResolvePreset(t *testing.T) {
+	preset, err := resolvePreset("", "key")
+	if err != nil || preset.Name != client.LatencyQuality {
+		t.Fatalf("default preset = %v, %v", preset.Name, err)
+	}
+	if _, err := resolvePreset("instant", "key"); err == nil {
+		t.Fatal("unknown preset accepted")
+	}
+	bad := client.Preset{Name: "bad", SegmentDuration: 2, PlaylistLength: 3, MaxFiles: 6, KeyframeInterval: 4000}
+	if err := validatePreset(bad); err == nil {
+		t.Fatal("keyframe interval longer than a segment accepted")
+	}
+}
+
+func TestPresetOutputs(t *testing.T) {
+	web := hlsProfiles[client.ProfileWebDefault]
+	for _, want := range []struct {
+		preset   string
+		rungs    int
+		ll       bool
+		pipeline string
+	}{
+		{client.LatencyQuality, 2, false, "target-duration=5 "},
+		{client.LatencyBalanced, 0, false, "target-duration=2 "},
+		{client.LatencyLow, 0, true, "target-duration=1 "},
+	} {
+		preset := presets[want.preset]
+		ladder, err := resolveLadder(preset, web, containerTS, "presets")
+		if err != nil || len(ladder) != want.rungs {
+			t.Errorf("%s ladder = %v, %v", want.preset, ladder, err)
+		}
+		if lowLatency(preset, "presets") != want.ll {
+			t.Errorf("%s packaged as LL-HLS = %v", want.preset, !want.ll)
+		}
+		sess := newSession("presets", nil, preset)
+		sess.ladder = ladder
+		if out := sess.outputPipeline("hls/presets", 1, false, false).String(); !strings.Contains(out, want.pipeline) {
+			t.Errorf("%s output = %s", want.preset, out)
+		}
+		ids := streamIDs(sess)
+		if _, ok := ids["master"]; ok != (want.rungs > 0) {
+			t.Errorf("%s master playlist = %v", want.preset, ok)
+		}
+		if _, ok := ids["lowLatencyPlaylist"]; ok != want.ll {
+			t.Errorf("%s LL-HLS playlist = %v", want.preset, ok)
+		}
+		for _, rung := range ladder {
+			if out := sess.rungPipeline("hls/presets", 1, rung, 0).String(); !strings.Contains(out, "target-duration=5 ") {
+				t.Errorf("%s rung %s = %s", want.preset, rung.Name, out)
+			}
+		}
+	}
+
+	// the ladder of quality only applies to TS outputs, abr_ladder and
+	// hls_mode override the presets
+	if ladder, err := resolveLadder(presets[client.LatencyQuality], web, containerFMP4, "presets"); err != nil || ladder != nil {
+		t.Fatalf("quality ladder of fmp4 = %v, %v", ladder, err)
+	}
+	t.Setenv("abr_ladder_overrides", "plain=off")
+	t.Setenv("hls_mode_overrides", "plain=hls")
+	if ladder, err := resolveLadder(presets[client.LatencyQuality], web, containerTS, "plain"); err != nil || ladder != nil {
+		t.Fatalf("quality ladder turned off = %v, %v", ladder, err)
+	}
+	if lowLatency(presets[client.LatencyLow], "plain") {
+		t.Fatal("hls_mode ignored under low-latency")
+	}
+}
+
+func TestLowLatencyPassthrough(t *testing.T) {
+	low := presets[client.LatencyLow]
+	t.Setenv("abr_ladder_overrides", "laddered=on")
+	if _, err := resolveLadder(low, hlsProfiles[client.ProfileWebDefault], containerTS, "laddered"); err == nil {
+		t.Fatal("ladder transcoded under low-latency")
+	}
+	if err := checkPassthrough(low, "grid", "composited"); err == nil {
+		t.Fatal("composite under low-latency")
+	}
+	watermarks.byKey["marked"] = &watermark{Image: "logo.png", Position: watermarkBottomRight, Opacity: 1, Scale: 1}
+	defer delete(watermarks.byKey, "marked")
+	if err := checkPassthrough(low, "", "marked"); err == nil {
+		t.Fatal("watermark under low-latency")
+	}
+	if err := checkPassthrough(low, "", "plain"); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkPassthrough(presets[client.LatencyQuality], "grid", "marked"); err != nil {
+		t.Fatalf("quality transcoding refused: %v", err)
+	}
+}
+
+func TestPipelineAudio(t *testing.T) {
+	sess := newSession("main", nil, presets[client.LatencyBalanced])
+	video := sess.outputPipeline("hls/main", 1, false, false).String()
+	if strings.Contains(video, "audiosrc") {
+		t.Fatalf("audio branch without audio: %s", video)
+	}
+	if !strings.Contains(video, "location=hls/main/segment-1-%05d.ts playlist-location=hls/main/playlist.m3u8 ") {
+		t.Fatalf("output outside the stream directory: %s", video)
+	}
+	withAudio := sess.outputPipeline("hls/main", 1, true, false).String()
+	if !strings.HasPrefix(withAudio, video) || !strings.Contains(withAudio, "name=audiosrc") || !strings.HasSuffix(withAudio, "! muxer.") {
+		t.Fatalf("audio pipeline = %s", withAudio)
+	}
+}
+
+func TestMuxAudio(t *testing.T) {
+	t.Setenv("hls_audio_overrides", "silent=off")
+	if !muxAudio(1, "show") {
+		t.Fatal("audio not muxed by default")
+	}
+	if muxAudio(0, "show") {
+		t.Fatal("audio muxed without an audio track")
+	}
+	if muxAudio(1, "silent") {
+		t.Fatal("hls_audio=off ignored")
+	}
+}
+
+func TestAudioRendition(t *testing.T) {
+	t.Setenv("hls_audio_rendition_overrides", "podcast=on")
+	preset := presets[client.LatencyBalanced]
+	sess := newSession("podcast", nil, preset)
+	sess.container = containerFMP4
+	if !audioRendition("podcast") || audioRendition("show") || !sess.takesAudio(1) {
+		t.Fatal("audio rendition not resolved")
+	}
+	sess.key = "show"
+	if sess.takesAudio(1) {
+		t.Fatal("fmp4 output takes audio without an audio-only rendition")
+	}
+
+	sess.key, sess.container = "podcast", containerTS
+	ts := sess.outputPipeline("hls/podcast", 2, true, false).String()
+	if !strings.Contains(ts, " aac. ! queue ! mpegtsmux name=audiomuxer ! hlssink location=hls/podcast/audio/segment-2-%05d.ts playlist-location=hls/podcast/audio/playlist.m3u8 ") {
+		t.Fatalf("ts rendition = %s", ts)
+	}
+	sess.container, sess.aacCaps = containerFMP4, adtsCaps
+	cmaf := sess.outputPipeline("hls/podcast", 2, true, false).String()
+	if strings.Contains(cmaf, "opusdec") || !strings.Contains(cmaf, "name=audiosrc "+adtsCaps) || !strings.Contains(cmaf, "location=hls/podcast/audio/segment-2-%05d.m4s ") {
+		t.Fatalf("fmp4 rendition = %s", cmaf)
+	}
+}
+
+func TestOpusPassthrough(t *testing.T) {
+	t.Setenv("opus_passthrough_overrides", "podcast=on,bad=yes")
+	t.Setenv("hls_audio_rendition_overrides", "podcast=on")
+	web := hlsProfiles[client.ProfileWebDefault]
+	if on, err := resolveOpusPassthrough(web, containerFMP4, "show"); err != nil || on {
+		t.Fatalf("default passthrough = %v, %v", on, err)
+	}
+	if on, err := resolveOpusPassthrough(web, containerFMP4, "podcast"); err != nil || !on {
+		t.Fatalf("passthrough = %v, %v", on, err)
+	}
+	if _, err := resolveOpusPassthrough(web, containerTS, "podcast"); err == nil {
+		t.Fatal("opus passed through to ts")
+	}
+	aacOnly := hlsProfile{Name: "aac-only", AudioCodecs: []string{aacCodec}}
+	if _, err := resolveOpusPassthrough(aacOnly, containerFMP4, "podcast"); err == nil {
+		t.Fatal("opus passed through to a profile without it")
+	}
+	if _, err := resolveOpusPassthrough(web, containerFMP4, "bad"); err == nil {
+		t.Fatal("bad value accepted")
+	}
+
+	sess := newSession("podcast", nil, presets[client.LatencyBalanced])
+	sess.container, sess.opusPassthrough = containerFMP4, true
+	cmaf := sess.outputPipeline("hls/podcast", 2, true, false).String()
+	if strings.Contains(cmaf, "opusdec") || !strings.Contains(cmaf, "name=audiosrc "+opusCaps+" ! opusparse ! tee name=aac ") {
+		t.Fatalf("opus rendition = %s", cmaf)
+	}
+	if sess.audioCodec() != opusCodec {
+		t.Fatalf("audio codec = %s", sess.audioCodec())
+	}
+	// the AAC of RTMP publishers is not transcoded anyway
+	sess.aacCaps = adtsCaps
+	if sess.passesOpus() || sess.audioCodec() != aacCodec {
+		t.Fatal("aac publish passed as opus")
+	}
+}
@@ -0,0 +1,144 @@
+package streamserver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/hlscheck"
+)
+
+// what this server's output is made of, checked against the profiles: its
+// audio is AAC. The container is checked by resolveContainer, renditions
+// by resolveLadder.
+var outputAudioCodecs = []string{aacCodec}
+
+// hlsProfile bundles the packaging constraints of a family of players, e.g.
+// smart TVs that only play fixed length TS segments
+type hlsProfile struct {
+	Name string `json:"name"`
+	// Container is the only segment container the players load, any when
+	// empty
+	Container string `json:"container,omitempty"`
+	// AudioCodecs are the audio codecs the players decode, as CODECS
+	// values; any when empty
+	AudioCodecs []string `json:"audioCodecs,omitempty"`
+	// MaxRenditions bounds the variants of a master playlist
+	MaxRenditions int `json:"maxRenditions,omitempty"`
+	// SegmentDuration is the exact segment duration in seconds the players
+	// need, and MaxSegmentDuration a bound on it; 0 for any
+	SegmentDuration    int `json:"segmentDuration,omitempty"`
+	MaxSegmentDuration int `json:"maxSegmentDuration,omitempty"`
+	// LowLatency allows LL-HLS tags in playlists
+	LowLatency bool `json:"lowLatency"`
+}
+
+// hlsProfiles are the compatibility profiles hls_profile and
+// hls_profile_overrides select from
+var hlsProfiles = map[string]hlsProfile{
+	client.ProfileTVLegacy: {
+		Name:            client.ProfileTVLegacy,
+		Container:       containerTS,
+		AudioCodecs:     []string{"mp4a.40.2"},
+		MaxRenditions:   3,
+		SegmentDuration: 6,
+	},
+	client.ProfileWebDefault: {
+		Name:       client.ProfileWebDefault,
+		LowLatency: true,
+	},
+	client.ProfileLLWeb: {
+		Name:               client.ProfileLLWeb,
+		MaxSegmentDuration: 2,
+		LowLatency:         true,
+	},
+}
+
+// profileConflict is a latency preset the publisher asked for that the
+// stream's compatibility profile does not allow
+type profileConflict struct {
+	profile string
+	preset  string
+	reason  string
+}
+
+func (e *profileConflict) Error() string {
+	return fmt.Sprintf("latency preset %s conflicts with hls profile %s: %s", e.preset, e.profile, e.reason)
+}
+
+// resolveProfile picks the profile of the stream key from hls_profile /
+// hls_profile_overrides, falling back to web-default
+func resolveProfile(key string) (hlsProfile, error) {
+	name := envForKey("hls_profile", key)
+	if name == "" {
+		name = client.ProfileWebDefault
+	}
+	profile, ok := hlsProfiles[name]
+	if !ok {
+		return hlsProfile{}, fmt.Errorf("unknown hls profile %q", name)
+	}
+	return profile, profile.checkOutput()
+}
+
+// checkOutput reports a profile this server cannot produce output for
+func (p hlsProfile) checkOutput() error {
+	for _, codec := range outputAudioCodecs {
+		if len(p.AudioCodecs) > 0 && !containsFold(p.AudioCodecs, codec) {
+			return fmt.Errorf("hls profile %s: audio codec %s not allowed", p.Name, codec)
+		}
+	}
+	return nil
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// fit returns preset adjusted to the segment durations of the profile,
+// without LL-HLS for a profile whose players do not load it. A preset the
+// publisher asked for (requested) is never adjusted: one that does not fit
+// is a *profileConflict.
+func (p hlsProfile) fit(preset client.Preset, requested bool) (client.Preset, error) {
+	duration := preset.SegmentDuration
+	var reason string
+	switch {
+	case p.SegmentDuration > 0 && duration != p.SegmentDuration:
+		reason = fmt.Sprintf("segments must last exactly %ds, the preset has %ds", p.SegmentDuration, duration)
+		duration = p.SegmentDuration
+	case p.MaxSegmentDuration > 0 && duration > p.MaxSegmentDuration:
+		reason = fmt.Sprintf("segments must last at most %ds, the preset has %ds", p.MaxSegmentDuration, duration)
+		duration = p.MaxSegmentDuration
+	case preset.HLSMode == hlsModeLL && !p.LowLatency:
+		reason = "players cannot load LL-HLS"
+	default:
+		return preset, nil
+	}
+	if requested {
+		return client.Preset{}, &profileConflict{profile: p.Name, preset: preset.Name, reason: reason}
+	}
+	if !p.LowLatency {
+		preset.HLSMode = ""
+	}
+	preset.SegmentDuration = duration
+	// segments are cut on keyframes, which must line up with the duration
+	if ms := duration * 1000; preset.KeyframeInterval <= 0 || preset.KeyframeInterval > ms || ms%preset.KeyframeInterval != 0 {
+		preset.KeyframeInterval = ms
+	}
+	return preset, validatePreset(preset)
+}
+
+// rules are the playlist validator checks of the profile
+func (p hlsProfile) rules() hlscheck.Rules {
+	return hlscheck.Rules{
+		TargetDuration:    p.SegmentDuration,
+		MaxTargetDuration: p.MaxSegmentDuration,
+		NoLowLatency:      !p.LowLatency,
+		MaxVariants:       p.MaxRenditions,
+		AudioCodecs:       p.AudioCodecs,
+	}
+}
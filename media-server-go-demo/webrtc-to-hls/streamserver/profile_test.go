@@ -0,0 +1,82 @@
+package streamserver
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/hlscheck"
+)
+
+func TestProfilesValidate(t *testing.T) {
+	for name, profile := range hlsProfiles {
+		if profile.Name != name {
+			t.Errorf("profile %s is named %s", name, profile.Name)
+		}
+		if err := profile.checkOutput(); err != nil {
+			t.Error(err)
+		}
+		// every preset fits every profile unless the publisher insists
+		for _, preset := range presets {
+			if _, err := profile.fit(preset, false); err != nil {
+				t.Errorf("%s with %s: %v", name, preset.Name, err)
+			}
+		}
+	}
+}
+
+func TestResolveProfile(t *testing.T) {
+	t.Setenv("hls_profile_overrides", "tv=tv-legacy,bad=cinema")
+	if profile, err := resolveProfile("web"); err != nil || profile.Name != client.ProfileWebDefault {
+		t.Fatalf("default profile = %v, %v", profile.Name, err)
+	}
+	if profile, err := resolveProfile("tv"); err != nil || profile.Name != client.ProfileTVLegacy {
+		t.Fatalf("tv profile = %v, %v", profile.Name, err)
+	}
+	if _, err := resolveProfile("bad"); err == nil {
+		t.Fatal("unknown profile accepted")
+	}
+}
+
+func TestProfileFit(t *testing.T) {
+	tv := hlsProfiles[client.ProfileTVLegacy]
+	preset, err := tv.fit(presets[client.LatencyQuality], false)
+	if err != nil || preset.SegmentDuration != 6 || preset.KeyframeInterval != 6000 {
+		t.Fatalf("default preset under tv-legacy = %+v, %v", preset, err)
+	}
+	if preset, err := tv.fit(presets[client.LatencyLow], false); err != nil || preset.HLSMode != "" {
+		t.Fatalf("low latency under tv-legacy = %+v, %v", preset, err)
+	}
+	_, err = tv.fit(presets[client.LatencyLow], true)
+	conflict, ok := err.(*profileConflict)
+	if !ok || !strings.Contains(conflict.Error(), "exactly 6s") || !strings.Contains(conflict.Error(), client.LatencyLow) {
+		t.Fatalf("requested low latency under tv-legacy = %v", err)
+	}
+
+	ll := hlsProfiles[client.ProfileLLWeb]
+	if preset, err := ll.fit(presets[client.LatencyQuality], false); err != nil || preset.SegmentDuration != 2 || preset.KeyframeInterval != 2000 {
+		t.Fatalf("default preset under ll-web = %+v, %v", preset, err)
+	}
+	if _, err := ll.fit(presets[client.LatencyQuality], true); err == nil {
+		t.Fatal("requested quality preset accepted under ll-web")
+	}
+	if preset, err := ll.fit(presets[client.LatencyLow], true); err != nil || preset != presets[client.LatencyLow] {
+		t.Fatalf("fitting preset changed: %+v, %v", preset, err)
+	}
+}
+
+func TestProfileRules(t *testing.T) {
+	ll, err := hlscheck.ParseMedia([]byte("#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"a.ts\"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hlsProfiles[client.ProfileTVLegacy].rules().CheckMedia(ll); err == nil {
+		t.Fatal("tv-legacy allowed LL-HLS tags")
+	}
+	if err := hlsProfiles[client.ProfileWebDefault].rules().CheckMedia(ll); err != nil {
+		t.Fatal(err)
+	}
+	if sess := newSession("rules", nil, presets[client.LatencyQuality]); sess.profile.Name != client.ProfileWebDefault {
+		t.Fatalf("session profile = %q", sess.profile.Name)
+	}
+}
@@ -0,0 +1,204 @@
+package streamserver
+
+import (
+	"bytes"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/hlscrypt"
+)
+
+// captureRate is the RTP clock rate of video
+const captureRate = 90000
+
+// captureWindow is how often the capture clock re-anchors on the least
+// delayed frame of the window before, following the drift between the
+// clocks of the publisher and of the server
+const captureWindow = 30 * time.Second
+
+// captureJump is the step between the RTP timestamps of frames, 10s, past
+// which the clock starts over
+const captureJump = 10 * captureRate
+
+// captureClock dates the frames of a publish by when they were captured,
+// on the server clock. The RTP timestamps of the video space the frames as
+// the publisher captured them; the frame that arrived the least delayed
+// anchors them to the server clock, less the transit from the publisher,
+// half the round trip, see session.captureTime. Publishes without RTP,
+// e.g. over RTMP, are dated on arrival.
+type captureClock struct {
+	sync.Mutex
+	started bool
+	last    uint32
+	// rtp is the timestamp of the last frame since the first, unwrapped
+	rtp int64
+	// anchor is when the first frame would have arrived, had it been as
+	// little delayed as the least delayed frame
+	anchor time.Time
+	// window is when the current window started, and best the anchor of
+	// its least delayed frame
+	window time.Time
+	best   time.Time
+	// delay is how much later than the least delayed frame the last one
+	// arrived
+	delay time.Duration
+}
+
+// frame records the arrival of a video frame of RTP timestamp timestamp
+func (c *captureClock) frame(timestamp uint32, arrival time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	step := int64(int32(timestamp - c.last))
+	if !c.started || step > captureJump || step < -captureJump {
+		// the first frame, or of another RTP clock, e.g. another layer
+		c.started, c.last, c.rtp = true, timestamp, 0
+		c.anchor, c.window, c.best = arrival.Add(-c.delay), arrival, arrival.Add(-c.delay)
+		return
+	}
+	c.rtp += step
+	c.last = timestamp
+	origin := arrival.Add(-time.Duration(c.rtp) * time.Second / captureRate)
+	if origin.Before(c.anchor) {
+		c.anchor = origin
+	}
+	if origin.Before(c.best) {
+		c.best = origin
+	}
+	if arrival.Sub(c.window) >= captureWindow {
+		c.anchor, c.window, c.best = c.best, arrival, origin
+	}
+	c.delay = origin.Sub(c.anchor)
+}
+
+// at is when what arrived at arrival was captured, as delayed as the last
+// frame
+func (c *captureClock) at(arrival time.Time) time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return arrival.Add(-c.delay)
+}
+
+// captureTime is when what the session output at arrival was captured by
+// its publisher, on the server clock
+func (s *session) captureTime(arrival time.Time) time.Time {
+	captured := s.clock.at(arrival)
+	if s.skew != nil {
+		captured = captured.Add(-s.skew.roundTrip() / 2)
+	}
+	return captured
+}
+
+// dateFrom dates what the session outputs some time after start, its
+// PROGRAM-DATE-TIME
+func (s *session) dateFrom(start time.Time) func(time.Duration) time.Time {
+	return func(d time.Duration) time.Time {
+		return s.captureTime(start.Add(d))
+	}
+}
+
+// programDateTime decides whether the playlists hlssink writes for key are
+// served with the PROGRAM-DATE-TIME of each segment, from
+// program_date_time / program_date_time_overrides ("on"). The playlists
+// written in Go, LL-HLS and splitmux ones, always date their segments.
+func programDateTime(key string) bool {
+	return strings.TrimSpace(envForKey("program_date_time", key)) == "on"
+}
+
+const programDateTimeTag = "#EXT-X-PROGRAM-DATE-TIME:"
+
+// dateMarks bounds the keyframes an output dates its segments by, over an
+// hour at a keyframe a second
+const dateMarks = 4096
+
+// dateMark is a keyframe an output wrote: when it arrived, and when it was
+// captured
+type dateMark struct {
+	generation int64
+	arrival    time.Time
+	capture    time.Time
+}
+
+// outputDates are the latest keyframes of an output, which its segments
+// start with
+type outputDates struct {
+	sync.Mutex
+	marks []dateMark
+}
+
+// mark records a keyframe of generation
+func (d *outputDates) mark(generation int64, arrival, capture time.Time) {
+	d.Lock()
+	defer d.Unlock()
+	if len(d.marks) >= dateMarks {
+		d.marks = append(d.marks[:0], d.marks[len(d.marks)-dateMarks+1:]...)
+	}
+	d.marks = append(d.marks, dateMark{generation: generation, arrival: arrival, capture: capture})
+}
+
+// date is when the segment of generation whose writing started at from was
+// captured: the last keyframe to arrive by then, or the first keyframe of
+// the generation for its first segment, from being zero
+func (d *outputDates) date(generation int64, from time.Time) (time.Time, bool) {
+	d.Lock()
+	defer d.Unlock()
+	var date time.Time
+	for _, m := range d.marks {
+		if m.generation != generation {
+			continue
+		}
+		if from.IsZero() {
+			return m.capture, true
+		}
+		if m.arrival.After(from) {
+			break
+		}
+		date = m.capture
+	}
+	return date, !date.IsZero()
+}
+
+// dateHLS stamps the PROGRAM-DATE-TIME of each segment in the playlists
+// hlssink writes for the stream keys of programDateTime, whichever handler
+// serves them, for captions, analytics and the feeds of other cameras to be
+// synchronized with the output
+func dateHLS(c *gin.Context) {
+	key, ok := outputKey(c.Request.URL.Path)
+	if !ok || !programDateTime(key) {
+		c.Next()
+		return
+	}
+	out := outputs.lookup(key)
+	if out == nil {
+		c.Next()
+		return
+	}
+	captured := &capturedResponse{ResponseWriter: c.Writer}
+	c.Writer = captured
+	c.Next()
+	c.Writer = captured.ResponseWriter
+
+	body := captured.body.Bytes()
+	if c.Writer.Status() == http.StatusOK && !bytes.Contains(body, []byte(programDateTimeTag)) {
+		body = hlscrypt.Decorate(body, func(uri string) string {
+			generation, from, _, ok := segmentWindow(out.dir, path.Base(uri))
+			if !ok {
+				return ""
+			}
+			date, ok := out.dates.date(generation, from)
+			if !ok {
+				return ""
+			}
+			return programDateTimeTag + date.UTC().Format(dateRangeFormat)
+		})
+		c.Writer.Header().Del("Content-Length")
+	}
+	if len(body) == 0 {
+		c.Writer.WriteHeaderNow()
+		return
+	}
+	c.Writer.Write(body)
+}
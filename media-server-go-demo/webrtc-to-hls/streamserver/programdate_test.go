@@ -0,0 +1,80 @@
+package streamserver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCaptureClock(t *testing.T) {
+	var c captureClock
+	now := time.Unix(1700000000, 0)
+	if got := c.at(now); !got.Equal(now) {
+		t.Fatalf("dated %v before a frame", got)
+	}
+	// the second frame the least delayed
+	first := uint32(4294900000)
+	c.frame(first, now.Add(20*time.Millisecond))
+	c.frame(first+9000, now.Add(100*time.Millisecond))
+	if got := c.at(now.Add(100 * time.Millisecond)); !got.Equal(now.Add(100 * time.Millisecond)) {
+		t.Fatalf("least delayed frame dated %v", got)
+	}
+	// arriving 40ms late, across the wrap of the timestamps
+	c.frame(first+9000+270000, now.Add(3140*time.Millisecond))
+	if got := c.at(now.Add(3140 * time.Millisecond)); !got.Equal(now.Add(3100 * time.Millisecond)) {
+		t.Fatalf("late frame dated %v", got)
+	}
+	// a jump starts the clock over, as delayed as before
+	c.frame(2000000000, now.Add(4*time.Second))
+	if got := c.at(now.Add(4 * time.Second)); !got.Equal(now.Add(3960 * time.Millisecond)) {
+		t.Fatalf("frame after a jump dated %v", got)
+	}
+}
+
+func TestCaptureTime(t *testing.T) {
+	s := &session{skew: newSkewEstimator()}
+	now := time.Unix(1700000000, 0)
+	s.skew.sample(toNTP(now), now, 100*time.Millisecond)
+	if got := s.captureTime(now); !got.Equal(now.Add(-50 * time.Millisecond)) {
+		t.Fatalf("captureTime = %v", got)
+	}
+	if got := s.dateFrom(now)(time.Second); !got.Equal(now.Add(950 * time.Millisecond)) {
+		t.Fatalf("dateFrom = %v", got)
+	}
+}
+
+func TestOutputDates(t *testing.T) {
+	var d outputDates
+	now := time.Unix(1700000000, 0)
+	if _, ok := d.date(1, time.Time{}); ok {
+		t.Fatal("dated without keyframes")
+	}
+	d.mark(1, now, now.Add(-time.Second))
+	d.mark(2, now.Add(time.Second), now)
+	d.mark(2, now.Add(3*time.Second), now.Add(2*time.Second))
+	if date, ok := d.date(2, time.Time{}); !ok || !date.Equal(now) {
+		t.Fatalf("first segment dated %v, %v", date, ok)
+	}
+	if date, ok := d.date(2, now.Add(3500*time.Millisecond)); !ok || !date.Equal(now.Add(2*time.Second)) {
+		t.Fatalf("segment dated %v, %v", date, ok)
+	}
+	if _, ok := d.date(2, now); ok {
+		t.Fatal("dated before the first keyframe")
+	}
+	for i := 0; i < dateMarks+10; i++ {
+		d.mark(3, now, now)
+	}
+	if len(d.marks) != dateMarks {
+		t.Fatalf("%d keyframes kept", len(d.marks))
+	}
+}
+
+func TestProgramDateTime(t *testing.T) {
+	if programDateTime("main") {
+		t.Fatal("dated by default")
+	}
+	t.Setenv("program_date_time", "on")
+	t.Setenv("program_date_time_overrides", "legacy=off")
+	if !programDateTime("main") || programDateTime("legacy") {
+		t.Fatal("program_date_time not read per key")
+	}
+}
@@ -0,0 +1,157 @@
+package streamserver
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultProxies are trusted without trusted_proxies: loopback and the
+// private networks, where a load balancer in front of the server usually is
+var defaultProxies = []string{"127.0.0.0/8", "::1/128", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"}
+
+// forwardedHeaders are the headers a proxy describes the request it
+// forwards with, dropped when not sent by a trusted proxy
+var forwardedHeaders = []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "X-Real-Ip"}
+
+// trustedProxies are the networks whose forwarded headers are honored, see
+// setupProxies
+var trustedProxies []*net.IPNet
+
+// setupProxies reads trusted_proxies, the comma separated addresses or
+// ranges of the load balancers and reverse proxies in front of the server,
+// e.g. 10.0.0.0/8,203.0.113.7: loopback and the private networks when
+// unset, none with "none". Others cannot pass for a client with
+// X-Forwarded-For.
+func setupProxies() error {
+	entries := envList("trusted_proxies")
+	switch {
+	case len(entries) == 0:
+		entries = defaultProxies
+	case len(entries) == 1 && entries[0] == "none":
+		entries = nil
+	}
+	networks, err := parseNetworks("trusted_proxies", entries)
+	if err != nil {
+		return err
+	}
+	trustedProxies = networks
+	return nil
+}
+
+// parseNetworks parses the CIDR ranges of setting, single addresses taken
+// as their own range
+func parseNetworks(setting string, entries []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("%s: %q is not an address", setting, entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", setting, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func trustedProxy(ip net.IP) bool {
+	for _, network := range trustedProxies {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedClient is the client of a request through hops, the addresses
+// of X-Forwarded-For: the last one not a trusted proxy, since those before
+// it are whatever the client sent. Empty when a hop is not an address.
+func forwardedClient(hops []string) string {
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			return ""
+		}
+		if i == 0 || !trustedProxy(ip) {
+			return ip.String()
+		}
+	}
+	return ""
+}
+
+// firstValue is the first of the comma separated values of a header, the
+// one set by the proxy closest to the client
+func firstValue(header string) string {
+	return strings.TrimSpace(strings.Split(header, ",")[0])
+}
+
+// honorForwarded makes the request of a trusted proxy look like the one it
+// forwards: X-Forwarded-For is left with the client alone, which
+// gin.Context.ClientIP reports, X-Forwarded-Host is the host and
+// X-Forwarded-Proto the scheme, see requestScheme. The forwarded headers of
+// anyone else are dropped, and so is the X-Admin-Identity they send
+// without admin_token, see adminTrusted.
+func honorForwarded(c *gin.Context) {
+	r := c.Request
+	peer, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if !trustedProxy(net.ParseIP(peer)) {
+		for _, header := range forwardedHeaders {
+			r.Header.Del(header)
+		}
+		if !adminTrusted(peer, r.Header.Get("Authorization")) {
+			r.Header.Del("X-Admin-Identity")
+		}
+		c.Next()
+		return
+	}
+	r.Header.Del("X-Real-Ip")
+	if hops := r.Header.Values("X-Forwarded-For"); len(hops) > 0 {
+		if client := forwardedClient(strings.Split(strings.Join(hops, ","), ",")); client != "" {
+			r.Header.Set("X-Forwarded-For", client)
+		} else {
+			r.Header.Del("X-Forwarded-For")
+		}
+	}
+	if host := firstValue(r.Header.Get("X-Forwarded-Host")); host != "" {
+		r.Host = host
+	}
+	switch proto := strings.ToLower(firstValue(r.Header.Get("X-Forwarded-Proto"))); proto {
+	case "http", "https":
+		r.Header.Set("X-Forwarded-Proto", proto)
+	default:
+		r.Header.Del("X-Forwarded-Proto")
+	}
+	c.Next()
+}
+
+// requestScheme is the scheme the client sent r with, as forwarded by a
+// trusted proxy or else as received
+func requestScheme(r *http.Request) string {
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		return proto
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// requestBaseURL is the URL the client reached the server at for r, e.g.
+// https://live.example
+func requestBaseURL(r *http.Request) string {
+	return requestScheme(r) + "://" + r.Host
+}
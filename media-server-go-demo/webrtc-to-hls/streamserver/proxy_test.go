@@ -0,0 +1,60 @@
+package streamserver
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestHonorForwarded(t *testing.T) {
+	defer func(networks []*net.IPNet) { trustedProxies = networks }(trustedProxies)
+	t.Setenv("trusted_proxies", "10.0.0.0/8,203.0.113.7")
+	if err := setupProxies(); err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(honorForwarded)
+	r.GET("/", func(c *gin.Context) {
+		c.String(http.StatusOK, c.ClientIP()+" "+requestBaseURL(c.Request))
+	})
+	get := func(peer string, headers map[string]string) string {
+		req := httptest.NewRequest(http.MethodGet, "http://node-1:9000/", nil)
+		req.RemoteAddr = peer + ":40000"
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Body.String()
+	}
+
+	forwarded := map[string]string{
+		"X-Forwarded-For":   "1.1.1.1, 198.51.100.4, 10.1.2.3",
+		"X-Forwarded-Proto": "https",
+		"X-Forwarded-Host":  "live.example",
+	}
+	// the client spoofed 1.1.1.1, the proxies appended the others
+	if got := get("10.0.0.5", forwarded); got != "198.51.100.4 https://live.example" {
+		t.Fatalf("through a trusted proxy: %s", got)
+	}
+	if got := get("203.0.113.7", map[string]string{"X-Real-Ip": "1.1.1.1"}); got != "203.0.113.7 http://node-1:9000" {
+		t.Fatalf("a single trusted address: %s", got)
+	}
+	if got := get("198.51.100.9", forwarded); got != "198.51.100.9 http://node-1:9000" {
+		t.Fatalf("from an untrusted peer: %s", got)
+	}
+
+	t.Setenv("trusted_proxies", "none")
+	if err := setupProxies(); err != nil || len(trustedProxies) != 0 {
+		t.Fatalf("none = %v, %v", trustedProxies, err)
+	}
+	t.Setenv("trusted_proxies", "10.0.0.0/33")
+	if err := setupProxies(); err == nil {
+		t.Fatal("accepted a bad range")
+	}
+}
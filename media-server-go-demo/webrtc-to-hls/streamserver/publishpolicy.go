@@ -0,0 +1,460 @@
+package streamserver
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/hlscheck"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/metrics"
+	"github.com/notedit/sdp"
+)
+
+var policyViolations = metrics.NewCounter("publish_policy_violations_total",
+	"Publishes over the resolution, bitrate or H.264 profile of their publish policy, by limit", "limit")
+
+// the limits of a publish policy
+const (
+	policyResolution = "resolution"
+	policyBitrate    = "bitrate"
+	policyProfile    = "profile"
+)
+
+// h264Profiles are the profiles publish_h264_profiles may name, by their
+// profile_idc
+var h264Profiles = map[string]int{
+	"baseline": 66,
+	"main":     77,
+	"extended": 88,
+	"high":     100,
+	"high10":   110,
+	"high422":  122,
+	"high444":  244,
+}
+
+// h264ProfileName names profile as publish_h264_profiles does
+func h264ProfileName(profile int) string {
+	for name, idc := range h264Profiles {
+		if idc == profile {
+			return name
+		}
+	}
+	return strconv.Itoa(profile)
+}
+
+// policyCodecs are the codecs publish_codecs may name, by the kind of their
+// m-line
+var policyCodecs = map[string]string{
+	codecH264: "video",
+	codecVP8:  "video",
+	codecVP9:  "video",
+	codecAV1:  "video",
+	codecH265: "video",
+	"opus":    "audio",
+}
+
+var errCodecNotAllowed = errors.New("none of the offered codecs is allowed by the publish policy")
+
+// publishPolicy constrains what the publisher of a stream key sends, read
+// per key: publish_max_resolution, e.g. 1280x720, publish_max_bitrate_kbps
+// the video bitrate, publish_codecs the codecs answered, e.g. "h264 opus",
+// publish_h264_profiles the H.264 profiles allowed, e.g. "baseline main",
+// and publish_policy_action what becomes of a publisher over its limits,
+// warn (the default) or end. The limits are asked for in the answer and
+// checked on the incoming video, since encoders do not all heed the answer.
+type publishPolicy struct {
+	// width and height are the longest and the shortest side allowed, so
+	// portrait video fits as well as landscape; 0 without a limit
+	width  int
+	height int
+	// bitrate is in bits per second, 0 without a limit
+	bitrate int
+	// codecs are the codecs allowed, nil for any; a kind none of them is
+	// of is not restricted
+	codecs map[string]bool
+	// profiles are the profile_idc of the H.264 profiles allowed, nil for
+	// any
+	profiles map[int]bool
+	end      bool
+}
+
+// resolvePublishPolicy reads the publish policy of key
+func resolvePublishPolicy(key string) (publishPolicy, error) {
+	var p publishPolicy
+	if value := strings.TrimSpace(envForKey("publish_max_resolution", key)); value != "" {
+		size := strings.SplitN(strings.ToLower(value), "x", 2)
+		if len(size) != 2 {
+			return p, fmt.Errorf("publish_max_resolution must be <width>x<height>, not %q", value)
+		}
+		width, err := strconv.Atoi(size[0])
+		height, heightErr := strconv.Atoi(size[1])
+		if err != nil || heightErr != nil || width <= 0 || height <= 0 {
+			return p, fmt.Errorf("publish_max_resolution must be <width>x<height>, not %q", value)
+		}
+		p.width, p.height = width, height
+		if p.height > p.width {
+			p.width, p.height = p.height, p.width
+		}
+	}
+	if value := strings.TrimSpace(envForKey("publish_max_bitrate_kbps", key)); value != "" {
+		kbps, err := strconv.Atoi(value)
+		if err != nil || kbps < 0 {
+			return p, fmt.Errorf("publish_max_bitrate_kbps must be a number of kbps, not %q", value)
+		}
+		p.bitrate = kbps * 1000
+	}
+	for _, codec := range strings.Fields(strings.ToLower(envForKey("publish_codecs", key))) {
+		if policyCodecs[codec] == "" {
+			return p, fmt.Errorf("publish_codecs: unknown codec %q", codec)
+		}
+		if p.codecs == nil {
+			p.codecs = map[string]bool{}
+		}
+		p.codecs[codec] = true
+	}
+	for _, name := range strings.Fields(strings.ToLower(envForKey("publish_h264_profiles", key))) {
+		profile, ok := h264Profiles[name]
+		if !ok {
+			return p, fmt.Errorf("publish_h264_profiles: unknown profile %q", name)
+		}
+		if p.profiles == nil {
+			p.profiles = map[int]bool{}
+		}
+		p.profiles[profile] = true
+	}
+	switch action := strings.TrimSpace(envForKey("publish_policy_action", key)); action {
+	case "", "warn":
+	case "end":
+		p.end = true
+	default:
+		return p, fmt.Errorf("publish_policy_action must be warn or end, not %q", action)
+	}
+	return p, nil
+}
+
+// restricts reports whether the policy restricts the codecs of kind
+func (p publishPolicy) restricts(kind string) bool {
+	for codec := range p.codecs {
+		if policyCodecs[codec] == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports whether the policy allows codec for kind
+func (p publishPolicy) allows(kind, codec string) bool {
+	return !p.restricts(kind) || p.codecs[strings.ToLower(codec)]
+}
+
+// checkOffer refuses an offer with no codec of a restricted kind the policy
+// allows and the server answers, before a session is claimed for it
+func (p publishPolicy) checkOffer(offer *sdp.SDPInfo) error {
+	for _, kind := range []string{"audio", "video"} {
+		media := offer.GetMedia(kind)
+		if media == nil || !p.restricts(kind) {
+			continue
+		}
+		answered := map[string]bool{}
+		for _, codec := range Capabilities[kind].Codecs {
+			answered[strings.ToLower(codec)] = true
+		}
+		found := false
+		for _, codec := range media.GetCodecs() {
+			name := strings.ToLower(codec.GetCodec())
+			found = found || (p.codecs[name] && answered[name])
+		}
+		if !found {
+			return errCodecNotAllowed
+		}
+	}
+	return nil
+}
+
+// ingestPolicy resolves the publish policy of a publish of key that is not
+// WebRTC, refused unless H.264, all such a publish sends, is allowed
+func ingestPolicy(key string) (publishPolicy, error) {
+	p, err := resolvePublishPolicy(key)
+	if err == nil && !p.allows("video", codecH264) {
+		err = errCodecNotAllowed
+	}
+	return p, err
+}
+
+// allowCodecs removes the codecs the policy does not allow from answer,
+// before a video codec is picked; the codecs of retransmission and error
+// correction stay. It fails when no media codec of an m-line is left.
+func (p publishPolicy) allowCodecs(answer *sdp.SDPInfo) error {
+	for _, kind := range []string{"audio", "video"} {
+		media := answer.GetMedia(kind)
+		if media == nil || !p.restricts(kind) {
+			continue
+		}
+		kept, left := map[int]*sdp.CodecInfo{}, false
+		for pt, codec := range media.GetCodecs() {
+			name := strings.ToLower(codec.GetCodec())
+			if policyCodecs[name] == "" || p.codecs[name] {
+				kept[pt] = codec
+				left = left || policyCodecs[name] != ""
+			}
+		}
+		if !left {
+			return errCodecNotAllowed
+		}
+		media.SetCodecs(kept)
+	}
+	return nil
+}
+
+// constrain asks the publisher of answer to keep its video within the
+// policy: the largest frame as the max-fs of the codec, in macroblocks of
+// 16x16 (RFC 6184 8.1, RFC 7741 6.1), and the bitrate as b=AS, lowering a
+// cap already set by capBitrate
+func (p publishPolicy) constrain(answer *sdp.SDPInfo) {
+	video := answer.GetMedia("video")
+	if video == nil {
+		return
+	}
+	if p.width > 0 {
+		frameSize := ((p.width + 15) / 16) * ((p.height + 15) / 16)
+		for _, codec := range video.GetCodecs() {
+			switch strings.ToLower(codec.GetCodec()) {
+			case codecH264, codecVP8, codecVP9:
+				codec.AddParam("max-fs", strconv.Itoa(frameSize))
+			}
+		}
+	}
+	if kbps := p.bitrate / 1000; kbps > 0 && (video.GetBitrate() == 0 || video.GetBitrate() > kbps) {
+		video.SetBitrate(kbps)
+	}
+}
+
+// withTIAS adds to each b=AS line of the serialized answer text the same
+// bitrate as b=TIAS (RFC 3890), which Firefox reads instead
+func withTIAS(text string) string {
+	lines := strings.Split(text, "\r\n")
+	out := make([]string, 0, len(lines))
+	for _, line := range lines {
+		out = append(out, line)
+		if strings.HasPrefix(line, "b=AS:") {
+			if kbps, err := strconv.Atoi(strings.TrimPrefix(line, "b=AS:")); err == nil {
+				out = append(out, fmt.Sprintf("b=TIAS:%d", kbps*1000))
+			}
+		}
+	}
+	return strings.Join(out, "\r\n")
+}
+
+// keyframeSize reads the resolution of a keyframe of codec: from the SPS
+// of H.264, the frame header of VP8 (RFC 6386 9.1), the sequence header of
+// AV1 or the SPS of H.265. VP9 is not read.
+func keyframeSize(codec string, frame []byte) (width, height int, ok bool) {
+	switch codec {
+	case codecVP8:
+		if len(frame) < 10 || frame[3] != 0x9d || frame[4] != 0x01 || frame[5] != 0x2a {
+			return 0, 0, false
+		}
+		width = int(binary.LittleEndian.Uint16(frame[6:8]) & 0x3fff)
+		height = int(binary.LittleEndian.Uint16(frame[8:10]) & 0x3fff)
+		return width, height, true
+	case codecVP9:
+		return 0, 0, false
+	case codecAV1:
+		payload, err := hlscheck.FindSequenceHeader(frame)
+		if err != nil {
+			return 0, 0, false
+		}
+		header, err := hlscheck.ParseSequenceHeader(payload)
+		if err != nil {
+			return 0, 0, false
+		}
+		return header.Width, header.Height, true
+	case codecH265:
+		nal, err := hlscheck.FindHEVCSPS(frame)
+		if err != nil {
+			return 0, 0, false
+		}
+		sps, err := hlscheck.ParseHEVCSPS(nal)
+		if err != nil {
+			return 0, 0, false
+		}
+		return sps.Width, sps.Height, true
+	}
+	nal, err := hlscheck.FindSPS(frame)
+	if err != nil {
+		return 0, 0, false
+	}
+	sps, err := hlscheck.ParseSPS(nal)
+	if err != nil {
+		return 0, 0, false
+	}
+	return sps.Width, sps.Height, true
+}
+
+// keyframeProfile reads the profile_idc of an H.264 keyframe from its SPS
+func keyframeProfile(frame []byte) (int, bool) {
+	nal, err := hlscheck.FindSPS(frame)
+	if err != nil {
+		return 0, false
+	}
+	sps, err := hlscheck.ParseSPS(nal)
+	if err != nil {
+		return 0, false
+	}
+	return sps.Profile, true
+}
+
+// frameSize is the resolution of the latest keyframe of a publish read,
+// and the H.264 profile when the publish policy restricts it
+type frameSize struct {
+	sync.Mutex
+	width   int
+	height  int
+	profile int
+	// turned is the warning of an orientation change not yet sent
+	turned *warning
+}
+
+// observeSize reads the resolution of keyframes, for the publish policy
+// and to notice the video turning between landscape and portrait
+func (s *session) observeSize(frame []byte, keyframe bool) {
+	if !keyframe {
+		return
+	}
+	s.Lock()
+	codec := s.videoCodec
+	s.Unlock()
+	width, height, ok := keyframeSize(codec, frame)
+	if !ok {
+		return
+	}
+	profile := 0
+	if s.policy.profiles != nil && codec == codecH264 {
+		profile, _ = keyframeProfile(frame)
+	}
+	s.size.Lock()
+	defer s.size.Unlock()
+	if turned(s.size.width, s.size.height, width, height) {
+		s.size.turned = &warning{
+			code: client.WarningOrientationChanged,
+			text: fmt.Sprintf("video turned from %dx%d to %dx%d, keep the orientation of a stream", s.size.width, s.size.height, width, height),
+			details: map[string]interface{}{
+				"width": width, "height": height, "previousWidth": s.size.width, "previousHeight": s.size.height,
+			},
+		}
+	}
+	s.size.width, s.size.height = width, height
+	if profile != 0 {
+		s.size.profile = profile
+	}
+}
+
+// turned reports whether a video of width x height is in the other
+// orientation than one of previousWidth x previousHeight; square video is
+// in neither
+func turned(previousWidth, previousHeight, width, height int) bool {
+	return previousWidth > previousHeight && height > width ||
+		previousHeight > previousWidth && width > height
+}
+
+// takeTurn returns the warning of an orientation change since the last
+// call, if any
+func (f *frameSize) takeTurn() (warning, bool) {
+	f.Lock()
+	defer f.Unlock()
+	if f.turned == nil {
+		return warning{}, false
+	}
+	w := *f.turned
+	f.turned = nil
+	return w, true
+}
+
+// policyBreaches returns the limits of the publish policy the video is
+// over, by limit: the resolution and H.264 profile of its latest
+// keyframe, and its bitrate averaged over the frame alert window once full
+func (s *session) policyBreaches() map[string]warning {
+	p := s.policy
+	breaches := map[string]warning{}
+	if p.width > 0 {
+		s.size.Lock()
+		width, height := s.size.width, s.size.height
+		s.size.Unlock()
+		long, short := width, height
+		if short > long {
+			long, short = short, long
+		}
+		if long > p.width || short > p.height {
+			breaches[policyResolution] = warning{
+				code: client.WarningPolicyResolution,
+				text: fmt.Sprintf("video of %dx%d over the %dx%d allowed", width, height, p.width, p.height),
+				details: map[string]interface{}{
+					"width": width, "height": height, "maxWidth": p.width, "maxHeight": p.height,
+				},
+			}
+		}
+	}
+	if p.profiles != nil {
+		s.size.Lock()
+		profile := s.size.profile
+		s.size.Unlock()
+		if profile != 0 && !p.profiles[profile] {
+			var allowed []string
+			for name, idc := range h264Profiles {
+				if p.profiles[idc] {
+					allowed = append(allowed, name)
+				}
+			}
+			sort.Strings(allowed)
+			breaches[policyProfile] = warning{
+				code:    client.WarningPolicyProfile,
+				text:    fmt.Sprintf("H.264 %s profile not allowed, only %s", h264ProfileName(profile), strings.Join(allowed, ", ")),
+				details: map[string]interface{}{"profile": h264ProfileName(profile), "allowed": allowed},
+			}
+		}
+	}
+	if p.bitrate > 0 {
+		if bitrate, full := s.frames.meanBitrate(); full && bitrate > p.bitrate {
+			breaches[policyBitrate] = warning{
+				code:    client.WarningPolicyBitrate,
+				text:    fmt.Sprintf("video of %d kbps over the %d kbps allowed", bitrate/1000, p.bitrate/1000),
+				details: map[string]interface{}{"bitrate": bitrate, "maxBitrate": p.bitrate},
+			}
+		}
+	}
+	return breaches
+}
+
+// enforcePolicy warns the publisher once about each limit of its policy
+// it went over, again if it goes over after coming back within, warned
+// holding the limits warned about; under the end action the publish is
+// ended instead. It reports whether the publish was ended.
+func (s *session) enforcePolicy(warned map[string]bool) bool {
+	breaches := s.policyBreaches()
+	for limit := range warned {
+		if _, ok := breaches[limit]; !ok {
+			delete(warned, limit)
+		}
+	}
+	for limit, breach := range breaches {
+		if warned[limit] {
+			continue
+		}
+		policyViolations.Inc(limit)
+		if s.policy.end {
+			s.logf("%s, ending the publish", breach.text)
+			s.timeline.add(eventSession, breach.text)
+			s.send(client.Message{Cmd: client.CmdError, Code: client.ErrorPolicyViolation, Reason: breach.text, Details: breach.details})
+			s.endWith(client.ClosePolicyViolation, breach.text)
+			return true
+		}
+		warned[limit] = true
+		s.frameAlert(breach)
+	}
+	return false
+}
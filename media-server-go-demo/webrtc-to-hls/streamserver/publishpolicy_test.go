@@ -0,0 +1,185 @@
+package streamserver
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/control"
+)
+
+func TestResolvePublishPolicy(t *testing.T) {
+	t.Setenv("publish_max_resolution_overrides", "mobile=720x1280,bad=720p")
+	t.Setenv("publish_max_bitrate_kbps_overrides", "mobile=1500")
+	t.Setenv("publish_codecs_overrides", "mobile=h264 opus,odd=h265")
+	t.Setenv("publish_h264_profiles_overrides", "mobile=baseline main,fancy=high5")
+	t.Setenv("publish_policy_action_overrides", "mobile=end,loose=ignore")
+
+	p, err := resolvePublishPolicy("mobile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.width != 1280 || p.height != 720 || p.bitrate != 1500000 || !p.end {
+		t.Fatalf("policy %+v", p)
+	}
+	if !p.profiles[66] || !p.profiles[77] || len(p.profiles) != 2 {
+		t.Fatalf("profiles %v", p.profiles)
+	}
+	if !p.allows("video", "H264") || p.allows("video", codecVP8) || !p.allows("audio", "opus") {
+		t.Fatalf("codecs %v", p.codecs)
+	}
+	if p, err := resolvePublishPolicy("other"); err != nil || p.width != 0 || p.codecs != nil || p.end {
+		t.Fatalf("default policy %+v, %v", p, err)
+	}
+	for _, key := range []string{"bad", "odd", "fancy", "loose"} {
+		if _, err := resolvePublishPolicy(key); err == nil {
+			t.Fatalf("policy of %s accepted", key)
+		}
+	}
+}
+
+func TestPolicyAnswer(t *testing.T) {
+	p := publishPolicy{width: 1280, height: 720, bitrate: 1500000, codecs: map[string]bool{codecVP8: true}}
+	offer, answer := answerFixture(t, "chrome_offer.sdp")
+	if err := p.checkOffer(offer); err == nil {
+		// VP8 is offered, but only transcoded when configured
+		t.Fatal("offer accepted without vp8 in the capabilities")
+	}
+	if err := p.allowCodecs(answer); err != errCodecNotAllowed {
+		t.Fatalf("answer without an allowed codec: %v", err)
+	}
+
+	p.codecs = map[string]bool{codecH264: true}
+	offer, answer = answerFixture(t, "chrome_offer.sdp")
+	if err := p.checkOffer(offer); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.allowCodecs(answer); err != nil {
+		t.Fatal(err)
+	}
+	if answer.GetMedia("audio").GetCodec("opus") == nil {
+		t.Fatal("audio restricted by a list of video codecs")
+	}
+	p.constrain(answer)
+	for _, codec := range answer.GetMedia("video").GetCodecs() {
+		if !strings.EqualFold(codec.GetCodec(), codecH264) {
+			t.Fatalf("%s answered", codec.GetCodec())
+		}
+		if fs := codec.GetParam("max-fs"); fs != "3600" {
+			t.Fatalf("max-fs %q", fs)
+		}
+	}
+	text := withTIAS(answer.String())
+	if !strings.Contains(text, "b=AS:1500\r\nb=TIAS:1500000\r\n") {
+		t.Fatalf("bitrate not in\n%s", text)
+	}
+
+	// a lower cap stays
+	answer.GetMedia("video").SetBitrate(800)
+	p.constrain(answer)
+	if bitrate := answer.GetMedia("video").GetBitrate(); bitrate != 800 {
+		t.Fatalf("b=AS %d", bitrate)
+	}
+}
+
+func TestKeyframeSize(t *testing.T) {
+	// a VP8 keyframe tag, start code and 640x360
+	frame := []byte{0x50, 0x42, 0x00, 0x9d, 0x01, 0x2a, 0x80, 0x02, 0x68, 0x01}
+	if width, height, ok := keyframeSize(codecVP8, frame); !ok || width != 640 || height != 360 {
+		t.Fatalf("vp8 %dx%d %v", width, height, ok)
+	}
+	if _, _, ok := keyframeSize(codecVP8, frame[:6]); ok {
+		t.Fatal("short vp8 frame read")
+	}
+	if _, _, ok := keyframeSize(codecH264, []byte{0, 0, 0, 1, 0x65, 0x88}); ok {
+		t.Fatal("h264 frame without SPS read")
+	}
+}
+
+// testKeyframe is an H.264 keyframe of sps, then the start of an IDR
+// slice
+func testKeyframe(sps ...byte) []byte {
+	return append(append([]byte{0, 0, 0, 1}, sps...), 0, 0, 0, 1, 0x65, 0x88)
+}
+
+var (
+	landscapeBaseline = testKeyframe(0x67, 0x42, 0xc0, 0x1f, 0xda, 0x01, 0x40, 0x16, 0xe4)
+	portraitBaseline  = testKeyframe(0x67, 0x42, 0xc0, 0x1f, 0xda, 0x02, 0xd0, 0x28, 0x64)
+	landscapeMain     = testKeyframe(0x67, 0x4d, 0x40, 0x1f, 0xda, 0x01, 0x40, 0x16, 0xe4)
+)
+
+// nextAlert is the next encoder.alert event of events
+func nextAlert(t *testing.T, events <-chan *control.Event) *control.Event {
+	t.Helper()
+	for {
+		select {
+		case event := <-events:
+			if event.Type == hookEncoderAlert {
+				return event
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no encoder.alert event")
+		}
+	}
+}
+
+func TestOrientationAlert(t *testing.T) {
+	events, cancel := controlEvents.Subscribe(16)
+	defer cancel()
+	sess := newSession("turning", nil, presets[client.LatencyBalanced])
+	sess.observeSize(landscapeBaseline, true)
+	sess.observeSize(landscapeBaseline, true)
+	if _, ok := sess.size.takeTurn(); ok {
+		t.Fatal("orientation change without a change")
+	}
+	sess.observeSize(portraitBaseline, true)
+	turn, ok := sess.size.takeTurn()
+	if !ok || turn.code != client.WarningOrientationChanged || turn.details["height"] != 1280 || turn.details["previousWidth"] != 1280 {
+		t.Fatalf("orientation change = %+v, %v", turn, ok)
+	}
+	if _, ok := sess.size.takeTurn(); ok {
+		t.Fatal("orientation change taken twice")
+	}
+
+	sess.frameAlert(turn)
+	event := nextAlert(t, events)
+	if event.Stream != "turning" || event.Data["code"] != client.WarningOrientationChanged || event.Data["width"] != "720" {
+		t.Fatalf("alert event = %v", event)
+	}
+	entries := sess.timeline.entries()
+	if last := entries[len(entries)-1]; last.Kind != eventWarning || !strings.HasPrefix(last.Detail, "orientation-changed: video turned from 1280x720 to 720x1280") {
+		t.Fatalf("timeline entry = %+v", last)
+	}
+}
+
+func TestProfilePolicy(t *testing.T) {
+	events, cancel := controlEvents.Subscribe(16)
+	defer cancel()
+	sess := newSession("high-profile", nil, presets[client.LatencyBalanced])
+	sess.policy = publishPolicy{profiles: map[int]bool{66: true}}
+	warned := map[string]bool{}
+
+	sess.observeSize(landscapeBaseline, true)
+	if sess.enforcePolicy(warned) || len(warned) != 0 {
+		t.Fatalf("baseline breaches %v", warned)
+	}
+	sess.observeSize(landscapeMain, true)
+	if sess.enforcePolicy(warned) || !warned[policyProfile] {
+		t.Fatalf("main breaches %v", warned)
+	}
+	event := nextAlert(t, events)
+	if event.Stream != "high-profile" || event.Data["code"] != client.WarningPolicyProfile || event.Data["profile"] != "main" {
+		t.Fatalf("alert event = %v", event)
+	}
+	entries := sess.timeline.entries()
+	if last := entries[len(entries)-1]; last.Kind != eventWarning || last.Detail != "policy-profile: H.264 main profile not allowed, only baseline" {
+		t.Fatalf("timeline entry = %+v", last)
+	}
+	// warned once, until the profile is allowed again
+	sess.enforcePolicy(warned)
+	sess.observeSize(landscapeBaseline, true)
+	if sess.enforcePolicy(warned) || len(warned) != 0 {
+		t.Fatalf("breaches after going back to baseline %v", warned)
+	}
+}
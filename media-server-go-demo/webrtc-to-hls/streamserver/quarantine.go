@@ -0,0 +1,414 @@
+package streamserver
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/hlscheck"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/ident"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/playlist"
+)
+
+const moderationNotice = "this stream is unavailable pending moderation review"
+
+// errQuarantined refuses a viewer of a quarantined stream
+var errQuarantined = errors.New(moderationNotice)
+
+// auditEntry is one line of the audit log
+type auditEntry struct {
+	Time   time.Time `json:"time"`
+	Admin  string    `json:"admin"`
+	Action string    `json:"action"`
+	Stream string    `json:"stream"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// auditLog appends entries as JSON lines to audit_log. It has no default:
+// the working directory is served over HTTP.
+type auditLog struct {
+	lock sync.Mutex
+	path string
+}
+
+var errNoAuditLog = errors.New("audit_log is not configured")
+
+func (a *auditLog) record(entry auditEntry) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.path == "" {
+		return errNoAuditLog
+	}
+	file, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(file).Encode(entry); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+var audit *auditLog
+
+// quarantines are the stream keys hidden from viewers by moderation.
+// Publishing and writing the output go on, only playback is refused.
+type quarantines struct {
+	sync.Mutex
+	keys map[string]string
+}
+
+var quarantined = &quarantines{keys: map[string]string{}}
+
+func (q *quarantines) set(key, reason string) bool {
+	q.Lock()
+	defer q.Unlock()
+	_, already := q.keys[key]
+	q.keys[key] = reason
+	return !already
+}
+
+func (q *quarantines) clear(key string) bool {
+	q.Lock()
+	defer q.Unlock()
+	_, ok := q.keys[key]
+	delete(q.keys, key)
+	return ok
+}
+
+func (q *quarantines) has(key string) bool {
+	q.Lock()
+	defer q.Unlock()
+	_, ok := q.keys[key]
+	return ok
+}
+
+// adminToken is the secret of the admin calls not made through a trusted
+// proxy, see setupAdmin
+var adminToken string
+
+// setupAdmin reads admin_token, the secret an admin call must carry as
+// Authorization: Bearer when it does not come through one of
+// trusted_proxies. Unset, only those proxies can name the acting admin.
+func setupAdmin() {
+	adminToken = os.Getenv("admin_token")
+}
+
+// adminTrusted tells whether the admin named by a request of peer can be
+// believed: the peer is the authenticating proxy, one of trusted_proxies,
+// or authorization is admin_token as a bearer token
+func adminTrusted(peer, authorization string) bool {
+	if trustedProxy(net.ParseIP(peer)) {
+		return true
+	}
+	token := strings.TrimPrefix(authorization, "Bearer ")
+	return adminToken != "" && token != authorization && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// adminIdentity is the acting admin, as set by the authenticating proxy in front
+// of the admin API or sent with admin_token; anyone else is refused
+func adminIdentity(c *gin.Context) (string, bool) {
+	admin := strings.TrimSpace(c.GetHeader("X-Admin-Identity"))
+	if admin == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "X-Admin-Identity required"})
+		return "", false
+	}
+	peer, _, _ := net.SplitHostPort(c.Request.RemoteAddr)
+	if !adminTrusted(peer, c.GetHeader("Authorization")) {
+		logger.Warn("untrusted admin identity refused", "admin", admin, "peer", peer)
+		c.JSON(http.StatusForbidden, gin.H{"error": "X-Admin-Identity is only taken from a trusted proxy or with admin_token"})
+		return "", false
+	}
+	return admin, true
+}
+
+// quarantineStream handles POST /api/streams/:id/quarantine
+func quarantineStream(c *gin.Context) {
+	admin, ok := adminIdentity(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Reason string `json:"reason"`
+		// NotifyPublisher overrides quarantine_notify_publisher
+		NotifyPublisher *bool `json:"notifyPublisher"`
+	}
+	key, ok := identParam(c, "id", ident.StreamKey)
+	if !ok {
+		return
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.BindJSON(&req); err != nil {
+			return
+		}
+	}
+	// audited before it takes effect, an unaudited quarantine must not happen
+	if err := audit.record(auditEntry{Time: time.Now(), Admin: admin, Action: "quarantine", Stream: key, Reason: req.Reason}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !quarantined.set(key, req.Reason) {
+		c.Status(http.StatusNoContent)
+		return
+	}
+	notify := os.Getenv("quarantine_notify_publisher") == "true"
+	if req.NotifyPublisher != nil {
+		notify = *req.NotifyPublisher
+	}
+	if out := outputs.lookup(key); out != nil {
+		out.markRestored(nil)
+	}
+	if sess := registry.get(key); sess != nil {
+		sess.logf("quarantined by %s", admin)
+		sess.timeline.add(eventSession, "quarantined")
+		sess.detachViewers(client.CloseQuarantined, moderationNotice)
+		if notify {
+			sess.warn(warning{code: client.WarningQuarantined, text: moderationNotice})
+		}
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// unquarantineStream handles DELETE /api/streams/:id/quarantine
+func unquarantineStream(c *gin.Context) {
+	admin, ok := adminIdentity(c)
+	if !ok {
+		return
+	}
+	key, ok := identParam(c, "id", ident.StreamKey)
+	if !ok {
+		return
+	}
+	if !quarantined.has(key) {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	if err := audit.record(auditEntry{Time: time.Now(), Admin: admin, Action: "unquarantine", Stream: key}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	quarantined.clear(key)
+	if sess := registry.get(key); sess != nil {
+		sess.restorePlayback()
+		sess.logf("quarantine lifted by %s", admin)
+		sess.timeline.add(eventSession, "quarantine lifted")
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// restrictedDir is where the output of quarantined streams is kept,
+// quarantine_dir: one directory per stream key, outside of the served
+// directories and on their file system. Without it, the output stays where
+// it is written, only playback is refused.
+func restrictedDir() string {
+	return os.Getenv("quarantine_dir")
+}
+
+// restrictFile moves file, output of key, to the restricted directory of
+// key if key is quarantined, and returns where the file is
+func restrictFile(key, file string) (string, bool) {
+	dir := restrictedDir()
+	if dir == "" || !quarantined.has(key) {
+		return file, false
+	}
+	target := filepath.Join(dir, key, filepath.Base(file))
+	if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		logger.Warn("quarantined output not restricted", "stream", key, "file", file, "error", err)
+		return file, false
+	}
+	if err := os.Rename(file, target); err != nil {
+		logger.Warn("quarantined output not restricted", "stream", key, "file", file, "error", err)
+		return file, false
+	}
+	return target, true
+}
+
+// restrictSegments moves the segments of generation of the quarantined key
+// that are complete, those before the newest, to the restricted directory.
+// The playlist keeps listing them while nobody is served it.
+func restrictSegments(key string, generation int64, newest int) {
+	if restrictedDir() == "" {
+		return
+	}
+	dir := outputDir(key)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	prefix := segmentPrefix(generation)
+	for _, f := range files {
+		if index, ok := segmentIndex(f.Name(), prefix); ok && index < newest {
+			restrictFile(key, filepath.Join(dir, f.Name()))
+		}
+	}
+}
+
+// quarantineRetention is how long restricted output is kept,
+// quarantine_retention_days (90), apart from the retention of the output
+func quarantineRetention() time.Duration {
+	return time.Duration(envInt("quarantine_retention_days", 90)) * 24 * time.Hour
+}
+
+// setupQuarantine removes restricted output past its retention, hourly
+func setupQuarantine() {
+	dir := restrictedDir()
+	if dir == "" {
+		return
+	}
+	go func() {
+		for {
+			pruneRestricted(dir, time.Now().Add(-quarantineRetention()))
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+// pruneRestricted removes the files of dir last written before cutoff
+func pruneRestricted(dir string, cutoff time.Time) {
+	filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && info.ModTime().Before(cutoff) {
+			os.Remove(file)
+		}
+		return nil
+	})
+}
+
+// restoreMark is the first segment of a generation served after a
+// quarantine: the segments before it were restricted, or never watched
+type restoreMark struct {
+	generation int64
+	first      int
+}
+
+func (o *streamOutput) markRestored(mark *restoreMark) {
+	o.restoreLock.Lock()
+	defer o.restoreLock.Unlock()
+	o.restored = mark
+}
+
+// restorePlayback resumes playback of s at the segment being written, as
+// the quarantine lifts
+func (s *session) restorePlayback() {
+	s.Lock()
+	generation := s.generation
+	s.Unlock()
+	if generation == 0 {
+		return
+	}
+	first := newestSegment(outputDir(s.key), generation)
+	if first < 0 {
+		first = 0
+	}
+	outputs.get(s.key).markRestored(&restoreMark{generation: generation, first: first})
+}
+
+// restoredPlaylist returns data, a revision of the live playlist of o, as
+// served after a quarantine lifted: the segments before the restore are
+// left out and the first one after it starts with a discontinuity. It
+// reports whether data was rewritten. Once the generation ends, playlists
+// are served as written again.
+func (o *streamOutput) restoredPlaylist(data []byte) ([]byte, bool) {
+	o.restoreLock.Lock()
+	mark := o.restored
+	o.restoreLock.Unlock()
+	if mark == nil {
+		return data, false
+	}
+	m, err := hlscheck.ParseMedia(data)
+	if err != nil || m.LowLatency != "" {
+		return data, false
+	}
+	restored := &playlist.Media{
+		TargetDuration: m.TargetDuration,
+		MediaSequence:  m.MediaSequence,
+		Map:            m.Map,
+		Ended:          m.Ended,
+	}
+	// the discontinuity slid out of the playlist once every segment is past it
+	restored.DiscontinuitySequence = 1
+	for _, segment := range m.Segments {
+		generation, index, ok := segmentGeneration(path.Base(segment.URI))
+		if !ok || generation > mark.generation {
+			// another generation is served
+			o.markRestored(nil)
+			return data, false
+		}
+		// a generation taken over is still listed before the restore
+		if generation < mark.generation || index < mark.first {
+			restored.MediaSequence++
+			continue
+		}
+		if index == mark.first {
+			restored.DiscontinuitySequence = 0
+		}
+		restored.Segments = append(restored.Segments, playlist.Segment{
+			URI:           segment.URI,
+			Duration:      segment.Duration,
+			Discontinuity: index == mark.first,
+		})
+	}
+	if len(restored.Segments) == 0 {
+		restored.DiscontinuitySequence = 0
+	}
+	var buf bytes.Buffer
+	restored.Write(&buf)
+	return buf.Bytes(), true
+}
+
+// playbackKeys returns the stream keys whose output a request path serves:
+// the id of /hls/:id/ or /whep/:id, resolved to its stream key for live
+// sessions
+func playbackKeys(urlPath string) []string {
+	var id string
+	switch {
+	case strings.HasPrefix(urlPath, "/hls/"):
+		id = strings.TrimPrefix(urlPath, "/hls/")
+	case strings.HasPrefix(urlPath, "/whep/"):
+		id = strings.TrimPrefix(urlPath, "/whep/")
+	default:
+		return nil
+	}
+	parts := strings.SplitN(id, "/", 2)
+	if len(parts) > 1 && strings.HasPrefix(urlPath, "/whep/") {
+		// DELETE /whep/:id/:viewer ends a viewer, it plays nothing
+		return nil
+	}
+	// live sessions are also served by external or session id
+	if sess := registry.find(parts[0]); sess != nil {
+		return []string{sess.key}
+	}
+	return parts[:1]
+}
+
+// refuseQuarantined answers playback of quarantined streams with 451
+func refuseQuarantined(c *gin.Context) {
+	for _, key := range playbackKeys(c.Request.URL.Path) {
+		if quarantined.has(key) {
+			refuseQuarantinedRequest(c)
+			c.Abort()
+			return
+		}
+	}
+	c.Next()
+}
+
+// refuseQuarantinedRequest answers a playback request with the moderation
+// notice
+func refuseQuarantinedRequest(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	c.String(http.StatusUnavailableForLegalReasons, fmt.Sprintf("%s\n", moderationNotice))
+}
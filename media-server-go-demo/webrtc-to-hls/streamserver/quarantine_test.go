@@ -0,0 +1,297 @@
+package streamserver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/hlscheck"
+)
+
+// testAdminToken is the admin_token of the tests, see asAdmin
+const testAdminToken = "test-admin-token"
+
+func init() {
+	adminToken = testAdminToken
+}
+
+// asAdmin makes req an admin call of admin, with admin_token
+func asAdmin(req *http.Request, admin string) {
+	req.Header.Set("X-Admin-Identity", admin)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+}
+
+func TestAdminIdentity(t *testing.T) {
+	defer func(networks []*net.IPNet) { trustedProxies = networks }(trustedProxies)
+	trustedProxies, _ = parseNetworks("trusted_proxies", []string{"10.0.0.0/8"})
+
+	gin.SetMode(gin.TestMode)
+	direct := gin.New()
+	direct.GET("/admin", func(c *gin.Context) {
+		if admin, ok := adminIdentity(c); ok {
+			c.String(http.StatusOK, admin)
+		}
+	})
+	proxied := gin.New()
+	proxied.Use(honorForwarded)
+	proxied.GET("/admin", func(c *gin.Context) {
+		if admin, ok := adminIdentity(c); ok {
+			c.String(http.StatusOK, admin)
+		}
+	})
+	for _, call := range []struct {
+		router      *gin.Engine
+		peer, token string
+		code        int
+		what        string
+	}{
+		{direct, "203.0.113.9", "", http.StatusForbidden, "spoofed"},
+		{direct, "203.0.113.9", "Bearer wrong", http.StatusForbidden, "wrong token"},
+		{direct, "203.0.113.9", testAdminToken, http.StatusForbidden, "token not as bearer"},
+		{direct, "203.0.113.9", "Bearer " + testAdminToken, http.StatusOK, "with token"},
+		{direct, "10.1.2.3", "", http.StatusOK, "from the proxy"},
+		{proxied, "203.0.113.9", "", http.StatusUnauthorized, "spoofed, stripped"},
+		{proxied, "203.0.113.9", "Bearer " + testAdminToken, http.StatusOK, "with token, kept"},
+		{proxied, "10.1.2.3", "", http.StatusOK, "from the proxy, kept"},
+	} {
+		req := httptest.NewRequest("GET", "/admin", nil)
+		req.RemoteAddr = call.peer + ":40000"
+		req.Header.Set("X-Admin-Identity", "mallory")
+		if call.token != "" {
+			req.Header.Set("Authorization", call.token)
+		}
+		w := httptest.NewRecorder()
+		call.router.ServeHTTP(w, req)
+		if w.Code != call.code || (w.Code == http.StatusOK && w.Body.String() != "mallory") {
+			t.Errorf("%s = %d %s, want %d", call.what, w.Code, w.Body, call.code)
+		}
+	}
+
+	saved := adminToken
+	adminToken = ""
+	defer func() { adminToken = saved }()
+	if adminTrusted("203.0.113.9", "Bearer ") {
+		t.Fatal("empty token taken without admin_token")
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quarantine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	audit = &auditLog{path: filepath.Join(dir, "audit.log")}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(refuseQuarantined)
+	r.GET("/hls/:id/*file", func(c *gin.Context) { c.String(http.StatusOK, "ok") })
+	r.POST("/api/streams/:id/quarantine", quarantineStream)
+	r.DELETE("/api/streams/:id/quarantine", unquarantineStream)
+
+	do := func(method, url, admin string) int {
+		req := httptest.NewRequest(method, url, nil)
+		if admin != "" {
+			asAdmin(req, admin)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := do("POST", "/api/streams/ext/quarantine", ""); code != http.StatusUnauthorized {
+		t.Fatalf("anonymous quarantine = %d", code)
+	}
+	if code := do("POST", "/api/streams/ext/quarantine", "alice"); code != http.StatusNoContent {
+		t.Fatalf("quarantine = %d", code)
+	}
+	if code := do("GET", "/hls/ext/playlist.m3u8", ""); code != http.StatusUnavailableForLegalReasons {
+		t.Fatalf("quarantined playback = %d", code)
+	}
+	if code := do("GET", "/hls/other/playlist.m3u8", ""); code != http.StatusOK {
+		t.Fatalf("other stream playback = %d", code)
+	}
+	if code := do("DELETE", "/api/streams/ext/quarantine", "bob"); code != http.StatusNoContent {
+		t.Fatalf("unquarantine = %d", code)
+	}
+	if code := do("GET", "/hls/ext/playlist.m3u8", ""); code != http.StatusOK {
+		t.Fatalf("restored playback = %d", code)
+	}
+
+	log, _ := ioutil.ReadFile(audit.path)
+	lines := strings.Split(strings.TrimSpace(string(log)), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"admin":"alice"`) || !strings.Contains(lines[1], `"action":"unquarantine"`) {
+		t.Fatalf("audit log:\n%s", log)
+	}
+}
+
+func TestQuarantinedViewers(t *testing.T) {
+	sess := newSession("hidden", nil, presets[client.LatencyBalanced])
+	if _, err := registry.claim(sess, conflictReject); err != nil {
+		t.Fatal(err)
+	}
+	defer registry.release(sess)
+	viewer := &webrtcViewer{id: "1-1", done: make(chan struct{})}
+	sess.viewers = map[string]*webrtcViewer{viewer.id: viewer}
+	quarantined.set("hidden", "test")
+	defer quarantined.clear("hidden")
+	sess.detachViewers(client.CloseQuarantined, moderationNotice)
+	select {
+	case <-viewer.done:
+	default:
+		t.Fatal("viewer kept watching")
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(refuseQuarantined)
+	r.POST("/whep/:id", func(c *gin.Context) { c.Status(http.StatusCreated) })
+	r.DELETE("/whep/:id/:viewer", func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.GET("/watch", watchChannel)
+	for path, want := range map[string]int{
+		"POST /whep/hidden":      http.StatusUnavailableForLegalReasons,
+		"POST /whep/" + sess.id:  http.StatusUnavailableForLegalReasons,
+		"POST /whep/shown":       http.StatusCreated,
+		"DELETE /whep/hidden/v1": http.StatusOK,
+	} {
+		parts := strings.SplitN(path, " ", 2)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(parts[0], parts[1], nil))
+		if rec.Code != want {
+			t.Errorf("%s = %d, want %d", path, rec.Code, want)
+		}
+	}
+
+	server := httptest.NewServer(r)
+	defer server.Close()
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/watch", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if err := ws.WriteJSON(client.Message{Cmd: client.CmdOffer, StreamID: "hidden", Sdp: "v=0\r\n"}); err != nil {
+		t.Fatal(err)
+	}
+	var msg client.Message
+	if err := ws.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Cmd != client.CmdError || msg.Code != client.ErrorQuarantined {
+		t.Fatalf("reply = %+v", msg)
+	}
+}
+
+func TestRestrictedOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restricted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	saved := hlsDir
+	defer func() { hlsDir = saved }()
+	hlsDir = filepath.Join(dir, "hls")
+	restricted := filepath.Join(dir, "restricted")
+	t.Setenv("quarantine_dir", restricted)
+
+	out := filepath.Join(hlsDir, "evidence")
+	os.MkdirAll(out, 0755)
+	for i := 0; i < 3; i++ {
+		ioutil.WriteFile(filepath.Join(out, fmt.Sprintf("%s%05d.ts", segmentPrefix(7), i)), []byte("ts"), 0644)
+	}
+	restrictSegments("evidence", 7, 2)
+	if files, _ := ioutil.ReadDir(out); len(files) != 3 {
+		t.Fatalf("segments of a stream not quarantined moved: %d left", len(files))
+	}
+
+	quarantined.set("evidence", "test")
+	defer quarantined.clear("evidence")
+	restrictSegments("evidence", 7, 2)
+	if files, _ := ioutil.ReadDir(out); len(files) != 1 || files[0].Name() != segmentPrefix(7)+"00002.ts" {
+		t.Fatalf("output left: %v", files)
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(restricted, "evidence")); len(files) != 2 {
+		t.Fatalf("restricted: %v", files)
+	}
+
+	pruneRestricted(restricted, time.Now().Add(-time.Hour))
+	if files, _ := ioutil.ReadDir(filepath.Join(restricted, "evidence")); len(files) != 2 {
+		t.Fatal("restricted output pruned within its retention")
+	}
+	pruneRestricted(restricted, time.Now().Add(time.Hour))
+	if files, _ := ioutil.ReadDir(filepath.Join(restricted, "evidence")); len(files) != 0 {
+		t.Fatal("restricted output kept past its retention")
+	}
+}
+
+func TestRestoredPlaylist(t *testing.T) {
+	revision := func(first, count int) []byte {
+		text := fmt.Sprintf("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:%d\n", first)
+		for i := first; i < first+count; i++ {
+			text += fmt.Sprintf("#EXTINF:2.000,\n%s%05d.ts\n", segmentPrefix(5), i)
+		}
+		return []byte(text)
+	}
+	out := &streamOutput{}
+	if data, restored := out.restoredPlaylist(revision(0, 3)); restored || string(data) != string(revision(0, 3)) {
+		t.Fatal("playlist rewritten without a quarantine")
+	}
+	out.markRestored(&restoreMark{generation: 5, first: 4})
+
+	var prev *hlscheck.Media
+	for _, step := range []struct {
+		first, count, sequence, discontinuities int
+		listed                                  string
+	}{
+		// the restricted segments are no longer listed
+		{2, 2, 4, 0, ""},
+		{2, 3, 4, 0, "D4"},
+		{3, 4, 4, 0, "D4 5 6"},
+		// the discontinuity slid out
+		{5, 3, 5, 1, "5 6 7"},
+	} {
+		data, restored := out.restoredPlaylist(revision(step.first, step.count))
+		m, err := hlscheck.ParseMedia(data)
+		if !restored || err != nil {
+			t.Fatalf("restored %v: %v\n%s", restored, err, data)
+		}
+		if err := m.Check(prev); err != nil {
+			t.Fatalf("%v\n%s", err, data)
+		}
+		prev = m
+		var listed []string
+		lines := strings.Split(string(data), "\n")
+		for i, line := range lines {
+			if strings.HasPrefix(line, segmentPrefix(5)) {
+				index := strings.TrimLeft(strings.TrimSuffix(strings.TrimPrefix(line, segmentPrefix(5)), ".ts"), "0")
+				if lines[i-2] == "#EXT-X-DISCONTINUITY" {
+					index = "D" + index
+				}
+				listed = append(listed, index)
+			}
+		}
+		if m.MediaSequence != step.sequence || strings.Join(listed, " ") != step.listed ||
+			strings.Contains(string(data), "#EXT-X-DISCONTINUITY-SEQUENCE:1") != (step.discontinuities == 1) {
+			t.Fatalf("revision from %d:\n%s", step.first, data)
+		}
+	}
+
+	// the next generation is served as written
+	next := []byte(strings.Replace(string(revision(0, 2)), segmentPrefix(5), segmentPrefix(6), -1))
+	if data, restored := out.restoredPlaylist(next); restored || string(data) != string(next) {
+		t.Fatal("next generation rewritten")
+	}
+	if out.restored != nil {
+		t.Fatal("restore mark kept")
+	}
+}
@@ -0,0 +1,293 @@
+package streamserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	mediaserver "github.com/notedit/media-server-go"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/sdp"
+)
+
+var (
+	errBadReconnect     = errors.New("unknown or expired reconnect token")
+	errReconnectLive    = errors.New("the connection already publishes, reconnect on a new one")
+	errCompositeRestart = errors.New("composited publishes cannot restart ICE, make a new offer")
+)
+
+// reconnectGrace is how long a session whose signaling connection dropped
+// waits for its publisher to reconnect, from reconnect_grace (10) seconds;
+// at 0 sessions end with their connection
+func reconnectGrace() time.Duration {
+	return time.Duration(envInt("reconnect_grace", 10)) * time.Second
+}
+
+// reconnectTokens are the sessions publishers can resume on a new
+// connection, by the token of their latest answer
+type reconnectTokens struct {
+	lock     sync.Mutex
+	sessions map[string]*session
+}
+
+var reconnects = &reconnectTokens{sessions: map[string]*session{}}
+
+// issue hands s a new token, the one it had no longer resuming it; empty
+// without a grace period. Only video publishes over the signaling
+// websocket are resumed.
+func (r *reconnectTokens) issue(s *session) string {
+	if reconnectGrace() <= 0 || s.kind != client.KindVideo {
+		return ""
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return ""
+	}
+	token := hex.EncodeToString(nonce)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	s.Lock()
+	previous := s.reconnectToken
+	s.reconnectToken = token
+	s.Unlock()
+	delete(r.sessions, previous)
+	r.sessions[token] = s
+	return token
+}
+
+// take redeems token for a publish of key, returning its session
+func (r *reconnectTokens) take(token, key string) *session {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	s := r.sessions[token]
+	if s == nil || s.key != key {
+		return nil
+	}
+	delete(r.sessions, token)
+	return s
+}
+
+// forget drops the token of s, closing
+func (r *reconnectTokens) forget(s *session) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	s.Lock()
+	token := s.reconnectToken
+	s.reconnectToken = ""
+	s.Unlock()
+	delete(r.sessions, token)
+}
+
+// droppedConnection reports whether err, ending a signaling connection,
+// is the connection lost rather than the publisher leaving
+func droppedConnection(err error) bool {
+	return err != nil && !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway)
+}
+
+// outlive decides, as the connection ws of s ends with err, whether the
+// session goes on without it: taken over by its publisher reconnecting, or
+// dropped while it has a reconnect token, then waiting reconnect_grace for
+// it and ending after. The session keeps endpoint, its transport possibly
+// on it, until it closes.
+func (s *session) outlive(ws *websocket.Conn, endpoint *mediaserver.Endpoint, err error) bool {
+	grace := reconnectGrace()
+	s.Lock()
+	switch {
+	case s.closed:
+		s.Unlock()
+		return false
+	case !s.conn.over(ws):
+		s.endpoints = append(s.endpoints, endpoint)
+		s.Unlock()
+		return true
+	case s.reconnectToken == "" || grace <= 0 || !droppedConnection(err):
+		s.Unlock()
+		return false
+	}
+	s.endpoints = append(s.endpoints, endpoint)
+	var timer *time.Timer
+	timer = time.AfterFunc(grace, func() {
+		s.Lock()
+		waiting := s.parked == timer
+		s.Unlock()
+		if waiting {
+			s.logf("publisher did not reconnect within %s, ending", grace)
+			s.end()
+		}
+	})
+	s.parked = timer
+	s.Unlock()
+	s.conn.detach()
+	s.timeline.add(eventSignaling, "connection dropped, waiting to reconnect")
+	s.logf("connection dropped, waiting %s for the publisher to reconnect", grace)
+	return true
+}
+
+// reconnecting reports whether s waits for its publisher to reconnect
+func (s *session) reconnecting() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.parked != nil
+}
+
+// reconnect resumes the session of token, a publish of key, on conn, a new
+// connection of its publisher, answering offer: on the transport of the
+// session when the offer keeps its ICE credentials, else on a new one
+// created on endpoint, see restartICE. The output goes on. A session that
+// cannot take the offer is ended, the publisher offering anew.
+func reconnect(token, key string, conn *signaling, endpoint *mediaserver.Endpoint, offer *sdp.SDPInfo) (*session, string, error) {
+	s := reconnects.take(token, key)
+	if s == nil {
+		return nil, "", errBadReconnect
+	}
+	s.Lock()
+	closed := s.closed
+	if s.parked != nil {
+		s.parked.Stop()
+		s.parked = nil
+	}
+	s.Unlock()
+	if closed {
+		return nil, "", errBadReconnect
+	}
+	// the connection it was on, if still open, is closed
+	s.conn.takeOver(conn)
+	s.log.with("connection", conn.id)
+	answer, err := s.renegotiate(s.pins, offer)
+	if err == errICERestart {
+		answer, err = s.restartICE(endpoint, s.pins, offer)
+	}
+	if err != nil {
+		s.logf("reconnect failed: %v", err)
+		s.end()
+		return nil, "", err
+	}
+	s.timeline.add(eventSignaling, "reconnected")
+	s.logf("publisher reconnected")
+	return s, answer, nil
+}
+
+// restartICE answers offer, with ICE credentials of its own, on a new
+// transport created on endpoint: the streams of the offer feed the output
+// in place of those of the transport it replaces, which is kept until the
+// session closes as the watchers of the session may still read its
+// tracks. Viewers attached to the replaced streams stay on them.
+func (s *session) restartICE(endpoint *mediaserver.Endpoint, pins *payloadPins, offer *sdp.SDPInfo) (string, error) {
+	s.Lock()
+	previous, refresher := s.transport, s.refresher
+	closed, kind, codec, layers, audio := s.closed, s.kind, s.videoCodec, s.simulcast, s.audio
+	s.Unlock()
+	switch {
+	case closed || previous == nil:
+		return "", errNotLive
+	case kind != client.KindVideo:
+		return "", errAudioOnlyChanges
+	case layers != nil || len(offeredLayers(offer)) > 1:
+		return "", errSimulcastChange
+	case s.screen != "":
+		return "", errCompositeRestart
+	}
+	video, audioStream := firstStreamWith(offer, "video"), ""
+	if video == "" {
+		return "", errNoVideoStream
+	}
+	if audio {
+		if audioStream = firstStreamWith(offer, "audio"); audioStream == "" {
+			return "", errNoAudioStream
+		}
+	}
+
+	pins.apply(offer)
+	transport := endpoint.CreateTransport(offer, nil)
+	s.watchDTLS(transport)
+	transport.SetRemoteProperties(offer.GetMedia("audio"), offer.GetMedia("video"))
+	answer := offer.Answer(transport.GetLocalICEInfo(),
+		transport.GetLocalDTLSInfo(),
+		localCandidates(endpoint.GetLocalCandidates()),
+		Capabilities)
+	if err := s.policy.allowCodecs(answer); err != nil {
+		transport.Stop()
+		return "", err
+	}
+	if pickVideoCodec(answer) != codec {
+		transport.Stop()
+		return "", errCodecChange
+	}
+	if answerModeFor(s.key) == answerMinimal {
+		minimizeAnswer(answer)
+	}
+	capBitrate(answer)
+	s.policy.constrain(answer)
+	transport.SetLocalProperties(answer.GetMedia("audio"), answer.GetMedia("video"))
+
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		transport.Stop()
+		return "", errNotLive
+	}
+	s.transport = transport
+	s.retired = append(s.retired, previous)
+	s.remoteUfrag = offer.GetICE().GetUfrag()
+	s.offered = offeredStreams(offer)
+	s.Unlock()
+	s.log.with("transport", transport.GetLocalICEInfo().GetUfrag())
+	if refresher != nil {
+		for _, incoming := range previous.GetIncomingStreams() {
+			refresher.RemoveStream(incoming)
+		}
+	}
+	go s.watchICE(transport)
+
+	for _, info := range offer.GetStreams() {
+		incoming := transport.CreateIncomingStream(info)
+		if refresher != nil {
+			refresher.AddStream(incoming)
+		}
+		if incoming.GetID() == video {
+			s.feedVideo(incoming)
+		}
+		if incoming.GetID() == audioStream {
+			s.feedAudio(incoming)
+		}
+		s.feedAlternateAudio(incoming)
+	}
+	if refresher != nil {
+		refresher.request(keyframeSwitch)
+	}
+	s.timeline.add(eventSignaling, "ice restarted")
+
+	answerSDP := withTIAS(orderAnswer(answer.String(), answer, preferredCodecs()))
+	s.sdps.add(client.CmdAnswer, redactSDP(answerSDP))
+	return answerSDP, nil
+}
+
+// reconnectedInfo describes the session resumed by a reconnect, answered
+// with answer, to its publisher
+func (s *session) reconnectedInfo(answer string) *client.SessionInfo {
+	s.Lock()
+	audio := s.audio
+	s.Unlock()
+	info := &client.SessionInfo{
+		ID:          s.id,
+		Stream:      s.key,
+		ExternalID:  s.externalID,
+		Codecs:      []string{},
+		Mode:        client.ModePassthrough,
+		Preset:      s.preset.Name,
+		Profile:     s.profile.Name,
+		Kind:        s.kind,
+		Audio:       audio,
+		Reconnected: true,
+		Answer:      answerModeFor(s.key),
+		Playlist:    playlistPath(s),
+	}
+	if parsed, err := sdp.Parse(answer); err == nil {
+		info.Codecs = answeredCodecs(parsed)
+	}
+	info.ReconnectToken = reconnects.issue(s)
+	return info
+}
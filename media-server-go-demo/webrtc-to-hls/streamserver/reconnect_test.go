@@ -0,0 +1,131 @@
+package streamserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+)
+
+func TestReconnectTokens(t *testing.T) {
+	sess := newSession("reconnect-tokens", nil, presets[client.LatencyBalanced])
+	first := reconnects.issue(sess)
+	if first == "" {
+		t.Fatal("no token issued")
+	}
+	second := reconnects.issue(sess)
+	if reconnects.take(first, sess.key) != nil {
+		t.Fatal("replaced token redeemed")
+	}
+	if reconnects.take(second, "other") != nil {
+		t.Fatal("token redeemed for another key")
+	}
+	if reconnects.take(second, sess.key) != sess {
+		t.Fatal("token not redeemed")
+	}
+	if reconnects.take(second, sess.key) != nil {
+		t.Fatal("token redeemed twice")
+	}
+	third := reconnects.issue(sess)
+	reconnects.forget(sess)
+	if reconnects.take(third, sess.key) != nil {
+		t.Fatal("token of a closed session redeemed")
+	}
+
+	t.Setenv("reconnect_grace", "0")
+	if token := reconnects.issue(sess); token != "" {
+		t.Fatal("token issued without a grace period")
+	}
+}
+
+// publisherConn serves a publisher connection of sess, taking the session
+// over when it has one, and reports whether the session outlived it once
+// it ends
+func publisherConn(t *testing.T, sess *session, outlived chan<- bool) (*websocket.Conn, func()) {
+	ready := make(chan struct{})
+	ws, done := dialSignaling(t, func(c *gin.Context) {
+		ws, err := upGrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		conn := newSignaling(ws)
+		if sess.conn == nil {
+			sess.conn = conn
+		} else {
+			sess.conn.takeOver(conn)
+		}
+		close(ready)
+		for {
+			if _, _, err = ws.ReadMessage(); err != nil {
+				break
+			}
+		}
+		outlived <- sess.outlive(ws, nil, err)
+	})
+	<-ready
+	return ws, done
+}
+
+func TestReconnectGrace(t *testing.T) {
+	t.Setenv("reconnect_grace", "1")
+	sess := newSession("reconnect-grace", nil, presets[client.LatencyBalanced])
+	if _, err := registry.claim(sess, conflictReject); err != nil {
+		t.Fatal(err)
+	}
+	reconnects.issue(sess)
+	outlived := make(chan bool, 2)
+	ws, done := publisherConn(t, sess, outlived)
+	defer done()
+
+	// the network goes away without a close frame
+	ws.UnderlyingConn().Close()
+	if !<-outlived {
+		t.Fatal("session ended with its dropped connection")
+	}
+	if !sess.reconnecting() || registry.get(sess.key) != sess {
+		t.Fatal("session not waiting for its publisher")
+	}
+	if err := sess.conn.send(client.Message{Cmd: client.CmdEvent}); err != errDetached {
+		t.Fatalf("send to a dropped publisher = %v", err)
+	}
+	select {
+	case <-sess.done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("session not ended after the grace period")
+	}
+	if registry.get(sess.key) != nil {
+		t.Fatal("stream key still held")
+	}
+}
+
+func TestReconnectTakeOver(t *testing.T) {
+	sess := newSession("reconnect-takeover", nil, presets[client.LatencyBalanced])
+	if _, err := registry.claim(sess, conflictReject); err != nil {
+		t.Fatal(err)
+	}
+	defer sess.end()
+	reconnects.issue(sess)
+	outlived := make(chan bool, 2)
+	first, done := publisherConn(t, sess, outlived)
+	defer done()
+	second, done2 := publisherConn(t, sess, outlived)
+	defer done2()
+	if _, _, err := first.ReadMessage(); !websocket.IsCloseError(err, client.CloseReplaced) {
+		t.Fatalf("read of the replaced connection = %v", err)
+	}
+	if !<-outlived {
+		t.Fatal("session ended with its replaced connection")
+	}
+	if sess.reconnecting() {
+		t.Fatal("taken over session waits for its publisher")
+	}
+
+	// leaving on purpose ends the session
+	second.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	if <-outlived {
+		t.Fatal("session outlived a normal close")
+	}
+}
@@ -0,0 +1,325 @@
+package streamserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	gstreamer "github.com/notedit/gstreamer-go"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/pipeline"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/teardown"
+)
+
+var (
+	errRecording       = errors.New("already recording")
+	errNotRecording    = errors.New("not recording")
+	errRecordingFailed = errors.New("recording pipeline failed")
+)
+
+// recordMuxers are the muxers of the recording formats
+var recordMuxers = map[string]string{
+	"mp4": "mp4mux",
+	"mkv": "matroskamux",
+}
+
+// recordDir is where recordings are written, record_dir (recordings), one
+// directory per stream key
+func recordDir() string {
+	if dir := os.Getenv("record_dir"); dir != "" {
+		return dir
+	}
+	return "recordings"
+}
+
+// recordAlways reports whether the output of key is recorded whenever it
+// is live, record / record_overrides set to always
+func recordAlways(key string) bool {
+	return envForKey("record", key) == "always"
+}
+
+// resolveRecordFormat reads the format recordings of key are written in,
+// record_format / record_format_overrides: mp4 (the default) or mkv
+func resolveRecordFormat(key string) (string, error) {
+	format := envForKey("record_format", key)
+	if format == "" {
+		return "mp4", nil
+	}
+	if _, ok := recordMuxers[format]; !ok {
+		return "", fmt.Errorf("record format must be mp4 or mkv, not %q", format)
+	}
+	return format, nil
+}
+
+// recordingPath names the recording of key started at start, e.g.
+// recordings/main/main-20261014T101500.250Z.mp4
+func recordingPath(dir, key, format string, start time.Time) string {
+	return filepath.Join(dir, key, fmt.Sprintf("%s-%s.%s", key, start.UTC().Format("20060102T150405.000Z"), format))
+}
+
+// recordingOutput is the pipeline writing a session to a file, its frames
+// queued for the pipeline, see sideFeeder. The file is only complete once
+// flushed: mp4mux writes the index of the file on EOS.
+type recordingOutput struct {
+	pipeline *gstreamer.Pipeline
+	appsrc   *gstreamer.Element
+	// audiosrc is nil when the pipeline has no audio branch
+	audiosrc *gstreamer.Element
+	feeder   *sideFeeder
+	path     string
+	// object is the name the file is stored as, see uploadFile
+	object  string
+	started time.Time
+	// completed, if set, is called by Drain once the file is complete
+	completed func(*recordingOutput)
+
+	eosOnce  sync.Once
+	eos      chan struct{}
+	failOnce sync.Once
+	failed   chan struct{}
+	// released is closed by Release
+	released chan struct{}
+	// key is the stream recorded, whose quarantine keeps the file in the
+	// restricted directory
+	key string
+}
+
+func newRecordingOutput(pipelineStr, path, object string) (*recordingOutput, error) {
+	pipeline, err := gstreamer.New(pipelineStr)
+	if err != nil {
+		return nil, err
+	}
+	out := &recordingOutput{
+		pipeline: pipeline,
+		appsrc:   pipeline.FindElement("appsrc"),
+		audiosrc: pipeline.FindElement("audiosrc"),
+		path:     path,
+		object:   object,
+		started:  time.Now(),
+		eos:      make(chan struct{}),
+		failed:   make(chan struct{}),
+		released: make(chan struct{}),
+	}
+	go out.watchBus(pipeline.PullMessage())
+	pipeline.Start()
+	out.feeder = newSideFeeder("recording", pipeline)
+	return out, nil
+}
+
+// watchBus drains the pipeline bus until Release closes it. An error, such
+// as a full disk, fails the recording.
+func (o *recordingOutput) watchBus(messages <-chan *gstreamer.Message) {
+	for msg := range messages {
+		switch msg.GetType() {
+		case gstreamer.MESSAGE_EOS:
+			o.eosOnce.Do(func() { close(o.eos) })
+		case gstreamer.MESSAGE_ERROR:
+			o.failOnce.Do(func() { close(o.failed) })
+		}
+	}
+}
+
+func (o *recordingOutput) push(frame []byte, keyframe bool) {
+	o.feeder.push(frame, keyframe)
+}
+
+func (o *recordingOutput) pushAudio(frame []byte) {
+	o.feeder.pushAudio(frame)
+}
+
+func (o *recordingOutput) Name() string {
+	return "recording"
+}
+
+// Flush pushes the queued frames and sends EOS so the muxer completes the
+// file, and waits for it to reach the bus
+func (o *recordingOutput) Flush(ctx context.Context) error {
+	if err := o.feeder.flush(ctx); err != nil {
+		return err
+	}
+	o.pipeline.SendEOS()
+	select {
+	case <-o.eos:
+		return nil
+	case <-o.failed:
+		return errRecordingFailed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Finalize is a no-op: the muxer finalizes the file itself on EOS
+func (o *recordingOutput) Finalize(ctx context.Context) error {
+	return nil
+}
+
+// Drain queues the upload of the complete file to the storage backend, if
+// any; uploads go on in the background
+func (o *recordingOutput) Drain(ctx context.Context) error {
+	if path, ok := restrictFile(o.key, o.path); ok {
+		// the recording of a quarantined stream does not leave the box
+		o.path, o.object = path, ""
+	}
+	if o.object != "" {
+		uploadFile(o.object, o.path)
+	}
+	select {
+	case <-o.eos:
+		if o.completed != nil {
+			o.completed(o)
+		}
+	default:
+	}
+	return nil
+}
+
+func (o *recordingOutput) Release() {
+	o.appsrc.Stop()
+	if o.audiosrc != nil {
+		o.audiosrc.Stop()
+	}
+	o.pipeline.Stop()
+	o.feeder.release()
+	close(o.released)
+}
+
+// startRecording starts recording the output to a new file, with the
+// session locked, and returns its path
+func (s *session) startRecording() (string, error) {
+	if s.closed || s.hls == nil {
+		return "", errNotLive
+	}
+	if s.recording != nil {
+		return "", errRecording
+	}
+	format, err := resolveRecordFormat(s.key)
+	if err != nil {
+		return "", err
+	}
+	dir, object := recordDir(), true
+	if restricted := restrictedDir(); restricted != "" && quarantined.has(s.key) {
+		dir, object = restricted, false
+	}
+	path := recordingPath(dir, s.key, format, time.Now())
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	if err := checkRecordingSpace(filepath.Dir(path)); err != nil {
+		return "", err
+	}
+	rec, err := newRecordingOutput(s.sidePipeline(sideQueueBytes, "", pipeline.File{Muxer: recordMuxers[format], Location: path}).String(), path, recordingObject(s.key, path))
+	if err != nil {
+		return "", err
+	}
+	if !object {
+		rec.object = ""
+	}
+	rec.key = s.key
+	rec.completed = s.notifyRecording
+	s.recording = rec
+	go s.watchRecording(rec)
+	s.timeline.add(eventPipeline, "recording to "+path)
+	s.logf("recording to %s", path)
+	return path, nil
+}
+
+// stopRecording stops feeding the recording and completes its file
+func (s *session) stopRecording() (*recordingOutput, error) {
+	s.Lock()
+	rec := s.recording
+	s.recording = nil
+	s.Unlock()
+	if rec == nil {
+		return nil, errNotRecording
+	}
+	plan := teardown.NewPlan(s.teardownLogf)
+	plan.AddSink(rec)
+	plan.Run(context.Background())
+	s.timeline.add(eventPipeline, "recorded "+rec.path)
+	return rec, nil
+}
+
+// watchRecording releases rec if its pipeline fails while recording; what
+// was written up to the failure is left as is
+func (s *session) watchRecording(rec *recordingOutput) {
+	select {
+	case <-rec.failed:
+	case <-rec.released:
+		return
+	}
+	s.Lock()
+	owned := s.recording == rec
+	if owned {
+		s.recording = nil
+	}
+	s.Unlock()
+	if owned {
+		s.logf("recording to %s failed", rec.path)
+		rec.Release()
+	}
+}
+
+// recordingFile is the file the session is recorded to, empty when not
+// recording
+func (s *session) recordingFile() string {
+	s.Lock()
+	defer s.Unlock()
+	if s.recording == nil {
+		return ""
+	}
+	return s.recording.path
+}
+
+// startStreamRecording handles POST /api/v1/streams/:id/record/start
+func startStreamRecording(c *gin.Context) {
+	admin, ok := adminIdentity(c)
+	if !ok {
+		return
+	}
+	sess := liveSession(c)
+	if sess == nil {
+		return
+	}
+	sess.Lock()
+	path, err := sess.startRecording()
+	sess.Unlock()
+	switch err {
+	case nil:
+	case errRecording, errNotLive:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case errDiskFull:
+		c.JSON(http.StatusInsufficientStorage, gin.H{"error": err.Error()})
+		return
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Info("recording started", "stream", sess.key, "file", path, "admin", admin)
+	c.JSON(http.StatusOK, gin.H{"stream": sess.key, "file": path})
+}
+
+// stopStreamRecording handles POST /api/v1/streams/:id/record/stop; it
+// answers once the file is complete
+func stopStreamRecording(c *gin.Context) {
+	admin, ok := adminIdentity(c)
+	if !ok {
+		return
+	}
+	sess := liveSession(c)
+	if sess == nil {
+		return
+	}
+	rec, err := sess.stopRecording()
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Info("recording stopped", "stream", sess.key, "file", rec.path, "admin", admin)
+	c.JSON(http.StatusOK, gin.H{"stream": sess.key, "file": rec.path, "durationMs": milliseconds(time.Since(rec.started))})
+}
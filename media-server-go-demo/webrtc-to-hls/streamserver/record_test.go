@@ -0,0 +1,100 @@
+package streamserver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/pipeline"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/teardown"
+)
+
+func TestResolveRecordFormat(t *testing.T) {
+	t.Setenv("record_format_overrides", "archive=mkv,bad=avi")
+	for key, want := range map[string]string{"archive": "mkv", "other": "mp4"} {
+		if format, err := resolveRecordFormat(key); err != nil || format != want {
+			t.Errorf("%s = %q, %v", key, format, err)
+		}
+	}
+	if _, err := resolveRecordFormat("bad"); err == nil {
+		t.Error("avi accepted")
+	}
+	start := time.Date(2026, 10, 14, 10, 15, 0, 250e6, time.UTC)
+	if path := recordingPath("recordings", "main", "mkv", start); path != "recordings/main/main-20261014T101500.250Z.mkv" {
+		t.Fatalf("path = %s", path)
+	}
+}
+
+func TestRecordingPipeline(t *testing.T) {
+	sess := newSession("record-pipeline", nil, presets[client.LatencyBalanced])
+	sess.audio, sess.aacCaps = true, adtsCaps
+	launch := sess.sidePipeline(0, "", pipeline.File{Muxer: recordMuxers["mp4"], Location: "recordings/a.mp4"}).String()
+	if !strings.HasPrefix(launch, `appsrc do-timestamp=true is-live=true name=appsrc ! h264parse ! tee name=video ! queue ! mp4mux name=muxer ! filesink location="recordings/a.mp4"`) || !strings.Contains(launch, "name=audiosrc "+adtsCaps+" ! aacparse ! tee name=aac ! queue ! muxer.") {
+		t.Fatalf("pipeline = %s", launch)
+	}
+}
+
+func TestRecordAPI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	t.Setenv("record_dir", dir)
+	// the stub pipelines never reach EOS
+	saved := teardown.DefaultPhaseTimeout
+	teardown.DefaultPhaseTimeout = 10 * time.Millisecond
+	defer func() { teardown.DefaultPhaseTimeout = saved }()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/api/v1/streams/:id", getStream)
+	r.POST("/api/v1/streams/:id/record/start", startStreamRecording)
+	r.POST("/api/v1/streams/:id/record/stop", stopStreamRecording)
+	do := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, nil)
+		asAdmin(req, "ops")
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	sess := newSession("record-live", nil, presets[client.LatencyBalanced])
+	if _, err := registry.claim(sess, conflictReject); err != nil {
+		t.Fatal(err)
+	}
+	defer registry.release(sess)
+	if w := do("POST", "/api/v1/streams/record-live/record/start"); w.Code != http.StatusConflict {
+		t.Fatalf("start before the output = %d", w.Code)
+	}
+	sess.hls, _ = newHLSOutput("")
+
+	w := do("POST", "/api/v1/streams/record-live/record/start")
+	var started struct {
+		File string `json:"file"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &started)
+	if w.Code != http.StatusOK || !strings.HasPrefix(started.File, filepath.Join(dir, "record-live", "record-live-")) || !strings.HasSuffix(started.File, ".mp4") {
+		t.Fatalf("start = %d %s", w.Code, w.Body)
+	}
+	if w := do("POST", "/api/v1/streams/record-live/record/start"); w.Code != http.StatusConflict {
+		t.Fatalf("second start = %d", w.Code)
+	}
+	if w := do("GET", "/api/v1/streams/record-live"); !strings.Contains(w.Body.String(), `"recording":"`+started.File+`"`) {
+		t.Fatalf("summary = %s", w.Body)
+	}
+	if w := do("POST", "/api/v1/streams/record-live/record/stop"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), started.File) {
+		t.Fatalf("stop = %d %s", w.Code, w.Body)
+	}
+	if w := do("POST", "/api/v1/streams/record-live/record/stop"); w.Code != http.StatusConflict {
+		t.Fatalf("second stop = %d", w.Code)
+	}
+}
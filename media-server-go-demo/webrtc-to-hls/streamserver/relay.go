@@ -0,0 +1,351 @@
+package streamserver
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	gstreamer "github.com/notedit/gstreamer-go"
+	mediaserver "github.com/notedit/media-server-go"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/abr"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/sdp"
+)
+
+// the protocols of publishers that are not WebRTC
+const (
+	protocolRTMP = "rtmp"
+	protocolSRT  = "srt"
+	protocolRTSP = "rtsp"
+	protocolRTP  = "rtp"
+)
+
+var errInputEnded = errors.New("ingest input ended")
+
+// the relays of a publish that is not WebRTC to WebRTC viewers, RTP sent to
+// the local port of a streamer session: the payload type and the port
+// complete them, and the caps of the AAC follow the audio appsrc
+const (
+	videoRelay = "appsrc do-timestamp=true is-live=true format=time name=appsrc caps=video/x-h264,stream-format=byte-stream,alignment=au ! h264parse ! rtph264pay config-interval=-1 pt=%d ! udpsink host=127.0.0.1 port=%d"
+	audioRelay = "appsrc do-timestamp=true is-live=true format=time name=appsrc ! aacparse ! avdec_aac ! audioconvert ! audioresample ! opusenc ! rtpopuspay pt=%d ! udpsink host=127.0.0.1 port=%d"
+)
+
+// newIngestSession resolves the output of a publish of key arriving over
+// RTMP, SRT, RTSP or plain RTP, which have no offer or signaling to pick settings from
+func newIngestSession(key string) (*session, error) {
+	preset, err := resolvePreset("", key)
+	profile, profileErr := resolveProfile(key)
+	if err == nil {
+		err = profileErr
+	}
+	if err == nil {
+		preset, err = profile.fit(preset, false)
+	}
+	if err == nil {
+		preset, err = resolveDVR(preset, key)
+	}
+	var dash bool
+	if err == nil {
+		dash, err = resolveDASH("", key)
+	}
+	var container string
+	if err == nil {
+		container, err = resolveContainer(profile, key)
+	}
+	var ladder []abr.Rung
+	if err == nil {
+		ladder, err = resolveLadder(preset, profile, container, key)
+	}
+	var egress string
+	if err == nil {
+		egress, err = resolveSRTEgress(key)
+	}
+	if err == nil {
+		err = checkPassthrough(preset, "", key)
+	}
+	if err == nil {
+		err = checkEncryption(container, dash, preset, key)
+	}
+	if err == nil {
+		err = checkDRM(container, false, preset, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sess := newSession(key, nil, preset)
+	sess.profile = profile
+	sess.dash = dash
+	sess.container = container
+	sess.ladder = ladder
+	sess.srtEgress = egress
+	return sess, nil
+}
+
+// startIngest starts the relay and the output of a publish that is not
+// WebRTC, once its media is known, ending the session after idle without
+// video. It reports whether the output muxes the publisher's AAC.
+func (s *session) startIngest(idle time.Duration) (bool, error) {
+	if err := s.waitPrevious(); err != nil {
+		return false, err
+	}
+	relay, err := newIngestRelay(s.aacCaps)
+	if err != nil {
+		return false, err
+	}
+	if !s.setRelay(relay) {
+		relay.stop()
+		return false, errStreamReplaced
+	}
+	audio := s.aacCaps != "" && s.takesAudio(1)
+	if err := s.startPipeline(audio); err != nil {
+		return false, err
+	}
+	go s.watchFrames()
+	go s.watchSegments()
+	go s.runHeartbeat()
+	go s.runFallback()
+	go s.endWhenIdle(idle)
+	return audio, nil
+}
+
+// ingestVideo feeds an Annex B access unit to the output and the relay
+func (s *session) ingestVideo(frame []byte, keyframe bool) {
+	ingestBytes.Add("video", uint64(len(frame)))
+	s.frames.record(frame, keyframe)
+	s.observeSize(frame, keyframe)
+	s.relayFrame(true, frame)
+	s.push(frame, frameTime{})
+}
+
+// ingestAudio feeds an AAC frame to the relay, and to the output with audio
+func (s *session) ingestAudio(frame []byte, audio bool) {
+	ingestBytes.Add("audio", uint64(len(frame)))
+	s.relayFrame(false, frame)
+	if audio {
+		s.pushAudio(frame, frameTime{})
+	}
+}
+
+// relayTrack is the RTP of one track of a publish, received by a streamer
+// session whose incoming track viewers attach to
+type relayTrack struct {
+	session  *mediaserver.StreamerSession
+	pipeline *gstreamer.Pipeline
+	appsrc   *gstreamer.Element
+}
+
+func newRelayTrack(media, codec, launch string) (*relayTrack, error) {
+	info := sdp.MediaInfoCreate(media, Capabilities[media])
+	if info.GetCodec(codec) == nil {
+		return nil, fmt.Errorf("no %s in the %s capabilities", codec, media)
+	}
+	session := mediaserver.NewStreamerSession(info)
+	pipeline, err := gstreamer.New(fmt.Sprintf(launch, info.GetCodec(codec).GetType(), session.GetLocalPort()))
+	if err != nil {
+		session.Stop()
+		return nil, err
+	}
+	pipeline.Start()
+	return &relayTrack{session: session, pipeline: pipeline, appsrc: pipeline.FindElement("appsrc")}, nil
+}
+
+func (t *relayTrack) stop() {
+	t.appsrc.Stop()
+	t.pipeline.Stop()
+	t.session.Stop()
+}
+
+// ingestRelay republishes a publish that is not WebRTC over RTP for WebRTC
+// viewers, the AAC transcoded to Opus
+type ingestRelay struct {
+	video *relayTrack
+	// audio is nil for publishers without audio
+	audio *relayTrack
+}
+
+// newIngestRelay starts the relay of the video and of the AAC of caps, none
+// when empty
+func newIngestRelay(caps string) (*ingestRelay, error) {
+	video, err := newRelayTrack("video", codecH264, videoRelay)
+	if err != nil {
+		return nil, err
+	}
+	r := &ingestRelay{video: video}
+	if caps == "" {
+		return r, nil
+	}
+	launch := strings.Replace(audioRelay, "name=appsrc", "name=appsrc "+caps, 1)
+	if r.audio, err = newRelayTrack("audio", "opus", launch); err != nil {
+		r.video.stop()
+		return nil, err
+	}
+	return r, nil
+}
+
+// tracks are the incoming tracks of the relay, audio nil without
+func (r *ingestRelay) tracks() (video, audio *mediaserver.IncomingStreamTrack) {
+	video = r.video.session.GetIncomingStreamTrack()
+	if r.audio != nil {
+		audio = r.audio.session.GetIncomingStreamTrack()
+	}
+	return video, audio
+}
+
+func (r *ingestRelay) stop() {
+	r.video.stop()
+	if r.audio != nil {
+		r.audio.stop()
+	}
+}
+
+// setRelay records the relay of a publish so close can stop it
+func (s *session) setRelay(relay *ingestRelay) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return false
+	}
+	s.relay = relay
+	return true
+}
+
+// relayFrame feeds a video or AAC frame to the relay, dropping it once
+// the session closed
+func (s *session) relayFrame(video bool, frame []byte) {
+	s.Lock()
+	defer s.Unlock()
+	switch {
+	case s.relay == nil:
+	case video:
+		s.relay.video.appsrc.Push(frame)
+	case s.relay.audio != nil:
+		s.relay.audio.appsrc.Push(frame)
+	}
+}
+
+// ingestInput is a publish that is not WebRTC received by a pipeline, its
+// H.264 out of the appsink videosink and its AAC, when it has an appsink
+// audiosink, out of that one
+type ingestInput struct {
+	protocol string
+	launch   string
+	// where is logged as where the publish comes from, without credentials
+	where string
+	// upstream is the origin an edge pulls the key from, empty for
+	// publishers
+	upstream string
+	// stop, if set, ends the publish once closed
+	stop <-chan struct{}
+}
+
+// ingestFrom starts the pipeline of in and publishes key from its first
+// keyframe until the input ends or the session does. Audio seen before
+// the first keyframe is muxed.
+func ingestFrom(key string, in ingestInput) error {
+	pipeline, err := gstreamer.New(in.launch)
+	if err != nil {
+		return err
+	}
+	videosink, audiosink := pipeline.FindElement("videosink"), pipeline.FindElement("audiosink")
+	videos := pumpFrames(videosink.Poll())
+	var audios <-chan []byte
+	if audiosink != nil {
+		audios = pumpFrames(audiosink.Poll())
+	}
+	pipeline.Start()
+	defer func() {
+		videosink.Stop()
+		if audiosink != nil {
+			audiosink.Stop()
+		}
+		pipeline.Stop()
+	}()
+
+	audioSeen := false
+	for {
+		select {
+		case <-in.stop:
+			return nil
+		case frame, ok := <-videos:
+			if !ok {
+				return errInputEnded
+			}
+			if videoKeyframe(codecH264, frame) {
+				return publishInput(key, in, frame, audioSeen, videos, audios)
+			}
+		case _, ok := <-audios:
+			if !ok {
+				audios = nil
+			}
+			audioSeen = audioSeen || ok
+		}
+	}
+}
+
+// publishInput runs the session of an input from its first keyframe, ended
+// after <protocol>_idle_timeout (15) seconds without video
+func publishInput(key string, in ingestInput, keyframe []byte, audioSeen bool, videos, audios <-chan []byte) error {
+	if _, err := admitPublish(client.Message{}, key); err != nil {
+		return err
+	}
+	var policy publishPolicy
+	if in.upstream == "" {
+		// the origin enforced the policy of its publisher already
+		var err error
+		if policy, err = ingestPolicy(key); err != nil {
+			return err
+		}
+	}
+	sess, err := newIngestSession(key)
+	if err != nil {
+		return err
+	}
+	sess.ingest = in.protocol
+	sess.policy = policy
+	sess.upstream = in.upstream
+	if audioSeen {
+		sess.aacCaps = adtsCaps
+	}
+	sess.timeline.add(eventSignaling, "in "+in.protocol+" publish")
+	if _, err := registry.claim(sess, conflictPolicyFor(key)); err != nil {
+		sess.close(0, "")
+		return err
+	}
+	defer sess.end()
+	scheduled.publishStarted(key)
+	sess.logf("publishing over %s from %s", in.protocol, in.where)
+	if in.upstream != "" {
+		go sess.endWhenUnwatched(edgeIdle)
+	}
+	audio, err := sess.startIngest(time.Duration(envInt(in.protocol+"_idle_timeout", 15)) * time.Second)
+	if err != nil {
+		return err
+	}
+	sess.timeline.add(eventMedia, "first video frame")
+	sess.ingestVideo(keyframe, true)
+	var firstAudio sync.Once
+	for {
+		select {
+		case <-sess.done:
+			return nil
+		case <-in.stop:
+			return nil
+		case frame, ok := <-videos:
+			if !ok {
+				return errInputEnded
+			}
+			sess.ingestVideo(frame, videoKeyframe(codecH264, frame))
+		case frame, ok := <-audios:
+			if !ok {
+				audios = nil
+				continue
+			}
+			firstAudio.Do(func() {
+				sess.timeline.add(eventMedia, "first audio frame")
+			})
+			sess.ingestAudio(frame, audio)
+		}
+	}
+}
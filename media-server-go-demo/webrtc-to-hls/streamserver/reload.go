@@ -0,0 +1,231 @@
+package streamserver
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/joho/godotenv"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/metrics"
+)
+
+var configReloads = metrics.NewCounter("config_reloads_total",
+	"Configuration reloads, by result", "result")
+
+// configLock guards the settings a reload replaces: presets, dashDefault,
+// defaultContainer, codecPreference and webhooks
+var configLock sync.RWMutex
+
+// settingsFile is the env file the settings were read from, see
+// parseSettings; its lock serializes reloads
+var settingsFile struct {
+	sync.Mutex
+	path string
+	// required is set when the file was named by -env-file rather than
+	// being the default .env, which may not exist
+	required bool
+	// fixed are the settings of the environment and of the flags, which
+	// the file does not override
+	fixed map[string]bool
+	// values are the settings the file set
+	values map[string]string
+}
+
+// loadSettingsFile sets the settings of the env file at path that the
+// environment and the flags do not set
+func loadSettingsFile(path string, required bool) error {
+	settingsFile.Lock()
+	defer settingsFile.Unlock()
+	settingsFile.path, settingsFile.required = path, required
+	settingsFile.fixed = map[string]bool{}
+	for _, variable := range os.Environ() {
+		settingsFile.fixed[strings.SplitN(variable, "=", 2)[0]] = true
+	}
+	values, err := readSettingsFile()
+	if err != nil {
+		return err
+	}
+	applySettings(values)
+	return nil
+}
+
+// readSettingsFile reads the settings file, none when the default one does
+// not exist or cannot be read
+func readSettingsFile() (map[string]string, error) {
+	values, err := godotenv.Read(settingsFile.path)
+	if err != nil && settingsFile.required {
+		return nil, err
+	}
+	if err != nil {
+		return map[string]string{}, nil
+	}
+	return values, nil
+}
+
+// applySettings makes values the settings of the file, unsetting those
+// the file no longer sets, and returns the names of those that changed
+func applySettings(values map[string]string) []string {
+	var changed []string
+	for name := range settingsFile.values {
+		if _, ok := values[name]; !ok && !settingsFile.fixed[name] {
+			os.Unsetenv(name)
+			changed = append(changed, name)
+		}
+	}
+	for name, value := range values {
+		if settingsFile.fixed[name] {
+			continue
+		}
+		if previous, ok := settingsFile.values[name]; !ok || previous != value {
+			os.Setenv(name, value)
+			changed = append(changed, name)
+		}
+	}
+	settingsFile.values = values
+	sort.Strings(changed)
+	return changed
+}
+
+// reloadConfig reads the settings file and the HLS config again and
+// applies them to the publishes to come, those live keeping what they
+// started with: the latency presets, the DASH and container defaults,
+// codec_preference, the webhooks, log_level when it changed, and every
+// setting read per stream key, such as the overrides of new stream keys.
+// The settings of the flags and the environment stay. Nothing changes when
+// the new settings are invalid, or move the outputs or rename their
+// segments; other settings read at startup, e.g. of the listeners, wait
+// for a restart. It returns the names of the settings that changed.
+func reloadConfig() ([]string, error) {
+	settingsFile.Lock()
+	defer settingsFile.Unlock()
+	values, err := readSettingsFile()
+	if err != nil {
+		return nil, err
+	}
+	previous := settingsFile.values
+	changed := applySettings(values)
+	if err := applyReload(changed); err != nil {
+		applySettings(previous)
+		if config, err := loadHLSConfig(os.Getenv("hls_config")); err == nil {
+			config.apply()
+		}
+		return nil, err
+	}
+	return changed, nil
+}
+
+// applyReload applies the settings of the environment, each one checked
+// before any is applied but those of the HLS config, which the stream keys
+// are then checked against
+func applyReload(changed []string) error {
+	hls, err := loadHLSConfig(os.Getenv("hls_config"))
+	if err != nil {
+		return err
+	}
+	if err := hls.restartOnly(); err != nil {
+		return err
+	}
+	rules, err := parseCodecPreference(os.Getenv("codec_preference"))
+	if err != nil {
+		return err
+	}
+	endpoints, err := readWebhooks()
+	if err != nil {
+		return err
+	}
+	if err := setupKeyframes(); err != nil {
+		return err
+	}
+	level, levelChanged := logLevel.Level(), false
+	for _, name := range changed {
+		levelChanged = levelChanged || name == "log_level"
+	}
+	if levelChanged {
+		// the level set through the API stays unless the setting changed
+		level = slog.LevelInfo
+		if value := os.Getenv("log_level"); value != "" {
+			if err := level.UnmarshalText([]byte(value)); err != nil {
+				return fmt.Errorf("log_level: %v", err)
+			}
+		}
+	}
+	if err := hls.apply(); err != nil {
+		return err
+	}
+	for _, key := range overriddenKeys() {
+		if err := validateKey(key); err != nil {
+			return fmt.Errorf("stream %s: %v", key, err)
+		}
+	}
+	configLock.Lock()
+	codecPreference, webhooks = rules, endpoints
+	configLock.Unlock()
+	logLevel.Set(level)
+	applyLogLevel()
+	return nil
+}
+
+// restartOnly fails when config changes what the live outputs rely on:
+// where they are written, and how their segments are named and deleted
+func (config hlsConfig) restartOnly() error {
+	switch {
+	case config.OutputDir != "" && config.OutputDir != hlsDir:
+		return fmt.Errorf("output_dir cannot change without a restart")
+	case config.SegmentName != "" && config.SegmentName != segmentName:
+		return fmt.Errorf("segment_name cannot change without a restart")
+	case config.DeleteOldSegments != nil && *config.DeleteOldSegments != deleteOldSegments:
+		return fmt.Errorf("delete_old_segments cannot change without a restart")
+	}
+	return nil
+}
+
+// reloadOnHangup reloads the configuration on every SIGHUP
+func reloadOnHangup() {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	for range hangups {
+		logReload(reloadConfig())
+	}
+}
+
+// logReload logs and counts the outcome of a reload
+func logReload(changed []string, err error) {
+	if err != nil {
+		configReloads.Inc("failed")
+		logger.Error("config not reloaded", "error", err)
+		return
+	}
+	configReloads.Inc("ok")
+	logger.Info("config reloaded", "changed", changed)
+}
+
+// reloadConfigHandler handles POST /api/v1/config/reload, answering the
+// settings that changed, or 422 with why nothing did
+func reloadConfigHandler(c *gin.Context) {
+	admin, ok := adminIdentity(c)
+	if !ok {
+		return
+	}
+	if err := audit.record(auditEntry{Time: time.Now(), Admin: admin, Action: "config-reload"}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	changed, err := reloadConfig()
+	logReload(changed, err)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	if changed == nil {
+		changed = []string{}
+	}
+	c.JSON(http.StatusOK, gin.H{"changed": changed})
+}
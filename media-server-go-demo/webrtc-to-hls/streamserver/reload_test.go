@@ -0,0 +1,73 @@
+package streamserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/webhook"
+)
+
+func TestReloadConfig(t *testing.T) {
+	defer saveHLS()()
+	defer func(saved []*webhook.Endpoint, rules []codecRule) {
+		webhooks, codecPreference = saved, rules
+	}(webhooks, codecPreference)
+	for _, name := range []string{"latency_overrides", "webhook_urls", "webhook_secret", "hls_low_latency_playlist_length", "codec_preference"} {
+		unsetenv(t, name)
+	}
+	defer func() {
+		settingsFile.path, settingsFile.required, settingsFile.fixed, settingsFile.values = "", false, nil, nil
+	}()
+	t.Setenv("webhook_secret", "from the environment")
+
+	path := filepath.Join(t.TempDir(), "settings.env")
+	write := func(settings string) {
+		if err := ioutil.WriteFile(path, []byte(settings), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("latency_overrides=main=balanced\nwebhook_secret=from the file\n")
+	if err := loadSettingsFile(path, true); err != nil {
+		t.Fatal(err)
+	}
+	if os.Getenv("latency_overrides") != "main=balanced" || os.Getenv("webhook_secret") != "from the environment" {
+		t.Fatalf("settings %q, %q", os.Getenv("latency_overrides"), os.Getenv("webhook_secret"))
+	}
+
+	write("webhook_urls=https://hooks.example/live\nhls_low_latency_playlist_length=5\n")
+	changed, err := reloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"hls_low_latency_playlist_length", "latency_overrides", "webhook_urls"}; !reflect.DeepEqual(changed, want) {
+		t.Fatalf("changed %v", changed)
+	}
+	if os.Getenv("latency_overrides") != "" || len(webhooks) != 1 || string(webhooks[0].Secret) != "from the environment" {
+		t.Fatalf("latency_overrides %q, webhooks %+v", os.Getenv("latency_overrides"), webhooks)
+	}
+	if low := presets[client.LatencyLow]; low.PlaylistLength != 5 {
+		t.Fatalf("low latency preset %+v", low)
+	}
+
+	// nothing of an invalid file applies
+	write("webhook_urls=https://hooks.example/other\ncodec_preference=h264;profile-level-id\n")
+	if _, err := reloadConfig(); err == nil {
+		t.Fatal("invalid codec_preference reloaded")
+	}
+	if os.Getenv("webhook_urls") != "https://hooks.example/live" || os.Getenv("codec_preference") != "" || webhooks[0].URL != "https://hooks.example/live" {
+		t.Fatalf("webhook_urls %q, webhooks %+v", os.Getenv("webhook_urls"), webhooks)
+	}
+	if low := presets[client.LatencyLow]; low.PlaylistLength != 5 {
+		t.Fatalf("low latency preset %+v", low)
+	}
+
+	write("hls_segment_name=other\n")
+	unsetenv(t, "hls_segment_name")
+	if _, err := reloadConfig(); err == nil {
+		t.Fatal("segment name changed by a reload")
+	}
+}
@@ -0,0 +1,415 @@
+package streamserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	gstreamer "github.com/notedit/gstreamer-go"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/abr"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/metrics"
+)
+
+var (
+	renditionTransitions = metrics.NewCounter("abr_rendition_transitions_total",
+		"Health changes of ABR renditions, by state entered", "state")
+	rungFramesDropped = metrics.NewCounter("abr_rung_frames_dropped_total",
+		"Frames dropped because the queue of an ABR rendition was full, by rendition", "rendition")
+)
+
+var errLadderReleased = errors.New("abr ladder released")
+
+// rungQueueFrames bounds the frames queued for a rung's pipeline. An
+// encoder falling this far behind drops frames until the next keyframe,
+// and its queue depth tells the health of the rung; see abr.HealthConfig.
+const rungQueueFrames = 120
+
+// rungFrame is a frame queued for a rung, of its video or its audio
+type rungFrame struct {
+	data []byte
+	// buf holds data, from frameBuffers
+	buf   *[]byte
+	audio bool
+}
+
+// rungOutput is the pipeline transcoding one rung. Frames reach it through
+// a queue, so a slow encoder never holds up the session.
+type rungOutput struct {
+	rung abr.Rung
+	// attempt counts the restarts of the rung, see rungPrefix
+	attempt  int
+	pipeline *gstreamer.Pipeline
+	appsrc   *gstreamer.Element
+	// audiosrc is nil when the pipeline has no audio branch
+	audiosrc *gstreamer.Element
+	queue    chan rungFrame
+	// keyframe is set once the first keyframe was queued; dropping once
+	// the queue overflowed, until the next one
+	keyframe bool
+	dropping bool
+	// seen is the highest segment index seen, -1 before the first
+	seen int
+	// memory holds the queued frames
+	memory *charge
+
+	eosOnce  sync.Once
+	eos      chan struct{}
+	flushing int32
+	// stop is closed by release
+	stop chan struct{}
+}
+
+func newRungOutput(rung abr.Rung, attempt int, pipelineStr string, memory *charge) (*rungOutput, error) {
+	pipeline, err := gstreamer.New(pipelineStr)
+	if err != nil {
+		return nil, err
+	}
+	out := &rungOutput{
+		rung:     rung,
+		attempt:  attempt,
+		pipeline: pipeline,
+		appsrc:   pipeline.FindElement("appsrc"),
+		audiosrc: pipeline.FindElement("audiosrc"),
+		queue:    make(chan rungFrame, rungQueueFrames),
+		seen:     -1,
+		memory:   memory,
+		eos:      make(chan struct{}),
+		stop:     make(chan struct{}),
+	}
+	go out.watchBus(pipeline.PullMessage())
+	pipeline.Start()
+	go out.feed()
+	return out, nil
+}
+
+// watchBus drains the pipeline bus until release closes it. A failed rung
+// stops writing segments, which its health check notices.
+func (o *rungOutput) watchBus(messages <-chan *gstreamer.Message) {
+	for msg := range messages {
+		if msg.GetType() == gstreamer.MESSAGE_EOS && atomic.LoadInt32(&o.flushing) == 1 {
+			o.eosOnce.Do(func() { close(o.eos) })
+		}
+	}
+}
+
+// feed pushes the queued frames into the pipeline until release
+func (o *rungOutput) feed() {
+	for {
+		select {
+		case <-o.stop:
+			return
+		case f := <-o.queue:
+			if !f.audio {
+				o.appsrc.Push(f.data)
+			} else if o.audiosrc != nil {
+				o.audiosrc.Push(f.data)
+			}
+			o.memory.shrink(int64(len(f.data)))
+			releaseFrame(f.buf)
+		}
+	}
+}
+
+// enqueue queues a copy of f, reserved before it is made, as the caller
+// reuses its buffers, and reports whether it fit the queue and the memory
+// budget
+func (o *rungOutput) enqueue(f rungFrame) bool {
+	if len(o.queue) == cap(o.queue) {
+		return false
+	}
+	size := int64(len(f.data))
+	if !o.memory.grow(size) {
+		return false
+	}
+	f.buf = copyFrame(f.data)
+	f.data = *f.buf
+	select {
+	case o.queue <- f:
+	default:
+		o.memory.shrink(size)
+		releaseFrame(f.buf)
+		return false
+	}
+	select {
+	case <-o.stop:
+		// released meanwhile, reserving makes the ladder drop the rungs
+		o.drain()
+	default:
+	}
+	return true
+}
+
+// drain empties the queue of a released rung, releasing its frames
+func (o *rungOutput) drain() {
+	for {
+		select {
+		case f := <-o.queue:
+			o.memory.shrink(int64(len(f.data)))
+			releaseFrame(f.buf)
+		default:
+			return
+		}
+	}
+}
+
+// push queues a video frame, the frames before the first keyframe, or
+// after an overflow before the next one, being dropped
+func (o *rungOutput) push(frame []byte, keyframe bool) {
+	if keyframe {
+		o.keyframe, o.dropping = true, false
+	}
+	if !o.keyframe || o.dropping {
+		return
+	}
+	if !o.enqueue(rungFrame{data: frame}) {
+		o.dropping = true
+		rungFramesDropped.Inc(o.rung.Name)
+	}
+}
+
+func (o *rungOutput) pushAudio(frame []byte) {
+	if o.audiosrc == nil || !o.keyframe {
+		return
+	}
+	if !o.enqueue(rungFrame{data: frame, audio: true}) {
+		rungFramesDropped.Inc(o.rung.Name)
+	}
+}
+
+// flush sends EOS so the last segment of the rung is closed, and waits for
+// it to reach the bus
+func (o *rungOutput) flush(ctx context.Context) error {
+	atomic.StoreInt32(&o.flushing, 1)
+	o.pipeline.SendEOS()
+	select {
+	case <-o.eos:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (o *rungOutput) release() {
+	close(o.stop)
+	o.drain()
+	o.appsrc.Stop()
+	if o.audiosrc != nil {
+		o.audiosrc.Stop()
+	}
+	o.pipeline.Stop()
+}
+
+// ladderOutput is the ABR ladder of one output generation: a pipeline per
+// rung, watched by an abr.Health. Wedged rungs are restarted, and those
+// out of restarts dropped; only healthy ones are listed by serveMaster.
+type ladderOutput struct {
+	sess       *session
+	dir        string
+	generation int64
+	config     abr.HealthConfig
+	health     *abr.Health
+	// queued holds the frames queued for the rungs
+	queued *charge
+
+	lock     sync.Mutex
+	ladder   []abr.Rung
+	rungs    map[string]*rungOutput
+	released bool
+}
+
+// listedRung is a rung serveMaster lists, at the playlist of its attempt
+type listedRung struct {
+	abr.Rung
+	playlist string
+}
+
+// startLadder starts the rungs of s, with the session locked, for the
+// output generation written to dir. There is no ladder without rungs.
+func (s *session) startLadder(dir string, generation int64) (*ladderOutput, error) {
+	if len(s.ladder) == 0 {
+		return nil, nil
+	}
+	l := &ladderOutput{sess: s, dir: dir, generation: generation, ladder: s.ladder, rungs: map[string]*rungOutput{}, queued: &charge{account: s.account}}
+	l.config = abr.DefaultHealthConfig(time.Duration(s.preset.SegmentDuration) * time.Second)
+	l.health = abr.NewHealth(l.config, l.restart, l.transition)
+	now := time.Now()
+	for _, rung := range s.ladder {
+		out, err := newRungOutput(rung, 0, s.rungPipeline(dir, generation, rung, 0).String(), l.queued)
+		if err != nil {
+			l.release()
+			return nil, err
+		}
+		l.rungs[rung.Name] = out
+		l.health.Add(rung.Name, now)
+	}
+	return l, nil
+}
+
+// push queues a video frame for every rung. The rungs are pushed to
+// outside the lock: reserving their queues may walk the degradation
+// ladder, which drops them.
+func (l *ladderOutput) push(frame []byte, keyframe bool) {
+	for _, out := range l.current() {
+		out.push(frame, keyframe)
+	}
+}
+
+func (l *ladderOutput) pushAudio(frame []byte) {
+	for _, out := range l.current() {
+		out.pushAudio(frame)
+	}
+}
+
+// current returns the running rungs
+func (l *ladderOutput) current() []*rungOutput {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	rungs := make([]*rungOutput, 0, len(l.rungs))
+	for _, out := range l.rungs {
+		rungs = append(rungs, out)
+	}
+	return rungs
+}
+
+// check reports the segments and queue depths of the rungs to their
+// health, every second from watchSegments. A stalled source stalls every
+// rung, which is the supervisor's business, so health is only checked
+// while the source writes segments.
+func (l *ladderOutput) check(now time.Time, source time.Time) {
+	type progress struct {
+		name  string
+		dir   string
+		out   *rungOutput
+		depth int
+	}
+	var rungs []progress
+	l.lock.Lock()
+	for _, rung := range l.ladder {
+		if out := l.rungs[rung.Name]; out != nil {
+			rungs = append(rungs, progress{rung.Name, rungDir(l.dir, rung), out, len(out.queue)})
+		}
+	}
+	l.lock.Unlock()
+	for _, r := range rungs {
+		l.health.QueueDepth(r.name, r.depth)
+		if newest := newestPrefixed(r.dir, rungPrefix(l.generation, r.out.attempt)); newest > r.out.seen {
+			r.out.seen = newest
+			l.health.Segment(r.name, now)
+		}
+	}
+	if now.Sub(source) < l.config.StallTimeout {
+		l.health.Check(now)
+	}
+}
+
+// restart replaces the pipeline of the rung name by a new attempt, which
+// writes a playlist of its own; see rungPlaylist
+func (l *ladderOutput) restart(name string) error {
+	l.lock.Lock()
+	old := l.rungs[name]
+	released := l.released
+	l.lock.Unlock()
+	if released || old == nil {
+		return errLadderReleased
+	}
+	s := l.sess
+	s.Lock()
+	pipeline := s.rungPipeline(l.dir, l.generation, old.rung, old.attempt+1).String()
+	s.Unlock()
+	out, err := newRungOutput(old.rung, old.attempt+1, pipeline, l.queued)
+	if err != nil {
+		return err
+	}
+	l.lock.Lock()
+	if l.released || l.rungs[name] != old {
+		l.lock.Unlock()
+		out.release()
+		return errLadderReleased
+	}
+	l.rungs[name] = out
+	l.lock.Unlock()
+	old.release()
+	return nil
+}
+
+// transition records a health change of a rendition: a rendition out of
+// restarts is dropped from the ladder
+func (l *ladderOutput) transition(t abr.Transition) {
+	s := l.sess
+	renditionTransitions.Inc(t.To.String())
+	s.timeline.add(eventPipeline, fmt.Sprintf("rendition %s %s: %s", t.Rendition, t.To, t.Reason))
+	s.logf("rendition %s %s -> %s: %s", t.Rendition, t.From, t.To, t.Reason)
+	s.notify(hookRenditionHealth, map[string]interface{}{
+		"session": s.id, "rendition": t.Rendition, "from": t.From.String(), "to": t.To.String(), "reason": t.Reason,
+	})
+	if t.To != abr.Failed {
+		return
+	}
+	l.lock.Lock()
+	out := l.rungs[t.Rendition]
+	delete(l.rungs, t.Rendition)
+	l.lock.Unlock()
+	if out != nil {
+		out.release()
+	}
+}
+
+// listed returns the rungs serveMaster lists, the healthy ones
+func (l *ladderOutput) listed() []listedRung {
+	var rungs []listedRung
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, rung := range l.ladder {
+		if out := l.rungs[rung.Name]; out != nil && l.health.Listed(rung.Name) {
+			rungs = append(rungs, listedRung{rung, rungPlaylist(out.attempt)})
+		}
+	}
+	return rungs
+}
+
+// renditions returns the health of each rendition of the ladder of s, nil
+// without one
+func (s *session) renditions() map[string]string {
+	s.Lock()
+	var l *ladderOutput
+	if s.hls != nil {
+		l = s.hls.ladder
+	}
+	s.Unlock()
+	if l == nil {
+		return nil
+	}
+	return l.states()
+}
+
+// states returns the health of each rendition of the ladder
+func (l *ladderOutput) states() map[string]string {
+	states := make(map[string]string, len(l.ladder))
+	for _, rung := range l.ladder {
+		states[rung.Name] = l.health.State(rung.Name).String()
+	}
+	return states
+}
+
+// flush closes the last segment of every rung
+func (l *ladderOutput) flush(ctx context.Context) error {
+	for _, out := range l.current() {
+		if err := out.flush(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *ladderOutput) release() {
+	l.lock.Lock()
+	rungs := l.rungs
+	l.rungs, l.released = map[string]*rungOutput{}, true
+	l.lock.Unlock()
+	for _, out := range rungs {
+		out.release()
+	}
+}
@@ -0,0 +1,374 @@
+package streamserver
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mediaserver "github.com/notedit/media-server-go"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/sdp"
+)
+
+var (
+	errICERestart       = errors.New("an ICE restart needs a new offer")
+	errCodecChange      = errors.New("the video codec of a publish cannot change, make a new offer")
+	errSimulcastChange  = errors.New("simulcast publishes cannot renegotiate, make a new offer")
+	errNoVideoStream    = errors.New("no published stream with video")
+	errNoAudioStream    = errors.New("the output has audio, keep a stream with audio")
+	errBadCandidate     = errors.New("bad candidate")
+	errAudioOnlyChanges = errors.New("audio-only publishes cannot renegotiate, make a new offer")
+)
+
+// feed is a published stream attached to the output; the frames of a
+// detached feed are dropped
+type feed struct {
+	stream   *mediaserver.IncomingStream
+	detached int32
+}
+
+func (f *feed) attached() bool {
+	return f != nil && atomic.LoadInt32(&f.detached) == 0
+}
+
+func (f *feed) detach() {
+	if f != nil {
+		atomic.StoreInt32(&f.detached, 1)
+	}
+}
+
+// feedVideo attaches the first video track of stream to the output and to
+// new viewers, detaching the track it replaces
+func (s *session) feedVideo(stream *mediaserver.IncomingStream) {
+	videoTrack := stream.GetVideoTracks()[0]
+	f := &feed{stream: stream}
+	s.Lock()
+	replaced := s.videoFeed
+	s.videoFeed = f
+	s.incoming = stream
+	layers := s.simulcast
+	s.Unlock()
+	replaced.detach()
+	if layers != nil {
+		videoTrack.SetMediaFrameEncoding(layers.current())
+	}
+	var firstFrame sync.Once
+	// the stream may have an output of its own too, see startStreamOutput
+	s.onVideoFrame(videoTrack, f.attached, func(frame []byte, timestamp uint) {
+		if !f.attached() || len(frame) <= 4 {
+			return
+		}
+		s.clock.frame(uint32(timestamp), time.Now())
+		firstFrame.Do(func() {
+			s.timeline.add(eventMedia, "first video frame")
+			s.traceStep("first frame")
+			s.pushEvent(client.Message{Event: client.EventFirstFrame, Details: map[string]interface{}{"track": "video"}})
+		})
+		keyframe := s.videoKeyframe(frame)
+		if layers != nil && !layers.admit(keyframe) {
+			return
+		}
+		ingestBytes.Add("video", uint64(len(frame)))
+		s.frames.record(frame, keyframe)
+		s.observeSize(frame, keyframe)
+		if c := s.compositor(); c != nil {
+			c.pushCamera(frame)
+			return
+		}
+		s.push(frame, rtpTime(timestamp))
+	})
+
+	videoTrack.OnStop(func() {
+		// a replaced track stops with the transport, after the output
+		if f.attached() {
+			s.stopPipeline()
+		}
+	})
+}
+
+// feedAudio attaches the audio track of stream muxed with its video to the
+// output, detaching the track it replaces
+func (s *session) feedAudio(stream *mediaserver.IncomingStream) {
+	f := &feed{stream: stream}
+	s.Lock()
+	replaced := s.audioFeed
+	s.audioFeed = f
+	s.Unlock()
+	replaced.detach()
+	var firstAudio sync.Once
+	firstAudioTrack(stream).OnMediaFrame(func(frame []byte, timestamp uint) {
+		if !f.attached() || len(frame) == 0 {
+			return
+		}
+		firstAudio.Do(func() {
+			s.timeline.add(eventMedia, "first audio frame")
+			s.pushEvent(client.Message{Event: client.EventFirstFrame, Details: map[string]interface{}{"track": "audio"}})
+		})
+		ingestBytes.Add("audio", uint64(len(frame)))
+		s.pushAudio(frame, rtpTime(timestamp))
+	})
+}
+
+// offeredStreams are the ids of the streams of offer
+func offeredStreams(offer *sdp.SDPInfo) map[string]bool {
+	ids := map[string]bool{}
+	for id := range offer.GetStreams() {
+		ids[id] = true
+	}
+	return ids
+}
+
+// firstStreamWith is the id of the first stream of offer, by id, with a
+// track of media, empty when there is none
+func firstStreamWith(offer *sdp.SDPInfo, media string) string {
+	ids := []string{}
+	for id, stream := range offer.GetStreams() {
+		if stream.GetFirstTrack(media) != nil {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return ""
+	}
+	sort.Strings(ids)
+	return ids[0]
+}
+
+// parseCandidate parses the candidate attribute line, e.g.
+// candidate:1 1 udp 2122260223 192.0.2.1 54321 typ host
+func parseCandidate(line string) (*sdp.CandidateInfo, error) {
+	line = strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(line), "a="), "candidate:")
+	fields := strings.Fields(line)
+	if len(fields) < 8 || fields[6] != "typ" {
+		return nil, errBadCandidate
+	}
+	component, err1 := strconv.Atoi(fields[1])
+	priority, err2 := strconv.Atoi(fields[3])
+	port, err3 := strconv.Atoi(fields[5])
+	if err1 != nil || err2 != nil || err3 != nil {
+		return nil, errBadCandidate
+	}
+	var relAddr string
+	var relPort int
+	for i := 8; i+1 < len(fields); i += 2 {
+		switch fields[i] {
+		case "raddr":
+			relAddr = fields[i+1]
+		case "rport":
+			relPort, _ = strconv.Atoi(fields[i+1])
+		}
+	}
+	return sdp.NewCandidateInfo(fields[0], component, strings.ToUpper(fields[2]), priority, fields[4], port, fields[7], relAddr, relPort), nil
+}
+
+// addCandidate registers a candidate the publisher trickled. The server is
+// ICE-lite and learns the publisher's address from its checks, the
+// candidate saves a round of them.
+func (s *session) addCandidate(line string) error {
+	if strings.TrimSpace(line) == "" {
+		// the end of the candidates
+		return nil
+	}
+	candidate, err := parseCandidate(line)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	transport := s.transport
+	s.Unlock()
+	if transport == nil {
+		return errNotLive
+	}
+	transport.AddRemoteCandidate(candidate)
+	s.timeline.add(eventSignaling, "candidate "+candidate.GetType())
+	return nil
+}
+
+// renegotiate answers a new offer of the live publish on its transport:
+// streams that appear are received, those with video packaged on their own
+// as in negotiate, and the outputs of those gone finalized. When the stream
+// feeding the output is gone, the first other one with video replaces it,
+// the output going on.
+// The ICE credentials, the video codec and the audio of the output stay.
+func (s *session) renegotiate(pins *payloadPins, offer *sdp.SDPInfo) (string, error) {
+	s.Lock()
+	transport, refresher := s.transport, s.refresher
+	videoFeed, audioFeed := s.videoFeed, s.audioFeed
+	closed, kind, ufrag, codec := s.closed, s.kind, s.remoteUfrag, s.videoCodec
+	layers, audio, previous := s.simulcast, s.audio, s.offered
+	s.Unlock()
+	switch {
+	case closed || transport == nil || videoFeed == nil:
+		return "", errNotLive
+	case kind != client.KindVideo:
+		return "", errAudioOnlyChanges
+	case layers != nil || len(offeredLayers(offer)) > 1:
+		return "", errSimulcastChange
+	case offer.GetICE() == nil || offer.GetICE().GetUfrag() != ufrag:
+		return "", errICERestart
+	}
+	offered := offeredStreams(offer)
+	video, audioStream := "", ""
+	if !offered[videoFeed.stream.GetID()] {
+		if video = firstStreamWith(offer, "video"); video == "" {
+			return "", errNoVideoStream
+		}
+	}
+	if audio && !offered[audioFeed.stream.GetID()] {
+		if audioStream = firstStreamWith(offer, "audio"); audioStream == "" {
+			return "", errNoAudioStream
+		}
+	}
+
+	pins.apply(offer)
+	answer := offer.Answer(transport.GetLocalICEInfo(),
+		transport.GetLocalDTLSInfo(),
+		localCandidates(transport.GetLocalCandidates()),
+		Capabilities)
+	if err := s.policy.allowCodecs(answer); err != nil {
+		return "", err
+	}
+	if pickVideoCodec(answer) != codec {
+		return "", errCodecChange
+	}
+	if answerModeFor(s.key) == answerMinimal {
+		minimizeAnswer(answer)
+	}
+	capBitrate(answer)
+	s.policy.constrain(answer)
+	transport.SetRemoteProperties(offer.GetMedia("audio"), offer.GetMedia("video"))
+	transport.SetLocalProperties(answer.GetMedia("audio"), answer.GetMedia("video"))
+
+	added, removed := 0, 0
+	var others []*mediaserver.IncomingStream
+	for id, info := range offer.GetStreams() {
+		if transport.GetIncomingStream(id) != nil {
+			continue
+		}
+		incoming := transport.CreateIncomingStream(info)
+		if refresher != nil {
+			refresher.AddStream(incoming)
+		}
+		// e.g. a translation offered again after it was dropped
+		s.feedAlternateAudio(incoming)
+		if len(incoming.GetVideoTracks()) > 0 && id != video && id != s.screen {
+			others = append(others, incoming)
+		}
+		added++
+	}
+	// dropped streams stop with the transport, their tracks possibly still
+	// read by the watchers of the session
+	for id := range previous {
+		if offered[id] {
+			continue
+		}
+		if incoming := transport.GetIncomingStream(id); incoming != nil && refresher != nil {
+			refresher.RemoveStream(incoming)
+		}
+		go s.stopStreamOutput(id)
+		removed++
+	}
+	if video != "" {
+		s.feedVideo(transport.GetIncomingStream(video))
+		if refresher != nil {
+			refresher.request(keyframeSwitch)
+		}
+		s.logf("output switched to stream %s", video)
+	}
+	if audioStream != "" {
+		s.feedAudio(transport.GetIncomingStream(audioStream))
+	}
+	go s.startStreamOutputs(others)
+	s.Lock()
+	s.offered = offered
+	s.Unlock()
+	s.timeline.add(eventSignaling, fmt.Sprintf("renegotiated, %d streams added, %d removed", added, removed))
+
+	answerSDP := withTIAS(orderAnswer(answer.String(), answer, preferredCodecs()))
+	s.sdps.add(client.CmdAnswer, redactSDP(answerSDP))
+	return answerSDP, nil
+}
+
+// switchVideo feeds the output the video of the published stream id, the
+// audio staying with its stream
+func (s *session) switchVideo(id string) error {
+	s.Lock()
+	transport, refresher, videoFeed := s.transport, s.refresher, s.videoFeed
+	layers, offered := s.simulcast, s.offered[id]
+	s.Unlock()
+	if transport == nil || videoFeed == nil {
+		return errNotLive
+	}
+	if layers != nil {
+		return errSimulcastChange
+	}
+	incoming := transport.GetIncomingStream(id)
+	if !offered || incoming == nil || len(incoming.GetVideoTracks()) == 0 {
+		return errNoVideoStream
+	}
+	if incoming == videoFeed.stream {
+		return nil
+	}
+	s.feedVideo(incoming)
+	if refresher != nil {
+		refresher.request(keyframeSwitch)
+	}
+	s.timeline.add(eventSignaling, "output switched to stream "+id)
+	s.logf("output switched to stream %s", id)
+	return nil
+}
+
+// signal handles the messages of a live publish other than offers:
+// trickled candidates, renegotiations, updates, cues and data messages
+func (s *session) signal(pins *payloadPins, msg client.Message) {
+	switch msg.Cmd {
+	case client.CmdCandidate:
+		// candidates are not answered, not even when refused
+		if err := s.addCandidate(msg.Candidate); err != nil {
+			s.logf("candidate %q refused: %v", msg.Candidate, err)
+		}
+	case client.CmdRenegotiate:
+		s.timeline.add(eventSignaling, "in "+msg.Cmd)
+		s.sdps.add(client.CmdRenegotiate, redactSDP(msg.Sdp))
+		offer, err := parseOffer(msg.Sdp)
+		if err != nil {
+			s.send(client.Message{Cmd: client.CmdError, Code: client.ErrorBadOffer, Reason: err.Error()})
+			return
+		}
+		answer, err := s.renegotiate(pins, offer)
+		if err != nil {
+			s.send(client.Message{Cmd: client.CmdError, Code: client.ErrorRejected, Reason: err.Error()})
+			return
+		}
+		s.send(client.Message{Cmd: client.CmdAnswer, Sdp: answer})
+	case client.CmdUpdate:
+		s.timeline.add(eventSignaling, "in "+msg.Cmd+" "+msg.Track)
+		if err := s.switchVideo(msg.Track); err != nil {
+			s.send(client.Message{Cmd: client.CmdError, Code: client.ErrorRejected, Reason: err.Error()})
+			return
+		}
+		s.send(client.Message{Cmd: client.CmdUpdate, Track: msg.Track})
+	case client.CmdCue:
+		if msg.Cue == nil {
+			s.send(client.Message{Cmd: client.CmdError, Code: client.ErrorRejected, Reason: errBadCue.Error()})
+			return
+		}
+		s.timeline.add(eventSignaling, "in "+msg.Cmd+" "+msg.Cue.ID)
+		cue, err := s.cue(*msg.Cue)
+		if err != nil {
+			s.send(client.Message{Cmd: client.CmdError, Code: client.ErrorRejected, Reason: err.Error()})
+			return
+		}
+		s.send(client.Message{Cmd: client.CmdCue, Cue: &cue})
+	case client.CmdData:
+		// data messages come too often for the timeline
+		if err := s.relayData(msg); err != nil {
+			s.send(client.Message{Cmd: client.CmdError, Code: client.ErrorRejected, Reason: err.Error()})
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package streamserver
+
+import (
+	"testing"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/sdp"
+)
+
+func TestParseCandidate(t *testing.T) {
+	c, err := parseCandidate("a=candidate:842163049 1 udp 1677729535 203.0.113.9 61642 typ srflx raddr 10.0.0.9 rport 61642 generation 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.GetFoundation() != "842163049" || c.GetTransport() != "UDP" || c.GetPriority() != 1677729535 || c.GetAddress() != "203.0.113.9" ||
+		c.GetPort() != 61642 || c.GetType() != "srflx" || c.GetRelAddr() != "10.0.0.9" || c.GetRelPort() != 61642 {
+		t.Fatalf("candidate = %+v", c)
+	}
+	for _, bad := range []string{"candidate:1 1 udp", "candidate:1 1 udp x 192.0.2.1 9 typ host", "candidate:1 1 udp 1 192.0.2.1 9 host"} {
+		if _, err := parseCandidate(bad); err != errBadCandidate {
+			t.Errorf("%q err = %v", bad, err)
+		}
+	}
+}
+
+func TestRenegotiateNotLive(t *testing.T) {
+	sess := newSession("renegotiate", nil, presets[client.LatencyBalanced])
+	if err := sess.addCandidate(""); err != nil {
+		t.Fatalf("end of candidates err = %v", err)
+	}
+	if err := sess.addCandidate("candidate:1 1 udp 2122260223 192.0.2.1 54321 typ host"); err != errNotLive {
+		t.Fatalf("candidate before the transport err = %v", err)
+	}
+	offer, err := sdp.Parse(string(mustRead(t, "testdata/chrome_offer.sdp")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sess.renegotiate(newPayloadPins(), offer); err != errNotLive {
+		t.Fatalf("renegotiate err = %v", err)
+	}
+	if err := sess.switchVideo("screen"); err != errNotLive {
+		t.Fatalf("switch err = %v", err)
+	}
+}
+
+func TestFirstStreamWith(t *testing.T) {
+	offer, err := sdp.Parse(string(mustRead(t, "testdata/chrome_offer.sdp")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	offered := offeredStreams(offer)
+	id := firstStreamWith(offer, "video")
+	if id == "" || !offered[id] {
+		t.Fatalf("video stream %q of %v", id, offered)
+	}
+	if firstStreamWith(offer, "application") != "" {
+		t.Fatal("stream with application tracks")
+	}
+
+	f := &feed{}
+	if !f.attached() {
+		t.Fatal("new feed detached")
+	}
+	f.detach()
+	var none *feed
+	none.detach()
+	if f.attached() || none.attached() {
+		t.Fatal("detached feed attached")
+	}
+}
@@ -0,0 +1,249 @@
+package streamserver
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	gstreamer "github.com/notedit/gstreamer-go"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/ident"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/pipeline"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/restream"
+)
+
+var errRestreamFailed = errors.New("restream pipeline failed")
+
+// destinations are the third-party RTMP destinations of every stream key
+var destinations = restream.NewRegistry()
+
+// restreamOutput is the pipeline pushing a session to one destination,
+// its frames queued for the pipeline, see sideFeeder
+type restreamOutput struct {
+	pipeline *gstreamer.Pipeline
+	appsrc   *gstreamer.Element
+	// audiosrc is nil when the pipeline has no audio branch
+	audiosrc *gstreamer.Element
+	feeder   *sideFeeder
+
+	failOnce sync.Once
+	failed   chan struct{}
+}
+
+func newRestreamOutput(pipelineStr string) (*restreamOutput, error) {
+	pipeline, err := gstreamer.New(pipelineStr)
+	if err != nil {
+		return nil, err
+	}
+	out := &restreamOutput{
+		pipeline: pipeline,
+		appsrc:   pipeline.FindElement("appsrc"),
+		audiosrc: pipeline.FindElement("audiosrc"),
+		failed:   make(chan struct{}),
+	}
+	go out.watchBus(pipeline.PullMessage())
+	pipeline.Start()
+	out.feeder = newSideFeeder("restream", pipeline)
+	return out, nil
+}
+
+// watchBus drains the pipeline bus until release closes it. An error, such
+// as the destination refusing the connection, or an EOS fails the push.
+func (o *restreamOutput) watchBus(messages <-chan *gstreamer.Message) {
+	for msg := range messages {
+		if msg.GetType() == gstreamer.MESSAGE_ERROR || msg.GetType() == gstreamer.MESSAGE_EOS {
+			o.failOnce.Do(func() { close(o.failed) })
+		}
+	}
+}
+
+func (o *restreamOutput) push(frame []byte, keyframe bool) {
+	o.feeder.push(frame, keyframe)
+}
+
+func (o *restreamOutput) pushAudio(frame []byte) {
+	o.feeder.pushAudio(frame)
+}
+
+func (o *restreamOutput) release() {
+	o.appsrc.Stop()
+	if o.audiosrc != nil {
+		o.audiosrc.Stop()
+	}
+	o.pipeline.Stop()
+	o.feeder.release()
+}
+
+// restreamPipeline is the pipeline pushing the session to target, an RTMP
+// or RTMPS url, as FLV, with the session locked
+func (s *session) restreamPipeline(target string) string {
+	return s.sidePipeline(sideQueueBytes, "", pipeline.RTMP{Location: target}).String()
+}
+
+// startRestreams pushes the output to every destination of the stream key
+// not pushed to yet, with the session locked once the output started
+func (s *session) startRestreams() {
+	if s.restreams == nil {
+		s.restreams = map[string]*restreamOutput{}
+	}
+	for _, d := range destinations.List(s.key) {
+		if _, ok := s.restreams[d.ID]; !ok {
+			s.restreams[d.ID] = nil
+			go s.pushTo(d)
+		}
+	}
+}
+
+// pushTo pushes the output to d until the session ends or d is removed,
+// reconnecting after failures
+func (s *session) pushTo(d *restream.Destination) {
+	defer func() {
+		s.Lock()
+		if s.restreams != nil {
+			delete(s.restreams, d.ID)
+		}
+		s.Unlock()
+		d.Idle(time.Now())
+	}()
+	for {
+		d.Connecting(time.Now())
+		out, err := s.connectRestream(d)
+		if err == nil {
+			d.Streaming(time.Now())
+			s.logf("restreaming to %s", d.URL)
+			select {
+			case <-out.failed:
+				err = errRestreamFailed
+			case <-s.done:
+			case <-d.Removed():
+			}
+			s.disconnectRestream(d.ID, out)
+		}
+		select {
+		case <-s.done:
+			return
+		case <-d.Removed():
+			return
+		default:
+		}
+		delay := d.Failed(err, time.Now())
+		s.logf("restream to %s: %v, retrying in %s", d.URL, err, delay)
+		select {
+		case <-s.done:
+			return
+		case <-d.Removed():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// connectRestream starts the pipeline pushing to d, fed from then on
+func (s *session) connectRestream(d *restream.Destination) (*restreamOutput, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed || s.hls == nil {
+		return nil, errNotLive
+	}
+	out, err := newRestreamOutput(s.restreamPipeline(d.Target()))
+	if err != nil {
+		return nil, err
+	}
+	s.restreams[d.ID] = out
+	return out, nil
+}
+
+// disconnectRestream stops feeding out and releases it, unless close took
+// it to release
+func (s *session) disconnectRestream(id string, out *restreamOutput) {
+	s.Lock()
+	owned := s.restreams != nil && s.restreams[id] == out
+	if owned {
+		s.restreams[id] = nil
+	}
+	s.Unlock()
+	if owned {
+		out.release()
+	}
+}
+
+// destinationJSON is a destination as listed, its key hinted at only
+func destinationJSON(d *restream.Destination) gin.H {
+	return gin.H{"id": d.ID, "name": d.Name, "url": d.URL, "key": d.KeyHint(), "status": d.Status()}
+}
+
+// listRestreams handles GET /api/v1/streams/:id/restreams, the destinations
+// of a stream key and the status of their pushes
+func listRestreams(c *gin.Context) {
+	key, ok := identParam(c, "id", ident.StreamKey)
+	if !ok {
+		return
+	}
+	list := []gin.H{}
+	for _, d := range destinations.List(key) {
+		list = append(list, destinationJSON(d))
+	}
+	c.JSON(http.StatusOK, gin.H{"stream": key, "restreams": list})
+}
+
+// addRestream handles POST /api/v1/streams/:id/restreams, adding an RTMP
+// destination of a stream key: {"name": "youtube", "url":
+// "rtmp://a.rtmp.youtube.com/live2", "key": "<stream key of the platform>"}.
+// A live stream starts pushing to it right away.
+func addRestream(c *gin.Context) {
+	admin, ok := adminIdentity(c)
+	if !ok {
+		return
+	}
+	key, ok := identParam(c, "id", ident.StreamKey)
+	if !ok {
+		return
+	}
+	var req struct {
+		Name string `json:"name"`
+		URL  string `json:"url"`
+		Key  string `json:"key"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		return
+	}
+	d, err := restream.New(req.Name, req.URL, req.Key)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := destinations.Add(key, d); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Info("restream added", "stream", key, "url", d.URL, "admin", admin)
+	if sess := registry.get(key); sess != nil {
+		sess.Lock()
+		if sess.restreams != nil {
+			sess.startRestreams()
+		}
+		sess.Unlock()
+	}
+	c.JSON(http.StatusCreated, destinationJSON(d))
+}
+
+// removeRestream handles DELETE /api/v1/streams/:id/restreams/:destination,
+// stopping its push
+func removeRestream(c *gin.Context) {
+	admin, ok := adminIdentity(c)
+	if !ok {
+		return
+	}
+	key, ok := identParam(c, "id", ident.StreamKey)
+	if !ok {
+		return
+	}
+	d, err := destinations.Remove(key, c.Param("destination"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Info("restream removed", "stream", key, "url", d.URL, "admin", admin)
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,67 @@
+package streamserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+)
+
+func TestRestreamPipeline(t *testing.T) {
+	sess := newSession("restream-live", nil, presets[client.LatencyBalanced])
+	target := "rtmp://a.rtmp.youtube.com/live2/abcd"
+	if pipeline := sess.restreamPipeline(target); pipeline != `appsrc do-timestamp=true is-live=true name=appsrc ! h264parse ! tee name=video ! queue ! flvmux name=muxer streamable=true ! rtmpsink location="rtmp://a.rtmp.youtube.com/live2/abcd live=1"` {
+		t.Fatalf("pipeline = %s", pipeline)
+	}
+	sess.audio, sess.videoCodec = true, codecVP8
+	pipeline := sess.restreamPipeline(target)
+	if !strings.Contains(pipeline, "vp8dec") || !strings.Contains(pipeline, "opusdec ! audioconvert ! audioresample ! avenc_aac ! aacparse ! tee name=aac ! queue ! muxer.") {
+		t.Fatalf("vp8 pipeline = %s", pipeline)
+	}
+	sess.aacCaps = adtsCaps
+	if pipeline := sess.restreamPipeline(target); strings.Contains(pipeline, "opusdec") {
+		t.Fatalf("aac transcoded: %s", pipeline)
+	}
+}
+
+func TestRestreamAPI(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/api/v1/streams/:id/restreams", listRestreams)
+	r.POST("/api/v1/streams/:id/restreams", addRestream)
+	r.DELETE("/api/v1/streams/:id/restreams/:destination", removeRestream)
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		asAdmin(req, "ops")
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := do("POST", "/api/v1/streams/restream-api/restreams", `{"url":"http://example.com","key":"k"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("bad url = %d", w.Code)
+	}
+	w := do("POST", "/api/v1/streams/restream-api/restreams", `{"name":"twitch","url":"rtmp://live.twitch.tv/app","key":"live_secret"}`)
+	if w.Code != http.StatusCreated || strings.Contains(w.Body.String(), "live_secret") {
+		t.Fatalf("add = %d %s", w.Code, w.Body.String())
+	}
+	var added struct {
+		ID string `json:"id"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &added)
+
+	w = do("GET", "/api/v1/streams/restream-api/restreams", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"state":"idle"`) || !strings.Contains(w.Body.String(), `"key":"****cret"`) {
+		t.Fatalf("list = %d %s", w.Code, w.Body.String())
+	}
+	if w := do("DELETE", "/api/v1/streams/restream-api/restreams/"+added.ID, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("remove = %d", w.Code)
+	}
+	if w := do("DELETE", "/api/v1/streams/restream-api/restreams/"+added.ID, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("second remove = %d", w.Code)
+	}
+}
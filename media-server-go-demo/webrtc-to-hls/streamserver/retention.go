@@ -0,0 +1,348 @@
+package streamserver
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/metrics"
+)
+
+var (
+	retentionPrunedFiles = metrics.NewCounter("retention_pruned_files_total",
+		"Segments and recordings removed by retention, by reason: age, quota or disk", "reason")
+	retentionPrunedBytes = metrics.NewCounter("retention_pruned_bytes_total",
+		"Bytes of the segments and recordings removed by retention, by reason: age, quota or disk", "reason")
+	recordingsRefused = metrics.NewCounter("recordings_refused_total",
+		"Recordings refused for lack of free disk space, see record_min_free_mb", "")
+	_ = metrics.NewGaugeFunc("disk_used_ratio",
+		"Used fraction of the filesystems of the outputs and the recordings, by directory", "dir", func() map[string]float64 {
+			used := map[string]float64{}
+			for _, dir := range []string{hlsDir, recordDir()} {
+				if usage, err := readDiskUsage(dir); err == nil {
+					used[dir] = usage.ratio()
+				}
+			}
+			return used
+		})
+)
+
+var errDiskFull = errors.New("not enough free disk space to record")
+
+// reasons retention removes files for
+const (
+	// pruneAge: older than retention_max_age_hours
+	pruneAge = "age"
+	// pruneQuota: over the retention_quota_mb of their stream key
+	pruneQuota = "quota"
+	// pruneDisk: their filesystem over disk_high_watermark
+	pruneDisk = "disk"
+)
+
+// retentionSettings are those that turn retention on, with their
+// _overrides
+var retentionSettings = []string{"retention_max_age_hours", "retention_quota_mb", "disk_high_watermark"}
+
+// retentionConfigured reports whether any retention setting is set
+func retentionConfigured() bool {
+	for _, name := range retentionSettings {
+		if os.Getenv(name) != "" || os.Getenv(name+"_overrides") != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// retentionInterval is how often retention runs, retention_interval
+// seconds (60)
+func retentionInterval() time.Duration {
+	return time.Duration(envInt("retention_interval", 60)) * time.Second
+}
+
+// setupRetention starts pruning the segments of the outputs and the
+// recordings, when retention is configured, see pruneStorage
+func setupRetention() {
+	if !retentionConfigured() {
+		return
+	}
+	go func() {
+		for {
+			pruneStorage(time.Now())
+			time.Sleep(retentionInterval())
+		}
+	}()
+}
+
+// retentionFile is a segment or a recording retention may remove
+type retentionFile struct {
+	path    string
+	key     string
+	size    int64
+	modTime time.Time
+}
+
+// retentionFiles lists the segments and recordings below root, whose
+// directories are named after stream keys, oldest first, but those keep
+// reports in use. Playlists and manifests are never removed: players get
+// a 404 for the segments they list that are gone.
+func retentionFiles(root string, keep func(key, path string) bool) []retentionFile {
+	var files []retentionFile
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !retainedMedia(info.Name()) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return nil
+		}
+		key := strings.Split(filepath.ToSlash(rel), "/")[0]
+		if key == rel || keep(key, path) {
+			return nil
+		}
+		files = append(files, retentionFile{path: path, key: key, size: info.Size(), modTime: info.ModTime()})
+		return nil
+	})
+	sort.SliceStable(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	return files
+}
+
+// retainedMedia reports whether name is a file retention may remove: a
+// segment of an output or a recording
+func retainedMedia(name string) bool {
+	_, recording := recordMuxers[strings.TrimPrefix(filepath.Ext(name), ".")]
+	return segmentFile(name) || recording
+}
+
+// inUse reports whether the file at path, below the output or the
+// recordings of key, is written or served by its live session: a segment
+// of the current generation of its output, or the file it records to
+func inUse(key, path string) bool {
+	sess := registry.get(key)
+	if sess == nil {
+		return false
+	}
+	if path == sess.recordingFile() {
+		return true
+	}
+	sess.Lock()
+	generation, started := sess.generation, sess.started
+	sess.Unlock()
+	name := filepath.Base(path)
+	return started && (strings.HasPrefix(name, segmentPrefix(generation)) || strings.HasPrefix(name, llPrefix(generation)))
+}
+
+// expired are the files of files older than the max age of their key,
+// files being oldest first
+func expired(files []retentionFile, maxAge func(key string) time.Duration, now time.Time) []retentionFile {
+	var old []retentionFile
+	for _, f := range files {
+		if age := maxAge(f.key); age > 0 && now.Sub(f.modTime) > age {
+			old = append(old, f)
+		}
+	}
+	return old
+}
+
+// overQuota are the oldest files of each key whose files add up to more
+// than its quota, the files removed bringing it back under; files being
+// oldest first
+func overQuota(files []retentionFile, quota func(key string) int64) []retentionFile {
+	used := map[string]int64{}
+	for _, f := range files {
+		used[f.key] += f.size
+	}
+	var over []retentionFile
+	for _, f := range files {
+		if limit := quota(f.key); limit > 0 && used[f.key] > limit {
+			over = append(over, f)
+			used[f.key] -= f.size
+		}
+	}
+	return over
+}
+
+// oldest are the first of files adding up to need bytes at least, files
+// being oldest first
+func oldest(files []retentionFile, need int64) []retentionFile {
+	var picked []retentionFile
+	for _, f := range files {
+		if need <= 0 {
+			break
+		}
+		picked = append(picked, f)
+		need -= f.size
+	}
+	return picked
+}
+
+// retentionMaxAge is how long the segments and recordings of key are
+// kept, retention_max_age_hours / retention_max_age_hours_overrides,
+// forever when unset
+func retentionMaxAge(key string) time.Duration {
+	hours, err := strconv.Atoi(envForKey("retention_max_age_hours", key))
+	if err != nil || hours <= 0 {
+		return 0
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+// retentionQuota is how many bytes the segments and the recordings of key
+// may take, each below its own directory, retention_quota_mb /
+// retention_quota_mb_overrides, unlimited when unset
+func retentionQuota(key string) int64 {
+	mb, err := strconv.Atoi(envForKey("retention_quota_mb", key))
+	if err != nil || mb <= 0 {
+		return 0
+	}
+	return int64(mb) << 20
+}
+
+// diskUsage is the space of a filesystem, in bytes
+type diskUsage struct {
+	total, free, available uint64
+}
+
+func (u diskUsage) ratio() float64 {
+	if u.total == 0 {
+		return 0
+	}
+	return float64(u.total-u.free) / float64(u.total)
+}
+
+// above is how many bytes must be freed to bring the usage down to
+// percent of the filesystem, 0 when it is under
+func (u diskUsage) above(percent int) int64 {
+	used := u.total - u.free
+	target := u.total / 100 * uint64(percent)
+	if used <= target {
+		return 0
+	}
+	return int64(used - target)
+}
+
+// readDiskUsage reads the usage of the filesystem of dir
+func readDiskUsage(dir string) (diskUsage, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return diskUsage{}, err
+	}
+	size := uint64(st.Bsize)
+	return diskUsage{total: st.Blocks * size, free: st.Bfree * size, available: st.Bavail * size}, nil
+}
+
+// diskWatermarks are disk_high_watermark, the percent of its filesystem
+// used past which retention removes the oldest files of a directory, and
+// disk_low_watermark, the percent it removes them down to, 10 points under
+// the high one by default
+func diskWatermarks() (high, low int) {
+	high = envInt("disk_high_watermark", 0)
+	low = envInt("disk_low_watermark", high-10)
+	if low > high {
+		low = high
+	}
+	return high, low
+}
+
+// checkRecordingSpace refuses a recording to dir when its filesystem has
+// less than record_min_free_mb free, none required by default
+func checkRecordingSpace(dir string) error {
+	min := uint64(envInt("record_min_free_mb", 0)) << 20
+	if min == 0 {
+		return nil
+	}
+	usage, err := readDiskUsage(dir)
+	if err != nil {
+		return err
+	}
+	if usage.available < min {
+		recordingsRefused.Inc("")
+		return errDiskFull
+	}
+	return nil
+}
+
+// pruned counts the files removed of a stream key for a reason
+type pruned struct {
+	files int
+	bytes int64
+}
+
+// pruneStorage removes the segments of the outputs and the recordings the
+// retention settings no longer keep: those past the max age of their key,
+// the oldest of a key over its quota, then the oldest of a directory whose
+// filesystem is over the high watermark, down to the low one. Files in use
+// by live sessions are kept. Each key files were removed of is posted as
+// retention.pruned, per reason.
+func pruneStorage(now time.Time) {
+	removed := map[[2]string]*pruned{}
+	remove := func(files []retentionFile, reason string) map[string]bool {
+		gone := map[string]bool{}
+		for _, f := range files {
+			if err := os.Remove(f.path); err != nil {
+				continue
+			}
+			gone[f.path] = true
+			retentionPrunedFiles.Inc(reason)
+			retentionPrunedBytes.Add(reason, uint64(f.size))
+			p := removed[[2]string{f.key, reason}]
+			if p == nil {
+				p = &pruned{}
+				removed[[2]string{f.key, reason}] = p
+			}
+			p.files++
+			p.bytes += f.size
+		}
+		return gone
+	}
+	high, low := diskWatermarks()
+	for _, root := range []string{hlsDir, recordDir()} {
+		files := retentionFiles(root, inUse)
+		files = without(files, remove(expired(files, retentionMaxAge, now), pruneAge))
+		files = without(files, remove(overQuota(files, retentionQuota), pruneQuota))
+		if high <= 0 {
+			continue
+		}
+		usage, err := readDiskUsage(root)
+		if err != nil {
+			continue
+		}
+		if usage.above(high) > 0 {
+			logger.Warn("disk over the high watermark", "dir", root, "usage", usage.String(), "high", high, "low", low)
+			remove(oldest(files, usage.above(low)), pruneDisk)
+		}
+	}
+	for id, p := range removed {
+		key, reason := id[0], id[1]
+		logger.Info("retention pruned", "stream", key, "reason", reason, "files", p.files, "bytes", p.bytes)
+		notifyHooks(hookRetentionPruned, key, map[string]interface{}{
+			"reason": reason,
+			"files":  p.files,
+			"bytes":  p.bytes,
+		})
+	}
+}
+
+// without are files but those of gone, by path
+func without(files []retentionFile, gone map[string]bool) []retentionFile {
+	if len(gone) == 0 {
+		return files
+	}
+	kept := files[:0:0]
+	for _, f := range files {
+		if !gone[f.path] {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+// String describes u for logs, e.g. 81.5% of 100 GiB used
+func (u diskUsage) String() string {
+	return fmt.Sprintf("%.1f%% of %d GiB used", u.ratio()*100, u.total>>30)
+}
@@ -0,0 +1,107 @@
+package streamserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRetentionFiles(t *testing.T) {
+	root, err := ioutil.TempDir("", "retention")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	now := time.Now()
+	write := func(name string, size int, age time.Duration) {
+		path := filepath.Join(root, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, now.Add(-age), now.Add(-age))
+	}
+	write("live/segment-1-00001.ts", 10, 3*time.Hour)
+	write("live/segment-2-00001.ts", 20, time.Hour)
+	write("live/playlist.m3u8", 1, 3*time.Hour)
+	write("live/480p/segment-1-00001.ts", 5, 2*time.Hour)
+	write("main/main-20261014T101500.250Z.mkv", 40, 4*time.Hour)
+	write("stray.ts", 1, 5*time.Hour)
+
+	keep := func(key, path string) bool { return filepath.Base(path) == "segment-2-00001.ts" }
+	files := retentionFiles(root, keep)
+	var names []string
+	for _, f := range files {
+		rel, _ := filepath.Rel(root, f.path)
+		names = append(names, f.key+":"+filepath.ToSlash(rel))
+	}
+	want := []string{"main:main/main-20261014T101500.250Z.mkv", "live:live/segment-1-00001.ts", "live:live/480p/segment-1-00001.ts"}
+	if len(names) != len(want) {
+		t.Fatalf("files = %v", names)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("files = %v, want %v", names, want)
+		}
+	}
+}
+
+func TestRetentionPolicies(t *testing.T) {
+	now := time.Now()
+	files := []retentionFile{
+		{path: "a1", key: "a", size: 100, modTime: now.Add(-5 * time.Hour)},
+		{path: "b1", key: "b", size: 100, modTime: now.Add(-4 * time.Hour)},
+		{path: "a2", key: "a", size: 100, modTime: now.Add(-3 * time.Hour)},
+		{path: "a3", key: "a", size: 100, modTime: now.Add(-time.Hour)},
+	}
+	maxAge := func(key string) time.Duration {
+		if key == "a" {
+			return 2 * time.Hour
+		}
+		return 0
+	}
+	if old := expired(files, maxAge, now); len(old) != 2 || old[0].path != "a1" || old[1].path != "a2" {
+		t.Fatalf("expired = %v", old)
+	}
+	quota := func(key string) int64 {
+		if key == "a" {
+			return 150
+		}
+		return 0
+	}
+	if over := overQuota(files, quota); len(over) != 2 || over[0].path != "a1" || over[1].path != "a2" {
+		t.Fatalf("over quota = %v", over)
+	}
+	if picked := oldest(files, 150); len(picked) != 2 || picked[1].path != "b1" {
+		t.Fatalf("oldest = %v", picked)
+	}
+	if picked := oldest(files, 0); len(picked) != 0 {
+		t.Fatalf("oldest of nothing = %v", picked)
+	}
+	if kept := without(files, map[string]bool{"b1": true}); len(kept) != 3 || kept[1].path != "a2" || len(files) != 4 {
+		t.Fatalf("without = %v", kept)
+	}
+}
+
+func TestDiskUsage(t *testing.T) {
+	u := diskUsage{total: 1000, free: 100, available: 50}
+	if u.ratio() != 0.9 {
+		t.Fatalf("ratio = %v", u.ratio())
+	}
+	if u.above(95) != 0 || u.above(80) != 100 {
+		t.Fatalf("above 95 = %d, 80 = %d", u.above(95), u.above(80))
+	}
+	if _, err := readDiskUsage(os.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("disk_high_watermark", "90")
+	if high, low := diskWatermarks(); high != 90 || low != 80 {
+		t.Fatalf("watermarks = %d, %d", high, low)
+	}
+	t.Setenv("record_min_free_mb", "1")
+	if err := checkRecordingSpace(filepath.Join(os.TempDir(), "missing", "dir")); err == nil {
+		t.Fatal("space of a missing directory")
+	}
+}
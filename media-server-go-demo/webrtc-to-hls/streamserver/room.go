@@ -0,0 +1,426 @@
+package streamserver
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	gstreamer "github.com/notedit/gstreamer-go"
+	mediaserver "github.com/notedit/media-server-go"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/metrics"
+	"github.com/notedit/sdp"
+)
+
+var _ = metrics.NewGaugeFunc("room_participants",
+	"Participants mixed into the broadcast of a room, by stream key", "stream", func() map[string]float64 {
+		return rooms.participants()
+	})
+
+var (
+	errRoomFull    = errors.New("the room is full")
+	errRoomEnded   = errors.New("the room ended")
+	errRoomJoined  = errors.New("already in the room")
+	errRoomNoVideo = errors.New("participants publish video")
+)
+
+// protocolMixer is the ingest of the broadcast of a mixed room
+const protocolMixer = "mixer"
+
+// roomModeMixer has the publishers of a stream key join a room, mixed
+// into one broadcast, see mixedRoom
+const roomModeMixer = "mixer"
+
+// mixerVideo scales the video of the participant in a slot to its cell of
+// the grid; mixerAudio decodes its Opus for the audio mixer
+const (
+	mixerVideo = "appsrc do-timestamp=true is-live=true name=video%d %s ! videoconvert ! videoscale ! video/x-raw,width=%d,height=%d ! mix.sink_%d "
+	mixerAudio = "appsrc do-timestamp=true is-live=true format=time name=audio%d " + opusDecode + " ! audioconvert ! audioresample ! amix. "
+)
+
+// mixerOutput mixes the audio, silence keeping the mixer going without any,
+// into the AAC of the broadcast, and lays the videos out into its H.264
+const mixerOutput = "audiotestsrc is-live=true wave=silence ! amix. audiomixer name=amix ! audioconvert ! audioresample ! avenc_aac ! aacparse ! audio/mpeg,stream-format=adts ! appsink name=audiosink sync=false " +
+	"compositor name=mix background=black%s ! video/x-raw,width=%d,height=%d%s ! video/x-h264,stream-format=byte-stream,alignment=au ! appsink name=videosink sync=false"
+
+// mixedRoom reports whether the publishers of key join a room mixed into
+// one broadcast, from room_mode / room_mode_overrides: mixer, or off (the
+// default) for a single publisher
+func mixedRoom(key string) bool {
+	return strings.TrimSpace(envForKey("room_mode", key)) == roomModeMixer
+}
+
+// roomSize bounds the participants of a room, from room_size (9)
+func roomSize() int {
+	if size := envInt("room_size", 9); size > 0 {
+		return size
+	}
+	return 9
+}
+
+// gridPlacements lays n videos out in a grid of the composite, filled row
+// by row, as square as it gets
+func gridPlacements(n int) []placement {
+	cols := 1
+	for cols*cols < n {
+		cols++
+	}
+	rows := (n + cols - 1) / cols
+	width, height := compositeWidth/cols, compositeHeight/rows
+	placements := make([]placement, n)
+	for i := range placements {
+		placements[i] = placement{x: i % cols * width, y: i / cols * height, width: width, height: height}
+	}
+	return placements
+}
+
+// mixerSlot is what the mixer decodes of a participant
+type mixerSlot struct {
+	codec string
+	audio bool
+}
+
+// mixerPipelineFor mixes slots, in grid order, into a broadcast of key
+// encoded for p
+func mixerPipelineFor(slots []mixerSlot, p client.Preset, key string) string {
+	var pipeline, pads strings.Builder
+	for i, cell := range gridPlacements(len(slots)) {
+		fmt.Fprintf(&pipeline, mixerVideo, i, decoderFor(slots[i].codec), cell.width, cell.height, i)
+		if slots[i].audio {
+			fmt.Fprintf(&pipeline, mixerAudio, i)
+		}
+		fmt.Fprintf(&pads, " sink_%d::xpos=%d sink_%d::ypos=%d", i, cell.x, i, cell.y)
+	}
+	fmt.Fprintf(&pipeline, mixerOutput, pads.String(), compositeWidth, compositeHeight, transcodeEncoding(p, key))
+	return pipeline.String()
+}
+
+// participant is a publisher mixed into a room
+type participant struct {
+	room      *room
+	conn      *signaling
+	transport *mediaserver.Transport
+	refresher *keyframeRequester
+	answer    *sdp.SDPInfo
+	codec     string
+	audio     bool
+	// video and audiosrc take the frames of the participant in the current
+	// pipeline of the room, audiosrc nil without audio
+	video    *gstreamer.Element
+	audiosrc *gstreamer.Element
+}
+
+// leave removes the participant from its room
+func (p *participant) leave() {
+	p.room.remove(p)
+	p.refresher.Stop()
+	p.transport.Stop()
+}
+
+// room mixes its participants, in the order they joined, into the output
+// of an ingest session of its stream key. Joins and leaves replace the
+// mixer pipeline with one of the new grid, the output going on from its
+// first keyframe.
+type room struct {
+	sync.Mutex
+	key  string
+	sess *session
+	// audio is set when the output muxes the mixed audio
+	audio        bool
+	participants []*participant
+	pipeline     *gstreamer.Pipeline
+	ended        bool
+}
+
+// roomRegistry holds the rooms by stream key
+type roomRegistry struct {
+	sync.Mutex
+	rooms map[string]*room
+}
+
+var rooms = &roomRegistry{rooms: map[string]*room{}}
+
+// join negotiates offer on endpoint for a participant of the room of key,
+// opening the room first, and returns the answer
+func (g *roomRegistry) join(key string, endpoint *mediaserver.Endpoint, pins *payloadPins, conn *signaling, offer *sdp.SDPInfo) (*participant, string, error) {
+	video, audio := firstStreamWith(offer, "video"), firstStreamWith(offer, "audio")
+	if video == "" {
+		return nil, "", errRoomNoVideo
+	}
+	g.Lock()
+	r := g.rooms[key]
+	if r == nil {
+		var err error
+		if r, err = openRoom(key); err != nil {
+			g.Unlock()
+			return nil, "", err
+		}
+		g.rooms[key] = r
+		go g.closeWhenEnded(r)
+	}
+	g.Unlock()
+
+	pins.apply(offer)
+	transport := endpoint.CreateTransport(offer, nil)
+	transport.SetRemoteProperties(offer.GetMedia("audio"), offer.GetMedia("video"))
+	answer := offer.Answer(transport.GetLocalICEInfo(),
+		transport.GetLocalDTLSInfo(),
+		localCandidates(endpoint.GetLocalCandidates()),
+		Capabilities)
+	p := &participant{room: r, conn: conn, transport: transport, answer: answer, codec: pickVideoCodec(answer), audio: audio != ""}
+	if answerModeFor(key) == answerMinimal {
+		minimizeAnswer(answer)
+	}
+	transport.SetLocalProperties(answer.GetMedia("audio"), answer.GetMedia("video"))
+
+	incoming := map[string]*mediaserver.IncomingStream{}
+	for id, info := range offer.GetStreams() {
+		incoming[id] = transport.CreateIncomingStream(info)
+	}
+	p.refresher = newKeyframeRequester(nil, refreshPeriod(r.sess.preset, key))
+	p.refresher.AddStream(incoming[video])
+	if err := r.add(p); err != nil {
+		p.refresher.Stop()
+		transport.Stop()
+		return nil, "", err
+	}
+
+	videoTrack := incoming[video].GetVideoTracks()[0]
+	onFrame := videoTrack.OnMediaFrame
+	if p.codec != codecH264 {
+		// only H.264 is converted to Annex B
+		onFrame = videoTrack.OnRawMediaFrame
+	}
+	onFrame(func(frame []byte, timestamp uint) {
+		if len(frame) > 4 {
+			r.pushVideo(p, frame)
+		}
+	})
+	if p.audio {
+		firstAudioTrack(incoming[audio]).OnMediaFrame(func(frame []byte, timestamp uint) {
+			if len(frame) > 0 {
+				r.pushAudio(p, frame)
+			}
+		})
+	}
+	return p, orderAnswer(answer.String(), answer, preferredCodecs()), nil
+}
+
+// participants counts the participants of the rooms by stream key
+func (g *roomRegistry) participants() map[string]float64 {
+	g.Lock()
+	defer g.Unlock()
+	counts := map[string]float64{}
+	for key, r := range g.rooms {
+		r.Lock()
+		counts[key] = float64(len(r.participants))
+		r.Unlock()
+	}
+	return counts
+}
+
+// closeWhenEnded forgets r once its output ended, e.g. kicked, sending its
+// participants away
+func (g *roomRegistry) closeWhenEnded(r *room) {
+	<-r.sess.done
+	g.Lock()
+	if g.rooms[r.key] == r {
+		delete(g.rooms, r.key)
+	}
+	g.Unlock()
+	for _, p := range r.end() {
+		p.conn.close(client.CloseStreamEnded, errRoomEnded.Error())
+	}
+}
+
+// openRoom starts the output of a room of key, as an ingest session
+func openRoom(key string) (*room, error) {
+	sess, err := newIngestSession(key)
+	if err != nil {
+		return nil, err
+	}
+	sess.ingest = protocolMixer
+	sess.aacCaps = adtsCaps
+	sess.timeline.add(eventSignaling, "room opened")
+	if _, err := registry.claim(sess, conflictPolicyFor(key)); err != nil {
+		sess.close(0, "")
+		return nil, err
+	}
+	scheduled.publishStarted(key)
+	audio, err := sess.startIngest(time.Duration(envInt("room_idle_timeout", 15)) * time.Second)
+	if err != nil {
+		sess.end()
+		return nil, err
+	}
+	sess.logf("mixing room")
+	return &room{key: key, sess: sess, audio: audio}, nil
+}
+
+// add mixes p into the room
+func (r *room) add(p *participant) error {
+	r.Lock()
+	defer r.Unlock()
+	if r.ended {
+		return errRoomEnded
+	}
+	for _, joined := range r.participants {
+		if joined.conn == p.conn {
+			return errRoomJoined
+		}
+	}
+	if len(r.participants) >= roomSize() {
+		return errRoomFull
+	}
+	if err := r.remix(append(r.participants, p)); err != nil {
+		return err
+	}
+	r.sess.timeline.add(eventSignaling, "participant "+p.conn.id+" joined")
+	return nil
+}
+
+// remove stops mixing p, ending the room with its last participant
+func (r *room) remove(p *participant) {
+	r.Lock()
+	defer r.Unlock()
+	var kept []*participant
+	for _, joined := range r.participants {
+		if joined != p {
+			kept = append(kept, joined)
+		}
+	}
+	if r.ended || len(kept) == len(r.participants) {
+		return
+	}
+	r.sess.timeline.add(eventSignaling, "participant "+p.conn.id+" left")
+	if len(kept) == 0 {
+		// later joins open a new room
+		r.ended = true
+		r.stopMixer()
+		r.participants = nil
+		go r.sess.end()
+		return
+	}
+	if err := r.remix(kept); err != nil {
+		r.sess.log.get().Error("room mixer failed", "error", err)
+		go r.sess.end()
+	}
+}
+
+// remix replaces the mixer with one of participants, with the room locked
+func (r *room) remix(participants []*participant) error {
+	slots := make([]mixerSlot, len(participants))
+	for i, p := range participants {
+		slots[i] = mixerSlot{codec: p.codec, audio: p.audio}
+	}
+	pipeline, err := gstreamer.New(mixerPipelineFor(slots, r.sess.preset, r.key))
+	if err != nil {
+		return err
+	}
+	videos := pumpFrames(pipeline.FindElement("videosink").Poll())
+	audios := pumpFrames(pipeline.FindElement("audiosink").Poll())
+	go func() {
+		// drained until Stop closes it
+		for range pipeline.PullMessage() {
+		}
+	}()
+	r.stopMixer()
+	r.participants, r.pipeline = participants, pipeline
+	for i, p := range participants {
+		p.video = pipeline.FindElement(fmt.Sprintf("video%d", i))
+		p.audiosrc = pipeline.FindElement(fmt.Sprintf("audio%d", i))
+	}
+	pipeline.Start()
+	go r.pump(pipeline, videos, audios)
+	// the decoders of the new pipeline start from keyframes
+	for _, p := range participants {
+		p.refresher.request(keyframeSwitch)
+	}
+	return nil
+}
+
+// stopMixer stops the current pipeline, with the room locked
+func (r *room) stopMixer() {
+	if r.pipeline == nil {
+		return
+	}
+	for _, p := range r.participants {
+		p.video.Stop()
+		if p.audiosrc != nil {
+			p.audiosrc.Stop()
+		}
+	}
+	r.pipeline.Stop()
+	r.pipeline = nil
+}
+
+// pump feeds the mixed frames of pipeline to the output while it is the
+// current one
+func (r *room) pump(pipeline *gstreamer.Pipeline, videos, audios <-chan []byte) {
+	for videos != nil || audios != nil {
+		select {
+		case frame, ok := <-videos:
+			if !ok {
+				videos = nil
+			} else if r.current(pipeline) {
+				r.sess.ingestVideo(frame, videoKeyframe(codecH264, frame))
+			}
+		case frame, ok := <-audios:
+			if !ok {
+				audios = nil
+			} else if r.current(pipeline) {
+				r.sess.ingestAudio(frame, r.audio)
+			}
+		}
+	}
+}
+
+func (r *room) current(pipeline *gstreamer.Pipeline) bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.pipeline == pipeline
+}
+
+func (r *room) pushVideo(p *participant, frame []byte) {
+	r.Lock()
+	defer r.Unlock()
+	if r.pipeline != nil && p.video != nil {
+		p.video.Push(frame)
+	}
+}
+
+func (r *room) pushAudio(p *participant, frame []byte) {
+	r.Lock()
+	defer r.Unlock()
+	if r.pipeline != nil && p.audiosrc != nil {
+		p.audiosrc.Push(frame)
+	}
+}
+
+// end stops mixing the room, returning the participants left
+func (r *room) end() []*participant {
+	r.Lock()
+	defer r.Unlock()
+	r.ended = true
+	r.stopMixer()
+	left := r.participants
+	r.participants = nil
+	return left
+}
+
+// info describes the room to p, who joined it
+func (r *room) info(p *participant) *client.SessionInfo {
+	return &client.SessionInfo{
+		ID:       r.sess.id,
+		Stream:   r.key,
+		Codecs:   answeredCodecs(p.answer),
+		Mode:     client.ModeMixed,
+		Preset:   r.sess.preset.Name,
+		Profile:  r.sess.profile.Name,
+		Kind:     client.KindVideo,
+		Audio:    r.audio && p.audio,
+		Answer:   answerModeFor(r.key),
+		Playlist: playlistPath(r.sess),
+	}
+}
@@ -0,0 +1,49 @@
+package streamserver
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+)
+
+func TestMixedRoom(t *testing.T) {
+	t.Setenv("room_mode_overrides", "standup="+roomModeMixer)
+	if !mixedRoom("standup") || mixedRoom("keynote") {
+		t.Fatal("room mode of the overrides")
+	}
+}
+
+func TestGridPlacements(t *testing.T) {
+	for n, want := range map[int][]placement{
+		1: {{0, 0, 1280, 720}},
+		2: {{0, 0, 640, 720}, {640, 0, 640, 720}},
+		3: {{0, 0, 640, 360}, {640, 0, 640, 360}, {0, 360, 640, 360}},
+		5: {{0, 0, 426, 360}, {426, 0, 426, 360}, {852, 0, 426, 360}, {0, 360, 426, 360}, {426, 360, 426, 360}},
+	} {
+		if got := gridPlacements(n); !reflect.DeepEqual(got, want) {
+			t.Fatalf("grid of %d = %v", n, got)
+		}
+	}
+}
+
+func TestMixerPipeline(t *testing.T) {
+	p := presets[client.LatencyBalanced]
+	pipeline := mixerPipelineFor([]mixerSlot{{codec: codecH264, audio: true}, {codec: codecVP8}}, p, "standup")
+	for _, part := range []string{
+		"name=video0 ! h264parse ! avdec_h264 ! videoconvert ! videoscale ! video/x-raw,width=640,height=720 ! mix.sink_0 ",
+		"name=audio0 " + opusDecode + " ! audioconvert ! audioresample ! amix. ",
+		"name=video1 caps=video/x-vp8 ! vp8dec ! videoconvert ! videoscale ! video/x-raw,width=640,height=720 ! mix.sink_1 ",
+		"compositor name=mix background=black sink_0::xpos=0 sink_0::ypos=0 sink_1::xpos=640 sink_1::ypos=0 ! video/x-raw,width=1280,height=720",
+		"appsink name=videosink",
+		"appsink name=audiosink",
+	} {
+		if !strings.Contains(pipeline, part) {
+			t.Fatalf("mixer pipeline lacks %q:\n%s", part, pipeline)
+		}
+	}
+	if strings.Contains(pipeline, "name=audio1") {
+		t.Fatalf("mixer pipeline mixes the audio of a participant without:\n%s", pipeline)
+	}
+}
@@ -0,0 +1,178 @@
+package streamserver
+
+import (
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/pubauth"
+	rtmp "github.com/notedit/rtmp-lib"
+	"github.com/notedit/rtmp-lib/aac"
+	"github.com/notedit/rtmp-lib/av"
+	"github.com/notedit/rtmp-lib/h264"
+)
+
+var errNoRTMPVideo = errors.New("rtmp publish has no h264 video")
+
+// setupRTMP listens for RTMP publishers on rtmp_listen, e.g. :1935, when
+// set, for encoders that do not speak WebRTC
+func setupRTMP() {
+	address := os.Getenv("rtmp_listen")
+	if address == "" {
+		return
+	}
+	server := &rtmp.Server{Addr: address, HandlePublish: rtmpPublish}
+	go func() {
+		fatal("rtmp listener failed", server.ListenAndServe())
+	}()
+}
+
+// rtmpKey returns the stream key of a publish to u, its last path segment
+// as in rtmp://host/live/key, and the token query parameter, the ingest
+// credential: rtmp://host/live/key?token=secret
+func rtmpKey(u *url.URL) (key, credential string) {
+	if u == nil {
+		return "", ""
+	}
+	key = path.Base(u.Path)
+	if key == "/" || key == "." {
+		key = ""
+	}
+	return key, u.Query().Get("token")
+}
+
+// rtmpPublish handles an RTMP publish: H.264 video, AAC audio optionally,
+// packaged like the media of a WebRTC publisher. The session is relayed to
+// WebRTC viewers too. It ends when the connection does.
+func rtmpPublish(conn *rtmp.Conn) {
+	defer conn.Close()
+	name, credential := rtmpKey(conn.URL)
+	key, _, err := publishIDs(client.Message{StreamID: name}, nil)
+	if err != nil {
+		logger.Warn("rtmp publish rejected", "stream", name, "error", err)
+		return
+	}
+	identity, err := auth.authorize(pubauth.Request{Key: key, Credential: credential})
+	if err != nil {
+		logger.Warn("publish unauthorized", "stream", key, "identity", identity, "error", err)
+		return
+	}
+	if _, err := admitPublish(client.Message{}, key); err != nil {
+		logger.Warn("rtmp publish rejected", "stream", key, "error", err)
+		return
+	}
+	streams, err := conn.Streams()
+	var video h264.CodecData
+	var audio *aac.CodecData
+	if err == nil {
+		video, audio, err = rtmpCodecs(streams)
+	}
+	if err != nil {
+		logger.Warn("rtmp publish rejected", "stream", key, "error", err)
+		return
+	}
+	policy, err := ingestPolicy(key)
+	if err != nil {
+		logger.Warn("rtmp publish rejected", "stream", key, "error", err)
+		return
+	}
+	sess, err := newIngestSession(key)
+	if err != nil {
+		logger.Error("rtmp publish error", "stream", key, "error", err)
+		return
+	}
+	sess.ingest = protocolRTMP
+	sess.policy = policy
+	sess.rtmp = conn
+	sess.identity = identity
+	if audio != nil {
+		sess.aacCaps = aacCaps(*audio)
+	}
+	sess.timeline.add(eventSignaling, "in rtmp publish")
+	if _, err := registry.claim(sess, conflictPolicyFor(key)); err != nil {
+		logger.Warn("publish rejected", "stream", key, "error", err)
+		sess.close(0, "")
+		return
+	}
+	scheduled.publishStarted(key)
+	sess.logf("publishing over rtmp from %s", conn.NetConn().RemoteAddr())
+	if err := sess.ingestRTMP(conn, streams, video); err != nil {
+		sess.logf("rtmp ingest ended: %v", err)
+	}
+	sess.end()
+}
+
+// rtmpCodecs returns the H.264 video and the AAC audio, if any, of the
+// streams of an RTMP publish
+func rtmpCodecs(streams []av.CodecData) (video h264.CodecData, audio *aac.CodecData, err error) {
+	found := false
+	for _, stream := range streams {
+		switch stream.Type() {
+		case av.H264:
+			video, found = stream.(h264.CodecData), true
+		case av.AAC:
+			codec := stream.(aac.CodecData)
+			audio = &codec
+		}
+	}
+	if !found {
+		return video, nil, errNoRTMPVideo
+	}
+	return video, audio, nil
+}
+
+// aacCaps are the caps of the raw AAC frames of an RTMP publish
+func aacCaps(codec aac.CodecData) string {
+	return "caps=audio/mpeg,mpegversion=4,stream-format=raw,codec_data=(buffer)" + hex.EncodeToString(codec.MPEG4AudioConfigBytes())
+}
+
+// annexB converts a length prefixed H.264 access unit of RTMP to Annex B,
+// the keyframes led by parameterSets, the SPS and PPS of the publish
+func annexB(data []byte, keyframe bool, parameterSets ...[]byte) []byte {
+	nalus, _ := h264.SplitNALUs(data)
+	if keyframe {
+		nalus = append(parameterSets, nalus...)
+	}
+	var frame []byte
+	for _, nalu := range nalus {
+		frame = append(frame, 0, 0, 0, 1)
+		frame = append(frame, nalu...)
+	}
+	return frame
+}
+
+// ingestRTMP feeds the packets read from conn to the output and the relay
+// until the connection fails or is closed
+func (s *session) ingestRTMP(conn *rtmp.Conn, streams []av.CodecData, video h264.CodecData) error {
+	audio, err := s.startIngest(time.Duration(envInt("rtmp_idle_timeout", 15)) * time.Second)
+	if err != nil {
+		return err
+	}
+	var firstFrame, firstAudio sync.Once
+	for {
+		packet, err := conn.ReadPacket()
+		if err != nil {
+			return err
+		}
+		if int(packet.Idx) >= len(streams) || len(packet.Data) == 0 {
+			continue
+		}
+		switch streams[packet.Idx].Type() {
+		case av.H264:
+			firstFrame.Do(func() {
+				s.timeline.add(eventMedia, "first video frame")
+			})
+			s.ingestVideo(annexB(packet.Data, packet.IsKeyFrame, video.SPS(), video.PPS()), packet.IsKeyFrame)
+		case av.AAC:
+			firstAudio.Do(func() {
+				s.timeline.add(eventMedia, "first audio frame")
+			})
+			s.ingestAudio(packet.Data, audio)
+		}
+	}
+}
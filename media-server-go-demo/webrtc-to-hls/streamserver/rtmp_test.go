@@ -0,0 +1,69 @@
+package streamserver
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/rtmp-lib/aac"
+	"github.com/notedit/rtmp-lib/av"
+)
+
+func TestRTMPKey(t *testing.T) {
+	for uri, want := range map[string][2]string{
+		"/live/main":              {"main", ""},
+		"/live/main?token=secret": {"main", "secret"},
+		"/live/":                  {"live", ""},
+		"/":                       {"", ""},
+	} {
+		u, err := url.ParseRequestURI(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key, credential := rtmpKey(u); key != want[0] || credential != want[1] {
+			t.Errorf("%s = %q, %q", uri, key, credential)
+		}
+	}
+	if key, _ := rtmpKey(nil); key != "" {
+		t.Fatal("key without url")
+	}
+}
+
+func TestAnnexB(t *testing.T) {
+	sps, pps := []byte{0x67, 0x42}, []byte{0x68, 0xce}
+	// an IDR and an SEI, length prefixed
+	avcc := []byte{0, 0, 0, 2, 0x65, 0x88, 0, 0, 0, 1, 0x06}
+	want := []byte{0, 0, 0, 1, 0x67, 0x42, 0, 0, 0, 1, 0x68, 0xce, 0, 0, 0, 1, 0x65, 0x88, 0, 0, 0, 1, 0x06}
+	if frame := annexB(avcc, true, sps, pps); !bytes.Equal(frame, want) {
+		t.Fatalf("keyframe = % x", frame)
+	}
+	if frame := annexB([]byte{0, 0, 0, 2, 0x41, 0x9a}, false, sps, pps); !bytes.Equal(frame, []byte{0, 0, 0, 1, 0x41, 0x9a}) {
+		t.Fatalf("frame = % x", frame)
+	}
+	if videoKeyframe(codecH264, annexB(avcc, true, sps, pps)) != true {
+		t.Fatal("converted keyframe not seen")
+	}
+}
+
+func TestRTMPCodecs(t *testing.T) {
+	audio, err := aac.NewCodecDataFromMPEG4AudioConfigBytes([]byte{0x12, 0x10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := rtmpCodecs([]av.CodecData{audio}); err != errNoRTMPVideo {
+		t.Fatalf("audio only = %v", err)
+	}
+	caps := aacCaps(audio)
+	if caps != "caps=audio/mpeg,mpegversion=4,stream-format=raw,codec_data=(buffer)1210" {
+		t.Fatalf("caps = %s", caps)
+	}
+
+	sess := newSession("main", nil, presets[client.LatencyBalanced])
+	sess.aacCaps = caps
+	pipeline := sess.outputPipeline("hls/main", 4, true, false).String()
+	if strings.Contains(pipeline, "opusdec") || !strings.Contains(pipeline, "name=audiosrc "+caps+" ! aacparse ! tee name=aac ") {
+		t.Fatalf("aac pipeline = %s", pipeline)
+	}
+}
@@ -0,0 +1,506 @@
+package streamserver
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	gstreamer "github.com/notedit/gstreamer-go"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/external"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/hlscheck"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/ident"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/playlist"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/restream"
+)
+
+// placeholders served before the publisher connects
+const (
+	placeholderSlate   = "slate"
+	placeholderOffline = "offline"
+)
+
+// states of a scheduled stream
+const (
+	scheduledWaiting = "scheduled"
+	scheduledLive    = "live"
+	scheduledEnded   = "ended"
+	scheduledExpired = "expired"
+)
+
+// scheduledHooks are the lifecycle events posted as a scheduled stream
+// enters each state
+var scheduledHooks = map[string]string{
+	scheduledWaiting: hookScheduledCreated,
+	scheduledLive:    hookScheduledLive,
+	scheduledEnded:   hookScheduledEnded,
+	scheduledExpired: hookScheduledExpired,
+}
+
+// slatePlaylistLength is the window of the slate playlist
+const slatePlaylistLength = 3
+
+var slatePipelineStr = "videotestsrc is-live=true pattern=smpte ! video/x-raw,width=640,height=360,framerate=25/1 ! textoverlay text=%s valignment=center halignment=center font-desc=\"Sans 24\" ! x264enc tune=zerolatency key-int-max=50 ! h264parse ! mpegtsmux ! hlssink location=%s playlist-location=%s target-duration=2 max-files=6 playlist-length=%d"
+
+var slateSegment = regexp.MustCompile(`^segment\d{5}\.ts$`)
+
+// scheduledRestream is a destination the publish of a scheduled stream
+// pushes to, as listed: its key is only hinted at
+type scheduledRestream struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	URL  string `json:"url"`
+	Key  string `json:"key"`
+}
+
+// scheduledStream is a playback id provisioned ahead of its event
+type scheduledStream struct {
+	ID          string    `json:"id"`
+	Key         string    `json:"key"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	Placeholder string    `json:"placeholder"`
+	State       string    `json:"state"`
+	Playlist    string    `json:"playlist"`
+	// Record records the publish of the key while the stream is live
+	Record bool `json:"record"`
+	// Restreams are added to the destinations of the key until the stream
+	// ends or expires
+	Restreams []scheduledRestream `json:"restreams,omitempty"`
+
+	slate    *gstreamer.Pipeline
+	slateDir string
+	// takeover continues the slate playlist with the live one, from the
+	// publish on; nil without a slate
+	takeover *continuation
+}
+
+// notify posts the lifecycle event of the state s entered
+func (s scheduledStream) notify() {
+	notifyHooks(scheduledHooks[s.State], s.Key, map[string]interface{}{
+		"scheduled": s.ID, "start": s.Start, "end": s.End, "playlist": s.Playlist,
+	})
+}
+
+type scheduledRegistry struct {
+	sync.Mutex
+	streams map[string]*scheduledStream
+}
+
+var scheduled = &scheduledRegistry{streams: map[string]*scheduledStream{}}
+
+func (r *scheduledRegistry) get(id string) *scheduledStream {
+	r.Lock()
+	defer r.Unlock()
+	return r.streams[id]
+}
+
+func (r *scheduledRegistry) list() []scheduledStream {
+	r.Lock()
+	defer r.Unlock()
+	streams := make([]scheduledStream, 0, len(r.streams))
+	for _, s := range r.streams {
+		streams = append(streams, *s)
+	}
+	return streams
+}
+
+// transition moves every entry bound to key from one state to another.
+// The slate of an entry going live stops, the segments it listed staying
+// in its playlist until the live ones replace them.
+func (r *scheduledRegistry) transition(key, from, to string) {
+	var moved []scheduledStream
+	r.Lock()
+	for _, s := range r.streams {
+		if s.Key != key || s.State != from {
+			continue
+		}
+		s.State = to
+		logger.Info("scheduled stream "+to, "stream", key, "scheduled", s.ID)
+		if to == scheduledLive {
+			s.takeOver()
+		} else {
+			s.removeSlate()
+			s.removeRestreams()
+		}
+		if to == scheduledEnded && time.Now().After(s.End) {
+			delete(r.streams, s.ID)
+		}
+		moved = append(moved, *s)
+	}
+	r.Unlock()
+	for _, s := range moved {
+		s.notify()
+	}
+}
+
+// publishStarted hands the scheduled ids bound to key over to the publisher
+func (r *scheduledRegistry) publishStarted(key string) {
+	r.transition(key, scheduledWaiting, scheduledLive)
+}
+
+func (r *scheduledRegistry) publishEnded(key string) {
+	r.transition(key, scheduledLive, scheduledEnded)
+}
+
+// expire drops id at the end of its window, unless it is still live, in
+// which case it goes when the publish ends
+func (r *scheduledRegistry) expire(id string) {
+	r.Lock()
+	s := r.streams[id]
+	if s == nil || s.State == scheduledLive {
+		r.Unlock()
+		return
+	}
+	s.removeSlate()
+	s.removeRestreams()
+	delete(r.streams, id)
+	expired := s.State == scheduledWaiting
+	if expired {
+		s.State = scheduledExpired
+		logger.Info("scheduled stream "+scheduledExpired, "stream", s.Key, "scheduled", s.ID)
+	}
+	r.Unlock()
+	if expired {
+		s.notify()
+	}
+}
+
+// records reports whether the publish of key is recorded for a scheduled
+// stream it is live for
+func (r *scheduledRegistry) records(key string) bool {
+	r.Lock()
+	defer r.Unlock()
+	for _, s := range r.streams {
+		if s.Key == key && s.State == scheduledLive && s.Record {
+			return true
+		}
+	}
+	return false
+}
+
+// addRestreams adds destinations to those of the key of s; none is added
+// when one cannot be
+func (s *scheduledStream) addRestreams(added []*restream.Destination) error {
+	for i, d := range added {
+		if err := destinations.Add(s.Key, d); err != nil {
+			for _, d := range added[:i] {
+				destinations.Remove(s.Key, d.ID)
+			}
+			return err
+		}
+	}
+	for _, d := range added {
+		s.Restreams = append(s.Restreams, scheduledRestream{ID: d.ID, Name: d.Name, URL: d.URL, Key: d.KeyHint()})
+	}
+	return nil
+}
+
+// removeRestreams removes the destinations s added, stopping their pushes;
+// it must be called with the registry lock held
+func (s *scheduledStream) removeRestreams() {
+	for _, d := range s.Restreams {
+		destinations.Remove(s.Key, d.ID)
+	}
+	s.Restreams = nil
+}
+
+// startSlate renders the placeholder into its own directory
+func (s *scheduledStream) startSlate() error {
+	dir, err := ioutil.TempDir("", "slate-"+s.ID)
+	if err != nil {
+		return err
+	}
+	text := strconv.Quote("Starting " + s.Start.UTC().Format("Jan 2 15:04 MST"))
+	pipeline, err := gstreamer.New(fmt.Sprintf(slatePipelineStr, text,
+		strconv.Quote(filepath.Join(dir, "segment%05d.ts")), strconv.Quote(filepath.Join(dir, playlistName)), slatePlaylistLength))
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	pipeline.Start()
+	s.slate, s.slateDir = pipeline, dir
+	return nil
+}
+
+// stopSlate stops rendering the slate, its segments staying on disk; it must
+// be called with the registry lock held, like removeSlate
+func (s *scheduledStream) stopSlate() {
+	if s.slate != nil {
+		s.slate.Stop()
+		s.slate = nil
+	}
+}
+
+// removeSlate stops the slate and removes its segments
+func (s *scheduledStream) removeSlate() {
+	s.stopSlate()
+	if s.slateDir != "" {
+		os.RemoveAll(s.slateDir)
+		s.slateDir = ""
+	}
+	s.takeover = nil
+}
+
+// takeOver stops the slate at the publish of the key, its last playlist
+// going on with the live one after a discontinuity: players keep reloading
+// the scheduled playlist
+func (s *scheduledStream) takeOver() {
+	s.stopSlate()
+	if s.slateDir == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(filepath.Join(s.slateDir, playlistName))
+	if err != nil {
+		return
+	}
+	m, err := hlscheck.ParseMedia(data)
+	if err != nil || len(m.Segments) == 0 {
+		return
+	}
+	window := slatePlaylistLength
+	if sess := registry.get(s.Key); sess != nil {
+		window = sess.preset.PlaylistLength
+	}
+	previous := &playlist.Media{TargetDuration: m.TargetDuration, MediaSequence: m.MediaSequence}
+	for _, segment := range m.Segments {
+		previous.Segments = append(previous.Segments, playlist.Segment{URI: segment.URI, Duration: segment.Duration})
+	}
+	s.takeover = &continuation{stream: playlist.Resume(previous, window)}
+}
+
+// createScheduledStream handles POST /api/scheduled-streams, provisioning
+// a playback id for the publishes of a stream key between start and end:
+// {"id": "launch", "key": "main", "start": ..., "end": ..., "placeholder":
+// "slate", "record": true, "restreams": [{"name": "youtube", "url":
+// "rtmp://a.rtmp.youtube.com/live2", "key": "<stream key of the
+// platform>"}]}. Its playlist is served from then on, the placeholder
+// until the key goes live.
+func createScheduledStream(c *gin.Context) {
+	admin, ok := adminIdentity(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		ID          string    `json:"id"`
+		Key         string    `json:"key"`
+		Start       time.Time `json:"start"`
+		End         time.Time `json:"end"`
+		Placeholder string    `json:"placeholder"`
+		Record      bool      `json:"record"`
+		Restreams   []struct {
+			Name string `json:"name"`
+			URL  string `json:"url"`
+			Key  string `json:"key"`
+		} `json:"restreams"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		return
+	}
+	if req.ID == "" {
+		req.ID = randomID()
+	}
+	if req.Placeholder == "" {
+		req.Placeholder = placeholderOffline
+	}
+	keyErr := ident.Check(ident.StreamKey, req.Key)
+	switch {
+	case !external.ValidID(req.ID):
+		c.JSON(http.StatusBadRequest, gin.H{"error": external.ErrBadID.Error()})
+		return
+	case keyErr != nil:
+		c.JSON(http.StatusBadRequest, gin.H{"error": keyErr.Error()})
+		return
+	case req.End.Before(time.Now()) || !req.End.After(req.Start):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "end must be in the future and after start"})
+		return
+	case req.Placeholder != placeholderSlate && req.Placeholder != placeholderOffline:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "placeholder must be slate or offline"})
+		return
+	}
+	var restreams []*restream.Destination
+	for _, r := range req.Restreams {
+		d, err := restream.New(r.Name, r.URL, r.Key)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		restreams = append(restreams, d)
+	}
+
+	s := &scheduledStream{
+		ID:          req.ID,
+		Key:         req.Key,
+		Start:       req.Start,
+		End:         req.End,
+		Placeholder: req.Placeholder,
+		State:       scheduledWaiting,
+		Playlist:    "/hls/" + req.ID + "/playlist.m3u8",
+		Record:      req.Record,
+	}
+	scheduled.Lock()
+	if scheduled.streams[s.ID] != nil || externalStreams.Get(s.ID) != nil {
+		scheduled.Unlock()
+		c.JSON(http.StatusConflict, gin.H{"error": "id already in use"})
+		return
+	}
+	if err := s.addRestreams(restreams); err != nil {
+		scheduled.Unlock()
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if s.Placeholder == placeholderSlate {
+		if err := s.startSlate(); err != nil {
+			s.removeRestreams()
+			scheduled.Unlock()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	time.AfterFunc(time.Until(s.End), func() { scheduled.expire(s.ID) })
+	scheduled.streams[s.ID] = s
+	created := *s
+	scheduled.Unlock()
+	if sess := registry.get(s.Key); sess != nil && len(restreams) > 0 {
+		// already live, e.g. rehearsing ahead of the window
+		sess.Lock()
+		if sess.restreams != nil {
+			sess.startRestreams()
+		}
+		sess.Unlock()
+	}
+	logger.Info("scheduled stream created", "stream", created.Key, "scheduled", created.ID, "admin", admin)
+	created.notify()
+	c.JSON(http.StatusCreated, created)
+}
+
+// listScheduledStreams handles GET /api/scheduled-streams
+func listScheduledStreams(c *gin.Context) {
+	c.JSON(http.StatusOK, scheduled.list())
+}
+
+// getScheduledStream handles GET /api/scheduled-streams/:id
+func getScheduledStream(c *gin.Context) {
+	scheduled.Lock()
+	s := scheduled.streams[c.Param("id")]
+	var found scheduledStream
+	if s != nil {
+		found = *s
+	}
+	scheduled.Unlock()
+	if s == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no such scheduled stream"})
+		return
+	}
+	c.JSON(http.StatusOK, found)
+}
+
+// serveScheduledStream serves /hls/:id/ for a scheduled id: the placeholder
+// until the publisher connects, then the live output, the slate segments
+// followed by a discontinuity and the live ones
+func serveScheduledStream(c *gin.Context, id, name string) bool {
+	scheduled.Lock()
+	s := scheduled.streams[id]
+	if s == nil {
+		scheduled.Unlock()
+		return false
+	}
+	state, placeholder, dir, key := s.State, s.Placeholder, s.slateDir, s.Key
+	scheduled.Unlock()
+
+	switch {
+	case state == scheduledLive && name == playlistName:
+		if data, ok := scheduledPlaylist(id, key); ok {
+			c.Header("Cache-Control", "no-cache")
+			c.Data(http.StatusOK, "application/vnd.apple.mpegurl", data)
+			break
+		}
+		c.Redirect(http.StatusFound, outputPath(key))
+	case state == scheduledLive && dir != "" && slateSegment.MatchString(name):
+		// the slate segments still listed by the taken over playlist
+		path, err := ident.Join(dir, name)
+		if err != nil {
+			c.Status(http.StatusNotFound)
+			break
+		}
+		c.File(path)
+	case state == scheduledLive:
+		c.Redirect(http.StatusFound, "/hls/"+key+"/"+name)
+	case state == scheduledWaiting && placeholder == placeholderSlate && (name == playlistName || slateSegment.MatchString(name)):
+		path, err := ident.Join(dir, name)
+		if err != nil {
+			c.Status(http.StatusNotFound)
+			break
+		}
+		c.Header("Cache-Control", "no-cache")
+		c.File(path)
+	case name == playlistName && strings.Contains(c.GetHeader("Accept"), "application/json"):
+		c.JSON(http.StatusOK, gin.H{"id": id, "state": state, "start": s.Start})
+	default:
+		c.Status(http.StatusNoContent)
+	}
+	return true
+}
+
+// scheduledPlaylist returns the live playlist of key as the playlist of the
+// scheduled id, its segments referred to below /hls/<key>/ and continuing
+// the slate if there was one. fMP4 and LL-HLS playlists, whose tags are not
+// carried over, are left to a redirect, as is a key without output.
+func scheduledPlaylist(id, key string) ([]byte, bool) {
+	out := outputs.lookup(key)
+	if out == nil {
+		return nil, false
+	}
+	data, err := ioutil.ReadFile(out.playlist())
+	if err != nil {
+		data = nil
+	}
+	var m *hlscheck.Media
+	if data != nil {
+		data, _ = out.generations.continuedPlaylist(data)
+		if m, err = hlscheck.ParseMedia(data); err != nil || m.Map != "" || m.LowLatency != "" {
+			return nil, false
+		}
+		for i, segment := range m.Segments {
+			if !strings.Contains(segment.URI, "://") && !strings.HasPrefix(segment.URI, "/") {
+				m.Segments[i].URI = "/hls/" + key + "/" + segment.URI
+			}
+		}
+	}
+
+	scheduled.Lock()
+	defer scheduled.Unlock()
+	s := scheduled.streams[id]
+	if s == nil {
+		return nil, false
+	}
+	if c := s.takeover; c != nil {
+		switch {
+		case m == nil:
+			// no live segment yet, the slate goes on
+			return c.render(), true
+		case c.sync(m):
+			return c.render(), true
+		}
+		// a later publish of the key, which players get as is
+		s.takeover = nil
+	}
+	if m == nil {
+		return nil, false
+	}
+	live := &playlist.Media{TargetDuration: m.TargetDuration, MediaSequence: m.MediaSequence, Ended: m.Ended}
+	for _, segment := range m.Segments {
+		live.Segments = append(live.Segments, playlist.Segment{URI: segment.URI, Duration: segment.Duration})
+	}
+	var buf bytes.Buffer
+	live.Write(&buf)
+	return buf.Bytes(), true
+}
@@ -0,0 +1,195 @@
+package streamserver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/hlscheck"
+)
+
+func TestScheduledStream(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/api/scheduled-streams", createScheduledStream)
+	r.GET("/hls/:id/*file", serveExternalStream)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		asAdmin(req, "ops@example.com")
+		r.ServeHTTP(w, req)
+		return w
+	}
+	end := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	start := time.Now().UTC().Format(time.RFC3339)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/api/scheduled-streams", strings.NewReader(`{"id":"launch","key":"main","end":"`+end+`"}`)))
+	if w.Code != http.StatusUnauthorized || scheduled.get("launch") != nil {
+		t.Fatalf("create without an admin = %d", w.Code)
+	}
+
+	if w := do("POST", "/api/scheduled-streams", `{"id":"launch","key":"main","start":"`+start+`","end":"`+end+`"}`); w.Code != http.StatusCreated {
+		t.Fatalf("create = %d %s", w.Code, w.Body)
+	}
+	if w := do("POST", "/api/scheduled-streams", `{"id":"launch","key":"other","start":"`+start+`","end":"`+end+`"}`); w.Code != http.StatusConflict {
+		t.Fatalf("duplicate = %d", w.Code)
+	}
+	if w := do("POST", "/api/scheduled-streams", `{"key":"main","start":"`+end+`","end":"`+start+`"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("bad window = %d", w.Code)
+	}
+
+	if w := do("GET", "/hls/launch/playlist.m3u8", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("offline placeholder = %d", w.Code)
+	}
+	scheduled.publishStarted("main")
+	// without an output yet
+	if w := do("GET", "/hls/launch/playlist.m3u8", ""); w.Code != http.StatusFound || w.Header().Get("Location") != outputPath("main") {
+		t.Fatalf("live = %d %q", w.Code, w.Header().Get("Location"))
+	}
+	scheduled.publishEnded("main")
+	if s := scheduled.get("launch"); s == nil || s.State != scheduledEnded {
+		t.Fatalf("after publish = %+v", s)
+	}
+	scheduled.expire("launch")
+	if w := do("GET", "/hls/launch/playlist.m3u8", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expired = %d", w.Code)
+	}
+}
+
+// TestScheduledTakeover follows a player of a scheduled id from the slate
+// to the live output, through the same playlist
+func TestScheduledTakeover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scheduled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	savedDir, savedOutputs := hlsDir, outputs
+	hlsDir, outputs = dir, newStreamOutputs(time.Now)
+	defer func() { hlsDir, outputs = savedDir, savedOutputs }()
+	events, cancel := controlEvents.Subscribe(8)
+	defer cancel()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/api/scheduled-streams", createScheduledStream)
+	r.GET("/hls/:id/*file", serveExternalStream)
+	do := func(path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		method := "GET"
+		if body != "" {
+			method = "POST"
+		}
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		asAdmin(req, "ops@example.com")
+		r.ServeHTTP(w, req)
+		return w
+	}
+	end := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	if w := do("/api/scheduled-streams", `{"id":"premiere","key":"stage","placeholder":"slate","start":"`+end+`","end":"`+end+`1"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("bad end = %d", w.Code)
+	}
+	if w := do("/api/scheduled-streams", `{"id":"premiere","key":"stage","placeholder":"slate","end":"`+end+`"}`); w.Code != http.StatusCreated {
+		t.Fatalf("create = %d %s", w.Code, w.Body)
+	}
+	defer scheduled.expire("premiere")
+	slate := scheduled.get("premiere").slateDir
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:7\n")
+	for i := 7; i < 10; i++ {
+		ioutil.WriteFile(filepath.Join(slate, fmt.Sprintf("segment%05d.ts", i)), []byte("slate"), 0644)
+		fmt.Fprintf(&b, "#EXTINF:2,\nsegment%05d.ts\n", i)
+	}
+	ioutil.WriteFile(filepath.Join(slate, playlistName), []byte(b.String()), 0644)
+
+	scheduled.publishStarted("stage")
+	out := outputs.get("stage")
+	os.MkdirAll(out.dir, 0755)
+	generation := out.generations.next()
+	writeGeneration(t, out.dir, generation, 0, 0, false)
+	w := do("/hls/premiere/playlist.m3u8", "")
+	m, err := hlscheck.ParseMedia(w.Body.Bytes())
+	if err != nil {
+		t.Fatalf("%d %v\n%s", w.Code, err, w.Body)
+	}
+	live := "/hls/stage/" + segmentPrefix(generation) + "00000.ts"
+	if m.MediaSequence != 8 || len(m.Segments) != 3 || m.Segments[1].URI != "segment00009.ts" ||
+		!strings.Contains(w.Body.String(), "#EXT-X-DISCONTINUITY\n#EXTINF:2.000,\n"+live+"\n") {
+		t.Fatalf("taken over playlist:\n%s", w.Body)
+	}
+	// the slate segments still listed are served
+	if w := do("/hls/premiere/segment00009.ts", ""); w.Code != http.StatusOK || w.Body.String() != "slate" {
+		t.Fatalf("slate segment = %d %q", w.Code, w.Body)
+	}
+
+	scheduled.publishEnded("stage")
+	var types []string
+	for len(types) < 3 {
+		select {
+		case event := <-events:
+			if event.Data["scheduled"] == "premiere" {
+				types = append(types, event.Type)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("lifecycle events = %v", types)
+		}
+	}
+	if strings.Join(types, " ") != hookScheduledCreated+" "+hookScheduledLive+" "+hookScheduledEnded {
+		t.Fatalf("lifecycle events = %v", types)
+	}
+}
+
+func TestScheduledSettings(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/api/scheduled-streams", createScheduledStream)
+	r.GET("/api/scheduled-streams/:id", getScheduledStream)
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		asAdmin(req, "ops@example.com")
+		r.ServeHTTP(w, req)
+		return w
+	}
+	end := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+
+	if w := do("POST", "/api/scheduled-streams", `{"id":"keynote","key":"hall","end":"`+end+`","restreams":[{"url":"http://example.com","key":"k"}]}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("bad restream = %d", w.Code)
+	}
+	body := `{"id":"keynote","key":"hall","end":"` + end + `","record":true,"restreams":[{"name":"youtube","url":"rtmp://a.rtmp.youtube.com/live2","key":"secret-key"}]}`
+	if w := do("POST", "/api/scheduled-streams", body); w.Code != http.StatusCreated {
+		t.Fatalf("create = %d %s", w.Code, w.Body)
+	}
+	w := do("GET", "/api/scheduled-streams/keynote", "")
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "secret-key") || !strings.Contains(w.Body.String(), `"record":true`) {
+		t.Fatalf("get = %d %s", w.Code, w.Body)
+	}
+	if w := do("GET", "/api/scheduled-streams/other", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("unknown = %d", w.Code)
+	}
+	if list := destinations.List("hall"); len(list) != 1 || list[0].Name != "youtube" {
+		t.Fatalf("destinations = %v", list)
+	}
+
+	if scheduled.records("hall") {
+		t.Fatal("recorded before going live")
+	}
+	scheduled.publishStarted("hall")
+	if !scheduled.records("hall") {
+		t.Fatal("not recorded while live")
+	}
+	scheduled.publishEnded("hall")
+	if scheduled.records("hall") || len(destinations.List("hall")) != 0 {
+		t.Fatal("settings outlived the event")
+	}
+	scheduled.expire("keynote")
+}
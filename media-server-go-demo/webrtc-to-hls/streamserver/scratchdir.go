@@ -0,0 +1,48 @@
+package streamserver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/scratch"
+)
+
+// scratchRoot holds the session scratch directories; main replaces it with
+// scratch_root capped at scratch_session_mb
+var scratchRoot = scratch.NewRoot(filepath.Join(os.TempDir(), "webrtc-to-hls-scratch"), 0)
+
+var sessionSeq uint64
+
+// newSessionID names a session uniquely across restarts, e.g. for its
+// scratch directory
+func newSessionID() string {
+	return fmt.Sprintf("%d-%d", time.Now().Unix(), atomic.AddUint64(&sessionSeq, 1))
+}
+
+// setupScratch configures scratchRoot from the environment and sweeps the
+// directories of sessions that did not survive the last run
+func setupScratch() {
+	root := os.Getenv("scratch_root")
+	if root == "" {
+		root = filepath.Join(os.TempDir(), "webrtc-to-hls-scratch")
+	}
+	scratchRoot = scratch.NewRoot(root, int64(envInt("scratch_session_mb", 256))<<20)
+	if err := scratchRoot.Sweep(registry.hasSession); err != nil {
+		logger.Warn("scratch sweep failed", "error", err)
+	}
+}
+
+// scratchDir returns the scratch directory of the session, the only way to
+// get one: features writing temporary data (captures, clips, staging) go
+// through it so the data is capped and removed with the session
+func (s *session) scratchDir() *scratch.Dir {
+	s.Lock()
+	defer s.Unlock()
+	if s.scratch == nil {
+		s.scratch = scratchRoot.Dir(s.id)
+	}
+	return s.scratch
+}
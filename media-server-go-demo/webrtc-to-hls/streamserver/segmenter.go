@@ -0,0 +1,243 @@
+package streamserver
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/playlist"
+)
+
+// the segmenters of hls_segmenter
+const (
+	// segmenterHlssink has hlssink cut the segments and write the playlist
+	segmenterHlssink = "hlssink"
+	// segmenterSplitmux has splitmuxsink cut the segments, listed by a
+	// playlistWriter
+	segmenterSplitmux = "splitmux"
+)
+
+// resolveSplitmux reads whether the output of key, in container, has its
+// playlist written in Go, from hls_segmenter / hls_segmenter_overrides:
+// hlssink, the default, or splitmux. Only TS segments without timed
+// metadata, which splitmuxsink cannot mux, are cut by splitmuxsink.
+func resolveSplitmux(container, key string) (bool, error) {
+	switch value := strings.TrimSpace(envForKey("hls_segmenter", key)); value {
+	case "", segmenterHlssink:
+		return false, nil
+	case segmenterSplitmux:
+		if container != containerTS {
+			return false, fmt.Errorf("hls segmenter: %s outputs are cut by hlscmafsink, only %s ones by splitmux", container, containerTS)
+		}
+		if timedMetadata(key) {
+			return false, fmt.Errorf("hls segmenter: splitmuxsink cannot mux timed metadata")
+		}
+		return true, nil
+	default:
+		return false, fmt.Errorf("hls segmenter must be %s or %s, not %q", segmenterHlssink, segmenterSplitmux, value)
+	}
+}
+
+// playlistWriter writes the playlist of an output generation whose
+// segments splitmuxsink cuts, in place of hlssink: a segment is listed once
+// the next one was opened, its duration taken from the timestamps of the
+// video in both, its PROGRAM-DATE-TIME by date from the time since the
+// output started, see session.dateFrom. A jump in the timestamps starts a discontinuity.
+type playlistWriter struct {
+	dir    string
+	prefix string
+	date   func(time.Duration) time.Time
+	target time.Duration
+
+	lock   sync.Mutex
+	stream *playlist.Stream
+	// next is the index of the segment to list next
+	next int
+	// first is the timestamp of the first segment since base, the time
+	// since the output started, and end where the last one listed ended
+	first, end, base time.Duration
+	ended            bool
+}
+
+func newPlaylistWriter(p client.Preset, dir string, generation int64, date func(time.Duration) time.Time) *playlistWriter {
+	return &playlistWriter{
+		dir:    dir,
+		prefix: segmentPrefix(generation),
+		date:   date,
+		target: time.Duration(p.SegmentDuration) * time.Second,
+		stream: &playlist.Stream{Window: p.PlaylistLength, TargetDuration: p.SegmentDuration},
+		first:  -1,
+	}
+}
+
+// segment is the path of segment n
+func (w *playlistWriter) segment(n int) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%s%05d.ts", w.prefix, n))
+}
+
+// run lists the segments as they complete until done is closed
+func (w *playlistWriter) run(done <-chan struct{}) {
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := w.sync(false); err != nil {
+				logger.Warn("playlist not written", "dir", w.dir, "error", err)
+			}
+		}
+	}
+}
+
+// sync lists the segments completed since the last call and rewrites the
+// playlist if it listed any; final lists the last segment too, its
+// muxer flushed
+func (w *playlistWriter) sync(final bool) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	listed := false
+	for !w.ended {
+		data, err := ioutil.ReadFile(w.segment(w.next))
+		if err != nil {
+			break
+		}
+		from, to, ok := videoTimes(data)
+		if !ok {
+			break
+		}
+		next, err := ioutil.ReadFile(w.segment(w.next + 1))
+		switch {
+		case err == nil:
+			start, _, ok := videoTimes(next)
+			if !ok {
+				return w.writeIf(listed)
+			}
+			// the next segment starts where this one ends, unless the
+			// timestamps jumped between them
+			if start >= from && start <= to+w.target {
+				to = start
+			}
+		case !final:
+			return w.writeIf(listed)
+		}
+		w.append(from, to)
+		listed = true
+		if err != nil {
+			break
+		}
+	}
+	return w.writeIf(listed)
+}
+
+// append lists segment next, its video from from to to
+func (w *playlistWriter) append(from, to time.Duration) {
+	discontinuity := false
+	switch {
+	case w.first < 0:
+		w.first, w.end = from, from
+	case from < w.end-w.target || from > w.end+2*w.target:
+		// the timestamps jumped, e.g. the clock of the publisher was
+		// reset: the time goes on from the end of the last segment
+		discontinuity = true
+		w.base, w.first = w.base+w.end-w.first, from
+	}
+	w.stream.Append(playlist.Segment{
+		URI:             filepath.Base(w.segment(w.next)),
+		Duration:        (to - from).Seconds(),
+		ProgramDateTime: w.date(w.base + from - w.first),
+		Discontinuity:   discontinuity,
+	})
+	w.end = to
+	w.next++
+}
+
+func (w *playlistWriter) writeIf(listed bool) error {
+	if !listed {
+		return nil
+	}
+	return w.write()
+}
+
+// write replaces the playlist with the current revision
+func (w *playlistWriter) write() error {
+	var buf bytes.Buffer
+	if err := w.stream.Media().Write(&buf); err != nil {
+		return err
+	}
+	path := filepath.Join(w.dir, playlistName)
+	if err := ioutil.WriteFile(path+".tmp", buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// finish lists the last segment and ends the playlist, the output flushed
+func (w *playlistWriter) finish() error {
+	if err := w.sync(true); err != nil {
+		return err
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.ended {
+		return nil
+	}
+	w.ended = true
+	w.stream.End()
+	return w.write()
+}
+
+// videoTimes is when the video of data, an MPEG-TS segment, starts and
+// ends: the lowest timestamp of its frames, and the highest one a frame
+// interval later; false before a frame of video was written
+func videoTimes(data []byte) (first, last time.Duration, ok bool) {
+	var pts []uint64
+	for i := 0; i+188 <= len(data); i += 188 {
+		packet := data[i : i+188]
+		// a payload starting a PES packet
+		if packet[0] != 0x47 || packet[1]&0x40 == 0 || packet[3]&0x10 == 0 {
+			continue
+		}
+		payload := packet[4:]
+		if packet[3]&0x20 != 0 {
+			if int(payload[0])+1 >= len(payload) {
+				continue
+			}
+			payload = payload[1+int(payload[0]):]
+		}
+		// a video stream, with a PTS
+		if len(payload) < 14 || payload[0] != 0 || payload[1] != 0 || payload[2] != 1 || payload[3]&0xf0 != 0xe0 || payload[7]&0x80 == 0 {
+			continue
+		}
+		p := payload[9:14]
+		pts = append(pts, uint64(p[0]>>1&0x07)<<30|uint64(p[1])<<22|uint64(p[2]>>1)<<15|uint64(p[3])<<7|uint64(p[4]>>1))
+	}
+	if len(pts) == 0 {
+		return 0, 0, false
+	}
+	low, high := pts[0], pts[0]
+	for _, p := range pts {
+		if p < low {
+			low = p
+		}
+		if p > high {
+			high = p
+		}
+	}
+	if len(pts) > 1 {
+		high += (high - low) / uint64(len(pts)-1)
+	}
+	return ticksToDuration(low), ticksToDuration(high), true
+}
+
+// ticksToDuration converts 90kHz MPEG timestamps
+func ticksToDuration(ticks uint64) time.Duration {
+	return time.Duration(ticks) * time.Second / 90000
+}
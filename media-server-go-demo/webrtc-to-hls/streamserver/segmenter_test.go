@@ -0,0 +1,103 @@
+package streamserver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+)
+
+// tsVideo is an MPEG-TS segment of video frames at pts, in 90kHz ticks
+func tsVideo(pts ...uint64) []byte {
+	var data []byte
+	for _, p := range pts {
+		packet := make([]byte, 188)
+		packet[0], packet[1], packet[2], packet[3] = 0x47, 0x41, 0x00, 0x10
+		pes := packet[4:]
+		copy(pes, []byte{0, 0, 1, 0xe0, 0, 0, 0x80, 0x80, 5})
+		pes[9] = 0x21 | byte(p>>29)&0x0e
+		pes[10] = byte(p >> 22)
+		pes[11] = byte(p>>14) | 1
+		pes[12] = byte(p >> 7)
+		pes[13] = byte(p<<1) | 1
+		data = append(data, packet...)
+	}
+	return data
+}
+
+func TestResolveSplitmux(t *testing.T) {
+	if splitmux, err := resolveSplitmux(containerTS, "main"); splitmux || err != nil {
+		t.Fatalf("default = %v, %v", splitmux, err)
+	}
+	t.Setenv("hls_segmenter", "splitmux")
+	t.Setenv("hls_segmenter_overrides", "legacy=hlssink")
+	if splitmux, err := resolveSplitmux(containerTS, "main"); !splitmux || err != nil {
+		t.Fatalf("splitmux = %v, %v", splitmux, err)
+	}
+	if splitmux, _ := resolveSplitmux(containerTS, "legacy"); splitmux {
+		t.Fatal("override ignored")
+	}
+	if _, err := resolveSplitmux(containerFMP4, "main"); err == nil {
+		t.Fatal("fmp4 cut by splitmux")
+	}
+	t.Setenv("hls_segmenter", "mp4mux")
+	if _, err := resolveSplitmux(containerTS, "main"); err == nil {
+		t.Fatal("unknown segmenter accepted")
+	}
+}
+
+func TestVideoTimes(t *testing.T) {
+	// B-frames: the timestamps are not in order
+	from, to, ok := videoTimes(tsVideo(9000, 15000, 12000, 18000))
+	if !ok || from != 100*time.Millisecond || to != 233333333*time.Nanosecond {
+		t.Fatalf("videoTimes = %v, %v, %v", from, to, ok)
+	}
+	// a packet not written out yet
+	if _, _, ok := videoTimes(tsVideo(9000)[:100]); ok {
+		t.Fatal("times of a segment without a frame")
+	}
+}
+
+func TestPlaylistWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "segmenter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	start := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	w := newPlaylistWriter(client.Preset{SegmentDuration: 2, PlaylistLength: 3}, dir, 7, start.Add)
+	write := func(n int, pts ...uint64) {
+		ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("%s%05d.ts", segmentPrefix(7), n)), tsVideo(pts...), 0644)
+	}
+	read := func() string {
+		data, _ := ioutil.ReadFile(filepath.Join(dir, playlistName))
+		return string(data)
+	}
+
+	write(0, 90000, 135000)
+	if err := w.sync(false); err != nil || read() != "" {
+		t.Fatalf("listed the segment being written: %v %q", err, read())
+	}
+	write(1, 270000, 315000)
+	w.sync(false)
+	if got := read(); !strings.Contains(got, "#EXT-X-PROGRAM-DATE-TIME:2026-10-15T12:00:00.000Z\n#EXTINF:2.000,\nsegment-7-00000.ts\n") || strings.Contains(got, "00001") {
+		t.Fatalf("playlist = %s", got)
+	}
+	// the clock of the publisher jumped back
+	write(2, 9000, 54000)
+	w.sync(false)
+	if got := read(); !strings.HasSuffix(got, "#EXT-X-PROGRAM-DATE-TIME:2026-10-15T12:00:02.000Z\n#EXTINF:1.000,\nsegment-7-00001.ts\n") {
+		t.Fatalf("playlist = %s", got)
+	}
+	if err := w.finish(); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(); !strings.HasSuffix(got, "#EXT-X-DISCONTINUITY\n#EXT-X-PROGRAM-DATE-TIME:2026-10-15T12:00:03.000Z\n#EXTINF:1.000,\nsegment-7-00002.ts\n#EXT-X-ENDLIST\n") {
+		t.Fatalf("final playlist = %s", got)
+	}
+}
@@ -0,0 +1,155 @@
+package streamserver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/metrics"
+)
+
+var segmentsWritten = metrics.NewCounter("hls_segments_written_total",
+	"HLS segments hlssink wrote", "")
+
+// segments tell when hlssink last wrote one, for stall alerts: a stream
+// whose age keeps growing past its segment duration is stalled
+var _ = metrics.NewGaugeFunc("hls_last_segment_age_seconds",
+	"Seconds since the output of a live stream wrote a segment, by stream key", "stream", func() map[string]float64 {
+		ages := map[string]float64{}
+		now := time.Now()
+		for _, key := range registry.keys() {
+			if sess := registry.get(key); sess != nil {
+				if last := sess.lastSegmentTime(); !last.IsZero() {
+					ages[key] = now.Sub(last).Seconds()
+				}
+			}
+		}
+		return ages
+	})
+
+// newestSegment returns the highest index among the segments of generation
+// in dir, -1 when there is none
+func newestSegment(dir string, generation int64) int {
+	return newestPrefixed(dir, segmentPrefix(generation))
+}
+
+// newestPrefixed returns the highest index among the segments in dir
+// written with prefix, -1 when there is none
+func newestPrefixed(dir, prefix string) int {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return -1
+	}
+	newest := -1
+	for _, f := range files {
+		if index, ok := segmentIndex(f.Name(), prefix); ok && index > newest {
+			newest = index
+		}
+	}
+	return newest
+}
+
+// segmentIndex returns the index of the segment file name written with
+// prefix, false for other files
+func segmentIndex(name, prefix string) (int, bool) {
+	if !strings.HasPrefix(name, prefix) || !segmentFile(name) {
+		return 0, false
+	}
+	// initialization sections are not numbered like segments
+	index, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, prefix), filepath.Ext(name)))
+	return index, err == nil
+}
+
+// segmentWindow returns when the segment name in dir was written, from when
+// the one before it was written to its own modification time; from is zero
+// for the first segment of its generation. Without the segment before, e.g.
+// once removed from the playlist window, the window is not known.
+func segmentWindow(dir, name string) (generation int64, from, to time.Time, ok bool) {
+	generation, ok = cmafGeneration(name)
+	if !ok {
+		return 0, from, to, false
+	}
+	prefix := segmentPrefix(generation)
+	index, ok := segmentIndex(name, prefix)
+	info, err := os.Stat(filepath.Join(dir, name))
+	if !ok || err != nil {
+		return 0, from, to, false
+	}
+	if index > 0 {
+		previous, err := os.Stat(filepath.Join(dir, fmt.Sprintf("%s%05d%s", prefix, index-1, filepath.Ext(name))))
+		if err != nil {
+			return 0, from, to, false
+		}
+		from = previous.ModTime()
+	}
+	return generation, from, info.ModTime(), true
+}
+
+// lastSegmentTime is when the output last wrote a segment, zero before the
+// first one
+func (s *session) lastSegmentTime() time.Time {
+	s.Lock()
+	defer s.Unlock()
+	return s.lastSegment
+}
+
+// watchSegments counts the segments the output writes until the session
+// closes. hlssink numbers them, and removes old ones past max-files, so the
+// highest index tells how many were written. The rungs of the ABR ladder
+// are checked on the same tick.
+func (s *session) watchSegments() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	seen, watched := -1, int64(0)
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			s.Lock()
+			generation, source := s.generation, s.lastSegment
+			var ladder *ladderOutput
+			if s.hls != nil {
+				ladder = s.hls.ladder
+			}
+			s.Unlock()
+			if generation == 0 {
+				continue
+			}
+			if ladder != nil {
+				ladder.check(now, source)
+			}
+			if generation != watched {
+				// each generation numbers its segments from 0
+				seen, watched = -1, generation
+			}
+			newest := newestSegment(outputDir(s.key), generation)
+			if newest <= seen {
+				continue
+			}
+			if seen < 0 {
+				s.pushEvent(client.Message{Event: client.EventPlaylistReady, URL: playbackURL(s)})
+				s.traceFirstSegment()
+			}
+			segmentsWritten.Add("", uint64(newest-seen))
+			seen = newest
+			// the segment before the newest is complete
+			prefetchSegment(outputDir(s.key), generation, newest-1)
+			s.Lock()
+			s.lastSegment = now
+			s.Unlock()
+			if quarantined.has(s.key) {
+				// the output of a quarantined stream does not leave the box
+				restrictSegments(s.key, generation, newest)
+			} else {
+				uploadOutput(s.key)
+			}
+			s.takeThumbnail(now)
+		}
+	}
+}
@@ -0,0 +1,857 @@
+package streamserver
+
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	mediaserver "github.com/notedit/media-server-go"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/abr"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/budget"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/metrics"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/pubauth"
+	"github.com/notedit/sdp"
+)
+
+var upGrader = websocket.Upgrader{
+	CheckOrigin: allowOrigin,
+}
+
+var Capabilities = map[string]*sdp.Capability{
+	"audio": &sdp.Capability{
+		Codecs: []string{"opus"},
+	},
+	"video": &sdp.Capability{
+		Codecs: []string{"h264"},
+		Rtx:    true,
+		Rtcpfbs: []*sdp.RtcpFeedback{
+			&sdp.RtcpFeedback{
+				ID: "goog-remb",
+			},
+			&sdp.RtcpFeedback{
+				ID: "transport-cc",
+			},
+			&sdp.RtcpFeedback{
+				ID:     "ccm",
+				Params: []string{"fir"},
+			},
+			&sdp.RtcpFeedback{
+				ID:     "nack",
+				Params: []string{"pli"},
+			},
+		},
+		Extensions: []string{
+			"urn:3gpp:video-orientation",
+			"http://www.ietf.org/id/draft-holmer-rmcat-transport-wide-cc-extensions-01",
+			"http://www.webrtc.org/experiments/rtp-hdrext/abs-send-time",
+			"urn:ietf:params:rtp-hdrext:toffse",
+			"urn:ietf:params:rtp-hdrext:sdes:rtp-stream-id",
+			"urn:ietf:params:rtp-hdrext:sdes:mid",
+			"urn:ietf:params:rtp-hdrext:sdes:repaired-rtp-stream-id",
+		},
+	},
+}
+
+var registry = newSessionRegistry()
+
+var auth *ingestAuth
+
+var ingestBytes = metrics.NewCounter("ingest_bytes_total",
+	"Media bytes received from publishers, by track", "track")
+
+func channel(c *gin.Context) {
+
+	ws, err := upGrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		websocketErrors.Inc("upgrade")
+		return
+	}
+	defer ws.Close()
+	ws.SetReadLimit(signalingMessageBytes())
+
+	conn := newSignaling(ws)
+	conn.speak(c)
+	defer conn.recoverPanic()
+	stopPings := make(chan struct{})
+	defer close(stopPings)
+	conn.keepAlive(stopPings)
+	// payload types stay the same across the offers of a connection
+	pins := newPayloadPins()
+	var sess *session
+	endpoint := newEndpoint(net.ParseIP(c.ClientIP()))
+	// kept is set when the session outlives the connection, its transport
+	// possibly on endpoint
+	kept := false
+	defer func() {
+		if !kept {
+			releaseEndpoint(endpoint)
+		}
+	}()
+	sendICEServers(conn, c.Query("stream"))
+
+	// dropped is the read error the connection ended with
+	var dropped error
+	defer func() {
+		if sess == nil {
+			return
+		}
+		if kept = sess.outlive(ws, endpoint, dropped); !kept {
+			sess.end()
+		}
+	}()
+	// member is the participation of the connection in a mixed room
+	var member *participant
+	defer func() {
+		if member != nil {
+			member.leave()
+		}
+	}()
+	conn.rate = newMessageRate()
+
+	for {
+		// read json
+		var msg client.Message
+		msg, err = conn.read()
+		if err != nil {
+			logger.Debug("signaling closed", "connection", conn.id, "error", err)
+			countReadError(err)
+			switch err {
+			case websocket.ErrReadLimit:
+				signalingRefused.Inc("size")
+			case errSignalingRate:
+				signalingRefused.Inc("rate")
+				logger.Warn("signaling over its message rate", "connection", conn.id)
+				conn.close(websocket.ClosePolicyViolation, err.Error())
+			}
+			if sess != nil && timedOut(err) {
+				sess.logf("signaling silent for %s", conn.timeout)
+			}
+			dropped = err
+			break
+		}
+		conn.received()
+
+		if msg.Cmd == client.CmdOffer {
+			parseStart := time.Now()
+			offer, err := parseOffer(msg.Sdp)
+			if err != nil {
+				conn.sendError(client.ErrorBadOffer, err)
+				continue
+			}
+			parseTime := time.Since(parseStart)
+
+			if msg.StreamID == "" {
+				// /channel?stream=KEY names the stream for every offer
+				msg.StreamID = c.Query("stream")
+			}
+			key, externalID, err := publishIDs(msg, offer)
+			if err != nil {
+				conn.sendError(client.ErrorBadIdentifier, err)
+				continue
+			}
+			identity, err := auth.authorize(pubauth.Request{
+				Key:        key,
+				Credential: channelCredential(c, msg),
+				TLS:        c.Request.TLS,
+			})
+			if err != nil {
+				logger.Warn("publish unauthorized", "stream", key, "identity", identity, "connection", conn.id, "error", err)
+				// the signaling equivalent of a 403
+				conn.sendError(client.ErrorUnauthorized, err)
+				conn.close(client.CloseUnauthorized, err.Error())
+				return
+			}
+			if msg.ReconnectToken != "" {
+				if sess != nil || member != nil {
+					conn.sendError(client.ErrorRejected, errReconnectLive)
+					continue
+				}
+				reconnected, answer, err := reconnect(msg.ReconnectToken, key, conn, endpoint, offer)
+				if err != nil {
+					conn.sendError(client.ErrorRejected, err)
+					continue
+				}
+				// the session signals over this connection from here on
+				sess, conn, pins = reconnected, reconnected.conn, reconnected.pins
+				preset := sess.preset
+				sess.send(client.Message{Cmd: client.CmdAnswer, Sdp: answer, Preset: &preset, Session: sess.reconnectedInfo(answer)})
+				continue
+			}
+			resumed, err := admitPublish(msg, key)
+			if err == errDraining {
+				conn.close(client.CloseDraining, err.Error())
+				return
+			}
+			if err != nil {
+				conn.sendError(client.ErrorRejected, err)
+				continue
+			}
+			if mixedRoom(key) {
+				// mixed into the broadcast of the room rather than published
+				if member != nil || sess != nil {
+					conn.sendError(client.ErrorRejected, errRoomJoined)
+					continue
+				}
+				p, answer, err := rooms.join(key, endpoint, pins, conn, offer)
+				if err != nil {
+					conn.sendError(client.ErrorRejected, err)
+					continue
+				}
+				member = p
+				conn.send(client.Message{Cmd: client.CmdAnswer, Sdp: answer, Session: p.room.info(p)})
+				continue
+			}
+			preset, err := resolvePreset(msg.Latency, key)
+			profile, profileErr := resolveProfile(key)
+			if err == nil {
+				err = profileErr
+			}
+			if err == nil {
+				preset, err = profile.fit(preset, msg.Latency != "")
+			}
+			if err == nil {
+				preset, err = resolveDVR(preset, key)
+			}
+			if err == nil && sess != nil && sess.produced() && sess.preset.Name != preset.Name {
+				err = errPresetChange
+			}
+			if err != nil {
+				code := client.ErrorRejected
+				if _, ok := err.(*profileConflict); ok {
+					code = client.ErrorProfileConflict
+				}
+				conn.sendError(code, err)
+				continue
+			}
+			kind, err := sessionKind(offer, key)
+			if err != nil {
+				conn.sendError(client.ErrorVideoRequired, err)
+				continue
+			}
+			dash, err := resolveDASH(c.Query("dash"), key)
+			var container string
+			if err == nil {
+				container, err = resolveContainer(profile, key)
+			}
+			var ladder []abr.Rung
+			if err == nil {
+				ladder, err = resolveLadder(preset, profile, container, key)
+			}
+			var passthrough bool
+			if err == nil {
+				passthrough, err = resolveAV1Passthrough(container, key)
+			}
+			var hevc bool
+			if err == nil {
+				hevc, err = resolveH265Passthrough(container, key)
+			}
+			var opus bool
+			if err == nil {
+				opus, err = resolveOpusPassthrough(profile, container, key)
+			}
+			var layer string
+			if err == nil {
+				layer, err = resolveLayer(key)
+			}
+			var egress string
+			if err == nil {
+				egress, err = resolveSRTEgress(key)
+			}
+			var policy publishPolicy
+			if err == nil {
+				policy, err = resolvePublishPolicy(key)
+			}
+			if err == nil {
+				err = policy.checkOffer(offer)
+			}
+			var mainAudio audioTrack
+			var alternateAudio []audioTrack
+			if err == nil {
+				mainAudio, alternateAudio, err = resolveAudioTracks(offer, msg.AudioLanguages)
+			}
+			var layout, screen string
+			if err == nil {
+				layout, screen, err = resolveComposite(offer, msg.Screen, key)
+			}
+			if err == nil {
+				err = checkPassthrough(preset, layout, key)
+			}
+			if err == nil {
+				err = checkEncryption(container, dash, preset, key)
+			}
+			if err == nil {
+				err = checkDRM(container, passthrough || hevc, preset, key)
+			}
+			if err != nil {
+				conn.sendError(client.ErrorRejected, err)
+				continue
+			}
+			if sess != nil {
+				registry.release(sess)
+				sess.close(0, "")
+			}
+			sess = newSession(key, conn, preset)
+			sess.baseURL = requestBaseURL(c.Request)
+			sess.kind = kind
+			sess.externalID = externalID
+			sess.profile = profile
+			sess.dash = dash
+			sess.container = container
+			sess.ladder = ladder
+			sess.av1Passthrough = passthrough
+			sess.h265Passthrough = hevc
+			sess.opusPassthrough = opus
+			sess.layer = layer
+			sess.srtEgress = egress
+			sess.policy = policy
+			sess.mainAudio = mainAudio
+			sess.alternateAudio = alternateAudio
+			sess.compositeLayout = layout
+			sess.screen = screen
+			sess.identity = identity
+			sess.timeline.add(eventSignaling, "in "+msg.Cmd)
+			if resumed {
+				sess.logf("resuming session migrated from another instance")
+				awaitHandover(key)
+				if err := resumeOutput(key, preset); err != nil {
+					sess.logf("playlist of the migration not continued: %v", err)
+				}
+			}
+			sess.startTrace(c.Request.Header, parseStart, parseTime)
+			if _, err := registry.claim(sess, conflictPolicyFor(key)); err != nil {
+				sess.log.get().Warn("publish rejected", "error", err)
+				sess.close(client.CloseStreamBusy, err.Error())
+				return
+			}
+			scheduled.publishStarted(key)
+
+			n, err := sess.negotiate(endpoint, pins, offer)
+			if err != nil {
+				// replaced while negotiating, or the pipeline failed; the
+				// session is ended on return
+				sess.log.get().Error("publish error", "error", err)
+				if err == errPreviousHeld {
+					sess.close(client.CloseStreamBusy, err.Error())
+					return
+				}
+				if err != errStreamReplaced {
+					conn.sendError(client.ErrorPipelineFailed, err)
+				}
+				return
+			}
+			info := sess.info(n, resumed, parseTime)
+			info.ReconnectToken = reconnects.issue(sess)
+			sess.send(client.Message{
+				Cmd:     client.CmdAnswer,
+				Sdp:     n.sdp,
+				Preset:  &preset,
+				Session: info,
+			})
+			if sess.kind == client.KindVideo {
+				// a publisher whose tab hung keeps the websocket alive
+				go sess.endWhenIdle(time.Duration(envInt("publish_idle_timeout", 15)) * time.Second)
+			}
+			continue
+		}
+
+		switch msg.Cmd {
+		case client.CmdCandidate, client.CmdRenegotiate, client.CmdUpdate, client.CmdCue, client.CmdData:
+			if sess == nil {
+				// nothing is published yet on the connection
+				if msg.Cmd != client.CmdCandidate {
+					conn.sendError(client.ErrorNotLive, errNotLive)
+				}
+				continue
+			}
+			sess.signal(pins, msg)
+		}
+	}
+}
+
+// negotiation is what answering an offer set up
+type negotiation struct {
+	answer *sdp.SDPInfo
+	// sdp is the answer as sent, codecs in preference order
+	sdp        string
+	answerMode string
+	audio      bool
+
+	negotiationTime time.Duration
+	pipelineTime    time.Duration
+}
+
+// negotiate creates the transport of offer on endpoint, answers it and
+// starts the output of the session with the offer's video. It fails when
+// the session was replaced meanwhile or the pipeline could not start.
+func (s *session) negotiate(endpoint *mediaserver.Endpoint, pins *payloadPins, offer *sdp.SDPInfo) (*negotiation, error) {
+	n := &negotiation{}
+	trace := s.traceContext()
+	negotiationStart := time.Now()
+	_, create := tracer.Start(trace, "transport.create")
+	pins.apply(offer)
+	transport := endpoint.CreateTransport(offer, nil)
+	s.watchDTLS(transport)
+	transport.SetRemoteProperties(offer.GetMedia("audio"), offer.GetMedia("video"))
+
+	n.answer = offer.Answer(transport.GetLocalICEInfo(),
+		transport.GetLocalDTLSInfo(),
+		localCandidates(endpoint.GetLocalCandidates()),
+		Capabilities)
+	if err := s.policy.allowCodecs(n.answer); err != nil {
+		transport.Stop()
+		return nil, err
+	}
+	codec := pickVideoCodec(n.answer)
+	answerSimulcast(offer, n.answer)
+	s.Lock()
+	s.videoCodec = codec
+	if s.preset.Passthrough && s.outputCodec() != codec {
+		s.Unlock()
+		transport.Stop()
+		return nil, fmt.Errorf("preset %s passes the video through, %s would be transcoded", s.preset.Name, codec)
+	}
+	s.h264 = offeredParameterSets(offer, n.answer)
+	if rids := offeredLayers(offer); len(rids) > 1 {
+		s.simulcast = newLayerSelection(rids, s.layer)
+	}
+	s.Unlock()
+	n.answerMode = answerModeFor(s.key)
+	if n.answerMode == answerMinimal {
+		minimizeAnswer(n.answer)
+	}
+	capBitrate(n.answer)
+	s.policy.constrain(n.answer)
+
+	transport.SetLocalProperties(n.answer.GetMedia("audio"), n.answer.GetMedia("video"))
+
+	n.negotiationTime = time.Since(negotiationStart)
+	create.SetAttribute("codec", codec)
+	create.End()
+
+	// keyframes are only requested from video
+	var refresher *keyframeRequester
+	if s.kind == client.KindVideo {
+		refresher = newKeyframeRequester(s, refreshPeriod(s.preset, s.key))
+	}
+	if !s.setTransport(transport, refresher) {
+		if refresher != nil {
+			refresher.Stop()
+		}
+		transport.Stop()
+		return nil, errStreamReplaced
+	}
+	s.Lock()
+	s.remoteUfrag = offer.GetICE().GetUfrag()
+	s.offered = offeredStreams(offer)
+	s.pins = pins
+	s.Unlock()
+	go s.watchICE(transport)
+	if err := s.startComposite(); err != nil {
+		return nil, err
+	}
+
+	// the primary stream feeds the output, each other one with video gets
+	// an output of its own once it started
+	primary := primaryStream(offer, s.screen)
+	var others []*mediaserver.IncomingStream
+	for _, stream := range offer.GetStreams() {
+		incomingStream := transport.CreateIncomingStream(stream)
+
+		if refresher != nil {
+			refresher.AddStream(incomingStream)
+		}
+
+		if s.screen != "" && incomingStream.GetID() == s.screen {
+			s.feedScreen(incomingStream)
+			continue
+		}
+
+		if len(incomingStream.GetVideoTracks()) > 0 && incomingStream.GetID() != primary {
+			others = append(others, incomingStream)
+		}
+
+		if incomingStream.GetID() == primary {
+
+			videoTrack := incomingStream.GetVideoTracks()[0]
+			s.setIncoming(incomingStream)
+
+			// a takeover must not start writing until the replaced
+			// publisher has stopped its pipeline
+			if err := s.waitPrevious(); err != nil {
+				return nil, err
+			}
+
+			n.audio = s.takesAudio(len(incomingStream.GetAudioTracks()))
+			pipelineStart := time.Now()
+			_, start := tracer.Start(trace, "pipeline.start")
+			start.SetAttribute("audio", n.audio)
+			err := s.startPipeline(n.audio)
+			start.Fail(err)
+			start.End()
+			if err != nil {
+				return nil, err
+			}
+			n.pipelineTime = time.Since(pipelineStart)
+			s.traceStep("negotiated")
+
+			s.feedVideo(incomingStream)
+			s.Lock()
+			layers := s.simulcast
+			s.Unlock()
+			if layers != nil {
+				go s.watchLayers(videoTrack)
+			}
+
+			go s.watchClockSkew(videoTrack)
+			go s.sendTransportStats(videoTrack)
+			go s.watchExtensions(videoTrack, negotiatedExtensions(n.answer.GetMedia("video")))
+			go s.watchFrames()
+			go s.watchSegments()
+			go s.runHeartbeat()
+			go s.runFallback()
+
+			if n.audio {
+				s.feedAudio(incomingStream)
+			}
+		}
+		// alternate audio may come in a stream of its own
+		s.feedAlternateAudio(incomingStream)
+	}
+	s.startStreamOutputs(others)
+
+	n.sdp = withTIAS(orderAnswer(n.answer.String(), n.answer, preferredCodecs()))
+	s.sdps.add(client.CmdAnswer, redactSDP(n.sdp))
+	return n, nil
+}
+
+// watchDTLS pushes the DTLS and ICE state of transport to the publisher
+// while it is the transport of the session, or about to be
+func (s *session) watchDTLS(transport *mediaserver.Transport) {
+	transport.OnDTLSICEState(func(state string) {
+		s.Lock()
+		retired := s.transport != nil && s.transport != transport
+		s.Unlock()
+		if retired {
+			return
+		}
+		s.timeline.add(eventState, "dtls/ice "+state)
+		s.pushEvent(client.Message{Event: client.EventDTLSState, State: state})
+		// a publisher without signaling connection is gone with its transport
+		if s.conn == nil && (state == "failed" || state == "closed") {
+			go s.end()
+		}
+	})
+}
+
+// info describes the negotiated session to its publisher
+func (s *session) info(n *negotiation, resumed bool, parseTime time.Duration) *client.SessionInfo {
+	return &client.SessionInfo{
+		ID:         s.id,
+		Stream:     s.key,
+		ExternalID: s.externalID,
+		Codecs:     answeredCodecs(n.answer),
+		Mode:       client.ModePassthrough,
+		Preset:     s.preset.Name,
+		Profile:    s.profile.Name,
+		Kind:       s.kind,
+		Audio:      n.audio,
+		Resumed:    resumed,
+		Answer:     n.answerMode,
+		Playlist:   playlistPath(s),
+		Streams:    s.streamPlaylists(),
+		Timings: client.Timings{
+			ParseSdp:    milliseconds(parseTime),
+			Negotiation: milliseconds(n.negotiationTime),
+			Pipeline:    milliseconds(n.pipelineTime),
+		},
+	}
+}
+
+// answeredCodecs lists the codecs of answer as media/codec in payload type order
+func answeredCodecs(answer *sdp.SDPInfo) []string {
+	codecs := []string{}
+	for _, media := range []string{"audio", "video"} {
+		info := answer.GetMedia(media)
+		if info == nil {
+			continue
+		}
+		types := []int{}
+		for pt := range info.GetCodecs() {
+			types = append(types, pt)
+		}
+		sort.Ints(types)
+		for _, pt := range types {
+			codecs = append(codecs, media+"/"+strings.ToLower(info.GetCodecs()[pt].GetCodec()))
+		}
+	}
+	return codecs
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func index(c *gin.Context) {
+	c.HTML(http.StatusOK, "index.html", gin.H{})
+}
+
+// runServer sets the server up from its settings and serves until it is
+// stopped; startup errors are fatal
+func runServer() {
+	s, err := New()
+	if err != nil {
+		fatal("startup failed", err)
+	}
+	if err := s.Run(); err != nil {
+		fatal("listener failed", err)
+	}
+}
+
+// New sets the server up from its settings, those of options first: it
+// starts what serves the publishes, e.g. the RTMP and SRT listeners, and
+// builds the router, which Run serves.
+func New(options ...Option) (*Server, error) {
+	s := &Server{indexPage: "./index.html"}
+	for _, option := range options {
+		option(s)
+	}
+	for name, value := range s.settings {
+		os.Setenv(name, value)
+	}
+	if err := setupLogging(); err != nil {
+		return nil, err
+	}
+	if err := setupTracing(); err != nil {
+		return nil, err
+	}
+	background = newJobQueue()
+	memory = budget.New(int64(envInt("memory_budget_mb", 0)) << 20)
+	tokens = newResumeTokens(os.Getenv("migration_secret"))
+	setupScratch()
+	setupEgress()
+	var err error
+	if auth, err = newIngestAuth(); err != nil {
+		return nil, err
+	}
+	if err := setupHLS(); err != nil {
+		return nil, err
+	}
+	if err := setupCodecPreference(); err != nil {
+		return nil, err
+	}
+	if err := setupTranscode(); err != nil {
+		return nil, err
+	}
+	if err := setupEncoder(); err != nil {
+		return nil, err
+	}
+	if err := setupAudience(); err != nil {
+		return nil, err
+	}
+	if err := setupCluster(); err != nil {
+		return nil, err
+	}
+	tokens.shared, tokens.node = directory, nodeURL
+	if err := setupEdge(); err != nil {
+		return nil, err
+	}
+	if err := setupWebhooks(); err != nil {
+		return nil, err
+	}
+	if err := setupAnalytics(); err != nil {
+		return nil, err
+	}
+	if err := setupEventBus(); err != nil {
+		return nil, err
+	}
+	if err := setupControl(); err != nil {
+		return nil, err
+	}
+	if err := setupKeyframes(); err != nil {
+		return nil, err
+	}
+	setupQuarantine()
+	setupRetention()
+	if err := setupPlayback(); err != nil {
+		return nil, err
+	}
+	if err := setupPlaybackACL(); err != nil {
+		return nil, err
+	}
+	if err := setupEncryption(); err != nil {
+		return nil, err
+	}
+	if err := setupDRM(); err != nil {
+		return nil, err
+	}
+	if err := setupStorage(); err != nil {
+		return nil, err
+	}
+	setupMediaCache()
+	if err := setupVOD(); err != nil {
+		return nil, err
+	}
+	setupRTMP()
+	if err := setupSRT(); err != nil {
+		return nil, err
+	}
+	if err := setupRTSP(); err != nil {
+		return nil, err
+	}
+	if err := setupLoadTest(); err != nil {
+		return nil, err
+	}
+	if err := setupPorts(); err != nil {
+		return nil, err
+	}
+	if err := setupEndpoints(); err != nil {
+		return nil, err
+	}
+	if err := setupProxies(); err != nil {
+		return nil, err
+	}
+	setupAdmin()
+	if s.address == "" {
+		s.address = ":9000"
+		if os.Getenv("port") != "" {
+			s.address = ":" + os.Getenv("port")
+		}
+	}
+	audit = &auditLog{path: os.Getenv("audit_log")}
+	go reloadOnHangup()
+	r := gin.Default()
+	r.Use(honorForwarded)
+	r.Use(allowCORS)
+	r.Use(routeToOwner)
+	r.Use(refuseQuarantined)
+	r.Use(restrictPlayback)
+	r.Use(authorizePlayback)
+	r.Use(pullOnDemand)
+	r.Use(shapeEgress)
+	r.Use(countViewers)
+	r.Use(trackViewers)
+	r.Use(encryptHLS)
+	r.Use(protectCMAF)
+	r.Use(serveEvents)
+	r.Use(spliceHLS)
+	r.Use(dateHLS)
+	r.Use(serveCaptions)
+	r.Use(servePlaylist)
+	r.Use(serveLowLatency)
+	r.Use(serveDASH)
+	r.Use(serveMaster)
+	r.Use(serveRenditionPlaylist)
+	r.Use(serveMedia)
+	r.LoadHTMLFiles(s.indexPage)
+	routes(r)
+	for _, register := range s.routes {
+		register(r)
+	}
+	s.engine = r
+
+	s.http = &http.Server{
+		Addr:    s.address,
+		Handler: r,
+	}
+	s.certFile, s.keyFile = os.Getenv("tls_cert"), os.Getenv("tls_key")
+	certs, err := setupAutocert(s.address)
+	if err != nil {
+		return nil, err
+	}
+	if s.certFile == "" && certs == nil {
+		if auth.mode == authCert {
+			return nil, errors.New("ingest_auth=cert needs tls_cert and tls_key, or tls_domains")
+		}
+		return s, nil
+	}
+	if s.http.TLSConfig, err = auth.tlsConfig(); err != nil {
+		return nil, err
+	}
+	if certs != nil {
+		s.http.TLSConfig.GetCertificate = certs.getCertificate
+	}
+	return s, nil
+}
+
+// routes registers the endpoints of the server on r. The first element of
+// their paths is reserved, see ident, so no stream key shadows one.
+func routes(r *gin.Engine) {
+	r.GET("/channel", guardSignaling, channel)
+	r.GET("/api/v1/signaling/schema", signalingSchema)
+	r.POST("/whip", whipPublish)
+	r.OPTIONS("/whip", iceOptions)
+	r.DELETE("/whip/:id", whipDelete)
+	r.GET("/watch", watchChannel)
+	r.POST("/whep/:id", whepPlay)
+	r.OPTIONS("/whep/:id", iceOptions)
+	r.DELETE("/whep/:id/:viewer", whepStop)
+	r.GET("/", index)
+	r.GET("/admin", adminPage)
+	r.POST("/api/external-streams", createExternalStream)
+	r.DELETE("/api/external-streams/:id", deleteExternalStream)
+	r.GET("/hls/:id/*file", serveExternalStream)
+	r.GET("/vod/:id/*file", serveVOD)
+	r.GET("/api/v1/vod", listVOD)
+	r.GET("/api/v1/vod/:id", getVOD)
+	r.DELETE("/api/v1/vod/:id", deleteVOD)
+	r.POST("/api/streams/:id/quarantine", quarantineStream)
+	r.DELETE("/api/streams/:id/quarantine", unquarantineStream)
+	r.POST("/api/drain", startDrain)
+	r.GET("/api/streams/:id/:detail", streamDetail)
+	r.GET("/api/v1/streams", listStreams)
+	r.GET("/api/v1/streams/:id", getStream)
+	r.GET("/api/v1/streams/:id/stats", getStreamStats)
+	r.GET("/api/v1/streams/:id/viewers", listStreamViewers)
+	r.GET("/api/v1/viewers", listViewers)
+	r.GET("/api/v1/stats/ws", statsSocket)
+	r.PUT("/api/v1/streams/:id/layer", setStreamLayer)
+	r.PUT("/api/v1/streams/:id/layout", setStreamLayout)
+	r.GET("/api/v1/streams/:id/watermark", getWatermark)
+	r.PUT("/api/v1/streams/:id/watermark", setStreamWatermark)
+	r.DELETE("/api/v1/streams/:id/watermark", removeStreamWatermark)
+	r.GET("/api/v1/streams/:id/restreams", listRestreams)
+	r.POST("/api/v1/streams/:id/restreams", addRestream)
+	r.DELETE("/api/v1/streams/:id/restreams/:destination", removeRestream)
+	r.GET("/api/v1/streams/:id/sinks", listSinks)
+	r.POST("/api/v1/streams/:id/sinks", addSink)
+	r.DELETE("/api/v1/streams/:id/sinks/:sink", removeSink)
+	r.POST("/api/v1/streams/:id/record/start", startStreamRecording)
+	r.POST("/api/v1/streams/:id/record/stop", stopStreamRecording)
+	r.POST("/api/v1/streams/:id/capture", startStreamCapture)
+	r.DELETE("/api/v1/streams/:id/capture", stopStreamCapture)
+	r.GET("/api/v1/streams/:id/thumbnail", getStreamThumbnail)
+	r.POST("/api/v1/streams/:id/metadata", injectStreamMetadata)
+	r.POST("/api/v1/streams/:id/splices", insertSplice)
+	r.GET("/api/v1/streams/:id/dvr", getDVR)
+	r.PUT("/api/v1/streams/:id/dvr", setDVR)
+	r.GET("/api/v1/streams/:id/playback", getPlayback)
+	r.PUT("/api/v1/streams/:id/playback", setPlayback)
+	r.POST("/api/v1/streams/:id/playback/tokens", issuePlaybackToken)
+	r.DELETE("/api/v1/streams/:id", kickStream)
+	r.GET("/api/support-bundles/:bundle", downloadSupportBundle)
+	r.POST("/api/streams/:id/keyframe", requestKeyframe)
+	r.GET("/metrics", gin.WrapH(metrics.Handler()))
+	r.GET("/healthz", healthz)
+	r.GET("/readyz", readyz)
+	r.POST("/api/scheduled-streams", createScheduledStream)
+	r.GET("/api/scheduled-streams", listScheduledStreams)
+	r.GET("/api/scheduled-streams/:id", getScheduledStream)
+	r.GET("/api/jobs/dead", listDeadJobs)
+	r.GET("/api/v1/log-level", getLogLevel)
+	r.POST("/api/v1/config/reload", reloadConfigHandler)
+	r.GET("/api/v1/loadtest", getLoadTest)
+	r.POST("/api/v1/loadtest", startLoadTest)
+	r.DELETE("/api/v1/loadtest", stopLoadTest)
+	r.PUT("/api/v1/log-level", setLogLevel)
+	r.POST("/api/jobs/dead/:id/requeue", requeueDeadJob)
+}
@@ -0,0 +1,1028 @@
+package streamserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	mediaserver "github.com/notedit/media-server-go"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/abr"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/budget"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/llhls"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/metrics"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/scratch"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/teardown"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/tracing"
+	rtmp "github.com/notedit/rtmp-lib"
+)
+
+// memory is the process wide memory budget, memory_budget_mb
+var memory = budget.New(0)
+
+// sessionMemoryLimit is the per session budget, session_memory_budget_mb
+func sessionMemoryLimit() int64 {
+	return int64(envInt("session_memory_budget_mb", 0)) << 20
+}
+
+// how long a takeover waits for the previous publisher to release its pipeline
+var releaseTimeout = teardown.DefaultDeadline + teardown.ReleaseTimeout
+
+var (
+	errStreamBusy     = errors.New("stream already publishing")
+	errStreamReplaced = errors.New("replaced by new publish")
+	// errPreviousHeld rejects a takeover whose previous publisher did not
+	// release its pipeline in time, and may still write the output
+	errPreviousHeld = errors.New("previous publish still holds the output")
+)
+
+// conflictPolicy decides what happens when a second publisher claims a live stream key
+type conflictPolicy string
+
+const (
+	conflictReject   conflictPolicy = "reject"
+	conflictTakeover conflictPolicy = "takeover"
+)
+
+// conflictPolicyFor reads the default policy from conflict_policy and per key
+// overrides from conflict_policy_overrides ("key1=takeover,key2=reject")
+func conflictPolicyFor(key string) conflictPolicy {
+	return parseConflictPolicy(envForKey("conflict_policy", key))
+}
+
+func parseConflictPolicy(value string) conflictPolicy {
+	if conflictPolicy(strings.TrimSpace(value)) == conflictTakeover {
+		return conflictTakeover
+	}
+	return conflictReject
+}
+
+// session is one publisher connection producing the HLS output of a stream key
+type session struct {
+	// id is unique per publish, unlike the stream key
+	id  string
+	key string
+	// externalID is the publisher's own id of the content, if given; unique
+	// among live sessions
+	externalID string
+	// baseURL is where the publish came in, e.g. https://live.example, see
+	// playbackURL
+	baseURL string
+	// kind is client.KindVideo, or client.KindAudioOnly for an offer
+	// accepted without video
+	kind   string
+	conn   *signaling
+	preset client.Preset
+	skew   *skewEstimator
+	// clock dates the frames of the publish, see captureTime
+	clock  captureClock
+	frames *frameStats
+	// policy constrains the publisher, set before negotiating; size is
+	// the resolution it is checked against
+	policy publishPolicy
+	size   frameSize
+	// heartbeat, if set, fills gaps in the input; guarded by the lock
+	heartbeat *heartbeat
+	// fallback, if set, shows a slate while the publisher is gone; guarded
+	// by the lock
+	fallback *fallback
+	account  *budget.Account
+	// migrating is set once the publisher was told to move to another
+	// instance; guarded by the lock
+	migrating bool
+	// shed is what the degradation ladder of account frees
+	shed     shedding
+	timeline *timeline
+	// log is the logger of the session, see sessionLog
+	log sessionLog
+	// logs are the latest lines logged by the session, and sdps its
+	// redacted offers and answers, for support bundles
+	logs *timeline
+	sdps *timeline
+	// identity is the authenticated publisher, empty without ingest auth
+	identity string
+	created  time.Time
+	// profile is the HLS compatibility profile the output is held to
+	profile hlsProfile
+	// container is containerTS or containerFMP4, see resolveContainer
+	container string
+	// videoCodec is the codec the publisher sends, once answered; other
+	// than codecH264 it is transcoded unless AV1 or H.265 is passed through.
+	// Guarded
+	// by the lock.
+	videoCodec string
+	// h264 completes the IDRs of H.264 video with its parameter sets,
+	// those of the offer until the publisher sends its own. Guarded by the
+	// lock.
+	h264 h264Params
+	// av1Passthrough packages AV1 as published, see resolveAV1Passthrough
+	av1Passthrough bool
+	// h265Passthrough packages H.265 as published, see
+	// resolveH265Passthrough
+	h265Passthrough bool
+	// opusPassthrough packages the Opus of WebRTC publishers as published,
+	// see resolveOpusPassthrough
+	opusPassthrough bool
+	// splitmux has splitmuxsink cut the segments, their playlist written by
+	// a playlistWriter, see resolveSplitmux. Guarded by the lock.
+	splitmux bool
+	// loudnessTarget is the loudness the audio of the outputs is normalized
+	// to, in LUFS, 0 when it is not, see resolveLoudness. Guarded by the
+	// lock.
+	loudnessTarget float64
+	// watermark is overlaid on the video of the output, nil without one,
+	// see watermarkFor. Guarded by the lock.
+	watermark *watermark
+	// layer is the simulcast layer wanted, see resolveLayer
+	layer string
+	// screen is the published stream sharing a screen, composited with the
+	// camera in compositeLayout, see resolveComposite
+	screen          string
+	compositeLayout string
+	// composite mixes the camera and the screen into the video of the
+	// output, nil unless composited. Guarded by the lock.
+	composite *compositor
+	// ingest is protocolRTMP, protocolSRT, protocolRTSP or protocolRTP for
+	// publishers that are not WebRTC, protocolWHEP for streams pulled from an origin, protocolMixer
+	// for the broadcast of a mixed room, protocolSynthetic for the
+	// publishers of the load generator, empty otherwise
+	ingest string
+	// upstream is the origin an edge pulls the stream from, see setupEdge
+	upstream string
+	// rtmp is the connection of an RTMP publisher, nil for others
+	rtmp *rtmp.Conn
+	// aacCaps are the caps of the AAC a publisher that is not WebRTC sends,
+	// empty without audio and for the Opus of WebRTC publishers
+	aacCaps string
+	// srtEgress is the uri the output is republished to, see
+	// resolveSRTEgress
+	srtEgress string
+
+	sync.Mutex
+	closed    bool
+	transport *mediaserver.Transport
+	refresher *keyframeRequester
+	// remoteUfrag is the ICE username fragment of the publisher, which a
+	// renegotiation keeps, and offered the ids of the streams of its latest
+	// offer
+	remoteUfrag string
+	offered     map[string]bool
+	// pins are the payload types of the connection the session was
+	// negotiated on, set once, which a reconnect keeps
+	pins *payloadPins
+	// reconnectToken resumes the session on a new connection, see
+	// reconnects, and parked is set while the session waits for its
+	// publisher to, ending it when it fires
+	reconnectToken string
+	parked         *time.Timer
+	// endpoints are those of the connections the session outlived, and
+	// retired the transports ICE restarts replaced, released on close
+	endpoints []*mediaserver.Endpoint
+	retired   []*mediaserver.Transport
+	// videoFeed and audioFeed are the published streams feeding the output
+	// its video and audio, see feedVideo
+	videoFeed *feed
+	audioFeed *feed
+	hls       *hlsOutput
+	// streams are the outputs of the published streams other than the one
+	// feeding hls, by stream id, see startStreamOutput, and videoFrames
+	// hand out the frames of the video tracks they and the feeds read
+	streams     map[string]*publishedOutput
+	videoFrames map[*mediaserver.IncomingStreamTrack]*videoFrames
+	// supervisor is the state of the output as its supervisor sees it, see
+	// superviseOutput
+	supervisor pipelineStatus
+	// ll packages the output as LL-HLS too, timed from llStart, fed by
+	// llWriter
+	ll       *llhls.Packager
+	llWriter *llWriter
+	llStart  time.Time
+	started  bool
+	// generation names the segments of the output, once started
+	generation int64
+	// pipeline is the launch description of the output, once started
+	pipeline string
+	// audio is set when the output muxes the publisher's audio, into the
+	// audio-only rendition alone for fMP4 outputs
+	audio bool
+	// dash is set when the output writes DASH next to HLS
+	dash bool
+	// audioRendition is set when the output writes an audio-only
+	// rendition, see outputAudio
+	audioRendition bool
+	// mainAudio and alternateAudio are the audio tracks the publisher
+	// offered, see resolveAudioTracks
+	mainAudio      audioTrack
+	alternateAudio []audioTrack
+	// packagedAudio are the alternate audio tracks the output writes a
+	// rendition of, see alternateAudioTrack
+	packagedAudio []audioTrack
+	// captionLanguage is the language the output is captioned in, empty
+	// when it is not
+	captionLanguage string
+	// cmaf times the DASH manifest of fMP4 outputs, once started
+	cmaf *cmafTimeline
+	// ladder are the renditions transcoded next to the published video
+	ladder []abr.Rung
+	// restreams push the output to the third-party destinations of the
+	// stream key, by destination id: nil while not connected, the map nil
+	// until the output starts
+	restreams map[string]*restreamOutput
+	// recording writes the output to a file, while recording
+	recording *recordingOutput
+	// sinks are the outputs attached next to the HLS one, by id, the map
+	// nil until the output starts; sinkSeq numbers them
+	sinks   map[string]*attachedSink
+	sinkSeq int
+	// capture dumps the packets of the publisher, while capturing, into
+	// the files of dumper, attached to the transport on the first capture
+	capture *packetCapture
+	dumper  *mediaserver.PCAPDumper
+	// simulcast picks the encoding of a simulcast publisher feeding the
+	// output, once negotiated
+	simulcast *layerSelection
+	// final is the playlist the output left behind, once ended
+	final []byte
+	// scratch is created by scratchDir and removed on close
+	scratch *scratch.Dir
+	// extensions is the sampled header extension usage, once taken
+	extensions *ExtensionUsage
+	// playable is the time to the first playable playlist, once served
+	playable time.Duration
+	// lastSegment is when the output last wrote a segment, see watchSegments
+	lastSegment time.Time
+	// trace is the span of the publish until its first segment, and
+	// traceMark when its last step ended, see startTrace
+	trace     *tracing.Span
+	traceMark time.Time
+	// thumbnailQueued is when a thumbnail was last queued, and thumbnailAt
+	// when one was last written, see takeThumbnail
+	thumbnailQueued time.Time
+	thumbnailAt     time.Time
+	// incoming is the published stream WebRTC viewers attach to, once
+	// negotiated, and viewers are the attached viewers by id
+	incoming *mediaserver.IncomingStream
+	viewers  map[string]*webrtcViewer
+	// relay republishes a publish that is not WebRTC for WebRTC viewers, once
+	// started
+	relay *ingestRelay
+
+	// previous is the session this one took over, if any
+	previous *session
+	// replaced is set once a new publish took the key over
+	replaced bool
+
+	once sync.Once
+	done chan struct{}
+}
+
+func newSession(key string, conn *signaling, preset client.Preset) *session {
+	s := &session{
+		id:         newSessionID(),
+		key:        key,
+		kind:       client.KindVideo,
+		conn:       conn,
+		preset:     preset,
+		profile:    hlsProfiles[client.ProfileWebDefault],
+		container:  containerTS,
+		videoCodec: codecH264,
+		skew:       newSkewEstimator(),
+		frames:     newFrameStats(frameAlertsFor(preset)),
+		done:       make(chan struct{}),
+		timeline:   newTimeline(timelineSize),
+		logs:       newTimeline(sessionLogSize),
+		sdps:       newTimeline(sdpHistorySize),
+		created:    time.Now(),
+	}
+	s.account = memory.Account(key, sessionMemoryLimit(), s.degradations()...)
+	s.heartbeat = heartbeatFor(key, preset.SegmentDuration, s.account)
+	s.fallback = fallbackFor(key)
+	s.log.with("stream", key, "session", s.id)
+	if conn != nil {
+		s.log.with("connection", conn.id)
+	}
+	return s
+}
+
+// waitPrevious blocks until the session we took over has released its pipeline,
+// so two pipelines never write the same output at once. When it has not
+// after releaseTimeout the takeover is rejected with errPreviousHeld, the
+// output left to the previous pipeline.
+func (s *session) waitPrevious() error {
+	if s.previous == nil {
+		return nil
+	}
+	select {
+	case <-s.previous.done:
+		return nil
+	case <-time.After(releaseTimeout):
+		s.logf("previous session %s did not release its pipeline", s.previous.id)
+		return errPreviousHeld
+	}
+}
+
+// startPipeline creates and starts the HLS pipeline, as a new output
+// generation, unless the session was closed (e.g. replaced) while it was
+// still negotiating. With audio the pipeline also muxes the frames given
+// to pushAudio.
+func (s *session) startPipeline(audio bool) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return errStreamReplaced
+	}
+	if s.hls != nil {
+		// one output per session
+		return nil
+	}
+	out := outputs.get(s.key)
+	if err := os.MkdirAll(out.dir, 0755); err != nil {
+		return err
+	}
+	generation := out.generations.next()
+	for _, rung := range s.ladder {
+		if err := os.MkdirAll(rungDir(out.dir, rung), 0755); err != nil {
+			return err
+		}
+	}
+	rendition, packaged := s.outputAudio(audio)
+	if rendition {
+		if err := os.MkdirAll(audioRenditionDir(out.dir), 0755); err != nil {
+			return err
+		}
+	}
+	for _, alternate := range packaged {
+		if err := os.MkdirAll(alternateAudioDir(out.dir, alternate.language), 0755); err != nil {
+			return err
+		}
+	}
+	// captions transcribe the AAC muxed into TS segments
+	provider := captionProvider(s.key)
+	captioned := provider != nil && audio && s.container != containerFMP4
+	switch codec, input := s.outputCodec(), s.inputCodec(); {
+	case codec != input:
+		s.logf("transcoding %s to h264", input)
+	case codec == codecAV1:
+		s.logf("passing av1 through")
+	case codec == codecH265:
+		s.logf("passing h265 through")
+	}
+	if audio && s.passesOpus() {
+		s.logf("passing opus through")
+	}
+	splitmux, err := resolveSplitmux(s.container, s.key)
+	if err != nil {
+		return err
+	}
+	s.splitmux = splitmux
+	target, err := resolveLoudness(s.key)
+	if err != nil {
+		return err
+	}
+	switch {
+	case target == 0 || !audio:
+	case s.passesOpus():
+		s.logf("not normalizing loudness, opus passed through")
+		target = 0
+	default:
+		s.logf("normalizing loudness to %g LUFS", target)
+	}
+	s.loudnessTarget = target
+	mark, err := watermarkFor(s.key)
+	if err != nil {
+		return err
+	}
+	if codec := s.outputCodec(); mark != nil && codec != codecH264 {
+		s.logf("not watermarking, %s passed through", codec)
+		mark = nil
+	}
+	s.watermark = mark
+	pipeline := s.outputPipeline(out.dir, generation, audio, captioned).String()
+	hls, err := newHLSOutput(pipeline)
+	if err != nil {
+		return err
+	}
+	if rtpTimestamps(s.key) {
+		hls.timing = newOutputTiming(time.Now())
+	}
+	if splitmux {
+		hls.playlist = newPlaylistWriter(s.preset, out.dir, generation, s.dateFrom(time.Now()))
+		go hls.playlist.run(hls.released)
+	}
+	s.generation = generation
+	s.pipeline = pipeline
+	s.audio = audio
+	s.audioRendition = rendition
+	s.packagedAudio = packaged
+	// the rungs mux the audio of the output, see sidePipeline
+	if hls.ladder, err = s.startLadder(out.dir, generation); err != nil {
+		hls.Release()
+		return err
+	}
+	s.cmaf = nil
+	if s.container == containerFMP4 {
+		s.cmaf = newCMAFTimeline(time.Now())
+	}
+	s.captionLanguage = ""
+	if captioned {
+		s.captionLanguage = captionLanguage(s.key)
+		out.captions.begin(generation, time.Now())
+		go s.transcribe(hls.pcm, provider, s.captionLanguage, generation)
+	} else {
+		out.captions.end()
+	}
+	// hlssink starts a new media sequence
+	out.gates.reset(s.profile.rules())
+	s.ll, s.llWriter = nil, nil
+	// LL-HLS packages the published H.264 itself, without the watermark
+	if lowLatency(s.preset, s.key) && s.inputCodec() == codecH264 && s.watermark == nil {
+		s.llStart = time.Now()
+		s.ll = newLowLatency(s.preset, out.dir, generation, s.dateFrom(s.llStart))
+		s.llWriter = s.startLowLatency(s.ll)
+	}
+	out.setLowLatency(s.ll)
+	s.shed.set(hls.ladder, s.llWriter)
+	s.hls = hls
+	s.started = true
+	s.supervisor.set(pipelineRunning, time.Now())
+	go s.superviseOutput(hls)
+	s.startRestreams()
+	s.startSinks()
+	s.timeline.add(eventPipeline, "started")
+	// a recording outlives a restart of the output
+	if s.recording == nil && (recordAlways(s.key) || scheduled.records(s.key)) {
+		if _, err := s.startRecording(); err != nil {
+			s.logf("recording: %v", err)
+		}
+	}
+	return nil
+}
+
+// produced reports whether the session ever started its output
+func (s *session) produced() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.started
+}
+
+// push feeds a frame captured at at to the pipeline, dropping it once
+// ingest stopped
+func (s *session) push(frame []byte, at frameTime) {
+	s.Lock()
+	keyframe := videoKeyframe(s.inputCodec(), frame)
+	if s.inputCodec() == codecH264 {
+		if frame = s.h264.complete(frame); frame == nil {
+			s.Unlock()
+			return
+		}
+	}
+	now := time.Now()
+	if s.fallback != nil {
+		ok, slate := s.fallback.real(keyframe, now)
+		if slate != nil {
+			go slate.stop()
+			s.timeline.add(eventMedia, "publisher back, fallback slate ended")
+			s.logf("publisher back, fallback slate ended")
+		}
+		if !ok {
+			s.Unlock()
+			return
+		}
+	}
+	if s.heartbeat == nil || s.heartbeat.real(frame, keyframe, now) {
+		s.output(frame, at, keyframe)
+	}
+	s.Unlock()
+}
+
+// output feeds a frame to the pipeline and queues it for the LL-HLS
+// packaging, with the session locked
+func (s *session) output(frame []byte, at frameTime, keyframe bool) {
+	if s.hls == nil {
+		return
+	}
+	s.hls.push(frame, at, keyframe)
+	if s.hls.ladder != nil {
+		s.hls.ladder.push(frame, keyframe)
+	}
+	for _, r := range s.restreams {
+		if r != nil {
+			r.push(frame, keyframe)
+		}
+	}
+	if s.recording != nil {
+		s.recording.push(frame, keyframe)
+	}
+	for _, a := range s.sinks {
+		a.sink.WriteVideo(frame, keyframe)
+	}
+	if keyframe {
+		now := time.Now()
+		outputs.get(s.key).dates.mark(s.generation, now, s.captureTime(now))
+	}
+	if keyframe && s.cmaf != nil {
+		s.cmaf.parameters(s.outputCodec(), frame)
+	}
+	if s.llWriter != nil {
+		// timed on arrival, as appsrc timestamps the pipeline's frames
+		s.llWriter.push(frame, time.Since(s.llStart), keyframe)
+	}
+}
+
+// pushAudio feeds an Opus frame captured at at to the audio branch of the
+// pipeline, dropping it while the fallback slate shows
+func (s *session) pushAudio(frame []byte, at frameTime) {
+	s.Lock()
+	defer s.Unlock()
+	if s.fallback != nil && s.fallback.showing {
+		return
+	}
+	s.writeAudio(frame, at)
+}
+
+// writeAudio feeds an audio frame to the audio branch of the pipeline and
+// the other outputs, with the session locked
+func (s *session) writeAudio(frame []byte, at frameTime) {
+	if s.hls == nil || !s.audio {
+		return
+	}
+	s.hls.pushAudio(frame, at)
+	if s.hls.ladder != nil {
+		s.hls.ladder.pushAudio(frame)
+	}
+	for _, r := range s.restreams {
+		if r != nil {
+			r.pushAudio(frame)
+		}
+	}
+	if s.recording != nil {
+		s.recording.pushAudio(frame)
+	}
+	for _, a := range s.sinks {
+		a.sink.WriteAudio(frame)
+	}
+}
+
+// detachOutput stops ingest into the pipeline and hands it to the caller
+func (s *session) detachOutput() *hlsOutput {
+	s.Lock()
+	defer s.Unlock()
+	return s.detachLocked()
+}
+
+// detachLocked is detachOutput with the session locked
+func (s *session) detachLocked() *hlsOutput {
+	hls := s.hls
+	s.hls = nil
+	s.shed.set(nil, nil)
+	if s.llWriter != nil {
+		// its players get the ENDLIST once the queued frames are written
+		s.llWriter.close()
+		s.ll, s.llWriter = nil, nil
+	}
+	return hls
+}
+
+// stopPipeline finalizes the output, if any, and leaves the session open
+func (s *session) stopPipeline() {
+	s.Lock()
+	hls := s.detachLocked()
+	s.supervisor.set(pipelineStopped, time.Now())
+	s.Unlock()
+	if hls == nil {
+		return
+	}
+	s.timeline.add(eventPipeline, "stopping")
+	plan := teardown.NewPlan(s.teardownLogf)
+	plan.AddSink(hls)
+	plan.Run(context.Background())
+	s.endGeneration()
+}
+
+// endGeneration hands the playlist the flushed output left behind to the
+// output of the stream key
+func (s *session) endGeneration() {
+	out := outputs.get(s.key)
+	if final, err := ioutil.ReadFile(out.playlist()); err == nil {
+		s.Lock()
+		s.final = final
+		replaced := s.replaced
+		s.Unlock()
+		// the playlist of a takeover goes on with a discontinuity
+		if !replaced || !out.generations.replaced(s.generation, final, s.preset) {
+			out.generations.ended(s.generation, final, s.preset)
+		}
+	}
+	s.Lock()
+	migrating := s.migrating
+	s.Unlock()
+	if migrating {
+		// the target of the migration continues the stored playlist
+		uploadHandover(s.key)
+		return
+	}
+	// the ENDLIST revision
+	uploadOutput(s.key)
+}
+
+// watchClockSkew re-evaluates the publisher clock offset from the sender
+// reports of track every clock_skew_interval seconds until the session closes,
+// warning the publisher when it exceeds clock_skew_threshold_ms. The warning
+// is re-armed once the skew falls back under half the threshold.
+func (s *session) watchClockSkew(track *mediaserver.IncomingStreamTrack) {
+	interval := time.Duration(envInt("clock_skew_interval", 5)) * time.Second
+	threshold := time.Duration(envInt("clock_skew_threshold_ms", 1000)) * time.Millisecond
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	warned := false
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		s.skew.sampleTrack(track)
+		skew, ok := s.skew.skew()
+		if !ok {
+			continue
+		}
+		skew = absDuration(skew)
+		switch {
+		case !warned && skew > threshold:
+			warned = true
+			s.warn(warning{
+				code:    client.WarningClockSkew,
+				text:    fmt.Sprintf("publisher clock is off by %v", skew.Round(time.Millisecond)),
+				details: map[string]interface{}{"skewMs": milliseconds(skew), "thresholdMs": milliseconds(threshold)},
+			})
+		case warned && skew < threshold/2:
+			warned = false
+		}
+	}
+}
+
+// clockSkew returns the smoothed publisher clock offset, once a sender
+// report was received
+func (s *session) clockSkew() (time.Duration, bool) {
+	return s.skew.skew()
+}
+
+// teardownLogf logs teardown phases and records them on the timeline
+func (s *session) teardownLogf(format string, args ...interface{}) {
+	s.logf(format, args...)
+	s.timeline.add(eventSession, fmt.Sprintf(format, args...))
+}
+
+func (s *session) logf(format string, args ...interface{}) {
+	line := fmt.Sprintf(format, args...)
+	s.log.get().Info(line)
+	s.logs.add("log", line)
+}
+
+// setTransport records the transport and refresher so close can release them
+func (s *session) setTransport(transport *mediaserver.Transport, refresher *keyframeRequester) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return false
+	}
+	s.transport = transport
+	s.refresher = refresher
+	s.log.with("transport", transport.GetLocalICEInfo().GetUfrag())
+	return true
+}
+
+// close tears the session down once, in teardown order: ingest stops before
+// the output is flushed and finalized, and transports are released last.
+// code and reason are sent to the publisher when code is non zero.
+func (s *session) close(code int, reason string) {
+	s.once.Do(func() {
+		if code != 0 {
+			s.timeline.add(eventSession, fmt.Sprintf("closing %d %s", code, reason))
+		} else {
+			s.timeline.add(eventSession, "closing")
+		}
+		reconnects.forget(s)
+		s.endTrace(reason)
+		s.Lock()
+		s.closed = true
+		if s.parked != nil {
+			s.parked.Stop()
+			s.parked = nil
+		}
+		transport, refresher, tmp := s.transport, s.refresher, s.scratch
+		retired, endpoints := s.retired, s.endpoints
+		s.retired, s.endpoints = nil, nil
+		viewers, relay, restreams, recording := s.viewers, s.relay, s.restreams, s.recording
+		s.viewers, s.relay, s.restreams, s.recording = nil, nil, nil, nil
+		sinks := s.sinks
+		s.sinks = nil
+		capture, dumper := s.capture, s.dumper
+		s.capture, s.dumper = nil, nil
+		s.Unlock()
+
+		// frames are dropped from here on
+		hls := s.detachOutput()
+
+		plan := teardown.NewPlan(s.teardownLogf)
+		s.detachStreams(plan)
+		if s.rtmp != nil {
+			plan.Add(teardown.StopIngest, "rtmp", func(context.Context) error {
+				return s.rtmp.Close()
+			})
+		}
+		if refresher != nil {
+			plan.Add(teardown.StopIngest, "refresher", func(context.Context) error {
+				refresher.Stop()
+				return nil
+			})
+		}
+		plan.Add(teardown.StopIngest, "fallback slate", func(context.Context) error {
+			s.stopFallback()
+			return nil
+		})
+		if composite := s.compositor(); composite != nil {
+			plan.Add(teardown.StopIngest, "compositor", func(context.Context) error {
+				composite.stop()
+				return nil
+			})
+		}
+		if capture != nil {
+			plan.Add(teardown.StopIngest, "packet capture", func(context.Context) error {
+				capture.stop()
+				return nil
+			})
+		}
+		if hls != nil {
+			plan.AddSink(hls)
+		}
+		if recording != nil {
+			plan.AddSink(recording)
+		}
+		for _, a := range sinks {
+			plan.Add(teardown.Flush, "sink "+a.spec, a.sink.Stop)
+		}
+		if len(viewers) > 0 {
+			plan.Add(teardown.StopIngest, "webrtc viewers", func(context.Context) error {
+				for _, v := range viewers {
+					v.stop(client.CloseStreamEnded, "publish ended")
+				}
+				return nil
+			})
+		}
+		if len(restreams) > 0 {
+			plan.Add(teardown.Release, "restreams", func(context.Context) error {
+				for _, r := range restreams {
+					if r != nil {
+						r.release()
+					}
+				}
+				return nil
+			})
+		}
+		if relay != nil {
+			plan.Add(teardown.Release, "relay", func(context.Context) error {
+				relay.stop()
+				return nil
+			})
+		}
+		if transport != nil || len(endpoints) > 0 {
+			plan.Add(teardown.Release, "transport", func(context.Context) error {
+				for _, t := range retired {
+					t.Stop()
+				}
+				if transport != nil {
+					transport.Stop()
+				}
+				// those of the connections the session outlived
+				for _, endpoint := range endpoints {
+					releaseEndpoint(endpoint)
+				}
+				return nil
+			})
+		}
+		if dumper != nil {
+			plan.Add(teardown.Release, "packet dumper", func(context.Context) error {
+				dumper.Delete()
+				return nil
+			})
+		}
+		if tmp != nil {
+			plan.Add(teardown.Release, "scratch", func(context.Context) error {
+				return tmp.Remove()
+			})
+		}
+		if code != 0 && s.conn != nil {
+			plan.Add(teardown.Release, "signaling", func(context.Context) error {
+				return s.conn.close(code, reason)
+			})
+		}
+		plan.Run(context.Background())
+		if hls != nil {
+			s.endGeneration()
+			s.archiveVOD()
+		}
+		s.account.Close()
+		timelines.put(s.key, s.timeline)
+		retained.put(s.record(time.Now()))
+		close(s.done)
+	})
+}
+
+// end closes a publish that is over, handing its stream key back. When the
+// key was still the session's, the schedule hears the stream ended and
+// its storyboard is scheduled.
+func (s *session) end() {
+	s.endWith(0, "")
+}
+
+// endWith ends the session like end, closing the signaling with code
+func (s *session) endWith(code int, reason string) {
+	ended := registry.release(s)
+	s.close(code, reason)
+	if ended {
+		scheduled.publishEnded(s.key)
+		s.notifyEnded(code, reason)
+	}
+	if ended && s.produced() {
+		scheduleStoryboard(s.key)
+	}
+}
+
+var (
+	_ = metrics.NewGaugeFunc("webrtc_transports",
+		"Active WebRTC transports, by role", "role", func() map[string]float64 {
+			counts := map[string]float64{"publisher": 0, "viewer": 0}
+			for _, key := range registry.keys() {
+				if sess := registry.get(key); sess != nil {
+					sess.Lock()
+					if sess.transport != nil {
+						counts["publisher"]++
+					}
+					counts["viewer"] += float64(len(sess.viewers))
+					sess.Unlock()
+				}
+			}
+			return counts
+		})
+	_ = metrics.NewGaugeFunc("hls_pipelines",
+		"Running HLS pipelines", "", func() map[string]float64 {
+			running := 0.0
+			for _, key := range registry.keys() {
+				if sess := registry.get(key); sess != nil {
+					sess.Lock()
+					if sess.hls != nil {
+						running++
+					}
+					sess.Unlock()
+				}
+			}
+			return map[string]float64{"": running}
+		})
+)
+
+// sessionRegistry tracks which session currently owns each stream key, and
+// each external id
+type sessionRegistry struct {
+	sync.Mutex
+	sessions  map[string]*session
+	externals map[string]*session
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{
+		sessions:  map[string]*session{},
+		externals: map[string]*session{},
+	}
+}
+
+// claim makes s the owner of its key; with takeover the previous owner is
+// closed and returned so the caller can wait for it to release the output.
+// An external id live under another key is never taken over, nor a key
+// live on another instance of the cluster.
+func (r *sessionRegistry) claim(s *session, policy conflictPolicy) (*session, error) {
+	if err := claimCluster(s.key); err != nil {
+		return nil, err
+	}
+	r.Lock()
+	if other := r.externals[s.externalID]; s.externalID != "" && other != nil && other.key != s.key {
+		_, held := r.sessions[s.key]
+		r.Unlock()
+		if !held {
+			releaseCluster(s.key)
+		}
+		return nil, &externalIDConflict{externalID: s.externalID, session: other.id}
+	}
+	current, ok := r.sessions[s.key]
+	if ok && current != s && policy != conflictTakeover {
+		r.Unlock()
+		return nil, errStreamBusy
+	}
+	r.sessions[s.key] = s
+	if ok && current.externalID != "" && r.externals[current.externalID] == current {
+		delete(r.externals, current.externalID)
+	}
+	if s.externalID != "" {
+		r.externals[s.externalID] = s
+	}
+	r.Unlock()
+
+	if ok && current != s {
+		s.notifyReplaced(current)
+	}
+	if !ok || current != s {
+		s.notifyStarted()
+	}
+	if ok && current != s {
+		current.Lock()
+		current.replaced = true
+		current.Unlock()
+		s.previous = current
+		s.timeline.add(eventSession, "took over from a previous publish")
+		current.timeline.add(eventSession, "taken over by a new publish")
+		go current.close(client.CloseReplaced, errStreamReplaced.Error())
+		return current, nil
+	}
+	return nil, nil
+}
+
+// hasSession reports whether a session with the given id owns a key
+func (r *sessionRegistry) hasSession(id string) bool {
+	r.Lock()
+	defer r.Unlock()
+	for _, s := range r.sessions {
+		if s.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// get returns the session owning key, or nil
+func (r *sessionRegistry) get(key string) *session {
+	r.Lock()
+	defer r.Unlock()
+	return r.sessions[key]
+}
+
+// byExternal returns the live session with the external id, or nil
+func (r *sessionRegistry) byExternal(id string) *session {
+	r.Lock()
+	defer r.Unlock()
+	return r.externals[id]
+}
+
+// find returns the live session known by id as stream key, external id or
+// session id, in that order
+func (r *sessionRegistry) find(id string) *session {
+	r.Lock()
+	defer r.Unlock()
+	if s := r.sessions[id]; s != nil {
+		return s
+	}
+	if s := r.externals[id]; s != nil {
+		return s
+	}
+	for _, s := range r.sessions {
+		if s.id == id {
+			return s
+		}
+	}
+	return nil
+}
+
+// keys returns the live stream keys
+func (r *sessionRegistry) keys() []string {
+	r.Lock()
+	defer r.Unlock()
+	keys := make([]string, 0, len(r.sessions))
+	for key := range r.sessions {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// release drops s from the registry if it still owns its key, reporting
+// whether it did (false once another publish took the key over). The key
+// is handed back to the cluster.
+func (r *sessionRegistry) release(s *session) bool {
+	r.Lock()
+	if r.externals[s.externalID] == s {
+		delete(r.externals, s.externalID)
+	}
+	owned := r.sessions[s.key] == s
+	if owned {
+		delete(r.sessions, s.key)
+	}
+	r.Unlock()
+	if owned {
+		releaseCluster(s.key)
+	}
+	return owned
+}
@@ -0,0 +1,102 @@
+package streamserver
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// serve runs server until it fails or the process is asked to stop with
+// SIGINT or SIGTERM, then shuts down gracefully. With a TLS config it
+// serves TLS, WebSockets as WSS, with the certificate of certFile unless
+// the config gets its own. A server shut down otherwise, see
+// Server.Shutdown, returns nil.
+func serve(server *http.Server, certFile, keyFile string) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	failed := make(chan error, 1)
+	go func() {
+		if server.TLSConfig != nil {
+			failed <- server.ListenAndServeTLS(certFile, keyFile)
+		} else {
+			failed <- server.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err := <-failed:
+		if err == http.ErrServerClosed {
+			return nil
+		}
+		return err
+	case sig := <-signals:
+		logger.Info("shutting down", "signal", sig.String())
+		// a second signal exits right away
+		signal.Reset(syscall.SIGINT, syscall.SIGTERM)
+	}
+	timeout := time.Duration(envInt("shutdown_timeout", 30)) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := shutdown(ctx, server); err != nil {
+		logger.Error("shutdown failed", "error", err)
+	}
+	// the spans of the sessions just closed
+	if err := tracer.Flush(ctx); err != nil {
+		logger.Warn("spans not exported", "error", err)
+	}
+	return nil
+}
+
+// shutdown stops the instance without truncating any output: new publishes
+// are refused, every live session is closed, its publisher told with a
+// going away close, so the pipeline gets its EOS and hlssink writes the last
+// segment and the ENDLIST playlist, and only then does the listener stop.
+// Sessions still tearing down when ctx is done are abandoned.
+func shutdown(ctx context.Context, server *http.Server) error {
+	drain.Lock()
+	drain.draining = true
+	drain.Unlock()
+
+	var sessions []*session
+	for _, key := range registry.keys() {
+		if sess := registry.get(key); sess != nil {
+			sessions = append(sessions, sess)
+		}
+	}
+	var wg sync.WaitGroup
+	for _, sess := range sessions {
+		wg.Add(1)
+		go func(sess *session) {
+			defer wg.Done()
+			sess.timeline.add(eventSession, "server shutting down")
+			sess.endWith(websocket.CloseGoingAway, "server shutting down")
+		}(sess)
+	}
+	ended := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(ended)
+	}()
+	select {
+	case <-ended:
+	case <-ctx.Done():
+		for _, sess := range sessions {
+			select {
+			case <-sess.done:
+			default:
+				sess.log.get().Warn("shutdown abandoned finalizing")
+			}
+		}
+	}
+	if server == nil {
+		return nil
+	}
+	return server.Shutdown(ctx)
+}
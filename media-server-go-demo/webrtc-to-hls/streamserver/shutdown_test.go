@@ -0,0 +1,45 @@
+package streamserver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+)
+
+func TestShutdown(t *testing.T) {
+	defer func() {
+		drain.Lock()
+		drain.draining = false
+		drain.Unlock()
+	}()
+	sessions := []*session{
+		newSession("shutdown-a", nil, presets[client.LatencyBalanced]),
+		newSession("shutdown-b", nil, presets[client.LatencyBalanced]),
+	}
+	for _, sess := range sessions {
+		if _, err := registry.claim(sess, conflictReject); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdown(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, sess := range sessions {
+		select {
+		case <-sess.done:
+		default:
+			t.Fatalf("%s not closed", sess.key)
+		}
+		if registry.get(sess.key) != nil {
+			t.Fatalf("%s still owns its key", sess.key)
+		}
+	}
+	if _, err := admitPublish(client.Message{}, "shutdown-c"); err != errDraining {
+		t.Fatalf("publish during shutdown: %v", err)
+	}
+}
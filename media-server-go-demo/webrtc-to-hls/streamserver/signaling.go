@@ -0,0 +1,288 @@
+package streamserver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/metrics"
+	"github.com/notedit/sdp"
+)
+
+var websocketErrors = metrics.NewCounter("websocket_errors_total",
+	"Signaling websocket failures, by stage: upgrade, read, decode, timeout, write, ping or panic", "stage")
+
+// signalingWriteTimeout bounds a write to a signaling websocket, so a peer
+// that stopped reading cannot hold its writers
+const signalingWriteTimeout = 10 * time.Second
+
+var (
+	errBadOffer = errors.New("bad offer")
+	errInternal = errors.New("internal error")
+	// errDetached is a send to a publisher that is reconnecting
+	errDetached = errors.New("publisher reconnecting")
+)
+
+// parseOffer parses an SDP offer. The parser panics on some malformed
+// offers, e.g. a media section without fingerprint, which is turned into
+// errBadOffer like its errors; so is an offer without media or ICE
+// credentials, before a transport is created for it.
+func parseOffer(raw string) (offer *sdp.SDPInfo, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			offer, err = nil, fmt.Errorf("%w: %v", errBadOffer, r)
+		}
+	}()
+	offer, err = sdp.Parse(raw)
+	switch {
+	case err != nil:
+		return nil, fmt.Errorf("%w: %v", errBadOffer, err)
+	case len(offer.GetMedias()) == 0:
+		return nil, fmt.Errorf("%w: no media", errBadOffer)
+	case offer.GetICE() == nil || offer.GetICE().GetUfrag() == "" || offer.GetDTLS() == nil:
+		return nil, fmt.Errorf("%w: no ICE credentials or DTLS fingerprint", errBadOffer)
+	}
+	return offer, nil
+}
+
+// countReadError counts err, from reading a signaling websocket, unless it
+// is the peer closing normally
+func countReadError(err error) {
+	if timedOut(err) {
+		websocketErrors.Inc("timeout")
+		return
+	}
+	if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+		websocketErrors.Inc("read")
+	}
+}
+
+// timedOut reports whether err is a read of keepAlive timing out
+func timedOut(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// signaling serializes writes to a publisher websocket, which besides the
+// channel handler also receives warnings from session goroutines
+type signaling struct {
+	// id tells the connection apart in the logs
+	id   string
+	ws   *websocket.Conn
+	lock sync.Mutex
+	// timeout is how long reads wait for the peer, see keepAlive; forever
+	// at 0
+	timeout time.Duration
+	// detached is set while the publisher is away, its session waiting
+	// for it to reconnect; see takeOver
+	detached bool
+	// version is the protocol version the peer speaks, client.Version1
+	// until it asks for another, see speak; request is the id of the
+	// request the reader handles, which its replies carry
+	version int
+	request string
+	// rate bounds the messages read, any number when nil
+	rate *messageRate
+}
+
+func newSignaling(ws *websocket.Conn) *signaling {
+	return &signaling{id: newSessionID(), ws: ws, version: client.Version1}
+}
+
+// speak has the messages sent in the protocol version the v query
+// parameter of the upgrade request of c asks for, before any is read
+func (s *signaling) speak(c *gin.Context) {
+	if v, err := strconv.Atoi(c.Query("v")); err == nil && v >= client.Version2 {
+		s.lock.Lock()
+		s.version = client.ProtocolVersion
+		s.lock.Unlock()
+	}
+}
+
+// read reads the next message of the peer, in either version: one of
+// Version2 has the messages sent from then on in Version2 as well. A
+// message that does not decode is answered with an error, and the next
+// one read; the error returned is that of the connection, or
+// errSignalingRate once the peer sends more messages than rate allows.
+// Called by the reader alone.
+func (s *signaling) read() (client.Message, error) {
+	for {
+		s.lock.Lock()
+		s.request = ""
+		s.lock.Unlock()
+		_, data, err := s.ws.ReadMessage()
+		if err != nil {
+			return client.Message{}, err
+		}
+		if s.rate != nil && !s.rate.allow(time.Now()) {
+			return client.Message{}, errSignalingRate
+		}
+		msg, err := client.DecodeMessage(data)
+		s.lock.Lock()
+		if msg.Version > s.version {
+			s.version = client.ProtocolVersion
+		}
+		s.request = msg.ID
+		s.lock.Unlock()
+		if unsupported, ok := err.(*client.UnsupportedVersion); ok {
+			s.send(client.Message{Cmd: client.CmdError, Code: client.ErrorUnsupportedVersion, Reason: err.Error(),
+				Details: map[string]interface{}{"version": unsupported.Version, "supported": client.ProtocolVersion}})
+			continue
+		}
+		if err != nil {
+			websocketErrors.Inc("decode")
+			s.sendError(client.ErrorBadMessage, err)
+			continue
+		}
+		return msg, nil
+	}
+}
+
+// send writes msg in the version of the peer. A reply, see client.IsReply,
+// carries the id of the request the reader handles, unless msg has one.
+func (s *signaling) send(msg client.Message) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.detached {
+		return errDetached
+	}
+	if msg.ID == "" && client.IsReply(msg.Cmd) {
+		msg.ID = s.request
+	}
+	data, err := client.EncodeMessage(msg, s.version)
+	if err != nil {
+		return err
+	}
+	s.ws.SetWriteDeadline(time.Now().Add(signalingWriteTimeout))
+	err = s.ws.WriteMessage(websocket.TextMessage, data)
+	if err != nil {
+		websocketErrors.Inc("write")
+	}
+	return err
+}
+
+// signalingSchema handles GET /api/v1/signaling/schema, the JSON schema of
+// the latest version of the signaling protocol
+func signalingSchema(c *gin.Context) {
+	c.Data(http.StatusOK, "application/schema+json", client.Schema)
+}
+
+// sendError answers with an error: code, one of the client.Error codes,
+// and err as the reason
+func (s *signaling) sendError(code string, err error) error {
+	msg := client.Message{Cmd: client.CmdError, Code: code, Reason: err.Error()}
+	if limit, ok := err.(*limitExceeded); ok {
+		msg.Code, msg.Details = client.ErrorLimitExceeded, limit.details()
+	}
+	return s.send(msg)
+}
+
+// recoverPanic, deferred by a signaling handler, turns a panic handling
+// the connection into client.ErrorInternal and a close with
+// CloseInternalServerErr, logged with its stack; the other connections go
+// on. The cleanup the handler defers after it runs first.
+func (s *signaling) recoverPanic() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	websocketErrors.Inc("panic")
+	logger.Error("signaling panic", "connection", s.id, "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+	s.sendError(client.ErrorInternal, errInternal)
+	s.close(websocket.CloseInternalServerErr, errInternal.Error())
+}
+
+// close sends a close frame with code and reason and closes the connection
+func (s *signaling) close(code int, reason string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	message := websocket.FormatCloseMessage(code, reason)
+	s.ws.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+	return s.ws.Close()
+}
+
+// keepAlive pings the peer every ws_ping_interval (10) seconds until done
+// is closed, and has reads fail once nothing, pongs included, came from it
+// for ws_pong_timeout (30) seconds. A browser that crashed without closing
+// the websocket, or whose network went away, then ends its connection like
+// one that closed it, instead of holding its transport and pipeline.
+func (s *signaling) keepAlive(done <-chan struct{}) {
+	interval := time.Duration(envInt("ws_ping_interval", 10)) * time.Second
+	s.timeout = time.Duration(envInt("ws_pong_timeout", 30)) * time.Second
+	s.received()
+	// run by the reader, as are the pings of the peer answered
+	s.ws.SetPongHandler(func(string) error {
+		s.received()
+		return nil
+	})
+	ping := s.ws.PingHandler()
+	s.ws.SetPingHandler(func(data string) error {
+		s.received()
+		return ping(data)
+	})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			if err := s.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(signalingWriteTimeout)); err != nil {
+				websocketErrors.Inc("ping")
+				return
+			}
+		}
+	}()
+}
+
+// received extends the read deadline of keepAlive once the peer sent
+// something, called by the reader
+func (s *signaling) received() {
+	s.lock.Lock()
+	ws, timeout := s.ws, s.timeout
+	s.lock.Unlock()
+	if timeout > 0 {
+		ws.SetReadDeadline(time.Now().Add(timeout))
+	}
+}
+
+// detach drops what is sent to a publisher whose connection dropped, until
+// it reconnects
+func (s *signaling) detach() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.detached = true
+}
+
+// takeOver moves s onto the connection of other, that of its publisher
+// reconnecting, and closes the one it was on: the handler reading it then
+// leaves the session to the new one, see over
+func (s *signaling) takeOver(other *signaling) {
+	s.lock.Lock()
+	previous := s.ws
+	s.ws, s.id, s.timeout, s.detached = other.ws, other.id, other.timeout, false
+	s.version, s.request, s.rate = other.version, other.request, other.rate
+	s.lock.Unlock()
+	if previous != other.ws {
+		message := websocket.FormatCloseMessage(client.CloseReplaced, "reconnected")
+		previous.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+		previous.Close()
+	}
+}
+
+// over reports whether s signals over ws
+func (s *signaling) over(ws *websocket.Conn) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.ws == ws
+}
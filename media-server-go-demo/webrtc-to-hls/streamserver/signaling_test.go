@@ -0,0 +1,252 @@
+package streamserver
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+)
+
+func TestParseOffer(t *testing.T) {
+	for _, raw := range []string{
+		"",
+		"v=0\r\n",
+		// the parser panics on a media section without fingerprint
+		"v=0\r\nm=video 9 UDP/TLS/RTP/SAVPF 96\r\na=rtpmap:96\r\n",
+	} {
+		if _, err := parseOffer(raw); !errors.Is(err, errBadOffer) {
+			t.Errorf("parseOffer(%q) = %v", raw, err)
+		}
+	}
+	if _, err := parseOffer(string(mustRead(t, "testdata/chrome_offer.sdp"))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// dialSignaling serves handler at /ws and dials it
+func dialSignaling(t *testing.T, handler gin.HandlerFunc) (*websocket.Conn, func()) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/ws", handler)
+	server := httptest.NewServer(r)
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", nil)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return ws, func() {
+		ws.Close()
+		server.Close()
+	}
+}
+
+func TestWatchBadOffer(t *testing.T) {
+	sess := newSession("bad-offer", nil, presets[client.LatencyBalanced])
+	if _, err := registry.claim(sess, conflictReject); err != nil {
+		t.Fatal(err)
+	}
+	defer registry.release(sess)
+	ws, done := dialSignaling(t, watchChannel)
+	defer done()
+	if err := ws.WriteJSON(client.Message{Cmd: client.CmdOffer, StreamID: "bad-offer", Sdp: "v=0\r\nm=video 9 UDP/TLS/RTP/SAVPF 96\r\n"}); err != nil {
+		t.Fatal(err)
+	}
+	var msg client.Message
+	if err := ws.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Cmd != client.CmdError || msg.Code != client.ErrorBadOffer {
+		t.Fatalf("reply = %+v", msg)
+	}
+}
+
+func TestRecoverPanic(t *testing.T) {
+	ws, done := dialSignaling(t, func(c *gin.Context) {
+		ws, err := upGrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		conn := newSignaling(ws)
+		defer conn.recoverPanic()
+		var nothing map[string]int
+		nothing["boom"]++
+	})
+	defer done()
+	var msg client.Message
+	if err := ws.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Cmd != client.CmdError || msg.Code != client.ErrorInternal {
+		t.Fatalf("reply = %+v", msg)
+	}
+	_, _, err := ws.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseInternalServerErr) {
+		t.Fatalf("read after the panic = %v", err)
+	}
+}
+
+func TestSignalingVersions(t *testing.T) {
+	ws, done := dialSignaling(t, func(c *gin.Context) {
+		ws, err := upGrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		conn := newSignaling(ws)
+		conn.speak(c)
+		for {
+			msg, err := conn.read()
+			if err != nil {
+				return
+			}
+			conn.send(client.Message{Cmd: client.CmdAnswer, Sdp: "answer-" + msg.Sdp})
+			// not a reply, it carries no request id
+			conn.send(client.Message{Cmd: client.CmdEvent, Event: client.EventICEState, State: iceConnected})
+		}
+	})
+	defer done()
+	exchange := func(raw string) (reply, event string) {
+		t.Helper()
+		if err := ws.WriteMessage(websocket.TextMessage, []byte(raw)); err != nil {
+			t.Fatal(err)
+		}
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), `"cmd":"answer"`) {
+			return string(data), ""
+		}
+		_, next, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data), string(next)
+	}
+
+	if reply, event := exchange(`{"cmd":"offer","sdp":"one"}`); reply != `{"cmd":"answer","sdp":"answer-one"}` || !strings.HasPrefix(event, `{"cmd":"event"`) {
+		t.Fatalf("v1 = %s %s", reply, event)
+	}
+	if reply, _ := exchange(`{"cmd":"offer"`); !strings.Contains(reply, `"code":"bad-message"`) {
+		t.Fatalf("bad message = %s", reply)
+	}
+	if reply, event := exchange(`{"v":2,"id":"r1","cmd":"offer","payload":{"sdp":"two"}}`); reply != `{"v":2,"id":"r1","cmd":"answer","payload":{"sdp":"answer-two"}}` || !strings.HasPrefix(event, `{"v":2,"cmd":"event"`) {
+		t.Fatalf("v2 = %s %s", reply, event)
+	}
+	// the connection stays in version 2
+	if reply, _ := exchange(`{"cmd":"offer","sdp":"three"}`); reply != `{"v":2,"cmd":"answer","payload":{"sdp":"answer-three"}}` {
+		t.Fatalf("v1 after v2 = %s", reply)
+	}
+	if reply, _ := exchange(`{"v":9,"id":"r2","cmd":"offer"}`); !strings.Contains(reply, `"id":"r2"`) || !strings.Contains(reply, `"code":"unsupported-version"`) {
+		t.Fatalf("v9 = %s", reply)
+	}
+}
+
+// TestSilentPublisherEnded has a publisher stop answering pings, as one
+// whose browser crashed does: its connection times out and its session is
+// torn down rather than leaked
+func TestSilentPublisherEnded(t *testing.T) {
+	t.Setenv("ws_ping_interval", "1")
+	t.Setenv("ws_pong_timeout", "2")
+	sess := newSession("silent", nil, presets[client.LatencyBalanced])
+	if _, err := registry.claim(sess, conflictReject); err != nil {
+		t.Fatal(err)
+	}
+	ended := make(chan error, 1)
+	ws, done := dialSignaling(t, func(c *gin.Context) {
+		ws, err := upGrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		conn := newSignaling(ws)
+		stop := make(chan struct{})
+		defer close(stop)
+		conn.keepAlive(stop)
+		defer sess.end()
+		for {
+			var msg client.Message
+			if err := ws.ReadJSON(&msg); err != nil {
+				ended <- err
+				return
+			}
+			conn.received()
+		}
+	})
+	defer done()
+
+	// messages keep the connection alive without pongs
+	for i := 0; i < 6; i++ {
+		if err := ws.WriteJSON(client.Message{Cmd: client.CmdCandidate}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	select {
+	case err := <-ended:
+		t.Fatalf("ended while sending: %v", err)
+	default:
+	}
+	// then the client neither sends nor reads, leaving the pings unanswered
+	select {
+	case err := <-ended:
+		if !timedOut(err) {
+			t.Fatalf("ended by %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("silent connection not timed out")
+	}
+	select {
+	case <-sess.done:
+	case <-time.After(releaseTimeout):
+		t.Fatal("session not closed")
+	}
+	if registry.get("silent") != nil {
+		t.Fatal("stream key still held")
+	}
+}
+
+func TestIdlePublisherEnded(t *testing.T) {
+	sess := newSession("idle", nil, presets[client.LatencyBalanced])
+	if _, err := registry.claim(sess, conflictReject); err != nil {
+		t.Fatal(err)
+	}
+	ws, done := dialSignaling(t, func(c *gin.Context) {
+		ws, err := upGrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			return
+		}
+		sess.conn = newSignaling(ws)
+		sess.endWhenIdle(time.Second)
+	})
+	defer done()
+	_, _, err := ws.ReadMessage()
+	if !websocket.IsCloseError(err, client.CloseIdle) {
+		t.Fatalf("read of an idle publisher = %v", err)
+	}
+	<-sess.done
+	if registry.get("idle") != nil {
+		t.Fatal("stream key still held")
+	}
+}
+
+func TestTakeoverRejectedWhilePreviousHeld(t *testing.T) {
+	defer func(timeout time.Duration) { releaseTimeout = timeout }(releaseTimeout)
+	releaseTimeout = 10 * time.Millisecond
+	previous := newSession("held", nil, presets[client.LatencyBalanced])
+	sess := newSession("held", nil, presets[client.LatencyBalanced])
+	sess.previous = previous
+	if err := sess.waitPrevious(); err != errPreviousHeld {
+		t.Fatalf("waited for a held output: %v", err)
+	}
+	close(previous.done)
+	if err := sess.waitPrevious(); err != nil {
+		t.Fatalf("waited for a released output: %v", err)
+	}
+}
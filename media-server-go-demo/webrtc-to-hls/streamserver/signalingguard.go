@@ -0,0 +1,131 @@
+package streamserver
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/metrics"
+)
+
+var signalingRefused = metrics.NewCounter("signaling_refused_total",
+	"Signaling websockets refused or closed by their limits, by reason: token, connections, size or rate", "reason")
+
+// errSignalingRate ends a connection sending more messages than
+// signaling_max_messages_per_second allows
+var errSignalingRate = errors.New("too many signaling messages")
+
+// signalingConnections are the open signaling websockets by client IP
+var signalingConnections = &ipConnections{open: map[string]int{}}
+
+// ipConnections counts connections by client IP
+type ipConnections struct {
+	sync.Mutex
+	open map[string]int
+}
+
+// acquire counts a connection of ip, false when it already has max; any
+// number at 0
+func (c *ipConnections) acquire(ip string, max int) bool {
+	c.Lock()
+	defer c.Unlock()
+	if max > 0 && c.open[ip] >= max {
+		return false
+	}
+	c.open[ip]++
+	return true
+}
+
+func (c *ipConnections) release(ip string) {
+	c.Lock()
+	defer c.Unlock()
+	if c.open[ip]--; c.open[ip] <= 0 {
+		delete(c.open, ip)
+	}
+}
+
+// signalingToken reports whether the upgrade request r carries one of the
+// tokens of signaling_tokens, comma separated, in its access_token query
+// parameter, as browsers cannot set headers on a websocket, or as a
+// bearer token; any request does when none is set
+func signalingToken(r *http.Request) bool {
+	tokens := envList("signaling_tokens")
+	if len(tokens) == 0 {
+		return true
+	}
+	token := r.URL.Query().Get("access_token")
+	if token == "" {
+		token = bearerToken(r)
+	}
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// guardSignaling refuses the upgrade of a signaling websocket without the
+// token signalingToken wants, or from a client IP that already has
+// signaling_max_connections_per_ip (20, any number at 0) open, before
+// anything is allocated for it
+func guardSignaling(c *gin.Context) {
+	if !signalingToken(c.Request) {
+		signalingRefused.Inc("token")
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "signaling token required"})
+		return
+	}
+	ip := c.ClientIP()
+	if !signalingConnections.acquire(ip, envInt("signaling_max_connections_per_ip", 20)) {
+		signalingRefused.Inc("connections")
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "too many signaling connections"})
+		return
+	}
+	defer signalingConnections.release(ip)
+	c.Next()
+}
+
+// signalingMessageBytes bounds a message of a signaling websocket, from
+// signaling_max_message_bytes (65536): an offer with simulcast and every
+// codec of a browser is a few kilobytes
+func signalingMessageBytes() int64 {
+	return int64(envInt("signaling_max_message_bytes", 64<<10))
+}
+
+// messageRate is a token bucket bounding the messages of a signaling
+// websocket to signaling_max_messages_per_second (20), in bursts of twice
+// that, as the ICE candidates of a browser come; any rate at 0. Used by
+// the reader alone.
+type messageRate struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newMessageRate() *messageRate {
+	rate := float64(envInt("signaling_max_messages_per_second", 20))
+	return &messageRate{rate: rate, tokens: 2 * rate}
+}
+
+// allow takes a token for a message received at now, false when none is
+// left
+func (m *messageRate) allow(now time.Time) bool {
+	if m.rate <= 0 {
+		return true
+	}
+	if !m.last.IsZero() {
+		m.tokens += now.Sub(m.last).Seconds() * m.rate
+		if m.tokens > 2*m.rate {
+			m.tokens = 2 * m.rate
+		}
+	}
+	m.last = now
+	if m.tokens < 1 {
+		return false
+	}
+	m.tokens--
+	return true
+}
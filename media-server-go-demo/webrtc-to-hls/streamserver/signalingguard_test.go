@@ -0,0 +1,93 @@
+package streamserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestGuardSignaling(t *testing.T) {
+	t.Setenv("signaling_tokens", "one, two")
+	t.Setenv("signaling_max_connections_per_ip", "1")
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	// the handler of the first connection holds it until release is closed
+	held, release := make(chan struct{}), make(chan struct{})
+	r.GET("/channel", guardSignaling, func(c *gin.Context) {
+		if c.Query("hold") != "" {
+			close(held)
+			<-release
+		}
+		c.Status(http.StatusOK)
+	})
+	do := func(target string, header ...string) int {
+		req := httptest.NewRequest("GET", target, nil)
+		req.RemoteAddr = "192.0.2.1:5000"
+		if len(header) == 2 {
+			req.Header.Set(header[0], header[1])
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := do("/channel"); code != http.StatusUnauthorized {
+		t.Fatalf("without token: %d", code)
+	}
+	if code := do("/channel?access_token=three"); code != http.StatusUnauthorized {
+		t.Fatalf("wrong token: %d", code)
+	}
+	if code := do("/channel", "Authorization", "Bearer two"); code != http.StatusOK {
+		t.Fatalf("bearer token: %d", code)
+	}
+
+	done := make(chan int)
+	go func() { done <- do("/channel?access_token=one&hold=1") }()
+	<-held
+	if code := do("/channel?access_token=one"); code != http.StatusTooManyRequests {
+		t.Fatalf("second connection of the ip: %d", code)
+	}
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Fatalf("held connection: %d", code)
+	}
+	if code := do("/channel?access_token=one"); code != http.StatusOK {
+		t.Fatalf("after the first closed: %d", code)
+	}
+}
+
+func TestMessageRate(t *testing.T) {
+	t.Setenv("signaling_max_messages_per_second", "5")
+	m := newMessageRate()
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		if !m.allow(now) {
+			t.Fatalf("message %d of the burst refused", i)
+		}
+	}
+	if m.allow(now) {
+		t.Fatal("message past the burst allowed")
+	}
+	// 5 a second come back
+	now = now.Add(time.Second)
+	for i := 0; i < 5; i++ {
+		if !m.allow(now) {
+			t.Fatalf("message %d after a second refused", i)
+		}
+	}
+	if m.allow(now) {
+		t.Fatal("message past the refill allowed")
+	}
+
+	t.Setenv("signaling_max_messages_per_second", "0")
+	unlimited := newMessageRate()
+	for i := 0; i < 1000; i++ {
+		if !unlimited.allow(now) {
+			t.Fatal("unlimited rate refused a message")
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package streamserver
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	mediaserver "github.com/notedit/media-server-go"
+	"github.com/notedit/sdp"
+)
+
+// the simulcast layers by bitrate, next to the rids of the offer
+const (
+	layerHigh = "high"
+	layerLow  = "low"
+)
+
+// ridPattern is what rids of RFC 8851 look like in practice
+var ridPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,16}$`)
+
+// offeredLayers returns the rids of the simulcast encodings the video of
+// offer sends, nil without simulcast. Of alternatives the first is taken.
+func offeredLayers(offer *sdp.SDPInfo) []string {
+	media := offer.GetMedia("video")
+	if media == nil || media.GetSimulcastInfo() == nil {
+		return nil
+	}
+	var rids []string
+	for _, alternatives := range media.GetSimulcastInfo().GetSimulcastStreams(sdp.SEND) {
+		if len(alternatives) > 0 && media.GetRID(alternatives[0].GetID()) != nil {
+			rids = append(rids, alternatives[0].GetID())
+		}
+	}
+	return rids
+}
+
+// answerSimulcast receives the simulcast encodings the video of offer
+// sends. The answer of sdp would send them back, when answering simulcast
+// at all. Rids keep the payload types answer still has.
+func answerSimulcast(offer, answer *sdp.SDPInfo) {
+	media, answered := offer.GetMedia("video"), answer.GetMedia("video")
+	rids := offeredLayers(offer)
+	if answered == nil || len(rids) == 0 {
+		return
+	}
+	simulcast := sdp.NewSimulcastInfo()
+	for _, rid := range rids {
+		offered := media.GetRID(rid)
+		reversed := sdp.NewRIDInfo(rid, offered.GetDirection().Reverse())
+		var formats []string
+		for _, pt := range offered.GetFormats() {
+			if answered.GetCodecForType(pt) != nil {
+				formats = append(formats, strconv.Itoa(pt))
+			}
+		}
+		reversed.SetFormats(formats)
+		reversed.SetParams(offered.GetParams())
+		answered.AddRID(reversed)
+		simulcast.AddSimulcastStream(sdp.RECV, sdp.NewSimulcastStreamInfo(rid, false))
+	}
+	answered.SetSimulcastInfo(simulcast)
+}
+
+// resolveLayer reads which simulcast layer feeds the output of key from
+// simulcast_layer / simulcast_layer_overrides: high (the default) or low
+// for the active encoding of the highest or lowest bitrate, else a rid
+func resolveLayer(key string) (string, error) {
+	layer := envForKey("simulcast_layer", key)
+	if layer == "" {
+		return layerHigh, nil
+	}
+	if !ridPattern.MatchString(layer) {
+		return "", fmt.Errorf("simulcast layer must be %s, %s or a rid, not %q", layerHigh, layerLow, layer)
+	}
+	return layer, nil
+}
+
+// layerSelection feeds the output of a simulcast publisher with one of its
+// encodings
+type layerSelection struct {
+	// switching serializes moving the frame callback between encodings
+	switching sync.Mutex
+
+	sync.Mutex
+	// rids are the encodings offered
+	rids []string
+	// want is layerHigh, layerLow or one of rids
+	want string
+	// selected is the encoding frames are taken from
+	selected string
+	// keyframe is set while frames of a newly selected encoding are
+	// dropped until its first keyframe
+	keyframe bool
+}
+
+// newLayerSelection starts with the wanted rid or else the first offered,
+// the bitrates are not known yet
+func newLayerSelection(rids []string, want string) *layerSelection {
+	l := &layerSelection{rids: rids, want: want, selected: rids[0]}
+	if l.offered(want) {
+		l.selected = want
+	}
+	return l
+}
+
+// current returns the selected encoding
+func (l *layerSelection) current() string {
+	l.Lock()
+	defer l.Unlock()
+	return l.selected
+}
+
+func (l *layerSelection) offered(rid string) bool {
+	for _, offered := range l.rids {
+		if offered == rid {
+			return true
+		}
+	}
+	return false
+}
+
+// pick returns the encoding to take frames from given the active layers,
+// the selected one when none of those wanted is active
+func (l *layerSelection) pick(layers *mediaserver.ActiveLayersInfo) string {
+	l.Lock()
+	defer l.Unlock()
+	if l.want != layerHigh && l.want != layerLow {
+		return l.want
+	}
+	// active encodings are ordered by bitrate
+	var active []string
+	for _, encoding := range layers.Active {
+		if l.offered(encoding.EncodingId) {
+			active = append(active, encoding.EncodingId)
+		}
+	}
+	switch {
+	case len(active) == 0:
+		return l.selected
+	case l.want == layerLow:
+		return active[0]
+	}
+	return active[len(active)-1]
+}
+
+// switchTo records rid as selected, its frames being dropped until a
+// keyframe. It reports whether the selection changed.
+func (l *layerSelection) switchTo(rid string) bool {
+	l.Lock()
+	defer l.Unlock()
+	if rid == l.selected {
+		return false
+	}
+	l.selected, l.keyframe = rid, true
+	return true
+}
+
+// admit reports whether a frame of the selected encoding is fed to the
+// output: the first after a switch must be a keyframe
+func (l *layerSelection) admit(keyframe bool) bool {
+	l.Lock()
+	defer l.Unlock()
+	if l.keyframe && !keyframe {
+		return false
+	}
+	l.keyframe = false
+	return true
+}
+
+// setWant changes the layer wanted, which must be high, low or offered
+func (l *layerSelection) setWant(want string) error {
+	l.Lock()
+	defer l.Unlock()
+	if want != layerHigh && want != layerLow && !l.offered(want) {
+		return fmt.Errorf("layer must be %s, %s or one of %v", layerHigh, layerLow, l.rids)
+	}
+	l.want = want
+	return nil
+}
+
+// describe is the selection as listed by the streams API
+func (l *layerSelection) describe() gin.H {
+	l.Lock()
+	defer l.Unlock()
+	return gin.H{"layers": l.rids, "want": l.want, "selected": l.selected}
+}
+
+// layers returns the simulcast selection of the session, nil when its
+// publisher does not send simulcast
+func (s *session) layers() *layerSelection {
+	s.Lock()
+	defer s.Unlock()
+	return s.simulcast
+}
+
+// videoTrack returns the published video track, nil until negotiated
+func (s *session) videoTrack() *mediaserver.IncomingStreamTrack {
+	stream := s.liveStream()
+	if stream == nil || len(stream.GetVideoTracks()) == 0 {
+		return nil
+	}
+	return stream.GetVideoTracks()[0]
+}
+
+// selectLayer moves the frames fed to the output to the encoding the
+// selection picks, asking it for a keyframe to start with
+func (s *session) selectLayer(track *mediaserver.IncomingStreamTrack) {
+	l := s.layers()
+	if l == nil {
+		return
+	}
+	l.switching.Lock()
+	defer l.switching.Unlock()
+	rid := l.pick(track.GetActiveLayers())
+	if track.GetEncoding(rid) == nil || !l.switchTo(rid) {
+		return
+	}
+	track.SetMediaFrameEncoding(rid)
+	s.timeline.add(eventMedia, "simulcast layer "+rid)
+	s.logf("simulcast layer %s", rid)
+	s.Lock()
+	refresher := s.refresher
+	s.Unlock()
+	if refresher != nil {
+		refresher.request(keyframeLayer)
+	}
+}
+
+// watchLayers follows the bitrates of the encodings of a simulcast
+// publisher, publishers pausing layers as their bandwidth drops
+func (s *session) watchLayers(track *mediaserver.IncomingStreamTrack) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		s.selectLayer(track)
+	}
+}
+
+// setStreamLayer handles PUT /api/v1/streams/:id/layer, picking the
+// simulcast layer feeding the output: {"layer": "high" | "low" | rid}
+func setStreamLayer(c *gin.Context) {
+	admin, ok := adminIdentity(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Layer string `json:"layer"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		return
+	}
+	sess := liveSession(c)
+	if sess == nil {
+		return
+	}
+	l := sess.layers()
+	if l == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "the publisher does not send simulcast"})
+		return
+	}
+	if err := l.setWant(req.Layer); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	sess.logf("simulcast layer %s wanted by %s", req.Layer, admin)
+	if track := sess.videoTrack(); track != nil {
+		sess.selectLayer(track)
+	}
+	c.JSON(http.StatusOK, l.describe())
+}
@@ -0,0 +1,119 @@
+package streamserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	mediaserver "github.com/notedit/media-server-go"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+)
+
+func TestAnswerSimulcast(t *testing.T) {
+	offer, answer := answerFixture(t, "simulcast_offer.sdp")
+	if rids := offeredLayers(offer); strings.Join(rids, ";") != "q;h;f" {
+		t.Fatalf("layers = %v", rids)
+	}
+	answerSimulcast(offer, answer)
+	sdp := answer.String()
+	for _, want := range []string{"a=simulcast:recv q;h;f", "a=rid:q recv", "a=rid:f recv", "urn:ietf:params:rtp-hdrext:sdes:rtp-stream-id"} {
+		if !strings.Contains(sdp, want) {
+			t.Fatalf("no %q in\n%s", want, sdp)
+		}
+	}
+	if strings.Contains(sdp, "simulcast:send") || strings.Contains(sdp, " send\r\n") {
+		t.Fatalf("simulcast sent back\n%s", sdp)
+	}
+
+	// no simulcast, nothing added
+	offer, answer = answerFixture(t, "chrome_offer.sdp")
+	answerSimulcast(offer, answer)
+	if offeredLayers(offer) != nil || strings.Contains(answer.String(), "a=simulcast") {
+		t.Fatal("simulcast answered without simulcast")
+	}
+}
+
+func TestResolveLayer(t *testing.T) {
+	t.Setenv("simulcast_layer_overrides", "small=low,fixed=h,bad=a b")
+	for key, want := range map[string]string{"main": layerHigh, "small": layerLow, "fixed": "h"} {
+		if layer, err := resolveLayer(key); err != nil || layer != want {
+			t.Errorf("%s layer = %q, %v", key, layer, err)
+		}
+	}
+	if _, err := resolveLayer("bad"); err == nil {
+		t.Fatal("bad layer accepted")
+	}
+}
+
+func TestLayerSelection(t *testing.T) {
+	active := &mediaserver.ActiveLayersInfo{Active: []*mediaserver.ActiveEncoding{
+		{EncodingId: "q", Bitrate: 150000},
+		{EncodingId: "h", Bitrate: 500000},
+	}}
+	l := newLayerSelection([]string{"q", "h", "f"}, layerHigh)
+	if l.current() != "q" {
+		t.Fatalf("initial layer = %s", l.current())
+	}
+	// f is paused
+	if rid := l.pick(active); rid != "h" {
+		t.Fatalf("high = %s", rid)
+	}
+	if !l.switchTo("h") || l.switchTo("h") {
+		t.Fatal("switch not reported once")
+	}
+	if l.admit(false) || !l.admit(true) || !l.admit(false) {
+		t.Fatal("frames before the first keyframe of the layer admitted")
+	}
+	if l.pick(&mediaserver.ActiveLayersInfo{}) != "h" {
+		t.Fatal("no active layer, selection not kept")
+	}
+
+	if err := l.setWant("x"); err == nil {
+		t.Fatal("unknown rid wanted")
+	}
+	if err := l.setWant(layerLow); err != nil || l.pick(active) != "q" {
+		t.Fatalf("low = %s, %v", l.pick(active), err)
+	}
+	if err := l.setWant("f"); err != nil || l.pick(active) != "f" {
+		t.Fatalf("rid = %s, %v", l.pick(active), err)
+	}
+	if fixed := newLayerSelection([]string{"q", "h"}, "h"); fixed.current() != "h" {
+		t.Fatalf("wanted rid not selected first: %s", fixed.current())
+	}
+}
+
+func TestSetStreamLayer(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.PUT("/api/v1/streams/:id/layer", setStreamLayer)
+	put := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("PUT", "/api/v1/streams/layer-live/layer", strings.NewReader(body))
+		asAdmin(req, "ops")
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	sess := newSession("layer-live", nil, presets[client.LatencyBalanced])
+	if _, err := registry.claim(sess, conflictReject); err != nil {
+		t.Fatal(err)
+	}
+	defer registry.release(sess)
+	if w := put(`{"layer":"low"}`); w.Code != http.StatusConflict {
+		t.Fatalf("without simulcast = %d", w.Code)
+	}
+	sess.Lock()
+	sess.simulcast = newLayerSelection([]string{"q", "h"}, layerHigh)
+	sess.Unlock()
+	if w := put(`{"layer":"x"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("unknown rid = %d", w.Code)
+	}
+	if w := put(`{"layer":"low"}`); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"want":"low"`) {
+		t.Fatalf("low = %d %s", w.Code, w.Body.String())
+	}
+	if streamSummary(sess)["simulcast"] == nil {
+		t.Fatal("simulcast not summarized")
+	}
+}
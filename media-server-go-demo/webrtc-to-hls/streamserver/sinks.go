@@ -0,0 +1,402 @@
+package streamserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	gstreamer "github.com/notedit/gstreamer-go"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/metrics"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/pipeline"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/teardown"
+)
+
+var (
+	errUnknownSink = errors.New("unknown sink")
+	errSinkFailed  = errors.New("sink pipeline failed")
+)
+
+var sinkFailures = metrics.NewCounter("sink_failures_total",
+	"Output sinks detached for a failed pipeline, by kind", "kind")
+
+// outputSink is an output of a publish next to its HLS one. The session
+// starts it once its output runs, writes it every frame of the publish
+// from then on, video as the output takes it and Opus audio, and stops it
+// with the publish or when it is detached. Start and the writes are called
+// with the session locked, so writes must not block: a sink with a
+// pipeline queues them, see sideFeeder.
+type outputSink interface {
+	Start(s *session) error
+	WriteVideo(frame []byte, keyframe bool)
+	WriteAudio(frame []byte)
+	// Stop completes what the sink wrote, e.g. the index of a file, within
+	// ctx, and releases it
+	Stop(ctx context.Context) error
+}
+
+// sinkKinds make the sink of a spec, kind:target, e.g. file:/mnt/archive,
+// by kind; RTMP urls are specs of their own and null takes no target
+var sinkKinds = map[string]func(target string) (outputSink, error){
+	"null": func(string) (outputSink, error) {
+		return &nullSink{}, nil
+	},
+	"file": func(dir string) (outputSink, error) {
+		return newPipelineSink("file", func(s *session) (pipeline.Sink, error) {
+			format, err := resolveRecordFormat(s.key)
+			if err != nil {
+				return nil, err
+			}
+			path := recordingPath(dir, s.key, format, time.Now())
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return nil, err
+			}
+			return pipeline.File{Muxer: recordMuxers[format], Location: path}, nil
+		}), nil
+	},
+	"hls": func(dir string) (outputSink, error) {
+		return newPipelineSink("hls", func(s *session) (pipeline.Sink, error) {
+			out := filepath.Join(dir, s.key)
+			if err := os.MkdirAll(out, 0755); err != nil {
+				return nil, err
+			}
+			return pipeline.HLS{
+				Container:      containerTS,
+				Prefix:         filepath.Join(out, fmt.Sprintf("segment-%d-", time.Now().Unix())),
+				Playlist:       filepath.Join(out, playlistName),
+				MaxFiles:       s.preset.MaxFiles,
+				TargetDuration: s.preset.SegmentDuration,
+				PlaylistLength: s.preset.PlaylistLength,
+			}, nil
+		}), nil
+	},
+	"rtmp":  rtmpSink,
+	"rtmps": rtmpSink,
+}
+
+func rtmpSink(url string) (outputSink, error) {
+	return newPipelineSink("rtmp", func(*session) (pipeline.Sink, error) {
+		return pipeline.RTMP{Location: url}, nil
+	}), nil
+}
+
+// parseSink makes the sink of spec
+func parseSink(spec string) (outputSink, error) {
+	spec = strings.TrimSpace(spec)
+	kind, target := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		kind, target = spec[:i], spec[i+1:]
+	}
+	if (kind == "rtmp" || kind == "rtmps") && target != "" {
+		target = spec
+	}
+	newSink, ok := sinkKinds[kind]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", errUnknownSink, kind)
+	}
+	if target == "" && kind != "null" {
+		return nil, fmt.Errorf("%s sink %q has no target", kind, spec)
+	}
+	return newSink(target)
+}
+
+// sinkSpecs are the sinks the output of key starts with, output_sinks /
+// output_sinks_overrides separated by spaces, e.g. "file:/mnt/archive
+// rtmp://backup/live/main"
+func sinkSpecs(key string) []string {
+	return strings.Fields(envForKey("output_sinks", key))
+}
+
+// sinkLabel is spec as logged and listed: the last element of the path of
+// an RTMP url, its stream key, hidden
+func sinkLabel(spec string) string {
+	if !strings.HasPrefix(spec, "rtmp://") && !strings.HasPrefix(spec, "rtmps://") {
+		return spec
+	}
+	if i := strings.LastIndex(spec, "/"); i > strings.Index(spec, "//")+1 {
+		return spec[:i+1] + "***"
+	}
+	return spec
+}
+
+// nullSink discards what it is written, counting it, e.g. to measure
+// ingest without an output
+type nullSink struct {
+	video, audio int64
+}
+
+func (n *nullSink) Start(*session) error {
+	return nil
+}
+
+func (n *nullSink) WriteVideo(frame []byte, keyframe bool) {
+	atomic.AddInt64(&n.video, 1)
+}
+
+func (n *nullSink) WriteAudio(frame []byte) {
+	atomic.AddInt64(&n.audio, 1)
+}
+
+func (n *nullSink) Stop(context.Context) error {
+	return nil
+}
+
+// pipelineSink writes a side pipeline of the session, see sidePipeline, to
+// the pipeline sink end makes at Start; the file, HLS and RTMP sinks are
+// ones. Its frames are queued for the pipeline, see sideFeeder.
+type pipelineSink struct {
+	kind string
+	end  func(s *session) (pipeline.Sink, error)
+
+	pipeline *gstreamer.Pipeline
+	appsrc   *gstreamer.Element
+	// audiosrc is nil when the pipeline has no audio branch
+	audiosrc *gstreamer.Element
+	feeder   *sideFeeder
+
+	eosOnce  sync.Once
+	eos      chan struct{}
+	failOnce sync.Once
+	failed   chan struct{}
+}
+
+func newPipelineSink(kind string, end func(s *session) (pipeline.Sink, error)) *pipelineSink {
+	return &pipelineSink{kind: kind, end: end, eos: make(chan struct{}), failed: make(chan struct{})}
+}
+
+func (p *pipelineSink) Start(s *session) error {
+	end, err := p.end(s)
+	if err != nil {
+		return err
+	}
+	pipe, err := gstreamer.New(s.sidePipeline(sideQueueBytes, "", end).String())
+	if err != nil {
+		return err
+	}
+	p.pipeline = pipe
+	p.appsrc = pipe.FindElement("appsrc")
+	p.audiosrc = pipe.FindElement("audiosrc")
+	go p.watchBus(pipe.PullMessage())
+	pipe.Start()
+	p.feeder = newSideFeeder("sink_"+p.kind, pipe)
+	return nil
+}
+
+// watchBus drains the pipeline bus until Stop closes it. An error, such as
+// the destination refusing the connection, fails the sink.
+func (p *pipelineSink) watchBus(messages <-chan *gstreamer.Message) {
+	for msg := range messages {
+		switch msg.GetType() {
+		case gstreamer.MESSAGE_EOS:
+			p.eosOnce.Do(func() { close(p.eos) })
+		case gstreamer.MESSAGE_ERROR:
+			p.failOnce.Do(func() { close(p.failed) })
+		}
+	}
+}
+
+func (p *pipelineSink) WriteVideo(frame []byte, keyframe bool) {
+	p.feeder.push(frame, keyframe)
+}
+
+func (p *pipelineSink) WriteAudio(frame []byte) {
+	p.feeder.pushAudio(frame)
+}
+
+// Stop pushes the queued frames and sends EOS, for the muxer to complete
+// the file or playlist, and releases the pipeline once it went through
+func (p *pipelineSink) Stop(ctx context.Context) error {
+	err := p.feeder.flush(ctx)
+	if err == nil {
+		p.pipeline.SendEOS()
+		select {
+		case <-p.eos:
+		case <-p.failed:
+			err = errSinkFailed
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	p.appsrc.Stop()
+	if p.audiosrc != nil {
+		p.audiosrc.Stop()
+	}
+	p.pipeline.Stop()
+	p.feeder.release()
+	return err
+}
+
+// attachedSink is a sink of a session
+type attachedSink struct {
+	id string
+	// spec is that of the sink, see sinkLabel
+	spec     string
+	sink     outputSink
+	attached time.Time
+}
+
+// attachSink starts sink, made of spec, and writes it the output from then
+// on, with the session locked
+func (s *session) attachSink(spec string, sink outputSink) (*attachedSink, error) {
+	if s.closed || s.hls == nil {
+		return nil, errNotLive
+	}
+	if err := sink.Start(s); err != nil {
+		return nil, err
+	}
+	if s.sinks == nil {
+		s.sinks = map[string]*attachedSink{}
+	}
+	s.sinkSeq++
+	a := &attachedSink{id: fmt.Sprintf("sink-%d", s.sinkSeq), spec: sinkLabel(spec), sink: sink, attached: time.Now()}
+	s.sinks[a.id] = a
+	if p, ok := sink.(*pipelineSink); ok {
+		go s.watchSink(a, p)
+	}
+	s.timeline.add(eventPipeline, "writing to "+a.spec)
+	s.logf("writing to sink %s", a.spec)
+	return a, nil
+}
+
+// startSinks attaches the sinks of output_sinks, once, with the session
+// locked as its output started; sinks outlive restarts of the output
+func (s *session) startSinks() {
+	if s.sinks != nil {
+		return
+	}
+	s.sinks = map[string]*attachedSink{}
+	for _, spec := range sinkSpecs(s.key) {
+		sink, err := parseSink(spec)
+		if err == nil {
+			_, err = s.attachSink(spec, sink)
+		}
+		if err != nil {
+			s.logf("sink %s: %v", sinkLabel(spec), err)
+		}
+	}
+}
+
+// detachSink stops writing to the sink id and stops it
+func (s *session) detachSink(id string) (*attachedSink, error) {
+	s.Lock()
+	a := s.sinks[id]
+	delete(s.sinks, id)
+	s.Unlock()
+	if a == nil {
+		return nil, errUnknownSink
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), teardown.DefaultPhaseTimeout)
+	defer cancel()
+	err := a.sink.Stop(ctx)
+	s.timeline.add(eventPipeline, "stopped writing to "+a.spec)
+	return a, err
+}
+
+// watchSink detaches a, whose pipeline is p, if p fails while attached
+func (s *session) watchSink(a *attachedSink, p *pipelineSink) {
+	select {
+	case <-p.failed:
+	case <-s.done:
+		return
+	}
+	s.Lock()
+	owned := s.sinks[a.id] == a
+	s.Unlock()
+	if owned {
+		sinkFailures.Inc(p.kind)
+		s.logf("sink %s failed, detaching it", a.spec)
+		s.detachSink(a.id)
+	}
+}
+
+// sinkJSON is a as listed
+func sinkJSON(a *attachedSink) gin.H {
+	return gin.H{"id": a.id, "sink": a.spec, "attachedAt": a.attached}
+}
+
+// listSinks handles GET /api/v1/streams/:id/sinks, the sinks a live
+// stream writes to
+func listSinks(c *gin.Context) {
+	sess := liveSession(c)
+	if sess == nil {
+		return
+	}
+	sess.Lock()
+	attached := make([]*attachedSink, 0, len(sess.sinks))
+	for _, a := range sess.sinks {
+		attached = append(attached, a)
+	}
+	sess.Unlock()
+	sort.Slice(attached, func(i, j int) bool { return attached[i].attached.Before(attached[j].attached) })
+	list := []gin.H{}
+	for _, a := range attached {
+		list = append(list, sinkJSON(a))
+	}
+	c.JSON(http.StatusOK, gin.H{"stream": sess.key, "sinks": list})
+}
+
+// addSink handles POST /api/v1/streams/:id/sinks, attaching the sink of
+// {"sink": "<spec>"} to a live stream, see sinkKinds
+func addSink(c *gin.Context) {
+	admin, ok := adminIdentity(c)
+	if !ok {
+		return
+	}
+	sess := liveSession(c)
+	if sess == nil {
+		return
+	}
+	var req struct {
+		Sink string `json:"sink"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		return
+	}
+	sink, err := parseSink(req.Sink)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	sess.Lock()
+	a, err := sess.attachSink(req.Sink, sink)
+	sess.Unlock()
+	switch err {
+	case nil:
+	case errNotLive:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Info("sink attached", "stream", sess.key, "sink", a.spec, "admin", admin)
+	c.JSON(http.StatusCreated, sinkJSON(a))
+}
+
+// removeSink handles DELETE /api/v1/streams/:id/sinks/:sink, stopping the
+// sink once what it wrote is complete
+func removeSink(c *gin.Context) {
+	admin, ok := adminIdentity(c)
+	if !ok {
+		return
+	}
+	sess := liveSession(c)
+	if sess == nil {
+		return
+	}
+	a, err := sess.detachSink(c.Param("sink"))
+	if a == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Info("sink detached", "stream", sess.key, "sink", a.spec, "admin", admin, "error", err)
+	c.Status(http.StatusNoContent)
+}
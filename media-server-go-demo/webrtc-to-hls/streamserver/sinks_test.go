@@ -0,0 +1,118 @@
+package streamserver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+)
+
+func TestParseSink(t *testing.T) {
+	for spec, kind := range map[string]string{
+		"null":                     "",
+		"file:/mnt/archive":        "file",
+		"hls:/mnt/mirror":          "hls",
+		"rtmp://backup/live/main":  "rtmp",
+		"rtmps://backup/live/main": "rtmp",
+	} {
+		sink, err := parseSink(spec)
+		if err != nil {
+			t.Fatalf("%s: %v", spec, err)
+		}
+		if p, ok := sink.(*pipelineSink); (ok && p.kind != kind) || (!ok && kind != "") {
+			t.Errorf("%s made %T", spec, sink)
+		}
+	}
+	for _, bad := range []string{"s3://bucket", "file:", "hls", "rtmp", ""} {
+		if _, err := parseSink(bad); err == nil {
+			t.Errorf("parseSink(%q) accepted", bad)
+		}
+	}
+	if label := sinkLabel("rtmp://a.rtmp.youtube.com/live2/secret-key"); label != "rtmp://a.rtmp.youtube.com/live2/***" {
+		t.Errorf("label %s", label)
+	}
+	if label := sinkLabel("file:/mnt/archive"); label != "file:/mnt/archive" {
+		t.Errorf("label %s", label)
+	}
+}
+
+func TestSinksWritten(t *testing.T) {
+	t.Setenv("output_sinks", "null  null")
+	sess := newSession("sinks-written", nil, presets[client.LatencyBalanced])
+	sess.hls = &hlsOutput{queue: newFrameQueue(4)}
+	sess.audio = true
+	sess.Lock()
+	sess.startSinks()
+	extra := &nullSink{}
+	if _, err := sess.attachSink("null", extra); err != nil {
+		t.Fatal(err)
+	}
+	// configured sinks are attached once, not on restarts
+	sess.startSinks()
+	attached := len(sess.sinks)
+	sess.Unlock()
+	if attached != 3 {
+		t.Fatalf("%d sinks attached", attached)
+	}
+
+	sess.push([]byte{0, 0, 0, 1, 0x65, 1, 2, 3}, frameTime{})
+	sess.pushAudio([]byte{1, 2, 3}, frameTime{})
+	sess.Lock()
+	for _, a := range sess.sinks {
+		if n := a.sink.(*nullSink); n.video != 1 || n.audio != 1 {
+			t.Fatalf("%s written %d video and %d audio frames", a.id, n.video, n.audio)
+		}
+	}
+	sess.Unlock()
+
+	if _, err := sess.detachSink("sink-3"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sess.detachSink("sink-3"); err != errUnknownSink {
+		t.Fatalf("detached twice: %v", err)
+	}
+	sess.push([]byte{0, 0, 0, 1, 0x41, 1, 2, 3}, frameTime{})
+	if extra.video != 1 {
+		t.Fatal("a detached sink was written")
+	}
+
+	sess.hls = nil
+	sess.Lock()
+	_, err := sess.attachSink("null", &nullSink{})
+	sess.Unlock()
+	if err != errNotLive {
+		t.Fatalf("attached without an output: %v", err)
+	}
+}
+
+func TestSideFeederNeverBlocks(t *testing.T) {
+	entered, stalled := make(chan struct{}, 1), make(chan struct{})
+	var pushed []string
+	f := &sideFeeder{kind: "test", video: func(frame []byte) {
+		select {
+		case entered <- struct{}{}:
+		default:
+		}
+		<-stalled
+		pushed = append(pushed, string(frame))
+	}}
+	f.start()
+	defer f.release()
+	f.push([]byte("before"), false)
+	f.push([]byte("first"), true)
+	<-entered
+	// the pipeline stalls on the first keyframe while the queue overflows
+	for i := 0; i < 2*outputQueueFrames; i++ {
+		f.push([]byte("lost"), false)
+	}
+	f.pushAudio([]byte("no audio branch"))
+	f.push([]byte("next"), true)
+	close(stalled)
+	if err := f.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// the video left after the gap is skipped up to the next keyframe
+	if len(pushed) != 2 || pushed[0] != "first" || pushed[1] != "next" {
+		t.Fatalf("pushed %q", pushed)
+	}
+}
@@ -0,0 +1,111 @@
+package streamserver
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	mediaserver "github.com/notedit/media-server-go"
+)
+
+// seconds between the NTP epoch (1900) and the unix epoch
+const ntpEpochOffset = 2208988800
+
+// ntpToTime converts a 64 bit NTP timestamp from an RTCP sender report
+func ntpToTime(ntp uint64) time.Time {
+	secs := int64(ntp>>32) - ntpEpochOffset
+	nsecs := int64((ntp & 0xffffffff) * 1e9 >> 32)
+	return time.Unix(secs, nsecs)
+}
+
+// skewEstimator smooths the publisher clock offset measured from sender
+// reports. A sample far away from the estimate is first treated as an
+// outlier; once jumpSamples of them in a row agree the estimate is reset,
+// which is how a device NTP-syncing mid-stream shows up.
+type skewEstimator struct {
+	alpha       float64
+	jump        time.Duration
+	jumpSamples int
+
+	sync.Mutex
+	valid    bool
+	estimate float64
+	pending  int
+	lastNTP  uint64
+	// rtt is the round trip time of the last report
+	rtt time.Duration
+}
+
+func newSkewEstimator() *skewEstimator {
+	return &skewEstimator{
+		alpha:       0.2,
+		jump:        500 * time.Millisecond,
+		jumpSamples: 3,
+	}
+}
+
+// sample feeds one sender report: ntp is the sender wallclock it carries,
+// received the server time it arrived and rtt the current round trip time.
+// Reports already seen are ignored.
+func (e *skewEstimator) sample(ntp uint64, received time.Time, rtt time.Duration) {
+	e.Lock()
+	defer e.Unlock()
+	if ntp == 0 || ntp == e.lastNTP {
+		return
+	}
+	e.lastNTP = ntp
+	e.rtt = rtt
+	// the report was sent half a round trip before it arrived
+	offset := float64(ntpToTime(ntp).Sub(received.Add(-rtt / 2)))
+
+	switch {
+	case !e.valid:
+		e.estimate = offset
+		e.valid = true
+	case math.Abs(offset-e.estimate) > float64(e.jump):
+		e.pending++
+		if e.pending >= e.jumpSamples {
+			e.estimate = offset
+			e.pending = 0
+		}
+	default:
+		e.estimate += e.alpha * (offset - e.estimate)
+		e.pending = 0
+	}
+}
+
+// skew returns how far the publisher clock is ahead of the server clock
+func (e *skewEstimator) skew() (time.Duration, bool) {
+	e.Lock()
+	defer e.Unlock()
+	return time.Duration(e.estimate), e.valid
+}
+
+// roundTrip is the round trip time to the publisher when it last sent a
+// report, zero before
+func (e *skewEstimator) roundTrip() time.Duration {
+	e.Lock()
+	defer e.Unlock()
+	return e.rtt
+}
+
+// sampleTrack feeds the latest sender report of the track's first encoding
+func (e *skewEstimator) sampleTrack(track *mediaserver.IncomingStreamTrack) {
+	encoding := track.GetFirstEncoding()
+	if encoding == nil {
+		return
+	}
+	stats := track.GetStats()[encoding.GetID()]
+	if stats == nil || stats.Media == nil || stats.Media.LastSenderReportTime == 0 {
+		return
+	}
+	received := time.Unix(0, int64(stats.Media.LastSenderReportTime)*int64(time.Microsecond))
+	e.sample(stats.Media.LastSenderReportNTP, received, time.Duration(stats.Rtt)*time.Millisecond)
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
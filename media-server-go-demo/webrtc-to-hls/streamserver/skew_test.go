@@ -0,0 +1,63 @@
+package streamserver
+
+import (
+	"testing"
+	"time"
+)
+
+func toNTP(t time.Time) uint64 {
+	secs := uint64(t.Unix() + ntpEpochOffset)
+	frac := uint64(t.Nanosecond()) << 32 / 1e9
+	return secs<<32 | frac
+}
+
+func TestNTPToTime(t *testing.T) {
+	now := time.Unix(1700000000, 250000000)
+	if got := ntpToTime(toNTP(now)); absDuration(got.Sub(now)) > time.Microsecond {
+		t.Fatalf("ntpToTime = %v, want %v", got, now)
+	}
+}
+
+func TestSkewEstimator(t *testing.T) {
+	e := newSkewEstimator()
+	if _, ok := e.skew(); ok {
+		t.Fatal("skew valid before any report")
+	}
+
+	now := time.Unix(1700000000, 0)
+	report := func(offset time.Duration) {
+		now = now.Add(time.Second)
+		e.sample(toNTP(now.Add(offset)), now, 0)
+	}
+
+	report(2 * time.Second)
+	report(2*time.Second + 100*time.Millisecond)
+	skew, _ := e.skew()
+	if skew <= 2*time.Second || skew >= 2*time.Second+100*time.Millisecond {
+		t.Fatalf("smoothed skew = %v", skew)
+	}
+
+	// a single outlier is ignored
+	report(0)
+	if skew, _ := e.skew(); skew < 2*time.Second {
+		t.Fatalf("skew after outlier = %v", skew)
+	}
+
+	// the device NTP-synced: the estimate follows after a few reports
+	report(0)
+	report(0)
+	if skew, _ := e.skew(); absDuration(skew) > time.Millisecond {
+		t.Fatalf("skew after resync = %v", skew)
+	}
+}
+
+func TestSkewEstimatorIgnoresRepeatedReport(t *testing.T) {
+	e := newSkewEstimator()
+	now := time.Unix(1700000000, 0)
+	ntp := toNTP(now.Add(time.Second))
+	e.sample(ntp, now, 0)
+	e.sample(ntp, now.Add(10*time.Second), 0)
+	if skew, _ := e.skew(); absDuration(skew-time.Second) > time.Microsecond {
+		t.Fatalf("skew = %v", skew)
+	}
+}
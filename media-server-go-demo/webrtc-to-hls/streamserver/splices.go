@@ -0,0 +1,241 @@
+package streamserver
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/hlscrypt"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/metrics"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/scte35"
+)
+
+var splicesInserted = metrics.NewCounter("scte35_splices_total",
+	"SCTE-35 splice points placed on live outputs, by type: out or in", "type")
+
+var (
+	errBreakOpen = errors.New("splice: an ad break is already open")
+	errNoBreak   = errors.New("splice: no ad break is open")
+	errBadSplice = errors.New("splice: a type of out or in and a duration of 0 or more are required")
+	errNoOutput  = errors.New("splice: the stream has no output yet")
+)
+
+// maxSplices bounds the ad breaks an output keeps for its playlists
+const maxSplices = 64
+
+// adBreak is an ad break of an output, between two splice points
+type adBreak struct {
+	id         uint32
+	generation int64
+	out        time.Time
+	// duration is planned, zero when unknown; a break with one returns
+	// when it elapses unless returned before
+	duration time.Duration
+	// in is when the break returned early, zero until then
+	in time.Time
+}
+
+// end is when the break returns, zero while it is open
+func (b *adBreak) end() time.Time {
+	if !b.in.IsZero() || b.duration == 0 {
+		return b.in
+	}
+	return b.out.Add(b.duration)
+}
+
+// outputSplices are the ad breaks of the output of a stream key, listed in
+// its playlist as it is served
+type outputSplices struct {
+	sync.Mutex
+	next   uint32
+	breaks []*adBreak
+}
+
+// open reports the break that has not returned at now, nil when none
+func (s *outputSplices) open(now time.Time) *adBreak {
+	if len(s.breaks) == 0 {
+		return nil
+	}
+	last := s.breaks[len(s.breaks)-1]
+	if end := last.end(); end.IsZero() || end.After(now) {
+		return last
+	}
+	return nil
+}
+
+// spliceOut opens an ad break of generation at now
+func (s *outputSplices) spliceOut(generation int64, now time.Time, duration time.Duration) (*adBreak, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.open(now) != nil {
+		return nil, errBreakOpen
+	}
+	s.next++
+	b := &adBreak{id: s.next, generation: generation, out: now, duration: duration}
+	s.breaks = append(s.breaks, b)
+	if len(s.breaks) > maxSplices {
+		s.breaks = append([]*adBreak(nil), s.breaks[len(s.breaks)-maxSplices:]...)
+	}
+	return b, nil
+}
+
+// spliceIn returns from the open ad break at now
+func (s *outputSplices) spliceIn(now time.Time) (*adBreak, error) {
+	s.Lock()
+	defer s.Unlock()
+	b := s.open(now)
+	if b == nil {
+		return nil, errNoBreak
+	}
+	b.in = now
+	return b, nil
+}
+
+// tags returns the playlist tags of the segment of generation written from
+// from until to: the splice out of a break starting in it as CUE-OUT and a
+// date range with its SCTE35-OUT, the return of a break ending in it as
+// CUE-IN and the SCTE35-IN of the range, or the CUE-OUT-CONT of a segment
+// within a break
+func (s *outputSplices) tags(generation int64, from, to time.Time) string {
+	s.Lock()
+	defer s.Unlock()
+	var tags []string
+	for _, b := range s.breaks {
+		end := b.end()
+		id := fmt.Sprintf("splice-%d", b.id)
+		switch {
+		case b.generation == generation && b.out.After(from) && !b.out.After(to):
+			section := scte35.Insert{EventID: b.id, Out: true, Duration: b.duration}.Section()
+			daterange := fmt.Sprintf(`#EXT-X-DATERANGE:ID="%s",START-DATE="%s"`, id, b.out.UTC().Format(dateRangeFormat))
+			cue := "#EXT-X-CUE-OUT"
+			if b.duration > 0 {
+				daterange += fmt.Sprintf(",PLANNED-DURATION=%.3f", b.duration.Seconds())
+				cue += fmt.Sprintf(":DURATION=%.3f", b.duration.Seconds())
+			}
+			if !from.IsZero() {
+				// date ranges need a PROGRAM-DATE-TIME in the playlist
+				tags = append(tags, "#EXT-X-PROGRAM-DATE-TIME:"+from.UTC().Format(dateRangeFormat))
+			}
+			tags = append(tags, daterange+",SCTE35-OUT=0x"+hex.EncodeToString(section), cue)
+		case !end.IsZero() && end.After(from) && !end.After(to) && !from.IsZero() && b.out.Before(from):
+			section := scte35.Insert{EventID: b.id}.Section()
+			tags = append(tags, fmt.Sprintf(`#EXT-X-DATERANGE:ID="%s",START-DATE="%s",END-DATE="%s",SCTE35-IN=0x%s`,
+				id, b.out.UTC().Format(dateRangeFormat), end.UTC().Format(dateRangeFormat), hex.EncodeToString(section)), "#EXT-X-CUE-IN")
+		case !from.IsZero() && b.out.Before(from) && (end.IsZero() || end.After(to)):
+			cont := fmt.Sprintf("#EXT-X-CUE-OUT-CONT:ElapsedTime=%.3f", from.Sub(b.out).Seconds())
+			if b.duration > 0 {
+				cont += fmt.Sprintf(",Duration=%.3f", b.duration.Seconds())
+			}
+			tags = append(tags, cont)
+		}
+	}
+	return strings.Join(tags, "\n")
+}
+
+// dateRangeFormat is the ISO 8601 date of playlist tags, to milliseconds
+const dateRangeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// spliceHLS lists the ad breaks of a stream key in its live playlist,
+// whichever handler serves it, for ad insertion services to stitch at
+func spliceHLS(c *gin.Context) {
+	key, ok := outputKey(c.Request.URL.Path)
+	if !ok {
+		c.Next()
+		return
+	}
+	out := outputs.lookup(key)
+	if out == nil {
+		c.Next()
+		return
+	}
+	out.splices.Lock()
+	none := len(out.splices.breaks) == 0
+	out.splices.Unlock()
+	if none {
+		c.Next()
+		return
+	}
+	captured := &capturedResponse{ResponseWriter: c.Writer}
+	c.Writer = captured
+	c.Next()
+	c.Writer = captured.ResponseWriter
+
+	body := captured.body.Bytes()
+	if c.Writer.Status() == http.StatusOK {
+		// segments dated already are not dated again
+		dated := bytes.Contains(body, []byte(programDateTimeTag))
+		body = hlscrypt.Decorate(body, func(uri string) string {
+			generation, from, to, ok := segmentWindow(out.dir, path.Base(uri))
+			if !ok {
+				return ""
+			}
+			tags := out.splices.tags(generation, from, to)
+			if dated && strings.HasPrefix(tags, programDateTimeTag) {
+				tags = tags[strings.IndexByte(tags, '\n')+1:]
+			}
+			return tags
+		})
+		c.Writer.Header().Del("Content-Length")
+	}
+	if len(body) == 0 {
+		c.Writer.WriteHeaderNow()
+		return
+	}
+	c.Writer.Write(body)
+}
+
+// insertSplice handles POST /api/v1/streams/:id/splices: type out opens an
+// ad break now, of durationMs when known, and type in returns from it. The
+// splice points are listed in the live playlist with the segment written
+// at the time.
+func insertSplice(c *gin.Context) {
+	admin, ok := adminIdentity(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Type       string  `json:"type"`
+		DurationMs float64 `json:"durationMs"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		return
+	}
+	if (req.Type != "out" && req.Type != "in") || req.DurationMs < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": errBadSplice.Error()})
+		return
+	}
+	sess := liveSession(c)
+	if sess == nil {
+		return
+	}
+	sess.Lock()
+	generation := sess.generation
+	sess.Unlock()
+	if generation == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": errNoOutput.Error()})
+		return
+	}
+	splices := &outputs.get(sess.key).splices
+	now := time.Now()
+	var b *adBreak
+	var err error
+	if req.Type == "out" {
+		b, err = splices.spliceOut(generation, now, time.Duration(req.DurationMs*float64(time.Millisecond)))
+	} else {
+		b, err = splices.spliceIn(now)
+	}
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	splicesInserted.Inc(req.Type)
+	sess.logf("splice %s of break %d by %s", req.Type, b.id, admin)
+	c.JSON(http.StatusOK, gin.H{"stream": sess.key, "id": b.id, "type": req.Type, "time": now.UTC()})
+}
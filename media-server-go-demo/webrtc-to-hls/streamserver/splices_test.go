@@ -0,0 +1,78 @@
+package streamserver
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/scte35"
+)
+
+func TestSplicePlaylist(t *testing.T) {
+	savedDir, savedOutputs := hlsDir, outputs
+	defer func() { hlsDir, outputs = savedDir, savedOutputs }()
+	hlsDir, outputs = t.TempDir(), newStreamOutputs(time.Now)
+
+	out := outputs.get("monetized")
+	os.MkdirAll(out.dir, 0755)
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	var playlist strings.Builder
+	playlist.WriteString("#EXTM3U\n#EXT-X-TARGETDURATION:2\n")
+	for i := 0; i < 6; i++ {
+		name := "segment-7-0000" + string(rune('0'+i)) + ".ts"
+		at := start.Add(time.Duration(2*i) * time.Second)
+		ioutil.WriteFile(filepath.Join(out.dir, name), []byte{0x47}, 0644)
+		os.Chtimes(filepath.Join(out.dir, name), at, at)
+		playlist.WriteString("#EXTINF:2.000,\n" + name + "\n")
+	}
+
+	if _, err := out.splices.spliceIn(start); err != errNoBreak {
+		t.Fatalf("return without a break: %v", err)
+	}
+	b, err := out.splices.spliceOut(7, start.Add(2500*time.Millisecond), 4*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := out.splices.spliceOut(7, start.Add(3*time.Second), 0); err != errBreakOpen {
+		t.Fatalf("break within a break: %v", err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(spliceHLS)
+	r.Use(func(c *gin.Context) { c.String(http.StatusOK, playlist.String()) })
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/hls/monetized/playlist.m3u8", nil))
+
+	section := hex.EncodeToString(scte35.Insert{EventID: b.id, Out: true, Duration: 4 * time.Second}.Section())
+	back := hex.EncodeToString(scte35.Insert{EventID: b.id}.Section())
+	want := "#EXTM3U\n#EXT-X-TARGETDURATION:2\n" +
+		"#EXTINF:2.000,\nsegment-7-00000.ts\n" +
+		"#EXTINF:2.000,\nsegment-7-00001.ts\n" +
+		"#EXT-X-PROGRAM-DATE-TIME:2024-03-01T12:00:02.000Z\n" +
+		`#EXT-X-DATERANGE:ID="splice-1",START-DATE="2024-03-01T12:00:02.500Z",PLANNED-DURATION=4.000,SCTE35-OUT=0x` + section + "\n" +
+		"#EXT-X-CUE-OUT:DURATION=4.000\n#EXTINF:2.000,\nsegment-7-00002.ts\n" +
+		"#EXT-X-CUE-OUT-CONT:ElapsedTime=1.500,Duration=4.000\n#EXTINF:2.000,\nsegment-7-00003.ts\n" +
+		`#EXT-X-DATERANGE:ID="splice-1",START-DATE="2024-03-01T12:00:02.500Z",END-DATE="2024-03-01T12:00:06.500Z",SCTE35-IN=0x` + back + "\n" +
+		"#EXT-X-CUE-IN\n#EXTINF:2.000,\nsegment-7-00004.ts\n" +
+		"#EXTINF:2.000,\nsegment-7-00005.ts\n"
+	if w.Code != http.StatusOK || w.Body.String() != want {
+		t.Fatalf("playlist %d:\n%s\nwant:\n%s", w.Code, w.Body, want)
+	}
+
+	// the break is over, another can start and end early
+	next, err := out.splices.spliceOut(7, start.Add(20*time.Second), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ended, err := out.splices.spliceIn(start.Add(25 * time.Second)); err != nil || ended != next || !next.end().Equal(start.Add(25*time.Second)) {
+		t.Fatalf("return = %v, %v", ended, err)
+	}
+}
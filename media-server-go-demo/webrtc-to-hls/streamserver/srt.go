@@ -0,0 +1,96 @@
+package streamserver
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/ident"
+)
+
+// srtIngestFormat receives the MPEG-TS of an SRT caller on the uri, H.264
+// and AAC taken out as published
+var srtIngestFormat = "srtsrc uri=%s ! tsdemux name=demux demux. ! queue ! h264parse ! video/x-h264,stream-format=byte-stream,alignment=au ! appsink name=videosink demux. ! queue ! aacparse ! audio/mpeg,stream-format=adts ! appsink name=audiosink"
+
+// adtsCaps are the caps of the AAC of SRT publishers
+const adtsCaps = "caps=audio/mpeg,mpegversion=4,stream-format=adts"
+
+// srtBuffer bounds the frames of an SRT input waiting to be ingested
+const srtBuffer = 256
+
+// validSRT checks uri is an srt:// uri that fits in a launch description
+func validSRT(uri string) error {
+	if !strings.HasPrefix(uri, "srt://") || strings.ContainsAny(uri, " !\"'") {
+		return fmt.Errorf("not an srt uri: %q", uri)
+	}
+	return nil
+}
+
+// resolveSRTEgress reads where the output of key is republished over SRT,
+// from srt_egress / srt_egress_overrides, e.g.
+// srt://contribution.example:9000?passphrase=secret; empty for nowhere
+func resolveSRTEgress(key string) (string, error) {
+	uri := envForKey("srt_egress", key)
+	if uri == "" {
+		return "", nil
+	}
+	if err := validSRT(uri); err != nil {
+		return "", fmt.Errorf("srt egress: %v", err)
+	}
+	return uri, nil
+}
+
+// setupSRT listens for the SRT publishers of srt_ingest_overrides, e.g.
+// main=srt://:9710?passphrase=secret, each stream key on its own uri in
+// listener mode. The listener being configured for the key, the
+// passphrase checked by libsrt is the credential of its publisher.
+func setupSRT() error {
+	for key, uri := range envOverrides("srt_ingest") {
+		if err := ident.Check(ident.StreamKey, key); err != nil {
+			return fmt.Errorf("srt ingest: %v", err)
+		}
+		if err := validSRT(uri); err != nil {
+			return fmt.Errorf("srt ingest of %s: %v", key, err)
+		}
+		go listenSRT(key, uri)
+	}
+	return nil
+}
+
+// listenSRT publishes key from its SRT listener, one caller after the other
+func listenSRT(key, uri string) {
+	for {
+		if err := ingestSRT(key, uri, ""); err != nil {
+			logger.Warn("srt ingest failed", "stream", key, "error", err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// pumpFrames forwards the buffers of an appsink, dropping them when out is
+// full: appsinks hand buffers over holding the lock of every pipeline
+func pumpFrames(in <-chan []byte) <-chan []byte {
+	out := make(chan []byte, srtBuffer)
+	go func() {
+		defer close(out)
+		for frame := range in {
+			select {
+			case out <- frame:
+			default:
+			}
+		}
+	}()
+	return out
+}
+
+// ingestSRT waits for a caller on uri and publishes key from it until the
+// caller leaves or the session ends. upstream is the origin an edge pulls
+// key from through uri, in caller mode, empty for publishers.
+func ingestSRT(key, uri, upstream string) error {
+	return ingestFrom(key, ingestInput{
+		protocol: protocolSRT,
+		launch:   fmt.Sprintf(srtIngestFormat, uri),
+		where:    strings.SplitN(uri, "?", 2)[0],
+		upstream: upstream,
+	})
+}
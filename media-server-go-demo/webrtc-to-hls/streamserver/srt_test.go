@@ -0,0 +1,43 @@
+package streamserver
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+)
+
+func TestResolveSRTEgress(t *testing.T) {
+	t.Setenv("srt_egress_overrides", "main=srt://contribution.example:9000?passphrase=secret,bad=rtmp://example/live,spaced=srt://a ! fakesink")
+	if uri, err := resolveSRTEgress("main"); err != nil || uri != "srt://contribution.example:9000?passphrase=secret" {
+		t.Fatalf("egress = %q, %v", uri, err)
+	}
+	if uri, err := resolveSRTEgress("other"); err != nil || uri != "" {
+		t.Fatalf("egress without config = %q, %v", uri, err)
+	}
+	for _, key := range []string{"bad", "spaced"} {
+		if _, err := resolveSRTEgress(key); err == nil {
+			t.Errorf("%s accepted", key)
+		}
+	}
+
+	sess := newSession("main", nil, presets[client.LatencyBalanced])
+	sess.srtEgress = "srt://contribution.example:9000"
+	pipeline := sess.outputPipeline("hls/main", 4, true, false).String()
+	if !strings.HasSuffix(pipeline, " tee name=aac ! queue ! muxer. video. ! queue ! mpegtsmux name=srtmux ! srtsink uri=srt://contribution.example:9000 wait-for-connection=false aac. ! queue ! srtmux.") {
+		t.Fatalf("pipeline = %s", pipeline)
+	}
+}
+
+func TestSetupSRT(t *testing.T) {
+	for _, overrides := range []string{"main=udp://:9710", "bad key=srt://:9710"} {
+		t.Setenv("srt_ingest_overrides", overrides)
+		if err := setupSRT(); err == nil {
+			t.Errorf("%s accepted", overrides)
+		}
+	}
+	t.Setenv("srt_ingest_overrides", "main=srt://:9710?passphrase=a=b, backup=srt://:9711,main=srt://:1")
+	if overrides := envOverrides("srt_ingest"); len(overrides) != 2 || overrides["main"] != "srt://:9710?passphrase=a=b" || overrides["backup"] != "srt://:9711" {
+		t.Fatalf("overrides = %v", overrides)
+	}
+}
@@ -0,0 +1,63 @@
+package streamserver
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// streamStats handles GET /api/streams/:id/stats for a live stream, by any
+// of its ids
+func streamStats(c *gin.Context) {
+	sess := registry.find(c.Param("id"))
+	if sess == nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	c.JSON(http.StatusOK, sessionStats(sess))
+}
+
+// sessionStats is the stats snapshot of a session
+func sessionStats(sess *session) gin.H {
+	stats := gin.H{
+		"id":         sess.id,
+		"externalId": sess.externalID,
+		"stream":     sess.key,
+		"kind":       sess.kind,
+		"preset":     sess.preset.Name,
+		"profile":    sess.profile,
+		"frames":     sess.frames.stats(),
+		"extensions": sess.extensionUsage(),
+		"egress":     egressUsage(sess.key),
+	}
+	sess.Lock()
+	keyframes := sess.refresher
+	hls := sess.hls
+	target := sess.loudnessTarget
+	sess.Unlock()
+	if keyframes != nil {
+		stats["keyframes"] = keyframes.keyframeStats()
+	}
+	if hls != nil {
+		stats["queue"] = hls.queueStats()
+		if hls.timing != nil {
+			stats["timestamps"] = hls.timing.stats()
+		}
+		if hls.meter != nil {
+			stats["loudness"] = loudnessStats(target, hls.meter)
+		}
+	}
+	if viewers != nil {
+		stats["audience"] = audienceFor(sess.key)
+	}
+	if pipeline := sess.pipelineState(); pipeline.State != "" {
+		stats["pipeline"] = pipeline
+	}
+	if playable := sess.timeToPlayable(); playable > 0 {
+		stats["firstPlayableMs"] = milliseconds(playable)
+	}
+	if skew, ok := sess.clockSkew(); ok {
+		stats["clockSkewMs"] = milliseconds(skew)
+	}
+	return stats
+}
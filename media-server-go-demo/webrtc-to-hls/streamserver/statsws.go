@@ -0,0 +1,143 @@
+package streamserver
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// statsSnapshot is a message of the stats websocket, the live streams at
+// one instant
+type statsSnapshot struct {
+	At      time.Time        `json:"at"`
+	Streams []streamSnapshot `json:"streams"`
+}
+
+// streamSnapshot is a live stream in a statsSnapshot
+type streamSnapshot struct {
+	Stream string `json:"stream"`
+	ID     string `json:"id"`
+	// Bitrate is the mean video bitrate received, in bits per second, and
+	// FPS the mean frame rate, both over the alert window
+	Bitrate int     `json:"bitrate"`
+	FPS     float64 `json:"fps"`
+	// Viewers counts the viewers of HLS and WebRTC
+	Viewers int `json:"viewers"`
+	// PacketLoss is the fraction of the video packets lost since the last
+	// snapshot, 0 in the first
+	PacketLoss float64 `json:"packetLoss"`
+	// Pipeline is the state of the output pipeline, empty before it started
+	Pipeline string `json:"pipeline,omitempty"`
+}
+
+// statsFeed builds the snapshots of a stats websocket, following the packet
+// counters of each publish between them
+type statsFeed struct {
+	feedback map[string]*transportFeedback
+}
+
+func newStatsFeed() *statsFeed {
+	return &statsFeed{feedback: map[string]*transportFeedback{}}
+}
+
+// snapshot is the stats of the live streams, ordered by stream key
+func (f *statsFeed) snapshot() statsSnapshot {
+	keys := registry.keys()
+	sort.Strings(keys)
+	concurrent := watching.Concurrent()
+	out := statsSnapshot{At: time.Now(), Streams: []streamSnapshot{}}
+	live := map[string]bool{}
+	for _, key := range keys {
+		sess := registry.get(key)
+		if sess == nil {
+			continue
+		}
+		live[sess.id] = true
+		frames := sess.frames.stats()
+		stats := streamSnapshot{
+			Stream:   sess.key,
+			ID:       sess.id,
+			Bitrate:  frames.Bitrate,
+			FPS:      frames.FPS,
+			Viewers:  concurrent[key][protocolHLS] + concurrent[key][protocolWebRTC],
+			Pipeline: sess.pipelineState().State,
+		}
+		if video, _ := sess.liveTracks(); video != nil {
+			feedback := f.feedback[sess.id]
+			if feedback == nil {
+				feedback = &transportFeedback{}
+				f.feedback[sess.id] = feedback
+			}
+			stats.PacketLoss = feedback.next(video.GetStats()).PacketLoss
+		}
+		out.Streams = append(out.Streams, stats)
+	}
+	for id := range f.feedback {
+		if !live[id] {
+			delete(f.feedback, id)
+		}
+	}
+	return out
+}
+
+// statsInterval is the interval of the snapshots of c, its interval query
+// parameter or stats_ws_interval, in seconds (2)
+func statsInterval(c *gin.Context) (time.Duration, bool) {
+	seconds := envInt("stats_ws_interval", 2)
+	if q := c.Query("interval"); q != "" {
+		n, err := strconv.Atoi(q)
+		if err != nil {
+			return 0, false
+		}
+		seconds = n
+	}
+	return time.Duration(seconds) * time.Second, seconds > 0
+}
+
+// statsSocket handles the /api/v1/stats/ws websocket of the dashboards: it
+// sends a statsSnapshot right away then every interval, until the client
+// closes it
+func statsSocket(c *gin.Context) {
+	if _, ok := adminIdentity(c); !ok {
+		return
+	}
+	interval, ok := statsInterval(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "interval must be a positive number of seconds"})
+		return
+	}
+	ws, err := upGrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		websocketErrors.Inc("upgrade")
+		return
+	}
+	defer ws.Close()
+
+	// dashboards send nothing; a read error is the websocket closing
+	closed := make(chan struct{})
+	go func() {
+		for {
+			if _, _, err := ws.NextReader(); err != nil {
+				close(closed)
+				return
+			}
+		}
+	}()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	feed := newStatsFeed()
+	for {
+		ws.SetWriteDeadline(time.Now().Add(signalingWriteTimeout))
+		if err := ws.WriteJSON(feed.snapshot()); err != nil {
+			return
+		}
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package streamserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+)
+
+func TestStatsSocket(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/api/v1/stats/ws", statsSocket)
+	server := httptest.NewServer(r)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/v1/stats/ws"
+
+	if _, resp, err := websocket.DefaultDialer.Dial(url, nil); err == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatal("stats websocket open without an admin identity")
+	}
+	admin := http.Header{"X-Admin-Identity": {"ops"}, "Authorization": {"Bearer " + testAdminToken}}
+	if _, resp, err := websocket.DefaultDialer.Dial(url+"?interval=0", admin); err == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("stats websocket open with no interval")
+	}
+
+	sess := newSession("stats-ws", nil, presets[client.LatencyBalanced])
+	if _, err := registry.claim(sess, conflictReject); err != nil {
+		t.Fatal(err)
+	}
+	defer registry.release(sess)
+	ws, _, err := websocket.DefaultDialer.Dial(url+"?interval=1", admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	for i := 0; i < 2; i++ {
+		var snapshot statsSnapshot
+		if err := ws.ReadJSON(&snapshot); err != nil {
+			t.Fatal(err)
+		}
+		var found bool
+		for _, stream := range snapshot.Streams {
+			if stream.Stream == "stats-ws" {
+				found = stream.ID == sess.id && stream.Viewers == 0 && stream.PacketLoss == 0
+			}
+		}
+		if !found {
+			t.Fatalf("snapshot %d: %+v", i, snapshot)
+		}
+	}
+}
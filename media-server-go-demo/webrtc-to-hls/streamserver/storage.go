@@ -0,0 +1,306 @@
+package streamserver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/jobs"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/storage"
+)
+
+// uploadJobs is the job class copying outputs to the storage backend
+const uploadJobs = "upload"
+
+// store is the backend outputs are copied to, nil to serve them from local
+// disk only
+var store storage.Backend
+
+// storagePrefix starts the names of stored objects, storage_prefix
+var storagePrefix string
+
+// setupStorage reads the backend outputs are copied to from storage: empty
+// for local disk only, disk to copy them to storage_dir, s3 or gcs for a
+// bucket, storage_bucket, with the HMAC keys storage_access_key and
+// storage_secret_key. s3 signs for storage_region (us-east-1) at
+// storage_endpoint (AWS S3 of the region), e.g. https://minio.example:9000.
+// http puts them below storage_endpoint, an origin taking HTTP PUT ingest,
+// with the headers of storage_http_headers, e.g.
+// "Authorization: Bearer secret,X-Ingest-Region: eu".
+func setupStorage() error {
+	storagePrefix = strings.Trim(os.Getenv("storage_prefix"), "/")
+	switch kind := os.Getenv("storage"); kind {
+	case "":
+		return nil
+	case "disk":
+		dir := os.Getenv("storage_dir")
+		if dir == "" {
+			return errors.New("storage: storage_dir required")
+		}
+		store = &storage.Disk{Root: dir}
+	case "s3", "gcs":
+		s3 := &storage.S3{
+			Endpoint:  os.Getenv("storage_endpoint"),
+			Region:    os.Getenv("storage_region"),
+			Bucket:    os.Getenv("storage_bucket"),
+			AccessKey: os.Getenv("storage_access_key"),
+			SecretKey: os.Getenv("storage_secret_key"),
+		}
+		if s3.Bucket == "" || s3.AccessKey == "" || s3.SecretKey == "" {
+			return errors.New("storage: storage_bucket, storage_access_key and storage_secret_key required")
+		}
+		switch {
+		case s3.Region != "":
+		case kind == "gcs":
+			s3.Region = "auto"
+		default:
+			s3.Region = "us-east-1"
+		}
+		switch {
+		case s3.Endpoint != "":
+		case kind == "gcs":
+			s3.Endpoint = "https://storage.googleapis.com"
+		default:
+			s3.Endpoint = "https://s3." + s3.Region + ".amazonaws.com"
+		}
+		store = s3
+	case "http":
+		endpoint := os.Getenv("storage_endpoint")
+		if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("storage: storage_endpoint must be an http(s) url, not %q", endpoint)
+		}
+		header := http.Header{}
+		for _, item := range envList("storage_http_headers") {
+			kv := strings.SplitN(item, ":", 2)
+			if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+				return fmt.Errorf("storage: storage_http_headers: %q is not Name: value", item)
+			}
+			header.Add(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+		}
+		store = &storage.HTTP{Endpoint: endpoint, Header: header}
+	default:
+		return fmt.Errorf("storage must be disk, s3, gcs or http, not %q", kind)
+	}
+	logger.Info("storing outputs", "storage", store.Name())
+	return nil
+}
+
+// cdnBase is the url the stored playlists of key refer to their segments
+// by, storage_cdn_base / storage_cdn_base_overrides followed by the key,
+// e.g. https://cdn.example/live/main; empty keeps them relative
+func cdnBase(key string) string {
+	base := strings.TrimRight(envForKey("storage_cdn_base", key), "/")
+	if base == "" {
+		return ""
+	}
+	return base + "/" + key
+}
+
+// objectName is the name the file name of the output of key is stored as
+func objectName(key, name string) string {
+	return path.Join(storagePrefix, key, name)
+}
+
+// putFile stores the file at path as name
+func putFile(ctx context.Context, name, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return store.Put(ctx, name, f, info.Size(), storage.ContentType(name))
+}
+
+// outputUploads tracks what the output of a stream key has stored. The
+// playlist revisions are uploaded one at a time, each after the segments
+// it lists, so a stored playlist never refers to a segment not stored yet.
+type outputUploads struct {
+	// submitted numbers the revisions queued, atomically: queueing never
+	// waits for an upload
+	submitted int64
+
+	sync.Mutex
+	// stored is the latest revision stored
+	stored int64
+	// uploaded are the files listed by the stored playlist
+	uploaded map[string]bool
+}
+
+// submit numbers a revision of the playlist queued for upload
+func (u *outputUploads) submit() int64 {
+	return atomic.AddInt64(&u.submitted, 1)
+}
+
+// restored records uris, the files of a stored playlist fetched back, as
+// stored
+func (u *outputUploads) restored(uris []string) {
+	u.Lock()
+	defer u.Unlock()
+	if u.uploaded == nil {
+		u.uploaded = map[string]bool{}
+	}
+	for _, uri := range uris {
+		u.uploaded[uri] = true
+	}
+}
+
+// upload stores the files playlist lists that are not stored yet, in dir,
+// then the playlist as revision. A revision older than the latest queued
+// is skipped, the latest one storing whatever it missed.
+func (u *outputUploads) upload(ctx context.Context, key, dir string, revision int64, playlist []byte) error {
+	u.Lock()
+	defer u.Unlock()
+	if revision < atomic.LoadInt64(&u.submitted) || revision <= u.stored {
+		return nil
+	}
+	rewritten, uris := storage.RewritePlaylist(playlist, cdnBase(key))
+	var missing []string
+	for _, uri := range uris {
+		if !u.uploaded[uri] {
+			missing = append(missing, uri)
+		}
+	}
+	stored, err := putFiles(ctx, key, dir, missing)
+	if u.uploaded == nil {
+		u.uploaded = map[string]bool{}
+	}
+	for _, uri := range stored {
+		u.uploaded[uri] = true
+	}
+	if err != nil {
+		return err
+	}
+	name := objectName(key, playlistName)
+	if err := store.Put(ctx, name, bytes.NewReader(rewritten), int64(len(rewritten)), storage.ContentType(name)); err != nil {
+		return err
+	}
+	u.stored = revision
+	listed := make(map[string]bool, len(uris))
+	for _, uri := range uris {
+		listed[uri] = true
+	}
+	u.uploaded = listed
+	return nil
+}
+
+// putFiles stores the files uris of the output of key, in dir,
+// storage_parallel (4) at once, returning those stored. The first to fail
+// cancels the others.
+func putFiles(ctx context.Context, key, dir string, uris []string) ([]string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	parallel := envInt("storage_parallel", 4)
+	if parallel < 1 {
+		parallel = 1
+	}
+	var (
+		lock     sync.Mutex
+		stored   []string
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	slots := make(chan struct{}, parallel)
+	for _, uri := range uris {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(uri string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			err := putFile(ctx, objectName(key, uri), filepath.Join(dir, filepath.FromSlash(uri)))
+			lock.Lock()
+			defer lock.Unlock()
+			switch {
+			case err == nil:
+				stored = append(stored, uri)
+			case firstErr == nil:
+				firstErr = err
+				cancel()
+			}
+		}(uri)
+	}
+	wg.Wait()
+	return stored, firstErr
+}
+
+// uploadOutput queues the upload of the current playlist of key, as served
+// when it continues a takeover or a migration, and of the segments it lists
+func uploadOutput(key string) {
+	if store == nil {
+		return
+	}
+	out := outputs.get(key)
+	playlist, err := ioutil.ReadFile(out.playlist())
+	if err != nil {
+		return
+	}
+	playlist, _ = out.generations.continuedPlaylist(playlist)
+	uploadPlaylist(key, playlist)
+}
+
+// uploadPlaylist queues the upload of playlist, a revision of the playlist
+// of key, and of the segments it lists
+func uploadPlaylist(key string, playlist []byte) {
+	out := outputs.get(key)
+	// the revision is staged against the memory budget of the session
+	release, ok := stageUpload(key, len(playlist))
+	if !ok {
+		// the next revision stores what this one missed
+		return
+	}
+	revision := out.uploads.submit()
+	_, err := background.Submit(uploadJobs, objectName(key, playlistName), func(ctx context.Context) error {
+		err := out.uploads.upload(ctx, key, out.dir, revision, playlist)
+		if err == nil {
+			release()
+		}
+		return err
+	})
+	if err != nil {
+		release()
+	}
+}
+
+// recordingObject is the name a recording of key is stored as
+func recordingObject(key, file string) string {
+	return path.Join(storagePrefix, "recordings", key, filepath.Base(file))
+}
+
+// uploadFile queues the upload of file as name
+func uploadFile(name, file string) {
+	if store == nil {
+		return
+	}
+	background.Submit(uploadJobs, name, func(ctx context.Context) error {
+		return putFile(ctx, name, file)
+	})
+}
+
+// uploadClass is the policy of uploads: storage_workers (4) at once, each
+// attempt bounded by storage_timeout (60) seconds, storage_attempts (5)
+// attempts
+func uploadClass() jobs.Class {
+	return jobs.Class{
+		Name:        uploadJobs,
+		Concurrency: envInt("storage_workers", 4),
+		Depth:       128,
+		MaxAttempts: envInt("storage_attempts", 5),
+		Backoff:     time.Second,
+		MaxBackoff:  30 * time.Second,
+		Timeout:     time.Duration(envInt("storage_timeout", 60)) * time.Second,
+	}
+}
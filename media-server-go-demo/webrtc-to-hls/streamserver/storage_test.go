@@ -0,0 +1,101 @@
+package streamserver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/storage"
+)
+
+func TestSetupStorage(t *testing.T) {
+	defer func() { store = nil }()
+	for _, name := range []string{"storage", "storage_bucket", "storage_access_key", "storage_secret_key", "storage_endpoint", "storage_http_headers"} {
+		unsetenv(t, name)
+	}
+	t.Setenv("storage", "ftp")
+	if err := setupStorage(); err == nil {
+		t.Fatal("ftp accepted")
+	}
+	t.Setenv("storage", "gcs")
+	if err := setupStorage(); err == nil {
+		t.Fatal("gcs without a bucket accepted")
+	}
+	t.Setenv("storage_bucket", "media")
+	t.Setenv("storage_access_key", "GOOG1")
+	t.Setenv("storage_secret_key", "secret")
+	if err := setupStorage(); err != nil {
+		t.Fatal(err)
+	}
+	if s3 := store.(*storage.S3); s3.Endpoint != "https://storage.googleapis.com" || s3.Region != "auto" {
+		t.Fatalf("gcs = %+v", s3)
+	}
+	t.Setenv("storage", "s3")
+	t.Setenv("storage_endpoint", "http://minio:9000")
+	if err := setupStorage(); err != nil || store.(*storage.S3).Region != "us-east-1" || store.Name() != "s3://media" {
+		t.Fatalf("s3 = %+v, %v", store, err)
+	}
+	t.Setenv("storage", "http")
+	t.Setenv("storage_endpoint", "ingest.example/live")
+	if err := setupStorage(); err == nil {
+		t.Fatal("endpoint without a scheme accepted")
+	}
+	t.Setenv("storage_endpoint", "https://ingest.example/live")
+	t.Setenv("storage_http_headers", "Authorization: Bearer secret, X-Ingest-Region:eu")
+	if err := setupStorage(); err != nil {
+		t.Fatal(err)
+	}
+	if h := store.(*storage.HTTP); h.Header.Get("Authorization") != "Bearer secret" || h.Header.Get("X-Ingest-Region") != "eu" {
+		t.Fatalf("http = %+v", h)
+	}
+	t.Setenv("storage_http_headers", "Authorization")
+	if err := setupStorage(); err == nil {
+		t.Fatal("header without a value accepted")
+	}
+}
+
+func TestOutputUploads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	live, stored := filepath.Join(dir, "live"), filepath.Join(dir, "stored")
+	os.MkdirAll(live, 0755)
+	store = &storage.Disk{Root: stored}
+	defer func() { store = nil }()
+	t.Setenv("storage_cdn_base", "https://cdn.example/live/")
+
+	ioutil.WriteFile(filepath.Join(live, "segment-1-0.ts"), []byte("ts0"), 0644)
+	playlist := []byte("#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXTINF:2.000,\nsegment-1-0.ts\n")
+	var u outputUploads
+	stale, latest := u.submit(), u.submit()
+	if err := u.upload(context.Background(), "main", live, stale, []byte("#EXTM3U\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(stored, "main", playlistName)); !os.IsNotExist(err) {
+		t.Fatal("stale revision stored")
+	}
+	if err := u.upload(context.Background(), "main", live, latest, playlist); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(stored, "main", "segment-1-0.ts")); string(data) != "ts0" {
+		t.Fatalf("segment = %q", data)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(stored, "main", playlistName))
+	if !strings.Contains(string(data), "\nhttps://cdn.example/live/main/segment-1-0.ts\n") {
+		t.Fatalf("playlist = %s", data)
+	}
+
+	// a segment missing fails the revision, to be retried
+	next := u.submit()
+	if err := u.upload(context.Background(), "main", live, next, append(playlist, "#EXTINF:2.000,\nsegment-1-1.ts\n"...)); err == nil {
+		t.Fatal("missing segment uploaded")
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(stored, "main", playlistName)); strings.Contains(string(data), "segment-1-1") {
+		t.Fatal("playlist stored before its segment")
+	}
+}
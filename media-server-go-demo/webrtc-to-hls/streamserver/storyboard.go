@@ -0,0 +1,144 @@
+package streamserver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	gstreamer "github.com/notedit/gstreamer-go"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/hlscheck"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/storyboard"
+)
+
+var extractPipelineStr = "filesrc location=%s ! %s ! h264parse ! avdec_h264 ! videoconvert ! videoscale ! video/x-raw,width=%d,height=%d ! jpegenc ! appsink name=appsink"
+
+const extractTimeout = 10 * time.Second
+
+const storyboardAttempts = 3
+
+// gstExtractor decodes the first frame of a segment with GStreamer. fMP4
+// segments are decoded behind init, their initialization section.
+type gstExtractor struct {
+	init string
+}
+
+func (e gstExtractor) Extract(path string, width, height int) (image.Image, error) {
+	demux := "tsdemux"
+	if e.init != "" {
+		joined, err := joinInit(e.init, path)
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(joined)
+		path, demux = joined, "qtdemux"
+	}
+	pipeline, err := gstreamer.New(fmt.Sprintf(extractPipelineStr, strconv.Quote(path), demux, width, height))
+	if err != nil {
+		return nil, err
+	}
+	appsink := pipeline.FindElement("appsink")
+	out := appsink.Poll()
+	pipeline.Start()
+	defer func() {
+		appsink.Stop()
+		pipeline.Stop()
+	}()
+
+	select {
+	case buffer, ok := <-out:
+		if !ok {
+			return nil, errors.New("no frame decoded")
+		}
+		return jpeg.Decode(bytes.NewReader(buffer))
+	case <-time.After(extractTimeout):
+		return nil, errors.New("timeout decoding frame")
+	}
+}
+
+// joinInit writes the fMP4 segment at path behind its initialization
+// section to a temporary file, which qtdemux can read
+func joinInit(init, path string) (string, error) {
+	header, err := ioutil.ReadFile(init)
+	if err != nil {
+		return "", err
+	}
+	segment, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile("", "storyboard*.mp4")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(header, segment...)); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// storyboardJobs is the job class of storyboard generation
+const storyboardJobs = "storyboard"
+
+// scheduleStoryboard builds the seek-preview storyboard for a finished stream.
+// It is enabled by setting storyboard_interval (seconds between frames).
+func scheduleStoryboard(key string) {
+	scheduleStoryboardIn(key, key, outputDir(key), "/hls/"+key+"/")
+}
+
+// scheduleStoryboardIn builds the storyboard of the playlist in dir, served
+// at base, the job being named name. A storyboard.ready event about key
+// tells where it is served once built.
+func scheduleStoryboardIn(key, name, dir, base string) {
+	interval := envInt("storyboard_interval", 0)
+	if interval <= 0 {
+		return
+	}
+	opts := storyboard.DefaultOptions
+	opts.Interval = float64(interval)
+
+	// a full queue is counted and logged by observeJob
+	background.Submit(storyboardJobs, name, func(ctx context.Context) error {
+		if err := buildStoryboard(dir, opts); err != nil {
+			return err
+		}
+		logger.Info("storyboard ready", "output", name)
+		notifyHooks(hookStoryboardReady, key, map[string]interface{}{
+			"output": name, "vtt": base + opts.VTTName(),
+		})
+		return nil
+	})
+}
+
+func buildStoryboard(dir string, opts storyboard.Options) error {
+	data, err := ioutil.ReadFile(filepath.Join(dir, playlistName))
+	if err != nil {
+		return err
+	}
+	segments, err := storyboard.ParsePlaylist(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	var extractor gstExtractor
+	if m, err := hlscheck.ParseMedia(data); err == nil {
+		extractor = playlistExtractor(dir, m)
+	}
+	return storyboard.Generate(dir, segments, opts, extractor)
+}
+
+// playlistExtractor decodes the segments of the playlist m of dir
+func playlistExtractor(dir string, m *hlscheck.Media) gstExtractor {
+	if m.Map == "" {
+		return gstExtractor{}
+	}
+	return gstExtractor{init: filepath.Join(dir, m.Map)}
+}
@@ -0,0 +1,341 @@
+package streamserver
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	mediaserver "github.com/notedit/media-server-go"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/ident"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/pipeline"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/teardown"
+	"github.com/notedit/sdp"
+)
+
+// streamsName is the directory of the outputs of the streams published
+// next to the one of the main output, e.g. the screen shared next to the
+// camera: each is packaged on its own, in a directory below it
+const streamsName = "streams"
+
+// maxStreamOutputs reads how many streams of a publish, besides the one of
+// the main output, get an output of their own, from max_stream_outputs, 3
+// by default. The others are received, for updates to switch the main
+// output to, but not packaged.
+func maxStreamOutputs() int {
+	return envInt("max_stream_outputs", 3)
+}
+
+// primaryStream is the id of the stream of offer feeding the main output:
+// the first, by id, with video, other than the screen of a composite.
+// Empty when there is none.
+func primaryStream(offer *sdp.SDPInfo, screen string) string {
+	streams := videoStreams(offer, screen)
+	if len(streams) == 0 {
+		return ""
+	}
+	return streams[0]
+}
+
+// videoStreams are the ids of the streams of offer with video, sorted,
+// but the screen of a composite
+func videoStreams(offer *sdp.SDPInfo, screen string) []string {
+	ids := []string{}
+	for id, stream := range offer.GetStreams() {
+		if id != screen && stream.GetFirstTrack("video") != nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// streamDirName is the directory of the output of the published stream
+// id: the id itself when it makes a file name, or else a hash of it, as
+// browsers name streams e.g. {uuid}
+func streamDirName(id string) string {
+	if ident.Check(ident.FileName, id) == nil {
+		return id
+	}
+	sum := sha1.Sum([]byte(id))
+	return "stream-" + hex.EncodeToString(sum[:6])
+}
+
+// streamDir is where the output of the published stream id goes, for the
+// main output written to dir
+func streamDir(dir, id string) string {
+	return filepath.Join(dir, streamsName, streamDirName(id))
+}
+
+// streamPlaylistPath is where players fetch the playlist of the output of
+// the published stream id of key
+func streamPlaylistPath(key, id string) string {
+	return "/hls/" + key + "/" + streamsName + "/" + streamDirName(id) + "/" + playlistName
+}
+
+// videoFrames hands the frames of a published video track to each of its
+// consumers, the main output and the output of its stream, as a track
+// takes a single listener
+type videoFrames struct {
+	sync.Mutex
+	listeners []frameListener
+}
+
+// frameListener gets the frames of a track while live reports true, and
+// is dropped after
+type frameListener struct {
+	live   func() bool
+	listen func(frame []byte, timestamp uint)
+}
+
+func (v *videoFrames) add(l frameListener) {
+	v.Lock()
+	v.listeners = append(v.listeners, l)
+	v.Unlock()
+}
+
+func (v *videoFrames) deliver(frame []byte, timestamp uint) {
+	v.Lock()
+	listeners := v.listeners[:0]
+	for _, l := range v.listeners {
+		if l.live() {
+			listeners = append(listeners, l)
+		}
+	}
+	v.listeners = listeners
+	live := append([]frameListener(nil), listeners...)
+	v.Unlock()
+	for _, l := range live {
+		l.listen(frame, timestamp)
+	}
+}
+
+// onVideoFrame gives listen the frames of track while live reports true,
+// as Annex B for H.264, as depacketized for other codecs
+func (s *session) onVideoFrame(track *mediaserver.IncomingStreamTrack, live func() bool, listen func(frame []byte, timestamp uint)) {
+	s.Lock()
+	if s.videoFrames == nil {
+		s.videoFrames = map[*mediaserver.IncomingStreamTrack]*videoFrames{}
+	}
+	frames, registered := s.videoFrames[track]
+	if !registered {
+		frames = &videoFrames{}
+		s.videoFrames[track] = frames
+	}
+	raw := s.videoCodec != codecH264
+	s.Unlock()
+	frames.add(frameListener{live: live, listen: listen})
+	if registered {
+		return
+	}
+	if raw {
+		track.OnRawMediaFrame(frames.deliver)
+		return
+	}
+	track.OnMediaFrame(frames.deliver)
+}
+
+// publishedOutput is the output of a published stream other than the one of
+// the main output: its video, in the codec and container of the main
+// output, and in TS outputs its audio, written by a pipeline of its own
+type publishedOutput struct {
+	id   string
+	path string
+	hls  *hlsOutput
+}
+
+// streamAudio decides whether the output of stream takes its audio: TS
+// outputs do, of a stream whose first audio track is not an alternate of
+// the main output
+func (s *session) streamAudio(stream *mediaserver.IncomingStream) bool {
+	if s.container == containerFMP4 || !muxAudio(len(stream.GetAudioTracks()), s.key) {
+		return false
+	}
+	id := firstAudioTrack(stream).GetID()
+	for _, alternate := range s.alternateAudio {
+		if alternate.id == id {
+			return false
+		}
+	}
+	return true
+}
+
+// streamPipeline is the pipeline of the output of a published stream,
+// written to dir, with the session locked
+func (s *session) streamPipeline(dir string, audio bool) *pipeline.Builder {
+	timestamped := rtpTimestamps(s.key)
+	video := pipeline.Track{Name: "appsrc", Input: videoInput(s.outputCodec(), s.inputCodec(), s.preset, s.key), MaxBytes: outputQueueBytes, Timestamped: timestamped}
+	b := pipeline.New(video, hlsSink(s.preset, dir, s.generation, s.container))
+	if audio {
+		track := aacTrack("")
+		if s.loudnessTarget != 0 {
+			track = normalizedTrack("", s.loudnessTarget)
+		}
+		track.Timestamped = timestamped
+		b.Audio(track)
+	}
+	return b
+}
+
+// startStreamOutput packages stream, published next to the stream of the
+// main output, into an output of its own, once the main output started
+func (s *session) startStreamOutput(stream *mediaserver.IncomingStream) error {
+	id := stream.GetID()
+	if limit := limitsFromEnv().pipelines; limit > 0 && runningPipelines() >= limit {
+		limitRefusals.Inc(limitPipelines)
+		return &limitExceeded{limit: limitPipelines, max: limit, current: runningPipelines()}
+	}
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		return errStreamReplaced
+	}
+	if s.streams[id] != nil {
+		s.Unlock()
+		return nil
+	}
+	dir := streamDir(outputs.get(s.key).dir, id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		s.Unlock()
+		return err
+	}
+	audio := s.streamAudio(stream)
+	hls, err := newHLSOutput(s.streamPipeline(dir, audio).String())
+	if err != nil {
+		s.Unlock()
+		return err
+	}
+	if rtpTimestamps(s.key) {
+		hls.timing = newOutputTiming(time.Now())
+	}
+	out := &publishedOutput{id: id, path: streamPlaylistPath(s.key, id), hls: hls}
+	if s.streams == nil {
+		s.streams = map[string]*publishedOutput{}
+	}
+	s.streams[id] = out
+	codec := s.inputCodec()
+	s.Unlock()
+
+	live := func() bool {
+		s.Lock()
+		defer s.Unlock()
+		return s.streams[id] == out
+	}
+	s.onVideoFrame(stream.GetVideoTracks()[0], live, func(frame []byte, timestamp uint) {
+		if len(frame) <= 4 {
+			return
+		}
+		ingestBytes.Add("video", uint64(len(frame)))
+		s.Lock()
+		if s.streams[id] == out {
+			hls.push(frame, rtpTime(timestamp), videoKeyframe(codec, frame))
+		}
+		s.Unlock()
+	})
+	if audio {
+		firstAudioTrack(stream).OnMediaFrame(func(frame []byte, timestamp uint) {
+			if len(frame) == 0 {
+				return
+			}
+			ingestBytes.Add("audio", uint64(len(frame)))
+			s.Lock()
+			if s.streams[id] == out {
+				hls.pushAudio(frame, rtpTime(timestamp))
+			}
+			s.Unlock()
+		})
+	}
+	go s.superviseStreamOutput(out)
+	s.timeline.add(eventPipeline, "stream "+id+" output started")
+	s.logf("stream %s packaged to %s", id, out.path)
+	return nil
+}
+
+// startStreamOutputs gives each of streams an output of its own, up to
+// maxStreamOutputs of them by id, the others and those failing to start
+// only logged: the main output goes on without them
+func (s *session) startStreamOutputs(streams []*mediaserver.IncomingStream) {
+	sort.Slice(streams, func(i, j int) bool { return streams[i].GetID() < streams[j].GetID() })
+	for _, stream := range streams {
+		s.Lock()
+		started := len(s.streams)
+		s.Unlock()
+		if started >= maxStreamOutputs() {
+			s.logf("stream %s not packaged, at most %d streams are", stream.GetID(), maxStreamOutputs())
+			continue
+		}
+		if err := s.startStreamOutput(stream); err != nil {
+			s.logf("stream %s not packaged: %v", stream.GetID(), err)
+		}
+	}
+}
+
+// stopStreamOutput finalizes the output of the published stream id, if
+// any, e.g. dropped by a renegotiation
+func (s *session) stopStreamOutput(id string) {
+	s.Lock()
+	out := s.streams[id]
+	delete(s.streams, id)
+	s.Unlock()
+	if out == nil {
+		return
+	}
+	s.timeline.add(eventPipeline, "stream "+id+" output stopping")
+	plan := teardown.NewPlan(s.teardownLogf)
+	plan.AddSink(out.hls)
+	plan.Run(context.Background())
+}
+
+// superviseStreamOutput drops the output of a published stream whose
+// pipeline failed, the main output going on without it
+func (s *session) superviseStreamOutput(out *publishedOutput) {
+	select {
+	case <-out.hls.failed:
+	case <-out.hls.released:
+		return
+	}
+	s.Lock()
+	owned := s.streams[out.id] == out
+	if owned {
+		delete(s.streams, out.id)
+	}
+	s.Unlock()
+	if !owned {
+		return
+	}
+	pipelineFailures.Inc(out.hls.failure)
+	out.hls.Release()
+	s.timeline.add(eventPipeline, "stream "+out.id+" output failed: "+out.hls.failure)
+	s.logf("stream %s output failed: %s", out.id, out.hls.failure)
+}
+
+// streamPlaylists are the playlists of the outputs of the published
+// streams, by stream id, nil without any
+func (s *session) streamPlaylists() map[string]string {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.streams) == 0 {
+		return nil
+	}
+	playlists := make(map[string]string, len(s.streams))
+	for id, out := range s.streams {
+		playlists[id] = out.path
+	}
+	return playlists
+}
+
+// detachStreams stops ingest into the outputs of the published streams
+// and adds their teardown to plan
+func (s *session) detachStreams(plan *teardown.Plan) {
+	s.Lock()
+	streams := s.streams
+	s.streams = nil
+	s.Unlock()
+	for _, out := range streams {
+		plan.AddSink(out.hls)
+	}
+}
@@ -0,0 +1,69 @@
+package streamserver
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/notedit/sdp"
+)
+
+func TestPrimaryStream(t *testing.T) {
+	offer, err := sdp.Parse(string(mustRead(t, "testdata/screen_share_offer.sdp")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	camera := "5Bq1nTqHKk1Yq7dFQZPmWLhWDkjvkxhzmTe7"
+	if streams := videoStreams(offer, ""); !reflect.DeepEqual(streams, []string{camera, "screen"}) {
+		t.Fatalf("video streams = %v", streams)
+	}
+	if primary := primaryStream(offer, ""); primary != camera {
+		t.Fatalf("primary = %q", primary)
+	}
+	// the screen of a composite is neither
+	if streams := videoStreams(offer, "screen"); !reflect.DeepEqual(streams, []string{camera}) {
+		t.Fatalf("video streams but the screen = %v", streams)
+	}
+	audio, err := sdp.Parse(string(mustRead(t, "testdata/audio_only_offer.sdp")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if primary := primaryStream(audio, ""); primary != "" {
+		t.Fatalf("audio-only primary = %q", primary)
+	}
+}
+
+func TestStreamDir(t *testing.T) {
+	if dir := streamDir("hls/live", "screen"); dir != "hls/live/streams/screen" {
+		t.Fatalf("dir = %s", dir)
+	}
+	if path := streamPlaylistPath("live", "screen"); path != "/hls/live/streams/screen/playlist.m3u8" {
+		t.Fatalf("path = %s", path)
+	}
+	// ids that make no file name are hashed, the same each time
+	name := streamDirName("{0b8a2d6e-5c1f-4e0a-9a3b-1c2d3e4f5a6b}")
+	if !strings.HasPrefix(name, "stream-") || strings.ContainsAny(name, "{}") || name != streamDirName("{0b8a2d6e-5c1f-4e0a-9a3b-1c2d3e4f5a6b}") {
+		t.Fatalf("name = %s", name)
+	}
+	if streamDirName("../x") == "../x" {
+		t.Fatal("id leaving the directory kept")
+	}
+}
+
+func TestVideoFrames(t *testing.T) {
+	var frames videoFrames
+	mainLive, ownLive := true, true
+	var main, own int
+	frames.add(frameListener{live: func() bool { return mainLive }, listen: func([]byte, uint) { main++ }})
+	frames.add(frameListener{live: func() bool { return ownLive }, listen: func([]byte, uint) { own++ }})
+	frames.deliver([]byte{0, 0, 0, 1, 0x65}, 0)
+	if main != 1 || own != 1 {
+		t.Fatalf("main %d, own %d", main, own)
+	}
+	// a switched away feed is dropped, the output of the stream goes on
+	mainLive = false
+	frames.deliver([]byte{0, 0, 0, 1, 0x41}, 3000)
+	if main != 1 || own != 2 || len(frames.listeners) != 1 {
+		t.Fatalf("main %d, own %d, %d listeners", main, own, len(frames.listeners))
+	}
+}
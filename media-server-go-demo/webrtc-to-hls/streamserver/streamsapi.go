@@ -0,0 +1,177 @@
+package streamserver
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/ident"
+)
+
+// The /api/v1/streams endpoints manage the live sessions of the registry:
+//
+//	GET    /api/v1/streams                             every live stream
+//	GET    /api/v1/streams/:id                         one stream, by any of its ids
+//	GET    /api/v1/streams/:id/stats                   its stats snapshot
+//	GET    /api/v1/streams/:id/viewers                 its viewers
+//	PUT    /api/v1/streams/:id/layer                   pick its simulcast layer
+//	GET    /api/v1/streams/:id/restreams               RTMP destinations of a key
+//	POST   /api/v1/streams/:id/restreams               add one
+//	DELETE /api/v1/streams/:id/restreams/:destination  remove one
+//	POST   /api/v1/streams/:id/record/start            record it to a file
+//	POST   /api/v1/streams/:id/record/stop             complete the file
+//	POST   /api/v1/streams/:id/capture                 dump the packets of its publisher
+//	DELETE /api/v1/streams/:id/capture                 stop dumping them
+//	GET    /api/v1/streams/:id/thumbnail               its latest thumbnail
+//	POST   /api/v1/streams/:id/metadata                put timed metadata on its output
+//	POST   /api/v1/streams/:id/splices                 open or end an ad break
+//	GET    /api/v1/streams/:id/dvr                     DVR window of a key
+//	PUT    /api/v1/streams/:id/dvr                     set it
+//	DELETE /api/v1/streams/:id                         kick its publisher, audited
+
+// streamSummary describes a live session in listings
+func streamSummary(s *session) gin.H {
+	summary := streamIDs(s)
+	summary["preset"] = s.preset.Name
+	summary["created"] = s.created
+	summary["publisher"] = s.identity
+	summary["whip"] = s.conn == nil && s.ingest == ""
+	summary["ingest"] = s.ingest
+	if s.upstream != "" {
+		summary["upstream"] = s.upstream
+	}
+	summary["srtEgress"] = s.srtEgress != ""
+	summary["webrtcViewers"] = s.viewerCount()
+	summary["viewers"] = concurrentViewers(s.key)["total"]
+	if file := s.recordingFile(); file != "" {
+		summary["recording"] = file
+	}
+	if file := s.captureFile(); file != "" {
+		summary["capture"] = file
+	}
+	if at := s.thumbnailTime(); !at.IsZero() {
+		summary["thumbnailAt"] = at
+	}
+	if pipeline := s.pipelineState(); pipeline.State != "" {
+		summary["pipeline"] = pipeline.State
+	}
+	summary["memory"] = s.account.Usage()
+	if renditions := s.renditions(); renditions != nil {
+		summary["renditions"] = renditions
+	}
+	if layers := s.layers(); layers != nil {
+		summary["simulcast"] = layers.describe()
+	}
+	if playable := s.timeToPlayable(); playable > 0 {
+		summary["firstPlayableMs"] = milliseconds(playable)
+	}
+	return summary
+}
+
+// liveSession returns the live session of the :id parameter, answering 400
+// or 404 when there is none
+func liveSession(c *gin.Context) *session {
+	id, ok := identParam(c, "id", ident.PlaybackID)
+	if !ok {
+		return nil
+	}
+	sess := registry.find(id)
+	if sess == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": errNotLive.Error()})
+	}
+	return sess
+}
+
+// listStreams handles GET /api/v1/streams
+func listStreams(c *gin.Context) {
+	keys := registry.keys()
+	sort.Strings(keys)
+	streams := make([]gin.H, 0, len(keys))
+	for _, key := range keys {
+		if sess := registry.get(key); sess != nil {
+			streams = append(streams, streamSummary(sess))
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"streams": streams})
+}
+
+// getStream handles GET /api/v1/streams/:id
+func getStream(c *gin.Context) {
+	if sess := liveSession(c); sess != nil {
+		c.JSON(http.StatusOK, streamSummary(sess))
+	}
+}
+
+// getStreamStats handles GET /api/v1/streams/:id/stats
+func getStreamStats(c *gin.Context) {
+	if sess := liveSession(c); sess != nil {
+		c.JSON(http.StatusOK, sessionStats(sess))
+	}
+}
+
+// listStreamViewers handles GET /api/v1/streams/:id/viewers. WebRTC viewers
+// are listed one by one; HLS viewers only as counts, concurrent and the
+// audience rollup, their addresses not being kept.
+func listStreamViewers(c *gin.Context) {
+	sess := liveSession(c)
+	if sess == nil {
+		return
+	}
+	webrtc := []gin.H{}
+	for _, v := range sess.webrtcViewers() {
+		signaling := "whep"
+		if v.conn != nil {
+			signaling = "websocket"
+		}
+		webrtc = append(webrtc, gin.H{"id": v.id, "signaling": signaling, "joined": v.joined})
+	}
+	body := gin.H{"stream": sess.key, "webrtc": webrtc, "concurrent": concurrentViewers(sess.key)}
+	if viewers != nil {
+		body["hls"] = audienceFor(sess.key)
+	}
+	c.JSON(http.StatusOK, body)
+}
+
+// kickStream handles DELETE /api/v1/streams/:id: the publisher is
+// disconnected with client.CloseKicked and its stream key freed
+func kickStream(c *gin.Context) {
+	admin, ok := adminIdentity(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.BindJSON(&req); err != nil {
+			return
+		}
+	}
+	sess := liveSession(c)
+	if sess == nil {
+		return
+	}
+	if err := kickSession(sess, admin, req.Reason); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// kickSession disconnects the publisher of sess for admin, with reason
+// told to the publisher when not empty
+func kickSession(sess *session, admin, reason string) error {
+	// audited before it takes effect, an unaudited kick must not happen
+	if err := audit.record(auditEntry{Time: time.Now(), Admin: admin, Action: "kick", Stream: sess.key, Reason: reason}); err != nil {
+		return err
+	}
+	told := "stopped by an operator"
+	if reason != "" {
+		told += ": " + reason
+	}
+	sess.logf("kicked by %s", admin)
+	sess.endWith(client.CloseKicked, told)
+	return nil
+}
@@ -0,0 +1,104 @@
+package streamserver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+)
+
+func TestStreamsAPI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "streamsapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	saved := audit
+	audit = &auditLog{path: filepath.Join(dir, "audit.log")}
+	defer func() { audit = saved }()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/api/v1/streams", listStreams)
+	r.GET("/api/v1/streams/:id", getStream)
+	r.GET("/api/v1/streams/:id/stats", getStreamStats)
+	r.GET("/api/v1/streams/:id/viewers", listStreamViewers)
+	r.DELETE("/api/v1/streams/:id", kickStream)
+	do := func(method, path, admin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if admin != "" {
+			asAdmin(req, admin)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	sess := newSession("api-live", nil, presets[client.LatencyBalanced])
+	sess.externalID = "api-ext"
+	if _, err := registry.claim(sess, conflictReject); err != nil {
+		t.Fatal(err)
+	}
+	defer registry.release(sess)
+
+	w := do("GET", "/api/v1/streams", "")
+	var list struct {
+		Streams []map[string]interface{} `json:"streams"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("list = %d %s", w.Code, w.Body)
+	}
+	found := false
+	for _, s := range list.Streams {
+		found = found || s["stream"] == "api-live"
+	}
+	if !found {
+		t.Fatalf("live stream not listed: %s", w.Body)
+	}
+
+	for path, status := range map[string]int{
+		"/api/v1/streams/api-ext":         http.StatusOK,
+		"/api/v1/streams/api-live/stats":  http.StatusOK,
+		"/api/v1/streams/unknown":         http.StatusNotFound,
+		"/api/v1/streams/_mosaic/viewers": http.StatusBadRequest,
+	} {
+		if w := do("GET", path, ""); w.Code != status {
+			t.Errorf("GET %s = %d, want %d", path, w.Code, status)
+		}
+	}
+	w = do("GET", "/api/v1/streams/api-live/viewers", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"webrtc":[]`) {
+		t.Fatalf("viewers = %d %s", w.Code, w.Body)
+	}
+
+	if w := do("DELETE", "/api/v1/streams/api-live", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("anonymous kick = %d", w.Code)
+	}
+	if registry.get("api-live") != sess {
+		t.Fatal("anonymous kick ended the stream")
+	}
+	if w := do("DELETE", "/api/v1/streams/api-live", "alice"); w.Code != http.StatusNoContent {
+		t.Fatalf("kick = %d %s", w.Code, w.Body)
+	}
+	select {
+	case <-sess.done:
+	default:
+		t.Fatal("kicked session not closed")
+	}
+	if registry.get("api-live") != nil {
+		t.Fatal("kicked session still owns its key")
+	}
+	if log, _ := ioutil.ReadFile(audit.path); !strings.Contains(string(log), `"kick"`) {
+		t.Fatalf("kick not audited: %s", log)
+	}
+	if w := do("DELETE", "/api/v1/streams/api-live", "alice"); w.Code != http.StatusNotFound {
+		t.Fatalf("second kick = %d", w.Code)
+	}
+}
@@ -0,0 +1,186 @@
+package streamserver
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/metrics"
+)
+
+var pipelineFailures = metrics.NewCounter("hls_pipeline_failures_total",
+	"HLS pipelines that failed while live, by reason: error or eos", "reason")
+
+// states of the output of a session, see pipelineStatus
+const (
+	pipelineRunning = "running"
+	// pipelineRestarting: the pipeline failed and waits to be restarted
+	pipelineRestarting = "restarting"
+	// pipelineFailed: the pipeline failed too often in a row, ending the
+	// publish
+	pipelineFailed = "failed"
+	// pipelineStopped: the publisher stopped sending video
+	pipelineStopped = "stopped"
+)
+
+var (
+	// pipelineStableAfter is how long a pipeline must run to reset the
+	// backoff of its restarts
+	pipelineStableAfter = 30 * time.Second
+	// pipelineMinBackoff and pipelineMaxBackoff bound the delay before a
+	// restart
+	pipelineMinBackoff = time.Second
+	pipelineMaxBackoff = 30 * time.Second
+)
+
+// pipelineStatus is the state of the output of a session, guarded by the
+// session lock
+type pipelineStatus struct {
+	State string    `json:"state"`
+	Since time.Time `json:"since"`
+	// Restarts counts the restarts of the publish
+	Restarts  int    `json:"restarts"`
+	LastError string `json:"lastError,omitempty"`
+	// failures are the failures in a row, for the backoff
+	failures int
+}
+
+func (p *pipelineStatus) set(state string, now time.Time) {
+	if p.State != state {
+		p.State, p.Since = state, now
+	}
+}
+
+// failed records a failure for reason and returns how long to wait before
+// restarting, false once the failures in a row exceed attempts
+func (p *pipelineStatus) failed(reason string, attempts int, now time.Time) (time.Duration, bool) {
+	if p.State == pipelineRunning && now.Sub(p.Since) >= pipelineStableAfter {
+		p.failures = 0
+	}
+	p.failures++
+	p.LastError = reason
+	if p.failures > attempts {
+		p.set(pipelineFailed, now)
+		return 0, false
+	}
+	p.set(pipelineRestarting, now)
+	return pipelineBackoff(p.failures), true
+}
+
+// pipelineBackoff is the delay before the restart after failures in a row,
+// doubling from pipelineMinBackoff up to pipelineMaxBackoff
+func pipelineBackoff(failures int) time.Duration {
+	delay := pipelineMinBackoff
+	for i := 1; i < failures && delay < pipelineMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > pipelineMaxBackoff {
+		delay = pipelineMaxBackoff
+	}
+	return delay
+}
+
+// pipelineAttempts is how many restarts in a row the output of key gets
+// before the publish is ended, pipeline_restarts / pipeline_restarts_overrides
+// (5); 0 ends the publish at the first failure
+func pipelineAttempts(key string) int {
+	if attempts, err := strconv.Atoi(envForKey("pipeline_restarts", key)); err == nil && attempts >= 0 {
+		return attempts
+	}
+	return 5
+}
+
+// superviseOutput watches hls until it is released. When it fails while
+// still the output of the session, it is released and a new pipeline,
+// a new output generation, is started after a backoff; the publisher is
+// asked for a keyframe so the new segments start right away. A pipeline
+// failing too often in a row ends the publish.
+func (s *session) superviseOutput(hls *hlsOutput) {
+	select {
+	case <-hls.failed:
+	case <-hls.released:
+		return
+	}
+	reason := hls.failure
+	s.Lock()
+	owned := s.hls == hls && !s.closed
+	if owned {
+		s.detachLocked()
+	}
+	audio := s.audio
+	s.Unlock()
+	if !owned {
+		// whoever detached it releases it
+		return
+	}
+	pipelineFailures.Inc(reason)
+	hls.Release()
+	s.timeline.add(eventPipeline, "failed: "+reason)
+	for {
+		s.Lock()
+		delay, restart := s.supervisor.failed(reason, pipelineAttempts(s.key), time.Now())
+		failures := s.supervisor.failures
+		s.Unlock()
+		s.notify(hookPipelineError, map[string]interface{}{
+			"session": s.id, "reason": reason, "failures": failures, "restarting": restart,
+		})
+		if !restart {
+			s.warn(warning{
+				code:    client.WarningPipelineFailed,
+				text:    fmt.Sprintf("output pipeline failed %d times in a row, ending the publish", failures),
+				details: map[string]interface{}{"reason": reason, "failures": failures},
+			})
+			s.endWith(client.ClosePipelineFailed, "output pipeline failed")
+			return
+		}
+		s.warn(warning{
+			code:    client.WarningPipelineRestarting,
+			text:    fmt.Sprintf("output pipeline failed (%s), restarting in %v", reason, delay),
+			details: map[string]interface{}{"reason": reason, "failures": failures, "delayMs": milliseconds(delay)},
+		})
+		select {
+		case <-s.done:
+			return
+		case <-time.After(delay):
+		}
+		err := s.restartPipeline(audio)
+		switch err {
+		case nil:
+			s.timeline.add(eventPipeline, fmt.Sprintf("restarted after %d failures", failures))
+			return
+		case errStreamReplaced, errNotLive:
+			return
+		}
+		reason = err.Error()
+	}
+}
+
+// restartPipeline starts the output over after a failure, unless the
+// session ended or stopped its output meanwhile
+func (s *session) restartPipeline(audio bool) error {
+	s.Lock()
+	state := s.supervisor.State
+	s.Unlock()
+	if state != pipelineRestarting {
+		return errNotLive
+	}
+	if err := s.startPipeline(audio); err != nil {
+		return err
+	}
+	s.Lock()
+	s.supervisor.Restarts++
+	refresher := s.refresher
+	s.Unlock()
+	if refresher != nil {
+		refresher.request(keyframeRestart)
+	}
+	return nil
+}
+
+// pipelineState is the state of the output, for the API
+func (s *session) pipelineState() pipelineStatus {
+	s.Lock()
+	defer s.Unlock()
+	return s.supervisor
+}
@@ -0,0 +1,96 @@
+package streamserver
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+)
+
+func TestPipelineBackoff(t *testing.T) {
+	now := time.Unix(1000, 0)
+	var p pipelineStatus
+	p.set(pipelineRunning, now)
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		delay, ok := p.failed(failureError, 3, now)
+		if !ok || delay != want || p.State != pipelineRestarting {
+			t.Fatalf("failure %d: %v %v %s", i+1, delay, ok, p.State)
+		}
+	}
+	if _, ok := p.failed(failureError, 3, now); ok || p.State != pipelineFailed {
+		t.Fatalf("restarted past the attempts: %s", p.State)
+	}
+	p.set(pipelineRunning, now)
+	if delay, ok := p.failed(failureEOS, 3, now.Add(pipelineStableAfter)); !ok || delay != time.Second || p.LastError != failureEOS {
+		t.Fatalf("a stable pipeline does not start the backoff over: %v %v", delay, ok)
+	}
+	if d := pipelineBackoff(20); d != pipelineMaxBackoff {
+		t.Fatalf("backoff = %v", d)
+	}
+}
+
+func waitPipeline(t *testing.T, sess *session, state string) pipelineStatus {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p := sess.pipelineState()
+		if p.State == state {
+			return p
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pipeline %+v, want %s", p, state)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSuperviseOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "supervisor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	saved, backoff := hlsDir, pipelineMinBackoff
+	defer func() { hlsDir, pipelineMinBackoff = saved, backoff }()
+	hlsDir, pipelineMinBackoff = dir, time.Millisecond
+	t.Setenv("pipeline_restarts", "1")
+
+	sess := newSession("supervised", nil, presets[client.LatencyBalanced])
+	if _, err := registry.claim(sess, conflictReject); err != nil {
+		t.Fatal(err)
+	}
+	defer registry.release(sess)
+	if err := sess.startPipeline(false); err != nil {
+		t.Fatal(err)
+	}
+	sess.Lock()
+	first := sess.hls
+	sess.Unlock()
+	first.fail(failureError)
+	<-first.released
+
+	waitPipeline(t, sess, pipelineRunning)
+	sess.Lock()
+	second := sess.hls
+	sess.Unlock()
+	if second == nil || second == first {
+		t.Fatal("no new pipeline after the failure")
+	}
+	if p := sess.pipelineState(); p.Restarts != 1 || p.LastError != failureError {
+		t.Fatalf("pipeline %+v", p)
+	}
+
+	second.fail(failureEOS)
+	select {
+	case <-sess.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the publish outlived a pipeline failing twice in a row")
+	}
+	if p := sess.pipelineState(); p.State != pipelineFailed || p.LastError != failureEOS {
+		t.Fatalf("pipeline %+v", p)
+	}
+	if registry.get("supervised") != nil {
+		t.Fatal("the stream key is still held")
+	}
+}
@@ -0,0 +1,363 @@
+package streamserver
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/bundle"
+)
+
+// sessionLogSize and sdpHistorySize bound what a session keeps for its
+// support bundle
+var (
+	sessionLogSize = 200
+	sdpHistorySize = 16
+)
+
+var (
+	// credentials and fingerprints are dropped, addresses masked
+	sdpSecrets   = regexp.MustCompile(`(?m)^(a=(?:ice-ufrag|ice-pwd|fingerprint|crypto|key-mgmt):)[^\r\n]*`)
+	sdpAddresses = regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b|\b[0-9a-fA-F]{1,4}(?::[0-9a-fA-F]{0,4}){2,7}\b`)
+)
+
+// redactSDP removes what a support bundle must not leak from an SDP:
+// ICE credentials, DTLS fingerprints and the publisher's addresses
+func redactSDP(text string) string {
+	text = sdpSecrets.ReplaceAllString(text, "${1}<redacted>")
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, "a=candidate:") || strings.HasPrefix(line, "c=") || strings.HasPrefix(line, "o=") || strings.HasPrefix(line, "a=rtcp:") {
+			lines[i] = sdpAddresses.ReplaceAllString(line, "<redacted>")
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// segmentInfo is one entry of the per-segment manifest
+type segmentInfo struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// segmentManifest lists the segments of generation still in dir
+func segmentManifest(dir string, generation int64) []segmentInfo {
+	segments := []segmentInfo{}
+	if generation == 0 {
+		return segments
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return segments
+	}
+	prefix := segmentPrefix(generation)
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), prefix) && segmentFile(f.Name()) {
+			segments = append(segments, segmentInfo{Name: f.Name(), Size: f.Size(), Modified: f.ModTime()})
+		}
+	}
+	return segments
+}
+
+// sessionRecord is what a support bundle is built from, taken from a live
+// session or kept after it ended
+type sessionRecord struct {
+	ID         string     `json:"id"`
+	Stream     string     `json:"stream"`
+	ExternalID string     `json:"externalId,omitempty"`
+	Preset     string     `json:"preset"`
+	Profile    string     `json:"profile"`
+	Created    time.Time  `json:"created"`
+	Ended      *time.Time `json:"ended,omitempty"`
+	Generation int64      `json:"generation,omitempty"`
+	timeline   []timelineEntry
+	logs       []timelineEntry
+	sdps       []timelineEntry
+	stats      gin.H
+	pipeline   string
+	playlist   []byte
+	segments   []segmentInfo
+}
+
+// record takes the support record of s; ended is zero while it is live
+func (s *session) record(ended time.Time) *sessionRecord {
+	s.Lock()
+	generation, pipeline, final := s.generation, s.pipeline, s.final
+	s.Unlock()
+	r := &sessionRecord{
+		ID:         s.id,
+		Stream:     s.key,
+		ExternalID: s.externalID,
+		Preset:     s.preset.Name,
+		Profile:    s.profile.Name,
+		Created:    s.created,
+		Generation: generation,
+		timeline:   s.timeline.entries(),
+		logs:       s.logs.entries(),
+		sdps:       s.sdps.entries(),
+		stats:      sessionStats(s),
+		pipeline:   pipeline,
+		playlist:   final,
+		segments:   segmentManifest(outputDir(s.key), generation),
+	}
+	if !ended.IsZero() {
+		r.Ended = &ended
+	}
+	if r.playlist == nil && generation != 0 {
+		// the live playlist, if it is this session's
+		if data, err := ioutil.ReadFile(filepath.Join(outputDir(s.key), playlistName)); err == nil && bytes.Contains(data, []byte(segmentPrefix(generation))) {
+			r.playlist = data
+		}
+	}
+	return r
+}
+
+// sessionRecords keeps the records of ended sessions for
+// session_retention_minutes (60)
+type sessionRecords struct {
+	sync.Mutex
+	records []*sessionRecord
+}
+
+var retained = &sessionRecords{}
+
+func sessionRetention() time.Duration {
+	return time.Duration(envInt("session_retention_minutes", 60)) * time.Minute
+}
+
+func (h *sessionRecords) put(r *sessionRecord) {
+	h.Lock()
+	defer h.Unlock()
+	h.prune(time.Now())
+	h.records = append(h.records, r)
+}
+
+// prune drops the records past retention; called with the lock held
+func (h *sessionRecords) prune(now time.Time) {
+	keep := h.records[:0]
+	for _, r := range h.records {
+		if now.Sub(*r.Ended) < sessionRetention() {
+			keep = append(keep, r)
+		}
+	}
+	h.records = keep
+}
+
+// find returns the latest retained record known by id as stream key,
+// external id or session id
+func (h *sessionRecords) find(id string) *sessionRecord {
+	h.Lock()
+	defer h.Unlock()
+	h.prune(time.Now())
+	for i := len(h.records) - 1; i >= 0; i-- {
+		r := h.records[i]
+		if r.Stream == id || r.ExternalID == id || r.ID == id {
+			return r
+		}
+	}
+	return nil
+}
+
+// support bundle states
+const (
+	bundlePending = "pending"
+	bundleReady   = "ready"
+	bundleFailed  = "failed"
+)
+
+// supportBundle is one requested bundle; its id is the secret of the
+// download link
+type supportBundle struct {
+	ID      string    `json:"id"`
+	Stream  string    `json:"stream"`
+	Session string    `json:"session"`
+	Status  string    `json:"status"`
+	Error   string    `json:"error,omitempty"`
+	Size    int       `json:"size,omitempty"`
+	Skipped []string  `json:"skipped,omitempty"`
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+	data    []byte
+}
+
+// bundleStore holds requested bundles until their link expires, after
+// support_bundle_ttl_minutes (15), when they are dropped whether or not
+// anyone asks for them again
+type bundleStore struct {
+	sync.Mutex
+	bundles map[string]*supportBundle
+}
+
+var supportBundles = &bundleStore{bundles: map[string]*supportBundle{}}
+
+func newBundleID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// start returns the pending bundle of the session, or starts building a
+// new one from record in the background
+func (b *bundleStore) start(record func() *sessionRecord, stream, session string) (supportBundle, error) {
+	b.Lock()
+	defer b.Unlock()
+	b.prune(time.Now())
+	for _, existing := range b.bundles {
+		if existing.Session == session && existing.Status == bundlePending {
+			return *existing, nil
+		}
+	}
+	id, err := newBundleID()
+	if err != nil {
+		return supportBundle{}, err
+	}
+	ttl := time.Duration(envInt("support_bundle_ttl_minutes", 15)) * time.Minute
+	sb := &supportBundle{
+		ID:      id,
+		Stream:  stream,
+		Session: session,
+		Status:  bundlePending,
+		URL:     "/api/support-bundles/" + id,
+		Expires: time.Now().Add(ttl),
+	}
+	b.bundles[id] = sb
+	time.AfterFunc(ttl, func() { b.expire(id) })
+	go func() {
+		data, skipped, err := buildSupportBundle(record(), int64(envInt("support_bundle_max_mb", 16))<<20)
+		b.Lock()
+		defer b.Unlock()
+		sb.Skipped = skipped
+		if err != nil {
+			sb.Status, sb.Error = bundleFailed, err.Error()
+			return
+		}
+		sb.Status, sb.data, sb.Size = bundleReady, data, len(data)
+	}()
+	return *sb, nil
+}
+
+// prune drops expired bundles; called with the lock held
+func (b *bundleStore) prune(now time.Time) {
+	for id, sb := range b.bundles {
+		if !now.Before(sb.Expires) {
+			delete(b.bundles, id)
+		}
+	}
+}
+
+// expire drops bundle id, its link expired
+func (b *bundleStore) expire(id string) {
+	b.Lock()
+	defer b.Unlock()
+	delete(b.bundles, id)
+}
+
+func (b *bundleStore) get(id string) (supportBundle, bool) {
+	b.Lock()
+	defer b.Unlock()
+	b.prune(time.Now())
+	sb, ok := b.bundles[id]
+	if !ok {
+		return supportBundle{}, false
+	}
+	return *sb, true
+}
+
+// buildSupportBundle assembles the zip of a record, at most limit bytes of
+// content
+func buildSupportBundle(r *sessionRecord, limit int64) ([]byte, []string, error) {
+	w := bundle.New(limit, time.Now())
+	w.AddJSON("session.json", r)
+	for i, entry := range r.sdps {
+		w.Add(fmt.Sprintf("sdp/%02d-%s.sdp", i, entry.Kind), []byte(entry.Detail))
+	}
+	w.AddJSON("timeline.json", r.timeline)
+	var logs bytes.Buffer
+	for _, entry := range r.logs {
+		fmt.Fprintf(&logs, "%s %s\n", entry.Time.UTC().Format(time.RFC3339Nano), entry.Detail)
+	}
+	w.Add("logs.txt", logs.Bytes())
+	w.AddJSON("stats.json", r.stats)
+	// the launch line stands in for a graph dump: gstreamer-go gives no
+	// access to the pipeline to dump, and the dumps GStreamer writes to
+	// GST_DEBUG_DUMP_DOT_DIR are not told apart by session
+	if r.pipeline != "" {
+		w.Add("pipeline/launch.txt", []byte(r.pipeline+"\n"))
+	}
+	if r.playlist != nil {
+		w.Add("playlists/"+playlistName, r.playlist)
+	}
+	w.AddJSON("segments.json", r.segments)
+	data, err := w.Close()
+	return data, w.Skipped(), err
+}
+
+// requestSupportBundle handles GET /api/streams/:id/support-bundle for a
+// live session or one retained after it ended, by any of its ids. The
+// bundle is built in the background; the reply links to its download.
+func requestSupportBundle(c *gin.Context) {
+	admin, ok := adminIdentity(c)
+	if !ok {
+		return
+	}
+	id := c.Param("id")
+	var record func() *sessionRecord
+	var stream, session string
+	if sess := registry.find(id); sess != nil {
+		record = func() *sessionRecord { return sess.record(time.Time{}) }
+		stream, session = sess.key, sess.id
+	} else if r := retained.find(id); r != nil {
+		record = func() *sessionRecord { return r }
+		stream, session = r.Stream, r.ID
+	} else {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	// bundles hold publisher data, so they are audited like other admin actions
+	if err := audit.record(auditEntry{Time: time.Now(), Admin: admin, Action: "support-bundle", Stream: stream, Reason: session}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	sb, err := supportBundles.start(record, stream, session)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusAccepted, sb)
+}
+
+// downloadSupportBundle handles GET /api/support-bundles/:bundle, the zip
+// once ready and its status until then
+func downloadSupportBundle(c *gin.Context) {
+	if _, ok := adminIdentity(c); !ok {
+		return
+	}
+	sb, ok := supportBundles.get(c.Param("bundle"))
+	if !ok {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	switch sb.Status {
+	case bundlePending:
+		c.Header("Retry-After", "1")
+		c.JSON(http.StatusAccepted, sb)
+	case bundleFailed:
+		c.JSON(http.StatusInternalServerError, sb)
+	default:
+		c.Header("Cache-Control", "no-store")
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"support-%s.zip\"", sb.Session))
+		c.Data(http.StatusOK, "application/zip", sb.data)
+	}
+}
@@ -0,0 +1,155 @@
+package streamserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+)
+
+func TestRedactSDP(t *testing.T) {
+	offer := string(mustRead(t, "testdata/chrome_offer.sdp"))
+	offer += "a=candidate:1 1 udp 2122260223 192.168.1.20 56143 typ host\r\n"
+	redacted := redactSDP(offer)
+	for _, secret := range []string{"OzEke1rU0bD4A9HwyCoc8KxM", "4A:AD:B9:B1", "192.168.1.20"} {
+		if strings.Contains(redacted, secret) {
+			t.Fatalf("%s not redacted", secret)
+		}
+	}
+	if !strings.Contains(redacted, "a=ice-pwd:<redacted>\r\n") || !strings.Contains(redacted, "m=video") {
+		t.Fatalf("redacted sdp:\n%s", redacted)
+	}
+}
+
+func TestSupportBundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "support")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	audit = &auditLog{path: filepath.Join(dir, "audit.log")}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/api/streams/:id/:detail", streamDetail)
+	r.GET("/api/support-bundles/:bundle", downloadSupportBundle)
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", path, nil)
+		asAdmin(req, "oncall")
+		r.ServeHTTP(w, req)
+		return w
+	}
+	// download waits for the bundle and returns its files
+	download := func(url string) map[string]string {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			w := get(url)
+			if w.Code == http.StatusOK {
+				data := w.Body.Bytes()
+				zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				files := map[string]string{}
+				for _, f := range zr.File {
+					rc, _ := f.Open()
+					content, _ := ioutil.ReadAll(rc)
+					rc.Close()
+					files[f.Name] = string(content)
+				}
+				return files
+			}
+			if w.Code != http.StatusAccepted || time.Now().After(deadline) {
+				t.Fatalf("download = %d %s", w.Code, w.Body)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	sess := newSession("support", nil, presets[client.LatencyBalanced])
+	if _, err := registry.claim(sess, conflictReject); err != nil {
+		t.Fatal(err)
+	}
+	sess.sdps.add(client.CmdOffer, redactSDP("v=0\r\na=ice-pwd:secret\r\n"))
+	sess.logf("hello from the session")
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/streams/support/support-bundle", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("without admin = %d", w.Code)
+	}
+
+	w = get("/api/streams/support/support-bundle")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("request = %d %s", w.Code, w.Body)
+	}
+	var sb supportBundle
+	if err := json.Unmarshal(w.Body.Bytes(), &sb); err != nil {
+		t.Fatal(err)
+	}
+	if sb.Session != sess.id || !strings.HasPrefix(sb.URL, "/api/support-bundles/") {
+		t.Fatalf("bundle = %+v", sb)
+	}
+	files := download(sb.URL)
+	for _, name := range []string{"session.json", "sdp/00-offer.sdp", "timeline.json", "logs.txt", "stats.json", "segments.json", "MANIFEST"} {
+		if _, ok := files[name]; !ok {
+			t.Fatalf("bundle misses %s: %v", name, files["MANIFEST"])
+		}
+	}
+	if strings.Contains(files["sdp/00-offer.sdp"], "secret") || !strings.Contains(files["logs.txt"], "hello from the session") {
+		t.Fatalf("bundle content: %v", files)
+	}
+
+	// ended sessions stay available by session id for the retention
+	registry.release(sess)
+	sess.close(0, "")
+	w = get("/api/streams/" + sess.id + "/support-bundle")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("ended request = %d", w.Code)
+	}
+	json.Unmarshal(w.Body.Bytes(), &sb)
+	if files := download(sb.URL); !strings.Contains(files["session.json"], `"ended"`) {
+		t.Fatalf("ended session.json = %s", files["session.json"])
+	}
+
+	if w := get("/api/support-bundles/unknown"); w.Code != http.StatusNotFound {
+		t.Fatalf("unknown bundle = %d", w.Code)
+	}
+	if w := get("/api/streams/nobody/support-bundle"); w.Code != http.StatusNotFound {
+		t.Fatalf("unknown stream = %d", w.Code)
+	}
+}
+
+func TestSupportBundleExpiry(t *testing.T) {
+	t.Setenv("support_bundle_ttl_minutes", "0")
+	b := &bundleStore{bundles: map[string]*supportBundle{}}
+	record := func() *sessionRecord { return &sessionRecord{ID: "expiring-session", Stream: "expiring"} }
+	if _, err := b.start(record, "expiring", "expiring-session"); err != nil {
+		t.Fatal(err)
+	}
+	// dropped without anyone asking for a bundle again
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b.Lock()
+		left := len(b.bundles)
+		b.Unlock()
+		if left == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expired bundle kept")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,119 @@
+package streamserver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image/jpeg"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/hlscheck"
+)
+
+// thumbnailJobs is the job class taking the thumbnails of live streams
+const thumbnailJobs = "thumbnail"
+
+// thumbnailName is the file the thumbnail of a live stream is written to,
+// in its output directory
+const thumbnailName = "thumbnail.jpg"
+
+// thumbnailInterval is how often a thumbnail of key is taken,
+// thumbnail_interval / thumbnail_interval_overrides seconds; 0, the
+// default, takes none
+func thumbnailInterval(key string) time.Duration {
+	seconds, err := strconv.Atoi(envForKey("thumbnail_interval", key))
+	if err != nil {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// takeThumbnail queues a thumbnail of the output when the last one is
+// older than the interval of the key; called as segments are written
+func (s *session) takeThumbnail(now time.Time) {
+	interval := thumbnailInterval(s.key)
+	if interval <= 0 {
+		return
+	}
+	s.Lock()
+	due := now.Sub(s.thumbnailQueued) >= interval
+	if due {
+		s.thumbnailQueued = now
+	}
+	s.Unlock()
+	if !due {
+		return
+	}
+	dir, width, height := outputDir(s.key), envInt("thumbnail_width", 320), envInt("thumbnail_height", 180)
+	// a full queue is counted and logged by observeJob
+	background.Submit(thumbnailJobs, s.key, func(ctx context.Context) error {
+		if err := writeThumbnail(dir, width, height); err != nil {
+			return err
+		}
+		s.Lock()
+		s.thumbnailAt = time.Now()
+		s.Unlock()
+		return nil
+	})
+}
+
+// writeThumbnail decodes the start of the newest segment the playlist in
+// dir lists, complete unlike the one hlssink is writing, into the
+// thumbnail of dir
+func writeThumbnail(dir string, width, height int) error {
+	data, err := ioutil.ReadFile(filepath.Join(dir, playlistName))
+	if err != nil {
+		return err
+	}
+	media, err := hlscheck.ParseMedia(data)
+	if err != nil {
+		return err
+	}
+	if len(media.Segments) == 0 {
+		return errors.New("thumbnail: no segment yet")
+	}
+	newest := media.Segments[len(media.Segments)-1]
+	frame, err := playlistExtractor(dir, media).Extract(filepath.Join(dir, filepath.FromSlash(newest.URI)), width, height)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, frame, &jpeg.Options{Quality: 80}); err != nil {
+		return err
+	}
+	// players polling the thumbnail never read half of it
+	tmp := filepath.Join(dir, thumbnailName+".tmp")
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, thumbnailName))
+}
+
+// thumbnailTime is when the last thumbnail of the session was written,
+// zero before the first one
+func (s *session) thumbnailTime() time.Time {
+	s.Lock()
+	defer s.Unlock()
+	return s.thumbnailAt
+}
+
+// getStreamThumbnail handles GET /api/v1/streams/:id/thumbnail, the latest
+// JPEG taken of a live stream
+func getStreamThumbnail(c *gin.Context) {
+	sess := liveSession(c)
+	if sess == nil {
+		return
+	}
+	if sess.thumbnailTime().IsZero() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no thumbnail yet"})
+		return
+	}
+	c.Header("Cache-Control", "no-cache")
+	c.File(filepath.Join(outputDir(sess.key), thumbnailName))
+}
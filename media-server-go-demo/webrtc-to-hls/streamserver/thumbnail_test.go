@@ -0,0 +1,89 @@
+package streamserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+)
+
+func TestTakeThumbnail(t *testing.T) {
+	t.Setenv("thumbnail_interval_overrides", "thumb-live=10")
+	if thumbnailInterval("other") != 0 || thumbnailInterval("thumb-live") != 10*time.Second {
+		t.Fatal("interval not read from the overrides")
+	}
+	background = newJobQueue()
+	defer background.Close()
+
+	sess := newSession("thumb-live", nil, presets[client.LatencyBalanced])
+	start := time.Now()
+	for _, at := range []time.Duration{0, 5 * time.Second, 10 * time.Second, 15 * time.Second} {
+		sess.takeThumbnail(start.Add(at))
+	}
+	if !sess.thumbnailQueued.Equal(start.Add(10 * time.Second)) {
+		t.Fatalf("last queued at %v", sess.thumbnailQueued.Sub(start))
+	}
+	other := newSession("other", nil, presets[client.LatencyBalanced])
+	other.takeThumbnail(start)
+	if !other.thumbnailQueued.IsZero() {
+		t.Fatal("thumbnail queued with thumbnails off")
+	}
+}
+
+func TestWriteThumbnailNoSegment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thumbnail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, playlistName), []byte("#EXTM3U\n#EXT-X-TARGETDURATION:2\n"), 0644)
+	if err := writeThumbnail(dir, 320, 180); err == nil {
+		t.Fatal("thumbnail of an empty playlist")
+	}
+	if _, err := os.Stat(filepath.Join(dir, thumbnailName)); !os.IsNotExist(err) {
+		t.Fatal("thumbnail written")
+	}
+}
+
+func TestStreamThumbnailAPI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thumbnail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	saved := hlsDir
+	defer func() { hlsDir = saved }()
+	hlsDir = dir
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/api/v1/streams/:id/thumbnail", getStreamThumbnail)
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+	if w := get("/api/v1/streams/thumb-api/thumbnail"); w.Code != http.StatusNotFound {
+		t.Fatalf("not live = %d", w.Code)
+	}
+	sess := newSession("thumb-api", nil, presets[client.LatencyBalanced])
+	if _, err := registry.claim(sess, conflictReject); err != nil {
+		t.Fatal(err)
+	}
+	defer registry.release(sess)
+	if w := get("/api/v1/streams/thumb-api/thumbnail"); w.Code != http.StatusNotFound {
+		t.Fatalf("before the first thumbnail = %d", w.Code)
+	}
+	os.MkdirAll(outputDir("thumb-api"), 0755)
+	ioutil.WriteFile(filepath.Join(outputDir("thumb-api"), thumbnailName), []byte("\xff\xd8jpeg"), 0644)
+	sess.thumbnailAt = time.Now()
+	if w := get("/api/v1/streams/thumb-api/thumbnail"); w.Code != http.StatusOK || w.Body.String() != "\xff\xd8jpeg" || w.Header().Get("Content-Type") != "image/jpeg" {
+		t.Fatalf("thumbnail = %d %q %s", w.Code, w.Body, w.Header().Get("Content-Type"))
+	}
+}
@@ -0,0 +1,129 @@
+package streamserver
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+)
+
+// kinds of timeline entries
+const (
+	eventSignaling = "signaling"
+	eventState     = "state"
+	eventPipeline  = "pipeline"
+	eventMedia     = "media"
+	eventWarning   = "warning"
+	eventSession   = "session"
+)
+
+// timelineSize bounds the entries kept per session, oldest dropped first
+var timelineSize = 256
+
+type timelineEntry struct {
+	Seq    uint64    `json:"seq"`
+	Time   time.Time `json:"time"`
+	Kind   string    `json:"kind"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// timeline is the ordered record of what happened to one session. Writers
+// claim a slot with an atomic increment and store the entry atomically, so
+// adding an entry never blocks on other writers or readers.
+type timeline struct {
+	next  uint64
+	slots []atomic.Value
+}
+
+func newTimeline(size int) *timeline {
+	return &timeline{slots: make([]atomic.Value, size)}
+}
+
+func (t *timeline) add(kind, detail string) {
+	seq := atomic.AddUint64(&t.next, 1) - 1
+	t.slots[seq%uint64(len(t.slots))].Store(&timelineEntry{
+		Seq:    seq,
+		Time:   time.Now(),
+		Kind:   kind,
+		Detail: detail,
+	})
+}
+
+// entries returns the retained entries in order
+func (t *timeline) entries() []timelineEntry {
+	entries := make([]timelineEntry, 0, len(t.slots))
+	for i := range t.slots {
+		if entry, ok := t.slots[i].Load().(*timelineEntry); ok {
+			entries = append(entries, *entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Seq < entries[j].Seq })
+	return entries
+}
+
+// last returns up to n of the latest entries
+func (t *timeline) last(n int) []timelineEntry {
+	entries := t.entries()
+	if len(entries) > n {
+		entries = entries[len(entries)-n:]
+	}
+	return entries
+}
+
+// timelineHistory keeps the timeline of the last ended session of each
+// stream key, so post-mortems can read it after the publisher is gone
+type timelineHistory struct {
+	sync.Mutex
+	ended map[string]*timeline
+}
+
+var timelines = &timelineHistory{ended: map[string]*timeline{}}
+
+func (h *timelineHistory) put(key string, t *timeline) {
+	h.Lock()
+	defer h.Unlock()
+	h.ended[key] = t
+}
+
+func (h *timelineHistory) get(key string) *timeline {
+	h.Lock()
+	defer h.Unlock()
+	return h.ended[key]
+}
+
+// send writes msg to the publisher and records its type on the timeline.
+// WHIP publishers have no signaling connection to write to.
+func (s *session) send(msg client.Message) error {
+	if s.conn == nil {
+		return errNoSignaling
+	}
+	s.timeline.add(eventSignaling, "out "+msg.Cmd)
+	return s.conn.send(msg)
+}
+
+// streamTimeline handles GET /api/streams/:id/timeline, the live session's
+// timeline, by any of its ids, or the one of the last session of a stream
+// key that ended
+func streamTimeline(c *gin.Context) {
+	key := c.Param("id")
+	var t *timeline
+	live := false
+	if sess := registry.find(key); sess != nil {
+		t, live, key = sess.timeline, true, sess.key
+	} else {
+		t = timelines.get(key)
+	}
+	if t == nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"stream":  key,
+		"live":    live,
+		"entries": t.entries(),
+	})
+}
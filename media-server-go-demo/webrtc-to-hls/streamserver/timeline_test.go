@@ -0,0 +1,48 @@
+package streamserver
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestTimelineBounded(t *testing.T) {
+	tl := newTimeline(4)
+	for i := 0; i < 10; i++ {
+		tl.add(eventSession, fmt.Sprint(i))
+	}
+	entries := tl.entries()
+	if len(entries) != 4 {
+		t.Fatalf("%d entries kept", len(entries))
+	}
+	for i, entry := range entries {
+		if entry.Detail != fmt.Sprint(6+i) {
+			t.Fatalf("entries %+v", entries)
+		}
+	}
+	if last := tl.last(2); len(last) != 2 || last[1].Detail != "9" {
+		t.Fatalf("last %+v", last)
+	}
+}
+
+func TestTimelineConcurrent(t *testing.T) {
+	tl := newTimeline(64)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				tl.add(eventMedia, "frame")
+				if i%100 == 0 {
+					tl.entries()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	entries := tl.entries()
+	if len(entries) != 64 || entries[63].Seq != 7999 {
+		t.Fatalf("%d entries, last seq %d", len(entries), entries[len(entries)-1].Seq)
+	}
+}
@@ -0,0 +1,175 @@
+package streamserver
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// opusRate is the RTP clock rate of Opus
+const opusRate = 48000
+
+// driftWindow is how often a media clock measures the drift of the RTP
+// timestamps of its track, from the least delayed frame of the window
+const driftWindow = 10 * time.Second
+
+// driftSlew bounds how fast a media clock corrects the drift: by a
+// driftSlew-th of the media time between two frames, 10ms a second, which
+// neither the eye nor the ear notices
+const driftSlew = 100
+
+// frameTime is the RTP timestamp of a frame. The frames of ingests without
+// RTP, e.g. RTMP, and those the server makes up, e.g. of the fallback
+// slate, have none: the zero frameTime.
+type frameTime struct {
+	rtp uint32
+	ok  bool
+}
+
+// rtpTime is the frameTime of a frame of a mediaserver track
+func rtpTime(timestamp uint) frameTime {
+	return frameTime{rtp: uint32(timestamp), ok: true}
+}
+
+// rtpTimestamps decides whether the output of key times its frames from
+// their RTP timestamps, from rtp_timestamps / rtp_timestamps_overrides
+// ("on"), rather than appsrc timestamping them as they are pushed, which
+// drifts from the RTP clock of the publisher over hours of a broadcast
+func rtpTimestamps(key string) bool {
+	return strings.TrimSpace(envForKey("rtp_timestamps", key)) != "off"
+}
+
+// mediaClock turns the RTP timestamps of a track into the PTS of its
+// frames, in the running time of the pipeline they are pushed into. The
+// first frame is timed on arrival, the next ones by their timestamps,
+// unwrapped; the drift between the RTP clock of the publisher and the
+// server clock is measured and corrected by slewing, so that the audio and
+// the video, each timed by its own clock, stay in sync. A frame without
+// timestamp is timed on arrival, the clock starting over on the next.
+type mediaClock struct {
+	rate    int64
+	started bool
+	last    uint32
+	// rtp is the timestamp of the last frame since the first, unwrapped
+	rtp int64
+	// anchor is the PTS of the first frame
+	anchor time.Duration
+	// window is when the current window started, and least the least
+	// delay of its frames; baseline is that of the first window
+	window   time.Duration
+	least    time.Duration
+	baseline time.Duration
+	measured bool
+	// drift is how far the RTP clock fell behind the server clock since
+	// the first frame, as last measured, and correction how much of it
+	// the PTS make up for so far
+	drift      time.Duration
+	correction time.Duration
+	// pts is that of the last frame, which the next one never precedes
+	pts time.Duration
+}
+
+// next is the PTS of the frame of at arrived at arrival, in the running
+// time of the pipeline
+func (c *mediaClock) next(at frameTime, arrival time.Duration) time.Duration {
+	if !at.ok {
+		c.started = false
+		return c.advance(arrival)
+	}
+	step := int64(int32(at.rtp - c.last))
+	if jump := captureJump / captureRate * c.rate; !c.started || step > jump || step < -jump {
+		// the first frame, or of another RTP clock, e.g. after a slate
+		*c = mediaClock{rate: c.rate, started: true, last: at.rtp, anchor: arrival, window: arrival, pts: c.pts}
+		return c.advance(arrival)
+	}
+	c.rtp += step
+	c.last = at.rtp
+	media := c.anchor + rtpDuration(c.rtp, c.rate)
+	delay := arrival - media
+	if delay < c.least {
+		c.least = delay
+	}
+	if arrival-c.window >= driftWindow {
+		if c.measured {
+			c.drift = c.least - c.baseline
+		} else {
+			c.baseline, c.measured = c.least, true
+		}
+		c.window, c.least = arrival, delay
+	}
+	if step > 0 {
+		slew := rtpDuration(step, c.rate) / driftSlew
+		switch diff := c.drift - c.correction; {
+		case diff > slew:
+			c.correction += slew
+		case diff < -slew:
+			c.correction -= slew
+		default:
+			c.correction = c.drift
+		}
+	}
+	return c.advance(media + c.correction)
+}
+
+// advance keeps the PTS from going back
+func (c *mediaClock) advance(pts time.Duration) time.Duration {
+	if pts < c.pts {
+		pts = c.pts
+	}
+	c.pts = pts
+	return pts
+}
+
+// rtpDuration is the duration of ticks of an RTP clock of rate, without
+// overflowing over days of a broadcast
+func rtpDuration(ticks, rate int64) time.Duration {
+	return time.Duration(ticks/rate)*time.Second + time.Duration(ticks%rate)*time.Second/time.Duration(rate)
+}
+
+// outputTiming times the frames pushed into an output pipeline, the video
+// and the audio by their own media clocks, from when the pipeline started
+type outputTiming struct {
+	sync.Mutex
+	start time.Time
+	video mediaClock
+	audio mediaClock
+}
+
+func newOutputTiming(start time.Time) *outputTiming {
+	return &outputTiming{start: start, video: mediaClock{rate: captureRate}, audio: mediaClock{rate: opusRate}}
+}
+
+// pts is the PTS of a frame of at arriving now
+func (t *outputTiming) pts(at frameTime, audio bool) time.Duration {
+	t.Lock()
+	defer t.Unlock()
+	arrival := time.Since(t.start)
+	if audio {
+		return t.audio.next(at, arrival)
+	}
+	return t.video.next(at, arrival)
+}
+
+// TimestampStats is the drift the media clocks of an output measured, for
+// the stats API
+type TimestampStats struct {
+	// VideoDriftMs and AudioDriftMs are how far the RTP clock of each track
+	// fell behind the server clock, negative when it ran ahead
+	VideoDriftMs float64 `json:"videoDriftMs"`
+	AudioDriftMs float64 `json:"audioDriftMs"`
+	// VideoCorrectionMs and AudioCorrectionMs are how much of it the PTS
+	// make up for so far
+	VideoCorrectionMs float64 `json:"videoCorrectionMs"`
+	AudioCorrectionMs float64 `json:"audioCorrectionMs"`
+}
+
+func (t *outputTiming) stats() TimestampStats {
+	t.Lock()
+	defer t.Unlock()
+	return TimestampStats{
+		VideoDriftMs:      milliseconds(t.video.drift),
+		AudioDriftMs:      milliseconds(t.audio.drift),
+		VideoCorrectionMs: milliseconds(t.video.correction),
+		AudioCorrectionMs: milliseconds(t.audio.correction),
+	}
+}
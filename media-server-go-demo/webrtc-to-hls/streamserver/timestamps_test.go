@@ -0,0 +1,53 @@
+package streamserver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMediaClockWraps(t *testing.T) {
+	c := mediaClock{rate: captureRate}
+	start := uint32(1<<32 - 3000)
+	if pts := c.next(rtpTime(uint(start)), 5*time.Second); pts != 5*time.Second {
+		t.Fatalf("first frame at %v", pts)
+	}
+	// 3000 ticks later the timestamp wraps; the PTS goes on
+	if pts := c.next(rtpTime(uint(start+6000)), 5*time.Second+60*time.Millisecond); pts != 5*time.Second+6000*time.Second/captureRate {
+		t.Fatalf("frame past the wrap at %v", pts)
+	}
+	// a frame arriving late is still timed by its timestamp
+	if pts := c.next(rtpTime(uint(start+9000)), 6*time.Second); pts != 5*time.Second+100*time.Millisecond {
+		t.Fatalf("late frame at %v", pts)
+	}
+	// a jump of the timestamps starts the clock over, on arrival
+	if pts := c.next(rtpTime(uint(start+9000+20*captureRate)), 7*time.Second); pts != 7*time.Second {
+		t.Fatalf("frame after a jump at %v", pts)
+	}
+	// frames without timestamp are timed on arrival, never going back
+	if pts := c.next(frameTime{}, 6*time.Second); pts != 7*time.Second {
+		t.Fatalf("untimed frame at %v", pts)
+	}
+}
+
+func TestMediaClockDrift(t *testing.T) {
+	// the publisher's clock runs 0.5% slow: frames of 900 ticks arrive
+	// 10ms apart, their RTP timestamps 895.5 ticks apart
+	c := mediaClock{rate: captureRate}
+	var pts, arrival time.Duration
+	for i := 0; i < 3000; i++ {
+		arrival = time.Duration(i) * 10 * time.Millisecond
+		pts = c.next(rtpTime(uint(i*1791/2)), arrival)
+	}
+	// measured at the end of the second window, from the least delayed
+	// frame of the window, its first
+	if c.drift < 49*time.Millisecond || c.drift > 51*time.Millisecond {
+		t.Fatalf("drift %v", c.drift)
+	}
+	// slewed by 1% of the media time, it caught up with the measure
+	if c.correction != c.drift {
+		t.Fatalf("correction %v of a drift of %v", c.correction, c.drift)
+	}
+	if lag := arrival - pts; lag < 50*time.Millisecond || lag > 150*time.Millisecond {
+		t.Fatalf("frame arrived at %v timed %v", arrival, pts)
+	}
+}
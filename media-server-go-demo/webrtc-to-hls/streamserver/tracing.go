@@ -0,0 +1,128 @@
+package streamserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/tracing"
+)
+
+// tracer traces the setup of publishes, from their offer to their first
+// segment; nil, tracing nothing, without otlp_endpoint
+var tracer *tracing.Tracer
+
+// setupTracing exports spans to the OpenTelemetry collector at
+// otlp_endpoint, its OTLP/HTTP base url, e.g. http://collector:4318, every
+// otlp_flush_interval (5) seconds, with the key=value headers of
+// otlp_headers, e.g. the credentials of a hosted collector
+func setupTracing() error {
+	endpoint := os.Getenv("otlp_endpoint")
+	if endpoint == "" {
+		return nil
+	}
+	base, err := url.Parse(endpoint)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return fmt.Errorf("otlp_endpoint: %q is not an http(s) url", endpoint)
+	}
+	headers := map[string]string{}
+	for _, header := range envList("otlp_headers") {
+		kv := strings.SplitN(header, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return fmt.Errorf("otlp_headers: %q is not key=value", header)
+		}
+		headers[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	interval := time.Duration(envInt("otlp_flush_interval", 5)) * time.Second
+	if interval <= 0 {
+		return fmt.Errorf("otlp_flush_interval: must be positive")
+	}
+	tracer = tracing.New(&tracing.OTLP{
+		URL:     strings.TrimRight(endpoint, "/") + "/v1/traces",
+		Service: "webrtc-to-hls",
+		Headers: headers,
+		Client:  &http.Client{Timeout: interval},
+	})
+	go tracer.Run(interval, nil, func(err error) {
+		logger.Warn("spans not exported", "error", err, "dropped", tracer.Dropped())
+	})
+	logger.Info("exporting traces", "endpoint", endpoint)
+	return nil
+}
+
+// startTrace opens the span of the publish of s, whose offer was received
+// at received, in the trace of the request header carries, if any. parse,
+// when known, is how long parsing the offer took. The span ends with the
+// first segment of the publish, its length the time to first segment, or
+// with the session.
+func (s *session) startTrace(header http.Header, received time.Time, parse time.Duration) {
+	_, span := tracer.StartAt(tracing.Extract(context.Background(), header), "publish", received)
+	if span == nil {
+		return
+	}
+	span.SetAttribute("stream", s.key)
+	span.SetAttribute("session", s.id)
+	span.SetAttribute("ingest", ingestProtocol(s))
+	if parse > 0 {
+		span.Record("sdp.parse", received, parse)
+	}
+	s.Lock()
+	s.trace, s.traceMark = span, time.Now()
+	s.Unlock()
+}
+
+// traceContext is under the span of the publish of s, for the requests
+// made on its behalf to carry its trace
+func (s *session) traceContext() context.Context {
+	s.Lock()
+	defer s.Unlock()
+	return tracing.ContextWith(context.Background(), s.trace)
+}
+
+// traceStep records the wait for what step names, since the step before,
+// in the span of the publish of s, while open
+func (s *session) traceStep(name string) {
+	s.Lock()
+	span, mark := s.trace, s.traceMark
+	now := time.Now()
+	s.traceMark = now
+	s.Unlock()
+	if !span.Ended() {
+		span.Record(name, mark, now.Sub(mark))
+		span.AddEvent(name)
+	}
+}
+
+// traceFirstSegment ends the span of the publish of s with its first
+// segment written
+func (s *session) traceFirstSegment() {
+	s.traceStep("first segment")
+	s.Lock()
+	span := s.trace
+	s.Unlock()
+	if span != nil && !span.Ended() {
+		now := time.Now()
+		span.SetAttribute("time_to_first_segment_ms", milliseconds(now.Sub(span.StartTime())))
+		span.EndAt(now)
+	}
+}
+
+// endTrace ends the span of the publish of s, closing with reason before
+// its first segment, if still open
+func (s *session) endTrace(reason string) {
+	s.Lock()
+	span := s.trace
+	s.Unlock()
+	if span == nil || span.Ended() {
+		return
+	}
+	if reason == "" {
+		reason = "closed"
+	}
+	span.Fail(fmt.Errorf("ended before the first segment: %s", reason))
+	span.End()
+}
@@ -0,0 +1,98 @@
+package streamserver
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/tracing"
+)
+
+type spanRecorder struct {
+	spans []*tracing.Span
+}
+
+func (r *spanRecorder) Export(ctx context.Context, spans []*tracing.Span) error {
+	r.spans = append(r.spans, spans...)
+	return nil
+}
+
+func (r *spanRecorder) names() []string {
+	var names []string
+	for _, span := range r.spans {
+		names = append(names, span.Name())
+	}
+	return names
+}
+
+func TestSetupTracing(t *testing.T) {
+	defer func() { tracer = nil }()
+	if err := setupTracing(); err != nil || tracer != nil {
+		t.Fatalf("traced without otlp_endpoint: %v", err)
+	}
+	t.Setenv("otlp_endpoint", "collector:4318")
+	if err := setupTracing(); err == nil {
+		t.Fatal("endpoint without a scheme accepted")
+	}
+	t.Setenv("otlp_endpoint", "http://collector:4318")
+	t.Setenv("otlp_headers", "authorization")
+	if err := setupTracing(); err == nil {
+		t.Fatal("header without a value accepted")
+	}
+	t.Setenv("otlp_headers", "authorization=Bearer t, x-tenant=a")
+	if err := setupTracing(); err != nil || tracer == nil {
+		t.Fatalf("setup: %v", err)
+	}
+}
+
+func TestPublishTrace(t *testing.T) {
+	recorder := &spanRecorder{}
+	tracer = tracing.New(recorder)
+	defer func() { tracer = nil }()
+
+	sess := newSession("publish-trace", nil, presets[client.LatencyBalanced])
+	header := http.Header{}
+	header.Set(tracing.Header, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	sess.startTrace(header, time.Now().Add(-time.Second), 5*time.Millisecond)
+	_, create := tracer.Start(sess.traceContext(), "transport.create")
+	create.End()
+	sess.traceStep("negotiated")
+	sess.traceStep("first frame")
+	sess.traceFirstSegment()
+	// later generations write first segments of their own
+	sess.traceFirstSegment()
+	sess.close(0, "")
+	tracer.Flush(context.Background())
+
+	want := []string{"sdp.parse", "transport.create", "negotiated", "first frame", "first segment", "publish"}
+	got := recorder.names()
+	if len(got) != len(want) {
+		t.Fatalf("spans %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("spans %v, want %v", got, want)
+		}
+	}
+	root := recorder.spans[len(recorder.spans)-1]
+	if root.Context().TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatal("publish not in the trace of its offer")
+	}
+	for _, span := range recorder.spans[:len(recorder.spans)-1] {
+		if span.Context().TraceID != root.Context().TraceID {
+			t.Fatalf("%s not in the trace of the publish", span.Name())
+		}
+	}
+
+	// a publish ending before its first segment still has its span
+	recorder.spans = nil
+	sess = newSession("publish-trace", nil, presets[client.LatencyBalanced])
+	sess.startTrace(nil, time.Now(), 0)
+	sess.close(client.CloseIdle, "no media")
+	tracer.Flush(context.Background())
+	if got := recorder.names(); len(got) != 1 || got[0] != "publish" {
+		t.Fatalf("spans %v", got)
+	}
+}
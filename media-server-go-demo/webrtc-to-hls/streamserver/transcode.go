@@ -0,0 +1,273 @@
+package streamserver
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/hlscheck"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/pipeline"
+	"github.com/notedit/sdp"
+)
+
+// the video codecs publishers can send
+const (
+	codecH264 = "h264"
+	codecVP8  = "vp8"
+	codecVP9  = "vp9"
+	codecAV1  = "av1"
+	codecH265 = "h265"
+)
+
+// transcodeFormats decode the video codecs other than H.264 publishers may
+// send. transcodeEncoder then encodes H.264 with videoEncoder at
+// transcode_kbps / transcode_kbps_overrides (2500), instead of parsing the
+// published H.264, see videoInput. The rate is fixed so the keyframe
+// interval can follow the preset; the profile is what browsers publish
+// H.264 with.
+var transcodeFormats = map[string]string{
+	codecVP8:  "caps=video/x-vp8 ! vp8dec",
+	codecVP9:  "caps=video/x-vp9 ! vp9dec",
+	codecAV1:  av1Caps + " ! av1parse ! dav1ddec",
+	codecH265: h265Caps + " ! h265parse ! avdec_h265",
+}
+
+// av1Caps are the temporal units of OBUs the AV1 depacketizer delivers
+const av1Caps = "caps=video/x-av1,stream-format=obu-stream,alignment=tu"
+
+// h265Caps are the Annex B access units the H.265 depacketizer delivers
+const h265Caps = "caps=video/x-h265,stream-format=byte-stream,alignment=au"
+
+const transcodeEncoder = " ! videoconvert ! videorate ! video/x-raw,framerate=%d/1 ! %s ! h264parse"
+
+// setupTranscode accepts the codecs of transcode_codecs ("vp8,vp9,av1,h265")
+// next to H.264, none by default. Safari publishes H.265 when offered it.
+func setupTranscode() error {
+	codecs, err := parseTranscodeCodecs(os.Getenv("transcode_codecs"))
+	if err != nil {
+		return err
+	}
+	// answered after H.264, see pickVideoCodec
+	Capabilities["video"].Codecs = append([]string{codecH264}, codecs...)
+	return nil
+}
+
+func parseTranscodeCodecs(value string) ([]string, error) {
+	var codecs []string
+	for _, codec := range strings.Split(value, ",") {
+		codec = strings.ToLower(strings.TrimSpace(codec))
+		if codec == "" {
+			continue
+		}
+		if _, ok := transcodeFormats[codec]; !ok {
+			return nil, fmt.Errorf("transcode_codecs: cannot transcode %q, only %s, %s, %s and %s", codec, codecVP8, codecVP9, codecAV1, codecH265)
+		}
+		codecs = append(codecs, codec)
+	}
+	return codecs, nil
+}
+
+// pickVideoCodec keeps a single video codec in answer, so the publisher
+// cannot switch to one the pipeline was not built for, and returns it.
+// H.264 wins unless codec_preference ranks another codec first: a browser
+// offering VP8 first must not be transcoded for nothing.
+func pickVideoCodec(answer *sdp.SDPInfo) string {
+	media := answer.GetMedia("video")
+	if media == nil {
+		return codecH264
+	}
+	rules := append(append([]codecRule(nil), preferredCodecs()...), codecRule{codec: codecH264})
+	chosen := ""
+	for _, codec := range rankedCodecs(media, rules) {
+		if name := strings.ToLower(codec.GetCodec()); name == codecH264 || transcodeFormats[name] != "" {
+			chosen = name
+			break
+		}
+	}
+	if chosen == "" {
+		return codecH264
+	}
+	kept := map[int]*sdp.CodecInfo{}
+	for pt, codec := range media.GetCodecs() {
+		if strings.ToLower(codec.GetCodec()) == chosen {
+			kept[pt] = codec
+		}
+	}
+	media.SetCodecs(kept)
+	return chosen
+}
+
+// videoInput is what follows the video appsrc of a pipeline fed frames in
+// input, for an output in codec: the H.264 parsed, the AV1 or H.265 passed
+// through parsed, or other codecs transcoded to H.264 at the keyframe
+// interval of p
+func videoInput(codec, input string, p client.Preset, key string) string {
+	if decode, ok := transcodeFormats[input]; ok && codec != input {
+		return decode + transcodeEncoding(p, key)
+	}
+	if codec == codecAV1 {
+		return av1Caps + " ! av1parse"
+	}
+	if codec == codecH265 {
+		return h265Caps + " ! h265parse"
+	}
+	return "! h264parse"
+}
+
+// transcodeEncoding is transcodeEncoder at the keyframe interval of p and
+// the bitrate of key
+func transcodeEncoding(p client.Preset, key string) string {
+	keyframes := p.KeyframeInterval * ladderRate / 1000
+	if keyframes < 1 {
+		keyframes = 1
+	}
+	kbps, err := strconv.Atoi(envForKey("transcode_kbps", key))
+	if err != nil || kbps <= 0 {
+		kbps = 2500
+	}
+	enc := pipeline.H264{Encoder: videoEncoder, Bitrate: kbps, KeyframeInterval: keyframes, Profile: "constrained-baseline"}
+	return fmt.Sprintf(transcodeEncoder, ladderRate, enc)
+}
+
+// resolveAV1Passthrough reads whether the AV1 a publisher of key may send
+// is packaged as published instead of transcoded, from av1_passthrough /
+// av1_passthrough_overrides (on or off, the default). Only fMP4 segments
+// carry AV1.
+func resolveAV1Passthrough(container string, key string) (bool, error) {
+	on, err := resolvePassthrough(codecAV1, key)
+	if on && container != containerFMP4 {
+		return false, fmt.Errorf("av1 passthrough: %s outputs cannot carry av1, only %s", container, containerFMP4)
+	}
+	return on, err
+}
+
+// resolveH265Passthrough reads whether the H.265 a publisher of key may
+// send is packaged as published, from h265_passthrough /
+// h265_passthrough_overrides (on or off, the default). Only fMP4 segments
+// carry H.265: TS outputs, which players without HEVC support rely on,
+// transcode it to H.264 whatever the setting.
+func resolveH265Passthrough(container string, key string) (bool, error) {
+	on, err := resolvePassthrough(codecH265, key)
+	return on && container == containerFMP4, err
+}
+
+// resolvePassthrough reads <codec>_passthrough / <codec>_passthrough_overrides
+// for key, on or off
+func resolvePassthrough(codec string, key string) (bool, error) {
+	name := codec + "_passthrough"
+	switch value := envForKey(name, key); value {
+	case "", "off":
+		return false, nil
+	case "on":
+		return true, nil
+	default:
+		return false, fmt.Errorf("%s must be on or off, not %q", name, value)
+	}
+}
+
+// outputCodec is the video codec of the output, with the session locked:
+// the published one when H.264 or passed through AV1 or H.265, else H.264,
+// as composites are
+func (s *session) outputCodec() string {
+	if s.videoCodec == codecAV1 && s.av1Passthrough && s.composite == nil {
+		return codecAV1
+	}
+	if s.videoCodec == codecH265 && s.h265Passthrough && s.composite == nil {
+		return codecH265
+	}
+	return codecH264
+}
+
+// inputCodec is the video codec of the frames pushed into the output, with
+// the session locked: H.264 for composites, else the published one
+func (s *session) inputCodec() string {
+	if s.composite != nil {
+		return codecH264
+	}
+	return s.videoCodec
+}
+
+// videoKeyframe reports whether frame, as published, starts a GOP
+func (s *session) videoKeyframe(frame []byte) bool {
+	s.Lock()
+	defer s.Unlock()
+	return videoKeyframe(s.videoCodec, frame)
+}
+
+// videoKeyframe reports whether frame of codec starts a GOP
+func videoKeyframe(codec string, frame []byte) bool {
+	switch codec {
+	case codecVP8:
+		// RFC 6386 9.1: the inverse keyframe bit of the frame tag
+		return len(frame) > 0 && frame[0]&0x01 == 0
+	case codecVP9:
+		return isVP9Keyframe(frame)
+	case codecAV1:
+		return isAV1Keyframe(frame)
+	case codecH265:
+		return isH265Keyframe(frame)
+	}
+	return isH264Keyframe(frame)
+}
+
+// isH265Keyframe reports whether an Annex B H.265 access unit carries an
+// IRAP picture, NAL unit types 16 to 23 (H.265 7.4.2.2)
+func isH265Keyframe(frame []byte) bool {
+	for _, nal := range splitAnnexB(frame) {
+		if len(nal) < 2 {
+			continue
+		}
+		if t := nal[0] >> 1 & 0x3f; t >= 16 && t <= 23 {
+			return true
+		}
+	}
+	return false
+}
+
+// isVP9Keyframe reads the frame type of the uncompressed header of a VP9
+// frame (VP9 bitstream specification 6.2)
+func isVP9Keyframe(frame []byte) bool {
+	if len(frame) == 0 || frame[0]>>6 != 2 {
+		// no frame marker
+		return false
+	}
+	bit := 2
+	next := func() int {
+		b := int(frame[bit/8]>>(7-uint(bit%8))) & 1
+		bit++
+		return b
+	}
+	profile := next() | next()<<1
+	if profile == 3 {
+		// reserved zero
+		next()
+	}
+	if next() == 1 {
+		// show_existing_frame
+		return false
+	}
+	return next() == 0
+}
+
+// isAV1Keyframe reads the frame type of the first frame header of an AV1
+// temporal unit (AV1 bitstream specification 5.9.2)
+func isAV1Keyframe(frame []byte) bool {
+	obus, err := hlscheck.ParseOBUs(frame)
+	if err != nil {
+		return false
+	}
+	for _, obu := range obus {
+		switch obu.Type {
+		case hlscheck.OBUSequenceHeader:
+			if seq, err := hlscheck.ParseSequenceHeader(obu.Payload); err == nil && seq.ReducedStillPicture {
+				return true
+			}
+		case hlscheck.OBUFrameHeader, hlscheck.OBUFrame:
+			// show_existing_frame unset, frame_type KEY_FRAME
+			return len(obu.Payload) > 0 && obu.Payload[0]&0xe0 == 0
+		}
+	}
+	return false
+}
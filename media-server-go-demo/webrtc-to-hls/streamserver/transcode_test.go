@@ -0,0 +1,161 @@
+package streamserver
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+)
+
+func TestPickVideoCodec(t *testing.T) {
+	saved, preference := Capabilities["video"].Codecs, codecPreference
+	defer func() { Capabilities["video"].Codecs, codecPreference = saved, preference }()
+	t.Setenv("transcode_codecs", "vp8")
+	if err := setupTranscode(); err != nil {
+		t.Fatal(err)
+	}
+
+	// chrome offers VP8 first, H.264 is answered anyway
+	_, answer := answerFixture(t, "chrome_offer.sdp")
+	if codec := pickVideoCodec(answer); codec != codecH264 {
+		t.Fatalf("picked %s", codec)
+	}
+	for _, c := range answer.GetMedia("video").GetCodecs() {
+		if !strings.EqualFold(c.GetCodec(), codecH264) {
+			t.Fatalf("%s answered next to h264", c.GetCodec())
+		}
+	}
+
+	codecPreference, _ = parseCodecPreference("vp8")
+	_, answer = answerFixture(t, "chrome_offer.sdp")
+	if codec := pickVideoCodec(answer); codec != codecVP8 || len(answer.GetMedia("video").GetCodecs()) != 1 {
+		t.Fatalf("picked %s of %d codecs", codec, len(answer.GetMedia("video").GetCodecs()))
+	}
+
+	t.Setenv("transcode_codecs", "h265")
+	if err := setupTranscode(); err == nil {
+		t.Fatal("h265 accepted")
+	}
+}
+
+func TestTranscodeInput(t *testing.T) {
+	t.Setenv("transcode_kbps_overrides", "mobile=800")
+	preset := presets[client.LatencyBalanced]
+	sess := newSession("mobile", nil, preset)
+	pipeline := sess.outputPipeline("hls/main", 4, false, false).String()
+	if !strings.Contains(pipeline, "name=appsrc ! h264parse ! tee name=video ") {
+		t.Fatalf("h264 pipeline = %s", pipeline)
+	}
+	sess.videoCodec = codecVP8
+	vp8 := sess.outputPipeline("hls/main", 4, false, false).String()
+	want := "name=appsrc caps=video/x-vp8 ! vp8dec ! videoconvert ! videorate ! video/x-raw,framerate=30/1 ! x264enc tune=zerolatency speed-preset=veryfast bitrate=800 key-int-max=60 ! video/x-h264,profile=constrained-baseline ! h264parse ! tee name=video "
+	if !strings.Contains(vp8, want) || !strings.HasSuffix(vp8, strings.SplitN(pipeline, "h264parse", 2)[1]) {
+		t.Fatalf("vp8 pipeline = %s", vp8)
+	}
+	if vp9 := videoInput(codecH264, codecVP9, preset, "main"); !strings.Contains(vp9, "vp9dec") || !strings.Contains(vp9, "bitrate=2500 ") {
+		t.Fatalf("vp9 input = %s", vp9)
+	}
+	if av1 := videoInput(codecH264, codecAV1, preset, "main"); !strings.Contains(av1, "alignment=tu ! av1parse ! dav1ddec ! videoconvert") {
+		t.Fatalf("av1 pipeline = %s", av1)
+	}
+}
+
+func TestAV1Passthrough(t *testing.T) {
+	t.Setenv("av1_passthrough_overrides", "cmaf=on,bad=yes")
+	if on, err := resolveAV1Passthrough(containerFMP4, "main"); err != nil || on {
+		t.Fatalf("default passthrough = %v, %v", on, err)
+	}
+	if on, err := resolveAV1Passthrough(containerFMP4, "cmaf"); err != nil || !on {
+		t.Fatalf("passthrough = %v, %v", on, err)
+	}
+	if _, err := resolveAV1Passthrough(containerTS, "cmaf"); err == nil {
+		t.Fatal("av1 passed through to ts")
+	}
+	if _, err := resolveAV1Passthrough(containerFMP4, "bad"); err == nil {
+		t.Fatal("bad value accepted")
+	}
+
+	sess := newSession("av1-live", nil, presets[client.LatencyBalanced])
+	sess.videoCodec = codecAV1
+	if sess.outputCodec() != codecH264 {
+		t.Fatal("av1 output without passthrough")
+	}
+	sess.av1Passthrough = true
+	if sess.outputCodec() != codecAV1 {
+		t.Fatal("av1 transcoded with passthrough")
+	}
+	sess.container = containerFMP4
+	pipeline := sess.outputPipeline("hls/av1-live", 4, false, false).String()
+	if !strings.Contains(pipeline, "name=appsrc caps=video/x-av1,stream-format=obu-stream,alignment=tu ! av1parse ! tee name=video ! queue ! hlscmafsink ") {
+		t.Fatalf("passthrough pipeline = %s", pipeline)
+	}
+}
+
+func TestH265Passthrough(t *testing.T) {
+	t.Setenv("h265_passthrough_overrides", "cmaf=on,bad=yes")
+	if on, err := resolveH265Passthrough(containerFMP4, "main"); err != nil || on {
+		t.Fatalf("default passthrough = %v, %v", on, err)
+	}
+	if on, err := resolveH265Passthrough(containerFMP4, "cmaf"); err != nil || !on {
+		t.Fatalf("passthrough = %v, %v", on, err)
+	}
+	if on, err := resolveH265Passthrough(containerTS, "cmaf"); err != nil || on {
+		t.Fatalf("ts passthrough = %v, %v, want transcoded", on, err)
+	}
+	if _, err := resolveH265Passthrough(containerFMP4, "bad"); err == nil {
+		t.Fatal("bad value accepted")
+	}
+
+	preset := presets[client.LatencyBalanced]
+	if h265 := videoInput(codecH264, codecH265, preset, "main"); !strings.Contains(h265, "alignment=au ! h265parse ! avdec_h265 ! videoconvert") {
+		t.Fatalf("h265 transcode = %s", h265)
+	}
+	sess := newSession("hevc-live", nil, preset)
+	sess.videoCodec = codecH265
+	if sess.outputCodec() != codecH264 {
+		t.Fatal("h265 output without passthrough")
+	}
+	sess.h265Passthrough = true
+	if sess.outputCodec() != codecH265 {
+		t.Fatal("h265 transcoded with passthrough")
+	}
+	sess.container = containerFMP4
+	pipeline := sess.outputPipeline("hls/hevc-live", 4, false, false).String()
+	if !strings.Contains(pipeline, "name=appsrc caps=video/x-h265,stream-format=byte-stream,alignment=au ! h265parse ! tee name=video ! queue ! hlscmafsink ") {
+		t.Fatalf("passthrough pipeline = %s", pipeline)
+	}
+}
+
+func TestVideoKeyframe(t *testing.T) {
+	for _, c := range []struct {
+		codec string
+		frame []byte
+		want  bool
+	}{
+		{codecVP8, []byte{0x50, 0x42, 0x00, 0x9d, 0x01, 0x2a}, true},
+		{codecVP8, []byte{0x31, 0x0b, 0x00}, false},
+		// profile 0, shown key frame
+		{codecVP9, []byte{0x82, 0x49, 0x83, 0x42}, true},
+		// profile 0, inter frame
+		{codecVP9, []byte{0x86, 0x00}, false},
+		// profile 3 skips the reserved bit
+		{codecVP9, []byte{0xb0, 0x00}, true},
+		{codecVP9, []byte{0x00}, false},
+		{codecH264, []byte{0, 0, 0, 1, 0x65, 0x88}, true},
+		// temporal delimiter, then a key frame without size field
+		{codecAV1, []byte{0x12, 0x00, 0x30, 0x10}, true},
+		// inter frame with size field
+		{codecAV1, []byte{0x32, 0x01, 0x20}, false},
+		// shown existing frame
+		{codecAV1, []byte{0x32, 0x01, 0x80}, false},
+		{codecAV1, []byte{0x12, 0x00}, false},
+		// VPS, SPS, PPS, then an IDR_W_RADL slice
+		{codecH265, []byte{0, 0, 0, 1, 0x40, 0x01, 0x0c, 0, 0, 0, 1, 0x42, 0x01, 0x01, 0, 0, 0, 1, 0x44, 0x01, 0xc1, 0, 0, 0, 1, 0x26, 0x01, 0xaf}, true},
+		// TRAIL_R slice
+		{codecH265, []byte{0, 0, 0, 1, 0x02, 0x01, 0xd0}, false},
+	} {
+		if got := videoKeyframe(c.codec, c.frame); got != c.want {
+			t.Errorf("%s % x = %v", c.codec, c.frame, got)
+		}
+	}
+}
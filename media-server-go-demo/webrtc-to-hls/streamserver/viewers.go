@@ -0,0 +1,145 @@
+package streamserver
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/audience"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/metrics"
+)
+
+var viewerCountries = metrics.NewCounter("viewers_total",
+	"Distinct viewers per flush interval, by country", "country")
+
+// viewers is nil unless audience=on
+var viewers *audience.Tracker
+
+// audienceTotals are the rollups of the flushed intervals, per stream key
+var audienceTotals = struct {
+	sync.Mutex
+	streams map[string]*audience.Rollup
+}{streams: map[string]*audience.Rollup{}}
+
+// audienceEntry is one line of audience_log
+type audienceEntry struct {
+	Time   time.Time        `json:"time"`
+	Stream string           `json:"stream"`
+	Rollup *audience.Rollup `json:"rollup"`
+}
+
+type unresolved struct{}
+
+func (unresolved) Resolve(net.IP) (audience.Location, error) {
+	return audience.Location{}, nil
+}
+
+// geo locates viewer addresses once opened by geoResolver
+var geo audience.Resolver
+
+// geoResolver opens the MaxMind databases geoip_country_db / geoip_asn_db,
+// cached for geoip_cache_size networks; without them nothing resolves
+func geoResolver() (audience.Resolver, error) {
+	if geo != nil {
+		return geo, nil
+	}
+	var resolver audience.Resolver = unresolved{}
+	if country, asn := os.Getenv("geoip_country_db"), os.Getenv("geoip_asn_db"); country != "" || asn != "" {
+		maxmind, err := audience.OpenMaxMind(country, asn)
+		if err != nil {
+			return nil, err
+		}
+		resolver = maxmind
+	}
+	geo = audience.NewCached(resolver, envInt("geoip_cache_size", 65536))
+	return geo, nil
+}
+
+// setupAudience starts the viewer rollup when audience=on. Addresses are
+// resolved with geoResolver, and every audience_flush_interval seconds the
+// interval is appended to audience_log and merged into the totals.
+// audience_metrics=on also counts viewers by country in metrics.
+func setupAudience() error {
+	if os.Getenv("audience") != "on" {
+		return nil
+	}
+	resolver, err := geoResolver()
+	if err != nil {
+		return err
+	}
+	viewers = audience.NewTracker(resolver, 4096)
+	if os.Getenv("audience_metrics") == "on" {
+		viewers.OnViewer = func(location audience.Location) {
+			country := location.Country
+			if country == "" {
+				country = audience.Unknown
+			}
+			viewerCountries.Inc(country)
+		}
+	}
+	go viewers.Run(make(chan struct{}))
+	go flushAudience(time.Duration(envInt("audience_flush_interval", 60))*time.Second, os.Getenv("audience_log"))
+	return nil
+}
+
+// countViewers records the viewer of each playlist request; playlists are
+// polled by every player, segments would only add load
+func countViewers(c *gin.Context) {
+	if viewers != nil && path.Ext(c.Request.URL.Path) == ".m3u8" {
+		viewers.Observe(playbackKeys(c.Request.URL.Path), net.ParseIP(c.ClientIP()), c.GetHeader("User-Agent"))
+	}
+	c.Next()
+}
+
+func flushAudience(interval time.Duration, logPath string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		rollups := viewers.Flush()
+		audienceTotals.Lock()
+		for stream, rollup := range rollups {
+			total := audienceTotals.streams[stream]
+			if total == nil {
+				audienceTotals.streams[stream] = rollup.Clone()
+			} else {
+				total.Merge(rollup)
+			}
+		}
+		audienceTotals.Unlock()
+		if logPath == "" {
+			continue
+		}
+		if err := appendAudience(logPath, now, rollups); err != nil {
+			logger.Warn("audience log failed", "error", err)
+		}
+	}
+}
+
+func appendAudience(logPath string, now time.Time, rollups map[string]*audience.Rollup) error {
+	file, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	for stream, rollup := range rollups {
+		if err := encoder.Encode(audienceEntry{Time: now, Stream: stream, Rollup: rollup}); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	return file.Close()
+}
+
+// audienceFor returns the flushed rollup of a stream key, or nil
+func audienceFor(key string) *audience.Rollup {
+	audienceTotals.Lock()
+	defer audienceTotals.Unlock()
+	if total := audienceTotals.streams[key]; total != nil {
+		return total.Clone()
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+package streamserver
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/hlscheck"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/ident"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/storyboard"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/vod"
+)
+
+// catalog holds the VOD assets ended streams left, created in main
+var catalog *vod.Catalog
+
+// setupVOD opens the catalog of vod_dir (vod)
+func setupVOD() error {
+	dir := os.Getenv("vod_dir")
+	if dir == "" {
+		dir = "vod"
+	}
+	var err error
+	catalog, err = vod.Open(dir)
+	return err
+}
+
+// vodEnabled reports whether the publishes of key are kept as VOD assets
+// once they end, vod / vod_overrides set to on
+func vodEnabled(key string) bool {
+	switch envForKey("vod", key) {
+	case "on", "true", "1":
+		return true
+	}
+	return false
+}
+
+// vodPath is where players fetch the playlist of the asset id
+func vodPath(id string) string {
+	return "/vod/" + id + "/" + playlistName
+}
+
+// linkFile links src to dst, copying it across filesystems
+func linkFile(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// archiveVOD keeps the ended output of the session as a VOD asset: the
+// ENDLIST playlist it left and the segments it lists, linked out of the
+// output before they are removed. The asset holds what the playlist
+// listed, its whole DVR window.
+func (s *session) archiveVOD() {
+	if catalog == nil || !vodEnabled(s.key) {
+		return
+	}
+	s.Lock()
+	final := s.final
+	s.Unlock()
+	media, err := hlscheck.ParseMedia(final)
+	if err != nil || !media.Ended || len(media.Segments) == 0 {
+		return
+	}
+	asset, err := s.writeVOD(final, media)
+	if err != nil {
+		s.logf("vod: %v", err)
+		return
+	}
+	s.timeline.add(eventSession, "vod "+asset.ID)
+	s.logf("ended as vod %s, %d segments", asset.ID, asset.Segments)
+	scheduleStoryboardIn(s.key, "vod/"+asset.ID, catalog.Dir(asset.ID), "/vod/"+asset.ID+"/")
+}
+
+// writeVOD writes the asset of the playlist final, registering it once
+// complete
+func (s *session) writeVOD(final []byte, media *hlscheck.Media) (vod.Asset, error) {
+	id, err := vod.NewID()
+	if err != nil {
+		return vod.Asset{}, err
+	}
+	dir := catalog.Dir(id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return vod.Asset{}, err
+	}
+	asset := vod.Asset{ID: id, Stream: s.key, Session: s.id, Created: time.Now(), Segments: len(media.Segments)}
+	names := []string{}
+	if media.Map != "" {
+		names = append(names, media.Map)
+	}
+	for _, segment := range media.Segments {
+		names = append(names, segment.URI)
+		asset.Duration += segment.Duration
+	}
+	for _, name := range names {
+		src, err := ident.Join(outputDir(s.key), name)
+		if err == nil {
+			var dst string
+			if dst, err = ident.Join(dir, name); err == nil {
+				err = linkFile(src, dst)
+			}
+		}
+		if err != nil {
+			os.RemoveAll(dir)
+			return vod.Asset{}, err
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, playlistName), withPlaylistType(final, "VOD"), 0644); err != nil {
+		os.RemoveAll(dir)
+		return vod.Asset{}, err
+	}
+	if err := catalog.Add(asset); err != nil {
+		os.RemoveAll(dir)
+		return vod.Asset{}, err
+	}
+	return asset, nil
+}
+
+// assetJSON is an asset as listed, with where to play it and, once built,
+// its storyboard
+func assetJSON(a vod.Asset) gin.H {
+	asset := gin.H{
+		"id":       a.ID,
+		"stream":   a.Stream,
+		"session":  a.Session,
+		"created":  a.Created,
+		"duration": a.Duration,
+		"segments": a.Segments,
+		"playlist": vodPath(a.ID),
+	}
+	if _, err := os.Stat(filepath.Join(catalog.Dir(a.ID), storyboard.DefaultOptions.VTTName())); err == nil {
+		asset["storyboard"] = "/vod/" + a.ID + "/" + storyboard.DefaultOptions.VTTName()
+	}
+	return asset
+}
+
+// vodAsset returns the asset of the :id parameter, answering 400 or 404
+// when there is none
+func vodAsset(c *gin.Context) (vod.Asset, bool) {
+	id, ok := identParam(c, "id", ident.FileName)
+	if !ok {
+		return vod.Asset{}, false
+	}
+	var asset vod.Asset
+	found := false
+	if catalog != nil {
+		asset, found = catalog.Get(id)
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": vod.ErrNotFound.Error()})
+	}
+	return asset, found
+}
+
+// serveVOD handles GET /vod/:id/*file, the playlist and segments of an
+// asset, which never change
+func serveVOD(c *gin.Context) {
+	asset, ok := vodAsset(c)
+	if !ok {
+		return
+	}
+	path, err := ident.Join(catalog.Dir(asset.ID), strings.TrimPrefix(c.Param("file"), "/"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if strings.HasSuffix(path, ".m3u8") {
+		c.Header("Content-Type", "application/vnd.apple.mpegurl")
+	}
+	c.Header("Cache-Control", "max-age=86400")
+	c.File(path)
+}
+
+// listVOD handles GET /api/v1/vod, the assets of ?stream= or all of them,
+// newest first
+func listVOD(c *gin.Context) {
+	stream := c.Query("stream")
+	if stream != "" {
+		if err := ident.Check(ident.StreamKey, stream); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	list := []gin.H{}
+	if catalog != nil {
+		for _, a := range catalog.List(stream) {
+			list = append(list, assetJSON(a))
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"assets": list})
+}
+
+// getVOD handles GET /api/v1/vod/:id
+func getVOD(c *gin.Context) {
+	if asset, ok := vodAsset(c); ok {
+		c.JSON(http.StatusOK, assetJSON(asset))
+	}
+}
+
+// deleteVOD handles DELETE /api/v1/vod/:id, removing the asset and its files
+func deleteVOD(c *gin.Context) {
+	admin, ok := adminIdentity(c)
+	if !ok {
+		return
+	}
+	asset, ok := vodAsset(c)
+	if !ok {
+		return
+	}
+	if err := catalog.Remove(asset.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Info("vod removed", "vod", asset.ID, "stream", asset.Stream, "admin", admin)
+	c.Status(http.StatusNoContent)
+}
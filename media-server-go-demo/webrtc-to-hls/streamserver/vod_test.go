@@ -0,0 +1,82 @@
+package streamserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/vod"
+)
+
+func TestArchiveVOD(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	savedDir, savedCatalog := hlsDir, catalog
+	defer func() { hlsDir, catalog = savedDir, savedCatalog }()
+	hlsDir = filepath.Join(dir, "hls")
+	if catalog, err = vod.Open(filepath.Join(dir, "vod")); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("vod_overrides", "vod-live=on")
+
+	os.MkdirAll(outputDir("vod-live"), 0755)
+	for _, name := range []string{"segment-7-00000.ts", "segment-7-00001.ts"} {
+		ioutil.WriteFile(filepath.Join(outputDir("vod-live"), name), []byte(name), 0644)
+	}
+	final := "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:2\n#EXTINF:2.000,\nsegment-7-00000.ts\n#EXTINF:1.500,\nsegment-7-00001.ts\n#EXT-X-ENDLIST\n"
+	sess := newSession("vod-live", nil, presets[client.LatencyBalanced])
+	sess.final = []byte(final)
+	sess.archiveVOD()
+	// no asset without ENDLIST, nor for keys without vod
+	other := newSession("vod-off", nil, presets[client.LatencyBalanced])
+	other.final = []byte(final)
+	other.archiveVOD()
+	assets := catalog.List("")
+	if len(assets) != 1 || assets[0].Stream != "vod-live" || assets[0].Duration != 3.5 || assets[0].Segments != 2 {
+		t.Fatalf("assets = %+v", assets)
+	}
+	id := assets[0].ID
+	// the output may be cleaned up, the asset stays
+	os.RemoveAll(outputDir("vod-live"))
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/vod/:id/*file", serveVOD)
+	r.GET("/api/v1/vod", listVOD)
+	r.DELETE("/api/v1/vod/:id", deleteVOD)
+	do := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, nil)
+		asAdmin(req, "ops")
+		r.ServeHTTP(w, req)
+		return w
+	}
+	w := do("GET", vodPath(id))
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), "#EXTM3U\n#EXT-X-PLAYLIST-TYPE:VOD\n") || w.Header().Get("Content-Type") != "application/vnd.apple.mpegurl" {
+		t.Fatalf("playlist = %d %s", w.Code, w.Body)
+	}
+	if w := do("GET", "/vod/"+id+"/segment-7-00001.ts"); w.Code != http.StatusOK || w.Body.String() != "segment-7-00001.ts" {
+		t.Fatalf("segment = %d %s", w.Code, w.Body)
+	}
+	if w := do("GET", "/vod/"+id+"/..%2Findex.json"); w.Code != http.StatusBadRequest {
+		t.Fatalf("escape = %d", w.Code)
+	}
+	if w := do("GET", "/api/v1/vod?stream=vod-live"); !strings.Contains(w.Body.String(), `"playlist":"`+vodPath(id)+`"`) {
+		t.Fatalf("list = %s", w.Body)
+	}
+	if w := do("DELETE", "/api/v1/vod/"+id); w.Code != http.StatusNoContent {
+		t.Fatalf("delete = %d", w.Code)
+	}
+	if w := do("GET", vodPath(id)); w.Code != http.StatusNotFound {
+		t.Fatalf("deleted asset = %d", w.Code)
+	}
+}
@@ -0,0 +1,155 @@
+package streamserver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/hlscheck"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/metrics"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/playlist"
+)
+
+// playlist_warmup modes, for playlist requests of a session registered
+// before its first segment is written
+const (
+	// warmupEmpty serves a live playlist without segments; the default
+	warmupEmpty = "empty"
+	// warmupHold holds the request for up to playlist_warmup_hold_ms
+	warmupHold = "hold"
+	// warmupOff answers 404 with a Retry-After
+	warmupOff = "off"
+)
+
+var (
+	firstPlayable = metrics.NewHistogram("playlist_first_playable_seconds",
+		"Time from publish to the first playlist with a segment",
+		[]float64{1, 2, 3, 5, 8, 13, 21})
+	warmupResponses = metrics.NewCounter("playlist_warmup_responses_total",
+		"Playlist requests answered before the first segment, by answer", "answer")
+)
+
+// warmupPoll is how often a held request checks for the first segment
+const warmupPoll = 100 * time.Millisecond
+
+// markPlayable records, once, that a playlist request found the output of
+// s playable
+func (s *session) markPlayable(now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	if s.playable != 0 {
+		return
+	}
+	s.playable = now.Sub(s.created)
+	if s.playable <= 0 {
+		s.playable = time.Nanosecond
+	}
+	firstPlayable.Observe(s.playable.Seconds())
+	s.timeline.add(eventPipeline, "first playable playlist")
+}
+
+// timeToPlayable returns how long after the publish a playlist request first
+// found the output playable, or zero while none did
+func (s *session) timeToPlayable() time.Duration {
+	s.Lock()
+	defer s.Unlock()
+	return s.playable
+}
+
+// ready reports whether the playlist on disk lists a segment of the output
+// of s, rather than nothing or a previous generation's segments
+func (s *session) ready() bool {
+	s.Lock()
+	generation := s.generation
+	s.Unlock()
+	if generation == 0 {
+		return false
+	}
+	data, err := ioutil.ReadFile(filepath.Join(outputDir(s.key), playlistName))
+	if err != nil || !bytes.Contains(data, []byte(segmentPrefix(generation))) {
+		return false
+	}
+	m, err := hlscheck.ParseMedia(data)
+	return err == nil && len(m.Segments) > 0
+}
+
+// warmingUp returns the live session of key if its output is not playable
+// yet, or nil. Audio-only sessions have no output to wait for.
+func warmingUp(key string) *session {
+	if sess := registry.get(key); sess != nil && sess.kind != client.KindAudioOnly && sess.timeToPlayable() == 0 {
+		return sess
+	}
+	return nil
+}
+
+// emptyPlaylist is a valid live playlist without segments, for a preset
+func emptyPlaylist(preset client.Preset) []byte {
+	var buf bytes.Buffer
+	m := &playlist.Media{TargetDuration: preset.SegmentDuration}
+	m.Write(&buf)
+	return buf.Bytes()
+}
+
+// serveWarmup answers a playlist request for sess until its first segment
+// exists, reporting whether it did. Once the output is playable, the
+// request is left to the normal path.
+func serveWarmup(c *gin.Context, sess *session) bool {
+	if sess.ready() {
+		sess.markPlayable(time.Now())
+		return false
+	}
+	switch os.Getenv("playlist_warmup") {
+	case warmupHold:
+		hold := time.Duration(envInt("playlist_warmup_hold_ms", 3000)) * time.Millisecond
+		if waitReady(c, sess, hold) {
+			warmupResponses.Inc(warmupHold)
+			sess.markPlayable(time.Now())
+			return false
+		}
+	case warmupOff:
+	default:
+		warmupResponses.Inc(warmupEmpty)
+		c.Header("Cache-Control", "no-cache")
+		c.Data(http.StatusOK, "application/vnd.apple.mpegurl", emptyPlaylist(sess.preset))
+		return true
+	}
+	// known but not started: tell players when to come back instead of
+	// letting them give up on a plain 404
+	warmupResponses.Inc("retry")
+	retry := sess.preset.SegmentDuration
+	if retry <= 0 {
+		retry = 1
+	}
+	c.Header("Retry-After", strconv.Itoa(retry))
+	c.Header("Cache-Control", "no-store")
+	c.Status(http.StatusNotFound)
+	return true
+}
+
+// waitReady waits up to hold for the first segment of sess, giving up early
+// when the player goes away or the session ends
+func waitReady(c *gin.Context, sess *session, hold time.Duration) bool {
+	ticker := time.NewTicker(warmupPoll)
+	defer ticker.Stop()
+	deadline := time.After(hold)
+	for {
+		select {
+		case <-ticker.C:
+			if sess.ready() {
+				return true
+			}
+		case <-deadline:
+			return false
+		case <-c.Request.Context().Done():
+			return false
+		case <-sess.done:
+			return false
+		}
+	}
+}
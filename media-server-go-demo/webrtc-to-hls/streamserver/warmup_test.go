@@ -0,0 +1,80 @@
+package streamserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+)
+
+func TestPlaylistWarmup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "warmup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	t.Setenv("playlist_validation", "off")
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(servePlaylist)
+	r.Use(serveMedia)
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", outputPath("warmup"), nil))
+		return w
+	}
+
+	// unknown streams get a plain 404
+	if w := get(); w.Code != http.StatusNotFound || w.Header().Get("Retry-After") != "" {
+		t.Fatalf("no session = %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	sess := newSession("warmup", nil, presets[client.LatencyBalanced])
+	if _, err := registry.claim(sess, conflictReject); err != nil {
+		t.Fatal(err)
+	}
+	defer registry.release(sess)
+	sess.generation = 7
+
+	w := get()
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "#EXT-X-TARGETDURATION:2\n") || strings.Contains(w.Body.String(), "#EXTINF") {
+		t.Fatalf("empty playlist = %d %q", w.Code, w.Body.String())
+	}
+
+	t.Setenv("playlist_warmup", warmupOff)
+	if w := get(); w.Code != http.StatusNotFound || w.Header().Get("Retry-After") != "2" {
+		t.Fatalf("known stream = %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if sess.timeToPlayable() != 0 {
+		t.Fatal("playable before the first segment")
+	}
+
+	t.Setenv("playlist_warmup", warmupHold)
+	t.Setenv("playlist_warmup_hold_ms", "5000")
+	observed := firstPlayable.Count()
+	go func() {
+		time.Sleep(2 * warmupPoll)
+		os.MkdirAll(outputDir("warmup"), 0755)
+		ioutil.WriteFile(filepath.Join(outputDir("warmup"), playlistName), []byte("#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXTINF:2,\n"+segmentPrefix(7)+"00000.ts\n"), 0644)
+	}()
+	w = get()
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), segmentPrefix(7)) {
+		t.Fatalf("held request = %d %q", w.Code, w.Body.String())
+	}
+	if sess.timeToPlayable() == 0 || firstPlayable.Count() != observed+1 {
+		t.Fatal("time to first playable playlist not recorded")
+	}
+}
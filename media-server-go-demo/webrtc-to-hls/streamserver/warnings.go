@@ -0,0 +1,35 @@
+package streamserver
+
+import (
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/metrics"
+)
+
+var publisherWarnings = metrics.NewCounter("publisher_warnings_total",
+	"Warnings sent to publishers, by code", "code")
+
+// warning is a problem with a publish that does not end it, as sent to
+// the publisher: a stable code, a text that says what to fix, and details a
+// publisher UI can act on
+type warning struct {
+	code    string
+	text    string
+	details map[string]interface{}
+}
+
+// warn sends w to the publisher, counts its code and records it on the
+// timeline and in the session log. Every warning goes through here.
+func (s *session) warn(w warning) {
+	publisherWarnings.Inc(w.code)
+	s.logf("warning %s: %s", w.code, w.text)
+	s.timeline.add(eventWarning, w.code+": "+w.text)
+	if s.conn == nil {
+		return
+	}
+	s.send(client.Message{
+		Cmd:     client.CmdWarning,
+		Code:    w.code,
+		Reason:  w.text,
+		Details: w.details,
+	})
+}
@@ -0,0 +1,30 @@
+package streamserver
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+)
+
+func TestWarn(t *testing.T) {
+	sess := newSession("warned", nil, presets[client.LatencyBalanced])
+	before := publisherWarnings.Value(client.WarningClockSkew)
+	sess.warn(warning{
+		code:    client.WarningClockSkew,
+		text:    "publisher clock is off by 2s",
+		details: map[string]interface{}{"skewMs": 2000.0},
+	})
+	if publisherWarnings.Value(client.WarningClockSkew) != before+1 {
+		t.Fatal("warning not counted")
+	}
+	entries := sess.timeline.entries()
+	last := entries[len(entries)-1]
+	if last.Kind != eventWarning || last.Detail != "clock-skew: publisher clock is off by 2s" {
+		t.Fatalf("timeline entry = %+v", last)
+	}
+	logs := sess.logs.entries()
+	if len(logs) == 0 || !strings.Contains(logs[len(logs)-1].Detail, "clock-skew") {
+		t.Fatalf("logs = %+v", logs)
+	}
+}
@@ -0,0 +1,282 @@
+package streamserver
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/ident"
+)
+
+// the corners a watermark is placed in
+const (
+	watermarkTopLeft     = "top-left"
+	watermarkTopRight    = "top-right"
+	watermarkBottomLeft  = "bottom-left"
+	watermarkBottomRight = "bottom-right"
+)
+
+// watermarkMargin is how far a watermark is from the edges of the video, in
+// pixels
+const watermarkMargin = 16
+
+var errPassedThrough = errors.New("the video is passed through, not transcoded: it cannot be watermarked")
+
+// watermark is an image overlaid on the video of an output, for branding or
+// compliance bugs
+type watermark struct {
+	// Image is the file name of the image, PNG or JPEG, in watermark_dir
+	Image string `json:"image"`
+	// Position is the corner of the video the image is placed in
+	Position string `json:"position"`
+	// Opacity is from 0, transparent, to 1, as the image is
+	Opacity float64 `json:"opacity"`
+	// Scale scales the image, 1 leaving it at its size
+	Scale float64 `json:"scale"`
+	// path, width and height are those of the image, scaled
+	path          string
+	width, height int
+}
+
+// watermarks are the watermarks the management API set, by stream key, nil
+// for none; they take precedence over the watermark settings
+var watermarks = struct {
+	sync.Mutex
+	byKey map[string]*watermark
+}{byKey: map[string]*watermark{}}
+
+// watermarkDir is where the images of watermarks are, watermark_dir
+// (watermarks)
+func watermarkDir() string {
+	if dir := os.Getenv("watermark_dir"); dir != "" {
+		return dir
+	}
+	return "watermarks"
+}
+
+// watermarkFor is the watermark of the outputs of key, nil without one: set
+// through the API, or read from watermark_image, watermark_position
+// (bottom-right), watermark_opacity (1) and watermark_scale (1), each with
+// its _overrides
+func watermarkFor(key string) (*watermark, error) {
+	watermarks.Lock()
+	w, ok := watermarks.byKey[key]
+	watermarks.Unlock()
+	if ok {
+		return w, nil
+	}
+	name := strings.TrimSpace(envForKey("watermark_image", key))
+	if name == "" {
+		return nil, nil
+	}
+	w = &watermark{Image: name, Position: strings.TrimSpace(envForKey("watermark_position", key)), Opacity: 1, Scale: 1}
+	for setting, value := range map[string]*float64{"watermark_opacity": &w.Opacity, "watermark_scale": &w.Scale} {
+		if s := strings.TrimSpace(envForKey(setting, key)); s != "" {
+			f, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %q is not a number", setting, s)
+			}
+			*value = f
+		}
+	}
+	return w, w.load()
+}
+
+// load checks the settings of w, defaulting its position, and reads the
+// size of its image
+func (w *watermark) load() error {
+	switch w.Position {
+	case "":
+		w.Position = watermarkBottomRight
+	case watermarkTopLeft, watermarkTopRight, watermarkBottomLeft, watermarkBottomRight:
+	default:
+		return fmt.Errorf("watermark position must be %s, %s, %s or %s, not %q", watermarkTopLeft, watermarkTopRight, watermarkBottomLeft, watermarkBottomRight, w.Position)
+	}
+	if w.Opacity <= 0 || w.Opacity > 1 {
+		return fmt.Errorf("watermark opacity must be over 0 and up to 1, not %g", w.Opacity)
+	}
+	if w.Scale <= 0 || w.Scale > 4 {
+		return fmt.Errorf("watermark scale must be over 0 and up to 4, not %g", w.Scale)
+	}
+	path, err := ident.Join(watermarkDir(), w.Image)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("watermark image: %v", err)
+	}
+	defer f.Close()
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return fmt.Errorf("watermark image %s: %v", w.Image, err)
+	}
+	w.path = path
+	w.width = int(math.Max(1, math.Round(float64(config.Width)*w.Scale)))
+	w.height = int(math.Max(1, math.Round(float64(config.Height)*w.Scale)))
+	return nil
+}
+
+// overlay is the gdkpixbufoverlay placing w on decoded video; negative
+// offsets are from the right and bottom edges
+func (w *watermark) overlay() string {
+	x, y := watermarkMargin, watermarkMargin
+	if strings.HasSuffix(w.Position, "right") {
+		x = -x
+	}
+	if strings.HasPrefix(w.Position, "bottom") {
+		y = -y
+	}
+	return fmt.Sprintf(" ! videoconvert ! gdkpixbufoverlay location=%q offset-x=%d offset-y=%d overlay-width=%d overlay-height=%d alpha=%g", w.path, x, y, w.width, w.height, w.Opacity)
+}
+
+// overlay is what overlays the watermark of the session on its decoded
+// video, with the session locked, empty without one
+func (s *session) overlay() string {
+	if s.watermark == nil {
+		return ""
+	}
+	return s.watermark.overlay()
+}
+
+// watermarkedInput is what follows the video appsrc of an output
+// watermarked: the video published decoded, overlaid and encoded to H.264
+// as transcoded video is
+func (s *session) watermarkedInput() string {
+	return decoderFor(s.inputCodec()) + s.overlay() + transcodeEncoding(s.preset, s.key)
+}
+
+// restartOutput starts the output of the session over as a new
+// generation, built anew from its settings, when running
+func (s *session) restartOutput() error {
+	s.Lock()
+	running := s.hls != nil
+	audio := s.audio
+	s.Unlock()
+	if !running {
+		return nil
+	}
+	s.stopPipeline()
+	if err := s.startPipeline(audio); err != nil {
+		return err
+	}
+	s.Lock()
+	refresher := s.refresher
+	s.Unlock()
+	if refresher != nil {
+		refresher.request(keyframeRestart)
+	}
+	return nil
+}
+
+// watermarkJSON describes the watermark of key, and that of its live
+// session
+func watermarkJSON(key string) gin.H {
+	w, err := watermarkFor(key)
+	body := gin.H{"stream": key, "watermark": w}
+	if err != nil {
+		body["error"] = err.Error()
+	}
+	if sess := registry.get(key); sess != nil {
+		sess.Lock()
+		body["live"] = sess.watermark
+		sess.Unlock()
+	}
+	return body
+}
+
+// getWatermark handles GET /api/v1/streams/:id/watermark
+func getWatermark(c *gin.Context) {
+	key, ok := identParam(c, "id", ident.StreamKey)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, watermarkJSON(key))
+}
+
+// setStreamWatermark handles PUT /api/v1/streams/:id/watermark, setting the
+// watermark of a stream key: {"image": "logo.png", "position": "top-right",
+// "opacity": 0.8, "scale": 0.5}, the image a file of watermark_dir. The
+// output of a live stream starts over with it.
+func setStreamWatermark(c *gin.Context) {
+	admin, ok := adminIdentity(c)
+	if !ok {
+		return
+	}
+	key, ok := identParam(c, "id", ident.StreamKey)
+	if !ok {
+		return
+	}
+	w := &watermark{Opacity: 1, Scale: 1}
+	if err := c.BindJSON(w); err != nil {
+		return
+	}
+	if w.Image == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "image required"})
+		return
+	}
+	if err := w.load(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !applyWatermark(c, key, w) {
+		return
+	}
+	logger.Info("watermark set", "stream", key, "image", w.Image, "position", w.Position, "admin", admin)
+	c.JSON(http.StatusOK, watermarkJSON(key))
+}
+
+// removeStreamWatermark handles DELETE /api/v1/streams/:id/watermark,
+// removing the watermark of a stream key, that of its settings too
+func removeStreamWatermark(c *gin.Context) {
+	admin, ok := adminIdentity(c)
+	if !ok {
+		return
+	}
+	key, ok := identParam(c, "id", ident.StreamKey)
+	if !ok {
+		return
+	}
+	if !applyWatermark(c, key, nil) {
+		return
+	}
+	logger.Info("watermark removed", "stream", key, "admin", admin)
+	c.JSON(http.StatusOK, watermarkJSON(key))
+}
+
+// applyWatermark sets w as the watermark of key, starting the output of
+// its live session over with it, and reports whether it did, answering c
+// when it did not
+func applyWatermark(c *gin.Context, key string, w *watermark) bool {
+	sess := registry.get(key)
+	if sess != nil && w != nil {
+		sess.Lock()
+		passed := sess.outputCodec() != codecH264
+		sess.Unlock()
+		if passed {
+			c.JSON(http.StatusConflict, gin.H{"error": errPassedThrough.Error()})
+			return false
+		}
+	}
+	watermarks.Lock()
+	watermarks.byKey[key] = w
+	watermarks.Unlock()
+	if sess == nil {
+		return true
+	}
+	if err := sess.restartOutput(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	sess.timeline.add(eventPipeline, "watermark changed")
+	return true
+}
@@ -0,0 +1,68 @@
+package streamserver
+
+import (
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/abr"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+)
+
+func TestWatermark(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watermarks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f, err := os.Create(filepath.Join(dir, "logo.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	png.Encode(f, image.NewNRGBA(image.Rect(0, 0, 200, 100)))
+	f.Close()
+	t.Setenv("watermark_dir", dir)
+	t.Setenv("watermark_image_overrides", "show=logo.png,missing=none.png,escape=../logo.png,corner=logo.png")
+	t.Setenv("watermark_scale_overrides", "show=0.5")
+	t.Setenv("watermark_position_overrides", "corner=middle")
+
+	if w, err := watermarkFor("other"); err != nil || w != nil {
+		t.Fatalf("default watermark = %v, %v", w, err)
+	}
+	w, err := watermarkFor("show")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ` ! videoconvert ! gdkpixbufoverlay location="` + filepath.Join(dir, "logo.png") + `" offset-x=-16 offset-y=-16 overlay-width=100 overlay-height=50 alpha=1`
+	if got := w.overlay(); got != want {
+		t.Fatalf("overlay = %s, want %s", got, want)
+	}
+	for _, key := range []string{"missing", "escape", "corner"} {
+		if _, err := watermarkFor(key); err == nil {
+			t.Fatalf("%s watermark accepted", key)
+		}
+	}
+
+	// the API takes precedence, nil removing the watermark of the settings
+	watermarks.byKey["show"] = nil
+	defer delete(watermarks.byKey, "show")
+	if w, err := watermarkFor("show"); err != nil || w != nil {
+		t.Fatalf("removed watermark = %v, %v", w, err)
+	}
+
+	sess := newSession("show", nil, presets[client.LatencyBalanced])
+	sess.watermark = w
+	sess.videoCodec = codecH264
+	out := sess.outputPipeline("hls/show", 2, false, false).String()
+	if !strings.Contains(out, "name=appsrc ! h264parse ! avdec_h264 ! videoconvert ! gdkpixbufoverlay ") || !strings.Contains(out, "alpha=1 ! videoconvert ! videorate ") {
+		t.Fatalf("watermarked output = %s", out)
+	}
+	rung := sess.rungPipeline("hls/show", 2, abr.Rung{Name: "360p", Width: 640, Height: 360, Bitrate: 800}, 0).String()
+	if !strings.Contains(rung, " ! avdec_h264 ! videoconvert ! gdkpixbufoverlay ") {
+		t.Fatalf("watermarked rung = %s", rung)
+	}
+}
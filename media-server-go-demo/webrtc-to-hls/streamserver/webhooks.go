@@ -0,0 +1,212 @@
+package streamserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/tracing"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/webhook"
+)
+
+// webhookJobs is the job class delivering lifecycle webhooks
+const webhookJobs = "webhook"
+
+// lifecycle events posted to webhooks
+const (
+	hookStreamStarted      = "stream.started"
+	hookStreamEnded        = "stream.ended"
+	hookRecordingCompleted = "recording.completed"
+	hookPipelineError      = "pipeline.error"
+	hookStreamReplaced     = "stream.replaced"
+	hookRenditionHealth    = "rendition.health"
+	hookStoryboardReady    = "storyboard.ready"
+	hookEncoderAlert       = "encoder.alert"
+	hookScheduledCreated   = "scheduled.created"
+	hookScheduledLive      = "scheduled.live"
+	hookScheduledEnded     = "scheduled.ended"
+	hookScheduledExpired   = "scheduled.expired"
+	hookRetentionPruned    = "retention.pruned"
+	hookExternalLive       = "external.live"
+	hookExternalOffline    = "external.offline"
+	hookExternalEnded      = "external.ended"
+)
+
+// failureCloses are the close codes of sessions ended by a failure, whose
+// stream.ended carries the last endedTimelineEntries of their timeline
+var failureCloses = map[int]bool{
+	client.ClosePipelineFailed: true,
+	client.CloseOverBudget:     true,
+	client.CloseIdle:           true,
+}
+
+const endedTimelineEntries = 20
+
+// webhooks are the endpoints lifecycle events are posted to, none unless
+// webhook_urls is set; guarded by configLock
+var webhooks []*webhook.Endpoint
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// setupWebhooks sets the endpoints lifecycle events are posted to, see
+// readWebhooks
+func setupWebhooks() error {
+	endpoints, err := readWebhooks()
+	if err != nil {
+		return err
+	}
+	configLock.Lock()
+	webhooks = endpoints
+	configLock.Unlock()
+	if len(endpoints) > 0 {
+		logger.Info("posting lifecycle webhooks", "endpoints", len(endpoints))
+	}
+	return nil
+}
+
+// readWebhooks reads the endpoints lifecycle events are posted to:
+// webhook_urls, comma separated, signed with webhook_secret. webhook_events
+// limits the events posted, comma separated, every one when empty.
+func readWebhooks() ([]*webhook.Endpoint, error) {
+	urls := envList("webhook_urls")
+	if len(urls) == 0 {
+		return nil, nil
+	}
+	secret := os.Getenv("webhook_secret")
+	if secret == "" {
+		return nil, errors.New("webhooks: webhook_secret required")
+	}
+	events := envList("webhook_events")
+	var endpoints []*webhook.Endpoint
+	for _, url := range urls {
+		endpoints = append(endpoints, &webhook.Endpoint{URL: url, Secret: []byte(secret), Events: events})
+	}
+	return endpoints, nil
+}
+
+// notifyHooks queues the delivery of an event of kind about the stream key
+// to every endpoint wanting it, and to the event bus, and sends it to the
+// gRPC watchers.
+// Deliveries are retried by the job queue, the event keeping its id, so
+// receivers drop duplicates by id and order events by time.
+func notifyHooks(kind, key string, data map[string]interface{}) {
+	notifyTraced(context.Background(), kind, key, data)
+}
+
+// notify is notifyHooks for an event about the publish of s, delivered in
+// its trace
+func (s *session) notify(kind string, data map[string]interface{}) {
+	notifyTraced(s.traceContext(), kind, s.key, data)
+}
+
+// notifyTraced is notifyHooks with each delivery a span of the trace of
+// trace, its request carrying the trace on
+func notifyTraced(trace context.Context, kind, key string, data map[string]interface{}) {
+	event := webhook.Event{ID: newSessionID(), Type: kind, Time: time.Now(), Stream: key, Data: data}
+	publishControlEvent(event)
+	publishLifecycle(event)
+	configLock.RLock()
+	endpoints := webhooks
+	configLock.RUnlock()
+	if len(endpoints) == 0 {
+		return
+	}
+	parent := tracing.FromContext(trace)
+	for _, endpoint := range endpoints {
+		if !endpoint.Wants(kind) {
+			continue
+		}
+		endpoint := endpoint
+		background.Submit(webhookJobs, kind+" "+endpoint.URL, func(ctx context.Context) error {
+			ctx, span := tracer.Start(tracing.ContextWith(ctx, parent), "webhook "+kind)
+			span.SetAttribute("url", endpoint.URL)
+			err := webhook.Deliver(ctx, webhookClient, endpoint, event, time.Now())
+			span.Fail(err)
+			span.End()
+			return err
+		})
+	}
+}
+
+// ingestProtocol is how s publishes: webrtc, whip, rtmp, srt, rtsp or rtp
+func ingestProtocol(s *session) string {
+	switch {
+	case s.ingest != "":
+		return s.ingest
+	case s.conn == nil:
+		return "whip"
+	}
+	return protocolWebRTC
+}
+
+// publisher adds who publishes s to data, the data of one of its lifecycle
+// events: the identity ingest auth authenticated and the external id the
+// publisher gave, if any
+func (s *session) publisher(data map[string]interface{}) map[string]interface{} {
+	if s.identity != "" {
+		data["identity"] = s.identity
+	}
+	if s.externalID != "" {
+		data["externalId"] = s.externalID
+	}
+	return data
+}
+
+// notifyStarted posts stream.started for s, now the publisher of its key
+func (s *session) notifyStarted() {
+	data := s.publisher(map[string]interface{}{"session": s.id, "ingest": ingestProtocol(s)})
+	if url := playbackURL(s); playlistPath(s) != "" {
+		data["playbackUrl"] = url
+	}
+	s.notify(hookStreamStarted, data)
+}
+
+// notifyReplaced posts stream.replaced for s, which took the key of
+// previous over; previous gets its stream.ended
+func (s *session) notifyReplaced(previous *session) {
+	previous.notifyEnded(client.CloseReplaced, errStreamReplaced.Error())
+	s.notify(hookStreamReplaced, s.publisher(map[string]interface{}{
+		"session":         s.id,
+		"previousSession": previous.id,
+		"ingest":          ingestProtocol(s),
+	}))
+}
+
+// notifyEnded posts stream.ended for s, closed with code and reason
+func (s *session) notifyEnded(code int, reason string) {
+	data := s.publisher(map[string]interface{}{
+		"session":         s.id,
+		"durationSeconds": time.Since(s.created).Seconds(),
+	})
+	if code != 0 {
+		data["code"] = code
+	}
+	if reason != "" {
+		data["reason"] = reason
+	}
+	if failureCloses[code] {
+		// what led to the failure, for the post-mortem
+		data["timeline"] = s.timeline.last(endedTimelineEntries)
+	}
+	s.notify(hookStreamEnded, data)
+}
+
+// notifyRecording posts recording.completed for rec, a recording of s whose
+// file is complete
+func (s *session) notifyRecording(rec *recordingOutput) {
+	data := map[string]interface{}{
+		"session":         s.id,
+		"file":            rec.path,
+		"durationSeconds": time.Since(rec.started).Seconds(),
+	}
+	if info, err := os.Stat(rec.path); err == nil {
+		data["bytes"] = info.Size()
+	}
+	if store != nil {
+		data["object"] = rec.object
+	}
+	s.notify(hookRecordingCompleted, data)
+}
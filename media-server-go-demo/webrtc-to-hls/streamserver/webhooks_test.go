@@ -0,0 +1,204 @@
+package streamserver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/storyboard"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/webhook"
+)
+
+func TestSetupWebhooks(t *testing.T) {
+	defer func(saved []*webhook.Endpoint) { webhooks = saved }(webhooks)
+	webhooks = nil
+	t.Setenv("webhook_urls", "https://cms.example/hooks, https://backup.example/hooks")
+	if setupWebhooks() == nil {
+		t.Fatal("webhooks without a secret")
+	}
+	t.Setenv("webhook_secret", "secret")
+	t.Setenv("webhook_events", "stream.started,stream.ended")
+	if err := setupWebhooks(); err != nil {
+		t.Fatal(err)
+	}
+	if len(webhooks) != 2 || webhooks[1].URL != "https://backup.example/hooks" || webhooks[0].Wants(hookPipelineError) {
+		t.Fatalf("webhooks = %+v", webhooks)
+	}
+}
+
+func TestLifecycleWebhooks(t *testing.T) {
+	defer func(saved []*webhook.Endpoint) { webhooks = saved }(webhooks)
+	received := make(chan webhook.Event, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := webhook.Verify([]byte("secret"), r.Header.Get(webhook.SignatureHeader), body, time.Now(), time.Minute); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		var event webhook.Event
+		json.Unmarshal(body, &event)
+		received <- event
+	}))
+	defer server.Close()
+	webhooks = []*webhook.Endpoint{{URL: server.URL, Secret: []byte("secret"), Events: []string{hookStreamStarted, hookStreamEnded}}}
+	background = newJobQueue()
+	defer background.Close()
+
+	next := func() webhook.Event {
+		select {
+		case event := <-received:
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatal("no webhook")
+		}
+		return webhook.Event{}
+	}
+	sess := newSession("hooked", nil, presets[client.LatencyBalanced])
+	if _, err := registry.claim(sess, conflictReject); err != nil {
+		t.Fatal(err)
+	}
+	if event := next(); event.Type != hookStreamStarted || event.Stream != "hooked" || event.Data["session"] != sess.id || event.Data["ingest"] != "whip" {
+		t.Fatalf("started = %+v", event)
+	}
+	// filtered out
+	notifyHooks(hookPipelineError, "hooked", nil)
+	sess.endWith(client.CloseKicked, "kicked")
+	if event := next(); event.Type != hookStreamEnded || event.Data["reason"] != "kicked" || event.Data["code"] != float64(client.CloseKicked) {
+		t.Fatalf("ended = %+v", event)
+	}
+}
+
+func TestTakeoverWebhooks(t *testing.T) {
+	events, cancel := controlEvents.Subscribe(8)
+	defer cancel()
+	first := newSession("handover", nil, presets[client.LatencyBalanced])
+	first.identity, first.externalID = "stage-a", "cms-a"
+	if _, err := registry.claim(first, conflictReject); err != nil {
+		t.Fatal(err)
+	}
+	second := newSession("handover", nil, presets[client.LatencyBalanced])
+	second.identity, second.externalID = "stage-b", "cms-b"
+	if _, err := registry.claim(second, conflictTakeover); err != nil {
+		t.Fatal(err)
+	}
+	defer registry.release(second)
+	<-first.done
+	// the replaced session no longer owns the key it ends with
+	first.end()
+
+	var types []string
+	for len(types) < 4 {
+		select {
+		case event := <-events:
+			if event.Stream != "handover" {
+				continue
+			}
+			types = append(types, event.Type)
+			switch event.Type {
+			case hookStreamStarted:
+				if want := map[string]string{first.id: "stage-a", second.id: "stage-b"}[event.Data["session"]]; event.Data["identity"] != want {
+					t.Fatalf("started = %v", event)
+				}
+			case hookStreamEnded:
+				if event.Data["session"] != first.id || event.Data["reason"] != errStreamReplaced.Error() || event.Data["identity"] != "stage-a" || event.Data["externalId"] != "cms-a" {
+					t.Fatalf("ended = %v", event)
+				}
+			case hookStreamReplaced:
+				if event.Data["session"] != second.id || event.Data["previousSession"] != first.id || event.Data["identity"] != "stage-b" || event.Data["externalId"] != "cms-b" {
+					t.Fatalf("replaced = %v", event)
+				}
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("events %v", types)
+		}
+	}
+	want := []string{hookStreamStarted, hookStreamEnded, hookStreamReplaced, hookStreamStarted}
+	if strings.Join(types, " ") != strings.Join(want, " ") {
+		t.Fatalf("events %v, want %v", types, want)
+	}
+	select {
+	case event := <-events:
+		if event.Stream == "handover" {
+			t.Fatalf("extra event %v", event)
+		}
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestStoryboardWebhook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storyboard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	t.Setenv("storyboard_interval", "1")
+	background = newJobQueue()
+	defer background.Close()
+	events, cancel := controlEvents.Subscribe(4)
+	defer cancel()
+
+	// the strip is on disk already, as after a failed attempt
+	ioutil.WriteFile(filepath.Join(dir, playlistName), []byte("#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXTINF:2,\nsegment-1-00000.ts\n#EXT-X-ENDLIST\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, storyboard.DefaultOptions.StripName(0)), []byte("jpeg"), 0644)
+	scheduleStoryboardIn("boarded", "vod/asset", dir, "/vod/asset/")
+	for {
+		select {
+		case event := <-events:
+			if event.Type != hookStoryboardReady {
+				continue
+			}
+			if event.Stream != "boarded" || event.Data["output"] != "vod/asset" || event.Data["vtt"] != "/vod/asset/"+storyboard.DefaultOptions.VTTName() {
+				t.Fatalf("storyboard ready = %v", event)
+			}
+			return
+		case <-time.After(5 * time.Second):
+			t.Fatal("no storyboard.ready event")
+		}
+	}
+}
+
+func TestFailureTimelineWebhook(t *testing.T) {
+	events, cancel := controlEvents.Subscribe(8)
+	defer cancel()
+	sess := newSession("failing", nil, presets[client.LatencyBalanced])
+	if _, err := registry.claim(sess, conflictReject); err != nil {
+		t.Fatal(err)
+	}
+	sess.timeline.add(eventPipeline, "output pipeline failed: error")
+	sess.endWith(client.ClosePipelineFailed, "output pipeline failed")
+
+	other := newSession("kicked", nil, presets[client.LatencyBalanced])
+	if _, err := registry.claim(other, conflictReject); err != nil {
+		t.Fatal(err)
+	}
+	other.endWith(client.CloseKicked, "kicked")
+	for ended := 0; ended < 2; {
+		select {
+		case event := <-events:
+			if event.Type != hookStreamEnded {
+				continue
+			}
+			ended++
+			timeline, ok := event.Data["timeline"]
+			switch event.Stream {
+			case "failing":
+				if !strings.Contains(timeline, "output pipeline failed: error") {
+					t.Fatalf("failure ended without its timeline: %v", event)
+				}
+			case "kicked":
+				if ok {
+					t.Fatalf("timeline of a session ended on purpose: %v", event)
+				}
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no stream.ended")
+		}
+	}
+}
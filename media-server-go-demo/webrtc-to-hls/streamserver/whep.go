@@ -0,0 +1,77 @@
+package streamserver
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	mediaserver "github.com/notedit/media-server-go"
+)
+
+// whepPath is where a WHEP viewer is ended, as sent in Location
+func whepPath(s *session, v *webrtcViewer) string {
+	return "/whep/" + s.key + "/" + v.id
+}
+
+// whepPlay handles POST /whep/:id, the WebRTC-HTTP egress protocol: the
+// body is a viewer's SDP offer for the live stream known by id as stream
+// key, external id or session id. The answer relays the publisher's media
+// without transcoding, at sub-second latency, and comes back with the
+// Location of the viewer, which DELETE ends. Viewers end with the publish.
+func whepPlay(c *gin.Context) {
+	if c.ContentType() != "application/sdp" {
+		c.String(http.StatusUnsupportedMediaType, "offer must be application/sdp")
+		return
+	}
+	sess := registry.find(c.Param("id"))
+	var video *mediaserver.IncomingStreamTrack
+	if sess != nil {
+		video, _ = sess.liveTracks()
+	}
+	if video == nil {
+		c.String(http.StatusNotFound, errNotLive.Error())
+		return
+	}
+	if quarantined.has(sess.key) {
+		refuseQuarantinedRequest(c)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(c.Request.Body, maxWHIPOffer))
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	offer, err := parseOffer(string(body))
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	viewer, answer, err := sess.attachViewer(offer, nil, net.ParseIP(c.ClientIP()))
+	switch err {
+	case nil:
+	case errNotLive:
+		c.String(http.StatusNotFound, err.Error())
+		return
+	case errQuarantined:
+		refuseQuarantinedRequest(c)
+		return
+	default:
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	c.Header("Location", whepPath(sess, viewer))
+	iceServerLinks(c, "")
+	c.Data(http.StatusCreated, "application/sdp", []byte(answer))
+}
+
+// whepStop handles DELETE /whep/:id/:viewer, the end of a WHEP viewer
+func whepStop(c *gin.Context) {
+	sess := registry.find(c.Param("id"))
+	if sess == nil || sess.detachViewer(c.Param("viewer")) == nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	c.Status(http.StatusOK)
+}
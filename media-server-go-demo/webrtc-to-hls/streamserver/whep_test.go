@@ -0,0 +1,44 @@
+package streamserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+)
+
+func TestWHEPNeedsLiveStream(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/whep/:id", whepPlay)
+	r.DELETE("/whep/:id/:viewer", whepStop)
+
+	// negotiating: no published stream to attach to yet
+	sess := newSession("whep-pending", nil, presets[client.LatencyBalanced])
+	if _, err := registry.claim(sess, conflictReject); err != nil {
+		t.Fatal(err)
+	}
+	defer registry.release(sess)
+
+	for _, tc := range []struct {
+		method, path, contentType string
+		status                    int
+	}{
+		{"POST", "/whep/whep-pending", "text/plain", http.StatusUnsupportedMediaType},
+		{"POST", "/whep/whep-pending", "application/sdp", http.StatusNotFound},
+		{"POST", "/whep/unknown", "application/sdp", http.StatusNotFound},
+		{"DELETE", "/whep/whep-pending/1-1", "", http.StatusNotFound},
+		{"DELETE", "/whep/unknown/1-1", "", http.StatusNotFound},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, strings.NewReader("v=0\r\n"))
+		req.Header.Set("Content-Type", tc.contentType)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Errorf("%s %s: status %d, want %d", tc.method, tc.path, w.Code, tc.status)
+		}
+	}
+}
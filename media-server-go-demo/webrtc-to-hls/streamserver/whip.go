@@ -0,0 +1,267 @@
+package streamserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/abr"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/pubauth"
+)
+
+var errNoSignaling = errors.New("publisher has no signaling connection")
+
+// maxWHIPOffer bounds the body of a WHIP request; offers are a few KB
+const maxWHIPOffer = 64 << 10
+
+// sessionHeader carries the session object of the answer message in a WHIP
+// response, as JSON
+const sessionHeader = "X-Session"
+
+// whipPath is where a WHIP session is ended, as sent in Location
+func whipPath(s *session) string {
+	return "/whip/" + s.id
+}
+
+// bearerToken returns the token of an Authorization: Bearer header
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
+
+// whipPublish handles POST /whip, the WebRTC-HTTP ingestion protocol (RFC
+// 9725) for encoders that publish without the websocket signaling, e.g.
+// OBS. The body is the SDP offer. The stream key is the stream query
+// parameter, else the bearer token, else the id of the offer's stream;
+// when ingest authentication takes a credential the bearer token is that
+// credential and never the key. dash=on adds a DASH output. The answer
+// comes back with the Location of the session, which DELETE ends.
+func whipPublish(c *gin.Context) {
+	if c.ContentType() != "application/sdp" {
+		c.String(http.StatusUnsupportedMediaType, "offer must be application/sdp")
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(c.Request.Body, maxWHIPOffer))
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	parseStart := time.Now()
+	offer, err := parseOffer(string(body))
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	parseTime := time.Since(parseStart)
+
+	id := c.Query("stream")
+	if id == "" && !auth.takesCredential() {
+		id = bearerToken(c.Request)
+	}
+	key, _, err := publishIDs(client.Message{StreamID: id}, offer)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	identity, err := auth.authorize(pubauth.Request{
+		Key:        key,
+		Credential: bearerToken(c.Request),
+		TLS:        c.Request.TLS,
+	})
+	if err != nil {
+		logger.Warn("publish unauthorized", "stream", key, "identity", identity, "error", err)
+		status := http.StatusForbidden
+		if unauthenticated(err) {
+			c.Header("WWW-Authenticate", "Bearer")
+			status = http.StatusUnauthorized
+		}
+		c.String(status, err.Error())
+		return
+	}
+	if _, err := admitPublish(client.Message{}, key); err != nil {
+		if limit, ok := err.(*limitExceeded); ok {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"code": client.ErrorLimitExceeded, "error": err.Error(), "details": limit.details()})
+			return
+		}
+		c.String(http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	preset, err := resolvePreset("", key)
+	profile, profileErr := resolveProfile(key)
+	if err == nil {
+		err = profileErr
+	}
+	if err == nil {
+		preset, err = profile.fit(preset, false)
+	}
+	if err == nil {
+		preset, err = resolveDVR(preset, key)
+	}
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	kind, err := sessionKind(offer, key)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	policy, err := resolvePublishPolicy(key)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := policy.checkOffer(offer); err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	dash, err := resolveDASH(c.Query("dash"), key)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	container, err := resolveContainer(profile, key)
+	var ladder []abr.Rung
+	if err == nil {
+		ladder, err = resolveLadder(preset, profile, container, key)
+	}
+	var passthrough bool
+	if err == nil {
+		passthrough, err = resolveAV1Passthrough(container, key)
+	}
+	var hevc bool
+	if err == nil {
+		hevc, err = resolveH265Passthrough(container, key)
+	}
+	var opus bool
+	if err == nil {
+		opus, err = resolveOpusPassthrough(profile, container, key)
+	}
+	var layer string
+	if err == nil {
+		layer, err = resolveLayer(key)
+	}
+	var egress string
+	if err == nil {
+		egress, err = resolveSRTEgress(key)
+	}
+	if err == nil {
+		err = checkPassthrough(preset, "", key)
+	}
+	if err == nil {
+		err = checkEncryption(container, dash, preset, key)
+	}
+	if err == nil {
+		err = checkDRM(container, passthrough || hevc, preset, key)
+	}
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	sess := newSession(key, nil, preset)
+	sess.baseURL = requestBaseURL(c.Request)
+	sess.kind = kind
+	sess.profile = profile
+	sess.dash = dash
+	sess.container = container
+	sess.ladder = ladder
+	sess.av1Passthrough = passthrough
+	sess.h265Passthrough = hevc
+	sess.opusPassthrough = opus
+	sess.layer = layer
+	sess.srtEgress = egress
+	sess.policy = policy
+	sess.identity = identity
+	sess.timeline.add(eventSignaling, "in whip offer")
+	sess.startTrace(c.Request.Header, parseStart, parseTime)
+	if _, err := registry.claim(sess, conflictPolicyFor(key)); err != nil {
+		logger.Warn("publish rejected", "stream", key, "error", err)
+		sess.close(0, "")
+		c.String(http.StatusConflict, err.Error())
+		return
+	}
+	scheduled.publishStarted(key)
+
+	endpoint := newEndpoint(net.ParseIP(c.ClientIP()))
+	n, err := sess.negotiate(endpoint, newPayloadPins(), offer)
+	if err != nil {
+		sess.log.get().Error("publish error", "error", err)
+		sess.end()
+		releaseEndpoint(endpoint)
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	sess.logf("publishing over whip, answered in %.0f ms", milliseconds(parseTime+n.negotiationTime+n.pipelineTime))
+	if kind == client.KindVideo {
+		go sess.endWhenIdle(time.Duration(envInt("whip_idle_timeout", 15)) * time.Second)
+	}
+	c.Header("Location", whipPath(sess))
+	iceServerLinks(c, key)
+	setSessionHeader(c, sess.info(n, false, parseTime))
+	c.Data(http.StatusCreated, "application/sdp", []byte(n.sdp))
+}
+
+// setSessionHeader describes the negotiated session in a WHIP response
+// like the answer message does
+func setSessionHeader(c *gin.Context, info *client.SessionInfo) {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return
+	}
+	c.Header(sessionHeader, string(data))
+}
+
+// whipDelete handles DELETE /whip/:id, the end of a WHIP session
+func whipDelete(c *gin.Context) {
+	id := c.Param("id")
+	sess := registry.find(id)
+	if sess == nil || sess.id != id || sess.conn != nil || sess.ingest != "" {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	sess.timeline.add(eventSignaling, "in whip delete")
+	sess.end()
+	c.Status(http.StatusOK)
+}
+
+// endWhenIdle ends a session whose publisher sent no video frame for
+// timeout, with client.CloseIdle. A WHIP encoder that went away without
+// DELETE would otherwise hold its stream key, there being no signaling
+// connection whose loss tells; a browser whose tab hung keeps its
+// websocket open.
+func (s *session) endWhenIdle(timeout time.Duration) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	frames, last := uint64(0), time.Now()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			if s.reconnecting() {
+				// bounded by the reconnect grace period instead
+				last = now
+				continue
+			}
+			if count := s.frames.stats().Frames.Count; count != frames {
+				frames, last = count, now
+			} else if now.Sub(last) >= timeout {
+				s.logf("no media for %s, ending", timeout)
+				s.endWith(client.CloseIdle, fmt.Sprintf("no media for %s", timeout))
+				return
+			}
+		}
+	}
+}
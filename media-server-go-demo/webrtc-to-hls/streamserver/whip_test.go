@@ -0,0 +1,181 @@
+package streamserver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/client"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/pubauth"
+)
+
+func whipRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/whip", whipPublish)
+	r.DELETE("/whip/:id", whipDelete)
+	return r
+}
+
+func TestBearerToken(t *testing.T) {
+	for header, want := range map[string]string{
+		"Bearer key-1":  "key-1",
+		"bearer  key-1": "key-1",
+		"Basic a2V5":    "",
+		"Bearer":        "",
+		"":              "",
+	} {
+		req := httptest.NewRequest("POST", "/whip", nil)
+		req.Header.Set("Authorization", header)
+		if got := bearerToken(req); got != want {
+			t.Errorf("bearerToken(%q) = %q", header, got)
+		}
+	}
+}
+
+func TestWHIPRefusesBadOffers(t *testing.T) {
+	offer, err := ioutil.ReadFile("testdata/chrome_offer.sdp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := whipRouter()
+	for _, tc := range []struct {
+		name        string
+		contentType string
+		token       string
+		body        string
+		status      int
+	}{
+		{"form post", "application/x-www-form-urlencoded", "key", string(offer), http.StatusUnsupportedMediaType},
+		{"hostile key", "application/sdp", "../etc", string(offer), http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest("POST", "/whip", strings.NewReader(tc.body))
+		req.Header.Set("Content-Type", tc.contentType)
+		req.Header.Set("Authorization", "Bearer "+tc.token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Errorf("%s: status %d, want %d: %s", tc.name, w.Code, tc.status, w.Body)
+		}
+		if w.Header().Get("Location") != "" {
+			t.Errorf("%s: refused publish has a Location", tc.name)
+		}
+	}
+}
+
+func TestWHIPDelete(t *testing.T) {
+	r := whipRouter()
+	sess := newSession("whip-delete", nil, presets[client.LatencyBalanced])
+	if _, err := registry.claim(sess, conflictReject); err != nil {
+		t.Fatal(err)
+	}
+	// websocket publishers are not ended over WHIP
+	ws := newSession("ws-delete", newSignaling(nil), presets[client.LatencyBalanced])
+	if _, err := registry.claim(ws, conflictReject); err != nil {
+		t.Fatal(err)
+	}
+	defer registry.release(ws)
+
+	for path, status := range map[string]int{
+		"/whip/unknown":     http.StatusNotFound,
+		"/whip/whip-delete": http.StatusNotFound,
+		"/whip/" + ws.id:    http.StatusNotFound,
+		whipPath(sess):      http.StatusOK,
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("DELETE", path, nil))
+		if w.Code != status {
+			t.Errorf("DELETE %s: status %d, want %d", path, w.Code, status)
+		}
+	}
+	if registry.get("whip-delete") != nil {
+		t.Fatal("deleted session still owns its key")
+	}
+	select {
+	case <-sess.done:
+	default:
+		t.Fatal("deleted session not closed")
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("DELETE", whipPath(sess), nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("second DELETE: status %d", w.Code)
+	}
+}
+
+func TestWHIPAuthentication(t *testing.T) {
+	offer, err := ioutil.ReadFile("testdata/chrome_offer.sdp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := auth
+	auth = &ingestAuth{mode: authKey, authenticator: pubauth.Keys{"whip-auth": "s3cret"}}
+	defer func() { auth = saved }()
+
+	r := whipRouter()
+	for _, tc := range []struct {
+		name   string
+		path   string
+		token  string
+		status int
+	}{
+		{"no credential", "/whip?stream=whip-auth", "", http.StatusUnauthorized},
+		{"wrong secret", "/whip?stream=whip-auth", "wrong", http.StatusForbidden},
+		// the secret is not taken for the key
+		{"secret only", "/whip", "s3cret", http.StatusForbidden},
+	} {
+		req := httptest.NewRequest("POST", tc.path, strings.NewReader(string(offer)))
+		req.Header.Set("Content-Type", "application/sdp")
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Errorf("%s: status %d, want %d: %s", tc.name, w.Code, tc.status, w.Body)
+		}
+		if tc.status == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("%s: no WWW-Authenticate challenge", tc.name)
+		}
+	}
+	if registry.get("whip-auth") != nil || registry.get("s3cret") != nil {
+		t.Fatal("refused publish claimed a key")
+	}
+}
+
+func TestWHIPSessionHeader(t *testing.T) {
+	raw, err := ioutil.ReadFile("testdata/chrome_offer.sdp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer, err := parseOffer(string(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := newSession("whip-info", nil, presets[client.LatencyBalanced])
+	n := &negotiation{answer: answer, audio: true, negotiationTime: 3 * time.Millisecond, pipelineTime: 40 * time.Millisecond}
+
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	setSessionHeader(c, sess.info(n, false, time.Millisecond))
+	header := w.Header().Get(sessionHeader)
+	if strings.ContainsAny(header, "\r\n") {
+		t.Fatalf("header spans lines: %q", header)
+	}
+	var info client.SessionInfo
+	if err := json.Unmarshal([]byte(header), &info); err != nil {
+		t.Fatalf("header %q: %v", header, err)
+	}
+	if info.ID != sess.id || info.Stream != "whip-info" || info.Playlist != playlistPath(sess) || !info.Audio || len(info.Codecs) == 0 {
+		t.Fatalf("session %+v", info)
+	}
+	if info.Timings.Pipeline != 40 || info.Timings.Negotiation != 3 {
+		t.Fatalf("timings %+v", info.Timings)
+	}
+}
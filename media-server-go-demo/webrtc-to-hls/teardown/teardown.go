@@ -0,0 +1,221 @@
+// Package teardown defines the order in which a session's outputs are shut
+// down, so e.g. an uploader is never cancelled before the final playlist it
+// has to upload is written.
+//
+// A Plan runs its steps phase by phase: stop ingest, flush encoders and
+// muxers (EOS), finalize playlists and manifests, drain sinks and uploaders,
+// then release transports and pipelines. Each phase has a bounded wait and
+// the whole teardown has a deadline; steps still running when their time is
+// up are abandoned (their context is cancelled) and teardown moves on. The
+// release phase always runs.
+package teardown
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Phase is one stage of teardown, run in declaration order
+type Phase int
+
+const (
+	StopIngest Phase = iota
+	Flush
+	Finalize
+	DrainSinks
+	Release
+	numPhases
+)
+
+var phaseNames = [...]string{"stop-ingest", "flush", "finalize", "drain-sinks", "release"}
+
+func (p Phase) String() string {
+	if p < 0 || p >= numPhases {
+		return fmt.Sprintf("phase(%d)", int(p))
+	}
+	return phaseNames[p]
+}
+
+// Step is one unit of teardown work; it must return promptly once ctx is done
+type Step func(ctx context.Context) error
+
+// Sink is an output taking part in every phase after ingest stopped
+type Sink interface {
+	Name() string
+	// Flush pushes buffered media through (EOS)
+	Flush(ctx context.Context) error
+	// Finalize writes closing playlists/manifests
+	Finalize(ctx context.Context) error
+	// Drain waits for pending uploads/writes of finalized data
+	Drain(ctx context.Context) error
+	// Release frees the resources; it is always called
+	Release()
+}
+
+// Default bounded waits
+var (
+	DefaultPhaseTimeout = 5 * time.Second
+	DefaultDeadline     = 15 * time.Second
+	ReleaseTimeout      = 2 * time.Second
+)
+
+type namedStep struct {
+	name string
+	step Step
+}
+
+// Plan collects the steps of one teardown
+type Plan struct {
+	steps    [numPhases][]namedStep
+	timeouts [numPhases]time.Duration
+	deadline time.Duration
+	logf     func(format string, args ...interface{})
+}
+
+// NewPlan returns an empty plan using the default timeouts; logf, if not
+// nil, receives one line per phase
+func NewPlan(logf func(format string, args ...interface{})) *Plan {
+	p := &Plan{
+		deadline: DefaultDeadline,
+		logf:     logf,
+	}
+	for i := range p.timeouts {
+		p.timeouts[i] = DefaultPhaseTimeout
+	}
+	p.timeouts[Release] = ReleaseTimeout
+	return p
+}
+
+// SetPhaseTimeout bounds how long phase waits for its steps
+func (p *Plan) SetPhaseTimeout(phase Phase, timeout time.Duration) {
+	p.timeouts[phase] = timeout
+}
+
+// SetDeadline bounds the whole teardown before the release phase
+func (p *Plan) SetDeadline(deadline time.Duration) {
+	p.deadline = deadline
+}
+
+// Add registers a step in phase; steps of one phase run concurrently
+func (p *Plan) Add(phase Phase, name string, step Step) {
+	p.steps[phase] = append(p.steps[phase], namedStep{name, step})
+}
+
+// AddSink registers sink in the flush, finalize, drain and release phases
+func (p *Plan) AddSink(sink Sink) {
+	p.Add(Flush, sink.Name(), sink.Flush)
+	p.Add(Finalize, sink.Name(), sink.Finalize)
+	p.Add(DrainSinks, sink.Name(), sink.Drain)
+	p.Add(Release, sink.Name(), func(context.Context) error {
+		sink.Release()
+		return nil
+	})
+}
+
+// PhaseResult reports how one phase went
+type PhaseResult struct {
+	Phase    Phase
+	Duration time.Duration
+	// Abandoned lists steps still running when the phase ran out of time
+	Abandoned []string
+	Errors    map[string]error
+	// Skipped is set when the overall deadline passed before the phase ran
+	Skipped bool
+}
+
+// Run executes the plan; it returns once the release phase finished or timed out
+func (p *Plan) Run(ctx context.Context) []PhaseResult {
+	results := make([]PhaseResult, 0, numPhases)
+	deadlineCtx, cancel := context.WithTimeout(ctx, p.deadline)
+	defer cancel()
+
+	for phase := StopIngest; phase < numPhases; phase++ {
+		parent := deadlineCtx
+		if phase == Release {
+			// release runs even when the deadline has passed
+			parent = context.Background()
+		} else if deadlineCtx.Err() != nil {
+			results = append(results, PhaseResult{Phase: phase, Skipped: true})
+			p.log(phase, 0, "skipped, teardown deadline exceeded")
+			continue
+		}
+		result := p.runPhase(parent, phase)
+		results = append(results, result)
+		switch {
+		case len(result.Abandoned) > 0:
+			p.log(phase, result.Duration, fmt.Sprintf("abandoned %v", result.Abandoned))
+		case len(result.Errors) > 0:
+			p.log(phase, result.Duration, fmt.Sprintf("errors %v", result.Errors))
+		default:
+			p.log(phase, result.Duration, "ok")
+		}
+	}
+	return results
+}
+
+func (p *Plan) runPhase(parent context.Context, phase Phase) PhaseResult {
+	result := PhaseResult{Phase: phase}
+	start := time.Now()
+	steps := p.steps[phase]
+	if len(steps) == 0 {
+		return result
+	}
+
+	ctx, cancel := context.WithTimeout(parent, p.timeouts[phase])
+	defer cancel()
+
+	// abandoned steps may still finish after we return, so results are
+	// collected under lock and copied out
+	var lock sync.Mutex
+	finished := map[string]bool{}
+	errs := map[string]error{}
+	var wg sync.WaitGroup
+	for _, s := range steps {
+		wg.Add(1)
+		go func(s namedStep) {
+			defer wg.Done()
+			err := s.step(ctx)
+			lock.Lock()
+			finished[s.name] = true
+			if err != nil {
+				errs[s.name] = err
+			}
+			lock.Unlock()
+		}(s)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+
+	lock.Lock()
+	for _, s := range steps {
+		if !finished[s.name] {
+			result.Abandoned = append(result.Abandoned, s.name)
+		}
+	}
+	for name, err := range errs {
+		if result.Errors == nil {
+			result.Errors = map[string]error{}
+		}
+		result.Errors[name] = err
+	}
+	lock.Unlock()
+
+	result.Duration = time.Since(start)
+	return result
+}
+
+func (p *Plan) log(phase Phase, d time.Duration, status string) {
+	if p.logf != nil {
+		p.logf("teardown %s %v: %s", phase, d.Round(time.Millisecond), status)
+	}
+}
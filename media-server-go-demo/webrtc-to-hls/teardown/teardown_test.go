@@ -0,0 +1,117 @@
+package teardown_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/teardown"
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/teardown/teardowntest"
+)
+
+func TestPhaseOrder(t *testing.T) {
+	recorder := &teardowntest.Recorder{}
+	plan := teardown.NewPlan(t.Logf)
+	plan.Add(teardown.Release, "transport", func(context.Context) error {
+		recorder.Record("transport:release")
+		return nil
+	})
+	plan.AddSink(&teardowntest.Sink{SinkName: "hls", Recorder: recorder})
+	plan.Add(teardown.StopIngest, "ingest", func(context.Context) error {
+		recorder.Record("ingest:stop")
+		return nil
+	})
+
+	plan.Run(context.Background())
+
+	got := recorder.Events()
+	want := []string{"ingest:stop", "hls:flush", "hls:finalize", "hls:drain"}
+	if !reflect.DeepEqual(got[:4], want) {
+		t.Fatalf("events = %v, want prefix %v", got, want)
+	}
+	// release steps run concurrently, only their phase is ordered
+	release := map[string]bool{}
+	for _, e := range got[4:] {
+		release[e] = true
+	}
+	if len(got) != 6 || !release["hls:release"] || !release["transport:release"] {
+		t.Fatalf("events = %v", got)
+	}
+}
+
+func TestFlushFinishesBeforeUploaderDrains(t *testing.T) {
+	recorder := &teardowntest.Recorder{}
+	plan := teardown.NewPlan(t.Logf)
+	slow := &teardowntest.Sink{SinkName: "hls", Recorder: recorder,
+		Delay: map[string]time.Duration{"finalize": 50 * time.Millisecond}}
+	uploader := &teardowntest.Sink{SinkName: "upload", Recorder: recorder}
+	plan.AddSink(uploader)
+	plan.AddSink(slow)
+
+	plan.Run(context.Background())
+
+	drained := -1
+	finalized := -1
+	for i, e := range recorder.Events() {
+		switch e {
+		case "upload:drain":
+			drained = i
+		case "hls:finalize":
+			finalized = i
+		}
+	}
+	if finalized < 0 || drained < finalized {
+		t.Fatalf("uploader drained before playlist finalized: %v", recorder.Events())
+	}
+}
+
+func TestStragglersAreAbandoned(t *testing.T) {
+	recorder := &teardowntest.Recorder{}
+	plan := teardown.NewPlan(t.Logf)
+	plan.SetPhaseTimeout(teardown.Flush, 20*time.Millisecond)
+	plan.SetDeadline(time.Second)
+	plan.AddSink(&teardowntest.Sink{SinkName: "stuck", Recorder: recorder,
+		Delay: map[string]time.Duration{"flush": time.Hour}})
+
+	start := time.Now()
+	results := plan.Run(context.Background())
+	if time.Since(start) > 500*time.Millisecond {
+		t.Fatal("teardown waited for a stuck sink")
+	}
+	if got := results[teardown.Flush].Abandoned; !reflect.DeepEqual(got, []string{"stuck"}) {
+		t.Fatalf("abandoned = %v", got)
+	}
+	if !contains(recorder.Events(), "stuck:release") {
+		t.Fatalf("release did not run: %v", recorder.Events())
+	}
+}
+
+func TestDeadlineSkipsToRelease(t *testing.T) {
+	recorder := &teardowntest.Recorder{}
+	plan := teardown.NewPlan(t.Logf)
+	plan.SetDeadline(30 * time.Millisecond)
+	plan.AddSink(&teardowntest.Sink{SinkName: "stuck", Recorder: recorder,
+		Delay: map[string]time.Duration{"flush": time.Hour}})
+
+	results := plan.Run(context.Background())
+	if !results[teardown.Finalize].Skipped || !results[teardown.DrainSinks].Skipped {
+		t.Fatalf("results = %+v", results)
+	}
+	if results[teardown.Release].Skipped {
+		t.Fatal("release skipped")
+	}
+	events := recorder.Events()
+	if !contains(events, "stuck:release") || contains(events, "stuck:finalize") || contains(events, "stuck:drain") {
+		t.Fatalf("events = %v", events)
+	}
+}
+
+func contains(events []string, event string) bool {
+	for _, e := range events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+// Package teardowntest provides a teardown.Sink test double that records the
+// order in which teardown phases reached it.
+package teardowntest
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Recorder is the ordered log shared by several sinks and steps
+type Recorder struct {
+	sync.Mutex
+	events []string
+}
+
+// Record appends event to the log
+func (r *Recorder) Record(event string) {
+	r.Lock()
+	r.events = append(r.events, event)
+	r.Unlock()
+}
+
+// Events returns a copy of the log
+func (r *Recorder) Events() []string {
+	r.Lock()
+	defer r.Unlock()
+	return append([]string(nil), r.events...)
+}
+
+// Sink records "<name>:<phase>" for every call. A non zero Delay for a phase
+// makes that call block until the delay passes or its context is cancelled,
+// recording "<name>:<phase>:cancelled" in the latter case.
+type Sink struct {
+	SinkName string
+	Recorder *Recorder
+	Delay    map[string]time.Duration
+}
+
+func (s *Sink) Name() string {
+	return s.SinkName
+}
+
+func (s *Sink) Flush(ctx context.Context) error {
+	return s.call(ctx, "flush")
+}
+
+func (s *Sink) Finalize(ctx context.Context) error {
+	return s.call(ctx, "finalize")
+}
+
+func (s *Sink) Drain(ctx context.Context) error {
+	return s.call(ctx, "drain")
+}
+
+func (s *Sink) Release() {
+	s.Recorder.Record(s.SinkName + ":release")
+}
+
+func (s *Sink) call(ctx context.Context, phase string) error {
+	if delay := s.Delay[phase]; delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			s.Recorder.Record(s.SinkName + ":" + phase + ":cancelled")
+			return ctx.Err()
+		}
+	}
+	s.Recorder.Record(s.SinkName + ":" + phase)
+	return nil
+}
@@ -0,0 +1,353 @@
+// Package tracing records spans, timed steps of some work, e.g. setting up
+// a publish, and exports them to an OpenTelemetry collector, see OTLP.
+// Spans carry W3C trace context: a span started under the traceparent
+// header of a request joins the trace of its caller, and requests made
+// under a span pass it on with Inject. A nil Tracer, and the nil spans it
+// starts, record nothing, so tracing costs nothing when it is off.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Header carries the trace context of a request
+const Header = "traceparent"
+
+// TraceID names a trace, the spans of one piece of work across services
+type TraceID [16]byte
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// SpanID names a span within its trace
+type SpanID [8]byte
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// SpanContext is what identifies a span across services
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	// Sampled spans are exported; the others are only passed on
+	Sampled bool
+}
+
+// Valid reports whether c names a span, IDs of zeros naming none
+func (c SpanContext) Valid() bool {
+	return c.TraceID != TraceID{} && c.SpanID != SpanID{}
+}
+
+// Traceparent is c as the value of Header
+func (c SpanContext) Traceparent() string {
+	flags := "00"
+	if c.Sampled {
+		flags = "01"
+	}
+	return "00-" + c.TraceID.String() + "-" + c.SpanID.String() + "-" + flags
+}
+
+// ParseTraceparent reads the value of Header, version 00 or a later one
+// with the same fields first
+func ParseTraceparent(value string) (SpanContext, bool) {
+	var c SpanContext
+	fields := strings.Split(strings.TrimSpace(value), "-")
+	if len(fields) < 4 || len(fields[0]) != 2 || fields[0] == "ff" || (fields[0] == "00" && len(fields) != 4) {
+		return c, false
+	}
+	if len(fields[1]) != 32 || len(fields[2]) != 16 || len(fields[3]) != 2 {
+		return c, false
+	}
+	if _, err := hex.Decode(c.TraceID[:], []byte(fields[1])); err != nil {
+		return c, false
+	}
+	if _, err := hex.Decode(c.SpanID[:], []byte(fields[2])); err != nil {
+		return c, false
+	}
+	flags, err := hex.DecodeString(fields[3])
+	if err != nil {
+		return c, false
+	}
+	c.Sampled = flags[0]&1 == 1
+	return c, c.Valid()
+}
+
+type contextKey int
+
+const (
+	spanKey contextKey = iota
+	remoteKey
+)
+
+// ContextWith is ctx under span; a nil span leaves ctx as it is
+func ContextWith(ctx context.Context, span *Span) context.Context {
+	if span == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey, span)
+}
+
+// FromContext is the span ctx is under, nil if none
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey).(*Span)
+	return span
+}
+
+// parent is the context of the span ctx is under, local or remote
+func parent(ctx context.Context) (SpanContext, bool) {
+	if span := FromContext(ctx); span != nil {
+		return span.context, true
+	}
+	remote, ok := ctx.Value(remoteKey).(SpanContext)
+	return remote, ok
+}
+
+// Extract is ctx under the span header names, the caller's, if any; the
+// spans started from it join its trace
+func Extract(ctx context.Context, header http.Header) context.Context {
+	if header == nil {
+		return ctx
+	}
+	remote, ok := ParseTraceparent(header.Get(Header))
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteKey, remote)
+}
+
+// Inject sets Header to the span ctx is under, if any, for the request
+// to be part of its trace
+func Inject(ctx context.Context, header http.Header) {
+	if c, ok := parent(ctx); ok {
+		header.Set(Header, c.Traceparent())
+	}
+}
+
+// Event is something that happened at a point of a span
+type Event struct {
+	Name string
+	Time time.Time
+}
+
+// Span is a timed step of some work. Its methods are safe for concurrent
+// use, and do nothing on a nil span.
+type Span struct {
+	tracer  *Tracer
+	name    string
+	context SpanContext
+	parent  SpanID
+
+	lock       sync.Mutex
+	start, end time.Time
+	attributes map[string]interface{}
+	events     []Event
+	err        string
+	ended      bool
+}
+
+// Context identifies s, the zero context for a nil span
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.context
+}
+
+// Name is what s is a step of
+func (s *Span) Name() string {
+	if s == nil {
+		return ""
+	}
+	return s.name
+}
+
+// StartTime is when s started, zero for a nil span
+func (s *Span) StartTime() time.Time {
+	if s == nil {
+		return time.Time{}
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.start
+}
+
+// SetAttribute describes s with key, value a string, bool, integer or
+// float
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.attributes[key] = value
+}
+
+// AddEvent marks name as happening now in s
+func (s *Span) AddEvent(name string) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.events = append(s.events, Event{Name: name, Time: time.Now()})
+}
+
+// Fail marks s as failed with err
+func (s *Span) Fail(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.err = err.Error()
+}
+
+// End ends s now, see EndAt
+func (s *Span) End() {
+	s.EndAt(time.Now())
+}
+
+// EndAt ends s at end and queues it for export, once: spans already ended
+// are left as they are
+func (s *Span) EndAt(end time.Time) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	if s.ended {
+		s.lock.Unlock()
+		return
+	}
+	s.ended, s.end = true, end
+	s.lock.Unlock()
+	if s.context.Sampled {
+		s.tracer.queue(s)
+	}
+}
+
+// Ended reports whether s ended
+func (s *Span) Ended() bool {
+	if s == nil {
+		return true
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.ended
+}
+
+// Record adds the child of s name, a step that began at start and took d
+func (s *Span) Record(name string, start time.Time, d time.Duration) {
+	if s == nil {
+		return
+	}
+	_, child := s.tracer.StartAt(ContextWith(context.Background(), s), name, start)
+	child.EndAt(start.Add(d))
+}
+
+// Exporter sends ended spans somewhere
+type Exporter interface {
+	Export(ctx context.Context, spans []*Span) error
+}
+
+// MaxQueued bounds the spans waiting for export; spans ended past it are
+// dropped
+const MaxQueued = 2048
+
+// Tracer starts spans and exports them, in batches, see Run
+type Tracer struct {
+	exporter Exporter
+
+	lock    sync.Mutex
+	queued  []*Span
+	dropped int
+}
+
+// New makes a tracer exporting to exporter
+func New(exporter Exporter) *Tracer {
+	return &Tracer{exporter: exporter}
+}
+
+// Start starts the span name now, see StartAt
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, *Span) {
+	return t.StartAt(ctx, name, time.Now())
+}
+
+// StartAt starts the span name at start, the child of the span ctx is
+// under, else the root of a new trace, and returns ctx under it
+func (t *Tracer) StartAt(ctx context.Context, name string, start time.Time) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	s := &Span{tracer: t, name: name, start: start, attributes: map[string]interface{}{}}
+	if p, ok := parent(ctx); ok {
+		s.context.TraceID, s.context.Sampled, s.parent = p.TraceID, p.Sampled, p.SpanID
+	} else {
+		rand.Read(s.context.TraceID[:])
+		s.context.Sampled = true
+	}
+	rand.Read(s.context.SpanID[:])
+	return ContextWith(ctx, s), s
+}
+
+func (t *Tracer) queue(s *Span) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.queued) >= MaxQueued {
+		t.dropped++
+		return
+	}
+	t.queued = append(t.queued, s)
+}
+
+// Dropped counts the spans dropped for a full queue
+func (t *Tracer) Dropped() int {
+	if t == nil {
+		return 0
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.dropped
+}
+
+// Flush exports the spans ended so far; those that fail to export are
+// dropped rather than piling up while the collector is down
+func (t *Tracer) Flush(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	t.lock.Lock()
+	batch := t.queued
+	t.queued = nil
+	t.lock.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+	return t.exporter.Export(ctx, batch)
+}
+
+// Run flushes t every interval until done is closed, reporting failed
+// exports to failed
+func (t *Tracer) Run(interval time.Duration, done <-chan struct{}, failed func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			if err := t.Flush(ctx); err != nil && failed != nil {
+				failed(err)
+			}
+			cancel()
+		}
+	}
+}
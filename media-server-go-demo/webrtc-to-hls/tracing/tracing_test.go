@@ -0,0 +1,151 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTraceparent(t *testing.T) {
+	value := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	c, ok := ParseTraceparent(value)
+	if !ok || !c.Sampled || c.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || c.SpanID.String() != "00f067aa0ba902b7" {
+		t.Fatalf("ParseTraceparent = %+v, %v", c, ok)
+	}
+	if c.Traceparent() != value {
+		t.Fatalf("Traceparent = %s", c.Traceparent())
+	}
+	if c, ok := ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-future"); !ok || c.Sampled {
+		t.Fatalf("later version: %+v, %v", c, ok)
+	}
+	for _, bad := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6-00f067aa0ba902b7-01",
+	} {
+		if _, ok := ParseTraceparent(bad); ok {
+			t.Errorf("ParseTraceparent(%q) ok", bad)
+		}
+	}
+}
+
+type exported struct {
+	spans []*Span
+}
+
+func (e *exported) Export(ctx context.Context, spans []*Span) error {
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func TestSpans(t *testing.T) {
+	var nilTracer *Tracer
+	ctx, span := nilTracer.Start(context.Background(), "off")
+	span.SetAttribute("stream", "key")
+	span.End()
+	if span != nil || FromContext(ctx) != nil || nilTracer.Flush(ctx) != nil {
+		t.Fatal("a nil tracer recorded")
+	}
+
+	e := &exported{}
+	tracer := New(e)
+	header := http.Header{}
+	header.Set(Header, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, root := tracer.Start(Extract(context.Background(), header), "publish")
+	_, child := tracer.Start(ctx, "transport.create")
+	root.Record("sdp.parse", time.Now(), time.Millisecond)
+	if root.Context().TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || root.parent.String() != "00f067aa0ba902b7" {
+		t.Fatalf("root did not join the caller's trace: %+v", root.Context())
+	}
+	if child.Context().TraceID != root.Context().TraceID || child.parent != root.Context().SpanID {
+		t.Fatal("child not under root")
+	}
+	outgoing := http.Header{}
+	Inject(ctx, outgoing)
+	if outgoing.Get(Header) != root.Context().Traceparent() {
+		t.Fatalf("injected %q", outgoing.Get(Header))
+	}
+
+	child.End()
+	child.End()
+	tracer.Flush(ctx)
+	if len(e.spans) != 2 || e.spans[0].name != "sdp.parse" || e.spans[1] != child {
+		t.Fatalf("exported %d spans before the root ended", len(e.spans))
+	}
+	root.End()
+	tracer.Flush(ctx)
+	if len(e.spans) != 3 || !root.Ended() {
+		t.Fatalf("exported %d spans", len(e.spans))
+	}
+
+	header.Set(Header, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	_, unsampled := tracer.Start(Extract(context.Background(), header), "publish")
+	unsampled.End()
+	tracer.Flush(ctx)
+	if len(e.spans) != 3 {
+		t.Fatal("exported a span its caller did not sample")
+	}
+}
+
+func TestOTLP(t *testing.T) {
+	var got map[string]interface{}
+	var auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &got)
+		auth = r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+
+	o := &OTLP{URL: server.URL + "/v1/traces", Service: "webrtc-to-hls", Headers: map[string]string{"Authorization": "Bearer t"}}
+	tracer := New(o)
+	_, span := tracer.StartAt(context.Background(), "publish", time.Unix(1700000000, 0))
+	span.SetAttribute("stream", "key")
+	span.SetAttribute("audio", true)
+	span.SetAttribute("time_to_first_segment_ms", 2500)
+	span.AddEvent("first video frame")
+	span.Fail(context.DeadlineExceeded)
+	span.EndAt(time.Unix(1700000002, 500000000))
+	if err := tracer.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if auth != "Bearer t" {
+		t.Fatal("headers not sent")
+	}
+	resource := got["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	service := resource["resource"].(map[string]interface{})["attributes"].([]interface{})[0].(map[string]interface{})
+	if service["key"] != "service.name" || service["value"].(map[string]interface{})["stringValue"] != "webrtc-to-hls" {
+		t.Fatalf("resource = %v", resource["resource"])
+	}
+	spans := resource["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})
+	exported := spans[0].(map[string]interface{})
+	if exported["name"] != "publish" || exported["traceId"] != span.Context().TraceID.String() || exported["parentSpanId"] != nil {
+		t.Fatalf("span = %v", exported)
+	}
+	if exported["startTimeUnixNano"] != "1700000000000000000" || exported["endTimeUnixNano"] != "1700000002500000000" {
+		t.Fatalf("times = %v, %v", exported["startTimeUnixNano"], exported["endTimeUnixNano"])
+	}
+	attributes := exported["attributes"].([]interface{})
+	first := attributes[1].(map[string]interface{})
+	if len(attributes) != 3 || first["key"] != "stream" || attributes[2].(map[string]interface{})["value"].(map[string]interface{})["intValue"] != "2500" {
+		t.Fatalf("attributes = %v", attributes)
+	}
+	if status := exported["status"].(map[string]interface{}); status["code"] != 2.0 {
+		t.Fatalf("status = %v", status)
+	}
+
+	server.Close()
+	_, span = tracer.Start(context.Background(), "publish")
+	span.End()
+	if err := tracer.Flush(context.Background()); err == nil {
+		t.Fatal("export to a closed collector succeeded")
+	}
+}
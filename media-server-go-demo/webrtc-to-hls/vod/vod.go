@@ -0,0 +1,150 @@
+// Package vod keeps the catalog of VOD assets left behind by live streams:
+// each asset is a directory holding an HLS playlist that ends with
+// EXT-X-ENDLIST and the segments it lists. The catalog is persisted next to
+// the assets so they survive restarts.
+package vod
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned for an asset the catalog does not hold
+var ErrNotFound = errors.New("vod: no such asset")
+
+// indexName is the file the catalog is persisted to, in its directory
+const indexName = "index.json"
+
+// Asset is one VOD asset
+type Asset struct {
+	ID string `json:"id"`
+	// Stream is the stream key the asset was published under, and Session
+	// the id of the publish
+	Stream   string    `json:"stream"`
+	Session  string    `json:"session"`
+	Created  time.Time `json:"created"`
+	Duration float64   `json:"duration"`
+	Segments int       `json:"segments"`
+}
+
+// Catalog is the set of assets below a directory, one subdirectory each
+type Catalog struct {
+	dir string
+
+	mu     sync.Mutex
+	assets map[string]Asset
+}
+
+// Open loads the catalog of dir, creating dir
+func Open(dir string) (*Catalog, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c := &Catalog{dir: dir, assets: map[string]Asset{}}
+	data, err := ioutil.ReadFile(filepath.Join(dir, indexName))
+	switch {
+	case os.IsNotExist(err):
+		return c, nil
+	case err != nil:
+		return nil, err
+	}
+	var assets []Asset
+	if err := json.Unmarshal(data, &assets); err != nil {
+		return nil, err
+	}
+	for _, a := range assets {
+		c.assets[a.ID] = a
+	}
+	return c, nil
+}
+
+// NewID returns the id of a new asset
+func NewID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// Dir is the directory of the asset id
+func (c *Catalog) Dir(id string) string {
+	return filepath.Join(c.dir, id)
+}
+
+// Add registers a, whose directory is complete
+func (c *Catalog) Add(a Asset) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.assets[a.ID] = a
+	return c.save()
+}
+
+// Get returns the asset id
+func (c *Catalog) Get(id string) (Asset, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	a, ok := c.assets[id]
+	return a, ok
+}
+
+// List returns the assets of stream, every asset when stream is empty,
+// newest first
+func (c *Catalog) List(stream string) []Asset {
+	c.mu.Lock()
+	list := make([]Asset, 0, len(c.assets))
+	for _, a := range c.assets {
+		if stream == "" || a.Stream == stream {
+			list = append(list, a)
+		}
+	}
+	c.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].Created.Equal(list[j].Created) {
+			return list[i].Created.After(list[j].Created)
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// Remove unregisters the asset id and deletes its directory
+func (c *Catalog) Remove(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.assets[id]; !ok {
+		return ErrNotFound
+	}
+	delete(c.assets, id)
+	if err := c.save(); err != nil {
+		return err
+	}
+	return os.RemoveAll(c.Dir(id))
+}
+
+// save writes the index, with the lock held, through a temporary file so
+// a crash never leaves half of it
+func (c *Catalog) save() error {
+	assets := make([]Asset, 0, len(c.assets))
+	for _, a := range c.assets {
+		assets = append(assets, a)
+	}
+	sort.Slice(assets, func(i, j int) bool { return assets[i].ID < assets[j].ID })
+	data, err := json.MarshalIndent(assets, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(c.dir, indexName+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(c.dir, indexName))
+}
@@ -0,0 +1,55 @@
+package vod
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCatalog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1760000000, 0).UTC()
+	for _, a := range []Asset{
+		{ID: "a", Stream: "main", Created: now},
+		{ID: "b", Stream: "main", Created: now.Add(time.Hour)},
+		{ID: "c", Stream: "other", Created: now},
+	} {
+		os.MkdirAll(c.Dir(a.ID), 0755)
+		if err := c.Add(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if list := c.List("main"); len(list) != 2 || list[0].ID != "b" {
+		t.Fatalf("list = %v", list)
+	}
+	if err := c.Remove("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(c.Dir("a")); !os.IsNotExist(err) {
+		t.Fatal("directory of a removed asset left")
+	}
+	if err := c.Remove("a"); err != ErrNotFound {
+		t.Fatalf("second remove = %v", err)
+	}
+
+	reopened, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, ok := reopened.Get("b"); !ok || !a.Created.Equal(now.Add(time.Hour)) || len(reopened.List("")) != 2 {
+		t.Fatalf("reopened = %v", reopened.List(""))
+	}
+	if _, err := os.Stat(filepath.Join(dir, indexName+".tmp")); !os.IsNotExist(err) {
+		t.Fatal("temporary index left")
+	}
+}
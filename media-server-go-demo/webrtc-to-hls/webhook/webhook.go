@@ -0,0 +1,149 @@
+// Package webhook posts lifecycle events of streams to HTTP endpoints. Each
+// request is signed with the secret of its endpoint, HMAC-SHA256 over the
+// timestamp and the body, so receivers can check it came from here and is
+// recent. Delivery makes one attempt; retrying is left to the caller. The
+// request carries the trace of its context, see tracing.Inject.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/notedit/media-server-go-demo/webrtc-to-hls/tracing"
+)
+
+// headers of a delivery
+const (
+	SignatureHeader = "X-Webhook-Signature"
+	EventHeader     = "X-Webhook-Event"
+	IDHeader        = "X-Webhook-Id"
+)
+
+var (
+	ErrBadSignature = errors.New("webhook: bad signature")
+	ErrExpired      = errors.New("webhook: signature timestamp out of tolerance")
+)
+
+// Event is what a delivery posts
+type Event struct {
+	// ID is the same across the attempts of one event, for receivers to
+	// drop duplicates
+	ID     string                 `json:"id"`
+	Type   string                 `json:"type"`
+	Time   time.Time              `json:"time"`
+	Stream string                 `json:"stream"`
+	Data   map[string]interface{} `json:"data,omitempty"`
+}
+
+// Endpoint is where events are posted
+type Endpoint struct {
+	URL    string
+	Secret []byte
+	// Events are the types posted, every type when empty
+	Events []string
+}
+
+// Wants reports whether events of kind are posted to e
+func (e *Endpoint) Wants(kind string) bool {
+	if len(e.Events) == 0 {
+		return true
+	}
+	for _, event := range e.Events {
+		if event == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Sign returns the signature header of body sent at timestamp, in unix
+// seconds: t=<timestamp>,v1=<hex HMAC-SHA256 of "<timestamp>.<body>">
+func Sign(secret []byte, timestamp int64, body []byte) string {
+	return fmt.Sprintf("t=%d,v1=%s", timestamp, hex.EncodeToString(mac(secret, timestamp, body)))
+}
+
+func mac(secret []byte, timestamp int64, body []byte) []byte {
+	m := hmac.New(sha256.New, secret)
+	m.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	m.Write([]byte{'.'})
+	m.Write(body)
+	return m.Sum(nil)
+}
+
+// Verify checks the signature header of body, signed at most tolerance
+// before or after now, as receivers do
+func Verify(secret []byte, header string, body []byte, now time.Time, tolerance time.Duration) error {
+	var timestamp int64
+	var signature []byte
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return ErrBadSignature
+		}
+		switch kv[0] {
+		case "t":
+			t, err := strconv.ParseInt(kv[1], 10, 64)
+			if err != nil {
+				return ErrBadSignature
+			}
+			timestamp = t
+		case "v1":
+			s, err := hex.DecodeString(kv[1])
+			if err != nil {
+				return ErrBadSignature
+			}
+			signature = s
+		}
+	}
+	if timestamp == 0 || signature == nil || !hmac.Equal(signature, mac(secret, timestamp, body)) {
+		return ErrBadSignature
+	}
+	if d := now.Sub(time.Unix(timestamp, 0)); d > tolerance || d < -tolerance {
+		return ErrExpired
+	}
+	return nil
+}
+
+// Deliver posts event to endpoint, signed at now; any answer but 2xx is an
+// error
+func Deliver(ctx context.Context, client *http.Client, endpoint *Endpoint, event Event, now time.Time) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, event.Type)
+	req.Header.Set(IDHeader, event.ID)
+	req.Header.Set(SignatureHeader, Sign(endpoint.Secret, now.Unix(), body))
+	tracing.Inject(ctx, req.Header)
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		detail, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("webhook: %s %s: %s %s", event.Type, endpoint.URL, resp.Status, strings.TrimSpace(string(detail)))
+	}
+	return nil
+}
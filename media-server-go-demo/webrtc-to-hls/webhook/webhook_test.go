@@ -0,0 +1,73 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignature(t *testing.T) {
+	secret, body := []byte("secret"), []byte(`{"type":"stream.started"}`)
+	now := time.Unix(1700000000, 0)
+	header := Sign(secret, now.Unix(), body)
+	if !strings.HasPrefix(header, "t=1700000000,v1=") {
+		t.Fatalf("header = %s", header)
+	}
+	if err := Verify(secret, header, body, now.Add(time.Minute), 5*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify([]byte("other"), header, body, now, time.Minute); err != ErrBadSignature {
+		t.Fatalf("other secret: %v", err)
+	}
+	if err := Verify(secret, header, []byte(`{}`), now, time.Minute); err != ErrBadSignature {
+		t.Fatalf("other body: %v", err)
+	}
+	if err := Verify(secret, header, body, now.Add(time.Hour), time.Minute); err != ErrExpired {
+		t.Fatalf("replayed: %v", err)
+	}
+	for _, bad := range []string{"", "t=1", "v1=zz,t=1700000000", "nonsense"} {
+		if err := Verify(secret, bad, body, now, time.Minute); err != ErrBadSignature {
+			t.Errorf("Verify(%q) = %v", bad, err)
+		}
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	endpoint := &Endpoint{Secret: []byte("secret"), Events: []string{"stream.started"}}
+	if !endpoint.Wants("stream.started") || endpoint.Wants("stream.ended") || !(&Endpoint{}).Wants("stream.ended") {
+		t.Fatal("event filter")
+	}
+	status := http.StatusNoContent
+	var got Event
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := Verify(endpoint.Secret, r.Header.Get(SignatureHeader), body, time.Now(), time.Minute); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get(EventHeader) != "stream.started" || r.Header.Get(IDHeader) != "e1" {
+			http.Error(w, "headers", http.StatusBadRequest)
+			return
+		}
+		json.Unmarshal(body, &got)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	endpoint.URL = server.URL
+	event := Event{ID: "e1", Type: "stream.started", Time: time.Now(), Stream: "live", Data: map[string]interface{}{"session": "s1"}}
+	if err := Deliver(context.Background(), nil, endpoint, event, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if got.Stream != "live" || got.Data["session"] != "s1" {
+		t.Fatalf("delivered %+v", got)
+	}
+	status = http.StatusServiceUnavailable
+	if err := Deliver(context.Background(), nil, endpoint, event, time.Now()); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("failed delivery = %v", err)
+	}
+}
@@ -41,6 +41,8 @@ func NewEndpointWithPort(ip string, port int) *Endpoint {
 	endpoint.bundle.Init(port)
 	endpoint.transports = make(map[string]*Transport)
 	endpoint.fingerprint = native.MediaServerGetFingerprint().ToString()
+	endpoint.mirroredStreams = make(map[string]*IncomingStream)
+	endpoint.mirroredTracks = make(map[string]*IncomingStreamTrack)
 	endpoint.candidate = sdp.NewCandidateInfo("1", 1, "UDP", 33554431, ip, endpoint.bundle.GetLocalPort(), "host", "", 0)
 	return endpoint
 }
@@ -1,5 +1,7 @@
 module github.com/notedit/media-server-go
 
+go 1.27.1
+
 require (
 	github.com/Jeffail/gabs v1.1.1
 	github.com/chuckpreslar/emission v0.0.0-20170206194824-a7ddd980baf9
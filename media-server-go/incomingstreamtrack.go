@@ -3,6 +3,7 @@ package mediaserver
 import (
 	"sort"
 	"strconv"
+	"sync"
 	"time"
 
 	native "github.com/notedit/media-server-go/wrapper"
@@ -61,7 +62,9 @@ type IncomingStreamTrack struct {
 	encodings             []*Encoding
 	trackInfo             *sdp.TrackInfo
 	stats                 map[string]*IncomingAllStats
+	statsLock             sync.Mutex
 	mediaframeMultiplexer *MediaFrameMultiplexer
+	mediaframeEncoding    string
 	onStopListeners       []func()
 	onAttachedListeners   []func()
 	onDetachedListeners   []func()
@@ -79,6 +82,10 @@ type IncomingStats struct {
 	TotalNACKs     uint
 	Bitrate        uint
 	Layers         []*Layer
+	// LastSenderReportNTP is the NTP timestamp carried by the last RTCP sender report
+	LastSenderReportNTP uint64
+	// LastSenderReportTime is the local time the last sender report arrived, in microseconds since the epoch
+	LastSenderReportTime uint64
 }
 
 // IncomingAllStats info
@@ -92,6 +99,8 @@ type IncomingAllStats struct {
 	Fec          *IncomingStats
 	Bitrate      uint
 	Total        uint
+	// Remb is the bandwidth the transport estimates the publisher can send,
+	// in bits per second, as fed back in REMB; 0 before any estimate
 	Remb         uint
 	SimulcastIdx int
 	timestamp    int64
@@ -125,6 +134,9 @@ func getStatsFromIncomingSource(source native.RTPIncomingSource) *IncomingStats
 		TotalNACKs:     source.GetTotalNACKs(),
 		Bitrate:        source.GetBitrate(),
 		Layers:         []*Layer{},
+
+		LastSenderReportNTP:  source.GetLastReceivedSenderNTPTimestamp(),
+		LastSenderReportTime: source.GetLastReceivedSenderReport(),
 	}
 
 	layers := source.Layers()
@@ -273,6 +285,9 @@ func (i *IncomingStreamTrack) GetSSRCs() []map[string]native.RTPIncomingSource {
 // GetStats Get stats for all encodings
 func (i *IncomingStreamTrack) GetStats() map[string]*IncomingAllStats {
 
+	i.statsLock.Lock()
+	defer i.statsLock.Unlock()
+
 	if i.stats == nil {
 		i.stats = map[string]*IncomingAllStats{}
 	}
@@ -297,6 +312,7 @@ func (i *IncomingStreamTrack) GetStats() map[string]*IncomingAllStats {
 				Fec:         fec,
 				Bitrate:     media.Bitrate,
 				Total:       media.Bitrate + fec.Bitrate + rtx.Bitrate,
+				Remb:        encoding.GetSource().GetRemoteBitrateEstimation(),
 				timestamp:   time.Now().UnixNano(),
 			}
 		}
@@ -325,7 +341,20 @@ func (i *IncomingStreamTrack) GetStats() map[string]*IncomingAllStats {
 		}
 	}
 
-	return i.stats
+	// copies, the cache is updated by the next call while callers may still read them
+	snapshot := make(map[string]*IncomingAllStats, len(i.stats))
+	for id, state := range i.stats {
+		copied := *state
+		media := *state.Media
+		media.Layers = make([]*Layer, len(state.Media.Layers))
+		for j, layer := range state.Media.Layers {
+			copiedLayer := *layer
+			media.Layers[j] = &copiedLayer
+		}
+		copied.Media = &media
+		snapshot[id] = &copied
+	}
+	return snapshot
 }
 
 // GetActiveLayers Get active encodings and layers ordered by bitrate
@@ -484,12 +513,86 @@ func (i *IncomingStreamTrack) OnStop(stop func()) {
 func (i *IncomingStreamTrack) OnMediaFrame(listener func([]byte, uint)) {
 
 	if i.mediaframeMultiplexer == nil {
-		i.mediaframeMultiplexer = NewMediaFrameMultiplexer(i)
+		i.mediaframeMultiplexer = i.newMediaFrameMultiplexer()
 	}
 
 	i.mediaframeMultiplexer.SetMediaFrameListener(listener)
 }
 
+// OnRawMediaFrame callback with the video frames as depacketized, for codecs other than h264
+// which OnMediaFrame would convert to annexb
+func (i *IncomingStreamTrack) OnRawMediaFrame(listener func([]byte, uint)) {
+
+	if i.mediaframeMultiplexer == nil {
+		i.mediaframeMultiplexer = i.newMediaFrameMultiplexer()
+	}
+
+	i.mediaframeMultiplexer.SetRaw(true)
+	i.mediaframeMultiplexer.SetMediaFrameListener(listener)
+}
+
+// SetMediaFrameEncoding select the simulcast encoding the media frame callback gets, the first one by default.
+// A registered callback moves to the new encoding, the extension usage counters start over. Returns false
+// if the track has no such encoding
+func (i *IncomingStreamTrack) SetMediaFrameEncoding(encodingID string) bool {
+
+	encoding := i.GetEncoding(encodingID)
+	if encoding == nil {
+		return false
+	}
+
+	i.mediaframeEncoding = encodingID
+
+	if old := i.mediaframeMultiplexer; old != nil {
+		i.mediaframeMultiplexer = NewMediaFrameMultiplexerForEncoding(i, encoding)
+		i.mediaframeMultiplexer.SetRaw(old.raw)
+		i.mediaframeMultiplexer.SampleExtensions(old.sampled)
+		i.mediaframeMultiplexer.SetMediaFrameListener(old.mediaframeListener)
+		old.Stop()
+	}
+	return true
+}
+
+// GetMediaFrameEncoding get the id of the encoding the media frame callback gets
+func (i *IncomingStreamTrack) GetMediaFrameEncoding() string {
+
+	if i.mediaframeEncoding == "" && i.GetFirstEncoding() != nil {
+		return i.GetFirstEncoding().GetID()
+	}
+	return i.mediaframeEncoding
+}
+
+func (i *IncomingStreamTrack) newMediaFrameMultiplexer() *MediaFrameMultiplexer {
+
+	encoding := i.GetEncoding(i.mediaframeEncoding)
+	if encoding == nil {
+		encoding = i.GetFirstEncoding()
+	}
+	return NewMediaFrameMultiplexerForEncoding(i, encoding)
+}
+
+// SampleExtensions counts the header extensions of the first packets the media frame callback's
+// encoding receives, up to packets of them; see GetExtensionUsage
+func (i *IncomingStreamTrack) SampleExtensions(packets uint) {
+
+	if i.mediaframeMultiplexer == nil {
+		i.mediaframeMultiplexer = i.newMediaFrameMultiplexer()
+	}
+
+	i.mediaframeMultiplexer.SampleExtensions(packets)
+}
+
+// GetExtensionUsage returns the number of rtp packets sampled and how many carried each of the given
+// header extension uris, see SampleExtensions
+func (i *IncomingStreamTrack) GetExtensionUsage(uris []string) (uint, map[string]uint) {
+
+	if i.mediaframeMultiplexer == nil {
+		return 0, nil
+	}
+
+	return i.mediaframeMultiplexer.GetExtensionUsage(uris)
+}
+
 // Stop Removes the track from the incoming stream and also detaches any attached outgoing track or recorder
 func (i *IncomingStreamTrack) Stop() {
 
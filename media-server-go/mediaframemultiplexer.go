@@ -15,6 +15,10 @@ type MediaFrameMultiplexer struct {
 	listener   mediaframeListener // used for native wrapper, see swig's doc
 
 	mediaframeListener func([]byte, uint) // used for outside
+	// raw passes video frames as depacketized, see SetRaw
+	raw bool
+	// sampled is the number of packets whose extensions are counted, see SampleExtensions
+	sampled uint
 }
 
 
@@ -40,7 +44,8 @@ func (p *overwrittenMediaFrameListener) OnMediaFrame(frame native.MediaFrame) {
 
 	if p.multiplexer != nil && p.multiplexer.mediaframeListener != nil {
 		buffer := C.GoBytes(unsafe.Pointer(frame.GetData()), C.int(frame.GetLength()))
-		if frame.GetType() == native.MediaFrameVideo {
+		if frame.GetType() == native.MediaFrameVideo && !p.multiplexer.raw {
+			// buffer is ours, converted in place rather than copied again
 			data, err := annexbConvert(buffer)
 			if err == nil {
 				p.multiplexer.mediaframeListener(data, frame.GetTimeStamp())
@@ -57,11 +62,17 @@ func (p *overwrittenMediaFrameListener) OnMediaFrame(frame native.MediaFrame) {
 // NewMediaStreamDuplicater duplicate this IncomingStreamTrack and callback the mediaframe
 func NewMediaFrameMultiplexer(track *IncomingStreamTrack) *MediaFrameMultiplexer {
 
+	// We should make sure this source is the main source
+	return NewMediaFrameMultiplexerForEncoding(track, track.GetFirstEncoding())
+}
+
+// NewMediaFrameMultiplexerForEncoding callback the mediaframe data of one encoding of a simulcast track
+func NewMediaFrameMultiplexerForEncoding(track *IncomingStreamTrack, encoding *Encoding) *MediaFrameMultiplexer {
+
 	duplicater := &MediaFrameMultiplexer{}
 	duplicater.track = track
 
-	// We should make sure this source is the main source
-	source := track.GetFirstEncoding().GetSource()
+	source := encoding.GetSource()
 	duplicater.multiplexer = native.NewMediaFrameMultiplexer(source)
 
 	listener := &overwrittenMediaFrameListener{
@@ -77,11 +88,50 @@ func NewMediaFrameMultiplexer(track *IncomingStreamTrack) *MediaFrameMultiplexer
 	return duplicater
 }
 
+// headerExtensions maps the extension uris the native side parses to their RTPHeaderExtension::Type
+var headerExtensions = map[string]int{
+	"urn:ietf:params:rtp-hdrext:ssrc-audio-level":                               1,
+	"urn:ietf:params:rtp-hdrext:toffset":                                        2,
+	"http://www.webrtc.org/experiments/rtp-hdrext/abs-send-time":                3,
+	"urn:3gpp:video-orientation":                                                4,
+	"http://www.ietf.org/id/draft-holmer-rmcat-transport-wide-cc-extensions-01": 5,
+	"urn:ietf:params:rtp-hdrext:framemarking":                                   6,
+	"http://tools.ietf.org/html/draft-ietf-avtext-framemarking-07":              6,
+	"urn:ietf:params:rtp-hdrext:sdes:rtp-stream-id":                             7,
+	"urn:ietf:params:rtp-hdrext:sdes:repaired-rtp-stream-id":                    8,
+	"urn:ietf:params:rtp-hdrext:sdes:mid":                                       9,
+}
+
+// SampleExtensions counts the header extensions of the first packets received, up to packets of them.
+// The native side does not look at the extensions of later packets, nor of any when packets is 0
+func (d *MediaFrameMultiplexer) SampleExtensions(packets uint) {
+	d.sampled = packets
+	d.multiplexer.SetExtensionSampling(packets)
+}
+
+// GetExtensionUsage returns how many rtp packets were received and, for each of the given
+// extension uris, how many of them carried it. Uris the native side does not parse are not counted
+func (d *MediaFrameMultiplexer) GetExtensionUsage(uris []string) (uint, map[string]uint) {
+	usage := map[string]uint{}
+	for _, uri := range uris {
+		if ext, ok := headerExtensions[uri]; ok {
+			usage[uri] = d.multiplexer.GetExtensionPackets(ext)
+		}
+	}
+	return d.multiplexer.GetPackets(), usage
+}
+
 // SetMediaFrameListener set outside mediaframe listener
 func (d *MediaFrameMultiplexer) SetMediaFrameListener(listener func([]byte, uint)) {
 	d.mediaframeListener = listener
 }
 
+// SetRaw set whether video frames are passed as depacketized instead of converted to annexb,
+// as needed for codecs other than h264
+func (d *MediaFrameMultiplexer) SetRaw(raw bool) {
+	d.raw = raw
+}
+
 // Stop stop this
 func (d *MediaFrameMultiplexer) Stop() {
 
@@ -0,0 +1,51 @@
+package mediaserver
+
+import (
+	"sync"
+
+	native "github.com/notedit/media-server-go/wrapper"
+)
+
+// PCAPDumper dumps the rtp and rtcp packets of a transport into pcap files,
+// switched from one to the next, or stopped and restarted, while the
+// transport goes on. Unlike Transport.Dump, which dumps into a single file
+// for the life of the transport.
+type PCAPDumper struct {
+	dumper native.PCAPDumperFacade
+	sync.Mutex
+}
+
+// NewPCAPDumper create a dumper, dropping the packets until Rotate
+func NewPCAPDumper() *PCAPDumper {
+	return &PCAPDumper{dumper: native.NewPCAPDumperFacade()}
+}
+
+// Rotate dumps into filename from now on, closing the previous file
+func (d *PCAPDumper) Rotate(filename string) bool {
+	d.Lock()
+	defer d.Unlock()
+	if d.dumper == nil {
+		return false
+	}
+	return d.dumper.Rotate(filename) != 0
+}
+
+// Stop closes the file dumped into, the packets dropped until Rotate
+func (d *PCAPDumper) Stop() {
+	d.Lock()
+	defer d.Unlock()
+	if d.dumper != nil {
+		d.dumper.Stop()
+	}
+}
+
+// Delete closes the file and frees the dumper; the transports dumping
+// into it drop their packets from then on
+func (d *PCAPDumper) Delete() {
+	d.Lock()
+	defer d.Unlock()
+	if d.dumper != nil {
+		native.DeletePCAPDumperFacade(d.dumper)
+		d.dumper = nil
+	}
+}
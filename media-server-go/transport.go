@@ -44,11 +44,18 @@ func (d *goDTLSICETransportListener) deleteDTLSICETransportListener() {
 }
 
 type overwrittenDTLSICETransportListener struct {
-	p native.DTLSICETransportListener
+	p         native.DTLSICETransportListener
+	transport *Transport
 }
 
+// dtlsStates names the DTLS states of the native transport, in order
+var dtlsStates = []string{"new", "connecting", "connected", "closed", "failed"}
+
 func (p *overwrittenDTLSICETransportListener) OnDTLSStateChange(state uint) {
-	fmt.Println("OnDTLSStateChange", state)
+	if int(state) >= len(dtlsStates) {
+		return
+	}
+	p.transport.setDTLSState(dtlsStates[state])
 }
 
 type (
@@ -145,7 +152,7 @@ func NewTransport(bundle native.RTPBundleTransport, remoteIce *sdp.ICEInfo, remo
 	transport.senderSideListener = &goSenderSideEstimatorListener{SenderSideEstimatorListener: p}
 	transport.transport.SetSenderSideEstimatorListener(transport.senderSideListener)
 
-	dtlsListener := &overwrittenDTLSICETransportListener{}
+	dtlsListener := &overwrittenDTLSICETransportListener{transport: transport}
 	dtlsl := native.NewDirectorDTLSICETransportListener(dtlsListener)
 	dtlsListener.p = dtlsl
 
@@ -191,6 +198,17 @@ func (t *Transport) Dump(filename string, incoming bool, outgoing bool, rtcp boo
 	return true
 }
 
+// DumpTo dump incoming and outgoing rtp and rtcp packets into the files of dumper,
+// a transport dumps at most once, to a file or to a dumper
+func (t *Transport) DumpTo(dumper *PCAPDumper, incoming bool, outgoing bool, rtcp bool) bool {
+	dumper.Lock()
+	defer dumper.Unlock()
+	if dumper.dumper == nil {
+		return false
+	}
+	return dumper.dumper.Attach(t.transport, incoming, outgoing, rtcp) != 0
+}
+
 // SetBandwidthProbing Enable/Disable bitrate probing
 // This will send padding only RTX packets to allow bandwidth estimation algortithm to probe bitrate beyonf current sent values.
 // The ammoung of probing bitrate would be limited by the sender bitrate estimation and the limit set on the setMaxProbing Bitrate.
@@ -205,9 +223,22 @@ func (t *Transport) SetMaxProbingBitrate(bitrate uint) {
 
 // GetDTLSState  get dtls state
 func (t *Transport) GetDTLSState() string {
+	t.Lock()
+	defer t.Unlock()
 	return t.dtlsState
 }
 
+// setDTLSState records the DTLS state and tells the OnDTLSICEState listener
+func (t *Transport) setDTLSState(state string) {
+	t.Lock()
+	t.dtlsState = state
+	listener := t.outDTLSStateListener
+	t.Unlock()
+	if listener != nil {
+		listener(state)
+	}
+}
+
 // GetICEStats  get ice stats
 func (t *Transport) GetICEStats() ICEStats {
 
@@ -601,7 +632,9 @@ func (t *Transport) OnOutgoingTrack(listener OutgoingTrackListener) {
 
 // OnDTLSICEState  OnDTLSICEState
 func (t *Transport) OnDTLSICEState(listener DTLSStateListener) {
+	t.Lock()
 	t.outDTLSStateListener = listener
+	t.Unlock()
 }
 
 // Stop stop this transport
@@ -45,28 +45,24 @@ func u32be(b []byte) (i uint32) {
 
 var nalu_prefix = []byte{0, 0, 0, 1}
 
+// annexbConvert converts a frame of length prefixed NALUs to annexb in
+// place, each 4 byte length becoming a start code, so the frame is not
+// copied again; NALUs past a truncated one are dropped
 func annexbConvert(avc []byte) ([]byte, error) {
 	if len(avc) < 4 {
 		return nil, errors.New("too short")
 	}
-	val4 := u32be(avc)
-	_val4 := val4
-	_b := avc[4:]
-	annexb := []byte{}
-
-	for {
-		annexb = append(annexb, nalu_prefix...)
-		annexb = append(annexb, _b[:_val4]...)
-		_b = _b[_val4:]
-		if len(_b) < 4 {
-			break
-		}
-		_val4 = u32be(_b)
-		_b = _b[4:]
-		if _val4 > uint32(len(_b)) {
+	if u32be(avc) > uint32(len(avc)-4) {
+		return nil, errors.New("not length prefixed")
+	}
+	end := 0
+	for len(avc)-end >= 4 {
+		size := u32be(avc[end:])
+		if size > uint32(len(avc)-end-4) {
 			break
 		}
+		copy(avc[end:], nalu_prefix)
+		end += 4 + int(size)
 	}
-
-	return annexb, nil
+	return avc[:end], nil
 }
@@ -0,0 +1,41 @@
+package mediaserver
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAnnexbConvert(t *testing.T) {
+	avc := []byte{0, 0, 0, 2, 0x67, 0x42, 0, 0, 0, 1, 0x65, 0, 0, 0, 9, 0x41}
+	annexb, err := annexbConvert(avc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the last NALU is truncated and dropped
+	if want := []byte{0, 0, 0, 1, 0x67, 0x42, 0, 0, 0, 1, 0x65}; !bytes.Equal(annexb, want) {
+		t.Fatalf("annexb = %x, want %x", annexb, want)
+	}
+	if _, err := annexbConvert([]byte{0, 0, 0, 9, 0x65}); err == nil {
+		t.Fatal("converted a frame that is not length prefixed")
+	}
+}
+
+// BenchmarkAnnexbConvert converts a frame of a 6 Mbps stream at 30 fps, in
+// place: 0 allocs/op
+func BenchmarkAnnexbConvert(b *testing.B) {
+	frame := make([]byte, 25000)
+	nalus := [][]byte{make([]byte, 20), make([]byte, 4), make([]byte, len(frame)-36)}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(frame)))
+	for i := 0; i < b.N; i++ {
+		avc := frame[:0]
+		for _, nalu := range nalus {
+			n := len(nalu)
+			avc = append(avc, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+			avc = append(avc, nalu...)
+		}
+		if _, err := annexbConvert(avc); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+#!/usr/bin/env bash
+
+# Regenerates native.go, mediaserver_wrap.cxx and mediaserver_wrap.h from
+# mediaserver.i. Run it after build.sh, which copies the headers the
+# interface includes into ../include.
+#
+#   ./generate.sh          rewrite the generated files
+#   ./generate.sh --check  fail when the committed files differ from what
+#                          SWIG generates, e.g. after a hand edit
+
+set -e
+
+SWIG=${SWIG:-swig}
+SWIG_VERSION=4.0.0
+WRAPPER_DIR=$(cd "$(dirname "$0")" && pwd)
+GENERATED="native.go mediaserver_wrap.cxx mediaserver_wrap.h"
+
+version=$($SWIG -version | awk '/SWIG Version/ { print $3 }')
+if [ "$version" != "$SWIG_VERSION" ];
+then
+    echo "generate.sh: want SWIG $SWIG_VERSION, have ${version:-none}" >&2
+    exit 1
+fi
+
+OUT_DIR=$WRAPPER_DIR
+if [ "$1" == "--check" ];
+then
+    OUT_DIR=$(mktemp -d)
+    trap 'rm -rf "$OUT_DIR"' EXIT
+fi
+
+# The input is given relative so the "source:" comment stays mediaserver.i
+cd "$WRAPPER_DIR"
+$SWIG -go -cgo -c++ -intgosize 64 -module native \
+    -o "$OUT_DIR/mediaserver_wrap.cxx" -outdir "$OUT_DIR" mediaserver.i
+
+if [ "$1" != "--check" ];
+then
+    exit 0
+fi
+
+# The symbol suffix SWIG derives for the module is not compared, the
+# declarations and glue it names are
+status=0
+for f in $GENERATED;
+do
+    if ! diff -u \
+        <(sed -E 's/_native_[0-9a-f]{16}/_native_ID/g' "$WRAPPER_DIR/$f") \
+        <(sed -E 's/_native_[0-9a-f]{16}/_native_ID/g' "$OUT_DIR/$f") >&2;
+    then
+        echo "generate.sh: $f is not what SWIG generates from mediaserver.i" >&2
+        status=1
+    fi
+done
+exit $status
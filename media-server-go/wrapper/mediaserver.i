@@ -4,6 +4,7 @@
 #include <string>
 #include <list>
 #include <functional>
+#include <atomic>
 #include "../include/media-server/include/config.h"	
 #include "../include/media-server/include/dtls.h"
 #include "../include/media-server/include/OpenSSL.h"
@@ -14,6 +15,7 @@
 #include "../include/media-server/include/DTLSICETransport.h"	
 #include "../include/media-server/include/RTPBundleTransport.h"
 #include "../include/media-server/include/PCAPTransportEmulator.h"	
+#include "../include/media-server/include/PCAPFile.h"
 #include "../include/media-server/include/mp4recorder.h"
 #include "../include/media-server/include/mp4streamer.h"
 #include "../include/media-server/include/rtp/RTPStreamTransponder.h"
@@ -834,6 +836,95 @@ private:
 };
 
 
+class PCAPDumperFacade
+{
+public:
+	PCAPDumperFacade() :
+		current(std::make_shared<Current>())
+	{};
+
+	~PCAPDumperFacade()
+	{
+		Stop();
+	}
+
+	// Rotate goes on dumping into a new pcap file, closing the previous one
+	int Rotate(const char* filename)
+	{
+		PCAPFile* pcap = new PCAPFile();
+		if (!pcap->Open(filename))
+		{
+			delete pcap;
+			return 0;
+		}
+		ScopedLock lock(current->mutex);
+		if (current->pcap)
+		{
+			current->pcap->Close();
+			delete current->pcap;
+		}
+		current->pcap = pcap;
+		return 1;
+	}
+
+	// Stop closes the pcap file, the packets dropped until the next Rotate
+	void Stop()
+	{
+		ScopedLock lock(current->mutex);
+		if (current->pcap)
+		{
+			current->pcap->Close();
+			delete current->pcap;
+			current->pcap = nullptr;
+		}
+	}
+
+	// Attach dumps the packets of transport for as long as it lives: the
+	// transport owns and deletes the dumper it is given, so it is given a
+	// proxy sharing the current file rather than the facade
+	int Attach(DTLSICETransport* transport, bool inbound, bool outbound, bool rtcp)
+	{
+		Proxy* proxy = new Proxy(current);
+		if (!transport->Dump(proxy, inbound, outbound, rtcp))
+		{
+			delete proxy;
+			return 0;
+		}
+		return 1;
+	}
+private:
+	struct Current
+	{
+		Mutex mutex;
+		PCAPFile* pcap = nullptr;
+	};
+
+	class Proxy :
+		public UDPDumper
+	{
+	public:
+		Proxy(const std::shared_ptr<Current>& current) :
+			current(current)
+		{};
+
+		virtual void WriteUDP(uint64_t currentTimeMillis,uint32_t originIp, short originPort, uint32_t destIp, short destPort,const uint8_t* data, uint32_t size) override
+		{
+			ScopedLock lock(current->mutex);
+			if (current->pcap) current->pcap->WriteUDP(currentTimeMillis, originIp, originPort, destIp, destPort, data, size);
+		}
+
+		virtual void Close() override
+		{
+			// the file is closed by the facade
+		}
+	private:
+		std::shared_ptr<Current> current;
+	};
+
+	std::shared_ptr<Current> current;
+};
+
+
 class MediaFrameListener :
 	public MediaFrame::Listener
 {
@@ -866,6 +957,11 @@ public:
 		this->incomingSource->AddListener(this);
 		//No depkacketixer yet
 		depacketizer = NULL;
+		//Nothing sampled yet
+		sampled = 0;
+		packets = 0;
+		for (auto& count : extensionPackets)
+			count = 0;
 	}
 
 	virtual ~MediaFrameMultiplexer()
@@ -880,6 +976,8 @@ public:
 
 	virtual void onRTP(RTPIncomingMediaStream* group,const RTPPacket::shared& packet)
 	{
+		//Count which header extensions are actually sent
+		CountExtensions(packet);
 
 		if (listeners.empty()) 
 			return;
@@ -953,13 +1051,53 @@ public:
 		//Clean it
 		incomingSource = NULL;
 	}
+
+	DWORD GetPackets() const
+	{
+		return packets;
+	}
+
+	//Number of packets received carrying the RTPHeaderExtension::Type extension
+	DWORD GetExtensionPackets(int type) const
+	{
+		if (type<0 || type>RTPHeaderExtension::MediaStreamId)
+			return 0;
+		return extensionPackets[type];
+	}
+
+	//Count the header extensions of the first packets received, up to packets of them
+	void SetExtensionSampling(DWORD packets)
+	{
+		sampled = packets;
+	}
 	
 private:
+	void CountExtensions(const RTPPacket::shared& packet)
+	{
+		//Only the first packets are sampled, the counters are read from another thread
+		if (packets>=sampled)
+			return;
+		const RTPHeaderExtension& extension = packet->GetRTPHeaderExtension();
+		packets++;
+		if (extension.hasAudioLevel)		extensionPackets[RTPHeaderExtension::SSRCAudioLevel]++;
+		if (extension.hasTimeOffset)		extensionPackets[RTPHeaderExtension::TimeOffset]++;
+		if (extension.hasAbsSentTime)		extensionPackets[RTPHeaderExtension::AbsoluteSendTime]++;
+		if (extension.hasVideoOrientation)	extensionPackets[RTPHeaderExtension::CoordinationOfVideoOrientation]++;
+		if (extension.hasTransportWideCC)	extensionPackets[RTPHeaderExtension::TransportWideCC]++;
+		if (extension.hasFrameMarking)		extensionPackets[RTPHeaderExtension::FrameMarking]++;
+		if (extension.hasRId)			extensionPackets[RTPHeaderExtension::RTPStreamId]++;
+		if (extension.hasRepairedId)		extensionPackets[RTPHeaderExtension::RepairedRTPStreamId]++;
+		if (extension.hasMediaStreamId)		extensionPackets[RTPHeaderExtension::MediaStreamId]++;
+	}
+
 	typedef std::set<MediaFrameListener*> Listeners;
 private:
 	Listeners listeners;
 	RTPDepacketizer* depacketizer;
 	RTPIncomingMediaStream* incomingSource;
+	std::atomic<DWORD> sampled;
+	std::atomic<DWORD> packets;
+	std::atomic<DWORD> extensionPackets[RTPHeaderExtension::MediaStreamId+1];
 };
 
 %}
@@ -1124,6 +1262,7 @@ struct RTPIncomingSourceGroup : public RTPIncomingMediaStream
 	DWORD minWaitedTime;
 	DWORD maxWaitedTime;
 	double avgWaitedTime;
+	DWORD remoteBitrateEstimation;
 
 	void AddListener(RTPIncomingMediaStreamListener* listener);
 	void RemoveListener(RTPIncomingMediaStreamListener* listener);
@@ -1428,6 +1567,16 @@ public:
 };
 
 
+class PCAPDumperFacade
+{
+public:
+	PCAPDumperFacade();
+	int Rotate(const char* filename);
+	void Stop();
+	int Attach(DTLSICETransport* transport, bool inbound, bool outbound, bool rtcp);
+};
+
+
 class MediaFrameListener 
 {
 public:
@@ -1444,6 +1593,9 @@ public:
 	void AddMediaListener(MediaFrameListener* listener);
 	void RemoveMediaListener(MediaFrameListener* listener);
 	void Stop();
+	DWORD GetPackets() const;
+	DWORD GetExtensionPackets(int type) const;
+	void SetExtensionSampling(DWORD packets);
 };
 
 
@@ -349,6 +349,7 @@ static void* Swig_malloc(int c) {
 #include <string>
 #include <list>
 #include <functional>
+#include <atomic>
 #include "../include/media-server/include/config.h"	
 #include "../include/media-server/include/dtls.h"
 #include "../include/media-server/include/OpenSSL.h"
@@ -359,6 +360,7 @@ static void* Swig_malloc(int c) {
 #include "../include/media-server/include/DTLSICETransport.h"	
 #include "../include/media-server/include/RTPBundleTransport.h"
 #include "../include/media-server/include/PCAPTransportEmulator.h"	
+#include "../include/media-server/include/PCAPFile.h"
 #include "../include/media-server/include/mp4recorder.h"
 #include "../include/media-server/include/mp4streamer.h"
 #include "../include/media-server/include/rtp/RTPStreamTransponder.h"
@@ -1179,6 +1181,95 @@ private:
 };
 
 
+class PCAPDumperFacade
+{
+public:
+	PCAPDumperFacade() :
+		current(std::make_shared<Current>())
+	{};
+
+	~PCAPDumperFacade()
+	{
+		Stop();
+	}
+
+	// Rotate goes on dumping into a new pcap file, closing the previous one
+	int Rotate(const char* filename)
+	{
+		PCAPFile* pcap = new PCAPFile();
+		if (!pcap->Open(filename))
+		{
+			delete pcap;
+			return 0;
+		}
+		ScopedLock lock(current->mutex);
+		if (current->pcap)
+		{
+			current->pcap->Close();
+			delete current->pcap;
+		}
+		current->pcap = pcap;
+		return 1;
+	}
+
+	// Stop closes the pcap file, the packets dropped until the next Rotate
+	void Stop()
+	{
+		ScopedLock lock(current->mutex);
+		if (current->pcap)
+		{
+			current->pcap->Close();
+			delete current->pcap;
+			current->pcap = nullptr;
+		}
+	}
+
+	// Attach dumps the packets of transport for as long as it lives: the
+	// transport owns and deletes the dumper it is given, so it is given a
+	// proxy sharing the current file rather than the facade
+	int Attach(DTLSICETransport* transport, bool inbound, bool outbound, bool rtcp)
+	{
+		Proxy* proxy = new Proxy(current);
+		if (!transport->Dump(proxy, inbound, outbound, rtcp))
+		{
+			delete proxy;
+			return 0;
+		}
+		return 1;
+	}
+private:
+	struct Current
+	{
+		Mutex mutex;
+		PCAPFile* pcap = nullptr;
+	};
+
+	class Proxy :
+		public UDPDumper
+	{
+	public:
+		Proxy(const std::shared_ptr<Current>& current) :
+			current(current)
+		{};
+
+		virtual void WriteUDP(uint64_t currentTimeMillis,uint32_t originIp, short originPort, uint32_t destIp, short destPort,const uint8_t* data, uint32_t size) override
+		{
+			ScopedLock lock(current->mutex);
+			if (current->pcap) current->pcap->WriteUDP(currentTimeMillis, originIp, originPort, destIp, destPort, data, size);
+		}
+
+		virtual void Close() override
+		{
+			// the file is closed by the facade
+		}
+	private:
+		std::shared_ptr<Current> current;
+	};
+
+	std::shared_ptr<Current> current;
+};
+
+
 class MediaFrameListener :
 	public MediaFrame::Listener
 {
@@ -1211,6 +1302,11 @@ public:
 		this->incomingSource->AddListener(this);
 		//No depkacketixer yet
 		depacketizer = NULL;
+		//Nothing sampled yet
+		sampled = 0;
+		packets = 0;
+		for (auto& count : extensionPackets)
+			count = 0;
 	}
 
 	virtual ~MediaFrameMultiplexer()
@@ -1225,6 +1321,8 @@ public:
 
 	virtual void onRTP(RTPIncomingMediaStream* group,const RTPPacket::shared& packet)
 	{
+		//Count which header extensions are actually sent
+		CountExtensions(packet);
 
 		if (listeners.empty()) 
 			return;
@@ -1298,13 +1396,53 @@ public:
 		//Clean it
 		incomingSource = NULL;
 	}
+
+	DWORD GetPackets() const
+	{
+		return packets;
+	}
+
+	//Number of packets received carrying the RTPHeaderExtension::Type extension
+	DWORD GetExtensionPackets(int type) const
+	{
+		if (type<0 || type>RTPHeaderExtension::MediaStreamId)
+			return 0;
+		return extensionPackets[type];
+	}
+
+	//Count the header extensions of the first packets received, up to packets of them
+	void SetExtensionSampling(DWORD packets)
+	{
+		sampled = packets;
+	}
 	
 private:
+	void CountExtensions(const RTPPacket::shared& packet)
+	{
+		//Only the first packets are sampled, the counters are read from another thread
+		if (packets>=sampled)
+			return;
+		const RTPHeaderExtension& extension = packet->GetRTPHeaderExtension();
+		packets++;
+		if (extension.hasAudioLevel)		extensionPackets[RTPHeaderExtension::SSRCAudioLevel]++;
+		if (extension.hasTimeOffset)		extensionPackets[RTPHeaderExtension::TimeOffset]++;
+		if (extension.hasAbsSentTime)		extensionPackets[RTPHeaderExtension::AbsoluteSendTime]++;
+		if (extension.hasVideoOrientation)	extensionPackets[RTPHeaderExtension::CoordinationOfVideoOrientation]++;
+		if (extension.hasTransportWideCC)	extensionPackets[RTPHeaderExtension::TransportWideCC]++;
+		if (extension.hasFrameMarking)		extensionPackets[RTPHeaderExtension::FrameMarking]++;
+		if (extension.hasRId)			extensionPackets[RTPHeaderExtension::RTPStreamId]++;
+		if (extension.hasRepairedId)		extensionPackets[RTPHeaderExtension::RepairedRTPStreamId]++;
+		if (extension.hasMediaStreamId)		extensionPackets[RTPHeaderExtension::MediaStreamId]++;
+	}
+
 	typedef std::set<MediaFrameListener*> Listeners;
 private:
 	Listeners listeners;
 	RTPDepacketizer* depacketizer;
 	RTPIncomingMediaStream* incomingSource;
+	std::atomic<DWORD> sampled;
+	std::atomic<DWORD> packets;
+	std::atomic<DWORD> extensionPackets[RTPHeaderExtension::MediaStreamId+1];
 };
 
 
@@ -4748,6 +4886,31 @@ double _wrap_RTPIncomingSourceGroup_avgWaitedTime_get_native_4b7afac4175a7297(RT
 }
 
 
+void _wrap_RTPIncomingSourceGroup_remoteBitrateEstimation_set_native_4b7afac4175a7297(RTPIncomingSourceGroup *_swig_go_0, intgo _swig_go_1) {
+  RTPIncomingSourceGroup *arg1 = (RTPIncomingSourceGroup *) 0 ;
+  uint32_t arg2 ;
+  
+  arg1 = *(RTPIncomingSourceGroup **)&_swig_go_0; 
+  arg2 = (uint32_t)_swig_go_1; 
+  
+  if (arg1) (arg1)->remoteBitrateEstimation = arg2;
+  
+}
+
+
+intgo _wrap_RTPIncomingSourceGroup_remoteBitrateEstimation_get_native_4b7afac4175a7297(RTPIncomingSourceGroup *_swig_go_0) {
+  RTPIncomingSourceGroup *arg1 = (RTPIncomingSourceGroup *) 0 ;
+  uint32_t result;
+  intgo _swig_go_result;
+  
+  arg1 = *(RTPIncomingSourceGroup **)&_swig_go_0; 
+  
+  result = (uint32_t) ((arg1)->remoteBitrateEstimation);
+  _swig_go_result = result; 
+  return _swig_go_result;
+}
+
+
 void _wrap_RTPIncomingSourceGroup_AddListener_native_4b7afac4175a7297(RTPIncomingSourceGroup *_swig_go_0, RTPIncomingMediaStreamListener *_swig_go_1) {
   RTPIncomingSourceGroup *arg1 = (RTPIncomingSourceGroup *) 0 ;
   RTPIncomingMediaStreamListener *arg2 = (RTPIncomingMediaStreamListener *) 0 ;
@@ -7342,6 +7505,78 @@ void _wrap_delete_ActiveSpeakerDetectorFacade_native_4b7afac4175a7297(ActiveSpea
 }
 
 
+PCAPDumperFacade *_wrap_new_PCAPDumperFacade_native_4b7afac4175a7297() {
+  PCAPDumperFacade *result = 0 ;
+  PCAPDumperFacade *_swig_go_result;
+  
+  
+  result = (PCAPDumperFacade *)new PCAPDumperFacade();
+  *(PCAPDumperFacade **)&_swig_go_result = (PCAPDumperFacade *)result; 
+  return _swig_go_result;
+}
+
+
+intgo _wrap_PCAPDumperFacade_Rotate_native_4b7afac4175a7297(PCAPDumperFacade *_swig_go_0, _gostring_ _swig_go_1) {
+  PCAPDumperFacade *arg1 = (PCAPDumperFacade *) 0 ;
+  char *arg2 = (char *) 0 ;
+  int result;
+  intgo _swig_go_result;
+  
+  arg1 = *(PCAPDumperFacade **)&_swig_go_0; 
+  
+  arg2 = (char *)malloc(_swig_go_1.n + 1);
+  memcpy(arg2, _swig_go_1.p, _swig_go_1.n);
+  arg2[_swig_go_1.n] = '\0';
+  
+  
+  result = (int)(arg1)->Rotate((char const *)arg2);
+  _swig_go_result = result; 
+  free(arg2); 
+  return _swig_go_result;
+}
+
+
+void _wrap_PCAPDumperFacade_Stop_native_4b7afac4175a7297(PCAPDumperFacade *_swig_go_0) {
+  PCAPDumperFacade *arg1 = (PCAPDumperFacade *) 0 ;
+  
+  arg1 = *(PCAPDumperFacade **)&_swig_go_0; 
+  
+  (arg1)->Stop();
+  
+}
+
+
+intgo _wrap_PCAPDumperFacade_Attach_native_4b7afac4175a7297(PCAPDumperFacade *_swig_go_0, DTLSICETransport *_swig_go_1, bool _swig_go_2, bool _swig_go_3, bool _swig_go_4) {
+  PCAPDumperFacade *arg1 = (PCAPDumperFacade *) 0 ;
+  DTLSICETransport *arg2 = (DTLSICETransport *) 0 ;
+  bool arg3 ;
+  bool arg4 ;
+  bool arg5 ;
+  int result;
+  intgo _swig_go_result;
+  
+  arg1 = *(PCAPDumperFacade **)&_swig_go_0; 
+  arg2 = *(DTLSICETransport **)&_swig_go_1; 
+  arg3 = (bool)_swig_go_2; 
+  arg4 = (bool)_swig_go_3; 
+  arg5 = (bool)_swig_go_4; 
+  
+  result = (int)(arg1)->Attach(arg2,arg3,arg4,arg5);
+  _swig_go_result = result; 
+  return _swig_go_result;
+}
+
+
+void _wrap_delete_PCAPDumperFacade_native_4b7afac4175a7297(PCAPDumperFacade *_swig_go_0) {
+  PCAPDumperFacade *arg1 = (PCAPDumperFacade *) 0 ;
+  
+  arg1 = *(PCAPDumperFacade **)&_swig_go_0; 
+  
+  delete arg1;
+  
+}
+
+
 MediaFrameListener *_wrap__swig_NewDirectorMediaFrameListenerMediaFrameListener_native_4b7afac4175a7297(intgo _swig_go_0) {
   int arg1 ;
   MediaFrameListener *result = 0 ;
@@ -7457,6 +7692,46 @@ void _wrap_MediaFrameMultiplexer_Stop_native_4b7afac4175a7297(MediaFrameMultiple
 }
 
 
+intgo _wrap_MediaFrameMultiplexer_GetPackets_native_4b7afac4175a7297(MediaFrameMultiplexer *_swig_go_0) {
+  MediaFrameMultiplexer *arg1 = (MediaFrameMultiplexer *) 0 ;
+  uint32_t result;
+  intgo _swig_go_result;
+  
+  arg1 = *(MediaFrameMultiplexer **)&_swig_go_0; 
+  
+  result = (uint32_t)((MediaFrameMultiplexer const *)arg1)->GetPackets();
+  _swig_go_result = result; 
+  return _swig_go_result;
+}
+
+
+intgo _wrap_MediaFrameMultiplexer_GetExtensionPackets_native_4b7afac4175a7297(MediaFrameMultiplexer *_swig_go_0, intgo _swig_go_1) {
+  MediaFrameMultiplexer *arg1 = (MediaFrameMultiplexer *) 0 ;
+  int arg2 ;
+  uint32_t result;
+  intgo _swig_go_result;
+  
+  arg1 = *(MediaFrameMultiplexer **)&_swig_go_0; 
+  arg2 = (int)_swig_go_1; 
+  
+  result = (uint32_t)((MediaFrameMultiplexer const *)arg1)->GetExtensionPackets(arg2);
+  _swig_go_result = result; 
+  return _swig_go_result;
+}
+
+
+void _wrap_MediaFrameMultiplexer_SetExtensionSampling_native_4b7afac4175a7297(MediaFrameMultiplexer *_swig_go_0, intgo _swig_go_1) {
+  MediaFrameMultiplexer *arg1 = (MediaFrameMultiplexer *) 0 ;
+  uint32_t arg2 ;
+  
+  arg1 = *(MediaFrameMultiplexer **)&_swig_go_0; 
+  arg2 = (uint32_t)_swig_go_1; 
+  
+  (arg1)->SetExtensionSampling(arg2);
+  
+}
+
+
 void _wrap_delete_MediaFrameMultiplexer_native_4b7afac4175a7297(MediaFrameMultiplexer *_swig_go_0) {
   MediaFrameMultiplexer *arg1 = (MediaFrameMultiplexer *) 0 ;
   
@@ -1,5 +1,7 @@
 package native
 
+//go:generate ./generate.sh
+
 /*
 #cgo CXXFLAGS: -std=c++1z
 #cgo CPPFLAGS: -I/usr/local/include
@@ -122,6 +122,7 @@ typedef long long swig_type_91;
 typedef long long swig_type_92;
 typedef long long swig_type_93;
 typedef long long swig_type_94;
+typedef _gostring_ swig_type_95;
 extern void _wrap_Swig_free_native_4b7afac4175a7297(uintptr_t arg1);
 extern uintptr_t _wrap_Swig_malloc_native_4b7afac4175a7297(swig_intgo arg1);
 extern swig_intgo _wrap_GetWidth_native_4b7afac4175a7297(swig_intgo arg1);
@@ -372,6 +373,8 @@ extern void _wrap_RTPIncomingSourceGroup_maxWaitedTime_set_native_4b7afac4175a72
 extern swig_intgo _wrap_RTPIncomingSourceGroup_maxWaitedTime_get_native_4b7afac4175a7297(uintptr_t arg1);
 extern void _wrap_RTPIncomingSourceGroup_avgWaitedTime_set_native_4b7afac4175a7297(uintptr_t arg1, double arg2);
 extern double _wrap_RTPIncomingSourceGroup_avgWaitedTime_get_native_4b7afac4175a7297(uintptr_t arg1);
+extern void _wrap_RTPIncomingSourceGroup_remoteBitrateEstimation_set_native_4b7afac4175a7297(uintptr_t arg1, swig_intgo arg2);
+extern swig_intgo _wrap_RTPIncomingSourceGroup_remoteBitrateEstimation_get_native_4b7afac4175a7297(uintptr_t arg1);
 extern void _wrap_RTPIncomingSourceGroup_AddListener_native_4b7afac4175a7297(uintptr_t arg1, uintptr_t arg2);
 extern void _wrap_RTPIncomingSourceGroup_RemoveListener_native_4b7afac4175a7297(uintptr_t arg1, uintptr_t arg2);
 extern void _wrap_RTPIncomingSourceGroup_Update_native_4b7afac4175a7297(uintptr_t arg1);
@@ -563,6 +566,11 @@ extern void _wrap_ActiveSpeakerDetectorFacade_SetMinActivationScore_native_4b7af
 extern void _wrap_ActiveSpeakerDetectorFacade_AddIncomingSourceGroup_native_4b7afac4175a7297(uintptr_t arg1, uintptr_t arg2);
 extern void _wrap_ActiveSpeakerDetectorFacade_RemoveIncomingSourceGroup_native_4b7afac4175a7297(uintptr_t arg1, uintptr_t arg2);
 extern void _wrap_delete_ActiveSpeakerDetectorFacade_native_4b7afac4175a7297(uintptr_t arg1);
+extern uintptr_t _wrap_new_PCAPDumperFacade_native_4b7afac4175a7297(void);
+extern swig_intgo _wrap_PCAPDumperFacade_Rotate_native_4b7afac4175a7297(uintptr_t arg1, swig_type_95 arg2);
+extern void _wrap_PCAPDumperFacade_Stop_native_4b7afac4175a7297(uintptr_t arg1);
+extern swig_intgo _wrap_PCAPDumperFacade_Attach_native_4b7afac4175a7297(uintptr_t arg1, uintptr_t arg2, _Bool arg3, _Bool arg4, _Bool arg5);
+extern void _wrap_delete_PCAPDumperFacade_native_4b7afac4175a7297(uintptr_t arg1);
 extern uintptr_t _wrap__swig_NewDirectorMediaFrameListenerMediaFrameListener_native_4b7afac4175a7297(int);
 extern void _wrap_DeleteDirectorMediaFrameListener_native_4b7afac4175a7297(uintptr_t arg1);
 extern void _wrap__swig_DirectorMediaFrameListener_upcall_OnMediaFrame_native_4b7afac4175a7297(uintptr_t, uintptr_t frame);
@@ -573,6 +581,9 @@ extern uintptr_t _wrap_new_MediaFrameMultiplexer_native_4b7afac4175a7297(uintptr
 extern void _wrap_MediaFrameMultiplexer_AddMediaListener_native_4b7afac4175a7297(uintptr_t arg1, uintptr_t arg2);
 extern void _wrap_MediaFrameMultiplexer_RemoveMediaListener_native_4b7afac4175a7297(uintptr_t arg1, uintptr_t arg2);
 extern void _wrap_MediaFrameMultiplexer_Stop_native_4b7afac4175a7297(uintptr_t arg1);
+extern swig_intgo _wrap_MediaFrameMultiplexer_GetPackets_native_4b7afac4175a7297(uintptr_t arg1);
+extern swig_intgo _wrap_MediaFrameMultiplexer_GetExtensionPackets_native_4b7afac4175a7297(uintptr_t arg1, swig_intgo arg2);
+extern void _wrap_MediaFrameMultiplexer_SetExtensionSampling_native_4b7afac4175a7297(uintptr_t arg1, swig_intgo arg2);
 extern void _wrap_delete_MediaFrameMultiplexer_native_4b7afac4175a7297(uintptr_t arg1);
 extern uintptr_t _wrap__swig_NewDirectorPlayerEndListenerPlayerEndListener_native_4b7afac4175a7297(int);
 extern void _wrap_DeleteDirectorPlayerEndListener_native_4b7afac4175a7297(uintptr_t arg1);
@@ -2977,6 +2988,19 @@ func (arg1 SwigcptrRTPIncomingSourceGroup) GetAvgWaitedTime() (_swig_ret float64
 	return swig_r
 }
 
+func (arg1 SwigcptrRTPIncomingSourceGroup) SetRemoteBitrateEstimation(arg2 uint) {
+	_swig_i_0 := arg1
+	_swig_i_1 := arg2
+	C._wrap_RTPIncomingSourceGroup_remoteBitrateEstimation_set_native_4b7afac4175a7297(C.uintptr_t(_swig_i_0), C.swig_intgo(_swig_i_1))
+}
+
+func (arg1 SwigcptrRTPIncomingSourceGroup) GetRemoteBitrateEstimation() (_swig_ret uint) {
+	var swig_r uint
+	_swig_i_0 := arg1
+	swig_r = (uint)(C._wrap_RTPIncomingSourceGroup_remoteBitrateEstimation_get_native_4b7afac4175a7297(C.uintptr_t(_swig_i_0)))
+	return swig_r
+}
+
 func (arg1 SwigcptrRTPIncomingSourceGroup) AddListener(arg2 RTPIncomingMediaStreamListener) {
 	_swig_i_0 := arg1
 	_swig_i_1 := arg2.Swigcptr()
@@ -3031,6 +3055,8 @@ type RTPIncomingSourceGroup interface {
 	GetMaxWaitedTime() (_swig_ret uint)
 	SetAvgWaitedTime(arg2 float64)
 	GetAvgWaitedTime() (_swig_ret float64)
+	SetRemoteBitrateEstimation(arg2 uint)
+	GetRemoteBitrateEstimation() (_swig_ret uint)
 	AddListener(arg2 RTPIncomingMediaStreamListener)
 	RemoveListener(arg2 RTPIncomingMediaStreamListener)
 	Update()
@@ -5053,6 +5079,61 @@ type ActiveSpeakerDetectorFacade interface {
 	RemoveIncomingSourceGroup(arg2 RTPIncomingMediaStream)
 }
 
+type SwigcptrPCAPDumperFacade uintptr
+
+func (p SwigcptrPCAPDumperFacade) Swigcptr() uintptr {
+	return (uintptr)(p)
+}
+
+func (p SwigcptrPCAPDumperFacade) SwigIsPCAPDumperFacade() {
+}
+
+func NewPCAPDumperFacade() (_swig_ret PCAPDumperFacade) {
+	var swig_r PCAPDumperFacade
+	swig_r = (PCAPDumperFacade)(SwigcptrPCAPDumperFacade(C._wrap_new_PCAPDumperFacade_native_4b7afac4175a7297()))
+	return swig_r
+}
+
+func (arg1 SwigcptrPCAPDumperFacade) Rotate(arg2 string) (_swig_ret int) {
+	var swig_r int
+	_swig_i_0 := arg1
+	_swig_i_1 := arg2
+	swig_r = (int)(C._wrap_PCAPDumperFacade_Rotate_native_4b7afac4175a7297(C.uintptr_t(_swig_i_0), *(*C.swig_type_95)(unsafe.Pointer(&_swig_i_1))))
+	if Swig_escape_always_false {
+		Swig_escape_val = arg2
+	}
+	return swig_r
+}
+
+func (arg1 SwigcptrPCAPDumperFacade) Stop() {
+	_swig_i_0 := arg1
+	C._wrap_PCAPDumperFacade_Stop_native_4b7afac4175a7297(C.uintptr_t(_swig_i_0))
+}
+
+func (arg1 SwigcptrPCAPDumperFacade) Attach(arg2 DTLSICETransport, arg3 bool, arg4 bool, arg5 bool) (_swig_ret int) {
+	var swig_r int
+	_swig_i_0 := arg1
+	_swig_i_1 := arg2.Swigcptr()
+	_swig_i_2 := arg3
+	_swig_i_3 := arg4
+	_swig_i_4 := arg5
+	swig_r = (int)(C._wrap_PCAPDumperFacade_Attach_native_4b7afac4175a7297(C.uintptr_t(_swig_i_0), C.uintptr_t(_swig_i_1), C._Bool(_swig_i_2), C._Bool(_swig_i_3), C._Bool(_swig_i_4)))
+	return swig_r
+}
+
+func DeletePCAPDumperFacade(arg1 PCAPDumperFacade) {
+	_swig_i_0 := arg1.Swigcptr()
+	C._wrap_delete_PCAPDumperFacade_native_4b7afac4175a7297(C.uintptr_t(_swig_i_0))
+}
+
+type PCAPDumperFacade interface {
+	Swigcptr() uintptr
+	SwigIsPCAPDumperFacade()
+	Rotate(arg2 string) (_swig_ret int)
+	Stop()
+	Attach(arg2 DTLSICETransport, arg3 bool, arg4 bool, arg5 bool) (_swig_ret int)
+}
+
 type _swig_DirectorMediaFrameListener struct {
 	SwigcptrMediaFrameListener
 	v interface{}
@@ -5180,6 +5261,27 @@ func (arg1 SwigcptrMediaFrameMultiplexer) Stop() {
 	C._wrap_MediaFrameMultiplexer_Stop_native_4b7afac4175a7297(C.uintptr_t(_swig_i_0))
 }
 
+func (arg1 SwigcptrMediaFrameMultiplexer) GetPackets() (_swig_ret uint) {
+	var swig_r uint
+	_swig_i_0 := arg1
+	swig_r = (uint)(C._wrap_MediaFrameMultiplexer_GetPackets_native_4b7afac4175a7297(C.uintptr_t(_swig_i_0)))
+	return swig_r
+}
+
+func (arg1 SwigcptrMediaFrameMultiplexer) GetExtensionPackets(arg2 int) (_swig_ret uint) {
+	var swig_r uint
+	_swig_i_0 := arg1
+	_swig_i_1 := arg2
+	swig_r = (uint)(C._wrap_MediaFrameMultiplexer_GetExtensionPackets_native_4b7afac4175a7297(C.uintptr_t(_swig_i_0), C.swig_intgo(_swig_i_1)))
+	return swig_r
+}
+
+func (arg1 SwigcptrMediaFrameMultiplexer) SetExtensionSampling(arg2 uint) {
+	_swig_i_0 := arg1
+	_swig_i_1 := arg2
+	C._wrap_MediaFrameMultiplexer_SetExtensionSampling_native_4b7afac4175a7297(C.uintptr_t(_swig_i_0), C.swig_intgo(_swig_i_1))
+}
+
 func DeleteMediaFrameMultiplexer(arg1 MediaFrameMultiplexer) {
 	_swig_i_0 := arg1.Swigcptr()
 	C._wrap_delete_MediaFrameMultiplexer_native_4b7afac4175a7297(C.uintptr_t(_swig_i_0))
@@ -5191,6 +5293,9 @@ type MediaFrameMultiplexer interface {
 	AddMediaListener(arg2 MediaFrameListener)
 	RemoveMediaListener(arg2 MediaFrameListener)
 	Stop()
+	GetPackets() (_swig_ret uint)
+	GetExtensionPackets(arg2 int) (_swig_ret uint)
+	SetExtensionSampling(arg2 uint)
 }
 
 type _swig_DirectorPlayerEndListener struct {
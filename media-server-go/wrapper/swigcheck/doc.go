@@ -0,0 +1,6 @@
+// Package swigcheck tests that the SWIG output in the wrapper package is
+// consistent with itself, for where SWIG is not installed to run
+// generate.sh --check. It is no substitute for regenerating, but it catches
+// the glue of a hand edit going out of step between native.go and
+// mediaserver_wrap.cxx.
+package swigcheck
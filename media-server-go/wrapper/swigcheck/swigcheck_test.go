@@ -0,0 +1,121 @@
+package swigcheck
+
+import (
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var (
+	externRe  = regexp.MustCompile(`(?m)^extern .*?\b(_wrap_\w+)\((.*)\);$`)
+	defRe     = regexp.MustCompile(`(?m)^[^\s#/].*?\b(_wrap_\w+)\((.*)\) \{$`)
+	callRe    = regexp.MustCompile(`\bC\.(_wrap_\w+)\(`)
+	typedefRe = regexp.MustCompile(`(?m)^typedef .* swig_type_(\d+);$`)
+	typeRe    = regexp.MustCompile(`\bswig_type_(\d+)\b`)
+)
+
+// wrapper is a function of the glue, with the number of its parameters
+type wrapper struct {
+	name   string
+	params int
+}
+
+func wrappers(t *testing.T, re *regexp.Regexp, data string) []wrapper {
+	var ws []wrapper
+	for _, m := range re.FindAllStringSubmatch(data, -1) {
+		params := 0
+		if m[2] != "" && m[2] != "void" {
+			params = strings.Count(m[2], ",") + 1
+		}
+		ws = append(ws, wrapper{m[1], params})
+	}
+	if len(ws) == 0 {
+		t.Fatalf("no wrappers found by %s", re)
+	}
+	return ws
+}
+
+func read(t *testing.T, name string) string {
+	data, err := ioutil.ReadFile("../" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// TestWrappers checks that native.go declares the functions
+// mediaserver_wrap.cxx defines, in the same order and with as many
+// parameters, and calls none it does not declare
+func TestWrappers(t *testing.T) {
+	native := read(t, "native.go")
+	externs := wrappers(t, externRe, native)
+	defs := wrappers(t, defRe, read(t, "mediaserver_wrap.cxx"))
+
+	for i := 0; i < len(externs) || i < len(defs); i++ {
+		switch {
+		case i >= len(defs):
+			t.Fatalf("%s is declared but not defined", externs[i].name)
+		case i >= len(externs):
+			t.Fatalf("%s is defined but not declared", defs[i].name)
+		case externs[i] != defs[i]:
+			t.Fatalf("declaration %d is %+v, definition is %+v", i, externs[i], defs[i])
+		}
+	}
+
+	declared := map[string]bool{}
+	for _, w := range externs {
+		declared[w.name] = true
+	}
+	for _, m := range callRe.FindAllStringSubmatch(native, -1) {
+		if !declared[m[1]] {
+			t.Errorf("%s is called but not declared", m[1])
+		}
+	}
+}
+
+// TestTypes checks the swig_type_N typedefs of native.go are numbered the
+// way SWIG numbers them, from 1 in the order the declarations first use
+// them, and that a call passes only the types its function declares
+func TestTypes(t *testing.T) {
+	native := read(t, "native.go")
+	typedefs := typedefRe.FindAllStringSubmatch(native, -1)
+	for i, m := range typedefs {
+		if m[1] != strconv.Itoa(i+1) {
+			t.Fatalf("typedef %d is swig_type_%s", i+1, m[1])
+		}
+	}
+
+	used := map[string]bool{}
+	next := 1
+	params := map[string]string{}
+	for _, m := range externRe.FindAllStringSubmatch(native, -1) {
+		params[m[1]] = m[0]
+		for _, n := range typeRe.FindAllStringSubmatch(m[0], -1) {
+			if used[n[1]] {
+				continue
+			}
+			if n[1] != strconv.Itoa(next) {
+				t.Fatalf("%s is the first to use swig_type_%s, want swig_type_%d", m[1], n[1], next)
+			}
+			used[n[1]] = true
+			next++
+		}
+	}
+	if next != len(typedefs)+1 {
+		t.Fatalf("declarations use %d of %d typedefs", next-1, len(typedefs))
+	}
+
+	for _, line := range strings.Split(native, "\n") {
+		call := callRe.FindStringSubmatch(line)
+		if call == nil || strings.HasPrefix(line, "extern ") {
+			continue
+		}
+		for _, n := range typeRe.FindAllString(line, -1) {
+			if !regexp.MustCompile(`\b` + n + `\b`).MatchString(params[call[1]]) {
+				t.Errorf("%s is called with %s it does not declare", call[1], n)
+			}
+		}
+	}
+}